@@ -44,6 +44,32 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, flags BehaviorFlags)
 		return false, err
 	}
 
+	// The utreexo data of the block must verify against the accumulator of
+	// a verifying relay after the previous block.  The accumulator after
+	// the block is stored along with the block.
+	var relayView *UtreexoViewpoint
+	if b.relayView != nil {
+		relayView, err = b.acceptRelayUData(block, prevNode)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// The utreexo proof of a block that extends the utreexo viewpoint must
+	// verify against it before the block is stored.  A block stored with a
+	// proof that doesn't verify would fail to connect and couldn't be
+	// accepted again with a valid proof from another peer.  The proof is
+	// ingested here so that it isn't verified again when the block is
+	// connected.
+	if b.utreexoView != nil && b.utreexoView.proofInterval == 1 &&
+		block.MsgBlock().UData != nil && prevNode == b.bestChain.Tip() {
+
+		err = b.ingestUtreexoViewUData(block)
+		if err != nil {
+			return false, err
+		}
+	}
+
 	// Insert the block into the database if it's not already there.  Even
 	// though it is possible the block will ultimately fail to connect, it
 	// has already passed all proof-of-work and validity tests which means
@@ -54,7 +80,15 @@ func (b *BlockChain) maybeAcceptBlock(block *btcutil.Block, flags BehaviorFlags)
 	// such as making blocks that never become part of the main chain or
 	// blocks that fail to connect available for further analysis.
 	err = b.db.Update(func(dbTx database.Tx) error {
-		return dbStoreBlock(dbTx, block)
+		err := dbStoreBlock(dbTx, block)
+		if err != nil {
+			return err
+		}
+
+		if relayView != nil {
+			return dbPutUtreexoView(dbTx, relayView, block.Hash())
+		}
+		return nil
 	})
 	if err != nil {
 		return false, err
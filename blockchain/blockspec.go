@@ -0,0 +1,404 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// ScriptType is the type of public key script that the outputs of generated
+// blocks pay to.  All of them are spendable without any keys.
+type ScriptType uint8
+
+const (
+	// ScriptOpTrue pays to a bare OP_TRUE.  It can't be reconstructed from
+	// the spending input so it's serialized whole in the leaf data.
+	ScriptOpTrue ScriptType = iota
+
+	// ScriptP2SHOpTrue pays to the script hash of OP_TRUE.
+	ScriptP2SHOpTrue
+
+	// ScriptP2WSHOpTrue pays to the version 0 witness script hash of
+	// OP_TRUE.  It's spent with a witness once segwit is active and as an
+	// anyone-can-spend output before that.
+	ScriptP2WSHOpTrue
+
+	// ScriptP2TROpTrue pays to a version 1 witness program of the hash of
+	// OP_TRUE.  Taproot isn't active on the chains the blocks are
+	// generated for so it's spent as an anyone-can-spend output, with a
+	// witness once segwit is active.
+	ScriptP2TROpTrue
+
+	// ScriptBareMultisig pays to a bare 0-of-3 multisig script.  It's
+	// spent with only the dummy element that OP_CHECKMULTISIG pops and
+	// since it can't be reconstructed from the spending input, its large
+	// script is serialized whole in the leaf data.
+	ScriptBareMultisig
+)
+
+// multisigPubKeys are the public keys of the ScriptBareMultisig script.  They
+// only need to look like compressed keys since no signature is checked
+// against them.
+var multisigPubKeys = func() [][]byte {
+	pubKeys := make([][]byte, 3)
+	for i := range pubKeys {
+		hash := sha256.Sum256([]byte{byte(i)})
+		pubKeys[i] = append([]byte{0x02}, hash[:]...)
+	}
+	return pubKeys
+}()
+
+// pkScript returns the public key script of the script type.
+func (st ScriptType) pkScript() ([]byte, error) {
+	switch st {
+	case ScriptOpTrue:
+		return opTrueScript, nil
+
+	case ScriptP2SHOpTrue:
+		return txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).
+			AddData(btcutil.Hash160(opTrueScript)).
+			AddOp(txscript.OP_EQUAL).Script()
+
+	case ScriptP2WSHOpTrue:
+		scriptHash := sha256.Sum256(opTrueScript)
+		return txscript.NewScriptBuilder().AddOp(txscript.OP_0).
+			AddData(scriptHash[:]).Script()
+
+	case ScriptP2TROpTrue:
+		scriptHash := sha256.Sum256(opTrueScript)
+		return txscript.NewScriptBuilder().AddOp(txscript.OP_1).
+			AddData(scriptHash[:]).Script()
+
+	case ScriptBareMultisig:
+		builder := txscript.NewScriptBuilder().AddOp(txscript.OP_0)
+		for _, pubKey := range multisigPubKeys {
+			builder.AddData(pubKey)
+		}
+		return builder.AddInt64(int64(len(multisigPubKeys))).
+			AddOp(txscript.OP_CHECKMULTISIG).Script()
+	}
+
+	return nil, fmt.Errorf("unknown script type %d", st)
+}
+
+// spendScripts returns the signature script and the witness that spend an
+// output of the script type.
+func (st ScriptType) spendScripts(segwit bool) ([]byte, wire.TxWitness, error) {
+	switch st {
+	case ScriptOpTrue:
+		return nil, nil, nil
+
+	case ScriptP2SHOpTrue:
+		sigScript, err := txscript.NewScriptBuilder().
+			AddData(opTrueScript).Script()
+		return sigScript, nil, err
+
+	case ScriptP2WSHOpTrue:
+		if !segwit {
+			return nil, nil, nil
+		}
+		return nil, wire.TxWitness{opTrueScript}, nil
+
+	case ScriptP2TROpTrue:
+		if !segwit {
+			return nil, nil, nil
+		}
+		return nil, wire.TxWitness{opTrueScript}, nil
+
+	case ScriptBareMultisig:
+		sigScript, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_0).Script()
+		return sigScript, nil, err
+	}
+
+	return nil, nil, fmt.Errorf("unknown script type %d", st)
+}
+
+// BlockSpec declares the shape of a block to generate with
+// GenerateBlockFromSpec.  It's meant for reproducing the shapes of blocks that
+// utreexo proof failures were reported at.
+type BlockSpec struct {
+	// NumTxs is the number of transactions besides the coinbase.
+	NumTxs int
+
+	// InputsPerTx is the number of inputs of every transaction.
+	InputsPerTx int
+
+	// OutputsPerTx is the number of outputs of every transaction.  0
+	// means 1.
+	OutputsPerTx int
+
+	// SpendSameBlock makes every transaction after the first one spend
+	// the first output of the transaction before it so that the outputs
+	// are created and spent in the same block.
+	SpendSameBlock bool
+
+	// ScriptTypes are the script types that the outputs are picked from.
+	// ScriptOpTrue is used if it's empty.
+	ScriptTypes []ScriptType
+
+	// OversizedScripts is the number of outputs of the coinbase that pay
+	// to scripts over the maximum script size.  They're unspendable so
+	// they never become leaves.
+	OversizedScripts int
+
+	// CraftedScripts are public key scripts that the coinbase pays
+	// nothing to with an output each.  They're for scripts that none of
+	// the script types are of, like ones that only some script
+	// interpreters would reject, so the outputs are never spent.
+	CraftedScripts [][]byte
+
+	// DuplicateLeafPattern makes every output of a transaction be paid
+	// twice with the same amount to the same script so that their leaves
+	// only differ by the output index.
+	DuplicateLeafPattern bool
+}
+
+// GenerateBlockFromSpec returns a block succeeding parent that's of the shape
+// declared by the spec.  The inputs are picked from the spendable outputs, and
+// the picks, the script types, and the nonce only depend on the seed, so the
+// same spendable outputs, spec, and seed always make the same block.  The
+// block isn't processed by the chain.
+//
+// The spendable outputs the block doesn't spend are returned after the ones it
+// creates.  They may be of any of the spec's script types so they should be
+// spent with GenerateBlockFromSpec as well.  An error is returned if the spec
+// can't be satisfied with the spendable outputs.
+func GenerateBlockFromSpec(chain *BlockChain, parent *btcutil.Block,
+	spendables []*SpendableOut, spec BlockSpec, seed int64) (
+	*btcutil.Block, []*SpendableOut, error) {
+
+	if spec.NumTxs < 0 || spec.OutputsPerTx < 0 || spec.OversizedScripts < 0 {
+		return nil, nil, fmt.Errorf("block spec counts must not be negative")
+	}
+	if spec.NumTxs > 0 && spec.InputsPerTx < 1 {
+		return nil, nil, fmt.Errorf("block spec transactions need at " +
+			"least one input")
+	}
+	needed := spec.NumTxs * spec.InputsPerTx
+	if spec.SpendSameBlock && spec.NumTxs > 1 {
+		needed -= spec.NumTxs - 1
+	}
+	if needed > len(spendables) {
+		return nil, nil, fmt.Errorf("block spec needs %d spendable "+
+			"outputs but only %d are available", needed, len(spendables))
+	}
+	outputsPerTx := spec.OutputsPerTx
+	if outputsPerTx == 0 {
+		outputsPerTx = 1
+	}
+	if spec.DuplicateLeafPattern {
+		outputsPerTx *= 2
+	}
+	scriptTypes := spec.ScriptTypes
+	if len(scriptTypes) == 0 {
+		scriptTypes = []ScriptType{ScriptOpTrue}
+	}
+
+	chain.chainLock.Lock()
+	parentNode := chain.index.LookupNode(parent.Hash())
+	var segwitState ThresholdState
+	var err error
+	if parentNode != nil {
+		segwitState, err = chain.deploymentState(parentNode,
+			chaincfg.DeploymentSegwit)
+	}
+	chain.chainLock.Unlock()
+	if parentNode == nil {
+		return nil, nil, fmt.Errorf("parent block %v is unknown",
+			parent.Hash())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	segwit := segwitState == ThresholdActive
+	height := parentNode.height + 1
+
+	rng := rand.New(rand.NewSource(seed))
+	pool := make([]*SpendableOut, len(spendables))
+	copy(pool, spendables)
+	rng.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+
+	coinbaseScript, err := txscript.NewScriptBuilder().
+		AddInt64(int64(height)).AddInt64(0).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+			wire.MaxPrevOutIndex),
+		Sequence:        wire.MaxTxInSequenceNum,
+		SignatureScript: coinbaseScript,
+	})
+	coinbase.AddTxOut(wire.NewTxOut(CalcBlockSubsidy(height, chain.chainParams),
+		opTrueScript))
+	oversized := make([]byte, txscript.MaxScriptSize+1)
+	for i := range oversized {
+		oversized[i] = txscript.OP_TRUE
+	}
+	for i := 0; i < spec.OversizedScripts; i++ {
+		coinbase.AddTxOut(wire.NewTxOut(0, oversized))
+	}
+	for _, pkScript := range spec.CraftedScripts {
+		coinbase.AddTxOut(wire.NewTxOut(0, pkScript))
+	}
+	txns := []*wire.MsgTx{coinbase}
+
+	var outs []*SpendableOut
+
+	var hasWitness bool
+	var prevOut *SpendableOut
+	for i := 0; i < spec.NumTxs; i++ {
+		inputs := make([]*SpendableOut, 0, spec.InputsPerTx)
+		if spec.SpendSameBlock && prevOut != nil {
+			inputs = append(inputs, prevOut)
+		}
+		for len(inputs) < spec.InputsPerTx {
+			inputs = append(inputs, pool[0])
+			pool = pool[1:]
+		}
+
+		tx := wire.NewMsgTx(1)
+		var total btcutil.Amount
+		for _, input := range inputs {
+			sigScript, witness, err := input.ScriptType.spendScripts(segwit)
+			if err != nil {
+				return nil, nil, err
+			}
+			tx.AddTxIn(&wire.TxIn{
+				PreviousOutPoint: input.PrevOut,
+				SignatureScript:  sigScript,
+				Witness:          witness,
+				Sequence:         wire.MaxTxInSequenceNum,
+			})
+			hasWitness = hasWitness || len(witness) > 0
+			total += input.Amount
+		}
+
+		value := total - lowFee
+		if value < btcutil.Amount(outputsPerTx) {
+			return nil, nil, fmt.Errorf("the inputs of transaction %d "+
+				"are worth %v which isn't enough for %d outputs",
+				i, total, outputsPerTx)
+		}
+
+		// What doesn't split evenly between the outputs goes to the
+		// fee along with the usual one.
+		share := value / btcutil.Amount(outputsPerTx)
+		fee := total - share*btcutil.Amount(outputsPerTx)
+		coinbase.TxOut[0].Value += int64(fee)
+
+		types := make([]ScriptType, 0, outputsPerTx)
+		for len(types) < outputsPerTx {
+			st := scriptTypes[rng.Intn(len(scriptTypes))]
+			types = append(types, st)
+			if spec.DuplicateLeafPattern {
+				types = append(types, st)
+			}
+		}
+		for _, st := range types {
+			pkScript, err := st.pkScript()
+			if err != nil {
+				return nil, nil, err
+			}
+			tx.AddTxOut(wire.NewTxOut(int64(share), pkScript))
+		}
+		txns = append(txns, tx)
+
+		// The first output is spent by the next transaction when
+		// spending in the same block.
+		txOuts := make([]*SpendableOut, 0, len(tx.TxOut))
+		for j, txOut := range tx.TxOut {
+			txOuts = append(txOuts, &SpendableOut{
+				PrevOut:    wire.OutPoint{Hash: tx.TxHash(), Index: uint32(j)},
+				Amount:     btcutil.Amount(txOut.Value),
+				ScriptType: types[j],
+			})
+		}
+		if spec.SpendSameBlock && i < spec.NumTxs-1 {
+			prevOut = txOuts[0]
+			txOuts = txOuts[1:]
+		}
+		outs = append(outs, txOuts...)
+	}
+	if hasWitness {
+		addWitnessCommitment(coinbase, txns)
+	}
+
+	// The coinbase is only complete once the fees and the witness
+	// commitment were added to it.
+	outs = append([]*SpendableOut{{
+		PrevOut: wire.OutPoint{Hash: coinbase.TxHash()},
+		Amount:  btcutil.Amount(coinbase.TxOut[0].Value),
+	}}, outs...)
+
+	utilTxns := make([]*btcutil.Tx, 0, len(txns))
+	for _, tx := range txns {
+		utilTxns = append(utilTxns, btcutil.NewTx(tx))
+	}
+	merkles := BuildMerkleTreeStore(utilTxns, false)
+	block := btcutil.NewBlock(&wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:    1,
+			PrevBlock:  *parent.Hash(),
+			MerkleRoot: *merkles[len(merkles)-1],
+			Bits:       chain.chainParams.PowLimitBits,
+			Timestamp:  parentNode.Header().Timestamp.Add(time.Second),
+		},
+		Transactions: txns,
+	})
+	block.SetHeight(height)
+
+	// Solve the block from nonce 0 up so that the nonce is deterministic
+	// as well, unlike with SolveBlock.
+	header := &block.MsgBlock().Header
+	target := CompactToBig(header.Bits)
+	for {
+		hash := header.BlockHash()
+		if HashToBig(&hash).Cmp(target) <= 0 {
+			break
+		}
+		if header.Nonce == math.MaxUint32 {
+			return nil, nil, fmt.Errorf("unable to solve block at "+
+				"height %d", height)
+		}
+		header.Nonce++
+	}
+
+	return block, append(outs, pool...), nil
+}
+
+// addWitnessCommitment adds the witness commitment of the transactions to the
+// coinbase, which must be the first of them.
+func addWitnessCommitment(coinbase *wire.MsgTx, txns []*wire.MsgTx) {
+	var witnessNonce [CoinbaseWitnessDataLen]byte
+	coinbase.TxIn[0].Witness = wire.TxWitness{witnessNonce[:]}
+
+	utilTxns := make([]*btcutil.Tx, 0, len(txns))
+	for _, tx := range txns {
+		utilTxns = append(utilTxns, btcutil.NewTx(tx))
+	}
+	merkles := BuildMerkleTreeStore(utilTxns, true)
+	witnessRoot := merkles[len(merkles)-1]
+
+	var preimage [chainhash.HashSize * 2]byte
+	copy(preimage[:], witnessRoot[:])
+	copy(preimage[chainhash.HashSize:], witnessNonce[:])
+	commitment := chainhash.DoubleHashB(preimage[:])
+
+	pkScript := append(append([]byte{}, WitnessMagicBytes...), commitment...)
+	coinbase.AddTxOut(wire.NewTxOut(0, pkScript))
+}
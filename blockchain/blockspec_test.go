@@ -0,0 +1,129 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// TestGenerateBlockFromSpec ensures that the generated blocks are of the shape
+// of their spec, that they only depend on the seed, and that their outputs of
+// every script type are spendable.
+func TestGenerateBlockFromSpec(t *testing.T) {
+	chain, params, tearDown := utxoCacheTestChain("TestGenerateBlockFromSpec")
+	defer tearDown()
+
+	tip, spendables := AddBlock(chain, btcutil.NewBlock(params.GenesisBlock), nil)
+
+	// process generates the block of the spec on the tip and connects it.
+	process := func(spec BlockSpec, seed int64) *btcutil.Block {
+		t.Helper()
+
+		block, outs, err := GenerateBlockFromSpec(chain, tip, spendables,
+			spec, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isMainChain, _, err := chain.ProcessBlock(block, BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isMainChain {
+			t.Fatalf("block %v isn't in the main chain", block.Hash())
+		}
+		tip, spendables = block, outs
+
+		return block
+	}
+
+	allTypes := []ScriptType{ScriptOpTrue, ScriptP2SHOpTrue, ScriptP2WSHOpTrue,
+		ScriptP2TROpTrue, ScriptBareMultisig}
+	fanOut := process(BlockSpec{
+		NumTxs:       1,
+		InputsPerTx:  1,
+		OutputsPerTx: 30,
+		ScriptTypes:  allTypes,
+	}, 1)
+	if got := len(fanOut.Transactions()[1].MsgTx().TxOut); got != 30 {
+		t.Fatalf("expected 30 outputs, got %d", got)
+	}
+
+	// The same seed makes the same block and another seed doesn't.
+	spec := BlockSpec{
+		NumTxs:               5,
+		InputsPerTx:          3,
+		SpendSameBlock:       true,
+		ScriptTypes:          allTypes,
+		OversizedScripts:     2,
+		DuplicateLeafPattern: true,
+	}
+	a, _, err := GenerateBlockFromSpec(chain, tip, spendables, spec, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := GenerateBlockFromSpec(chain, tip, spendables, spec, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := GenerateBlockFromSpec(chain, tip, spendables, spec, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *a.Hash() != *b.Hash() {
+		t.Fatal("expected the same seed to make the same block")
+	}
+	if *a.Hash() == *c.Hash() {
+		t.Fatal("expected another seed to make another block")
+	}
+
+	block := process(spec, 7)
+	txns := block.Transactions()
+	if len(txns) != spec.NumTxs+1 {
+		t.Fatalf("expected %d transactions, got %d", spec.NumTxs+1, len(txns))
+	}
+	var oversized int
+	for _, txOut := range txns[0].MsgTx().TxOut {
+		if len(txOut.PkScript) > txscript.MaxScriptSize {
+			oversized++
+		}
+	}
+	if oversized != spec.OversizedScripts {
+		t.Fatalf("expected %d oversized scripts, got %d",
+			spec.OversizedScripts, oversized)
+	}
+	for i, tx := range txns[1:] {
+		msgTx := tx.MsgTx()
+		if len(msgTx.TxIn) != spec.InputsPerTx || len(msgTx.TxOut) != 2 {
+			t.Fatalf("tx %d: expected %d inputs and 2 outputs, got %d "+
+				"and %d", i, spec.InputsPerTx, len(msgTx.TxIn),
+				len(msgTx.TxOut))
+		}
+		if msgTx.TxOut[0].Value != msgTx.TxOut[1].Value {
+			t.Fatalf("tx %d: expected the duplicated outputs to pay "+
+				"the same amount", i)
+		}
+		if i > 0 && msgTx.TxIn[0].PreviousOutPoint.Hash != *txns[i].Hash() {
+			t.Fatalf("tx %d: expected it to spend the tx before it", i)
+		}
+	}
+
+	// The outputs of every script type are spendable.
+	process(BlockSpec{
+		NumTxs:      1,
+		InputsPerTx: len(spendables),
+	}, 9)
+
+	// Specs that need more spendable outputs than there are fail.
+	_, _, err = GenerateBlockFromSpec(chain, tip, spendables, BlockSpec{
+		NumTxs:      1,
+		InputsPerTx: len(spendables) + 1,
+	}, 10)
+	if err == nil {
+		t.Fatal("expected an error for an unsatisfiable spec")
+	}
+}
@@ -46,6 +46,7 @@ type BlockLocator []*chainhash.Hash
 // forever.
 type orphanBlock struct {
 	block      *btcutil.Block
+	flags      BehaviorFlags
 	expiration time.Time
 }
 
@@ -152,6 +153,11 @@ type BlockChain struct {
 	// to help prevent logic races when blocks are being processed.
 	utxoCache *utxoCache
 
+	// flushDeferredSince is the height of the first periodic flush of the
+	// UTXO state that was postponed to align it with the indexes.  It's -1
+	// if no flush is postponed.  It is protected by the chain lock.
+	flushDeferredSince int32
+
 	// The UTXO state represeted as a utreexo accumulator. A node can choose to
 	// use the utreexoView instead of utxoCache.
 	//
@@ -159,6 +165,21 @@ type BlockChain struct {
 	// from peers.
 	utreexoView *UtreexoViewpoint
 
+	// leafHasher hashes the leaves of the created and the spent outputs of
+	// the blocks.
+	leafHasher *wire.LeafHasher
+
+	// retainUData is whether the utreexo data of the blocks is kept after
+	// they're connected to the utreexo accumulator.
+	retainUData bool
+
+	// relayView is the utreexo accumulator of a verifying relay at the end
+	// of the main chain.  The utreexo data of incoming blocks is verified
+	// against the accumulator after their parent without a utreexo proof
+	// index, and the accumulator after every accepted block is stored.  It
+	// is protected by the chain lock.
+	relayView *UtreexoViewpoint
+
 	// These fields are related to handling of orphan blocks.  They are
 	// protected by a combination of the chain lock and the orphan lock.
 	orphanLock   sync.RWMutex
@@ -314,8 +335,9 @@ func (b *BlockChain) removeOrphanBlock(orphan *orphanBlock) {
 // up any expired blocks so a separate cleanup poller doesn't need to be run.
 // It also imposes a maximum limit on the number of outstanding orphan
 // blocks and will remove the oldest received orphan block if the limit is
-// exceeded.
-func (b *BlockChain) addOrphanBlock(block *btcutil.Block) {
+// exceeded.  The flags the block was processed with are kept so that it's
+// accepted with them once its parent is.
+func (b *BlockChain) addOrphanBlock(block *btcutil.Block, flags BehaviorFlags) {
 	// Remove expired orphan blocks.
 	for _, oBlock := range b.orphans {
 		if time.Now().After(oBlock.expiration) {
@@ -348,6 +370,7 @@ func (b *BlockChain) addOrphanBlock(block *btcutil.Block) {
 	expiration := time.Now().Add(time.Hour)
 	oBlock := &orphanBlock{
 		block:      block,
+		flags:      flags,
 		expiration: expiration,
 	}
 	b.orphans[*block.Hash()] = oBlock
@@ -629,6 +652,16 @@ func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block,
 	state := newBestState(node, blockSize, blockWeight, numTxns,
 		curTotalTxns+numTxns, node.CalcPastMedianTime())
 
+	// The accumulator of a verifying relay after the block was stored when
+	// the block was accepted.
+	var relayView *UtreexoViewpoint
+	if b.relayView != nil {
+		relayView, err = b.fetchRelayView(&node.hash)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Atomically insert info into the database.
 	err = b.db.Update(func(dbTx database.Tx) error {
 		// Update best block state.
@@ -674,6 +707,20 @@ func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block,
 	if err != nil {
 		return err
 	}
+	if relayView != nil {
+		b.relayView = relayView
+	}
+
+	// Write the index entries that were deferred until the block was
+	// committed.  The block is already connected, so a failure is only
+	// logged and the entries are written along with the next block.
+	if writer, ok := b.indexManager.(IndexFollowUpWriter); ok {
+		err := writer.WriteFollowUps()
+		if err != nil {
+			log.Errorf("Unable to write the deferred index entries of "+
+				"block %s: %v", block.Hash(), err)
+		}
+	}
 
 	// Don't commit to the utxo set if we're a utreexo node.
 	if b.utreexoView == nil {
@@ -698,6 +745,13 @@ func (b *BlockChain) connectBlock(node *blockNode, block *btcutil.Block,
 	b.stateSnapshot = state
 	b.stateLock.Unlock()
 
+	// The utreexo data was verified and applied to the accumulator so
+	// it's no longer needed.  Release it before the block is handed to the
+	// notification consumers, which may hold on to the block for longer.
+	if b.utreexoView != nil && !b.retainUData {
+		block.ReleaseUData()
+	}
+
 	// Notify the caller that the block was connected to the main chain.
 	// The caller would typically want to react with actions such as
 	// updating wallets.
@@ -761,6 +815,17 @@ func (b *BlockChain) disconnectBlock(node *blockNode, block *btcutil.Block, view
 	state := newBestState(prevNode, blockSize, blockWeight, numTxns,
 		newTotalTxns, prevNode.CalcPastMedianTime())
 
+	// The accumulator of a verifying relay goes back to the one stored after
+	// the previous block.  The one after the block stays stored in case the
+	// block is connected again.
+	var relayView *UtreexoViewpoint
+	if b.relayView != nil {
+		relayView, err = b.fetchRelayView(&prevNode.hash)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = b.db.Update(func(dbTx database.Tx) error {
 		// Update best block state.
 		err := dbPutBestState(dbTx, state, node.workSum)
@@ -804,6 +869,10 @@ func (b *BlockChain) disconnectBlock(node *blockNode, block *btcutil.Block, view
 	b.utxoCache.Commit(view)
 	b.stateLock.Unlock()
 
+	if relayView != nil {
+		b.relayView = relayView
+	}
+
 	// This node's parent is now the end of the best chain.
 	b.bestChain.SetTip(node.parent)
 
@@ -957,6 +1026,9 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 				}
 				return nil
 			})
+			if uView != nil {
+				uView.proofWorkers = b.utreexoView.proofWorkers
+			}
 			b.utreexoView = uView
 		}
 
@@ -1022,10 +1094,11 @@ func (b *BlockChain) reorganizeChain(detachNodes, attachNodes *list.List) error
 		//
 		// In the case the block is determined to be invalid due to a
 		// rule violation, mark it as invalid and mark all of its
-		// descendants as having an invalid ancestor.
+		// descendants as having an invalid ancestor.  Invalid utreexo
+		// data is the fault of whoever sent it, not of the block.
 		err = b.checkConnectBlock(n, block, view, nil)
 		if err != nil {
-			if _, ok := err.(RuleError); ok {
+			if _, ok := err.(RuleError); ok && !isUDataError(err) {
 				b.index.SetStatusFlags(n, statusValidateFailed)
 				for de := e.Next(); de != nil; de = de.Next() {
 					dn := de.Value.(*blockNode)
@@ -1161,7 +1234,12 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block, fla
 			if err == nil {
 				b.index.SetStatusFlags(node, statusValid)
 			} else if _, ok := err.(RuleError); ok {
-				b.index.SetStatusFlags(node, statusValidateFailed)
+				// Invalid utreexo data is the fault of
+				// whoever sent it, not of the block.
+				if !isUDataError(err) {
+					b.index.SetStatusFlags(node,
+						statusValidateFailed)
+				}
 			} else {
 				return false, err
 			}
@@ -1181,7 +1259,8 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block, fla
 			if b.utreexoView != nil {
 				// Check that the block txOuts are valid by checking the utreexo proof and
 				// extra data and then update the accumulator.
-				err := b.utreexoView.ProcessUData(block, b.bestChain, block.MsgBlock().UData)
+				err := b.utreexoView.ProcessUData(block, b.bestChain, block.MsgBlock().UData,
+					b.chainParams.LeafCommitments, b.leafHasher)
 				if err != nil {
 					return false, err
 				}
@@ -1208,7 +1287,7 @@ func (b *BlockChain) connectBestChain(node *blockNode, block *btcutil.Block, fla
 			// If we got hit with a rule error, then we'll mark
 			// that status of the block as invalid and flush the
 			// index state to disk before returning with the error.
-			if _, ok := err.(RuleError); ok {
+			if _, ok := err.(RuleError); ok && !isUDataError(err) {
 				b.index.SetStatusFlags(
 					node, statusValidateFailed,
 				)
@@ -1710,6 +1789,30 @@ type IndexManager interface {
 	DisconnectBlock(database.Tx, *btcutil.Block, []SpentTxOut) error
 }
 
+// IndexFlushAligner is an optional interface that an IndexManager may
+// implement for the periodic flushes of the cached chain state to be aligned
+// with the heights that the indexes have their own state persisted at.  This
+// keeps the amount of blocks that have to be replayed after a crash small.
+type IndexFlushAligner interface {
+	// DurableHeight returns the lowest height that the indexes have their
+	// state persisted at.  The bool is false if none of the indexes keep
+	// any state that needs to be aligned.
+	DurableHeight() (int32, bool)
+
+	// FlushIndexes persists the state of all the indexes.
+	FlushIndexes() error
+}
+
+// IndexFollowUpWriter is an optional interface that an IndexManager may
+// implement to write part of the index entries of a connected block in their
+// own database transactions after the one of the block.  This keeps the
+// transaction of a block that writes a lot to the indexes small.
+type IndexFollowUpWriter interface {
+	// WriteFollowUps writes the index entries of the last connected block
+	// that were deferred until its transaction was committed.
+	WriteFollowUps() error
+}
+
 // Config is a descriptor which specifies the blockchain instance configuration.
 type Config struct {
 	// DB defines the database which houses the blocks and will be used to
@@ -1783,6 +1886,37 @@ type Config struct {
 	//
 	// This field can be nil as being a utreexo node is optional.
 	UtreexoView *UtreexoViewpoint
+
+	// UtreexoRelay makes the chain a verifying relay.  The blocks are
+	// validated against the UTXO set as usual, while a pruned utreexo
+	// accumulator is kept in step with it.  Every block must come with its
+	// utreexo data, which is verified against the accumulator and updates
+	// it.  The roots of the accumulator after every block are stored so
+	// that disconnecting blocks and loading the chain don't replay any.
+	// They're built from the spend journal the first time the chain is
+	// loaded as a verifying relay.
+	//
+	// This field may not be set along with UtreexoView.
+	UtreexoRelay bool
+
+	// RetainUData keeps the utreexo data of the blocks after they're
+	// connected to the utreexo accumulator.  Otherwise, the blocks only
+	// carry a summary of their utreexo data once they're connected so that
+	// the proofs don't stay in memory for as long as the blocks are
+	// referenced.  Only consumers that need the proofs of connected blocks
+	// should set it.
+	//
+	// This field is only used when UtreexoView is set.
+	RetainUData bool
+
+	// LeafHasher hashes the leaves of the created and the spent outputs
+	// of the blocks.  The utreexo proof indexes hash their leaves with it
+	// as well.  It's given so that the hash states it keeps may be restored
+	// before the indexes are caught up.
+	//
+	// This field can be nil, in which case a hasher is made for the chain
+	// parameters.
+	LeafHasher *wire.LeafHasher
 }
 
 // New returns a BlockChain instance using the provided configuration details.
@@ -1797,6 +1931,10 @@ func New(config *Config) (*BlockChain, error) {
 	if config.TimeSource == nil {
 		return nil, AssertError("blockchain.New timesource is nil")
 	}
+	if config.UtreexoRelay && config.UtreexoView != nil {
+		return nil, AssertError("blockchain.New utreexo view and utreexo " +
+			"relay are both set")
+	}
 
 	// Generate a checkpoint by height map from the provided checkpoints
 	// and assert the provided checkpoints are sorted by height as required.
@@ -1827,6 +1965,10 @@ func New(config *Config) (*BlockChain, error) {
 	}
 
 	params := config.ChainParams
+	leafHasher := config.LeafHasher
+	if leafHasher == nil {
+		leafHasher = NewLeafHasher(params)
+	}
 	targetTimespan := int64(params.TargetTimespan / time.Second)
 	targetTimePerBlock := int64(params.TargetTimePerBlock / time.Second)
 	adjustmentFactor := params.RetargetAdjustmentFactor
@@ -1843,7 +1985,10 @@ func New(config *Config) (*BlockChain, error) {
 		blocksPerRetarget:   int32(targetTimespan / targetTimePerBlock),
 		index:               newBlockIndex(config.DB, params),
 		utxoCache:           utxoCache,
+		flushDeferredSince:  -1,
 		utreexoView:         config.UtreexoView,
+		leafHasher:          leafHasher,
+		retainUData:         config.RetainUData,
 		hashCache:           config.HashCache,
 		bestChain:           newChainView(nil),
 		orphans:             make(map[chainhash.Hash]*orphanBlock),
@@ -1875,6 +2020,14 @@ func New(config *Config) (*BlockChain, error) {
 		}
 	}
 
+	// Load the accumulator of a verifying relay, building it the first
+	// time.
+	if config.UtreexoRelay {
+		if err := b.loadRelayView(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Initialize and catch up all of the currently active optional indexes
 	// as needed.
 	if config.IndexManager != nil {
@@ -1907,8 +2060,81 @@ func (b *BlockChain) CachedStateSize() uint64 {
 // database.
 //
 // This method is safe for concurrent access.
+//
+// A periodic flush is postponed for up to MaxFlushAlignDelay blocks when the
+// index manager implements the IndexFlushAligner interface and the indexes
+// aren't durable at the current height.  This is safe to do since the cache
+// is still flushed when it goes over its maximum size.
 func (b *BlockChain) FlushCachedState(mode FlushMode) error {
 	b.chainLock.Lock()
 	defer b.chainLock.Unlock()
+
+	if mode == FlushPeriodic {
+		needed := b.utxoCache.TotalMemoryUsage() > b.utxoCache.flushThreshold(mode)
+		if !needed {
+			b.flushDeferredSince = -1
+			return nil
+		}
+		if b.deferFlush(b.stateSnapshot.Height) {
+			return nil
+		}
+	}
+
 	return b.utxoCache.Flush(mode, b.stateSnapshot)
 }
+
+// FlushAlignedState persists the state of the indexes and then flushes all the
+// cached state of the blockchain so that they're all durable at the same
+// height.  A utreexo node has no cached state of its own so only the indexes
+// are flushed.
+//
+// This method is safe for concurrent access.
+func (b *BlockChain) FlushAlignedState() error {
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	if aligner, ok := b.indexManager.(IndexFlushAligner); ok {
+		err := aligner.FlushIndexes()
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.utxoCache == nil {
+		return nil
+	}
+	b.flushDeferredSince = -1
+	return b.utxoCache.Flush(FlushRequired, b.stateSnapshot)
+}
+
+// deferFlush returns whether a periodic flush of the cached state at the given
+// height should be postponed so that it happens at a height that the indexes
+// are durable at.  A flush is never postponed for more than MaxFlushAlignDelay
+// blocks.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) deferFlush(height int32) bool {
+	aligner, ok := b.indexManager.(IndexFlushAligner)
+	if !ok {
+		return false
+	}
+
+	durable, ok := aligner.DurableHeight()
+	if !ok || durable == height {
+		b.flushDeferredSince = -1
+		return false
+	}
+
+	if b.flushDeferredSince == -1 || height < b.flushDeferredSince {
+		b.flushDeferredSince = height
+	}
+	if height-b.flushDeferredSince >= MaxFlushAlignDelay {
+		log.Debugf("Flushing the UTXO cache at height %d without "+
+			"the indexes being durable (durable at %d)", height,
+			durable)
+		b.flushDeferredSince = -1
+		return false
+	}
+
+	return true
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
 	"github.com/utreexo/utreexod/wire"
 )
 
@@ -963,3 +964,115 @@ func TestIntervalBlockHashes(t *testing.T) {
 		}
 	}
 }
+
+// fakeFlushAligner is an IndexManager that reports a durable height and counts
+// how many times it was flushed.
+type fakeFlushAligner struct {
+	durable int32
+	flushes int
+}
+
+func (m *fakeFlushAligner) Init(*BlockChain, <-chan struct{}) error { return nil }
+
+func (m *fakeFlushAligner) ConnectBlock(database.Tx, *btcutil.Block, []SpentTxOut) error {
+	return nil
+}
+
+func (m *fakeFlushAligner) DisconnectBlock(database.Tx, *btcutil.Block, []SpentTxOut) error {
+	return nil
+}
+
+func (m *fakeFlushAligner) DurableHeight() (int32, bool) { return m.durable, true }
+
+func (m *fakeFlushAligner) FlushIndexes() error {
+	m.flushes++
+	return nil
+}
+
+// TestFlushAlignment ensures that the periodic flushes of the cached state are
+// postponed to the heights that the indexes are durable at and that they're
+// never postponed for more than MaxFlushAlignDelay blocks.
+func TestFlushAlignment(t *testing.T) {
+	// simulate connects the given number of blocks with the indexes being
+	// durable every durableInterval blocks and the cache wanting to be
+	// flushed every flushInterval blocks.  It returns the heights the
+	// cache was flushed at along with how far apart the flushed height and
+	// the durable height were summed over every block.  The latter is the
+	// amount of blocks that would have to be replayed to bring the indexes
+	// and the chain state back in line after a crash at every block.
+	simulate := func(aligned bool, blocks, flushInterval,
+		durableInterval int32) ([]int32, int32) {
+
+		aligner := &fakeFlushAligner{}
+		b := &BlockChain{flushDeferredSince: -1}
+		if aligned {
+			b.indexManager = aligner
+		}
+
+		var flushes []int32
+		var flushed, replayed int32
+		var pending bool
+		for height := int32(1); height <= blocks; height++ {
+			if durableInterval > 0 && height%durableInterval == 0 {
+				aligner.durable = height
+			}
+			if height%flushInterval == 0 {
+				pending = true
+			}
+			if pending && !b.deferFlush(height) {
+				flushes = append(flushes, height)
+				flushed = height
+				pending = false
+			}
+
+			if flushed > aligner.durable {
+				replayed += flushed - aligner.durable
+			} else {
+				replayed += aligner.durable - flushed
+			}
+		}
+
+		return flushes, replayed
+	}
+
+	// Every flush lands on a height that the indexes are durable at.
+	flushes, aligned := simulate(true, 200, 10, 25)
+	if len(flushes) == 0 {
+		t.Fatal("expected the cache to be flushed")
+	}
+	for _, height := range flushes {
+		if height%25 != 0 {
+			t.Fatalf("flush at height %d isn't aligned with the "+
+				"indexes", height)
+		}
+	}
+
+	// The crash recovery work shrinks compared to the unaligned flushes.
+	_, unaligned := simulate(false, 200, 10, 25)
+	if aligned >= unaligned {
+		t.Fatalf("expected less recovery work with aligned flushes, "+
+			"got %d aligned and %d unaligned", aligned, unaligned)
+	}
+
+	// The flushes aren't postponed for more than the bound when the
+	// indexes are never durable at a height the cache wants to flush at.
+	flushes, _ = simulate(true, 3*MaxFlushAlignDelay, 10, 0)
+	want := []int32{10 + MaxFlushAlignDelay, 20 + 2*MaxFlushAlignDelay}
+	if !reflect.DeepEqual(flushes, want) {
+		t.Fatalf("expected flushes at %v, got %v", want, flushes)
+	}
+}
+
+// TestFlushAlignedStateUtreexoView ensures that an aligned flush of a utreexo
+// node, which has no cached state of its own, flushes the indexes.
+func TestFlushAlignedStateUtreexoView(t *testing.T) {
+	aligner := &fakeFlushAligner{}
+	b := &BlockChain{flushDeferredSince: -1, indexManager: aligner}
+	if err := b.FlushAlignedState(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aligner.flushes != 1 {
+		t.Fatalf("expected the indexes to be flushed once, got %d",
+			aligner.flushes)
+	}
+}
@@ -1149,7 +1149,7 @@ func dbFetchUtreexoView(dbTx database.Tx, blockHash *chainhash.Hash) (*UtreexoVi
 		return nil, nil
 	}
 
-	uView := NewUtreexoViewpoint()
+	uView := NewUtreexoViewpoint(0)
 	err := deserializeUtreexoView(uView, serializedUtreexoView)
 	if err != nil {
 		return nil, err
@@ -839,7 +839,7 @@ func initUtreexoViewpoints() []*UtreexoViewpoint {
 	// 3 is enough for testing serialization.
 	var uViews [3]*UtreexoViewpoint
 	for i := 0; i < len(uViews); i++ {
-		uViews[i] = NewUtreexoViewpoint()
+		uViews[i] = NewUtreexoViewpoint(0)
 	}
 
 	var leafCount int
@@ -867,7 +867,7 @@ func initUtreexoViewpoints() []*UtreexoViewpoint {
 			panic(retErr)
 		}
 
-		newUView := NewUtreexoViewpoint()
+		newUView := NewUtreexoViewpoint(0)
 		err = deserializeUtreexoView(newUView, bytes)
 		if err != nil {
 			retErr := fmt.Errorf("initUtreexoViewpoints #%d unexpected "+
@@ -921,7 +921,7 @@ func TestUtreexoViewSerialize(t *testing.T) {
 			continue
 		}
 
-		gotUtreexoView := NewUtreexoViewpoint()
+		gotUtreexoView := NewUtreexoViewpoint(0)
 		err = deserializeUtreexoView(gotUtreexoView, gotBytes)
 		if err != nil {
 			t.Errorf("serializeUtreexoView #%d (%s) unexpected "+
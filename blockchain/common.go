@@ -154,6 +154,10 @@ func SolveBlock(header *wire.BlockHeader) bool {
 type SpendableOut struct {
 	PrevOut wire.OutPoint
 	Amount  btcutil.Amount
+
+	// ScriptType is the type of script the output pays to.  AddBlock
+	// only spends outputs of ScriptOpTrue.
+	ScriptType ScriptType
 }
 
 // MakeSpendableOutForTx returns a spendable output for the given transaction
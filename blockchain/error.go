@@ -220,6 +220,28 @@ const (
 	// current chain tip. This is not a block validation rule, but is required
 	// for block proposals submitted via getblocktemplate RPC.
 	ErrPrevBlockNotBest
+
+	// ErrUDataCommitmentMismatch indicates that the leaves of the utreexo
+	// data attached to a block aren't the ones spent by the transactions
+	// committed to in the block's merkle root.
+	ErrUDataCommitmentMismatch
+
+	// ErrUDataStaleCommitment indicates that a leaf of the utreexo data
+	// attached to a block commits to a known block at the leaf's height
+	// that isn't an ancestor of the block.  This is what utreexo data
+	// generated before a reorg looks like, so it's likely served by a
+	// bridge that hasn't caught up with the reorg yet rather than being
+	// invalid.
+	ErrUDataStaleCommitment
+
+	// ErrUDataInvalid indicates that the utreexo data attached to a block
+	// can't be completed from the block or that its accumulator proof
+	// doesn't prove its leaves.
+	ErrUDataInvalid
+
+	// ErrUDataMissing indicates that a block came without the utreexo data
+	// that's needed to accept it.
+	ErrUDataMissing
 )
 
 // Map of ErrorCode values back to their constant names for pretty printing.
@@ -267,6 +289,10 @@ var errorCodeStrings = map[ErrorCode]string{
 	ErrPreviousBlockUnknown:      "ErrPreviousBlockUnknown",
 	ErrInvalidAncestorBlock:      "ErrInvalidAncestorBlock",
 	ErrPrevBlockNotBest:          "ErrPrevBlockNotBest",
+	ErrUDataCommitmentMismatch:   "ErrUDataCommitmentMismatch",
+	ErrUDataStaleCommitment:      "ErrUDataStaleCommitment",
+	ErrUDataInvalid:              "ErrUDataInvalid",
+	ErrUDataMissing:              "ErrUDataMissing",
 }
 
 // String returns the ErrorCode as a human-readable name.
@@ -296,3 +322,23 @@ func (e RuleError) Error() string {
 func ruleError(c ErrorCode, desc string) RuleError {
 	return RuleError{ErrorCode: c, Description: desc}
 }
+
+// isUDataError returns whether the error is a rule violation of the utreexo
+// data that came with a block rather than of the block itself.  The utreexo
+// data is from whoever sent the block, so the block isn't marked as invalid for
+// it.
+func isUDataError(err error) bool {
+	ruleErr, ok := err.(RuleError)
+	if !ok {
+		return false
+	}
+
+	switch ruleErr.ErrorCode {
+	case ErrUDataCommitmentMismatch, ErrUDataStaleCommitment,
+		ErrUDataInvalid, ErrUDataMissing:
+
+		return true
+	}
+
+	return false
+}
@@ -58,6 +58,10 @@ func TestErrorCodeStringer(t *testing.T) {
 		{ErrPreviousBlockUnknown, "ErrPreviousBlockUnknown"},
 		{ErrInvalidAncestorBlock, "ErrInvalidAncestorBlock"},
 		{ErrPrevBlockNotBest, "ErrPrevBlockNotBest"},
+		{ErrUDataCommitmentMismatch, "ErrUDataCommitmentMismatch"},
+		{ErrUDataStaleCommitment, "ErrUDataStaleCommitment"},
+		{ErrUDataInvalid, "ErrUDataInvalid"},
+		{ErrUDataMissing, "ErrUDataMissing"},
 		{0xffff, "Unknown ErrorCode (65535)"},
 	}
 
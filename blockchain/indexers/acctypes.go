@@ -0,0 +1,250 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// The types in this file are what the exported methods of the utreexo proof
+// indexes take and return instead of the types of the accumulator library they
+// are built on.  That way the library can be swapped out without breaking the
+// code that uses the indexes.  The conversion functions and the deprecated
+// methods that still take and return the types of the library are the only
+// exported parts of the package that refer to it.
+
+const (
+	// maxUndoBlockPrealloc is the most positions or hashes that are
+	// allocated up front when an undo block is deserialized.  The counts
+	// are read from the serialized undo block so they aren't trusted with
+	// anything more.
+	maxUndoBlockPrealloc = 1 << 16
+)
+
+// AccHash is the hash of a leaf or a root of the utreexo accumulator.
+type AccHash [32]byte
+
+// String returns the hash as a hexadecimal string.
+func (h AccHash) String() string {
+	return fmt.Sprintf("%x", h[:])
+}
+
+// BatchProof is the proof that a batch of leaves is in the utreexo
+// accumulator.
+type BatchProof struct {
+	// Targets are the positions of the leaves that are proven.
+	Targets []uint64
+
+	// Proof are the hashes needed to hash the targets up to the roots.
+	Proof []AccHash
+}
+
+// UndoBlock is what's needed to undo connecting a block to the utreexo
+// accumulator.  It serializes into exactly the same bytes as the undo block of
+// the accumulator library, which is how the indexes store it.
+type UndoBlock struct {
+	// Height is the height of the block.  It isn't serialized.
+	Height int32
+
+	// NumAdds is the number of leaves that the block added.
+	NumAdds uint32
+
+	// Positions are the positions of the leaves that the block deleted
+	// and Hashes are their hashes.
+	Positions []uint64
+	Hashes    []AccHash
+}
+
+// SerializeSize returns the number of bytes the undo block serializes into.
+func (u *UndoBlock) SerializeSize() int {
+	return 4 + 8 + len(u.Positions)*8 + 8 + len(u.Hashes)*32
+}
+
+// Serialize encodes the undo block into the given writer.
+func (u *UndoBlock) Serialize(w io.Writer) error {
+	buf := make([]byte, u.SerializeSize())
+	binary.BigEndian.PutUint32(buf, u.NumAdds)
+	offset := 4
+	binary.BigEndian.PutUint64(buf[offset:], uint64(len(u.Positions)))
+	offset += 8
+	for _, pos := range u.Positions {
+		binary.BigEndian.PutUint64(buf[offset:], pos)
+		offset += 8
+	}
+	binary.BigEndian.PutUint64(buf[offset:], uint64(len(u.Hashes)))
+	offset += 8
+	for i := range u.Hashes {
+		offset += copy(buf[offset:], u.Hashes[i][:])
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Deserialize decodes the undo block from the given reader.  The height is
+// left as it is.
+func (u *UndoBlock) Deserialize(r io.Reader) error {
+	var buf [8]byte
+	_, err := io.ReadFull(r, buf[:4])
+	if err != nil {
+		return err
+	}
+	u.NumAdds = binary.BigEndian.Uint32(buf[:4])
+
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return err
+	}
+	count := binary.BigEndian.Uint64(buf[:])
+	u.Positions = make([]uint64, 0, minUint64(count, maxUndoBlockPrealloc))
+	for i := uint64(0); i < count; i++ {
+		_, err = io.ReadFull(r, buf[:])
+		if err != nil {
+			return err
+		}
+		u.Positions = append(u.Positions, binary.BigEndian.Uint64(buf[:]))
+	}
+
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return err
+	}
+	count = binary.BigEndian.Uint64(buf[:])
+	u.Hashes = make([]AccHash, 0, minUint64(count, maxUndoBlockPrealloc))
+	for i := uint64(0); i < count; i++ {
+		var hash AccHash
+		_, err = io.ReadFull(r, hash[:])
+		if err != nil {
+			return err
+		}
+		u.Hashes = append(u.Hashes, hash)
+	}
+
+	return nil
+}
+
+// minUint64 returns the smaller of a and b.
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ForestType is the kind of forest that keeps the accumulator of a utreexo
+// proof index.
+type ForestType int
+
+// The kinds of forests that the accumulator can be kept in.  They have the same
+// values as the forest types of the accumulator library.
+const (
+	DiskForest ForestType = iota
+	RamForest
+	CacheForest
+	CowForest
+)
+
+// accumulatorForestType returns the forest type of the accumulator library.
+func (t ForestType) accumulatorForestType() accumulator.ForestType {
+	switch t {
+	case RamForest:
+		return accumulator.RamForest
+	case CowForest:
+		return accumulator.CowForest
+	case CacheForest:
+		return accumulator.CacheForest
+	default:
+		return accumulator.DiskForest
+	}
+}
+
+// NewAccHashes returns the hashes of the accumulator library as AccHashes.
+func NewAccHashes(hashes []accumulator.Hash) []AccHash {
+	if hashes == nil {
+		return nil
+	}
+
+	accHashes := make([]AccHash, len(hashes))
+	for i := range hashes {
+		accHashes[i] = AccHash(hashes[i])
+	}
+
+	return accHashes
+}
+
+// AccumulatorHashes returns the AccHashes as the hashes of the accumulator
+// library.
+func AccumulatorHashes(hashes []AccHash) []accumulator.Hash {
+	if hashes == nil {
+		return nil
+	}
+
+	accHashes := make([]accumulator.Hash, len(hashes))
+	for i := range hashes {
+		accHashes[i] = accumulator.Hash(hashes[i])
+	}
+
+	return accHashes
+}
+
+// NewBatchProof returns the batch proof of the accumulator library as a
+// BatchProof.
+func NewBatchProof(proof *accumulator.BatchProof) *BatchProof {
+	return &BatchProof{
+		Targets: proof.Targets,
+		Proof:   NewAccHashes(proof.Proof),
+	}
+}
+
+// AccumulatorBatchProof returns the batch proof as the batch proof of the
+// accumulator library.
+func (bp *BatchProof) AccumulatorBatchProof() *accumulator.BatchProof {
+	return &accumulator.BatchProof{
+		Targets: bp.Targets,
+		Proof:   AccumulatorHashes(bp.Proof),
+	}
+}
+
+// NewUndoBlock returns the undo block of the accumulator library as an
+// UndoBlock.  The accumulator library doesn't expose what's in its undo
+// blocks so it's converted through their serialization.
+func NewUndoBlock(undoBlock *accumulator.UndoBlock) (*UndoBlock, error) {
+	var buf bytes.Buffer
+	err := undoBlock.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &UndoBlock{Height: undoBlock.Height}
+	err = u.Deserialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// AccumulatorUndoBlock returns the undo block as the undo block of the
+// accumulator library.
+func (u *UndoBlock) AccumulatorUndoBlock() (*accumulator.UndoBlock, error) {
+	var buf bytes.Buffer
+	err := u.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	undoBlock := &accumulator.UndoBlock{Height: u.Height}
+	err = undoBlock.Deserialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return undoBlock, nil
+}
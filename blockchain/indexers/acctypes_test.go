@@ -0,0 +1,209 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestUndoBlockFixtures ensures that the undo blocks serialize into the same
+// bytes as the undo blocks of the accumulator library did before the indexes
+// had types of their own.
+func TestUndoBlockFixtures(t *testing.T) {
+	hash := func(s string) AccHash {
+		var h AccHash
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(h[:], b)
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		fixture string
+		want    UndoBlock
+	}{
+		{
+			name:    "only adds",
+			fixture: "0000000800000000000000000000000000000000",
+			want: UndoBlock{
+				NumAdds:   8,
+				Positions: []uint64{},
+				Hashes:    []AccHash{},
+			},
+		},
+		{
+			name: "with deletions",
+			fixture: "00000002000000000000000200000000000000020000" +
+				"0000000000050000000000000002dbc1b4c900ffe48d575b5da5" +
+				"c638040125f65db0fe3e24494b76ea986457d986e77b9a9ae9e3" +
+				"0b0dbdb6f510a264ef9de781501d7b6b92ae89eb059c5ab743db",
+			want: UndoBlock{
+				NumAdds:   2,
+				Positions: []uint64{2, 5},
+				Hashes: []AccHash{
+					hash("dbc1b4c900ffe48d575b5da5c638040125f65db0" +
+						"fe3e24494b76ea986457d986"),
+					hash("e77b9a9ae9e30b0dbdb6f510a264ef9de781501d" +
+						"7b6b92ae89eb059c5ab743db"),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		fixture, err := hex.DecodeString(test.fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var undo UndoBlock
+		err = undo.Deserialize(bytes.NewReader(fixture))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(undo, test.want) {
+			t.Fatalf("%s: expected %+v, got %+v", test.name,
+				test.want, undo)
+		}
+
+		var buf bytes.Buffer
+		err = undo.Serialize(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), fixture) {
+			t.Fatalf("%s: expected %x, got %x", test.name, fixture,
+				buf.Bytes())
+		}
+		if undo.SerializeSize() != len(fixture) {
+			t.Fatalf("%s: expected size %d, got %d", test.name,
+				len(fixture), undo.SerializeSize())
+		}
+
+		// Converting to and from the undo block of the library keeps
+		// the bytes the same.
+		libUndo, err := undo.AccumulatorUndoBlock()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		buf.Reset()
+		err = libUndo.Serialize(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), fixture) {
+			t.Fatalf("%s: expected %x from the library, got %x",
+				test.name, fixture, buf.Bytes())
+		}
+
+		converted, err := NewUndoBlock(libUndo)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(*converted, test.want) {
+			t.Fatalf("%s: expected %+v converted back, got %+v",
+				test.name, test.want, *converted)
+		}
+
+		// What the indexes store is the same as well.
+		stored, err := serializeUndoBlock(libUndo)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if stored[0] != accSerializationVersion ||
+			!bytes.Equal(stored[1:], fixture) {
+
+			t.Fatalf("%s: expected %x tagged, got %x", test.name,
+				fixture, stored)
+		}
+		payload, err := untagAccPayload("undo block", stored)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		libUndo, err = deserializeUndoBlock(payload)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		converted, err = NewUndoBlock(libUndo)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(*converted, test.want) {
+			t.Fatalf("%s: expected %+v from the stored bytes, got %+v",
+				test.name, test.want, *converted)
+		}
+	}
+}
+
+// TestBatchProofFixture ensures that converting a batch proof to and from the
+// batch proof of the accumulator library keeps its wire serialization the same.
+func TestBatchProofFixture(t *testing.T) {
+	fixture, err := hex.DecodeString("0203fd2c0101" +
+		"1111111111111111111111111111111111111111111111111111111111111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	libProof, err := wire.BatchProofDeserialize(bytes.NewReader(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := NewBatchProof(libProof)
+	var hash AccHash
+	copy(hash[:], bytes.Repeat([]byte{0x11}, 32))
+	want := &BatchProof{
+		Targets: []uint64{3, 300},
+		Proof:   []AccHash{hash},
+	}
+	if !reflect.DeepEqual(proof, want) {
+		t.Fatalf("expected %+v, got %+v", want, proof)
+	}
+
+	var buf bytes.Buffer
+	err = wire.BatchProofSerialize(&buf, proof.AccumulatorBatchProof())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), fixture) {
+		t.Fatalf("expected %x, got %x", fixture, buf.Bytes())
+	}
+
+	hashes := []accumulator.Hash{libProof.Proof[0], {1}}
+	if got := AccumulatorHashes(NewAccHashes(hashes)); !reflect.DeepEqual(got, hashes) {
+		t.Fatalf("expected %v, got %v", hashes, got)
+	}
+	if NewAccHashes(nil) != nil || AccumulatorHashes(nil) != nil {
+		t.Fatalf("expected nil hashes to stay nil")
+	}
+}
+
+// TestForestTypes ensures that the forest types are the ones of the
+// accumulator library.
+func TestForestTypes(t *testing.T) {
+	tests := []struct {
+		local ForestType
+		lib   accumulator.ForestType
+	}{
+		{DiskForest, accumulator.DiskForest},
+		{RamForest, accumulator.RamForest},
+		{CacheForest, accumulator.CacheForest},
+		{CowForest, accumulator.CowForest},
+	}
+	for _, test := range tests {
+		if got := test.local.accumulatorForestType(); got != test.lib {
+			t.Fatalf("forest type %d: expected %d, got %d", test.local,
+				test.lib, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"math/bits"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// AccumulatorTip is the utreexo accumulator that a utreexo proof index is at.
+type AccumulatorTip struct {
+	// Name is the name of the index.
+	Name string
+
+	// Height is the height of the tip of the index.  It's read separately
+	// from the accumulator, so the accumulator may already include the
+	// block that's being connected.
+	Height int32
+
+	// NumLeaves and Roots are of the accumulator of the index.
+	NumLeaves uint64
+	Roots     []*chainhash.Hash
+
+	// NumHashes is the number of hashes of the trees of the accumulator,
+	// including the roots.
+	NumHashes uint64
+}
+
+// forestNumHashes returns the number of hashes of the trees of a forest with
+// the given number of leaves.  The forest keeps every one of them: each tree of
+// n leaves has 2n-1 hashes and there's a tree for every bit that's set in the
+// number of leaves.
+func forestNumHashes(numLeaves uint64) uint64 {
+	return 2*numLeaves - uint64(bits.OnesCount64(numLeaves))
+}
+
+// AccumulatorTips returns the accumulators of the enabled utreexo proof indexes
+// in the order that the indexes were enabled in.  Only the tips and the roots
+// are read, so it takes the same time however long the chain is.
+//
+// This function is safe for concurrent access.
+func (m *Manager) AccumulatorTips() ([]AccumulatorTip, error) {
+	var tips []AccumulatorTip
+	for _, indexer := range m.enabledIndexes {
+		r, ok := indexer.(recoverable)
+		if !ok {
+			continue
+		}
+
+		tip := AccumulatorTip{Name: indexer.Name()}
+		err := m.db.View(func(dbTx database.Tx) error {
+			var err error
+			_, tip.Height, err = dbFetchIndexerTip(dbTx, indexer.Key())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		state, mtx := r.accumulatorState()
+		mtx.RLock()
+		tip.NumLeaves, err = state.NumLeaves()
+		roots := state.state.GetRoots()
+		mtx.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		tip.NumHashes = forestNumHashes(tip.NumLeaves)
+
+		tip.Roots = make([]*chainhash.Hash, len(roots))
+		for i, root := range roots {
+			hash := chainhash.Hash(root)
+			tip.Roots[i] = &hash
+		}
+		tips = append(tips, tip)
+	}
+
+	return tips, nil
+}
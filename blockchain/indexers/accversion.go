@@ -0,0 +1,391 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/database"
+)
+
+const (
+	// accSerializationVersion is the version of how the accumulator
+	// library serializes the undo blocks and the forest.  Any upgrade of
+	// the accumulator library that changes how they're serialized must
+	// bump this version and add a case in migrateAccPayload that re-encodes
+	// the previous version.
+	//
+	// Version 1 is what the accumulator library wrote before the stored
+	// artifacts were tagged with their version.  Untagged artifacts are of
+	// version 1.
+	//
+	// Version 2 tags every artifact with its version.  The accumulator
+	// library encodes the artifacts themselves the same as in version 1.
+	accSerializationVersion = 2
+
+	// accVersionFileName is the name of the file that keeps the
+	// accumulator serialization version of the forest in the utreexo state
+	// directory.  In the directory of the undo blocks of the flat utreexo
+	// proof index, it keeps the height up to which the undo blocks were
+	// stored untagged instead.
+	accVersionFileName = "accversion.dat"
+
+	// accMigrateSuffix is the suffix given to the name of the flat file
+	// that the undo blocks are re-encoded into before it replaces the
+	// original.
+	accMigrateSuffix = "-accmigrate"
+)
+
+var (
+	// utreexoAccVersionKey is the key in the utreexoParentBucketKey bucket
+	// that keeps the accumulator serialization version of the undo blocks
+	// of the utreexo proof index.  Indexes without it have their undo
+	// blocks stored untagged.
+	utreexoAccVersionKey = []byte("utreexoaccversion")
+)
+
+// accVersionError returns the error for an artifact that was serialized by an
+// accumulator serialization version that can't be read.
+func accVersionError(kind string, version uint8) error {
+	return fmt.Errorf("the %s was serialized by accumulator serialization "+
+		"version %d but this version of utreexod uses version %d and "+
+		"can't read it.  The utreexo proof index must be dropped and "+
+		"reindexed", kind, version, accSerializationVersion)
+}
+
+// migrateAccPayload re-encodes the payload of an artifact that was serialized
+// by the given accumulator serialization version into the current version.
+// Each serialization change must add a case that re-encodes the payload by a
+// single version.
+func migrateAccPayload(kind string, payload []byte, version uint8) ([]byte, error) {
+	if version == 0 || version > accSerializationVersion {
+		return nil, accVersionError(kind, version)
+	}
+
+	for ; version < accSerializationVersion; version++ {
+		switch version {
+		// Version 1 only lacked the tag so the payload is read as is.
+		case 1:
+
+		default:
+			return nil, accVersionError(kind, version)
+		}
+	}
+
+	return payload, nil
+}
+
+// tagAccPayload returns the payload tagged with the current accumulator
+// serialization version.
+func tagAccPayload(payload []byte) []byte {
+	tagged := make([]byte, 0, len(payload)+1)
+	tagged = append(tagged, accSerializationVersion)
+	return append(tagged, payload...)
+}
+
+// untagAccPayload returns the payload of the tagged artifact re-encoded into
+// the current accumulator serialization version.
+func untagAccPayload(kind string, tagged []byte) ([]byte, error) {
+	if len(tagged) == 0 {
+		return nil, errDeserialize(fmt.Sprintf("empty tagged %s", kind))
+	}
+
+	return migrateAccPayload(kind, tagged[1:], tagged[0])
+}
+
+// serializeUndoBlock returns the undo block serialized by the accumulator
+// library and tagged with the current accumulator serialization version.
+func serializeUndoBlock(undoBlock *accumulator.UndoBlock) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(undoBlock.SerializeSize() + 1)
+	buf.WriteByte(accSerializationVersion)
+	err := undoBlock.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// deserializeUndoBlock deserializes the undo block from the payload that's
+// of the current accumulator serialization version.
+func deserializeUndoBlock(payload []byte) (*accumulator.UndoBlock, error) {
+	undoBlock := new(accumulator.UndoBlock)
+	err := undoBlock.Deserialize(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	return undoBlock, nil
+}
+
+// readUntaggedUndoTip returns the height up to which the undo blocks in the
+// flat file at the given path are stored untagged.  A flat file without the
+// accumulator version file was written before the undo blocks were tagged so
+// every undo block in it is untagged and the file is written for it.
+func readUntaggedUndoTip(path string, bestHeight int32) (int32, error) {
+	buf, err := os.ReadFile(filepath.Join(path, accVersionFileName))
+	if err == nil {
+		if len(buf) != 4 {
+			return 0, fmt.Errorf("corrupt accumulator version file. "+
+				"Expected 4 bytes but got %d", len(buf))
+		}
+		return int32(binary.BigEndian.Uint32(buf)), nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	err = writeUntaggedUndoTip(path, bestHeight)
+	if err != nil {
+		return 0, err
+	}
+
+	return bestHeight, nil
+}
+
+// writeUntaggedUndoTip writes the height up to which the undo blocks in the
+// flat file at the given path are stored untagged.
+func writeUntaggedUndoTip(path string, height int32) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(height))
+	return os.WriteFile(filepath.Join(path, accVersionFileName), buf[:], 0600)
+}
+
+// lowerUntaggedUndoTip makes sure that the undo blocks stored after the given
+// height are read as tagged.  It's called whenever undo blocks are removed so
+// that the ones stored in their place aren't mistaken for untagged ones.
+func (idx *FlatUtreexoProofIndex) lowerUntaggedUndoTip(height int32) error {
+	if idx.untaggedUndoTip <= height {
+		return nil
+	}
+
+	path := flatFilePath(idx.dataDir, undoEncodingName(idx.undoSnapshotInterval))
+	err := writeUntaggedUndoTip(path, height)
+	if err != nil {
+		return err
+	}
+	idx.untaggedUndoTip = height
+
+	return nil
+}
+
+// decodeUndoRecord returns the undo block stored for the given height.  Undo
+// blocks stored untagged are re-encoded as they're read.
+func (idx *FlatUtreexoProofIndex) decodeUndoRecord(height int32, stored []byte) (
+	*accumulator.UndoBlock, error) {
+
+	var payload []byte
+	var err error
+	if height <= idx.untaggedUndoTip {
+		payload, err = migrateAccPayload("undo block", stored, 1)
+	} else {
+		payload, err = untagAccPayload("undo block", stored)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("height %d: %v", height, err)
+	}
+
+	return deserializeUndoBlock(payload)
+}
+
+// SetEagerAccMigration sets whether the undo blocks that were stored by an
+// older accumulator serialization version are all re-encoded when the index is
+// initialized.  Otherwise, they're re-encoded every time they're read.
+func (idx *FlatUtreexoProofIndex) SetEagerAccMigration(eager bool) {
+	idx.eagerAccMigration = eager
+}
+
+// migrateUndoAccVersion re-encodes all the undo blocks that were stored
+// untagged into the current accumulator serialization version.  The undo blocks
+// are written into a new flat file that then replaces the original one.
+func (idx *FlatUtreexoProofIndex) migrateUndoAccVersion() error {
+	if idx.untaggedUndoTip <= 0 {
+		return nil
+	}
+
+	name := undoEncodingName(idx.undoSnapshotInterval)
+	path := flatFilePath(idx.dataDir, name)
+	migratePath := flatFilePath(idx.dataDir, name+accMigrateSuffix)
+	log.Infof("Re-encoding the undo blocks up to height %d of the flat "+
+		"utreexo proof index into accumulator serialization version %d",
+		idx.untaggedUndoTip, accSerializationVersion)
+
+	// Start over if a previous migration was interrupted.
+	err := os.RemoveAll(migratePath)
+	if err != nil {
+		return err
+	}
+	migrateState, err := loadFlatFileState(idx.dataDir, name+accMigrateSuffix)
+	if err != nil {
+		return err
+	}
+	migrated := &FlatUtreexoProofIndex{
+		undoState:            *migrateState,
+		undoSnapshotInterval: idx.undoSnapshotInterval,
+		lastUndoHeight:       -1,
+	}
+
+	tip := idx.undoState.BestHeight()
+	for height := int32(1); height <= tip; height++ {
+		// The pruned undo blocks are stored empty as they're never
+		// read again.
+		if idx.checkUndoPruned(height) != nil {
+			err = migrated.storeUndoBlock(height, accumulator.UndoBlock{})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		undoBlock, err := idx.fetchUndoBlock(height)
+		if err != nil {
+			return err
+		}
+		err = migrated.storeUndoBlock(height, *undoBlock)
+		if err != nil {
+			return err
+		}
+	}
+	// The migrated undo blocks replace the original ones so they're
+	// synced regardless of the fsync policy.
+	err = migrated.undoState.Sync()
+	if err != nil {
+		return err
+	}
+	err = writeUntaggedUndoTip(migratePath, 0)
+	if err != nil {
+		return err
+	}
+
+	// Swap the re-encoded flat file in.
+	for _, ff := range []*FlatFileState{&idx.undoState, &migrated.undoState} {
+		err = ff.dataFile.Close()
+		if err != nil {
+			return err
+		}
+		err = ff.offsetFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(filepath.Join(migratePath, name+accMigrateSuffix+dataFileSuffix),
+		filepath.Join(migratePath, name+dataFileSuffix))
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(migratePath, path)
+	if err != nil {
+		return err
+	}
+
+	undoState, err := loadFlatFileState(idx.dataDir, name)
+	if err != nil {
+		return err
+	}
+	idx.undoState = *undoState
+	idx.untaggedUndoTip = 0
+	idx.lastUndoHeight = -1
+	idx.lastUndoBytes = nil
+
+	return nil
+}
+
+// migrateDBUndoAccVersion tags all the undo blocks of the utreexo proof index
+// that were stored untagged with the current accumulator serialization version.
+// Indexes that already have their undo blocks tagged are left alone.
+func migrateDBUndoAccVersion(dbTx database.Tx) error {
+	parentBucket := dbTx.Metadata().Bucket(utreexoParentBucketKey)
+	if parentBucket == nil {
+		return nil
+	}
+
+	version := parentBucket.Get(utreexoAccVersionKey)
+	if len(version) == 1 && version[0] == accSerializationVersion {
+		return nil
+	}
+	if len(version) > 0 {
+		return accVersionError("undo blocks", version[0])
+	}
+
+	undoBucket := parentBucket.Bucket(utreexoUndoKey)
+	var keys, values [][]byte
+	err := undoBucket.ForEach(func(k, v []byte) error {
+		payload, err := migrateAccPayload("undo block", v, 1)
+		if err != nil {
+			return err
+		}
+
+		// The keys and values are only valid during the iteration.
+		keys = append(keys, append([]byte(nil), k...))
+		values = append(values, tagAccPayload(payload))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		err = undoBucket.Put(keys[i], values[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return parentBucket.Put(utreexoAccVersionKey, []byte{accSerializationVersion})
+}
+
+// checkForestAccVersion checks the accumulator serialization version of the
+// forest in the utreexo state directory and re-encodes it into the current
+// version if needed.  A forest without the version file was written before the
+// forest was tagged and is of version 1.
+func checkForestAccVersion(basePath string) error {
+	version := uint8(1)
+	buf, err := os.ReadFile(filepath.Join(basePath, accVersionFileName))
+	switch {
+	case err == nil:
+		if len(buf) != 1 {
+			return fmt.Errorf("corrupt accumulator version file. "+
+				"Expected 1 byte but got %d", len(buf))
+		}
+		version = buf[0]
+
+	case !os.IsNotExist(err):
+		return err
+	}
+	if version == accSerializationVersion {
+		return nil
+	}
+
+	// The forest is read by the accumulator library straight from its
+	// files so there's no payload to re-encode for the versions known so
+	// far.  Only the version is checked.
+	_, err = migrateAccPayload("utreexo forest", nil, version)
+	if err != nil {
+		return err
+	}
+
+	return writeForestAccVersion(basePath)
+}
+
+// writeForestAccVersion writes the current accumulator serialization version
+// into the utreexo state directory.
+func writeForestAccVersion(basePath string) error {
+	err := os.MkdirAll(basePath, 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(basePath, accVersionFileName),
+		[]byte{accSerializationVersion}, 0600)
+}
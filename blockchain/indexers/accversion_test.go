@@ -0,0 +1,186 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// TestUndoAccVersionUpgrade ensures that the undo blocks stored untagged by an
+// older accumulator serialization version are read back the same both when
+// they're re-encoded as they're read and when they're all re-encoded at once.
+func TestUndoAccVersionUpgrade(t *testing.T) {
+	dataDir := t.TempDir()
+	name := undoEncodingName(10)
+	path := flatFilePath(dataDir, name)
+
+	// Store the undo blocks untagged like before they were versioned.
+	undoState, err := loadFlatFileState(dataDir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := &FlatUtreexoProofIndex{
+		dataDir:              dataDir,
+		undoState:            *undoState,
+		undoSnapshotInterval: 10,
+		lastUndoHeight:       -1,
+	}
+	legacy := make(map[int32][]byte)
+	for height := int32(1); height <= 15; height++ {
+		var buf bytes.Buffer
+		err := new(accumulator.UndoBlock).Serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.storeUndoBytes(height, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		legacy[height] = buf.Bytes()
+	}
+
+	// check makes sure that the undo blocks up to the tip are read back
+	// into what the accumulator library serializes them as.
+	check := func(tip int32) {
+		for height := int32(1); height <= tip; height++ {
+			undoBlock, err := idx.fetchUndoBlock(height)
+			if err != nil {
+				t.Fatalf("height %d: %v", height, err)
+			}
+			var buf bytes.Buffer
+			err = undoBlock.Serialize(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), legacy[height]) {
+				t.Fatalf("height %d: expected %x, got %x", height,
+					legacy[height], buf.Bytes())
+			}
+		}
+	}
+	checkTagged := func(start, end int32) {
+		for height := start; height <= end; height++ {
+			stored, err := idx.fetchUndoBytes(height)
+			if err != nil {
+				t.Fatalf("height %d: %v", height, err)
+			}
+			if len(stored) == 0 || stored[0] != accSerializationVersion {
+				t.Fatalf("height %d: expected a tagged undo block, "+
+					"got %x", height, stored)
+			}
+		}
+	}
+
+	// Opening the legacy undo blocks marks them all as untagged.
+	idx.untaggedUndoTip, err = readUntaggedUndoTip(path, idx.undoState.BestHeight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.untaggedUndoTip != 15 {
+		t.Fatalf("expected the untagged tip at 15, got %d",
+			idx.untaggedUndoTip)
+	}
+
+	// The lazy path reads the untagged undo blocks while the new ones are
+	// stored tagged, including the ones stored in place of removed ones.
+	check(15)
+	err = idx.storeUndoBlock(16, accumulator.UndoBlock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTagged(16, 16)
+	for height := int32(16); height >= 15; height-- {
+		err = idx.removeUndoBlock(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for height := int32(15); height <= 16; height++ {
+		err = idx.storeUndoBlock(height, accumulator.UndoBlock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy[16] = legacy[15]
+	checkTagged(15, 16)
+	check(16)
+	tip, err := readUntaggedUndoTip(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tip != 14 {
+		t.Fatalf("expected the untagged tip to be lowered to 14, got %d", tip)
+	}
+
+	// The eager path re-encodes every untagged undo block.
+	err = idx.migrateUndoAccVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.untaggedUndoTip != 0 {
+		t.Fatalf("expected no untagged undo blocks, got up to %d",
+			idx.untaggedUndoTip)
+	}
+	checkTagged(1, 16)
+	check(16)
+	_, err = os.Stat(flatFilePath(dataDir, name+accMigrateSuffix))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected the re-encoded flat file to be moved, got %v", err)
+	}
+
+	// Undo blocks from unknown versions name both versions.
+	for _, version := range []uint8{0, accSerializationVersion + 1} {
+		_, err = idx.decodeUndoRecord(17, []byte{version})
+		if err == nil || !strings.Contains(err.Error(), "reindexed") {
+			t.Fatalf("expected a reindex error for version %d, got %v",
+				version, err)
+		}
+	}
+}
+
+// TestForestAccVersion ensures that the accumulator serialization version of
+// the forest is upgraded from legacy states and unknown versions are rejected.
+func TestForestAccVersion(t *testing.T) {
+	basePath := t.TempDir()
+	versionPath := filepath.Join(basePath, accVersionFileName)
+
+	// A forest without a version file is upgraded.
+	err := checkForestAccVersion(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := os.ReadFile(versionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(version, []byte{accSerializationVersion}) {
+		t.Fatalf("expected version %d, got %x", accSerializationVersion,
+			version)
+	}
+
+	err = os.WriteFile(versionPath, []byte{accSerializationVersion + 1}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkForestAccVersion(basePath)
+	if err == nil || !strings.Contains(err.Error(), "reindexed") {
+		t.Fatalf("expected a reindex error, got %v", err)
+	}
+
+	err = os.WriteFile(versionPath, []byte{1, 2}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkForestAccVersion(basePath)
+	if err == nil {
+		t.Fatal("expected an error for a corrupt version file")
+	}
+}
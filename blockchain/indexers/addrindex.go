@@ -735,11 +735,10 @@ func (idx *AddrIndex) indexBlock(data writeIndexData, block *btcutil.Block,
 // the transactions in the block involve.
 //
 // This is part of the Indexer interface.
-func (idx *AddrIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
-
+func (idx *AddrIndex) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	// The offset and length of the transactions within the serialized
 	// block.
+	block := n.Block
 	txLocs, err := block.TxLoc()
 	if err != nil {
 		return err
@@ -753,7 +752,7 @@ func (idx *AddrIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
 
 	// Build all of the address to transaction mappings in a local map.
 	addrsToTxns := make(writeIndexData)
-	idx.indexBlock(addrsToTxns, block, stxos)
+	idx.indexBlock(addrsToTxns, block, n.SpentTxOuts)
 
 	// Add all of the index entries for each address.
 	addrIdxBucket := dbTx.Metadata().Bucket(addrIndexKey)
@@ -775,12 +774,10 @@ func (idx *AddrIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
 // each transaction in the block involve.
 //
 // This is part of the Indexer interface.
-func (idx *AddrIndex) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
-
+func (idx *AddrIndex) DisconnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	// Build all of the address to transaction mappings in a local map.
 	addrsToTxns := make(writeIndexData)
-	idx.indexBlock(addrsToTxns, block, stxos)
+	idx.indexBlock(addrsToTxns, n.Block, n.SpentTxOuts)
 
 	// Remove all of the index entries for each address.
 	bucket := dbTx.Metadata().Bucket(addrIndexKey)
@@ -974,5 +971,5 @@ func NewAddrIndex(db database.DB, chainParams *chaincfg.Params) *AddrIndex {
 // DropAddrIndex drops the address index from the provided database if it
 // exists.
 func DropAddrIndex(db database.DB, interrupt <-chan struct{}) error {
-	return dropIndex(db, addrIndexKey, addrIndexName, interrupt)
+	return dropIndex(db, addrIndexKey, addrIndexName, nil, interrupt)
 }
@@ -0,0 +1,100 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// utreexoRootsKey is the key of the bucket in the utreexoParentBucketKey bucket
+// that keeps the number of leaves and the roots of the accumulator right after
+// every connected block by the hash of the block.  The bucket is created with
+// the first roots that are stored, so the blocks connected before the roots
+// were kept don't have them.
+var utreexoRootsKey = []byte("utreexorootskey")
+
+// serializeBlockRoots returns the number of leaves and the roots serialized to
+// be stored.  It's the number of leaves followed by the roots.
+func serializeBlockRoots(numLeaves uint64, roots []accumulator.Hash) []byte {
+	serialized := make([]byte, 8+len(roots)*chainhash.HashSize)
+	byteOrder.PutUint64(serialized[0:8], numLeaves)
+	for i, root := range roots {
+		copy(serialized[8+i*chainhash.HashSize:], root[:])
+	}
+	return serialized
+}
+
+// deserializeBlockRoots returns the number of leaves and the roots that were
+// serialized with serializeBlockRoots.
+func deserializeBlockRoots(hash *chainhash.Hash, serialized []byte) (
+	uint64, []*chainhash.Hash, error) {
+
+	if len(serialized) < 8 || (len(serialized)-8)%chainhash.HashSize != 0 {
+		return 0, nil, database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("corrupt utreexo roots of block "+
+				"%v. Unexpected length of %d bytes", hash,
+				len(serialized)),
+		}
+	}
+
+	numLeaves := byteOrder.Uint64(serialized[0:8])
+	roots := make([]*chainhash.Hash, 0, (len(serialized)-8)/chainhash.HashSize)
+	for offset := 8; offset < len(serialized); offset += chainhash.HashSize {
+		var root chainhash.Hash
+		copy(root[:], serialized[offset:offset+chainhash.HashSize])
+		roots = append(roots, &root)
+	}
+
+	return numLeaves, roots, nil
+}
+
+// dbPutBlockRoots records the number of leaves and the roots of the accumulator
+// right after the block with the given hash was connected.
+func dbPutBlockRoots(dbTx database.Tx, hash *chainhash.Hash, numLeaves uint64,
+	roots []accumulator.Hash) error {
+
+	bucket, err := dbTx.Metadata().Bucket(utreexoParentBucketKey).
+		CreateBucketIfNotExists(utreexoRootsKey)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(hash[:], serializeBlockRoots(numLeaves, roots))
+}
+
+// dbFetchBlockRoots returns the number of leaves and the roots of the
+// accumulator that were recorded for the block with the given hash.  The roots
+// are nil if none were recorded, like for the blocks connected before the
+// roots were kept or whose roots were pruned.
+func dbFetchBlockRoots(dbTx database.Tx, hash *chainhash.Hash) (
+	uint64, []*chainhash.Hash, error) {
+
+	bucket := dbTx.Metadata().Bucket(utreexoParentBucketKey).Bucket(utreexoRootsKey)
+	if bucket == nil {
+		return 0, nil, nil
+	}
+	serialized := bucket.Get(hash[:])
+	if serialized == nil {
+		return 0, nil, nil
+	}
+
+	return deserializeBlockRoots(hash, serialized)
+}
+
+// dbDeleteBlockRoots removes the roots recorded for the block with the given
+// hash.
+func dbDeleteBlockRoots(dbTx database.Tx, hash *chainhash.Hash) error {
+	bucket := dbTx.Metadata().Bucket(utreexoParentBucketKey).Bucket(utreexoRootsKey)
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.Delete(hash[:])
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+)
+
+// blockSpecTest is a regression test of the utreexo proofs for a block shape.
+// A proof failure that's reported at some block shape becomes a new entry in
+// blockSpecTests.
+type blockSpecTest struct {
+	name string
+
+	// setup are the specs of the blocks that are connected before the
+	// block under test to create the outputs that it spends.
+	setup []blockchain.BlockSpec
+
+	// spec is the shape of the block under test.
+	spec blockchain.BlockSpec
+
+	// seed is the seed the blocks are generated with.
+	seed int64
+
+	// unsatisfiable is whether the block under test is expected to fail
+	// to generate.
+	unsatisfiable bool
+}
+
+// fanOut returns the spec of a block that creates the given number of outputs
+// of the given script types from a single one.
+func fanOut(outputs int, scriptTypes ...blockchain.ScriptType) blockchain.BlockSpec {
+	return blockchain.BlockSpec{
+		NumTxs:       1,
+		InputsPerTx:  1,
+		OutputsPerTx: outputs,
+		ScriptTypes:  scriptTypes,
+	}
+}
+
+var blockSpecTests = []blockSpecTest{
+	{
+		name:  "large consolidation",
+		setup: []blockchain.BlockSpec{fanOut(500)},
+		spec: blockchain.BlockSpec{
+			NumTxs:      1,
+			InputsPerTx: 500,
+		},
+		seed: 1,
+	},
+	{
+		name:  "large consolidation spending same-block outputs",
+		setup: []blockchain.BlockSpec{fanOut(1000)},
+		spec: blockchain.BlockSpec{
+			NumTxs:         2,
+			InputsPerTx:    500,
+			SpendSameBlock: true,
+		},
+		seed: 2,
+	},
+	{
+		name:  "same-block spend chain",
+		setup: []blockchain.BlockSpec{fanOut(1)},
+		spec: blockchain.BlockSpec{
+			NumTxs:         50,
+			InputsPerTx:    1,
+			SpendSameBlock: true,
+		},
+		seed: 3,
+	},
+	{
+		name: "mixed scripts with duplicate leaves and oversized scripts",
+		setup: []blockchain.BlockSpec{fanOut(60, blockchain.ScriptOpTrue,
+			blockchain.ScriptP2SHOpTrue, blockchain.ScriptP2WSHOpTrue)},
+		spec: blockchain.BlockSpec{
+			NumTxs:      20,
+			InputsPerTx: 3,
+			ScriptTypes: []blockchain.ScriptType{blockchain.ScriptOpTrue,
+				blockchain.ScriptP2SHOpTrue, blockchain.ScriptP2WSHOpTrue},
+			OversizedScripts:     3,
+			DuplicateLeafPattern: true,
+		},
+		seed: 4,
+	},
+	{
+		// Taproot isn't active on the test chain so the outputs are
+		// spent without a witness.  Their scripts are serialized whole
+		// in the leaf datas either way.
+		name:  "taproot spends",
+		setup: []blockchain.BlockSpec{fanOut(100, blockchain.ScriptP2TROpTrue)},
+		spec: blockchain.BlockSpec{
+			NumTxs:      10,
+			InputsPerTx: 10,
+			ScriptTypes: []blockchain.ScriptType{blockchain.ScriptP2TROpTrue},
+		},
+		seed: 6,
+	},
+	{
+		name:  "bare multisig spends",
+		setup: []blockchain.BlockSpec{fanOut(100, blockchain.ScriptBareMultisig)},
+		spec: blockchain.BlockSpec{
+			NumTxs:         10,
+			InputsPerTx:    10,
+			SpendSameBlock: true,
+			ScriptTypes:    []blockchain.ScriptType{blockchain.ScriptBareMultisig},
+		},
+		seed: 7,
+	},
+	{
+		name: "more inputs than spendable outputs",
+		spec: blockchain.BlockSpec{
+			NumTxs:      1,
+			InputsPerTx: 2,
+		},
+		seed:          5,
+		unsatisfiable: true,
+	},
+}
+
+// runBlockSpecTest connects the blocks of the test and then makes sure that the
+// proofs of the block under test are the same on both indexes, that they
+// verify, and that a compact state node is able to connect the blocks with
+// them.
+func runBlockSpecTest(t *testing.T, i int, test *blockSpecTest) {
+	dbName := fmt.Sprintf("TestBlockSpecs-%d", i)
+	chain, indexes, params, tearDown := indexersTestChain(dbName, 1)
+	defer tearDown()
+
+	tip, spendables := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+
+	specs := append(test.setup, test.spec)
+	for j, spec := range specs {
+		block, outs, err := blockchain.GenerateBlockFromSpec(chain, tip,
+			spendables, spec, test.seed+int64(j))
+		if j == len(specs)-1 && test.unsatisfiable {
+			if err == nil {
+				t.Fatalf("%s: expected the spec to be unsatisfiable",
+					test.name)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: block %d: %v", test.name, j, err)
+		}
+		_, _, err = chain.ProcessBlock(block, blockchain.BFNone)
+		if err != nil {
+			t.Fatalf("%s: block %d: %v", test.name, j, err)
+		}
+		tip, spendables = block, outs
+	}
+
+	err := testUtreexoProof(tip, chain, indexes)
+	if err != nil {
+		t.Fatalf("%s: %v", test.name, err)
+	}
+	err = compareUtreexoIdx(1, tip.Height()+1, chain, indexes)
+	if err != nil {
+		t.Fatalf("%s: %v", test.name, err)
+	}
+
+	csnChain, _, csnTearDown, err := csnTestChain(dbName + "-CsnChain")
+	defer csnTearDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncCsnChain(1, tip.Height()+1, chain, csnChain, indexes)
+	if err != nil {
+		t.Fatalf("%s: %v", test.name, err)
+	}
+}
+
+// TestBlockSpecs runs the utreexo proof regression tests of the block shapes.
+func TestBlockSpecs(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	for i := range blockSpecTests {
+		runBlockSpecTest(t, i, &blockSpecTests[i])
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// flatUtreexoQuarantineName is the name of the directory that the
+// non-canonical proofs of the flat utreexo proof index are copied to before
+// they're regenerated.  It's left in place when the index is dropped.
+const flatUtreexoQuarantineName = "quarantine"
+
+// NonCanonicalProof describes a stored proof that doesn't serialize back into
+// the exact same bytes that it's stored as.
+type NonCanonicalProof struct {
+	// Height is the height of the block that the proof is for.
+	Height int32
+
+	// Err describes why the proof isn't canonical.
+	Err error
+
+	// QuarantinePath is the file that the stored proof was copied to.  It's
+	// empty if the proof wasn't quarantined.
+	QuarantinePath string
+}
+
+// checkLeafScript returns an error if the leaf data's script is stored whole
+// even though it would be serialized with a reconstructable type.  A leaf data
+// like that has a different compact serialization than the one generated for
+// the same utxo.  The input spends the leaf data and decides whether the script
+// is reconstructable.  If it's nil, the script is taken to be reconstructable
+// whenever its type is.
+func checkLeafScript(ld *wire.LeafData, txIn *wire.TxIn) error {
+	if ld.ReconstructablePkType != wire.OtherTy {
+		return nil
+	}
+
+	ty := canonicalPkType(ld, txIn)
+	if ty != wire.OtherTy {
+		return fmt.Errorf("script %x is stored whole but is "+
+			"reconstructable as %v", ld.PkScript, ty)
+	}
+
+	return nil
+}
+
+// reserializeProof deserializes the proof stored for the given height and
+// returns it serialized again along with its leaf datas.
+func (idx *FlatUtreexoProofIndex) reserializeProof(height int32, raw []byte) (
+	[]byte, []wire.LeafData, error) {
+
+	r := bytes.NewReader(raw)
+	var buf bytes.Buffer
+
+	// The accumulator proof is only stored with the utreexo data when
+	// proofs are generated for every block.
+	ud := new(wire.UData)
+	if idx.proofGenInterVal == 1 {
+		err := ud.DeserializeCompact(r, udataSerializeBool, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ud.SerializeCompact(&buf, udataSerializeBool)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		err := ud.DeserializeCompactNoAccProof(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = ud.SerializeCompactNoAccProof(&buf)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The multi-block proof and the hashes of the leaf datas it proves
+	// follow at every proof generation interval.
+	if idx.proofGenInterVal != 1 && height%idx.proofGenInterVal == 0 {
+		multiUd := new(wire.UData)
+		err := multiUd.DeserializeCompact(r, udataSerializeBool, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = multiUd.SerializeCompact(&buf, udataSerializeBool)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var countBytes [4]byte
+		_, err = io.ReadFull(r, countBytes[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		count := binary.LittleEndian.Uint32(countBytes[:])
+		if uint64(r.Len()) < uint64(count)*chainhash.HashSize {
+			return nil, nil, fmt.Errorf("%d leaf data hashes don't "+
+				"fit in the remaining %d bytes", count, r.Len())
+		}
+		hashes := make([]byte, count*chainhash.HashSize)
+		_, err = io.ReadFull(r, hashes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buf.Write(countBytes[:])
+		buf.Write(hashes)
+	}
+
+	if r.Len() != 0 {
+		return nil, nil, fmt.Errorf("%d trailing bytes", r.Len())
+	}
+
+	return buf.Bytes(), ud.LeafDatas, nil
+}
+
+// checkProofCanonical returns an error if the proof stored for the given height
+// doesn't serialize back into the exact same bytes or if any of its leaf datas
+// have a script that isn't serialized the way it would be now.
+func (idx *FlatUtreexoProofIndex) checkProofCanonical(height int32, raw []byte) error {
+	reserialized, leaves, err := idx.reserializeProof(height, raw)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(raw, reserialized) {
+		offset := 0
+		for offset < len(raw) && offset < len(reserialized) &&
+			raw[offset] == reserialized[offset] {
+
+			offset++
+		}
+		return fmt.Errorf("stored as %d bytes but reserialized as %d "+
+			"bytes, differing from offset %d", len(raw),
+			len(reserialized), offset)
+	}
+
+	// The inputs of the block decide which scripts are reconstructable.
+	var txIns []*wire.TxIn
+	if idx.chain != nil {
+		block, err := idx.chain.BlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		txIns = blockchain.BlockToDelTxIns(block)
+	}
+	if len(txIns) != len(leaves) {
+		txIns = nil
+	}
+
+	for i := range leaves {
+		var txIn *wire.TxIn
+		if txIns != nil {
+			txIn = txIns[i]
+		}
+		err = checkLeafScript(&leaves[i], txIn)
+		if err != nil {
+			return fmt.Errorf("leaf data %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// AuditCanonicalProofs checks that the proofs stored for the blocks from start
+// to end, inclusive, serialize back into the exact same bytes they're stored as
+// and returns the ones that don't.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) AuditCanonicalProofs(start, end int32) (
+	[]NonCanonicalProof, error) {
+
+	tip := idx.proofState.BestHeight()
+	if start <= 0 || start > end || end > tip {
+		return nil, fmt.Errorf("invalid range of %d to %d. Start must be "+
+			"above 0, not above the end, and the end must not be "+
+			"above the tip height of %d", start, end, tip)
+	}
+
+	var found []NonCanonicalProof
+	for height := start; height <= end; height++ {
+		raw, err := idx.proofState.FetchData(height)
+		if err != nil {
+			return nil, err
+		}
+
+		err = idx.checkProofCanonical(height, raw)
+		if err != nil {
+			found = append(found, NonCanonicalProof{
+				Height: height,
+				Err:    err,
+			})
+		}
+	}
+
+	return found, nil
+}
+
+// quarantineProof copies the proof stored for the given height into the
+// quarantine directory and returns the path it was copied to.  Proofs that were
+// quarantined before for the same height are never overwritten.
+func (idx *FlatUtreexoProofIndex) quarantineProof(height int32, raw []byte) (
+	string, error) {
+
+	dir := flatFilePath(idx.dataDir, flatUtreexoQuarantineName)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d-%d.dat",
+			flatUtreexoProofName, height, i))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		_, err = f.Write(raw)
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		err = idx.fsync.syncFile(ArtifactQuarantine, f)
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+
+		return path, f.Close()
+	}
+}
+
+// RepairNonCanonicalProofs audits the proofs stored for the blocks from start
+// to end, inclusive, and regenerates the index from the lowest height with a
+// non-canonical proof.  Every non-canonical proof is copied into the
+// quarantine directory before it's regenerated.  The non-canonical proofs that
+// were found are returned.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) RepairNonCanonicalProofs(start, end int32) (
+	[]NonCanonicalProof, error) {
+
+	found, err := idx.AuditCanonicalProofs(start, end)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	for i := range found {
+		raw, err := idx.proofState.FetchData(found[i].Height)
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := idx.quarantineProof(found[i].Height, raw)
+		if err != nil {
+			return nil, err
+		}
+		found[i].QuarantinePath = path
+
+		log.Warnf("Quarantined the non-canonical utreexo proof for "+
+			"height %d to %s: %v", found[i].Height, path, found[i].Err)
+	}
+
+	err = idx.ReindexFrom(found[0].Height)
+	if err != nil {
+		return found, err
+	}
+
+	// Proofs that are still non-canonical after being regenerated are
+	// written that way by the current serializer.
+	remaining, err := idx.AuditCanonicalProofs(found[0].Height, end)
+	if err != nil {
+		return found, err
+	}
+	if len(remaining) != 0 {
+		return found, fmt.Errorf("the utreexo proof for height %d is "+
+			"still non-canonical after it was regenerated: %v",
+			remaining[0].Height, remaining[0].Err)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestAuditCanonicalProofs ensures that proofs that don't serialize back into
+// the same bytes are found and quarantined without touching the others.
+func TestAuditCanonicalProofs(t *testing.T) {
+	dataDir := t.TempDir()
+	proofState, err := loadFlatFileState(dataDir, flatUtreexoProofName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := &FlatUtreexoProofIndex{
+		proofGenInterVal: 2,
+		dataDir:          dataDir,
+		proofState:       *proofState,
+	}
+
+	p2pkh, _ := hex.DecodeString("76a9142cc2b87a28c8a097f48fcc1d468ced6e" +
+		"7d39958d88ac")
+	opReturn, _ := hex.DecodeString("6a0401020304")
+	newUData := func(height int32, script []byte) *wire.UData {
+		return &wire.UData{
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{uint64(height)},
+			},
+			LeafDatas: []wire.LeafData{{
+				Amount:                1000,
+				ReconstructablePkType: wire.OtherTy,
+				PkScript:              script,
+				Height:                height - 1,
+			}},
+		}
+	}
+
+	for height := int32(1); height <= 6; height++ {
+		script := opReturn
+		if height == 3 {
+			// Plant a leaf data that has its script stored whole
+			// even though it's reconstructable.
+			script = p2pkh
+		}
+		ud := newUData(height, script)
+
+		if height%idx.proofGenInterVal == 0 {
+			multiUd := &wire.UData{
+				AccProof: accumulator.BatchProof{
+					Targets: []uint64{1, 2},
+					Proof:   []accumulator.Hash{{1}, {2}},
+				},
+			}
+			dels := []accumulator.Hash{{3}, {4}}
+			err = idx.storeMultiBlockProof(height, ud, multiUd, dels)
+		} else if height == 5 {
+			// Plant a proof with a trailing byte.
+			var buf bytes.Buffer
+			err = ud.SerializeCompactNoAccProof(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteByte(0)
+			err = idx.proofState.StoreData(height, buf.Bytes())
+		} else {
+			err = idx.storeProof(height, true, ud)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := idx.AuditCanonicalProofs(1, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Height != 3 || found[1].Height != 5 {
+		t.Fatalf("expected non-canonical proofs at heights 3 and 5, "+
+			"got %v", found)
+	}
+
+	_, err = idx.AuditCanonicalProofs(1, 7)
+	if err == nil {
+		t.Fatal("expected an error for a range beyond the tip")
+	}
+
+	// Quarantining the same height twice keeps both copies.
+	raw, err := idx.proofState.FetchData(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i := 0; i < 2; i++ {
+		path, err := idx.quarantineProof(5, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+
+		quarantined, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(quarantined, raw) {
+			t.Fatalf("expected %x to be quarantined, got %x", raw,
+				quarantined)
+		}
+	}
+	if paths[0] == paths[1] {
+		t.Fatalf("expected the second quarantine to not overwrite %s",
+			paths[0])
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"github.com/utreexo/utreexod/wire"
+)
+
+// Capabilities describes everything that a utreexo proof index is able to
+// serve so that clients are able to make their routing and format decisions up
+// front.
+type Capabilities struct {
+	// LowHeight and HighHeight are the range of block heights that the
+	// utreexo proofs are served for.
+	LowHeight  int32
+	HighHeight int32
+
+	// Formats are the utreexo proof formats that are served.
+	Formats wire.UtreexoProofFormat
+
+	// MultiBlockInterval is the interval of the multi-block proofs.  It's
+	// 0 if multi-block proofs aren't served.
+	MultiBlockInterval int32
+
+	// OnDemand is whether proofs for arbitrary utxos are generated on
+	// demand.
+	OnDemand bool
+
+	// MaxResponseSize is the maximum size in bytes of a single response.
+	MaxResponseSize uint64
+
+	// HashFunction is the hash function used by the accumulator.
+	HashFunction wire.AccumulatorHash
+}
+
+// MsgUtreexoCaps returns the capabilities as a utreexocaps message.
+func (c *Capabilities) MsgUtreexoCaps() *wire.MsgUtreexoCaps {
+	return &wire.MsgUtreexoCaps{
+		LowHeight:          c.LowHeight,
+		HighHeight:         c.HighHeight,
+		Formats:            c.Formats,
+		MultiBlockInterval: c.MultiBlockInterval,
+		OnDemand:           c.OnDemand,
+		MaxResponseSize:    c.MaxResponseSize,
+		HashFunction:       c.HashFunction,
+	}
+}
+
+// maxResponseSize returns the maximum size of a single response given the
+// proof generation budget.
+func maxResponseSize(budget *ProofGenBudget) uint64 {
+	if budget != nil {
+		stats := budget.Stats()
+		if stats.MaxCallBytes > 0 {
+			return stats.MaxCallBytes
+		}
+		if stats.MaxBytes < wire.MaxMessagePayload {
+			return stats.MaxBytes
+		}
+	}
+
+	return wire.MaxMessagePayload
+}
+
+// Capabilities returns everything that the index is able to serve.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) Capabilities() (*Capabilities, error) {
+	caps := &Capabilities{
+		LowHeight:       0,
+		HighHeight:      idx.proofState.BestHeight(),
+		OnDemand:        true,
+		MaxResponseSize: maxResponseSize(idx.proofGenBudget),
+		HashFunction:    wire.AccHashSHA512_256,
+	}
+
+	// The accumulator proofs are only kept for the multi-block proofs
+	// when the proofs aren't generated for every block.
+	if idx.proofGenInterVal == 1 {
+		caps.Formats = wire.UPFBlockProof
+	} else {
+		caps.Formats = wire.UPFMultiBlockProof
+		caps.MultiBlockInterval = idx.proofGenInterVal
+	}
+
+	return caps, nil
+}
+
+// Capabilities returns everything that the index is able to serve.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) Capabilities() (*Capabilities, error) {
+	tip, err := idx.tipHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Capabilities{
+		LowHeight:       0,
+		HighHeight:      tip,
+		Formats:         wire.UPFBlockProof,
+		OnDemand:        true,
+		MaxResponseSize: maxResponseSize(idx.proofGenBudget),
+		HashFunction:    wire.AccHashSHA512_256,
+	}, nil
+}
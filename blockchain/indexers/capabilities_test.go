@@ -0,0 +1,33 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/wire"
+)
+
+func TestMaxResponseSize(t *testing.T) {
+	perCall := NewProofGenBudget(1<<20, time.Second)
+	perCall.SetMaxCallBytes(1 << 10)
+
+	tests := []struct {
+		name   string
+		budget *ProofGenBudget
+		want   uint64
+	}{
+		{"no budget", nil, wire.MaxMessagePayload},
+		{"small budget", NewProofGenBudget(1<<20, time.Second), 1 << 20},
+		{"large budget", NewProofGenBudget(1<<30, time.Second), wire.MaxMessagePayload},
+		{"per call limit", perCall, 1 << 10},
+	}
+	for _, test := range tests {
+		if got := maxResponseSize(test.budget); got != test.want {
+			t.Errorf("%s: expected %d, got %d", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,659 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// DefaultCatchUpWorkers is how many of the indexes are caught up to the
+	// chain tip at the same time by default.
+	DefaultCatchUpWorkers = 4
+
+	// DefaultCatchUpFetchers is how many blocks are loaded at the same
+	// time for each of the indexes that are caught up by default.
+	DefaultCatchUpFetchers = 4
+
+	// DefaultCatchUpQueueDepth is how many blocks are loaded ahead of the
+	// one that's connected to the indexes that are caught up by default.
+	DefaultCatchUpQueueDepth = 16
+)
+
+// CatchUpError is returned by Init when connecting a block to one of the
+// indexes fails while it's caught up to the chain tip.
+type CatchUpError struct {
+	// Index is the name of the index that failed and Height is the height
+	// of the block that it failed to connect.
+	Index  string
+	Height int32
+
+	// Err is why it failed.
+	Err error
+}
+
+// Error returns the error as a human-readable string.
+func (e *CatchUpError) Error() string {
+	return fmt.Sprintf("unable to catch up the %s at height %d: %v",
+		e.Index, e.Height, e.Err)
+}
+
+// Unwrap returns why the index failed.
+func (e *CatchUpError) Unwrap() error {
+	return e.Err
+}
+
+// catchUpLane is a set of indexes that are caught up together.  The blocks are
+// connected to each of them in the order of the enabled indexes before the
+// next block is, just like when the blocks are connected to the chain.  The
+// lanes don't depend on one another so they're caught up at the same time.
+type catchUpLane struct {
+	// positions are the positions of the indexes of the lane in the
+	// enabled indexes.
+	positions []int
+
+	// fanOut is whether the block is connected to all the indexes of the
+	// lane at the same time instead of in their order.  It's only set for
+	// the lanes of indexes that don't depend on one another.
+	fanOut bool
+}
+
+// name returns the names of the indexes of the lane.
+func (l *catchUpLane) name(indexes []Indexer) string {
+	names := make([]string, len(l.positions))
+	for i, pos := range l.positions {
+		names[i] = indexes[pos].Name()
+	}
+
+	return strings.Join(names, " and ")
+}
+
+// catchUpDependent returns whether the index depends on what the other one
+// stores for a block:
+//
+//   - The address index refers to the blocks by the IDs that the transaction
+//     index gives them.
+//   - The undo blocks of the utreexo proof index that keeps them in the flat
+//     utreexo proof index are only there once the flat one stored them.
+func catchUpDependent(indexer, other Indexer) bool {
+	switch idx := indexer.(type) {
+	case *AddrIndex:
+		_, ok := other.(*TxIndex)
+		return ok
+
+	case *UtreexoProofIndex:
+		flat, ok := other.(*FlatUtreexoProofIndex)
+		return ok && idx.sharedUndo == flat
+	}
+
+	return false
+}
+
+// catchUpFannedOut returns whether the block is connected to both indexes at
+// the same time when they're caught up.  The two utreexo proof indexes do the
+// same work for every block, so they're caught up from the same blocks with
+// each of them modifying its own accumulator on its own core.  They can't be
+// when the utreexo proof index keeps its undo blocks in the flat one.
+func catchUpFannedOut(indexer, other Indexer) bool {
+	switch idx := indexer.(type) {
+	case *UtreexoProofIndex:
+		_, ok := other.(*FlatUtreexoProofIndex)
+		return ok && idx.sharedUndo == nil
+
+	case *FlatUtreexoProofIndex:
+		return catchUpFannedOut(other, idx)
+	}
+
+	return false
+}
+
+// catchUpLanes returns the lanes of the indexes that are behind the tip.  Each
+// index is its own lane except for the ones that depend on one another, which
+// are kept in step in the same lane, and the ones whose blocks are fanned out
+// to them.
+func catchUpLanes(indexes []Indexer, heights []int32, tip int32) []*catchUpLane {
+	var lanes []*catchUpLane
+	laneOf := make(map[Indexer]*catchUpLane)
+	for i, indexer := range indexes {
+		if heights[i] >= tip {
+			continue
+		}
+
+		var lane *catchUpLane
+		var fanOut bool
+		for _, other := range indexes[:i] {
+			if laneOf[other] == nil {
+				continue
+			}
+			if catchUpDependent(indexer, other) ||
+				catchUpDependent(other, indexer) {
+
+				lane = laneOf[other]
+				fanOut = false
+				break
+			}
+			if lane == nil && catchUpFannedOut(indexer, other) {
+				lane = laneOf[other]
+				fanOut = true
+			}
+		}
+		if lane == nil {
+			lane = &catchUpLane{}
+			lanes = append(lanes, lane)
+		}
+		lane.positions = append(lane.positions, i)
+		lane.fanOut = fanOut
+		laneOf[indexer] = lane
+	}
+
+	return lanes
+}
+
+// catchUpUpdate runs fn in a database transaction like the Update of the
+// database does, except that the transaction is only committed with commitMtx
+// held.  The cache of the database isn't safe to read from while a transaction
+// commits to it, so the reads of the other lanes hold commitMtx for reading.
+func catchUpUpdate(db database.DB, commitMtx *sync.RWMutex,
+	fn func(database.Tx) error) error {
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	// Release the transaction if fn panics so that the database remains
+	// usable.
+	defer func() {
+		if r := recover(); r != nil {
+			_ = tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	commitMtx.Lock()
+	defer commitMtx.Unlock()
+
+	return tx.Commit()
+}
+
+// catchUpBlock is a block that's loaded for the indexes of a lane along with
+// what they're notified of it.
+type catchUpBlock struct {
+	block *btcutil.Block
+
+	// notifications are the notifications of the block for the indexes of
+	// the lane in the order of its positions.  It's nil for the indexes
+	// that already have the block.
+	notifications []*BlockNotification
+
+	// err is why the block couldn't be loaded.
+	err error
+}
+
+// fetchCatchUpBlock loads the block at the given height and gathers the
+// notifications of the indexes of the lane that don't have it, which are the
+// ones whose starting heights are below it.  The spent outputs are only loaded
+// once an index that requires them is reached, just like when the blocks are
+// connected to the chain.  The database is only read with commitMtx held for
+// reading.
+func (m *Manager) fetchCatchUpBlock(chain *blockchain.BlockChain,
+	lane *catchUpLane, starts []int32, height int32,
+	commitMtx *sync.RWMutex, interrupt <-chan struct{}) (*catchUpBlock, error) {
+
+	// Load the block for the height since it is required to index it.
+	commitMtx.RLock()
+	block, err := chain.BlockByHeight(height)
+	commitMtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.ioLimiter.Wait(1, uint64(block.MsgBlock().SerializeSize()),
+		interrupt)
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := &catchUpBlock{
+		block:         block,
+		notifications: make([]*BlockNotification, len(lane.positions)),
+	}
+	var spentTxos []blockchain.SpentTxOut
+	var n *BlockNotification
+	for j, i := range lane.positions {
+		// Skip indexes that don't need to be updated with this block.
+		if starts[j] >= height {
+			continue
+		}
+
+		// When the index requires all of the referenced txouts and they
+		// haven't been loaded yet, they need to be retrieved from the
+		// spend journal.
+		commitMtx.RLock()
+		if spentTxos == nil && indexNeedsInputs(m.enabledIndexes[i]) {
+			spentTxos, err = chain.FetchSpendJournal(block)
+			n = nil
+		}
+		if err == nil && n == nil {
+			n, err = m.blockNotification(block, spentTxos, true)
+		}
+		commitMtx.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		fetched.notifications[j] = n
+	}
+
+	// Hash the leaves of the utreexo proof indexes here, where the blocks
+	// are spread over the fetchers, rather than when the blocks are
+	// connected one at a time.
+	for j, i := range lane.positions {
+		n := fetched.notifications[j]
+		schedule, hasher, ok := catchUpLeafSchedule(m.enabledIndexes[i])
+		if n == nil || !ok || n.leaves != nil {
+			continue
+		}
+		n.leaves, err = newUtreexoLeaves(n, schedule, hasher)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fetched, nil
+}
+
+// catchUpLeafSchedule returns the leaf commitment schedule and the hasher that
+// the index hashes the leaves of the utreexo accumulator with, or false if it
+// doesn't have an accumulator.
+func catchUpLeafSchedule(indexer Indexer) (wire.LeafCommitmentSchedule,
+	*wire.LeafHasher, bool) {
+
+	switch idx := indexer.(type) {
+	case *UtreexoProofIndex:
+		return idx.chainParams.LeafCommitments, idx.leafHasher, true
+
+	case *FlatUtreexoProofIndex:
+		return idx.chainParams.LeafCommitments, idx.leafHasher, true
+	}
+
+	return nil, nil, false
+}
+
+// prefetchCatchUp loads the blocks from start to the tip for the indexes of the
+// lane on the given number of fetchers and returns them in the order of their
+// heights.  At most depth blocks are loaded ahead of the one that's read so
+// that the loading waits for the connecting of the blocks when it's faster.
+// The fetchers stop once done or quit is closed and the returned channel is
+// closed once all of them returned.
+func (m *Manager) prefetchCatchUp(chain *blockchain.BlockChain,
+	lane *catchUpLane, starts []int32, start, tip int32,
+	commitMtx *sync.RWMutex, fetchers, depth int,
+	done, quit, interrupt <-chan struct{}) <-chan chan *catchUpBlock {
+
+	type fetchJob struct {
+		height int32
+		result chan *catchUpBlock
+	}
+
+	// Every block has its own result so that the fetchers can load them
+	// in any order while they're read in the order of their heights.
+	results := make(chan chan *catchUpBlock, depth)
+	jobs := make(chan fetchJob)
+	var wg sync.WaitGroup
+	wg.Add(fetchers)
+	for i := 0; i < fetchers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				fetched, err := m.fetchCatchUpBlock(chain, lane,
+					starts, job.height, commitMtx, interrupt)
+				if err != nil {
+					fetched = &catchUpBlock{err: err}
+				}
+				job.result <- fetched
+			}
+		}()
+	}
+
+	go func() {
+		defer func() {
+			close(jobs)
+			wg.Wait()
+			close(results)
+		}()
+
+		for height := start; height <= tip; height++ {
+			job := fetchJob{
+				height: height,
+				result: make(chan *catchUpBlock, 1),
+			}
+			select {
+			case results <- job.result:
+			case <-done:
+				return
+			case <-quit:
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// catchUpLane connects the blocks up to the tip to the indexes of the lane
+// that don't have them yet.  The database is only read with commitMtx held for
+// reading.  It stops early without an error once quit is closed.
+//
+// The blocks go through the stages of a pipeline:
+//
+//   - Load: up to catchUpFetchers load the blocks and their spent outputs at
+//     the same time, at most catchUpQueueDepth of them ahead of the one that's
+//     connected.
+//   - Hash: the same fetchers turn the outputs that the blocks spend and
+//     create into the leaves of the utreexo accumulators and hash them.
+//   - Prove and modify: the utreexo proof indexes prove the spent leaves and
+//     modify their accumulators one block at a time.
+//   - Serialize and write: the proof of a block is serialized and written to
+//     the flat files or the database while the accumulator is modified with
+//     the block, and the undo block once it's modified.
+//
+// Without any fetchers every block is loaded and hashed right before it's
+// connected.
+func (m *Manager) catchUpLane(chain *blockchain.BlockChain, lane *catchUpLane,
+	heights []int32, tip int32, commitMtx *sync.RWMutex,
+	quit, interrupt <-chan struct{}) error {
+
+	start := tip
+	starts := make([]int32, len(lane.positions))
+	for j, pos := range lane.positions {
+		starts[j] = heights[pos]
+		if heights[pos] < start {
+			start = heights[pos]
+		}
+	}
+
+	progressLogger := newBlockProgressLogger(fmt.Sprintf("Caught up the %s "+
+		"by", lane.name(m.enabledIndexes)), log)
+
+	// next returns the block at the given height.  It's nil if the
+	// fetchers were stopped by quit.
+	next := func(height int32) (*catchUpBlock, error) {
+		return m.fetchCatchUpBlock(chain, lane, starts, height,
+			commitMtx, interrupt)
+	}
+	if m.catchUpFetchers > 0 {
+		depth := m.catchUpQueueDepth
+		if depth < m.catchUpFetchers {
+			depth = m.catchUpFetchers
+		}
+
+		// The fetchers are stopped and waited for before returning so
+		// that nothing reads the database once the lane is done.
+		done := make(chan struct{})
+		results := m.prefetchCatchUp(chain, lane, starts, start+1, tip,
+			commitMtx, m.catchUpFetchers, depth, done, quit,
+			interrupt)
+		defer func() {
+			close(done)
+			for range results {
+			}
+		}()
+
+		next = func(height int32) (*catchUpBlock, error) {
+			result, ok := <-results
+			if !ok {
+				return nil, nil
+			}
+			fetched := <-result
+			return fetched, fetched.err
+		}
+	}
+
+	for height := start + 1; height <= tip; height++ {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+
+		fetched, err := next(height)
+		if err != nil {
+			return err
+		}
+		if fetched == nil {
+			return nil
+		}
+
+		if interruptRequested(interrupt) {
+			return errInterruptRequested
+		}
+
+		if lane.fanOut {
+			err := m.connectFannedOut(lane, fetched, height, commitMtx)
+			if err != nil {
+				return err
+			}
+			for j, i := range lane.positions {
+				if fetched.notifications[j] != nil {
+					heights[i] = height
+					m.syncProgress.caughtUp(i, height)
+				}
+			}
+			progressLogger.LogBlockHeight(fetched.block)
+			continue
+		}
+
+		// Connect the block for all indexes that need it.
+		for j, i := range lane.positions {
+			n := fetched.notifications[j]
+			if n == nil {
+				continue
+			}
+
+			indexer := m.enabledIndexes[i]
+			err := catchUpUpdate(m.db, commitMtx, func(dbTx database.Tx) error {
+				return dbIndexConnectBlock(dbTx, indexer, n)
+			})
+			if err != nil {
+				return &CatchUpError{
+					Index:  indexer.Name(),
+					Height: height,
+					Err:    err,
+				}
+			}
+			heights[i] = height
+			m.syncProgress.caughtUp(i, height)
+		}
+
+		// Log indexing progress.
+		progressLogger.LogBlockHeight(fetched.block)
+	}
+
+	return nil
+}
+
+// connectFannedOut connects the block to all the indexes of the fan-out lane
+// that don't have it at the same time in a single database transaction, which
+// they share through a lockedTx.  The block is either connected to all of them
+// or to none: when one of them fails, the block is disconnected from the ones
+// that connected it before the transaction is rolled back so that their
+// accumulators stay at their tips.
+func (m *Manager) connectFannedOut(lane *catchUpLane, fetched *catchUpBlock,
+	height int32, commitMtx *sync.RWMutex) error {
+
+	// The block and its transactions cache their hashes on first use, so
+	// they're computed here rather than by the indexes at the same time.
+	block := fetched.block
+	block.Hash()
+	for _, tx := range block.Transactions() {
+		tx.Hash()
+	}
+
+	var failed Indexer
+	err := catchUpUpdate(m.db, commitMtx, func(dbTx database.Tx) error {
+		lockedTx := newLockedTx(dbTx)
+		errs := make([]error, len(lane.positions))
+		var wg sync.WaitGroup
+		for j, i := range lane.positions {
+			n := fetched.notifications[j]
+			if n == nil {
+				continue
+			}
+
+			wg.Add(1)
+			go func(j int, indexer Indexer) {
+				defer wg.Done()
+				errs[j] = dbIndexConnectBlock(lockedTx, indexer, n)
+			}(j, m.enabledIndexes[i])
+		}
+		wg.Wait()
+
+		var failErr error
+		for j, err := range errs {
+			if err != nil {
+				failed = m.enabledIndexes[lane.positions[j]]
+				failErr = err
+				break
+			}
+		}
+		if failErr == nil {
+			return nil
+		}
+
+		// Take the block back out of the accumulators of the indexes
+		// that connected it.  Their entries are rolled back along with
+		// the transaction.
+		for j := len(lane.positions) - 1; j >= 0; j-- {
+			n := fetched.notifications[j]
+			if n == nil || errs[j] != nil {
+				continue
+			}
+
+			indexer := m.enabledIndexes[lane.positions[j]]
+			dn, err := m.blockNotification(block, n.SpentTxOuts, false)
+			if err == nil {
+				err = dbIndexDisconnectBlock(dbTx, indexer, dn)
+			}
+			if err != nil {
+				return fmt.Errorf("%w (the block couldn't be "+
+					"disconnected from the %s again: %v)",
+					failErr, indexer.Name(), err)
+			}
+		}
+
+		return failErr
+	})
+	if err != nil {
+		name := lane.name(m.enabledIndexes)
+		if failed != nil {
+			name = failed.Name()
+		}
+		return &CatchUpError{Index: name, Height: height, Err: err}
+	}
+
+	return nil
+}
+
+// catchUp connects the blocks up to the tip to the enabled indexes that don't
+// have them yet.  The lanes of the indexes are caught up by up to catchUpWorkers
+// at the same time and the first of them to fail stops the others.
+//
+// The database only allows one write transaction at a time, so it's the
+// connecting of a block to an index in one lane, like writing the flat files of
+// the proofs, that overlaps the loading of the blocks and their spent outputs
+// in the others.  The utreexo proof indexes share a transaction instead so that
+// both of them modify their accumulators at the same time.
+func (m *Manager) catchUp(chain *blockchain.BlockChain, heights []int32,
+	tip int32, interrupt <-chan struct{}) error {
+
+	lanes := catchUpLanes(m.enabledIndexes, heights, tip)
+	workers := m.catchUpWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(lanes) {
+		workers = len(lanes)
+	}
+
+	work := make(chan *catchUpLane, len(lanes))
+	for _, lane := range lanes {
+		work <- lane
+	}
+	close(work)
+
+	var (
+		commitMtx sync.RWMutex
+		errMtx    sync.Mutex
+		firstErr  error
+		quit      = make(chan struct{})
+		wg        sync.WaitGroup
+	)
+	fail := func(err error) {
+		errMtx.Lock()
+		defer errMtx.Unlock()
+
+		if firstErr == nil {
+			firstErr = err
+			close(quit)
+		}
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for lane := range work {
+				err := m.catchUpLane(chain, lane, heights, tip,
+					&commitMtx, quit, interrupt)
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// SetCatchUpWorkers sets how many of the indexes are caught up to the chain tip
+// at the same time.  The indexes that depend on one another, like the address
+// index on the transaction index, are always caught up together.  Values below 1
+// catch up one index at a time.  It must be set before the manager is
+// initialized.
+func (m *Manager) SetCatchUpWorkers(workers int) {
+	m.catchUpWorkers = workers
+}
+
+// SetCatchUpPipeline sets how many blocks are loaded at the same time for each
+// of the indexes that are caught up to the chain tip and how many of them are
+// loaded ahead of the one that's connected.  The depth is raised to the number
+// of fetchers if it's below it.  No fetchers load every block right before it's
+// connected.  It must be set before the manager is initialized.
+func (m *Manager) SetCatchUpPipeline(fetchers, depth int) {
+	m.catchUpFetchers = fetchers
+	m.catchUpQueueDepth = depth
+}
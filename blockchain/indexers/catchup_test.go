@@ -0,0 +1,733 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// errCatchUpTest is the error that failingIndexer fails with.
+var errCatchUpTest = errors.New("catch up test failure")
+
+// failingIndexer is a fakeRebuilder that fails to connect the block at the
+// given height.
+type failingIndexer struct {
+	*fakeRebuilder
+	failHeight int32
+}
+
+func (idx *failingIndexer) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	if n.Height == idx.failHeight {
+		return errCatchUpTest
+	}
+	return idx.fakeRebuilder.ConnectBlock(dbTx, n)
+}
+
+// newCatchUpChain returns the chain in the database that isn't connected to any
+// indexes.
+func newCatchUpChain(db database.DB, params *chaincfg.Params) (
+	*blockchain.BlockChain, error) {
+
+	return blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+	})
+}
+
+// catchUpTestChain returns a chain of the given number of blocks that isn't
+// connected to any indexes.  Every block spends all the outputs of the one
+// before it, so each of them has a transaction more than the one before it.
+func catchUpTestChain(db database.DB, params *chaincfg.Params, numBlocks int) (
+	*blockchain.BlockChain, []*btcutil.Block, error) {
+
+	chain, err := newCatchUpChain(db, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	var blocks []*btcutil.Block
+	for i := 0; i < numBlocks; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+		blocks = append(blocks, tip)
+	}
+
+	return chain, blocks, nil
+}
+
+// TestCatchUpLanes ensures that every index that's behind is caught up on its
+// own except for the ones that depend on one another.
+func TestCatchUpLanes(t *testing.T) {
+	flat := &FlatUtreexoProofIndex{}
+	shared := &UtreexoProofIndex{sharedUndo: flat}
+	txIndex := &TxIndex{}
+	addrIndex := &AddrIndex{}
+	cfIndex := &CfIndex{}
+
+	tests := []struct {
+		name    string
+		indexes []Indexer
+		heights []int32
+		want    [][]int
+
+		// fanOut are the lanes whose blocks are fanned out.
+		fanOut []bool
+	}{
+		{
+			name:    "independent",
+			indexes: []Indexer{txIndex, cfIndex},
+			heights: []int32{0, 0},
+			want:    [][]int{{0}, {1}},
+		},
+		{
+			name:    "fanned out",
+			indexes: []Indexer{&UtreexoProofIndex{}, txIndex, flat},
+			heights: []int32{0, 0, 0},
+			want:    [][]int{{0, 2}, {1}},
+			fanOut:  []bool{true, false},
+		},
+		{
+			name:    "fanned out behind",
+			indexes: []Indexer{flat, &UtreexoProofIndex{}},
+			heights: []int32{3, 0},
+			want:    [][]int{{0, 1}},
+			fanOut:  []bool{true},
+		},
+		{
+			name:    "shared undo",
+			indexes: []Indexer{shared, txIndex, flat, cfIndex},
+			heights: []int32{0, 0, 0, 0},
+			want:    [][]int{{0, 2}, {1}, {3}},
+		},
+		{
+			name:    "address index",
+			indexes: []Indexer{txIndex, cfIndex, addrIndex},
+			heights: []int32{0, 0, 0},
+			want:    [][]int{{0, 2}, {1}},
+		},
+		{
+			name:    "caught up",
+			indexes: []Indexer{shared, txIndex, flat},
+			heights: []int32{5, 10, 0},
+			want:    [][]int{{0, 2}},
+		},
+	}
+
+	for _, test := range tests {
+		var got [][]int
+		fanOut := make([]bool, len(test.want))
+		for i, lane := range catchUpLanes(test.indexes, test.heights, 10) {
+			got = append(got, lane.positions)
+			if i < len(fanOut) {
+				fanOut[i] = lane.fanOut
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected lanes %v, got %v", test.name,
+				test.want, got)
+		}
+		wantFanOut := test.fanOut
+		if wantFanOut == nil {
+			wantFanOut = make([]bool, len(test.want))
+		}
+		if !reflect.DeepEqual(fanOut, wantFanOut) {
+			t.Errorf("%s: expected fanned out lanes %v, got %v",
+				test.name, wantFanOut, fanOut)
+		}
+	}
+}
+
+// TestCatchUpConcurrent ensures that the indexes that are caught up at the same
+// time end up with every block of the chain.
+func TestCatchUpConcurrent(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestCatchUpConcurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	const numBlocks = 30
+	chain, blocks, err := catchUpTestChain(db, &params, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// There are fewer workers than indexes so that some of them wait for
+	// the others.
+	_, indexes, err := initIndexes(1, dbPath, &db, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes = append(indexes, secondaryTestIndexes(db, &params)...)
+	m := NewManager(db, indexes)
+	m.SetCatchUpWorkers(3)
+	err = m.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkIndexTips(db, indexes, repeatHeight(numBlocks, indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := []proofStore{indexes[0].(proofStore), indexes[1].(proofStore)}
+	for _, block := range blocks {
+		if len(block.Transactions()) > 1 {
+			err = checkSecondaryEntries(indexes, block)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		id := &BlockID{Height: block.Height(), Hash: *block.Hash()}
+		result, err := compareProofStores(id, stores, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Agree() {
+			t.Fatalf("the proof indexes differ: %v", result.String())
+		}
+	}
+}
+
+// TestCatchUpFailure ensures that an index that fails to be caught up fails
+// Init with the index and the height of the block it failed at.
+func TestCatchUpFailure(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestCatchUpFailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	chain, _, err := catchUpTestChain(db, &params, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := &failingIndexer{
+		fakeRebuilder: &fakeRebuilder{key: []byte("failing")},
+		failHeight:    10,
+	}
+	m := NewManager(db, []Indexer{NewTxIndex(db), failing})
+	err = m.Init(chain, nil)
+	if !errors.Is(err, errCatchUpTest) {
+		t.Fatalf("expected the failure of the index, got %v", err)
+	}
+	var catchUpErr *CatchUpError
+	if !errors.As(err, &catchUpErr) || catchUpErr.Index != failing.Name() ||
+		catchUpErr.Height != 10 {
+
+		t.Fatalf("expected the failure at height 10 of the %s, got %v",
+			failing.Name(), err)
+	}
+
+	// The index is left at the block before the one it failed at.
+	err = checkIndexTips(db, []Indexer{failing}, []int32{9})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCatchUpFanOutFailure ensures that a block that one of the utreexo proof
+// indexes fails to connect while it's fanned out to both of them is connected
+// to neither, and that both of them are caught up from there on the next start.
+func TestCatchUpFanOutFailure(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestCatchUpFanOutFailure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	const numBlocks = 30
+	chain, _, err := catchUpTestChain(db, &params, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail writing the proof of the block at the height to the flat
+	// utreexo proof index.  The proofs are written from the first block
+	// on.
+	const failHeight = 17
+	_, indexes, err := initIndexes(1, dbPath, &db, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbIdx := indexes[0].(*UtreexoProofIndex)
+	flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+	var proofs int32
+	flatIdx.proofState.failpoint = func(write flatFileWrite, buf []byte) (int, error) {
+		if write == flatWriteEntry {
+			proofs++
+			if proofs == failHeight {
+				return 0, errCatchUpTest
+			}
+		}
+		return len(buf), nil
+	}
+	m := NewManager(db, indexes)
+	err = m.Init(chain, nil)
+	var catchUpErr *CatchUpError
+	if !errors.Is(err, errCatchUpTest) || !errors.As(err, &catchUpErr) ||
+		catchUpErr.Index != flatIdx.Name() ||
+		catchUpErr.Height != failHeight {
+
+		t.Fatalf("expected the failure at height %d of the %s, got %v",
+			failHeight, flatIdx.Name(), err)
+	}
+
+	// Neither index has the block and the utreexo proof index took it back
+	// out of its accumulator.
+	err = checkIndexTips(db, indexes, repeatHeight(failHeight-1, indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dbIdx.utreexoState.state.GetRoots(),
+		flatIdx.utreexoState.state.GetRoots()) {
+
+		t.Fatal("the roots of the indexes differ after the failure")
+	}
+
+	_, indexes, err = initIndexes(1, dbPath, &db, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = NewManager(db, indexes)
+	err = m.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkIndexTips(db, indexes, repeatHeight(numBlocks, indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compareUtreexoIdx(1, numBlocks+1, chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexes[0].(*UtreexoProofIndex).utreexoState.state.GetRoots(),
+		indexes[1].(*FlatUtreexoProofIndex).utreexoState.state.GetRoots()) {
+
+		t.Fatal("the roots of the indexes differ")
+	}
+}
+
+// TestCatchUpInterrupt ensures that interrupting the catch up of the indexes
+// leaves the flat utreexo proof index at the last block it connected with its
+// flat files and utreexo state at the same block, and that the next start
+// resumes every index from where it was interrupted.
+func TestCatchUpInterrupt(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestCatchUpInterrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	const numBlocks = 30
+	chain, blocks, err := catchUpTestChain(db, &params, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the catch up while the proof of the block at the height is
+	// written to the flat utreexo proof index.
+	const interruptHeight = 12
+	_, indexes, err := initIndexes(1, dbPath, &db, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The proofs are written from the first block on.
+	flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+	interrupt := make(chan struct{})
+	var proofs int32
+	flatIdx.proofState.failpoint = func(write flatFileWrite, buf []byte) (int, error) {
+		if write == flatWriteEntry {
+			proofs++
+			if proofs == interruptHeight {
+				close(interrupt)
+			}
+		}
+		return len(buf), nil
+	}
+	indexes = append(indexes, secondaryTestIndexes(db, &params)...)
+	m := NewManager(db, indexes)
+	err = m.Init(chain, interrupt)
+	if !errors.Is(err, errInterruptRequested) {
+		t.Fatalf("expected the catch up to be interrupted, got %v", err)
+	}
+
+	// The flat utreexo proof index has everything for the block it was
+	// interrupted at and nothing past it.
+	err = checkIndexTips(db, indexes[1:2], []int32{interruptHeight})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := flatIdx.committedHeight(); got != interruptHeight {
+		t.Fatalf("the flat files are at height %d, want %d", got,
+			interruptHeight)
+	}
+	state, err := readForestHeight(utreexoBasePath(flatIdx.utreexoState.config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != interruptHeight {
+		t.Fatalf("the utreexo state was flushed at height %d, want %d",
+			state, interruptHeight)
+	}
+
+	// The next start resumes the indexes and only connects the blocks that
+	// they didn't have yet.
+	_, indexes, err = initIndexes(1, dbPath, &db, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes = append(indexes, secondaryTestIndexes(db, &params)...)
+	m = NewManager(db, indexes)
+	err = m.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkIndexTips(db, indexes, repeatHeight(numBlocks, indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbIdx := indexes[0].(*UtreexoProofIndex)
+	flatIdx = indexes[1].(*FlatUtreexoProofIndex)
+	if got := flatIdx.Stats().Total.Blocks; got != numBlocks-interruptHeight {
+		t.Fatalf("connected %d blocks after the restart, want %d", got,
+			numBlocks-interruptHeight)
+	}
+	err = compareUtreexoIdx(1, numBlocks+1, chain, []Indexer{dbIdx, flatIdx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dbIdx.utreexoState.state.GetRoots(),
+		flatIdx.utreexoState.state.GetRoots()) {
+
+		t.Fatal("the roots of the indexes differ")
+	}
+	for _, block := range blocks {
+		if len(block.Transactions()) > 1 {
+			err = checkSecondaryEntries(indexes, block)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// digestBucket writes every key and value of the bucket and its nested buckets
+// to the hash, prefixed by the keys of the buckets they're in.
+func digestBucket(h hash.Hash, bucket database.Bucket, prefix []byte) error {
+	err := bucket.ForEach(func(k, v []byte) error {
+		fmt.Fprintf(h, "%x/%x=%x\n", prefix, k, v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var nested [][]byte
+	err = bucket.ForEachBucket(func(k []byte) error {
+		nested = append(nested, append([]byte(nil), k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range nested {
+		path := append(append(append([]byte(nil), prefix...), '/'), k...)
+		err = digestBucket(h, bucket.Bucket(k), path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// catchUpDigest returns the digest of everything that's in the database and of
+// the flat files of the flat utreexo proof index in the data directory.
+func catchUpDigest(db database.DB, dataDir string) ([sha256.Size]byte, error) {
+	h := sha256.New()
+	err := db.View(func(dbTx database.Tx) error {
+		return digestBucket(h, dbTx.Metadata(), nil)
+	})
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	// The files are walked in lexical order.
+	err = filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dataDir, path)
+		if err != nil {
+			return err
+		}
+		dir := strings.Split(rel, string(filepath.Separator))[0]
+		if !info.Mode().IsRegular() ||
+			!strings.HasSuffix(dir, "_"+flatFileNameSuffix) {
+
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%s\n", filepath.ToSlash(rel))
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest, nil
+}
+
+// catchUpCopy catches up the indexes of a copy of the chain in the src
+// directory with the given catch up pipeline and returns the digest of what
+// they stored.
+func catchUpCopy(src, dst string, params *chaincfg.Params, fetchers,
+	depth int) ([sha256.Size]byte, error) {
+
+	var digest [sha256.Size]byte
+	err := copyTree(dst, src)
+	if err != nil {
+		return digest, err
+	}
+	db, err := database.Open(testDbType, dst, blockDataNet)
+	if err != nil {
+		return digest, err
+	}
+	defer db.Close()
+
+	chain, err := newCatchUpChain(db, params)
+	if err != nil {
+		return digest, err
+	}
+	_, indexes, err := initIndexes(1, dst, &db, params)
+	if err != nil {
+		return digest, err
+	}
+	indexes = append(indexes, secondaryTestIndexes(db, params)...)
+	m := NewManager(db, indexes)
+	m.SetCatchUpPipeline(fetchers, depth)
+	err = m.Init(chain, nil)
+	if err != nil {
+		return digest, err
+	}
+
+	return catchUpDigest(db, dst)
+}
+
+// TestCatchUpPipeline ensures that the indexes that are caught up with blocks
+// that are loaded ahead of the one that's connected store exactly what they do
+// when every block is loaded right before it's connected.
+func TestCatchUpPipeline(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestCatchUpPipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	chain, _, err := catchUpTestChain(db, &params, 40)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	err = chain.FlushCachedState(blockchain.FlushRequired)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		fetchers int
+		depth    int
+	}{
+		{name: "sequential", fetchers: 0, depth: 0},
+		{name: "one fetcher", fetchers: 1, depth: 1},
+		{name: "depth below fetchers", fetchers: 4, depth: 2},
+		{name: "pipelined", fetchers: 8, depth: 32},
+	}
+
+	var want [sha256.Size]byte
+	for i, test := range tests {
+		dst := dbPath + "-" + strings.ReplaceAll(test.name, " ", "-")
+		digest, err := catchUpCopy(dbPath, dst, &params, test.fetchers,
+			test.depth)
+		os.RemoveAll(dst)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if i == 0 {
+			want = digest
+			continue
+		}
+		if digest != want {
+			t.Fatalf("%s: got digest %x, want %x of the sequential "+
+				"catch up", test.name, digest, want)
+		}
+	}
+}
+
+// BenchmarkCatchUpPipeline benchmarks catching up the indexes to a chain whose
+// blocks get larger up to a few hundred transactions.  The sequential catch up
+// without fetchers is run on one core, and the pipeline is run with as many
+// fetchers as cores for each number of cores up to the ones of the machine.
+// The loading and the hashing of the blocks are spread over the cores and the
+// proofs are written out while the accumulators are modified, so the speedup
+// is read off the results for the different numbers of cores.
+func BenchmarkCatchUpPipeline(b *testing.B) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("BenchmarkCatchUpPipeline")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	chain, _, err := catchUpTestChain(db, &params, 300)
+	if err != nil {
+		db.Close()
+		b.Fatal(err)
+	}
+	err = chain.FlushCachedState(blockchain.FlushRequired)
+	db.Close()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	type benchCase struct {
+		procs    int
+		fetchers int
+	}
+	cases := []benchCase{{procs: 1, fetchers: 0}}
+	for procs := 1; procs <= runtime.NumCPU(); procs *= 2 {
+		cases = append(cases, benchCase{procs: procs, fetchers: procs})
+	}
+	if procs := cases[len(cases)-1].procs; procs != runtime.NumCPU() {
+		cases = append(cases, benchCase{procs: runtime.NumCPU(),
+			fetchers: runtime.NumCPU()})
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for _, c := range cases {
+		n := c.fetchers
+		name := fmt.Sprintf("procs=%d/fetchers=%d", c.procs, n)
+		b.Run(name, func(b *testing.B) {
+			runtime.GOMAXPROCS(c.procs)
+			for i := 0; i < b.N; i++ {
+				dst := fmt.Sprintf("%s-%d-%d-%d", dbPath,
+					c.procs, n, i)
+				b.StopTimer()
+				err := copyTree(dst, dbPath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				db, err := database.Open(testDbType, dst,
+					blockDataNet)
+				if err != nil {
+					b.Fatal(err)
+				}
+				chain, err := newCatchUpChain(db, &params)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, indexes, err := initIndexes(1, dst, &db, &params)
+				if err != nil {
+					b.Fatal(err)
+				}
+				indexes = append(indexes,
+					secondaryTestIndexes(db, &params)...)
+				m := NewManager(db, indexes)
+				m.SetCatchUpPipeline(n, 4*n)
+				b.StartTimer()
+
+				err = m.Init(chain, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				db.Close()
+				os.RemoveAll(dst)
+				b.StartTimer()
+			}
+		})
+	}
+}
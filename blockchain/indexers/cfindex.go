@@ -7,7 +7,6 @@ package indexers
 import (
 	"errors"
 
-	"github.com/utreexo/utreexod/blockchain"
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/btcutil/gcs"
 	"github.com/utreexo/utreexod/btcutil/gcs/builder"
@@ -209,27 +208,25 @@ func storeFilter(dbTx database.Tx, block *btcutil.Block, f *gcs.Filter,
 // ConnectBlock is invoked by the index manager when a new block has been
 // connected to the main chain. This indexer adds a hash-to-cf mapping for
 // every passed block. This is part of the Indexer interface.
-func (idx *CfIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
-
-	prevScripts := make([][]byte, len(stxos))
-	for i, stxo := range stxos {
+func (idx *CfIndex) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	prevScripts := make([][]byte, len(n.SpentTxOuts))
+	for i, stxo := range n.SpentTxOuts {
 		prevScripts[i] = stxo.PkScript
 	}
 
-	f, err := builder.BuildBasicFilter(block.MsgBlock(), prevScripts)
+	f, err := builder.BuildBasicFilter(n.Block.MsgBlock(), prevScripts)
 	if err != nil {
 		return err
 	}
 
-	return storeFilter(dbTx, block, f, wire.GCSFilterRegular)
+	return storeFilter(dbTx, n.Block, f, wire.GCSFilterRegular)
 }
 
 // DisconnectBlock is invoked by the index manager when a block has been
 // disconnected from the main chain.  This indexer removes the hash-to-cf
 // mapping for every passed block. This is part of the Indexer interface.
-func (idx *CfIndex) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
-	_ []blockchain.SpentTxOut) error {
+func (idx *CfIndex) DisconnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	block := n.Block
 
 	for _, key := range cfIndexKeys {
 		err := dbDeleteFilterIdxEntry(dbTx, key, block.Hash())
@@ -353,5 +350,5 @@ func NewCfIndex(db database.DB, chainParams *chaincfg.Params) *CfIndex {
 
 // DropCfIndex drops the CF index from the provided database if exists.
 func DropCfIndex(db database.DB, interrupt <-chan struct{}) error {
-	return dropIndex(db, cfIndexParentBucketKey, cfIndexName, interrupt)
+	return dropIndex(db, cfIndexParentBucketKey, cfIndexName, nil, interrupt)
 }
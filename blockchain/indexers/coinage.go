@@ -0,0 +1,312 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// coinAgeStatsFileName is the name of the file in the directory of the
+	// proofs of the flat utreexo proof index that caches the coin age
+	// statistics of the blocks.
+	coinAgeStatsFileName = "coinage.dat"
+
+	// coinAgeRecordSize is the size of the cached coin age statistics of a
+	// block.  It's whether the record is filled in, the input count and the
+	// spent value, the coinbase input count and the spent coinbase value,
+	// and the satoshi-blocks destroyed.
+	coinAgeRecordSize = 1 + 8 + 8 + 8 + 8 + 8
+)
+
+// CoinAgeStats are the age weighted statistics of the outputs spent by a block.
+// They're computed from the leaf datas in the stored proof of the block so only
+// the outputs that the proof has a leaf data for are counted:
+//
+//   - The input of a coinbase transaction spends no output so it's never
+//     counted.
+//   - Spent outputs that were created by a coinbase transaction are counted
+//     like any other output.  They're also counted apart in CoinbaseInputs and
+//     CoinbaseValue so that they may be left out.
+//   - Outputs created and spent in the same block never enter the accumulator
+//     and the proof has no leaf data for them.  Their age is zero so they never
+//     add to SatBlocksDestroyed and they're left out of the counts and the
+//     value as well.
+type CoinAgeStats struct {
+	// Height is the height of the block.
+	Height int32
+
+	// Inputs is how many outputs the block spends and Value is how many
+	// satoshis they hold.
+	Inputs uint64
+	Value  uint64
+
+	// CoinbaseInputs is how many of the spent outputs were created by a
+	// coinbase transaction and CoinbaseValue is how many satoshis they
+	// hold.
+	CoinbaseInputs uint64
+	CoinbaseValue  uint64
+
+	// SatBlocksDestroyed is the sum of the amount of every spent output
+	// in satoshis times the number of blocks since it was created.
+	SatBlocksDestroyed uint64
+}
+
+// add adds the spent output of the leaf data to the statistics of the block.
+func (s *CoinAgeStats) add(ld *wire.LeafData) error {
+	if ld.Amount < 0 || ld.Height < 0 || ld.Height > s.Height {
+		return fmt.Errorf("leaf data spent at height %d has amount "+
+			"%d and height %d", s.Height, ld.Amount, ld.Height)
+	}
+
+	amount := uint64(ld.Amount)
+	hi, destroyed := bits.Mul64(amount, uint64(s.Height-ld.Height))
+	sum, carry := bits.Add64(s.SatBlocksDestroyed, destroyed, 0)
+	if hi != 0 || carry != 0 {
+		return fmt.Errorf("satoshi-blocks destroyed at height %d "+
+			"overflow", s.Height)
+	}
+	s.SatBlocksDestroyed = sum
+
+	s.Inputs++
+	s.Value += amount
+	if ld.IsCoinBase {
+		s.CoinbaseInputs++
+		s.CoinbaseValue += amount
+	}
+
+	return nil
+}
+
+// serialize returns the cache record of the statistics.
+func (s *CoinAgeStats) serialize() []byte {
+	var buf [coinAgeRecordSize]byte
+	buf[0] = 1
+	binary.BigEndian.PutUint64(buf[1:], s.Inputs)
+	binary.BigEndian.PutUint64(buf[9:], s.Value)
+	binary.BigEndian.PutUint64(buf[17:], s.CoinbaseInputs)
+	binary.BigEndian.PutUint64(buf[25:], s.CoinbaseValue)
+	binary.BigEndian.PutUint64(buf[33:], s.SatBlocksDestroyed)
+
+	return buf[:]
+}
+
+// deserialize sets the statistics from the cache record.
+func (s *CoinAgeStats) deserialize(buf []byte) {
+	s.Inputs = binary.BigEndian.Uint64(buf[1:])
+	s.Value = binary.BigEndian.Uint64(buf[9:])
+	s.CoinbaseInputs = binary.BigEndian.Uint64(buf[17:])
+	s.CoinbaseValue = binary.BigEndian.Uint64(buf[25:])
+	s.SatBlocksDestroyed = binary.BigEndian.Uint64(buf[33:])
+}
+
+// coinAgeCache keeps the coin age statistics of the blocks once they're
+// computed.  The record of a block is at a fixed offset from its height so
+// that any block's statistics can be filled in.  The records above a height
+// are dropped whenever the stored proofs above it are.
+type coinAgeCache struct {
+	mtx  sync.Mutex
+	path string
+
+	// generation is bumped every time records are dropped so that
+	// statistics computed from a proof that was dropped in the meantime
+	// are never cached.
+	generation uint64
+}
+
+// newCoinAgeCache returns the cache of the coin age statistics at the given
+// path.
+func newCoinAgeCache(path string) *coinAgeCache {
+	return &coinAgeCache{path: path}
+}
+
+// currentGeneration returns the generation that statistics computed from now
+// on must be stored with.
+//
+// This function is safe for concurrent access.
+func (c *coinAgeCache) currentGeneration() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.generation
+}
+
+// fetch returns the cached statistics of the block at the given height and
+// whether they were cached.
+//
+// This function is safe for concurrent access.
+func (c *coinAgeCache) fetch(height int32) (CoinAgeStats, bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	stats := CoinAgeStats{Height: height}
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return stats, false, nil
+	}
+	if err != nil {
+		return stats, false, err
+	}
+	defer f.Close()
+
+	var buf [coinAgeRecordSize]byte
+	_, err = f.ReadAt(buf[:], int64(height)*coinAgeRecordSize)
+	if err == io.EOF {
+		return stats, false, nil
+	}
+	if err != nil {
+		return stats, false, err
+	}
+	if buf[0] == 0 {
+		return stats, false, nil
+	}
+	stats.deserialize(buf[:])
+
+	return stats, true, nil
+}
+
+// store caches the statistics of the block if no records were dropped since
+// the given generation.
+//
+// This function is safe for concurrent access.
+func (c *coinAgeCache) store(stats *CoinAgeStats, generation uint64) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if generation != c.generation {
+		return nil
+	}
+
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(stats.serialize(), int64(stats.Height)*coinAgeRecordSize)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// truncate drops the records of the blocks above the given height.
+//
+// This function is safe for concurrent access.
+func (c *coinAgeCache) truncate(height int32) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.generation++
+
+	fi, err := os.Stat(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	size := int64(height+1) * coinAgeRecordSize
+	if size < 0 {
+		size = 0
+	}
+	if fi.Size() <= size {
+		return nil
+	}
+
+	return os.Truncate(c.path, size)
+}
+
+// FetchCoinAgeStats returns the coin age statistics of every block from start
+// to end, both inclusive.  They're computed from the leaf datas in the stored
+// proofs, which are decoded one at a time so that the memory used doesn't grow
+// with the size of the blocks.  The statistics of a block are cached once
+// they're computed.  ErrLeafTTLDisabled is returned if the index is built
+// without the leaf time to live data.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) FetchCoinAgeStats(start, end int32) (
+	[]CoinAgeStats, error) {
+
+	if idx.noLeafTTL {
+		return nil, ErrLeafTTLDisabled
+	}
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	tip := idx.proofState.BestHeight()
+	if start < 0 || start > end || end > tip {
+		return nil, fmt.Errorf("range %d-%d is not within the heights "+
+			"0-%d of the index", start, end, tip)
+	}
+
+	stats := make([]CoinAgeStats, 0, end-start+1)
+	for height := start; height <= end; height++ {
+		if err := idx.degraded.check(height); err != nil {
+			return nil, err
+		}
+		if err := idx.checkServable(height); err != nil {
+			return nil, err
+		}
+
+		blockStats, cached, err := idx.coinAge.fetch(height)
+		if err != nil {
+			return nil, err
+		}
+		if !cached {
+			blockStats, err = idx.computeCoinAgeStats(height)
+			if err != nil {
+				return nil, err
+			}
+		}
+		stats = append(stats, blockStats)
+	}
+
+	return stats, nil
+}
+
+// computeCoinAgeStats computes the coin age statistics of the block at the
+// given height from its stored proof and caches them.
+func (idx *FlatUtreexoProofIndex) computeCoinAgeStats(height int32) (
+	CoinAgeStats, error) {
+
+	stats := CoinAgeStats{Height: height}
+
+	// The genesis block spends nothing and has no stored proof.
+	if height == 0 {
+		return stats, nil
+	}
+
+	generation := idx.coinAge.currentGeneration()
+	proofBytes, err := idx.proofState.FetchData(height)
+	if err != nil {
+		return stats, err
+	}
+	if proofBytes == nil {
+		return stats, fmt.Errorf("Couldn't fetch Utreexo proof for "+
+			"height %d", height)
+	}
+
+	// The proofs are stored without the accumulator proof for the
+	// multi-block proofs.  The leaf datas of the block itself come first
+	// at the heights that the multi-block proofs are stored at.
+	noAccProof := idx.proofGenInterVal != 1
+	err = wire.ForEachLeafDataCompact(bytes.NewReader(proofBytes), noAccProof,
+		stats.add)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, idx.coinAge.store(&stats, generation)
+}
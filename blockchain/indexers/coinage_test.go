@@ -0,0 +1,187 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+)
+
+// bruteForceCoinAgeStats computes the coin age statistics of the block at the
+// given height from the whole utreexo data of its proof.
+func bruteForceCoinAgeStats(idx *FlatUtreexoProofIndex, height int32) (
+	CoinAgeStats, error) {
+
+	stats := CoinAgeStats{Height: height}
+	ud, err := idx.FetchUtreexoProof(height, idx.proofGenInterVal != 1)
+	if err != nil {
+		return stats, err
+	}
+	for _, ld := range ud.LeafDatas {
+		amount := uint64(ld.Amount)
+		stats.Inputs++
+		stats.Value += amount
+		stats.SatBlocksDestroyed += amount * uint64(height-ld.Height)
+		if ld.IsCoinBase {
+			stats.CoinbaseInputs++
+			stats.CoinbaseValue += amount
+		}
+	}
+
+	return stats, nil
+}
+
+// TestFetchCoinAgeStats ensures that the coin age statistics streamed from the
+// stored proofs match the ones computed from the whole utreexo data, both with
+// single-block and multi-block proofs and for blocks with same-block spends,
+// and that the cached statistics are dropped along with their proofs.
+func TestFetchCoinAgeStats(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	for _, interval := range []int32{1, defaultProofGenInterval} {
+		testName := fmt.Sprintf("TestFetchCoinAgeStats-%d", interval)
+		chain, indexes, params, tearDown := indexersTestChain(testName,
+			interval)
+
+		var idx *FlatUtreexoProofIndex
+		for _, indexer := range indexes {
+			if flat, ok := indexer.(*FlatUtreexoProofIndex); ok {
+				idx = flat
+			}
+		}
+
+		tip := btcutil.NewBlock(params.GenesisBlock)
+		var spends []*blockchain.SpendableOut
+		for i := 0; i < 12; i++ {
+			tip, spends = blockchain.AddBlock(chain, tip, spends)
+		}
+
+		// Connect the blocks with same-block spends.
+		tip, spendables := blockchain.AddBlock(chain, tip, spends)
+		sameBlockHeights := make(map[int32]int)
+		for _, test := range blockSpecTests[1:3] {
+			specs := append(test.setup, test.spec)
+			for j, spec := range specs {
+				block, outs, err := blockchain.GenerateBlockFromSpec(
+					chain, tip, spendables, spec,
+					test.seed+int64(j))
+				if err != nil {
+					tearDown()
+					t.Fatalf("interval %d: %s: %v", interval,
+						test.name, err)
+				}
+				_, _, err = chain.ProcessBlock(block, blockchain.BFNone)
+				if err != nil {
+					tearDown()
+					t.Fatalf("interval %d: %s: %v", interval,
+						test.name, err)
+				}
+				tip, spendables = block, outs
+			}
+
+			var inputs int
+			for _, tx := range tip.MsgBlock().Transactions[1:] {
+				inputs += len(tx.TxIn)
+			}
+			sameBlockHeights[tip.Height()] = inputs
+		}
+		for i := 0; i < 3; i++ {
+			tip, _ = blockchain.AddBlock(chain, tip, nil)
+		}
+		tipHeight := tip.Height()
+
+		got, err := idx.FetchCoinAgeStats(0, tipHeight)
+		if err != nil {
+			tearDown()
+			t.Fatalf("interval %d: %v", interval, err)
+		}
+		if len(got) != int(tipHeight)+1 {
+			tearDown()
+			t.Fatalf("interval %d: got stats of %d blocks, want %d",
+				interval, len(got), tipHeight+1)
+		}
+
+		var coinbaseInputs uint64
+		for height := int32(0); height <= tipHeight; height++ {
+			want, err := bruteForceCoinAgeStats(idx, height)
+			if err != nil {
+				tearDown()
+				t.Fatalf("interval %d: height %d: %v", interval,
+					height, err)
+			}
+			if got[height] != want {
+				tearDown()
+				t.Fatalf("interval %d: height %d: got %+v, want %+v",
+					interval, height, got[height], want)
+			}
+			coinbaseInputs += want.CoinbaseInputs
+
+			// The outputs created and spent in the block aren't
+			// counted.
+			if inputs, ok := sameBlockHeights[height]; ok &&
+				want.Inputs >= uint64(inputs) {
+
+				tearDown()
+				t.Fatalf("interval %d: height %d: %d of %d inputs "+
+					"counted with same-block spends", interval,
+					height, want.Inputs, inputs)
+			}
+		}
+		if coinbaseInputs == 0 {
+			tearDown()
+			t.Fatalf("interval %d: no spent coinbase outputs were "+
+				"counted", interval)
+		}
+
+		// The statistics are cached and the cached ones are the same.
+		for height := int32(1); height <= tipHeight; height++ {
+			cached, ok, err := idx.coinAge.fetch(height)
+			if err != nil || !ok || cached != got[height] {
+				tearDown()
+				t.Fatalf("interval %d: height %d: cached %+v, %v, "+
+					"%v, want %+v", interval, height, cached, ok,
+					err, got[height])
+			}
+		}
+		again, err := idx.FetchCoinAgeStats(5, 10)
+		if err != nil || len(again) != 6 || again[0] != got[5] {
+			tearDown()
+			t.Fatalf("interval %d: unexpected cached stats %+v, %v",
+				interval, again, err)
+		}
+
+		// The cached statistics are dropped along with their proofs
+		// and computed again.
+		err = idx.coinAge.truncate(tipHeight - 2)
+		if err != nil {
+			tearDown()
+			t.Fatalf("interval %d: %v", interval, err)
+		}
+		if _, ok, _ := idx.coinAge.fetch(tipHeight); ok {
+			tearDown()
+			t.Fatalf("interval %d: cached stats of height %d "+
+				"weren't dropped", interval, tipHeight)
+		}
+		again, err = idx.FetchCoinAgeStats(tipHeight-2, tipHeight)
+		if err != nil || again[2] != got[tipHeight] {
+			tearDown()
+			t.Fatalf("interval %d: unexpected recomputed stats %+v, "+
+				"%v", interval, again, err)
+		}
+
+		_, err = idx.FetchCoinAgeStats(tipHeight, tipHeight+1)
+		if err == nil {
+			tearDown()
+			t.Fatalf("interval %d: expected an error for a range "+
+				"past the tip", interval)
+		}
+		tearDown()
+	}
+}
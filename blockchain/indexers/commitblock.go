@@ -0,0 +1,168 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// commitStage is a boundary between the writes done when committing a block to
+// a utreexo proof index.
+type commitStage int
+
+const (
+	// commitStageState is the boundary right after the accumulator state
+	// is modified.
+	commitStageState commitStage = iota
+
+	// commitStageEntries is the boundary right after the proof and the undo
+	// entries are stored.
+	commitStageEntries
+
+	// commitStageSync is the boundary right after the stored entries are
+	// synced to disk.
+	commitStageSync
+)
+
+// String returns the commitStage in human-readable form.
+func (s commitStage) String() string {
+	switch s {
+	case commitStageState:
+		return "state"
+	case commitStageEntries:
+		return "entries"
+	case commitStageSync:
+		return "sync"
+	default:
+		return fmt.Sprintf("unknown commitStage (%d)", int(s))
+	}
+}
+
+// checkFailpoint returns the error of the failpoint of the blockCommit for the
+// given stage if one is set.
+func (c *blockCommit) checkFailpoint(stage commitStage) error {
+	if c.failpoint == nil {
+		return nil
+	}
+
+	return c.failpoint(stage)
+}
+
+// commitRollbackError is returned when the writes of a block commit couldn't be
+// rolled back after one of them failed.  The index may be left with part of the
+// block so connecting it must not be attempted again.
+type commitRollbackError struct {
+	rollbackErr error
+	err         error
+}
+
+// Error returns the error as a human-readable string.
+func (e *commitRollbackError) Error() string {
+	return fmt.Sprintf("failed to roll back the block commit: %v after "+
+		"error: %v", e.rollbackErr, e.err)
+}
+
+// Unwrap returns the error that the commit failed with.
+func (e *commitRollbackError) Unwrap() error {
+	return e.err
+}
+
+// blockCommit is all the writes that a utreexo proof index does when a block is
+// connected.
+type blockCommit struct {
+	// modifyState modifies the accumulator state with the block and
+	// returns the undo block for the modification.
+	modifyState func() (*accumulator.UndoBlock, error)
+
+	// storeProof serializes and stores the proof for the block.  The proof
+	// only depends on the accumulator state before the block, so it's
+	// stored while the state is modified.  It may be nil if the proof is
+	// stored along with the undo entries.
+	storeProof func() error
+
+	// storeEntries stores the undo entries for the block, along with the
+	// proof if it isn't stored by storeProof.
+	storeEntries func(undoBlock *accumulator.UndoBlock) error
+
+	// sync makes sure that the stored entries are persisted.  It may be
+	// nil if the entries are persisted with the index tip.
+	sync func() error
+
+	// rollback reverts the modification done to the accumulator state
+	// along with any entries that were stored.  The undo block is nil if
+	// only the proof was stored because the state failed to be modified.
+	rollback func(undoBlock *accumulator.UndoBlock) error
+
+	// failpoint is called at every commit stage boundary and the commit
+	// is aborted if it returns an error.  It's only ever set by tests to
+	// simulate a crash at each of the boundaries.
+	failpoint func(stage commitStage) error
+}
+
+// commitBlock does the writes of the passed in blockCommit in the order that
+// both utreexo proof indexes must follow: the accumulator state, then the proof
+// and undo entries, then the sync barrier.  The proof is stored at the same
+// time as the accumulator state is modified when the blockCommit stores it on
+// its own.  The index tip is written by the index manager after commitBlock
+// returns.
+//
+// If any of the writes fail, the writes done until then are rolled back so
+// that the index either cleanly contains the block or cleanly doesn't.  This
+// keeps the next attempt to connect the block from applying it twice.
+func commitBlock(c *blockCommit) error {
+	var proofErr chan error
+	if c.storeProof != nil {
+		proofErr = make(chan error, 1)
+		go func() {
+			proofErr <- c.storeProof()
+		}()
+	}
+
+	undoBlock, err := c.modifyState()
+	if proofErr != nil {
+		storeErr := <-proofErr
+		if err != nil {
+			// Take back the proof that was stored while the state
+			// failed to be modified.
+			rbErr := c.rollback(nil)
+			if rbErr != nil {
+				return &commitRollbackError{rollbackErr: rbErr,
+					err: err}
+			}
+			return err
+		}
+		err = storeErr
+	} else if err != nil {
+		return err
+	}
+
+	if err == nil {
+		err = c.checkFailpoint(commitStageState)
+	}
+	if err == nil {
+		err = c.storeEntries(undoBlock)
+	}
+	if err == nil {
+		err = c.checkFailpoint(commitStageEntries)
+	}
+	if err == nil && c.sync != nil {
+		err = c.sync()
+	}
+	if err == nil {
+		err = c.checkFailpoint(commitStageSync)
+	}
+	if err == nil {
+		return nil
+	}
+
+	rbErr := c.rollback(undoBlock)
+	if rbErr != nil {
+		return &commitRollbackError{rollbackErr: rbErr, err: err}
+	}
+
+	return err
+}
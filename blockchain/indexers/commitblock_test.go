@@ -0,0 +1,187 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// testCommit is a blockCommit that keeps track of the writes done to it.
+type testCommit struct {
+	// writes are the writes currently applied in the order they were done.
+	writes []string
+
+	// applied counts how many times the state modification was applied
+	// without being rolled back.
+	applied int
+}
+
+func (tc *testCommit) blockCommit() *blockCommit {
+	return &blockCommit{
+		modifyState: func() (*accumulator.UndoBlock, error) {
+			tc.writes = append(tc.writes, "state")
+			tc.applied++
+			return &accumulator.UndoBlock{}, nil
+		},
+		storeEntries: func(*accumulator.UndoBlock) error {
+			tc.writes = append(tc.writes, "entries")
+			return nil
+		},
+		sync: func() error {
+			tc.writes = append(tc.writes, "sync")
+			return nil
+		},
+		rollback: func(*accumulator.UndoBlock) error {
+			tc.writes = nil
+			tc.applied--
+			return nil
+		},
+	}
+}
+
+func TestCommitBlock(t *testing.T) {
+	tc := &testCommit{}
+	err := commitBlock(tc.blockCommit())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"state", "entries", "sync"}
+	if !reflect.DeepEqual(tc.writes, want) {
+		t.Fatalf("expected writes %v, got %v", want, tc.writes)
+	}
+}
+
+// TestCommitBlockFailpoints ensures that a crash at any of the commit stages
+// leaves nothing of the block behind and that retrying the commit doesn't
+// apply the block twice.
+func TestCommitBlockFailpoints(t *testing.T) {
+	errCrash := errors.New("crash")
+	stages := []commitStage{commitStageState, commitStageEntries, commitStageSync}
+	for _, crashStage := range stages {
+		tc := &testCommit{}
+		commit := tc.blockCommit()
+		commit.failpoint = func(stage commitStage) error {
+			if stage == crashStage {
+				return errCrash
+			}
+			return nil
+		}
+		err := commitBlock(commit)
+		if err != errCrash {
+			t.Fatalf("%v: expected %v, got %v", crashStage, errCrash, err)
+		}
+		if len(tc.writes) != 0 || tc.applied != 0 {
+			t.Fatalf("%v: expected a clean state after the crash, "+
+				"got writes %v applied %d", crashStage, tc.writes,
+				tc.applied)
+		}
+
+		// Retry the commit without the crash.
+		err = commitBlock(tc.blockCommit())
+		if err != nil {
+			t.Fatalf("%v: %v", crashStage, err)
+		}
+		if tc.applied != 1 {
+			t.Fatalf("%v: expected the block to be applied once, "+
+				"got %d", crashStage, tc.applied)
+		}
+	}
+}
+
+// TestCommitBlockStoreProof ensures that a proof stored while the accumulator
+// state is modified is rolled back along with the state when either of them
+// fails.
+func TestCommitBlockStoreProof(t *testing.T) {
+	errProof := errors.New("proof")
+	errState := errors.New("state")
+	tests := []struct {
+		name     string
+		proofErr error
+		stateErr error
+		wantErr  error
+		wantUndo bool
+	}{
+		{
+			name: "stored",
+		},
+		{
+			name:     "proof fails",
+			proofErr: errProof,
+			wantErr:  errProof,
+			wantUndo: true,
+		},
+		{
+			name:     "state fails",
+			stateErr: errState,
+			wantErr:  errState,
+		},
+	}
+
+	for _, test := range tests {
+		var proofStored bool
+		var writes []string
+		var rolledBack *accumulator.UndoBlock
+		undoBlock := &accumulator.UndoBlock{}
+		commit := &blockCommit{
+			storeProof: func() error {
+				if test.proofErr != nil {
+					return test.proofErr
+				}
+				proofStored = true
+				return nil
+			},
+			modifyState: func() (*accumulator.UndoBlock, error) {
+				if test.stateErr != nil {
+					return nil, test.stateErr
+				}
+				return undoBlock, nil
+			},
+			storeEntries: func(*accumulator.UndoBlock) error {
+				writes = append(writes, "entries")
+				return nil
+			},
+			sync: func() error {
+				writes = append(writes, "sync")
+				return nil
+			},
+			rollback: func(undo *accumulator.UndoBlock) error {
+				rolledBack = undo
+				proofStored = false
+				writes = nil
+				return nil
+			},
+		}
+
+		err := commitBlock(commit)
+		if err != test.wantErr {
+			t.Fatalf("%s: expected %v, got %v", test.name,
+				test.wantErr, err)
+		}
+		if err == nil {
+			if !proofStored || rolledBack != nil {
+				t.Fatalf("%s: expected the proof to be stored",
+					test.name)
+			}
+			if !reflect.DeepEqual(writes, []string{"entries", "sync"}) {
+				t.Fatalf("%s: unexpected writes %v", test.name,
+					writes)
+			}
+			continue
+		}
+		if proofStored || len(writes) != 0 {
+			t.Fatalf("%s: expected a clean state, got proof stored "+
+				"%v and writes %v", test.name, proofStored, writes)
+		}
+		if test.wantUndo != (rolledBack == undoBlock) {
+			t.Fatalf("%s: rolled back with undo block %v", test.name,
+				rolledBack)
+		}
+	}
+}
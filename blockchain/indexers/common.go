@@ -11,8 +11,6 @@ import (
 	"encoding/binary"
 	"errors"
 
-	"github.com/utreexo/utreexod/blockchain"
-	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/database"
 )
 
@@ -32,6 +30,39 @@ type NeedsInputser interface {
 	NeedsInputs() bool
 }
 
+// FlushAligner provides a generic interface for an indexer that keeps part of
+// its state in memory to report the height that the state was last persisted
+// at.  The index manager uses it to align the flushes of the cached chain state
+// with the indexes.
+type FlushAligner interface {
+	// DurableHeight returns the height of the block that the state of the
+	// index was last persisted at.  It's -1 if the persisted state isn't
+	// of a block in the main chain.
+	DurableHeight() int32
+}
+
+// HistoryNeeder provides a generic interface for an indexer to specify that it
+// requires the blocks right before a connected block along with it.  The index
+// manager gathers them into the History of the notification as the indexer
+// can't fetch them from the chain while it handles the notification.
+type HistoryNeeder interface {
+	// HistoryNeeded returns the number of main chain blocks right before
+	// the connected block at the given height that the indexer requires.
+	HistoryNeeded(height int32) int32
+}
+
+// AncestorNeeder provides a generic interface for an indexer to specify that it
+// requires the hashes of main chain blocks further below a connected block than
+// the history it needs.  The index manager gathers them into the AncestorHashes
+// of the notification as the indexer can't fetch them from the chain while it
+// handles the notification.
+type AncestorNeeder interface {
+	// AncestorsNeeded returns the heights of the main chain blocks below
+	// the connected block at the given height whose hashes the indexer
+	// requires and whether it requires any.
+	AncestorsNeeded(height int32) (HeightRange, bool)
+}
+
 // Indexer provides a generic interface for an indexer that is managed by an
 // index manager such as the Manager type provided by this package.
 type Indexer interface {
@@ -52,15 +83,17 @@ type Indexer interface {
 
 	// ConnectBlock is invoked when a new block has been connected to the
 	// main chain. The set of output spent within a block is also passed in
-	// so indexers can access the pevious output scripts input spent if
-	// required.
-	ConnectBlock(database.Tx, *btcutil.Block, []blockchain.SpentTxOut) error
+	// the notification so indexers can access the pevious output scripts
+	// input spent if required.  The chain lock is held so the indexer must
+	// not call back into the chain.
+	ConnectBlock(database.Tx, *BlockNotification) error
 
 	// DisconnectBlock is invoked when a block has been disconnected from
 	// the main chain. The set of outputs scripts that were spent within
-	// this block is also returned so indexers can clean up the prior index
-	// state for this block
-	DisconnectBlock(database.Tx, *btcutil.Block, []blockchain.SpentTxOut) error
+	// this block is also passed in the notification so indexers can clean
+	// up the prior index state for this block.  The chain lock is held so
+	// the indexer must not call back into the chain.
+	DisconnectBlock(database.Tx, *BlockNotification) error
 }
 
 // AssertError identifies an error that indicates an internal code consistency
@@ -0,0 +1,394 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// verifyProgressInterval is how often the progress of verifying that the
+// utreexo proof indexes agree is logged.
+const verifyProgressInterval = 10 * time.Second
+
+// ErrIndexesDiverge is matched by errors.Is for an IndexDivergenceError.
+var ErrIndexesDiverge = errors.New("utreexo proof indexes diverge")
+
+// IndexDivergenceError is returned when the utreexo proof indexes stored a
+// different utreexo proof or undo block for the same block.
+type IndexDivergenceError struct {
+	// Result is the comparison of the first block that the indexes
+	// stored differently.
+	Result ComparisonResult
+}
+
+// Error returns the error as a human-readable string.
+func (e *IndexDivergenceError) Error() string {
+	return e.Result.String()
+}
+
+// Is returns whether the target is ErrIndexesDiverge.
+func (e *IndexDivergenceError) Is(target error) bool {
+	return target == ErrIndexesDiverge
+}
+
+// BlockID identifies a block of the main chain by both its height and its
+// hash so that every index can be asked for the block by the key it stores
+// the block under.
+type BlockID struct {
+	Height int32
+	Hash   chainhash.Hash
+}
+
+// proofStore is an index that stores the utreexo proof and the undo block of
+// every block it connected.
+type proofStore interface {
+	Indexer
+
+	// fetchProof returns the utreexo proof stored for the block.
+	fetchProof(id *BlockID) (*wire.UData, error)
+
+	// fetchUndo returns the undo block stored for the block.
+	fetchUndo(id *BlockID) (*accumulator.UndoBlock, error)
+}
+
+// Ensure the utreexo proof indexes implement the proofStore interface.
+var _ proofStore = (*FlatUtreexoProofIndex)(nil)
+var _ proofStore = (*UtreexoProofIndex)(nil)
+
+// fetchProof returns the utreexo proof stored for the block.
+//
+// This is part of the proofStore interface.
+func (idx *FlatUtreexoProofIndex) fetchProof(id *BlockID) (*wire.UData, error) {
+	return idx.FetchUtreexoProof(id.Height, false)
+}
+
+// fetchUndo returns the undo block stored for the block.
+//
+// This is part of the proofStore interface.
+func (idx *FlatUtreexoProofIndex) fetchUndo(id *BlockID) (*accumulator.UndoBlock, error) {
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	if err := idx.degraded.check(id.Height); err != nil {
+		return nil, err
+	}
+
+	return idx.fetchUndoBlock(id.Height)
+}
+
+// fetchProof returns the utreexo proof stored for the block.  It's read from the
+// database rather than the proof cache so that it's what's stored.
+//
+// This is part of the proofStore interface.
+func (idx *UtreexoProofIndex) fetchProof(id *BlockID) (*wire.UData, error) {
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	if id.Hash.IsEqual(idx.chainParams.GenesisHash) {
+		return blockchain.GenesisUData(), nil
+	}
+
+	ud, _, err := idx.fetchStoredProof(&id.Hash)
+	return ud, err
+}
+
+// fetchUndo returns the undo block stored for the block.  The undo block for
+// the genesis block is always empty as it doesn't modify the accumulator.
+//
+// This is part of the proofStore interface.
+func (idx *UtreexoProofIndex) fetchUndo(id *BlockID) (*accumulator.UndoBlock, error) {
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	if id.Height == 0 {
+		return &accumulator.UndoBlock{}, nil
+	}
+	err := idx.prune.checkUndo(idx.Name(), id.Height, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var undoBlock *accumulator.UndoBlock
+	err = idx.db.View(func(dbTx database.Tx) error {
+		undoBytes, err := dbFetchUndoBlockEntry(dbTx, &id.Hash)
+		if err != nil {
+			return err
+		}
+
+		undoBlock, err = idx.undoBlockFromEntry(id, undoBytes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return undoBlock, nil
+}
+
+// ComparisonResult is the outcome of comparing what the enabled utreexo proof
+// indexes stored for the same block.
+type ComparisonResult struct {
+	// Block is the block that was compared.
+	Block BlockID
+
+	// Indexes are the names of the compared indexes in the order they're
+	// enabled in.  The first one is the reference that the others are
+	// compared against.
+	Indexes []string
+
+	// ProofDiffs are the differences of the utreexo proof of every index
+	// whose proof differs from the one of the reference index, one per
+	// line, by the name of the index.
+	ProofDiffs map[string][]string
+
+	// UndoDiffs are the names of the indexes whose undo block differs from
+	// the one of the reference index.
+	UndoDiffs []string
+}
+
+// Agree returns whether all of the compared indexes stored the same utreexo
+// proof and undo block.
+func (r *ComparisonResult) Agree() bool {
+	return len(r.ProofDiffs) == 0 && len(r.UndoDiffs) == 0
+}
+
+// String returns a human-readable description of the comparison.
+func (r *ComparisonResult) String() string {
+	if r.Agree() {
+		return fmt.Sprintf("indexes %s agree on block %v at height %d",
+			strings.Join(r.Indexes, ", "), r.Block.Hash,
+			r.Block.Height)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "indexes differ from the %s on block %v at height %d",
+		r.Indexes[0], r.Block.Hash, r.Block.Height)
+	for _, diff := range r.Differences() {
+		fmt.Fprintf(&b, "\n  %s", diff)
+	}
+
+	return b.String()
+}
+
+// Differences returns how every index that differs from the reference index
+// differs, one line per proof and undo block, in the order of the names of the
+// indexes.
+func (r *ComparisonResult) Differences() []string {
+	names := make([]string, 0, len(r.ProofDiffs))
+	for name := range r.ProofDiffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	diffs := make([]string, 0, len(names)+len(r.UndoDiffs))
+	for _, name := range names {
+		diffs = append(diffs, fmt.Sprintf("%s proof: %s", name,
+			strings.Join(r.ProofDiffs[name], "; ")))
+	}
+	for _, name := range r.UndoDiffs {
+		diffs = append(diffs, fmt.Sprintf("%s undo block differs", name))
+	}
+
+	return diffs
+}
+
+// proofStores returns the enabled indexes that store utreexo proofs.
+func (m *Manager) proofStores() []proofStore {
+	var stores []proofStore
+	for _, indexer := range m.enabledIndexes {
+		if store, ok := indexer.(proofStore); ok {
+			stores = append(stores, store)
+		}
+	}
+
+	return stores
+}
+
+// FetchProofAllIndexes returns the utreexo proof that every enabled utreexo
+// proof index stored for the block by the name of the index.
+func (m *Manager) FetchProofAllIndexes(id *BlockID) (map[string]*wire.UData, error) {
+	return fetchProofs(id, m.proofStores())
+}
+
+// fetchProofs returns the utreexo proof that every passed in index stored for
+// the block by the name of the index.
+func fetchProofs(id *BlockID, stores []proofStore) (map[string]*wire.UData, error) {
+	proofs := make(map[string]*wire.UData)
+	for _, store := range stores {
+		ud, err := store.fetchProof(id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch the utreexo "+
+				"proof for block %v at height %d from the %s: "+
+				"%w", id.Hash, id.Height, store.Name(), err)
+		}
+		proofs[store.Name()] = ud
+	}
+
+	return proofs, nil
+}
+
+// FetchUndoBlocks returns the undo block that every enabled utreexo proof index
+// stored for the block by the name of the index.
+func (m *Manager) FetchUndoBlocks(id *BlockID) (map[string]*UndoBlock, error) {
+	accUndos, err := m.fetchUndoAllIndexes(id)
+	if err != nil {
+		return nil, err
+	}
+
+	undos := make(map[string]*UndoBlock, len(accUndos))
+	for name, accUndo := range accUndos {
+		undo, err := NewUndoBlock(accUndo)
+		if err != nil {
+			return nil, err
+		}
+		undos[name] = undo
+	}
+
+	return undos, nil
+}
+
+// FetchUndoAllIndexes returns the undo block that every enabled utreexo proof
+// index stored for the block by the name of the index.
+//
+// Deprecated: Use FetchUndoBlocks instead.
+func (m *Manager) FetchUndoAllIndexes(id *BlockID) (map[string]*accumulator.UndoBlock, error) {
+	return m.fetchUndoAllIndexes(id)
+}
+
+// fetchUndoAllIndexes returns the undo block that every enabled utreexo proof
+// index stored for the block by the name of the index.
+func (m *Manager) fetchUndoAllIndexes(id *BlockID) (map[string]*accumulator.UndoBlock, error) {
+	return fetchUndos(id, m.proofStores())
+}
+
+// fetchUndos returns the undo block that every passed in index stored for the
+// block by the name of the index.
+func fetchUndos(id *BlockID, stores []proofStore) (map[string]*accumulator.UndoBlock, error) {
+	undos := make(map[string]*accumulator.UndoBlock)
+	for _, store := range stores {
+		undo, err := store.fetchUndo(id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch the undo "+
+				"block for block %v at height %d from the %s: "+
+				"%w", id.Hash, id.Height, store.Name(), err)
+		}
+		undos[store.Name()] = undo
+	}
+
+	return undos, nil
+}
+
+// CompareIndexesAt compares the utreexo proof and the undo block that every
+// enabled utreexo proof index stored for the block against the ones of the
+// first enabled utreexo proof index.  An error is returned if no utreexo proof
+// index is enabled or any of them fails to fetch the block.
+func (m *Manager) CompareIndexesAt(id *BlockID) (ComparisonResult, error) {
+	stores := m.proofStores()
+	if len(stores) == 0 {
+		return ComparisonResult{}, fmt.Errorf("no utreexo proof " +
+			"index is enabled")
+	}
+
+	return compareProofStores(id, stores, nil)
+}
+
+// compareProofStores compares the utreexo proof and the undo block that every
+// passed in index stored for the block against the ones of the first index.
+// If corrupt isn't nil, it's called with the proof of every index but the first
+// before they're compared.
+func compareProofStores(id *BlockID, stores []proofStore,
+	corrupt func(id *BlockID, ud *wire.UData)) (ComparisonResult, error) {
+
+	proofs, err := fetchProofs(id, stores)
+	if err != nil {
+		return ComparisonResult{}, err
+	}
+	undos, err := fetchUndos(id, stores)
+	if err != nil {
+		return ComparisonResult{}, err
+	}
+
+	result := ComparisonResult{
+		Block:   *id,
+		Indexes: make([]string, 0, len(stores)),
+	}
+	ref := stores[0].Name()
+	for _, store := range stores {
+		name := store.Name()
+		result.Indexes = append(result.Indexes, name)
+		if name == ref {
+			continue
+		}
+		if corrupt != nil {
+			corrupt(id, proofs[name])
+		}
+
+		diff := diffUDataNamed(proofs[ref], proofs[name], ref, name)
+		if len(diff) > 0 {
+			if result.ProofDiffs == nil {
+				result.ProofDiffs = make(map[string][]string)
+			}
+			result.ProofDiffs[name] = diff
+		}
+		if !reflect.DeepEqual(undos[ref], undos[name]) {
+			result.UndoDiffs = append(result.UndoDiffs, name)
+		}
+	}
+
+	return result, nil
+}
+
+// VerifyUtreexoIndexes compares the utreexo proofs and the undo blocks that the
+// utreexo proof index and the flat utreexo proof index stored for the main
+// chain blocks from start to end inclusive.  An IndexDivergenceError for the
+// first block that they stored differently is returned.  The blocks are
+// compared one at a time so that any range can be verified without holding
+// more than a single block's proofs in memory.
+func VerifyUtreexoIndexes(chain *blockchain.BlockChain, idx *UtreexoProofIndex,
+	flatIdx *FlatUtreexoProofIndex, start, end int32) error {
+
+	tip := chain.BestSnapshot().Height
+	if start < 0 || end < start || end > tip {
+		return fmt.Errorf("invalid range from %d to %d of a chain with "+
+			"the tip at height %d", start, end, tip)
+	}
+
+	stores := []proofStore{idx, flatIdx}
+	lastLog := time.Now()
+	for height := start; height <= end; height++ {
+		hash, err := chain.BlockHashByHeight(height)
+		if err != nil {
+			return err
+		}
+
+		result, err := compareProofStores(
+			&BlockID{Height: height, Hash: *hash}, stores, nil)
+		if err != nil {
+			return err
+		}
+		if !result.Agree() {
+			return &IndexDivergenceError{Result: result}
+		}
+
+		if time.Since(lastLog) >= verifyProgressInterval {
+			log.Infof("Verified that the utreexo proof indexes agree "+
+				"up to height %d of %d", height, end)
+			lastLog = time.Now()
+		}
+	}
+
+	return nil
+}
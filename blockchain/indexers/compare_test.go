@@ -0,0 +1,271 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// fakeProofStore is a proofStore that serves the utreexo proof and the undo
+// block it was given for every block.
+type fakeProofStore struct {
+	fakeIndexer
+	name  string
+	ud    *wire.UData
+	undo  *accumulator.UndoBlock
+	fetch error
+}
+
+func (idx *fakeProofStore) Name() string { return idx.name }
+
+func (idx *fakeProofStore) fetchProof(*BlockID) (*wire.UData, error) {
+	if idx.fetch != nil {
+		return nil, idx.fetch
+	}
+	return idx.ud, nil
+}
+
+func (idx *fakeProofStore) fetchUndo(*BlockID) (*accumulator.UndoBlock, error) {
+	return idx.undo, nil
+}
+
+func TestCompareIndexesAt(t *testing.T) {
+	id := &BlockID{Height: 7, Hash: chainhash.Hash{7}}
+	ud := func(targets ...uint64) *wire.UData {
+		return &wire.UData{
+			AccProof: accumulator.BatchProof{
+				Targets: targets,
+				Proof:   []accumulator.Hash{{1}, {2}},
+			},
+			RememberIdx: []uint32{0},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		indexes []Indexer
+		want    ComparisonResult
+	}{
+		{
+			name: "one index",
+			indexes: []Indexer{
+				&fakeIndexer{},
+				&fakeProofStore{name: "a", ud: ud(1, 2),
+					undo: &accumulator.UndoBlock{Height: 7}},
+			},
+			want: ComparisonResult{
+				Block:   *id,
+				Indexes: []string{"a"},
+			},
+		},
+		{
+			name: "two indexes agreeing",
+			indexes: []Indexer{
+				&fakeProofStore{name: "a", ud: ud(1, 2),
+					undo: &accumulator.UndoBlock{Height: 7}},
+				&fakeIndexer{},
+				&fakeProofStore{name: "b", ud: ud(1, 2),
+					undo: &accumulator.UndoBlock{Height: 7}},
+			},
+			want: ComparisonResult{
+				Block:   *id,
+				Indexes: []string{"a", "b"},
+			},
+		},
+		{
+			name: "two indexes diverging",
+			indexes: []Indexer{
+				&fakeProofStore{name: "a", ud: ud(1, 2),
+					undo: &accumulator.UndoBlock{Height: 7}},
+				&fakeProofStore{name: "b", ud: ud(1, 3),
+					undo: &accumulator.UndoBlock{Height: 6}},
+			},
+			want: ComparisonResult{
+				Block:   *id,
+				Indexes: []string{"a", "b"},
+				ProofDiffs: map[string][]string{
+					"b": {"target 1: a 2, b 3"},
+				},
+				UndoDiffs: []string{"b"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		m := NewManager(nil, test.indexes)
+		got, err := m.CompareIndexesAt(id)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: expected %+v, got %+v", test.name,
+				test.want, got)
+		}
+		if got.Agree() != (test.want.ProofDiffs == nil &&
+			test.want.UndoDiffs == nil) {
+
+			t.Fatalf("%s: unexpected agreement %v", test.name,
+				got.Agree())
+		}
+
+		proofs, err := m.FetchProofAllIndexes(id)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		undos, err := m.FetchUndoAllIndexes(id)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(proofs) != len(test.want.Indexes) ||
+			len(undos) != len(test.want.Indexes) {
+
+			t.Fatalf("%s: expected %d proofs and undo blocks, got "+
+				"%d and %d", test.name, len(test.want.Indexes),
+				len(proofs), len(undos))
+		}
+		for _, indexer := range test.indexes {
+			store, ok := indexer.(*fakeProofStore)
+			if !ok {
+				continue
+			}
+			if proofs[store.name] != store.ud {
+				t.Fatalf("%s: wrong proof for %s", test.name,
+					store.name)
+			}
+			if undos[store.name] != store.undo {
+				t.Fatalf("%s: wrong undo block for %s",
+					test.name, store.name)
+			}
+		}
+	}
+
+	// The divergence is described along with the block.
+	m := NewManager(nil, tests[2].indexes)
+	result, _ := m.CompareIndexesAt(id)
+	want := "indexes differ from the a on block " + id.Hash.String() +
+		" at height 7\n  b proof: target 1: a 2, b 3\n  b undo block differs"
+	if result.String() != want {
+		t.Fatalf("expected %q, got %q", want, result.String())
+	}
+
+	// Fetch errors are returned along with the index and no index to
+	// compare is an error.
+	fetchErr := errors.New("fetch failed")
+	m = NewManager(nil, []Indexer{
+		&fakeProofStore{name: "a", ud: ud(1)},
+		&fakeProofStore{name: "b", fetch: fetchErr},
+	})
+	_, err := m.CompareIndexesAt(id)
+	if !errors.Is(err, fetchErr) || !strings.Contains(err.Error(), "from the b") {
+		t.Fatalf("expected the fetch error of b, got %v", err)
+	}
+	m = NewManager(nil, []Indexer{&fakeIndexer{}})
+	if _, err := m.CompareIndexesAt(id); err == nil {
+		t.Fatal("expected an error without a utreexo proof index")
+	}
+}
+
+// TestVerifyUtreexoIndexes ensures that verifying the utreexo proof indexes
+// against each other reports the first block whose utreexo proof or undo block
+// they stored differently.
+func TestVerifyUtreexoIndexes(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestVerifyUtreexoIndexes", 1)
+	defer tearDown()
+
+	var idx *UtreexoProofIndex
+	var flatIdx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		switch index := indexer.(type) {
+		case *UtreexoProofIndex:
+			idx = index
+		case *FlatUtreexoProofIndex:
+			flatIdx = index
+		}
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 10; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	err := VerifyUtreexoIndexes(chain, idx, flatIdx, 0, tip.Height())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyUtreexoIndexes(chain, idx, flatIdx, 0, tip.Height()+1)
+	if err == nil {
+		t.Fatal("expected an error for a range past the tip")
+	}
+
+	blockID := func(height int32) *BlockID {
+		hash, err := chain.BlockHashByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &BlockID{Height: height, Hash: *hash}
+	}
+
+	// Store the undo block of block 8 for block 7 and the proof of block 6
+	// for block 4 in the utreexo proof index.
+	undo, err := idx.fetchUndo(blockID(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ud, err := idx.fetchProof(blockID(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.db.Update(func(dbTx database.Tx) error {
+		err := dbStoreUndoBlock(dbTx, &blockID(7).Hash, undo)
+		if err != nil {
+			return err
+		}
+		return dbStoreUtreexoProof(dbTx, &blockID(4).Hash, ud)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start      int32
+		wantHeight int32
+		wantUndo   bool
+	}{
+		{start: 5, wantHeight: 7, wantUndo: true},
+		{start: 0, wantHeight: 4},
+	}
+	for _, test := range tests {
+		err := VerifyUtreexoIndexes(chain, idx, flatIdx, test.start,
+			tip.Height())
+		var divergence *IndexDivergenceError
+		if !errors.As(err, &divergence) {
+			t.Fatalf("from %d: expected a divergence, got %v",
+				test.start, err)
+		}
+		result := divergence.Result
+		if result.Block.Height != test.wantHeight ||
+			(len(result.UndoDiffs) > 0) != test.wantUndo ||
+			(len(result.ProofDiffs) > 0) == test.wantUndo {
+
+			t.Fatalf("from %d: got %v", test.start, &result)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// completenessFileName is the name of the file in the directory of the
+	// proofs of the flat utreexo proof index that keeps the ranges of the
+	// block heights that are missing their proofs.
+	completenessFileName = "completeness.dat"
+)
+
+// ErrHeightUnservable is returned when the proof for a block height that the
+// index doesn't have is asked for.
+var ErrHeightUnservable = errors.New("utreexo proof height not servable")
+
+// HeightRange is an inclusive range of block heights.
+type HeightRange struct {
+	Start int32
+	End   int32
+}
+
+// Contains returns whether the given height is within the range.
+func (r HeightRange) Contains(height int32) bool {
+	return height >= r.Start && height <= r.End
+}
+
+// String returns the range in human-readable form.
+func (r HeightRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// addHeightRange returns the given set of sorted and disjoint ranges with the
+// range added to it.  Ranges that overlap or touch are merged.
+func addHeightRange(set []HeightRange, r HeightRange) []HeightRange {
+	if r.End < r.Start {
+		return set
+	}
+
+	merged := make([]HeightRange, 0, len(set)+1)
+	for _, other := range set {
+		switch {
+		case other.End+1 < r.Start:
+			merged = append(merged, other)
+		case r.End+1 < other.Start:
+			merged = append(merged, r)
+			r = other
+		default:
+			if other.Start < r.Start {
+				r.Start = other.Start
+			}
+			if other.End > r.End {
+				r.End = other.End
+			}
+		}
+	}
+
+	return append(merged, r)
+}
+
+// removeHeightRange returns the given set of sorted and disjoint ranges with the
+// range removed from it.
+func removeHeightRange(set []HeightRange, r HeightRange) []HeightRange {
+	if r.End < r.Start {
+		return set
+	}
+
+	left := make([]HeightRange, 0, len(set)+1)
+	for _, other := range set {
+		if other.End < r.Start || other.Start > r.End {
+			left = append(left, other)
+			continue
+		}
+		if other.Start < r.Start {
+			left = append(left, HeightRange{other.Start, r.Start - 1})
+		}
+		if other.End > r.End {
+			left = append(left, HeightRange{r.End + 1, other.End})
+		}
+	}
+
+	return left
+}
+
+// UnionHeightRanges returns the sorted and disjoint ranges that cover every
+// height in any of the given sets.
+func UnionHeightRanges(sets ...[]HeightRange) []HeightRange {
+	var union []HeightRange
+	for _, set := range sets {
+		for _, r := range set {
+			union = addHeightRange(union, r)
+		}
+	}
+
+	return union
+}
+
+// containsHeight returns whether the height is within any of the ranges.
+func containsHeight(set []HeightRange, height int32) bool {
+	for _, r := range set {
+		if r.Contains(height) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MsgProofRanges returns the ranges as a proofranges message.  The last range
+// follows the tip if it ends at the given tip height.
+func MsgProofRanges(ranges []HeightRange, tip int32) *wire.MsgProofRanges {
+	msg := wire.NewMsgProofRanges()
+	for _, r := range ranges {
+		if len(msg.Ranges) == wire.MaxProofRanges {
+			// Drop what doesn't fit rather than advertise heights
+			// that aren't served.
+			msg.FollowsTip = false
+			break
+		}
+		msg.Ranges = append(msg.Ranges, wire.ProofRange{
+			Start: r.Start,
+			End:   r.End,
+		})
+		msg.FollowsTip = r.End == tip
+	}
+
+	return msg
+}
+
+// UnservableHeightError is returned when the proof for a block height that's
+// outside of every range the index serves is asked for.
+type UnservableHeightError struct {
+	// Index is the name of the index that was asked.
+	Index string
+
+	// Height is the height that was asked for.
+	Height int32
+
+	// Servable are the ranges of heights that the index does serve.
+	Servable []HeightRange
+}
+
+// Error returns the error as a human-readable string.
+func (e *UnservableHeightError) Error() string {
+	ranges := make([]string, 0, len(e.Servable))
+	for _, r := range e.Servable {
+		ranges = append(ranges, r.String())
+	}
+
+	return fmt.Sprintf("%v: %s doesn't have the proof for height %d "+
+		"(serves %s)", ErrHeightUnservable, e.Index, e.Height,
+		strings.Join(ranges, ", "))
+}
+
+// Is returns true for ErrHeightUnservable so that callers may check for an
+// unservable height regardless of the index.
+func (e *UnservableHeightError) Is(target error) bool {
+	return target == ErrHeightUnservable
+}
+
+// RangeServer is implemented by the indexes that are able to tell which block
+// heights they serve the utreexo proofs for.
+type RangeServer interface {
+	// ServableRanges returns the sorted and disjoint ranges of block
+	// heights that the utreexo proofs are currently served for.
+	ServableRanges() ([]HeightRange, error)
+}
+
+// completeness keeps the ranges of block heights below the tip of an index
+// that are missing their proofs.  The ranges are persisted so that they're
+// known again after a restart.
+//
+// Nothing is missing for a nil completeness.
+type completeness struct {
+	mtx     sync.RWMutex
+	path    string
+	missing []HeightRange
+}
+
+// loadCompleteness loads the missing ranges persisted at the given path.
+// Nothing is missing if they were never persisted.
+func loadCompleteness(path string) (*completeness, error) {
+	c := &completeness{path: path}
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf)%8 != 0 {
+		return nil, fmt.Errorf("corrupt completeness file. Expected a "+
+			"multiple of 8 bytes but got %d", len(buf))
+	}
+	for i := 0; i < len(buf); i += 8 {
+		c.missing = addHeightRange(c.missing, HeightRange{
+			Start: int32(binary.BigEndian.Uint32(buf[i:])),
+			End:   int32(binary.BigEndian.Uint32(buf[i+4:])),
+		})
+	}
+
+	return c, nil
+}
+
+// write persists the missing ranges.
+//
+// This function MUST be called with the mutex locked.
+func (c *completeness) write() error {
+	buf := make([]byte, len(c.missing)*8)
+	for i, r := range c.missing {
+		binary.BigEndian.PutUint32(buf[i*8:], uint32(r.Start))
+		binary.BigEndian.PutUint32(buf[i*8+4:], uint32(r.End))
+	}
+
+	tmpPath := c.path + ".tmp"
+	err := os.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, c.path)
+}
+
+// markMissing records that the proofs for the given range are missing.
+//
+// This function is safe for concurrent access.
+func (c *completeness) markMissing(r HeightRange) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.missing = addHeightRange(c.missing, r)
+	return c.write()
+}
+
+// markServable records that the proofs for the given range are there again.
+//
+// This function is safe for concurrent access.
+func (c *completeness) markServable(r HeightRange) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.missing = removeHeightRange(c.missing, r)
+	return c.write()
+}
+
+// servable returns the ranges from the genesis block to the given tip that
+// aren't missing.
+//
+// This function is safe for concurrent access.
+func (c *completeness) servable(tip int32) []HeightRange {
+	if tip < 0 {
+		return nil
+	}
+	servable := []HeightRange{{0, tip}}
+	if c == nil {
+		return servable
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	for _, r := range c.missing {
+		servable = removeHeightRange(servable, r)
+	}
+
+	return servable
+}
+
+// isMissing returns whether the proof for the block at the given height is
+// missing.
+//
+// This function is safe for concurrent access.
+func (c *completeness) isMissing(height int32) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	return containsHeight(c.missing, height)
+}
+
+// ServableRanges returns the union of the ranges of block heights that the
+// enabled utreexo proof indexes serve the proofs for.  The indexes that are
+// unable to tell are left out.
+//
+// This function is safe for concurrent access.
+func (m *Manager) ServableRanges() []HeightRange {
+	var sets [][]HeightRange
+	for _, indexer := range m.enabledIndexes {
+		rs, ok := indexer.(RangeServer)
+		if !ok {
+			continue
+		}
+		ranges, err := rs.ServableRanges()
+		if err != nil {
+			log.Warnf("Unable to fetch the servable ranges of the "+
+				"%s: %v", indexer.Name(), err)
+			continue
+		}
+		sets = append(sets, ranges)
+	}
+
+	return UnionHeightRanges(sets...)
+}
+
+// ServableRanges returns the ranges of block heights that the utreexo proofs
+// are currently served for.  Nothing is served while the index is rebuilt, the
+// heights above the durable height aren't served once the index is degraded,
+// the heights that are being regenerated aren't served until they are, and the
+// pruned heights that aren't pinned aren't served.
+//
+// This is part of the RangeServer interface.
+func (idx *FlatUtreexoProofIndex) ServableRanges() ([]HeightRange, error) {
+	if idx.gate.check() != nil {
+		return nil, nil
+	}
+
+	tip := idx.proofState.BestHeight()
+	if durable, ok := idx.degraded.tip(); ok && durable < tip {
+		tip = durable
+	}
+
+	return removePruned(idx.complete.servable(tip), idx.PrunedHeight(),
+		idx.pins.list()), nil
+}
+
+// checkServable returns a ProofPrunedError if the proof for the block at the
+// given height was pruned and an UnservableHeightError if it's missing.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) checkServable(height int32) error {
+	err := idx.prune.checkProof(idx.Name(), height, idx.pins.isPinned)
+	if err != nil {
+		return err
+	}
+	if !idx.complete.isMissing(height) {
+		return nil
+	}
+
+	servable, err := idx.ServableRanges()
+	if err != nil {
+		return err
+	}
+	return &UnservableHeightError{
+		Index:    idx.Name(),
+		Height:   height,
+		Servable: servable,
+	}
+}
+
+// ServableRanges returns the ranges of block heights that the utreexo proofs
+// are currently served for.  Nothing is served while the index is rebuilt and
+// the pruned heights aren't served.
+//
+// This is part of the RangeServer interface.
+func (idx *UtreexoProofIndex) ServableRanges() ([]HeightRange, error) {
+	if idx.gate.check() != nil {
+		return nil, nil
+	}
+
+	tip, err := idx.tipHeight()
+	if err != nil {
+		return nil, err
+	}
+	if tip < 0 {
+		return nil, nil
+	}
+
+	return removePruned([]HeightRange{{0, tip}}, idx.PrunedHeight(), nil), nil
+}
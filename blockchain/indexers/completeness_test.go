@@ -0,0 +1,210 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/wire"
+)
+
+func TestHeightRangeSet(t *testing.T) {
+	var set []HeightRange
+	for _, r := range []HeightRange{{20, 29}, {0, 4}, {10, 14}, {5, 6},
+		{15, 19}, {40, 49}, {8, 7}} {
+
+		set = addHeightRange(set, r)
+	}
+	want := []HeightRange{{0, 6}, {10, 29}, {40, 49}}
+	if !reflect.DeepEqual(set, want) {
+		t.Fatalf("add: got %v, want %v", set, want)
+	}
+
+	set = removeHeightRange(set, HeightRange{3, 12})
+	set = removeHeightRange(set, HeightRange{45, 60})
+	want = []HeightRange{{0, 2}, {13, 29}, {40, 44}}
+	if !reflect.DeepEqual(set, want) {
+		t.Fatalf("remove: got %v, want %v", set, want)
+	}
+
+	union := UnionHeightRanges(set, []HeightRange{{2, 13}, {30, 35}},
+		nil, []HeightRange{{100, 100}})
+	want = []HeightRange{{0, 35}, {40, 44}, {100, 100}}
+	if !reflect.DeepEqual(union, want) {
+		t.Fatalf("union: got %v, want %v", union, want)
+	}
+
+	for height, want := range map[int32]bool{0: true, 35: true, 36: false,
+		44: true, 99: false, 100: true} {
+
+		if got := containsHeight(union, height); got != want {
+			t.Errorf("contains %d: got %v, want %v", height, got, want)
+		}
+	}
+}
+
+// TestCompletenessGaps ensures that the heights missing their proofs after
+// pruning and a shard outage are left out of the servable ranges, that they're
+// still missing after a restart, and that they're servable again once they're
+// backfilled.
+func TestCompletenessGaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), completenessFileName)
+	c, err := loadCompleteness(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.servable(100); !reflect.DeepEqual(got, []HeightRange{{0, 100}}) {
+		t.Fatalf("expected everything to be servable, got %v", got)
+	}
+
+	// The proofs of the first blocks are pruned and a shard holding the
+	// ones from 40 to 49 goes away.
+	if err := c.markMissing(HeightRange{0, 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.markMissing(HeightRange{40, 49}); err != nil {
+		t.Fatal(err)
+	}
+	want := []HeightRange{{10, 39}, {50, 100}}
+	if got := c.servable(100); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// The gaps are known again after a restart.
+	c, err = loadCompleteness(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.servable(100); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after reload got %v, want %v", got, want)
+	}
+
+	// Part of the shard is backfilled.
+	if err := c.markServable(HeightRange{40, 44}); err != nil {
+		t.Fatal(err)
+	}
+	want = []HeightRange{{10, 44}, {50, 100}}
+	if got := c.servable(100); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after backfill got %v, want %v", got, want)
+	}
+	if !c.isMissing(45) || c.isMissing(44) {
+		t.Fatal("expected only the heights that weren't backfilled to " +
+			"be missing")
+	}
+
+	// A corrupt file is refused.
+	if err := os.WriteFile(path, []byte{1, 2, 3}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCompleteness(path); err == nil {
+		t.Fatal("expected an error for a corrupt completeness file")
+	}
+
+	// Nothing is missing without a completeness.
+	var none *completeness
+	if err := none.markMissing(HeightRange{0, 9}); err != nil || none.isMissing(5) {
+		t.Fatal("expected nothing to be missing without a completeness")
+	}
+}
+
+// TestFlatServableRanges ensures that the flat utreexo proof index refuses the
+// heights that are missing their proofs with an UnservableHeightError and that
+// the ranges it advertises leave them out.
+func TestFlatServableRanges(t *testing.T) {
+	c, err := loadCompleteness(filepath.Join(t.TempDir(),
+		completenessFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := &FlatUtreexoProofIndex{
+		proofState: *NewFlatFileState(),
+		complete:   c,
+	}
+	idx.proofState.currentHeight = 60
+	if err := c.markMissing(HeightRange{20, 29}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = idx.FetchUtreexoProof(25, false)
+	var unservable *UnservableHeightError
+	if !errors.Is(err, ErrHeightUnservable) || !errors.As(err, &unservable) {
+		t.Fatalf("expected an UnservableHeightError, got %v", err)
+	}
+	want := []HeightRange{{0, 19}, {30, 60}}
+	if unservable.Height != 25 || !reflect.DeepEqual(unservable.Servable, want) {
+		t.Fatalf("unexpected error %+v", unservable)
+	}
+
+	// The last range follows the tip only when it ends at it.
+	msg := MsgProofRanges(want, 60)
+	wantMsg := &wire.MsgProofRanges{
+		Ranges: []wire.ProofRange{{Start: 0, End: 19},
+			{Start: 30, End: 60}},
+		FollowsTip: true,
+	}
+	if !reflect.DeepEqual(msg, wantMsg) {
+		t.Fatalf("got %+v, want %+v", msg, wantMsg)
+	}
+	if MsgProofRanges(want, 70).FollowsTip {
+		t.Fatal("expected the ranges behind the tip not to follow it")
+	}
+
+	// Nothing above the durable height is served once degraded.
+	idx.degraded.set(&DegradedError{DurableHeight: 35})
+	ranges, err := idx.ServableRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []HeightRange{{0, 19}, {30, 35}}; !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("got %v, want %v", ranges, want)
+	}
+}
+
+// rangeIndexer is an index that serves the proofs for the given ranges.
+type rangeIndexer struct {
+	fakeRebuilder
+	ranges []HeightRange
+	err    error
+}
+
+func (idx *rangeIndexer) ServableRanges() ([]HeightRange, error) {
+	return idx.ranges, idx.err
+}
+
+// TestManagerServableRanges ensures that the manager serves the union of what
+// the proof indexes serve and leaves out the ones that can't tell.
+func TestManagerServableRanges(t *testing.T) {
+	pruned := &rangeIndexer{
+		fakeRebuilder: fakeRebuilder{key: []byte("pruned")},
+		ranges:        []HeightRange{{50, 100}},
+	}
+	sharded := &rangeIndexer{
+		fakeRebuilder: fakeRebuilder{key: []byte("sharded")},
+		ranges:        []HeightRange{{0, 19}, {30, 60}},
+	}
+	broken := &rangeIndexer{
+		fakeRebuilder: fakeRebuilder{key: []byte("broken")},
+		ranges:        []HeightRange{{20, 29}},
+		err:           errors.New("unreadable"),
+	}
+	other := &fakeRebuilder{key: []byte("other")}
+	m := NewManager(nil, []Indexer{pruned, sharded, broken, other})
+
+	want := []HeightRange{{0, 19}, {30, 100}}
+	if got := m.ServableRanges(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	health := m.Health()
+	if !reflect.DeepEqual(health[1].Servable, sharded.ranges) ||
+		health[3].Servable != nil {
+
+		t.Fatalf("unexpected health %+v", health)
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+const (
+	// corpusDir is the directory in testdata that keeps the compatibility
+	// corpus.  Every entry in it is a directory with the data directory of
+	// a harness chain under corpusDataDir and its manifest.
+	corpusDir = "corpus"
+
+	// corpusDataDir is the name of the data directory of a corpus entry.
+	corpusDataDir = "data"
+
+	// corpusManifestName is the name of the manifest of a corpus entry.
+	corpusManifestName = "manifest.json"
+
+	// corpusBlocks is how many blocks the harness chain of a corpus entry
+	// has on top of the genesis block.
+	corpusBlocks = 24
+
+	// corpusUndoSnapshot is the undo snapshot interval that the flat
+	// utreexo proof index of the harness chain is built with so that both
+	// the full and the delta-encoded undo blocks are in the corpus.
+	corpusUndoSnapshot = 8
+)
+
+// generateCorpus is whether TestGenerateCorpus adds the corpus entry of the
+// current formats.  It's run by hand for every release that changes a format.
+var generateCorpus = flag.Bool("gencorpus", false, "generate the "+
+	"compatibility corpus entry of the current on-disk formats")
+
+// corpusFormats returns the current versions of the on-disk formats of the
+// utreexo proof indexes by name.  A format that gains a version must be added
+// here so that changing it requires a new corpus entry.
+func corpusFormats() map[string]uint32 {
+	return map[string]uint32{
+		"flatfile":         flatFileVersion,
+		"flatrecords":      flatFileRecordsVersion,
+		"accserialization": accSerializationVersion,
+		"flatindexformat":  flatIndexFormatVersion,
+	}
+}
+
+// corpusEntryName returns the name of the corpus entry of the given format
+// versions.
+func corpusEntryName(formats map[string]uint32) string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s%d", name, formats[name])
+	}
+	return strings.Join(parts, "-")
+}
+
+// corpusBlock is what the utreexo proof indexes stored for a block of the
+// harness chain.  The proof and the undo block are the hashes of their
+// serializations, the compact one for the proof.
+type corpusBlock struct {
+	Height int32  `json:"height"`
+	Hash   string `json:"hash"`
+	Proof  string `json:"proof"`
+	Undo   string `json:"undo"`
+}
+
+// corpusManifest describes a corpus entry along with what the current code must
+// read from it.
+type corpusManifest struct {
+	// Formats are the versions of the formats that the entry was written
+	// with.
+	Formats map[string]uint32 `json:"formats"`
+
+	// UndoSnapshotInterval is the undo snapshot interval that the flat
+	// utreexo proof index was built with.
+	UndoSnapshotInterval int32 `json:"undosnapshotinterval"`
+
+	// TipHeight and TipHash are the tip of the harness chain.
+	TipHeight int32  `json:"tipheight"`
+	TipHash   string `json:"tiphash"`
+
+	// Blocks are what was stored for every block after the genesis block.
+	Blocks []corpusBlock `json:"blocks"`
+
+	// NumLeaves and Roots are the accumulator at the tip.
+	NumLeaves uint64   `json:"numleaves"`
+	Roots     []string `json:"roots"`
+}
+
+// corpusParams returns the chain parameters of the harness chain.
+func corpusParams() chaincfg.Params {
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+	return params
+}
+
+// openCorpusChain opens the harness chain in the given data directory along
+// with both utreexo proof indexes through the same paths that a node opens them
+// on start up.
+func openCorpusChain(dataDir string, undoSnapshot int32, params *chaincfg.Params) (
+	database.DB, *blockchain.BlockChain, *UtreexoProofIndex,
+	*FlatUtreexoProofIndex, error) {
+
+	var db database.DB
+	var err error
+	if _, statErr := os.Stat(filepath.Join(dataDir, "metadata")); statErr == nil {
+		db, err = database.Open(testDbType, dataDir, blockDataNet)
+	} else {
+		db, err = database.Create(testDbType, dataDir, blockDataNet)
+	}
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	interval := int32(1)
+	flatIdx, err := NewFlatUtreexoProofIndex(dataDir, params, &interval,
+		undoSnapshot, false)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, nil, err
+	}
+	dbIdx, err := NewUtreexoProofIndex(db, dataDir, params)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	m := NewManager(db, []Indexer{dbIdx, flatIdx})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     m,
+	})
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, nil, err
+	}
+	err = m.Init(chain, nil)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	return db, chain, dbIdx, flatIdx, nil
+}
+
+// closeCorpusChain persists the harness chain and its indexes like a node does
+// on shutdown and closes its database.
+func closeCorpusChain(db database.DB, chain *blockchain.BlockChain,
+	dbIdx *UtreexoProofIndex, flatIdx *FlatUtreexoProofIndex) error {
+
+	defer db.Close()
+
+	err := dbIdx.FlushUtreexoState()
+	if err != nil {
+		return err
+	}
+	err = flatIdx.FlushUtreexoState()
+	if err != nil {
+		return err
+	}
+
+	return chain.FlushCachedState(blockchain.FlushRequired)
+}
+
+// corpusHash returns the hash of what the serialize function writes.
+func corpusHash(serialize func(w *bytes.Buffer) error) (string, error) {
+	var buf bytes.Buffer
+	err := serialize(&buf)
+	if err != nil {
+		return "", err
+	}
+
+	return chainhash.HashH(buf.Bytes()).String(), nil
+}
+
+// corpusFetch returns what the index stored for the block.
+func corpusFetch(store proofStore, height int32, hash *chainhash.Hash) (
+	corpusBlock, error) {
+
+	block := corpusBlock{Height: height, Hash: hash.String()}
+	id := &BlockID{Height: height, Hash: *hash}
+	ud, err := store.fetchProof(id)
+	if err != nil {
+		return block, fmt.Errorf("%s: %v", store.Name(), err)
+	}
+	block.Proof, err = corpusHash(func(w *bytes.Buffer) error {
+		return ud.SerializeCompact(w, false)
+	})
+	if err != nil {
+		return block, err
+	}
+
+	undo, err := store.fetchUndo(id)
+	if err != nil {
+		return block, fmt.Errorf("%s: %v", store.Name(), err)
+	}
+	block.Undo, err = corpusHash(func(w *bytes.Buffer) error {
+		return undo.Serialize(w)
+	})
+
+	return block, err
+}
+
+// corpusRoots returns the number of leaves and the roots of the accumulator of
+// the utreexo state.
+func corpusRoots(state *UtreexoState) (uint64, []string) {
+	numLeaves, _ := state.NumLeaves()
+	var roots []string
+	for _, root := range state.state.GetRoots() {
+		roots = append(roots, hex.EncodeToString(root[:]))
+	}
+
+	return numLeaves, roots
+}
+
+// copyTree copies the directory tree at src to dst without the lock and the log
+// files of the database.
+func copyTree(dst, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if info.Name() == "LOCK" || strings.HasPrefix(info.Name(), "LOG") {
+			return nil
+		}
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, buf, 0644)
+	})
+}
+
+// TestGenerateCorpus adds the compatibility corpus entry of the current formats
+// to testdata.  It only runs with -gencorpus:
+//
+//	go test -run TestGenerateCorpus -gencorpus
+func TestGenerateCorpus(t *testing.T) {
+	if !*generateCorpus {
+		t.Skip("the corpus is only generated with -gencorpus")
+	}
+
+	formats := corpusFormats()
+	entry := filepath.Join("testdata", corpusDir, corpusEntryName(formats))
+	if _, err := os.Stat(entry); err == nil {
+		t.Fatalf("the corpus entry %s already exists", entry)
+	}
+
+	dataDir := filepath.Join(t.TempDir(), corpusDataDir)
+	params := corpusParams()
+	db, chain, dbIdx, flatIdx, err := openCorpusChain(dataDir,
+		corpusUndoSnapshot, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < corpusBlocks; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	manifest := corpusManifest{
+		Formats:              formats,
+		UndoSnapshotInterval: corpusUndoSnapshot,
+		TipHeight:            tip.Height(),
+		TipHash:              tip.Hash().String(),
+	}
+	for height := int32(1); height <= tip.Height(); height++ {
+		hash, err := chain.BlockHashByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := corpusFetch(flatIdx, height, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Blocks = append(manifest.Blocks, block)
+	}
+	manifest.NumLeaves, manifest.Roots = corpusRoots(flatIdx.utreexoState)
+
+	err = closeCorpusChain(db, chain, dbIdx, flatIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = copyTree(filepath.Join(entry, corpusDataDir), dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.MarshalIndent(&manifest, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(entry, corpusManifestName),
+		append(buf, '\n'), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadCorpus returns the manifests of the corpus entries by their names.
+func loadCorpus(t *testing.T) map[string]*corpusManifest {
+	entries, err := os.ReadDir(filepath.Join("testdata", corpusDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corpus := make(map[string]*corpusManifest)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join("testdata", corpusDir,
+			entry.Name(), corpusManifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest corpusManifest
+		err = json.Unmarshal(buf, &manifest)
+		if err != nil {
+			t.Fatalf("%s: %v", entry.Name(), err)
+		}
+		corpus[entry.Name()] = &manifest
+	}
+
+	return corpus
+}
+
+// TestCorpusFormats ensures that the corpus has an entry for the current
+// versions of the on-disk formats so that a format change can't go in without
+// one.
+func TestCorpusFormats(t *testing.T) {
+	formats := corpusFormats()
+	corpus := loadCorpus(t)
+
+	for name, manifest := range corpus {
+		for format, version := range manifest.Formats {
+			current, ok := formats[format]
+			if !ok || version > current {
+				t.Fatalf("the corpus entry %s was written with %s "+
+					"version %d that this version doesn't know of",
+					name, format, version)
+			}
+		}
+	}
+
+	name := corpusEntryName(formats)
+	manifest, ok := corpus[name]
+	if !ok || !reflect.DeepEqual(manifest.Formats, formats) {
+		t.Fatalf("there's no compatibility corpus entry for the current "+
+			"on-disk formats %v.  An on-disk format changed, so add "+
+			"its entry by running\n\n\tgo test -run "+
+			"TestGenerateCorpus -gencorpus\n\nin blockchain/indexers "+
+			"and commit testdata/%s/%s along with the change.  Keep "+
+			"the entries of the previous formats so that they're "+
+			"still read", formats, corpusDir, name)
+	}
+}
+
+// TestCorpusReplay ensures that the current code opens every entry of the
+// compatibility corpus through the paths that a node opens its data directory
+// with, reads back what the manifest of the entry recorded, and keeps
+// connecting blocks on top of it.
+func TestCorpusReplay(t *testing.T) {
+	corpus := loadCorpus(t)
+	if len(corpus) == 0 {
+		t.Fatal("the compatibility corpus is empty")
+	}
+
+	for name, manifest := range corpus {
+		dataDir := filepath.Join(t.TempDir(), corpusDataDir)
+		err := copyTree(dataDir, filepath.Join("testdata", corpusDir, name,
+			corpusDataDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params := corpusParams()
+		db, chain, dbIdx, flatIdx, err := openCorpusChain(dataDir,
+			manifest.UndoSnapshotInterval, &params)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		best := chain.BestSnapshot()
+		if best.Height != manifest.TipHeight ||
+			best.Hash.String() != manifest.TipHash {
+
+			t.Fatalf("%s: expected the tip %s at height %d, got %v "+
+				"at height %d", name, manifest.TipHash,
+				manifest.TipHeight, best.Hash, best.Height)
+		}
+
+		for _, want := range manifest.Blocks {
+			hash, err := chainhash.NewHashFromStr(want.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, store := range []proofStore{dbIdx, flatIdx} {
+				got, err := corpusFetch(store, want.Height, hash)
+				if err != nil {
+					t.Fatalf("%s: height %d: %v", name,
+						want.Height, err)
+				}
+				if got != want {
+					t.Fatalf("%s: the %s read %+v, expected %+v",
+						name, store.Name(), got, want)
+				}
+			}
+		}
+
+		for _, state := range []*UtreexoState{dbIdx.utreexoState,
+			flatIdx.utreexoState} {
+
+			numLeaves, roots := corpusRoots(state)
+			if numLeaves != manifest.NumLeaves ||
+				!reflect.DeepEqual(roots, manifest.Roots) {
+
+				t.Fatalf("%s: expected %d leaves with the roots %v, "+
+					"got %d leaves with the roots %v", name,
+					manifest.NumLeaves, manifest.Roots,
+					numLeaves, roots)
+			}
+		}
+
+		// The indexes keep connecting blocks on top of what they read.
+		tip, err := chain.BlockByHash(&best.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tip, _ = blockchain.AddBlock(chain, tip, nil)
+		id := &BlockID{Height: tip.Height(), Hash: *tip.Hash()}
+		result, err := compareProofStores(id, []proofStore{dbIdx, flatIdx},
+			nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !result.Agree() {
+			t.Fatalf("%s: %v", name, result.String())
+		}
+
+		err = closeCorpusChain(db, chain, dbIdx, flatIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
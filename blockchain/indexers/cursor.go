@@ -0,0 +1,387 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// cursorVersion is the current serialization version of the Cursor.
+	// Any change to the serialization or to what the position of a cursor
+	// means for the indexes must bump this version.
+	cursorVersion = 2
+
+	// unleasedCursorVersion is the serialization version of the cursors
+	// from before they were leased.  They're still resumed.
+	unleasedCursorVersion = 1
+
+	// maxCursorIndexKeyLen is the maximum length of the index key that's
+	// serialized in a cursor.
+	maxCursorIndexKeyLen = 255
+)
+
+// ErrCursorInvalidated is returned when a cursor can't be resumed because the
+// blocks it scanned are no longer part of the index.
+var ErrCursorInvalidated = errors.New("cursor invalidated")
+
+// CursorInvalidatedError is returned when a cursor can't be resumed because a
+// reorg or a repair of the index touched the range it scanned.  RestartHeight
+// is the height the scan can safely be restarted from.
+type CursorInvalidatedError struct {
+	RestartHeight int32
+}
+
+// Error returns the error as a human-readable string.
+//
+// This is part of the error interface.
+func (e *CursorInvalidatedError) Error() string {
+	return fmt.Sprintf("%v: restart from height %d", ErrCursorInvalidated,
+		e.RestartHeight)
+}
+
+// Is returns whether the target is ErrCursorInvalidated.
+func (e *CursorInvalidatedError) Is(target error) bool {
+	return target == ErrCursorInvalidated
+}
+
+// Cursor is a position in a range scan of an index.  It's serializable so that
+// the caller may persist it and resume the scan after a restart.
+//
+// The cursor holds the hash of the last block that was scanned.  The hash is
+// checked when resuming so that a scan never silently continues past a reorg or
+// a repair of the index.
+type Cursor struct {
+	// indexKey is the key of the index the cursor was created for.
+	indexKey []byte
+
+	// height is the height of the next block to scan.
+	height int32
+
+	// hash is the hash of the block right before height.  It's all zeros
+	// when height is of the genesis block.
+	hash chainhash.Hash
+
+	// lease is the id of the lease of the cursor.  It's 0 if the cursor
+	// isn't leased.
+	lease uint64
+}
+
+// Height returns the height of the next block that'll be scanned.
+func (c *Cursor) Height() int32 {
+	return c.height
+}
+
+// Serialize returns the cursor serialized to bytes.
+//
+// The serialized format is:
+//
+//	<version><index key len><index key><height><hash><lease>
+//
+//	Field            Type       Size
+//	version          uint8      1
+//	index key len    uint8      1
+//	index key        []byte     index key len
+//	height           uint32     4
+//	hash             [32]byte   32
+//	lease            uint64     8
+//
+// The cursors of version 1 have no lease.
+func (c *Cursor) Serialize() []byte {
+	w := bytes.NewBuffer(make([]byte, 0, 2+len(c.indexKey)+4+chainhash.HashSize+8))
+	w.WriteByte(cursorVersion)
+	w.WriteByte(byte(len(c.indexKey)))
+	w.Write(c.indexKey)
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:4], uint32(c.height))
+	w.Write(buf[:4])
+	w.Write(c.hash[:])
+	binary.LittleEndian.PutUint64(buf[:], c.lease)
+	w.Write(buf[:])
+
+	return w.Bytes()
+}
+
+// DeserializeCursor returns the cursor from the bytes returned by Serialize.
+func DeserializeCursor(serialized []byte) (*Cursor, error) {
+	if len(serialized) < 2 {
+		return nil, fmt.Errorf("cursor of %d bytes is too short",
+			len(serialized))
+	}
+
+	version := serialized[0]
+	if version != cursorVersion && version != unleasedCursorVersion {
+		return nil, fmt.Errorf("unsupported cursor version %d, expected %d",
+			version, cursorVersion)
+	}
+
+	keyLen := int(serialized[1])
+	wantLen := 2 + keyLen + 4 + chainhash.HashSize
+	if version == cursorVersion {
+		wantLen += 8
+	}
+	if len(serialized) != wantLen {
+		return nil, fmt.Errorf("expected a cursor of %d bytes but got %d",
+			wantLen, len(serialized))
+	}
+
+	offset := 2
+	c := &Cursor{
+		indexKey: make([]byte, keyLen),
+	}
+	copy(c.indexKey, serialized[offset:offset+keyLen])
+	offset += keyLen
+
+	c.height = int32(binary.LittleEndian.Uint32(serialized[offset : offset+4]))
+	offset += 4
+	copy(c.hash[:], serialized[offset:offset+chainhash.HashSize])
+	offset += chainhash.HashSize
+	if version == cursorVersion {
+		c.lease = binary.LittleEndian.Uint64(serialized[offset:])
+	}
+
+	if c.height < 0 {
+		return nil, fmt.Errorf("invalid cursor height %d", c.height)
+	}
+
+	return c, nil
+}
+
+// newCursor returns a cursor for the index with the given key that starts the
+// scan at the given height of the main chain.
+func newCursor(chain indexChain, indexKey []byte, start int32) (*Cursor, error) {
+	if len(indexKey) > maxCursorIndexKeyLen {
+		return nil, fmt.Errorf("index key of %d bytes is too long for "+
+			"a cursor", len(indexKey))
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("invalid start height %d", start)
+	}
+
+	c := &Cursor{indexKey: indexKey, height: start}
+	if start == 0 {
+		return c, nil
+	}
+
+	hash, err := chain.BlockHashByHeight(start - 1)
+	if err != nil {
+		return nil, err
+	}
+	c.hash = *hash
+
+	return c, nil
+}
+
+// checkCursor returns an error if the cursor can't be resumed on the index with
+// the given key and tip height.  A CursorInvalidatedError is returned if the
+// block the cursor last scanned is no longer in the index.
+func checkCursor(chain indexChain, indexKey []byte, tip int32, c *Cursor) error {
+	if !bytes.Equal(c.indexKey, indexKey) {
+		return fmt.Errorf("cursor is for the index with the key %q, "+
+			"not %q", c.indexKey, indexKey)
+	}
+
+	// Nothing was scanned yet if the cursor is at the genesis block.
+	if c.height == 0 {
+		return nil
+	}
+
+	// A repair of the index may have removed the blocks the cursor
+	// scanned.
+	if c.height-1 > tip {
+		return &CursorInvalidatedError{RestartHeight: tip + 1}
+	}
+
+	if chain.MainChainHasBlock(&c.hash) {
+		return nil
+	}
+
+	// The last scanned block was reorged out.  Restart from the block
+	// after the fork point.  The locator is for the tip when the hash isn't
+	// known at all so restart from the beginning then.
+	restart := int32(1)
+	locator := chain.BlockLocatorFromHash(&c.hash)
+	if len(locator) > 0 && locator[0].IsEqual(&c.hash) {
+		for _, hash := range locator {
+			if !chain.MainChainHasBlock(hash) {
+				continue
+			}
+			height, err := chain.BlockHeightByHash(hash)
+			if err != nil {
+				return err
+			}
+			restart = height + 1
+			break
+		}
+	}
+	if restart > tip+1 {
+		restart = tip + 1
+	}
+
+	return &CursorInvalidatedError{RestartHeight: restart}
+}
+
+// forEachProof calls fn with the proofs fetched with fetch for the blocks
+// starting at the cursor up to the tip, or up to maxBlocks blocks if maxBlocks
+// is above 0.  The returned cursor is positioned right after the last block fn
+// was called for without an error.
+//
+// The cursor is looked up in the leases first and a LeaseError is returned if
+// its lease ended.  The cursors with an unknown lease, like the ones from
+// before a restart, are checked against the chain as if they weren't leased.
+// The returned cursor takes over the lease of the cursor so that only the
+// latest position of a scan is leased.
+func forEachProof(chain indexChain, leases *LeaseManager, indexKey []byte,
+	tip int32, c *Cursor, maxBlocks int32,
+	fetch func(int32, *chainhash.Hash) (*wire.UData, error),
+	fn func(int32, *chainhash.Hash, *wire.UData) error) (*Cursor, error) {
+
+	if c.lease != 0 {
+		_, err := leases.lookup(leases.now(), LeaseCursor, c.lease)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	next, err := scanProofs(chain, indexKey, tip, c, maxBlocks, fetch, fn)
+	if next != nil {
+		leaseCursor(leases, c.lease, next)
+	}
+
+	return next, err
+}
+
+// leaseCursor releases the lease with the given id and leases the cursor with
+// a new one.  The cursor is left unleased if there's no memory for the lease.
+func leaseCursor(leases *LeaseManager, prevLease uint64, c *Cursor) {
+	if prevLease != 0 {
+		leases.release(prevLease)
+	}
+
+	// The lease depends on the last scanned block.
+	id, _, err := leases.acquire(leases.now(), LeaseCursor,
+		leasePriorityCursor, cursorLeaseSize, c.height-1, nil)
+	if err != nil {
+		c.lease = 0
+		return
+	}
+	c.lease = id
+}
+
+// scanProofs does the scan of forEachProof without looking up or taking over
+// the lease of the cursor.
+func scanProofs(chain indexChain, indexKey []byte, tip int32,
+	c *Cursor, maxBlocks int32, fetch func(int32, *chainhash.Hash) (*wire.UData, error),
+	fn func(int32, *chainhash.Hash, *wire.UData) error) (*Cursor, error) {
+
+	err := checkCursor(chain, indexKey, tip, c)
+	if err != nil {
+		return nil, err
+	}
+
+	end := tip
+	if maxBlocks > 0 && c.height+maxBlocks-1 < end {
+		end = c.height + maxBlocks - 1
+	}
+
+	next := *c
+	for height := c.height; height <= end; height++ {
+		hash, err := chain.BlockHashByHeight(height)
+		if err != nil {
+			return &next, err
+		}
+
+		// Make sure that the block the cursor last scanned is still
+		// the parent as a reorg may happen during the scan.
+		header, err := chain.HeaderByHash(hash)
+		if err != nil {
+			return &next, err
+		}
+		if !header.PrevBlock.IsEqual(&next.hash) {
+			return &next, checkCursor(chain, indexKey, tip, &next)
+		}
+
+		ud, err := fetch(height, hash)
+		if err != nil {
+			return &next, err
+		}
+
+		err = fn(height, hash, ud)
+		if err != nil {
+			return &next, err
+		}
+
+		next.height = height + 1
+		next.hash = *hash
+	}
+
+	return &next, nil
+}
+
+// NewCursor returns a cursor that starts a range scan of the index at the
+// block at the given height of the main chain.
+func (idx *FlatUtreexoProofIndex) NewCursor(start int32) (*Cursor, error) {
+	return newCursor(idx.chain, idx.Key(), start)
+}
+
+// ForEachProof calls fn with the utreexo proof of each block starting at the
+// cursor, up to maxBlocks blocks or up to the index tip if maxBlocks is 0.  The
+// returned cursor may be persisted and passed back in to resume the scan.  It's
+// returned along with the error if fn or the fetching of a proof fails.
+//
+// A CursorInvalidatedError is returned if a reorg or a repair of the index
+// touched the range scanned by the cursor.  A LeaseError is returned if the
+// lease of the cursor expired, was shed, or was invalidated by a reorg.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) ForEachProof(c *Cursor, maxBlocks int32,
+	fn func(height int32, hash *chainhash.Hash, ud *wire.UData) error) (*Cursor, error) {
+
+	fetch := func(height int32, _ *chainhash.Hash) (*wire.UData, error) {
+		return idx.FetchUtreexoProof(height, false)
+	}
+
+	return forEachProof(idx.chain, idx.leases, idx.Key(),
+		idx.proofState.BestHeight(), c, maxBlocks, fetch, fn)
+}
+
+// NewCursor returns a cursor that starts a range scan of the index at the
+// block at the given height of the main chain.
+func (idx *UtreexoProofIndex) NewCursor(start int32) (*Cursor, error) {
+	return newCursor(idx.chain, idx.Key(), start)
+}
+
+// ForEachProof calls fn with the utreexo proof of each block starting at the
+// cursor, up to maxBlocks blocks or up to the index tip if maxBlocks is 0.  The
+// returned cursor may be persisted and passed back in to resume the scan.  It's
+// returned along with the error if fn or the fetching of a proof fails.
+//
+// A CursorInvalidatedError is returned if a reorg or a repair of the index
+// touched the range scanned by the cursor.  A LeaseError is returned if the
+// lease of the cursor expired, was shed, or was invalidated by a reorg.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) ForEachProof(c *Cursor, maxBlocks int32,
+	fn func(height int32, hash *chainhash.Hash, ud *wire.UData) error) (*Cursor, error) {
+
+	tip, err := idx.tipHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	fetch := func(_ int32, hash *chainhash.Hash) (*wire.UData, error) {
+		return idx.FetchUtreexoProof(hash)
+	}
+
+	return forEachProof(idx.chain, idx.leases, idx.Key(), tip, c,
+		maxBlocks, fetch, fn)
+}
@@ -0,0 +1,442 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+func TestCursorSerialize(t *testing.T) {
+	c := &Cursor{
+		indexKey: []byte("utreexoparentindexkey"),
+		height:   10,
+		hash:     chainhash.Hash{0x01, 0x02},
+	}
+
+	serialized := c.Serialize()
+	got, err := DeserializeCursor(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Fatalf("expected %+v, got %+v", c, got)
+	}
+
+	tests := []struct {
+		name       string
+		serialized []byte
+	}{
+		{"empty", nil},
+		{"unknown version", append([]byte{cursorVersion + 1}, serialized[1:]...)},
+		{"truncated", serialized[:len(serialized)-1]},
+		{"trailing bytes", append(append([]byte{}, serialized...), 0x00)},
+		{"negative height", (&Cursor{height: -1}).Serialize()},
+	}
+	for _, test := range tests {
+		_, err := DeserializeCursor(test.serialized)
+		if err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestCursorInvalidatedError(t *testing.T) {
+	var err error = &CursorInvalidatedError{RestartHeight: 5}
+	if !errors.Is(err, ErrCursorInvalidated) {
+		t.Fatalf("expected %v to be %v", err, ErrCursorInvalidated)
+	}
+}
+
+// proofScanner is the range scan api shared by the utreexo proof indexes.
+type proofScanner interface {
+	NewCursor(start int32) (*Cursor, error)
+	ForEachProof(c *Cursor, maxBlocks int32,
+		fn func(height int32, hash *chainhash.Hash, ud *wire.UData) error) (*Cursor, error)
+}
+
+// scanHashes returns the hashes of the blocks scanned from the cursor and the
+// cursor after the scan.
+func scanHashes(scanner proofScanner, c *Cursor, maxBlocks int32) (
+	[]chainhash.Hash, *Cursor, error) {
+
+	var hashes []chainhash.Hash
+	next, err := scanner.ForEachProof(c, maxBlocks,
+		func(height int32, hash *chainhash.Hash, _ *wire.UData) error {
+			if height != c.Height()+int32(len(hashes)) {
+				return errors.New("blocks scanned out of order")
+			}
+			hashes = append(hashes, *hash)
+			return nil
+		})
+
+	return hashes, next, err
+}
+
+// expectHashes returns an error if the hashes aren't of the given blocks.
+func expectHashes(hashes []chainhash.Hash, blocks []*btcutil.Block) error {
+	if len(hashes) != len(blocks) {
+		return fmt.Errorf("expected %d blocks scanned, got %d",
+			len(blocks), len(hashes))
+	}
+	for i, block := range blocks {
+		if !hashes[i].IsEqual(block.Hash()) {
+			return fmt.Errorf("unexpected block scanned at height %d",
+				block.Height())
+		}
+	}
+
+	return nil
+}
+
+func TestForEachProofCursor(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	testName := "TestForEachProofCursor"
+	chain, indexes, params, tearDown := indexersTestChain(testName, 1)
+	defer tearDown()
+
+	// Create a chain of 20 blocks.  blocks[i] is at height i+1.
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	blocks := make([]*btcutil.Block, 0, 20)
+	var outs [][]*blockchain.SpendableOut
+	for i := 0; i < 20; i++ {
+		var newOuts []*blockchain.SpendableOut
+		tip, newOuts = blockchain.AddBlock(chain, tip, nil)
+		blocks = append(blocks, tip)
+		outs = append(outs, newOuts)
+	}
+
+	// untouched is resumed after a reorg that doesn't touch the range it
+	// scanned and touched after a reorg that does.
+	untouched := make([]*Cursor, len(indexes))
+	touched := make([]*Cursor, len(indexes))
+	for i, indexer := range indexes {
+		scanner := indexer.(proofScanner)
+
+		c, err := scanner.NewCursor(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes, c, err := scanHashes(scanner, c, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := expectHashes(hashes, blocks[:10]); err != nil {
+			t.Fatalf("%s: %v", indexer.Name(), err)
+		}
+
+		// Persist the cursor and reopen the index.  The db backed
+		// index has nothing in memory to reopen.
+		serialized := c.Serialize()
+		if flatIdx, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			dataDir := filepath.Join(testDbRoot, testName)
+			proofState, err := loadFlatFileState(dataDir, flatUtreexoProofName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flatIdx.proofState = *proofState
+		}
+
+		c, err = DeserializeCursor(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes, c, err = scanHashes(scanner, c, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := expectHashes(hashes, blocks[10:15]); err != nil {
+			t.Fatalf("%s: %v", indexer.Name(), err)
+		}
+		untouched[i] = c
+
+		hashes, c, err = scanHashes(scanner, c, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := expectHashes(hashes, blocks[15:19]); err != nil {
+			t.Fatalf("%s: %v", indexer.Name(), err)
+		}
+		touched[i] = c
+	}
+
+	// Reorg out the blocks after height 17 with a longer chain.  The first
+	// block spends the coinbase of the block at height 17 so that it's
+	// different from the block it replaces.
+	altTip := blocks[16]
+	altBlocks := blocks[:17:17]
+	spends := outs[16]
+	for altTip.Height() < 22 {
+		altTip, _ = blockchain.AddBlock(chain, altTip, spends)
+		altBlocks = append(altBlocks, altTip)
+		spends = nil
+	}
+
+	for i, indexer := range indexes {
+		scanner := indexer.(proofScanner)
+
+		// The reorg happened after the range scanned by the cursor so
+		// the scan continues on the new chain.
+		hashes, _, err := scanHashes(scanner, untouched[i], 0)
+		if err != nil {
+			t.Fatalf("%s: %v", indexer.Name(), err)
+		}
+		if err := expectHashes(hashes, altBlocks[15:]); err != nil {
+			t.Fatalf("%s: %v", indexer.Name(), err)
+		}
+
+		// The cursor scanned blocks that were reorged out so it has to
+		// restart from the block after the fork point.
+		_, _, err = scanHashes(scanner, touched[i], 0)
+		var invalidErr *CursorInvalidatedError
+		if !errors.As(err, &invalidErr) {
+			t.Fatalf("%s: expected CursorInvalidatedError, got %v",
+				indexer.Name(), err)
+		}
+		if invalidErr.RestartHeight != 18 {
+			t.Fatalf("%s: expected restart height 18, got %d",
+				indexer.Name(), invalidErr.RestartHeight)
+		}
+	}
+}
+
+// TestFetchUtreexoProofBatch ensures that the proofs fetched in a batch are the
+// same as the ones fetched one at a time and that ranges that aren't fully
+// indexed are rejected.
+func TestFetchUtreexoProofBatch(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestFetchUtreexoProofBatch", 1)
+	defer tearDown()
+
+	var idx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		if flat, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			idx = flat
+		}
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 15; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	serialize := func(ud *wire.UData) []byte {
+		var buf bytes.Buffer
+		err := ud.SerializeCompact(&buf, udataSerializeBool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	for _, r := range [][2]int32{{0, 15}, {0, 0}, {1, 1}, {4, 11}, {15, 15}} {
+		uds, err := idx.FetchUtreexoProofBatch(r[0], r[1])
+		if err != nil {
+			t.Fatalf("heights %d to %d: %v", r[0], r[1], err)
+		}
+		if len(uds) != int(r[1]-r[0]+1) {
+			t.Fatalf("heights %d to %d: expected %d proofs, got %d",
+				r[0], r[1], r[1]-r[0]+1, len(uds))
+		}
+		for i, ud := range uds {
+			height := r[0] + int32(i)
+			want, err := idx.FetchUtreexoProof(height, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(serialize(ud), serialize(want)) {
+				t.Fatalf("proof at height %d differs from the one "+
+					"fetched on its own", height)
+			}
+		}
+	}
+
+	for _, r := range [][2]int32{{-1, 3}, {5, 4}, {10, 16}} {
+		_, err := idx.FetchUtreexoProofBatch(r[0], r[1])
+		if err == nil {
+			t.Fatalf("heights %d to %d: expected an error", r[0], r[1])
+		}
+	}
+}
+
+// TestFetchUtreexoProofs ensures that the proofs fetched for several blocks at
+// once are the same as the ones fetched one at a time and that the missing
+// block is identified.
+func TestFetchUtreexoProofs(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestFetchUtreexoProofs", 1)
+	defer tearDown()
+
+	var idx *UtreexoProofIndex
+	for _, indexer := range indexes {
+		if utreexoIdx, ok := indexer.(*UtreexoProofIndex); ok {
+			idx = utreexoIdx
+		}
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	hashes := []*chainhash.Hash{tip.Hash()}
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 10; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+		hashes = append(hashes, tip.Hash())
+	}
+
+	// Fetch them out of order.
+	hashes[2], hashes[7] = hashes[7], hashes[2]
+	uds, err := idx.FetchUtreexoProofs(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uds) != len(hashes) {
+		t.Fatalf("expected %d proofs, got %d", len(hashes), len(uds))
+	}
+	for i, ud := range uds {
+		want, err := idx.FetchUtreexoProof(hashes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ud, want) {
+			t.Fatalf("proof of block %v differs from the one fetched "+
+				"on its own", hashes[i])
+		}
+	}
+
+	missing := chainhash.Hash{0x01}
+	_, err = idx.FetchUtreexoProofs([]*chainhash.Hash{hashes[1], &missing,
+		hashes[3]})
+	var notFound *ProofNotFoundError
+	if !errors.As(err, &notFound) || notFound.Hash != missing {
+		t.Fatalf("expected a ProofNotFoundError for %v, got %v",
+			missing, err)
+	}
+	if !errors.Is(err, ErrProofNotFound) {
+		t.Fatalf("expected %v to be %v", err, ErrProofNotFound)
+	}
+}
+
+// TestFetchUtreexoRoots ensures that the roots fetched for a block are the ones
+// the accumulator had right after the block was connected and that fetching
+// them leaves the accumulator at the tip.
+func TestFetchUtreexoRoots(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestFetchUtreexoRoots", 1)
+	defer tearDown()
+
+	var idx *UtreexoProofIndex
+	for _, indexer := range indexes {
+		if utreexoIdx, ok := indexer.(*UtreexoProofIndex); ok {
+			idx = utreexoIdx
+		}
+	}
+
+	// roots returns the current roots and number of leaves of the index.
+	roots := func() ([]*chainhash.Hash, int64) {
+		idx.mtx.RLock()
+		defer idx.mtx.RUnlock()
+
+		accRoots := idx.utreexoState.state.GetRoots()
+		numLeaves, _ := idx.utreexoState.NumLeaves()
+		hashes := make([]*chainhash.Hash, 0, len(accRoots))
+		for _, root := range accRoots {
+			h := chainhash.Hash(root)
+			hashes = append(hashes, &h)
+		}
+
+		return hashes, int64(numLeaves)
+	}
+
+	type rootsAt struct {
+		hash      *chainhash.Hash
+		roots     []*chainhash.Hash
+		numLeaves int64
+	}
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	want := []rootsAt{{hash: tip.Hash(), roots: []*chainhash.Hash{}}}
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 10; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+		r, numLeaves := roots()
+		want = append(want, rootsAt{tip.Hash(), r, numLeaves})
+	}
+
+	// check fetches the roots of every block and compares them with the
+	// ones the accumulator had.
+	check := func() {
+		t.Helper()
+		for height, w := range want {
+			got, numLeaves, err := idx.FetchUtreexoRoots(w.hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if numLeaves != w.numLeaves {
+				t.Fatalf("expected %d leaves at height %d, got %d",
+					w.numLeaves, height, numLeaves)
+			}
+			if !reflect.DeepEqual(got, w.roots) {
+				t.Fatalf("expected roots %v at height %d, got %v",
+					w.roots, height, got)
+			}
+		}
+	}
+
+	// The roots are read from the ones stored when the blocks were
+	// connected.
+	check()
+
+	// The blocks connected before the roots were stored roll the
+	// accumulator back instead.
+	err := idx.db.Update(func(dbTx database.Tx) error {
+		for _, w := range want[1:] {
+			err := dbDeleteBlockRoots(dbTx, w.hash)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// The accumulator is back at the tip.
+	r, numLeaves := roots()
+	last := want[len(want)-1]
+	if numLeaves != last.numLeaves || !reflect.DeepEqual(r, last.roots) {
+		t.Fatalf("expected the accumulator back at the tip")
+	}
+
+	missing := chainhash.Hash{0x01}
+	_, _, err = idx.FetchUtreexoRoots(&missing)
+	var notFound *ProofNotFoundError
+	if !errors.As(err, &notFound) || notFound.Hash != missing {
+		t.Fatalf("expected a ProofNotFoundError for %v, got %v",
+			missing, err)
+	}
+}
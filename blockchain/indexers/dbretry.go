@@ -0,0 +1,393 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/database"
+)
+
+const (
+	// defaultDbRetries is how many times connecting a block to an index is
+	// attempted again after a transient database error before it's given
+	// up on.
+	defaultDbRetries = 4
+
+	// defaultDbRetryBackoff is how long the first attempt after a
+	// transient database error waits.  Every attempt after it waits twice
+	// as long as the one before, up to maxDbRetryBackoff.  The chain lock
+	// is held while waiting so the waits are kept short.
+	defaultDbRetryBackoff = 5 * time.Millisecond
+
+	// maxDbRetryBackoff is the longest an attempt after a transient
+	// database error waits.
+	maxDbRetryBackoff = 100 * time.Millisecond
+)
+
+// DbRetryStats are the counts of the attempts to connect blocks to an index
+// again after they failed with a transient database error.
+type DbRetryStats struct {
+	// Retries is the number of times connecting a block was attempted
+	// again.
+	Retries uint64
+
+	// Recovered is the number of blocks that were connected after being
+	// attempted again.
+	Recovered uint64
+
+	// Exhausted is the number of blocks that still failed to connect after
+	// every attempt.
+	Exhausted uint64
+}
+
+// retryingIndexer is an index whose connect may be attempted again after a
+// transient database error.  Its connect must only write to the database
+// transaction and to the state that it rolls back when it fails so that the
+// writes of a failed attempt can be undone.
+type retryingIndexer interface {
+	Indexer
+
+	// recordDbRetries records that connecting a block was attempted again
+	// the given number of times and whether it was connected in the end.
+	recordDbRetries(retries int, connected bool)
+}
+
+// dbRetryPolicy is how connecting a block to an index is attempted again after
+// a transient database error.
+type dbRetryPolicy struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// defaultDbRetryPolicy returns the retry policy that the index manager uses.
+func defaultDbRetryPolicy() dbRetryPolicy {
+	return dbRetryPolicy{
+		retries:    defaultDbRetries,
+		backoff:    defaultDbRetryBackoff,
+		maxBackoff: maxDbRetryBackoff,
+	}
+}
+
+// isTransientDbErr returns whether the database error may go away when the
+// writes are attempted again, like running out of file handles or contending
+// for a lock with the writes of the blocks.  Every other error, including the
+// ones that aren't database errors, is permanent.
+func isTransientDbErr(err error) bool {
+	// The writes of a block commit that couldn't be rolled back may be
+	// left in the index so they must never be attempted again.
+	var rbErr *commitRollbackError
+	if errors.As(err, &rbErr) {
+		return false
+	}
+
+	var dbErr database.Error
+	if !errors.As(err, &dbErr) || dbErr.ErrorCode != database.ErrDriverSpecific {
+		return false
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE,
+		syscall.EAGAIN, syscall.EINTR, syscall.EBUSY} {
+
+		if errors.Is(dbErr.Err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't transient,
+// or the retries run out.  The writes that a failed attempt did through the
+// transaction passed to fn are undone before the next attempt so that every
+// attempt is all-or-nothing.  The number of retries is returned along with the
+// error of the last attempt.
+func (p dbRetryPolicy) retry(dbTx database.Tx, fn func(database.Tx) error) (
+	int, error) {
+
+	backoff := p.backoff
+	for retries := 0; ; retries++ {
+		jTx := newJournalTx(dbTx)
+		err := fn(jTx)
+		if err == nil {
+			return retries, nil
+		}
+		if !isTransientDbErr(err) || retries == p.retries || jTx.irreversible {
+			return retries, err
+		}
+		if undoErr := jTx.undo(); undoErr != nil {
+			return retries, undoErr
+		}
+
+		log.Debugf("Retrying a database write in %v after a transient "+
+			"error: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+// connectIndex connects the block to the index.  The indexes that support it
+// are attempted again after a transient database error.
+func (m *Manager) connectIndex(dbTx database.Tx, indexer Indexer,
+	n *BlockNotification) error {
+
+	r, ok := indexer.(retryingIndexer)
+	if !ok {
+		return dbIndexConnectBlock(dbTx, indexer, n)
+	}
+
+	// The index is connected and its tip is put in separate attempts as
+	// the state that the index keeps outside of the database is already
+	// modified once it's connected.
+	var retries int
+	err := m.retryConnect(r, &retries, dbTx, func(tx database.Tx) error {
+		return dbIndexConnectAttempt(tx, indexer, n)
+	})
+	if err == nil {
+		err = m.retryConnect(r, &retries, dbTx, func(tx database.Tx) error {
+			return dbPutIndexerTip(tx, indexer.Key(), n.Block.Hash(),
+				n.Height)
+		})
+	}
+	if retries > 0 {
+		r.recordDbRetries(retries, err == nil)
+	}
+
+	return err
+}
+
+// retryConnect calls fn with the retry policy of the manager and adds the
+// retries it took to the passed in count.
+func (m *Manager) retryConnect(r retryingIndexer, retries *int, dbTx database.Tx,
+	fn func(database.Tx) error) error {
+
+	n, err := m.dbRetry.retry(dbTx, fn)
+	*retries += n
+	if n > 0 {
+		log.Infof("Connecting a block to the %s took %d retries after "+
+			"transient database errors (err: %v)", r.Name(), n, err)
+	}
+
+	return err
+}
+
+// journalTx is a database transaction that journals the writes done to the
+// buckets of its metadata so that they can be undone.
+type journalTx struct {
+	database.Tx
+
+	// undos are the functions that undo the writes in the order they
+	// were done.
+	undos []func() error
+
+	// irreversible is set once a write that can't be undone is done.
+	irreversible bool
+}
+
+// newJournalTx returns a journalTx that writes through to the passed in
+// transaction.
+func newJournalTx(dbTx database.Tx) *journalTx {
+	return &journalTx{Tx: dbTx}
+}
+
+// undo undoes the journaled writes in the reverse order they were done.
+func (tx *journalTx) undo() error {
+	for i := len(tx.undos) - 1; i >= 0; i-- {
+		if err := tx.undos[i](); err != nil {
+			return err
+		}
+	}
+	tx.undos = nil
+
+	return nil
+}
+
+// Metadata returns the top-most bucket for all metadata storage with the
+// writes to it and its nested buckets journaled.
+//
+// This is part of the database.Tx interface.
+func (tx *journalTx) Metadata() database.Bucket {
+	return &journalBucket{dbBucket: tx.Tx.Metadata(), tx: tx}
+}
+
+// StoreBlock stores the block in the database.  Stored blocks can't be undone.
+//
+// This is part of the database.Tx interface.
+func (tx *journalTx) StoreBlock(block *btcutil.Block) error {
+	tx.irreversible = true
+	return tx.Tx.StoreBlock(block)
+}
+
+// journalBucket is a database bucket that journals the writes done to it and
+// its nested buckets.
+type journalBucket struct {
+	dbBucket
+	tx *journalTx
+}
+
+// Bucket returns the nested bucket with the given key with the writes to it
+// journaled.  nil is returned if the bucket doesn't exist.
+//
+// This is part of the database.Bucket interface.
+func (b *journalBucket) Bucket(key []byte) database.Bucket {
+	bucket := b.dbBucket.Bucket(key)
+	if bucket == nil {
+		return nil
+	}
+
+	return &journalBucket{dbBucket: bucket, tx: b.tx}
+}
+
+// CreateBucket creates and returns a new nested bucket with the given key.
+//
+// This is part of the database.Bucket interface.
+func (b *journalBucket) CreateBucket(key []byte) (database.Bucket, error) {
+	bucket, err := b.dbBucket.CreateBucket(key)
+	if err != nil {
+		return nil, err
+	}
+	b.journalCreate(key)
+
+	return &journalBucket{dbBucket: bucket, tx: b.tx}, nil
+}
+
+// CreateBucketIfNotExists creates and returns a new nested bucket with the
+// given key if it does not already exist.
+//
+// This is part of the database.Bucket interface.
+func (b *journalBucket) CreateBucketIfNotExists(key []byte) (database.Bucket, error) {
+	existed := b.dbBucket.Bucket(key) != nil
+	bucket, err := b.dbBucket.CreateBucketIfNotExists(key)
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		b.journalCreate(key)
+	}
+
+	return &journalBucket{dbBucket: bucket, tx: b.tx}, nil
+}
+
+// journalCreate journals the creation of the nested bucket with the given key.
+func (b *journalBucket) journalCreate(key []byte) {
+	key = copyBytes(key)
+	b.tx.undos = append(b.tx.undos, func() error {
+		return b.dbBucket.DeleteBucket(key)
+	})
+}
+
+// DeleteBucket removes the nested bucket with the given key.  Deleted buckets
+// can't be undone.
+//
+// This is part of the database.Bucket interface.
+func (b *journalBucket) DeleteBucket(key []byte) error {
+	b.tx.irreversible = true
+	return b.dbBucket.DeleteBucket(key)
+}
+
+// Cursor returns a new cursor with the deletes done through it journaled.
+//
+// This is part of the database.Bucket interface.
+func (b *journalBucket) Cursor() database.Cursor {
+	return &journalCursor{dbCursor: b.dbBucket.Cursor(), bucket: b}
+}
+
+// Put saves the key/value pair to the bucket and journals the value it had.
+//
+// This is part of the database.Bucket interface.
+func (b *journalBucket) Put(key, value []byte) error {
+	b.journalKey(key)
+	err := b.dbBucket.Put(key, value)
+	if err != nil {
+		b.tx.undos = b.tx.undos[:len(b.tx.undos)-1]
+	}
+
+	return err
+}
+
+// Delete removes the key from the bucket and journals the value it had.
+//
+// This is part of the database.Bucket interface.
+func (b *journalBucket) Delete(key []byte) error {
+	b.journalKey(key)
+	err := b.dbBucket.Delete(key)
+	if err != nil {
+		b.tx.undos = b.tx.undos[:len(b.tx.undos)-1]
+	}
+
+	return err
+}
+
+// journalKey journals restoring the key to the value it has now.
+func (b *journalBucket) journalKey(key []byte) {
+	key = copyBytes(key)
+	prev := b.dbBucket.Get(key)
+	if prev == nil {
+		b.tx.undos = append(b.tx.undos, func() error {
+			return b.dbBucket.Delete(key)
+		})
+		return
+	}
+
+	prev = copyBytes(prev)
+	b.tx.undos = append(b.tx.undos, func() error {
+		return b.dbBucket.Put(key, prev)
+	})
+}
+
+// dbCursor lets journalCursor embed database.Cursor while overriding its
+// Bucket method.
+type dbCursor = database.Cursor
+
+// journalCursor is a database cursor that journals the deletes done through it.
+type journalCursor struct {
+	dbCursor
+	bucket *journalBucket
+}
+
+// Bucket returns the bucket the cursor was created for.
+//
+// This is part of the database.Cursor interface.
+func (c *journalCursor) Bucket() database.Bucket {
+	return c.bucket
+}
+
+// Delete removes the current key/value pair the cursor is at and journals it.
+//
+// This is part of the database.Cursor interface.
+func (c *journalCursor) Delete() error {
+	key := copyBytes(c.dbCursor.Key())
+	value := c.dbCursor.Value()
+
+	// A nil value is a nested bucket, which the cursor refuses to delete.
+	if value != nil {
+		value = copyBytes(value)
+		bucket := c.bucket.dbBucket
+		c.bucket.tx.undos = append(c.bucket.tx.undos, func() error {
+			return bucket.Put(key, value)
+		})
+	}
+	err := c.dbCursor.Delete()
+	if err != nil && value != nil {
+		c.bucket.tx.undos = c.bucket.tx.undos[:len(c.bucket.tx.undos)-1]
+	}
+
+	return err
+}
+
+// copyBytes returns a copy of the passed in bytes.  The keys and the values
+// returned by the database are only valid during the transaction and may be
+// reused by the caller.
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
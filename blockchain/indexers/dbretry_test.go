@@ -0,0 +1,419 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// dbFault fails the puts into the nested bucket with the given name.  Only the
+// puts of the given key fail if it's set.
+type dbFault struct {
+	bucket []byte
+	key    []byte
+	err    error
+
+	// failures is how many more puts fail and hits is how many failed.
+	failures int
+	hits     int
+}
+
+// faultyTx is a database transaction that fails the puts matched by its fault.
+type faultyTx struct {
+	database.Tx
+	fault *dbFault
+}
+
+// Metadata returns the top-most bucket with the puts into its nested buckets
+// failed by the fault.
+func (tx *faultyTx) Metadata() database.Bucket {
+	return &faultyBucket{dbBucket: tx.Tx.Metadata(), fault: tx.fault}
+}
+
+// faultyBucket is a database bucket that fails the puts matched by its fault.
+type faultyBucket struct {
+	dbBucket
+	name  []byte
+	fault *dbFault
+}
+
+// Bucket returns the nested bucket with the given key with its puts failed by
+// the fault.
+func (b *faultyBucket) Bucket(key []byte) database.Bucket {
+	bucket := b.dbBucket.Bucket(key)
+	if bucket == nil {
+		return nil
+	}
+
+	return &faultyBucket{dbBucket: bucket, name: key, fault: b.fault}
+}
+
+// Put fails if the fault matches the put and saves the key/value pair
+// otherwise.
+func (b *faultyBucket) Put(key, value []byte) error {
+	f := b.fault
+	if f.failures > 0 && bytes.Equal(b.name, f.bucket) &&
+		(f.key == nil || bytes.Equal(key, f.key)) {
+
+		f.failures--
+		f.hits++
+		return f.err
+	}
+
+	return b.dbBucket.Put(key, value)
+}
+
+// faultyManager is an index manager that connects the blocks with a transaction
+// that fails the puts matched by its fault.
+type faultyManager struct {
+	*Manager
+	fault *dbFault
+}
+
+// ConnectBlock connects the block with a transaction that fails the puts
+// matched by the fault.
+func (m *faultyManager) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
+	stxos []blockchain.SpentTxOut) error {
+
+	return m.Manager.ConnectBlock(&faultyTx{Tx: dbTx, fault: m.fault},
+		block, stxos)
+}
+
+// faultyTestChain creates a chain with the utreexo proof indexes whose blocks
+// are connected through the returned fault.
+func faultyTestChain(testName string) (*blockchain.BlockChain, []Indexer,
+	*Manager, *dbFault, func(), error) {
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	db, dbPath, err := createDB(testName)
+	tearDown := func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}
+	if err != nil {
+		return nil, nil, nil, nil, tearDown, err
+	}
+
+	m, indexes, err := initIndexes(1, dbPath, &db, &params)
+	if err != nil {
+		return nil, nil, nil, nil, tearDown, err
+	}
+	fault := &dbFault{}
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     &faultyManager{Manager: m, fault: fault},
+	})
+	if err != nil {
+		return nil, nil, nil, nil, tearDown, err
+	}
+	err = m.Init(chain, nil)
+	if err != nil {
+		return nil, nil, nil, nil, tearDown, err
+	}
+
+	return chain, indexes, m, fault, tearDown, nil
+}
+
+// tryAddBlock adds a block to the chain like blockchain.AddBlock but returns
+// the error that the block failed to be processed with.
+func tryAddBlock(chain *blockchain.BlockChain, prev *btcutil.Block,
+	spends []*blockchain.SpendableOut) (block *btcutil.Block,
+	outs []*blockchain.SpendableOut, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	block, outs = blockchain.AddBlock(chain, prev, spends)
+
+	return block, outs, nil
+}
+
+// TestIsTransientDbErr ensures that only the database errors that may go away
+// are retried.
+func TestIsTransientDbErr(t *testing.T) {
+	driverErr := func(err error) error {
+		return database.Error{
+			ErrorCode:   database.ErrDriverSpecific,
+			Description: "failed to open file",
+			Err:         err,
+		}
+	}
+	emfile := driverErr(&os.PathError{Op: "open", Path: "000001.ldb",
+		Err: syscall.EMFILE})
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"file handles", emfile, true},
+		{"wrapped", fmt.Errorf("store proof: %w", emfile), true},
+		{"lock contention", driverErr(syscall.EAGAIN), true},
+		{"interrupted", driverErr(syscall.EINTR), true},
+		{"other driver error", driverErr(errors.New("bad")), false},
+		{"corruption", database.Error{ErrorCode: database.ErrCorruption,
+			Err: syscall.EAGAIN}, false},
+		{"tx closed", database.Error{ErrorCode: database.ErrTxClosed}, false},
+		{"not a database error", syscall.EMFILE, false},
+		{"rolled back", &commitRollbackError{rollbackErr: errors.New("undo"),
+			err: emfile}, false},
+	}
+	for _, test := range tests {
+		if got := isTransientDbErr(test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestDbRetry ensures that the blocks whose database writes fail with transient
+// errors are connected once the errors go away, that the writes of the failed
+// attempts are undone, and that permanent errors fail the block right away.
+func TestDbRetry(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, m, fault, tearDown, err := faultyTestChain("TestDbRetry")
+	defer tearDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.dbRetry.backoff = time.Millisecond
+
+	var idx *UtreexoProofIndex
+	for _, indexer := range indexes {
+		if utreexoIdx, ok := indexer.(*UtreexoProofIndex); ok {
+			idx = utreexoIdx
+		}
+	}
+
+	tip := btcutil.NewBlock(chaincfg.RegressionNetParams.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 5; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	transient := database.Error{
+		ErrorCode:   database.ErrDriverSpecific,
+		Description: "failed to open file",
+		Err:         &os.PathError{Op: "open", Err: syscall.EMFILE},
+	}
+	tests := []struct {
+		name      string
+		bucket    []byte
+		key       []byte
+		err       error
+		failures  int
+		connected bool
+		want      DbRetryStats
+	}{
+		{
+			// The proof is put before the undo block so it has to
+			// be undone on every failed attempt.
+			name:      "undo block put",
+			bucket:    utreexoUndoKey,
+			err:       transient,
+			failures:  3,
+			connected: true,
+			want:      DbRetryStats{Retries: 3, Recovered: 1},
+		},
+		{
+			name:      "tip put",
+			bucket:    indexTipsBucketName,
+			key:       idx.Key(),
+			err:       transient,
+			failures:  2,
+			connected: true,
+			want:      DbRetryStats{Retries: 5, Recovered: 2},
+		},
+		{
+			name:     "retries exhausted",
+			bucket:   utreexoUndoKey,
+			err:      transient,
+			failures: defaultDbRetries + 1,
+			want:     DbRetryStats{Retries: 9, Recovered: 2, Exhausted: 1},
+		},
+		{
+			name:   "permanent error",
+			bucket: utreexoUndoKey,
+			err: database.Error{
+				ErrorCode:   database.ErrCorruption,
+				Description: "corrupt",
+			},
+			failures: 1,
+			want:     DbRetryStats{Retries: 9, Recovered: 2, Exhausted: 1},
+		},
+	}
+	for _, test := range tests {
+		*fault = dbFault{
+			bucket:   test.bucket,
+			key:      test.key,
+			err:      test.err,
+			failures: test.failures,
+		}
+
+		block, outs, err := tryAddBlock(chain, tip, spends)
+		if test.connected != (err == nil) {
+			t.Fatalf("%s: block connected %v, want %v (err: %v)",
+				test.name, err == nil, test.connected, err)
+		}
+		best := chain.BestSnapshot()
+		if fault.hits != test.failures {
+			t.Fatalf("%s: %d of the puts failed, want %d", test.name,
+				fault.hits, test.failures)
+		}
+		if got := idx.Stats().DbRetries; got != test.want {
+			t.Fatalf("%s: got retry stats %+v, want %+v", test.name,
+				got, test.want)
+		}
+		if test.connected {
+			tip, spends = block, outs
+		}
+		if best.Hash != *tip.Hash() {
+			t.Fatalf("%s: chain tip is %v, want %v", test.name,
+				best.Hash, tip.Hash())
+		}
+
+		// Both indexes hold the same proofs for every block of the
+		// chain after the failed attempts.
+		err = compareUtreexoIdx(1, best.Height+1, chain, indexes)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err = testUtreexoProof(tip, chain, indexes)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+
+	// The indexes still connect the blocks that extend the tip that the
+	// failed blocks were on.
+	*fault = dbFault{}
+	tip, _ = blockchain.AddBlock(chain, tip, spends)
+	if chain.BestSnapshot().Hash != *tip.Hash() {
+		t.Fatalf("block after the failed blocks wasn't connected")
+	}
+	err = testUtreexoProof(tip, chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestJournalTxUndo ensures that undoing the journaled writes leaves the
+// buckets as they were before the writes.
+func TestJournalTxUndo(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestJournalTxUndo")
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucketKey := []byte("journaltest")
+	err = db.Update(func(dbTx database.Tx) error {
+		bucket, err := dbTx.Metadata().CreateBucket(bucketKey)
+		if err != nil {
+			return err
+		}
+		for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+			err := bucket.Put([]byte(kv[0]), []byte(kv[1]))
+			if err != nil {
+				return err
+			}
+		}
+
+		jTx := newJournalTx(dbTx)
+		jBucket := jTx.Metadata().Bucket(bucketKey)
+		if err := jBucket.Put([]byte("a"), []byte("changed")); err != nil {
+			return err
+		}
+		if err := jBucket.Put([]byte("d"), []byte("added")); err != nil {
+			return err
+		}
+		if err := jBucket.Delete([]byte("b")); err != nil {
+			return err
+		}
+		cursor := jBucket.Cursor()
+		if !cursor.Seek([]byte("c")) {
+			return fmt.Errorf("key c not found")
+		}
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+		nested, err := jBucket.CreateBucketIfNotExists([]byte("nested"))
+		if err != nil {
+			return err
+		}
+		if err := nested.Put([]byte("e"), []byte("5")); err != nil {
+			return err
+		}
+		if jTx.irreversible {
+			return fmt.Errorf("journaled writes marked irreversible")
+		}
+
+		if err := jTx.undo(); err != nil {
+			return err
+		}
+
+		got := make(map[string]string)
+		err = bucket.ForEach(func(k, v []byte) error {
+			got[string(k)] = string(v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		want := map[string]string{"a": "1", "b": "2", "c": "3"}
+		if len(got) != len(want) {
+			return fmt.Errorf("got %v after the undo, want %v", got, want)
+		}
+		for k, v := range want {
+			if got[k] != v {
+				return fmt.Errorf("got %v after the undo, want %v",
+					got, want)
+			}
+		}
+		if bucket.Bucket([]byte("nested")) != nil {
+			return fmt.Errorf("created bucket wasn't deleted")
+		}
+
+		// Deleted buckets can't be brought back.
+		if err := jTx.Metadata().DeleteBucket(bucketKey); err != nil {
+			return err
+		}
+		if !jTx.irreversible {
+			return fmt.Errorf("deleted bucket not marked irreversible")
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
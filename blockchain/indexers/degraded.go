@@ -0,0 +1,243 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/utreexo/utreexod/database"
+)
+
+// ErrIndexDegraded is returned when a degraded index is asked for what it
+// doesn't have persisted.
+var ErrIndexDegraded = errors.New("index is degraded to read-only")
+
+// DegradedError is returned by the fetches of a degraded index for the blocks
+// above the height it was rolled back to.
+type DegradedError struct {
+	// Index is the name of the degraded index.
+	Index string
+
+	// DurableHeight is the height that the index was rolled back to.  It's
+	// -1 if the index had nothing of the main chain persisted.
+	DurableHeight int32
+
+	// Cause is the write failure that degraded the index.
+	Cause error
+}
+
+// Error returns the error as a human-readable string.
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("%v: %s only serves up to height %d after the "+
+		"write failure: %v", ErrIndexDegraded, e.Index, e.DurableHeight,
+		e.Cause)
+}
+
+// Is returns true for ErrIndexDegraded so that callers may check for a degraded
+// index regardless of the cause.
+func (e *DegradedError) Is(target error) bool {
+	return target == ErrIndexDegraded
+}
+
+// isPersistentWriteErr returns whether the error is a write failure that won't
+// go away without the operator stepping in, like the file system being
+// remounted read-only or the database refusing writes.
+func isPersistentWriteErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.EROFS) {
+		return true
+	}
+	var dbErr database.Error
+	return errors.As(err, &dbErr) && dbErr.ErrorCode == database.ErrTxNotWritable
+}
+
+// degradedGate refuses the fetches of an index for the blocks it doesn't have
+// persisted once it's degraded.
+type degradedGate struct {
+	mtx sync.RWMutex
+	err *DegradedError
+}
+
+// set makes the gate refuse the fetches above the durable height of the error.
+//
+// This function is safe for concurrent access.
+func (g *degradedGate) set(err *DegradedError) {
+	g.mtx.Lock()
+	g.err = err
+	g.mtx.Unlock()
+}
+
+// check returns a DegradedError if the index is degraded and the block at the
+// given height is above the height it was rolled back to.
+//
+// This function is safe for concurrent access.
+func (g *degradedGate) check(height int32) error {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.err == nil || height <= g.err.DurableHeight {
+		return nil
+	}
+
+	return g.err
+}
+
+// tip returns the height that the index was rolled back to and whether it's
+// degraded.
+//
+// This function is safe for concurrent access.
+func (g *degradedGate) tip() (int32, bool) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.err == nil {
+		return 0, false
+	}
+
+	return g.err.DurableHeight, true
+}
+
+// degradable is an index that keeps state in memory ahead of what it
+// persisted.
+type degradable interface {
+	// rollbackToDurable rolls the state kept in memory back from the given
+	// tip to the height it was last persisted at and makes the index
+	// refuse to serve the blocks above that height.  It returns the height
+	// that the state was rolled back to.
+	rollbackToDurable(tip int32, cause error) (int32, error)
+}
+
+// IndexHealth is the health of an index managed by the index manager.
+type IndexHealth struct {
+	// Name is the name of the index.
+	Name string
+
+	// Degraded is whether the index was degraded to read-only after a
+	// write failure that won't go away without a restart.
+	Degraded bool
+
+	// Servable are the ranges of block heights that the index serves the
+	// utreexo proofs for.  They're only set for the proof indexes.
+	Servable []HeightRange
+
+	// The fields below are only set for degraded indexes.
+	//
+	// Cause is the write failure that degraded the index and Since is
+	// when it happened.
+	Cause error
+	Since time.Time
+
+	// DurableHeight is the height that the index was rolled back to and
+	// still serves up to.  It's -1 if nothing is served.
+	DurableHeight int32
+
+	// SkippedConnects and SkippedDisconnects are the number of blocks
+	// that were connected and disconnected since the index was degraded
+	// and weren't applied to it.
+	SkippedConnects    uint64
+	SkippedDisconnects uint64
+}
+
+// degrade takes the index out of the connects and the disconnects for good
+// after a write failure that won't go away.  What the index keeps in memory is
+// rolled back to what it persisted so that it's served consistently until the
+// node is restarted.  The tip is the height of the last block that the index
+// connected.
+func (m *Manager) degrade(indexer Indexer, tip int32, cause error) {
+	durable := tip
+	if d, ok := indexer.(degradable); ok {
+		var err error
+		durable, err = d.rollbackToDurable(tip, cause)
+		if err != nil {
+			log.Errorf("Unable to roll back the %s to what it "+
+				"persisted: %v", indexer.Name(), err)
+			durable = -1
+		}
+	}
+
+	log.Warnf("The %s is unable to write (%v) -- serving what it has up "+
+		"to height %d read-only.  Restart the node once the storage is "+
+		"writable again", indexer.Name(), cause, durable)
+
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	if m.degraded == nil {
+		m.degraded = make(map[Indexer]*IndexHealth)
+	}
+	m.degraded[indexer] = &IndexHealth{
+		Name:          indexer.Name(),
+		Degraded:      true,
+		Cause:         cause,
+		Since:         time.Now(),
+		DurableHeight: durable,
+	}
+}
+
+// skipDegraded returns whether the index is degraded and counts the skipped
+// connect or disconnect if it is.
+//
+// This function is safe for concurrent access.
+func (m *Manager) skipDegraded(indexer Indexer, connect bool) bool {
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	health, ok := m.degraded[indexer]
+	if !ok {
+		return false
+	}
+	if connect {
+		health.SkippedConnects++
+	} else {
+		health.SkippedDisconnects++
+	}
+
+	return true
+}
+
+// isDegraded returns whether the index is degraded.
+//
+// This function is safe for concurrent access.
+func (m *Manager) isDegraded(indexer Indexer) bool {
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	_, ok := m.degraded[indexer]
+	return ok
+}
+
+// Health returns the health of every enabled index in the order they're
+// enabled in.
+//
+// This function is safe for concurrent access.
+func (m *Manager) Health() []IndexHealth {
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	health := make([]IndexHealth, 0, len(m.enabledIndexes))
+	for _, indexer := range m.enabledIndexes {
+		h := IndexHealth{Name: indexer.Name()}
+		if degraded, ok := m.degraded[indexer]; ok {
+			h = *degraded
+		}
+		if rs, ok := indexer.(RangeServer); ok {
+			servable, err := rs.ServableRanges()
+			if err != nil {
+				log.Warnf("Unable to fetch the servable ranges of "+
+					"the %s: %v", indexer.Name(), err)
+			}
+			h.Servable = servable
+		}
+		health = append(health, h)
+	}
+
+	return health
+}
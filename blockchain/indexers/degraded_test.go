@@ -0,0 +1,202 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// unwritableIndexer is a degradable index whose writes fail from the given
+// height on like they do when the file system is remounted read-only.
+type unwritableIndexer struct {
+	fakeRebuilder
+	failFrom int32
+	durable  int32
+
+	// tip is the height of the last block in the state kept in memory.
+	tip int32
+
+	connects  int
+	rollbacks []int32
+	degraded  degradedGate
+}
+
+func (idx *unwritableIndexer) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	idx.connects++
+	if n.Height >= idx.failFrom {
+		return &os.PathError{Op: "write", Path: "proofs", Err: syscall.EROFS}
+	}
+	idx.tip = n.Height
+	return idx.fakeRebuilder.ConnectBlock(dbTx, n)
+}
+
+func (idx *unwritableIndexer) DurableHeight() int32 { return idx.durable }
+
+func (idx *unwritableIndexer) rollbackToDurable(tip int32, cause error) (int32, error) {
+	idx.rollbacks = append(idx.rollbacks, tip)
+	idx.degraded.set(&DegradedError{
+		Index:         idx.Name(),
+		DurableHeight: idx.durable,
+		Cause:         cause,
+	})
+	idx.tip = idx.durable
+	return idx.durable, nil
+}
+
+func TestIsPersistentWriteErr(t *testing.T) {
+	rofs := &os.PathError{Op: "write", Path: "proofs", Err: syscall.EROFS}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"read-only file system", rofs, true},
+		{"failed rollback", fmt.Errorf("failed to roll back: %v "+
+			"after error: %w", errors.New("truncate"), rofs), true},
+		{"read-only transaction", database.Error{
+			ErrorCode: database.ErrTxNotWritable}, true},
+		{"permission denied", &os.PathError{Op: "write", Path: "proofs",
+			Err: syscall.EACCES}, false},
+		{"corruption", database.Error{ErrorCode: database.ErrCorruption},
+			false},
+	}
+	for _, test := range tests {
+		if got := isPersistentWriteErr(test.err); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want,
+				got)
+		}
+	}
+}
+
+// TestManagerDegradesUnwritableIndex ensures that an index that's unable to
+// write mid-sync is rolled back to its durable height, serves up to it, and
+// stays out of the way of the other indexes for the rest of the run.
+func TestManagerDegradesUnwritableIndex(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestManagerDegradesUnwritableIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	// The writes fail from block 6 on and the state was last persisted at
+	// block 3.
+	healthy := &fakeRebuilder{key: []byte("healthy")}
+	unwritable := &unwritableIndexer{
+		fakeRebuilder: fakeRebuilder{key: []byte("unwritable")},
+		failFrom:      6,
+		durable:       3,
+	}
+	m := NewManager(db, []Indexer{healthy, unwritable})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Init(chain, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const numBlocks = 50
+	var spends []*blockchain.SpendableOut
+	block := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < numBlocks; b++ {
+		block, spends = blockchain.AddBlock(chain, block, spends)
+		if err := m.FlushIndexes(); err != nil {
+			t.Fatalf("block %d: %v", block.Height(), err)
+		}
+	}
+
+	// The index was rolled back once from the last block it connected
+	// and was never asked to connect another block after the genesis
+	// block and blocks 1 to 6.
+	if !reflect.DeepEqual(unwritable.rollbacks, []int32{5}) {
+		t.Fatalf("expected a single rollback from height 5, got %v",
+			unwritable.rollbacks)
+	}
+	if unwritable.tip != 3 || unwritable.connects != 7 {
+		t.Fatalf("expected the index to be at height 3 after 7 "+
+			"connects, got height %d after %d", unwritable.tip,
+			unwritable.connects)
+	}
+
+	// The index serves up to its durable height and nothing above it.
+	if err := unwritable.degraded.check(3); err != nil {
+		t.Fatalf("expected height 3 to be served, got %v", err)
+	}
+	err = unwritable.degraded.check(4)
+	var degradedErr *DegradedError
+	if !errors.Is(err, ErrIndexDegraded) || !errors.As(err, &degradedErr) ||
+		!errors.Is(degradedErr.Cause, syscall.EROFS) {
+
+		t.Fatalf("expected a DegradedError caused by EROFS, got %v", err)
+	}
+
+	// The other index kept going while the tip of the degraded one stayed
+	// at the last block it connected.
+	tips := make(map[string]int32)
+	err = db.View(func(dbTx database.Tx) error {
+		for _, indexer := range []Indexer{healthy, unwritable} {
+			_, height, err := dbFetchIndexerTip(dbTx, indexer.Key())
+			if err != nil {
+				return err
+			}
+			tips[indexer.Name()] = height
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tips[healthy.Name()] != numBlocks || tips[unwritable.Name()] != 5 {
+		t.Fatalf("unexpected index tips %v", tips)
+	}
+
+	// The degraded index no longer holds the durable height back.
+	if _, ok := m.DurableHeight(); ok {
+		t.Fatal("expected no durable height without a healthy aligner")
+	}
+
+	health := m.Health()
+	if len(health) != 2 ||
+		!reflect.DeepEqual(health[0], IndexHealth{Name: healthy.Name()}) {
+
+		t.Fatalf("expected the first index to be healthy, got %+v", health)
+	}
+	got := health[1]
+	if !got.Degraded || got.Name != unwritable.Name() ||
+		got.DurableHeight != 3 || got.SkippedConnects != numBlocks-6 ||
+		got.SkippedDisconnects != 0 || got.Since.IsZero() ||
+		!errors.Is(got.Cause, syscall.EROFS) {
+
+		t.Fatalf("unexpected health of the degraded index %+v", got)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/utreexo/utreexod/database"
+)
+
+// ErrFlatIndexIncomplete is matched by errors.Is for a FlatIndexIncompleteError.
+var ErrFlatIndexIncomplete = errors.New("flat utreexo proof index is incomplete")
+
+// FlatIndexIncompleteError is returned once the flat utreexo proof index is
+// dropped if some of the directories that it was created with were already
+// missing.  Everything else of the index is still dropped.
+type FlatIndexIncompleteError struct {
+	// Missing are the paths of the directories that were missing.
+	Missing []string
+}
+
+// Error returns the error as a human-readable string.
+func (e *FlatIndexIncompleteError) Error() string {
+	return fmt.Sprintf("dropped the %s, but it was already partially "+
+		"deleted: missing %s", flatUtreexoProofIndexName,
+		strings.Join(e.Missing, ", "))
+}
+
+// Is returns whether the target is ErrFlatIndexIncomplete.
+func (e *FlatIndexIncompleteError) Is(target error) bool {
+	return target == ErrFlatIndexIncomplete
+}
+
+// flatIndexDir is a directory that the flat utreexo proof index keeps in the
+// data directory.
+type flatIndexDir struct {
+	path string
+
+	// required is whether the directory is created along with the index.
+	required bool
+}
+
+// flatIndexDirs returns the flat file directories that the flat utreexo proof
+// index keeps in the data directory.  The undo blocks are kept in one of the two
+// undo directories depending on their encoding, so neither of them is required
+// on its own.
+func flatIndexDirs(dataDir string) []flatIndexDir {
+	return []flatIndexDir{
+		{flatFilePath(dataDir, flatUtreexoProofName), true},
+		{flatFilePath(dataDir, flatUtreexoUndoName), false},
+		{flatFilePath(dataDir, flatUtreexoUndoDeltaName), false},
+		{flatFilePath(dataDir, flatUtreexoUndoName+accMigrateSuffix), false},
+		{flatFilePath(dataDir, flatUtreexoUndoDeltaName+accMigrateSuffix), false},
+		{flatFilePath(dataDir, flatRememberIdxName), true},
+		{flatFilePath(dataDir, flatUtreexoProofStatsName), true},
+		{flatFilePath(dataDir, flatUtreexoQuarantineName), false},
+	}
+}
+
+// flatIndexStatePath returns the directory of the utreexo state of the flat
+// utreexo proof index in the data directory.
+func flatIndexStatePath(dataDir string) string {
+	return utreexoBasePath(&UtreexoConfig{
+		DataDir: dataDir,
+		Name:    flatUtreexoProofIndexType,
+	})
+}
+
+// pathExists returns whether something exists at the given path.
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// missingFlatIndexDirs returns the directories that the flat utreexo proof
+// index was created with that are missing from the data directory.
+func missingFlatIndexDirs(dataDir string) ([]string, error) {
+	var missing []string
+	for _, dir := range flatIndexDirs(dataDir) {
+		if !dir.required {
+			continue
+		}
+		exists, err := pathExists(dir.path)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, dir.path)
+		}
+	}
+
+	undoExists, err := pathExists(flatFilePath(dataDir, flatUtreexoUndoName))
+	if err != nil {
+		return nil, err
+	}
+	deltaExists, err := pathExists(flatFilePath(dataDir,
+		flatUtreexoUndoDeltaName))
+	if err != nil {
+		return nil, err
+	}
+	if !undoExists && !deltaExists {
+		missing = append(missing, flatFilePath(dataDir, flatUtreexoUndoName))
+	}
+
+	statePath := flatIndexStatePath(dataDir)
+	exists, err := pathExists(statePath)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		missing = append(missing, statePath)
+	}
+
+	return missing, nil
+}
+
+// markFlatIndexDrop marks the flat utreexo proof index as being dropped and
+// returns the directories that it was created with that are already missing.
+// The drop is marked before anything is deleted so that what an interrupted
+// drop already deleted isn't reported as missing once it's run again.  Nothing
+// is marked if the index doesn't exist.
+func markFlatIndexDrop(db database.DB, dataDir string) ([]string, error) {
+	var exists, resumed bool
+	err := db.View(func(dbTx database.Tx) error {
+		indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+		if indexesBucket == nil {
+			return nil
+		}
+		exists = indexesBucket.Get(flatUtreexoBucketKey) != nil
+		resumed = indexesBucket.Get(indexDropKey(flatUtreexoBucketKey)) != nil
+		return nil
+	})
+	if err != nil || !exists || resumed {
+		return nil, err
+	}
+
+	missing, err := missingFlatIndexDirs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(dbTx database.Tx) error {
+		indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+		return indexesBucket.Put(indexDropKey(flatUtreexoBucketKey),
+			flatUtreexoBucketKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
+// deleteFlatIndexDirs deletes the flat files and the utreexo state of the flat
+// utreexo proof index from the data directory.  The directories that are
+// already gone are skipped.
+func deleteFlatIndexDirs(dataDir string) error {
+	for _, dir := range flatIndexDirs(dataDir) {
+		err := deleteFlatFile(dir.path)
+		if err != nil {
+			return fmt.Errorf("unable to delete %s of the %s: %v",
+				dir.path, flatUtreexoProofIndexName, err)
+		}
+	}
+
+	statePath := flatIndexStatePath(dataDir)
+	err := deleteUtreexoState(statePath)
+	if err != nil {
+		return fmt.Errorf("unable to delete %s of the %s: %v", statePath,
+			flatUtreexoProofIndexName, err)
+	}
+
+	return nil
+}
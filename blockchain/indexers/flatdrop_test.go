@@ -0,0 +1,120 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/database"
+)
+
+// TestDropFlatUtreexoProofIndex ensures that dropping the flat utreexo proof
+// index deletes its files and its database entries, that it reports what was
+// already missing unless an interrupted drop deleted it, and that it's a no-op
+// once the index is gone.
+func TestDropFlatUtreexoProofIndex(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	tests := []struct {
+		name    string
+		resumed bool
+	}{
+		{name: "TestDropFlatIncomplete"},
+		{name: "TestDropFlatResumed", resumed: true},
+	}
+
+	for _, test := range tests {
+		chain, indexes, params, tearDown := indexersTestChain(test.name, 1)
+
+		var db database.DB
+		for _, indexer := range indexes {
+			if idx, ok := indexer.(*UtreexoProofIndex); ok {
+				db = idx.db
+			}
+		}
+
+		tip := btcutil.NewBlock(params.GenesisBlock)
+		var spends []*blockchain.SpendableOut
+		for i := 0; i < 5; i++ {
+			tip, spends = blockchain.AddBlock(chain, tip, spends)
+		}
+
+		// Delete a directory of the index as if it was lost or as if an
+		// earlier drop was interrupted after deleting it.
+		dataDir := filepath.Join(testDbRoot, test.name)
+		rememberPath := flatFilePath(dataDir, flatRememberIdxName)
+		if err := os.RemoveAll(rememberPath); err != nil {
+			t.Fatal(err)
+		}
+		if test.resumed {
+			err := db.Update(func(dbTx database.Tx) error {
+				return dbTx.Metadata().Bucket(indexTipsBucketName).Put(
+					indexDropKey(flatUtreexoBucketKey),
+					flatUtreexoBucketKey)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := DropFlatUtreexoProofIndex(db, dataDir, nil)
+		var incomplete *FlatIndexIncompleteError
+		switch {
+		case test.resumed && err != nil:
+			t.Fatalf("%s: %v", test.name, err)
+
+		case !test.resumed && (!errors.As(err, &incomplete) ||
+			!reflect.DeepEqual(incomplete.Missing, []string{rememberPath})):
+
+			t.Fatalf("%s: expected the remember indexes to be "+
+				"missing, got %v", test.name, err)
+		}
+
+		for _, dir := range flatIndexDirs(dataDir) {
+			if exists, _ := pathExists(dir.path); exists {
+				t.Fatalf("%s: %s wasn't deleted", test.name, dir.path)
+			}
+		}
+		if exists, _ := pathExists(flatIndexStatePath(dataDir)); exists {
+			t.Fatalf("%s: the utreexo state wasn't deleted", test.name)
+		}
+		err = db.View(func(dbTx database.Tx) error {
+			meta := dbTx.Metadata()
+			indexesBucket := meta.Bucket(indexTipsBucketName)
+			if indexesBucket.Get(flatUtreexoBucketKey) != nil ||
+				indexesBucket.Get(indexDropKey(flatUtreexoBucketKey)) != nil ||
+				meta.Bucket(flatUtreexoBucketKey) != nil {
+
+				return errors.New("the index is still in the database")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		// Dropping the index again deletes what was left of it without
+		// reporting anything as missing.
+		leftover := flatFilePath(dataDir, flatUtreexoProofName)
+		if err := os.MkdirAll(leftover, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := DropFlatUtreexoProofIndex(db, dataDir, nil); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if exists, _ := pathExists(leftover); exists {
+			t.Fatalf("%s: %s wasn't deleted", test.name, leftover)
+		}
+
+		tearDown()
+	}
+}
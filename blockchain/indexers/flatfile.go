@@ -5,12 +5,15 @@
 package indexers
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -25,11 +28,32 @@ const (
 
 	// dataFileSuffix is the suffix given to the dataFile name.
 	dataFileSuffix = ".dat"
+
+	// versionFileName is the name given to the file that keeps the format
+	// version of the FlatFileState.
+	versionFileName = "version.dat"
+
+	// flatFileVersion is the current format version of the FlatFileState.
+	// Any change to how the offsets or the data are laid out on disk must
+	// bump this version and add a migration in migrateFlatFile.  A format
+	// feature that older versions can't read or append after must also
+	// raise the minimum versions with requireVersions once it's used.
+	//
+	// Version 1 is the original format.  FlatFileStates written before
+	// the version file was introduced are of version 1.
+	//
+	// Version 2 replaced the offsets in the offset file with fixed-size
+	// records that can each be validated on their own.
+	flatFileVersion = 2
 )
 
 var (
 	// magicBytes are the bytes prepended to any entry in the dataFiles.
 	magicBytes = []byte{0xaa, 0xff, 0xaa, 0xff}
+
+	// errFlatFileReadOnly is returned when writing to a FlatFileState that
+	// was opened with InitReadOnly.
+	errFlatFileReadOnly = errors.New("flat file was opened read-only")
 )
 
 // FlatFileState is the shared state for storing flatfiles.  It is specifically designed
@@ -57,6 +81,82 @@ type FlatFileState struct {
 	// NOTE Since we account for the genesis block in the offsets, to fetch data for
 	// height x, you'd do 'offsets[x]' and not 'offsets[x-1]'.
 	offsets []int64
+
+	// lengths and checksums are the sizes and the checksums of the data of
+	// the entries from their offset records.  They're indexed like the
+	// offsets.
+	lengths   []uint32
+	checksums []uint32
+
+	// recovery is what loading the offsets did to recover from a crash.
+	recovery flatFileRecovery
+
+	// failpoint is called with the bytes of every write that StoreData
+	// does.  Only the returned amount of them is written and the returned
+	// error is returned by StoreData when it's not nil.  It's nil unless
+	// it's set by tests to simulate crashes.
+	failpoint func(write flatFileWrite, buf []byte) (int, error)
+
+	// path is the directory the files are kept in.
+	path string
+
+	// version is the format version the FlatFileState is read and written
+	// as.  It's flatFileVersion unless it's overridden by tests.
+	version uint32
+
+	// readOnly is whether the FlatFileState was opened with InitReadOnly.
+	// Nothing is written to the files when it's set.
+	readOnly bool
+
+	// writes counts the writes done to the files since the FlatFileState
+	// was created.
+	writes flatFileWrites
+
+	// dataReader is what the data file is read from.  It's the dataFile
+	// unless it's overridden by tests.
+	dataReader io.ReaderAt
+
+	// reads counts the reads from the data file that didn't return
+	// everything right away.  They aren't counted if it's nil.
+	reads *flatFileReads
+
+	// readBackoff is how long the first retry of a read from the data
+	// file waits.  It's defaultFlatReadBackoff unless it's overridden by
+	// tests.
+	readBackoff time.Duration
+}
+
+// flatFileWrite is a write that StoreData does.
+type flatFileWrite uint8
+
+const (
+	// flatWriteEntry is the write of the entry to the data file.
+	flatWriteEntry flatFileWrite = iota
+
+	// flatWriteRecord is the write of the offset record of the entry.
+	flatWriteRecord
+)
+
+// flatFileWrites counts the data stored to a FlatFileState along with the
+// bytes and the syncs it took to store it.
+type flatFileWrites struct {
+	// dataBytes is the size of the data that was stored.
+	dataBytes uint64
+
+	// writtenBytes is everything that was written to the files to store
+	// the data.  That's the data, its magic bytes and size, and its offset
+	// record.
+	writtenBytes uint64
+
+	// syncs is the number of files that were synced to disk.
+	syncs uint64
+}
+
+// add adds the counts of other to the flatFileWrites.
+func (w *flatFileWrites) add(other flatFileWrites) {
+	w.dataBytes += other.dataBytes
+	w.writtenBytes += other.writtenBytes
+	w.syncs += other.syncs
 }
 
 // Init initializes the FlatFileState.  If resuming, it loads the offsets onto memory.
@@ -70,6 +170,14 @@ func (ff *FlatFileState) Init(path, dataName string) error {
 		return err
 	}
 
+	// Make sure the files on disk are of the current format before
+	// reading anything.
+	err = checkFlatFileVersion(path, dataName, ff.version)
+	if err != nil {
+		return err
+	}
+	ff.path = path
+
 	offsetPath := filepath.Join(path, offsetFileName)
 	ff.offsetFile, err = os.OpenFile(offsetPath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
@@ -82,60 +190,37 @@ func (ff *FlatFileState) Init(path, dataName string) error {
 		return err
 	}
 
-	// Seek to end to get the number of offsets in the file (# of blocks).
-	offsetFileSize, err := ff.offsetFile.Seek(0, 2)
+	return ff.loadOffsets()
+}
+
+// InitReadOnly initializes the FlatFileState at the given path for reading
+// only.  Unlike Init, nothing is created, migrated, or written, so it's able to
+// open FlatFileStates that a newer version wrote as long as their format can be
+// read by this version.  The write methods return an error afterwards.
+func (ff *FlatFileState) InitReadOnly(path, dataName string) error {
+	meta, err := readFlatFileMeta(path)
 	if err != nil {
 		return err
 	}
-
-	// Offsets are always 8 bytes each.
-	if offsetFileSize%8 != 0 {
-		return fmt.Errorf("FlatFileState.Init(): Corrupt FlatFileState. " +
-			"offsetFile not mulitple of 8 bytes")
+	if meta.version == 0 {
+		return fmt.Errorf("no flat file at %s", path)
 	}
+	if ff.version < meta.minReadVersion {
+		return newFlatFileVersionError(path, ff.version, meta)
+	}
+	ff.path = path
+	ff.readOnly = true
 
-	// If the file size is bigger than 0, we're resuming and will read all
-	// existing offsets to ff.offsets.
-	if offsetFileSize > 0 {
-		// -1 since we have to account for the genesis block of height 0.
-		ff.currentHeight = int32(offsetFileSize/8) - 1
-
-		// Seek back to the file start / block "0".
-		_, err := ff.offsetFile.Seek(0, 0)
-		if err != nil {
-			return err
-		}
-		ff.offsets = make([]int64, offsetFileSize/8)
-
-		// Go through the entire offset file and read&store every offset in memory.
-		for i := int32(0); i <= ff.currentHeight; i++ {
-			err = binary.Read(ff.offsetFile, binary.BigEndian, &ff.currentOffset)
-			if err != nil {
-				return err
-			}
-
-			ff.offsets[i] = ff.currentOffset
-		}
-
-		// Set the currentOffset to the end of the data file.
-		ff.currentOffset, err = ff.dataFile.Seek(0, 2)
-		if err != nil {
-			return err
-		}
-
-	} else {
-		// We don't save block 0 with utreexo proof index.  Just append
-		// 0s since we don't keep it.
-		_, err = ff.offsetFile.Write(make([]byte, 8))
-		if err != nil {
-			return err
-		}
-
-		// Oo the same with the in-ram slice.
-		ff.offsets = make([]int64, 1)
+	ff.offsetFile, err = os.Open(filepath.Join(path, offsetFileName))
+	if err != nil {
+		return err
+	}
+	ff.dataFile, err = os.Open(filepath.Join(path, dataName+dataFileSuffix))
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return ff.loadOffsets()
 }
 
 // StoreData stores the given byte slice as a new entry in the dataFile.
@@ -153,42 +238,47 @@ func (ff *FlatFileState) StoreData(height int32, data []byte) error {
 	ff.mtx.Lock()
 	defer ff.mtx.Unlock()
 
+	if ff.readOnly {
+		return errFlatFileReadOnly
+	}
+
 	// We only accept the next block in seqence.
 	if height != ff.currentHeight+1 || height <= 0 {
 		return fmt.Errorf("Passed in height not the next block in sequence. "+
 			"Expected height of %d but got %d", ff.currentHeight+1, height)
 	}
 
-	// Pre-allocate the needed buffer.
+	// The entry is written before its record so that a record is only
+	// ever written for an entry that was.
 	buf := make([]byte, len(data)+8)
-
-	// Slice the buffer to 8 bytes and encode the offset to it.
-	buf = buf[:8]
-	ff.offsets = append(ff.offsets, ff.currentOffset)
-	binary.BigEndian.PutUint64(buf, uint64(ff.currentOffset))
-
-	// Do the actual currentOffset write to the offset file.
-	_, err := ff.offsetFile.WriteAt(buf, int64(height)*8)
-	if err != nil {
-		return err
-	}
-
-	// Re-slice the buffer to the total length.
-	buf = buf[:len(data)+8]
-
-	// Add the magic bytes, size, and the data to the buffer to be written.
 	copy(buf[:4], magicBytes)
 	binary.BigEndian.PutUint32(buf[4:8], uint32(len(data)))
 	copy(buf[8:], data)
+	err := ff.writeAt(ff.dataFile, flatWriteEntry, buf, ff.currentOffset)
+	if err != nil {
+		return err
+	}
 
-	// Write the magic+size+data to the dataFile.
-	_, err = ff.dataFile.WriteAt(buf, ff.currentOffset)
+	record := flatOffsetRecord{
+		height:   height,
+		offset:   ff.currentOffset,
+		length:   uint32(len(data)),
+		checksum: crc32.Checksum(data, flatChecksumTable),
+	}
+	err = ff.writeAt(ff.offsetFile, flatWriteRecord, record.serialize(),
+		int64(height)*flatOffsetRecordSize)
 	if err != nil {
 		return err
 	}
 
-	// Increment the current offset.  +8 to account for the magic bytes and size.
-	ff.currentOffset += int64(len(data)) + 8
+	ff.offsets = append(ff.offsets, record.offset)
+	ff.lengths = append(ff.lengths, record.length)
+	ff.checksums = append(ff.checksums, record.checksum)
+	ff.currentOffset = record.end()
+
+	// The record and the magic+size+data were written.
+	ff.writes.dataBytes += uint64(len(data))
+	ff.writes.writtenBytes += uint64(len(data)) + 8 + flatOffsetRecordSize
 
 	// Finally, increment the currentHeight.
 	ff.currentHeight++
@@ -211,34 +301,62 @@ func (ff *FlatFileState) FetchData(height int32) ([]byte, error) {
 		return nil, nil
 	}
 
-	// Grab the offset for where the data is in the dataFile.
-	offset := ff.offsets[height]
-
-	// Read from the dataFile.  This read will grab the magic bytes and the
-	// size bytes.
-	buf := make([]byte, 8)
-	_, err := ff.dataFile.ReadAt(buf, offset)
+	// The record tells the size of the entry so it's read whole at once.
+	// Short reads are retried so that a flaky network mount isn't
+	// mistaken for a corrupt entry.
+	buf := make([]byte, 8+int(ff.lengths[height]))
+	err := ff.readAtFull(buf, ff.offsets[height])
 	if err != nil {
 		return nil, err
 	}
-
-	// Sanity check.  If wrong magic was read, then error out.
-	if !bytes.Equal(buf[:4], magicBytes) {
-		return nil, fmt.Errorf("Read wrong magic bytes. Expect %x but got %x",
-			magicBytes, buf[:4])
+	err = ff.checkEntryBytes(height, ff.offsets[height], buf,
+		ff.lengths[height], ff.checksums[height])
+	if err != nil {
+		return nil, err
 	}
 
-	// Size of the actual data we want to fetch.
-	size := binary.BigEndian.Uint32(buf[4:])
+	return buf[8:], nil
+}
+
+// FetchDataRange fetches the data stored for the block heights from start to
+// end inclusive, in height order.  The entries are read with a single read
+// that spans all of them and each one is checked against its offset record
+// the same as with FetchData.  An error is returned if any height in the range
+// wasn't stored.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) FetchDataRange(start, end int32) ([][]byte, error) {
+	ff.mtx.RLock()
+	defer ff.mtx.RUnlock()
 
-	// Now do the actual read of the data from the dataFile.
-	dataBuf := make([]byte, size)
-	_, err = ff.dataFile.ReadAt(dataBuf, offset+8)
+	if start <= 0 || end < start || end > ff.currentHeight {
+		return nil, fmt.Errorf("can't fetch heights %d to %d from %s "+
+			"which has data stored for heights 1 to %d", start, end,
+			ff.path, ff.currentHeight)
+	}
+
+	// The entries are stored one after the other so the range is read
+	// from the start of the first one to the end of the last one.
+	base := ff.offsets[start]
+	buf := make([]byte, ff.offsets[end]+8+int64(ff.lengths[end])-base)
+	err := ff.readAtFull(buf, base)
 	if err != nil {
 		return nil, err
 	}
 
-	return dataBuf, nil
+	datas := make([][]byte, 0, end-start+1)
+	for height := start; height <= end; height++ {
+		offset := ff.offsets[height] - base
+		entry := buf[offset : offset+8+int64(ff.lengths[height])]
+		err = ff.checkEntryBytes(height, ff.offsets[height], entry,
+			ff.lengths[height], ff.checksums[height])
+		if err != nil {
+			return nil, err
+		}
+		datas = append(datas, entry[8:])
+	}
+
+	return datas, nil
 }
 
 // DisconnectBlock is used during reorganizations and it deletes the last data
@@ -250,55 +368,366 @@ func (ff *FlatFileState) DisconnectBlock(height int32) error {
 	ff.mtx.Lock()
 	defer ff.mtx.Unlock()
 
+	if ff.readOnly {
+		return errFlatFileReadOnly
+	}
+
 	if height != ff.currentHeight {
 		return fmt.Errorf("FlatFileState: Lastest block saved is %d but was asked to disconnect height %d",
 			ff.currentHeight, height)
 	}
 
-	offset := ff.offsets[height]
-	buf := make([]byte, 8)
+	// Make sure that the entry being removed is the one of the record.
+	_, err := ff.readEntryHeader(height)
+	if err != nil {
+		return err
+	}
 
-	// Read from the dataFile to get the size of the data.
-	_, err := ff.dataFile.ReadAt(buf, offset)
+	// The entry starts where the data file is truncated to and the
+	// records are addressed by height.
+	err = ff.dataFile.Truncate(ff.offsets[height])
+	if err != nil {
+		return err
+	}
+	err = ff.offsetFile.Truncate(int64(height) * flatOffsetRecordSize)
 	if err != nil {
 		return err
 	}
 
-	if !bytes.Equal(buf[:4], magicBytes) {
-		return fmt.Errorf("read wrong magic of %x", buf[:4])
+	// Set the currentOffset as the last offset.
+	ff.currentOffset = ff.offsets[height]
+
+	// Pop the record in memory.
+	ff.offsets = ff.offsets[:height]
+	ff.lengths = ff.lengths[:height]
+	ff.checksums = ff.checksums[:height]
+
+	// Go back one height.
+	ff.currentHeight--
+
+	return nil
+}
+
+// BestHeight returns the latest height that data is stored for.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) BestHeight() int32 {
+	ff.mtx.RLock()
+	defer ff.mtx.RUnlock()
+
+	return ff.currentHeight
+}
+
+// Sync commits the contents of the dataFile and the offsetFile to disk.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) Sync() error {
+	ff.mtx.Lock()
+	defer ff.mtx.Unlock()
+
+	err := ff.dataFile.Sync()
+	if err != nil {
+		return err
+	}
+	ff.writes.syncs++
+
+	err = ff.offsetFile.Sync()
+	if err != nil {
+		return err
+	}
+	ff.writes.syncs++
+
+	return nil
+}
+
+// writeCounts returns the writes done to the FlatFileState so far.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) writeCounts() flatFileWrites {
+	ff.mtx.RLock()
+	defer ff.mtx.RUnlock()
+
+	return ff.writes
+}
+
+// truncate deletes all the data stored after the given height.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) truncate(height int32) error {
+	for {
+		ff.mtx.RLock()
+		currentHeight := ff.currentHeight
+		ff.mtx.RUnlock()
+
+		// Height 0 is never stored so there's nothing to delete.
+		if currentHeight <= height || currentHeight <= 0 {
+			return nil
+		}
+
+		err := ff.DisconnectBlock(currentHeight)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flatFileMeta is the format metadata kept in the version file of a
+// FlatFileState.
+type flatFileMeta struct {
+	// version is the newest format version that wrote to the
+	// FlatFileState.
+	version uint32
+
+	// minReadVersion is the oldest format version that's able to read the
+	// FlatFileState.
+	minReadVersion uint32
+
+	// minWriteVersion is the oldest format version that's able to write to
+	// the FlatFileState without leaving entries that no version can read.
+	minWriteVersion uint32
+}
+
+// FlatFileVersionError is returned when a FlatFileState can't be opened
+// because it uses format features that are newer than the running version.
+type FlatFileVersionError struct {
+	// Path is the directory of the FlatFileState.
+	Path string
+
+	// Version is the format version of the running binary.
+	Version uint32
+
+	// MinReadVersion and MinWriteVersion are the oldest format versions
+	// that are able to read and write the FlatFileState.
+	MinReadVersion  uint32
+	MinWriteVersion uint32
+
+	// ReadOnly is whether the FlatFileState can still be opened with
+	// InitReadOnly.
+	ReadOnly bool
+}
+
+// newFlatFileVersionError returns a FlatFileVersionError for the FlatFileState
+// at the given path with the given metadata.
+func newFlatFileVersionError(path string, version uint32,
+	meta flatFileMeta) *FlatFileVersionError {
+
+	return &FlatFileVersionError{
+		Path:            path,
+		Version:         version,
+		MinReadVersion:  meta.minReadVersion,
+		MinWriteVersion: meta.minWriteVersion,
+		ReadOnly:        version >= meta.minReadVersion,
+	}
+}
+
+// Error returns the FlatFileVersionError as a human-readable string.
+func (e *FlatFileVersionError) Error() string {
+	str := fmt.Sprintf("flat file at %s requires format version %d to be "+
+		"written to but this binary is of version %d", e.Path,
+		e.MinWriteVersion, e.Version)
+	if e.ReadOnly {
+		return str + ".  It can still be opened read-only"
+	}
+
+	return str + fmt.Sprintf(".  It can't be opened read-only either as "+
+		"that requires version %d", e.MinReadVersion)
+}
+
+// readFlatFileMeta returns the format metadata of the FlatFileState at the
+// given path.  A FlatFileState without a version file is of version 1 as it was
+// created before the version file was introduced.  Version files from before
+// the minimum versions were introduced only hold the version, which is then
+// the minimum version to read and write it as well.  The version is 0 if
+// there's no FlatFileState at the given path.
+func readFlatFileMeta(path string) (flatFileMeta, error) {
+	buf, err := os.ReadFile(filepath.Join(path, versionFileName))
+	if err == nil {
+		switch len(buf) {
+		case 4:
+			version := binary.BigEndian.Uint32(buf)
+			return flatFileMeta{version, version, version}, nil
+
+		case 12:
+			return flatFileMeta{
+				version:         binary.BigEndian.Uint32(buf[0:4]),
+				minReadVersion:  binary.BigEndian.Uint32(buf[4:8]),
+				minWriteVersion: binary.BigEndian.Uint32(buf[8:12]),
+			}, nil
+		}
+
+		return flatFileMeta{}, fmt.Errorf("corrupt flat file version "+
+			"file. Expected 4 or 12 bytes but got %d", len(buf))
+	}
+	if !os.IsNotExist(err) {
+		return flatFileMeta{}, err
+	}
+
+	// Not having a version file means that the FlatFileState is either new
+	// or is a legacy one.
+	_, err = os.Stat(filepath.Join(path, offsetFileName))
+	if err == nil {
+		return flatFileMeta{1, 1, 1}, nil
 	}
+	if os.IsNotExist(err) {
+		return flatFileMeta{}, nil
+	}
+	return flatFileMeta{}, err
+}
+
+// readFlatFileVersion returns the format version of the FlatFileState at the
+// given path.  0 is returned if there's no FlatFileState at the given path.
+func readFlatFileVersion(path string) (uint32, error) {
+	meta, err := readFlatFileMeta(path)
+	return meta.version, err
+}
 
-	size := int64(binary.BigEndian.Uint32(buf[4:]))
+// writeFlatFileMeta writes the given metadata to the version file of the
+// FlatFileState at the given path.
+func writeFlatFileMeta(path string, meta flatFileMeta) error {
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[0:4], meta.version)
+	binary.BigEndian.PutUint32(buf[4:8], meta.minReadVersion)
+	binary.BigEndian.PutUint32(buf[8:12], meta.minWriteVersion)
+	return os.WriteFile(filepath.Join(path, versionFileName), buf[:], 0600)
+}
+
+// writeFlatFileVersion writes the given version to the version file of the
+// FlatFileState at the given path with the version also being the minimum
+// version to read and write it.
+func writeFlatFileVersion(path string, version uint32) error {
+	return writeFlatFileMeta(path, flatFileMeta{version, version, version})
+}
 
-	dataFileSize, err := ff.dataFile.Seek(0, 2)
+// DowngradeCheck returns an error if the running binary isn't able to write to
+// the FlatFileState at the given path because a newer version used format
+// features that this one doesn't know of.  The returned error is a
+// FlatFileVersionError that tells whether the FlatFileState can still be opened
+// read-only.  Nothing is written by it so it's meant to be called before
+// anything is opened for writing.
+func DowngradeCheck(path string) error {
+	return downgradeCheck(path, flatFileVersion)
+}
+
+// downgradeCheck returns an error if the given format version isn't able to
+// write to the FlatFileState at the given path.
+func downgradeCheck(path string, version uint32) error {
+	meta, err := readFlatFileMeta(path)
 	if err != nil {
 		return err
 	}
 
-	err = ff.dataFile.Truncate(dataFileSize - (size + 8))
+	return checkFlatFileMeta(path, version, meta)
+}
+
+// checkFlatFileMeta returns an error if the given format version isn't able to
+// write to the FlatFileState at the given path with the given metadata.
+func checkFlatFileMeta(path string, version uint32, meta flatFileMeta) error {
+	if version < meta.minReadVersion || version < meta.minWriteVersion {
+		return newFlatFileVersionError(path, version, meta)
+	}
+
+	return nil
+}
+
+// checkFlatFileVersion checks the format metadata of the FlatFileState at the
+// given path and migrates it to the given version if it's older.  An error is
+// returned before anything is written if the FlatFileState uses format
+// features that the given version isn't able to write.
+//
+// A FlatFileState that a newer version wrote without raising the minimum
+// versions is left at its version since its entries are still of a format that
+// the older version writes as well.
+func checkFlatFileVersion(path, dataName string, version uint32) error {
+	meta, err := readFlatFileMeta(path)
 	if err != nil {
 		return err
 	}
 
-	offsetFileSize, err := ff.offsetFile.Seek(0, 2)
+	// New FlatFileState.  It's only readable by the versions that know of
+	// the offset records.
+	if meta.version == 0 {
+		return writeFlatFileMeta(path, flatFileMeta{version,
+			flatFileRecordsVersion, flatFileRecordsVersion})
+	}
+
+	err = checkFlatFileMeta(path, version, meta)
 	if err != nil {
 		return err
 	}
 
-	// Each offset is 8 bytes.
-	err = ff.offsetFile.Truncate(offsetFileSize - 8)
+	if meta.version < version {
+		err = migrateFlatFile(path, dataName, meta.version, version)
+		if err != nil {
+			return err
+		}
+		meta.version = version
+	}
+	if meta.minReadVersion < flatFileRecordsVersion {
+		meta.minReadVersion = flatFileRecordsVersion
+	}
+	if meta.minWriteVersion < flatFileRecordsVersion {
+		meta.minWriteVersion = flatFileRecordsVersion
+	}
+
+	// Legacy FlatFileStates don't have a version file and older version
+	// files don't have the minimum versions so make sure they're there.
+	return writeFlatFileMeta(path, meta)
+}
+
+// requireVersions raises the minimum format versions that are able to read and
+// write the FlatFileState.  It must be called before a format feature that
+// older versions can't handle is first used so that they refuse to open the
+// FlatFileState instead of corrupting it.  The minimum versions are never
+// lowered.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) requireVersions(minRead, minWrite uint32) error {
+	ff.mtx.Lock()
+	defer ff.mtx.Unlock()
+
+	if ff.readOnly {
+		return errFlatFileReadOnly
+	}
+
+	meta, err := readFlatFileMeta(ff.path)
 	if err != nil {
 		return err
 	}
+	if minRead > ff.version || minWrite > ff.version {
+		return fmt.Errorf("can't require version %d to read and %d to "+
+			"write the flat file at %s as this binary is of version %d",
+			minRead, minWrite, ff.path, ff.version)
+	}
+	if minRead <= meta.minReadVersion && minWrite <= meta.minWriteVersion {
+		return nil
+	}
+	if minRead > meta.minReadVersion {
+		meta.minReadVersion = minRead
+	}
+	if minWrite > meta.minWriteVersion {
+		meta.minWriteVersion = minWrite
+	}
 
-	// Set the currentOffset as the last offset.
-	ff.currentOffset = ff.offsets[len(ff.offsets)-1]
+	return writeFlatFileMeta(ff.path, meta)
+}
 
-	// Pop the offset in memory.
-	ff.offsets = ff.offsets[:len(ff.offsets)-1]
+// migrateFlatFile migrates the FlatFileState at the given path from the given
+// version to the target version.  Each format change must add a case that
+// upgrades the files by a single version.
+func migrateFlatFile(path, dataName string, version, target uint32) error {
+	for ; version < target; version++ {
+		switch version {
+		case 1:
+			err := migrateOffsetRecords(path, dataName)
+			if err != nil {
+				return err
+			}
 
-	// Go back one height.
-	ff.currentHeight--
+		default:
+			return fmt.Errorf("no migration for flat file at %s "+
+				"from version %d", path, version)
+		}
+	}
 
 	return nil
 }
@@ -315,9 +744,33 @@ func deleteFlatFile(path string) error {
 	return os.RemoveAll(path)
 }
 
+// writeAt writes buf to the file at the given offset through the failpoint.
+//
+// This function MUST be called with the lock held.
+func (ff *FlatFileState) writeAt(f *os.File, write flatFileWrite, buf []byte,
+	offset int64) error {
+
+	var failErr error
+	if ff.failpoint != nil {
+		var n int
+		n, failErr = ff.failpoint(write, buf)
+		buf = buf[:n]
+	}
+
+	_, err := f.WriteAt(buf, offset)
+	if err != nil {
+		return err
+	}
+
+	return failErr
+}
+
 // NewFlatFileState returns a new but uninitialized FlatFileState.
 func NewFlatFileState() *FlatFileState {
 	return &FlatFileState{
-		mtx: new(sync.RWMutex),
+		mtx:         new(sync.RWMutex),
+		version:     flatFileVersion,
+		reads:       new(flatFileReads),
+		readBackoff: defaultFlatReadBackoff,
 	}
 }
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -276,9 +277,9 @@ func TestStoreAndFetchData(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if (int64(blockCount)*8)+8 != offsetOffset {
-		err := fmt.Errorf("Expected currentOffset of %d but got %d",
-			offsetOffset, (blockCount*8)+8)
+	if (int64(blockCount)+1)*flatOffsetRecordSize != offsetOffset {
+		err := fmt.Errorf("Expected offsetFile size of %d but got %d",
+			(int64(blockCount)+1)*flatOffsetRecordSize, offsetOffset)
 		t.Fatal(err)
 	}
 
@@ -344,7 +345,7 @@ func getAfterSizes(ff *FlatFileState, height int32) (int64, int64, error) {
 		return 0, 0, err
 	}
 
-	return dataFileSize - int64(dataSize+8), offsetSize - 8, nil
+	return dataFileSize - int64(dataSize+8), offsetSize - flatOffsetRecordSize, nil
 }
 
 func getSizes(ff *FlatFileState) (int64, int64, error) {
@@ -649,3 +650,740 @@ func TestMultipleFetchData(t *testing.T) {
 
 	wg.Wait()
 }
+
+// fixtureData returns the data that the flat file fixtures in testdata store
+// for the given height.
+func fixtureData(height int32) []byte {
+	return bytes.Repeat([]byte{byte(height)}, int(height)*10)
+}
+
+// fixtureHeight is the height of the flat file fixtures in testdata.
+const fixtureHeight = 5
+
+// copyFixture copies the flat file fixture in the given testdata directory to
+// a temporary directory and returns the path to it.
+func copyFixture(t *testing.T, fixture string) string {
+	path := filepath.Join(t.TempDir(), fixture)
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		buf, err := os.ReadFile(filepath.Join("testdata", fixture, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(path, entry.Name()), buf, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// TestFlatFileFixtures ensures that the flat file fixtures of every previous
+// format version are still loadable by the current code.  When the format
+// changes, add a fixture for the previous version along with the migration.
+func TestFlatFileFixtures(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		fixture string
+		version uint32
+	}{
+		// Legacy flat files without a version file.
+		{fixture: "flatfile_v1", version: 1},
+
+		// Flat files with offset records.
+		{fixture: "flatfile_v2", version: 2},
+	}
+
+	for _, test := range tests {
+		path := copyFixture(t, test.fixture)
+
+		version, err := readFlatFileVersion(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != test.version {
+			t.Fatalf("%s: expected version %d, got %d",
+				test.fixture, test.version, version)
+		}
+
+		ff := NewFlatFileState()
+		err = ff.Init(path, "data")
+		if err != nil {
+			t.Fatalf("%s: %v", test.fixture, err)
+		}
+
+		if ff.currentHeight != fixtureHeight {
+			t.Fatalf("%s: expected height %d, got %d", test.fixture,
+				fixtureHeight, ff.currentHeight)
+		}
+		for height := int32(1); height <= fixtureHeight; height++ {
+			data, err := ff.FetchData(height)
+			if err != nil {
+				t.Fatalf("%s: %v", test.fixture, err)
+			}
+			if !bytes.Equal(data, fixtureData(height)) {
+				t.Fatalf("%s: data mismatch at height %d",
+					test.fixture, height)
+			}
+		}
+
+		_, _, _, err = closeFF(ff)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The flat file should now be of the current version.
+		version, err = readFlatFileVersion(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != flatFileVersion {
+			t.Fatalf("%s: expected version %d after init, got %d",
+				test.fixture, flatFileVersion, version)
+		}
+	}
+}
+
+// TestFlatFileGolden ensures that the current code writes the exact same bytes
+// as the fixture of the current format version.  A failure here means that the
+// format changed and flatFileVersion needs to be bumped with a migration.
+func TestFlatFileGolden(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "golden")
+	ff := NewFlatFileState()
+	err := ff.Init(path, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := int32(1); height <= fixtureHeight; height++ {
+		err = ff.StoreData(height, fixtureData(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, _, err = closeFF(ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := fmt.Sprintf("flatfile_v%d", flatFileVersion)
+	for _, name := range []string{offsetFileName, "data" + dataFileSuffix} {
+		want, err := os.ReadFile(filepath.Join("testdata", fixture, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s differs from the %s fixture", name, fixture)
+		}
+	}
+}
+
+func TestFlatFileVersionTooNew(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir()
+	err := writeFlatFileVersion(path, flatFileVersion+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ff := NewFlatFileState()
+	err = ff.Init(path, "data")
+	if err == nil {
+		t.Fatal("expected error for a flat file of a newer version")
+	}
+}
+
+// readFFDir returns the contents of every file in the given directory.
+func readFFDir(t *testing.T, path string) map[string][]byte {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		buf, err := os.ReadFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = buf
+	}
+
+	return files
+}
+
+// TestFlatFileDowngrade ensures that an older version refuses to write to a flat
+// file that a newer version used incompatible format features in before
+// anything is written, and that it's still able to open it read-only when the
+// features are readable by it.
+func TestFlatFileDowngrade(t *testing.T) {
+	t.Parallel()
+
+	const older, newer = flatFileVersion, flatFileVersion + 1
+
+	tests := []struct {
+		name     string
+		minRead  uint32
+		minWrite uint32
+		writable bool
+		readable bool
+	}{
+		{
+			name:     "no new features",
+			writable: true,
+			readable: true,
+		},
+		{
+			name:     "forward compatible features",
+			minRead:  older,
+			minWrite: newer,
+			readable: true,
+		},
+		{
+			name:     "incompatible features",
+			minRead:  newer,
+			minWrite: newer,
+		},
+	}
+
+	for _, test := range tests {
+		// The newer version writes all but the last fixture height.
+		path := filepath.Join(t.TempDir(), "downgrade")
+		ff := NewFlatFileState()
+		ff.version = newer
+		err := ff.Init(path, "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for height := int32(1); height < fixtureHeight; height++ {
+			err = ff.StoreData(height, fixtureData(height))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.minRead != 0 {
+			err = ff.requireVersions(test.minRead, test.minWrite)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		_, _, _, err = closeFF(ff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := readFFDir(t, path)
+
+		// Then the older version opens it for writing.
+		checkErr := downgradeCheck(path, older)
+		ff = NewFlatFileState()
+		ff.version = older
+		initErr := ff.Init(path, "data")
+		if test.writable {
+			if checkErr != nil || initErr != nil {
+				t.Fatalf("%s: expected the flat file to be writable, "+
+					"got %v and %v", test.name, checkErr, initErr)
+			}
+			err = ff.StoreData(fixtureHeight, fixtureData(fixtureHeight))
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			_, _, _, err = closeFF(ff)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The version isn't lowered by the older version.
+			version, err := readFlatFileVersion(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != newer {
+				t.Fatalf("%s: expected version %d, got %d", test.name,
+					newer, version)
+			}
+			continue
+		}
+
+		for _, err := range []error{checkErr, initErr} {
+			var verr *FlatFileVersionError
+			if !errors.As(err, &verr) {
+				t.Fatalf("%s: expected a FlatFileVersionError, got %v",
+					test.name, err)
+			}
+			if verr.Version != older || verr.MinWriteVersion != newer ||
+				verr.ReadOnly != test.readable {
+
+				t.Fatalf("%s: unexpected error %+v", test.name, verr)
+			}
+		}
+		if !reflect.DeepEqual(readFFDir(t, path), before) {
+			t.Fatalf("%s: the flat file was modified by the refused "+
+				"open", test.name)
+		}
+
+		ro := NewFlatFileState()
+		ro.version = older
+		err = ro.InitReadOnly(path, "data")
+		if !test.readable {
+			if err == nil {
+				t.Fatalf("%s: expected the read-only open to fail",
+					test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for height := int32(1); height < fixtureHeight; height++ {
+			data, err := ro.FetchData(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, fixtureData(height)) {
+				t.Fatalf("%s: unexpected data at height %d",
+					test.name, height)
+			}
+		}
+		if ro.StoreData(fixtureHeight, fixtureData(fixtureHeight)) == nil {
+			t.Fatalf("%s: expected a read-only store to fail", test.name)
+		}
+		if ro.DisconnectBlock(fixtureHeight-1) == nil {
+			t.Fatalf("%s: expected a read-only disconnect to fail",
+				test.name)
+		}
+		_, _, _, err = closeFF(ro)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(readFFDir(t, path), before) {
+			t.Fatalf("%s: the flat file was modified by the read-only "+
+				"open", test.name)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	t.Parallel()
+
+	ff, tmpDir, err := initFF("TestTruncate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for height := int32(1); height <= fixtureHeight; height++ {
+		err = ff.StoreData(height, fixtureData(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Truncating to a height above the current one does nothing.
+	err = ff.truncate(fixtureHeight + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff.currentHeight != fixtureHeight {
+		t.Fatalf("expected height %d, got %d", fixtureHeight, ff.currentHeight)
+	}
+
+	err = ff.truncate(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff.currentHeight != 2 {
+		t.Fatalf("expected height 2, got %d", ff.currentHeight)
+	}
+
+	// The data for the following heights should be storable again.
+	for height := int32(3); height <= fixtureHeight; height++ {
+		err = ff.StoreData(height, fixtureData(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for height := int32(1); height <= fixtureHeight; height++ {
+		data, err := ff.FetchData(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, fixtureData(height)) {
+			t.Fatalf("data mismatch at height %d", height)
+		}
+	}
+
+	// Truncating below height 1 empties the flat file.
+	err = ff.truncate(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff.currentHeight != 0 {
+		t.Fatalf("expected height 0, got %d", ff.currentHeight)
+	}
+}
+
+func TestFlatFileWriteCounts(t *testing.T) {
+	t.Parallel()
+
+	ff, tmpDir, err := initFF("TestFlatFileWriteCounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var want flatFileWrites
+	for height := int32(1); height <= fixtureHeight; height++ {
+		data := fixtureData(height)
+		err = ff.StoreData(height, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Each entry writes its offset record, magic bytes, and size
+		// along with the data.
+		want.dataBytes += uint64(len(data))
+		want.writtenBytes += uint64(len(data)) + 8 + flatOffsetRecordSize
+	}
+	err = ff.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.syncs = 2
+
+	got := ff.writeCounts()
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	// The written bytes must add up to the size of the files.
+	var fileBytes uint64
+	for _, f := range []*os.File{ff.dataFile, ff.offsetFile} {
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileBytes += uint64(info.Size())
+	}
+
+	// The offset file starts with the record of the genesis block, which
+	// isn't stored with StoreData.
+	if fileBytes != got.writtenBytes+flatOffsetRecordSize {
+		t.Fatalf("expected the files to be %d bytes, got %d",
+			got.writtenBytes+flatOffsetRecordSize, fileBytes)
+	}
+}
+
+// TestFlatFileTornRecord ensures that a crash at any byte of the write of an
+// offset record only loses the entry of that record and that recovering from it
+// only reads the entry of the last record.
+func TestFlatFileTornRecord(t *testing.T) {
+	t.Parallel()
+
+	errCrash := errors.New("simulated crash")
+	type tornWrite struct {
+		name  string
+		write flatFileWrite
+		cut   func(buf []byte) int
+		err   error
+	}
+	var tests []tornWrite
+	for cut := 0; cut <= flatOffsetRecordSize; cut++ {
+		cut := cut
+		tests = append(tests, tornWrite{
+			name:  fmt.Sprintf("record cut at byte %d", cut),
+			write: flatWriteRecord,
+			cut:   func([]byte) int { return cut },
+			err:   errCrash,
+		})
+	}
+
+	// The entry may still be torn when the record isn't if they reach the
+	// disk out of order.
+	tests = append(tests, tornWrite{
+		name:  "entry cut in half",
+		write: flatWriteEntry,
+		cut:   func(buf []byte) int { return len(buf) / 2 },
+	})
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "torn")
+		ff := NewFlatFileState()
+		err := ff.Init(path, "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for height := int32(1); height < fixtureHeight; height++ {
+			err = ff.StoreData(height, fixtureData(height))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		keptData, err := ff.dataFile.Seek(0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ff.failpoint = func(write flatFileWrite, buf []byte) (int, error) {
+			if write != test.write {
+				return len(buf), nil
+			}
+			return test.cut(buf), test.err
+		}
+		err = ff.StoreData(fixtureHeight, fixtureData(fixtureHeight))
+		if err != test.err {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		_, _, _, err = closeFF(ff)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ff = NewFlatFileState()
+		err = ff.Init(path, "data")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		// Only the record that was written whole is kept and only the
+		// entries of the last records are read to tell.
+		wantHeight := int32(fixtureHeight - 1)
+		want := flatFileRecovery{checked: 1}
+		switch {
+		case test.write == flatWriteEntry:
+			want = flatFileRecovery{
+				checked:       2,
+				dropped:       1,
+				dataTruncated: (8 + int64(len(fixtureData(fixtureHeight)))) / 2,
+			}
+		case test.cut(nil) == flatOffsetRecordSize:
+			wantHeight = fixtureHeight
+		default:
+			want.tornBytes = int64(test.cut(nil))
+		}
+		if ff.currentHeight != wantHeight {
+			t.Fatalf("%s: expected height %d after recovery, got %d",
+				test.name, wantHeight, ff.currentHeight)
+		}
+		if ff.recovery != want {
+			t.Fatalf("%s: expected recovery %+v, got %+v", test.name,
+				want, ff.recovery)
+		}
+		offsetSize, err := ff.offsetFile.Seek(0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offsetSize != int64(wantHeight+1)*flatOffsetRecordSize {
+			t.Fatalf("%s: expected the offset file to be cut to %d "+
+				"records, got %d bytes", test.name, wantHeight+1,
+				offsetSize)
+		}
+		if test.write == flatWriteEntry && ff.currentOffset != keptData {
+			t.Fatalf("%s: expected the data file to be cut to %d "+
+				"bytes, got %d", test.name, keptData,
+				ff.currentOffset)
+		}
+
+		// The lost entry is stored again after the recovery.
+		for height := wantHeight + 1; height <= fixtureHeight; height++ {
+			err = ff.StoreData(height, fixtureData(height))
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		for height := int32(1); height <= fixtureHeight; height++ {
+			data, err := ff.FetchData(height)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if !bytes.Equal(data, fixtureData(height)) {
+				t.Fatalf("%s: data mismatch at height %d",
+					test.name, height)
+			}
+		}
+		_, _, _, err = closeFF(ff)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestFlatFileCorruptRecord ensures that an offset record that's broken before
+// the tail of the offset file isn't taken for a torn write.
+func TestFlatFileCorruptRecord(t *testing.T) {
+	t.Parallel()
+
+	ff, tmpDir, err := initFF("TestFlatFileCorruptRecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for height := int32(1); height <= fixtureHeight; height++ {
+		err = ff.StoreData(height, fixtureData(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = ff.offsetFile.WriteAt([]byte{0xff}, 2*flatOffsetRecordSize+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = closeFF(ff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = restartFF(tmpDir, "TestFlatFileCorruptRecord")
+	if err == nil {
+		t.Fatal("expected an error loading a corrupt offset record")
+	}
+}
+
+// fetchHeaderFirst fetches the data stored for the given height the way it was
+// before the offset records held the size of the entries, by reading the magic
+// bytes and the size of the entry before its data.
+func fetchHeaderFirst(ff *FlatFileState, height int32) ([]byte, error) {
+	ff.mtx.RLock()
+	defer ff.mtx.RUnlock()
+
+	size, err := ff.readEntryHeader(height)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	err = ff.readAtFull(data, ff.offsets[height]+8)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// BenchmarkFlatFileFetch measures fetching entries at random heights with the
+// entry read whole at the offset of its record and with its header read first.
+func BenchmarkFlatFileFetch(b *testing.B) {
+	ff, tmpDir, err := initFF("BenchmarkFlatFileFetch")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer closeFF(ff)
+
+	const numEntries = 2000
+	rnd := rand.New(rand.NewSource(1))
+	for height := int32(1); height <= numEntries; height++ {
+		data := make([]byte, 512+rnd.Intn(4096))
+		rnd.Read(data)
+		err = ff.StoreData(height, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	fetches := []struct {
+		name  string
+		fetch func(*FlatFileState, int32) ([]byte, error)
+	}{
+		{"record", (*FlatFileState).FetchData},
+		{"header first", fetchHeaderFirst},
+	}
+	for _, fetch := range fetches {
+		b.Run(fetch.name, func(b *testing.B) {
+			rnd := rand.New(rand.NewSource(2))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				height := int32(rnd.Intn(numEntries)) + 1
+				_, err := fetch.fetch(ff, height)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestFetchDataRange ensures that the data fetched for a range of heights is
+// the same as the data fetched one height at a time, including after an entry
+// was left behind between two others by a torn offset record.
+func TestFetchDataRange(t *testing.T) {
+	t.Parallel()
+
+	ff, tmpDir, err := initFF("TestFetchDataRange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for height := int32(1); height <= fixtureHeight; height++ {
+		if height == 3 {
+			// Leave an entry behind without its record and
+			// recover from it.
+			ff.failpoint = func(write flatFileWrite, buf []byte) (int, error) {
+				if write == flatWriteRecord {
+					return 0, errors.New("simulated crash")
+				}
+				return len(buf), nil
+			}
+			if err := ff.StoreData(height, []byte("lost")); err == nil {
+				t.Fatal("expected the simulated crash")
+			}
+			if _, _, _, err := closeFF(ff); err != nil {
+				t.Fatal(err)
+			}
+			ff, err = restartFF(tmpDir, "TestFetchDataRange")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = ff.StoreData(height, fixtureData(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer closeFF(ff)
+	if ff.offsets[3] == ff.offsets[2]+8+int64(ff.lengths[2]) {
+		t.Fatal("expected an entry left behind between heights 2 and 3")
+	}
+
+	for start := int32(1); start <= fixtureHeight; start++ {
+		for end := start; end <= fixtureHeight; end++ {
+			datas, err := ff.FetchDataRange(start, end)
+			if err != nil {
+				t.Fatalf("heights %d to %d: %v", start, end, err)
+			}
+			if len(datas) != int(end-start+1) {
+				t.Fatalf("heights %d to %d: expected %d entries, "+
+					"got %d", start, end, end-start+1, len(datas))
+			}
+			for i, data := range datas {
+				height := start + int32(i)
+				if !bytes.Equal(data, fixtureData(height)) {
+					t.Fatalf("heights %d to %d: data mismatch "+
+						"at height %d", start, end, height)
+				}
+			}
+		}
+	}
+
+	for _, r := range [][2]int32{{0, 2}, {3, 2}, {2, fixtureHeight + 1}} {
+		_, err := ff.FetchDataRange(r[0], r[1])
+		if err == nil {
+			t.Fatalf("heights %d to %d: expected an error", r[0], r[1])
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// flatReadRetries is how many times a read from a flat file that came
+	// up short or failed with a transient error is retried before it's
+	// given up on.
+	flatReadRetries = 4
+
+	// defaultFlatReadBackoff is how long the first retry of a flat file
+	// read waits.  Every retry after it waits twice as long as the one
+	// before.
+	defaultFlatReadBackoff = 20 * time.Millisecond
+)
+
+var (
+	// ErrShortRead is the error that's wrapped when a read from a flat file
+	// keeps returning less than what the offsets say is stored.  The data
+	// on disk may well be intact, as network file systems return short
+	// reads while the mount is flaky, so it must never be treated as
+	// corruption.
+	ErrShortRead = errors.New("short read from flat file")
+
+	// ErrCorruptEntry is the error that's wrapped when an entry that was
+	// read whole from a flat file doesn't have the magic bytes, the size,
+	// or the checksum that its offset record says it has.
+	ErrCorruptEntry = errors.New("corrupt flat file entry")
+)
+
+// ShortReadError describes a read from a flat file that still came up short
+// after it was retried.
+type ShortReadError struct {
+	// Path is the directory of the flat file.
+	Path string
+
+	// Offset is the offset in the data file that was read from and Want
+	// and Got are the bytes that were asked for and that were read.
+	Offset int64
+	Want   int
+	Got    int
+
+	// Retries is the number of times the read was retried.
+	Retries int
+
+	// Err is the error that the last attempt failed with.  It's nil if
+	// the last attempt returned less without an error.
+	Err error
+}
+
+// Error returns the error as a human-readable string.
+func (e *ShortReadError) Error() string {
+	str := fmt.Sprintf("%v at %s: read %d of %d bytes at offset %d after "+
+		"%d retries", ErrShortRead, e.Path, e.Got, e.Want, e.Offset,
+		e.Retries)
+	if e.Err != nil {
+		str += ": " + e.Err.Error()
+	}
+
+	return str
+}
+
+// Is returns true for ErrShortRead.
+func (e *ShortReadError) Is(target error) bool {
+	return target == ErrShortRead
+}
+
+// Unwrap returns the error that the last attempt failed with.
+func (e *ShortReadError) Unwrap() error {
+	return e.Err
+}
+
+// CorruptEntryError describes an entry of a flat file that was read whole but
+// isn't what the offsets say is stored.
+type CorruptEntryError struct {
+	// Path is the directory of the flat file.
+	Path string
+
+	// Height is the height that the entry was stored for and Offset is
+	// where the entry starts in the data file.
+	Height int32
+	Offset int64
+
+	// Reason describes what's wrong with the entry.
+	Reason string
+}
+
+// Error returns the error as a human-readable string.
+func (e *CorruptEntryError) Error() string {
+	return fmt.Sprintf("%v at %s for height %d at offset %d: %s",
+		ErrCorruptEntry, e.Path, e.Height, e.Offset, e.Reason)
+}
+
+// Is returns true for ErrCorruptEntry.
+func (e *CorruptEntryError) Is(target error) bool {
+	return target == ErrCorruptEntry
+}
+
+// isTransientReadErr returns whether the read error may go away when the read
+// is retried, like the ones network file systems return while the server is
+// unreachable or the file handle is being revalidated.
+func isTransientReadErr(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.EAGAIN,
+		syscall.ETIMEDOUT, syscall.ESTALE, syscall.EIO} {
+
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// FlatReadStats are the counts of the reads from the flat files that didn't
+// return everything right away.
+type FlatReadStats struct {
+	// ShortReads is the number of reads that returned less than asked for
+	// without a transient error, including the ones that hit the end of
+	// the data file early.
+	ShortReads uint64
+
+	// TransientErrors is the number of reads that failed with an error
+	// that may go away on a retry.
+	TransientErrors uint64
+
+	// Retries is the number of times a read was retried.
+	Retries uint64
+
+	// Failed is the number of reads that were given up on after all of
+	// the retries with a ShortReadError.
+	Failed uint64
+}
+
+// add adds the counts of other to the FlatReadStats.
+func (s *FlatReadStats) add(other FlatReadStats) {
+	s.ShortReads += other.ShortReads
+	s.TransientErrors += other.TransientErrors
+	s.Retries += other.Retries
+	s.Failed += other.Failed
+}
+
+// flatFileReads keeps the read stats of a FlatFileState.  The reads happen
+// under the read lock of the FlatFileState so the counts have a lock of their
+// own.
+type flatFileReads struct {
+	mtx   sync.Mutex
+	stats FlatReadStats
+}
+
+// count applies the given function to the read stats.  It does nothing if the
+// reads aren't counted.
+//
+// This function is safe for concurrent access.
+func (r *flatFileReads) count(f func(*FlatReadStats)) {
+	if r == nil {
+		return
+	}
+
+	r.mtx.Lock()
+	f(&r.stats)
+	r.mtx.Unlock()
+}
+
+// snapshot returns the current read stats.
+//
+// This function is safe for concurrent access.
+func (r *flatFileReads) snapshot() FlatReadStats {
+	if r == nil {
+		return FlatReadStats{}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.stats
+}
+
+// readCounts returns the read stats of the FlatFileState so far.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) readCounts() FlatReadStats {
+	return ff.reads.snapshot()
+}
+
+// dataReaderAt returns what the data file is read from.
+func (ff *FlatFileState) dataReaderAt() io.ReaderAt {
+	if ff.dataReader != nil {
+		return ff.dataReader
+	}
+
+	return ff.dataFile
+}
+
+// readAtFull reads exactly len(buf) bytes from the data file at the given
+// offset.  Reads that return less, either with an error or without one, are
+// continued from where they stopped.  Reaching the end of the data file right
+// at the expected length is a complete read.  Reaching it early and transient
+// errors are retried up to flatReadRetries times with backoff, after which a
+// ShortReadError is returned.  Other errors are returned as they are.
+//
+// This function MUST be called with the read lock held.
+func (ff *FlatFileState) readAtFull(buf []byte, offset int64) error {
+	r := ff.dataReaderAt()
+	backoff := ff.readBackoff
+
+	var read, retries int
+	for {
+		n, err := r.ReadAt(buf[read:], offset+int64(read))
+		read += n
+		if read >= len(buf) {
+			return nil
+		}
+
+		// Keep reading after a partial read that made progress.
+		if n > 0 && err == nil {
+			ff.reads.count(func(s *FlatReadStats) { s.ShortReads++ })
+			continue
+		}
+
+		switch {
+		case err == nil, errors.Is(err, io.EOF),
+			errors.Is(err, io.ErrUnexpectedEOF):
+
+			ff.reads.count(func(s *FlatReadStats) { s.ShortReads++ })
+
+		case isTransientReadErr(err):
+			ff.reads.count(func(s *FlatReadStats) { s.TransientErrors++ })
+
+		default:
+			return err
+		}
+
+		if retries == flatReadRetries {
+			ff.reads.count(func(s *FlatReadStats) { s.Failed++ })
+			return &ShortReadError{
+				Path:    ff.path,
+				Offset:  offset,
+				Want:    len(buf),
+				Got:     read,
+				Retries: retries,
+				Err:     err,
+			}
+		}
+		retries++
+		ff.reads.count(func(s *FlatReadStats) { s.Retries++ })
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// readEntryHeader reads the magic bytes and the size of the entry stored for
+// the given height and returns the size.  The size is checked against the
+// offset record.
+//
+// This function MUST be called with the read lock held.
+func (ff *FlatFileState) readEntryHeader(height int32) (uint32, error) {
+	offset := ff.offsets[height]
+
+	var buf [8]byte
+	err := ff.readAtFull(buf[:], offset)
+	if err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(buf[:4], magicBytes) {
+		return 0, &CorruptEntryError{
+			Path:   ff.path,
+			Height: height,
+			Offset: offset,
+			Reason: fmt.Sprintf("read wrong magic bytes. Expect %x "+
+				"but got %x", magicBytes, buf[:4]),
+		}
+	}
+	size := binary.BigEndian.Uint32(buf[4:])
+
+	if size != ff.lengths[height] {
+		return 0, &CorruptEntryError{
+			Path:   ff.path,
+			Height: height,
+			Offset: offset,
+			Reason: fmt.Sprintf("size of %d bytes but the offset "+
+				"record says %d", size, ff.lengths[height]),
+		}
+	}
+
+	return size, nil
+}
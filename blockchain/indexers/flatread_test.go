@@ -0,0 +1,324 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/utreexo/utreexod/chaincfg"
+)
+
+// readFault is how a single read from a flakyReaderAt fails.  At most n bytes
+// are read before err is returned.
+type readFault struct {
+	n   int
+	err error
+}
+
+// flakyReaderAt reads from the underlying reader but fails the reads with the
+// faults it holds, one fault per read, until it runs out of them.  When always
+// is set, every read fails with it after that.
+type flakyReaderAt struct {
+	r      io.ReaderAt
+	faults []readFault
+	always *readFault
+	reads  int
+}
+
+func (f *flakyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	f.reads++
+
+	fault := f.always
+	if len(f.faults) > 0 {
+		fault = &f.faults[0]
+		f.faults = f.faults[1:]
+	}
+	if fault == nil {
+		return f.r.ReadAt(p, off)
+	}
+
+	if fault.n < len(p) {
+		p = p[:fault.n]
+	}
+	n, err := f.r.ReadAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, fault.err
+}
+
+// timeoutErr is a read error that timed out.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string { return "i/o timeout" }
+func (timeoutErr) Timeout() bool { return true }
+
+// flatReadTestState returns a FlatFileState with the data for heights 1 to 3
+// stored in it.
+func flatReadTestState(t *testing.T) (*FlatFileState, [][]byte) {
+	ff, err := loadFlatFileState(t.TempDir(), "flatread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ff.dataFile.Close()
+		ff.offsetFile.Close()
+	})
+
+	// Don't wait between the retries.
+	ff.readBackoff = 0
+
+	datas := [][]byte{
+		nil,
+		bytes.Repeat([]byte{1}, 10),
+		bytes.Repeat([]byte{2}, 20),
+		bytes.Repeat([]byte{3}, 30),
+	}
+	for height := int32(1); height < int32(len(datas)); height++ {
+		err := ff.StoreData(height, datas[height])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return ff, datas
+}
+
+// TestFlatFileReadRetries ensures that reads from the flat files that come up
+// short or fail with transient errors are retried and counted, and that the
+// ones that never complete are told apart from corrupt entries.
+func TestFlatFileReadRetries(t *testing.T) {
+	eof := readFault{0, io.EOF}
+	tests := []struct {
+		name    string
+		faults  []readFault
+		always  *readFault
+		want    FlatReadStats
+		wantErr error
+	}{
+		{
+			name: "clean reads",
+		},
+		{
+			name:   "partial reads",
+			faults: []readFault{{3, nil}, {1, nil}, {0, nil}, {5, nil}},
+			want: FlatReadStats{
+				ShortReads: 4,
+				Retries:    1,
+			},
+		},
+		{
+			name:   "end of file",
+			faults: []readFault{{4, io.EOF}, {0, io.ErrUnexpectedEOF}},
+			want: FlatReadStats{
+				ShortReads: 2,
+				Retries:    2,
+			},
+		},
+		{
+			name: "transient errors",
+			faults: []readFault{
+				{0, syscall.EIO},
+				{2, &os.PathError{Op: "read", Err: syscall.ESTALE}},
+				{0, syscall.EINTR},
+				{0, timeoutErr{}},
+			},
+			want: FlatReadStats{
+				TransientErrors: 4,
+				Retries:         4,
+			},
+		},
+		{
+			name:    "short reads that don't go away",
+			always:  &eof,
+			want:    FlatReadStats{ShortReads: 5, Retries: 4, Failed: 1},
+			wantErr: ErrShortRead,
+		},
+		{
+			name:    "transient errors that don't go away",
+			always:  &readFault{0, syscall.EIO},
+			want:    FlatReadStats{TransientErrors: 5, Retries: 4, Failed: 1},
+			wantErr: ErrShortRead,
+		},
+		{
+			name:    "persistent errors",
+			faults:  []readFault{{0, syscall.EACCES}},
+			wantErr: syscall.EACCES,
+		},
+	}
+	for _, test := range tests {
+		ff, datas := flatReadTestState(t)
+		reader := &flakyReaderAt{
+			r:      ff.dataFile,
+			faults: test.faults,
+			always: test.always,
+		}
+		ff.dataReader = reader
+
+		data, err := ff.FetchData(2)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: expected error %v, got %v", test.name,
+				test.wantErr, err)
+		}
+		if errors.Is(err, ErrCorruptEntry) {
+			t.Fatalf("%s: short read taken for a corrupt entry",
+				test.name)
+		}
+		if err == nil && !bytes.Equal(data, datas[2]) {
+			t.Fatalf("%s: expected %x, got %x", test.name, datas[2],
+				data)
+		}
+		if got := ff.readCounts(); got != test.want {
+			t.Fatalf("%s: expected stats %+v, got %+v", test.name,
+				test.want, got)
+		}
+
+		if !errors.Is(test.wantErr, ErrShortRead) {
+			continue
+		}
+		var shortErr *ShortReadError
+		if !errors.As(err, &shortErr) {
+			t.Fatalf("%s: expected a ShortReadError, got %T",
+				test.name, err)
+		}
+		if shortErr.Retries != flatReadRetries ||
+			shortErr.Want != 8+len(datas[2]) ||
+			shortErr.Got != 0 || shortErr.Offset != ff.offsets[2] {
+
+			t.Fatalf("%s: unexpected short read %+v", test.name,
+				shortErr)
+		}
+		if isPersistentWriteErr(err) {
+			t.Fatalf("%s: short read taken for a persistent error",
+				test.name)
+		}
+	}
+}
+
+// TestFlatFileCorruptEntry ensures that entries that are read whole but don't
+// match the offsets are reported as corrupt.
+func TestFlatFileCorruptEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{
+			name:   "wrong magic",
+			header: []byte{0, 0, 0, 0, 0, 0, 0, 20},
+		},
+		{
+			name:   "wrong size",
+			header: append(append([]byte{}, magicBytes...), 0, 0, 0, 21),
+		},
+	}
+	for _, test := range tests {
+		ff, _ := flatReadTestState(t)
+		_, err := ff.dataFile.WriteAt(test.header, ff.offsets[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ff.FetchData(2)
+		var corruptErr *CorruptEntryError
+		if !errors.As(err, &corruptErr) || !errors.Is(err, ErrCorruptEntry) {
+			t.Fatalf("%s: expected a CorruptEntryError, got %v",
+				test.name, err)
+		}
+		if corruptErr.Height != 2 || corruptErr.Offset != ff.offsets[2] ||
+			errors.Is(err, ErrShortRead) {
+
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+	}
+
+	// Disconnecting reads the same header.
+	ff, _ := flatReadTestState(t)
+	_, err := ff.dataFile.WriteAt(tests[0].header, ff.offsets[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ff.DisconnectBlock(3)
+	if !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("expected ErrCorruptEntry disconnecting, got %v", err)
+	}
+
+	// The size of the last entry is checked against its offset record
+	// too.
+	ff, _ = flatReadTestState(t)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], 29)
+	_, err = ff.dataFile.WriteAt(size[:], ff.offsets[3]+4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ff.FetchData(3)
+	if !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("expected ErrCorruptEntry for the last entry, got %v",
+			err)
+	}
+
+	// The data is checked against the checksum of its offset record.
+	ff, _ = flatReadTestState(t)
+	_, err = ff.dataFile.WriteAt([]byte{0xff}, ff.offsets[2]+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ff.FetchData(2)
+	if !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("expected ErrCorruptEntry for flipped data, got %v",
+			err)
+	}
+}
+
+// TestShortReadNotRepaired ensures that a flat file that can't be read whole is
+// never quarantined or regenerated by the repair of the non-canonical proofs.
+func TestShortReadNotRepaired(t *testing.T) {
+	dataDir := t.TempDir()
+	ff, datas := flatReadTestState(t)
+	idx := &FlatUtreexoProofIndex{
+		proofGenInterVal: 1,
+		dataDir:          dataDir,
+		chainParams:      &chaincfg.RegressionNetParams,
+		proofState:       *ff,
+	}
+	idx.proofState.dataReader = &flakyReaderAt{
+		r:      ff.dataFile,
+		always: &readFault{0, io.EOF},
+	}
+
+	_, err := idx.RepairNonCanonicalProofs(1, 3)
+	if !errors.Is(err, ErrShortRead) {
+		t.Fatalf("expected ErrShortRead, got %v", err)
+	}
+	_, err = os.Stat(flatFilePath(dataDir, flatUtreexoQuarantineName))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be quarantined, got %v", err)
+	}
+	if tip := idx.proofState.BestHeight(); tip != 3 {
+		t.Fatalf("expected the tip to stay at 3, got %d", tip)
+	}
+
+	want := &FlatReadStats{ShortReads: 5, Retries: 4, Failed: 1}
+	if got := idx.Stats().Reads; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected read stats %+v, got %+v", want, got)
+	}
+
+	// The data is all there once the mount recovers.
+	idx.proofState.dataReader = nil
+	for height := int32(1); height <= 3; height++ {
+		data, err := idx.proofState.FetchData(height)
+		if err != nil || !bytes.Equal(data, datas[height]) {
+			t.Fatalf("height %d: expected %x, got %x with error %v",
+				height, datas[height], data, err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// flatOffsetRecordSize is the size of a record in the offset file.
+	// The record of a height is at height*flatOffsetRecordSize.
+	//
+	// The serialized format is:
+	//
+	//	<height><segment><offset><length><entry checksum><record checksum>
+	//
+	//	Field            Type     Size
+	//	height           uint32   4
+	//	segment          uint32   4
+	//	offset           uint64   8
+	//	length           uint32   4
+	//	entry checksum   uint32   4
+	//	record checksum  uint32   4
+	flatOffsetRecordSize = 28
+
+	// flatFileRecordsVersion is the first format version where the offset
+	// file is made of records.  The versions before it can't read or write
+	// the records.
+	flatFileRecordsVersion = 2
+
+	// legacyOffsetSize is the size of an offset in the offset file of the
+	// versions before flatFileRecordsVersion.
+	legacyOffsetSize = 8
+
+	// offsetMigrateSuffix is the suffix of the offset file that the records
+	// are written to while the offsets are migrated.
+	offsetMigrateSuffix = ".migrate"
+)
+
+// flatChecksumTable is the table the checksums of the entries and the records
+// are calculated with.
+var flatChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// flatOffsetRecord is the record of an entry in the offset file.  Every record
+// can be validated on its own so that a write of one that was torn by a crash
+// is detected without looking at the other ones.
+type flatOffsetRecord struct {
+	// height is the height the entry was stored for.
+	height int32
+
+	// segment is the data file the entry is in.  There's only the one data
+	// file for now so it's always 0.
+	segment uint32
+
+	// offset is where the entry starts in the data file and length is the
+	// size of the data of the entry, without its magic bytes and size.
+	offset int64
+	length uint32
+
+	// checksum is the checksum of the data of the entry.
+	checksum uint32
+}
+
+// end returns the offset in the data file right after the entry.
+func (r *flatOffsetRecord) end() int64 {
+	if r.height == 0 {
+		return 0
+	}
+	return r.offset + 8 + int64(r.length)
+}
+
+// serialize returns the record serialized with its record checksum.
+func (r *flatOffsetRecord) serialize() []byte {
+	buf := make([]byte, flatOffsetRecordSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(r.height))
+	binary.BigEndian.PutUint32(buf[4:8], r.segment)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(r.offset))
+	binary.BigEndian.PutUint32(buf[16:20], r.length)
+	binary.BigEndian.PutUint32(buf[20:24], r.checksum)
+	binary.BigEndian.PutUint32(buf[24:28],
+		crc32.Checksum(buf[:24], flatChecksumTable))
+
+	return buf
+}
+
+// deserializeOffsetRecord returns the record serialized in buf after checking
+// that its record checksum matches and that it's of the given height.
+func deserializeOffsetRecord(buf []byte, height int32) (flatOffsetRecord, error) {
+	if len(buf) != flatOffsetRecordSize {
+		return flatOffsetRecord{}, fmt.Errorf("offset record of %d "+
+			"bytes, expected %d", len(buf), flatOffsetRecordSize)
+	}
+	checksum := binary.BigEndian.Uint32(buf[24:28])
+	if crc32.Checksum(buf[:24], flatChecksumTable) != checksum {
+		return flatOffsetRecord{}, fmt.Errorf("checksum mismatch in "+
+			"the offset record of height %d", height)
+	}
+
+	r := flatOffsetRecord{
+		height:   int32(binary.BigEndian.Uint32(buf[0:4])),
+		segment:  binary.BigEndian.Uint32(buf[4:8]),
+		offset:   int64(binary.BigEndian.Uint64(buf[8:16])),
+		length:   binary.BigEndian.Uint32(buf[16:20]),
+		checksum: binary.BigEndian.Uint32(buf[20:24]),
+	}
+	if r.height != height {
+		return flatOffsetRecord{}, fmt.Errorf("offset record of height "+
+			"%d is at the position of height %d", r.height, height)
+	}
+	if r.segment != 0 || r.offset < 0 {
+		return flatOffsetRecord{}, fmt.Errorf("offset record of height "+
+			"%d points to offset %d of segment %d", height, r.offset,
+			r.segment)
+	}
+
+	return r, nil
+}
+
+// genesisOffsetRecord is the record of the genesis block.  Nothing is stored
+// for it but it keeps the records addressable by height.
+var genesisOffsetRecord = flatOffsetRecord{
+	checksum: crc32.Checksum(nil, flatChecksumTable),
+}
+
+// flatFileRecovery is what loading the offsets did to recover from a crash.
+type flatFileRecovery struct {
+	// checked is the number of entries that were read to validate the
+	// records at the tail of the offset file.
+	checked int
+
+	// dropped is the number of records at the tail that were torn or
+	// whose entries were.  tornBytes is the size of the incomplete record
+	// at the very end of the offset file.
+	dropped   int
+	tornBytes int64
+
+	// dataTruncated is the amount of bytes of torn entries that were
+	// removed from the end of the data file.
+	dataTruncated int64
+}
+
+// checkEntry returns an error if the entry of the record isn't in the data file
+// of the given size whole with the checksum of the record.
+//
+// This function MUST be called with the lock held.
+func (ff *FlatFileState) checkEntry(r *flatOffsetRecord, dataSize int64) error {
+	if r.end() > dataSize {
+		return fmt.Errorf("entry of height %d ends at %d past the end "+
+			"of the data file at %d", r.height, r.end(), dataSize)
+	}
+
+	buf := make([]byte, 8+int(r.length))
+	err := ff.readAtFull(buf, r.offset)
+	if err != nil {
+		return err
+	}
+
+	return ff.checkEntryBytes(r.height, r.offset, buf, r.length, r.checksum)
+}
+
+// checkEntryBytes returns a CorruptEntryError if buf, read from the given
+// offset, doesn't hold the magic bytes, the given size, and data with the given
+// checksum.
+func (ff *FlatFileState) checkEntryBytes(height int32, offset int64, buf []byte,
+	length, checksum uint32) error {
+
+	var reason string
+	switch {
+	case !bytes.Equal(buf[:4], magicBytes):
+		reason = fmt.Sprintf("read wrong magic bytes. Expect %x but "+
+			"got %x", magicBytes, buf[:4])
+
+	case binary.BigEndian.Uint32(buf[4:8]) != length:
+		reason = fmt.Sprintf("size of %d bytes but the offset record "+
+			"says %d", binary.BigEndian.Uint32(buf[4:8]), length)
+
+	case crc32.Checksum(buf[8:], flatChecksumTable) != checksum:
+		reason = "data doesn't match the checksum of the offset record"
+
+	default:
+		return nil
+	}
+
+	return &CorruptEntryError{
+		Path:   ff.path,
+		Height: height,
+		Offset: offset,
+		Reason: reason,
+	}
+}
+
+// loadOffsets reads the records from the offsetFile.  The records at the tail
+// that were torn by a crash, or whose entries were, are dropped along with
+// their entries.  Only the entries at the tail are read to tell so in the
+// common case only the entry of the last record is read.  The records before
+// them are only checked on their own.
+func (ff *FlatFileState) loadOffsets() error {
+	offsetFileSize, err := ff.offsetFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	dataSize, err := ff.dataFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, offsetFileSize)
+	_, err = ff.offsetFile.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	count := int32(offsetFileSize / flatOffsetRecordSize)
+	ff.recovery = flatFileRecovery{
+		tornBytes: offsetFileSize % flatOffsetRecordSize,
+	}
+
+	// Walk back from the last record until one that's whole has an entry
+	// that's whole.  The genesis record has no entry.
+	var last flatOffsetRecord
+	for ; count > 1; count-- {
+		height := count - 1
+		last, err = deserializeOffsetRecord(
+			buf[height*flatOffsetRecordSize:count*flatOffsetRecordSize],
+			height)
+		if err == nil {
+			ff.recovery.checked++
+			err = ff.checkEntry(&last, dataSize)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, ErrShortRead) {
+				return err
+			}
+		}
+
+		log.Warnf("Dropping the torn offset record of height %d "+
+			"at %s: %v", height, ff.path, err)
+		ff.recovery.dropped++
+	}
+
+	// Check the records that weren't walked back over on their own.  A
+	// record that's broken before the tail isn't from a torn write.
+	ff.offsets = make([]int64, count)
+	ff.lengths = make([]uint32, count)
+	ff.checksums = make([]uint32, count)
+	for height := int32(0); height < count; height++ {
+		start := height * flatOffsetRecordSize
+		r, err := deserializeOffsetRecord(
+			buf[start:start+flatOffsetRecordSize], height)
+		if err != nil {
+			return fmt.Errorf("corrupt offset file at %s: %v", ff.path,
+				err)
+		}
+		ff.offsets[height] = r.offset
+		ff.lengths[height] = r.length
+		ff.checksums[height] = r.checksum
+	}
+
+	if count == 0 {
+		// The genesis record is stored for a new FlatFileState or
+		// if its own write was torn.
+		ff.offsets = []int64{0}
+		ff.lengths = []uint32{0}
+		ff.checksums = []uint32{genesisOffsetRecord.checksum}
+		count = 1
+		if !ff.readOnly {
+			err = ff.offsetFile.Truncate(0)
+			if err != nil {
+				return err
+			}
+			_, err = ff.offsetFile.WriteAt(
+				genesisOffsetRecord.serialize(), 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	ff.currentHeight = count - 1
+
+	// The data file is used as is when nothing was torn as the entry of a
+	// record that was never written may be followed by the next one.
+	ff.currentOffset = dataSize
+	if ff.recovery.dropped == 0 && ff.recovery.tornBytes == 0 {
+		return nil
+	}
+	if ff.recovery.dropped > 0 {
+		ff.currentOffset = last.end()
+		if count == 1 {
+			ff.currentOffset = 0
+		}
+		ff.recovery.dataTruncated = dataSize - ff.currentOffset
+	}
+	if ff.readOnly {
+		return nil
+	}
+
+	err = ff.offsetFile.Truncate(int64(count) * flatOffsetRecordSize)
+	if err != nil {
+		return err
+	}
+	err = ff.dataFile.Truncate(ff.currentOffset)
+	if err != nil {
+		return err
+	}
+	log.Infof("Recovered the flat file at %s at height %d after "+
+		"dropping %d torn offset records", ff.path, ff.currentHeight,
+		ff.recovery.dropped)
+
+	return nil
+}
+
+// migrateOffsetRecords rewrites the offsets in the offset file of the
+// FlatFileState at the given path as records.  The records are written to a
+// separate file that's swapped in once it's synced so that a crash leaves
+// either the offsets or the records.  Every entry is read once to get its
+// checksum.
+func migrateOffsetRecords(path, dataName string) error {
+	offsetPath := filepath.Join(path, offsetFileName)
+	offsets, err := os.ReadFile(offsetPath)
+	if err != nil {
+		return err
+	}
+	// The version is written after the records are swapped in so a crash
+	// in between leaves records that are already migrated.
+	if len(offsets)%flatOffsetRecordSize == 0 && len(offsets) > 0 {
+		_, err := deserializeOffsetRecord(offsets[:flatOffsetRecordSize], 0)
+		if err == nil {
+			return nil
+		}
+	}
+	if len(offsets)%legacyOffsetSize != 0 {
+		return fmt.Errorf("corrupt flat file at %s. Offset file not "+
+			"multiple of %d bytes", path, legacyOffsetSize)
+	}
+
+	dataFile, err := os.Open(filepath.Join(path, dataName+dataFileSuffix))
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	migratePath := offsetPath + offsetMigrateSuffix
+	migrateFile, err := os.OpenFile(migratePath,
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer migrateFile.Close()
+
+	w := bufio.NewWriter(migrateFile)
+	_, err = w.Write(genesisOffsetRecord.serialize())
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	for height := 1; height < len(offsets)/legacyOffsetSize; height++ {
+		offset := int64(binary.BigEndian.Uint64(
+			offsets[height*legacyOffsetSize:]))
+		_, err = dataFile.ReadAt(header[:], offset)
+		if err != nil {
+			return fmt.Errorf("unable to read the entry of height "+
+				"%d at %s: %v", height, path, err)
+		}
+		if !bytes.Equal(header[:4], magicBytes) {
+			return fmt.Errorf("corrupt flat file at %s. Wrong magic "+
+				"bytes %x at height %d", path, header[:4], height)
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		_, err = dataFile.ReadAt(data, offset+8)
+		if err != nil {
+			return fmt.Errorf("unable to read the entry of height "+
+				"%d at %s: %v", height, path, err)
+		}
+
+		r := flatOffsetRecord{
+			height:   int32(height),
+			offset:   offset,
+			length:   uint32(len(data)),
+			checksum: crc32.Checksum(data, flatChecksumTable),
+		}
+		_, err = w.Write(r.serialize())
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = migrateFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(migratePath, offsetPath)
+}
+
+// offsetsSize returns the size of the offset file of a FlatFileState of the
+// given format version that only has the offset of the genesis block.
+func offsetsSize(version uint32) int64 {
+	if version < flatFileRecordsVersion {
+		return legacyOffsetSize
+	}
+
+	return flatOffsetRecordSize
+}
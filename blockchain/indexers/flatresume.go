@@ -0,0 +1,173 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// forestHeightFileName is the name of the file in the utreexo state directory
+// of the flat utreexo proof index that keeps the height that the utreexo state
+// was flushed at.
+const forestHeightFileName = "forestheight.dat"
+
+// readForestHeight returns the height that the utreexo state at the given path
+// was flushed at.  It's -1 if none was recorded or if the state was being
+// flushed when the node stopped.
+func readForestHeight(basePath string) (int32, error) {
+	buf, err := os.ReadFile(filepath.Join(basePath, forestHeightFileName))
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) != 4 {
+		return 0, fmt.Errorf("corrupt utreexo state height file. "+
+			"Expected 4 bytes but got %d", len(buf))
+	}
+
+	return int32(binary.BigEndian.Uint32(buf)), nil
+}
+
+// writeForestHeight records the height that the utreexo state at the given path
+// was flushed at.  -1 records that the height isn't known.
+func writeForestHeight(basePath string, height int32) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(height))
+	return os.WriteFile(filepath.Join(basePath, forestHeightFileName),
+		buf[:], 0600)
+}
+
+// committedHeight returns the height of the last block that both the proof and
+// the undo flat files of the index have the entries of.
+func (idx *FlatUtreexoProofIndex) committedHeight() int32 {
+	height := idx.proofState.BestHeight()
+	if undoHeight := idx.undoState.BestHeight(); undoHeight < height {
+		height = undoHeight
+	}
+
+	return height
+}
+
+// rollBackToCommitted rolls the utreexo state and the flat files of the index
+// back to the last block that they and the index tip at the given height all
+// have and returns its height.  The flat files are written one after the other
+// for every block and apart from the database, and the utreexo state is only
+// flushed every so often, so a crash may leave any of them ahead of the others.
+//
+// An error is returned if the utreexo state is ahead of the undo blocks as it
+// can't be rolled back without them.
+func (idx *FlatUtreexoProofIndex) rollBackToCommitted(tip int32) (int32, error) {
+	committed := idx.committedHeight()
+	state := idx.loadedStateHeight
+	if state < 0 {
+		state = committed
+	}
+	if undoHeight := idx.undoState.BestHeight(); state > undoHeight {
+		return 0, fmt.Errorf("the utreexo state of the %s is at height "+
+			"%d but it only has the undo blocks up to height %d.  "+
+			"Drop the index with --dropflatutreexoproofindex to "+
+			"start it over", idx.Name(), state, undoHeight)
+	}
+
+	height := tip
+	if state < height {
+		height = state
+	}
+	if committed < height {
+		height = committed
+	}
+
+	if state > height {
+		idx.mtx.Lock()
+		err := idx.undoUtreexoState(state, height+1, nil)
+		idx.mtx.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := idx.truncateFlatFiles(height)
+	if err != nil {
+		return 0, err
+	}
+
+	// The state that was rolled back is flushed so that a crash before
+	// the next flush doesn't find the state ahead of the index tip.
+	if state > height {
+		err := idx.FlushUtreexoState()
+		if err != nil {
+			return 0, err
+		}
+	}
+	idx.loadedStateHeight = height
+
+	return height, nil
+}
+
+// resumeFlatIndex makes the flat utreexo proof index resume from the last block
+// that its tip, its utreexo state, and its flat files all have after a crash.
+// The tip is set back to that block so that the index is caught up from there
+// rather than from a tip that it's missing the entries or the utreexo state
+// of.
+func (m *Manager) resumeFlatIndex() error {
+	_, flatIdx := m.utreexoProofIndexes()
+	if flatIdx == nil {
+		return nil
+	}
+
+	var tipHash *chainhash.Hash
+	var tip int32
+	err := m.db.View(func(dbTx database.Tx) error {
+		var err error
+		tipHash, tip, err = dbFetchIndexerTip(dbTx, flatIdx.Key())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if tip <= 0 {
+		return nil
+	}
+
+	// The blocks that the utreexo state is rolled back over are only
+	// taken from the chain if rolling it back fails.
+	flatIdx.SetChain(m.chain)
+	height, err := flatIdx.rollBackToCommitted(tip)
+	if err != nil {
+		return err
+	}
+	if height == tip {
+		return nil
+	}
+
+	// The tip may be of a block that's no longer in the main chain so
+	// the block it's set back to is found through the headers.
+	hash := tipHash
+	for h := tip; h > height; h-- {
+		header, err := m.chain.HeaderByHash(hash)
+		if err != nil {
+			return err
+		}
+		hash = &header.PrevBlock
+	}
+	err = m.db.Update(func(dbTx database.Tx) error {
+		return dbPutIndexerTip(dbTx, flatIdx.Key(), hash, height)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Resuming the %s from height %d as it only had everything "+
+		"up to there for its tip at height %d", flatIdx.Name(), height,
+		tip)
+
+	return nil
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/database"
+)
+
+// TestResumeFlatIndex ensures that the flat utreexo proof index is set back to
+// the last block that it has everything for when a crash left its last proof
+// torn or its tip behind the rest of it, and that it's caught back up from
+// there to the same entries and accumulator as the utreexo proof index.
+func TestResumeFlatIndex(t *testing.T) {
+	defer os.RemoveAll(testDbRoot)
+
+	tests := []struct {
+		name string
+
+		// crash leaves the index of the chain at the given tip the way
+		// a crash would.
+		crash func(t *testing.T, dbPath string, db database.DB,
+			chain *blockchain.BlockChain, tip int32)
+
+		// resumed is how far back from the tip the index resumes.
+		resumed int32
+	}{
+		{
+			name: "torn last proof",
+			crash: func(t *testing.T, dbPath string, db database.DB,
+				chain *blockchain.BlockChain, tip int32) {
+
+				dataPath := filepath.Join(flatFilePath(dbPath,
+					flatUtreexoProofName),
+					flatUtreexoProofName+dataFileSuffix)
+				fi, err := os.Stat(dataPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.Truncate(dataPath, fi.Size()-3)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			resumed: 1,
+		},
+		{
+			name: "tip behind the flat files",
+			crash: func(t *testing.T, dbPath string, db database.DB,
+				chain *blockchain.BlockChain, tip int32) {
+
+				hash, err := chain.BlockHashByHeight(tip - 3)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = db.Update(func(dbTx database.Tx) error {
+					return dbPutIndexerTip(dbTx,
+						flatUtreexoBucketKey, hash,
+						tip-3)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			resumed: 3,
+		},
+	}
+
+	for _, test := range tests {
+		testName := "TestResumeFlatIndex" + test.name
+		chain, indexes, params, tearDown := indexersTestChain(testName, 1)
+
+		tip, spendables := blockchain.AddBlock(chain,
+			btcutil.NewBlock(params.GenesisBlock), nil)
+		for i := 0; i < 20; i++ {
+			tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+		}
+
+		// The utreexo states are flushed as they are on shutdown.
+		db := indexes[0].(*UtreexoProofIndex).db
+		for _, indexer := range indexes {
+			var err error
+			switch idx := indexer.(type) {
+			case *UtreexoProofIndex:
+				err = idx.FlushUtreexoState()
+			case *FlatUtreexoProofIndex:
+				err = idx.FlushUtreexoState()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		dbPath := filepath.Join(testDbRoot, testName)
+		test.crash(t, dbPath, db, chain, tip.Height())
+
+		// The index is only set back to where it resumes from.
+		m, dbIdx, flatIdx := migrationManager(t, dbPath, indexes, params,
+			MigrateNone)
+		m.chain = chain
+		err := m.resumeFlatIndex()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		want := tip.Height() - test.resumed
+		err = db.View(func(dbTx database.Tx) error {
+			hash, height, err := dbFetchIndexerTip(dbTx, flatIdx.Key())
+			if err != nil {
+				return err
+			}
+			wantHash, err := chain.BlockHashByHeight(want)
+			if err != nil {
+				return err
+			}
+			if height != want || *hash != *wantHash {
+				t.Fatalf("%s: got the tip at height %d (%v), "+
+					"want height %d (%v)", test.name, height,
+					hash, want, wantHash)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := flatIdx.committedHeight(); got != want {
+			t.Fatalf("%s: the flat files are at height %d, want %d",
+				test.name, got, want)
+		}
+		state, err := readForestHeight(
+			utreexoBasePath(flatIdx.utreexoState.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != want {
+			t.Fatalf("%s: the utreexo state was flushed at height "+
+				"%d, want %d", test.name, state, want)
+		}
+
+		// Resuming the index a second time leaves it where it is.
+		err = m.resumeFlatIndex()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := flatIdx.committedHeight(); got != want {
+			t.Fatalf("%s: the flat files are at height %d, want %d",
+				test.name, got, want)
+		}
+
+		// The index is caught back up to the same entries and roots
+		// as the utreexo proof index.
+		err = m.Init(chain, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := flatIdx.Stats().Total.Blocks; got != uint64(test.resumed) {
+			t.Fatalf("%s: connected %d blocks, want %d", test.name,
+				got, test.resumed)
+		}
+		err = compareUtreexoIdx(1, tip.Height()+1, chain,
+			[]Indexer{dbIdx, flatIdx})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(dbIdx.utreexoState.state.GetRoots(),
+			flatIdx.utreexoState.state.GetRoots()) {
+
+			t.Fatalf("%s: the roots of the indexes differ", test.name)
+		}
+
+		tearDown()
+	}
+}
+
+// faultyJournalChain is a chain that hands out a spend journal with the amount
+// of the first spent output changed for the block at the given height.
+type faultyJournalChain struct {
+	*blockchain.BlockChain
+	height   int32
+	tampered bool
+}
+
+// Ensure the faultyJournalChain type implements the indexChain interface.
+var _ indexChain = (*faultyJournalChain)(nil)
+
+func (c *faultyJournalChain) FetchSpendJournalUnsafe(block *btcutil.Block) (
+	[]blockchain.SpentTxOut, error) {
+
+	stxos, err := c.BlockChain.FetchSpendJournalUnsafe(block)
+	if err != nil || block.Height() != c.height || len(stxos) == 0 {
+		return stxos, err
+	}
+	tampered := make([]blockchain.SpentTxOut, len(stxos))
+	copy(tampered, stxos)
+	tampered[0].Amount++
+	c.tampered = true
+
+	return tampered, nil
+}
+
+// TestReindexFromFailure ensures that a regeneration of the flat utreexo proof
+// index that can't connect a block returns the error with the index left at
+// the block before it, and that the regeneration is finished when it's tried
+// again or when the index is caught up on restart.
+func TestReindexFromFailure(t *testing.T) {
+	defer os.RemoveAll(testDbRoot)
+
+	const start, failHeight = 10, 15
+
+	for _, restart := range []bool{false, true} {
+		testName := "TestReindexFromFailure"
+		if restart {
+			testName += "Restart"
+		}
+		chain, indexes, params, tearDown := indexersTestChain(testName, 1)
+
+		tip, spendables := blockchain.AddBlock(chain,
+			btcutil.NewBlock(params.GenesisBlock), nil)
+		for i := 0; i < 20; i++ {
+			tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+		}
+
+		var dbIdx *UtreexoProofIndex
+		var flatIdx *FlatUtreexoProofIndex
+		for _, indexer := range indexes {
+			switch idx := indexer.(type) {
+			case *UtreexoProofIndex:
+				dbIdx = idx
+			case *FlatUtreexoProofIndex:
+				flatIdx = idx
+			}
+		}
+
+		faulty := &faultyJournalChain{BlockChain: chain, height: failHeight}
+		flatIdx.chain = faulty
+		err := flatIdx.ReindexFrom(start)
+		if err == nil {
+			t.Fatalf("%s: expected an error", testName)
+		}
+		if !faulty.tampered {
+			t.Fatalf("%s: block %d has no spends to tamper with",
+				testName, failHeight)
+		}
+
+		// The index has everything up to the block that failed and
+		// nothing after it.
+		if got := flatIdx.committedHeight(); got != failHeight-1 {
+			t.Fatalf("%s: the flat files are at height %d, want %d",
+				testName, got, failHeight-1)
+		}
+		for h := int32(start); h <= tip.Height(); h++ {
+			missing := flatIdx.complete.isMissing(h)
+			if missing != (h >= failHeight) {
+				t.Fatalf("%s: got missing %v for height %d",
+					testName, missing, h)
+			}
+		}
+		state, err := readForestHeight(
+			utreexoBasePath(flatIdx.utreexoState.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != failHeight-1 {
+			t.Fatalf("%s: the utreexo state was flushed at height "+
+				"%d, want %d", testName, state, failHeight-1)
+		}
+
+		if !restart {
+			// Trying again from past the last connected block
+			// connects the rest of the blocks.
+			flatIdx.SetChain(chain)
+			err = flatIdx.ReindexFrom(failHeight + 1)
+			if err == nil {
+				t.Fatalf("%s: expected an error for a start past "+
+					"the connected blocks", testName)
+			}
+			err = flatIdx.ReindexFrom(failHeight)
+			if err != nil {
+				t.Fatalf("%s: %v", testName, err)
+			}
+		} else {
+			// The index resumes from the block before the one
+			// that failed on restart and is caught up from there.
+			dbPath := filepath.Join(testDbRoot, testName)
+			var m *Manager
+			m, dbIdx, flatIdx = migrationManager(t, dbPath, indexes,
+				params, MigrateNone)
+			m.chain = chain
+			err = m.resumeFlatIndex()
+			if err != nil {
+				t.Fatalf("%s: %v", testName, err)
+			}
+			if got := flatIdx.committedHeight(); got != failHeight-1 {
+				t.Fatalf("%s: resumed from height %d, want %d",
+					testName, got, failHeight-1)
+			}
+			err = m.Init(chain, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", testName, err)
+			}
+		}
+
+		servable := flatIdx.complete.servable(tip.Height())
+		if !reflect.DeepEqual(servable,
+			[]HeightRange{{0, tip.Height()}}) {
+
+			t.Fatalf("%s: got servable heights %v", testName,
+				servable)
+		}
+		err = compareUtreexoIdx(1, tip.Height()+1, chain,
+			[]Indexer{dbIdx, flatIdx})
+		if err != nil {
+			t.Fatalf("%s: %v", testName, err)
+		}
+		if !reflect.DeepEqual(dbIdx.utreexoState.state.GetRoots(),
+			flatIdx.utreexoState.state.GetRoots()) {
+
+			t.Fatalf("%s: the roots of the indexes differ", testName)
+		}
+
+		tearDown()
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/utreexo/utreexod/blockchain"
@@ -71,18 +73,41 @@ var _ Indexer = (*FlatUtreexoProofIndex)(nil)
 // Ensure the UtreexoProofIndex type implements the NeedsInputser interface.
 var _ NeedsInputser = (*FlatUtreexoProofIndex)(nil)
 
+// Ensure the FlatUtreexoProofIndex type implements the FlushAligner interface.
+var _ FlushAligner = (*FlatUtreexoProofIndex)(nil)
+
+// Ensure the FlatUtreexoProofIndex type implements the Rebuilder interface.
+var _ Rebuilder = (*FlatUtreexoProofIndex)(nil)
+
+// Ensure the FlatUtreexoProofIndex type implements the degradable interface.
+var _ degradable = (*FlatUtreexoProofIndex)(nil)
+
+// Ensure the FlatUtreexoProofIndex type implements the RangeServer interface.
+var _ RangeServer = (*FlatUtreexoProofIndex)(nil)
+
 // FlatUtreexoProofIndex implements a utreexo accumulator proof index for all the blocks.
 // In a flat file.
 type FlatUtreexoProofIndex struct {
+	// The following variables must only be used atomically.
+	//
+	// durableHeight is the height that the utreexo state was last flushed
+	// to disk at.
+	durableHeight int32
+
 	proofGenInterVal int32
+	dataDir          string
 	proofState       FlatFileState
 	undoState        FlatFileState
 	rememberIdxState FlatFileState
 	proofStatsState  FlatFileState
 	chainParams      *chaincfg.Params
 
+	// leafHasher hashes the leaves of the blocks.  It's the hasher of the
+	// chain once the chain is set.
+	leafHasher *wire.LeafHasher
+
 	// The blockchain instance the index corresponds to.
-	chain *blockchain.BlockChain
+	chain indexChain
 
 	// mtx protects concurrent access to the utreexoView .
 	mtx *sync.RWMutex
@@ -91,8 +116,121 @@ type FlatUtreexoProofIndex struct {
 	// It keeps all the elements of the forest in order to generate proofs.
 	utreexoState *UtreexoState
 
+	// loadedStateHeight is the height of the utreexo state that was loaded
+	// on start up.  It's -1 if the height wasn't recorded when the state
+	// was flushed.
+	loadedStateHeight int32
+
 	// pStats are the proof size statistics that are kept for research purposes.
 	pStats proofStats
+
+	// reindexRest are the blocks that a regeneration of the index failed
+	// to connect again.  They're connected again before any other block is
+	// connected or disconnected, and reindexStats are the proof statistics
+	// that are put back once they are.
+	reindexRest  []*BlockNotification
+	reindexStats proofStats
+
+	// proofGenBudget caps the memory used by in-flight proof generation.
+	// It's nil if there's no cap.
+	proofGenBudget *ProofGenBudget
+
+	// snapshotMtx serializes connecting and disconnecting blocks with
+	// proof generation against snapshots as the latter rolls back the
+	// utreexo state.
+	snapshotMtx sync.Mutex
+
+	// leases are the leases of the proof sessions and the cursors of the
+	// clients of the index.
+	leases *LeaseManager
+
+	// sessions are the open proof sessions.
+	sessions proofSessions
+
+	// stateFlushInterval is how often in blocks the utreexo state is
+	// flushed to disk.  It's 0 if the state is only flushed on shutdown.
+	stateFlushInterval int32
+
+	// undoSnapshotInterval is how often in blocks a full undo block is
+	// stored when the undo blocks are delta-encoded.  It's 0 if the undo
+	// blocks are stored whole.
+	undoSnapshotInterval int32
+
+	// lastUndoHeight and lastUndoBytes are the height and the serialized
+	// undo block that was last stored.  They're kept to delta-encode the
+	// next undo block without fetching the previous one.
+	lastUndoHeight int32
+	lastUndoBytes  []byte
+
+	// untaggedUndoTip is the height up to which the undo blocks were
+	// stored untagged by an older accumulator serialization version.
+	untaggedUndoTip int32
+
+	// eagerAccMigration is whether the untagged undo blocks are all
+	// re-encoded when the index is initialized.
+	eagerAccMigration bool
+
+	// verifyOnInit is whether every entry of the flat files is checked
+	// when the index is initialized.
+	verifyOnInit bool
+
+	// replication hands the committed blocks to the replication streams.
+	replication replicationHub
+
+	// writeStats are the bytes written to the flat files to connect blocks.
+	writeStats writeStats
+
+	// recovery is the progress of rebuilding the index from the utreexo
+	// proof index.
+	recovery recoveryProgress
+
+	// gate refuses the fetches while the index is being rebuilt.
+	gate rebuildGate
+
+	// degraded refuses the fetches above the durable height once the
+	// index is unable to write.
+	degraded degradedGate
+
+	// complete keeps the heights below the tip that are missing their
+	// proofs.
+	complete *completeness
+
+	// pins are the heights whose proofs, undo blocks, and roots must
+	// never be pruned.
+	pins *proofPins
+
+	// coinAge caches the coin age statistics of the blocks.
+	coinAge *coinAgeCache
+
+	// proofCost caches the proof costs of the bands of blocks.
+	proofCost *proofCostCache
+
+	// noLeafTTL is whether the index is built without the leaf time to
+	// live data.
+	noLeafTTL bool
+
+	// undoAssert checks that disconnecting blocks undoes connecting them.
+	// It's nil unless the assertions are enabled.
+	undoAssert *undoAssertions
+
+	// fsync is how the flat files are synced to disk and recordedFsync is
+	// the policy that the index was last run with.
+	fsync         FsyncPolicy
+	recordedFsync string
+
+	// collisions checks the added leaves for leaf hash collisions.
+	collisions leafCollisionChecker
+
+	// rowGrowth anticipates the forest gaining a row.
+	rowGrowth *rowGrowth
+
+	// leafLimit keeps the forest within the leaves that the platform can
+	// address.
+	leafLimit *leafLimit
+
+	// prune is how long the proofs are retained for and how far the index
+	// was pruned.
+	prune pruneState
 }
 
 // NeedsInputs signals that the index requires the referenced inputs in order
@@ -106,7 +244,29 @@ func (idx *FlatUtreexoProofIndex) NeedsInputs() bool {
 // Init initializes the flat utreexo proof index. This is part of the Indexer
 // interface.
 func (idx *FlatUtreexoProofIndex) Init() error {
-	return nil // nothing to do
+	idx.mtx.RLock()
+	numLeaves, err := idx.utreexoState.NumLeaves()
+	idx.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	err = idx.leafLimit.checkStart(numLeaves)
+	if err != nil {
+		return err
+	}
+
+	if idx.verifyOnInit {
+		err = idx.verifyFlatFiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	if idx.eagerAccMigration {
+		return idx.migrateUndoAccVersion()
+	}
+
+	return nil
 }
 
 // Name returns the human-readable name of the index.
@@ -142,126 +302,494 @@ func (idx *FlatUtreexoProofIndex) Create(dbTx database.Tx) error {
 // connected to the main chain.
 //
 // This is part of the Indexer interface.
-func (idx *FlatUtreexoProofIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
-
+func (idx *FlatUtreexoProofIndex) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	// Don't include genesis blocks.
-	if block.Height() == 0 {
+	if n.Height == 0 {
 		log.Tracef("UtreexoProofIndex.ConnectBlock: Asked to connect genesis"+
 			" block (height %d) Ignoring request and skipping block",
-			block.Height())
+			n.Height)
 		return nil
 	}
 
-	_, outCount, inskip, outskip := blockchain.DedupeBlock(block)
-	dels, _, err := blockchain.BlockToDelLeaves(stxos, idx.chain, block, inskip, -1)
+	start := time.Now()
+	eligibility, err := checkLeafEligibility(dbTx, idx.Key(), idx.Name(),
+		n.Block)
 	if err != nil {
 		return err
 	}
-	adds := blockchain.BlockToAddLeaves(block, outskip, nil, outCount)
+
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	err = idx.connectReindexed()
+	if err != nil {
+		return err
+	}
+
+	idx.rowGrowth.anticipate()
+	err = idx.connectBlock(n)
+	if err != nil {
+		return err
+	}
+	err = dbPutLeafEligibility(dbTx, idx.Key(), n.Block.Hash(), eligibility)
+	if err != nil {
+		return err
+	}
+	err = idx.pruneFlatFiles(n.Height)
+	if err != nil {
+		return err
+	}
+	idx.publishReplication(n.Block, false)
 
 	idx.mtx.RLock()
-	ud, err := wire.GenerateUData(dels, idx.utreexoState.state)
+	idx.rowGrowth.recordConnected(n.Height, idx.utreexoState, start)
 	idx.mtx.RUnlock()
+
+	return nil
+}
+
+// HistoryNeeded returns the number of blocks right before the connected block
+// at the given height that the index requires.  The blocks of the proof
+// generation interval are required by the block that ends the interval to make
+// the multi-block proof.
+//
+// This is part of the HistoryNeeder interface.
+func (idx *FlatUtreexoProofIndex) HistoryNeeded(height int32) int32 {
+	if idx.proofGenInterVal == 1 || height%idx.proofGenInterVal != 0 {
+		return 0
+	}
+
+	return idx.proofGenInterVal
+}
+
+// connectBlock connects the block to the utreexo state and stores the proof,
+// the undo block, and the proof statistics for it.
+//
+// This function MUST be called with the snapshotMtx held.
+func (idx *FlatUtreexoProofIndex) connectBlock(n *BlockNotification) error {
+	block := n.Block
+
+	// Remove any entries left behind by a previous attempt to connect this
+	// block that didn't make it to the index tip.
+	err := idx.truncateFlatFiles(block.Height() - 1)
 	if err != nil {
 		return err
 	}
+	if idx.undoAssert != nil {
+		fp, err := idx.fingerprint(block.Height())
+		if err != nil {
+			return err
+		}
+		idx.undoAssert.record(block, fp)
+	}
 
-	idx.mtx.Lock()
-	undoBlock, err := idx.utreexoState.state.Modify(adds, ud.AccProof.Targets)
-	idx.mtx.Unlock()
+	leaves, err := n.utreexoLeaves(idx.chainParams.LeafCommitments,
+		idx.leafHasher)
 	if err != nil {
 		return err
 	}
+	dels, adds := leaves.dels, leaves.adds
 
-	idx.pStats.UpdateTotalDelCount(uint64(len(dels)))
-	idx.pStats.UpdateUDStats(false, ud)
+	idx.mtx.RLock()
+	ud, err := wire.GenerateUDataFromHashes(dels, leaves.delHashes,
+		idx.utreexoState.state)
+	idx.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
 
-	err = idx.storeUndoBlock(block.Height(), *undoBlock)
+	// Make sure that none of the added leaves share their leaf hash with
+	// another leaf before they're added.
+	idx.mtx.RLock()
+	err = idx.collisions.check(block.Height(), adds, leaves.addOutPoints,
+		dels, leaves.delHashes, idx.utreexoState.state)
+	idx.mtx.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	// If the interval is 1, then just save the utreexo proof and we're done.
-	if idx.proofGenInterVal == 1 {
-		err = idx.storeProof(block.Height(), false, ud)
-		if err != nil {
-			return err
+	// The proof of a block that doesn't end a proof generation interval
+	// doesn't depend on the accumulator after the block, so it's stored
+	// while the accumulator is modified.
+	var storeProof func() error
+	multiBlock := idx.proofGenInterVal != 1 &&
+		block.Height()%idx.proofGenInterVal == 0
+	if !multiBlock {
+		storeProof = func() error {
+			return idx.storeProof(block.Height(),
+				idx.proofGenInterVal != 1, ud)
 		}
-	} else {
-		// Every proof generation interval, we'll make a multi-block proof.
-		if (block.Height() % idx.proofGenInterVal) == 0 {
-			err = idx.MakeMultiBlockProof(block.Height(), block.Height()-idx.proofGenInterVal,
-				block, ud, stxos)
+	}
+
+	storedBefore, allBefore := idx.flatFileWrites()
+	prevStats := idx.pStats
+	err = commitBlock(&blockCommit{
+		modifyState: func() (*accumulator.UndoBlock, error) {
+			idx.mtx.Lock()
+			defer idx.mtx.Unlock()
+			return idx.leafLimit.modify(idx.utreexoState, adds,
+				ud.AccProof.Targets)
+		},
+		storeProof: storeProof,
+		storeEntries: func(undoBlock *accumulator.UndoBlock) error {
+			return idx.storeBlockEntries(n, dels, ud, undoBlock,
+				multiBlock)
+		},
+		sync: func() error {
+			return idx.syncFlatFiles(block.Height())
+		},
+		rollback: func(undoBlock *accumulator.UndoBlock) error {
+			if undoBlock == nil {
+				return idx.truncateFlatFiles(block.Height() - 1)
+			}
+
+			idx.mtx.Lock()
+			err := idx.utreexoState.undo(*undoBlock)
+			idx.mtx.Unlock()
 			if err != nil {
 				return err
 			}
-		} else {
-			err = idx.storeProof(block.Height(), true, ud)
+
+			idx.pStats = prevStats
+			err = idx.pStats.WritePStats(&idx.proofStatsState)
 			if err != nil {
 				return err
 			}
-		}
-	}
 
-	idx.pStats.BlockHeight = uint64(block.Height())
-	err = idx.pStats.WritePStats(&idx.proofStatsState)
+			return idx.truncateFlatFiles(block.Height() - 1)
+		},
+	})
 	if err != nil {
 		return err
 	}
+	storedAfter, allAfter := idx.flatFileWrites()
+	idx.writeStats.record(block.Height(), flatWriteStats(storedBefore,
+		allBefore, storedAfter, allAfter))
+
+	// The proof of the block is servable again if it was missing.  The
+	// block is already committed so a failed write only leaves the height
+	// out of the servable ranges until it's regenerated again.
+	if idx.complete.isMissing(block.Height()) {
+		height := block.Height()
+		err := idx.complete.markServable(HeightRange{height, height})
+		if err != nil {
+			log.Warnf("Unable to mark the proof of height %d of the "+
+				"%s as servable: %v", height, idx.Name(), err)
+		}
+	}
 
 	if block.Height()%1000 == 0 {
 		idx.pStats.LogProofStats()
 	}
 
+	// Flush the utreexo state every state flush interval so that the
+	// chain is able to align the flushes of its cached state with it.
+	// The block is already committed so a failed flush only leaves the
+	// durable height behind.
+	if idx.stateFlushInterval > 0 &&
+		block.Height()%idx.stateFlushInterval == 0 {
+
+		err := idx.FlushUtreexoState()
+		if err != nil {
+			log.Warnf("Unable to flush the utreexo state of the %s "+
+				"at height %d: %v", idx.Name(), block.Height(), err)
+		}
+	}
+
 	return nil
 }
 
-// calcProofOverhead calculates the overhead of the current utreexo accumulator proof
-// has.
-func calcProofOverhead(ud *wire.UData) float64 {
-	if ud == nil || len(ud.AccProof.Targets) == 0 {
-		return 0
+// ReindexFrom regenerates everything stored for the blocks from the given
+// height up to the tip.  The utreexo state is rolled back to the block before
+// start and every block is connected again.  The flat files are append-only so
+// the entries above start can't be kept even if only the one at start needs to
+// be regenerated.
+//
+// If a block can't be connected again, the index is left with everything up to
+// the block before it and the error is returned.  The blocks that weren't
+// connected are connected again before the next block is connected or
+// disconnected, by calling ReindexFrom again with a start up to the height
+// right after the last connected block, or on restart as the index is caught
+// up from there.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) ReindexFrom(start int32) error {
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	// A regeneration that failed left the blocks after the last connected
+	// one to be connected again.
+	current := idx.undoState.currentHeight
+	tip, last := current, current
+	if len(idx.reindexRest) > 0 {
+		tip = idx.reindexRest[len(idx.reindexRest)-1].Height
+		last = current + 1
+	}
+	if start <= 0 || start > last {
+		return fmt.Errorf("height %d is not between 1 and %d", start,
+			last)
+	}
+	if tip-start >= maxSnapshotDepth {
+		return fmt.Errorf("height %d is more than %d blocks behind "+
+			"the tip", start, maxSnapshotDepth)
+	}
+
+	// Fetch the blocks first so that nothing is touched if any of them
+	// aren't available.  The blocks of the proof generation interval that
+	// start is in are fetched as well for the multi-block proofs.
+	first := start - idx.proofGenInterVal
+	if first < 0 {
+		first = 0
+	}
+	fetched, err := fetchNotifications(idx.chain, first, tip+1)
+	if err != nil {
+		return err
+	}
+	notifications := fetched[start-first:]
+	for i, n := range notifications {
+		needed := idx.HistoryNeeded(n.Height)
+		if needed > n.Height {
+			needed = n.Height
+		}
+		end := int(start-first) + i
+		n.History = fetched[end-int(needed) : end]
 	}
 
-	return float64(len(ud.AccProof.Proof)) / float64(len(ud.AccProof.Targets))
+	// The proofs from start are missing until they're regenerated.  Each
+	// one is servable again as soon as its block is connected again.
+	err = idx.complete.markMissing(HeightRange{start, tip})
+	if err != nil {
+		return err
+	}
+
+	if start <= current {
+		idx.mtx.Lock()
+		err = idx.undoUtreexoState(current, start, nil)
+		idx.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The proof statistics already account for the blocks so they're put
+	// back once the blocks are connected again.
+	if idx.reindexRest == nil {
+		idx.reindexStats = idx.pStats
+	}
+	idx.reindexRest = notifications
+	err = idx.connectReindexed()
+	if err != nil {
+		// The utreexo state is flushed at the last connected block so
+		// that the index resumes from there on restart.
+		flushErr := idx.FlushUtreexoState()
+		if flushErr != nil {
+			log.Warnf("Unable to flush the utreexo state of the %s: %v",
+				idx.Name(), flushErr)
+		}
+		return err
+	}
+
+	return nil
 }
 
-// fetchBlocks fetches the blocks and stxos from the given range of blocks.
-func (idx *FlatUtreexoProofIndex) fetchBlocks(start, end int32) (
-	[]*btcutil.Block, [][]blockchain.SpentTxOut, error) {
+// connectReindexed connects the blocks that a regeneration of the index left
+// to be connected again and puts back the proof statistics from before the
+// regeneration once all of them are.  Nothing is done if there aren't any.
+//
+// This function MUST be called with the snapshotMtx held.
+func (idx *FlatUtreexoProofIndex) connectReindexed() error {
+	if idx.reindexRest == nil {
+		return nil
+	}
 
-	blocks := make([]*btcutil.Block, 0, end-start)
-	allStxos := make([][]blockchain.SpentTxOut, 0, end-start)
-	for i := start; i < end; i++ {
-		block, err := idx.chain.BlockByHeight(i)
+	for len(idx.reindexRest) > 0 {
+		n := idx.reindexRest[0]
+		err := idx.connectBlock(n)
 		if err != nil {
-			return nil, nil, err
+			return fmt.Errorf("cannot connect block %d again while "+
+				"regenerating the %s: %v", n.Height, idx.Name(),
+				err)
 		}
-		blocks = append(blocks, block)
+		idx.reindexRest = idx.reindexRest[1:]
+	}
+	idx.reindexRest = nil
+	idx.pStats = idx.reindexStats
+
+	return idx.pStats.WritePStats(&idx.proofStatsState)
+}
+
+// storeBlockEntries stores the undo block and the proof statistics for the
+// given block, along with the multi-block proof if the block ends a proof
+// generation interval.  The proofs of the other blocks are stored on their own.
+func (idx *FlatUtreexoProofIndex) storeBlockEntries(n *BlockNotification,
+	dels []wire.LeafData, ud *wire.UData,
+	undoBlock *accumulator.UndoBlock, multiBlock bool) error {
 
-		stxos, err := idx.chain.FetchSpendJournalUnsafe(block)
+	block := n.Block
+
+	idx.pStats.UpdateTotalDelCount(uint64(len(dels)))
+	idx.pStats.UpdateUDStats(false, ud)
+
+	err := idx.storeUndoBlock(block.Height(), *undoBlock)
+	if err != nil {
+		return err
+	}
+
+	// Every proof generation interval, we'll make a multi-block proof.
+	// The proofs of the other blocks were already stored.
+	if multiBlock {
+		idx.mtx.Lock()
+		err = idx.makeMultiBlockProof(n, ud)
+		idx.mtx.Unlock()
 		if err != nil {
-			return nil, nil, err
+			return err
 		}
+	}
+
+	idx.pStats.BlockHeight = uint64(block.Height())
+	return idx.pStats.WritePStats(&idx.proofStatsState)
+}
 
-		allStxos = append(allStxos, stxos)
+// classedFlatFiles returns the flat files of the index along with the class of
+// the artifacts they keep.
+func (idx *FlatUtreexoProofIndex) classedFlatFiles() []classedFlatFile {
+	return []classedFlatFile{
+		{&idx.proofState, ArtifactProofs},
+		{&idx.undoState, ArtifactUndo},
+		{&idx.rememberIdxState, ArtifactProofs},
+		{&idx.proofStatsState, ArtifactProofStats},
 	}
+}
+
+// syncFlatFiles commits the contents of the flat files written for the block at
+// the given height to disk.  The flat files of the artifact classes that the
+// fsync policy relaxes are only committed every relaxedSyncInterval blocks.
+func (idx *FlatUtreexoProofIndex) syncFlatFiles(height int32) error {
+	for _, cf := range idx.classedFlatFiles() {
+		if !idx.fsync.syncNow(cf.class, height) {
+			continue
+		}
 
-	return blocks, allStxos, nil
+		err := cf.ff.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// deletionsToProve returns all the deletions that need to be proven from the given
-// blocks and stxos.
-func (idx *FlatUtreexoProofIndex) deletionsToProve(blocks []*btcutil.Block,
-	stxos [][]blockchain.SpentTxOut) ([]wire.LeafData, [][]uint32, error) {
+// syncRelaxedFlatFiles commits the contents of the flat files of the artifact
+// classes that the fsync policy relaxes to disk.  It's called before the utreexo
+// state is flushed so that everything the flushed state depends on is on disk.
+func (idx *FlatUtreexoProofIndex) syncRelaxedFlatFiles() error {
+	for _, cf := range idx.classedFlatFiles() {
+		if idx.fsync.Mode(cf.class) == SyncStrict {
+			continue
+		}
 
-	// Check that the length is equal to prevent index errors in the below loop.
-	if len(blocks) != len(stxos) {
-		err := fmt.Errorf("Got %d blocks but %d stxos", len(blocks), len(stxos))
-		return nil, nil, err
+		err := cf.ff.Sync()
+		if err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+// flatFileWrites returns the writes done to the proof and the undo flat files
+// and the writes done to every flat file of the index.
+func (idx *FlatUtreexoProofIndex) flatFileWrites() (flatFileWrites, flatFileWrites) {
+	stored := idx.proofState.writeCounts()
+	stored.add(idx.undoState.writeCounts())
+
+	all := stored
+	all.add(idx.rememberIdxState.writeCounts())
+	all.add(idx.proofStatsState.writeCounts())
+
+	return stored, all
+}
+
+// setShadow sets whether the index is run as the shadow of another index.
+//
+// This is part of the shadowIndexer interface.
+func (idx *FlatUtreexoProofIndex) setShadow(shadow bool) {
+	idx.writeStats.setShadow(shadow)
+}
+
+// Stats returns the bytes written to the flat files to connect blocks since the
+// index was started along with the reads from them that didn't return
+// everything right away.  The counts are exact.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) Stats() IndexWriteStats {
+	stats := idx.writeStats.snapshot()
+	stats.Network = idx.chainParams.Name
+	stats.FsyncPolicy = idx.fsync.String()
+	stats.RecordedFsyncPolicy = idx.recordedFsync
+
+	var reads FlatReadStats
+	for _, cf := range idx.classedFlatFiles() {
+		reads.add(cf.ff.readCounts())
+	}
+	stats.Reads = &reads
+	stats.LeafHashing = idx.leafHasher.Stats()
+	stats.Recovery = idx.recovery.snapshot()
+	stats.MaxLeaves, stats.LeafHeadroom = idx.leafHeadroom()
+
+	return stats
+}
+
+// truncateFlatFiles deletes all the proofs, undo blocks, and remember indexes
+// that weren't stored by the blocks up to the given height.
+func (idx *FlatUtreexoProofIndex) truncateFlatFiles(height int32) error {
+	err := idx.proofState.truncate(height)
+	if err != nil {
+		return err
+	}
+	err = idx.coinAge.truncate(height)
+	if err != nil {
+		return err
+	}
+	err = idx.proofCost.truncate(height)
+	if err != nil {
+		return err
+	}
+
+	err = idx.undoState.truncate(height)
+	if err != nil {
+		return err
+	}
+	if idx.lastUndoHeight > height {
+		idx.lastUndoHeight = -1
+		idx.lastUndoBytes = nil
+	}
+	err = idx.lowerUntaggedUndoTip(height)
+	if err != nil {
+		return err
+	}
+
+	// The remember indexes for an interval are only stored once the block
+	// at the end of the interval is connected.
+	lastIntervalEnd := height - (height % idx.proofGenInterVal)
+	return idx.rememberIdxState.truncate(lastIntervalEnd - 1)
+}
+
+// calcProofOverhead calculates the overhead of the current utreexo accumulator proof
+// has.
+func calcProofOverhead(ud *wire.UData) float64 {
+	if ud == nil || len(ud.AccProof.Targets) == 0 {
+		return 0
+	}
+
+	return float64(len(ud.AccProof.Proof)) / float64(len(ud.AccProof.Targets))
+}
+
+// deletionsToProve returns all the deletions that need to be proven from the given
+// blocks.
+func (idx *FlatUtreexoProofIndex) deletionsToProve(blocks []*BlockNotification) (
+	[]wire.LeafData, [][]uint32, error) {
+
 	// createdMap will keep track of all the utxos created in the blocks that were
 	// passed in.
 	createdMap := make(map[wire.OutPoint]uint32)
@@ -269,7 +797,8 @@ func (idx *FlatUtreexoProofIndex) deletionsToProve(blocks []*btcutil.Block,
 	remembers := make([][]uint32, len(blocks))
 
 	var delsToProve []wire.LeafData
-	for i, block := range blocks {
+	for _, n := range blocks {
+		block := n.Block
 		_, _, inskip, outskip := blockchain.DedupeBlock(block)
 
 		var txOutBlockIdx uint32
@@ -290,7 +819,7 @@ func (idx *FlatUtreexoProofIndex) deletionsToProve(blocks []*btcutil.Block,
 
 		excludeAfter := block.Height() - (block.Height() % idx.proofGenInterVal)
 
-		dels, excludes, err := blockchain.BlockToDelLeaves(stxos[i], idx.chain,
+		dels, excludes, err := blockchain.BlockToDelLeaves(n.SpentTxOuts, n,
 			block, inskip, excludeAfter)
 		if err != nil {
 			return nil, nil, err
@@ -311,48 +840,62 @@ func (idx *FlatUtreexoProofIndex) deletionsToProve(blocks []*btcutil.Block,
 }
 
 // attachBlock attaches the passed in block to the utreexo accumulator state.
-func (idx *FlatUtreexoProofIndex) attachBlock(blk *btcutil.Block, stxos []blockchain.SpentTxOut) error {
-	_, outCount, inskip, outskip := blockchain.DedupeBlock(blk)
-	dels, _, err := blockchain.BlockToDelLeaves(stxos, idx.chain, blk, inskip, -1)
-	if err != nil {
-		return err
-	}
+func (idx *FlatUtreexoProofIndex) attachBlock(n *BlockNotification) error {
+	_, err := idx.attachBlockWithUndo(n)
+	return err
+}
 
-	adds := blockchain.BlockToAddLeaves(blk, outskip, nil, outCount)
-	ud, err := wire.GenerateUData(dels, idx.utreexoState.state)
+// attachBlockWithUndo attaches the passed in block to the utreexo accumulator
+// state and returns the undo block for it.
+func (idx *FlatUtreexoProofIndex) attachBlockWithUndo(n *BlockNotification) (
+	*accumulator.UndoBlock, error) {
+
+	blk := n.Block
+	_, outCount, inskip, outskip := blockchain.DedupeBlock(blk)
+	dels, _, err := blockchain.BlockToDelLeaves(n.SpentTxOuts, n, blk, inskip, -1)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = idx.utreexoState.state.Modify(adds, ud.AccProof.Targets)
+	adds := blockchain.BlockToAddLeaves(blk, outskip, nil, outCount,
+		idx.chainParams.LeafCommitments, idx.leafHasher)
+	ud, err := wire.GenerateUData(dels, idx.utreexoState.state,
+		idx.chainParams.LeafCommitments)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return idx.leafLimit.modify(idx.utreexoState, adds,
+		ud.AccProof.Targets)
 }
 
 // resyncUtreexoState fetches blocks from start to finish-1 and attaches all the fetched
-// blocks to the utreexo accumulator state.
+// blocks to the utreexo accumulator state.  The blocks are taken from the given
+// notifications when they're in them so that the chain isn't called back into
+// while a block notification is handled.
 func (idx *FlatUtreexoProofIndex) resyncUtreexoState(start, finish int32,
-	blocks []*btcutil.Block, allStxos [][]blockchain.SpentTxOut) error {
+	history []*BlockNotification) error {
+
 	for h := start; h < finish; h++ {
 		if h == 0 {
 			// nothing to do for genesis blocks.
 			continue
 		}
 
-		blk, err := idx.chain.BlockByHeight(h)
-		if err != nil {
-			return err
-		}
+		var n *BlockNotification
+		if len(history) > 0 && h >= history[0].Height &&
+			h-history[0].Height < int32(len(history)) {
 
-		stxos, err := idx.chain.FetchSpendJournalUnsafe(blk)
-		if err != nil {
-			return err
+			n = history[h-history[0].Height]
+		} else {
+			fetched, err := fetchNotifications(idx.chain, h, h+1)
+			if err != nil {
+				return err
+			}
+			n = fetched[0]
 		}
 
-		err = idx.attachBlock(blk, stxos)
+		err := idx.attachBlock(n)
 		if err != nil {
 			return err
 		}
@@ -361,22 +904,15 @@ func (idx *FlatUtreexoProofIndex) resyncUtreexoState(start, finish int32,
 	return nil
 }
 
-// reattachToUtreexoState reattaches the passed in blocks and slice of stxos slices back
-// to the utreexo accumulator state.
-func (idx *FlatUtreexoProofIndex) reattachToUtreexoState(blocks []*btcutil.Block,
-	allStxos [][]blockchain.SpentTxOut) error {
-
-	if len(blocks) != len(allStxos) {
-		return fmt.Errorf("Got %d blocks but got %d []stxos",
-			len(blocks), len(allStxos))
-	}
-
-	for i, block := range blocks {
-		if block.Height() == 0 {
+// reattachToUtreexoState reattaches the passed in blocks back to the utreexo
+// accumulator state.
+func (idx *FlatUtreexoProofIndex) reattachToUtreexoState(blocks []*BlockNotification) error {
+	for _, n := range blocks {
+		if n.Height == 0 {
 			continue
 		}
 
-		err := idx.attachBlock(block, allStxos[i])
+		err := idx.attachBlock(n)
 		if err != nil {
 			return err
 		}
@@ -386,9 +922,13 @@ func (idx *FlatUtreexoProofIndex) reattachToUtreexoState(blocks []*btcutil.Block
 }
 
 // undoUtreexoState reverses the utreexo accumulator state to the desired height.
-func (idx *FlatUtreexoProofIndex) undoUtreexoState(currentHeight, desiredHeight int32) error {
+// The blocks that are needed to restore the state on failure are taken from the
+// given notifications when they're in them.
+func (idx *FlatUtreexoProofIndex) undoUtreexoState(currentHeight, desiredHeight int32,
+	history []*BlockNotification) error {
+
 	restoreState := func(start, finish int32, prevErr error) {
-		err := idx.resyncUtreexoState(start, finish, nil, nil)
+		err := idx.resyncUtreexoState(start, finish, history)
 		if err != nil {
 			str := fmt.Errorf("undoUtreexoState: cannot restore state at %d. This likely "+
 				"is happening because of a disk correuption. The user should re-download the blocks "+
@@ -411,7 +951,7 @@ func (idx *FlatUtreexoProofIndex) undoUtreexoState(currentHeight, desiredHeight
 				h, err)
 		}
 
-		err = idx.utreexoState.state.Undo(*undoBlock)
+		err = idx.utreexoState.undo(*undoBlock)
 		if err != nil {
 			restoreState(h, currentHeight, err)
 			return err
@@ -425,44 +965,65 @@ func (idx *FlatUtreexoProofIndex) undoUtreexoState(currentHeight, desiredHeight
 // generation height and makes a proof of all the stxos in the upcoming interval.  The
 // utreexo state is caught back up to the current height after the mulit-block proof is
 // generated.
+//
+// The blocks of the interval are fetched from the chain so it must not be called while
+// the chain notifies the index.
 func (idx *FlatUtreexoProofIndex) MakeMultiBlockProof(currentHeight, proveHeight int32,
 	block *btcutil.Block, currentUD *wire.UData, stxos []blockchain.SpentTxOut) error {
 
-	idx.mtx.Lock()
-	defer idx.mtx.Unlock()
-
-	startRoots := idx.utreexoState.state.GetRoots()
-
-	// Go back to the desired block to generate the multi-block proof.
-	err := idx.undoUtreexoState(currentHeight, proveHeight)
+	n, err := newBlockNotification(idx.chain, block, stxos, true)
 	if err != nil {
 		return err
 	}
-
-	blocks, allStxos, err := idx.fetchBlocks(proveHeight, currentHeight)
+	n.History, err = fetchNotifications(idx.chain, proveHeight, currentHeight)
 	if err != nil {
 		return err
 	}
 
-	if int32(len(blocks)) != idx.proofGenInterVal {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	return idx.makeMultiBlockProof(n, currentUD)
+}
+
+// makeMultiBlockProof makes the multi-block proof for the interval that ends with the
+// block of the notification.  The blocks of the interval are taken from the history of
+// the notification.
+//
+// This function MUST be called with the index mutex held.
+func (idx *FlatUtreexoProofIndex) makeMultiBlockProof(n *BlockNotification,
+	currentUD *wire.UData) error {
+
+	if int32(len(n.History)) != idx.proofGenInterVal {
 		err := fmt.Errorf("Only fetched %d blocks but the proofGenInterVal is %d",
-			len(blocks), idx.proofGenInterVal)
+			len(n.History), idx.proofGenInterVal)
 		panic(err)
 	}
+	currentHeight := n.Height
+	proveHeight := currentHeight - idx.proofGenInterVal
+
+	startRoots := idx.utreexoState.state.GetRoots()
+
+	// Go back to the desired block to generate the multi-block proof.
+	err := idx.undoUtreexoState(currentHeight, proveHeight, n.History)
+	if err != nil {
+		return err
+	}
 
-	delsToProve, remembers, err := idx.deletionsToProve(blocks, allStxos)
+	delsToProve, remembers, err := idx.deletionsToProve(n.History)
 	if err != nil {
 		return err
 	}
 
-	ud, err := wire.GenerateUData(delsToProve, idx.utreexoState.state)
+	ud, err := wire.GenerateUData(delsToProve, idx.utreexoState.state,
+		idx.chainParams.LeafCommitments)
 	if err != nil {
 		panic(err)
 	}
 
 	delHashes := make([]accumulator.Hash, 0, len(delsToProve))
 	for _, del := range delsToProve {
-		delHashes = append(delHashes, del.LeafHash())
+		delHashes = append(delHashes, del.ScheduledLeafHash(idx.chainParams.LeafCommitments))
 	}
 
 	// Store the proof that we have created.
@@ -478,13 +1039,13 @@ func (idx *FlatUtreexoProofIndex) MakeMultiBlockProof(currentHeight, proveHeight
 	}
 
 	// Re-sync all the reorged blocks.
-	err = idx.reattachToUtreexoState(blocks, allStxos)
+	err = idx.reattachToUtreexoState(n.History)
 	if err != nil {
 		return err
 	}
 
 	// Attach the current block.
-	err = idx.attachBlock(block, stxos)
+	err = idx.attachBlock(n)
 	if err != nil {
 		return err
 	}
@@ -506,8 +1067,16 @@ func (idx *FlatUtreexoProofIndex) MakeMultiBlockProof(currentHeight, proveHeight
 // disconnected to the main chain.
 //
 // This is part of the Indexer interface.
-func (idx *FlatUtreexoProofIndex) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
+func (idx *FlatUtreexoProofIndex) DisconnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	block := n.Block
+
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	err := idx.connectReindexed()
+	if err != nil {
+		return err
+	}
 
 	undoBlock, err := idx.fetchUndoBlock(block.Height())
 	if err != nil {
@@ -515,35 +1084,128 @@ func (idx *FlatUtreexoProofIndex) DisconnectBlock(dbTx database.Tx, block *btcut
 	}
 
 	idx.mtx.Lock()
-	err = idx.utreexoState.state.Undo(*undoBlock)
+	err = idx.utreexoState.undo(*undoBlock)
 	idx.mtx.Unlock()
 	if err != nil {
 		return err
 	}
+	idx.mtx.RLock()
+	idx.rowGrowth.disconnected(idx.utreexoState)
+	idx.mtx.RUnlock()
+
+	err = idx.removeUndoBlock(block.Height())
+	if err != nil {
+		return err
+	}
 
-	// Check if we're at a height where proof was generated.
-	if (block.Height() % idx.proofGenInterVal) == 0 {
-		height := block.Height() / idx.proofGenInterVal
-		err = idx.proofState.DisconnectBlock(height)
+	// A proof is stored for every block and the remember indexes of an
+	// interval are stored with the block at its end.  Remove what was
+	// stored for the block.
+	err = idx.truncateFlatFiles(block.Height() - 1)
+	if err != nil {
+		return err
+	}
+	err = dbDeleteLeafEligibility(dbTx, idx.Key(), block.Hash())
+	if err != nil {
+		return err
+	}
+	if idx.undoAssert != nil {
+		fp, err := idx.fingerprint(block.Height())
+		if err != nil {
+			return err
+		}
+		err = idx.undoAssert.check(block, fp)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = idx.undoState.DisconnectBlock(block.Height())
-	if err != nil {
-		return err
+	// The utreexo state on disk is of a block that's no longer in the main
+	// chain so nothing is durable until the state is flushed again.
+	if atomic.LoadInt32(&idx.durableHeight) >= block.Height() {
+		atomic.StoreInt32(&idx.durableHeight, -1)
 	}
+	idx.leases.invalidateFrom(block.Height())
+	idx.publishReplication(block, true)
 
 	return nil
 }
 
+// DurableHeight returns the height that the utreexo state was last flushed to
+// disk at.  It's -1 if the flushed state isn't of a block in the main chain.
+//
+// This is part of the FlushAligner interface.
+func (idx *FlatUtreexoProofIndex) DurableHeight() int32 {
+	return atomic.LoadInt32(&idx.durableHeight)
+}
+
+// rollbackToDurable rolls the utreexo state back from the given tip to the
+// height it was last flushed at with the stored undo blocks and makes the index
+// refuse to serve the blocks above that height.
+//
+// This is part of the degradable interface.
+func (idx *FlatUtreexoProofIndex) rollbackToDurable(tip int32, cause error) (int32, error) {
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	// Refuse the blocks above the durable height before rolling back so
+	// that nothing is served from the state while it's rolled back.
+	durable := idx.DurableHeight()
+	gateErr := &DegradedError{
+		Index:         idx.Name(),
+		DurableHeight: durable,
+		Cause:         cause,
+	}
+	idx.degraded.set(gateErr)
+	if durable < 0 {
+		return -1, fmt.Errorf("the flushed utreexo state isn't of a " +
+			"block in the main chain")
+	}
+	if durable >= tip {
+		return durable, nil
+	}
+
+	idx.mtx.Lock()
+	err := idx.undoUtreexoState(tip, durable+1, nil)
+	idx.mtx.Unlock()
+	if err != nil {
+		idx.degraded.set(&DegradedError{
+			Index:         idx.Name(),
+			DurableHeight: -1,
+			Cause:         cause,
+		})
+		return -1, err
+	}
+
+	return durable, nil
+}
+
+// SetStateFlushInterval sets how often in blocks the utreexo state is flushed to
+// disk.  0 means that the state is only flushed on shutdown.
+func (idx *FlatUtreexoProofIndex) SetStateFlushInterval(interval int32) {
+	idx.stateFlushInterval = interval
+}
+
 // FetchUtreexoProof returns the Utreexo proof data for the given block height.
+// The proof data for the genesis block is always empty as it doesn't modify the
+// accumulator.  A RebuildingError is returned while the index is being rebuilt
+// and an UnservableHeightError is returned for a height that's missing its
+// proof.
 func (idx *FlatUtreexoProofIndex) FetchUtreexoProof(height int32, excludeAccProof bool) (
 	*wire.UData, error) {
 
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	if err := idx.degraded.check(height); err != nil {
+		return nil, err
+	}
+	if err := idx.checkServable(height); err != nil {
+		return nil, err
+	}
+
 	if height == 0 {
-		return nil, fmt.Errorf("No Utreexo Proof for height %d", height)
+		return blockchain.GenesisUData(), nil
 	}
 
 	proofBytes, err := idx.proofState.FetchData(height)
@@ -553,16 +1215,93 @@ func (idx *FlatUtreexoProofIndex) FetchUtreexoProof(height int32, excludeAccProo
 	if proofBytes == nil {
 		return nil, fmt.Errorf("Couldn't fetch Utreexo proof for height %d", height)
 	}
+
+	return deserializeFlatProof(proofBytes, excludeAccProof)
+}
+
+// FetchUtreexoProofBatch returns the utreexo proofs for the blocks from start
+// to end inclusive, in height order.  The proofs are read with a single
+// sequential read of the flat files and deserialized the same as with
+// FetchUtreexoProof, so they're the same as the ones it returns one at a time.
+// An error is returned if the range isn't within the index tip or if the proof
+// of any height in it isn't served.  A RebuildingError is returned while the
+// index is being rebuilt.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) FetchUtreexoProofBatch(start, end int32) (
+	[]*wire.UData, error) {
+
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+
+	return fetchFlatProofBatch(&idx.proofState, start, end,
+		func(height int32) error {
+			if err := idx.degraded.check(height); err != nil {
+				return err
+			}
+			return idx.checkServable(height)
+		})
+}
+
+// fetchFlatProofBatch returns the utreexo proofs stored in the proof flat file
+// for the blocks from start to end inclusive, in height order.  check is called
+// for every height before anything is read and its error is returned as is.
+func fetchFlatProofBatch(proofState *FlatFileState, start, end int32,
+	check func(int32) error) ([]*wire.UData, error) {
+
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid utreexo proof range from height "+
+			"%d to %d", start, end)
+	}
+	tip := proofState.BestHeight()
+	if end > tip {
+		return nil, fmt.Errorf("utreexo proof range from height %d to "+
+			"%d is beyond the index tip at height %d", start, end, tip)
+	}
+	for height := start; height <= end; height++ {
+		if err := check(height); err != nil {
+			return nil, err
+		}
+	}
+
+	uds := make([]*wire.UData, 0, end-start+1)
+	if start == 0 {
+		uds = append(uds, blockchain.GenesisUData())
+		if end == 0 {
+			return uds, nil
+		}
+		start = 1
+	}
+
+	proofs, err := proofState.FetchDataRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, proofBytes := range proofs {
+		ud, err := deserializeFlatProof(proofBytes, false)
+		if err != nil {
+			return nil, err
+		}
+		uds = append(uds, ud)
+	}
+
+	return uds, nil
+}
+
+// deserializeFlatProof deserializes the utreexo data stored in the proof flat
+// file.  excludeAccProof is whether it was stored without the accumulator proof.
+func deserializeFlatProof(proofBytes []byte, excludeAccProof bool) (*wire.UData, error) {
 	r := bytes.NewReader(proofBytes)
 
 	ud := new(wire.UData)
 	if excludeAccProof {
-		err = ud.DeserializeCompactNoAccProof(r)
+		err := ud.DeserializeCompactNoAccProof(r)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		err = ud.DeserializeCompact(r, udataSerializeBool, 0)
+		err := ud.DeserializeCompact(r, udataSerializeBool, 0)
 		if err != nil {
 			return nil, err
 		}
@@ -573,10 +1312,38 @@ func (idx *FlatUtreexoProofIndex) FetchUtreexoProof(height int32, excludeAccProo
 
 // FetchMultiUtreexoProof fetches the utreexo data, multi-block proof, and the hashes for
 // the given height.  Attempting to fetch multi-block proof at a height where there weren't
-// any mulit-block proof generated will result in an error.
+// any mulit-block proof generated will result in an error.  A RebuildingError
+// is returned while the index is being rebuilt.
+//
+// Deprecated: Use FetchMultiBlockProof instead.
 func (idx *FlatUtreexoProofIndex) FetchMultiUtreexoProof(height int32) (
 	*wire.UData, *wire.UData, []accumulator.Hash, error) {
 
+	ud, multiUd, dels, err := idx.FetchMultiBlockProof(height)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return ud, multiUd, AccumulatorHashes(dels), nil
+}
+
+// FetchMultiBlockProof fetches the utreexo data, multi-block proof, and the
+// hashes for the given height.  Attempting to fetch multi-block proof at a
+// height where there weren't any mulit-block proof generated will result in an
+// error.  A RebuildingError is returned while the index is being rebuilt.
+func (idx *FlatUtreexoProofIndex) FetchMultiBlockProof(height int32) (
+	*wire.UData, *wire.UData, []AccHash, error) {
+
+	if err := idx.gate.check(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := idx.degraded.check(height); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := idx.checkServable(height); err != nil {
+		return nil, nil, nil, err
+	}
+
 	if height == 0 {
 		return nil, nil, nil, fmt.Errorf("No Utreexo Proof for height %d", height)
 	}
@@ -618,7 +1385,7 @@ func (idx *FlatUtreexoProofIndex) FetchMultiUtreexoProof(height int32) (
 		return nil, nil, nil, err
 	}
 	count := binary.LittleEndian.Uint32(buf)
-	dels := make([]accumulator.Hash, count)
+	dels := make([]AccHash, count)
 	for i := range dels {
 		_, err = r.Read(dels[i][:])
 		if err != nil {
@@ -629,8 +1396,41 @@ func (idx *FlatUtreexoProofIndex) FetchMultiUtreexoProof(height int32) (
 	return ud, multiUd, dels, nil
 }
 
+// FetchIntervalProof fetches the multi-block proof of the interval that starts
+// at the given height along with the hashes of the leaves it proves.  The proof
+// proves every leaf spent in the blocks from baseHeight up to but not including
+// baseHeight plus the proof generation interval, except for the ones created
+// within the interval, against the accumulator right before the interval.  It's
+// stored with the block that ends the interval so it's only there once that
+// block is connected and it's gone once that block is disconnected.
+func (idx *FlatUtreexoProofIndex) FetchIntervalProof(baseHeight int32) (
+	*wire.UData, []AccHash, error) {
+
+	if baseHeight%idx.proofGenInterVal != 0 {
+		return nil, nil, fmt.Errorf("height %d doesn't start a proof "+
+			"generation interval of %d blocks", baseHeight,
+			idx.proofGenInterVal)
+	}
+
+	_, multiUd, dels, err := idx.FetchMultiBlockProof(baseHeight + idx.proofGenInterVal)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return multiUd, dels, nil
+}
+
 // FetchRemembers fetches the remember indexes of the desired block height.
+// There are no remember indexes for the genesis block.  ErrLeafTTLDisabled is
+// returned if the index is built without the leaf time to live data.
 func (idx *FlatUtreexoProofIndex) FetchRemembers(height int32) ([]uint32, error) {
+	if idx.noLeafTTL {
+		return nil, ErrLeafTTLDisabled
+	}
+	if height == 0 {
+		return nil, nil
+	}
+
 	// Fetch the raw bytes.
 	rememberBytes, err := idx.rememberIdxState.FetchData(height)
 	if err != nil {
@@ -720,20 +1520,15 @@ func (idx *FlatUtreexoProofIndex) storeMultiBlockProof(height int32, ud, multiUd
 	return nil
 }
 
-// storeUndoBlock serializes and stores undo blocks in the undo state.
+// storeUndoBlock serializes and stores undo blocks in the undo state.  They're
+// tagged with the accumulator serialization version.
 func (idx *FlatUtreexoProofIndex) storeUndoBlock(height int32, undoBlock accumulator.UndoBlock) error {
-	undoBuf := bytes.NewBuffer(make([]byte, 0, undoBlock.SerializeSize()))
-	err := undoBlock.Serialize(undoBuf)
+	undoBytes, err := serializeUndoBlock(&undoBlock)
 	if err != nil {
 		return err
 	}
 
-	err = idx.undoState.StoreData(height, undoBuf.Bytes())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return idx.storeUndoBytes(height, undoBytes)
 }
 
 // storeRemembers serializes and stores the remember indexes in the remember index state.
@@ -761,39 +1556,40 @@ func (idx *FlatUtreexoProofIndex) storeRemembers(remembers [][]uint32, startHeig
 	return nil
 }
 
-// fetchUndoBlock returns the undoblock for the given block height.
+// fetchUndoBlock returns the undoblock for the given block height.  The undo
+// block for the genesis block is always empty as it doesn't modify the
+// accumulator.
 func (idx *FlatUtreexoProofIndex) fetchUndoBlock(height int32) (*accumulator.UndoBlock, error) {
 	if height == 0 {
-		return nil, fmt.Errorf("No Undo Block for height %d", height)
+		return &accumulator.UndoBlock{}, nil
 	}
-
-	undoBytes, err := idx.undoState.FetchData(height)
+	err := idx.checkUndoPruned(height)
 	if err != nil {
 		return nil, err
 	}
-	r := bytes.NewReader(undoBytes)
 
-	undoBlock := new(accumulator.UndoBlock)
-	err = undoBlock.Deserialize(r)
+	undoBytes, err := idx.fetchUndoBytes(height)
 	if err != nil {
 		return nil, err
 	}
 
-	return undoBlock, nil
+	return idx.decodeUndoRecord(height, undoBytes)
 }
 
 // GenerateUData generates utreexo data for the dels passed in.  Height passed in
 // should either be of block height of where the deletions are happening or just
 // the lastest block height for mempool tx proof generation.
+//
+// If a proof generation budget is set, the request is rejected with
+// ErrProofGenBudgetExceeded when the budget doesn't have room for it.
 func (idx *FlatUtreexoProofIndex) GenerateUData(dels []wire.LeafData) (*wire.UData, error) {
-	idx.mtx.RLock()
-	ud, err := wire.GenerateUData(dels, idx.utreexoState.state)
-	idx.mtx.RUnlock()
-	if err != nil {
-		return nil, err
-	}
+	return generateBudgetedUData(idx.proofGenBudget, idx.mtx, idx.utreexoState, dels)
+}
 
-	return ud, nil
+// SetProofGenBudget sets the memory budget that proof generation requests
+// made through GenerateUData must be admitted into.
+func (idx *FlatUtreexoProofIndex) SetProofGenBudget(budget *ProofGenBudget) {
+	idx.proofGenBudget = budget
 }
 
 // ProveUtxos returns an accumulator proof of the outpoints passed in with
@@ -807,6 +1603,52 @@ func (idx *FlatUtreexoProofIndex) GenerateUData(dels []wire.LeafData) (*wire.UDa
 func (idx *FlatUtreexoProofIndex) ProveUtxos(utxos []*blockchain.UtxoEntry,
 	outpoints *[]wire.OutPoint) (*blockchain.ChainTipProof, error) {
 
+	// A degraded index no longer has the utreexo state of the tip.
+	if err := idx.degraded.check(idx.chain.BestSnapshot().Height); err != nil {
+		return nil, err
+	}
+
+	hashes, err := idx.utxosToLeafHashes(utxos, outpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	// Admit the request into the proof generation budget.
+	release, err := acquireProveBudget(idx.proofGenBudget, idx.mtx,
+		idx.utreexoState, len(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Get a read lock for the index.  This will prevent connectBlock from updating
+	// the beststate snapshot and the utreexo state.
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	accProof, err := idx.utreexoState.state.ProveBatch(hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Grab the height and the blockhash the proof was generated at.
+	snapshot := idx.chain.BestSnapshot()
+	provedAtHash := snapshot.Hash
+
+	proof := &blockchain.ChainTipProof{
+		ProvedAtHash: &provedAtHash,
+		AccProof:     &accProof,
+		HashesProven: hashes,
+	}
+
+	return proof, nil
+}
+
+// utxosToLeafHashes returns the hashes committed in the accumulator for the
+// passed in utxos and their outpoints.
+func (idx *FlatUtreexoProofIndex) utxosToLeafHashes(utxos []*blockchain.UtxoEntry,
+	outpoints *[]wire.OutPoint) ([]accumulator.Hash, error) {
+
 	// We'll turn the entries and outpoints into leaves that go in
 	// the accumulator.
 	leaves := make([]wire.LeafData, 0, len(utxos))
@@ -842,42 +1684,33 @@ func (idx *FlatUtreexoProofIndex) ProveUtxos(utxos []*blockchain.UtxoEntry,
 	// commited in the accumulator.
 	hashes := make([]accumulator.Hash, 0, len(leaves))
 	for _, leaf := range leaves {
-		hashes = append(hashes, leaf.LeafHash())
+		hashes = append(hashes, leaf.ScheduledLeafHash(idx.chainParams.LeafCommitments))
 	}
 
-	// Get a read lock for the index.  This will prevent connectBlock from updating
-	// the beststate snapshot and the utreexo state.
-	idx.mtx.RLock()
-	defer idx.mtx.RUnlock()
-
-	accProof, err := idx.utreexoState.state.ProveBatch(hashes)
-	if err != nil {
-		return nil, err
-	}
-
-	// Grab the height and the blockhash the proof was generated at.
-	snapshot := idx.chain.BestSnapshot()
-	provedAtHash := snapshot.Hash
-
-	proof := &blockchain.ChainTipProof{
-		ProvedAtHash: &provedAtHash,
-		AccProof:     &accProof,
-		HashesProven: hashes,
-	}
+	return hashes, nil
+}
 
-	return proof, nil
+// VerifyBatchProof verifies the given accumulator proof.  Returns an error if
+// the verification failed.
+func (idx *FlatUtreexoProofIndex) VerifyBatchProof(toProve []AccHash,
+	proof *BatchProof) error {
+	return idx.utreexoState.state.VerifyBatchProof(
+		AccumulatorHashes(toProve), *proof.AccumulatorBatchProof())
 }
 
 // VerifyAccProof verifies the given accumulator proof.  Returns an error if the
 // verification failed.
+//
+// Deprecated: Use VerifyBatchProof instead.
 func (idx *FlatUtreexoProofIndex) VerifyAccProof(toProve []accumulator.Hash,
 	proof *accumulator.BatchProof) error {
-	return idx.utreexoState.state.VerifyBatchProof(toProve, *proof)
+	return idx.VerifyBatchProof(NewAccHashes(toProve), NewBatchProof(proof))
 }
 
 // SetChain sets the given chain as the chain to be used for blockhash fetching.
 func (idx *FlatUtreexoProofIndex) SetChain(chain *blockchain.BlockChain) {
 	idx.chain = chain
+	idx.leafHasher = chain.LeafHasher()
 }
 
 // flatFilePath returns the path to the flatfile.
@@ -907,8 +1740,20 @@ func loadFlatFileState(dataDir, name string) (*FlatFileState, error) {
 // It implements the Indexer interface which plugs into the IndexManager that in
 // turn is used by the blockchain package.  This allows the index to be
 // seamlessly maintained along with the chain.
+//
+// The undo blocks are delta-encoded with a full undo block stored every
+// undoSnapshotInterval blocks.  An undoSnapshotInterval of 0 stores every undo
+// block whole.  It can't be changed between 0 and non-zero values for an
+// existing index.
+//
+// The index is built without the leaf time to live data that's only used for
+// analytics if noLeafTTL is set.  The coin age statistics aren't stored then
+// while the proofs are served as usual.  The remember indexes are needed to
+// sync from the multi-block proofs so it's only allowed with a proof interval
+// of 1, which stores none.  It can't be changed for an existing index.
 func NewFlatUtreexoProofIndex(dataDir string, chainParams *chaincfg.Params,
-	proofGenInterVal *int32) (*FlatUtreexoProofIndex, error) {
+	proofGenInterVal *int32, undoSnapshotInterval int32,
+	noLeafTTL bool) (*FlatUtreexoProofIndex, error) {
 
 	// If the proofGenInterVal argument is nil, use the default value.
 	var intervalToUse int32
@@ -917,11 +1762,41 @@ func NewFlatUtreexoProofIndex(dataDir string, chainParams *chaincfg.Params,
 	} else {
 		intervalToUse = defaultProofGenInterval
 	}
+	if noLeafTTL && intervalToUse != 1 {
+		return nil, fmt.Errorf("the flat utreexo proof index can only be "+
+			"built without the leaf time to live data with a proof "+
+			"interval of 1, not %d", intervalToUse)
+	}
 
+	leases := NewLeaseManager()
 	idx := &FlatUtreexoProofIndex{
-		proofGenInterVal: intervalToUse,
-		chainParams:      chainParams,
-		mtx:              new(sync.RWMutex),
+		proofGenInterVal:     intervalToUse,
+		dataDir:              dataDir,
+		chainParams:          chainParams,
+		leafHasher:           blockchain.NewLeafHasher(chainParams),
+		mtx:                  new(sync.RWMutex),
+		leases:               leases,
+		sessions:             newProofSessions(leases, defaultProofSessionTTL),
+		undoSnapshotInterval: undoSnapshotInterval,
+		lastUndoHeight:       -1,
+		noLeafTTL:            noLeafTTL,
+		collisions: leafCollisionChecker{
+			sampleRate: defaultLeafCollisionSampleRate,
+		},
+	}
+
+	// Refuse to open the index if any of the flat files was written with
+	// format features that this version doesn't know of.  This is done
+	// for all of them before anything is written so that a downgrade
+	// doesn't leave some of them modified.
+	for _, name := range []string{flatUtreexoProofName,
+		undoEncodingName(undoSnapshotInterval), flatRememberIdxName,
+		flatUtreexoProofStatsName} {
+
+		err := DowngradeCheck(flatFilePath(dataDir, name))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Init Utreexo State.
@@ -929,13 +1804,15 @@ func NewFlatUtreexoProofIndex(dataDir string, chainParams *chaincfg.Params,
 		DataDir: dataDir,
 		Name:    flatUtreexoProofIndexType,
 		// Default to ram for now.
-		Type:   accumulator.RamForest,
+		Type:   RamForest,
 		Params: chainParams,
 	})
 	if err != nil {
 		return nil, err
 	}
 	idx.utreexoState = uState
+	idx.rowGrowth = newRowGrowth(idx.Name(), uState)
+	idx.leafLimit = newLeafLimit(idx.Name(), uState)
 
 	// Init the utreexo proof state.
 	proofState, err := loadFlatFileState(dataDir, flatUtreexoProofName)
@@ -943,13 +1820,47 @@ func NewFlatUtreexoProofIndex(dataDir string, chainParams *chaincfg.Params,
 		return nil, err
 	}
 	idx.proofState = *proofState
+	err = checkNetworkFile(flatFilePath(dataDir, flatUtreexoProofName),
+		chainParams.Net, true)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFlatIndexFormat(flatFilePath(dataDir, flatUtreexoProofName),
+		noLeafTTL, proofState.BestHeight() > 0)
+	if err != nil {
+		return nil, err
+	}
+	idx.complete, err = loadCompleteness(filepath.Join(
+		flatFilePath(dataDir, flatUtreexoProofName), completenessFileName))
+	if err != nil {
+		return nil, err
+	}
+	idx.pins, err = loadProofPins(filepath.Join(
+		flatFilePath(dataDir, flatUtreexoProofName), proofPinsFileName))
+	if err != nil {
+		return nil, err
+	}
+	idx.coinAge = newCoinAgeCache(filepath.Join(
+		flatFilePath(dataDir, flatUtreexoProofName), coinAgeStatsFileName))
+	idx.proofCost = newProofCostCache(filepath.Join(
+		flatFilePath(dataDir, flatUtreexoProofName), proofCostFileName))
 
 	// Init the undo block state.
-	undoState, err := loadFlatFileState(dataDir, flatUtreexoUndoName)
+	err = checkUndoEncoding(dataDir, undoSnapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+	undoState, err := loadFlatFileState(dataDir,
+		undoEncodingName(undoSnapshotInterval))
 	if err != nil {
 		return nil, err
 	}
 	idx.undoState = *undoState
+	idx.untaggedUndoTip, err = readUntaggedUndoTip(flatFilePath(dataDir,
+		undoEncodingName(undoSnapshotInterval)), undoState.BestHeight())
+	if err != nil {
+		return nil, err
+	}
 
 	// Init the remember idx state.
 	rememberIdxState, err := loadFlatFileState(dataDir, flatRememberIdxName)
@@ -969,41 +1880,65 @@ func NewFlatUtreexoProofIndex(dataDir string, chainParams *chaincfg.Params,
 		return nil, err
 	}
 
+	// The disk space of the pruned entries is freed again in case the
+	// index stopped after the pruned heights were persisted but before
+	// it was.
+	pruned, err := readPrunedHeights(idx.prunedPath())
+	if err != nil {
+		return nil, err
+	}
+	idx.prune.set(pruned)
+	err = idx.punchPruned(pruneHeights{}, pruned)
+	if err != nil {
+		return nil, err
+	}
+
+	// The utreexo state that was just loaded is the one that was flushed
+	// at the recorded height.  It's taken to be the one of the stored
+	// proofs if none was recorded.
+	idx.loadedStateHeight, err = readForestHeight(utreexoBasePath(uState.config))
+	if err != nil {
+		return nil, err
+	}
+	idx.durableHeight = idx.loadedStateHeight
+	if idx.durableHeight < 0 {
+		idx.durableHeight = idx.proofState.BestHeight()
+	}
+
 	return idx, nil
 }
 
-// DropFlatUtreexoProofIndex drops the address index from the provided database if it
-// exists.
+// DropFlatUtreexoProofIndex drops the flat utreexo proof index from the provided
+// database and deletes its flat files and utreexo state from the data
+// directory.  It's meant to be called while the index isn't loaded.  A
+// FlatIndexIncompleteError is returned once the index is dropped if some of
+// what it was created with was already missing.
 func DropFlatUtreexoProofIndex(db database.DB, dataDir string, interrupt <-chan struct{}) error {
-	err := dropIndex(db, flatUtreexoBucketKey, flatUtreexoProofIndexName, interrupt)
+	// The utreexo proof index may keep its undo blocks in the index.
+	err := db.View(checkSharedUndoDrop)
 	if err != nil {
 		return err
 	}
 
-	proofPath := flatFilePath(dataDir, flatUtreexoProofName)
-	err = deleteFlatFile(proofPath)
+	missing, err := markFlatIndexDrop(db, dataDir)
 	if err != nil {
 		return err
 	}
 
-	undoPath := flatFilePath(dataDir, flatUtreexoUndoName)
-	err = deleteFlatFile(undoPath)
+	// The files are deleted before the entries in the database so that
+	// the index can't be created again over what's left of them.
+	err = deleteFlatIndexDirs(dataDir)
 	if err != nil {
 		return err
 	}
 
-	rememberIdxPath := flatFilePath(dataDir, flatRememberIdxName)
-	err = deleteFlatFile(rememberIdxPath)
+	err = dropIndex(db, flatUtreexoBucketKey, flatUtreexoProofIndexName, nil, interrupt)
 	if err != nil {
 		return err
 	}
 
-	proofStatsPath := flatFilePath(dataDir, flatUtreexoProofStatsName)
-	err = deleteFlatFile(proofStatsPath)
-	if err != nil {
-		return err
+	if len(missing) > 0 {
+		return &FlatIndexIncompleteError{Missing: missing}
 	}
-
-	path := utreexoBasePath(&UtreexoConfig{DataDir: dataDir, Name: flatUtreexoProofIndexType})
-	return deleteUtreexoState(path)
+	return nil
 }
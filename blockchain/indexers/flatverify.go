@@ -0,0 +1,100 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+)
+
+// verifyEntries reads the entries stored for the heights from start to end
+// inclusive one at a time and checks each of them against its offset record.
+// It returns a CorruptEntryError for the first entry that doesn't match.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) verifyEntries(start, end int32) error {
+	if start < 1 {
+		start = 1
+	}
+	for height := start; height <= end; height++ {
+		_, err := ff.FetchData(height)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifyAll reads every entry of the flat files of the index that wasn't
+// pruned and checks it against the checksum and the size of its offset record.
+// A CorruptEntryError is returned for the corrupt entry with the lowest height
+// out of all the flat files, which is the height that the index has to be
+// reindexed from.  Errors other than corrupt entries, like reads that keep
+// coming up short, are returned right away.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) VerifyAll() error {
+	// Connecting, disconnecting, and pruning blocks are held off so that
+	// the entries don't change while they're read.
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	pruned := idx.prune.heights()
+	var first *CorruptEntryError
+	for _, cf := range idx.classedFlatFiles() {
+		start := int32(1)
+		switch cf.ff {
+		case &idx.proofState, &idx.rememberIdxState:
+			start = pruned.proofs + 1
+		case &idx.undoState:
+			start = pruned.undo + 1
+		}
+
+		// Only the entries below the corrupt one found so far are
+		// worth reading.
+		end := cf.ff.BestHeight()
+		if first != nil && first.Height-1 < end {
+			end = first.Height - 1
+		}
+
+		err := cf.ff.verifyEntries(start, end)
+		var corruptErr *CorruptEntryError
+		if errors.As(err, &corruptErr) {
+			first = corruptErr
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if first != nil {
+		return first
+	}
+
+	return nil
+}
+
+// SetVerifyOnInit sets whether every entry of the flat files is checked with
+// VerifyAll when the index is initialized.  The index refuses to start with a
+// corrupt entry.
+func (idx *FlatUtreexoProofIndex) SetVerifyOnInit(verify bool) {
+	idx.verifyOnInit = verify
+}
+
+// verifyFlatFiles checks every entry of the flat files when the index is
+// initialized.  The error for a corrupt entry tells the height that the index
+// has to be reindexed from.
+func (idx *FlatUtreexoProofIndex) verifyFlatFiles() error {
+	log.Infof("Verifying the flat files of the %s", idx.Name())
+	err := idx.VerifyAll()
+	var corruptErr *CorruptEntryError
+	if errors.As(err, &corruptErr) {
+		return fmt.Errorf("%w. The %s has to be reindexed from height %d",
+			err, idx.Name(), corruptErr.Height)
+	}
+
+	return err
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+)
+
+// flipEntryByte flips a byte of the data of the entry stored for the given
+// height.
+func flipEntryByte(t *testing.T, ff *FlatFileState, height int32) {
+	t.Helper()
+
+	offset := ff.offsets[height] + 8 + int64(ff.lengths[height])/2
+	var b [1]byte
+	_, err := ff.dataFile.ReadAt(b[:], offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	_, err = ff.dataFile.WriteAt(b[:], offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFlatVerifyAll ensures that VerifyAll reports the corrupt entry with the
+// lowest height out of all the flat files of the index, that the fetches of a
+// corrupt entry fail, and that the index refuses to start with a corrupt entry
+// when it's verified on start up.
+func TestFlatVerifyAll(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestFlatVerifyAll", 1)
+	defer tearDown()
+	idx := indexes[1].(*FlatUtreexoProofIndex)
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 15; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	err := idx.VerifyAll()
+	if err != nil {
+		t.Fatalf("expected the flat files to verify, got %v", err)
+	}
+
+	// Corrupt the undo block of a later block and the proof of an earlier
+	// one.
+	flipEntryByte(t, &idx.undoState, 9)
+	flipEntryByte(t, &idx.proofState, 6)
+
+	_, err = idx.FetchUtreexoProof(6, false)
+	if !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("expected ErrCorruptEntry fetching the proof, got %v", err)
+	}
+	_, err = idx.fetchUndoBlock(9)
+	if !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("expected ErrCorruptEntry fetching the undo block, got %v",
+			err)
+	}
+
+	err = idx.VerifyAll()
+	var corruptErr *CorruptEntryError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("expected a CorruptEntryError, got %v", err)
+	}
+	if corruptErr.Height != 6 || corruptErr.Path != idx.proofState.path ||
+		corruptErr.Offset != idx.proofState.offsets[6] {
+
+		t.Fatalf("expected the proof at height 6 at offset %d to be "+
+			"reported, got %v", idx.proofState.offsets[6], err)
+	}
+
+	// The index refuses to start with the height to reindex it from.
+	idx.SetVerifyOnInit(true)
+	err = idx.Init()
+	if !errors.Is(err, ErrCorruptEntry) ||
+		!strings.Contains(err.Error(), "reindexed from height 6") {
+
+		t.Fatalf("expected Init to refuse the corrupt proof, got %v", err)
+	}
+
+	// Once only the undo block is corrupt, it's the one reported.
+	flipEntryByte(t, &idx.proofState, 6)
+	err = idx.VerifyAll()
+	if !errors.As(err, &corruptErr) || corruptErr.Height != 9 ||
+		corruptErr.Path != idx.undoState.path {
+
+		t.Fatalf("expected the undo block at height 9 to be reported, "+
+			"got %v", err)
+	}
+
+	flipEntryByte(t, &idx.undoState, 9)
+	err = idx.Init()
+	if err != nil {
+		t.Fatalf("expected Init to verify the flat files, got %v", err)
+	}
+}
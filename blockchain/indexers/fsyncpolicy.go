@@ -0,0 +1,320 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/utreexo/utreexod/database"
+)
+
+const (
+	// relaxedSyncInterval is how often in blocks the artifacts that are
+	// synced relaxed are synced to disk when the utreexo state isn't
+	// flushed before then.
+	relaxedSyncInterval = 144
+)
+
+var (
+	// fsyncPolicyKey is the key in the bucket of a utreexo proof index
+	// that keeps the fsync policy the index was last run with.
+	fsyncPolicyKey = []byte("fsyncpolicy")
+)
+
+// ArtifactClass is a class of the artifacts that the utreexo proof indexes
+// write to disk.  The fsync policy is set per class.
+type ArtifactClass uint8
+
+const (
+	// ArtifactProofs are the proofs and the remember indexes of the
+	// blocks.  They're the bulk of what's written when the index is
+	// rebuilt.
+	ArtifactProofs ArtifactClass = iota
+
+	// ArtifactProofStats are the proof statistics kept along with the
+	// proofs.
+	ArtifactProofStats
+
+	// ArtifactUndo are the undo blocks that the blocks within the reorg
+	// window are disconnected with.
+	ArtifactUndo
+
+	// ArtifactQuarantine are the copies of the non-canonical proofs that
+	// are kept for inspection before the proofs are regenerated.
+	ArtifactQuarantine
+
+	// numArtifactClasses is the number of artifact classes.
+	numArtifactClasses
+)
+
+// artifactClassNames are the names of the artifact classes as used in the
+// custom fsync policies.
+var artifactClassNames = [numArtifactClasses]string{
+	ArtifactProofs:     "proofs",
+	ArtifactProofStats: "proofstats",
+	ArtifactUndo:       "undo",
+	ArtifactQuarantine: "quarantine",
+}
+
+// String returns the ArtifactClass in human-readable form.
+func (c ArtifactClass) String() string {
+	if c < numArtifactClasses {
+		return artifactClassNames[c]
+	}
+
+	return fmt.Sprintf("unknown ArtifactClass (%d)", uint8(c))
+}
+
+// SyncMode is how the writes of an artifact class are synced to disk.
+type SyncMode uint8
+
+const (
+	// SyncStrict syncs the writes as soon as they're done.
+	SyncStrict SyncMode = iota
+
+	// SyncRelaxed syncs the writes every relaxedSyncInterval blocks and
+	// before the utreexo state is flushed.  The writes done since they
+	// were last synced may be lost on a crash, but never the ones that
+	// the flushed utreexo state depends on, so the index is always
+	// recovered by connecting the lost blocks again.
+	SyncRelaxed
+)
+
+// String returns the SyncMode in human-readable form.
+func (m SyncMode) String() string {
+	switch m {
+	case SyncStrict:
+		return "strict"
+	case SyncRelaxed:
+		return "relaxed"
+	default:
+		return fmt.Sprintf("unknown SyncMode (%d)", uint8(m))
+	}
+}
+
+// FsyncPolicy is how each class of the artifacts that the utreexo proof indexes
+// write is synced to disk.  The zero value syncs every class strictly.
+type FsyncPolicy struct {
+	modes [numArtifactClasses]SyncMode
+}
+
+// StrictFsyncPolicy returns the policy that syncs every artifact as soon as
+// it's written.  It's the default.
+func StrictFsyncPolicy() FsyncPolicy {
+	return FsyncPolicy{}
+}
+
+// RelaxedFsyncPolicy returns the policy that relaxes syncing the bulk
+// artifacts while keeping the undo blocks and the quarantined proofs strict.
+// It's meant for storage that's battery-backed or replicated.
+func RelaxedFsyncPolicy() FsyncPolicy {
+	var p FsyncPolicy
+	p.modes[ArtifactProofs] = SyncRelaxed
+	p.modes[ArtifactProofStats] = SyncRelaxed
+
+	return p
+}
+
+// ParseFsyncPolicy parses the policy from its string form.  It's either
+// "strict", "relaxed", or a comma-separated list of class=mode pairs such as
+// "proofs=relaxed,undo=strict".  The classes that aren't listed are strict.
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "", "strict":
+		return StrictFsyncPolicy(), nil
+	case "relaxed":
+		return RelaxedFsyncPolicy(), nil
+	}
+
+	var p FsyncPolicy
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return FsyncPolicy{}, fmt.Errorf("invalid fsync policy "+
+				"%q: expected strict, relaxed, or class=mode "+
+				"pairs", s)
+		}
+
+		class := numArtifactClasses
+		for c, name := range artifactClassNames {
+			if parts[0] == name {
+				class = ArtifactClass(c)
+			}
+		}
+		if class == numArtifactClasses {
+			return FsyncPolicy{}, fmt.Errorf("invalid fsync policy "+
+				"%q: unknown artifact class %q (expected one of "+
+				"%s)", s, parts[0],
+				strings.Join(artifactClassNames[:], ", "))
+		}
+
+		switch parts[1] {
+		case "strict":
+			p.modes[class] = SyncStrict
+		case "relaxed":
+			p.modes[class] = SyncRelaxed
+		default:
+			return FsyncPolicy{}, fmt.Errorf("invalid fsync policy "+
+				"%q: unknown sync mode %q for %v (expected "+
+				"strict or relaxed)", s, parts[1], class)
+		}
+	}
+
+	return p, nil
+}
+
+// Mode returns how the artifacts of the given class are synced.
+func (p FsyncPolicy) Mode(class ArtifactClass) SyncMode {
+	return p.modes[class]
+}
+
+// String returns the policy in the form that ParseFsyncPolicy parses.
+func (p FsyncPolicy) String() string {
+	switch p {
+	case StrictFsyncPolicy():
+		return "strict"
+	case RelaxedFsyncPolicy():
+		return "relaxed"
+	}
+
+	pairs := make([]string, 0, numArtifactClasses)
+	for c, mode := range p.modes {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", ArtifactClass(c), mode))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// syncNow returns whether the writes of the given class done for the block at
+// the given height are to be synced right away.
+func (p FsyncPolicy) syncNow(class ArtifactClass, height int32) bool {
+	return p.modes[class] == SyncStrict || height%relaxedSyncInterval == 0
+}
+
+// syncFile syncs the file if the writes of the given class are synced
+// strictly.  The relaxed ones are left to be written back by the OS.
+func (p FsyncPolicy) syncFile(class ArtifactClass, f *os.File) error {
+	if p.modes[class] != SyncStrict {
+		return nil
+	}
+
+	return f.Sync()
+}
+
+// classedFlatFile is a flat file along with the class of the artifacts it
+// keeps.
+type classedFlatFile struct {
+	ff    *FlatFileState
+	class ArtifactClass
+}
+
+// SetFsyncPolicy sets how the flat files of the index are synced to disk.  It
+// must be called before the index is initialized.
+func (idx *FlatUtreexoProofIndex) SetFsyncPolicy(policy FsyncPolicy) {
+	idx.fsync = policy
+}
+
+// FsyncPolicy returns the policy that the flat files of the index are synced
+// to disk with.
+func (idx *FlatUtreexoProofIndex) FsyncPolicy() FsyncPolicy {
+	return idx.fsync
+}
+
+// setRecordedFsyncPolicy sets the policy that was recorded for the index before
+// it was started.
+func (idx *FlatUtreexoProofIndex) setRecordedFsyncPolicy(policy string) {
+	idx.recordedFsync = policy
+}
+
+// SetFsyncPolicy sets the fsync policy of the index.  The index writes through
+// database transactions that are synced by the database, so the policy is only
+// recorded and reported.  It must be called before the index is initialized.
+func (idx *UtreexoProofIndex) SetFsyncPolicy(policy FsyncPolicy) {
+	idx.fsync = policy
+}
+
+// FsyncPolicy returns the fsync policy of the index.
+func (idx *UtreexoProofIndex) FsyncPolicy() FsyncPolicy {
+	return idx.fsync
+}
+
+// setRecordedFsyncPolicy sets the policy that was recorded for the index before
+// it was started.
+func (idx *UtreexoProofIndex) setRecordedFsyncPolicy(policy string) {
+	idx.recordedFsync = policy
+}
+
+// SetFsyncPolicy sets how the enabled utreexo proof indexes sync what they
+// write to disk.  It must be called before the manager is initialized.
+func (m *Manager) SetFsyncPolicy(policy FsyncPolicy) {
+	for _, indexer := range m.enabledIndexes {
+		switch idxType := indexer.(type) {
+		case *UtreexoProofIndex:
+			idxType.SetFsyncPolicy(policy)
+		case *FlatUtreexoProofIndex:
+			idxType.SetFsyncPolicy(policy)
+		}
+	}
+}
+
+// fsyncPolicyIndex is implemented by the indexes that sync their writes
+// according to an fsync policy.
+type fsyncPolicyIndex interface {
+	Indexer
+
+	// FsyncPolicy returns the policy that the index syncs its writes with.
+	FsyncPolicy() FsyncPolicy
+
+	// setRecordedFsyncPolicy sets the policy that was recorded for the
+	// index before it was started.
+	setRecordedFsyncPolicy(policy string)
+}
+
+// recordFsyncPolicy records the fsync policy of the index in its bucket and
+// hands the one that was recorded before back to the index.  The policy is
+// kept so that it's known what an index that ended up corrupted was run with.
+func recordFsyncPolicy(dbTx database.Tx, idx fsyncPolicyIndex) error {
+	bucket := dbTx.Metadata().Bucket(idx.Key())
+	if bucket == nil {
+		return nil
+	}
+
+	policy := idx.FsyncPolicy().String()
+	recorded := string(bucket.Get(fsyncPolicyKey))
+	idx.setRecordedFsyncPolicy(recorded)
+	if recorded == policy {
+		return nil
+	}
+	if recorded != "" {
+		log.Infof("The fsync policy of the %s changed from %s to %s",
+			idx.Name(), recorded, policy)
+	}
+
+	return bucket.Put(fsyncPolicyKey, []byte(policy))
+}
+
+// recordFsyncPolicies records the fsync policies of the enabled indexes that
+// have one.
+func (m *Manager) recordFsyncPolicies(dbTx database.Tx) error {
+	for _, indexer := range m.enabledIndexes {
+		idx, ok := indexer.(fsyncPolicyIndex)
+		if !ok {
+			continue
+		}
+
+		err := recordFsyncPolicy(dbTx, idx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Ensure the utreexo proof indexes implement the fsyncPolicyIndex interface.
+var _ fsyncPolicyIndex = (*UtreexoProofIndex)(nil)
+var _ fsyncPolicyIndex = (*FlatUtreexoProofIndex)(nil)
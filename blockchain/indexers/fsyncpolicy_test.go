@@ -0,0 +1,303 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+)
+
+func TestParseFsyncPolicy(t *testing.T) {
+	custom := StrictFsyncPolicy()
+	custom.modes[ArtifactProofs] = SyncRelaxed
+	custom.modes[ArtifactQuarantine] = SyncRelaxed
+
+	tests := []struct {
+		in      string
+		want    FsyncPolicy
+		wantStr string
+		wantErr bool
+	}{
+		{in: "", want: StrictFsyncPolicy(), wantStr: "strict"},
+		{in: "strict", want: StrictFsyncPolicy(), wantStr: "strict"},
+		{in: "relaxed", want: RelaxedFsyncPolicy(), wantStr: "relaxed"},
+		{
+			in:      "proofs=relaxed,proofstats=relaxed",
+			want:    RelaxedFsyncPolicy(),
+			wantStr: "relaxed",
+		},
+		{
+			in:   "proofs=relaxed, quarantine=relaxed,undo=strict",
+			want: custom,
+			wantStr: "proofs=relaxed,proofstats=strict,undo=strict," +
+				"quarantine=relaxed",
+		},
+		{in: "lax", wantErr: true},
+		{in: "proofs=lax", wantErr: true},
+		{in: "tips=relaxed", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := ParseFsyncPolicy(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if got != test.want || got.String() != test.wantStr {
+			t.Errorf("%q: got %v, want %v", test.in, got, test.wantStr)
+			continue
+		}
+
+		// The string form parses back to the same policy.
+		again, err := ParseFsyncPolicy(got.String())
+		if err != nil || again != got {
+			t.Errorf("%q: %v didn't round trip: %v", test.in, got, err)
+		}
+	}
+}
+
+// syncedSizes are the sizes of the data and the offset files of a flat file as
+// of the last time they were synced.
+type syncedSizes struct {
+	data, offsets int64
+	syncs         uint64
+}
+
+// update records the sizes of the files of the flat file if they were synced
+// since the sizes were last recorded.
+func (s *syncedSizes) update(ff *FlatFileState) error {
+	syncs := ff.writeCounts().syncs
+	if syncs == s.syncs {
+		return nil
+	}
+	s.syncs = syncs
+
+	data, err := ff.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	offsets, err := ff.offsetFile.Stat()
+	if err != nil {
+		return err
+	}
+	s.data, s.offsets = data.Size(), offsets.Size()
+
+	return nil
+}
+
+// fsyncTestData returns the data stored for the given height in the flat file
+// at the given index.
+func fsyncTestData(i int, height int32) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%d-%d;", i, height)), 16)
+}
+
+// TestFlatFsyncPolicyCrash ensures that a crash that loses everything written
+// since the flat files were last synced leaves the flat files recoverable under
+// both the strict and the relaxed policies.  The relaxed policy may lose more
+// of the trailing blocks, but never the ones the flushed utreexo state depends
+// on nor the undo blocks, and what's left is never wrong.
+func TestFlatFsyncPolicyCrash(t *testing.T) {
+	const (
+		flushHeight = 100
+		tip         = relaxedSyncInterval + 6
+	)
+
+	for _, policy := range []FsyncPolicy{StrictFsyncPolicy(),
+		RelaxedFsyncPolicy()} {
+
+		dir := t.TempDir()
+		idx := &FlatUtreexoProofIndex{fsync: policy}
+		files := idx.classedFlatFiles()
+		for i, cf := range files {
+			ff, err := loadFlatFileState(dir, fmt.Sprintf("crash%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			*cf.ff = *ff
+		}
+
+		sizes := make([]syncedSizes, len(files))
+		for height := int32(1); height <= tip; height++ {
+			for i, cf := range files {
+				err := cf.ff.StoreData(height, fsyncTestData(i, height))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := idx.syncFlatFiles(height)
+			if err == nil && height == flushHeight {
+				err = idx.syncRelaxedFlatFiles()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, cf := range files {
+				if err := sizes[i].update(cf.ff); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		// Crash and lose everything that wasn't synced.
+		for i, cf := range files {
+			cf.ff.dataFile.Close()
+			cf.ff.offsetFile.Close()
+			err := os.Truncate(cf.ff.dataFile.Name(), sizes[i].data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Truncate(cf.ff.offsetFile.Name(), sizes[i].offsets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lowest := int32(tip)
+		for i, cf := range files {
+			ff, err := loadFlatFileState(dir, fmt.Sprintf("crash%d", i))
+			if err != nil {
+				t.Fatalf("%v: %v flat file unrecoverable: %v", policy,
+					cf.class, err)
+			}
+
+			best := ff.BestHeight()
+			if best < lowest {
+				lowest = best
+			}
+			switch policy.Mode(cf.class) {
+			case SyncStrict:
+				if best != tip {
+					t.Fatalf("%v: expected the strict %v flat "+
+						"file to keep every block, got %d",
+						policy, cf.class, best)
+				}
+			case SyncRelaxed:
+				if best < flushHeight || best >= tip {
+					t.Fatalf("%v: expected the relaxed %v flat "+
+						"file to keep the blocks up to the "+
+						"last sync, got %d", policy, cf.class,
+						best)
+				}
+			}
+
+			for height := int32(1); height <= best; height++ {
+				data, err := ff.FetchData(height)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, fsyncTestData(i, height)) {
+					t.Fatalf("%v: wrong %v data for height %d",
+						policy, cf.class, height)
+				}
+			}
+			*cf.ff = *ff
+		}
+
+		// The blocks after the lowest height are connected again.
+		for i, cf := range files {
+			err := cf.ff.truncate(lowest)
+			if err == nil {
+				err = cf.ff.StoreData(lowest+1,
+					fsyncTestData(i, lowest+1))
+			}
+			if err != nil {
+				t.Fatalf("%v: unable to connect again after the "+
+					"crash: %v", policy, err)
+			}
+		}
+	}
+}
+
+// TestRecordFsyncPolicy ensures that the fsync policy of an index is recorded
+// and that the one it was run with before is reported.
+func TestRecordFsyncPolicy(t *testing.T) {
+	db, dbPath, err := createDB("TestRecordFsyncPolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+	defer db.Close()
+
+	idx := &FlatUtreexoProofIndex{chainParams: &chaincfg.RegressionNetParams}
+	err = db.Update(func(dbTx database.Tx) error {
+		_, err := dbTx.Metadata().CreateBucket(idx.Key())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(policy FsyncPolicy) IndexWriteStats {
+		idx.SetFsyncPolicy(policy)
+		err := db.Update(func(dbTx database.Tx) error {
+			return recordFsyncPolicy(dbTx, idx)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idx.Stats()
+	}
+
+	stats := record(RelaxedFsyncPolicy())
+	if stats.FsyncPolicy != "relaxed" || stats.RecordedFsyncPolicy != "" {
+		t.Fatalf("unexpected policies on the first start: %+v", stats)
+	}
+	stats = record(StrictFsyncPolicy())
+	if stats.FsyncPolicy != "strict" || stats.RecordedFsyncPolicy != "relaxed" {
+		t.Fatalf("unexpected policies after the change: %+v", stats)
+	}
+	stats = record(StrictFsyncPolicy())
+	if stats.RecordedFsyncPolicy != "strict" {
+		t.Fatalf("unexpected policies on restart: %+v", stats)
+	}
+}
+
+// BenchmarkFlatFsyncPolicy measures how fast blocks are stored to the flat files
+// of the index, as when it's rebuilt, under each fsync policy.
+func BenchmarkFlatFsyncPolicy(b *testing.B) {
+	data := bytes.Repeat([]byte{0xab}, 4096)
+	for _, policy := range []FsyncPolicy{StrictFsyncPolicy(),
+		RelaxedFsyncPolicy()} {
+
+		b.Run(policy.String(), func(b *testing.B) {
+			dir := b.TempDir()
+			idx := &FlatUtreexoProofIndex{fsync: policy}
+			for i, cf := range idx.classedFlatFiles() {
+				ff, err := loadFlatFileState(dir,
+					fmt.Sprintf("bench%d", i))
+				if err != nil {
+					b.Fatal(err)
+				}
+				*cf.ff = *ff
+			}
+
+			b.SetBytes(int64(len(data) * len(idx.classedFlatFiles())))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				height := int32(n + 1)
+				for _, cf := range idx.classedFlatFiles() {
+					err := cf.ff.StoreData(height, data)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err := idx.syncFlatFiles(height)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package indexers
 
 import (
-	"bytes"
 	"fmt"
 	"math/rand"
 	"os"
@@ -14,6 +13,7 @@ import (
 	"github.com/utreexo/utreexod/blockchain"
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
 	"github.com/utreexo/utreexod/database"
 	_ "github.com/utreexo/utreexod/database/ffldb"
 	"github.com/utreexo/utreexod/txscript"
@@ -74,7 +74,7 @@ func initIndexes(interval int32, dbPath string, db *database.DB, params *chaincf
 
 	proofGenInterval := new(int32)
 	*proofGenInterval = interval
-	flatUtreexoProofIndex, err := NewFlatUtreexoProofIndex(dbPath, params, proofGenInterval)
+	flatUtreexoProofIndex, err := NewFlatUtreexoProofIndex(dbPath, params, proofGenInterval, 0, false)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -84,6 +84,11 @@ func initIndexes(interval int32, dbPath string, db *database.DB, params *chaincf
 		return nil, nil, err
 	}
 
+	// Check that every reorg in the tests undoes connecting the blocks
+	// exactly.
+	flatUtreexoProofIndex.SetUndoAssertions(true)
+	utreexoProofIndex.SetUndoAssertions(true)
+
 	indexes := []Indexer{
 		utreexoProofIndex,
 		flatUtreexoProofIndex,
@@ -96,6 +101,48 @@ func indexersTestChain(testName string, proofGenInterval int32) (*blockchain.Blo
 	params := chaincfg.RegressionNetParams
 	params.CoinbaseMaturity = 1
 
+	return indexersTestChainWithParams(testName, proofGenInterval, &params)
+}
+
+// indexersTestChainWithParams creates a chain with the utreexo proof indexes
+// for the given chain parameters.
+func indexersTestChainWithParams(testName string, proofGenInterval int32,
+	params *chaincfg.Params) (*blockchain.BlockChain, []Indexer, *chaincfg.Params, func()) {
+
+	return indexersTestChainWithCheckpoints(testName, proofGenInterval,
+		params, nil)
+}
+
+// indexersTestChainWithCheckpoints creates a chain with the utreexo proof
+// indexes for the given chain parameters that doesn't run the scripts of the
+// blocks up to the latest of the given checkpoints.
+func indexersTestChainWithCheckpoints(testName string, proofGenInterval int32,
+	params *chaincfg.Params, checkpoints []chaincfg.Checkpoint) (
+	*blockchain.BlockChain, []Indexer, *chaincfg.Params, func()) {
+
+	return newIndexersTestChain(testName, proofGenInterval, params,
+		checkpoints, false)
+}
+
+// ttlIndexersTestChain creates a chain with the utreexo proof indexes followed
+// by the time to live index.
+func ttlIndexersTestChain(testName string, proofGenInterval int32) (
+	*blockchain.BlockChain, []Indexer, *chaincfg.Params, func()) {
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	return newIndexersTestChain(testName, proofGenInterval, &params, nil,
+		true)
+}
+
+// newIndexersTestChain creates a chain with the utreexo proof indexes, and the
+// time to live index if asked for, that doesn't run the scripts of the blocks
+// up to the latest of the given checkpoints.
+func newIndexersTestChain(testName string, proofGenInterval int32,
+	params *chaincfg.Params, checkpoints []chaincfg.Checkpoint, ttl bool) (
+	*blockchain.BlockChain, []Indexer, *chaincfg.Params, func()) {
+
 	db, dbPath, err := createDB(testName)
 	tearDown := func() {
 		db.Close()
@@ -108,18 +155,22 @@ func indexersTestChain(testName string, proofGenInterval int32) (*blockchain.Blo
 	}
 
 	// Create the indexes to be used in the chain.
-	indexManager, indexes, err := initIndexes(proofGenInterval, dbPath, &db, &params)
+	indexManager, indexes, err := initIndexes(proofGenInterval, dbPath, &db, params)
 	if err != nil {
 		tearDown()
 		os.RemoveAll(testDbRoot)
 		panic(fmt.Errorf("error creating indexes: %v", err))
 	}
+	if ttl {
+		indexes = append(indexes, NewTTLIndex(db, params))
+		indexManager = NewManager(db, indexes)
+	}
 
 	// Create the main chain instance.
 	chain, err := blockchain.New(&blockchain.Config{
 		DB:               db,
-		ChainParams:      &params,
-		Checkpoints:      nil,
+		ChainParams:      params,
+		Checkpoints:      checkpoints,
 		TimeSource:       blockchain.NewMedianTime(),
 		SigCache:         txscript.NewSigCache(1000),
 		UtxoCacheMaxSize: 10 * 1024 * 1024,
@@ -139,7 +190,7 @@ func indexersTestChain(testName string, proofGenInterval int32) (*blockchain.Blo
 		panic(fmt.Errorf("failed to init indexs: %v", err))
 	}
 
-	return chain, indexes, &params, tearDown
+	return chain, indexes, params, tearDown
 }
 
 // csnTestChain creates a chain using the compact utreexo state.
@@ -147,6 +198,14 @@ func csnTestChain(testName string) (*blockchain.BlockChain, *chaincfg.Params, fu
 	params := chaincfg.RegressionNetParams
 	params.CoinbaseMaturity = 1
 
+	return csnTestChainWithParams(testName, &params)
+}
+
+// csnTestChainWithParams creates a chain using the compact utreexo state for
+// the given chain parameters.
+func csnTestChainWithParams(testName string, params *chaincfg.Params) (
+	*blockchain.BlockChain, *chaincfg.Params, func(), error) {
+
 	db, dbPath, err := createDB(testName)
 	tearDown := func() {
 		db.Close()
@@ -159,78 +218,94 @@ func csnTestChain(testName string) (*blockchain.BlockChain, *chaincfg.Params, fu
 	// Create the main csn chain instance.
 	chain, err := blockchain.New(&blockchain.Config{
 		DB:          db,
-		ChainParams: &params,
+		ChainParams: params,
 		Checkpoints: nil,
 		TimeSource:  blockchain.NewMedianTime(),
 		SigCache:    txscript.NewSigCache(1000),
-		UtreexoView: blockchain.NewUtreexoViewpoint(),
+		UtreexoView: blockchain.NewUtreexoViewpoint(0),
 	})
 	if err != nil {
 		err := fmt.Errorf("failed to create csn chain instance: %v", err)
 		return nil, nil, tearDown, err
 	}
 
-	return chain, &params, tearDown, nil
+	return chain, params, tearDown, nil
 }
 
 // compareUtreexoIdx compares the indexed proof and the undo blocks from start
 // to end.
 func compareUtreexoIdx(start, end int32, chain *blockchain.BlockChain, indexes []Indexer) error {
 	// Check that the newly added data to both of the indexes are equal.
+	m := NewManager(nil, indexes)
 	for b := start; b < end; b++ {
-		// Declare the utreexo data and the undo blocks that we'll be
-		// comparing.
-		var utreexoUD, flatUD *wire.UData
-		var undo, flatUndo *accumulator.UndoBlock
+		hash, err := chain.BlockHashByHeight(b)
+		if err != nil {
+			return err
+		}
 
-		for _, indexer := range indexes {
-			switch idxType := indexer.(type) {
-			case *UtreexoProofIndex:
-				block, err := chain.BlockByHeight(b)
-				utreexoUD, err = idxType.FetchUtreexoProof(block.Hash())
-				if err != nil {
-					return err
-				}
+		result, err := m.CompareIndexesAt(&BlockID{Height: b, Hash: *hash})
+		if err != nil {
+			return err
+		}
+		if !result.Agree() {
+			return fmt.Errorf("%v", result.String())
+		}
+	}
 
-				err = idxType.db.View(func(dbTx database.Tx) error {
-					undoBytes, err := dbFetchUndoBlockEntry(dbTx, block.Hash())
-					r := bytes.NewReader(undoBytes)
-					undo = new(accumulator.UndoBlock)
-					err = undo.Deserialize(r)
-					if err != nil {
-						return err
-					}
-					return nil
-				})
-				if err != nil {
-					return err
-				}
+	return nil
+}
 
-			case *FlatUtreexoProofIndex:
-				var err error
-				flatUD, err = idxType.FetchUtreexoProof(b, false)
-				if err != nil {
-					return err
-				}
+// checkTTLIndex checks that the spend heights that the ttl index among the
+// indexes has for every main chain block up to the tip are the heights that
+// the main chain blocks spend the outputs at.
+func checkTTLIndex(chain *blockchain.BlockChain, indexes []Indexer) error {
+	var ttlIdx *TTLIndex
+	for _, indexer := range indexes {
+		if idx, ok := indexer.(*TTLIndex); ok {
+			ttlIdx = idx
+		}
+	}
 
-				flatUndo, err = idxType.fetchUndoBlock(b)
-				if err != nil {
-					return err
-				}
+	tip := chain.BestSnapshot().Height
+	blocks := make([]*btcutil.Block, tip+1)
+	spentAt := make(map[wire.OutPoint]int32)
+	for height := int32(0); height <= tip; height++ {
+		block, err := chain.BlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		blocks[height] = block
+		for _, tx := range block.Transactions()[1:] {
+			for _, txIn := range tx.MsgTx().TxIn {
+				spentAt[txIn.PreviousOutPoint] = height
 			}
 		}
+	}
 
-		if !reflect.DeepEqual(utreexoUD, flatUD) {
-			err := fmt.Errorf("Fetched utreexo data differ for "+
-				"utreexo proof index and flat utreexo proof index at height %d", b)
-			return err
+	for height, block := range blocks {
+		var want []int32
+		for _, tx := range block.Transactions() {
+			for i := range tx.MsgTx().TxOut {
+				op := wire.OutPoint{Hash: *tx.Hash(), Index: uint32(i)}
+				want = append(want, spentAt[op])
+			}
 		}
 
-		if !reflect.DeepEqual(undo, flatUndo) {
-			err := fmt.Errorf("Fetched undo data differ for "+
-				"utreexo proof index and flat utreexo proof index at height %d", b)
+		got, err := ttlIdx.FetchTTLs(int32(height))
+		if err != nil {
 			return err
 		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("got spend heights %v for the block at "+
+				"height %d, want %v", got, height, want)
+		}
+	}
+
+	// The blocks above the tip have no spend heights.
+	_, err := ttlIdx.FetchTTLs(tip + 1)
+	if err == nil {
+		return fmt.Errorf("got spend heights for the block above the "+
+			"tip at height %d", tip)
 	}
 
 	return nil
@@ -241,6 +316,7 @@ func compareUtreexoIdx(start, end int32, chain *blockchain.BlockChain, indexes [
 func syncCsnChain(start, end int32, chainToSyncFrom, csnChain *blockchain.BlockChain,
 	indexes []Indexer) error {
 
+	m := NewManager(nil, indexes)
 	for b := start; b < end; b++ {
 		// Fetch the raw block bytes from the database.
 		block, err := chainToSyncFrom.BlockByHeight(b)
@@ -249,31 +325,21 @@ func syncCsnChain(start, end int32, chainToSyncFrom, csnChain *blockchain.BlockC
 			return str
 		}
 
-		var flatUD, ud *wire.UData
-		for _, indexer := range indexes {
-			switch idxType := indexer.(type) {
-			case *FlatUtreexoProofIndex:
-				flatUD, err = idxType.FetchUtreexoProof(b, false)
-				if err != nil {
-					return err
-				}
-			case *UtreexoProofIndex:
-				ud, err = idxType.FetchUtreexoProof(block.Hash())
-				if err != nil {
-					return err
-				}
-			}
+		id := &BlockID{Height: b, Hash: *block.Hash()}
+		result, err := m.CompareIndexesAt(id)
+		if err != nil {
+			return err
 		}
-
-		if !reflect.DeepEqual(ud, flatUD) {
-			err := fmt.Errorf("Fetched utreexo data differ for "+
-				"utreexo proof index and flat utreexo proof index at height %d", b)
+		if len(result.ProofDiffs) > 0 {
+			return fmt.Errorf("%v", result.String())
+		}
+		proofs, err := m.FetchProofAllIndexes(id)
+		if err != nil {
 			return err
 		}
 
-		block.MsgBlock().UData = ud
-
-		_, _, err = csnChain.ProcessBlock(block, blockchain.BFNone)
+		_, _, err = csnChain.ProcessBlockWithUData(block,
+			proofs[result.Indexes[0]], blockchain.BFNone)
 		if err != nil {
 			str := fmt.Errorf("ProcessBlock fail at block height %d err: %s\n", b, err)
 			return str
@@ -291,18 +357,18 @@ func syncCsnChainMultiBlockProof(start, end, interval int32, chainToSyncFrom, cs
 	for b := start; b < end; b++ {
 		var err error
 		var ud, multiUd *wire.UData
-		var dels []accumulator.Hash
+		var dels []AccHash
 		var remembers []uint32
 		if (b % interval) == 0 {
 			for _, indexer := range indexes {
 				switch idxType := indexer.(type) {
 				case *FlatUtreexoProofIndex:
-					_, multiUd, dels, err = idxType.FetchMultiUtreexoProof(b + csnChain.GetUtreexoView().GetProofInterval())
+					_, multiUd, dels, err = idxType.FetchMultiBlockProof(b + csnChain.GetUtreexoView().GetProofInterval())
 					if err != nil {
 						return err
 					}
 
-					ud, _, _, err = idxType.FetchMultiUtreexoProof(b)
+					ud, _, _, err = idxType.FetchMultiBlockProof(b)
 					if err != nil {
 						return err
 					}
@@ -313,7 +379,7 @@ func syncCsnChainMultiBlockProof(start, end, interval int32, chainToSyncFrom, cs
 					}
 				}
 			}
-			err = csnChain.GetUtreexoView().IngestProof(true, dels, &multiUd.AccProof)
+			err = csnChain.GetUtreexoView().IngestProof(true, AccumulatorHashes(dels), &multiUd.AccProof)
 			if err != nil {
 				return fmt.Errorf("syncCsnChainMultiBlockProof err at height %d. err: %v:", b, err)
 			}
@@ -365,9 +431,12 @@ func testUtreexoProof(block *btcutil.Block, chain *blockchain.BlockChain, indexe
 	// Fetch the proofs from each of the indexes.
 	var flatUD, ud *wire.UData
 	var undo, flatUndo *accumulator.UndoBlock
+	var schedule wire.LeafCommitmentSchedule
 	for _, indexer := range indexes {
 		switch idxType := indexer.(type) {
 		case *FlatUtreexoProofIndex:
+			schedule = idxType.chainParams.LeafCommitments
+
 			var err error
 			flatUD, err = idxType.FetchUtreexoProof(block.Height(), false)
 			if err != nil {
@@ -386,15 +455,10 @@ func testUtreexoProof(block *btcutil.Block, chain *blockchain.BlockChain, indexe
 				return err
 			}
 
-			err = idxType.db.View(func(dbTx database.Tx) error {
-				undoBytes, err := dbFetchUndoBlockEntry(dbTx, block.Hash())
-				r := bytes.NewReader(undoBytes)
-				undo = new(accumulator.UndoBlock)
-				err = undo.Deserialize(r)
-				if err != nil {
-					return err
-				}
-				return nil
+			// The undo block may be kept in the shared undo store.
+			undo, err = idxType.fetchUndo(&BlockID{
+				Height: block.Height(),
+				Hash:   *block.Hash(),
 			})
 			if err != nil {
 				return err
@@ -423,7 +487,8 @@ func testUtreexoProof(block *btcutil.Block, chain *blockchain.BlockChain, indexe
 	}
 
 	_, outCount, inskip, outskip := blockchain.DedupeBlock(block)
-	adds := blockchain.BlockToAddLeaves(block, outskip, nil, outCount)
+	adds := blockchain.BlockToAddLeaves(block, outskip, nil, outCount, schedule,
+		nil)
 
 	dels, _, err := blockchain.BlockToDelLeaves(stxos, chain, block, inskip, -1)
 	if err != nil {
@@ -434,7 +499,7 @@ func testUtreexoProof(block *btcutil.Block, chain *blockchain.BlockChain, indexe
 		if del.IsUnconfirmed() {
 			continue
 		}
-		delHashes = append(delHashes, del.LeafHash())
+		delHashes = append(delHashes, del.ScheduledLeafHash(schedule))
 	}
 
 	// Verify the proof on the accumulator.
@@ -442,7 +507,7 @@ func testUtreexoProof(block *btcutil.Block, chain *blockchain.BlockChain, indexe
 		switch idxType := indexer.(type) {
 		case *FlatUtreexoProofIndex:
 			// Undo back to the state where the proof was generated.
-			err := idxType.utreexoState.state.Undo(*flatUndo)
+			err := idxType.utreexoState.undo(*flatUndo)
 			if err != nil {
 				return err
 			}
@@ -452,14 +517,14 @@ func testUtreexoProof(block *btcutil.Block, chain *blockchain.BlockChain, indexe
 				return err
 			}
 			// Go back to the original state.
-			_, err = idxType.utreexoState.state.Modify(adds, flatUD.AccProof.Targets)
+			_, err = idxType.utreexoState.modify(adds, flatUD.AccProof.Targets)
 			if err != nil {
 				return err
 			}
 
 		case *UtreexoProofIndex:
 			// Undo back to the state where the proof was generated.
-			err := idxType.utreexoState.state.Undo(*undo)
+			err := idxType.utreexoState.undo(*undo)
 			if err != nil {
 				return err
 			}
@@ -469,7 +534,7 @@ func testUtreexoProof(block *btcutil.Block, chain *blockchain.BlockChain, indexe
 				return err
 			}
 			// Go back to the original state.
-			_, err = idxType.utreexoState.state.Modify(adds, ud.AccProof.Targets)
+			_, err = idxType.utreexoState.modify(adds, ud.AccProof.Targets)
 			if err != nil {
 				return err
 			}
@@ -622,8 +687,9 @@ func TestUtreexoProofIndex(t *testing.T) {
 	source := rand.NewSource(time.Now().UnixNano())
 	rand := rand.New(source)
 
-	chain, indexes, params, tearDown := indexersTestChain("TestUtreexoProofIndex", 1)
+	chain, indexes, params, tearDown := ttlIndexersTestChain("TestUtreexoProofIndex", 1)
 	defer tearDown()
+	proofIndexes := indexes[:2]
 
 	tip := btcutil.NewBlock(params.GenesisBlock)
 
@@ -654,7 +720,7 @@ func TestUtreexoProofIndex(t *testing.T) {
 
 		// Test that the proof that the indexes generated verify on those
 		// same indexes.
-		err := testUtreexoProof(newBlock, chain, indexes)
+		err := testUtreexoProof(newBlock, chain, proofIndexes)
 		if err != nil {
 			t.Fatal(fmt.Sprintf("TestUtreexoProofIndex failed testUtreexoProof. err: %v", err))
 		}
@@ -668,7 +734,11 @@ func TestUtreexoProofIndex(t *testing.T) {
 	}
 
 	// Check that the added 100 blocks are equal for both indexes.
-	err := compareUtreexoIdx(1, 100, chain, indexes)
+	err := compareUtreexoIdx(1, 100, chain, proofIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkTTLIndex(chain, indexes)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -682,7 +752,7 @@ func TestUtreexoProofIndex(t *testing.T) {
 	}
 
 	// Sync the csn chain to the tip from block 1.
-	err = syncCsnChain(1, 100, chain, csnChain, indexes)
+	err = syncCsnChain(1, 100, chain, csnChain, proofIndexes)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -712,18 +782,77 @@ func TestUtreexoProofIndex(t *testing.T) {
 	}
 
 	// Check that the newly added data to both of the indexes are equal.
-	err = compareUtreexoIdx(1, 100, chain, indexes)
+	err = compareUtreexoIdx(1, 100, chain, proofIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The spends of the blocks that were reorganized out are reset.
+	err = checkTTLIndex(chain, indexes)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Reorg the csn chain as well.
-	err = syncCsnChain(2, 100, chain, csnChain, indexes)
+	err = syncCsnChain(2, 100, chain, csnChain, proofIndexes)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+// TestTTLIndex ensures that the ttl index keeps the height that every output
+// is spent at and that the spend heights of the outputs that a block spent are
+// reset once it's reorganized out of the main chain.
+func TestTTLIndex(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := ttlIndexersTestChain("TestTTLIndex", 1)
+	defer tearDown()
+	ttlIdx := indexes[2].(*TTLIndex)
+
+	// Spend the outputs of the block at height 1 at height 2 and the ones
+	// of height 2 at height 3.
+	b1, spends := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	b2, spends := blockchain.AddBlock(chain, b1, spends)
+	b3, _ := blockchain.AddBlock(chain, b2, spends)
+	blockchain.AddBlock(chain, b3, nil)
+	err := checkTTLIndex(chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spendHeights, err := ttlIdx.FetchTTLs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spendHeights) != 1 || spendHeights[0] != 2 {
+		t.Fatalf("got spend heights %v at height 1, want [2]",
+			spendHeights)
+	}
+
+	// Reorganize to a longer chain from height 1 that spends nothing.
+	tip := b1
+	for i := 0; i < 4; i++ {
+		tip, _ = blockchain.AddBlock(chain, tip, nil)
+	}
+	if chain.BestSnapshot().Hash != *tip.Hash() {
+		t.Fatalf("the chain didn't reorganize to the longer chain")
+	}
+	err = checkTTLIndex(chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spendHeights, err = ttlIdx.FetchTTLs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spendHeights) != 1 || spendHeights[0] != 0 {
+		t.Fatalf("got spend heights %v at height 1 after the reorg, "+
+			"want [0]", spendHeights)
+	}
+}
+
 func TestMultiBlockProof(t *testing.T) {
 	// Always remove the root on return.
 	defer os.RemoveAll(testDbRoot)
@@ -790,3 +919,469 @@ func TestMultiBlockProof(t *testing.T) {
 		t.Fatal(str)
 	}
 }
+
+// TestEarlyBlockProofs ensures that both indexes return the same well-defined
+// utreexo data for the genesis block and the first blocks after it.
+func TestEarlyBlockProofs(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestEarlyBlockProofs", 1)
+	defer tearDown()
+
+	// Block 2 spends the coinbase of block 1.
+	genesis := btcutil.NewBlock(params.GenesisBlock)
+	b1, spendableOuts := blockchain.AddBlock(chain, genesis, nil)
+	b2, _ := blockchain.AddBlock(chain, b1, spendableOuts)
+
+	blocks := []*btcutil.Block{genesis, b1, b2}
+	wantDels := []int{0, 0, 1}
+	for height, block := range blocks {
+		var flatUD, ud *wire.UData
+		for _, indexer := range indexes {
+			var err error
+			switch idxType := indexer.(type) {
+			case *FlatUtreexoProofIndex:
+				flatUD, err = idxType.FetchUtreexoProof(int32(height), false)
+			case *UtreexoProofIndex:
+				ud, err = idxType.FetchUtreexoProof(block.Hash())
+			}
+			if err != nil {
+				t.Fatalf("%s: height %d: %v", indexer.Name(), height, err)
+			}
+		}
+
+		if !reflect.DeepEqual(ud, flatUD) {
+			t.Fatalf("utreexo data differ for the indexes at height %d",
+				height)
+		}
+		if len(ud.LeafDatas) != wantDels[height] {
+			t.Fatalf("expected %d dels at height %d, got %d",
+				wantDels[height], height, len(ud.LeafDatas))
+		}
+	}
+
+	// A scan from the genesis block includes it.
+	for _, indexer := range indexes {
+		scanner := indexer.(proofScanner)
+		c, err := scanner.NewCursor(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes, c, err := scanHashes(scanner, c, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", indexer.Name(), err)
+		}
+		if err := expectHashes(hashes, blocks); err != nil {
+			t.Fatalf("%s: %v", indexer.Name(), err)
+		}
+		if c.Height() != 3 {
+			t.Fatalf("%s: expected the cursor at height 3, got %d",
+				indexer.Name(), c.Height())
+		}
+	}
+}
+
+// leafCommitmentUpgradeHeight is the height that the tagged leaf commitment
+// scheme activates at in the params returned by leafCommitmentUpgradeParams.
+const leafCommitmentUpgradeHeight = 50
+
+// leafCommitmentUpgradeParams returns the regression test network params with
+// the tagged leaf commitment scheme activating at leafCommitmentUpgradeHeight.
+func leafCommitmentUpgradeParams() *chaincfg.Params {
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+	params.LeafCommitments = wire.LeafCommitmentSchedule{{
+		Height: leafCommitmentUpgradeHeight,
+		Scheme: wire.LeafCommitmentTaggedV1,
+	}}
+
+	return &params
+}
+
+// TestLeafCommitmentUpgradeReorg ensures that the leaves are committed with the
+// scheme for the height they're created at and that the indexes stay consistent
+// through a reorg that crosses the activation height.
+func TestLeafCommitmentUpgradeReorg(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	source := rand.NewSource(time.Now().UnixNano())
+	rand := rand.New(source)
+
+	chain, indexes, params, tearDown := indexersTestChainWithParams(
+		"TestLeafCommitmentUpgradeReorg", 1, leafCommitmentUpgradeParams())
+	defer tearDown()
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+
+	// Create block at height 1.
+	var emptySpendableOuts []*blockchain.SpendableOut
+	b1, spendableOuts1 := blockchain.AddBlock(chain, tip, emptySpendableOuts)
+
+	// addBlocks adds count blocks on top of the given block that spend the
+	// outputs of the previous blocks in random order.  The proofs of the
+	// blocks are tested as they're connected if isTip is set.
+	addBlocks := func(prev *btcutil.Block, spends []*blockchain.SpendableOut,
+		count int, isTip bool) []*btcutil.Block {
+
+		blocks := make([]*btcutil.Block, 0, count)
+		var allSpends []*blockchain.SpendableOut
+		for i := 0; i < count; i++ {
+			newBlock, newSpends := blockchain.AddBlock(chain, prev, spends)
+			prev = newBlock
+			blocks = append(blocks, newBlock)
+
+			allSpends = append(allSpends, newSpends...)
+
+			var nextSpends []*blockchain.SpendableOut
+			for j := 0; j < len(allSpends); j++ {
+				randIdx := rand.Intn(len(allSpends))
+
+				spend := allSpends[randIdx]
+				allSpends = append(allSpends[:randIdx], allSpends[randIdx+1:]...)
+				nextSpends = append(nextSpends, spend)
+			}
+			spends = nextSpends
+
+			if isTip {
+				err := testUtreexoProof(newBlock, chain, indexes)
+				if err != nil {
+					t.Fatalf("block %d: %v", newBlock.Height(), err)
+				}
+			}
+		}
+
+		return blocks
+	}
+
+	// Create a chain with 61 blocks that crosses the activation height.
+	mainBlocks := addBlocks(b1, spendableOuts1, 60, true)
+
+	// The leaves are only committed with the tagged scheme from the
+	// activation height onwards.
+	for _, block := range mainBlocks {
+		_, outCount, _, outskip := blockchain.DedupeBlock(block)
+		scheduled := blockchain.BlockToAddLeaves(block, outskip, nil,
+			outCount, params.LeafCommitments, nil)
+		v0 := blockchain.BlockToAddLeaves(block, outskip, nil, outCount,
+			nil, nil)
+
+		upgraded := block.Height() >= leafCommitmentUpgradeHeight
+		if upgraded == reflect.DeepEqual(scheduled, v0) {
+			t.Fatalf("block %d: expected the leaves to be committed "+
+				"with the %v scheme", block.Height(),
+				params.LeafCommitments.SchemeAt(block.Height()))
+		}
+	}
+
+	err := compareUtreexoIdx(1, 61, chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a longer chain from block 1 so that the indexes disconnect back
+	// below the activation height and then connect above it again.
+	addBlocks(b1, spendableOuts1, 70, false)
+	best, err := chain.BlockByHeight(chain.BestSnapshot().Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Height() != 71 {
+		t.Fatalf("expected the chain to reorg to height 71, got %d",
+			best.Height())
+	}
+	err = testUtreexoProof(best, chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = compareUtreexoIdx(1, 71, chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A csn chain with the same params must be able to consume the proofs
+	// of the new chain on both sides of the activation height.
+	csnChain, _, csnTearDown, err := csnTestChainWithParams(
+		"TestLeafCommitmentUpgradeReorg-CsnChain",
+		leafCommitmentUpgradeParams())
+	defer csnTearDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = syncCsnChain(1, 72, chain, csnChain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCsnReleasesUData ensures that a csn chain releases the utreexo data of the
+// blocks it connects and that the connected notifications still carry a
+// summary of it.
+func TestCsnReleasesUData(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestCsnReleasesUData", 1)
+	defer tearDown()
+
+	var nextSpends []*blockchain.SpendableOut
+	nextBlock := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < 20; b++ {
+		nextBlock, nextSpends = blockchain.AddBlock(chain, nextBlock, nextSpends)
+	}
+
+	csnChain, _, csnTearDown, err := csnTestChain("TestCsnReleasesUData-CsnChain")
+	defer csnTearDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The accumulator library proves leaves with no targets while there's
+	// at most one leaf in the accumulator, so the targets are counted from
+	// the proofs that the csn chain is given.
+	targets := make(map[int32]int)
+	for h := int32(1); h <= 20; h++ {
+		block, err := chain.BlockByHeight(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud, err := indexes[0].(*UtreexoProofIndex).FetchUtreexoProof(
+			block.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets[h] = len(ud.AccProof.Targets)
+	}
+
+	var connected []*btcutil.Block
+	csnChain.Subscribe(func(n *blockchain.Notification) {
+		if n.Type == blockchain.NTBlockConnected {
+			connected = append(connected, n.Data.(*btcutil.Block))
+		}
+	})
+
+	err = syncCsnChain(1, 21, chain, csnChain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connected) != 20 {
+		t.Fatalf("expected 20 connected blocks, got %d", len(connected))
+	}
+
+	for _, block := range connected {
+		if block.MsgBlock().UData != nil {
+			t.Fatalf("block %d: expected the utreexo data to be released",
+				block.Height())
+		}
+
+		// Every input of the generated blocks spends an output created
+		// in an earlier block.
+		var inputs int
+		for _, tx := range block.Transactions()[1:] {
+			inputs += len(tx.MsgTx().TxIn)
+		}
+		summary := block.UDataSummary()
+		if summary == nil || summary.LeafCount != inputs ||
+			summary.TargetCount != targets[block.Height()] {
+
+			t.Fatalf("block %d: expected a summary of %d leaves and "+
+				"%d targets, got %+v", block.Height(), inputs,
+				targets[block.Height()], summary)
+		}
+	}
+}
+
+// TestCsnProofCheckedWithScripts ensures that a csn chain refuses a block whose
+// utreexo proof doesn't verify as invalid utreexo data, even when the other
+// checks of the block would fail on the leaf datas of the proof, and that the
+// roots of the accumulator are left as they were.
+func TestCsnProofCheckedWithScripts(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestCsnProofCheckedWithScripts", 1)
+	defer tearDown()
+
+	var nextSpends []*blockchain.SpendableOut
+	nextBlock := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < 20; b++ {
+		nextBlock, nextSpends = blockchain.AddBlock(chain, nextBlock, nextSpends)
+	}
+	ud, err := indexes[0].(*UtreexoProofIndex).FetchUtreexoProof(
+		nextBlock.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csnChain, _, csnTearDown, err := csnTestChain(
+		"TestCsnProofCheckedWithScripts-CsnChain")
+	defer csnTearDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncCsnChain(1, 20, chain, csnChain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := csnChain.GetUtreexoView().GetRoots()
+
+	tests := []struct {
+		name string
+
+		// tamper changes the leaf data of the spent output so that
+		// the proof no longer verifies.  It may also make the other
+		// checks of the block fail.
+		tamper func(ld *wire.LeafData)
+	}{
+		{
+			name: "coinbase flag",
+			tamper: func(ld *wire.LeafData) {
+				ld.IsCoinBase = !ld.IsCoinBase
+			},
+		},
+		{
+			name: "amount spent too high",
+			tamper: func(ld *wire.LeafData) {
+				ld.Amount = 0
+			},
+		},
+		{
+			name: "failing script",
+			tamper: func(ld *wire.LeafData) {
+				ld.PkScript = []byte{txscript.OP_FALSE}
+			},
+		},
+	}
+	for _, test := range tests {
+		bad := *ud
+		bad.LeafDatas = append([]wire.LeafData(nil), ud.LeafDatas...)
+		test.tamper(&bad.LeafDatas[0])
+		msgBlock := *nextBlock.MsgBlock()
+		msgBlock.UData = &bad
+
+		// The block is checked as a template since the proof of a
+		// block that's processed is verified before it's stored.
+		err := csnChain.CheckConnectBlockTemplate(btcutil.NewBlock(&msgBlock))
+		if err == nil {
+			t.Fatalf("%s: expected the block to be refused", test.name)
+		}
+		ruleErr, ok := err.(blockchain.RuleError)
+		if !ok || ruleErr.ErrorCode != blockchain.ErrUDataInvalid {
+			t.Fatalf("%s: expected the error of the proof, got %v",
+				test.name, err)
+		}
+		if !reflect.DeepEqual(csnChain.GetUtreexoView().GetRoots(), roots) {
+			t.Fatalf("%s: expected the accumulator to be left as it was",
+				test.name)
+		}
+	}
+
+	// The block still connects with its own proof.
+	_, _, err = csnChain.ProcessBlockWithUData(nextBlock, ud, blockchain.BFNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csnChain.BestSnapshot().Height != 20 {
+		t.Fatalf("expected the tip to be at height 20, got %d",
+			csnChain.BestSnapshot().Height)
+	}
+}
+
+// TestGenerateNonInclusionProof ensures that the non-inclusion proofs tell
+// outpoints that weren't created yet from the spent ones and that they're
+// refused for outpoints that are in the accumulator.
+func TestGenerateNonInclusionProof(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestGenerateNonInclusionProof", 1)
+	defer tearDown()
+
+	// The outputs created in every block are spent in the next one.
+	created := make(map[int32][]*blockchain.SpendableOut)
+	var nextSpends []*blockchain.SpendableOut
+	nextBlock := btcutil.NewBlock(params.GenesisBlock)
+	for height := int32(1); height <= 10; height++ {
+		nextBlock, nextSpends = blockchain.AddBlock(chain, nextBlock, nextSpends)
+		created[height] = nextSpends
+	}
+	spent := created[3][0].PrevOut
+	unspent := created[10][0].PrevOut
+
+	tests := []struct {
+		op          wire.OutPoint
+		height      int32
+		reason      NonInclusionReason
+		spendHeight int32
+		err         error
+	}{
+		{op: spent, height: 2, reason: NonInclusionNotCreated},
+		{op: spent, height: 3, err: ErrOutPointIncluded},
+		{op: spent, height: 4, reason: NonInclusionSpent, spendHeight: 4},
+		{op: spent, height: 10, reason: NonInclusionSpent, spendHeight: 4},
+		{op: unspent, height: 9, reason: NonInclusionNotCreated},
+		{op: unspent, height: 10, err: ErrOutPointIncluded},
+		{op: wire.OutPoint{Hash: chainhash.Hash{1}}, height: 10,
+			reason: NonInclusionNotCreated},
+	}
+	for _, test := range tests {
+		var proofs []*NonInclusionProof
+		for _, indexer := range indexes {
+			var proof *NonInclusionProof
+			var err error
+			switch idxType := indexer.(type) {
+			case *FlatUtreexoProofIndex:
+				proof, err = idxType.GenerateNonInclusionProof(test.op, test.height)
+			case *UtreexoProofIndex:
+				proof, err = idxType.GenerateNonInclusionProof(test.op, test.height)
+			default:
+				continue
+			}
+			if err != test.err {
+				t.Fatalf("%v at %d: expected error %v, got %v", test.op,
+					test.height, test.err, err)
+			}
+			if err != nil {
+				continue
+			}
+
+			if proof.Reason != test.reason ||
+				proof.SpendHeight != test.spendHeight {
+
+				t.Fatalf("%v at %d: expected %v at %d, got %v at %d",
+					test.op, test.height, test.reason,
+					test.spendHeight, proof.Reason, proof.SpendHeight)
+			}
+			if test.reason == NonInclusionSpent {
+				if proof.LeafData == nil || proof.LeafData.OutPoint != test.op ||
+					proof.LeafData.Height != 3 {
+
+					t.Fatalf("%v at %d: unexpected leaf %v", test.op,
+						test.height, proof.LeafData)
+				}
+				if len(proof.UData.LeafDatas) != len(proof.UData.AccProof.Targets) {
+					t.Fatalf("%v at %d: %d leaves for %d targets",
+						test.op, test.height,
+						len(proof.UData.LeafDatas),
+						len(proof.UData.AccProof.Targets))
+				}
+			}
+			proofs = append(proofs, proof)
+		}
+
+		// Both indexes make the same proofs.
+		if len(proofs) == 2 && !reflect.DeepEqual(proofs[0], proofs[1]) {
+			t.Fatalf("%v at %d: the indexes made different proofs",
+				test.op, test.height)
+		}
+	}
+
+	_, err := indexes[0].(*UtreexoProofIndex).GenerateNonInclusionProof(spent, 11)
+	if err == nil {
+		t.Fatal("expected an error for a height past the tip")
+	}
+}
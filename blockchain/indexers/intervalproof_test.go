@@ -0,0 +1,188 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+)
+
+// intervalSpends returns the outputs of the pool that the next block spends and
+// the ones that are left.  The given number of the oldest outputs are spent
+// along with the newest so that the blocks spend outputs that were created both
+// before and within the interval of the block.
+func intervalSpends(pool []*blockchain.SpendableOut, oldest int, newest bool) (
+	[]*blockchain.SpendableOut, []*blockchain.SpendableOut) {
+
+	var spends []*blockchain.SpendableOut
+	if newest && len(pool) > 0 {
+		spends = append(spends, pool[len(pool)-1])
+		pool = pool[:len(pool)-1]
+	}
+	for i := 0; i < oldest && len(pool) > 0; i++ {
+		spends = append(spends, pool[0])
+		pool = pool[1:]
+	}
+
+	return spends, pool
+}
+
+// intervalUnion returns the hashes of the leaves that the single-block proofs of
+// the utreexo proof index prove for the blocks of the interval that starts at
+// base, leaving out the ones that are created within the interval.
+func intervalUnion(chain *blockchain.BlockChain, idx *UtreexoProofIndex,
+	base, interval int32) ([]AccHash, error) {
+
+	var union []AccHash
+	for height := base; height < base+interval; height++ {
+		if height == 0 {
+			continue
+		}
+		block, err := chain.BlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		ud, err := idx.FetchUtreexoProof(block.Hash())
+		if err != nil {
+			return nil, err
+		}
+		hashes, err := blockchain.ReconstructUData(ud, block,
+			chain.BlockHashByHeight, idx.chainParams.LeafCommitments,
+			nil)
+		if err != nil {
+			return nil, err
+		}
+		for i, hash := range hashes {
+			if ud.LeafDatas[i].Height >= base {
+				continue
+			}
+			union = append(union, AccHash(hash))
+		}
+	}
+
+	return union, nil
+}
+
+// checkIntervalProof returns an error unless the multi-block proof of the
+// interval that starts at base proves the leaves that the single-block proofs
+// of the blocks of the interval prove.
+func checkIntervalProof(chain *blockchain.BlockChain, indexes []Indexer,
+	base, interval int32) ([]AccHash, error) {
+
+	multiUd, dels, err := indexes[1].(*FlatUtreexoProofIndex).FetchIntervalProof(base)
+	if err != nil {
+		return nil, err
+	}
+	union, err := intervalUnion(chain, indexes[0].(*UtreexoProofIndex),
+		base, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dels) != len(union) || (len(dels) > 0 && !reflect.DeepEqual(dels, union)) {
+		return nil, fmt.Errorf("interval %d: the multi-block proof proves "+
+			"%v but the single-block proofs prove %v", base, dels, union)
+	}
+	if len(multiUd.AccProof.Targets) != len(dels) {
+		return nil, fmt.Errorf("interval %d: %d targets for %d leaves",
+			base, len(multiUd.AccProof.Targets), len(dels))
+	}
+
+	return dels, nil
+}
+
+// TestIntervalProof ensures that the multi-block proof of every interval proves
+// the same leaves as the single-block proofs of its blocks and that a reorg that
+// crosses the end of an interval replaces its multi-block proof.
+func TestIntervalProof(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	const interval = 5
+	chain, indexes, params, tearDown := indexersTestChain("TestIntervalProof",
+		interval)
+	defer tearDown()
+	flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var pool, spends []*blockchain.SpendableOut
+	pools := make(map[int32][]*blockchain.SpendableOut)
+	blocks := make(map[int32]*btcutil.Block)
+	for height := int32(1); height <= 4*interval; height++ {
+		spends, pool = intervalSpends(pool, 2, height%2 == 0)
+		var outs []*blockchain.SpendableOut
+		tip, outs = blockchain.AddBlock(chain, tip, spends)
+		pool = append(pool[:len(pool):len(pool)], outs...)
+		pools[height] = pool
+		blocks[height] = tip
+	}
+
+	var before []AccHash
+	for base := int32(0); base < 4*interval; base += interval {
+		dels, err := checkIntervalProof(chain, indexes, base, interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if base == 3*interval {
+			before = dels
+		}
+	}
+	if len(before) == 0 {
+		t.Fatal("the last interval doesn't spend any outputs created " +
+			"before it")
+	}
+
+	// The interval that isn't over yet doesn't have a multi-block proof and
+	// the heights in the middle of an interval don't start one.
+	_, _, err := flatIdx.FetchIntervalProof(4 * interval)
+	if err == nil {
+		t.Fatal("expected no multi-block proof for the unfinished interval")
+	}
+	_, _, err = flatIdx.FetchIntervalProof(interval + 1)
+	if err == nil {
+		t.Fatal("expected an error for a height that doesn't start an " +
+			"interval")
+	}
+
+	// Reorg out the last two blocks of the last interval with a longer
+	// chain whose blocks spend more of the oldest outputs so that the
+	// interval spends different outputs created before it.
+	forkHeight := int32(4*interval - 2)
+	altTip := blocks[forkHeight]
+	pool = pools[forkHeight]
+	for altTip.Height() < 4*interval+1 {
+		spends, pool = intervalSpends(pool, 3, false)
+		var outs []*blockchain.SpendableOut
+		altTip, outs = blockchain.AddBlock(chain, altTip, spends)
+		pool = append(pool[:len(pool):len(pool)], outs...)
+	}
+	best := chain.BestSnapshot()
+	if best.Hash != *altTip.Hash() {
+		t.Fatalf("expected the chain to reorg to height %d, got %d",
+			altTip.Height(), best.Height)
+	}
+
+	after, err := checkIntervalProof(chain, indexes, 3*interval, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(before, after) {
+		t.Fatal("expected the reorg to replace the multi-block proof of " +
+			"the last interval")
+	}
+
+	// The intervals before the fork are left alone.
+	for base := int32(0); base < 3*interval; base += interval {
+		_, err := checkIntervalProof(chain, indexes, base, interval)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
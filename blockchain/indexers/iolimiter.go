@@ -0,0 +1,128 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"sync"
+	"time"
+)
+
+// IOLimiter limits the rate of disk I/O done by background index maintenance
+// such as catching up and dropping the indexes so that it doesn't degrade the
+// latency of serving data to peers and RPC clients.  Foreground fetches don't go
+// through the limiter.
+//
+// The rate is limited in bytes per second and in operations per second.  Up to
+// a second worth of I/O may be done in a burst.
+//
+// A nil IOLimiter doesn't limit anything.
+type IOLimiter struct {
+	// mtx protects all the fields below.
+	mtx sync.Mutex
+
+	// bytesPerSec and opsPerSec are the rates that the I/O is limited to.
+	// A rate of 0 is not limited.
+	bytesPerSec float64
+	opsPerSec   float64
+
+	// bytes and ops are the amounts that may be used right now.  They go
+	// negative when a request bigger than what's available is reserved.
+	bytes float64
+	ops   float64
+
+	// last is when bytes and ops were last refilled.
+	last time.Time
+
+	// waited is the total duration that the callers were throttled for.
+	waited time.Duration
+}
+
+// NewIOLimiter returns a new IOLimiter that limits the I/O to the given bytes
+// and operations per second.  A rate of 0 is not limited.
+func NewIOLimiter(bytesPerSec, opsPerSec uint64) *IOLimiter {
+	return &IOLimiter{
+		bytesPerSec: float64(bytesPerSec),
+		opsPerSec:   float64(opsPerSec),
+		bytes:       float64(bytesPerSec),
+		ops:         float64(opsPerSec),
+		last:        time.Now(),
+	}
+}
+
+// reserve reserves the given operations and bytes and returns how long the
+// caller must wait before doing them.
+func (l *IOLimiter) reserve(now time.Time, ops, bytes uint64) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	elapsed := now.Sub(l.last).Seconds()
+	if elapsed > 0 {
+		l.last = now
+	}
+
+	var wait time.Duration
+	take := func(avail *float64, rate, amount float64) {
+		if rate == 0 {
+			return
+		}
+		if elapsed > 0 {
+			*avail += elapsed * rate
+			if *avail > rate {
+				*avail = rate
+			}
+		}
+		*avail -= amount
+		if *avail < 0 {
+			d := time.Duration(-*avail * float64(time.Second) / rate)
+			if d > wait {
+				wait = d
+			}
+		}
+	}
+	take(&l.bytes, l.bytesPerSec, float64(bytes))
+	take(&l.ops, l.opsPerSec, float64(ops))
+
+	l.waited += wait
+	return wait
+}
+
+// Wait blocks until the given operations and bytes of I/O may be done.  It
+// returns early with errInterruptRequested if the interrupt channel is closed.
+//
+// This function is safe for concurrent access.
+func (l *IOLimiter) Wait(ops, bytes uint64, interrupt <-chan struct{}) error {
+	if l == nil {
+		return nil
+	}
+
+	wait := l.reserve(time.Now(), ops, bytes)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-interrupt:
+		return errInterruptRequested
+	}
+}
+
+// Waited returns the total duration that the callers were throttled for.
+//
+// This function is safe for concurrent access.
+func (l *IOLimiter) Waited() time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.waited
+}
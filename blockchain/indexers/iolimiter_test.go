@@ -0,0 +1,77 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIOLimiterReserve(t *testing.T) {
+	l := NewIOLimiter(1000, 10)
+	now := l.last
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		ops     uint64
+		bytes   uint64
+		want    time.Duration
+	}{
+		// A second worth of I/O is available right away.
+		{"burst", 0, 1, 1000, 0},
+
+		// The bytes are used up so the caller waits for them.
+		{"bytes limited", 0, 1, 500, 500 * time.Millisecond},
+
+		// Half a second refills 500 bytes which pays back the debt.
+		// The ops are refilled up to 10 so 9 are left afterwards.
+		{"refilled", 500 * time.Millisecond, 1, 0, 0},
+
+		// The 2 ops over what's left need a fifth of a second.
+		{"ops limited", 0, 11, 0, 200 * time.Millisecond},
+
+		// The refill never goes above a second worth of I/O.
+		{"capped", time.Hour, 10, 1000, 0},
+		{"capped limited", 0, 1, 0, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		now = now.Add(test.elapsed)
+		got := l.reserve(now, test.ops, test.bytes)
+		if got != test.want {
+			t.Fatalf("%s: expected a wait of %v, got %v", test.name,
+				test.want, got)
+		}
+	}
+
+	if waited := l.Waited(); waited != 800*time.Millisecond {
+		t.Fatalf("expected %v waited, got %v", 800*time.Millisecond, waited)
+	}
+}
+
+func TestIOLimiterWait(t *testing.T) {
+	// A nil limiter doesn't limit anything.
+	var l *IOLimiter
+	if err := l.Wait(1, 1<<30, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rate of 0 isn't limited.
+	l = NewIOLimiter(0, 0)
+	if err := l.Wait(1<<30, 1<<30, nil); err != nil {
+		t.Fatal(err)
+	}
+	if waited := l.Waited(); waited != 0 {
+		t.Fatalf("expected no wait, got %v", waited)
+	}
+
+	// The wait returns early on an interrupt.
+	l = NewIOLimiter(1, 0)
+	interrupt := make(chan struct{})
+	close(interrupt)
+	if err := l.Wait(1, 3600, interrupt); err != errInterruptRequested {
+		t.Fatalf("expected %v, got %v", errInterruptRequested, err)
+	}
+}
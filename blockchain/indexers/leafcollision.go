@@ -0,0 +1,142 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// defaultLeafCollisionSampleRate is how many of the leaves added to
+	// the accumulator are added for every one that's checked against the
+	// leaves already in it by default.
+	defaultLeafCollisionSampleRate = 64
+)
+
+// ErrLeafHashCollision is the error that's wrapped when a leaf added to the
+// accumulator has the same leaf hash as another leaf of a different outpoint.
+var ErrLeafHashCollision = errors.New("utreexo leaf hash collision")
+
+// LeafCollisionError describes a leaf whose leaf hash is the same as the one of
+// a leaf of another outpoint.  The proofs for either of them would verify while
+// referring to the other one.
+type LeafCollisionError struct {
+	// Height is the height of the block that added the leaf.
+	Height int32
+
+	// Hash is the leaf hash that collided.
+	Hash AccHash
+
+	// OutPoint is the outpoint of the leaf that was added.
+	OutPoint wire.OutPoint
+
+	// Other is the outpoint of the leaf it collided with.  It's nil if the
+	// collision was found against the accumulator, which doesn't keep
+	// the outpoints of its leaves.
+	Other *wire.OutPoint
+}
+
+// Error returns the error as a human-readable string.
+func (e *LeafCollisionError) Error() string {
+	other := "a leaf already in the accumulator"
+	if e.Other != nil {
+		other = e.Other.String()
+	}
+
+	return fmt.Sprintf("%v: the leaf of %v added at height %d has the "+
+		"same leaf hash %x as %s", ErrLeafHashCollision, e.OutPoint,
+		e.Height, e.Hash[:], other)
+}
+
+// Is returns true for ErrLeafHashCollision.
+func (e *LeafCollisionError) Is(target error) bool {
+	return target == ErrLeafHashCollision
+}
+
+// leafFinder is the part of the accumulator that's able to tell whether a leaf
+// hash is in it.
+type leafFinder interface {
+	FindLeaf(leaf accumulator.Hash) bool
+}
+
+// leafCollisionChecker checks that the leaves added to the accumulator never
+// share a leaf hash with another leaf.  Two leaves only share a leaf hash if
+// their leaf data serializes the same, which it never does for different
+// outpoints, so a collision means the leaf data or its serialization is
+// broken.
+//
+// The leaves added by a block are checked against each other and against the
+// leaves it deletes exactly.  Every sampleRate-th added leaf is also looked up
+// in the accumulator.  The accumulator finds its leaves by the first 12 bytes
+// of their hashes, so those are what's checked against all of its leaves.
+type leafCollisionChecker struct {
+	// sampleRate is how many added leaves there are for every one checked
+	// against the accumulator.  The accumulator isn't checked if it's 0.
+	sampleRate uint64
+
+	// added counts the leaves added so far to pick the sampled ones.
+	added uint64
+}
+
+// check returns a corruption error with a LeafCollisionError if any of the
+// leaves added by the block at the given height collide with another leaf.
+// addOutPoints are the outpoints of the added leaves, dels the leaf datas of
+// the leaves deleted by the block, and delHashes the hashes of the leaf datas.
+//
+// The accumulator MUST NOT be modified by the block yet and MUST NOT be
+// modified during the check.
+func (c *leafCollisionChecker) check(height int32, adds []accumulator.Leaf,
+	addOutPoints []wire.OutPoint, dels []wire.LeafData,
+	delHashes []accumulator.Hash, acc leafFinder) error {
+
+	seen := make(map[accumulator.Hash]wire.OutPoint, len(adds)+len(dels))
+	for i := range dels {
+		if dels[i].IsUnconfirmed() {
+			continue
+		}
+		seen[delHashes[i]] = dels[i].OutPoint
+	}
+
+	for i, add := range adds {
+		outPoint := addOutPoints[i]
+		if other, ok := seen[add.Hash]; ok && other != outPoint {
+			return leafCollisionError(&LeafCollisionError{
+				Height:   height,
+				Hash:     AccHash(add.Hash),
+				OutPoint: outPoint,
+				Other:    &other,
+			})
+		}
+		seen[add.Hash] = outPoint
+
+		c.added++
+		if c.sampleRate == 0 || c.added%c.sampleRate != 0 {
+			continue
+		}
+		if acc.FindLeaf(add.Hash) {
+			return leafCollisionError(&LeafCollisionError{
+				Height:   height,
+				Hash:     AccHash(add.Hash),
+				OutPoint: outPoint,
+			})
+		}
+	}
+
+	return nil
+}
+
+// leafCollisionError returns the collision as a database corruption error.
+func leafCollisionError(collision *LeafCollisionError) error {
+	return database.Error{
+		ErrorCode:   database.ErrCorruption,
+		Description: "utreexo accumulator leaf collision",
+		Err:         collision,
+	}
+}
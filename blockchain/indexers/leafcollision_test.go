@@ -0,0 +1,130 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// fakeLeafFinder finds only the leaf hashes it holds.
+type fakeLeafFinder map[accumulator.Hash]bool
+
+func (f fakeLeafFinder) FindLeaf(leaf accumulator.Hash) bool {
+	return f[leaf]
+}
+
+func TestLeafCollisionChecker(t *testing.T) {
+	outPoint := func(i uint32) wire.OutPoint {
+		return wire.OutPoint{Hash: chainhash.Hash{1}, Index: i}
+	}
+	del := wire.LeafData{
+		BlockHash: chainhash.Hash{2},
+		OutPoint:  outPoint(9),
+		Height:    5,
+		Amount:    1000,
+		PkScript:  []byte{0x51},
+	}
+	delHash := accumulator.Hash(del.LeafHash())
+	unconfirmed := del
+	unconfirmed.SetUnconfirmed()
+
+	tests := []struct {
+		name       string
+		adds       []accumulator.Hash
+		dels       []wire.LeafData
+		live       fakeLeafFinder
+		sampleRate uint64
+		wantHash   accumulator.Hash
+		wantOther  *wire.OutPoint
+		wantErr    bool
+	}{
+		{
+			name: "distinct",
+			adds: []accumulator.Hash{{1}, {2}, {3}},
+			dels: []wire.LeafData{del},
+		},
+		{
+			name:      "same hash for two outputs",
+			adds:      []accumulator.Hash{{1}, {2}, {1}},
+			wantHash:  accumulator.Hash{1},
+			wantOther: &wire.OutPoint{Hash: chainhash.Hash{1}, Index: 0},
+			wantErr:   true,
+		},
+		{
+			name:      "same hash as a spent leaf",
+			adds:      []accumulator.Hash{{1}, delHash},
+			dels:      []wire.LeafData{del},
+			wantHash:  delHash,
+			wantOther: &wire.OutPoint{Hash: chainhash.Hash{1}, Index: 9},
+			wantErr:   true,
+		},
+		{
+			name: "unconfirmed spent leaf",
+			adds: []accumulator.Hash{{1}, delHash},
+			dels: []wire.LeafData{unconfirmed},
+		},
+		{
+			name:       "already in the accumulator",
+			adds:       []accumulator.Hash{{1}, {2}, {3}, {4}},
+			live:       fakeLeafFinder{{4}: true},
+			sampleRate: 2,
+			wantHash:   accumulator.Hash{4},
+			wantErr:    true,
+		},
+		{
+			name:       "in the accumulator but not sampled",
+			adds:       []accumulator.Hash{{1}, {2}, {3}},
+			live:       fakeLeafFinder{{3}: true},
+			sampleRate: 2,
+		},
+	}
+	for _, test := range tests {
+		adds := make([]accumulator.Leaf, len(test.adds))
+		addOutPoints := make([]wire.OutPoint, len(test.adds))
+		for i, hash := range test.adds {
+			adds[i] = accumulator.Leaf{Hash: hash}
+			addOutPoints[i] = outPoint(uint32(i))
+		}
+
+		c := &leafCollisionChecker{sampleRate: test.sampleRate}
+		ud := &wire.UData{LeafDatas: test.dels}
+		err := c.check(7, adds, addOutPoints, test.dels,
+			ud.StxoHashes(nil), test.live)
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+
+		var dbErr database.Error
+		if !errors.As(err, &dbErr) || dbErr.ErrorCode != database.ErrCorruption {
+			t.Errorf("%s: expected a corruption error, got %v",
+				test.name, err)
+			continue
+		}
+		collision, ok := dbErr.Err.(*LeafCollisionError)
+		if !ok || !errors.Is(collision, ErrLeafHashCollision) {
+			t.Errorf("%s: expected a LeafCollisionError, got %v",
+				test.name, dbErr.Err)
+			continue
+		}
+		if collision.Height != 7 || collision.Hash != AccHash(test.wantHash) {
+			t.Errorf("%s: unexpected collision %v", test.name, collision)
+		}
+		if (collision.Other == nil) != (test.wantOther == nil) ||
+			(collision.Other != nil && *collision.Other != *test.wantOther) {
+
+			t.Errorf("%s: expected the other outpoint %v, got %v",
+				test.name, test.wantOther, collision.Other)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// leafEligibilitySize is the size of a recorded leaf eligibility summary.  It's
+// the leaf eligibility version, the number of ineligible outputs, and the
+// number of execution dependent decisions.
+const leafEligibilitySize = 4 + 4 + 4
+
+// leafEligibilityBucketKey is the key of the bucket in the bucket of a utreexo
+// proof index that keeps the leaf eligibility summary of every connected block
+// by its hash.
+var leafEligibilityBucketKey = []byte("leafeligibility")
+
+// serializeLeafEligibility returns the leaf eligibility summary serialized to be
+// stored.
+func serializeLeafEligibility(summary *blockchain.BlockEligibility) []byte {
+	serialized := make([]byte, leafEligibilitySize)
+	byteOrder.PutUint32(serialized[0:4], summary.Version)
+	byteOrder.PutUint32(serialized[4:8], summary.Ineligible)
+	byteOrder.PutUint32(serialized[8:12], summary.ExecutionDependent)
+	return serialized
+}
+
+// dbPutLeafEligibility records the leaf eligibility summary of the block with
+// the given hash for the index with the given key.
+func dbPutLeafEligibility(dbTx database.Tx, idxKey []byte, hash *chainhash.Hash,
+	summary *blockchain.BlockEligibility) error {
+
+	bucket, err := dbTx.Metadata().Bucket(idxKey).CreateBucketIfNotExists(
+		leafEligibilityBucketKey)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(hash[:], serializeLeafEligibility(summary))
+}
+
+// dbFetchLeafEligibility returns the leaf eligibility summary that the index
+// with the given key recorded for the block with the given hash.  It's nil if
+// none was recorded, like for blocks connected before the summaries were.
+func dbFetchLeafEligibility(dbTx database.Tx, idxKey []byte,
+	hash *chainhash.Hash) (*blockchain.BlockEligibility, error) {
+
+	bucket := dbTx.Metadata().Bucket(idxKey).Bucket(leafEligibilityBucketKey)
+	if bucket == nil {
+		return nil, nil
+	}
+	serialized := bucket.Get(hash[:])
+	if serialized == nil {
+		return nil, nil
+	}
+	if len(serialized) != leafEligibilitySize {
+		return nil, database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("corrupt leaf eligibility of "+
+				"block %v. Expected %d bytes but got %d", hash,
+				leafEligibilitySize, len(serialized)),
+		}
+	}
+
+	return &blockchain.BlockEligibility{
+		Version:            byteOrder.Uint32(serialized[0:4]),
+		Ineligible:         byteOrder.Uint32(serialized[4:8]),
+		ExecutionDependent: byteOrder.Uint32(serialized[8:12]),
+	}, nil
+}
+
+// dbDeleteLeafEligibility removes the leaf eligibility summary that the index
+// with the given key recorded for the block with the given hash.
+func dbDeleteLeafEligibility(dbTx database.Tx, idxKey []byte,
+	hash *chainhash.Hash) error {
+
+	bucket := dbTx.Metadata().Bucket(idxKey).Bucket(leafEligibilityBucketKey)
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.Delete(hash[:])
+}
+
+// checkLeafEligibility returns the leaf eligibility summary of the block that's
+// about to be connected to the index with the given key and name.  An
+// AssertError is returned if any of the decisions depended on executing a
+// script, or if the parent of the block was connected under another leaf
+// eligibility version, as either makes the accumulator of the index
+// incompatible with ones of nodes that verify scripts differently.
+func checkLeafEligibility(dbTx database.Tx, idxKey []byte, name string,
+	block *btcutil.Block) (*blockchain.BlockEligibility, error) {
+
+	summary := blockchain.BlockLeafEligibility(block)
+	if summary.ExecutionDependent > 0 {
+		return nil, AssertError(fmt.Sprintf("%s: %d of the leaf "+
+			"eligibility decisions for block %v at height %d "+
+			"depended on script execution", name,
+			summary.ExecutionDependent, block.Hash(), block.Height()))
+	}
+
+	parentHash := &block.MsgBlock().Header.PrevBlock
+	parent, err := dbFetchLeafEligibility(dbTx, idxKey, parentHash)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		return &summary, nil
+	}
+	if parent.ExecutionDependent > 0 {
+		return nil, AssertError(fmt.Sprintf("%s: block %v was "+
+			"recorded with %d leaf eligibility decisions that "+
+			"depended on script execution", name, parentHash,
+			parent.ExecutionDependent))
+	}
+	if parent.Version != summary.Version {
+		return nil, AssertError(fmt.Sprintf("%s: block %v was "+
+			"connected under leaf eligibility version %d but block "+
+			"%v at height %d is under version %d.  The index must "+
+			"be rebuilt", name, parentHash, parent.Version,
+			block.Hash(), block.Height(), summary.Version))
+	}
+
+	return &summary, nil
+}
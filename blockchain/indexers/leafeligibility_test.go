@@ -0,0 +1,259 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// spendOutputBlock returns a block succeeding parent with a transaction that
+// spends the output at the given outpoint with an empty signature script.
+func spendOutputBlock(t *testing.T, params *chaincfg.Params,
+	parent *btcutil.Block, prevOut wire.OutPoint) *btcutil.Block {
+
+	height := parent.Height() + 1
+	coinbaseScript, err := txscript.NewScriptBuilder().
+		AddInt64(int64(height)).AddInt64(0).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+			wire.MaxPrevOutIndex),
+		Sequence:        wire.MaxTxInSequenceNum,
+		SignatureScript: coinbaseScript,
+	})
+	coinbase.AddTxOut(wire.NewTxOut(blockchain.CalcBlockSubsidy(height,
+		params), []byte{txscript.OP_TRUE}))
+
+	spend := wire.NewMsgTx(1)
+	spend.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: prevOut,
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	spend.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_TRUE}))
+
+	txns := []*btcutil.Tx{btcutil.NewTx(coinbase), btcutil.NewTx(spend)}
+	merkles := blockchain.BuildMerkleTreeStore(txns, false)
+	block := btcutil.NewBlock(&wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:    1,
+			PrevBlock:  *parent.Hash(),
+			MerkleRoot: *merkles[len(merkles)-1],
+			Bits:       params.PowLimitBits,
+			Timestamp:  parent.MsgBlock().Header.Timestamp.Add(time.Second),
+		},
+		Transactions: []*wire.MsgTx{coinbase, spend},
+	})
+	block.SetHeight(height)
+	if !blockchain.SolveBlock(&block.MsgBlock().Header) {
+		t.Fatalf("unable to solve block at height %d", height)
+	}
+
+	return block
+}
+
+// utreexoRoots returns the roots of the accumulator of the utreexo proof index.
+func utreexoRoots(indexer Indexer) interface{} {
+	switch idx := indexer.(type) {
+	case *UtreexoProofIndex:
+		idx.mtx.RLock()
+		defer idx.mtx.RUnlock()
+		return idx.utreexoState.state.GetRoots()
+
+	case *FlatUtreexoProofIndex:
+		idx.mtx.RLock()
+		defer idx.mtx.RUnlock()
+		return idx.utreexoState.state.GetRoots()
+	}
+
+	return nil
+}
+
+// TestLeafEligibilityAssumeValid ensures that a chain that skips the scripts of
+// the blocks below its checkpoint and a chain that runs them make the same
+// leaves of outputs that are unspendable only once their scripts are executed,
+// and that the indexes record that none of the decisions depended on script
+// execution.
+func TestLeafEligibilityAssumeValid(t *testing.T) {
+	t.Parallel()
+
+	verifying, verifyingIndexes, params, tearDown := indexersTestChain(
+		"TestLeafEligibilityAssumeValid-verifying", 1)
+	defer tearDown()
+
+	// The checkpoint is far above the blocks of the test so that none of
+	// their scripts are run.
+	assumeValidParams := chaincfg.RegressionNetParams
+	assumeValidParams.CoinbaseMaturity = 1
+	checkpoints := []chaincfg.Checkpoint{{Height: 1000, Hash: &chainhash.Hash{}}}
+	assumeValid, assumeValidIndexes, _, tearDownAssumeValid :=
+		indexersTestChainWithCheckpoints(
+			"TestLeafEligibilityAssumeValid-assumevalid", 1,
+			&assumeValidParams, checkpoints)
+	defer tearDownAssumeValid()
+
+	processBoth := func(block *btcutil.Block) {
+		t.Helper()
+		for _, chain := range []*blockchain.BlockChain{verifying, assumeValid} {
+			_, _, err := chain.ProcessBlock(block, blockchain.BFNone)
+			if err != nil {
+				t.Fatalf("block at height %d: %v", block.Height(), err)
+			}
+		}
+	}
+
+	// The OP_RETURN of takenReturn is executed so spending it fails while
+	// the one of skippedReturn isn't.  Neither is decided to be ineligible
+	// by it and neither is unparseable.
+	takenReturn := []byte{txscript.OP_TRUE, txscript.OP_IF,
+		txscript.OP_RETURN, txscript.OP_ENDIF}
+	skippedReturn := []byte{txscript.OP_FALSE, txscript.OP_IF,
+		txscript.OP_RETURN, txscript.OP_ENDIF, txscript.OP_TRUE}
+	unparseable := []byte{txscript.OP_PUSHDATA1}
+	nullData := []byte{txscript.OP_RETURN, txscript.OP_DATA_1, 0x42}
+
+	// AddBlock processes the first block on the verifying chain.
+	first, spendables := blockchain.AddBlock(verifying,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	_, _, err := assumeValid.ProcessBlock(first, blockchain.BFNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crafted, _, err := blockchain.GenerateBlockFromSpec(verifying, first,
+		spendables, blockchain.BlockSpec{
+			NumTxs:       1,
+			InputsPerTx:  1,
+			OutputsPerTx: 2,
+			CraftedScripts: [][]byte{takenReturn, skippedReturn,
+				unparseable, nullData},
+		}, 242)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processBoth(crafted)
+
+	// The crafted outputs come right after the subsidy in the coinbase.
+	coinbaseHash := crafted.MsgBlock().Transactions[0].TxHash()
+	spendSkipped := spendOutputBlock(t, params, crafted,
+		wire.OutPoint{Hash: coinbaseHash, Index: 2})
+	processBoth(spendSkipped)
+
+	for i, indexes := range [][]Indexer{verifyingIndexes, assumeValidIndexes} {
+		for j, indexer := range indexes {
+			want := utreexoRoots(verifyingIndexes[0])
+			if got := utreexoRoots(indexer); !reflect.DeepEqual(got, want) {
+				t.Fatalf("chain %d index %s: roots %v, want %v",
+					i, indexer.Name(), got, want)
+			}
+
+			db := indexes[0].(*UtreexoProofIndex).db
+			err := db.View(func(dbTx database.Tx) error {
+				summary, err := dbFetchLeafEligibility(dbTx,
+					indexer.Key(), crafted.Hash())
+				if err != nil {
+					return err
+				}
+				want := &blockchain.BlockEligibility{
+					Version:    blockchain.LeafEligibilityVersion,
+					Ineligible: 1,
+				}
+				if !reflect.DeepEqual(summary, want) {
+					t.Fatalf("chain %d index %d: leaf eligibility "+
+						"%+v, want %+v", i, j, summary, want)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Only the chain that runs the scripts rejects spending the output
+	// whose OP_RETURN is executed.
+	spendTaken := spendOutputBlock(t, params, spendSkipped,
+		wire.OutPoint{Hash: coinbaseHash, Index: 1})
+	_, _, err = verifying.ProcessBlock(spendTaken, blockchain.BFNone)
+	var ruleErr blockchain.RuleError
+	if !errors.As(err, &ruleErr) ||
+		ruleErr.ErrorCode != blockchain.ErrScriptValidation {
+
+		t.Fatalf("verifying chain: expected a script validation error "+
+			"but got %v", err)
+	}
+	_, _, err = assumeValid.ProcessBlock(spendTaken, blockchain.BFNone)
+	if err != nil {
+		t.Fatalf("assumevalid chain: %v", err)
+	}
+}
+
+// TestLeafEligibilityVersionMismatch ensures that connecting a block on top of
+// one that was connected under another leaf eligibility version fails loudly.
+func TestLeafEligibilityVersionMismatch(t *testing.T) {
+	t.Parallel()
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestLeafEligibilityVersionMismatch", 1)
+	defer tearDown()
+
+	tip, spendables := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	next, _, err := blockchain.GenerateBlockFromSpec(chain, tip,
+		spendables, blockchain.BlockSpec{NumTxs: 1, InputsPerTx: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := indexes[0].(*UtreexoProofIndex).db
+	for _, indexer := range indexes {
+		err := db.Update(func(dbTx database.Tx) error {
+			// The recorded summary of the tip allows the next block.
+			_, err := checkLeafEligibility(dbTx, indexer.Key(),
+				indexer.Name(), next)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", indexer.Name(), err)
+			}
+
+			return dbPutLeafEligibility(dbTx, indexer.Key(), tip.Hash(),
+				&blockchain.BlockEligibility{
+					Version: blockchain.LeafEligibilityVersion + 1,
+				})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.View(func(dbTx database.Tx) error {
+			_, err := checkLeafEligibility(dbTx, indexer.Key(),
+				indexer.Name(), next)
+			return err
+		})
+		var assertErr AssertError
+		if !errors.As(err, &assertErr) {
+			t.Fatalf("%s: expected an assertion error but got %v",
+				indexer.Name(), err)
+		}
+	}
+
+	// Connecting the block fails with the mismatch.
+	_, _, err = chain.ProcessBlock(next, blockchain.BFNone)
+	if err == nil {
+		t.Fatal("expected the block to fail to connect")
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+const (
+	// leafLimitApproachDivisor is the fraction of the most leaves that a
+	// forest can hold on the platform that is left once the forest is
+	// considered to approach the limit.  The forest approaches it once it
+	// holds all but an eighth of them.
+	leafLimitApproachDivisor = 8
+)
+
+var (
+	// ErrPositionOverflow is matched by errors.Is for a PositionOverflowError.
+	ErrPositionOverflow = errors.New("position overflows int")
+
+	// ErrLeafLimit is matched by errors.Is for a LeafLimitError.
+	ErrLeafLimit = errors.New("forest approaches the platform leaf limit")
+)
+
+// PositionOverflowError is returned instead of silently truncating a position
+// or a leaf count of the forest that doesn't fit into the ints that index its
+// storage on the platform.
+type PositionOverflowError struct {
+	// What is what overflowed, such as a position of a block's proof.
+	What string
+
+	// Value is the value that overflowed and Limit is the largest value
+	// that doesn't.
+	Value uint64
+	Limit uint64
+
+	// IntBits is the size of an int of the platform in bits.
+	IntBits int
+}
+
+// Error returns the error as a human-readable string.
+func (e *PositionOverflowError) Error() string {
+	return fmt.Sprintf("%s %d overflows the %d-bit ints of the platform "+
+		"(limit %d)", e.What, e.Value, e.IntBits, e.Limit)
+}
+
+// Is returns whether the target is ErrPositionOverflow.
+func (e *PositionOverflowError) Is(target error) bool {
+	return target == ErrPositionOverflow
+}
+
+// LeafLimitError is returned when a utreexo proof index is started with a
+// forest that approaches the most leaves that it can hold on the platform.
+type LeafLimitError struct {
+	// Index is the name of the index.
+	Index string
+
+	// NumLeaves is the number of leaves of the forest and MaxLeaves is the
+	// most that it can hold.
+	NumLeaves uint64
+	MaxLeaves uint64
+
+	// IntBits is the size of an int of the platform in bits.
+	IntBits int
+}
+
+// Error returns the error as a human-readable string.
+func (e *LeafLimitError) Error() string {
+	return fmt.Sprintf("the forest of the %s holds %d of the %d leaves that "+
+		"its storage can address with %d-bit ints; refusing to run "+
+		"(start with --utreexoleaflimitwarn to run anyway)", e.Index,
+		e.NumLeaves, e.MaxLeaves, e.IntBits)
+}
+
+// Is returns whether the target is ErrLeafLimit.
+func (e *LeafLimitError) Is(target error) bool {
+	return target == ErrLeafLimit
+}
+
+// maxPlatformInt returns the largest int of a platform whose ints have the
+// given number of bits.
+func maxPlatformInt(intBits int) uint64 {
+	return 1<<(intBits-1) - 1
+}
+
+// checkedInt converts v into an int of a platform whose ints have the given
+// number of bits.  A PositionOverflowError is returned if it doesn't fit.
+// intBits must not be more than the bits of an int of this platform.
+func checkedInt(v uint64, intBits int, what string) (int, error) {
+	limit := maxPlatformInt(intBits)
+	if v > limit {
+		return 0, &PositionOverflowError{
+			What:    what,
+			Value:   v,
+			Limit:   limit,
+			IntBits: intBits,
+		}
+	}
+
+	return int(v), nil
+}
+
+// storageOffset returns the offset of the node at the given position in the
+// storage of a forest of the given type as an int of a platform whose ints
+// have the given number of bits.
+func storageOffset(forestType ForestType, pos uint64, intBits int) (int, error) {
+	nodeBytes := forestSizeMultiple(forestType) * forestNodeSize
+	if pos > maxPlatformInt(intBits)/nodeBytes {
+		return 0, &PositionOverflowError{
+			What:    "position",
+			Value:   pos,
+			Limit:   maxPlatformInt(intBits) / nodeBytes,
+			IntBits: intBits,
+		}
+	}
+
+	return checkedInt(pos*nodeBytes, intBits, "storage offset")
+}
+
+// maxForestLeaves returns the most leaves that a forest of the given type can
+// hold on a platform whose ints have the given number of bits.  A forest that
+// has room for 2^n leaves has 2^(n+1) - 1 nodes, and the offsets of all of them
+// into its storage have to fit into an int.
+func maxForestLeaves(forestType ForestType, intBits int) uint64 {
+	nodes := maxPlatformInt(intBits) /
+		(forestSizeMultiple(forestType) * forestNodeSize)
+
+	// The largest n for which 2^(n+1) - 1 <= nodes.
+	rows := bits.Len64(nodes+1) - 2
+	if rows < 0 {
+		return 0
+	}
+	return 1 << uint(rows)
+}
+
+// leafLimit keeps the forest of a utreexo proof index within the most leaves
+// that its storage can address on the platform.
+type leafLimit struct {
+	index      string
+	forestType ForestType
+	intBits    int
+
+	mtx      sync.Mutex
+	warnOnly bool
+	warned   bool
+}
+
+// newLeafLimit returns the leafLimit of the given utreexo state of the index
+// with the given name on this platform.
+func newLeafLimit(index string, uState *UtreexoState) *leafLimit {
+	return &leafLimit{
+		index:      index,
+		forestType: uState.config.Type,
+		intBits:    bits.UintSize,
+	}
+}
+
+// setWarnOnly sets whether starting with a forest that approaches the limit
+// is only warned about instead of refused.
+//
+// This function is safe for concurrent access.
+func (l *leafLimit) setWarnOnly(warnOnly bool) {
+	l.mtx.Lock()
+	l.warnOnly = warnOnly
+	l.mtx.Unlock()
+}
+
+// maxLeaves returns the most leaves that the forest can hold.
+func (l *leafLimit) maxLeaves() uint64 {
+	return maxForestLeaves(l.forestType, l.intBits)
+}
+
+// headroom returns the most leaves that the forest can hold and how many more
+// leaves a forest with the given number of them can take.
+func (l *leafLimit) headroom(numLeaves uint64) (uint64, uint64) {
+	limit := l.maxLeaves()
+	if numLeaves >= limit {
+		return limit, 0
+	}
+	return limit, limit - numLeaves
+}
+
+// approaching returns whether a forest with the given number of leaves
+// approaches the limit.
+func (l *leafLimit) approaching(numLeaves uint64) bool {
+	limit := l.maxLeaves()
+	return numLeaves >= limit-limit/leafLimitApproachDivisor
+}
+
+// checkStart returns a LeafLimitError if the forest that the index was started
+// with approaches the limit, unless it's only to be warned about.
+//
+// This function is safe for concurrent access.
+func (l *leafLimit) checkStart(numLeaves uint64) error {
+	if !l.approaching(numLeaves) {
+		return nil
+	}
+
+	err := &LeafLimitError{
+		Index:     l.index,
+		NumLeaves: numLeaves,
+		MaxLeaves: l.maxLeaves(),
+		IntBits:   l.intBits,
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if !l.warnOnly {
+		return err
+	}
+	log.Warnf("The forest of the %s holds %d of the %d leaves that its "+
+		"storage can address with %d-bit ints.  It will stop connecting "+
+		"blocks once it's full", l.index, numLeaves, err.MaxLeaves,
+		l.intBits)
+	l.warned = true
+
+	return nil
+}
+
+// checkModify returns a PositionOverflowError if a block that adds the given
+// number of leaves to a forest with the given number of them and deletes the
+// leaves at the targets would take the forest past the limit.  It's checked
+// before the forest is modified so that the forest is left untouched.
+//
+// This function is safe for concurrent access.
+func (l *leafLimit) checkModify(numLeaves uint64, adds int,
+	targets []uint64) error {
+
+	limit := l.maxLeaves()
+	total := numLeaves + uint64(adds)
+	if total < numLeaves || total > limit {
+		return &PositionOverflowError{
+			What:    "leaf count",
+			Value:   total,
+			Limit:   limit,
+			IntBits: l.intBits,
+		}
+	}
+	for _, target := range targets {
+		if target >= 2*limit-1 {
+			return &PositionOverflowError{
+				What:    "position",
+				Value:   target,
+				Limit:   2*limit - 2,
+				IntBits: l.intBits,
+			}
+		}
+		_, err := storageOffset(l.forestType, target, l.intBits)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !l.approaching(total) {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if !l.warned {
+		log.Warnf("The forest of the %s holds %d of the %d leaves that "+
+			"its storage can address with %d-bit ints", l.index,
+			total, limit, l.intBits)
+		l.warned = true
+	}
+
+	return nil
+}
+
+// modify modifies the forest with the leaves that a block adds and the leaves
+// at the targets that it deletes once they're checked to keep the forest within
+// the limit.
+//
+// The caller must hold the lock of the utreexo state of the index.
+func (l *leafLimit) modify(uState *UtreexoState, adds []accumulator.Leaf,
+	targets []uint64) (*accumulator.UndoBlock, error) {
+
+	numLeaves, err := uState.NumLeaves()
+	if err != nil {
+		return nil, err
+	}
+	err = l.checkModify(numLeaves, len(adds), targets)
+	if err != nil {
+		return nil, err
+	}
+
+	return uState.modify(adds, targets)
+}
+
+// SetLeafLimitWarnOnly sets whether the index only warns instead of refusing to
+// start when its forest approaches the most leaves that its storage can
+// address on the platform.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) SetLeafLimitWarnOnly(warnOnly bool) {
+	idx.leafLimit.setWarnOnly(warnOnly)
+}
+
+// SetLeafLimitWarnOnly sets whether the index only warns instead of refusing to
+// start when its forest approaches the most leaves that its storage can
+// address on the platform.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) SetLeafLimitWarnOnly(warnOnly bool) {
+	idx.leafLimit.setWarnOnly(warnOnly)
+}
+
+// leafHeadroom returns the most leaves that the forest of the index can hold
+// and how many more leaves it can take.  Both are 0 if the forest of the index
+// wasn't loaded.
+func (idx *UtreexoProofIndex) leafHeadroom() (uint64, uint64) {
+	if idx.leafLimit == nil {
+		return 0, 0
+	}
+	return idx.leafLimit.headroom(idx.rowGrowth.stats().NumLeaves)
+}
+
+// leafHeadroom returns the most leaves that the forest of the index can hold
+// and how many more leaves it can take.  Both are 0 if the forest of the index
+// wasn't loaded.
+func (idx *FlatUtreexoProofIndex) leafHeadroom() (uint64, uint64) {
+	if idx.leafLimit == nil {
+		return 0, 0
+	}
+	return idx.leafLimit.headroom(idx.rowGrowth.stats().NumLeaves)
+}
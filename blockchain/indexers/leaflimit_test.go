@@ -0,0 +1,195 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"math/rand"
+	"testing"
+
+	"github.com/utreexo/utreexod/chaincfg"
+)
+
+// TestMaxForestLeaves ensures that the most leaves a forest can hold are the
+// largest power of two whose forest's storage can be addressed with the ints
+// of the platform.
+func TestMaxForestLeaves(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		forestType ForestType
+		intBits    int
+		want       uint64
+	}{
+		{RamForest, 32, 1 << 25},
+		{DiskForest, 32, 1 << 24},
+		{RamForest, 64, 1 << 57},
+		{DiskForest, 64, 1 << 56},
+	}
+
+	for _, test := range tests {
+		got := maxForestLeaves(test.forestType, test.intBits)
+		if got != test.want {
+			t.Errorf("%d with %d-bit ints: got %d, want %d",
+				test.forestType, test.intBits, got, test.want)
+		}
+
+		// The offset of the last node of the largest forest fits and
+		// the forest twice as large doesn't.
+		_, err := storageOffset(test.forestType, 2*got-2, test.intBits)
+		if err != nil {
+			t.Errorf("%d with %d-bit ints: %v", test.forestType,
+				test.intBits, err)
+		}
+		_, err = storageOffset(test.forestType, 4*got-2, test.intBits)
+		if !errors.Is(err, ErrPositionOverflow) {
+			t.Errorf("%d with %d-bit ints: expected an overflow, "+
+				"got %v", test.forestType, test.intBits, err)
+		}
+	}
+}
+
+// TestCheckedConversions ensures that positions that don't fit into the ints
+// of the platform return errors instead of wrapping around.
+func TestCheckedConversions(t *testing.T) {
+	t.Parallel()
+
+	v, err := checkedInt(math.MaxInt32, 32, "value")
+	if err != nil || v != math.MaxInt32 {
+		t.Fatalf("got %d, %v", v, err)
+	}
+	_, err = checkedInt(math.MaxInt32+1, 32, "value")
+	var overflow *PositionOverflowError
+	if !errors.As(err, &overflow) || overflow.Limit != math.MaxInt32 ||
+		overflow.IntBits != 32 {
+
+		t.Fatalf("expected an overflow of a 32-bit int, got %v", err)
+	}
+
+	// A position whose offset would wrap around to 0 in 32 bits.
+	_, err = storageOffset(RamForest, 1<<27, 32)
+	if !errors.Is(err, ErrPositionOverflow) {
+		t.Fatalf("expected an overflow, got %v", err)
+	}
+	offset, err := storageOffset(RamForest, 1<<26-1, 32)
+	if err != nil || offset != (1<<26-1)*forestNodeSize {
+		t.Fatalf("got %d, %v", offset, err)
+	}
+
+	_, err = checkedInt(math.MaxUint64, 64, "value")
+	if !errors.Is(err, ErrPositionOverflow) {
+		t.Fatalf("expected an overflow, got %v", err)
+	}
+	_, err = storageOffset(DiskForest, 1<<58, 64)
+	if !errors.Is(err, ErrPositionOverflow) {
+		t.Fatalf("expected an overflow, got %v", err)
+	}
+	if bits.UintSize == 64 {
+		offset, err := storageOffset(RamForest, 1<<40, 64)
+		if err != nil || uint64(offset) != 1<<40*forestNodeSize {
+			t.Fatalf("got %d, %v", offset, err)
+		}
+	}
+}
+
+// TestLeafLimit ensures that blocks that would take a forest past the most
+// leaves it can hold are refused, that starting with a forest that approaches
+// them is refused unless it's only to be warned about, and that the headroom
+// is reported.
+func TestLeafLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, intBits := range []int{32, 64} {
+		l := &leafLimit{index: "test", forestType: RamForest, intBits: intBits}
+		limit := l.maxLeaves()
+
+		err := l.checkModify(limit-10, 10, []uint64{2*limit - 2})
+		if err != nil {
+			t.Fatalf("%d-bit: %v", intBits, err)
+		}
+		err = l.checkModify(limit-10, 11, nil)
+		var overflow *PositionOverflowError
+		if !errors.As(err, &overflow) || overflow.Value != limit+1 {
+			t.Fatalf("%d-bit: expected the leaf count to overflow, "+
+				"got %v", intBits, err)
+		}
+		err = l.checkModify(limit-10, 0, []uint64{2*limit - 1})
+		if !errors.Is(err, ErrPositionOverflow) {
+			t.Fatalf("%d-bit: expected the position to overflow, "+
+				"got %v", intBits, err)
+		}
+		err = l.checkModify(math.MaxUint64, 1, nil)
+		if !errors.Is(err, ErrPositionOverflow) {
+			t.Fatalf("%d-bit: expected the leaf count to overflow "+
+				"instead of wrapping around, got %v", intBits, err)
+		}
+
+		approach := limit - limit/leafLimitApproachDivisor
+		if err := l.checkStart(approach - 1); err != nil {
+			t.Fatalf("%d-bit: %v", intBits, err)
+		}
+		err = l.checkStart(approach)
+		var limitErr *LeafLimitError
+		if !errors.As(err, &limitErr) || limitErr.MaxLeaves != limit {
+			t.Fatalf("%d-bit: expected a leaf limit error, got %v",
+				intBits, err)
+		}
+		l.setWarnOnly(true)
+		if err := l.checkStart(approach); err != nil {
+			t.Fatalf("%d-bit: %v", intBits, err)
+		}
+
+		maxLeaves, headroom := l.headroom(approach)
+		if maxLeaves != limit || headroom != limit-approach {
+			t.Fatalf("%d-bit: got headroom %d of %d", intBits,
+				headroom, maxLeaves)
+		}
+		if _, headroom := l.headroom(math.MaxUint64); headroom != 0 {
+			t.Fatalf("%d-bit: got headroom %d past the limit",
+				intBits, headroom)
+		}
+	}
+}
+
+// TestLeafLimitModify ensures that a block that would take a forest past the
+// most leaves it can hold leaves the forest untouched.  The ints are made small
+// enough for a forest of 32 leaves to reach the limit.
+func TestLeafLimitModify(t *testing.T) {
+	t.Parallel()
+
+	uState, err := InitUtreexoState(&UtreexoConfig{
+		DataDir: t.TempDir(),
+		Name:    "leaflimit",
+		Type:    RamForest,
+		Params:  &chaincfg.RegressionNetParams,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLeafLimit("test", uState)
+	l.intBits = 12
+	if got := l.maxLeaves(); got != 32 {
+		t.Fatalf("got %d max leaves, want 32", got)
+	}
+
+	rng := rand.New(rand.NewSource(252))
+	_, err = l.modify(uState, randLeaves(rng, 30), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.modify(uState, randLeaves(rng, 3), nil)
+	if !errors.Is(err, ErrPositionOverflow) {
+		t.Fatalf("expected an overflow, got %v", err)
+	}
+	if numLeaves, _ := uState.NumLeaves(); numLeaves != 30 {
+		t.Fatalf("the forest was modified to %d leaves", numLeaves)
+	}
+	_, err = l.modify(uState, randLeaves(rng, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
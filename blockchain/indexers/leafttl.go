@@ -0,0 +1,107 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// flatIndexFormatVersion is the version of the format that the flat
+	// utreexo proof index is stored in.  Version 1 is the first version that
+	// records the format and the features it was built with.
+	flatIndexFormatVersion = 1
+
+	// flatIndexFormatFileName is the name of the file in the directory of
+	// the proofs of the flat utreexo proof index that keeps the version of
+	// its format and the features it was built with.
+	flatIndexFormatFileName = "format.dat"
+
+	// flatFormatNoLeafTTL is the feature flag of a flat utreexo proof index
+	// that was built without the leaf time to live data.
+	flatFormatNoLeafTTL = 1 << 0
+)
+
+// ErrLeafTTLDisabled is returned when the leaf time to live data of the flat
+// utreexo proof index is asked for but the index is built without it.
+var ErrLeafTTLDisabled = errors.New("the leaf time to live data of the flat " +
+	"utreexo proof index is disabled")
+
+// flatIndexFormat is the version of the format that the flat utreexo proof
+// index is stored in along with the features it was built with.
+type flatIndexFormat struct {
+	version uint8
+	flags   uint8
+}
+
+// leafTTLName returns how the leaf time to live data is described for the
+// format flags.
+func leafTTLName(flags uint8) string {
+	if flags&flatFormatNoLeafTTL != 0 {
+		return "without"
+	}
+	return "with"
+}
+
+// checkFlatIndexFormat returns an error unless the flat utreexo proof index
+// whose proofs are in the given directory was built with the leaf time to live
+// data as asked for.  An index without the format file that already stored
+// proofs was built before the format was recorded, which always stored the
+// leaf time to live data.  The format file is written if it's missing.
+func checkFlatIndexFormat(path string, noLeafTTL, stored bool) error {
+	var flags uint8
+	if noLeafTTL {
+		flags |= flatFormatNoLeafTTL
+	}
+
+	formatPath := filepath.Join(path, flatIndexFormatFileName)
+	buf, err := os.ReadFile(formatPath)
+	switch {
+	case os.IsNotExist(err):
+		format := flatIndexFormat{version: flatIndexFormatVersion, flags: flags}
+		if stored {
+			format.flags = 0
+		}
+		err = os.WriteFile(formatPath, []byte{format.version, format.flags},
+			0600)
+		if err != nil {
+			return err
+		}
+		buf = []byte{format.version, format.flags}
+
+	case err != nil:
+		return err
+	}
+
+	if len(buf) != 2 {
+		return fmt.Errorf("corrupt flat utreexo proof index format file. "+
+			"Expected 2 bytes but got %d", len(buf))
+	}
+	format := flatIndexFormat{version: buf[0], flags: buf[1]}
+	if format.version > flatIndexFormatVersion {
+		return fmt.Errorf("the flat utreexo proof index is stored in "+
+			"format version %d but this version of utreexod only "+
+			"knows of version %d.  The index must be dropped and "+
+			"reindexed", format.version, flatIndexFormatVersion)
+	}
+	if format.flags != flags {
+		return fmt.Errorf("the flat utreexo proof index was built %s the "+
+			"leaf time to live data and can't be opened %s it.  The "+
+			"index must be dropped to change between them",
+			leafTTLName(format.flags), leafTTLName(flags))
+	}
+
+	return nil
+}
+
+// LeafTTLDisabled returns whether the index is built without the leaf time to
+// live data.  The coin age statistics aren't stored then and fetching them or
+// the remember indexes returns ErrLeafTTLDisabled.
+func (idx *FlatUtreexoProofIndex) LeafTTLDisabled() bool {
+	return idx.noLeafTTL
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// TestNoLeafTTL ensures that a flat utreexo proof index built without the leaf
+// time to live data still serves its proofs, refuses the fetches of the data it
+// doesn't have, and can't be reopened with the data asked for.
+func TestNoLeafTTL(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestNoLeafTTL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	// The remember indexes are needed by the multi-block proofs.
+	interval := int32(2)
+	_, err = NewFlatUtreexoProofIndex(dbPath, &params, &interval, 0, true)
+	if err == nil {
+		t.Fatal("expected an error for a proof interval of 2")
+	}
+
+	interval = 1
+	idx, err := NewFlatUtreexoProofIndex(dbPath, &params, &interval, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.LeafTTLDisabled() {
+		t.Fatal("expected the leaf ttl data to be disabled")
+	}
+
+	m := NewManager(db, []Indexer{idx})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numBlocks = 10
+	var spends []*blockchain.SpendableOut
+	block := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < numBlocks; b++ {
+		block, spends = blockchain.AddBlock(chain, block, spends)
+	}
+
+	for height := int32(1); height <= numBlocks; height++ {
+		ud, err := idx.FetchUtreexoProof(height, false)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+		if ud == nil {
+			t.Fatalf("height %d: no proof", height)
+		}
+	}
+
+	_, err = idx.FetchCoinAgeStats(0, numBlocks)
+	if !errors.Is(err, ErrLeafTTLDisabled) {
+		t.Fatalf("expected ErrLeafTTLDisabled, got %v", err)
+	}
+	_, err = idx.FetchRemembers(1)
+	if !errors.Is(err, ErrLeafTTLDisabled) {
+		t.Fatalf("expected ErrLeafTTLDisabled, got %v", err)
+	}
+	proofPath := flatFilePath(dbPath, flatUtreexoProofName)
+	_, err = os.Stat(filepath.Join(proofPath, coinAgeStatsFileName))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected no coin age statistics, got %v", err)
+	}
+
+	// The index was recorded as built without the data so it's refused
+	// with it, while an index that stored proofs before the format was
+	// recorded was built with it.
+	err = checkFlatIndexFormat(proofPath, false, true)
+	if err == nil || !strings.Contains(err.Error(), "built without") {
+		t.Fatalf("expected a format mismatch, got %v", err)
+	}
+	err = checkFlatIndexFormat(proofPath, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacyPath := filepath.Join(dbPath, "legacy")
+	err = os.MkdirAll(legacyPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkFlatIndexFormat(legacyPath, true, true)
+	if err == nil || !strings.Contains(err.Error(), "built with") {
+		t.Fatalf("expected a format mismatch, got %v", err)
+	}
+	err = checkFlatIndexFormat(legacyPath, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A format newer than this version knows of is refused.
+	err = os.WriteFile(filepath.Join(legacyPath, flatIndexFormatFileName),
+		[]byte{flatIndexFormatVersion + 1, 0}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkFlatIndexFormat(legacyPath, false, true)
+	if err == nil || !strings.Contains(err.Error(), "format version") {
+		t.Fatalf("expected a newer format to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,590 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCursorLeaseTTL is the default duration a cursor lease stays
+	// valid for after the cursor was last used.
+	defaultCursorLeaseTTL = time.Hour
+
+	// maxEndedLeases is the maximum amount of leases that ended before
+	// their clients released them that are remembered so that the
+	// clients are told why.
+	maxEndedLeases = 4096
+
+	// cursorLeaseSize is the memory accounted for a cursor lease.
+	cursorLeaseSize = 128
+
+	// sessionLeaseOverhead is the memory accounted for a proof session
+	// lease on top of the roots of its snapshot.
+	sessionLeaseOverhead = 256
+)
+
+const (
+	// leasePriorityCursor and leasePrioritySession are the priorities of
+	// the leases under memory pressure.  The leases of the lowest priority
+	// are shed first.  Cursors are shed before the sessions as they only
+	// cost the client a lookup of its position to resume while a session
+	// costs a roll back of the utreexo state to open again.
+	leasePriorityCursor  = 0
+	leasePrioritySession = 1
+)
+
+// LeaseKind is the kind of state that a lease pins on behalf of a client.
+type LeaseKind uint8
+
+const (
+	// LeaseProofSession is the lease of a proof session pinned to a
+	// snapshot of the utreexo state.
+	LeaseProofSession LeaseKind = iota
+
+	// LeaseCursor is the lease of a cursor that resumes a range scan of an
+	// index.
+	LeaseCursor
+
+	// numLeaseKinds is the number of lease kinds.
+	numLeaseKinds
+)
+
+// String returns the LeaseKind in human-readable form.
+func (k LeaseKind) String() string {
+	switch k {
+	case LeaseProofSession:
+		return "proof session"
+	case LeaseCursor:
+		return "cursor"
+	default:
+		return fmt.Sprintf("unknown LeaseKind (%d)", uint8(k))
+	}
+}
+
+// LeaseReason is why a lease ended before its client released it.  Each reason
+// calls for a different reaction from the client.
+type LeaseReason uint8
+
+const (
+	// LeaseExpired is a lease that went past its TTL.  The client may
+	// recreate it right away from its resume height.
+	LeaseExpired LeaseReason = iota
+
+	// LeaseShed is a lease that was shed to make room for others or to
+	// free memory under pressure.  The client should back off before it
+	// recreates it from its resume height.
+	LeaseShed
+
+	// LeaseReorged is a lease of state that a reorg made invalid.  The
+	// client has to restart from the resume height, which is the last
+	// height that's still in the main chain.
+	LeaseReorged
+
+	// numLeaseReasons is the number of lease reasons.
+	numLeaseReasons
+)
+
+var (
+	// ErrLeaseExpired is matched by the LeaseError of a lease that
+	// expired.
+	ErrLeaseExpired = errors.New("lease expired")
+
+	// ErrLeaseShed is matched by the LeaseError of a lease that was shed.
+	ErrLeaseShed = errors.New("lease shed to free memory")
+
+	// ErrLeaseReorged is matched by the LeaseError of a lease that was
+	// invalidated by a reorg.
+	ErrLeaseReorged = errors.New("lease invalidated by a reorg")
+)
+
+// leaseReasonErrors maps each reason to the error that its LeaseError matches.
+var leaseReasonErrors = [numLeaseReasons]error{
+	LeaseExpired: ErrLeaseExpired,
+	LeaseShed:    ErrLeaseShed,
+	LeaseReorged: ErrLeaseReorged,
+}
+
+// String returns the LeaseReason in human-readable form.
+func (r LeaseReason) String() string {
+	switch r {
+	case LeaseExpired:
+		return "expired"
+	case LeaseShed:
+		return "shed"
+	case LeaseReorged:
+		return "reorged"
+	default:
+		return fmt.Sprintf("unknown LeaseReason (%d)", uint8(r))
+	}
+}
+
+// LeaseError is returned when the state that a client pinned is looked up after
+// its lease ended.  ResumeHeight is the height a new proof session can be
+// opened at or that a range scan can be restarted from.
+type LeaseError struct {
+	Kind         LeaseKind
+	ID           uint64
+	Reason       LeaseReason
+	ResumeHeight int32
+}
+
+// Error returns the error as a human-readable string.
+//
+// This is part of the error interface.
+func (e *LeaseError) Error() string {
+	return fmt.Sprintf("%v %d: %v: resume from height %d", e.Kind, e.ID,
+		leaseReasonErrors[e.Reason], e.ResumeHeight)
+}
+
+// Is returns whether the target is the error of the reason of the lease or the
+// error that the kind of the lease returned before it was leased.  Those are
+// ErrProofSessionNotFound and ErrProofSessionStale for the proof sessions and
+// ErrCursorInvalidated for the cursors.
+func (e *LeaseError) Is(target error) bool {
+	if e.Reason < numLeaseReasons && target == leaseReasonErrors[e.Reason] {
+		return true
+	}
+
+	switch e.Kind {
+	case LeaseProofSession:
+		if e.Reason == LeaseReorged {
+			return target == ErrProofSessionStale
+		}
+		return target == ErrProofSessionNotFound
+	case LeaseCursor:
+		return target == ErrCursorInvalidated
+	default:
+		return false
+	}
+}
+
+// As sets the target to a CursorInvalidatedError with the resume height of the
+// lease if the lease is of a cursor so that the callers that only know of the
+// errors of the cursors from before they were leased still restart the scan.
+func (e *LeaseError) As(target interface{}) bool {
+	invalidErr, ok := target.(**CursorInvalidatedError)
+	if !ok || e.Kind != LeaseCursor {
+		return false
+	}
+	*invalidErr = &CursorInvalidatedError{RestartHeight: e.ResumeHeight}
+
+	return true
+}
+
+// lease is the state that a client pinned.
+type lease struct {
+	id       uint64
+	kind     LeaseKind
+	priority uint8
+	size     uint64
+
+	// height is the height of the last block the pinned state depends on.
+	height int32
+
+	// expiry is when the lease expires and lastUsed is when it was last
+	// looked up.
+	expiry   time.Time
+	lastUsed time.Time
+
+	// value is the pinned state.
+	value interface{}
+}
+
+// resumeHeight returns the height that the client of a lease of the given kind
+// resumes from when the state it pinned depends on the block at the given
+// height.  A session is opened again at the block while a scan restarts from
+// the block after it.
+func resumeHeight(kind LeaseKind, height int32) int32 {
+	if kind == LeaseCursor {
+		return height + 1
+	}
+	return height
+}
+
+// LeaseKindStats are the statistics of the leases of a kind.
+type LeaseKindStats struct {
+	Kind LeaseKind
+
+	// Active is the amount of leases currently held and Bytes is the
+	// memory accounted for them.
+	Active int
+	Bytes  uint64
+
+	// Acquired is the total count of leases that were acquired and
+	// Released is the count of the ones that their clients released.
+	Acquired uint64
+	Released uint64
+
+	// Expired, Shed, and Reorged are the counts of the leases that ended
+	// for each reason.
+	Expired uint64
+	Shed    uint64
+	Reorged uint64
+}
+
+// LeaseStats are the statistics of a LeaseManager.
+type LeaseStats struct {
+	// Kinds are the statistics of every lease kind.
+	Kinds []LeaseKindStats
+}
+
+// LeaseManager keeps the leases of the state that the clients of an index pin,
+// like the snapshots of the proof sessions and the positions of the cursors.
+// Every lease has a TTL and a priority for when memory has to be freed.  The
+// leases that end before the clients release them are remembered along with
+// the reason so that looking them up tells the client how to react.
+type LeaseManager struct {
+	// mtx protects all the fields below.
+	mtx sync.Mutex
+
+	// ttls are the TTLs of the leases of each kind.
+	ttls [numLeaseKinds]time.Duration
+
+	// now returns the current time.  It's only replaced by tests.
+	now func() time.Time
+
+	// nextID is the id given to the next lease.
+	nextID uint64
+
+	// leases are the held leases keyed by their id.
+	leases map[uint64]*lease
+
+	// ended are the errors of the leases that ended before they were
+	// released keyed by their id.  endedOrder has their ids in the order
+	// they ended in so that the oldest are forgotten first.
+	ended      map[uint64]*LeaseError
+	endedOrder []uint64
+
+	// stats are the counts reported in the LeaseStats.
+	stats [numLeaseKinds]LeaseKindStats
+
+	// mem is the handle the memory of the leases is reserved through.
+	// It's nil if the memory isn't accounted.
+	mem *MemHandle
+}
+
+// Ensure the LeaseManager type implements the Account interface.
+var _ Account = (*LeaseManager)(nil)
+
+// NewLeaseManager returns an empty LeaseManager.
+func NewLeaseManager() *LeaseManager {
+	lm := &LeaseManager{
+		now:    time.Now,
+		nextID: 1,
+		leases: make(map[uint64]*lease),
+		ended:  make(map[uint64]*LeaseError),
+	}
+	lm.ttls[LeaseProofSession] = defaultProofSessionTTL
+	lm.ttls[LeaseCursor] = defaultCursorLeaseTTL
+	for kind := range lm.stats {
+		lm.stats[kind].Kind = LeaseKind(kind)
+	}
+
+	return lm
+}
+
+// SetLeaseTTL sets the TTL of the leases of the given kind acquired or renewed
+// from now on.
+//
+// This function is safe for concurrent access.
+func (lm *LeaseManager) SetLeaseTTL(kind LeaseKind, ttl time.Duration) {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+
+	lm.ttls[kind] = ttl
+}
+
+// SetMemAccountant registers the leases with the memory accountant under the
+// given name so that they're among the first to be shed when it's at its cap or
+// under memory pressure.  It must be called before any lease is acquired.
+func (lm *LeaseManager) SetMemAccountant(a *MemAccountant, name string) {
+	lm.mem = a.Register(name, MemClassCache, 0, lm)
+}
+
+// acquire acquires a lease of the given kind for the value and returns its id
+// and expiry.  The value depends on the block at the given height.
+// ErrMemCapExceeded is returned if the memory of the lease can't be reserved.
+func (lm *LeaseManager) acquire(now time.Time, kind LeaseKind, priority uint8,
+	size uint64, height int32, value interface{}) (uint64, time.Time, error) {
+
+	// The memory is reserved without the lease manager locked as the
+	// accountant may have the other subsystems evict while it's reserved.
+	err := lm.mem.Reserve(size)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	lm.mtx.Lock()
+	freed := lm.prune(now)
+	l := &lease{
+		id:       lm.nextID,
+		kind:     kind,
+		priority: priority,
+		size:     size,
+		height:   height,
+		expiry:   now.Add(lm.ttls[kind]),
+		lastUsed: now,
+		value:    value,
+	}
+	lm.leases[l.id] = l
+	lm.nextID++
+	lm.stats[kind].Acquired++
+	lm.mtx.Unlock()
+
+	lm.mem.Release(freed)
+
+	return l.id, l.expiry, nil
+}
+
+// lookup returns the held lease of the given kind with the given id and marks it
+// as used.  A LeaseError is returned if the lease ended before it was released.
+// The lease is nil without an error if it's unknown.
+func (lm *LeaseManager) lookup(now time.Time, kind LeaseKind, id uint64) (
+	*lease, error) {
+
+	lm.mtx.Lock()
+	freed := lm.prune(now)
+	l, err := lm.find(kind, id)
+	if l != nil {
+		l.lastUsed = now
+	}
+	lm.mtx.Unlock()
+
+	lm.mem.Release(freed)
+
+	return l, err
+}
+
+// find returns the held lease of the given kind with the given id.  A
+// LeaseError is returned if the lease ended before it was released.  The lease
+// is nil without an error if it's unknown.
+//
+// This function MUST be called with the mutex held.
+func (lm *LeaseManager) find(kind LeaseKind, id uint64) (*lease, error) {
+	if l, ok := lm.leases[id]; ok && l.kind == kind {
+		return l, nil
+	}
+	if leaseErr, ok := lm.ended[id]; ok && leaseErr.Kind == kind {
+		return nil, leaseErr
+	}
+
+	return nil, nil
+}
+
+// renew marks the lease as used, extends it by its TTL, and makes it depend on
+// the block at the given height.  It returns false if the lease isn't held.
+func (lm *LeaseManager) renew(now time.Time, kind LeaseKind, id uint64,
+	height int32) bool {
+
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+
+	l, ok := lm.leases[id]
+	if !ok || l.kind != kind || now.After(l.expiry) {
+		return false
+	}
+	l.lastUsed = now
+	l.expiry = now.Add(lm.ttls[kind])
+	l.height = height
+
+	return true
+}
+
+// release releases the lease with the given id that its client is done with.
+func (lm *LeaseManager) release(id uint64) {
+	lm.mtx.Lock()
+	l, ok := lm.leases[id]
+	if ok {
+		delete(lm.leases, id)
+		lm.stats[l.kind].Released++
+	}
+	lm.mtx.Unlock()
+
+	if ok {
+		lm.mem.Release(l.size)
+	}
+}
+
+// shed ends the lease with the given id to make room for another.
+func (lm *LeaseManager) shed(now time.Time, id uint64) {
+	lm.mtx.Lock()
+	l, ok := lm.leases[id]
+	if ok {
+		lm.end(l, LeaseShed, resumeHeight(l.kind, l.height))
+	}
+	lm.mtx.Unlock()
+
+	if ok {
+		lm.mem.Release(l.size)
+	}
+}
+
+// leastRecentlyUsed returns the least recently used lease of the given kind
+// that's held along with the amount of held leases of the kind.
+func (lm *LeaseManager) leastRecentlyUsed(now time.Time, kind LeaseKind) (
+	*lease, int) {
+
+	lm.mtx.Lock()
+	freed := lm.prune(now)
+	var lru *lease
+	var count int
+	for _, l := range lm.leases {
+		if l.kind != kind {
+			continue
+		}
+		count++
+		if lru == nil || l.lastUsed.Before(lru.lastUsed) {
+			lru = l
+		}
+	}
+	lm.mtx.Unlock()
+
+	lm.mem.Release(freed)
+
+	return lru, count
+}
+
+// invalidateFrom ends the leases that depend on the block at the given height or
+// on a later one because the block was disconnected.  The clients resume from
+// the block before it.  The leases that already ended and resume from the
+// block or a later one are moved back to resume from the block before it too.
+//
+// This function is safe for concurrent access.
+func (lm *LeaseManager) invalidateFrom(height int32) {
+	var freed uint64
+	lm.mtx.Lock()
+	for _, l := range lm.leases {
+		if l.height >= height {
+			lm.end(l, LeaseReorged, resumeHeight(l.kind, height-1))
+			freed += l.size
+		}
+	}
+	for id, leaseErr := range lm.ended {
+		resume := resumeHeight(leaseErr.Kind, height-1)
+		if leaseErr.ResumeHeight > resume {
+			// The errors may be held by the callers so they're
+			// replaced rather than modified.
+			moved := *leaseErr
+			moved.ResumeHeight = resume
+			lm.ended[id] = &moved
+		}
+	}
+	lm.mtx.Unlock()
+
+	lm.mem.Release(freed)
+}
+
+// EvictMem sheds the leases of the lowest priority that were least recently
+// used until they account for at least the given amount of bytes and returns
+// the amount of bytes they accounted for.
+//
+// This is part of the Account interface.
+func (lm *LeaseManager) EvictMem(bytes uint64) uint64 {
+	lm.mtx.Lock()
+	defer lm.mtx.Unlock()
+
+	var freed uint64
+	for freed < bytes {
+		var victim *lease
+		for _, l := range lm.leases {
+			if victim == nil || l.priority < victim.priority ||
+				(l.priority == victim.priority &&
+					l.lastUsed.Before(victim.lastUsed)) {
+
+				victim = l
+			}
+		}
+		if victim == nil {
+			break
+		}
+
+		lm.end(victim, LeaseShed, resumeHeight(victim.kind, victim.height))
+		freed += victim.size
+	}
+
+	return freed
+}
+
+// prune ends the leases that expired by the given time and returns the amount
+// of bytes that they accounted for.  They must be released once the mutex is
+// released.
+//
+// This function MUST be called with the mutex held.
+func (lm *LeaseManager) prune(now time.Time) uint64 {
+	var freed uint64
+	for _, l := range lm.leases {
+		if now.After(l.expiry) {
+			lm.end(l, LeaseExpired, resumeHeight(l.kind, l.height))
+			freed += l.size
+		}
+	}
+
+	return freed
+}
+
+// end removes the lease and remembers that it ended for the given reason.  The
+// memory of the lease isn't released.
+//
+// This function MUST be called with the mutex held.
+func (lm *LeaseManager) end(l *lease, reason LeaseReason, resumeHeight int32) {
+	delete(lm.leases, l.id)
+
+	stats := &lm.stats[l.kind]
+	switch reason {
+	case LeaseExpired:
+		stats.Expired++
+	case LeaseShed:
+		stats.Shed++
+	case LeaseReorged:
+		stats.Reorged++
+	}
+
+	if len(lm.endedOrder) >= maxEndedLeases {
+		delete(lm.ended, lm.endedOrder[0])
+		lm.endedOrder = lm.endedOrder[1:]
+	}
+	lm.ended[l.id] = &LeaseError{
+		Kind:         l.kind,
+		ID:           l.id,
+		Reason:       reason,
+		ResumeHeight: resumeHeight,
+	}
+	lm.endedOrder = append(lm.endedOrder, l.id)
+}
+
+// Stats returns a snapshot of the lease statistics.  Expired leases aren't
+// counted as active.
+//
+// This function is safe for concurrent access.
+func (lm *LeaseManager) Stats() LeaseStats {
+	lm.mtx.Lock()
+	freed := lm.prune(lm.now())
+	kinds := make([]LeaseKindStats, numLeaseKinds)
+	copy(kinds, lm.stats[:])
+	for _, l := range lm.leases {
+		kinds[l.kind].Active++
+		kinds[l.kind].Bytes += l.size
+	}
+	lm.mtx.Unlock()
+
+	lm.mem.Release(freed)
+
+	return LeaseStats{Kinds: kinds}
+}
+
+// Leases returns the leases of the proof sessions and the cursors of the
+// clients of the index.
+func (idx *FlatUtreexoProofIndex) Leases() *LeaseManager {
+	return idx.leases
+}
+
+// Leases returns the leases of the cursors of the clients of the index.
+func (idx *UtreexoProofIndex) Leases() *LeaseManager {
+	return idx.leases
+}
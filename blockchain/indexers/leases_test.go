@@ -0,0 +1,309 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// expectLeaseError returns an error unless err is a LeaseError of the given
+// kind and reason with the given resume height.
+func expectLeaseError(err error, kind LeaseKind, reason LeaseReason,
+	resume int32) error {
+
+	var leaseErr *LeaseError
+	if !errors.As(err, &leaseErr) {
+		return fmt.Errorf("expected a LeaseError, got %v", err)
+	}
+	if leaseErr.Kind != kind || leaseErr.Reason != reason ||
+		leaseErr.ResumeHeight != resume {
+
+		return fmt.Errorf("expected a %v %v lease resuming from %d, "+
+			"got %v", reason, kind, resume, leaseErr)
+	}
+
+	return nil
+}
+
+// TestLeaseManager ensures that the leases end for the right reason with the
+// right resume height and that the cursors are shed before the sessions.
+func TestLeaseManager(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	lm := NewLeaseManager()
+	lm.now = func() time.Time { return now }
+
+	session, _, err := lm.acquire(now, LeaseProofSession,
+		leasePrioritySession, 100, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, _, err := lm.acquire(now, LeaseCursor, leasePriorityCursor,
+		10, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cursor is shed first even though it's the most recently used.
+	if freed := lm.EvictMem(1); freed != 10 {
+		t.Fatalf("expected 10 bytes freed, got %d", freed)
+	}
+	_, err = lm.lookup(now, LeaseCursor, cursor)
+	if err := expectLeaseError(err, LeaseCursor, LeaseShed, 6); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := lm.lookup(now, LeaseProofSession, session); l == nil {
+		t.Fatalf("expected the session to be held, got %v", err)
+	}
+
+	// A reorg of the block the session depends on invalidates it and
+	// moves the resume height of the shed cursor before the reorg.
+	lm.invalidateFrom(4)
+	_, err = lm.lookup(now, LeaseProofSession, session)
+	err = expectLeaseError(err, LeaseProofSession, LeaseReorged, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lm.lookup(now, LeaseCursor, cursor)
+	if err := expectLeaseError(err, LeaseCursor, LeaseShed, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewing a cursor extends it by its TTL.
+	cursor, _, err = lm.acquire(now, LeaseCursor, leasePriorityCursor,
+		10, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(defaultCursorLeaseTTL / 2)
+	if !lm.renew(now, LeaseCursor, cursor, 2) {
+		t.Fatal("expected the cursor lease to be renewed")
+	}
+	now = now.Add(defaultCursorLeaseTTL / 2)
+	if l, err := lm.lookup(now, LeaseCursor, cursor); l == nil {
+		t.Fatalf("expected the cursor to be held, got %v", err)
+	}
+	now = now.Add(defaultCursorLeaseTTL)
+	_, err = lm.lookup(now, LeaseCursor, cursor)
+	if err := expectLeaseError(err, LeaseCursor, LeaseExpired, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Released leases are unknown.
+	released, _, err := lm.acquire(now, LeaseCursor, leasePriorityCursor,
+		10, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm.release(released)
+	if l, err := lm.lookup(now, LeaseCursor, released); l != nil || err != nil {
+		t.Fatalf("expected the released lease to be unknown, got %v", err)
+	}
+
+	want := []LeaseKindStats{
+		{Kind: LeaseProofSession, Acquired: 1, Reorged: 1},
+		{Kind: LeaseCursor, Acquired: 3, Released: 1, Expired: 1, Shed: 1},
+	}
+	stats := lm.Stats()
+	for i := range want {
+		if stats.Kinds[i] != want[i] {
+			t.Fatalf("expected stats %+v, got %+v", want[i],
+				stats.Kinds[i])
+		}
+	}
+}
+
+// TestLeaseErrorIs ensures that the lease errors match the errors of their
+// reasons and the errors their kinds returned before they were leased.
+func TestLeaseErrorIs(t *testing.T) {
+	tests := []struct {
+		err  *LeaseError
+		want []error
+		not  []error
+	}{
+		{
+			err:  &LeaseError{Kind: LeaseProofSession, Reason: LeaseExpired},
+			want: []error{ErrLeaseExpired, ErrProofSessionNotFound},
+			not:  []error{ErrLeaseShed, ErrProofSessionStale},
+		},
+		{
+			err:  &LeaseError{Kind: LeaseProofSession, Reason: LeaseShed},
+			want: []error{ErrLeaseShed, ErrProofSessionNotFound},
+			not:  []error{ErrLeaseReorged, ErrCursorInvalidated},
+		},
+		{
+			err:  &LeaseError{Kind: LeaseProofSession, Reason: LeaseReorged},
+			want: []error{ErrLeaseReorged, ErrProofSessionStale},
+			not:  []error{ErrLeaseExpired, ErrProofSessionNotFound},
+		},
+		{
+			err:  &LeaseError{Kind: LeaseCursor, Reason: LeaseShed},
+			want: []error{ErrLeaseShed, ErrCursorInvalidated},
+			not:  []error{ErrLeaseExpired, ErrProofSessionNotFound},
+		},
+	}
+	for _, test := range tests {
+		for _, target := range test.want {
+			if !errors.Is(test.err, target) {
+				t.Fatalf("expected %v to be %v", test.err, target)
+			}
+		}
+		for _, target := range test.not {
+			if errors.Is(test.err, target) {
+				t.Fatalf("expected %v not to be %v", test.err, target)
+			}
+		}
+	}
+
+	// The cursor errors can still be told apart as the errors of the
+	// cursors from before they were leased.
+	var err error = &LeaseError{Kind: LeaseCursor, ResumeHeight: 7}
+	var invalidErr *CursorInvalidatedError
+	if !errors.As(err, &invalidErr) || invalidErr.RestartHeight != 7 {
+		t.Fatalf("expected a CursorInvalidatedError from %v", err)
+	}
+}
+
+// TestLeaseInvalidation ensures that the proof sessions and the cursors of an
+// index tell apart expiring, being shed under memory pressure, and being
+// invalidated by a reorg along with where to resume from.
+func TestLeaseInvalidation(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestLeaseInvalidation", 1)
+	defer tearDown()
+
+	var idx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		if flat, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			idx = flat
+		}
+	}
+
+	// The leases are accounted for so that they're shed once memory has to
+	// be made for something that can't be evicted.
+	const memCap = 1 << 20
+	acct := NewMemAccountant(memCap)
+	idx.Leases().SetMemAccountant(acct, "leases")
+	pinned := acct.Register("pinned", MemClassPinned, 0, nil)
+
+	// Create a chain of 20 blocks.  blocks[i] is at height i+1.
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	blocks := make([]*btcutil.Block, 0, 20)
+	var outs [][]*blockchain.SpendableOut
+	for i := 0; i < 20; i++ {
+		var newOuts []*blockchain.SpendableOut
+		tip, newOuts = blockchain.AddBlock(chain, tip, nil)
+		blocks = append(blocks, tip)
+		outs = append(outs, newOuts)
+	}
+
+	// open opens a session at the given height and scans from the first
+	// block up to and including the given height.
+	open := func(height int32) (*ProofSession, *Cursor) {
+		s, err := idx.OpenProofSession(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := idx.NewCursor(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, c, err = scanHashes(idx, c, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.lease == 0 {
+			t.Fatal("expected the cursor to be leased")
+		}
+
+		return s, c
+	}
+
+	// expect checks that the session and the cursor fail with the given
+	// reason and resume heights.
+	expect := func(name string, s *ProofSession, c *Cursor,
+		reason LeaseReason, sessionResume, cursorResume int32) {
+
+		_, err := s.FetchUtreexoProof(1)
+		err = expectLeaseError(err, LeaseProofSession, reason,
+			sessionResume)
+		if err != nil {
+			t.Fatalf("%s: session: %v", name, err)
+		}
+		_, err = idx.ProofSession(s.ID())
+		err = expectLeaseError(err, LeaseProofSession, reason,
+			sessionResume)
+		if err != nil {
+			t.Fatalf("%s: session lookup: %v", name, err)
+		}
+
+		_, _, err = scanHashes(idx, c, 0)
+		err = expectLeaseError(err, LeaseCursor, reason, cursorResume)
+		if err != nil {
+			t.Fatalf("%s: cursor: %v", name, err)
+		}
+	}
+
+	// The leases are shed when memory has to be made for data that can't
+	// be evicted.
+	s, c := open(12)
+	if err := pinned.Reserve(memCap); err != nil {
+		t.Fatal(err)
+	}
+	expect("shed", s, c, LeaseShed, 12, 13)
+	pinned.Release(memCap)
+
+	// The leases expire once they go unused for longer than their TTLs.
+	s, c = open(12)
+	later := time.Now().Add(defaultCursorLeaseTTL * 2)
+	idx.sessions.now = func() time.Time { return later }
+	idx.leases.now = func() time.Time { return later }
+	expect("expired", s, c, LeaseExpired, 12, 13)
+	idx.sessions.now = time.Now
+	idx.leases.now = time.Now
+
+	// Reorg out the blocks after height 17 with a longer chain.  The
+	// leases of the blocks before the fork point are kept and the others
+	// resume from the fork point.
+	before, beforeCursor := open(15)
+	s, c = open(19)
+	altTip := blocks[16]
+	spends := outs[16]
+	for altTip.Height() < 22 {
+		altTip, _ = blockchain.AddBlock(chain, altTip, spends)
+		spends = nil
+	}
+	expect("reorged", s, c, LeaseReorged, 17, 18)
+	if _, err := before.FetchUtreexoProof(15); err != nil {
+		t.Fatalf("session before the fork point: %v", err)
+	}
+	_, err := idx.ForEachProof(beforeCursor, 1,
+		func(int32, *chainhash.Hash, *wire.UData) error { return nil })
+	if err != nil {
+		t.Fatalf("cursor before the fork point: %v", err)
+	}
+
+	// Every lease that ended is counted by its reason.
+	stats := idx.Leases().Stats()
+	for _, kind := range []LeaseKind{LeaseProofSession, LeaseCursor} {
+		got := stats.Kinds[kind]
+		if got.Expired != 1 || got.Shed != 1 || got.Reorged != 1 ||
+			got.Active != 1 {
+
+			t.Fatalf("unexpected %v stats %+v", kind, got)
+		}
+	}
+}
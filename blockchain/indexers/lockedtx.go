@@ -0,0 +1,412 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"sync"
+
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// lockedTx is a database transaction that several indexes can use at the same
+// time.  The database transactions aren't safe for concurrent access, so every
+// read and write through it and its buckets and cursors is done with its mutex
+// held.
+type lockedTx struct {
+	database.Tx
+	mtx *sync.Mutex
+}
+
+// newLockedTx returns a lockedTx that reads and writes through to the passed in
+// transaction.
+func newLockedTx(dbTx database.Tx) *lockedTx {
+	return &lockedTx{Tx: dbTx, mtx: new(sync.Mutex)}
+}
+
+// Metadata returns the top-most bucket for all metadata storage with the reads
+// and writes of it and its nested buckets locked.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) Metadata() database.Bucket {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return &lockedBucket{dbBucket: tx.Tx.Metadata(), mtx: tx.mtx}
+}
+
+// StoreBlock stores the block in the database.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) StoreBlock(block *btcutil.Block) error {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.StoreBlock(block)
+}
+
+// HasBlock returns whether or not a block with the given hash exists in the
+// database.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) HasBlock(hash *chainhash.Hash) (bool, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.HasBlock(hash)
+}
+
+// HasBlocks returns whether or not the blocks with the provided hashes exist in
+// the database.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) HasBlocks(hashes []chainhash.Hash) ([]bool, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.HasBlocks(hashes)
+}
+
+// FetchBlockHeader returns the raw serialized bytes for the block header
+// identified by the given hash.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) FetchBlockHeader(hash *chainhash.Hash) ([]byte, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.FetchBlockHeader(hash)
+}
+
+// FetchBlockHeaders returns the raw serialized bytes for the block headers
+// identified by the given hashes.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) FetchBlockHeaders(hashes []chainhash.Hash) ([][]byte, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.FetchBlockHeaders(hashes)
+}
+
+// FetchBlock returns the raw serialized bytes for the block identified by the
+// given hash.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) FetchBlock(hash *chainhash.Hash) ([]byte, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.FetchBlock(hash)
+}
+
+// FetchBlocks returns the raw serialized bytes for the blocks identified by the
+// given hashes.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) FetchBlocks(hashes []chainhash.Hash) ([][]byte, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.FetchBlocks(hashes)
+}
+
+// FetchBlockRegion returns the raw serialized bytes for the given block region.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) FetchBlockRegion(region *database.BlockRegion) ([]byte, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.FetchBlockRegion(region)
+}
+
+// FetchBlockRegions returns the raw serialized bytes for the given block
+// regions.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) FetchBlockRegions(regions []database.BlockRegion) ([][]byte, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.FetchBlockRegions(regions)
+}
+
+// StoreSpendJournal stores the serialized spend journal of the block with the
+// given hash.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) StoreSpendJournal(blockHash *chainhash.Hash, spendJournal []byte) error {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.StoreSpendJournal(blockHash, spendJournal)
+}
+
+// FetchSpendJournal returns the serialized spend journal of the block with the
+// given hash.
+//
+// This is part of the database.Tx interface.
+func (tx *lockedTx) FetchSpendJournal(hash *chainhash.Hash) ([]byte, error) {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+
+	return tx.Tx.FetchSpendJournal(hash)
+}
+
+// lockedBucket is a database bucket whose reads and writes, and the ones of its
+// nested buckets and cursors, are done with the mutex of its lockedTx held.
+type lockedBucket struct {
+	dbBucket
+	mtx *sync.Mutex
+}
+
+// Bucket returns the nested bucket with the given key with its reads and
+// writes locked.  nil is returned if the bucket doesn't exist.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) Bucket(key []byte) database.Bucket {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	bucket := b.dbBucket.Bucket(key)
+	if bucket == nil {
+		return nil
+	}
+
+	return &lockedBucket{dbBucket: bucket, mtx: b.mtx}
+}
+
+// CreateBucket creates and returns a new nested bucket with the given key.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) CreateBucket(key []byte) (database.Bucket, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	bucket, err := b.dbBucket.CreateBucket(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lockedBucket{dbBucket: bucket, mtx: b.mtx}, nil
+}
+
+// CreateBucketIfNotExists creates and returns a new nested bucket with the
+// given key if it does not already exist.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) CreateBucketIfNotExists(key []byte) (database.Bucket, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	bucket, err := b.dbBucket.CreateBucketIfNotExists(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lockedBucket{dbBucket: bucket, mtx: b.mtx}, nil
+}
+
+// DeleteBucket removes the nested bucket with the given key.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) DeleteBucket(key []byte) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.dbBucket.DeleteBucket(key)
+}
+
+// ForEach invokes the passed function with every key/value pair in the bucket.
+// The pairs are gathered first so that the function is called without the
+// mutex held and can use the bucket itself.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) ForEach(fn func(k, v []byte) error) error {
+	var keys, values [][]byte
+	b.mtx.Lock()
+	err := b.dbBucket.ForEach(func(k, v []byte) error {
+		keys = append(keys, copyBytes(k))
+		values = append(values, copyBytes(v))
+		return nil
+	})
+	b.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		if err := fn(keys[i], values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ForEachBucket invokes the passed function with the key of every nested bucket
+// in the bucket.  The keys are gathered first so that the function is called
+// without the mutex held and can use the bucket itself.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) ForEachBucket(fn func(k []byte) error) error {
+	var keys [][]byte
+	b.mtx.Lock()
+	err := b.dbBucket.ForEachBucket(func(k []byte) error {
+		keys = append(keys, copyBytes(k))
+		return nil
+	})
+	b.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Cursor returns a new cursor whose moves, reads and deletes are locked.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) Cursor() database.Cursor {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return &lockedCursor{dbCursor: b.dbBucket.Cursor(), bucket: b}
+}
+
+// Put saves the key/value pair to the bucket.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) Put(key, value []byte) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.dbBucket.Put(key, value)
+}
+
+// Get returns the value for the given key.  nil is returned if the key doesn't
+// exist.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) Get(key []byte) []byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.dbBucket.Get(key)
+}
+
+// Delete removes the key from the bucket.
+//
+// This is part of the database.Bucket interface.
+func (b *lockedBucket) Delete(key []byte) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.dbBucket.Delete(key)
+}
+
+// lockedCursor is a database cursor whose moves, reads and deletes are done with
+// the mutex of its lockedTx held.  Like any cursor, it must not be used while
+// the bucket it iterates is written to.
+type lockedCursor struct {
+	dbCursor
+	bucket *lockedBucket
+}
+
+// Bucket returns the bucket that the cursor was created for.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Bucket() database.Bucket {
+	return c.bucket
+}
+
+// Delete removes the key/value pair that the cursor is at.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Delete() error {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.Delete()
+}
+
+// First moves the cursor to the first key/value pair.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) First() bool {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.First()
+}
+
+// Last moves the cursor to the last key/value pair.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Last() bool {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.Last()
+}
+
+// Next moves the cursor one key/value pair forward.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Next() bool {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.Next()
+}
+
+// Prev moves the cursor one key/value pair backward.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Prev() bool {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.Prev()
+}
+
+// Seek moves the cursor to the first key/value pair with a key that's greater
+// than or equal to the given one.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Seek(seek []byte) bool {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.Seek(seek)
+}
+
+// Key returns the key that the cursor is at.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Key() []byte {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.Key()
+}
+
+// Value returns the value that the cursor is at.
+//
+// This is part of the database.Cursor interface.
+func (c *lockedCursor) Value() []byte {
+	c.bucket.mtx.Lock()
+	defer c.bucket.mtx.Unlock()
+
+	return c.dbCursor.Value()
+}
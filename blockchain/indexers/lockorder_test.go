@@ -0,0 +1,298 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// errReentrant is returned by the lockOrderChain in place of calling into the
+// chain while the chain notifies the index manager.
+var errReentrant = errors.New("called back into the chain during a block " +
+	"notification")
+
+// lockOrderChain is the chain of the indexes that records every call that the
+// indexes make while the chain notifies the index manager.  The chain holds
+// its lock during the notifications so a call to a chain method that takes the
+// lock deadlocks.  None of the calls are passed through during a notification.
+type lockOrderChain struct {
+	*blockchain.BlockChain
+
+	mtx           sync.Mutex
+	notifying     bool
+	notifications int
+	violations    []string
+}
+
+// Ensure the lockOrderChain type implements the indexChain interface.
+var _ indexChain = (*lockOrderChain)(nil)
+
+// setNotifying marks the start or the end of a block notification.
+func (c *lockOrderChain) setNotifying(notifying bool) {
+	c.mtx.Lock()
+	c.notifying = notifying
+	if notifying {
+		c.notifications++
+	}
+	c.mtx.Unlock()
+}
+
+// reentrant records the call to the chain method and returns whether it's made
+// during a block notification.
+func (c *lockOrderChain) reentrant(method string, takesLock bool) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.notifying {
+		return false
+	}
+	if takesLock {
+		method = "reentrant chain lock acquisition in " + method
+	}
+	c.violations = append(c.violations, method)
+	return true
+}
+
+func (c *lockOrderChain) BestSnapshot() *blockchain.BestState {
+	if c.reentrant("BestSnapshot", false) {
+		return &blockchain.BestState{}
+	}
+	return c.BlockChain.BestSnapshot()
+}
+
+func (c *lockOrderChain) BlockByHeight(height int32) (*btcutil.Block, error) {
+	if c.reentrant("BlockByHeight", false) {
+		return nil, errReentrant
+	}
+	return c.BlockChain.BlockByHeight(height)
+}
+
+func (c *lockOrderChain) BlockHashByHeight(height int32) (*chainhash.Hash, error) {
+	if c.reentrant("BlockHashByHeight", false) {
+		return nil, errReentrant
+	}
+	return c.BlockChain.BlockHashByHeight(height)
+}
+
+func (c *lockOrderChain) BlockHeightByHash(hash *chainhash.Hash) (int32, error) {
+	if c.reentrant("BlockHeightByHash", false) {
+		return 0, errReentrant
+	}
+	return c.BlockChain.BlockHeightByHash(hash)
+}
+
+func (c *lockOrderChain) BlockLocatorFromHash(hash *chainhash.Hash) blockchain.BlockLocator {
+	if c.reentrant("BlockLocatorFromHash", true) {
+		return nil
+	}
+	return c.BlockChain.BlockLocatorFromHash(hash)
+}
+
+func (c *lockOrderChain) FetchSpendJournalUnsafe(block *btcutil.Block) (
+	[]blockchain.SpentTxOut, error) {
+
+	if c.reentrant("FetchSpendJournalUnsafe", false) {
+		return nil, errReentrant
+	}
+	return c.BlockChain.FetchSpendJournalUnsafe(block)
+}
+
+func (c *lockOrderChain) FetchUtxoEntry(outpoint wire.OutPoint) (*blockchain.UtxoEntry, error) {
+	if c.reentrant("FetchUtxoEntry", true) {
+		return nil, errReentrant
+	}
+	return c.BlockChain.FetchUtxoEntry(outpoint)
+}
+
+func (c *lockOrderChain) HeaderByHash(hash *chainhash.Hash) (wire.BlockHeader, error) {
+	if c.reentrant("HeaderByHash", false) {
+		return wire.BlockHeader{}, errReentrant
+	}
+	return c.BlockChain.HeaderByHash(hash)
+}
+
+func (c *lockOrderChain) MainChainHasBlock(hash *chainhash.Hash) bool {
+	if c.reentrant("MainChainHasBlock", false) {
+		return false
+	}
+	return c.BlockChain.MainChainHasBlock(hash)
+}
+
+// lockOrderManager is the index manager that the chain notifies.  It marks the
+// notifications on the chain of the indexes.
+type lockOrderManager struct {
+	*Manager
+	chain *lockOrderChain
+}
+
+func (m *lockOrderManager) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
+	stxos []blockchain.SpentTxOut) error {
+
+	m.chain.setNotifying(true)
+	defer m.chain.setNotifying(false)
+	return m.Manager.ConnectBlock(dbTx, block, stxos)
+}
+
+func (m *lockOrderManager) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
+	stxos []blockchain.SpentTxOut) error {
+
+	m.chain.setNotifying(true)
+	defer m.chain.setNotifying(false)
+	return m.Manager.DisconnectBlock(dbTx, block, stxos)
+}
+
+// lockOrderTestChain creates a chain with the utreexo proof indexes whose
+// calls back into the chain are recorded.
+func lockOrderTestChain(t *testing.T, testName string, proofGenInterval int32) (
+	*blockchain.BlockChain, *lockOrderChain, []Indexer, *chaincfg.Params, func()) {
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	db, dbPath, err := createDB(testName)
+	tearDown := func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}
+	if err != nil {
+		tearDown()
+		t.Fatalf("error creating database: %v", err)
+	}
+
+	indexManager, indexes, err := initIndexes(proofGenInterval, dbPath, &db, &params)
+	if err != nil {
+		tearDown()
+		t.Fatalf("error creating indexes: %v", err)
+	}
+	guard := &lockOrderChain{}
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     &lockOrderManager{indexManager, guard},
+	})
+	if err != nil {
+		tearDown()
+		t.Fatalf("failed to create chain instance: %v", err)
+	}
+	err = indexManager.Init(chain, nil)
+	if err != nil {
+		tearDown()
+		t.Fatalf("failed to init indexes: %v", err)
+	}
+
+	// The index manager gathers the notifications from the chain itself
+	// and only the indexes call the guard.
+	guard.BlockChain = chain
+	for _, indexer := range indexes {
+		switch idx := indexer.(type) {
+		case *UtreexoProofIndex:
+			idx.chain = guard
+		case *FlatUtreexoProofIndex:
+			idx.chain = guard
+		}
+	}
+
+	return chain, guard, indexes, &params, tearDown
+}
+
+// addLockOrderBlocks adds count blocks on top of prev, spending the outputs of
+// the blocks before them, and returns the last block.
+func addLockOrderBlocks(chain *blockchain.BlockChain, prev *btcutil.Block,
+	spends []*blockchain.SpendableOut, count int) *btcutil.Block {
+
+	var allSpends []*blockchain.SpendableOut
+	for i := 0; i < count; i++ {
+		var newSpends []*blockchain.SpendableOut
+		prev, newSpends = blockchain.AddBlock(chain, prev, spends)
+		allSpends = append(allSpends, newSpends...)
+
+		// Spend the oldest outputs first.
+		n := len(allSpends) / 2
+		spends, allSpends = allSpends[:n], allSpends[n:]
+	}
+
+	return prev
+}
+
+// TestIndexNotificationLockOrder ensures that the utreexo proof indexes never
+// call back into the chain while the chain notifies them of connected and
+// disconnected blocks, both with single-block and multi-block proofs and
+// through a reorg.
+func TestIndexNotificationLockOrder(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	for _, interval := range []int32{1, defaultProofGenInterval} {
+		testName := fmt.Sprintf("TestIndexNotificationLockOrder-%d", interval)
+		chain, guard, indexes, params, tearDown := lockOrderTestChain(
+			t, testName, interval)
+
+		// Build the main chain and then a longer chain from block 1 that
+		// the chain reorgs to.
+		tip := btcutil.NewBlock(params.GenesisBlock)
+		b1, spends := blockchain.AddBlock(chain, tip, nil)
+		addLockOrderBlocks(chain, b1, spends, int(interval)*3)
+		altTip := addLockOrderBlocks(chain, b1, spends, int(interval)*3+5)
+
+		best := chain.BestSnapshot()
+		if best.Hash != *altTip.Hash() {
+			tearDown()
+			t.Fatalf("interval %d: chain didn't reorg to the longer "+
+				"chain", interval)
+		}
+		if guard.notifications == 0 {
+			tearDown()
+			t.Fatalf("interval %d: no block notifications were "+
+				"delivered", interval)
+		}
+		if len(guard.violations) > 0 {
+			tearDown()
+			t.Fatalf("interval %d: indexes called back into the "+
+				"chain during block notifications: %v", interval,
+				guard.violations)
+		}
+
+		// The proofs that the indexes made during the notifications are
+		// still the ones that a compact state node accepts.
+		csnChain, _, csnTearDown, err := csnTestChain(testName + "-CsnChain")
+		if err != nil {
+			csnTearDown()
+			tearDown()
+			t.Fatal(err)
+		}
+		if interval == 1 {
+			err = compareUtreexoIdx(1, best.Height, chain, indexes)
+			if err == nil {
+				err = syncCsnChain(1, best.Height+1, chain, csnChain,
+					indexes)
+			}
+		} else {
+			csnChain.GetUtreexoView().SetProofInterval(interval)
+			end := best.Height - best.Height%interval
+			err = syncCsnChainMultiBlockProof(1, end, interval, chain,
+				csnChain, indexes)
+		}
+		csnTearDown()
+		tearDown()
+		if err != nil {
+			t.Fatalf("interval %d: %v", interval, err)
+		}
+	}
+}
@@ -9,6 +9,13 @@ import "github.com/btcsuite/btclog"
 // log is a logger that is initialized with no output filters.  This
 // means the package will not perform any logging by default until the caller
 // requests it.
+//
+// It's the only package-level variable of the indexes that's ever written to
+// after the package is initialized.  It's set once at startup and the btclog loggers are safe for concurrent use, so
+// the indexes of every network run in the process share it.  Everything else
+// that an index keeps, such as its stats, its caches, and its paths, is kept
+// by the index or its Manager and is derived from the data directory and the
+// chain parameters that the index was created with.
 var log btclog.Logger
 
 // The default amount of logging is none.
@@ -6,7 +6,9 @@ package indexers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/utreexo/utreexod/blockchain"
 	"github.com/utreexo/utreexod/btcutil"
@@ -68,38 +70,42 @@ func dbFetchIndexerTip(dbTx database.Tx, idxKey []byte) (*chainhash.Hash, int32,
 // given block using the provided indexer and updates the tip of the indexer
 // accordingly.  An error will be returned if the current tip for the indexer is
 // not the previous block for the passed block.
-func dbIndexConnectBlock(dbTx database.Tx, indexer Indexer, block *btcutil.Block,
-	stxo []blockchain.SpentTxOut) error {
+func dbIndexConnectBlock(dbTx database.Tx, indexer Indexer, n *BlockNotification) error {
+	if err := dbIndexConnectAttempt(dbTx, indexer, n); err != nil {
+		return err
+	}
+
+	// Update the current index tip.
+	return dbPutIndexerTip(dbTx, indexer.Key(), n.Block.Hash(), n.Height)
+}
+
+// dbIndexConnectAttempt asserts that the block extends the current tip of the
+// index and notifies the indexer with it without updating the tip.
+func dbIndexConnectAttempt(dbTx database.Tx, indexer Indexer,
+	n *BlockNotification) error {
 
 	// Assert that the block being connected properly connects to the
 	// current tip of the index.
-	idxKey := indexer.Key()
-	curTipHash, _, err := dbFetchIndexerTip(dbTx, idxKey)
+	curTipHash, _, err := dbFetchIndexerTip(dbTx, indexer.Key())
 	if err != nil {
 		return err
 	}
-	if !curTipHash.IsEqual(&block.MsgBlock().Header.PrevBlock) {
+	if !curTipHash.IsEqual(&n.ParentHash) {
 		return AssertError(fmt.Sprintf("dbIndexConnectBlock must be "+
 			"called with a block that extends the current index "+
 			"tip (%s, tip %s, block %s)", indexer.Name(),
-			curTipHash, block.Hash()))
+			curTipHash, n.Block.Hash()))
 	}
 
 	// Notify the indexer with the connected block so it can index it.
-	if err := indexer.ConnectBlock(dbTx, block, stxo); err != nil {
-		return err
-	}
-
-	// Update the current index tip.
-	return dbPutIndexerTip(dbTx, idxKey, block.Hash(), block.Height())
+	return indexer.ConnectBlock(dbTx, n)
 }
 
 // dbIndexDisconnectBlock removes all of the index entries associated with the
 // given block using the provided indexer and updates the tip of the indexer
 // accordingly.  An error will be returned if the current tip for the indexer is
 // not the passed block.
-func dbIndexDisconnectBlock(dbTx database.Tx, indexer Indexer, block *btcutil.Block,
-	stxo []blockchain.SpentTxOut) error {
+func dbIndexDisconnectBlock(dbTx database.Tx, indexer Indexer, n *BlockNotification) error {
 
 	// Assert that the block being disconnected is the current tip of the
 	// index.
@@ -108,22 +114,21 @@ func dbIndexDisconnectBlock(dbTx database.Tx, indexer Indexer, block *btcutil.Bl
 	if err != nil {
 		return err
 	}
-	if !curTipHash.IsEqual(block.Hash()) {
+	if !curTipHash.IsEqual(n.Block.Hash()) {
 		return AssertError(fmt.Sprintf("dbIndexDisconnectBlock must "+
 			"be called with the block at the current index tip "+
 			"(%s, tip %s, block %s)", indexer.Name(),
-			curTipHash, block.Hash()))
+			curTipHash, n.Block.Hash()))
 	}
 
 	// Notify the indexer with the disconnected block so it can remove all
 	// of the appropriate entries.
-	if err := indexer.DisconnectBlock(dbTx, block, stxo); err != nil {
+	if err := indexer.DisconnectBlock(dbTx, n); err != nil {
 		return err
 	}
 
 	// Update the current index tip.
-	prevHash := &block.MsgBlock().Header.PrevBlock
-	return dbPutIndexerTip(dbTx, idxKey, prevHash, block.Height()-1)
+	return dbPutIndexerTip(dbTx, idxKey, &n.ParentHash, n.Height-1)
 }
 
 // Manager defines an index manager that manages multiple optional indexes and
@@ -132,11 +137,108 @@ func dbIndexDisconnectBlock(dbTx database.Tx, indexer Indexer, block *btcutil.Bl
 type Manager struct {
 	db             database.DB
 	enabledIndexes []Indexer
+
+	// chain is the chain that the indexes are for.  It's set when the
+	// manager is initialized.
+	chain *blockchain.BlockChain
+
+	// ioLimiter limits the disk I/O done by catching up and dropping the
+	// indexes.  It's nil if the I/O isn't limited.
+	ioLimiter *IOLimiter
+
+	// rebuild is the rebuild of the indexes that depend on a changed
+	// utreexo rule.  It's nil if no rebuild is in progress.  It's
+	// protected by rebuildMtx.
+	rebuildMtx sync.Mutex
+	rebuild    *rebuild
+
+	// rebuildRunning is set while RebuildAll is running.  It must only be
+	// used atomically.
+	rebuildRunning int32
+
+	// blockByHeight loads the block at the given height of the main chain
+	// for the rebuild scan.  It's the BlockByHeight of the chain if nil.
+	blockByHeight func(int32) (*btcutil.Block, error)
+
+	// servingLag records when the proofs of the connected blocks became
+	// fetchable.  It's nil if they aren't recorded.
+	servingLag *ServingLag
+
+	// degraded are the health of the indexes that were degraded to
+	// read-only after a write failure that won't go away.  It's protected
+	// by healthMtx.
+	healthMtx sync.Mutex
+	degraded  map[Indexer]*IndexHealth
+
+	// sharedUndo is whether the utreexo proof index is to keep its undo
+	// blocks in the flat utreexo proof index.
+	sharedUndo bool
+
+	// recoveryMode is what's done on start up when one of the utreexo
+	// proof indexes is empty while the other one covers the chain and
+	// recoverySample is how often in blocks the proofs of an index that's
+	// rebuilt from the other one are verified.
+	recoveryMode   RecoveryMode
+	recoverySample int32
+
+	// recoveryBatch is how many blocks are rebuilt in a single database
+	// transaction.
+	recoveryBatch int32
+
+	// migration is the direction that the utreexo proof indexes are to be
+	// migrated in on start up.  It's MigrateNone if they aren't.
+	migration MigrationDirection
+
+	// dbRetry is how connecting a block to the indexes that support it is
+	// attempted again after a transient database error.
+	dbRetry dbRetryPolicy
+
+	// shadows are the experiments that run an index as the shadow of
+	// another and detached are the old primaries of the promoted shadows
+	// that are no longer connected to the blocks.  They're protected by
+	// experimentMtx, which is held while a block is connected or
+	// disconnected so that the roles only change between blocks.
+	experimentMtx sync.Mutex
+	shadows       []*shadowExperiment
+	detached      map[Indexer]struct{}
+
+	// splitWriteThreshold is the estimated size in bytes of the writes of
+	// a block to all the indexes above which the secondary indexes are
+	// written in their own database transactions after the one of the
+	// block.  0 means they're always written along with the block.
+	// followUps are the connects that were deferred until the transaction
+	// of the block was committed and splitBlocks is the number of blocks
+	// whose writes were split.  They're protected by experimentMtx.
+	splitWriteThreshold uint64
+	followUps           []followUp
+	splitBlocks         uint64
+
+	// syncProgress is how far the indexes were caught up while Init
+	// catches them up to the chain tip.
+	syncProgress syncProgress
+
+	// catchUpWorkers is how many of the indexes are caught up to the chain
+	// tip at the same time.
+	catchUpWorkers int
+
+	// catchUpFetchers is how many blocks are loaded at the same time for
+	// each of the indexes that are caught up and catchUpQueueDepth is how
+	// many of them are loaded ahead of the one that's connected.
+	catchUpFetchers   int
+	catchUpQueueDepth int
 }
 
 // Ensure the Manager type implements the blockchain.IndexManager interface.
 var _ blockchain.IndexManager = (*Manager)(nil)
 
+// Ensure the Manager type implements the blockchain.IndexFlushAligner
+// interface.
+var _ blockchain.IndexFlushAligner = (*Manager)(nil)
+
+// Ensure the Manager type implements the blockchain.IndexFollowUpWriter
+// interface.
+var _ blockchain.IndexFollowUpWriter = (*Manager)(nil)
+
 // indexDropKey returns the key for an index which indicates it is in the
 // process of being dropped.
 func indexDropKey(idxKey []byte) []byte {
@@ -187,7 +289,8 @@ func (m *Manager) maybeFinishDrops(interrupt <-chan struct{}) error {
 		}
 
 		log.Infof("Resuming %s drop", indexer.Name())
-		err := dropIndex(m.db, indexer.Key(), indexer.Name(), interrupt)
+		err := dropIndex(m.db, indexer.Key(), indexer.Name(),
+			m.ioLimiter, interrupt)
 		if err != nil {
 			return err
 		}
@@ -234,6 +337,8 @@ func (m *Manager) maybeCreateIndexes(dbTx database.Tx) error {
 //
 // This is part of the blockchain.IndexManager interface.
 func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{}) error {
+	m.chain = chain
+
 	// Nothing to do when no indexes are enabled.
 	if len(m.enabledIndexes) == 0 {
 		return nil
@@ -248,8 +353,24 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 		return err
 	}
 
+	// Resume an interrupted rebuild.  The indexes that weren't dropped
+	// yet are dropped and created again and the catch up below scans the
+	// chain for all of them.
+	r, err := m.loadRebuild()
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		log.Infof("Resuming the rebuild of the indexes for %v", r.change)
+		m.startRebuild(r)
+		err = m.dropRebuilding(r, interrupt)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Create the initial state for the indexes as needed.
-	err := m.db.Update(func(dbTx database.Tx) error {
+	err = m.db.Update(func(dbTx database.Tx) error {
 		// Create the bucket for the current tips as needed.
 		meta := dbTx.Metadata()
 		_, err := meta.CreateBucketIfNotExists(indexTipsBucketName)
@@ -257,7 +378,17 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 			return err
 		}
 
-		return m.maybeCreateIndexes(dbTx)
+		err = m.maybeCreateIndexes(dbTx)
+		if err != nil {
+			return err
+		}
+
+		err = m.recordFsyncPolicies(dbTx)
+		if err != nil {
+			return err
+		}
+
+		return m.loadSharedUndo(dbTx)
 	})
 	if err != nil {
 		return err
@@ -270,13 +401,31 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 		}
 	}
 
+	// Start the utreexo proof indexes whose entries went missing over so
+	// that they aren't rolled back or caught up from them.
+	recovery, err := m.startOverLostIndexes()
+	if err != nil {
+		return err
+	}
+
+	// Set the flat utreexo proof index back to the last block that it has
+	// everything for in case a crash left part of it behind its tip.
+	err = m.resumeFlatIndex()
+	if err != nil {
+		return err
+	}
+
 	// Rollback indexes to the main chain if their tip is an orphaned fork.
 	// This is fairly unlikely, but it can happen if the chain is
 	// reorganized while the index is disabled.  This has to be done in
-	// reverse order because later indexes can depend on earlier ones.
+	// reverse order because later indexes can depend on earlier ones,
+	// except for the utreexo proof index that needs the undo blocks that
+	// the flat one keeps for it.
+	rollbackOrder := make([]Indexer, 0, len(m.enabledIndexes))
 	for i := len(m.enabledIndexes); i > 0; i-- {
-		indexer := m.enabledIndexes[i-1]
-
+		rollbackOrder = append(rollbackOrder, m.enabledIndexes[i-1])
+	}
+	for _, indexer := range undoSharersFirst(rollbackOrder) {
 		// Fetch the current tip for the index.
 		var height int32
 		var hash *chainhash.Hash
@@ -309,6 +458,10 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 				if err != nil {
 					return err
 				}
+				err = m.ioLimiter.Wait(1, uint64(len(blockBytes)), interrupt)
+				if err != nil {
+					return err
+				}
 				block, err = btcutil.NewBlockFromBytes(blockBytes)
 				if err != nil {
 					return err
@@ -326,15 +479,17 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 			if err != nil {
 				return err
 			}
+			n, err := m.blockNotification(block, spentTxos, false)
+			if err != nil {
+				return err
+			}
 
 			// With the block and stxo set for that block retrieved,
 			// we can now update the index itself.
 			err = m.db.Update(func(dbTx database.Tx) error {
 				// Remove all of the index entries associated
 				// with the block and update the indexer tip.
-				err = dbIndexDisconnectBlock(
-					dbTx, indexer, block, spentTxos,
-				)
+				err = dbIndexDisconnectBlock(dbTx, indexer, n)
 				if err != nil {
 					return err
 				}
@@ -361,6 +516,23 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 		}
 	}
 
+	// Migrate a utreexo proof index to the other one when it was asked
+	// for or a previous migration was interrupted.  Otherwise rebuild an
+	// empty utreexo proof index from the other one rather than connecting
+	// every block to it when it's allowed to.
+	migration, err := m.loadMigration()
+	if err != nil {
+		return err
+	}
+	if migration != nil {
+		err = m.migrateIndex(migration, interrupt)
+	} else {
+		err = m.maybeRecover(recovery, interrupt)
+	}
+	if err != nil {
+		return err
+	}
+
 	// Fetch the current tip heights for each index along with tracking the
 	// lowest one so the catchup code only needs to start at the earliest
 	// block and is able to skip connecting the block for the indexes that
@@ -391,17 +563,16 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 
 	// Nothing to index if all of the indexes are caught up.
 	if lowestHeight == bestHeight {
-		return nil
+		return m.finishInit(interrupt)
 	}
 
-	// Create a progress logger for the indexing process below.
-	progressLogger := newBlockProgressLogger("Indexed", log)
-
 	// At this point, one or more indexes are behind the current best chain
 	// tip and need to be caught up, so log the details and loop through
 	// each block that needs to be indexed.
 	log.Infof("Catching up indexes from height %d to %d", lowestHeight,
 		bestHeight)
+	m.syncProgress.start(m.enabledIndexes, indexerHeights, bestHeight)
+	defer m.syncProgress.finish()
 
 	// For Utreexo proof indexes, we have to set the chain.
 	for _, indexer := range m.enabledIndexes {
@@ -431,60 +602,121 @@ func (m *Manager) Init(chain *blockchain.BlockChain, interrupt <-chan struct{})
 		}
 	}()
 
-	for height := lowestHeight + 1; height <= bestHeight; height++ {
-		// Load the block for the height since it is required to index
-		// it.
-		block, err := chain.BlockByHeight(height)
-		if err != nil {
-			return err
+	// Every block is connected to an index in its own transaction along
+	// with the tip of the index, so an interrupted catch up is resumed from
+	// the tips on the next start once the utreexo states are flushed above.
+	err = m.catchUp(chain, indexerHeights, bestHeight, interrupt)
+	if errors.Is(err, errInterruptRequested) {
+		for i, indexer := range m.enabledIndexes {
+			if indexerHeights[i] >= bestHeight {
+				continue
+			}
+			log.Infof("Interrupted catching up the %s at height %d, "+
+				"it'll be resumed from there", indexer.Name(),
+				indexerHeights[i])
 		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
 
-		if interruptRequested(interrupt) {
-			return errInterruptRequested
+	log.Infof("Indexes caught up to height %d", bestHeight)
+	return m.finishInit(interrupt)
+}
+
+// finishInit does what's left to initialize the indexes once they're caught
+// up.
+func (m *Manager) finishInit(interrupt <-chan struct{}) error {
+	err := m.maybeFinishRebuild(interrupt)
+	if err != nil {
+		return err
+	}
+
+	return m.maybeMigrateSharedUndo(interrupt)
+}
+
+// maybeFinishRebuild makes the indexes of a resumed rebuild serve again now
+// that they were caught up.
+func (m *Manager) maybeFinishRebuild(interrupt <-chan struct{}) error {
+	r := m.activeRebuild()
+	if r == nil {
+		return nil
+	}
+
+	return m.finishRebuild(r, interrupt)
+}
+
+// DurableHeight returns the lowest height that the enabled indexes which
+// implement the FlushAligner interface have their state persisted at.  The bool
+// is false if none of the enabled indexes implement it.  The degraded indexes
+// never persist anything again so they're left out.
+//
+// This is part of the blockchain.IndexFlushAligner interface.
+func (m *Manager) DurableHeight() (int32, bool) {
+	var lowest int32
+	var found bool
+	for _, indexer := range m.enabledIndexes {
+		aligner, ok := indexer.(FlushAligner)
+		if !ok || m.isDegraded(indexer) {
+			continue
 		}
 
-		// Connect the block for all indexes that need it.
-		var spentTxos []blockchain.SpentTxOut
-		for i, indexer := range m.enabledIndexes {
-			// Skip indexes that don't need to be updated with this
-			// block.
-			if indexerHeights[i] >= height {
-				continue
-			}
+		height := aligner.DurableHeight()
+		if !found || height < lowest {
+			lowest = height
+		}
+		found = true
+	}
 
-			// When the index requires all of the referenced txouts
-			// and they haven't been loaded yet, they need to be
-			// retrieved from the spend journal.
-			if spentTxos == nil && indexNeedsInputs(indexer) {
-				spentTxos, err = chain.FetchSpendJournal(block)
-				if err != nil {
-					return err
-				}
-			}
+	return lowest, found
+}
 
-			err := m.db.Update(func(dbTx database.Tx) error {
-				return dbIndexConnectBlock(
-					dbTx, indexer, block, spentTxos,
-				)
-			})
+// FlushIndexes persists the state that the enabled indexes keep in memory.  The
+// degraded indexes aren't flushed so that what they persisted is left as it
+// was.
+//
+// This is part of the blockchain.IndexFlushAligner interface.
+func (m *Manager) FlushIndexes() error {
+	for _, indexer := range m.enabledIndexes {
+		if m.isDegraded(indexer) {
+			continue
+		}
+
+		switch idxType := indexer.(type) {
+		case *UtreexoProofIndex:
+			err := idxType.FlushUtreexoState()
+			if err != nil {
+				return err
+			}
+		case *FlatUtreexoProofIndex:
+			err := idxType.FlushUtreexoState()
 			if err != nil {
 				return err
 			}
-			indexerHeights[i] = height
 		}
+	}
 
-		// Log indexing progress.
-		progressLogger.LogBlockHeight(block)
-
-		if interruptRequested(interrupt) {
-			return errInterruptRequested
-		}
+	if height, ok := m.DurableHeight(); ok {
+		m.servingLag.durable(height)
 	}
 
-	log.Infof("Indexes caught up to height %d", bestHeight)
 	return nil
 }
 
+// ForceAlignedFlush persists the state of all the enabled indexes together with
+// the cached state of the chain so that they're all durable at the same height.
+// It's used when the node shuts down and may be used before the data directory
+// is copied while the node is running.
+func (m *Manager) ForceAlignedFlush() error {
+	if m.chain == nil {
+		return AssertError("ForceAlignedFlush called before the index " +
+			"manager was initialized")
+	}
+
+	return m.chain.FlushAlignedState()
+}
+
 // indexNeedsInputs returns whether or not the index needs access to the txouts
 // referenced by the transaction inputs being indexed.
 func indexNeedsInputs(index Indexer) bool {
@@ -531,14 +763,72 @@ func dbFetchTx(dbTx database.Tx, hash *chainhash.Hash) (*wire.MsgTx, error) {
 func (m *Manager) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
 	stxos []blockchain.SpentTxOut) error {
 
+	m.servingLag.connected(block.Height(), block.Hash())
+
+	// Everything the indexes need is gathered before they're notified
+	// since the chain lock is held and they can't call back into the
+	// chain.
+	n, err := m.blockNotification(block, stxos, true)
+	if err != nil {
+		return err
+	}
+
+	m.experimentMtx.Lock()
+	defer m.experimentMtx.Unlock()
+
+	// The follow-ups of the block before that couldn't be written on
+	// their own are written along with this one.
+	err = m.completeFollowUps(dbTx)
+	if err != nil {
+		return err
+	}
+
 	// Call each of the currently active optional indexes with the block
-	// being connected so they can update accordingly.
+	// being connected so they can update accordingly.  The indexes that
+	// are being rebuilt are only connected once the rebuild scan caught
+	// them up.  An index that's unable to write for good is degraded
+	// instead of failing the block so that the node keeps running and
+	// serving what the index has.  The secondary indexes are deferred to
+	// their own transactions if the block writes too much to the indexes
+	// for a single one.
+	split := m.splitWrites(n)
 	for _, index := range m.enabledIndexes {
-		err := dbIndexConnectBlock(dbTx, index, block, stxos)
+		if m.isDetached(index) || m.skipDegraded(index, true) {
+			continue
+		}
+
+		connect, err := m.connectRebuilding(dbTx, index, block)
 		if err != nil {
 			return err
 		}
+		if !connect {
+			continue
+		}
+
+		if split && isSecondary(index) {
+			m.followUps = append(m.followUps, followUp{index, n})
+			continue
+		}
+
+		err = m.connectIndex(dbTx, index, n)
+		if isPersistentWriteErr(err) {
+			m.degrade(index, block.Height()-1, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	m.shadowConnected(&BlockID{Height: block.Height(), Hash: *block.Hash()})
+
+	m.servingLag.generated(block.Hash())
+	durable, ok := m.DurableHeight()
+	if !ok {
+		durable = block.Height()
 	}
+	m.servingLag.durable(durable)
+
 	return nil
 }
 
@@ -551,17 +841,105 @@ func (m *Manager) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
 func (m *Manager) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
 	stxo []blockchain.SpentTxOut) error {
 
+	m.servingLag.disconnected(block.Hash())
+
+	n, err := m.blockNotification(block, stxo, false)
+	if err != nil {
+		return err
+	}
+
+	m.experimentMtx.Lock()
+	defer m.experimentMtx.Unlock()
+
+	// The indexes whose follow-ups of the block weren't written yet never
+	// had it connected, and the follow-ups of the blocks before it have to
+	// be written before it's disconnected from the rest.
+	discarded := m.discardFollowUps(block.Hash())
+	err = m.completeFollowUps(dbTx)
+	if err != nil {
+		return err
+	}
+
 	// Call each of the currently active optional indexes with the block
-	// being disconnected so they can update accordingly.
-	for _, index := range m.enabledIndexes {
-		err := dbIndexDisconnectBlock(dbTx, index, block, stxo)
+	// being disconnected so they can update accordingly.  The indexes that
+	// are being rebuilt are only disconnected if the rebuild scan got to
+	// the block.
+	for _, index := range undoSharersFirst(m.enabledIndexes) {
+		if _, ok := discarded[index]; ok {
+			continue
+		}
+		if m.isDetached(index) || m.skipDegraded(index, false) {
+			continue
+		}
+
+		disconnect, err := m.disconnectRebuilding(dbTx, index, block)
+		if err != nil {
+			return err
+		}
+		if !disconnect {
+			continue
+		}
+
+		err = dbIndexDisconnectBlock(dbTx, index, n)
 		if err != nil {
 			return err
 		}
 	}
+
+	m.shadowDisconnected(&BlockID{Height: block.Height(), Hash: *block.Hash()})
+
 	return nil
 }
 
+// blockNotification gathers the notification of the block for the indexes.  The
+// notifications of the main chain blocks before a connected block, and the
+// hashes of the ones further below it, are gathered as well if any of the
+// indexes needs them.
+//
+// Only the chain methods that don't take the chain lock are called so that it's
+// safe to call while the chain notifies the manager.
+func (m *Manager) blockNotification(block *btcutil.Block,
+	stxos []blockchain.SpentTxOut, mainChain bool) (*BlockNotification, error) {
+
+	// A nil chain is left as a nil interface so that it's seen as unset.
+	var chain indexChain
+	if m.chain != nil {
+		chain = m.chain
+	}
+
+	n, err := newBlockNotification(chain, block, stxos, mainChain)
+	if err != nil {
+		return nil, err
+	}
+	if !mainChain {
+		return n, nil
+	}
+
+	needed := historyNeeded(m.enabledIndexes, n.Height)
+	if needed > 0 {
+		n.History, err = fetchNotifications(chain, n.Height-needed,
+			n.Height)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ancestors, ok := ancestorsNeeded(m.enabledIndexes, n.Height)
+	if ok && chain != nil {
+		n.AncestorHashes = make(map[int32]chainhash.Hash,
+			ancestors.End-ancestors.Start+1)
+		for height := ancestors.Start; height <= ancestors.End; height++ {
+			hash, err := chain.BlockHashByHeight(height)
+			if err != nil {
+				return nil, err
+			}
+			n.AncestorHashes[height] = *hash
+		}
+	}
+
+	return n, nil
+}
+
 // NewManager returns a new index manager with the provided indexes enabled.
 //
 // The manager returned satisfies the blockchain.IndexManager interface and thus
@@ -570,15 +948,44 @@ func NewManager(db database.DB, enabledIndexes []Indexer) *Manager {
 	return &Manager{
 		db:             db,
 		enabledIndexes: enabledIndexes,
+		dbRetry:        defaultDbRetryPolicy(),
+		recoverySample: DefaultRecoverySampleInterval,
+		recoveryBatch:  defaultRecoveryBatch,
+
+		splitWriteThreshold: DefaultSplitWriteThreshold,
+		catchUpWorkers:      DefaultCatchUpWorkers,
+		catchUpFetchers:     DefaultCatchUpFetchers,
+		catchUpQueueDepth:   DefaultCatchUpQueueDepth,
 	}
 }
 
+// SetServingLag sets the recorder of when the proofs of the connected blocks
+// become fetchable.
+func (m *Manager) SetServingLag(servingLag *ServingLag) {
+	m.servingLag = servingLag
+}
+
+// ServingLagStats returns the summaries of the lags of serving the proofs of
+// the recently connected blocks.  It's empty if they aren't recorded.
+func (m *Manager) ServingLagStats() ServingLagStats {
+	return m.servingLag.Stats()
+}
+
+// SetIOLimiter sets the limiter for the disk I/O done by catching up and
+// dropping the indexes.  It must be set before the manager is initialized.
+func (m *Manager) SetIOLimiter(limiter *IOLimiter) {
+	m.ioLimiter = limiter
+}
+
 // dropIndex drops the passed index from the database.  Since indexes can be
 // massive, it deletes the index in multiple database transactions in order to
 // keep memory usage to reasonable levels.  It also marks the drop in progress
 // so the drop can be resumed if it is stopped before it is done before the
-// index can be used again.
-func dropIndex(db database.DB, idxKey []byte, idxName string, interrupt <-chan struct{}) error {
+// index can be used again.  The deletions are limited by the passed in
+// limiter if it's not nil.
+func dropIndex(db database.DB, idxKey []byte, idxName string, limiter *IOLimiter,
+	interrupt <-chan struct{}) error {
+
 	// Nothing to do if the index doesn't already exist.
 	var needsDelete bool
 	err := db.View(func(dbTx database.Tx) error {
@@ -683,6 +1090,11 @@ func dropIndex(db database.DB, idxKey []byte, idxName string, interrupt <-chan s
 				log.Infof("Deleted %d keys (%d total) from %s",
 					numDeleted, totalDeleted, idxName)
 			}
+
+			err = limiter.Wait(uint64(numDeleted), 0, interrupt)
+			if err != nil {
+				return err
+			}
 		}
 
 		if interruptRequested(interrupt) {
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"testing"
+
+	"github.com/utreexo/utreexod/database"
+)
+
+// fakeIndexer is an Indexer that doesn't index anything.
+type fakeIndexer struct{}
+
+func (idx *fakeIndexer) Key() []byte                   { return []byte("fake") }
+func (idx *fakeIndexer) Name() string                  { return "fake index" }
+func (idx *fakeIndexer) Create(dbTx database.Tx) error { return nil }
+func (idx *fakeIndexer) Init() error                   { return nil }
+
+func (idx *fakeIndexer) ConnectBlock(database.Tx, *BlockNotification) error {
+	return nil
+}
+
+func (idx *fakeIndexer) DisconnectBlock(database.Tx, *BlockNotification) error {
+	return nil
+}
+
+// fakeAligner is an Indexer that implements the FlushAligner interface.
+type fakeAligner struct {
+	fakeIndexer
+	durable int32
+}
+
+func (idx *fakeAligner) DurableHeight() int32 { return idx.durable }
+
+func TestManagerDurableHeight(t *testing.T) {
+	tests := []struct {
+		name    string
+		indexes []Indexer
+		want    int32
+		wantOk  bool
+	}{
+		{"no aligners", []Indexer{&fakeIndexer{}}, 0, false},
+		{"one aligner", []Indexer{&fakeIndexer{}, &fakeAligner{durable: 20}}, 20, true},
+		{"lowest aligner", []Indexer{&fakeAligner{durable: 20}, &fakeAligner{durable: 10}}, 10, true},
+		{"not durable", []Indexer{&fakeAligner{durable: 20}, &fakeAligner{durable: -1}}, -1, true},
+	}
+	for _, test := range tests {
+		m := NewManager(nil, test.indexes)
+		got, ok := m.DurableHeight()
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("%s: expected (%d, %v), got (%d, %v)", test.name,
+				test.want, test.wantOk, got, ok)
+		}
+	}
+
+	// Forcing an aligned flush isn't possible before the manager is
+	// initialized with the chain.
+	m := NewManager(nil, []Indexer{&fakeAligner{}})
+	if err := m.ForceAlignedFlush(); err == nil {
+		t.Fatal("expected an error for an uninitialized manager")
+	}
+}
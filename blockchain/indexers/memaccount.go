@@ -0,0 +1,453 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrMemCapExceeded is returned when memory for utreexo data can't be reserved
+// because the memory accountant is at its cap and not enough could be evicted
+// to make room.
+var ErrMemCapExceeded = errors.New("utreexo data memory cap exceeded")
+
+// MemClass is the eviction class of a subsystem that holds utreexo data in
+// memory.  When the memory accountant is at its cap, the subsystems are
+// evicted from in the order of their classes.
+type MemClass uint8
+
+const (
+	// MemClassCache is the class of caches of utreexo data that can be
+	// fetched again.  They're evicted from first.
+	MemClassCache MemClass = iota
+
+	// MemClassPrefetch is the class of utreexo data fetched ahead of when
+	// it's needed.
+	MemClassPrefetch
+
+	// MemClassStaging is the class of utreexo data staged to be sent out
+	// or connected.  It's evicted from last.
+	MemClassStaging
+
+	// MemClassPinned is the class of utreexo data that can't be dropped,
+	// like the proofs of the blocks at the tip.  It's never evicted from.
+	MemClassPinned
+
+	// numMemClasses is the number of eviction classes.
+	numMemClasses
+)
+
+// String returns the MemClass in human-readable form.
+func (c MemClass) String() string {
+	switch c {
+	case MemClassCache:
+		return "cache"
+	case MemClassPrefetch:
+		return "prefetch"
+	case MemClassStaging:
+		return "staging"
+	case MemClassPinned:
+		return "pinned"
+	default:
+		return fmt.Sprintf("unknown MemClass (%d)", uint8(c))
+	}
+}
+
+// Account is implemented by the subsystems that register the memory of the
+// utreexo data they hold with a MemAccountant so that it can have them evict.
+type Account interface {
+	// EvictMem drops utreexo data worth at least the given amount of
+	// bytes if it can and returns the amount of bytes that were dropped.
+	// The dropped bytes are released by the accountant and must not be
+	// released through the MemHandle again.
+	//
+	// EvictMem is called with the accountant locked and so it must not
+	// call back into the accountant.
+	EvictMem(bytes uint64) uint64
+}
+
+// MemSubsystemStats are the memory statistics of a subsystem registered with a
+// MemAccountant.
+type MemSubsystemStats struct {
+	// Name and Class are what the subsystem was registered with.
+	Name  string
+	Class MemClass
+
+	// Quota is the soft quota of the subsystem.  0 means no quota.
+	Quota uint64
+
+	// Floor is the least the subsystem is shrunk to under memory
+	// pressure.
+	Floor uint64
+
+	// Used is the amount of bytes the subsystem currently holds and Peak
+	// is the most it held at once.
+	Used uint64
+	Peak uint64
+
+	// Evictions is the amount of times the subsystem was evicted from and
+	// EvictedBytes is the total amount of bytes that were evicted.
+	Evictions    uint64
+	EvictedBytes uint64
+
+	// Rejected is the amount of reservations of the subsystem that were
+	// refused.
+	Rejected uint64
+}
+
+// MemAccountantStats are the statistics of a MemAccountant.
+type MemAccountantStats struct {
+	// Cap is the maximum amount of bytes that may be held in total.
+	Cap uint64
+
+	// Used is the amount of bytes currently held in total and Peak is the
+	// most that was held at once.
+	Used uint64
+	Peak uint64
+
+	// Subsystems are the statistics of every registered subsystem in the
+	// order they were registered in.
+	Subsystems []MemSubsystemStats
+
+	// Pressure is the state of the memory pressure responder.  It's the
+	// zero value if there's none.
+	Pressure MemPressureStats
+}
+
+// MemAccountant caps the memory of the utreexo data held by all the subsystems
+// registered with it.  Every subsystem reserves the memory of the utreexo data
+// before it holds on to it and releases it once it drops it.  When a
+// reservation would go over the cap, the other subsystems are evicted from in
+// the order of their classes until there's room, starting with the ones that
+// are over their soft quotas.  The cap is never exceeded.
+//
+// A nil MemAccountant doesn't limit anything.
+type MemAccountant struct {
+	// mtx protects all the fields below and the fields of the handles.
+	mtx sync.Mutex
+
+	cap  uint64
+	used uint64
+	peak uint64
+
+	// handles are the registered subsystems in the order they were
+	// registered in.
+	handles []*MemHandle
+
+	// limit is the amount of bytes that the subsystems that can be evicted
+	// from may hold in total while they're shrunk under memory pressure.
+	// 0 means they're not shrunk.
+	limit uint64
+
+	// pressure is the state of the memory pressure responder.
+	pressure MemPressureStats
+}
+
+// NewMemAccountant returns a MemAccountant that allows capBytes of utreexo data
+// to be held in total.
+func NewMemAccountant(capBytes uint64) *MemAccountant {
+	return &MemAccountant{cap: capBytes}
+}
+
+// MemHandle is what a subsystem reserves and releases its memory through.  A
+// nil MemHandle reserves anything.
+type MemHandle struct {
+	acct    *MemAccountant
+	account Account
+	stats   MemSubsystemStats
+}
+
+// Register registers a subsystem with the given eviction class and soft quota.
+// A quota of 0 means that the subsystem has no quota.  The account may only be
+// nil for pinned subsystems.  A nil handle is returned for a nil accountant.
+//
+// This function is safe for concurrent access.
+func (a *MemAccountant) Register(name string, class MemClass, quota uint64,
+	account Account) *MemHandle {
+
+	if a == nil {
+		return nil
+	}
+
+	h := &MemHandle{
+		acct:    a,
+		account: account,
+		stats: MemSubsystemStats{
+			Name:  name,
+			Class: class,
+			Quota: quota,
+		},
+	}
+
+	a.mtx.Lock()
+	a.handles = append(a.handles, h)
+	a.mtx.Unlock()
+
+	return h
+}
+
+// SetFloor sets the least the subsystem is shrunk to while the system is under
+// memory pressure.  The subsystem may still be evicted from below its floor to
+// stay under the cap.
+//
+// This function is safe for concurrent access.
+func (h *MemHandle) SetFloor(floor uint64) {
+	if h == nil {
+		return
+	}
+
+	h.acct.mtx.Lock()
+	h.stats.Floor = floor
+	h.acct.mtx.Unlock()
+}
+
+// aboveFloor returns how many bytes the subsystem holds above its floor.
+//
+// This function MUST be called with the accountant locked.
+func (h *MemHandle) aboveFloor() uint64 {
+	if h.stats.Used <= h.stats.Floor {
+		return 0
+	}
+
+	return h.stats.Used - h.stats.Floor
+}
+
+// overQuota returns how many bytes the subsystem holds over its quota.
+//
+// This function MUST be called with the accountant locked.
+func (h *MemHandle) overQuota() uint64 {
+	if h.stats.Quota == 0 || h.stats.Used <= h.stats.Quota {
+		return 0
+	}
+
+	return h.stats.Used - h.stats.Quota
+}
+
+// evict has the subsystem drop up to the given amount of bytes and returns
+// how many it dropped.
+//
+// This function MUST be called with the accountant locked.
+func (h *MemHandle) evict(bytes uint64) uint64 {
+	if bytes > h.stats.Used {
+		bytes = h.stats.Used
+	}
+	if bytes == 0 || h.account == nil || h.stats.Class == MemClassPinned {
+		return 0
+	}
+
+	freed := h.account.EvictMem(bytes)
+	if freed > h.stats.Used {
+		freed = h.stats.Used
+	}
+	if freed == 0 {
+		return 0
+	}
+
+	h.stats.Used -= freed
+	h.stats.Evictions++
+	h.stats.EvictedBytes += freed
+	h.acct.used -= freed
+
+	return freed
+}
+
+// makeRoom evicts from the subsystems other than the given one until the given
+// amount of bytes fit under the cap and returns whether they do.  The
+// subsystems over their quotas are evicted from first.  If the reserving
+// subsystem would end up over its own quota, only the subsystems over their
+// quotas are evicted from.
+//
+// This function MUST be called with the accountant locked.
+func (a *MemAccountant) makeRoom(h *MemHandle, bytes uint64) bool {
+	fits := func() bool { return a.used+bytes <= a.cap }
+	need := func() uint64 { return a.used + bytes - a.cap }
+
+	for class := MemClass(0); class < numMemClasses && !fits(); class++ {
+		for _, other := range a.handles {
+			if fits() {
+				break
+			}
+			if other == h || other.stats.Class != class {
+				continue
+			}
+			over := other.overQuota()
+			if over > need() {
+				over = need()
+			}
+			other.evict(over)
+		}
+	}
+
+	reservingOver := h.stats.Quota != 0 && h.stats.Used+bytes > h.stats.Quota
+	if reservingOver {
+		return fits()
+	}
+
+	for class := MemClass(0); class < numMemClasses && !fits(); class++ {
+		for _, other := range a.handles {
+			if fits() {
+				break
+			}
+			if other == h || other.stats.Class != class {
+				continue
+			}
+			other.evict(need())
+		}
+	}
+
+	return fits()
+}
+
+// makeRoomUnderLimit evicts from the subsystems other than the given one, down
+// to their floors and in the order of their classes, until the given amount of
+// bytes fit under the limit that the subsystems are shrunk to under memory
+// pressure and returns whether they do.  Pinned subsystems and the ones that
+// stay within their floors aren't held to the limit.
+//
+// This function MUST be called with the accountant locked.
+func (a *MemAccountant) makeRoomUnderLimit(h *MemHandle, bytes uint64) bool {
+	if !a.pressure.Shrunk || h.stats.Class == MemClassPinned ||
+		h.stats.Used+bytes <= h.stats.Floor {
+
+		return true
+	}
+
+	used := a.evictableUsed()
+	fits := func() bool { return used+bytes <= a.pressure.Limit }
+	for class := MemClass(0); class < MemClassPinned && !fits(); class++ {
+		for _, other := range a.handles {
+			if fits() {
+				break
+			}
+			if other == h || other.stats.Class != class {
+				continue
+			}
+			evict := used + bytes - a.pressure.Limit
+			if above := other.aboveFloor(); evict > above {
+				evict = above
+			}
+			used -= other.evict(evict)
+		}
+	}
+
+	return fits()
+}
+
+// evictableUsed returns the amount of bytes held by the subsystems that can be
+// evicted from.
+//
+// This function MUST be called with the accountant locked.
+func (a *MemAccountant) evictableUsed() uint64 {
+	var used uint64
+	for _, h := range a.handles {
+		if h.stats.Class != MemClassPinned {
+			used += h.stats.Used
+		}
+	}
+
+	return used
+}
+
+// Reserve reserves the given amount of bytes for the subsystem, evicting from
+// the other subsystems if needed to stay under the cap.  ErrMemCapExceeded is
+// returned if not enough could be evicted.  While the subsystems are shrunk
+// under memory pressure, the ones that can be evicted from are also held to
+// the limit they were shrunk to.  The subsystem doesn't evict from itself so it
+// must not hold any lock that its EvictMem takes while reserving.
+//
+// This function is safe for concurrent access.
+func (h *MemHandle) Reserve(bytes uint64) error {
+	if h == nil {
+		return nil
+	}
+
+	a := h.acct
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if bytes > a.cap || !a.makeRoomUnderLimit(h, bytes) ||
+		!a.makeRoom(h, bytes) {
+
+		h.stats.Rejected++
+		return ErrMemCapExceeded
+	}
+
+	h.stats.Used += bytes
+	if h.stats.Used > h.stats.Peak {
+		h.stats.Peak = h.stats.Used
+	}
+	a.used += bytes
+	if a.used > a.peak {
+		a.peak = a.used
+	}
+
+	return nil
+}
+
+// Release releases the given amount of bytes the subsystem reserved.
+//
+// This function is safe for concurrent access.
+func (h *MemHandle) Release(bytes uint64) {
+	if h == nil {
+		return
+	}
+
+	a := h.acct
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if bytes > h.stats.Used {
+		log.Warnf("Releasing %d bytes of utreexo data memory for %s "+
+			"which only holds %d", bytes, h.stats.Name,
+			h.stats.Used)
+		bytes = h.stats.Used
+	}
+	h.stats.Used -= bytes
+	a.used -= bytes
+}
+
+// Used returns the amount of bytes the subsystem currently holds.
+//
+// This function is safe for concurrent access.
+func (h *MemHandle) Used() uint64 {
+	if h == nil {
+		return 0
+	}
+
+	h.acct.mtx.Lock()
+	defer h.acct.mtx.Unlock()
+
+	return h.stats.Used
+}
+
+// Stats returns a snapshot of the statistics of the accountant and every
+// registered subsystem.
+//
+// This function is safe for concurrent access.
+func (a *MemAccountant) Stats() MemAccountantStats {
+	if a == nil {
+		return MemAccountantStats{}
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	stats := MemAccountantStats{
+		Cap:        a.cap,
+		Used:       a.used,
+		Peak:       a.peak,
+		Subsystems: make([]MemSubsystemStats, 0, len(a.handles)),
+	}
+	for _, h := range a.handles {
+		stats.Subsystems = append(stats.Subsystems, h.stats)
+	}
+	stats.Pressure = a.pressure
+	stats.Pressure.History = append([]MemPressureAdjustment(nil),
+		a.pressure.History...)
+
+	return stats
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeMemAccount is a subsystem that holds entries of utreexo data in the order
+// they were added and evicts the oldest ones first.
+type fakeMemAccount struct {
+	handle  *MemHandle
+	entries []uint64
+
+	// onEvict is called before every eviction.
+	onEvict func(f *fakeMemAccount)
+}
+
+// held returns the amount of bytes of the entries the subsystem holds.
+func (f *fakeMemAccount) held() uint64 {
+	var held uint64
+	for _, size := range f.entries {
+		held += size
+	}
+	return held
+}
+
+// add reserves and adds an entry of the given size.
+func (f *fakeMemAccount) add(size uint64) error {
+	if err := f.handle.Reserve(size); err != nil {
+		return err
+	}
+	f.entries = append(f.entries, size)
+	return nil
+}
+
+// drop drops and releases the oldest entry.
+func (f *fakeMemAccount) drop() {
+	if len(f.entries) == 0 {
+		return
+	}
+	f.handle.Release(f.entries[0])
+	f.entries = f.entries[1:]
+}
+
+// EvictMem drops the oldest entries until at least the given amount of bytes
+// were dropped.
+//
+// This is part of the Account interface.
+func (f *fakeMemAccount) EvictMem(bytes uint64) uint64 {
+	if f.onEvict != nil {
+		f.onEvict(f)
+	}
+
+	var freed uint64
+	for freed < bytes && len(f.entries) > 0 {
+		freed += f.entries[0]
+		f.entries = f.entries[1:]
+	}
+	return freed
+}
+
+// TestMemAccountantEvictionOrder drives all the eviction classes towards the
+// cap at the same time and ensures that the cap is never exceeded, that the
+// classes are evicted from in order, and that nothing leaks once the load
+// subsides.
+func TestMemAccountantEvictionOrder(t *testing.T) {
+	const memCap = 1000
+	acct := NewMemAccountant(memCap)
+
+	classes := []MemClass{MemClassCache, MemClassPrefetch,
+		MemClassStaging, MemClassPinned}
+	subsystems := make([]*fakeMemAccount, len(classes))
+	for i, class := range classes {
+		f := &fakeMemAccount{}
+		f.handle = acct.Register(class.String(), class, 0, f)
+		subsystems[i] = f
+	}
+
+	// Every eviction must come from the lowest class that holds anything
+	// other than the one reserving.
+	var reserving *fakeMemAccount
+	for i, f := range subsystems {
+		i := i
+		f.onEvict = func(*fakeMemAccount) {
+			for _, lower := range subsystems[:i] {
+				if lower != reserving && lower.held() > 0 {
+					t.Fatalf("evicted from %v while %v holds %d "+
+						"bytes", classes[i],
+						lower.handle.stats.Name, lower.held())
+				}
+			}
+		}
+	}
+
+	checkBalanced := func() {
+		t.Helper()
+		stats := acct.Stats()
+		if stats.Used > memCap {
+			t.Fatalf("used %d bytes over the cap of %d", stats.Used,
+				memCap)
+		}
+		var total uint64
+		for i, f := range subsystems {
+			if stats.Subsystems[i].Used != f.held() {
+				t.Fatalf("%v: accounted for %d bytes but holds %d",
+					classes[i], stats.Subsystems[i].Used, f.held())
+			}
+			total += f.held()
+		}
+		if stats.Used != total {
+			t.Fatalf("accounted for %d bytes in total but %d are held",
+				stats.Used, total)
+		}
+	}
+
+	// Have every subsystem add entries in turn so that they all push
+	// towards the cap.  The pinned one stops short of the cap so that the
+	// staging one can always make room for itself.
+	for round := 0; round < 50; round++ {
+		for i, f := range subsystems {
+			if classes[i] == MemClassPinned && f.held() >= 300 {
+				continue
+			}
+			reserving = f
+			if err := f.add(uint64(10 + i)); err != nil {
+				t.Fatalf("round %d: %v: %v", round, classes[i], err)
+			}
+			checkBalanced()
+		}
+	}
+
+	// The pinned subsystem is never evicted from and the staging one is
+	// only evicted from once the others are empty.
+	stats := acct.Stats()
+	if stats.Subsystems[3].Evictions != 0 {
+		t.Fatalf("evicted %d times from the pinned subsystem",
+			stats.Subsystems[3].Evictions)
+	}
+	for i := 0; i < 3; i++ {
+		if stats.Subsystems[i].Evictions == 0 {
+			t.Fatalf("%v was never evicted from", classes[i])
+		}
+	}
+	if stats.Peak > memCap {
+		t.Fatalf("peaked at %d bytes over the cap of %d", stats.Peak,
+			memCap)
+	}
+
+	// A reservation the pinned subsystem can't make room for is refused
+	// and a reservation over the cap is always refused.
+	reserving = subsystems[3]
+	if err := subsystems[3].add(memCap); !errors.Is(err, ErrMemCapExceeded) {
+		t.Fatalf("expected ErrMemCapExceeded, got %v", err)
+	}
+	if err := subsystems[0].add(memCap + 1); !errors.Is(err, ErrMemCapExceeded) {
+		t.Fatalf("expected ErrMemCapExceeded, got %v", err)
+	}
+	checkBalanced()
+
+	// Nothing is left once the load subsides.
+	for _, f := range subsystems {
+		for len(f.entries) > 0 {
+			f.drop()
+		}
+	}
+	checkBalanced()
+	if used := acct.Stats().Used; used != 0 {
+		t.Fatalf("expected nothing to be held, got %d bytes", used)
+	}
+}
+
+// TestMemAccountantQuotas ensures that the subsystems over their soft quotas
+// are evicted from before the ones under them and that a subsystem over its own
+// quota can't evict the ones under their quotas.
+func TestMemAccountantQuotas(t *testing.T) {
+	acct := NewMemAccountant(100)
+	cache := &fakeMemAccount{}
+	cache.handle = acct.Register("cache", MemClassCache, 50, cache)
+	staging := &fakeMemAccount{}
+	staging.handle = acct.Register("staging", MemClassStaging, 20, staging)
+	pinned := &fakeMemAccount{}
+	pinned.handle = acct.Register("pinned", MemClassPinned, 0, pinned)
+
+	for i := 0; i < 4; i++ {
+		if err := cache.add(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := staging.add(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The staging subsystem is 30 bytes over its quota so it's evicted
+	// from before the cache that's under its quota.
+	for i := 0; i < 2; i++ {
+		if err := pinned.add(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cache.held() != 40 || staging.held() != 40 {
+		t.Fatalf("expected the cache and the staging to hold 40 bytes "+
+			"each, got %d and %d", cache.held(), staging.held())
+	}
+
+	// The staging subsystem goes over its quota while there's room but
+	// can't evict the cache that's under its quota to do so.
+	if err := staging.add(10); !errors.Is(err, ErrMemCapExceeded) {
+		t.Fatalf("expected ErrMemCapExceeded, got %v", err)
+	}
+	if cache.held() != 40 {
+		t.Fatalf("expected the cache to hold 40 bytes, got %d",
+			cache.held())
+	}
+
+	// The pinned subsystem without a quota evicts the staging subsystem
+	// down to its quota first and then the cache.
+	if err := pinned.add(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := pinned.add(30); err != nil {
+		t.Fatal(err)
+	}
+	if staging.held() != 20 || cache.held() != 20 {
+		t.Fatalf("expected the staging and the cache to hold 20 bytes "+
+			"each, got %d and %d", staging.held(), cache.held())
+	}
+
+	stats := acct.Stats()
+	if stats.Used != 100 || stats.Subsystems[2].Rejected != 0 ||
+		stats.Subsystems[1].Rejected != 1 {
+
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// TestProofGenBudgetMemAccountant ensures that the bulk lane requests of the
+// proof generation budget are reserved with the memory accountant and the
+// relay lane requests aren't.
+func TestProofGenBudgetMemAccountant(t *testing.T) {
+	acct := NewMemAccountant(100)
+	cache := &fakeMemAccount{}
+	cache.handle = acct.Register("cache", MemClassCache, 0, cache)
+	if err := cache.add(80); err != nil {
+		t.Fatal(err)
+	}
+
+	budget := NewProofGenBudget(1000, 0)
+	budget.SetMemAccountant(acct)
+
+	// The bulk request evicts the cache to make room and a relay request
+	// is admitted without a reservation.
+	if err := budget.Acquire(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := budget.AcquireLane(ProofLaneRelay, 500); err != nil {
+		t.Fatal(err)
+	}
+	if cache.held() != 0 || acct.Stats().Used != 60 {
+		t.Fatalf("expected only the bulk request to be held, got %+v",
+			acct.Stats())
+	}
+
+	// A bulk request that fits in the budget but not in the accountant is
+	// deferred.
+	var deferred *ProofDeferredError
+	if err := budget.Acquire(50); !errors.As(err, &deferred) {
+		t.Fatalf("expected a ProofDeferredError, got %v", err)
+	}
+
+	budget.ReleaseLane(ProofLaneRelay, 500)
+	budget.Release(60)
+	if used := acct.Stats().Used; used != 0 {
+		t.Fatalf("expected nothing to be held, got %d bytes", used)
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMemPressureInterval is how often the memory pressure is
+	// sampled by default.
+	defaultMemPressureInterval = 5 * time.Second
+
+	// defaultMemPressureHigh is the memory pressure at or above which a
+	// sample counts as pressured by default.  For the pressure stall
+	// information of Linux, it's the percentage of the last 10 seconds
+	// that some tasks were stalled waiting on memory.
+	defaultMemPressureHigh = 10
+
+	// defaultMemPressureLow is the memory pressure at or below which a
+	// sample counts as relieved by default.
+	defaultMemPressureLow = 1
+
+	// defaultMemPressureSustain is how many samples in a row must be
+	// pressured before the subsystems are shrunk, or relieved before
+	// they're restored, by default.
+	defaultMemPressureSustain = 3
+
+	// defaultMemPressureShrinkPercent is the percentage of the bytes held
+	// above the floors that's evicted by every shrink by default.
+	defaultMemPressureShrinkPercent = 25
+
+	// defaultMemPressureRestorePercent is the percentage of the cap of the
+	// accountant that the limit is raised by on every restore by default.
+	defaultMemPressureRestorePercent = 10
+
+	// maxMemPressureHistory is how many of the last adjustments are kept.
+	maxMemPressureHistory = 32
+
+	// memUsagePressureStart is the percentage of the memory limit past
+	// which the memory usage starts to count as pressure for the sources
+	// that read the usage instead of the stalls.
+	memUsagePressureStart = 80
+)
+
+// MemPressureSource is where the memory pressure of the system is read from.
+type MemPressureSource interface {
+	// Name returns a human-readable name of the source.
+	Name() string
+
+	// MemPressure returns the current memory pressure from 0, when there's
+	// none, to 100.
+	MemPressure() (float64, error)
+}
+
+// MemPressureAdjustment is a shrink or a restore of the subsystems of the
+// memory accountant.
+type MemPressureAdjustment struct {
+	// Time is when the adjustment was made and Pressure the memory
+	// pressure sampled right before it.
+	Time     time.Time
+	Pressure float64
+
+	// Shrink is whether the subsystems were shrunk or restored.
+	Shrink bool
+
+	// Freed is the amount of bytes that a shrink evicted.
+	Freed uint64
+
+	// Limit is the limit of the bytes that the subsystems that can be
+	// evicted from hold after the adjustment.  It's 0 once they were
+	// fully restored.
+	Limit uint64
+}
+
+// MemPressureStats are the state of the memory pressure responder of a memory
+// accountant.
+type MemPressureStats struct {
+	// Source is the name of the source the pressure is read from and
+	// Pressure the last sampled pressure.
+	Source   string
+	Pressure float64
+
+	// Samples is the number of times the pressure was sampled and
+	// SampleErrors how many of them failed.
+	Samples      uint64
+	SampleErrors uint64
+
+	// Shrunk is whether the subsystems that can be evicted from are
+	// currently held to Limit bytes in total.
+	Shrunk bool
+	Limit  uint64
+
+	// Shrinks and Restores are the number of adjustments of each kind.
+	Shrinks  uint64
+	Restores uint64
+
+	// History is up to the last maxMemPressureHistory adjustments, the
+	// oldest first.
+	History []MemPressureAdjustment
+}
+
+// recordPressureSample records a sample of the memory pressure.
+//
+// This function is safe for concurrent access.
+func (a *MemAccountant) recordPressureSample(source string, pressure float64,
+	err error) {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.pressure.Source = source
+	a.pressure.Samples++
+	if err != nil {
+		a.pressure.SampleErrors++
+		return
+	}
+	a.pressure.Pressure = pressure
+}
+
+// recordAdjustment adds the adjustment to the history.
+//
+// This function MUST be called with the accountant locked.
+func (a *MemAccountant) recordAdjustment(adj MemPressureAdjustment) {
+	if len(a.pressure.History) == maxMemPressureHistory {
+		copy(a.pressure.History, a.pressure.History[1:])
+		a.pressure.History = a.pressure.History[:maxMemPressureHistory-1]
+	}
+	a.pressure.History = append(a.pressure.History, adj)
+}
+
+// shrinkForPressure evicts the given percentage of the bytes that the
+// subsystems that can be evicted from hold above their floors, in the order of
+// their classes, and holds them to what they're left with until they're
+// restored.  It returns false if there was nothing left to evict.
+//
+// This function is safe for concurrent access.
+func (a *MemAccountant) shrinkForPressure(pressure float64, percent uint) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	var above uint64
+	for _, h := range a.handles {
+		if h.stats.Class != MemClassPinned {
+			above += h.aboveFloor()
+		}
+	}
+	target := above * uint64(percent) / 100
+	if target == 0 {
+		target = above
+	}
+
+	var freed uint64
+	for class := MemClass(0); class < MemClassPinned && freed < target; class++ {
+		for _, h := range a.handles {
+			if freed >= target {
+				break
+			}
+			if h.stats.Class != class {
+				continue
+			}
+			evict := target - freed
+			if above := h.aboveFloor(); evict > above {
+				evict = above
+			}
+			freed += h.evict(evict)
+		}
+	}
+
+	limit := a.evictableUsed()
+	if a.pressure.Shrunk && freed == 0 && limit >= a.pressure.Limit {
+		return false
+	}
+	a.pressure.Shrunk = true
+	a.pressure.Limit = limit
+	a.pressure.Shrinks++
+	a.recordAdjustment(MemPressureAdjustment{
+		Time:     time.Now(),
+		Pressure: pressure,
+		Shrink:   true,
+		Freed:    freed,
+		Limit:    limit,
+	})
+
+	log.Infof("Shrunk the utreexo data caches to %d bytes under memory "+
+		"pressure of %.2f (evicted %d bytes)", limit, pressure, freed)
+
+	return true
+}
+
+// restoreFromPressure raises the limit of the shrunk subsystems by the given
+// percentage of the cap.  The subsystems are no longer held to a limit once it
+// reaches the cap.  It returns false if they weren't shrunk.
+//
+// This function is safe for concurrent access.
+func (a *MemAccountant) restoreFromPressure(pressure float64, percent uint) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if !a.pressure.Shrunk {
+		return false
+	}
+
+	step := a.cap * uint64(percent) / 100
+	if step == 0 {
+		step = 1
+	}
+	a.pressure.Limit += step
+	if a.pressure.Limit >= a.cap {
+		a.pressure.Shrunk = false
+		a.pressure.Limit = 0
+	}
+	a.pressure.Restores++
+	a.recordAdjustment(MemPressureAdjustment{
+		Time:     time.Now(),
+		Pressure: pressure,
+		Limit:    a.pressure.Limit,
+	})
+
+	if a.pressure.Shrunk {
+		log.Infof("Restored the utreexo data caches to %d bytes after "+
+			"memory pressure eased to %.2f", a.pressure.Limit, pressure)
+	} else {
+		log.Infof("Fully restored the utreexo data caches after memory "+
+			"pressure eased to %.2f", pressure)
+	}
+
+	return true
+}
+
+// MemPressureConfig is the configuration of a MemPressureResponder.  The zero
+// values of all the fields but the source use the defaults.
+type MemPressureConfig struct {
+	// Source is where the memory pressure is read from.
+	Source MemPressureSource
+
+	// Interval is how often the pressure is sampled.
+	Interval time.Duration
+
+	// High is the pressure at or above which a sample is pressured and Low
+	// the pressure at or below which it's relieved.
+	High float64
+	Low  float64
+
+	// Sustain is how many samples in a row must be pressured before every
+	// shrink or relieved before every restore.
+	Sustain int
+
+	// ShrinkPercent is the percentage of the bytes held above the floors
+	// that every shrink evicts and RestorePercent the percentage of the
+	// cap that every restore raises the limit by.
+	ShrinkPercent  uint
+	RestorePercent uint
+}
+
+// MemPressureResponder shrinks the subsystems of a memory accountant that can
+// be evicted from while the system is under sustained memory pressure so that
+// the process gives the memory back before the OS kills it.  They're shrunk a
+// step at a time, caches first, down to their floors and restored a step at a
+// time once the pressure clears.
+type MemPressureResponder struct {
+	acct *MemAccountant
+	cfg  MemPressureConfig
+
+	// pressured and relieved are the number of samples in a row that were
+	// pressured and relieved.  They're only used by the handler.
+	pressured int
+	relieved  int
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewMemPressureResponder returns a MemPressureResponder for the accountant.
+func NewMemPressureResponder(acct *MemAccountant,
+	cfg *MemPressureConfig) *MemPressureResponder {
+
+	r := &MemPressureResponder{
+		acct: acct,
+		cfg:  *cfg,
+		quit: make(chan struct{}),
+	}
+	if r.cfg.Interval <= 0 {
+		r.cfg.Interval = defaultMemPressureInterval
+	}
+	if r.cfg.High <= 0 {
+		r.cfg.High = defaultMemPressureHigh
+	}
+	if r.cfg.Low <= 0 || r.cfg.Low >= r.cfg.High {
+		r.cfg.Low = defaultMemPressureLow
+		if r.cfg.Low >= r.cfg.High {
+			r.cfg.Low = r.cfg.High / 2
+		}
+	}
+	if r.cfg.Sustain <= 0 {
+		r.cfg.Sustain = defaultMemPressureSustain
+	}
+	if r.cfg.ShrinkPercent == 0 || r.cfg.ShrinkPercent > 100 {
+		r.cfg.ShrinkPercent = defaultMemPressureShrinkPercent
+	}
+	if r.cfg.RestorePercent == 0 || r.cfg.RestorePercent > 100 {
+		r.cfg.RestorePercent = defaultMemPressureRestorePercent
+	}
+
+	return r
+}
+
+// Start starts sampling the memory pressure.
+func (r *MemPressureResponder) Start() {
+	log.Infof("Responding to the memory pressure read from %s",
+		r.cfg.Source.Name())
+
+	r.wg.Add(1)
+	go r.handler()
+}
+
+// Stop stops sampling the memory pressure.  The subsystems are left as they
+// are.
+func (r *MemPressureResponder) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// handler samples the memory pressure at the configured interval.
+//
+// This function MUST be run as a goroutine.
+func (r *MemPressureResponder) handler() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.sample()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// sample samples the memory pressure once and shrinks or restores the
+// subsystems if the pressure was sustained for long enough.
+func (r *MemPressureResponder) sample() {
+	pressure, err := r.cfg.Source.MemPressure()
+	r.acct.recordPressureSample(r.cfg.Source.Name(), pressure, err)
+	if err != nil {
+		log.Debugf("Unable to read the memory pressure from %s: %v",
+			r.cfg.Source.Name(), err)
+
+		// The pressure must be sustained over samples in a row.
+		r.pressured = 0
+		r.relieved = 0
+		return
+	}
+
+	switch {
+	case pressure >= r.cfg.High:
+		r.relieved = 0
+		r.pressured++
+		if r.pressured < r.cfg.Sustain {
+			return
+		}
+		r.pressured = 0
+		r.acct.shrinkForPressure(pressure, r.cfg.ShrinkPercent)
+
+	case pressure <= r.cfg.Low:
+		r.pressured = 0
+		r.relieved++
+		if r.relieved < r.cfg.Sustain {
+			return
+		}
+		r.relieved = 0
+		r.acct.restoreFromPressure(pressure, r.cfg.RestorePercent)
+
+	default:
+		r.pressured = 0
+		r.relieved = 0
+	}
+}
+
+// psiSource reads the memory pressure from a pressure stall information file
+// of Linux, either the one of a cgroup v2 or the one of the system.  The
+// pressure is the percentage of the last 10 seconds that some tasks were
+// stalled waiting on memory.
+type psiSource struct {
+	path string
+}
+
+// Name returns a human-readable name of the source.
+//
+// This is part of the MemPressureSource interface.
+func (s *psiSource) Name() string {
+	return "pressure stall information " + s.path
+}
+
+// MemPressure returns the current memory pressure.
+//
+// This is part of the MemPressureSource interface.
+func (s *psiSource) MemPressure() (float64, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	return parsePSI(data)
+}
+
+// parsePSI returns the avg10 of the "some" line of the pressure stall
+// information, which looks like:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePSI(data []byte) (float64, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "avg10=") {
+				continue
+			}
+			avg, err := strconv.ParseFloat(
+				strings.TrimPrefix(field, "avg10="), 64)
+			if err != nil {
+				return 0, fmt.Errorf("malformed pressure stall "+
+					"information %q: %v", field, err)
+			}
+			return avg, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no avg10 in the some line of the pressure " +
+		"stall information")
+}
+
+// memUsageSource estimates the memory pressure from the memory used by the
+// process and by the system where the stalls can't be read.  The usage counts
+// as pressure past memUsagePressureStart percent of the limit and rises to 100
+// at the limit.
+type memUsageSource struct {
+	// processLimit is the memory in bytes that the process may use.  0
+	// means that only the system memory is read.
+	processLimit uint64
+
+	// systemMemory returns the total and the available memory of the
+	// system.  It returns false if it can't be read.
+	systemMemory func() (uint64, uint64, bool)
+}
+
+// Name returns a human-readable name of the source.
+//
+// This is part of the MemPressureSource interface.
+func (s *memUsageSource) Name() string {
+	return fmt.Sprintf("memory usage (process limit %d bytes)",
+		s.processLimit)
+}
+
+// MemPressure returns the estimated memory pressure, the higher of the one of
+// the process and the one of the system.
+//
+// This is part of the MemPressureSource interface.
+func (s *memUsageSource) MemPressure() (float64, error) {
+	var pressure float64
+	known := false
+	if s.processLimit > 0 {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		pressure = usagePressure(memStats.Sys, s.processLimit)
+		known = true
+	}
+	if total, available, ok := s.systemMemory(); ok && total > 0 {
+		used := uint64(0)
+		if available < total {
+			used = total - available
+		}
+		if p := usagePressure(used, total); p > pressure {
+			pressure = p
+		}
+		known = true
+	}
+	if !known {
+		return 0, fmt.Errorf("neither the process memory limit nor " +
+			"the system memory is known")
+	}
+
+	return pressure, nil
+}
+
+// usagePressure returns the memory pressure estimated from the used memory of
+// the given limit.
+func usagePressure(used, limit uint64) float64 {
+	start := float64(limit) * memUsagePressureStart / 100
+	if float64(used) <= start {
+		return 0
+	}
+	if used >= limit {
+		return 100
+	}
+
+	return 100 * (float64(used) - start) / (float64(limit) - start)
+}
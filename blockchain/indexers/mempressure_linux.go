@@ -0,0 +1,91 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NewMemPressureSource returns the source of the memory pressure for the
+// platform.  The pressure stall information of the cgroup v2 of the process is
+// preferred, then the one of the system.  The memory usage of the process
+// against processLimit and of the system is read where neither is available.
+func NewMemPressureSource(processLimit uint64) MemPressureSource {
+	var paths []string
+	if cgroup, ok := cgroupV2Path(); ok {
+		paths = append(paths, filepath.Join("/sys/fs/cgroup", cgroup,
+			"memory.pressure"))
+	}
+	paths = append(paths, "/sys/fs/cgroup/memory.pressure",
+		"/proc/pressure/memory")
+	for _, path := range paths {
+		source := &psiSource{path: path}
+		if _, err := source.MemPressure(); err == nil {
+			return source
+		}
+	}
+
+	return &memUsageSource{
+		processLimit: processLimit,
+		systemMemory: systemMemory,
+	}
+}
+
+// cgroupV2Path returns the path of the cgroup v2 of the process relative to
+// the cgroup mount.
+func cgroupV2Path() (string, bool) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", false
+	}
+
+	// The unified hierarchy is the line with the hierarchy ID 0.
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), true
+		}
+	}
+
+	return "", false
+}
+
+// systemMemory returns the total and the available memory of the system as
+// read from /proc/meminfo.
+func systemMemory() (uint64, uint64, bool) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var total, available uint64
+	var haveTotal, haveAvailable bool
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// The lines look like "MemTotal:       16318908 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kib, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, haveTotal = kib*1024, true
+		case "MemAvailable:":
+			available, haveAvailable = kib*1024, true
+		}
+	}
+
+	return total, available, haveTotal && haveAvailable
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package indexers
+
+// NewMemPressureSource returns the source of the memory pressure for the
+// platform.  The memory stalls can't be read outside of Linux so the memory
+// usage of the process against processLimit is read instead.
+func NewMemPressureSource(processLimit uint64) MemPressureSource {
+	return &memUsageSource{
+		processLimit: processLimit,
+		systemMemory: systemMemory,
+	}
+}
+
+// systemMemory returns false as the memory of the system isn't read outside of
+// Linux.
+func systemMemory() (uint64, uint64, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,455 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// fakePressureSource is a memory pressure source that returns whatever it was
+// set to.
+type fakePressureSource struct {
+	mtx      sync.Mutex
+	pressure float64
+	err      error
+}
+
+// set sets the pressure and the error that are returned.
+func (s *fakePressureSource) set(pressure float64, err error) {
+	s.mtx.Lock()
+	s.pressure, s.err = pressure, err
+	s.mtx.Unlock()
+}
+
+// Name returns a human-readable name of the source.
+//
+// This is part of the MemPressureSource interface.
+func (s *fakePressureSource) Name() string {
+	return "fake"
+}
+
+// MemPressure returns the pressure the source was set to.
+//
+// This is part of the MemPressureSource interface.
+func (s *fakePressureSource) MemPressure() (float64, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.pressure, s.err
+}
+
+// TestMemPressureShrinkRestore drives the memory pressure through pressure and
+// relief and ensures that the subsystems are only adjusted once the pressure
+// is sustained, that they're shrunk in the order of their classes down to their
+// floors, that they're held to the limit while shrunk, and that they're
+// restored a step at a time.
+func TestMemPressureShrinkRestore(t *testing.T) {
+	acct := NewMemAccountant(1000)
+
+	classes := []MemClass{MemClassCache, MemClassPrefetch,
+		MemClassStaging, MemClassPinned}
+	floors := []uint64{100, 50, 0, 0}
+	fills := []uint64{400, 200, 100, 100}
+	subsystems := make([]*fakeMemAccount, len(classes))
+	for i, class := range classes {
+		f := &fakeMemAccount{}
+		f.handle = acct.Register(class.String(), class, 0, f)
+		f.handle.SetFloor(floors[i])
+		for j := uint64(0); j < fills[i]; j++ {
+			if err := f.add(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		subsystems[i] = f
+	}
+	cache, prefetch, staging, pinned := subsystems[0], subsystems[1],
+		subsystems[2], subsystems[3]
+
+	// A class is only evicted from once the lower ones are at their
+	// floors and no subsystem goes below its floor.
+	for i, f := range subsystems {
+		i := i
+		f.onEvict = func(*fakeMemAccount) {
+			for j, lower := range subsystems[:i] {
+				if lower.held() > floors[j] {
+					t.Fatalf("shrunk %v while %v holds %d bytes "+
+						"over its floor", classes[i], classes[j],
+						lower.held()-floors[j])
+				}
+			}
+		}
+	}
+
+	source := &fakePressureSource{}
+	r := NewMemPressureResponder(acct, &MemPressureConfig{
+		Source:         source,
+		High:           10,
+		Low:            1,
+		Sustain:        2,
+		ShrinkPercent:  50,
+		RestorePercent: 20,
+	})
+	sample := func(pressure float64) {
+		t.Helper()
+		source.set(pressure, nil)
+		r.sample()
+	}
+	held := func(want ...uint64) {
+		t.Helper()
+		for i, f := range subsystems {
+			if f.held() != want[i] {
+				t.Fatalf("%v holds %d bytes, want %d", classes[i],
+					f.held(), want[i])
+			}
+		}
+	}
+
+	// Pressure that isn't sustained, or that eases to between the
+	// thresholds, doesn't shrink anything.
+	sample(50)
+	sample(5)
+	sample(50)
+	source.set(0, errors.New("unreadable"))
+	r.sample()
+	held(400, 200, 100, 100)
+
+	// Sustained pressure evicts half of what's held above the floors,
+	// caches first.
+	sample(50)
+	held(400, 200, 100, 100)
+	sample(50)
+	held(125, 200, 100, 100)
+	sample(50)
+	sample(50)
+	held(100, 88, 100, 100)
+
+	// The subsystems stay at their floors once they reach them and the
+	// pinned one is never shrunk.
+	for i := 0; i < 40; i++ {
+		sample(50)
+	}
+	held(100, 50, 0, 100)
+	stats := acct.Stats()
+	if !stats.Pressure.Shrunk || stats.Pressure.Limit != 150 {
+		t.Fatalf("unexpected pressure stats %+v", stats.Pressure)
+	}
+	shrinks := stats.Pressure.Shrinks
+
+	// While shrunk, the subsystems can't grow over the limit but they can
+	// grow back to their floors and the pinned one isn't held to it.
+	if err := cache.add(1); !errors.Is(err, ErrMemCapExceeded) {
+		t.Fatalf("expected ErrMemCapExceeded, got %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		staging.drop()
+		prefetch.drop()
+	}
+	if err := prefetch.add(10); err != nil {
+		t.Fatalf("unable to grow back to the floor: %v", err)
+	}
+	if err := pinned.add(500); err != nil {
+		t.Fatal(err)
+	}
+
+	// Relief raises the limit a step at a time until the subsystems are
+	// no longer held to it.
+	wantLimits := []uint64{350, 550, 750, 950, 0}
+	for i, want := range wantLimits {
+		sample(0)
+		sample(0)
+		stats := acct.Stats()
+		if stats.Pressure.Limit != want ||
+			stats.Pressure.Shrunk != (want != 0) {
+
+			t.Fatalf("restore #%d: unexpected pressure stats %+v",
+				i, stats.Pressure)
+		}
+		if i == 0 {
+			// The caches may only grow up to the raised limit.
+			if err := cache.add(200); err != nil {
+				t.Fatal(err)
+			}
+			if err := cache.add(1); !errors.Is(err, ErrMemCapExceeded) {
+				t.Fatalf("expected ErrMemCapExceeded, got %v",
+					err)
+			}
+		}
+	}
+	held(300, 50, 0, 600)
+
+	// Nothing more is restored once the subsystems were fully restored.
+	sample(0)
+	sample(0)
+	stats = acct.Stats()
+	if stats.Pressure.Restores != uint64(len(wantLimits)) ||
+		stats.Pressure.Shrinks != shrinks ||
+		stats.Pressure.Samples != 60 || stats.Pressure.SampleErrors != 1 ||
+		stats.Pressure.Source != "fake" {
+
+		t.Fatalf("unexpected pressure stats %+v", stats.Pressure)
+	}
+
+	// The history has the shrinks followed by the restores.
+	history := stats.Pressure.History
+	if len(history) != int(shrinks)+len(wantLimits) {
+		t.Fatalf("expected %d adjustments, got %d",
+			int(shrinks)+len(wantLimits), len(history))
+	}
+	for i, adj := range history {
+		if adj.Shrink != (i < int(shrinks)) {
+			t.Fatalf("adjustment #%d out of order: %+v", i, adj)
+		}
+	}
+	if history[0].Freed != 275 || history[0].Limit != 425 {
+		t.Fatalf("unexpected first adjustment %+v", history[0])
+	}
+}
+
+// TestMemPressureSources ensures that the pressure is read right from the
+// pressure stall information and estimated right from the memory usage.
+func TestMemPressureSources(t *testing.T) {
+	t.Parallel()
+
+	psi := "some avg10=12.50 avg60=3.00 avg300=1.00 total=1234\n" +
+		"full avg10=2.00 avg60=1.00 avg300=0.50 total=567\n"
+	path := filepath.Join(t.TempDir(), "memory.pressure")
+	if err := os.WriteFile(path, []byte(psi), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pressure, err := (&psiSource{path: path}).MemPressure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pressure != 12.5 {
+		t.Fatalf("expected a pressure of 12.5, got %v", pressure)
+	}
+
+	for _, malformed := range []string{"", "full avg10=1.00\n",
+		"some avg10=high\n", "some total=1\n"} {
+
+		if _, err := parsePSI([]byte(malformed)); err == nil {
+			t.Fatalf("expected an error parsing %q", malformed)
+		}
+	}
+
+	tests := []struct {
+		used, limit uint64
+		want        float64
+	}{
+		{0, 1000, 0},
+		{800, 1000, 0},
+		{900, 1000, 50},
+		{1000, 1000, 100},
+		{2000, 1000, 100},
+	}
+	for _, test := range tests {
+		got := usagePressure(test.used, test.limit)
+		if got != test.want {
+			t.Fatalf("usage of %d of %d: got %v, want %v",
+				test.used, test.limit, got, test.want)
+		}
+	}
+
+	// The system memory is used when the process has no limit and the
+	// source fails when neither is known.
+	source := &memUsageSource{
+		systemMemory: func() (uint64, uint64, bool) {
+			return 1000, 50, true
+		},
+	}
+	if pressure, err := source.MemPressure(); err != nil || pressure != 75 {
+		t.Fatalf("expected a pressure of 75, got %v (err: %v)",
+			pressure, err)
+	}
+	source.systemMemory = func() (uint64, uint64, bool) {
+		return 0, 0, false
+	}
+	if _, err := source.MemPressure(); err == nil {
+		t.Fatal("expected an error without any memory limit")
+	}
+}
+
+// TestMemPressureProofGeneration ensures that shrinking and restoring the
+// subsystems under memory pressure, the proof cache of the utreexo proof index
+// among them, doesn't change the proofs generated or fetched concurrently with
+// it.
+func TestMemPressureProofGeneration(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestMemPressureProofGeneration", 1)
+	defer tearDown()
+
+	var spends, allSpends []*blockchain.SpendableOut
+	var hashes []*chainhash.Hash
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	for i := 0; i < 20; i++ {
+		var created []*blockchain.SpendableOut
+		tip, created = blockchain.AddBlock(chain, tip, spends)
+		spends = created[:len(created)/2]
+		allSpends = append(allSpends, created[len(created)/2:]...)
+		hashes = append(hashes, tip.Hash())
+	}
+
+	var utxos []*blockchain.UtxoEntry
+	var outpoints []wire.OutPoint
+	for _, spend := range allSpends {
+		utxo, err := chain.FetchUtxoEntry(spend.PrevOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if utxo == nil || utxo.IsSpent() {
+			continue
+		}
+		utxos = append(utxos, utxo)
+		outpoints = append(outpoints, spend.PrevOut)
+	}
+
+	var idx *UtreexoProofIndex
+	for _, indexer := range indexes {
+		if utreexoIdx, ok := indexer.(*UtreexoProofIndex); ok {
+			idx = utreexoIdx
+		}
+	}
+	wantUDs := make([]*wire.UData, len(hashes))
+	for i, hash := range hashes {
+		ud, err := idx.FetchUtreexoProof(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantUDs[i] = ud
+	}
+
+	acct := NewMemAccountant(1 << 20)
+	budget := NewProofGenBudget(1<<30, 0)
+	budget.SetMemAccountant(acct)
+	idx.SetProofCacheSize(4096)
+	idx.proofCache.clear()
+	idx.SetMemAccountant(acct)
+
+	type prover interface {
+		ProveUtxos([]*blockchain.UtxoEntry, *[]wire.OutPoint) (
+			*blockchain.ChainTipProof, error)
+		SetProofGenBudget(*ProofGenBudget)
+	}
+	var provers []prover
+	var want []*blockchain.ChainTipProof
+	for _, indexer := range indexes {
+		p, ok := indexer.(prover)
+		if !ok {
+			continue
+		}
+		proof, err := p.ProveUtxos(utxos, &outpoints)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.SetProofGenBudget(budget)
+		provers = append(provers, p)
+		want = append(want, proof)
+	}
+
+	source := &fakePressureSource{}
+	r := NewMemPressureResponder(acct, &MemPressureConfig{
+		Source:  source,
+		Sustain: 1,
+	})
+
+	// Cycle through pressure and relief while the proofs keep being
+	// fetched into the proof cache.
+	quit := make(chan struct{})
+	var pressureWg sync.WaitGroup
+	pressureWg.Add(1)
+	fetchErrs := make(chan error, 1)
+	go func() {
+		defer pressureWg.Done()
+		for i := 0; ; i++ {
+			if i >= 2*len(hashes) {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+			}
+			if i%20 < 10 {
+				source.set(50, nil)
+			} else {
+				source.set(0, nil)
+			}
+			r.sample()
+
+			k := i % len(hashes)
+			ud, err := idx.FetchUtreexoProof(hashes[k])
+			if err == nil && !reflect.DeepEqual(ud, wantUDs[k]) {
+				err = errors.New("proof fetched under memory " +
+					"pressure differs")
+			}
+			if err != nil {
+				fetchErrs <- err
+				return
+			}
+		}
+	}()
+
+	// Every index proves from its own goroutine as proving from the same
+	// forest concurrently updates its statistics.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(provers))
+	for i, p := range provers {
+		wg.Add(1)
+		go func(i int, p prover) {
+			defer wg.Done()
+			for k := 0; k < 50; k++ {
+				proof, err := p.ProveUtxos(utxos, &outpoints)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(proof, want[i]) {
+					errs <- errors.New("proof generated under " +
+						"memory pressure differs")
+					return
+				}
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	close(quit)
+	pressureWg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	close(fetchErrs)
+	for err := range fetchErrs {
+		t.Fatal(err)
+	}
+
+	stats := acct.Stats()
+	if stats.Pressure.Shrinks == 0 || stats.Pressure.Restores == 0 {
+		t.Fatalf("expected the pressure to be cycled, got %+v",
+			stats.Pressure)
+	}
+	var evicted uint64
+	for _, sub := range stats.Subsystems {
+		if sub.Name == "utreexo proof cache" {
+			evicted = sub.EvictedBytes
+		}
+	}
+	if evicted == 0 {
+		t.Fatalf("nothing was evicted from the proof cache: %+v",
+			stats.Subsystems)
+	}
+}
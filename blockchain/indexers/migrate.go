@@ -0,0 +1,302 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// MigrationDirection is which of the utreexo proof indexes is migrated to the
+// other one.
+type MigrationDirection uint8
+
+const (
+	// MigrateNone doesn't migrate either of the utreexo proof indexes.
+	MigrateNone MigrationDirection = iota
+
+	// MigrateToFlat migrates the utreexo proof index to the flat utreexo
+	// proof index.
+	MigrateToFlat
+
+	// MigrateToDB migrates the flat utreexo proof index to the utreexo
+	// proof index.
+	MigrateToDB
+)
+
+// String returns the MigrationDirection in human-readable form.
+func (d MigrationDirection) String() string {
+	switch d {
+	case MigrateNone:
+		return "none"
+	case MigrateToFlat:
+		return "toflat"
+	case MigrateToDB:
+		return "todb"
+	default:
+		return fmt.Sprintf("unknown migration direction %d", uint8(d))
+	}
+}
+
+// ParseMigrationDirection returns the migration direction with the given name.
+// An empty name is MigrateNone.
+func ParseMigrationDirection(s string) (MigrationDirection, error) {
+	switch s {
+	case "", "none":
+		return MigrateNone, nil
+	case "toflat":
+		return MigrateToFlat, nil
+	case "todb":
+		return MigrateToDB, nil
+	}
+
+	return 0, fmt.Errorf("invalid migration direction %q: expected "+
+		"toflat or todb", s)
+}
+
+// utreexoMigrationKey is the key in the index tips bucket that the progress of
+// migrating a utreexo proof index to the other one is kept at.
+var utreexoMigrationKey = []byte("utreexomigration")
+
+// -----------------------------------------------------------------------------
+// The progress of a migration is kept in the index tips bucket under the
+// utreexo migration key until the migration is done.
+//
+// The serialized format is:
+//
+//   <direction><block height><block hash>
+//
+//   Field           Type             Size
+//   direction       uint8            1 byte
+//   block height    uint32           4 bytes
+//   block hash      chainhash.Hash   chainhash.HashSize
+// -----------------------------------------------------------------------------
+
+// migrationRecord is how far a migration got.  The entries of the blocks up to
+// the block with the hash at the height are migrated.
+type migrationRecord struct {
+	direction MigrationDirection
+	height    int32
+	hash      chainhash.Hash
+}
+
+// serializeMigrationRecord returns the serialized migration record.
+func serializeMigrationRecord(rec *migrationRecord) []byte {
+	serialized := make([]byte, 5+chainhash.HashSize)
+	serialized[0] = byte(rec.direction)
+	byteOrder.PutUint32(serialized[1:5], uint32(rec.height))
+	copy(serialized[5:], rec.hash[:])
+	return serialized
+}
+
+// deserializeMigrationRecord returns the migration record that was serialized.
+func deserializeMigrationRecord(serialized []byte) (*migrationRecord, error) {
+	if len(serialized) != 5+chainhash.HashSize {
+		return nil, database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("unexpected utreexo migration "+
+				"record length %d", len(serialized)),
+		}
+	}
+
+	rec := &migrationRecord{
+		direction: MigrationDirection(serialized[0]),
+		height:    int32(byteOrder.Uint32(serialized[1:5])),
+	}
+	copy(rec.hash[:], serialized[5:])
+	return rec, nil
+}
+
+// dbFetchMigration returns the progress of the migration that isn't done yet.
+// It's nil if there's none.
+func dbFetchMigration(dbTx database.Tx) (*migrationRecord, error) {
+	indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+	if indexesBucket == nil {
+		return nil, nil
+	}
+	serialized := indexesBucket.Get(utreexoMigrationKey)
+	if serialized == nil {
+		return nil, nil
+	}
+
+	return deserializeMigrationRecord(serialized)
+}
+
+// dbPutMigration records the progress of the migration.
+func dbPutMigration(dbTx database.Tx, rec *migrationRecord) error {
+	indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+	return indexesBucket.Put(utreexoMigrationKey, serializeMigrationRecord(rec))
+}
+
+// dbDeleteMigration deletes the progress of the migration once it's done.
+func dbDeleteMigration(dbTx database.Tx) error {
+	indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+	return indexesBucket.Delete(utreexoMigrationKey)
+}
+
+// SetUtreexoMigration sets the direction that the utreexo proof indexes are
+// migrated in on start up.  The entries and the utreexo state of the source are
+// copied to the destination without connecting any block to it, and whatever
+// the destination had before is thrown away.  Both indexes must be enabled.  An
+// interrupted migration is resumed on the next start up whether it's set or
+// not.  It must be called before the manager is initialized.
+func (m *Manager) SetUtreexoMigration(direction MigrationDirection) {
+	m.migration = direction
+}
+
+// loadMigration returns the migration that was asked for or that was
+// interrupted.  It's nil if there's none.
+func (m *Manager) loadMigration() (*indexRecovery, error) {
+	var rec *migrationRecord
+	err := m.db.View(func(dbTx database.Tx) error {
+		var err error
+		rec, err = dbFetchMigration(dbTx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	direction := m.migration
+	if rec != nil {
+		if direction != MigrateNone && direction != rec.direction {
+			return nil, fmt.Errorf("unable to migrate the utreexo "+
+				"proof indexes %v as the migration %v was "+
+				"interrupted at height %d", direction,
+				rec.direction, rec.height)
+		}
+		direction = rec.direction
+	}
+	if direction == MigrateNone {
+		return nil, nil
+	}
+
+	dbIdx, flatIdx := m.utreexoProofIndexes()
+	r := &indexRecovery{migration: direction}
+	switch direction {
+	case MigrateToFlat:
+		r.dest, r.source = flatIdx, dbIdx
+	case MigrateToDB:
+		r.dest, r.source = dbIdx, flatIdx
+	default:
+		return nil, AssertError(fmt.Sprintf("unknown utreexo migration "+
+			"direction %d", uint8(direction)))
+	}
+
+	// The destination of an interrupted migration is only left alone while
+	// it's disabled.
+	if dbIdx == nil || flatIdx == nil {
+		if rec == nil {
+			return nil, fmt.Errorf("unable to migrate the utreexo "+
+				"proof indexes %v without both of them enabled",
+				direction)
+		}
+		if r.dest != nil {
+			return nil, fmt.Errorf("the migration of the %s to the "+
+				"%s was interrupted at height %d.  Enable both "+
+				"indexes to resume it", r.source.Name(),
+				r.dest.Name(), rec.height)
+		}
+		log.Warnf("The migration of the utreexo proof indexes %v was "+
+			"interrupted at height %d.  Enable both indexes to "+
+			"resume it", direction, rec.height)
+		return nil, nil
+	}
+
+	// A migration is resumed from the last block that was migrated as long
+	// as it wasn't reorganized out of the main chain since.
+	if rec != nil && rec.height > 0 && m.chain.MainChainHasBlock(&rec.hash) {
+		r.resume = rec.height
+	}
+
+	return r, nil
+}
+
+// migrateIndex migrates the source of the migration to its destination.  The
+// migration is started over unless it's resumed, in which case the destination
+// keeps what was migrated up to the recorded height.
+func (m *Manager) migrateIndex(r *indexRecovery, interrupt <-chan struct{}) error {
+	var sourceTip int32
+	err := m.db.View(func(dbTx database.Tx) error {
+		var err error
+		_, sourceTip, err = dbFetchIndexerTip(dbTx, r.source.Key())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sourceTip <= 0 {
+		return fmt.Errorf("unable to migrate the %s to the %s as it "+
+			"has no entries", r.source.Name(), r.dest.Name())
+	}
+	if err := m.recoveryBlocker(r); err != nil {
+		return fmt.Errorf("unable to migrate the %s to the %s: %v",
+			r.source.Name(), r.dest.Name(), err)
+	}
+
+	// The source may have been rolled back past the recorded height.
+	if r.resume > sourceTip {
+		r.resume = 0
+	}
+
+	if r.resume > 0 {
+		log.Infof("Resuming the migration of the %s to the %s from "+
+			"height %d", r.source.Name(), r.dest.Name(), r.resume)
+		err = r.dest.resumeRecovery(r.resume)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Infof("Migrating the %s to the %s up to height %d",
+			r.source.Name(), r.dest.Name(), sourceTip)
+
+		// The destination isn't used until it's migrated.
+		err = m.db.Update(func(dbTx database.Tx) error {
+			err := dbPutIndexerTip(dbTx, r.dest.Key(),
+				&chainhash.Hash{}, -1)
+			if err != nil {
+				return err
+			}
+			return dbPutMigration(dbTx, &migrationRecord{
+				direction: r.migration,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = r.dest.ResetIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.recoverIndex(r, sourceTip, interrupt)
+	if err != nil {
+		return err
+	}
+	log.Infof("Migrated the %s to the %s.  The %s may be dropped now",
+		r.source.Name(), r.dest.Name(), r.source.Name())
+
+	return nil
+}
+
+// recordMigration records that the entries up to the given block were migrated
+// once everything that was migrated up to it is written out.
+func (m *Manager) recordMigration(r *indexRecovery, id *BlockID) error {
+	err := r.dest.syncRecovered(id.Height)
+	if err != nil {
+		return err
+	}
+
+	return m.db.Update(func(dbTx database.Tx) error {
+		return dbPutMigration(dbTx, &migrationRecord{
+			direction: r.migration,
+			height:    id.Height,
+			hash:      id.Hash,
+		})
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+)
+
+// migrationManager returns a manager of new instances of the utreexo proof
+// indexes on the same database and data directory as the given ones that
+// migrates in the given direction five blocks at a time.
+func migrationManager(t *testing.T, dbPath string, indexes []Indexer,
+	params *chaincfg.Params, direction MigrationDirection) (
+	*Manager, *UtreexoProofIndex, *FlatUtreexoProofIndex) {
+
+	db := indexes[0].(*UtreexoProofIndex).db
+	proofGenInterval := int32(1)
+	flatIdx, err := NewFlatUtreexoProofIndex(dbPath, params,
+		&proofGenInterval, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbIdx, err := NewUtreexoProofIndex(db, dbPath, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(db, []Indexer{dbIdx, flatIdx})
+	m.SetUtreexoMigration(direction)
+	m.recoveryBatch = 5
+
+	return m, dbIdx, flatIdx
+}
+
+// fetchMigration returns the progress of the migration that isn't done yet.
+func fetchMigration(t *testing.T, db database.DB) *migrationRecord {
+	var rec *migrationRecord
+	err := db.View(func(dbTx database.Tx) error {
+		var err error
+		rec, err = dbFetchMigration(dbTx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rec
+}
+
+// TestMigrateUtreexoProofIndex ensures that a utreexo proof index is migrated
+// to the other one without connecting any block to it, that an interrupted
+// migration is resumed from the height it got up to, and that the migrated
+// index has the same entries as the index it was migrated from.
+func TestMigrateUtreexoProofIndex(t *testing.T) {
+	defer os.RemoveAll(testDbRoot)
+	for _, direction := range []MigrationDirection{MigrateToFlat, MigrateToDB} {
+		testName := "TestMigrateUtreexoProofIndex" + direction.String()
+		chain, indexes, params, tearDown := indexersTestChain(testName, 1)
+
+		tip, spendables := blockchain.AddBlock(chain,
+			btcutil.NewBlock(params.GenesisBlock), nil)
+		for i := 0; i < 20; i++ {
+			tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+		}
+
+		// The utreexo states are flushed as they are on shutdown.
+		db := indexes[0].(*UtreexoProofIndex).db
+		for _, indexer := range indexes {
+			var err error
+			switch idx := indexer.(type) {
+			case *UtreexoProofIndex:
+				err = idx.FlushUtreexoState()
+			case *FlatUtreexoProofIndex:
+				err = idx.FlushUtreexoState()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		dbPath := filepath.Join(testDbRoot, testName)
+
+		// Start the migration and interrupt it after the first batch.
+		m, _, _ := migrationManager(t, dbPath, indexes, params,
+			MigrateNone)
+		err := m.Init(chain, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", direction, err)
+		}
+		m.SetUtreexoMigration(direction)
+		r, err := m.loadMigration()
+		if err != nil {
+			t.Fatalf("%v: %v", direction, err)
+		}
+		interrupt := make(chan struct{})
+		close(interrupt)
+		err = m.migrateIndex(r, interrupt)
+		if !errors.Is(err, errInterruptRequested) {
+			t.Fatalf("%v: got error %v, want an interruption",
+				direction, err)
+		}
+		rec := fetchMigration(t, db)
+		if rec == nil || rec.direction != direction || rec.height != 5 {
+			t.Fatalf("%v: got migration record %+v", direction, rec)
+		}
+		err = db.View(func(dbTx database.Tx) error {
+			_, height, err := dbFetchIndexerTip(dbTx, r.dest.Key())
+			if err == nil && height != -1 {
+				t.Fatalf("%v: the tip of the %s is at height %d "+
+					"while it's migrated", direction,
+					r.dest.Name(), height)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Migrating in the other direction is refused until the
+		// interrupted migration is done.
+		other := MigrateToDB
+		if direction == MigrateToDB {
+			other = MigrateToFlat
+		}
+		m, _, _ = migrationManager(t, dbPath, indexes, params, other)
+		err = m.Init(chain, nil)
+		if err == nil {
+			t.Fatalf("%v: migrated %v while a migration was "+
+				"interrupted", direction, other)
+		}
+
+		// The interrupted migration is resumed without being asked.
+		m, dbIdx, flatIdx := migrationManager(t, dbPath, indexes, params,
+			MigrateNone)
+		err = m.Init(chain, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", direction, err)
+		}
+		if rec := fetchMigration(t, db); rec != nil {
+			t.Fatalf("%v: the migration is still recorded at height "+
+				"%d", direction, rec.height)
+		}
+
+		destStats := flatIdx.Stats()
+		if direction == MigrateToDB {
+			destStats = dbIdx.Stats()
+		}
+		recovery := destStats.Recovery
+		if destStats.Total.Blocks != 0 {
+			t.Fatalf("%v: connected %d blocks", direction,
+				destStats.Total.Blocks)
+		}
+		if recovery == nil || !recovery.Done ||
+			recovery.Height != tip.Height() {
+
+			t.Fatalf("%v: got migration %+v", direction, recovery)
+		}
+
+		err = compareUtreexoIdx(1, tip.Height()+1, chain,
+			[]Indexer{dbIdx, flatIdx})
+		if err != nil {
+			t.Fatalf("%v: %v", direction, err)
+		}
+
+		tearDown()
+	}
+}
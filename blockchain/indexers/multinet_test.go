@@ -0,0 +1,232 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+)
+
+// multiNetStack is a chain with the utreexo proof indexes of one network that
+// runs alongside the ones of other networks.
+type multiNetStack struct {
+	params  chaincfg.Params
+	chain   *blockchain.BlockChain
+	indexes []Indexer
+	flat    *FlatUtreexoProofIndex
+	dbPath  string
+	tip     *btcutil.Block
+
+	tearDown func()
+}
+
+// run connects blocks to the chain of the stack, reorgs to a longer chain, and
+// then checks everything that the indexes serve against the chain.  The stack
+// has to be torn down once it's no longer needed.
+func (s *multiNetStack) run(testName string) error {
+	chain, indexes, _, tearDown := indexersTestChainWithParams(testName, 1,
+		&s.params)
+	s.chain, s.indexes, s.tearDown = chain, indexes, tearDown
+	s.dbPath = filepath.Join(testDbRoot, testName)
+	for _, indexer := range indexes {
+		if flat, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			s.flat = flat
+		}
+	}
+
+	genesis := btcutil.NewBlock(s.params.GenesisBlock)
+	b1, spends := blockchain.AddBlock(chain, genesis, nil)
+	addLockOrderBlocks(chain, b1, spends, 10)
+	s.tip = addLockOrderBlocks(chain, b1, spends, 14)
+
+	best := chain.BestSnapshot()
+	if best.Hash != *s.tip.Hash() {
+		return fmt.Errorf("chain didn't reorg to the longer chain")
+	}
+
+	err := testUtreexoProof(s.tip, chain, indexes)
+	if err != nil {
+		return err
+	}
+	err = compareUtreexoIdx(1, best.Height+1, chain, indexes)
+	if err != nil {
+		return err
+	}
+
+	// A utreexo node of the network syncs the chain with the proofs of
+	// the indexes.
+	csnChain, _, csnTearDown, err := csnTestChainWithParams(
+		testName+"-CsnChain", &s.params)
+	defer csnTearDown()
+	if err != nil {
+		return err
+	}
+	err = syncCsnChain(1, best.Height+1, chain, csnChain, indexes)
+	if err != nil {
+		return err
+	}
+	if csnBest := csnChain.BestSnapshot(); csnBest.Hash != best.Hash {
+		return fmt.Errorf("the utreexo node synced to height %d "+
+			"instead of %d", csnBest.Height, best.Height)
+	}
+
+	stats, err := s.flat.FetchCoinAgeStats(0, best.Height)
+	if err != nil {
+		return err
+	}
+	for height := int32(0); height <= best.Height; height++ {
+		want, err := bruteForceCoinAgeStats(s.flat, height)
+		if err != nil {
+			return err
+		}
+		if stats[height] != want {
+			return fmt.Errorf("height %d: got coin age stats %+v, "+
+				"want %+v", height, stats[height], want)
+		}
+	}
+
+	for _, indexer := range indexes {
+		var writeStats IndexWriteStats
+		switch idx := indexer.(type) {
+		case *FlatUtreexoProofIndex:
+			writeStats = idx.Stats()
+		case *UtreexoProofIndex:
+			writeStats = idx.Stats()
+		}
+		if writeStats.Network != s.params.Name ||
+			writeStats.LastHeight != best.Height {
+
+			return fmt.Errorf("%s: unexpected write stats %+v",
+				indexer.Name(), writeStats)
+		}
+	}
+
+	return nil
+}
+
+// testSigNetChallenge is the challenge of the custom signet of the tests.  It's
+// an OP_TRUE so the blocks don't need to be signed.
+var testSigNetChallenge = []byte{0x51}
+
+// testSigNetParams returns the parameters of a custom signet that the test
+// harness can mine blocks for.  The network is derived from the challenge like
+// for any signet but the genesis block and the proof of work limit are the ones
+// of regtest since the harness can't mine blocks at the difficulty of the signet
+// genesis block, and the soft forks are moved to the heights of regtest since
+// the harness only mines version 1 blocks.
+func testSigNetParams() chaincfg.Params {
+	params := chaincfg.CustomSignetParams(testSigNetChallenge, nil)
+	regtest := chaincfg.RegressionNetParams
+	params.GenesisBlock = regtest.GenesisBlock
+	params.GenesisHash = regtest.GenesisHash
+	params.PowLimit = regtest.PowLimit
+	params.PowLimitBits = regtest.PowLimitBits
+	params.BIP0034Height = regtest.BIP0034Height
+	params.BIP0065Height = regtest.BIP0065Height
+	params.BIP0066Height = regtest.BIP0066Height
+
+	return params
+}
+
+// TestConcurrentNetworks ensures that the indexes of different networks run in
+// one process don't share any of their stats, caches, or files.
+func TestConcurrentNetworks(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	// The harness only mines version 1 blocks so the soft forks of simnet
+	// are moved to the heights of regtest.
+	simNet := chaincfg.SimNetParams
+	simNet.BIP0034Height = chaincfg.RegressionNetParams.BIP0034Height
+	simNet.BIP0065Height = chaincfg.RegressionNetParams.BIP0065Height
+	simNet.BIP0066Height = chaincfg.RegressionNetParams.BIP0066Height
+	stacks := []*multiNetStack{
+		{params: chaincfg.RegressionNetParams},
+		{params: simNet},
+		{params: testSigNetParams()},
+	}
+	errs := make([]error, len(stacks))
+	var wg sync.WaitGroup
+	for i, stack := range stacks {
+		stack.params.CoinbaseMaturity = 1
+
+		wg.Add(1)
+		go func(i int, stack *multiNetStack) {
+			defer wg.Done()
+			testName := "TestConcurrentNetworks-" + stack.params.Name
+			errs[i] = stack.run(testName)
+		}(i, stack)
+	}
+	wg.Wait()
+	for _, stack := range stacks {
+		if stack.tearDown != nil {
+			defer stack.tearDown()
+		}
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("%s: %v", stacks[i].params.Name, err)
+		}
+	}
+
+	// Every file of the indexes is kept in the data directory of their
+	// network.
+	dbPaths := make(map[string]bool)
+	for _, stack := range stacks {
+		paths := []string{
+			stack.flat.dataDir,
+			stack.flat.proofState.path,
+			stack.flat.undoState.path,
+			stack.flat.coinAge.path,
+			stack.flat.pins.path,
+		}
+		for _, path := range paths {
+			if !strings.HasPrefix(path, stack.dbPath+string(filepath.Separator)) &&
+				path != stack.dbPath {
+
+				t.Fatalf("%s: %s isn't in the data directory %s",
+					stack.params.Name, path, stack.dbPath)
+			}
+		}
+
+		if dbPaths[stack.dbPath] {
+			t.Fatalf("%s: the data directory %s is used by another "+
+				"network", stack.params.Name, stack.dbPath)
+		}
+		dbPaths[stack.dbPath] = true
+	}
+	entries, err := os.ReadDir(testDbRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(testDbRoot, entry.Name())
+		if !dbPaths[path] {
+			t.Fatalf("unexpected file %s outside of the data "+
+				"directories of the networks", path)
+		}
+	}
+
+	// The flat files of every network end at its own tip.
+	for _, stack := range stacks {
+		for _, ff := range []*FlatFileState{&stack.flat.proofState,
+			&stack.flat.undoState} {
+
+			if ff.BestHeight() != stack.tip.Height() {
+				t.Fatalf("%s: %s ends at height %d, want %d",
+					stack.params.Name, ff.path, ff.BestHeight(),
+					stack.tip.Height())
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// ErrOutPointIncluded is returned when a non-inclusion proof is requested for
+// an outpoint whose leaf is in the accumulator at the requested height.
+var ErrOutPointIncluded = errors.New("the leaf for the outpoint is in the " +
+	"accumulator at the requested height")
+
+// NonInclusionReason describes why the leaf for an outpoint isn't in the
+// accumulator at a height.
+type NonInclusionReason uint8
+
+const (
+	// NonInclusionNotCreated is the reason for outpoints that weren't
+	// created in any block up to the height.
+	NonInclusionNotCreated NonInclusionReason = iota
+
+	// NonInclusionSpent is the reason for outpoints that were spent in a
+	// block up to the height.
+	NonInclusionSpent
+)
+
+// String returns the NonInclusionReason as a human-readable name.
+func (r NonInclusionReason) String() string {
+	switch r {
+	case NonInclusionNotCreated:
+		return "notcreated"
+	case NonInclusionSpent:
+		return "spent"
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(r))
+}
+
+// NonInclusionProof is the evidence that the leaf for an outpoint isn't in the
+// accumulator after the block at a height was connected.
+//
+// The accumulator doesn't order its leaves, so there is no structure that
+// proves that a leaf is missing on its own.  The evidence for a spent outpoint
+// is the proof that the spending block carried: LeafData is proven by UData
+// against the roots after the block before SpendHeight, and the block at
+// SpendHeight removes it.  A verifier that trusts the headers up to Height and
+// the roots at SpendHeight-1 doesn't need to trust the node that made the
+// proof, as outpoints can't be created twice.
+//
+// An outpoint that was never created can't be proven at all.  The proof is
+// then only a statement that the node found no block up to Height creating the
+// outpoint, and trusting it means trusting the node.  The same goes for
+// outpoints that were spent in the block that created them, since they never
+// had a leaf.  Their UData and LeafData are nil.
+type NonInclusionProof struct {
+	// OutPoint is the outpoint the proof is for.
+	OutPoint wire.OutPoint
+
+	// Height is the height of the block after which the leaf for the
+	// outpoint isn't in the accumulator.
+	Height int32
+
+	// Reason is why the leaf isn't in the accumulator.
+	Reason NonInclusionReason
+
+	// SpendHeight and SpendBlockHash are the block that spent the
+	// outpoint.  They're only set for NonInclusionSpent.
+	SpendHeight    int32
+	SpendBlockHash chainhash.Hash
+
+	// SpendTxHash is the transaction that spent the outpoint.  It's only
+	// set for NonInclusionSpent.
+	SpendTxHash chainhash.Hash
+
+	// LeafData is the leaf that was removed from the accumulator when the
+	// outpoint was spent.
+	LeafData *wire.LeafData
+
+	// UData is the utreexo data of the spending block with every leaf data
+	// filled in.  Its accumulator proof proves LeafData along with the
+	// rest of the leaves the block spent.
+	UData *wire.UData
+}
+
+// GenerateNonInclusionProof returns the evidence that the leaf for the given
+// outpoint isn't in the accumulator after the block at the given height was
+// connected.  ErrOutPointIncluded is returned if it is.
+//
+// Finding the block that spent an outpoint scans the inputs of every block
+// down from the chain tip so it's meant for occasional requests.
+func (idx *FlatUtreexoProofIndex) GenerateNonInclusionProof(op wire.OutPoint,
+	height int32) (*NonInclusionProof, error) {
+
+	return generateNonInclusionProof(idx.chain, op, height,
+		func(block *btcutil.Block) (*wire.UData, error) {
+			return idx.FetchUtreexoProof(block.Height(), false)
+		})
+}
+
+// GenerateNonInclusionProof returns the evidence that the leaf for the given
+// outpoint isn't in the accumulator after the block at the given height was
+// connected.  ErrOutPointIncluded is returned if it is.
+//
+// Finding the block that spent an outpoint scans the inputs of every block
+// down from the chain tip so it's meant for occasional requests.
+func (idx *UtreexoProofIndex) GenerateNonInclusionProof(op wire.OutPoint,
+	height int32) (*NonInclusionProof, error) {
+
+	return generateNonInclusionProof(idx.chain, op, height,
+		func(block *btcutil.Block) (*wire.UData, error) {
+			return idx.FetchUtreexoProof(block.Hash())
+		})
+}
+
+// generateNonInclusionProof returns the evidence that the leaf for the given
+// outpoint isn't in the accumulator after the block at the given height.  The
+// stored utreexo data of a block is fetched with fetchUData.
+func generateNonInclusionProof(chain indexChain, op wire.OutPoint,
+	height int32, fetchUData func(*btcutil.Block) (*wire.UData, error)) (
+	*NonInclusionProof, error) {
+
+	if chain == nil {
+		return nil, fmt.Errorf("no chain set to generate the non-inclusion " +
+			"proof with")
+	}
+	best := chain.BestSnapshot()
+	if height < 0 || height > best.Height {
+		return nil, fmt.Errorf("height %d is out of range [0, %d]", height,
+			best.Height)
+	}
+
+	proof := &NonInclusionProof{OutPoint: op, Height: height}
+
+	// An unspent outpoint is in the accumulator from the block that
+	// created it on.
+	entry, err := chain.FetchUtxoEntry(op)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && !entry.IsSpent() {
+		if entry.BlockHeight() <= height {
+			return nil, ErrOutPointIncluded
+		}
+		proof.Reason = NonInclusionNotCreated
+		return proof, nil
+	}
+
+	spendBlock, spendTx, err := findSpendingBlock(chain, op, best.Height)
+	if err != nil {
+		return nil, err
+	}
+	if spendBlock == nil {
+		proof.Reason = NonInclusionNotCreated
+		return proof, nil
+	}
+
+	stxos, err := chain.FetchSpendJournalUnsafe(spendBlock)
+	if err != nil {
+		return nil, err
+	}
+	_, _, inskip, _ := blockchain.DedupeBlock(spendBlock)
+	dels, _, err := blockchain.BlockToDelLeaves(stxos, chain, spendBlock,
+		inskip, -1)
+	if err != nil {
+		return nil, err
+	}
+	var leaf *wire.LeafData
+	for i := range dels {
+		if dels[i].OutPoint == op {
+			leaf = &dels[i]
+			break
+		}
+	}
+
+	// The outpoint never had a leaf if it was spent in the block that
+	// created it.
+	if leaf == nil {
+		if spendBlock.Height() <= height {
+			proof.Reason = NonInclusionSpent
+			proof.SpendHeight = spendBlock.Height()
+			proof.SpendBlockHash = *spendBlock.Hash()
+			proof.SpendTxHash = *spendTx
+		}
+		return proof, nil
+	}
+
+	switch {
+	case leaf.Height > height:
+		proof.Reason = NonInclusionNotCreated
+		return proof, nil
+
+	case spendBlock.Height() > height:
+		return nil, ErrOutPointIncluded
+	}
+
+	ud, err := fetchUData(spendBlock)
+	if err != nil {
+		return nil, err
+	}
+	if len(ud.LeafDatas) != len(dels) {
+		return nil, fmt.Errorf("the utreexo data of block %d has %d "+
+			"leaves but the block spends %d", spendBlock.Height(),
+			len(ud.LeafDatas), len(dels))
+	}
+	ud.LeafDatas = dels
+
+	proof.Reason = NonInclusionSpent
+	proof.SpendHeight = spendBlock.Height()
+	proof.SpendBlockHash = *spendBlock.Hash()
+	proof.SpendTxHash = *spendTx
+	proof.LeafData = leaf
+	proof.UData = ud
+
+	return proof, nil
+}
+
+// findSpendingBlock returns the block at or below the given height that spent
+// the outpoint and the hash of the spending transaction.  A nil block is
+// returned if no block spent it.
+func findSpendingBlock(chain indexChain, op wire.OutPoint,
+	height int32) (*btcutil.Block, *chainhash.Hash, error) {
+
+	for h := height; h > 0; h-- {
+		block, err := chain.BlockByHeight(h)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The coinbase doesn't spend any outpoints.
+		for _, tx := range block.Transactions()[1:] {
+			for _, txIn := range tx.MsgTx().TxIn {
+				if txIn.PreviousOutPoint == op {
+					return block, tx.Hash(), nil
+				}
+			}
+		}
+	}
+
+	return nil, nil, nil
+}
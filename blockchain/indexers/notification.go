@@ -0,0 +1,309 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// indexChain is what the indexes read from the chain outside of the block
+// notifications.  It's implemented by blockchain.BlockChain.
+type indexChain interface {
+	BestSnapshot() *blockchain.BestState
+	BlockByHeight(height int32) (*btcutil.Block, error)
+	BlockHashByHeight(height int32) (*chainhash.Hash, error)
+	BlockHeightByHash(hash *chainhash.Hash) (int32, error)
+	BlockLocatorFromHash(hash *chainhash.Hash) blockchain.BlockLocator
+	FetchSpendJournalUnsafe(block *btcutil.Block) ([]blockchain.SpentTxOut, error)
+	FetchUtxoEntry(outpoint wire.OutPoint) (*blockchain.UtxoEntry, error)
+	HeaderByHash(hash *chainhash.Hash) (wire.BlockHeader, error)
+	MainChainHasBlock(hash *chainhash.Hash) bool
+}
+
+// Ensure the BlockChain type implements the indexChain interface.
+var _ indexChain = (*blockchain.BlockChain)(nil)
+
+// BlockNotification is what the indexes are told about a block that's connected
+// to or disconnected from the main chain.
+//
+// The chain holds its lock while it notifies the index manager, so an index
+// that calls back into the chain while it handles a notification deadlocks as
+// soon as the chain method takes the lock.  The index manager gathers
+// everything the indexes need before it notifies them instead, and the indexes
+// must only use the notification.
+type BlockNotification struct {
+	// Block is the block that's connected or disconnected and Height is
+	// its height.
+	Block  *btcutil.Block
+	Height int32
+
+	// ParentHash is the hash of the block that the block builds on.
+	ParentHash chainhash.Hash
+
+	// SpentTxOuts are the outputs spent by the block in the order that
+	// they're spent in.
+	SpentTxOuts []blockchain.SpentTxOut
+
+	// SpentBlockHashes are the hashes of the main chain blocks that
+	// created the spent outputs by their height.  They're nil if there
+	// was no chain to gather them from.
+	SpentBlockHashes map[int32]chainhash.Hash
+
+	// MainChain is whether the block is in the main chain once the
+	// notification is handled.  It's true for connected blocks and false
+	// for disconnected ones.
+	MainChain bool
+
+	// History are the notifications of the main chain blocks right before
+	// a connected block, oldest first, as many as the indexes asked for
+	// through the HistoryNeeder interface.
+	History []*BlockNotification
+
+	// AncestorHashes are the hashes of the main chain blocks below a
+	// connected block by their height, as many as the indexes asked for
+	// through the AncestorNeeder interface.
+	AncestorHashes map[int32]chainhash.Hash
+
+	// leaves are the leaves of the utreexo accumulators for the block
+	// when they were hashed ahead of the block being connected.  It's nil
+	// if the indexes hash them themselves.
+	leaves *utreexoLeaves
+}
+
+// utreexoLeaves are the leaves that a block deletes from and adds to the utreexo
+// accumulators along with their hashes.
+type utreexoLeaves struct {
+	// schedule is the leaf commitment schedule that the leaves are hashed
+	// with.
+	schedule wire.LeafCommitmentSchedule
+
+	// dels are the leaf datas of the outputs that the block spends and
+	// delHashes are their hashes.
+	dels      []wire.LeafData
+	delHashes []accumulator.Hash
+
+	// adds are the leaves of the outputs that the block creates and
+	// addOutPoints are their outpoints.
+	adds         []accumulator.Leaf
+	addOutPoints []wire.OutPoint
+}
+
+// newUtreexoLeaves turns the outputs that the block of the notification spends
+// and creates into leaves and hashes them by the given hasher with the given
+// schedule.
+func newUtreexoLeaves(n *BlockNotification, schedule wire.LeafCommitmentSchedule,
+	hasher *wire.LeafHasher) (*utreexoLeaves, error) {
+
+	block := n.Block
+	_, outCount, inskip, outskip := blockchain.DedupeBlock(block)
+	dels, _, err := blockchain.BlockToDelLeaves(n.SpentTxOuts, n, block,
+		inskip, -1)
+	if err != nil {
+		return nil, err
+	}
+	delHashes := make([]accumulator.Hash, len(dels))
+	for i := range dels {
+		delHashes[i] = hasher.ScheduledLeafHash(&dels[i], schedule)
+	}
+
+	return &utreexoLeaves{
+		schedule:  schedule,
+		dels:      dels,
+		delHashes: delHashes,
+		adds: blockchain.BlockToAddLeaves(block, outskip, nil,
+			outCount, schedule, hasher),
+		addOutPoints: blockchain.BlockToAddOutPoints(block, outskip),
+	}, nil
+}
+
+// utreexoLeaves returns the leaves of the block hashed by the given hasher with
+// the given schedule.  The ones hashed ahead of time are used if they were
+// hashed with the same schedule.  The slices are copies so that the caller may keep them in what it
+// stores for the block.
+func (n *BlockNotification) utreexoLeaves(schedule wire.LeafCommitmentSchedule,
+	hasher *wire.LeafHasher) (*utreexoLeaves, error) {
+
+	if n.leaves == nil || !sameLeafSchedule(n.leaves.schedule, schedule) {
+		return newUtreexoLeaves(n, schedule, hasher)
+	}
+
+	leaves := *n.leaves
+	leaves.dels = append([]wire.LeafData(nil), leaves.dels...)
+	leaves.delHashes = append([]accumulator.Hash(nil), leaves.delHashes...)
+	leaves.adds = append([]accumulator.Leaf(nil), leaves.adds...)
+	leaves.addOutPoints = append([]wire.OutPoint(nil),
+		leaves.addOutPoints...)
+
+	return &leaves, nil
+}
+
+// sameLeafSchedule returns whether the two leaf commitment schedules are the
+// same.
+func sameLeafSchedule(a, b wire.LeafCommitmentSchedule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Ensure the BlockNotification type implements the blockchain.BlockHashLookup
+// interface.
+var _ blockchain.BlockHashLookup = (*BlockNotification)(nil)
+
+// BlockHashByHeight returns the hash of the main chain block at the given
+// height that created one of the spent outputs.  It lets the notification stand
+// in for the chain when the spent outputs are turned into leaves.
+//
+// This is part of the blockchain.BlockHashLookup interface.
+func (n *BlockNotification) BlockHashByHeight(height int32) (*chainhash.Hash, error) {
+	hash, ok := n.SpentBlockHashes[height]
+	if !ok {
+		return nil, fmt.Errorf("no block at height %d created an "+
+			"output spent by block %v", height, n.Block.Hash())
+	}
+
+	return &hash, nil
+}
+
+// newBlockNotification gathers the notification of the block from the chain.
+// Only the chain methods that don't take the chain lock are called so that it
+// can be called while the chain notifies the index manager.  The hashes of the
+// blocks that created the spent outputs aren't gathered if the chain is nil.
+func newBlockNotification(chain indexChain, block *btcutil.Block,
+	stxos []blockchain.SpentTxOut, mainChain bool) (*BlockNotification, error) {
+
+	n := &BlockNotification{
+		Block:       block,
+		Height:      block.Height(),
+		ParentHash:  block.MsgBlock().Header.PrevBlock,
+		SpentTxOuts: stxos,
+		MainChain:   mainChain,
+	}
+	if chain == nil {
+		return n, nil
+	}
+
+	// The blocks below the block are in the main chain whether the block
+	// is connected or disconnected.
+	n.SpentBlockHashes = make(map[int32]chainhash.Hash)
+	for _, stxo := range stxos {
+		if _, ok := n.SpentBlockHashes[stxo.Height]; ok {
+			continue
+		}
+
+		// The outputs created and spent in the block itself are
+		// from a block that the chain doesn't have at the height yet.
+		if stxo.Height == n.Height {
+			n.SpentBlockHashes[stxo.Height] = *block.Hash()
+			continue
+		}
+
+		hash, err := chain.BlockHashByHeight(stxo.Height)
+		if err != nil {
+			return nil, err
+		}
+		n.SpentBlockHashes[stxo.Height] = *hash
+	}
+
+	return n, nil
+}
+
+// fetchNotifications gathers the notifications of the main chain blocks from
+// start to end-1 from the chain.  Like newBlockNotification, it doesn't take
+// the chain lock.
+func fetchNotifications(chain indexChain, start, end int32) (
+	[]*BlockNotification, error) {
+
+	if chain == nil {
+		return nil, fmt.Errorf("the chain of the index isn't set")
+	}
+
+	notifications := make([]*BlockNotification, 0, end-start)
+	for height := start; height < end; height++ {
+		block, err := chain.BlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		stxos, err := chain.FetchSpendJournalUnsafe(block)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := newBlockNotification(chain, block, stxos, true)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
+
+// historyNeeded returns the number of main chain blocks right before the
+// connected block at the given height that any of the indexes needs the
+// notifications of.
+func historyNeeded(indexes []Indexer, height int32) int32 {
+	var needed int32
+	for _, indexer := range indexes {
+		if hn, ok := indexer.(HistoryNeeder); ok {
+			if n := hn.HistoryNeeded(height); n > needed {
+				needed = n
+			}
+		}
+	}
+
+	if needed > height {
+		needed = height
+	}
+	return needed
+}
+
+// ancestorsNeeded returns the heights of the main chain blocks below the
+// connected block at the given height whose hashes any of the indexes needs and
+// whether any of them needs some.
+func ancestorsNeeded(indexes []Indexer, height int32) (HeightRange, bool) {
+	var needed HeightRange
+	var found bool
+	for _, indexer := range indexes {
+		an, ok := indexer.(AncestorNeeder)
+		if !ok {
+			continue
+		}
+		r, ok := an.AncestorsNeeded(height)
+		if !ok {
+			continue
+		}
+		if !found {
+			needed, found = r, true
+			continue
+		}
+		if r.Start < needed.Start {
+			needed.Start = r.Start
+		}
+		if r.End > needed.End {
+			needed.End = r.End
+		}
+	}
+
+	if needed.Start < 1 {
+		needed.Start = 1
+	}
+	if needed.End >= height {
+		needed.End = height - 1
+	}
+	return needed, found && needed.End >= needed.Start
+}
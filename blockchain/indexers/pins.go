@@ -0,0 +1,326 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// proofPinsFileName is the name of the file in the directory of the
+	// proofs of the flat utreexo proof index that keeps the pinned heights.
+	proofPinsFileName = "pins.dat"
+
+	// MaxPinLabelLen is the maximum length in bytes of the label of a pin.
+	MaxPinLabelLen = 256
+
+	// proofPinHeaderSize is the size of a serialized pin without its
+	// label.  It's the height, the pin time, and the length of the label.
+	proofPinHeaderSize = 4 + 8 + 2
+)
+
+// ErrPinUnavailable is returned when a height whose proof the index doesn't
+// hold is asked to be pinned.
+var ErrPinUnavailable = errors.New("utreexo proof height can't be pinned")
+
+// PinUnavailableError is returned when a height whose proof the index doesn't
+// hold is asked to be pinned.  The proof has to be fetched again or the index
+// reindexed from the height before it can be pinned.
+type PinUnavailableError struct {
+	// Index is the name of the index that was asked.
+	Index string
+
+	// Height is the height that was asked to be pinned.
+	Height int32
+
+	// Reason is why the index doesn't hold the proof.
+	Reason string
+}
+
+// Error returns the error as a human-readable string.
+func (e *PinUnavailableError) Error() string {
+	return fmt.Sprintf("%v: %s doesn't hold the proof for height %d (%s). "+
+		"It can only be pinned after the proof is fetched again or the "+
+		"index is reindexed from it", ErrPinUnavailable, e.Index,
+		e.Height, e.Reason)
+}
+
+// Is returns true for ErrPinUnavailable so that callers may check for an
+// unavailable height regardless of the reason.
+func (e *PinUnavailableError) Is(target error) bool {
+	return target == ErrPinUnavailable
+}
+
+// ProofPin is a height whose proof, undo block, and roots are never pruned.
+type ProofPin struct {
+	// Height is the pinned height.
+	Height int32
+
+	// Label is what the operator noted about why the height is pinned.
+	Label string
+
+	// Time is when the height was pinned.
+	Time time.Time
+
+	// Bytes is how much of the disk the entries of the height take up.
+	// It's only filled in by ListPins.
+	Bytes uint64
+}
+
+// proofPins keeps the pinned heights of an index.  The pins are persisted so
+// that they're known again after a restart.  They're kept apart from the flat
+// files so that rewriting the flat files never loses them.
+type proofPins struct {
+	mtx  sync.RWMutex
+	path string
+	pins map[int32]ProofPin
+}
+
+// loadProofPins loads the pins persisted at the given path.  Nothing is pinned
+// if they were never persisted.
+func loadProofPins(path string) (*proofPins, error) {
+	p := &proofPins{
+		path: path,
+		pins: make(map[int32]ProofPin),
+	}
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(buf) > 0 {
+		if len(buf) < proofPinHeaderSize {
+			return nil, fmt.Errorf("corrupt pins file. Expected a "+
+				"pin of at least %d bytes but got %d",
+				proofPinHeaderSize, len(buf))
+		}
+		height := int32(binary.BigEndian.Uint32(buf))
+		unix := int64(binary.BigEndian.Uint64(buf[4:]))
+		labelLen := int(binary.BigEndian.Uint16(buf[12:]))
+		buf = buf[proofPinHeaderSize:]
+		if len(buf) < labelLen {
+			return nil, fmt.Errorf("corrupt pins file. Expected a "+
+				"label of %d bytes but got %d", labelLen, len(buf))
+		}
+
+		p.pins[height] = ProofPin{
+			Height: height,
+			Label:  string(buf[:labelLen]),
+			Time:   time.Unix(unix, 0),
+		}
+		buf = buf[labelLen:]
+	}
+
+	return p, nil
+}
+
+// write persists the pins.
+//
+// This function MUST be called with the mutex locked.
+func (p *proofPins) write() error {
+	var buf []byte
+	for _, pin := range p.sorted() {
+		var header [proofPinHeaderSize]byte
+		binary.BigEndian.PutUint32(header[:], uint32(pin.Height))
+		binary.BigEndian.PutUint64(header[4:], uint64(pin.Time.Unix()))
+		binary.BigEndian.PutUint16(header[12:], uint16(len(pin.Label)))
+		buf = append(buf, header[:]...)
+		buf = append(buf, pin.Label...)
+	}
+
+	tmpPath := p.path + ".tmp"
+	err := os.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, p.path)
+}
+
+// sorted returns the pins by their height.
+//
+// This function MUST be called with the mutex held.
+func (p *proofPins) sorted() []ProofPin {
+	pins := make([]ProofPin, 0, len(p.pins))
+	for _, pin := range p.pins {
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Height < pins[j].Height
+	})
+
+	return pins
+}
+
+// pin pins the given heights with the label.  A height that's already pinned
+// gets the new label and time.
+//
+// This function is safe for concurrent access.
+func (p *proofPins) pin(heights []int32, label string, now time.Time) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, height := range heights {
+		p.pins[height] = ProofPin{
+			Height: height,
+			Label:  label,
+			Time:   now,
+		}
+	}
+
+	return p.write()
+}
+
+// unpin unpins the given heights.  Heights that aren't pinned are ignored.
+//
+// This function is safe for concurrent access.
+func (p *proofPins) unpin(heights []int32) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, height := range heights {
+		delete(p.pins, height)
+	}
+
+	return p.write()
+}
+
+// list returns the pins by their height.  There are none if the pins weren't
+// loaded.
+//
+// This function is safe for concurrent access.
+func (p *proofPins) list() []ProofPin {
+	if p == nil {
+		return nil
+	}
+
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.sorted()
+}
+
+// isPinned returns whether the given height is pinned.
+//
+// This function is safe for concurrent access.
+func (p *proofPins) isPinned(height int32) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	_, ok := p.pins[height]
+	return ok
+}
+
+// PinHeights pins the given heights so that their proofs, undo blocks, and
+// roots are never pruned.  Either all of the heights are pinned or none of
+// them are.  A PinUnavailableError is returned for the first height whose
+// proof the index doesn't hold.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) PinHeights(heights []int32, label string) error {
+	if len(label) > MaxPinLabelLen {
+		return fmt.Errorf("pin label of %d bytes is longer than the "+
+			"maximum of %d", len(label), MaxPinLabelLen)
+	}
+	if err := idx.gate.check(); err != nil {
+		return err
+	}
+
+	tip := idx.proofState.BestHeight()
+	for _, height := range heights {
+		var reason string
+		switch {
+		case height < 0 || height > tip:
+			reason = fmt.Sprintf("not between 0 and the tip height "+
+				"of %d", tip)
+		case idx.degraded.check(height) != nil:
+			reason = "above the durable height of the degraded index"
+		case idx.complete.isMissing(height):
+			reason = "missing from the index"
+		default:
+			continue
+		}
+
+		return &PinUnavailableError{
+			Index:  idx.Name(),
+			Height: height,
+			Reason: reason,
+		}
+	}
+
+	// The pin time is persisted to the second.
+	return idx.pins.pin(heights, label, time.Unix(time.Now().Unix(), 0))
+}
+
+// UnpinHeights unpins the given heights.  Heights that aren't pinned are
+// ignored.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) UnpinHeights(heights []int32) error {
+	return idx.pins.unpin(heights)
+}
+
+// IsPinned returns whether the given height is pinned.  Anything that prunes
+// the proof, the undo block, or the roots of a height must keep them if the
+// height is pinned.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) IsPinned(height int32) bool {
+	return idx.pins.isPinned(height)
+}
+
+// ListPins returns the pinned heights by their height along with how much of
+// the disk their entries take up.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) ListPins() ([]ProofPin, error) {
+	pins := idx.pins.list()
+	for i := range pins {
+		size, err := idx.pinnedSize(pins[i].Height)
+		if err != nil {
+			return nil, err
+		}
+		pins[i].Bytes = size
+	}
+
+	return pins, nil
+}
+
+// pinnedSize returns how much of the disk the entries stored for the height
+// take up.  Entries that aren't stored for the height count as nothing.
+func (idx *FlatUtreexoProofIndex) pinnedSize(height int32) (uint64, error) {
+	var size uint64
+	states := []*FlatFileState{
+		&idx.proofState,
+		&idx.undoState,
+		&idx.rememberIdxState,
+	}
+	for _, ff := range states {
+		data, err := ff.FetchData(height)
+		if err != nil {
+			return 0, err
+		}
+		if data != nil {
+			// Every entry has the magic bytes and the size before
+			// the data.
+			size += uint64(len(data)) + 8
+		}
+	}
+
+	return size, nil
+}
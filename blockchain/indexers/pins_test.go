@@ -0,0 +1,138 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+)
+
+// TestProofPins ensures that pinned heights are kept with their labels across
+// a regeneration of the index and a restart, and that heights whose proofs
+// the index doesn't hold can't be pinned.
+func TestProofPins(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestProofPins", 1)
+	defer tearDown()
+
+	var idx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		if flat, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			idx = flat
+		}
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 20; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+	tipHeight := tip.Height()
+
+	err := idx.PinHeights([]int32{3, 7, 12}, "audit 2022-Q3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.IsPinned(7) || idx.IsPinned(8) {
+		t.Fatal("expected only the given heights to be pinned")
+	}
+
+	pins, err := idx.ListPins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 3 {
+		t.Fatalf("expected 3 pins, got %d", len(pins))
+	}
+	for i, height := range []int32{3, 7, 12} {
+		pin := pins[i]
+		if pin.Height != height || pin.Label != "audit 2022-Q3" ||
+			pin.Time.IsZero() || pin.Bytes == 0 {
+
+			t.Fatalf("unexpected pin %+v", pin)
+		}
+	}
+
+	// Heights whose proofs aren't held can't be pinned and nothing is
+	// pinned along with them.
+	err = idx.PinHeights([]int32{5, tipHeight + 1}, "dispute")
+	var unavailable *PinUnavailableError
+	if !errors.Is(err, ErrPinUnavailable) || !errors.As(err, &unavailable) ||
+		unavailable.Height != tipHeight+1 {
+
+		t.Fatalf("expected a PinUnavailableError for height %d, got %v",
+			tipHeight+1, err)
+	}
+	if idx.IsPinned(5) {
+		t.Fatal("expected nothing to be pinned along with an " +
+			"unavailable height")
+	}
+	if err := idx.complete.markMissing(HeightRange{15, 15}); err != nil {
+		t.Fatal(err)
+	}
+	err = idx.PinHeights([]int32{15}, "dispute")
+	if !errors.As(err, &unavailable) || unavailable.Height != 15 ||
+		!strings.Contains(err.Error(), "reindexed") {
+
+		t.Fatalf("expected a PinUnavailableError for the missing "+
+			"height, got %v", err)
+	}
+	if err := idx.complete.markServable(HeightRange{15, 15}); err != nil {
+		t.Fatal(err)
+	}
+	err = idx.PinHeights([]int32{5}, strings.Repeat("x", MaxPinLabelLen+1))
+	if err == nil || idx.IsPinned(5) {
+		t.Fatal("expected a label that's too long to be refused")
+	}
+
+	// Regenerating the index from below the pinned heights keeps them
+	// pinned along with their entries.
+	err = idx.ReindexFrom(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reindexed, err := idx.ListPins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reindexed, pins) {
+		t.Fatalf("pins changed by the reindex: got %+v, want %+v",
+			reindexed, pins)
+	}
+
+	// Unpinning is persisted and the pins are known again after a
+	// restart.
+	err = idx.UnpinHeights([]int32{3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := loadProofPins(idx.pins.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := idx.pins.list()
+	if got := restarted.list(); !reflect.DeepEqual(got, want) ||
+		len(got) != 2 || got[0].Height != 7 {
+
+		t.Fatalf("after restart got %+v, want %+v", got, want)
+	}
+
+	// A corrupt file is refused.
+	err = os.WriteFile(idx.pins.path, []byte{0, 0, 0, 1, 2}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadProofPins(idx.pins.path); err == nil {
+		t.Fatal("expected an error for a corrupt pins file")
+	}
+}
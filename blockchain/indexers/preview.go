@@ -0,0 +1,294 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// These are the checks that are performed by PreviewConnect, in the order
+// they're performed in.
+const (
+	// PreviewCheckInputs checks that every input spends an output that's
+	// either unspent in the utxo set or created earlier in the block, and
+	// that no output is spent twice.
+	PreviewCheckInputs = "inputs"
+
+	// PreviewCheckLeaves checks that a leaf data is built for every input
+	// that spends an output created before the block.
+	PreviewCheckLeaves = "leaves"
+
+	// PreviewCheckTargets checks that every leaf was created at or below
+	// the tip of the accumulator and that no two inputs commit to the same
+	// leaf.
+	PreviewCheckTargets = "targets"
+
+	// PreviewCheckProof checks that the proof for the leaves is generated
+	// from the accumulator and that it verifies.
+	PreviewCheckProof = "proof"
+)
+
+// ConnectPreview is the result of previewing what connecting a block would do
+// to the utreexo accumulator.
+type ConnectPreview struct {
+	// Complete is whether every check was performed.  A preview is
+	// partial when a check failed or when the deadline passed before the
+	// proof was constructed.
+	Complete bool
+
+	// Checks are the checks that were performed, in the order they were
+	// performed in.  The last one is the one that failed when Err is set.
+	Checks []string
+
+	// Err is the reason the block would fail to connect.  It's nil if
+	// every check that was performed passed.
+	Err error
+}
+
+// previewSource is what a block is previewed against.
+type previewSource struct {
+	// tipHeight is the height of the block that the accumulator is at.
+	tipHeight int32
+
+	// schedule is the leaf commitment schedule of the chain.
+	schedule wire.LeafCommitmentSchedule
+
+	// fetchUtxo returns the unspent utxo for the outpoint.  It returns nil
+	// if there isn't one.
+	fetchUtxo func(wire.OutPoint) (*blockchain.UtxoEntry, error)
+
+	// blockHash returns the hash of the main chain block at the height.
+	blockHash func(int32) (*chainhash.Hash, error)
+
+	// prove generates the utreexo data for the leaves.
+	prove func([]wire.LeafData) (*wire.UData, error)
+
+	// verify verifies the accumulator proof for the leaf hashes.
+	verify func([]accumulator.Hash, *accumulator.BatchProof) error
+}
+
+// previewLeaves checks that every input of the block spends an available
+// output and returns the leaf datas of the inputs that spend outputs created
+// before the block.
+func previewLeaves(src *previewSource, block *btcutil.Block) (
+	[]wire.LeafData, string, error) {
+
+	created := make(map[wire.OutPoint]struct{})
+	spent := make(map[wire.OutPoint]struct{})
+	var entries []*blockchain.UtxoEntry
+	var txIns []*wire.TxIn
+	for txIdx, tx := range block.Transactions() {
+		if txIdx != 0 {
+			for _, txIn := range tx.MsgTx().TxIn {
+				op := txIn.PreviousOutPoint
+				if _, ok := spent[op]; ok {
+					return nil, PreviewCheckInputs, fmt.Errorf("output "+
+						"%v is spent more than once", op)
+				}
+				spent[op] = struct{}{}
+
+				// Outputs created earlier in the block are never
+				// added to the accumulator.
+				if _, ok := created[op]; ok {
+					continue
+				}
+
+				entry, err := src.fetchUtxo(op)
+				if err != nil {
+					return nil, PreviewCheckInputs, err
+				}
+				if entry == nil || entry.IsSpent() {
+					return nil, PreviewCheckInputs, fmt.Errorf("output "+
+						"%v spent by tx %v is not available", op,
+						tx.Hash())
+				}
+				entries = append(entries, entry)
+				txIns = append(txIns, txIn)
+			}
+		}
+
+		op := wire.OutPoint{Hash: *tx.Hash()}
+		for i := range tx.MsgTx().TxOut {
+			op.Index = uint32(i)
+			created[op] = struct{}{}
+		}
+	}
+
+	leaves := make([]wire.LeafData, 0, len(entries))
+	for i, entry := range entries {
+		blockHash, err := src.blockHash(entry.BlockHeight())
+		if err != nil {
+			return nil, PreviewCheckLeaves, err
+		}
+		if blockHash == nil {
+			return nil, PreviewCheckLeaves, fmt.Errorf("couldn't find "+
+				"blockhash for height %d", entry.BlockHeight())
+		}
+
+		leaves = append(leaves, wire.LeafData{
+			BlockHash:             *blockHash,
+			OutPoint:              txIns[i].PreviousOutPoint,
+			Amount:                entry.Amount(),
+			PkScript:              entry.PkScript(),
+			Height:                entry.BlockHeight(),
+			IsCoinBase:            entry.IsCoinBase(),
+			ReconstructablePkType: blockchain.ReconstructablePkTypeForInput(entry.PkScript(), txIns[i]),
+		})
+	}
+
+	return leaves, "", nil
+}
+
+// previewConnect previews connecting the block to the accumulator of the
+// source.  The inputs, leaves, and targets are always checked.  The proof is
+// only constructed and verified if the deadline hasn't passed once the other
+// checks are done.
+func previewConnect(src *previewSource, block *btcutil.Block,
+	deadline time.Time) *ConnectPreview {
+
+	preview := new(ConnectPreview)
+	fail := func(check string, err error) *ConnectPreview {
+		preview.Checks = append(preview.Checks, check)
+		preview.Err = err
+		return preview
+	}
+
+	leaves, failed, err := previewLeaves(src, block)
+	if err != nil {
+		if failed == PreviewCheckLeaves {
+			preview.Checks = append(preview.Checks, PreviewCheckInputs)
+		}
+		return fail(failed, err)
+	}
+	preview.Checks = append(preview.Checks, PreviewCheckInputs,
+		PreviewCheckLeaves)
+
+	hashes := make([]accumulator.Hash, 0, len(leaves))
+	seen := make(map[accumulator.Hash]struct{}, len(leaves))
+	for i := range leaves {
+		if leaves[i].Height > src.tipHeight {
+			return fail(PreviewCheckTargets, fmt.Errorf("leaf for %v "+
+				"was created at height %d which is above the "+
+				"accumulator tip of %d", leaves[i].OutPoint,
+				leaves[i].Height, src.tipHeight))
+		}
+
+		hash := leaves[i].ScheduledLeafHash(src.schedule)
+		if _, ok := seen[hash]; ok {
+			return fail(PreviewCheckTargets, fmt.Errorf("leaf for %v "+
+				"is committed more than once", leaves[i].OutPoint))
+		}
+		seen[hash] = struct{}{}
+		hashes = append(hashes, hash)
+	}
+	preview.Checks = append(preview.Checks, PreviewCheckTargets)
+
+	if !time.Now().Before(deadline) {
+		return preview
+	}
+
+	ud, err := src.prove(leaves)
+	if err != nil {
+		return fail(PreviewCheckProof, err)
+	}
+	err = src.verify(hashes, &ud.AccProof)
+	if err != nil {
+		return fail(PreviewCheckProof, err)
+	}
+	preview.Checks = append(preview.Checks, PreviewCheckProof)
+	preview.Complete = true
+
+	return preview
+}
+
+// newPreviewSource returns the source to preview blocks against the given
+// utreexo state with.
+func newPreviewSource(chain indexChain, tipHeight int32,
+	budget *ProofGenBudget, mtx *sync.RWMutex, uState *UtreexoState) *previewSource {
+
+	return &previewSource{
+		tipHeight: tipHeight,
+		schedule:  uState.config.Params.LeafCommitments,
+		fetchUtxo: chain.FetchUtxoEntry,
+		blockHash: chain.BlockHashByHeight,
+		prove: func(leaves []wire.LeafData) (*wire.UData, error) {
+			return generateBudgetedUData(budget, mtx, uState, leaves)
+		},
+		verify: func(hashes []accumulator.Hash, proof *accumulator.BatchProof) error {
+			mtx.RLock()
+			defer mtx.RUnlock()
+			return uState.state.VerifyBatchProof(hashes, *proof)
+		},
+	}
+}
+
+// checkPreviewTip returns an error if the block doesn't build on the block that
+// the accumulator is at.
+func checkPreviewTip(chain indexChain, tipHeight int32,
+	block *btcutil.Block) error {
+
+	tipHash, err := chain.BlockHashByHeight(tipHeight)
+	if err != nil {
+		return err
+	}
+	prevHash := &block.MsgBlock().Header.PrevBlock
+	if !tipHash.IsEqual(prevHash) {
+		return fmt.Errorf("block builds on %v but the accumulator is at "+
+			"%v", prevHash, tipHash)
+	}
+
+	return nil
+}
+
+// PreviewConnect previews whether the block's proof would generate and verify
+// against the accumulator if it were connected.  The cheap checks are always
+// performed and the proof is only constructed if the deadline hasn't passed
+// by the time they're done.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) PreviewConnect(block *btcutil.Block,
+	deadline time.Time) (*ConnectPreview, error) {
+
+	tip := idx.proofState.BestHeight()
+	err := checkPreviewTip(idx.chain, tip, block)
+	if err != nil {
+		return nil, err
+	}
+
+	src := newPreviewSource(idx.chain, tip, idx.proofGenBudget, idx.mtx,
+		idx.utreexoState)
+	return previewConnect(src, block, deadline), nil
+}
+
+// PreviewConnect previews whether the block's proof would generate and verify
+// against the accumulator if it were connected.  The cheap checks are always
+// performed and the proof is only constructed if the deadline hasn't passed
+// by the time they're done.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) PreviewConnect(block *btcutil.Block,
+	deadline time.Time) (*ConnectPreview, error) {
+
+	tip, err := idx.tipHeight()
+	if err != nil {
+		return nil, err
+	}
+	err = checkPreviewTip(idx.chain, tip, block)
+	if err != nil {
+		return nil, err
+	}
+
+	src := newPreviewSource(idx.chain, tip, idx.proofGenBudget, idx.mtx,
+		idx.utreexoState)
+	return previewConnect(src, block, deadline), nil
+}
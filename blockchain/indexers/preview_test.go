@@ -0,0 +1,162 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestPreviewConnect ensures that previews are marked complete only when the
+// proof was constructed and that invalid spends are caught by the cheap checks.
+func TestPreviewConnect(t *testing.T) {
+	available := wire.OutPoint{Hash: chainhash.Hash{1}, Index: 0}
+	missing := wire.OutPoint{Hash: chainhash.Hash{2}, Index: 0}
+
+	var proved int
+	src := &previewSource{
+		tipHeight: 10,
+		fetchUtxo: func(op wire.OutPoint) (*blockchain.UtxoEntry, error) {
+			if op != available {
+				return nil, nil
+			}
+			txOut := wire.NewTxOut(1000, []byte{0x51})
+			return blockchain.NewUtxoEntry(txOut, 5, false), nil
+		},
+		blockHash: func(height int32) (*chainhash.Hash, error) {
+			return &chainhash.Hash{byte(height)}, nil
+		},
+		prove: func(leaves []wire.LeafData) (*wire.UData, error) {
+			proved++
+			return &wire.UData{LeafDatas: leaves}, nil
+		},
+		verify: func([]accumulator.Hash, *accumulator.BatchProof) error {
+			return nil
+		},
+	}
+
+	// newBlock returns a block with a transaction that spends the given
+	// outpoint and a transaction that spends the output of the first one.
+	newBlock := func(spend wire.OutPoint) *btcutil.Block {
+		coinbase := wire.NewMsgTx(1)
+		coinbase.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			nil, nil))
+		coinbase.AddTxOut(wire.NewTxOut(5000, []byte{0x51}))
+
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(wire.NewTxIn(&spend, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(900, []byte{0x51}))
+
+		child := wire.NewMsgTx(1)
+		child.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: tx.TxHash()}, nil, nil))
+		child.AddTxOut(wire.NewTxOut(800, []byte{0x51}))
+
+		msgBlock := wire.NewMsgBlock(&wire.BlockHeader{})
+		msgBlock.AddTransaction(coinbase)
+		msgBlock.AddTransaction(tx)
+		msgBlock.AddTransaction(child)
+		return btcutil.NewBlock(msgBlock)
+	}
+
+	allChecks := []string{PreviewCheckInputs, PreviewCheckLeaves,
+		PreviewCheckTargets, PreviewCheckProof}
+	tests := []struct {
+		name     string
+		spend    wire.OutPoint
+		deadline time.Duration
+		complete bool
+		checks   []string
+		invalid  bool
+	}{
+		{
+			name:     "valid with generous deadline",
+			spend:    available,
+			deadline: time.Hour,
+			complete: true,
+			checks:   allChecks,
+		},
+		{
+			name:     "valid with tiny deadline",
+			spend:    available,
+			deadline: -time.Second,
+			checks:   allChecks[:3],
+		},
+		{
+			name:     "invalid with generous deadline",
+			spend:    missing,
+			deadline: time.Hour,
+			checks:   allChecks[:1],
+			invalid:  true,
+		},
+		{
+			name:     "invalid with tiny deadline",
+			spend:    missing,
+			deadline: -time.Second,
+			checks:   allChecks[:1],
+			invalid:  true,
+		},
+	}
+	for _, test := range tests {
+		proved = 0
+		preview := previewConnect(src, newBlock(test.spend),
+			time.Now().Add(test.deadline))
+
+		if preview.Complete != test.complete {
+			t.Fatalf("%s: expected complete %v, got %v", test.name,
+				test.complete, preview.Complete)
+		}
+		if !reflect.DeepEqual(preview.Checks, test.checks) {
+			t.Fatalf("%s: expected checks %v, got %v", test.name,
+				test.checks, preview.Checks)
+		}
+		if (preview.Err != nil) != test.invalid {
+			t.Fatalf("%s: unexpected error %v", test.name, preview.Err)
+		}
+		if test.complete != (proved == 1) {
+			t.Fatalf("%s: expected the proof to be constructed %v, "+
+				"got %d proofs", test.name, test.complete, proved)
+		}
+	}
+
+	// Spending the same output twice is caught by the cheap checks.
+	block := newBlock(available)
+	dup := wire.NewMsgTx(1)
+	dup.AddTxIn(wire.NewTxIn(&available, nil, nil))
+	block.MsgBlock().AddTransaction(dup)
+	preview := previewConnect(src, btcutil.NewBlock(block.MsgBlock()),
+		time.Now())
+	if preview.Err == nil || preview.Complete {
+		t.Fatal("expected the double spend to be caught")
+	}
+
+	// Leaves created above the accumulator tip can't be resolved.
+	src.tipHeight = 4
+	preview = previewConnect(src, newBlock(available), time.Now().Add(time.Hour))
+	if preview.Err == nil || !reflect.DeepEqual(preview.Checks, allChecks[:3]) {
+		t.Fatalf("expected the targets check to fail, got %v: %v",
+			preview.Checks, preview.Err)
+	}
+	src.tipHeight = 10
+
+	// A proof that doesn't verify fails the proof check.
+	src.verify = func([]accumulator.Hash, *accumulator.BatchProof) error {
+		return errors.New("bad proof")
+	}
+	preview = previewConnect(src, newBlock(available), time.Now().Add(time.Hour))
+	if preview.Err == nil || preview.Complete ||
+		!reflect.DeepEqual(preview.Checks, allChecks) {
+
+		t.Fatalf("expected the proof check to fail, got %v: %v",
+			preview.Checks, preview.Err)
+	}
+}
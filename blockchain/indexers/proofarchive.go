@@ -0,0 +1,299 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// proofArchiveName is the human-readable name for the proof archive.
+	proofArchiveName = "utreexo proof archive"
+
+	// networkFileName is the name of the file in the proof flat file
+	// directory that holds the network the proofs were made for.
+	networkFileName = "network.dat"
+)
+
+var (
+	// ErrServeOnly is returned by the methods of a ProofArchive that
+	// would modify it.  A proof archive only serves the proofs it was
+	// opened with.
+	ErrServeOnly = errors.New("the utreexo proof archive is serve-only")
+)
+
+// UtreexoProofStore is what's needed to serve the utreexo proofs of blocks by
+// their heights.  It's implemented by the flat utreexo proof index and by the
+// proof archive that serves its flat files without a chain.
+type UtreexoProofStore interface {
+	RangeServer
+
+	// FetchUtreexoProof returns the utreexo proof for the block at the
+	// given height.
+	FetchUtreexoProof(height int32, excludeAccProof bool) (*wire.UData, error)
+
+	// FetchUtreexoProofBatch returns the utreexo proofs for the blocks
+	// from start to end inclusive, in height order.
+	FetchUtreexoProofBatch(start, end int32) ([]*wire.UData, error)
+}
+
+// Ensure the FlatUtreexoProofIndex and the ProofArchive types implement the
+// UtreexoProofStore interface.
+var _ UtreexoProofStore = (*FlatUtreexoProofIndex)(nil)
+var _ UtreexoProofStore = (*ProofArchive)(nil)
+
+// Ensure the ProofArchive type implements the Indexer interface so that it's
+// refused rather than maintained if it's handed to a Manager.
+var _ Indexer = (*ProofArchive)(nil)
+
+// checkNetworkFile returns an error if the network file in the given directory
+// is of another network.  A missing network file is written if create is set
+// and is an error otherwise.
+func checkNetworkFile(path string, net wire.BitcoinNet, create bool) error {
+	networkPath := filepath.Join(path, networkFileName)
+	buf, err := os.ReadFile(networkPath)
+	if os.IsNotExist(err) && create {
+		var netBuf [4]byte
+		binary.BigEndian.PutUint32(netBuf[:], uint32(net))
+		return os.WriteFile(networkPath, netBuf[:], 0644)
+	}
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no network file at %s", path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != 4 {
+		return fmt.Errorf("corrupt network file at %s. Expected 4 bytes "+
+			"but got %d", path, len(buf))
+	}
+
+	fileNet := wire.BitcoinNet(binary.BigEndian.Uint32(buf))
+	if fileNet != net {
+		return fmt.Errorf("the utreexo proofs at %s are for %v but "+
+			"%v was expected", path, fileNet, net)
+	}
+
+	return nil
+}
+
+// ProofArchiveHealth is the health of a proof archive.
+type ProofArchiveHealth struct {
+	// Tip is the height of the newest proof in the archive.
+	Tip int32
+
+	// Servable are the ranges of heights that the archive serves the
+	// proofs for.
+	Servable []HeightRange
+
+	// Staleness is how long ago the newest proof was written.
+	Staleness time.Duration
+}
+
+// ProofArchive serves the utreexo proofs of the flat files of a flat utreexo
+// proof index without a chain, a database, or a Manager.  The flat files are
+// opened read-only so the archive never changes while it's served.
+type ProofArchive struct {
+	path        string
+	chainParams *chaincfg.Params
+	proofState  FlatFileState
+	complete    *completeness
+	pins        *proofPins
+	prune       pruneState
+}
+
+// OpenProofArchive opens the utreexo proofs of the flat utreexo proof index in
+// the given data directory for serving only.  An error is returned if the
+// proofs were made for a network other than the one of the given chain params.
+func OpenProofArchive(dataDir string, chainParams *chaincfg.Params) (
+	*ProofArchive, error) {
+
+	path := flatFilePath(dataDir, flatUtreexoProofName)
+	err := checkNetworkFile(path, chainParams.Net, false)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &ProofArchive{
+		path:        path,
+		chainParams: chainParams,
+		proofState:  *NewFlatFileState(),
+	}
+	err = archive.proofState.InitReadOnly(path, flatUtreexoProofName)
+	if err != nil {
+		return nil, err
+	}
+	archive.complete, err = loadCompleteness(filepath.Join(path,
+		completenessFileName))
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	archive.pins, err = loadProofPins(filepath.Join(path, proofPinsFileName))
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	pruned, err := readPrunedHeights(filepath.Join(path,
+		prunedHeightsFileName))
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	archive.prune.set(pruned)
+
+	return archive, nil
+}
+
+// Close closes the flat files of the archive.
+func (a *ProofArchive) Close() error {
+	err := a.proofState.dataFile.Close()
+	if closeErr := a.proofState.offsetFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// BestHeight returns the height of the newest proof in the archive.
+func (a *ProofArchive) BestHeight() int32 {
+	return a.proofState.BestHeight()
+}
+
+// checkServable returns an error if the archive doesn't have the proof for the
+// block at the given height.  It's a ProofPrunedError if the index pruned it.
+func (a *ProofArchive) checkServable(height int32) error {
+	err := a.prune.checkProof(a.Name(), height, a.pins.isPinned)
+	if err != nil {
+		return err
+	}
+	if height >= 0 && height <= a.BestHeight() && !a.complete.isMissing(height) {
+		return nil
+	}
+
+	servable, err := a.ServableRanges()
+	if err != nil {
+		return err
+	}
+	return &UnservableHeightError{
+		Index:    a.Name(),
+		Height:   height,
+		Servable: servable,
+	}
+}
+
+// FetchUtreexoProof returns the utreexo proof for the block at the given
+// height.  An UnservableHeightError is returned if the archive doesn't have it.
+//
+// This is part of the UtreexoProofStore interface.
+func (a *ProofArchive) FetchUtreexoProof(height int32, excludeAccProof bool) (
+	*wire.UData, error) {
+
+	if err := a.checkServable(height); err != nil {
+		return nil, err
+	}
+	if height == 0 {
+		return blockchain.GenesisUData(), nil
+	}
+
+	proofBytes, err := a.proofState.FetchData(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return deserializeFlatProof(proofBytes, excludeAccProof)
+}
+
+// FetchUtreexoProofBatch returns the utreexo proofs for the blocks from start
+// to end inclusive, in height order, with a single read of the flat files.
+//
+// This is part of the UtreexoProofStore interface.
+func (a *ProofArchive) FetchUtreexoProofBatch(start, end int32) (
+	[]*wire.UData, error) {
+
+	return fetchFlatProofBatch(&a.proofState, start, end, a.checkServable)
+}
+
+// ServableRanges returns the ranges of block heights that the archive serves
+// the utreexo proofs for.
+//
+// This is part of the RangeServer interface.
+func (a *ProofArchive) ServableRanges() ([]HeightRange, error) {
+	return removePruned(a.complete.servable(a.BestHeight()),
+		a.prune.heights().proofs, a.pins.list()), nil
+}
+
+// Health returns the heights that the archive covers and how long ago its
+// newest proof was written.
+func (a *ProofArchive) Health() (*ProofArchiveHealth, error) {
+	fi, err := a.proofState.dataFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	servable, err := a.ServableRanges()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProofArchiveHealth{
+		Tip:       a.BestHeight(),
+		Servable:  servable,
+		Staleness: time.Since(fi.ModTime()),
+	}, nil
+}
+
+// Key returns the key of the flat utreexo proof index that the archive was
+// made by.
+//
+// This is part of the Indexer interface.
+func (a *ProofArchive) Key() []byte {
+	return flatUtreexoBucketKey
+}
+
+// Name returns the human-readable name of the archive.
+//
+// This is part of the Indexer interface.
+func (a *ProofArchive) Name() string {
+	return proofArchiveName
+}
+
+// Create always returns ErrServeOnly.
+//
+// This is part of the Indexer interface.
+func (a *ProofArchive) Create(database.Tx) error {
+	return ErrServeOnly
+}
+
+// Init always returns ErrServeOnly as the archive is never caught up to a
+// chain.
+//
+// This is part of the Indexer interface.
+func (a *ProofArchive) Init() error {
+	return ErrServeOnly
+}
+
+// ConnectBlock always returns ErrServeOnly.
+//
+// This is part of the Indexer interface.
+func (a *ProofArchive) ConnectBlock(database.Tx, *BlockNotification) error {
+	return ErrServeOnly
+}
+
+// DisconnectBlock always returns ErrServeOnly.
+//
+// This is part of the Indexer interface.
+func (a *ProofArchive) DisconnectBlock(database.Tx, *BlockNotification) error {
+	return ErrServeOnly
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+)
+
+// copyDir copies the regular files of the src directory into the dst
+// directory.
+func copyDir(dst, src string) error {
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(dst, entry.Name()), buf, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TestProofArchive ensures that a proof archive serves the same proofs as the
+// flat utreexo proof index it was copied from without a chain, only for the
+// network it was made for, and that it refuses to be modified.
+func TestProofArchive(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestProofArchive", 1)
+	defer tearDown()
+
+	var idx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		if flat, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			idx = flat
+		}
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 12; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	// Copy the proofs of the index somewhere else the way they'd be
+	// shipped to an archive server.
+	archiveDir := t.TempDir()
+	err := copyDir(flatFilePath(archiveDir, flatUtreexoProofName),
+		flatFilePath(idx.dataDir, flatUtreexoProofName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrongNet := chaincfg.MainNetParams
+	if _, err := OpenProofArchive(archiveDir, &wrongNet); err == nil {
+		t.Fatal("expected an error opening the archive for another network")
+	}
+	if _, err := OpenProofArchive(t.TempDir(), params); err == nil {
+		t.Fatal("expected an error opening a missing archive")
+	}
+
+	archive, err := OpenProofArchive(archiveDir, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	var store UtreexoProofStore = archive
+	uds, err := store.FetchUtreexoProofBatch(0, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height, ud := range uds {
+		want, err := idx.FetchUtreexoProof(int32(height), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ud, want) {
+			t.Fatalf("proof at height %d differs from the index", height)
+		}
+		got, err := store.FetchUtreexoProof(int32(height), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("proof at height %d differs from the index", height)
+		}
+	}
+
+	_, err = store.FetchUtreexoProof(13, false)
+	if !errors.Is(err, ErrHeightUnservable) {
+		t.Fatalf("expected %v past the tip, got %v", ErrHeightUnservable, err)
+	}
+
+	health, err := archive.Health()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HeightRange{{0, 12}}
+	if health.Tip != 12 || !reflect.DeepEqual(health.Servable, want) {
+		t.Fatalf("expected tip 12 serving %v, got %+v", want, health)
+	}
+
+	// The archive refuses everything that would modify it.
+	if err := archive.Init(); err != ErrServeOnly {
+		t.Fatalf("init: expected %v, got %v", ErrServeOnly, err)
+	}
+	if err := archive.Create(nil); err != ErrServeOnly {
+		t.Fatalf("create: expected %v, got %v", ErrServeOnly, err)
+	}
+	if err := archive.ConnectBlock(nil, nil); err != ErrServeOnly {
+		t.Fatalf("connect: expected %v, got %v", ErrServeOnly, err)
+	}
+	if err := archive.DisconnectBlock(nil, nil); err != ErrServeOnly {
+		t.Fatalf("disconnect: expected %v, got %v", ErrServeOnly, err)
+	}
+	if err := archive.proofState.StoreData(13, []byte{1}); err == nil {
+		t.Fatal("expected the flat files to be read-only")
+	}
+}
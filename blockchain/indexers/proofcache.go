@@ -0,0 +1,318 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+)
+
+const (
+	// DefaultProofCacheSize is the default size in bytes of the utreexo
+	// proofs that the utreexo proof index keeps in memory.
+	DefaultProofCacheSize = 32 * 1024 * 1024
+
+	// proofCacheEntryOverhead is the size that's counted for an entry on
+	// top of its proof bytes for its key, list element and map entry.
+	proofCacheEntryOverhead = chainhash.HashSize + 96
+
+	// proofCacheFloorDivisor is the divisor of the maximum size of the
+	// proof cache that gives the least it's shrunk to under memory
+	// pressure.
+	proofCacheFloorDivisor = 4
+)
+
+// ProofCacheStats are the counts of the fetches of the utreexo proofs that were
+// served from the proof cache of the utreexo proof index.
+type ProofCacheStats struct {
+	// Size is the size in bytes of the cached proofs and MaxSize is the
+	// most that they may take.
+	Size    uint64
+	MaxSize uint64
+
+	// Entries is the number of cached proofs.
+	Entries int
+
+	// Hits and Misses are the number of fetched proofs that were and
+	// weren't cached.
+	Hits   uint64
+	Misses uint64
+
+	// Evictions is the number of proofs that were evicted to make room for
+	// others.
+	Evictions uint64
+}
+
+// HitRate returns the share of the fetched proofs that were cached.
+func (s *ProofCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// proofCacheEntry is a cached proof in its compact serialization as it's stored
+// in the database.
+type proofCacheEntry struct {
+	hash       chainhash.Hash
+	proofBytes []byte
+}
+
+// size returns the size in bytes that's counted for the entry.
+func (e *proofCacheEntry) size() uint64 {
+	return uint64(len(e.proofBytes)) + proofCacheEntryOverhead
+}
+
+// proofCache is a least recently used cache of the serialized utreexo proofs of
+// the blocks keyed by their hash.  The proofs are kept serialized so that every
+// fetch gets its own copy to deserialize and so that their size is known
+// exactly.
+//
+// The memory of the cached proofs is reserved with the memory accountant when
+// there is one, which evicts from the cache through EvictMem.  The accountant
+// is never called with the cache mutex held since it may have the cache evict
+// at the same time.
+type proofCache struct {
+	mtx     sync.Mutex
+	maxSize uint64
+	size    uint64
+	lru     *list.List
+	entries map[chainhash.Hash]*list.Element
+
+	// generation is bumped every time proofs are dropped so that a proof
+	// that was read from the database before it was deleted isn't added
+	// back afterwards.
+	generation uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	// mem is the handle of the cache with the memory accountant.  It's
+	// nil if there's no accountant.
+	mem *MemHandle
+}
+
+// newProofCache returns an empty proof cache that holds up to maxSize bytes of
+// proofs.  Nothing is cached if it's 0.
+func newProofCache(maxSize uint64) *proofCache {
+	return &proofCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[chainhash.Hash]*list.Element),
+	}
+}
+
+// get returns the serialized proof of the block with the given hash and whether
+// it was cached along with the generation of the cache.  The generation is
+// passed to add when the proof that wasn't cached is read from the database.
+//
+// This function is safe for concurrent access.
+func (c *proofCache) get(hash *chainhash.Hash) ([]byte, uint64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[*hash]
+	if !ok {
+		c.misses++
+		return nil, c.generation, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+
+	return elem.Value.(*proofCacheEntry).proofBytes, c.generation, true
+}
+
+// add caches the serialized proof of the block with the given hash, evicting the
+// least recently used proofs to make room for it.  It's not cached if proofs
+// were dropped since the generation that it was read at, if it's larger than
+// the whole cache or if the memory accountant can't make room for it.  The
+// proof bytes must not be modified afterwards.
+//
+// This function is safe for concurrent access.
+func (c *proofCache) add(hash *chainhash.Hash, proofBytes []byte,
+	generation uint64) {
+
+	entry := &proofCacheEntry{hash: *hash, proofBytes: proofBytes}
+	c.mtx.Lock()
+	cacheable := c.cacheable(entry, generation)
+	c.mtx.Unlock()
+	if !cacheable || c.mem.Reserve(entry.size()) != nil {
+		return
+	}
+
+	// The cache may have changed while the memory was reserved.
+	c.mtx.Lock()
+	if !c.cacheable(entry, generation) {
+		c.mtx.Unlock()
+		c.mem.Release(entry.size())
+		return
+	}
+
+	freed := c.evict(c.maxSize - entry.size())
+	c.entries[*hash] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	c.mtx.Unlock()
+
+	c.mem.Release(freed)
+}
+
+// cacheable returns whether the entry read at the given generation can be
+// cached.
+//
+// This function MUST be called with the cache mutex held.
+func (c *proofCache) cacheable(entry *proofCacheEntry, generation uint64) bool {
+	if generation != c.generation || entry.size() > c.maxSize {
+		return false
+	}
+	_, ok := c.entries[entry.hash]
+	return !ok
+}
+
+// evict removes the least recently used proofs until the cached ones take at
+// most the given size and returns the size of the removed proofs.
+//
+// This function MUST be called with the cache mutex held.
+func (c *proofCache) evict(maxSize uint64) uint64 {
+	var freed uint64
+	for c.size > maxSize {
+		elem := c.lru.Back()
+		entry := elem.Value.(*proofCacheEntry)
+		c.lru.Remove(elem)
+		delete(c.entries, entry.hash)
+		c.size -= entry.size()
+		c.evictions++
+		freed += entry.size()
+	}
+
+	return freed
+}
+
+// EvictMem drops the least recently used proofs worth at least the given amount
+// of bytes if there are that many cached and returns the size of the dropped
+// proofs.
+//
+// This is part of the Account interface.
+func (c *proofCache) EvictMem(bytes uint64) uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if bytes >= c.size {
+		return c.evict(0)
+	}
+	return c.evict(c.size - bytes)
+}
+
+// remove drops the proof of the block with the given hash.
+//
+// This function is safe for concurrent access.
+func (c *proofCache) remove(hash *chainhash.Hash) {
+	c.mtx.Lock()
+	c.generation++
+	elem, ok := c.entries[*hash]
+	if !ok {
+		c.mtx.Unlock()
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.entries, *hash)
+	size := elem.Value.(*proofCacheEntry).size()
+	c.size -= size
+	c.mtx.Unlock()
+
+	c.mem.Release(size)
+}
+
+// stale drops the proof of the block with the given hash that was returned by
+// get but can't be served anymore and counts its fetch as a miss.  Proofs read
+// at the generation that get returned with it aren't cached anymore.
+//
+// This function is safe for concurrent access.
+func (c *proofCache) stale(hash *chainhash.Hash) {
+	c.mtx.Lock()
+	c.hits--
+	c.misses++
+	c.mtx.Unlock()
+
+	c.remove(hash)
+}
+
+// clear drops every proof.
+//
+// This function is safe for concurrent access.
+func (c *proofCache) clear() {
+	c.mtx.Lock()
+	c.generation++
+	c.lru.Init()
+	c.entries = make(map[chainhash.Hash]*list.Element)
+	size := c.size
+	c.size = 0
+	c.mtx.Unlock()
+
+	c.mem.Release(size)
+}
+
+// setMaxSize sets the most bytes of proofs that are cached, evicting the least
+// recently used ones that don't fit anymore.
+//
+// This function is safe for concurrent access.
+func (c *proofCache) setMaxSize(maxSize uint64) {
+	c.mtx.Lock()
+	c.maxSize = maxSize
+	freed := c.evict(maxSize)
+	c.mtx.Unlock()
+
+	c.mem.Release(freed)
+	c.mem.SetFloor(maxSize / proofCacheFloorDivisor)
+}
+
+// setMemAccountant registers the cache with the memory accountant as a cache
+// that's shrunk down to a quarter of its maximum size under memory pressure.
+// It must be called before any proof is cached.
+func (c *proofCache) setMemAccountant(a *MemAccountant, name string) {
+	c.mem = a.Register(name, MemClassCache, 0, c)
+
+	c.mtx.Lock()
+	maxSize := c.maxSize
+	c.mtx.Unlock()
+
+	c.mem.SetFloor(maxSize / proofCacheFloorDivisor)
+}
+
+// stats returns the counts of the cache.
+//
+// This function is safe for concurrent access.
+func (c *proofCache) stats() *ProofCacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return &ProofCacheStats{
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+		Entries:   len(c.entries),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// SetProofCacheSize sets the most bytes of the utreexo proofs that the index
+// keeps in memory to serve the fetches of the same proofs without reading them
+// from the database again.  Nothing is cached if it's 0.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) SetProofCacheSize(size uint64) {
+	idx.proofCache.setMaxSize(size)
+}
+
+// SetMemAccountant registers the proof cache of the index with the memory
+// accountant so that the cached proofs count towards its cap and are the first
+// to be evicted when it's at its cap or under memory pressure.  It must be
+// called before any proof is fetched.
+func (idx *UtreexoProofIndex) SetMemAccountant(a *MemAccountant) {
+	idx.proofCache.setMemAccountant(a, "utreexo proof cache")
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestProofCache ensures that the proof cache evicts the least recently used
+// proofs to stay within its size and that proofs read before others were
+// dropped aren't cached.
+func TestProofCache(t *testing.T) {
+	proof := func(size int) []byte {
+		return make([]byte, size-proofCacheEntryOverhead)
+	}
+	hashes := []chainhash.Hash{{0x01}, {0x02}, {0x03}, {0x04}}
+	expect := func(c *proofCache, cached ...chainhash.Hash) {
+		t.Helper()
+		if len(c.entries) != len(cached) {
+			t.Fatalf("got %d cached proofs, want %d", len(c.entries),
+				len(cached))
+		}
+		for _, hash := range cached {
+			if _, ok := c.entries[hash]; !ok {
+				t.Fatalf("proof %v isn't cached", hash)
+			}
+		}
+	}
+
+	c := newProofCache(3000)
+	for _, hash := range hashes[:3] {
+		_, gen, ok := c.get(&hash)
+		if ok {
+			t.Fatalf("proof %v is cached before it's added", hash)
+		}
+		c.add(&hash, proof(1000), gen)
+	}
+	expect(c, hashes[:3]...)
+
+	// Using the first proof makes the second one the least recently used.
+	_, gen, ok := c.get(&hashes[0])
+	if !ok {
+		t.Fatal("the first proof isn't cached")
+	}
+	c.add(&hashes[3], proof(1000), gen)
+	expect(c, hashes[0], hashes[2], hashes[3])
+
+	// A proof that's larger than the whole cache isn't cached.
+	c.add(&hashes[1], proof(3001), gen)
+	expect(c, hashes[0], hashes[2], hashes[3])
+
+	// A proof read before another was dropped isn't cached.
+	c.remove(&hashes[2])
+	c.add(&hashes[1], proof(1000), gen)
+	expect(c, hashes[0], hashes[3])
+
+	// A stale proof is counted as a miss.
+	if _, _, ok := c.get(&hashes[3]); !ok {
+		t.Fatal("the fourth proof isn't cached")
+	}
+	c.stale(&hashes[3])
+	expect(c, hashes[0])
+
+	stats := c.stats()
+	want := &ProofCacheStats{
+		Size:      1000,
+		MaxSize:   3000,
+		Entries:   1,
+		Hits:      1,
+		Misses:    4,
+		Evictions: 1,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Fatalf("got stats %+v, want %+v", stats, want)
+	}
+	if got := stats.HitRate(); got != 0.2 {
+		t.Fatalf("got hit rate %v, want 0.2", got)
+	}
+
+	// Shrinking the cache evicts what doesn't fit and nothing is cached
+	// once it's 0.
+	_, gen, _ = c.get(&hashes[1])
+	c.add(&hashes[1], proof(1000), gen)
+	c.setMaxSize(1000)
+	expect(c, hashes[1])
+	c.setMaxSize(0)
+	expect(c)
+	_, gen, _ = c.get(&hashes[1])
+	c.add(&hashes[1], proof(1000), gen)
+	expect(c)
+	if c.size != 0 {
+		t.Fatalf("got size %d after evicting every proof", c.size)
+	}
+
+	c.setMaxSize(3000)
+	_, gen, _ = c.get(&hashes[1])
+	c.add(&hashes[1], proof(1000), gen)
+	c.clear()
+	expect(c)
+}
+
+// TestProofCacheMemAccountant ensures that the proof cache reserves the memory
+// of its proofs with the memory accountant, that the accountant evicts from it
+// to make room for the other subsystems and that it's shrunk down to its floor
+// under memory pressure.
+func TestProofCacheMemAccountant(t *testing.T) {
+	proof := func(size int) []byte {
+		return make([]byte, size-proofCacheEntryOverhead)
+	}
+	hashes := []chainhash.Hash{{0x01}, {0x02}, {0x03}, {0x04}}
+	acct := NewMemAccountant(5000)
+	c := newProofCache(4000)
+	c.setMemAccountant(acct, "proof cache")
+	add := func(hash chainhash.Hash) {
+		_, gen, _ := c.get(&hash)
+		c.add(&hash, proof(1000), gen)
+	}
+	expect := func(cached ...chainhash.Hash) {
+		t.Helper()
+		if len(c.entries) != len(cached) {
+			t.Fatalf("got %d cached proofs, want %d", len(c.entries),
+				len(cached))
+		}
+		for _, hash := range cached {
+			if _, ok := c.entries[hash]; !ok {
+				t.Fatalf("proof %v isn't cached", hash)
+			}
+		}
+		if used := c.mem.Used(); used != c.size {
+			t.Fatalf("got %d reserved bytes for %d cached bytes",
+				used, c.size)
+		}
+	}
+
+	for _, hash := range hashes[:3] {
+		add(hash)
+	}
+	expect(hashes[:3]...)
+
+	// The least recently used proof is evicted to make room for another
+	// subsystem.
+	pinned := acct.Register("pinned", MemClassPinned, 0, nil)
+	if err := pinned.Reserve(3000); err != nil {
+		t.Fatalf("unable to reserve: %v", err)
+	}
+	expect(hashes[1:3]...)
+	pinned.Release(3000)
+
+	// Under memory pressure, the cache is shrunk down to its floor of a
+	// quarter of its size and held there until the pressure clears.
+	if !acct.shrinkForPressure(50, 100) {
+		t.Fatal("nothing was shrunk")
+	}
+	expect(hashes[2])
+	add(hashes[3])
+	expect(hashes[2])
+	acct.restoreFromPressure(0, 100)
+	add(hashes[3])
+	expect(hashes[2], hashes[3])
+
+	c.clear()
+	expect()
+	if used := acct.Stats().Used; used != 0 {
+		t.Fatalf("got %d bytes held after clearing the cache", used)
+	}
+}
+
+// TestUtreexoProofIndexProofCache ensures that the utreexo proof index serves
+// the same proofs from its proof cache as from the database, also to fetches at
+// the same time, and that the proofs of disconnected and pruned blocks aren't
+// served from it.
+func TestUtreexoProofIndexProofCache(t *testing.T) {
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestUtreexoProofIndexProofCache", 1)
+	defer tearDown()
+	idx := indexes[0].(*UtreexoProofIndex)
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	blocks := []*btcutil.Block{tip}
+	outs := [][]*blockchain.SpendableOut{nil}
+	for i := 0; i < 12; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+		blocks = append(blocks, tip)
+		outs = append(outs, spends)
+	}
+
+	// The proofs are read from the database the first time and from the
+	// cache afterwards.  Every fetch gets its own proof.
+	hash := blocks[8].Hash()
+	first, err := idx.FetchUtreexoProof(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	fetched := make([]*wire.UData, 8)
+	errs := make([]error, len(fetched))
+	for i := range fetched {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fetched[i], errs[i] = idx.FetchUtreexoProof(hash)
+		}(i)
+	}
+	wg.Wait()
+	for i, ud := range fetched {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !reflect.DeepEqual(ud, first) {
+			t.Fatalf("fetch %d: the cached proof differs", i)
+		}
+	}
+	first.LeafDatas = nil
+	if reflect.DeepEqual(fetched[0], first) {
+		t.Fatal("the fetches share the cached proof")
+	}
+	stats := idx.Stats().ProofCache
+	if stats.Hits != uint64(len(fetched)) || stats.Misses != 1 ||
+		stats.Entries != 1 {
+
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+
+	// Reorg out the blocks after height 10 with a longer chain.  The
+	// proofs of the disconnected blocks are dropped.
+	for _, block := range blocks[9:] {
+		_, err := idx.FetchUtreexoProof(block.Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	altTip := blocks[10]
+	altSpends := outs[10]
+	for altTip.Height() < 14 {
+		altTip, _ = blockchain.AddBlock(chain, altTip, altSpends)
+		altSpends = nil
+	}
+	for _, block := range blocks[11:] {
+		if _, ok := idx.proofCache.entries[*block.Hash()]; ok {
+			t.Fatalf("the proof of disconnected block %d is cached",
+				block.Height())
+		}
+		_, err := idx.FetchUtreexoProof(block.Hash())
+		if !errors.Is(err, ErrProofNotFound) {
+			t.Fatalf("height %d: got error %v, want a not found "+
+				"error", block.Height(), err)
+		}
+	}
+
+	// A proof that was cached right as its block was disconnected isn't
+	// served.
+	stale := blocks[12].Hash()
+	_, gen, _ := idx.proofCache.get(stale)
+	idx.proofCache.add(stale, []byte{0x00}, gen)
+	_, err = idx.FetchUtreexoProof(stale)
+	if !errors.Is(err, ErrProofNotFound) {
+		t.Fatalf("got error %v for the stale proof, want a not found "+
+			"error", err)
+	}
+	if _, ok := idx.proofCache.entries[*stale]; ok {
+		t.Fatal("the stale proof is still cached")
+	}
+
+	// The proofs that are pruned are dropped as well.
+	idx.SetRetainBlocks(5)
+	for altTip.Height() < 16 {
+		altTip, _ = blockchain.AddBlock(chain, altTip, nil)
+	}
+	_, err = idx.FetchUtreexoProof(hash)
+	var pruneErr *ProofPrunedError
+	if !errors.As(err, &pruneErr) {
+		t.Fatalf("got error %v for the pruned proof, want a pruned "+
+			"error", err)
+	}
+
+	// Nothing is cached once the size is 0.
+	idx.SetProofCacheSize(0)
+	if _, err := idx.FetchUtreexoProof(altTip.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := idx.Stats().ProofCache; stats.Entries != 0 ||
+		stats.Size != 0 {
+
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+}
@@ -0,0 +1,594 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// proofCostFileName is the name of the file in the directory of the
+	// proofs of the flat utreexo proof index that caches the proof costs
+	// of the bands of blocks.
+	proofCostFileName = "proofcost.dat"
+
+	// defaultProofCostBandSize is the number of blocks that the proof
+	// costs are cached for together.
+	defaultProofCostBandSize = 2016
+
+	// proofCostClasses is the number of script classes that the proof
+	// costs are kept for.
+	proofCostClasses = int(txscript.WitnessUnknownTy) + 1
+
+	// proofCostRecordSize is the size of the cached proof costs of a band.
+	// It's the number of script classes the record was made with, the
+	// number of leaves of the accumulator before and after the band, and
+	// the spends, the proof hash shares, the leaf data bytes and the summed
+	// up ages of every script class.
+	proofCostRecordSize = 1 + 8 + 8 + proofCostClasses*4*8
+
+	// ProofHashShare is how many shares a proof hash is split into between
+	// the spent outputs that it's attributed to.  It's divisible by every
+	// number up to 16 so that the proof hashes shared by a few outputs are
+	// split evenly.
+	ProofHashShare = 720720
+)
+
+// ScriptTypeProofCost is how much of the utreexo proofs of a range of blocks is
+// attributed to the spent outputs of a script class.
+//
+// Every proof hash is needed because of the spent outputs in the subtree that
+// it's the sibling of.  It's attributed to them in equal shares, and the
+// shares that don't split evenly go to the first of them, so the proof hash
+// shares of every script class always sum up to ProofHashShare times the proof
+// hashes of the blocks.
+type ScriptTypeProofCost struct {
+	// Class is the script class of the spent outputs.
+	Class txscript.ScriptClass
+
+	// Spends is how many outputs of the class were spent.
+	Spends uint64
+
+	// ProofHashShares is how many shares of the proof hashes are
+	// attributed to the spent outputs.  There are ProofHashShare shares
+	// to a proof hash.
+	ProofHashShares uint64
+
+	// LeafDataBytes is the size of the compact leaf datas of the spent
+	// outputs.
+	LeafDataBytes uint64
+
+	// AgeSum is the sum of the number of blocks between every spent output
+	// being created and spent.
+	AgeSum uint64
+}
+
+// ProofHashes returns the number of proof hashes attributed to the spent
+// outputs.
+func (c *ScriptTypeProofCost) ProofHashes() float64 {
+	return float64(c.ProofHashShares) / ProofHashShare
+}
+
+// AvgProofHashes returns the average number of proof hashes attributed to a
+// spent output.
+func (c *ScriptTypeProofCost) AvgProofHashes() float64 {
+	if c.Spends == 0 {
+		return 0
+	}
+	return c.ProofHashes() / float64(c.Spends)
+}
+
+// AvgAge returns the average number of blocks between a spent output being
+// created and spent.
+func (c *ScriptTypeProofCost) AvgAge() float64 {
+	if c.Spends == 0 {
+		return 0
+	}
+	return float64(c.AgeSum) / float64(c.Spends)
+}
+
+// proofCost is the proof cost of every script class over a span of blocks
+// along with the number of leaves of the accumulator before and after them.
+type proofCost struct {
+	leavesBefore uint64
+	leavesAfter  uint64
+	classes      [proofCostClasses]ScriptTypeProofCost
+}
+
+// add adds the proof costs of the other span of blocks, which must follow it.
+func (c *proofCost) add(other *proofCost) {
+	c.leavesAfter = other.leavesAfter
+	for i := range c.classes {
+		c.classes[i].Spends += other.classes[i].Spends
+		c.classes[i].ProofHashShares += other.classes[i].ProofHashShares
+		c.classes[i].LeafDataBytes += other.classes[i].LeafDataBytes
+		c.classes[i].AgeSum += other.classes[i].AgeSum
+	}
+}
+
+// serialize returns the cache record of the proof costs.
+func (c *proofCost) serialize() []byte {
+	var buf [proofCostRecordSize]byte
+	buf[0] = byte(proofCostClasses)
+	binary.BigEndian.PutUint64(buf[1:], c.leavesBefore)
+	binary.BigEndian.PutUint64(buf[9:], c.leavesAfter)
+	offset := 17
+	for i := range c.classes {
+		for _, v := range []uint64{c.classes[i].Spends,
+			c.classes[i].ProofHashShares, c.classes[i].LeafDataBytes,
+			c.classes[i].AgeSum} {
+
+			binary.BigEndian.PutUint64(buf[offset:], v)
+			offset += 8
+		}
+	}
+
+	return buf[:]
+}
+
+// deserialize sets the proof costs from the cache record.
+func (c *proofCost) deserialize(buf []byte) {
+	c.leavesBefore = binary.BigEndian.Uint64(buf[1:])
+	c.leavesAfter = binary.BigEndian.Uint64(buf[9:])
+	offset := 17
+	for i := range c.classes {
+		for _, v := range []*uint64{&c.classes[i].Spends,
+			&c.classes[i].ProofHashShares, &c.classes[i].LeafDataBytes,
+			&c.classes[i].AgeSum} {
+
+			*v = binary.BigEndian.Uint64(buf[offset:])
+			offset += 8
+		}
+	}
+}
+
+// leafScriptClass returns the script class of the output of the leaf data.  The
+// scripts that are reconstructed from the spending input aren't in the leaf
+// data so their class is the type they're reconstructed as.
+func leafScriptClass(ld *wire.LeafData) txscript.ScriptClass {
+	switch ld.ReconstructablePkType {
+	case wire.PubKeyHashTy:
+		return txscript.PubKeyHashTy
+	case wire.WitnessV0PubKeyHashTy:
+		return txscript.WitnessV0PubKeyHashTy
+	case wire.ScriptHashTy:
+		return txscript.ScriptHashTy
+	case wire.WitnessV0ScriptHashTy:
+		return txscript.WitnessV0ScriptHashTy
+	}
+
+	return txscript.GetScriptClass(ld.PkScript)
+}
+
+// attributeProofHashes returns the proof hash shares attributed to each of the
+// targets of a batch proof against an accumulator with the given number of
+// leaves.  The proof hashes are found the same way as accumulator.ProofPositions
+// does, but the nodes are tracked by their offset in their row so that it
+// doesn't depend on the rows of the forest.  An error is returned if the
+// number of proof hashes isn't the one of the proof.
+func attributeProofHashes(targets []uint64, numLeaves uint64,
+	proofHashes int) ([]uint64, error) {
+
+	shares := make([]uint64, len(targets))
+
+	// node is a node that's hashed up to the roots along with the targets
+	// under it.
+	type node struct {
+		offset  uint64
+		targets []int
+	}
+	nodes := make([]node, 0, len(targets))
+	for i, target := range targets {
+		if target >= numLeaves {
+			return nil, fmt.Errorf("target %d isn't one of the %d "+
+				"leaves", target, numLeaves)
+		}
+		nodes = append(nodes, node{offset: target, targets: []int{i}})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].offset < nodes[j].offset
+	})
+
+	var found int
+	for row := uint8(0); len(nodes) > 0; row++ {
+		width := numLeaves >> row
+		next := make([]node, 0, len(nodes))
+		for i := 0; i < len(nodes); i++ {
+			n := nodes[i]
+			if i+1 < len(nodes) && nodes[i+1].offset == n.offset {
+				return nil, fmt.Errorf("target %d is proven twice",
+					targets[n.targets[0]])
+			}
+
+			// The root of a tree needs no proof hash.
+			if width&1 == 1 && n.offset == width-1 {
+				continue
+			}
+
+			// Siblings that are both hashed up need no proof hash
+			// either.  Otherwise the proof hash is attributed to the
+			// targets under the node.
+			if n.offset&1 == 0 && i+1 < len(nodes) &&
+				nodes[i+1].offset == n.offset|1 {
+
+				n.targets = append(n.targets, nodes[i+1].targets...)
+				i++
+			} else {
+				found++
+				share := uint64(ProofHashShare / len(n.targets))
+				rem := ProofHashShare % len(n.targets)
+				for j, target := range n.targets {
+					shares[target] += share
+					if j < rem {
+						shares[target]++
+					}
+				}
+			}
+			next = append(next, node{offset: n.offset >> 1,
+				targets: n.targets})
+		}
+		nodes = next
+	}
+	if found != proofHashes {
+		return nil, fmt.Errorf("the targets need %d proof hashes but "+
+			"the proof has %d", found, proofHashes)
+	}
+
+	return shares, nil
+}
+
+// proofCostCache keeps the proof costs of the bands of blocks once they're
+// computed.  The record of a band is at a fixed offset from its number so that
+// any band's proof costs can be filled in.  The records of the bands above a
+// height are dropped whenever the stored proofs above it are.
+type proofCostCache struct {
+	mtx  sync.Mutex
+	path string
+
+	// bandSize is the number of blocks of a band.  Band n is of the
+	// blocks from height n*bandSize on.
+	bandSize int32
+
+	// generation is bumped every time records are dropped so that proof
+	// costs computed from a proof that was dropped in the meantime are
+	// never cached.
+	generation uint64
+}
+
+// newProofCostCache returns the cache of the proof costs at the given path.
+func newProofCostCache(path string) *proofCostCache {
+	return &proofCostCache{path: path, bandSize: defaultProofCostBandSize}
+}
+
+// currentGeneration returns the generation that proof costs computed from now
+// on must be stored with.
+//
+// This function is safe for concurrent access.
+func (c *proofCostCache) currentGeneration() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.generation
+}
+
+// fetch returns the cached proof costs of the given band and whether they were
+// cached.
+//
+// This function is safe for concurrent access.
+func (c *proofCostCache) fetch(band int32) (*proofCost, bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	var buf [proofCostRecordSize]byte
+	_, err = f.ReadAt(buf[:], int64(band)*int64(proofCostRecordSize))
+	if err == io.EOF {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// A record made with a different number of script classes is laid
+	// out differently and is computed again.
+	if buf[0] != byte(proofCostClasses) {
+		return nil, false, nil
+	}
+	cost := new(proofCost)
+	cost.deserialize(buf[:])
+
+	return cost, true, nil
+}
+
+// store caches the proof costs of the given band if no records were dropped
+// since the given generation.
+//
+// This function is safe for concurrent access.
+func (c *proofCostCache) store(band int32, cost *proofCost,
+	generation uint64) error {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if generation != c.generation {
+		return nil
+	}
+
+	f, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(cost.serialize(), int64(band)*int64(proofCostRecordSize))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// truncate drops the records of the bands with blocks above the given height.
+//
+// This function is safe for concurrent access.
+func (c *proofCostCache) truncate(height int32) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.generation++
+
+	fi, err := os.Stat(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only the bands that end at or below the height are kept.
+	size := int64((height+1)/c.bandSize) * int64(proofCostRecordSize)
+	if size < 0 {
+		size = 0
+	}
+	if fi.Size() <= size {
+		return nil
+	}
+
+	return os.Truncate(c.path, size)
+}
+
+// FetchProofCostByScriptType returns how much of the utreexo proofs of the
+// blocks from start to end, both inclusive, is attributed to the spent outputs
+// of every script class that any of them spent, ordered by the script class.
+// The blocks are read one at a time so that the memory used doesn't grow with
+// the range, and the proof costs of every whole band of blocks in the range are
+// cached once they're computed.  Only the leaf datas of the stored proofs are
+// read for the spent outputs, so the age of a spent output is the same as the
+// one kept by the time to live index.
+//
+// The accumulator proofs of the blocks are only stored with a proof generation
+// interval of 1 so an error is returned otherwise.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) FetchProofCostByScriptType(start, end int32) (
+	[]ScriptTypeProofCost, error) {
+
+	if idx.proofGenInterVal != 1 {
+		return nil, fmt.Errorf("the accumulator proofs of the blocks "+
+			"aren't stored with a proof generation interval of %d",
+			idx.proofGenInterVal)
+	}
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	tip := idx.proofState.BestHeight()
+	if start < 0 || start > end || end > tip {
+		return nil, fmt.Errorf("range %d-%d is not within the heights "+
+			"0-%d of the index", start, end, tip)
+	}
+	for height := start; height <= end; height++ {
+		if err := idx.degraded.check(height); err != nil {
+			return nil, err
+		}
+		if err := idx.checkServable(height); err != nil {
+			return nil, err
+		}
+	}
+
+	leaves, err := idx.proofCostLeavesBefore(start)
+	if err != nil {
+		return nil, err
+	}
+	total := proofCost{leavesBefore: leaves, leavesAfter: leaves}
+	bandSize := idx.proofCost.bandSize
+	for height := start; height <= end; {
+		// Whole bands are taken from the cache and cached once
+		// they're computed.
+		band := height / bandSize
+		if height%bandSize == 0 && height+bandSize-1 <= end {
+			cost, cached, err := idx.proofCost.fetch(band)
+			if err != nil {
+				return nil, err
+			}
+			if !cached || cost.leavesBefore != total.leavesAfter {
+				generation := idx.proofCost.currentGeneration()
+				cost, err = idx.computeProofCost(height,
+					height+bandSize-1, total.leavesAfter)
+				if err != nil {
+					return nil, err
+				}
+				err = idx.proofCost.store(band, cost, generation)
+				if err != nil {
+					return nil, err
+				}
+			}
+			total.add(cost)
+			height += bandSize
+			continue
+		}
+
+		cost, err := idx.computeProofCost(height, height,
+			total.leavesAfter)
+		if err != nil {
+			return nil, err
+		}
+		total.add(cost)
+		height++
+	}
+
+	var costs []ScriptTypeProofCost
+	for i := range total.classes {
+		if total.classes[i].Spends == 0 {
+			continue
+		}
+		total.classes[i].Class = txscript.ScriptClass(i)
+		costs = append(costs, total.classes[i])
+	}
+
+	return costs, nil
+}
+
+// proofCostLeavesBefore returns the number of leaves of the accumulator before
+// the block at the given height was connected.  It's counted up from the
+// latest cached band below the height, or from the genesis block if there's
+// none, with the leaves that every block added and deleted.
+func (idx *FlatUtreexoProofIndex) proofCostLeavesBefore(height int32) (
+	uint64, error) {
+
+	from := int32(1)
+	var leaves uint64
+	for band := height/idx.proofCost.bandSize - 1; band >= 0; band-- {
+		cost, cached, err := idx.proofCost.fetch(band)
+		if err != nil {
+			return 0, err
+		}
+		if cached {
+			from = (band + 1) * idx.proofCost.bandSize
+			leaves = cost.leavesAfter
+			break
+		}
+	}
+
+	for ; from < height; from++ {
+		var err error
+		leaves, err = idx.proofCostLeavesAfter(from, leaves)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return leaves, nil
+}
+
+// proofCostLeavesAfter returns the number of leaves of the accumulator after
+// the block at the given height was connected to the accumulator with the given
+// number of leaves.  The forest moves leaves into the positions of the ones
+// that are deleted so every deletion takes a leaf away.
+func (idx *FlatUtreexoProofIndex) proofCostLeavesAfter(height int32,
+	leaves uint64) (uint64, error) {
+
+	undoBlock, err := idx.fetchUndoBlock(height)
+	if err != nil {
+		return 0, err
+	}
+	undo, err := NewUndoBlock(undoBlock)
+	if err != nil {
+		return 0, err
+	}
+	after := leaves + uint64(undo.NumAdds)
+	if uint64(len(undo.Positions)) > after {
+		return 0, fmt.Errorf("the undo block of height %d deletes %d "+
+			"of %d leaves", height, len(undo.Positions), after)
+	}
+
+	return after - uint64(len(undo.Positions)), nil
+}
+
+// computeProofCost computes the proof costs of the blocks from start to end,
+// both inclusive, from their stored proofs.  leaves is the number of leaves of
+// the accumulator before the block at start was connected.
+func (idx *FlatUtreexoProofIndex) computeProofCost(start, end int32,
+	leaves uint64) (*proofCost, error) {
+
+	cost := &proofCost{leavesBefore: leaves, leavesAfter: leaves}
+	for height := start; height <= end; height++ {
+		// The genesis block spends nothing and has no stored proof.
+		if height == 0 {
+			continue
+		}
+
+		proofBytes, err := idx.proofState.FetchData(height)
+		if err != nil {
+			return nil, err
+		}
+		if proofBytes == nil {
+			return nil, fmt.Errorf("Couldn't fetch Utreexo proof "+
+				"for height %d", height)
+		}
+		ud, err := deserializeFlatProof(proofBytes, false)
+		if err != nil {
+			return nil, err
+		}
+
+		// The targets are of the leaf datas of the outputs that were
+		// in the accumulator, in the same order.
+		lds := make([]*wire.LeafData, 0, len(ud.AccProof.Targets))
+		for i := range ud.LeafDatas {
+			if !ud.LeafDatas[i].IsUnconfirmed() {
+				lds = append(lds, &ud.LeafDatas[i])
+			}
+		}
+		var shares []uint64
+		if len(ud.AccProof.Targets) > 0 {
+			shares, err = attributeProofHashes(ud.AccProof.Targets,
+				cost.leavesAfter, len(ud.AccProof.Proof))
+			if err != nil {
+				return nil, fmt.Errorf("height %d: %v", height, err)
+			}
+			if len(lds) != len(shares) {
+				return nil, fmt.Errorf("height %d: the proof has %d "+
+					"targets for %d leaf datas", height,
+					len(shares), len(lds))
+			}
+		}
+
+		for i, ld := range lds {
+			if ld.Height < 0 || ld.Height > height {
+				return nil, fmt.Errorf("leaf data spent at height "+
+					"%d has height %d", height, ld.Height)
+			}
+			class := &cost.classes[leafScriptClass(ld)]
+			class.Spends++
+			class.LeafDataBytes += uint64(ld.SerializeSizeCompact(false))
+			class.AgeSum += uint64(height - ld.Height)
+			if shares != nil {
+				class.ProofHashShares += shares[i]
+			}
+		}
+
+		cost.leavesAfter, err = idx.proofCostLeavesAfter(height,
+			cost.leavesAfter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cost, nil
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"math/bits"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// TestAttributeProofHashes ensures that every proof hash is split between the
+// targets under the node that it's the sibling of and that as many proof hashes
+// are attributed as accumulator.ProofPositions finds.
+func TestAttributeProofHashes(t *testing.T) {
+	const share = ProofHashShare
+	tests := []struct {
+		name      string
+		numLeaves uint64
+		targets   []uint64
+		want      []uint64
+	}{
+		{
+			name:      "single target",
+			numLeaves: 8,
+			targets:   []uint64{0},
+			want:      []uint64{3 * share},
+		},
+		{
+			name:      "siblings",
+			numLeaves: 8,
+			targets:   []uint64{0, 1},
+			want:      []uint64{share, share},
+		},
+		{
+			name:      "cousins",
+			numLeaves: 8,
+			targets:   []uint64{2, 0},
+			want:      []uint64{share + share/2, share + share/2},
+		},
+		{
+			name:      "split in three",
+			numLeaves: 8,
+			targets:   []uint64{0, 1, 2},
+			want:      []uint64{share / 3, share / 3, share + share/3},
+		},
+		{
+			name:      "root of a single leaf",
+			numLeaves: 7,
+			targets:   []uint64{6},
+			want:      []uint64{0},
+		},
+		{
+			name:      "root and a leaf of another tree",
+			numLeaves: 3,
+			targets:   []uint64{2, 0},
+			want:      []uint64{0, share},
+		},
+	}
+
+	for _, test := range tests {
+		var proofHashes uint64
+		for _, s := range test.want {
+			proofHashes += s
+		}
+		got, err := attributeProofHashes(test.targets, test.numLeaves,
+			int(proofHashes/share))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: got shares %v, want %v", test.name, got,
+				test.want)
+		}
+	}
+
+	_, err := attributeProofHashes([]uint64{0}, 8, 2)
+	if err == nil {
+		t.Fatal("expected an error for the wrong number of proof hashes")
+	}
+	_, err = attributeProofHashes([]uint64{8}, 8, 3)
+	if err == nil {
+		t.Fatal("expected an error for a target past the leaves")
+	}
+
+	rand := rand.New(rand.NewSource(1))
+	for numLeaves := uint64(2); numLeaves < 70; numLeaves++ {
+		for i := 0; i < 20; i++ {
+			perm := rand.Perm(int(numLeaves))
+			targets := make([]uint64, 1+rand.Intn(len(perm)))
+			for j := range targets {
+				targets[j] = uint64(perm[j])
+			}
+
+			sorted := make([]uint64, len(targets))
+			copy(sorted, targets)
+			sort.Slice(sorted, func(i, j int) bool {
+				return sorted[i] < sorted[j]
+			})
+			var positions []uint64
+			accumulator.ProofPositions(sorted, numLeaves,
+				uint8(bits.Len64(numLeaves-1)), &positions)
+
+			shares, err := attributeProofHashes(targets, numLeaves,
+				len(positions))
+			if err != nil {
+				t.Fatalf("%d leaves, targets %v: %v", numLeaves,
+					targets, err)
+			}
+			var sum uint64
+			for _, s := range shares {
+				sum += s
+			}
+			if sum != uint64(len(positions))*share {
+				t.Fatalf("%d leaves, targets %v: attributed %d "+
+					"shares for %d proof hashes", numLeaves,
+					targets, sum, len(positions))
+			}
+		}
+	}
+}
+
+// TestFetchProofCostByScriptType ensures that the proof costs of the blocks of a
+// chain with a controlled mix of script types and lifetimes are attributed to
+// the script types that the blocks spend, that they sum up to the proof hashes
+// of the blocks, that they're the same whether they're taken from the cached
+// bands or computed a block at a time, and that the cached bands are dropped
+// along with their proofs.
+func TestFetchProofCostByScriptType(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestFetchProofCostByScriptType", 1)
+	defer tearDown()
+	idx := indexes[1].(*FlatUtreexoProofIndex)
+	idx.proofCost.bandSize = 4
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	process := func(spendables []*blockchain.SpendableOut,
+		spec blockchain.BlockSpec) []*blockchain.SpendableOut {
+
+		block, outs, err := blockchain.GenerateBlockFromSpec(chain, tip,
+			spendables, spec, int64(tip.Height()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = chain.ProcessBlock(block, blockchain.BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tip = block
+		return outs
+	}
+	spendAll := func(spendables []*blockchain.SpendableOut,
+		scriptType blockchain.ScriptType) blockchain.BlockSpec {
+
+		return blockchain.BlockSpec{
+			NumTxs:      len(spendables),
+			InputsPerTx: 1,
+			ScriptTypes: []blockchain.ScriptType{scriptType},
+		}
+	}
+	fanOut := func(scriptType blockchain.ScriptType) blockchain.BlockSpec {
+		return blockchain.BlockSpec{
+			NumTxs:       1,
+			InputsPerTx:  1,
+			OutputsPerTx: 8,
+			ScriptTypes:  []blockchain.ScriptType{scriptType},
+		}
+	}
+
+	// Block 2 and 3 pay 8 outputs each to witness script hashes and bare
+	// multisigs.  They're spent 2 and 4 blocks later and block 8 spends
+	// half of the script hash outputs of block 4 along with the coinbase
+	// of block 3.
+	cb1 := process(nil, blockchain.BlockSpec{})[:1]
+	outs := process(cb1, fanOut(blockchain.ScriptP2WSHOpTrue))
+	cb2, witness := outs[:1], outs[1:]
+	outs = process(cb2, fanOut(blockchain.ScriptBareMultisig))
+	cb3, multisig := outs[:1], outs[1:]
+	scriptHash := process(witness, spendAll(witness,
+		blockchain.ScriptP2SHOpTrue))[1:5]
+	process(nil, blockchain.BlockSpec{})
+	process(nil, blockchain.BlockSpec{})
+	process(multisig, spendAll(multisig, blockchain.ScriptP2SHOpTrue))
+	mixed := append(cb3, scriptHash...)
+	process(mixed, spendAll(mixed, blockchain.ScriptOpTrue))
+	for i := 0; i < 3; i++ {
+		process(nil, blockchain.BlockSpec{})
+	}
+	tipHeight := tip.Height()
+
+	// proofHashes and leafDataBytes are of the proof of the block at the
+	// given height.
+	proofHashes := func(height int32) uint64 {
+		ud, err := idx.FetchUtreexoProof(height, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uint64(len(ud.AccProof.Proof))
+	}
+	leafDataBytes := func(height int32) uint64 {
+		ud, err := idx.FetchUtreexoProof(height, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var size uint64
+		for _, ld := range ud.LeafDatas {
+			size += uint64(ld.SerializeSizeCompact(false))
+		}
+		return size
+	}
+	byClass := func(costs []ScriptTypeProofCost) map[txscript.ScriptClass]ScriptTypeProofCost {
+		m := make(map[txscript.ScriptClass]ScriptTypeProofCost)
+		for _, c := range costs {
+			m[c.Class] = c
+		}
+		return m
+	}
+
+	got, err := idx.FetchProofCostByScriptType(0, tipHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	costs := byClass(got)
+	if len(costs) != 4 {
+		t.Fatalf("got the proof costs of %d script classes, want 4: %+v",
+			len(costs), got)
+	}
+
+	// The blocks that only spend a single script class have all their
+	// proof hashes attributed to it.
+	witnessCost := costs[txscript.WitnessV0ScriptHashTy]
+	if witnessCost.Spends != 8 || witnessCost.AvgAge() != 2 ||
+		witnessCost.ProofHashShares != proofHashes(4)*ProofHashShare ||
+		witnessCost.AvgProofHashes() != float64(proofHashes(4))/8 ||
+		witnessCost.LeafDataBytes != leafDataBytes(4) {
+
+		t.Fatalf("unexpected proof cost of the witness script hashes "+
+			"%+v, want %d proof hashes", witnessCost, proofHashes(4))
+	}
+	multisigCost := costs[txscript.MultiSigTy]
+	if multisigCost.Spends != 8 || multisigCost.AvgAge() != 4 ||
+		multisigCost.ProofHashShares != proofHashes(7)*ProofHashShare ||
+		multisigCost.LeafDataBytes != leafDataBytes(7) {
+
+		t.Fatalf("unexpected proof cost of the multisigs %+v, want "+
+			"%d proof hashes", multisigCost, proofHashes(7))
+	}
+
+	// The coinbases are spent a block after they're created, except for
+	// the one spent in the mixed block 5 blocks after.
+	nonStandard := costs[txscript.NonStandardTy]
+	scriptHashCost := costs[txscript.ScriptHashTy]
+	if nonStandard.Spends != 3 || nonStandard.AvgAge() != 7.0/3 ||
+		scriptHashCost.Spends != 4 || scriptHashCost.AvgAge() != 4 {
+
+		t.Fatalf("unexpected proof costs of the coinbases %+v and the "+
+			"script hashes %+v", nonStandard, scriptHashCost)
+	}
+	if nonStandard.ProofHashShares+scriptHashCost.ProofHashShares !=
+		(proofHashes(2)+proofHashes(3)+proofHashes(8))*ProofHashShare ||
+		nonStandard.LeafDataBytes+scriptHashCost.LeafDataBytes !=
+			leafDataBytes(2)+leafDataBytes(3)+leafDataBytes(8) {
+
+		t.Fatalf("the proof costs of the coinbases %+v and the script "+
+			"hashes %+v don't sum up to the ones of their blocks",
+			nonStandard, scriptHashCost)
+	}
+
+	// Every whole band is cached and taken from the cache again.
+	for band := int32(0); band <= tipHeight/4; band++ {
+		if _, ok, err := idx.proofCost.fetch(band); err != nil || !ok {
+			t.Fatalf("band %d isn't cached: %v", band, err)
+		}
+	}
+	again, err := idx.FetchProofCostByScriptType(0, tipHeight)
+	if err != nil || !reflect.DeepEqual(again, got) {
+		t.Fatalf("got cached proof costs %+v, %v, want %+v", again, err,
+			got)
+	}
+
+	// The proof costs of any range are the sum of the ones of its blocks
+	// and the proof hashes of the blocks.
+	checkRange := func(start, end int32) {
+		t.Helper()
+
+		rangeCost, err := idx.FetchProofCostByScriptType(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum proofCost
+		var wantShares, gotShares uint64
+		for height := start; height <= end; height++ {
+			blockCost, err := idx.FetchProofCostByScriptType(height,
+				height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var blockShares uint64
+			for _, c := range blockCost {
+				sum.classes[c.Class].Class = c.Class
+				sum.classes[c.Class].Spends += c.Spends
+				sum.classes[c.Class].ProofHashShares += c.ProofHashShares
+				sum.classes[c.Class].LeafDataBytes += c.LeafDataBytes
+				sum.classes[c.Class].AgeSum += c.AgeSum
+				blockShares += c.ProofHashShares
+			}
+			if height > 0 && blockShares != proofHashes(height)*ProofHashShare {
+				t.Fatalf("height %d: attributed %d shares for %d "+
+					"proof hashes", height, blockShares,
+					proofHashes(height))
+			}
+			if height > 0 {
+				wantShares += proofHashes(height) * ProofHashShare
+			}
+		}
+		var want []ScriptTypeProofCost
+		for _, c := range sum.classes {
+			if c.Spends > 0 {
+				want = append(want, c)
+			}
+		}
+		for _, c := range rangeCost {
+			gotShares += c.ProofHashShares
+		}
+		if !reflect.DeepEqual(rangeCost, want) || gotShares != wantShares {
+			t.Fatalf("range %d-%d: got proof costs %+v, want %+v",
+				start, end, rangeCost, want)
+		}
+	}
+	checkRange(0, tipHeight)
+	checkRange(3, 9)
+	checkRange(4, 7)
+	checkRange(8, 8)
+
+	// The cached bands are dropped along with their proofs and computed
+	// again.
+	err = idx.proofCost.truncate(tipHeight - 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := idx.proofCost.fetch(tipHeight / 4); ok {
+		t.Fatalf("the band of height %d wasn't dropped", tipHeight)
+	}
+	if _, ok, _ := idx.proofCost.fetch(1); !ok {
+		t.Fatal("the band below the dropped height was dropped")
+	}
+	again, err = idx.FetchProofCostByScriptType(0, tipHeight)
+	if err != nil || !reflect.DeepEqual(again, got) {
+		t.Fatalf("got recomputed proof costs %+v, %v, want %+v", again,
+			err, got)
+	}
+
+	_, err = idx.FetchProofCostByScriptType(tipHeight, tipHeight+1)
+	if err == nil {
+		t.Fatal("expected an error for a range past the tip")
+	}
+
+	// The accumulator proofs of the blocks aren't stored with multi-block
+	// proofs.
+	_, multiIndexes, _, multiTearDown := indexersTestChain(
+		"TestFetchProofCostByScriptType-multi", defaultProofGenInterval)
+	defer multiTearDown()
+	_, err = multiIndexes[1].(*FlatUtreexoProofIndex).
+		FetchProofCostByScriptType(0, 0)
+	if err == nil {
+		t.Fatal("expected an error without the accumulator proofs")
+	}
+}
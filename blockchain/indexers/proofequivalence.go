@@ -0,0 +1,379 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// ProofVerdict is the result of comparing a utreexo proof produced by another
+// implementation with the one of the local index for the same block.
+type ProofVerdict int
+
+const (
+	// ProofIdentical is a proof that's the same as the local one down to
+	// the parts that don't change what's proven.
+	ProofIdentical ProofVerdict = iota
+
+	// ProofEquivalent is a proof that proves the same leaves at the same
+	// positions as the local one but differs from it in parts that don't
+	// change what's proven, like the order of the leaves.
+	ProofEquivalent
+
+	// ProofDifferentTargets is a proof that verifies against the roots of
+	// the block but proves the leaves at other positions than the local
+	// one.  Both can only verify if the leaves are in the accumulator
+	// twice or the local proof is wrong, so it's cause for alarm.
+	ProofDifferentTargets
+
+	// ProofInvalid is a proof that doesn't verify against the roots of the
+	// block.
+	ProofInvalid
+)
+
+// proofVerdictStrings is a map of proof verdicts back to their constant names
+// for pretty printing.
+var proofVerdictStrings = map[ProofVerdict]string{
+	ProofIdentical:        "identical",
+	ProofEquivalent:       "equivalent",
+	ProofDifferentTargets: "differenttargets",
+	ProofInvalid:          "invalid",
+}
+
+// String returns the ProofVerdict as a human-readable name.
+func (v ProofVerdict) String() string {
+	if s, ok := proofVerdictStrings[v]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown proof verdict (%d)", int(v))
+}
+
+// ProofComparison is the outcome of comparing a utreexo proof produced by
+// another implementation with the one of the local index.
+type ProofComparison struct {
+	// Verdict is how the proof compares to the local one.
+	Verdict ProofVerdict
+
+	// Redundant describes every part of the proof that differs from the
+	// local one without changing what's proven, one per line.  It's only
+	// set for equivalent proofs.
+	Redundant []string
+
+	// Diff describes every difference between the canonical forms of the
+	// local proof and the proof, one per line.  It's only set for proofs
+	// with different targets.
+	Diff []string
+
+	// Err is why the proof didn't verify.  It's only set for invalid
+	// proofs.
+	Err error
+}
+
+// ProofVerifyError is returned by VerifyUDataAt when the utreexo proof doesn't
+// verify against the roots of the accumulator right before its block.
+type ProofVerifyError struct {
+	// Height is the height of the block the proof is for.
+	Height int32
+
+	// Err is why the proof didn't verify.
+	Err error
+}
+
+// Error returns the ProofVerifyError in human-readable form.
+func (e *ProofVerifyError) Error() string {
+	return fmt.Sprintf("utreexo proof for height %d doesn't verify: %v",
+		e.Height, e.Err)
+}
+
+// Unwrap returns why the proof didn't verify.
+func (e *ProofVerifyError) Unwrap() error {
+	return e.Err
+}
+
+// CanonicalizeUData returns the canonical form of the given utreexo proof for
+// the given block so that proofs produced by different implementations compare
+// equal with UData.Equal whenever they prove the same leaves at the same
+// positions.  The canonical form is:
+//
+//   - the leaf datas and their targets in the order of the inputs of the block
+//     that they're spent by.  Leaf datas that have their outpoints are put in
+//     that order and ones that don't are taken to already be in it;
+//   - the leaf datas in the form the indexes store them in, without their
+//     block hashes, their outpoints, or the scripts that are reconstructable;
+//   - no remember indexes, as they're only a caching hint for the compact
+//     state nodes and don't change what's proven.
+//
+// An error is returned if the proof doesn't have exactly one target for every
+// leaf data and one leaf data for every input of the block that needs to be
+// proven.
+func CanonicalizeUData(ud *wire.UData, block *btcutil.Block) (*wire.UData, error) {
+	delOPs := blockchain.BlockToDelOPs(block)
+	if len(ud.LeafDatas) != len(delOPs) {
+		return nil, fmt.Errorf("%d leaf datas for the %d inputs of block %v "+
+			"that need to be proven", len(ud.LeafDatas), len(delOPs),
+			block.Hash())
+	}
+	if len(ud.AccProof.Targets) != len(ud.LeafDatas) {
+		return nil, fmt.Errorf("%d targets for %d leaf datas",
+			len(ud.AccProof.Targets), len(ud.LeafDatas))
+	}
+
+	// Either every leaf data has its outpoint or none of them do.
+	var withOutPoints int
+	for i := range ud.LeafDatas {
+		if ud.LeafDatas[i].OutPoint != (wire.OutPoint{}) {
+			withOutPoints++
+		}
+	}
+	if withOutPoints != 0 && withOutPoints != len(ud.LeafDatas) {
+		return nil, fmt.Errorf("%d of %d leaf datas have their outpoints",
+			withOutPoints, len(ud.LeafDatas))
+	}
+
+	// order[i] is the index of the leaf data and the target that's spent
+	// by the ith input.
+	order := make([]int, len(delOPs))
+	for i := range order {
+		order[i] = i
+	}
+	if withOutPoints != 0 {
+		inputIdx := make(map[wire.OutPoint]int, len(delOPs))
+		for i, op := range delOPs {
+			inputIdx[op] = i
+		}
+		placed := make([]bool, len(delOPs))
+		for i := range ud.LeafDatas {
+			op := ud.LeafDatas[i].OutPoint
+			j, ok := inputIdx[op]
+			if !ok {
+				return nil, fmt.Errorf("leaf data %d is for %v, which "+
+					"isn't spent by block %v", i, op, block.Hash())
+			}
+			if placed[j] {
+				return nil, fmt.Errorf("leaf data %d is for %v, "+
+					"which has another leaf data", i, op)
+			}
+			placed[j] = true
+			order[j] = i
+		}
+	}
+
+	ordered := &wire.UData{
+		AccProof: accumulator.BatchProof{
+			Targets: make([]uint64, len(order)),
+			Proof:   ud.AccProof.Proof,
+		},
+		LeafDatas: make([]wire.LeafData, len(order)),
+	}
+	for j, i := range order {
+		ordered.AccProof.Targets[j] = ud.AccProof.Targets[i]
+		ordered.LeafDatas[j] = ud.LeafDatas[i]
+	}
+
+	canonical := canonicalUData(ordered, blockchain.BlockToDelTxIns(block))
+	canonical.RememberIdx = nil
+
+	return canonical, nil
+}
+
+// redundantParts describes every part of the given proof that it has on top of
+// its canonical form, one per line.  The remember indexes are compared against
+// the ones of the local proof.
+func redundantParts(ud, canonical, local *wire.UData) []string {
+	var parts []string
+	for i := range ud.AccProof.Targets {
+		if ud.AccProof.Targets[i] != canonical.AccProof.Targets[i] {
+			parts = append(parts, "order: the targets and the leaf "+
+				"datas aren't in the order of the block's inputs")
+			break
+		}
+	}
+
+	// The canonical form only leaves out the scripts that are
+	// reconstructable from the inputs that spend them, so the scripts it
+	// doesn't have are the redundant ones.
+	var outPoints, scripts int
+	for i := range ud.LeafDatas {
+		ld := &ud.LeafDatas[i]
+		if ld.OutPoint != (wire.OutPoint{}) || ld.BlockHash != (chainhash.Hash{}) {
+			outPoints++
+		}
+		if len(ld.PkScript) > 0 {
+			scripts++
+		}
+		if len(canonical.LeafDatas[i].PkScript) > 0 {
+			scripts--
+		}
+	}
+	if outPoints > 0 {
+		parts = append(parts, fmt.Sprintf("outpoints: %d leaf datas "+
+			"include their block hash and outpoint", outPoints))
+	}
+	if scripts > 0 {
+		parts = append(parts, fmt.Sprintf("scripts: %d leaf datas "+
+			"include a script that's reconstructable", scripts))
+	}
+
+	if !uint32sEqual(ud.RememberIdx, local.RememberIdx) {
+		parts = append(parts, fmt.Sprintf("remember indexes: local %v, "+
+			"submitted %v", local.RememberIdx, ud.RememberIdx))
+	}
+
+	return parts
+}
+
+// uint32sEqual returns whether the two slices hold the same values in the same
+// order.  Nil and empty slices are equal.
+func uint32sEqual(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareProofs returns how the given proof compares to the local one once
+// both are canonicalized for the given block.  The proof must already have
+// been verified against the roots of the block.
+func compareProofs(ud, local *wire.UData, block *btcutil.Block) (
+	*ProofComparison, error) {
+
+	localCanonical, err := CanonicalizeUData(local, block)
+	if err != nil {
+		return nil, fmt.Errorf("local proof: %v", err)
+	}
+	canonical, err := CanonicalizeUData(ud, block)
+	if err != nil {
+		return &ProofComparison{Verdict: ProofInvalid, Err: err}, nil
+	}
+
+	// A verified proof with the same targets as the local one proves the
+	// same leaves with the same proof hashes.  So once both are in their
+	// canonical forms, any difference is in which leaves are proven where.
+	if !canonical.Equal(localCanonical) {
+		return &ProofComparison{
+			Verdict: ProofDifferentTargets,
+			Diff: diffUDataNamed(localCanonical, canonical,
+				"local", "submitted"),
+		}, nil
+	}
+
+	redundant := redundantParts(ud, canonical, local)
+	if len(redundant) == 0 {
+		return &ProofComparison{Verdict: ProofIdentical}, nil
+	}
+
+	return &ProofComparison{
+		Verdict:   ProofEquivalent,
+		Redundant: redundant,
+	}, nil
+}
+
+// VerifyUDataAt verifies the given utreexo proof for the main chain block at
+// the given height against the roots of the accumulator right before the block.
+// The leaf datas of the proof may be in the full or the compact form.  They're
+// filled in from the block and the main chain before they're hashed, so only
+// the leaf datas for the block's own inputs verify.
+//
+// A ProofVerifyError is returned if the proof doesn't verify.  Any other error
+// means that the roots for the block couldn't be fetched.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) VerifyUDataAt(height int32, ud *wire.UData) error {
+	if height <= 0 {
+		return fmt.Errorf("height %d has no utreexo proof to verify",
+			height)
+	}
+	block, err := idx.chain.BlockByHeight(height)
+	if err != nil {
+		return err
+	}
+
+	return idx.verifyUDataAt(ud, block)
+}
+
+// verifyUDataAt verifies the given utreexo proof for the given main chain block
+// against the roots of the accumulator right before the block.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) verifyUDataAt(ud *wire.UData,
+	block *btcutil.Block) error {
+
+	canonical, err := CanonicalizeUData(ud, block)
+	if err != nil {
+		return &ProofVerifyError{Height: block.Height(), Err: err}
+	}
+	delHashes, err := blockchain.ReconstructUData(canonical, block,
+		idx.chain.BlockHashByHeight, idx.chainParams.LeafCommitments,
+		idx.leafHasher)
+	if err != nil {
+		return &ProofVerifyError{Height: block.Height(), Err: err}
+	}
+
+	var verifyErr error
+	err = idx.withSnapshotState(block.Height()-1, func() error {
+		verifyErr = idx.utreexoState.state.VerifyBatchProof(delHashes,
+			canonical.AccProof)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if verifyErr != nil {
+		return &ProofVerifyError{Height: block.Height(), Err: verifyErr}
+	}
+
+	return nil
+}
+
+// CompareProof verifies the given utreexo proof produced by another
+// implementation for the main chain block at the given height against the
+// roots of the accumulator right before the block and compares it with the
+// local proof for the block once both are canonicalized.  The proof may have
+// its leaf datas in the full or the compact form.
+//
+// An error is only returned when the local proof or the roots for the block
+// can't be fetched.  A proof that doesn't verify is given the invalid verdict.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) CompareProof(height int32, ud *wire.UData) (
+	*ProofComparison, error) {
+
+	if height <= 0 {
+		return nil, fmt.Errorf("height %d has no utreexo proof to "+
+			"compare", height)
+	}
+	local, err := idx.FetchUtreexoProof(height, false)
+	if err != nil {
+		return nil, err
+	}
+	block, err := idx.chain.BlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	err = idx.verifyUDataAt(ud, block)
+	var verifyErr *ProofVerifyError
+	if errors.As(err, &verifyErr) {
+		return &ProofComparison{Verdict: ProofInvalid, Err: verifyErr.Err}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return compareProofs(ud, local, block)
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// copyUData returns a deep copy of the utreexo data.
+func copyUData(ud *wire.UData) *wire.UData {
+	cp := &wire.UData{
+		AccProof: accumulator.BatchProof{
+			Targets: append([]uint64(nil), ud.AccProof.Targets...),
+			Proof:   append([]accumulator.Hash(nil), ud.AccProof.Proof...),
+		},
+		LeafDatas:   make([]wire.LeafData, len(ud.LeafDatas)),
+		RememberIdx: append([]uint32(nil), ud.RememberIdx...),
+	}
+	for i, ld := range ud.LeafDatas {
+		ld.PkScript = append([]byte(nil), ld.PkScript...)
+		cp.LeafDatas[i] = ld
+	}
+
+	return cp
+}
+
+// TestCompareProof ensures that proofs produced by another implementation are
+// verified against the roots of their block and compared with the local proof
+// once both are canonicalized.
+func TestCompareProof(t *testing.T) {
+	chain, indexes, params, tearDown := indexersTestChain("TestCompareProof", 1)
+	defer tearDown()
+
+	tip, spendables := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	for i := 0; i < 5; i++ {
+		tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+	}
+	var idx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		if flat, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			idx = flat
+		}
+	}
+
+	// Compare the proof of a block before the tip so that the roots have
+	// to be rolled back.
+	height := tip.Height() - 1
+	block, err := chain.BlockByHeight(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := idx.FetchUtreexoProof(height, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local.LeafDatas) < 3 || len(local.AccProof.Proof) == 0 {
+		t.Fatalf("expected a proof of several leaves but got %d leaf "+
+			"datas and %d proof hashes", len(local.LeafDatas),
+			len(local.AccProof.Proof))
+	}
+
+	// The proof as it'd be produced with the leaf datas in the full form.
+	full := copyUData(local)
+	_, err = blockchain.ReconstructUData(full, block, chain.BlockHashByHeight,
+		params.LeafCommitments, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		modify    func(ud *wire.UData) *wire.UData
+		verdict   ProofVerdict
+		redundant []string
+	}{
+		{
+			name:    "local proof",
+			modify:  func(ud *wire.UData) *wire.UData { return ud },
+			verdict: ProofIdentical,
+		},
+		{
+			name:      "full leaf datas",
+			modify:    func(*wire.UData) *wire.UData { return copyUData(full) },
+			verdict:   ProofEquivalent,
+			redundant: []string{"outpoints: "},
+		},
+		{
+			name: "reordered full leaf datas",
+			modify: func(*wire.UData) *wire.UData {
+				ud := copyUData(full)
+				n := len(ud.LeafDatas) - 1
+				ud.LeafDatas[0], ud.LeafDatas[n] = ud.LeafDatas[n], ud.LeafDatas[0]
+				ud.AccProof.Targets[0], ud.AccProof.Targets[n] =
+					ud.AccProof.Targets[n], ud.AccProof.Targets[0]
+				return ud
+			},
+			verdict:   ProofEquivalent,
+			redundant: []string{"order: ", "outpoints: "},
+		},
+		{
+			name: "other remember indexes",
+			modify: func(ud *wire.UData) *wire.UData {
+				ud.RememberIdx = append(ud.RememberIdx, 0)
+				return ud
+			},
+			verdict:   ProofEquivalent,
+			redundant: []string{"remember indexes: "},
+		},
+		{
+			name: "reordered targets",
+			modify: func(ud *wire.UData) *wire.UData {
+				ud.AccProof.Targets[0], ud.AccProof.Targets[1] =
+					ud.AccProof.Targets[1], ud.AccProof.Targets[0]
+				return ud
+			},
+			verdict: ProofInvalid,
+		},
+		{
+			name: "corrupted proof hash",
+			modify: func(ud *wire.UData) *wire.UData {
+				ud.AccProof.Proof[0][0] ^= 1
+				return ud
+			},
+			verdict: ProofInvalid,
+		},
+		{
+			name: "extra proof hash",
+			modify: func(ud *wire.UData) *wire.UData {
+				ud.AccProof.Proof = append(ud.AccProof.Proof,
+					ud.AccProof.Proof[0])
+				return ud
+			},
+			verdict: ProofInvalid,
+		},
+		{
+			name: "corrupted amount",
+			modify: func(ud *wire.UData) *wire.UData {
+				ud.LeafDatas[1].Amount++
+				return ud
+			},
+			verdict: ProofInvalid,
+		},
+		{
+			name: "missing leaf data",
+			modify: func(ud *wire.UData) *wire.UData {
+				ud.LeafDatas = ud.LeafDatas[1:]
+				ud.AccProof.Targets = ud.AccProof.Targets[1:]
+				return ud
+			},
+			verdict: ProofInvalid,
+		},
+		{
+			name: "outpoint not spent by the block",
+			modify: func(*wire.UData) *wire.UData {
+				ud := copyUData(full)
+				ud.LeafDatas[0].OutPoint.Index++
+				return ud
+			},
+			verdict: ProofInvalid,
+		},
+		{
+			name: "height after the block",
+			modify: func(ud *wire.UData) *wire.UData {
+				ud.LeafDatas[0].Height = tip.Height() + 1
+				return ud
+			},
+			verdict: ProofInvalid,
+		},
+	}
+
+	for _, test := range tests {
+		ud := test.modify(copyUData(local))
+		cmp, err := idx.CompareProof(height, ud)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if cmp.Verdict != test.verdict {
+			t.Fatalf("%s: got verdict %v (%v), want %v", test.name,
+				cmp.Verdict, cmp.Err, test.verdict)
+		}
+		if (cmp.Verdict == ProofInvalid) != (cmp.Err != nil) {
+			t.Fatalf("%s: %v verdict with error %v", test.name,
+				cmp.Verdict, cmp.Err)
+		}
+		if len(cmp.Redundant) != len(test.redundant) {
+			t.Fatalf("%s: got redundant parts %q, want %d", test.name,
+				cmp.Redundant, len(test.redundant))
+		}
+		for i, want := range test.redundant {
+			if !strings.HasPrefix(cmp.Redundant[i], want) {
+				t.Fatalf("%s: got redundant part %q, want %q",
+					test.name, cmp.Redundant[i], want)
+			}
+		}
+
+		// The verification on its own agrees with the verdict.
+		err = idx.VerifyUDataAt(height, ud)
+		var verifyErr *ProofVerifyError
+		if (test.verdict == ProofInvalid) != errors.As(err, &verifyErr) {
+			t.Fatalf("%s: VerifyUDataAt returned %v", test.name, err)
+		}
+	}
+
+	// Equivalent proofs have the same canonical form.
+	want, err := CanonicalizeUData(local, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests[:4] {
+		canonical, err := CanonicalizeUData(test.modify(copyUData(local)),
+			block)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !canonical.Equal(want) {
+			t.Fatalf("%s: canonical form differs", test.name)
+		}
+	}
+
+	// A proof that verifies but doesn't prove the leaves at the same
+	// positions as the local one is told apart.  Both can only verify if
+	// one of the indexes is wrong, so the local proof is the one tampered
+	// with here.
+	wrongLocal := copyUData(local)
+	wrongLocal.AccProof.Targets[0]++
+	cmp, err := compareProofs(local, wrongLocal, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmp.Verdict != ProofDifferentTargets || len(cmp.Diff) == 0 ||
+		!strings.HasPrefix(cmp.Diff[0], "target 0: ") {
+
+		t.Fatalf("got verdict %v with diff %q", cmp.Verdict, cmp.Diff)
+	}
+
+	// Heights without a proof or without the roots before them are errors
+	// rather than verdicts.
+	for _, badHeight := range []int32{0, tip.Height() + 1} {
+		_, err := idx.CompareProof(badHeight, local)
+		if err == nil {
+			t.Fatalf("expected an error comparing at height %d",
+				badHeight)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"math/bits"
+	"sort"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// LeafEstimate is what proving a single utxo adds to the proof of the utxos
+// before it.
+type LeafEstimate struct {
+	// Exists is whether the leaf of the utxo is in the accumulator.  Nothing
+	// else is set if it isn't.
+	Exists bool
+
+	// Position is the position of the leaf and Depth is the number of rows
+	// of the tree that it's in, which is the number of hashes that prove it
+	// on its own.
+	Position uint64
+	Depth    uint8
+
+	// MarginalHashes, MarginalBytes and MarginalHashOps are how much the
+	// proof hashes, the serialized bytes and the hashes computed to verify
+	// the proof grow by once the leaf is proven along with the leaves before
+	// it.  They're negative if the leaf was itself one of the proof hashes
+	// of the leaves before it.
+	MarginalHashes  int
+	MarginalBytes   int
+	MarginalHashOps int64
+}
+
+// ProofEstimate is the estimate of the proof that ProveUtxos would return for
+// a set of utxos and of what it costs to verify it.
+//
+// The estimate is exact for the accumulator that it's made against, but the
+// positions of the leaves change as blocks are connected so it only holds
+// until the next block.
+type ProofEstimate struct {
+	// Leaves are the estimates of each of the utxos in the order they were
+	// given in.
+	Leaves []LeafEstimate
+
+	// NumLeaves is the number of leaves of the accumulator.
+	NumLeaves uint64
+
+	// ProofHashes is the number of hashes of the proof of the leaves that
+	// exist, SerializedBytes is the size of their serialized chain-tip
+	// inclusion proof and HashOps is the number of hashes computed to verify
+	// it.
+	ProofHashes     int
+	SerializedBytes int
+	HashOps         int64
+}
+
+// proofPositionsCost returns the number of proof hashes and the number of
+// hashes computed to verify the proof of the leaves at the given positions of
+// an accumulator with the given number of leaves.  The positions of the leaves
+// are the same regardless of the rows of the forest, so the proof is laid out
+// in the fewest rows that the leaves fit in.
+func proofPositionsCost(positions []uint64, numLeaves uint64) (int, int64) {
+	// An accumulator with a single leaf is its own proof.
+	if len(positions) == 0 || numLeaves <= 1 {
+		return 0, 0
+	}
+
+	sorted := make([]uint64, len(positions))
+	copy(sorted, positions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var proofPositions []uint64
+	hashOps := accumulator.ProofPositions(sorted, numLeaves,
+		uint8(bits.Len64(numLeaves-1)), &proofPositions)
+
+	return len(proofPositions), hashOps
+}
+
+// chainTipProofSize returns the serialized size of a chain-tip inclusion proof
+// of the leaves at the given positions with the given number of proof hashes.
+func chainTipProofSize(positions []uint64, numLeaves uint64, proofHashes int) int {
+	bp := accumulator.BatchProof{Targets: positions}
+	if numLeaves <= 1 {
+		bp.Targets = nil
+	}
+
+	size := chainhash.HashSize + wire.BatchProofSerializeTargetSize(&bp)
+	size += wire.VarIntSerializeSize(uint64(proofHashes))
+	size += chainhash.HashSize * proofHashes
+
+	// Then the count of the proven hashes and the hashes themselves.
+	return size + 4 + chainhash.HashSize*len(positions)
+}
+
+// estimateProof estimates the proof of the given leaf hashes.  Nil hashes are
+// reported as not existing.
+//
+// The caller must hold the lock of the utreexo state of the index.
+func estimateProof(uState *UtreexoState, hashes []*accumulator.Hash) (
+	*ProofEstimate, error) {
+
+	numLeaves, err := uState.NumLeaves()
+	if err != nil {
+		return nil, err
+	}
+	forest := uState.state
+	est := &ProofEstimate{
+		Leaves:          make([]LeafEstimate, len(hashes)),
+		NumLeaves:       numLeaves,
+		SerializedBytes: chainTipProofSize(nil, numLeaves, 0),
+	}
+
+	// The forest only exposes the position of a leaf through its proof.
+	var positions []uint64
+	for i, hash := range hashes {
+		if hash == nil || !forest.FindLeaf(*hash) {
+			continue
+		}
+		proof, err := forest.Prove(*hash)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, proof.Position)
+
+		proofHashes, hashOps := proofPositionsCost(positions, numLeaves)
+		size := chainTipProofSize(positions, numLeaves, proofHashes)
+		est.Leaves[i] = LeafEstimate{
+			Exists:          true,
+			Position:        proof.Position,
+			Depth:           uint8(len(proof.Siblings)),
+			MarginalHashes:  proofHashes - est.ProofHashes,
+			MarginalBytes:   size - est.SerializedBytes,
+			MarginalHashOps: hashOps - est.HashOps,
+		}
+		est.ProofHashes = proofHashes
+		est.SerializedBytes = size
+		est.HashOps = hashOps
+	}
+
+	return est, nil
+}
+
+// leafHashesOf returns the leaf hashes of the given utxos with nil for the ones
+// that are nil or spent.
+func leafHashesOf(utxos []*blockchain.UtxoEntry, outpoints []wire.OutPoint,
+	toLeafHashes func([]*blockchain.UtxoEntry, *[]wire.OutPoint) (
+		[]accumulator.Hash, error)) ([]*accumulator.Hash, error) {
+
+	var indexes []int
+	var entries []*blockchain.UtxoEntry
+	var ops []wire.OutPoint
+	for i, utxo := range utxos {
+		if utxo == nil || utxo.IsSpent() {
+			continue
+		}
+		indexes = append(indexes, i)
+		entries = append(entries, utxo)
+		ops = append(ops, outpoints[i])
+	}
+
+	leafHashes, err := toLeafHashes(entries, &ops)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]*accumulator.Hash, len(utxos))
+	for j, i := range indexes {
+		hashes[i] = &leafHashes[j]
+	}
+
+	return hashes, nil
+}
+
+// EstimateUtxoProof estimates the proof that ProveUtxos would return for the
+// passed in utxos and what it costs to verify it without building it, so that
+// a set of utxos to spend can be picked before the transaction is made.  The
+// utxos that are nil or spent are reported as not existing instead of failing
+// the estimate.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) EstimateUtxoProof(utxos []*blockchain.UtxoEntry,
+	outpoints []wire.OutPoint) (*ProofEstimate, error) {
+
+	hashes, err := leafHashesOf(utxos, outpoints, idx.utxosToLeafHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	return estimateProof(idx.utreexoState, hashes)
+}
+
+// EstimateUtxoProof estimates the proof that ProveUtxos would return for the
+// passed in utxos and what it costs to verify it without building it, so that
+// a set of utxos to spend can be picked before the transaction is made.  The
+// utxos that are nil or spent are reported as not existing instead of failing
+// the estimate.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) EstimateUtxoProof(utxos []*blockchain.UtxoEntry,
+	outpoints []wire.OutPoint) (*ProofEstimate, error) {
+
+	// A degraded index no longer has the utreexo state of the tip.
+	if err := idx.degraded.check(idx.chain.BestSnapshot().Height); err != nil {
+		return nil, err
+	}
+
+	hashes, err := leafHashesOf(utxos, outpoints, idx.utxosToLeafHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	return estimateProof(idx.utreexoState, hashes)
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// proofEstimator is a utreexo proof index that estimates and builds proofs of
+// utxos.
+type proofEstimator interface {
+	EstimateUtxoProof([]*blockchain.UtxoEntry, []wire.OutPoint) (
+		*ProofEstimate, error)
+	ProveUtxos([]*blockchain.UtxoEntry, *[]wire.OutPoint) (
+		*blockchain.ChainTipProof, error)
+}
+
+// TestEstimateUtxoProof ensures that the estimates of both utreexo proof
+// indexes match the proofs that they build for sets of utxos that share
+// branches of the accumulator to different extents, and that unknown utxos
+// are reported instead of failing the estimate.
+func TestEstimateUtxoProof(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestEstimateUtxoProof", 1)
+	defer tearDown()
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	var outpoints []wire.OutPoint
+	for i := 0; i < 30; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+		for _, tx := range tip.Transactions() {
+			for vout := range tx.MsgTx().TxOut {
+				outpoints = append(outpoints,
+					*wire.NewOutPoint(tx.Hash(), uint32(vout)))
+			}
+		}
+	}
+
+	var utxos []*blockchain.UtxoEntry
+	var unspent []wire.OutPoint
+	for _, op := range outpoints {
+		entry, err := chain.FetchUtxoEntry(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || entry.IsSpent() {
+			continue
+		}
+		utxos = append(utxos, entry)
+		unspent = append(unspent, op)
+	}
+	if len(utxos) < 20 {
+		t.Fatalf("expected at least 20 utxos, got %d", len(utxos))
+	}
+
+	rng := rand.New(rand.NewSource(253))
+	sets := map[string][]int{
+		"single":   {0},
+		"adjacent": {0, 1, 2, 3, 4, 5, 6, 7},
+		"reversed": {7, 6, 5, 4, 3, 2, 1, 0},
+		"spread":   {0, len(utxos) / 2, len(utxos) - 1},
+		"random":   rng.Perm(len(utxos))[:len(utxos)/2],
+	}
+	all := make([]int, len(utxos))
+	for i := range all {
+		all[i] = i
+	}
+	sets["all"] = all
+
+	for _, indexer := range indexes {
+		idx, ok := indexer.(proofEstimator)
+		if !ok {
+			continue
+		}
+
+		for name, set := range sets {
+			entries := make([]*blockchain.UtxoEntry, 0, len(set))
+			ops := make([]wire.OutPoint, 0, len(set))
+			for _, i := range set {
+				entries = append(entries, utxos[i])
+				ops = append(ops, unspent[i])
+			}
+
+			est, err := idx.EstimateUtxoProof(entries, ops)
+			if err != nil {
+				t.Fatalf("%T %s: %v", idx, name, err)
+			}
+			proof, err := idx.ProveUtxos(entries, &ops)
+			if err != nil {
+				t.Fatalf("%T %s: %v", idx, name, err)
+			}
+			var buf bytes.Buffer
+			if err := proof.Serialize(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if est.ProofHashes != len(proof.AccProof.Proof) ||
+				est.SerializedBytes != buf.Len() {
+
+				t.Fatalf("%T %s: estimated %d hashes and %d bytes, "+
+					"got %d hashes and %d bytes", idx, name,
+					est.ProofHashes, est.SerializedBytes,
+					len(proof.AccProof.Proof), buf.Len())
+			}
+
+			var hashes, size int
+			var hashOps int64
+			for i, leaf := range est.Leaves {
+				if !leaf.Exists || leaf.Position != proof.AccProof.Targets[i] {
+					t.Fatalf("%T %s: leaf %d: got %+v, want position %d",
+						idx, name, i, leaf, proof.AccProof.Targets[i])
+				}
+				hashes += leaf.MarginalHashes
+				size += leaf.MarginalBytes
+				hashOps += leaf.MarginalHashOps
+			}
+			empty := chainTipProofSize(nil, est.NumLeaves, 0)
+			if hashes != est.ProofHashes || size+empty != est.SerializedBytes ||
+				hashOps != est.HashOps {
+
+				t.Fatalf("%T %s: the marginal costs don't add up to "+
+					"%+v", idx, name, est)
+			}
+
+			// The depth of a leaf is the size of its proof on its own.
+			single, err := idx.EstimateUtxoProof(entries[:1], ops[:1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(est.Leaves[0].Depth) != single.ProofHashes {
+				t.Fatalf("%T %s: got depth %d, want %d", idx, name,
+					est.Leaves[0].Depth, single.ProofHashes)
+			}
+		}
+
+		// Sibling leaves share their branches, so proving the second of
+		// them takes its own hash away from the proof of the first.
+		est, err := idx.EstimateUtxoProof(utxos, unspent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions := make(map[uint64]int, len(est.Leaves))
+		for i, leaf := range est.Leaves {
+			positions[leaf.Position] = i
+		}
+		var siblings []int
+		for i, leaf := range est.Leaves {
+			if j, ok := positions[leaf.Position^1]; ok {
+				siblings = []int{i, j}
+				break
+			}
+		}
+		if siblings == nil {
+			t.Fatalf("%T: no sibling leaves", idx)
+		}
+		est, err = idx.EstimateUtxoProof(
+			[]*blockchain.UtxoEntry{utxos[siblings[0]], utxos[siblings[1]]},
+			[]wire.OutPoint{unspent[siblings[0]], unspent[siblings[1]]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est.Leaves[1].MarginalHashes != -1 {
+			t.Fatalf("%T: expected the sibling to take a hash away, "+
+				"got %+v", idx, est.Leaves[1])
+		}
+
+		// Unknown and spent utxos are reported as not existing and left
+		// out of the estimate.
+		unknown := *wire.NewOutPoint(&chainhash.Hash{0x01}, 0)
+		est, err = idx.EstimateUtxoProof(
+			[]*blockchain.UtxoEntry{utxos[0], nil, utxos[1]},
+			[]wire.OutPoint{unspent[0], unknown, unspent[1]})
+		if err != nil {
+			t.Fatalf("%T: %v", idx, err)
+		}
+		want, err := idx.EstimateUtxoProof(utxos[:2], unspent[:2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if est.Leaves[1].Exists || est.ProofHashes != want.ProofHashes ||
+			est.SerializedBytes != want.SerializedBytes {
+
+			t.Fatalf("%T: expected the unknown utxo to be left out, "+
+				"got %+v, want %+v", idx, est, want)
+		}
+	}
+}
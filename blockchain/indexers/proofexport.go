@@ -0,0 +1,484 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// proofExportVersion is the version of the proof export streams that
+	// are written.  It's the only version that's able to be imported.
+	proofExportVersion = 1
+
+	// maxProofExportRecordSize is the largest record of a proof export
+	// stream that's read.  It has room for a proof and an undo block of
+	// the largest size that a replication record takes.
+	maxProofExportRecordSize = 2*wire.MaxMessagePayload + 64
+)
+
+var (
+	// proofExportMagic are the bytes that every proof export stream
+	// starts with.
+	proofExportMagic = [4]byte{'u', 't', 'x', 'p'}
+
+	// ErrUnknownProofExportVersion is returned by ImportProofs for a
+	// stream of a version that it doesn't understand.
+	ErrUnknownProofExportVersion = errors.New("unknown utreexo proof " +
+		"export version")
+)
+
+// -----------------------------------------------------------------------------
+// A proof export stream is a header:
+//
+//   Field         Type             Size
+//   magic         [4]byte          4
+//   version       uint32           4
+//
+// followed by a record for every exported block in height order:
+//
+//   Field         Type             Size
+//   size          uint32           4
+//   height        uint32           4
+//   hash          chainhash        32
+//   proof         []byte           varint + variable
+//   undo          []byte           varint + variable
+//
+// The size is of the rest of the record.  The proof is the utreexo proof as
+// it's stored by the flat utreexo proof index and the undo is the undo block
+// tagged with its accumulator serialization version, the same as in a
+// replication record.
+// -----------------------------------------------------------------------------
+
+// proofExportRecord is the proof and the undo block of a block in a proof
+// export stream.
+type proofExportRecord struct {
+	height int32
+	hash   chainhash.Hash
+	proof  []byte
+	undo   []byte
+}
+
+// serialize writes the record to w.
+func (rec *proofExportRecord) serialize(w io.Writer) error {
+	var buf bytes.Buffer
+	var header [4 + chainhash.HashSize]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(rec.height))
+	copy(header[4:], rec.hash[:])
+	buf.Write(header[:])
+	err := wire.WriteVarBytes(&buf, 0, rec.proof)
+	if err != nil {
+		return err
+	}
+	err = wire.WriteVarBytes(&buf, 0, rec.undo)
+	if err != nil {
+		return err
+	}
+
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(buf.Len()))
+	_, err = w.Write(size[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// deserialize reads a record from r.  io.EOF is returned if r ends before the
+// record starts.
+func (rec *proofExportRecord) deserialize(r io.Reader) error {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:1])
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r, size[1:])
+	if err != nil {
+		return err
+	}
+	recSize := binary.LittleEndian.Uint32(size[:])
+	if recSize > maxProofExportRecordSize {
+		return errDeserialize(fmt.Sprintf("proof export record of %d "+
+			"bytes is too large", recSize))
+	}
+	buf := make([]byte, recSize)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return err
+	}
+
+	br := bytes.NewReader(buf)
+	var header [4 + chainhash.HashSize]byte
+	_, err = io.ReadFull(br, header[:])
+	if err != nil {
+		return err
+	}
+	*rec = proofExportRecord{
+		height: int32(binary.LittleEndian.Uint32(header[:4])),
+	}
+	copy(rec.hash[:], header[4:])
+	rec.proof, err = wire.ReadVarBytes(br, 0, wire.MaxMessagePayload,
+		"exported proof")
+	if err != nil {
+		return err
+	}
+	rec.undo, err = wire.ReadVarBytes(br, 0, wire.MaxMessagePayload,
+		"exported undo")
+	if err != nil {
+		return err
+	}
+	if br.Len() != 0 {
+		return errDeserialize(fmt.Sprintf("proof export record for "+
+			"height %d has %d trailing bytes", rec.height, br.Len()))
+	}
+
+	return nil
+}
+
+// writeProofExportHeader writes the header of a proof export stream to w.
+func writeProofExportHeader(w io.Writer) error {
+	var header [8]byte
+	copy(header[:4], proofExportMagic[:])
+	binary.LittleEndian.PutUint32(header[4:], proofExportVersion)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// readProofExportHeader reads the header of a proof export stream from r.  An
+// error is returned if r isn't a proof export stream or if it's of a version
+// that isn't understood.
+func readProofExportHeader(r io.Reader) error {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], proofExportMagic[:]) {
+		return fmt.Errorf("not a utreexo proof export. Expected the "+
+			"magic bytes %x but got %x", proofExportMagic, header[:4])
+	}
+	version := binary.LittleEndian.Uint32(header[4:])
+	if version != proofExportVersion {
+		return fmt.Errorf("%w %d. Only version %d is supported",
+			ErrUnknownProofExportVersion, version, proofExportVersion)
+	}
+
+	return nil
+}
+
+// proofExportRecord returns the export record of the block that's committed to
+// the index at the given height.
+func (idx *FlatUtreexoProofIndex) proofExportRecord(height int32) (
+	*proofExportRecord, error) {
+
+	hash, err := idx.chain.BlockHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	tip := idx.proofState.BestHeight()
+	if height > tip {
+		return nil, fmt.Errorf("height %d is not committed to the index "+
+			"at tip height %d", height, tip)
+	}
+	proof, err := idx.proofState.FetchData(height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Undo blocks stored by an older accumulator serialization version
+	// are exported re-encoded.
+	undoBlock, err := idx.fetchUndoBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	undo, err := serializeUndoBlock(undoBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proofExportRecord{
+		height: height,
+		hash:   *hash,
+		proof:  proof,
+		undo:   undo,
+	}, nil
+}
+
+// ExportProofs writes the proofs and the undo blocks of the blocks from the
+// start height to the end height inclusive to w as a proof export stream that
+// ImportProofs on another node is able to connect the same blocks with.
+// Exporting is only supported when proofs are generated for every block.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) ExportProofs(w io.Writer, startHeight,
+	endHeight int32) error {
+
+	if err := idx.gate.check(); err != nil {
+		return err
+	}
+	if idx.proofGenInterVal != 1 {
+		return fmt.Errorf("exporting proofs needs proofs for every "+
+			"block but they're generated every %d blocks",
+			idx.proofGenInterVal)
+	}
+	if idx.chain == nil {
+		return fmt.Errorf("the chain of the index isn't set")
+	}
+	tip := idx.proofState.BestHeight()
+	if startHeight <= 0 || startHeight > endHeight || endHeight > tip {
+		return fmt.Errorf("heights %d to %d are not between 1 and the "+
+			"tip height of %d", startHeight, endHeight, tip)
+	}
+
+	err := writeProofExportHeader(w)
+	if err != nil {
+		return err
+	}
+	for height := startHeight; height <= endHeight; height++ {
+		rec, err := idx.proofExportRecord(height)
+		if err != nil {
+			return err
+		}
+		err = rec.serialize(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importProofRecord connects the block of the record to the index with the
+// exported proof and undo block.  The record must be for the block of the local
+// main chain right after the ones committed to the index, its proof must verify
+// against the accumulator, and connecting the block must make the same undo
+// block as the exported one.
+func (idx *FlatUtreexoProofIndex) importProofRecord(rec *proofExportRecord) error {
+	block, err := idx.chain.BlockByHeight(rec.height)
+	if err != nil {
+		return fmt.Errorf("unable to import the proof for height %d: %v",
+			rec.height, err)
+	}
+	hash := block.Hash()
+	if *hash != rec.hash {
+		return fmt.Errorf("the proof for height %d is for block %v but "+
+			"the main chain has block %v there", rec.height,
+			rec.hash, hash)
+	}
+
+	ud := new(wire.UData)
+	err = ud.DeserializeCompact(bytes.NewReader(rec.proof),
+		udataSerializeBool, 0)
+	if err != nil {
+		return err
+	}
+	delHashes, err := blockchain.ReconstructUData(ud, block,
+		idx.chain.BlockHashByHeight, idx.chainParams.LeafCommitments,
+		idx.leafHasher)
+	if err != nil {
+		return err
+	}
+	exportedUndo, err := untagAccPayload("undo block", rec.undo)
+	if err != nil {
+		return err
+	}
+
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	if tip := idx.committedHeight(); rec.height != tip+1 {
+		return fmt.Errorf("the proof for height %d doesn't follow the "+
+			"index at height %d", rec.height, tip)
+	}
+
+	idx.mtx.RLock()
+	err = idx.utreexoState.state.VerifyBatchProof(delHashes, ud.AccProof)
+	idx.mtx.RUnlock()
+	if err != nil {
+		return fmt.Errorf("the proof for block %v at height %d doesn't "+
+			"verify: %v", hash, rec.height, err)
+	}
+
+	return idx.connectShipped(block, ud, rec.proof,
+		func(undoBlock *accumulator.UndoBlock) error {
+			same, err := sameUndoBlock(undoBlock, exportedUndo)
+			if err != nil {
+				return err
+			}
+			if !same {
+				return fmt.Errorf("the undo block for height %d "+
+					"differs from the exported one",
+					rec.height)
+			}
+			return nil
+		})
+}
+
+// ImportProofs connects the blocks of the proof export stream read from r to
+// the index with the proofs and the undo blocks in it rather than generating
+// them.  The stream must start at the block after the ones committed to the
+// index and every record must be for the block at its height in the local main
+// chain.  The utreexo state is flushed once r ends or a record is refused, with
+// the blocks before that record kept.
+//
+// The index must not be maintained by an index manager while the proofs are
+// imported to it.  Manager.ImportFlatProofs moves the index tip along with
+// the imported blocks.
+func (idx *FlatUtreexoProofIndex) ImportProofs(r io.Reader) error {
+	if err := idx.gate.check(); err != nil {
+		return err
+	}
+	if idx.proofGenInterVal != 1 {
+		return fmt.Errorf("importing proofs needs proofs for every "+
+			"block but they're generated every %d blocks",
+			idx.proofGenInterVal)
+	}
+	if idx.chain == nil {
+		return fmt.Errorf("the chain of the index isn't set")
+	}
+	err := readProofExportHeader(r)
+	if err != nil {
+		return err
+	}
+
+	start := idx.committedHeight()
+	var importErr error
+	for {
+		rec := new(proofExportRecord)
+		err := rec.deserialize(r)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = idx.importProofRecord(rec)
+		}
+		if err != nil {
+			importErr = err
+			break
+		}
+	}
+
+	tip := idx.committedHeight()
+	if tip == start {
+		return importErr
+	}
+	err = idx.syncRecovered(tip)
+	if err != nil {
+		return err
+	}
+	err = idx.FlushUtreexoState()
+	if err != nil {
+		return err
+	}
+	log.Infof("Imported the proofs of heights %d to %d to the %s",
+		start+1, tip, idx.Name())
+
+	return importErr
+}
+
+// ImportFlatProofs imports the proof export stream read from r to the flat
+// utreexo proof index with its ImportProofs and moves the index tip to the last
+// imported block so that the index is caught up from there.  It must be called
+// before Init with the chain that Init is going to be called with.
+func (m *Manager) ImportFlatProofs(chain *blockchain.BlockChain,
+	r io.Reader) error {
+
+	_, flatIdx := m.utreexoProofIndexes()
+	if flatIdx == nil {
+		return fmt.Errorf("the %s isn't enabled",
+			flatUtreexoProofIndexName)
+	}
+	m.chain = chain
+	flatIdx.SetChain(chain)
+
+	// Make the flat files line up with the index tip first as a crash may
+	// have left them apart.
+	fetchTip := func() (int32, error) {
+		tip := int32(-1)
+		err := m.db.View(func(dbTx database.Tx) error {
+			indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+			if indexesBucket == nil ||
+				indexesBucket.Get(flatIdx.Key()) == nil {
+
+				return nil
+			}
+			var err error
+			_, tip, err = dbFetchIndexerTip(dbTx, flatIdx.Key())
+			return err
+		})
+		return tip, err
+	}
+	tip, err := fetchTip()
+	if err != nil {
+		return err
+	}
+	if tip > 0 {
+		err = m.resumeFlatIndex()
+		if err != nil {
+			return err
+		}
+		tip, err = fetchTip()
+		if err != nil {
+			return err
+		}
+	}
+	if tip < 0 {
+		tip = 0
+	}
+	if committed := flatIdx.committedHeight(); committed != tip {
+		return fmt.Errorf("the %s has the entries up to height %d but "+
+			"its tip is at height %d.  Drop the index with "+
+			"--dropflatutreexoproofindex to import the proofs from "+
+			"the start", flatIdx.Name(), committed, tip)
+	}
+
+	importErr := flatIdx.ImportProofs(r)
+	height := flatIdx.committedHeight()
+	if height == tip {
+		return importErr
+	}
+	hash, err := chain.BlockHashByHeight(height)
+	if err != nil {
+		return err
+	}
+	err = m.db.Update(func(dbTx database.Tx) error {
+		indexesBucket, err := dbTx.Metadata().CreateBucketIfNotExists(
+			indexTipsBucketName)
+		if err != nil {
+			return err
+		}
+
+		// Create the index the same as the index manager would so that
+		// it's resumed from the tip instead of being created again.
+		if indexesBucket.Get(flatIdx.Key()) == nil {
+			err = flatIdx.Create(dbTx)
+			if err != nil {
+				return err
+			}
+		}
+
+		return dbPutIndexerTip(dbTx, flatIdx.Key(), hash, height)
+	})
+	if err != nil {
+		return err
+	}
+
+	return importErr
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// importTestIndex returns a new empty flat utreexo proof index in the given
+// directory that takes its blocks from the chain.
+func importTestIndex(t *testing.T, dir string, chain *blockchain.BlockChain,
+	params *chaincfg.Params) *FlatUtreexoProofIndex {
+
+	proofGenInterval := int32(1)
+	idx, err := NewFlatUtreexoProofIndex(dir, params, &proofGenInterval, 0,
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.SetChain(chain)
+
+	return idx
+}
+
+// TestExportImportProofs ensures that the proofs exported from a flat utreexo
+// proof index connect the same blocks to an empty one with the same entries and
+// accumulator, and that streams that don't line up with the local chain or the
+// index, or that are of an unknown version, are refused.
+func TestExportImportProofs(t *testing.T) {
+	defer os.RemoveAll(testDbRoot)
+
+	source := rand.NewSource(time.Now().UnixNano())
+	rand := rand.New(source)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestExportImportProofs", 1)
+	defer tearDown()
+	srcIdx := indexes[1].(*FlatUtreexoProofIndex)
+
+	// Create the same 101 block chain as TestUtreexoProofIndex.
+	tip, spends := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	var allSpends []*blockchain.SpendableOut
+	for b := 0; b < 100; b++ {
+		var newSpends []*blockchain.SpendableOut
+		tip, newSpends = blockchain.AddBlock(chain, tip, spends)
+		allSpends = append(allSpends, newSpends...)
+
+		spends = nil
+		for i := 0; i < len(allSpends); i++ {
+			randIdx := rand.Intn(len(allSpends))
+			spends = append(spends, allSpends[randIdx])
+			allSpends = append(allSpends[:randIdx],
+				allSpends[randIdx+1:]...)
+		}
+	}
+	tipHeight := tip.Height()
+
+	// Export the proofs in two streams so that the second one is imported
+	// on top of the first.
+	var first, second bytes.Buffer
+	err := srcIdx.ExportProofs(&first, 1, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srcIdx.ExportProofs(&second, 51, tipHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstBytes := append([]byte(nil), first.Bytes()...)
+
+	// Nothing past the tip is exported.
+	err = srcIdx.ExportProofs(&bytes.Buffer{}, 1, tipHeight+1)
+	if err == nil {
+		t.Fatal("expected an error exporting past the tip")
+	}
+
+	dir := filepath.Join(testDbRoot, "TestExportImportProofs-import")
+	dstIdx := importTestIndex(t, dir, chain, params)
+	err = dstIdx.ImportProofs(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dstIdx.committedHeight(); got != 50 {
+		t.Fatalf("imported up to height %d, want 50", got)
+	}
+
+	// The first stream doesn't follow the index anymore.
+	err = dstIdx.ImportProofs(bytes.NewReader(firstBytes))
+	if err == nil || !strings.Contains(err.Error(), "doesn't follow") {
+		t.Fatalf("got error %v importing the first stream again", err)
+	}
+
+	err = dstIdx.ImportProofs(&second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dstIdx.committedHeight(); got != tipHeight {
+		t.Fatalf("imported up to height %d, want %d", got, tipHeight)
+	}
+	err = compareUtreexoIdx(1, tipHeight+1, chain,
+		[]Indexer{srcIdx, dstIdx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(srcIdx.utreexoState.state.GetRoots(),
+		dstIdx.utreexoState.state.GetRoots()) {
+
+		t.Fatal("the roots of the imported index differ")
+	}
+
+	tests := []struct {
+		name string
+
+		// stream returns the stream to import to an empty index.
+		stream func() []byte
+
+		// errIs is the error that's returned if it's known.  errText
+		// is in the error otherwise.
+		errIs   error
+		errText string
+
+		// imported is the height that the blocks before the refused
+		// record were imported up to.
+		imported int32
+	}{
+		{
+			name: "unknown version",
+			stream: func() []byte {
+				stream := append([]byte(nil), firstBytes...)
+				stream[4]++
+				return stream
+			},
+			errIs: ErrUnknownProofExportVersion,
+		},
+		{
+			name: "wrong magic",
+			stream: func() []byte {
+				stream := append([]byte(nil), firstBytes...)
+				stream[0] ^= 0xff
+				return stream
+			},
+			errText: "not a utreexo proof export",
+		},
+		{
+			name: "block not in the local chain",
+			stream: func() []byte {
+				rec, err := srcIdx.proofExportRecord(1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec.hash = chainhash.Hash{0x01}
+				return exportStream(t, rec)
+			},
+			errText: "the main chain has block",
+		},
+		{
+			name: "undo block of another block",
+			stream: func() []byte {
+				rec, err := srcIdx.proofExportRecord(1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				other, err := srcIdx.proofExportRecord(2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec.undo = other.undo
+				return exportStream(t, rec)
+			},
+			errText: "differs from the exported one",
+		},
+		{
+			name: "truncated record",
+			stream: func() []byte {
+				return firstBytes[:len(firstBytes)-1]
+			},
+			errIs:    io.ErrUnexpectedEOF,
+			imported: 49,
+		},
+	}
+
+	for _, test := range tests {
+		idx := importTestIndex(t, filepath.Join(dir, test.name), chain,
+			params)
+		err := idx.ImportProofs(bytes.NewReader(test.stream()))
+		switch {
+		case err == nil:
+			t.Fatalf("%s: expected an error", test.name)
+
+		case test.errIs != nil && !errors.Is(err, test.errIs):
+			t.Fatalf("%s: got error %v, want %v", test.name, err,
+				test.errIs)
+
+		case test.errText != "" && !strings.Contains(err.Error(),
+			test.errText):
+
+			t.Fatalf("%s: got error %v, want one with %q",
+				test.name, err, test.errText)
+		}
+		if got := idx.committedHeight(); got != test.imported {
+			t.Fatalf("%s: imported up to height %d, want %d",
+				test.name, got, test.imported)
+		}
+	}
+
+	// The index manager moves the index tip along with the imported blocks
+	// so that it's resumed from there.
+	db, _, err := createDB("TestExportImportProofs-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mgrIdx := importTestIndex(t, filepath.Join(dir, "manager"), chain,
+		params)
+	m := NewManager(db, []Indexer{mgrIdx})
+	err = m.ImportFlatProofs(chain, bytes.NewReader(firstBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(dbTx database.Tx) error {
+		hash, height, err := dbFetchIndexerTip(dbTx, mgrIdx.Key())
+		if err != nil {
+			return err
+		}
+		wantHash, err := chain.BlockHashByHeight(50)
+		if err != nil {
+			return err
+		}
+		if height != 50 || *hash != *wantHash {
+			t.Fatalf("got the index tip at height %d (%v), want "+
+				"height 50 (%v)", height, hash, wantHash)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mgrIdx.Stats().Total.Blocks; got != uint64(tipHeight-50) {
+		t.Fatalf("connected %d blocks after the import, want %d", got,
+			tipHeight-50)
+	}
+	err = compareUtreexoIdx(1, tipHeight+1, chain,
+		[]Indexer{srcIdx, mgrIdx})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exportStream returns a proof export stream of the given records.
+func exportStream(t *testing.T, recs ...*proofExportRecord) []byte {
+	var buf bytes.Buffer
+	err := writeProofExportHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		err = rec.serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,450 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// defaultProofGenMaxWait is the default duration a proof generation
+	// request will wait for the budget to free up before being rejected.
+	defaultProofGenMaxWait = time.Second * 5
+
+	// proofTargetSize is the in-memory size of a single target in the
+	// accumulator proof.
+	proofTargetSize = 8
+)
+
+var (
+	// ErrProofGenBudgetExceeded is returned when a proof generation request
+	// could not be admitted as the memory used by the in-flight proof
+	// generation requests would exceed the budget.
+	ErrProofGenBudgetExceeded = errors.New("proof generation memory budget exceeded")
+)
+
+// ProofLane is the priority lane a proof request is admitted through.
+type ProofLane uint8
+
+const (
+	// ProofLaneBulk is the lane for requests that may be deferred such
+	// as historical block proofs, mempool tx proofs, and RPC requests.
+	ProofLaneBulk ProofLane = iota
+
+	// ProofLaneRelay is the lane for attaching proofs to blocks that are
+	// being relayed at the tip.  Requests in this lane are never queued
+	// behind the bulk lane.
+	ProofLaneRelay
+)
+
+// String returns the ProofLane in human-readable form.
+func (l ProofLane) String() string {
+	switch l {
+	case ProofLaneBulk:
+		return "bulk"
+	case ProofLaneRelay:
+		return "relay"
+	default:
+		return fmt.Sprintf("unknown ProofLane (%d)", uint8(l))
+	}
+}
+
+// ProofDeferredError is returned when a bulk request couldn't be admitted in
+// time because the budget was full.  The caller should retry the request later.
+type ProofDeferredError struct {
+	// RetryAfter is the suggested duration to wait before retrying.
+	RetryAfter time.Duration
+}
+
+// Error returns the error as a human-readable string.
+func (e *ProofDeferredError) Error() string {
+	return fmt.Sprintf("%v: request deferred, retry after %v",
+		ErrProofGenBudgetExceeded, e.RetryAfter)
+}
+
+// Is returns true for ErrProofGenBudgetExceeded so that callers may check for a
+// budget rejection regardless of the reason.
+func (e *ProofDeferredError) Is(target error) bool {
+	return target == ErrProofGenBudgetExceeded
+}
+
+// ProofSizeError is returned when a single bulk request is bigger than what a
+// single call is allowed to use.  The caller should split the request.
+type ProofSizeError struct {
+	// Size is the estimated size of the request.
+	Size uint64
+
+	// MaxSize is the maximum size allowed for a single call.
+	MaxSize uint64
+}
+
+// Error returns the error as a human-readable string.
+func (e *ProofSizeError) Error() string {
+	return fmt.Sprintf("%v: request of %d bytes is over the per-call "+
+		"maximum of %d bytes, split the request into smaller ones",
+		ErrProofGenBudgetExceeded, e.Size, e.MaxSize)
+}
+
+// Is returns true for ErrProofGenBudgetExceeded so that callers may check for a
+// budget rejection regardless of the reason.
+func (e *ProofSizeError) Is(target error) bool {
+	return target == ErrProofGenBudgetExceeded
+}
+
+// EstimateProofSize returns an upper bound of the memory needed to generate a
+// utreexo proof for the given leaf datas in an accumulator that has the given
+// amount of rows.  The estimate assumes that no proof hashes are shared between
+// the leaves which is the worst case.
+func EstimateProofSize(dels []wire.LeafData, forestRows uint8) uint64 {
+	var leafDataSize uint64
+	var proven int
+	for i := range dels {
+		// The leaf data will be included in the proof.
+		leafDataSize += uint64(dels[i].SerializeSize())
+
+		// Unconfirmed leaves aren't proven.
+		if dels[i].IsUnconfirmed() {
+			continue
+		}
+		proven++
+	}
+
+	return proofSize(leafDataSize, proven, forestRows)
+}
+
+// EstimateBlockProofSize returns the same bound as EstimateProofSize for the
+// leaves that the stxos of a block are turned into with the given inskip.  It's
+// computed from the stxos alone, so the leaf datas are counted exactly before
+// they're made regardless of how large the witnesses of the spending
+// transactions are.
+func EstimateBlockProofSize(stxos []blockchain.SpentTxOut, inskip []uint32,
+	forestRows uint8) uint64 {
+
+	count, leafDataSize := blockchain.DelLeavesSize(stxos, inskip, -1)
+	return proofSize(uint64(leafDataSize), count, forestRows)
+}
+
+// proofSize returns the size of a proof with the given size of leaf datas and
+// number of proven leaves in an accumulator that has the given amount of rows.
+// Each proven leaf needs a target and at most a hash per row.
+func proofSize(leafDataSize uint64, proven int, forestRows uint8) uint64 {
+	perLeaf := uint64(proofTargetSize) +
+		uint64(forestRows)*chainhash.HashSize
+	return leafDataSize + uint64(proven)*perLeaf
+}
+
+// EstimateChainTipProofSize returns an upper bound of the memory needed to
+// prove the given amount of leaf hashes in an accumulator that has the given
+// amount of rows.
+func EstimateChainTipProofSize(numHashes int, forestRows uint8) uint64 {
+	perHash := uint64(proofTargetSize) + chainhash.HashSize +
+		uint64(forestRows)*chainhash.HashSize
+	return uint64(numHashes) * perHash
+}
+
+// ProofGenBudgetStats are the statistics for the proof generation budget.
+type ProofGenBudgetStats struct {
+	// MaxBytes is the maximum amount of bytes that are allowed to be used
+	// by in-flight proof generation requests.
+	MaxBytes uint64
+
+	// MaxCallBytes is the maximum amount of bytes a single bulk request is
+	// allowed to use.  0 means that a single request may use the entire
+	// budget.
+	MaxCallBytes uint64
+
+	// InFlightBytes is the estimated amount of bytes currently used by
+	// the in-flight proof generation requests.
+	InFlightBytes uint64
+
+	// InFlightRequests is the amount of currently in-flight proof
+	// generation requests.
+	InFlightRequests uint64
+
+	// Admitted is the total count of admitted requests.
+	Admitted uint64
+
+	// Queued is the total count of requests that had to wait for the
+	// budget to free up before being admitted or rejected.
+	Queued uint64
+
+	// RelayAdmitted is the total count of requests admitted through the
+	// relay lane.  These are included in Admitted.
+	RelayAdmitted uint64
+
+	// Rejected is the total count of requests rejected for being too big.
+	Rejected uint64
+
+	// Deferred is the total count of requests that were rejected because
+	// the budget didn't free up in time.
+	Deferred uint64
+}
+
+// ProofGenBudget is a memory budget for in-flight proof generation and serving.
+// Requests in the bulk lane are admitted only while the estimated memory used
+// by all the admitted requests stays under the budget.  Bulk requests that
+// don't fit are queued for up to maxWait before being deferred.  Requests in
+// the relay lane are always admitted right away but their memory is still
+// accounted for so that the bulk lane backs off.
+//
+// A single ProofGenBudget may be shared between multiple indexes and the
+// RPC and p2p serving paths to enforce a global budget.
+type ProofGenBudget struct {
+	// maxWait is the maximum duration a request will be queued for.
+	maxWait time.Duration
+
+	// mtx protects all the fields below.
+	mtx sync.Mutex
+
+	// freed is closed and replaced every time memory is released.  Queued
+	// requests wait on it to re-check the budget.
+	freed chan struct{}
+
+	// mem is the handle the bulk lane requests are also reserved through
+	// when the budget is registered with a memory accountant.
+	mem *MemHandle
+
+	stats ProofGenBudgetStats
+}
+
+// NewProofGenBudget returns a new ProofGenBudget that allows maxBytes to be
+// used by the in-flight proof generation requests.  A maxWait of 0 will use
+// the default wait duration.
+func NewProofGenBudget(maxBytes uint64, maxWait time.Duration) *ProofGenBudget {
+	if maxWait == 0 {
+		maxWait = defaultProofGenMaxWait
+	}
+
+	return &ProofGenBudget{
+		maxWait: maxWait,
+		freed:   make(chan struct{}),
+		stats:   ProofGenBudgetStats{MaxBytes: maxBytes},
+	}
+}
+
+// SetMaxCallBytes sets the maximum amount of bytes a single bulk request is
+// allowed to use.  0 means that a single request may use the entire budget.
+//
+// This function is safe for concurrent access.
+func (b *ProofGenBudget) SetMaxCallBytes(maxCallBytes uint64) {
+	b.mtx.Lock()
+	b.stats.MaxCallBytes = maxCallBytes
+	b.mtx.Unlock()
+}
+
+// SetMemAccountant registers the budget with the memory accountant so that the
+// bulk lane requests also count towards the cap of the accountant.  The relay
+// lane requests are always admitted and so they aren't reserved with the
+// accountant.
+//
+// This function is safe for concurrent access.
+func (b *ProofGenBudget) SetMemAccountant(a *MemAccountant) {
+	mem := a.Register("proof generation", MemClassPinned, 0, nil)
+
+	b.mtx.Lock()
+	b.mem = mem
+	b.mtx.Unlock()
+}
+
+// Acquire admits a bulk lane request that is estimated to use size bytes.
+//
+// This function is safe for concurrent access.
+func (b *ProofGenBudget) Acquire(size uint64) error {
+	return b.AcquireLane(ProofLaneBulk, size)
+}
+
+// AcquireLane admits a request that is estimated to use size bytes through the
+// given lane.
+//
+// Relay lane requests are always admitted.  For bulk lane requests, if the
+// budget doesn't have enough room, AcquireLane blocks until enough memory is
+// released or until the max wait duration has passed, in which case a
+// ProofDeferredError is returned.  Bulk requests that could never be admitted
+// return ErrProofGenBudgetExceeded or a ProofSizeError right away.
+//
+// The caller must call Release with the same size once the request is done.
+//
+// This function is safe for concurrent access.
+func (b *ProofGenBudget) AcquireLane(lane ProofLane, size uint64) error {
+	b.mtx.Lock()
+
+	if lane == ProofLaneRelay {
+		b.stats.RelayAdmitted++
+		b.admit(size)
+		b.mtx.Unlock()
+		return nil
+	}
+
+	// A request bigger than the entire budget will never be admitted.
+	if size > b.stats.MaxBytes {
+		b.stats.Rejected++
+		b.mtx.Unlock()
+		return ErrProofGenBudgetExceeded
+	}
+
+	if b.stats.MaxCallBytes > 0 && size > b.stats.MaxCallBytes {
+		err := &ProofSizeError{Size: size, MaxSize: b.stats.MaxCallBytes}
+		b.stats.Rejected++
+		b.mtx.Unlock()
+		return err
+	}
+
+	var timer *time.Timer
+	for b.stats.InFlightBytes+size > b.stats.MaxBytes {
+		if timer == nil {
+			b.stats.Queued++
+			timer = time.NewTimer(b.maxWait)
+			defer timer.Stop()
+		}
+
+		freed := b.freed
+		b.mtx.Unlock()
+
+		select {
+		case <-freed:
+		case <-timer.C:
+			b.mtx.Lock()
+			b.stats.Deferred++
+			b.mtx.Unlock()
+			return &ProofDeferredError{RetryAfter: b.maxWait}
+		}
+
+		b.mtx.Lock()
+	}
+
+	// The memory accountant may be at its cap even though the budget
+	// has room.  Nothing that's queued on the budget would make room in
+	// the accountant so defer the request right away.
+	if err := b.mem.Reserve(size); err != nil {
+		b.stats.Deferred++
+		b.mtx.Unlock()
+		return &ProofDeferredError{RetryAfter: b.maxWait}
+	}
+
+	b.admit(size)
+	b.mtx.Unlock()
+
+	return nil
+}
+
+// admit accounts for an admitted request of the given size.
+//
+// This function MUST be called with the mutex held.
+func (b *ProofGenBudget) admit(size uint64) {
+	b.stats.InFlightBytes += size
+	b.stats.InFlightRequests++
+	b.stats.Admitted++
+}
+
+// Release returns size bytes of a bulk lane request back to the budget and
+// wakes up any queued requests.
+//
+// This function is safe for concurrent access.
+func (b *ProofGenBudget) Release(size uint64) {
+	b.ReleaseLane(ProofLaneBulk, size)
+}
+
+// ReleaseLane returns size bytes of a request admitted through the given lane
+// back to the budget and wakes up any queued requests.
+//
+// This function is safe for concurrent access.
+func (b *ProofGenBudget) ReleaseLane(lane ProofLane, size uint64) {
+	b.mtx.Lock()
+	if lane == ProofLaneBulk {
+		b.mem.Release(size)
+	}
+	if size > b.stats.InFlightBytes {
+		size = b.stats.InFlightBytes
+	}
+	b.stats.InFlightBytes -= size
+	if b.stats.InFlightRequests > 0 {
+		b.stats.InFlightRequests--
+	}
+
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mtx.Unlock()
+}
+
+// Stats returns a snapshot of the current proof generation budget statistics.
+//
+// This function is safe for concurrent access.
+func (b *ProofGenBudget) Stats() ProofGenBudgetStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.stats
+}
+
+// generateBudgetedUData generates the utreexo data for the passed in dels from
+// the given utreexo state.  If a budget is given, the request is admitted into
+// the budget before the proof is generated.
+//
+// The passed in mutex is the one that protects the utreexo state.
+func generateBudgetedUData(budget *ProofGenBudget, mtx *sync.RWMutex,
+	uState *UtreexoState, dels []wire.LeafData) (*wire.UData, error) {
+
+	var size uint64
+	if budget != nil {
+		mtx.RLock()
+		_, rows, err := uState.stats()
+		mtx.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+
+		size = EstimateProofSize(dels, rows)
+		err = budget.Acquire(size)
+		if err != nil {
+			return nil, err
+		}
+		defer budget.Release(size)
+	}
+
+	mtx.RLock()
+	ud, err := wire.GenerateUData(dels, uState.state, uState.config.Params.LeafCommitments)
+	mtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return ud, nil
+}
+
+// acquireProveBudget admits a bulk lane request to prove the given amount of
+// leaf hashes into the budget.  The returned function releases the request
+// from the budget and must be called once the proof is no longer needed.  A
+// nil budget admits every request.
+//
+// The passed in mutex is the one that protects the utreexo state.
+func acquireProveBudget(budget *ProofGenBudget, mtx *sync.RWMutex,
+	uState *UtreexoState, numHashes int) (func(), error) {
+
+	if budget == nil {
+		return func() {}, nil
+	}
+
+	mtx.RLock()
+	_, rows, err := uState.stats()
+	mtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	size := EstimateChainTipProofSize(numHashes, rows)
+	err = budget.Acquire(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { budget.Release(size) }, nil
+}
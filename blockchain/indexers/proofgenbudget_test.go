@@ -0,0 +1,210 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+func TestEstimateProofSize(t *testing.T) {
+	confirmed := wire.LeafData{Height: 10, PkScript: []byte{0x51}}
+	unconfirmed := wire.LeafData{Height: -1, PkScript: []byte{0x51}}
+
+	dels := []wire.LeafData{confirmed, unconfirmed}
+	got := EstimateProofSize(dels, 20)
+
+	want := uint64(confirmed.SerializeSize()) + proofTargetSize +
+		20*chainhash.HashSize + uint64(unconfirmed.SerializeSize())
+	if got != want {
+		t.Fatalf("expected %d, got %d", want, got)
+	}
+
+	if size := EstimateProofSize(nil, 20); size != 0 {
+		t.Fatalf("expected 0 for no dels, got %d", size)
+	}
+}
+
+// TestEstimateBlockProofSize ensures that the proof size estimated from the
+// stxos of a block is the same as the one estimated from its leaves.
+func TestEstimateBlockProofSize(t *testing.T) {
+	taproot := append([]byte{0x51, 0x20}, make([]byte, 32)...)
+	multisig := append([]byte{0x00}, make([]byte, 3*34+2)...)
+	stxos := []blockchain.SpentTxOut{
+		{Height: 3, PkScript: taproot},
+		{Height: 4, PkScript: multisig},
+		{Height: 5, PkScript: taproot},
+		{Height: 6, PkScript: multisig},
+	}
+
+	// The second input of the block after the coinbase is skipped.
+	inskip := []uint32{2}
+	var dels []wire.LeafData
+	for i := range stxos {
+		if i == 1 {
+			continue
+		}
+		dels = append(dels, wire.LeafData{
+			Height:   stxos[i].Height,
+			PkScript: stxos[i].PkScript,
+		})
+	}
+
+	want := EstimateProofSize(dels, 20)
+	if got := EstimateBlockProofSize(stxos, inskip, 20); got != want {
+		t.Fatalf("expected %d, got %d", want, got)
+	}
+	if size := EstimateBlockProofSize(nil, nil, 20); size != 0 {
+		t.Fatalf("expected 0 for no stxos, got %d", size)
+	}
+}
+
+func TestProofGenBudget(t *testing.T) {
+	budget := NewProofGenBudget(100, 50*time.Millisecond)
+
+	// A request bigger than the entire budget is rejected right away.
+	if err := budget.Acquire(101); err != ErrProofGenBudgetExceeded {
+		t.Fatalf("expected %v, got %v", ErrProofGenBudgetExceeded, err)
+	}
+
+	// Fill up the budget.
+	if err := budget.Acquire(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := budget.Acquire(40); err != nil {
+		t.Fatal(err)
+	}
+
+	// The budget is full so the request times out and is deferred.
+	err := budget.Acquire(1)
+	if _, ok := err.(*ProofDeferredError); !ok {
+		t.Fatalf("expected ProofDeferredError, got %v", err)
+	}
+	if !errors.Is(err, ErrProofGenBudgetExceeded) {
+		t.Fatalf("expected %v to be %v", err, ErrProofGenBudgetExceeded)
+	}
+
+	// A queued request is admitted once enough memory is released.
+	errChan := make(chan error)
+	go func() {
+		errChan <- budget.Acquire(50)
+	}()
+	budget.Release(60)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	stats := budget.Stats()
+	want := ProofGenBudgetStats{
+		MaxBytes:         100,
+		InFlightBytes:    90,
+		InFlightRequests: 2,
+		Admitted:         3,
+		Rejected:         1,
+		Deferred:         1,
+	}
+	// Whether the last request got queued depends on goroutine scheduling.
+	stats.Queued = 0
+	if stats != want {
+		t.Fatalf("expected stats %+v, got %+v", want, stats)
+	}
+
+	budget.Release(40)
+	budget.Release(50)
+	stats = budget.Stats()
+	if stats.InFlightBytes != 0 || stats.InFlightRequests != 0 {
+		t.Fatalf("expected nothing in flight, got %+v", stats)
+	}
+}
+
+func TestProofGenBudgetMaxCallBytes(t *testing.T) {
+	budget := NewProofGenBudget(100, 50*time.Millisecond)
+	budget.SetMaxCallBytes(10)
+
+	err := budget.Acquire(11)
+	sizeErr, ok := err.(*ProofSizeError)
+	if !ok {
+		t.Fatalf("expected ProofSizeError, got %v", err)
+	}
+	if sizeErr.Size != 11 || sizeErr.MaxSize != 10 {
+		t.Fatalf("expected size 11 and max size 10, got %d and %d",
+			sizeErr.Size, sizeErr.MaxSize)
+	}
+
+	// The relay lane isn't bound by the per-call ceiling.
+	err = budget.AcquireLane(ProofLaneRelay, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget.Release(11)
+
+	stats := budget.Stats()
+	if stats.Rejected != 1 || stats.RelayAdmitted != 1 {
+		t.Fatalf("expected 1 rejected and 1 relay admitted, got %+v", stats)
+	}
+}
+
+// TestProofGenBudgetRelayLane ensures that relay lane requests are admitted
+// right away while the bulk lane is saturated and that the bulk lane backs off
+// while the relay lane is using the budget.
+func TestProofGenBudgetRelayLane(t *testing.T) {
+	budget := NewProofGenBudget(100, 200*time.Millisecond)
+
+	// Saturate the bulk lane and queue up more bulk requests.
+	err := budget.Acquire(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const queued = 10
+	errChan := make(chan error, queued)
+	for i := 0; i < queued; i++ {
+		go func() {
+			errChan <- budget.Acquire(50)
+		}()
+	}
+
+	// Relay requests shouldn't wait behind the queued bulk requests.
+	for i := 0; i < 100; i++ {
+		start := time.Now()
+		err := budget.AcquireLane(ProofLaneRelay, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+			t.Fatalf("relay request took %v", elapsed)
+		}
+		budget.Release(50)
+	}
+
+	// The queued bulk requests are deferred since the budget never had
+	// room for them.
+	for i := 0; i < queued; i++ {
+		err := <-errChan
+		deferErr, ok := err.(*ProofDeferredError)
+		if !ok {
+			t.Fatalf("expected ProofDeferredError, got %v", err)
+		}
+		if deferErr.RetryAfter <= 0 {
+			t.Fatalf("expected a retry hint, got %v", deferErr.RetryAfter)
+		}
+	}
+
+	stats := budget.Stats()
+	if stats.Deferred != queued {
+		t.Fatalf("expected %d deferred, got %d", queued, stats.Deferred)
+	}
+	if stats.RelayAdmitted != 100 {
+		t.Fatalf("expected 100 relay admitted, got %d", stats.RelayAdmitted)
+	}
+	if stats.InFlightBytes != 100 || stats.InFlightRequests != 1 {
+		t.Fatalf("expected only the first bulk request in flight, got %+v",
+			stats)
+	}
+}
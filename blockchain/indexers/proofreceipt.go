@@ -0,0 +1,365 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/utreexo/utreexod/btcec"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+const (
+	// ReceiptRequestIDSize is the size of the id of a request that utreexo
+	// proofs were served with receipts for.
+	ReceiptRequestIDSize = 16
+
+	// receiptSignatureHeader is prepended to the fields of a proof receipt
+	// before they're signed so that a receipt signature can't be passed off
+	// as the signature of anything else.
+	receiptSignatureHeader = "utreexod proof receipt:\n"
+
+	// receiptKeySize is the size of the key of a serve in the audit log.
+	// It's the timestamp, the request id, and the block hash.
+	receiptKeySize = 8 + ReceiptRequestIDSize + chainhash.HashSize
+
+	// receiptPruneInterval is how often the serves that are older than the
+	// retention are removed from the audit log.
+	receiptPruneInterval = time.Hour
+
+	// DefaultProofReceiptRetention is how long the serves that receipts
+	// were given for are kept in the audit log by default.
+	DefaultProofReceiptRetention = 90 * 24 * time.Hour
+)
+
+// proofReceiptsBucketKey is the key of the bucket that the serves that receipts
+// were given for are recorded in.
+var proofReceiptsBucketKey = []byte("proofreceipts")
+
+// ErrInvalidReceiptSignature is returned by VerifyReceipt when the signature of
+// a receipt wasn't made by the given key over the fields of the receipt.
+var ErrInvalidReceiptSignature = errors.New("receipt signature is invalid")
+
+// ReceiptRequestID is the id of a request that utreexo proofs were served with
+// receipts for.  Every receipt given for the proofs of one request has the
+// same id.
+type ReceiptRequestID [ReceiptRequestIDSize]byte
+
+// String returns the request id as a hex string.
+func (id ReceiptRequestID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// NewReceiptRequestID returns a random request id.
+func NewReceiptRequestID() (ReceiptRequestID, error) {
+	var id ReceiptRequestID
+	_, err := rand.Read(id[:])
+	return id, err
+}
+
+// ReceiptRequestIDFromStr returns the request id of the given hex string.
+func ReceiptRequestIDFromStr(s string) (ReceiptRequestID, error) {
+	var id ReceiptRequestID
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(decoded) != ReceiptRequestIDSize {
+		return id, fmt.Errorf("request id is %d bytes instead of %d",
+			len(decoded), ReceiptRequestIDSize)
+	}
+	copy(id[:], decoded)
+	return id, nil
+}
+
+// ReceiptUDataHash returns the hash of the serialized utreexo proof of a block
+// that's committed to by a receipt.
+func ReceiptUDataHash(serialized []byte) chainhash.Hash {
+	return chainhash.DoubleHashH(serialized)
+}
+
+// ProofReceipt is a signed statement by a bridge that it served the utreexo
+// proof with the given hash for the block with the given hash at the given
+// time in answer to the request with the given id.
+type ProofReceipt struct {
+	RequestID ReceiptRequestID
+	BlockHash chainhash.Hash
+	UDataHash chainhash.Hash
+
+	// Timestamp is when the proof was served with a precision of a second.
+	Timestamp time.Time
+
+	// Signature is the compact signature of the fields above by the
+	// attestation key of the bridge.
+	Signature []byte
+}
+
+// sigHash returns the hash of the fields of the receipt that's signed.
+func (r *ProofReceipt) sigHash() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(receiptSignatureHeader)
+	buf.Write(r.RequestID[:])
+	buf.Write(r.BlockHash[:])
+	buf.Write(r.UDataHash[:])
+	var timestamp [8]byte
+	binary.LittleEndian.PutUint64(timestamp[:], uint64(r.Timestamp.Unix()))
+	buf.Write(timestamp[:])
+
+	return chainhash.DoubleHashB(buf.Bytes())
+}
+
+// VerifyReceipt returns ErrInvalidReceiptSignature if the receipt wasn't signed
+// by the given public key.  It only needs the receipt and the key of the bridge
+// so that a wallet is able to verify a receipt offline.
+func VerifyReceipt(receipt *ProofReceipt, pubKey *btcec.PublicKey) error {
+	signer, _, err := btcec.RecoverCompact(btcec.S256(), receipt.Signature,
+		receipt.sigHash())
+	if err != nil || !signer.IsEqual(pubKey) {
+		return ErrInvalidReceiptSignature
+	}
+
+	return nil
+}
+
+// ReceiptStatus is the result of checking a presented receipt against the
+// audit log of the bridge.
+type ReceiptStatus int
+
+const (
+	// ReceiptConfirmed is a receipt that was signed by the bridge for a
+	// serve that's in its audit log.
+	ReceiptConfirmed ReceiptStatus = iota
+
+	// ReceiptInvalidSignature is a receipt that wasn't signed by the
+	// bridge.
+	ReceiptInvalidSignature
+
+	// ReceiptNotFound is a receipt that was signed by the bridge but whose
+	// serve isn't in its audit log, like once it's older than the
+	// retention.
+	ReceiptNotFound
+
+	// ReceiptMismatch is a receipt that was signed by the bridge for a
+	// serve that's in its audit log with another utreexo proof.
+	ReceiptMismatch
+)
+
+// receiptStatusStrings is a map of receipt statuses back to their constant
+// names for pretty printing.
+var receiptStatusStrings = map[ReceiptStatus]string{
+	ReceiptConfirmed:        "confirmed",
+	ReceiptInvalidSignature: "invalidsignature",
+	ReceiptNotFound:         "notfound",
+	ReceiptMismatch:         "mismatch",
+}
+
+// String returns the ReceiptStatus as a human-readable name.
+func (s ReceiptStatus) String() string {
+	if str, ok := receiptStatusStrings[s]; ok {
+		return str
+	}
+	return fmt.Sprintf("unknown receipt status (%d)", int(s))
+}
+
+// LoadAttestationKey returns the attestation key of the node that's kept
+// hex-encoded in the file at the given path.  A new key is generated and saved
+// to the file if it doesn't exist.
+func LoadAttestationKey(path string) (*btcec.PrivateKey, error) {
+	serialized, err := os.ReadFile(path)
+	if err == nil {
+		decoded, err := hex.DecodeString(strings.TrimSpace(string(serialized)))
+		if err != nil || len(decoded) != btcec.PrivKeyBytesLen {
+			return nil, fmt.Errorf("malformed attestation key in %s", path)
+		}
+		privKey, _ := btcec.PrivKeyFromBytes(btcec.S256(), decoded)
+		return privKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	encoded := hex.EncodeToString(privKey.Serialize()) + "\n"
+	err = os.WriteFile(path, []byte(encoded), 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Generated a new attestation key in %s", path)
+
+	return privKey, nil
+}
+
+// ProofReceipts signs the receipts of served utreexo proofs with the attestation
+// key of the node and keeps an audit log of the serves that they were signed
+// for so that a presented receipt can be confirmed or denied later.
+type ProofReceipts struct {
+	db        database.DB
+	key       *btcec.PrivateKey
+	retention time.Duration
+
+	mtx       sync.Mutex
+	lastPrune time.Time
+}
+
+// NewProofReceipts returns a ProofReceipts that signs receipts with the given
+// key and keeps the serves that they're signed for in the given database for
+// the given retention.
+func NewProofReceipts(db database.DB, key *btcec.PrivateKey,
+	retention time.Duration) *ProofReceipts {
+
+	if retention <= 0 {
+		retention = DefaultProofReceiptRetention
+	}
+
+	return &ProofReceipts{
+		db:        db,
+		key:       key,
+		retention: retention,
+	}
+}
+
+// PubKey returns the public key that receipts are signed with.
+func (r *ProofReceipts) PubKey() *btcec.PublicKey {
+	return r.key.PubKey()
+}
+
+// Sign returns the signed receipt of serving the given serialized utreexo proof
+// of the block with the given hash at the given time in answer to the request
+// with the given id.  The receipt isn't in the audit log until it's recorded.
+func (r *ProofReceipts) Sign(requestID ReceiptRequestID,
+	blockHash *chainhash.Hash, serialized []byte,
+	timestamp time.Time) (*ProofReceipt, error) {
+
+	receipt := &ProofReceipt{
+		RequestID: requestID,
+		BlockHash: *blockHash,
+		UDataHash: ReceiptUDataHash(serialized),
+		Timestamp: time.Unix(timestamp.Unix(), 0),
+	}
+	sig, err := btcec.SignCompact(btcec.S256(), r.key, receipt.sigHash(), true)
+	if err != nil {
+		return nil, err
+	}
+	receipt.Signature = sig
+
+	return receipt, nil
+}
+
+// receiptKey returns the key of the serve of the receipt in the audit log.  The
+// timestamp comes first so that the serves are ordered by age.
+func receiptKey(receipt *ProofReceipt) []byte {
+	key := make([]byte, receiptKeySize)
+	binary.BigEndian.PutUint64(key[0:8], uint64(receipt.Timestamp.Unix()))
+	copy(key[8:], receipt.RequestID[:])
+	copy(key[8+ReceiptRequestIDSize:], receipt.BlockHash[:])
+	return key
+}
+
+// Record adds the serves that the given receipts were signed for to the audit
+// log.  The serves older than the retention are removed at most once every
+// prune interval.
+func (r *ProofReceipts) Record(receipts []*ProofReceipt) error {
+	now := time.Now()
+	r.mtx.Lock()
+	prune := now.Sub(r.lastPrune) >= receiptPruneInterval
+	if prune {
+		r.lastPrune = now
+	}
+	r.mtx.Unlock()
+
+	return r.db.Update(func(dbTx database.Tx) error {
+		bucket, err := dbTx.Metadata().CreateBucketIfNotExists(
+			proofReceiptsBucketKey)
+		if err != nil {
+			return err
+		}
+		if prune {
+			err := pruneReceipts(bucket, now.Add(-r.retention))
+			if err != nil {
+				return err
+			}
+		}
+		for _, receipt := range receipts {
+			err := bucket.Put(receiptKey(receipt), receipt.UDataHash[:])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// pruneReceipts removes the serves from before the given cutoff from the
+// bucket of the audit log.
+func pruneReceipts(bucket database.Bucket, cutoff time.Time) error {
+	// Collect the expired serves before removing them since the bucket
+	// can't be changed while it's being iterated.
+	var expired [][]byte
+	cursor := bucket.Cursor()
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		key := cursor.Key()
+		if binary.BigEndian.Uint64(key[0:8]) >= uint64(cutoff.Unix()) {
+			break
+		}
+		expired = append(expired, append([]byte(nil), key...))
+	}
+	for _, key := range expired {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	if len(expired) > 0 {
+		log.Debugf("Pruned %d proof receipts from before %v",
+			len(expired), cutoff)
+	}
+
+	return nil
+}
+
+// Confirm checks the presented receipt against the audit log.  A receipt is
+// only confirmed if it was signed by the attestation key of the node and the
+// audit log has its serve with the same utreexo proof.
+func (r *ProofReceipts) Confirm(receipt *ProofReceipt) (ReceiptStatus, error) {
+	if err := VerifyReceipt(receipt, r.PubKey()); err != nil {
+		return ReceiptInvalidSignature, nil
+	}
+
+	status := ReceiptNotFound
+	err := r.db.View(func(dbTx database.Tx) error {
+		bucket := dbTx.Metadata().Bucket(proofReceiptsBucketKey)
+		if bucket == nil {
+			return nil
+		}
+		udataHash := bucket.Get(receiptKey(receipt))
+		switch {
+		case udataHash == nil:
+			status = ReceiptNotFound
+		case bytes.Equal(udataHash, receipt.UDataHash[:]):
+			status = ReceiptConfirmed
+		default:
+			status = ReceiptMismatch
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return status, nil
+}
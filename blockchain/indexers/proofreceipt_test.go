@@ -0,0 +1,262 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestLoadAttestationKey ensures that the attestation key is generated once and
+// loaded back from its file afterwards.
+func TestLoadAttestationKey(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "attestation.key")
+	key, err := LoadAttestationKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAttestationKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Serialize(), loaded.Serialize()) {
+		t.Fatal("loaded a different attestation key than was generated")
+	}
+}
+
+// TestProofReceipts ensures that the receipts of served utreexo proofs verify
+// offline against the attestation key, that changing any of their fields makes
+// them fail to, and that they're confirmed against the audit log only once
+// their serves are recorded.
+func TestProofReceipts(t *testing.T) {
+	t.Parallel()
+
+	chain, indexes, params, tearDown := indexersTestChain("TestProofReceipts", 1)
+	defer tearDown()
+
+	tip, spendables := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	for i := 0; i < 4; i++ {
+		tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+	}
+
+	idx := indexes[0].(*UtreexoProofIndex)
+	key, err := LoadAttestationKey(filepath.Join(t.TempDir(), "attestation.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipts := NewProofReceipts(idx.db, key, 0)
+	other, err := LoadAttestationKey(filepath.Join(t.TempDir(), "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign the receipts of the proofs of every block as one request.
+	requestID, err := NewReceiptRequestID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed []*ProofReceipt
+	var serialized [][]byte
+	cursor, err := idx.NewCursor(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idx.ForEachProof(cursor, 100,
+		func(height int32, hash *chainhash.Hash, ud *wire.UData) error {
+			var buf bytes.Buffer
+			if err := ud.SerializeCompact(&buf, udataSerializeBool); err != nil {
+				return err
+			}
+			receipt, err := receipts.Sign(requestID, hash, buf.Bytes(),
+				time.Now())
+			if err != nil {
+				return err
+			}
+			signed = append(signed, receipt)
+			serialized = append(serialized, buf.Bytes())
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signed) != int(tip.Height()) {
+		t.Fatalf("signed %d receipts for %d blocks", len(signed),
+			tip.Height())
+	}
+
+	for i, receipt := range signed {
+		if receipt.UDataHash != ReceiptUDataHash(serialized[i]) {
+			t.Fatalf("receipt %d commits to another proof", i)
+		}
+		err := VerifyReceipt(receipt, receipts.PubKey())
+		if err != nil {
+			t.Fatalf("receipt %d: %v", i, err)
+		}
+		if err := VerifyReceipt(receipt, other.PubKey()); err == nil {
+			t.Fatalf("receipt %d verified against another key", i)
+		}
+
+		// The serves aren't in the audit log until they're recorded.
+		status, err := receipts.Confirm(receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != ReceiptNotFound {
+			t.Fatalf("receipt %d is %v before being recorded", i, status)
+		}
+	}
+	if err := receipts.Record(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	tampers := []struct {
+		name   string
+		tamper func(*ProofReceipt)
+	}{
+		{"request id", func(r *ProofReceipt) { r.RequestID[0] ^= 1 }},
+		{"block hash", func(r *ProofReceipt) { r.BlockHash[0] ^= 1 }},
+		{"udata hash", func(r *ProofReceipt) { r.UDataHash[0] ^= 1 }},
+		{"timestamp", func(r *ProofReceipt) {
+			r.Timestamp = r.Timestamp.Add(time.Second)
+		}},
+		{"signature", func(r *ProofReceipt) { r.Signature[10] ^= 1 }},
+	}
+	for i, receipt := range signed {
+		status, err := receipts.Confirm(receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != ReceiptConfirmed {
+			t.Fatalf("receipt %d is %v after being recorded", i, status)
+		}
+
+		for _, test := range tampers {
+			tampered := *receipt
+			tampered.Signature = append([]byte(nil), receipt.Signature...)
+			test.tamper(&tampered)
+
+			err := VerifyReceipt(&tampered, receipts.PubKey())
+			if err != ErrInvalidReceiptSignature {
+				t.Fatalf("receipt %d with a tampered %s: got %v, "+
+					"want %v", i, test.name, err,
+					ErrInvalidReceiptSignature)
+			}
+			status, err := receipts.Confirm(&tampered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != ReceiptInvalidSignature {
+				t.Fatalf("receipt %d with a tampered %s is %v", i,
+					test.name, status)
+			}
+		}
+	}
+
+	// A receipt that the node did sign for another proof of a recorded
+	// serve is a mismatch rather than confirmed.
+	mismatched, err := receipts.Sign(requestID, &signed[0].BlockHash,
+		serialized[1], signed[0].Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := receipts.Confirm(mismatched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != ReceiptMismatch {
+		t.Fatalf("receipt for another proof is %v", status)
+	}
+}
+
+// TestProofReceiptsPrune ensures that the serves older than the retention are
+// removed from the audit log.
+func TestProofReceiptsPrune(t *testing.T) {
+	t.Parallel()
+
+	db, dbPath, err := createDB("TestProofReceiptsPrune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	key, err := LoadAttestationKey(filepath.Join(t.TempDir(), "attestation.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipts := NewProofReceipts(db, key, time.Hour)
+
+	var requestID ReceiptRequestID
+	now := time.Now()
+	old, err := receipts.Sign(requestID, &chainhash.Hash{1}, []byte{1},
+		now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, err := receipts.Sign(requestID, &chainhash.Hash{2}, []byte{2}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first record prunes before the serves are added to the audit log.
+	if err := receipts.Record([]*ProofReceipt{old, recent}); err != nil {
+		t.Fatal(err)
+	}
+	for _, receipt := range []*ProofReceipt{old, recent} {
+		status, err := receipts.Confirm(receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != ReceiptConfirmed {
+			t.Fatalf("receipt is %v before pruning", status)
+		}
+	}
+
+	receipts.lastPrune = time.Time{}
+	if err := receipts.Record(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []ReceiptStatus{ReceiptNotFound, ReceiptConfirmed} {
+		receipt := []*ProofReceipt{old, recent}[i]
+		status, err := receipts.Confirm(receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != want {
+			t.Fatalf("receipt %d is %v after pruning, want %v", i,
+				status, want)
+		}
+	}
+
+	err = db.View(func(dbTx database.Tx) error {
+		count := 0
+		bucket := dbTx.Metadata().Bucket(proofReceiptsBucketKey)
+		err := bucket.ForEach(func(_, _ []byte) error {
+			count++
+			return nil
+		})
+		if count != 1 {
+			t.Fatalf("%d serves left in the audit log", count)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
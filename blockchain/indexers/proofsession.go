@@ -0,0 +1,489 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// defaultProofSessionTTL is the default duration a proof session stays
+	// open for.
+	defaultProofSessionTTL = time.Minute * 10
+
+	// proofSessionMinIdle is how long a session has to go unused before it
+	// may be evicted to make room for a new one.
+	proofSessionMinIdle = time.Second * 30
+
+	// maxSnapshotDepth is the maximum amount of blocks the utreexo state
+	// may be rolled back for a snapshot.  Every proof generated against a
+	// snapshot rolls the utreexo state back to it so this bounds the cost.
+	maxSnapshotDepth = 1000
+)
+
+var (
+	// ErrProofSessionNotFound is returned when the requested proof session
+	// doesn't exist or has expired.
+	ErrProofSessionNotFound = errors.New("proof session not found or expired")
+
+	// ErrProofSessionStale is returned when the block the proof session
+	// is pinned to is no longer in the main chain.
+	ErrProofSessionStale = errors.New("proof session snapshot is no longer " +
+		"in the main chain")
+
+	// ErrTooManySessions is returned when a proof session can't be opened
+	// because the maximum amount of sessions are open and none of them
+	// have been idle for long enough to be evicted.
+	ErrTooManySessions = errors.New("too many open proof sessions")
+)
+
+// ProofSession is a handle to a snapshot of the utreexo state at a given block.
+// All the proofs fetched through the session are relative to the roots of the
+// snapshot, regardless of the tip moving during the session.
+type ProofSession struct {
+	// id is the unique identifier of the session.
+	id uint64
+
+	// height and hash are of the block the session is pinned to.
+	height int32
+	hash   chainhash.Hash
+
+	// roots are the roots of the accumulator after the block the session
+	// is pinned to was connected.
+	roots []accumulator.Hash
+
+	// expiry is when the session expires.
+	expiry time.Time
+
+	// idx is the index the session was opened on.
+	idx *FlatUtreexoProofIndex
+}
+
+// ID returns the unique identifier of the session.
+func (s *ProofSession) ID() uint64 {
+	return s.id
+}
+
+// Height returns the height of the block the session is pinned to.
+func (s *ProofSession) Height() int32 {
+	return s.height
+}
+
+// Hash returns the hash of the block the session is pinned to.
+func (s *ProofSession) Hash() chainhash.Hash {
+	return s.hash
+}
+
+// RootHashes returns the accumulator roots of the snapshot.
+func (s *ProofSession) RootHashes() []AccHash {
+	return NewAccHashes(s.roots)
+}
+
+// Roots returns the accumulator roots of the snapshot.
+//
+// Deprecated: Use RootHashes instead.
+func (s *ProofSession) Roots() []accumulator.Hash {
+	return s.roots
+}
+
+// Expiry returns when the session expires.
+func (s *ProofSession) Expiry() time.Time {
+	return s.expiry
+}
+
+// checkValid returns an error if the session has expired or if the block it's
+// pinned to was reorged out.
+func (s *ProofSession) checkValid() error {
+	if time.Now().After(s.expiry) {
+		return &LeaseError{
+			Kind:         LeaseProofSession,
+			ID:           s.id,
+			Reason:       LeaseExpired,
+			ResumeHeight: s.height,
+		}
+	}
+	if !s.idx.chain.MainChainHasBlock(&s.hash) {
+		return ErrProofSessionStale
+	}
+
+	return nil
+}
+
+// FetchUtreexoProof returns the utreexo proof for the block at the given height.
+// Only the blocks up to and including the snapshot may be fetched.
+func (s *ProofSession) FetchUtreexoProof(height int32) (*wire.UData, error) {
+	err := s.idx.sessions.touch(s)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkValid()
+	if err != nil {
+		return nil, err
+	}
+
+	if height > s.height {
+		return nil, fmt.Errorf("height %d is after the session snapshot "+
+			"at height %d", height, s.height)
+	}
+
+	return s.idx.FetchUtreexoProof(height, false)
+}
+
+// ProveUtxos returns an accumulator proof of the outpoints passed in with
+// respect to the roots of the session snapshot.
+//
+// This function is safe for concurrent access.
+func (s *ProofSession) ProveUtxos(utxos []*blockchain.UtxoEntry,
+	outpoints *[]wire.OutPoint) (*blockchain.ChainTipProof, error) {
+
+	err := s.idx.sessions.touch(s)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkValid()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := s.idx.utxosToLeafHashes(utxos, outpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	var accProof accumulator.BatchProof
+	err = s.idx.withSnapshotState(s.height, func() error {
+		// Sanity check that we're proving against the snapshot.
+		roots := s.idx.utreexoState.state.GetRoots()
+		if !reflect.DeepEqual(roots, s.roots) {
+			return fmt.Errorf("roots at height %d differ from the "+
+				"session snapshot", s.height)
+		}
+
+		var err error
+		accProof, err = s.idx.utreexoState.state.ProveBatch(hashes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	provedAtHash := s.hash
+	proof := &blockchain.ChainTipProof{
+		ProvedAtHash: &provedAtHash,
+		AccProof:     &accProof,
+		HashesProven: hashes,
+	}
+
+	return proof, nil
+}
+
+// Close closes the session.  The session may not be used afterwards.
+func (s *ProofSession) Close() {
+	s.idx.sessions.remove(s.id)
+}
+
+// OpenProofSession opens a proof session pinned to the main chain block at
+// the given height.  The session expires after the session TTL.  If the
+// maximum amount of sessions are open, the least recently used one is evicted
+// if it has been idle for long enough and ErrTooManySessions is returned
+// otherwise.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) OpenProofSession(height int32) (*ProofSession, error) {
+	// Check for room before the snapshot is taken since rolling back the
+	// utreexo state is the expensive part.
+	err := idx.sessions.admit()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := idx.chain.BlockHashByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []accumulator.Hash
+	err = idx.withSnapshotState(height, func() error {
+		roots = idx.utreexoState.state.GetRoots()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session := &ProofSession{
+		height: height,
+		hash:   *hash,
+		roots:  roots,
+		idx:    idx,
+	}
+	err = idx.sessions.add(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ProofSession returns the open proof session with the given id.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) ProofSession(id uint64) (*ProofSession, error) {
+	return idx.sessions.get(id)
+}
+
+// SetProofSessionTTL sets the duration that the proof sessions opened from now
+// on stay open for.
+func (idx *FlatUtreexoProofIndex) SetProofSessionTTL(ttl time.Duration) {
+	idx.sessions.setTTL(ttl)
+}
+
+// SetMaxProofSessions sets the maximum amount of proof sessions that may be
+// open at once.  0 means that there's no limit.  Sessions that are already open
+// are only evicted when new ones are opened.
+func (idx *FlatUtreexoProofIndex) SetMaxProofSessions(max int) {
+	idx.sessions.setMax(max)
+}
+
+// ProofSessionStats returns a snapshot of the proof session statistics.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) ProofSessionStats() ProofSessionStats {
+	return idx.sessions.stats()
+}
+
+// withSnapshotState rolls back the utreexo state to the given height, calls fn,
+// and then brings the utreexo state back up to the tip.  No blocks are
+// connected or disconnected while fn is called.
+func (idx *FlatUtreexoProofIndex) withSnapshotState(height int32, fn func() error) error {
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// The undo blocks are stored for every block that's in the state.  A
+	// degraded index rolled its state back to its durable height.
+	tip := idx.undoState.currentHeight
+	if durable, ok := idx.degraded.tip(); ok {
+		tip = durable
+	}
+	if height < 0 || height > tip {
+		return fmt.Errorf("height %d is not between 0 and the tip "+
+			"height of %d", height, tip)
+	}
+	if tip-height > maxSnapshotDepth {
+		return fmt.Errorf("height %d is more than %d blocks behind "+
+			"the tip", height, maxSnapshotDepth)
+	}
+
+	// Nothing to roll back if the snapshot is the tip.
+	if height == tip {
+		return fn()
+	}
+
+	err := idx.undoUtreexoState(tip, height+1, nil)
+	if err != nil {
+		return err
+	}
+
+	fnErr := fn()
+
+	err = idx.resyncUtreexoState(height+1, tip+1, nil)
+	if err != nil {
+		return err
+	}
+
+	return fnErr
+}
+
+// ProofSessionStats are the statistics of the proof sessions.
+type ProofSessionStats struct {
+	// Active is the amount of currently open sessions.
+	Active int
+
+	// MaxSessions is the maximum amount of sessions that may be open at
+	// once.  0 means that there's no limit.
+	MaxSessions int
+
+	// Opened is the total count of opened sessions.
+	Opened uint64
+
+	// Evicted is the total count of idle sessions that were evicted to
+	// make room for new ones.
+	Evicted uint64
+
+	// Rejected is the total count of sessions that weren't opened because
+	// there was no room for them.
+	Rejected uint64
+}
+
+// proofSessions keeps track of the open proof sessions.  The sessions are held
+// through leases so that they expire and are shed along with the other state
+// pinned by the clients of the index.
+type proofSessions struct {
+	// mtx protects all the fields below.
+	mtx sync.Mutex
+
+	// leases are the leases of the open sessions.  The pinned value of a
+	// lease is its session.
+	leases *LeaseManager
+
+	// max is the maximum amount of open sessions.  0 means that there's
+	// no limit.
+	max int
+
+	// opened, evicted, and rejected are the counts reported in the
+	// ProofSessionStats.
+	opened   uint64
+	evicted  uint64
+	rejected uint64
+
+	// now returns the current time.  It's only replaced by tests.
+	now func() time.Time
+}
+
+// newProofSessions returns an empty proofSessions where the sessions are held
+// through the given leases and stay open for the given ttl.
+func newProofSessions(leases *LeaseManager, ttl time.Duration) proofSessions {
+	leases.SetLeaseTTL(LeaseProofSession, ttl)
+	return proofSessions{
+		leases: leases,
+		now:    time.Now,
+	}
+}
+
+// setTTL sets the duration new sessions stay open for.
+func (ps *proofSessions) setTTL(ttl time.Duration) {
+	ps.leases.SetLeaseTTL(LeaseProofSession, ttl)
+}
+
+// setMax sets the maximum amount of open sessions.
+func (ps *proofSessions) setMax(max int) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	ps.max = max
+}
+
+// admit returns ErrTooManySessions if there's no room for a new session.  The
+// least recently used session is evicted to make room if it's idle.
+func (ps *proofSessions) admit() error {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	return ps.makeRoom(ps.now())
+}
+
+// makeRoom makes sure that there's room for a new session by shedding the
+// least recently used one if it has been idle for at least
+// proofSessionMinIdle.  Expired sessions don't take up room.
+// ErrTooManySessions is returned if there's no room.
+//
+// This function MUST be called with the mutex held.
+func (ps *proofSessions) makeRoom(now time.Time) error {
+	if ps.max <= 0 {
+		return nil
+	}
+	lru, count := ps.leases.leastRecentlyUsed(now, LeaseProofSession)
+	if count < ps.max {
+		return nil
+	}
+	if count > ps.max || now.Sub(lru.lastUsed) < proofSessionMinIdle {
+		ps.rejected++
+		return ErrTooManySessions
+	}
+
+	ps.leases.shed(now, lru.id)
+	ps.evicted++
+
+	return nil
+}
+
+// add gives the session an id and an expiry and then adds it to the open
+// sessions.  ErrTooManySessions is returned if there's no room for the session.
+func (ps *proofSessions) add(s *ProofSession) error {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	now := ps.now()
+	err := ps.makeRoom(now)
+	if err != nil {
+		return err
+	}
+
+	size := uint64(len(s.roots)*32) + sessionLeaseOverhead
+	id, expiry, err := ps.leases.acquire(now, LeaseProofSession,
+		leasePrioritySession, size, s.height, s)
+	if err != nil {
+		return err
+	}
+	s.id = id
+	s.expiry = expiry
+	ps.opened++
+
+	return nil
+}
+
+// get returns the open session with the given id and marks it as used.  A
+// LeaseError is returned if the session expired, was evicted, or was
+// invalidated by a reorg.
+func (ps *proofSessions) get(id uint64) (*ProofSession, error) {
+	l, err := ps.leases.lookup(ps.now(), LeaseProofSession, id)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, ErrProofSessionNotFound
+	}
+
+	return l.value.(*ProofSession), nil
+}
+
+// touch marks the session as used.  A LeaseError is returned if the session
+// expired, was evicted, or was invalidated by a reorg and
+// ErrProofSessionNotFound is returned if it was closed.
+func (ps *proofSessions) touch(s *ProofSession) error {
+	l, err := ps.leases.lookup(ps.now(), LeaseProofSession, s.id)
+	if err != nil {
+		return err
+	}
+	if l == nil || l.value != s {
+		return ErrProofSessionNotFound
+	}
+
+	return nil
+}
+
+// stats returns a snapshot of the session statistics.  Expired sessions aren't
+// counted as active.
+func (ps *proofSessions) stats() ProofSessionStats {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	_, active := ps.leases.leastRecentlyUsed(ps.now(), LeaseProofSession)
+
+	return ProofSessionStats{
+		Active:      active,
+		MaxSessions: ps.max,
+		Opened:      ps.opened,
+		Evicted:     ps.evicted,
+		Rejected:    ps.rejected,
+	}
+}
+
+// remove removes the session with the given id.
+func (ps *proofSessions) remove(id uint64) {
+	ps.leases.release(id)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProofSessions(t *testing.T) {
+	ps := newProofSessions(NewLeaseManager(), time.Hour)
+
+	s1 := &ProofSession{height: 1}
+	s2 := &ProofSession{height: 2}
+	ps.add(s1)
+	ps.add(s2)
+	if s1.ID() == s2.ID() {
+		t.Fatalf("sessions share the id %d", s1.ID())
+	}
+
+	got, err := ps.get(s2.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != s2 {
+		t.Fatalf("expected session %d, got %d", s2.ID(), got.ID())
+	}
+
+	ps.remove(s2.ID())
+	_, err = ps.get(s2.ID())
+	if !errors.Is(err, ErrProofSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrProofSessionNotFound, err)
+	}
+
+	// Sessions added with a TTL that has passed are pruned.
+	ps.setTTL(-time.Second)
+	s3 := &ProofSession{height: 3}
+	ps.add(s3)
+	_, err = ps.get(s3.ID())
+	if !errors.Is(err, ErrProofSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrProofSessionNotFound, err)
+	}
+
+	// The session that hasn't expired is still there.
+	_, err = ps.get(s1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.checkValid(); !errors.Is(err, ErrProofSessionNotFound) {
+		t.Fatalf("expected %v, got %v", ErrProofSessionNotFound, err)
+	}
+}
+
+// TestProofSessionLimit ensures that the least recently used idle session is
+// evicted to make room for a new one and that new sessions are refused while
+// all the open ones are in use.
+func TestProofSessionLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ps := newProofSessions(NewLeaseManager(), time.Hour)
+	ps.now = func() time.Time { return now }
+	ps.setMax(2)
+
+	s1 := &ProofSession{height: 1}
+	s2 := &ProofSession{height: 2}
+	for _, s := range []*ProofSession{s1, s2} {
+		err := ps.add(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither session has been idle for long enough to be evicted.
+	now = now.Add(proofSessionMinIdle / 2)
+	err := ps.add(&ProofSession{height: 3})
+	if err != ErrTooManySessions {
+		t.Fatalf("expected %v, got %v", ErrTooManySessions, err)
+	}
+
+	// Using the first session makes the second one the least recently
+	// used one so it's the one that's evicted.
+	_, err = ps.get(s1.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(proofSessionMinIdle / 2)
+	err = ps.admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := &ProofSession{height: 3}
+	err = ps.add(s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.touch(s2); !errors.Is(err, ErrProofSessionNotFound) {
+		t.Fatalf("expected the evicted session to be gone, got %v", err)
+	}
+	if err := ps.touch(s1); err != nil {
+		t.Fatalf("expected the recently used session to stay, got %v", err)
+	}
+
+	// Expired sessions don't count against the limit.
+	now = now.Add(time.Hour + proofSessionMinIdle)
+	err = ps.add(&ProofSession{height: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ProofSessionStats{
+		Active:      1,
+		MaxSessions: 2,
+		Opened:      4,
+		Evicted:     1,
+		Rejected:    1,
+	}
+	if got := ps.stats(); got != want {
+		t.Fatalf("expected stats %+v, got %+v", want, got)
+	}
+
+	// No limit.
+	ps.setMax(0)
+	for i := 0; i < 10; i++ {
+		err = ps.add(&ProofSession{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
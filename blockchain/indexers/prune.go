@@ -0,0 +1,648 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+const (
+	// pruneReorgDepth is how many blocks below the tip the undo blocks are
+	// always kept for when an index is pruned, so that the index can still
+	// be disconnected through reorgs up to that depth.
+	pruneReorgDepth = 288
+
+	// pruneBatchSize is the maximum number of heights whose proofs or undo
+	// blocks are pruned when a block is connected.  The heights that are
+	// already past the retention depth when pruning is turned on are pruned
+	// a batch at a time as the blocks after them are connected.
+	pruneBatchSize = 1000
+
+	// prunedHeightsFileName is the name of the file in the directory of
+	// the proofs of the flat utreexo proof index that keeps the heights up
+	// to which the index was pruned.
+	prunedHeightsFileName = "pruned.dat"
+
+	// prunedHeightsSize is the size of the serialized pruned heights.
+	prunedHeightsSize = 8
+)
+
+var (
+	// utreexoPrunedKey is the key in the utreexoParentBucketKey bucket
+	// that keeps the heights up to which the utreexo proof index was
+	// pruned.
+	utreexoPrunedKey = []byte("utreexoprunedkey")
+
+	// ErrProofPruned is the error that's wrapped when the utreexo proof or
+	// the undo block of a block was pruned from the index.
+	ErrProofPruned = errors.New("utreexo proof pruned")
+
+	// ErrPruneNotReorgSafe is matched by errors.Is for a
+	// PruneHeightError.
+	ErrPruneNotReorgSafe = errors.New("prune height isn't reorg-safe")
+)
+
+// ProofPrunedError identifies the block whose utreexo proof or undo block was
+// pruned from the index.  Unlike a ProofNotFoundError, the index did have it
+// once.
+type ProofPrunedError struct {
+	// Index is the name of the index that was asked.
+	Index string
+
+	// Height is the height of the block that was asked for.
+	Height int32
+
+	// PrunedHeight is the height up to which the index was pruned.
+	PrunedHeight int32
+
+	// Undo is whether it's the undo block that was pruned.
+	Undo bool
+}
+
+// Error returns the error as a human-readable string.
+func (e *ProofPrunedError) Error() string {
+	what := "proofs"
+	if e.Undo {
+		what = "undo blocks"
+	}
+
+	return fmt.Sprintf("%v: %s pruned its %s up to height %d and no "+
+		"longer has the one for height %d", ErrProofPruned, e.Index,
+		what, e.PrunedHeight, e.Height)
+}
+
+// Is returns true for ErrProofPruned so that callers may tell a pruned proof
+// apart from one that was never indexed.
+func (e *ProofPrunedError) Is(target error) bool {
+	return target == ErrProofPruned
+}
+
+// PruneHeightError is returned when the proofs of an index are asked to be
+// pruned up to blocks that aren't buried deep enough to be safe from reorgs.
+type PruneHeightError struct {
+	// Index is the name of the index that was asked.
+	Index string
+
+	// Height is the height that the proofs before were asked to be pruned
+	// and MaxHeight is the highest one that they can be.
+	Height    int32
+	MaxHeight int32
+}
+
+// Error returns the error as a human-readable string.
+func (e *PruneHeightError) Error() string {
+	return fmt.Sprintf("%v: %s can't prune the proofs before height %d as "+
+		"the blocks from height %d on are within %d blocks of the tip",
+		ErrPruneNotReorgSafe, e.Index, e.Height, e.MaxHeight,
+		pruneReorgDepth)
+}
+
+// Is returns whether the target is ErrPruneNotReorgSafe.
+func (e *PruneHeightError) Is(target error) bool {
+	return target == ErrPruneNotReorgSafe
+}
+
+// pruneHeights are the heights up to which the proofs and the undo blocks of
+// an index were pruned.  They're 0 when nothing was pruned as the genesis block
+// has neither.
+type pruneHeights struct {
+	proofs int32
+	undo   int32
+}
+
+// serialize returns the pruned heights serialized.
+func (h pruneHeights) serialize() []byte {
+	var buf [prunedHeightsSize]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(h.proofs))
+	binary.BigEndian.PutUint32(buf[4:], uint32(h.undo))
+	return buf[:]
+}
+
+// deserializePruneHeights returns the pruned heights serialized in buf.
+func deserializePruneHeights(buf []byte) (pruneHeights, error) {
+	if len(buf) != prunedHeightsSize {
+		return pruneHeights{}, fmt.Errorf("corrupt pruned heights. "+
+			"Expected %d bytes but got %d", prunedHeightsSize, len(buf))
+	}
+
+	return pruneHeights{
+		proofs: int32(binary.BigEndian.Uint32(buf)),
+		undo:   int32(binary.BigEndian.Uint32(buf[4:])),
+	}, nil
+}
+
+// readPrunedHeights reads the pruned heights persisted at the given path.
+// Nothing was pruned if they were never persisted.
+func readPrunedHeights(path string) (pruneHeights, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pruneHeights{}, nil
+	}
+	if err != nil {
+		return pruneHeights{}, err
+	}
+
+	return deserializePruneHeights(buf)
+}
+
+// writePrunedHeights persists the pruned heights at the given path.
+func writePrunedHeights(path string, h pruneHeights) error {
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, h.serialize(), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// pruneState is how many blocks the proofs of an index are retained for and
+// the heights up to which the index was pruned.
+type pruneState struct {
+	mtx    sync.RWMutex
+	retain int32
+	pruned pruneHeights
+}
+
+// setRetain sets how many blocks below the tip the proofs are retained for.
+// Nothing is pruned from then on if it's 0.
+//
+// This function is safe for concurrent access.
+func (p *pruneState) setRetain(blocks int32) {
+	p.mtx.Lock()
+	p.retain = blocks
+	p.mtx.Unlock()
+}
+
+// heights returns the heights up to which the index was pruned.
+//
+// This function is safe for concurrent access.
+func (p *pruneState) heights() pruneHeights {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.pruned
+}
+
+// set sets the heights up to which the index was pruned.
+//
+// This function is safe for concurrent access.
+func (p *pruneState) set(h pruneHeights) {
+	p.mtx.Lock()
+	p.pruned = h
+	p.mtx.Unlock()
+}
+
+// next returns the heights up to which the index is to be pruned once the block
+// at the given height is connected and whether they differ from the current
+// ones.  The undo blocks are kept for at least pruneReorgDepth blocks and no
+// more than pruneBatchSize heights of either are pruned at once.  alignUndo,
+// if it's not nil, lowers the height up to which the undo blocks are pruned to
+// one whose following undo blocks can still be read.
+//
+// This function is safe for concurrent access.
+func (p *pruneState) next(tip int32,
+	alignUndo func(int32) int32) (pruneHeights, bool) {
+
+	p.mtx.RLock()
+	retain, cur := p.retain, p.pruned
+	p.mtx.RUnlock()
+
+	if retain <= 0 {
+		return cur, false
+	}
+	undoDepth := retain
+	if undoDepth < pruneReorgDepth {
+		undoDepth = pruneReorgDepth
+	}
+
+	next := pruneHeights{proofs: tip - retain, undo: tip - undoDepth}
+	if next.proofs > cur.proofs+pruneBatchSize {
+		next.proofs = cur.proofs + pruneBatchSize
+	}
+	if next.undo > cur.undo+pruneBatchSize {
+		next.undo = cur.undo + pruneBatchSize
+	}
+	if alignUndo != nil {
+		next.undo = alignUndo(next.undo)
+	}
+	if next.proofs < cur.proofs {
+		next.proofs = cur.proofs
+	}
+	if next.undo < cur.undo {
+		next.undo = cur.undo
+	}
+
+	return next, next != cur
+}
+
+// checkProof returns a ProofPrunedError if the proof for the block at the given
+// height was pruned.  keep returns whether a height was kept when the ones
+// around it were pruned.  It may be nil.
+//
+// This function is safe for concurrent access.
+func (p *pruneState) checkProof(index string, height int32,
+	keep func(int32) bool) error {
+
+	pruned := p.heights().proofs
+	if height <= 0 || height > pruned || (keep != nil && keep(height)) {
+		return nil
+	}
+
+	return &ProofPrunedError{
+		Index:        index,
+		Height:       height,
+		PrunedHeight: pruned,
+	}
+}
+
+// checkUndo returns a ProofPrunedError if the undo block for the block at the
+// given height was pruned.  keep returns whether a height was kept when the
+// ones around it were pruned.  It may be nil.
+//
+// This function is safe for concurrent access.
+func (p *pruneState) checkUndo(index string, height int32,
+	keep func(int32) bool) error {
+
+	pruned := p.heights().undo
+	if height <= 0 || height > pruned || (keep != nil && keep(height)) {
+		return nil
+	}
+
+	return &ProofPrunedError{
+		Index:        index,
+		Height:       height,
+		PrunedHeight: pruned,
+		Undo:         true,
+	}
+}
+
+// removePruned removes the heights up to the pruned height from the servable
+// ranges, apart from the pinned ones.
+func removePruned(servable []HeightRange, pruned int32,
+	pins []ProofPin) []HeightRange {
+
+	start := int32(1)
+	for _, pin := range pins {
+		if pin.Height > pruned {
+			break
+		}
+		if pin.Height < start {
+			continue
+		}
+		servable = removeHeightRange(servable,
+			HeightRange{Start: start, End: pin.Height - 1})
+		start = pin.Height + 1
+	}
+
+	return removeHeightRange(servable, HeightRange{Start: start, End: pruned})
+}
+
+// punchEntries frees the disk space taken up by the entries stored for the
+// heights from start to end inclusive.  The entries read back as zeros
+// afterwards so they must never be fetched again.  The space isn't freed where
+// the filesystem can't punch holes into files.
+//
+// This function is safe for concurrent access.
+func (ff *FlatFileState) punchEntries(start, end int32) error {
+	ff.mtx.Lock()
+	defer ff.mtx.Unlock()
+
+	if start < 1 {
+		start = 1
+	}
+	if end > ff.currentHeight {
+		end = ff.currentHeight
+	}
+	if end < start {
+		return nil
+	}
+
+	offset := ff.offsets[start]
+	length := ff.offsets[end] + 8 + int64(ff.lengths[end]) - offset
+	_, err := punchHole(ff.dataFile, offset, length)
+	return err
+}
+
+// punchUnpinned frees the disk space taken up by the entries of the flat file
+// from start to end inclusive, apart from the ones that the pinned heights need.
+// need returns the lowest height whose entry is needed to read the entry of the
+// given one.
+func punchUnpinned(ff *FlatFileState, start, end int32, pins []ProofPin,
+	need func(int32) int32) error {
+
+	for _, pin := range pins {
+		keepStart, keepEnd := need(pin.Height), pin.Height
+		if keepEnd < start {
+			continue
+		}
+		if keepStart > end {
+			break
+		}
+		if keepStart > start {
+			err := ff.punchEntries(start, keepStart-1)
+			if err != nil {
+				return err
+			}
+		}
+		start = keepEnd + 1
+	}
+
+	return ff.punchEntries(start, end)
+}
+
+// SetRetainBlocks sets how many blocks below the tip the proofs are retained for.
+// The proofs and the undo blocks of the blocks buried deeper are pruned as
+// blocks are connected, apart from the undo blocks of the last
+// pruneReorgDepth blocks that are needed to handle reorgs.  Nothing is pruned
+// if it's 0.  The proofs that were already pruned stay pruned.
+func (idx *UtreexoProofIndex) SetRetainBlocks(blocks int32) {
+	idx.prune.setRetain(blocks)
+}
+
+// PrunedHeight returns the height up to which the proofs of the index were
+// pruned.  It's 0 if nothing was pruned.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) PrunedHeight() int32 {
+	return idx.prune.heights().proofs
+}
+
+// AncestorsNeeded returns the heights of the main chain blocks whose hashes the
+// index requires to prune their proofs and undo blocks once the block at the
+// given height is connected.
+//
+// This is part of the AncestorNeeder interface.
+func (idx *UtreexoProofIndex) AncestorsNeeded(height int32) (HeightRange, bool) {
+	cur := idx.prune.heights()
+	next, ok := idx.prune.next(height, nil)
+	if !ok {
+		return HeightRange{}, false
+	}
+
+	start := cur.undo
+	if cur.proofs < start {
+		start = cur.proofs
+	}
+	end := next.undo
+	if next.proofs > end {
+		end = next.proofs
+	}
+
+	return HeightRange{Start: start + 1, End: end}, true
+}
+
+// loadPruned loads the heights up to which the index was pruned.
+func (idx *UtreexoProofIndex) loadPruned() error {
+	return idx.db.View(func(dbTx database.Tx) error {
+		bucket := dbTx.Metadata().Bucket(utreexoParentBucketKey)
+		buf := bucket.Get(utreexoPrunedKey)
+		if buf == nil {
+			idx.prune.set(pruneHeights{})
+			return nil
+		}
+
+		h, err := deserializePruneHeights(buf)
+		if err != nil {
+			return err
+		}
+		idx.prune.set(h)
+
+		return nil
+	})
+}
+
+// pruneBlocks deletes the proofs, the undo blocks, and the roots of the blocks
+// that are past the retention depth once the block of the notification is
+// connected.  The roots are pruned along with the undo blocks.  Only the blocks
+// whose hashes were gathered into the notification are pruned.
+func (idx *UtreexoProofIndex) pruneBlocks(dbTx database.Tx, n *BlockNotification) error {
+	cur := idx.prune.heights()
+	next, ok := idx.prune.next(n.Height, nil)
+	if !ok {
+		return nil
+	}
+
+	for h := cur.proofs + 1; h <= next.proofs; h++ {
+		hash, ok := n.AncestorHashes[h]
+		if !ok {
+			next.proofs = h - 1
+			break
+		}
+		err := dbDeleteUtreexoProofEntry(dbTx, &hash)
+		if err != nil {
+			return err
+		}
+		idx.proofCache.remove(&hash)
+	}
+	for h := cur.undo + 1; h <= next.undo; h++ {
+		hash, ok := n.AncestorHashes[h]
+		if !ok {
+			next.undo = h - 1
+			break
+		}
+		err := dbDeleteUndoBlockEntry(dbTx, &hash)
+		if err != nil {
+			return err
+		}
+		err = dbDeleteBlockRoots(dbTx, &hash)
+		if err != nil {
+			return err
+		}
+	}
+	if next == cur {
+		return nil
+	}
+
+	bucket := dbTx.Metadata().Bucket(utreexoParentBucketKey)
+	err := bucket.Put(utreexoPrunedKey, next.serialize())
+	if err != nil {
+		return err
+	}
+	idx.prune.set(next)
+
+	return nil
+}
+
+// missingProofError returns the error for the block with the given hash whose
+// proof isn't in the index.  It's a ProofPrunedError if the block is in the
+// main chain at a height whose proof was pruned and a ProofNotFoundError
+// otherwise.
+func (idx *UtreexoProofIndex) missingProofError(hash *chainhash.Hash) error {
+	if idx.chain != nil && idx.chain.MainChainHasBlock(hash) {
+		height, err := idx.chain.BlockHeightByHash(hash)
+		if err == nil {
+			err = idx.prune.checkProof(idx.Name(), height, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return &ProofNotFoundError{Index: idx.Name(), Hash: *hash}
+}
+
+// SetRetainBlocks sets how many blocks below the tip the proofs are retained for.
+// The proofs, the remember indexes, and the undo blocks of the blocks buried
+// deeper are pruned as blocks are connected, apart from the undo blocks of the
+// last pruneReorgDepth blocks that are needed to handle reorgs and the entries
+// of the pinned heights.  Nothing is pruned if it's 0.  The proofs that were
+// already pruned stay pruned.
+func (idx *FlatUtreexoProofIndex) SetRetainBlocks(blocks int32) {
+	idx.prune.setRetain(blocks)
+}
+
+// PrunedHeight returns the height up to which the proofs of the index were
+// pruned.  It's 0 if nothing was pruned.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) PrunedHeight() int32 {
+	return idx.prune.heights().proofs
+}
+
+// prunedPath returns the path of the file that keeps the heights up to which
+// the index was pruned.
+func (idx *FlatUtreexoProofIndex) prunedPath() string {
+	return filepath.Join(flatFilePath(idx.dataDir, flatUtreexoProofName),
+		prunedHeightsFileName)
+}
+
+// undoChainStart returns the lowest height whose undo record is needed to read
+// the undo block of the given height.  It's the height itself unless the undo
+// blocks are delta-encoded.
+func (idx *FlatUtreexoProofIndex) undoChainStart(height int32) int32 {
+	if idx.undoSnapshotInterval <= 0 {
+		return height
+	}
+
+	start := height - height%idx.undoSnapshotInterval
+	if start < 1 {
+		start = 1
+	}
+	return start
+}
+
+// alignUndoPrune lowers the height up to which the undo blocks are pruned so
+// that the undo block after it starts a chain of delta-encoded undo records.
+func (idx *FlatUtreexoProofIndex) alignUndoPrune(height int32) int32 {
+	return idx.undoChainStart(height+1) - 1
+}
+
+// checkUndoPruned returns a ProofPrunedError if the undo block of the block at
+// the given height was pruned.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) checkUndoPruned(height int32) error {
+	return idx.prune.checkUndo(idx.Name(), height, idx.undoPinned)
+}
+
+// undoPinned returns whether the undo record of the given height is needed to
+// read the undo block of a pinned height.
+func (idx *FlatUtreexoProofIndex) undoPinned(height int32) bool {
+	for _, pin := range idx.pins.list() {
+		if height >= idx.undoChainStart(pin.Height) && height <= pin.Height {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneFlatFiles prunes the proofs, the remember indexes, and the undo blocks
+// of the blocks that are past the retention depth once the block at the given
+// height is connected.  The pruned heights are persisted before the disk space
+// is freed so that a pruned entry is never read.
+//
+// This function MUST be called with the snapshotMtx held.
+func (idx *FlatUtreexoProofIndex) pruneFlatFiles(height int32) error {
+	cur := idx.prune.heights()
+	next, ok := idx.prune.next(height, idx.alignUndoPrune)
+	if !ok {
+		return nil
+	}
+
+	err := writePrunedHeights(idx.prunedPath(), next)
+	if err != nil {
+		return err
+	}
+	idx.prune.set(next)
+
+	return idx.punchPruned(cur, next)
+}
+
+// PruneProofsBefore prunes the proofs and the remember indexes of the blocks
+// below the given height along with their undo blocks, apart from the entries
+// of the pinned heights.  It refuses to prune any of the last pruneReorgDepth
+// blocks, whose undo blocks are needed to handle reorgs.  The pruned heights
+// are persisted before the disk space is freed so that the index restarts with
+// them.  The heights that were already pruned stay pruned.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) PruneProofsBefore(height int32) error {
+	if err := idx.gate.check(); err != nil {
+		return err
+	}
+
+	// Connecting and disconnecting blocks are held off so that the tip
+	// doesn't move while the heights are pruned.
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	maxHeight := idx.proofState.BestHeight() - pruneReorgDepth + 1
+	if height > maxHeight {
+		return &PruneHeightError{
+			Index:     idx.Name(),
+			Height:    height,
+			MaxHeight: maxHeight,
+		}
+	}
+
+	cur := idx.prune.heights()
+	next := pruneHeights{
+		proofs: height - 1,
+		undo:   idx.alignUndoPrune(height - 1),
+	}
+	if next.proofs < cur.proofs {
+		next.proofs = cur.proofs
+	}
+	if next.undo < cur.undo {
+		next.undo = cur.undo
+	}
+	if next == cur {
+		return nil
+	}
+
+	err := writePrunedHeights(idx.prunedPath(), next)
+	if err != nil {
+		return err
+	}
+	idx.prune.set(next)
+
+	return idx.punchPruned(cur, next)
+}
+
+// punchPruned frees the disk space taken up by the entries pruned between the
+// given pruned heights.
+func (idx *FlatUtreexoProofIndex) punchPruned(from, to pruneHeights) error {
+	pins := idx.pins.list()
+	same := func(height int32) int32 { return height }
+	for _, ff := range []*FlatFileState{&idx.proofState, &idx.rememberIdxState} {
+		err := punchUnpinned(ff, from.proofs+1, to.proofs, pins, same)
+		if err != nil {
+			return err
+		}
+	}
+
+	return punchUnpinned(&idx.undoState, from.undo+1, to.undo, pins,
+		idx.undoChainStart)
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocPunchHole is the fallocate mode that frees the range.  It must be
+// combined with fallocKeepSize.
+const fallocPunchHole = 0x2
+
+// punchHole frees the disk space of the given range of the file without
+// changing its size.  The range reads back as zeros afterwards.  It returns
+// false if the filesystem can't punch holes.
+func punchHole(f *os.File, offset, length int64) (bool, error) {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize,
+		offset, length)
+	switch err {
+	case nil:
+		return true, nil
+	case syscall.EOPNOTSUPP, syscall.ENOSYS:
+		return false, nil
+	}
+
+	return false, err
+}
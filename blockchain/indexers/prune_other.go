@@ -0,0 +1,17 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package indexers
+
+import "os"
+
+// punchHole frees the disk space of the given range of the file without
+// changing its size.  Holes can only be punched on Linux so it always returns
+// false and the range is left as it is.
+func punchHole(f *os.File, offset, length int64) (bool, error) {
+	return false, nil
+}
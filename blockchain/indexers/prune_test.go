@@ -0,0 +1,301 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+)
+
+// TestPruneStateNext ensures that the heights up to which an index is pruned
+// follow the tip, keep the undo blocks for a reorg and never go backwards.
+func TestPruneStateNext(t *testing.T) {
+	aligned := &FlatUtreexoProofIndex{undoSnapshotInterval: 100}
+
+	tests := []struct {
+		name    string
+		retain  int32
+		cur     pruneHeights
+		tip     int32
+		align   func(int32) int32
+		want    pruneHeights
+		changed bool
+	}{
+		{
+			name:   "retain nothing",
+			retain: 0,
+			tip:    5000,
+			want:   pruneHeights{},
+		},
+		{
+			name:    "undo within reorg depth",
+			retain:  5,
+			tip:     20,
+			want:    pruneHeights{proofs: 15},
+			changed: true,
+		},
+		{
+			name:    "batched",
+			retain:  5,
+			tip:     5000,
+			want:    pruneHeights{proofs: 1000, undo: 1000},
+			changed: true,
+		},
+		{
+			name:    "undo reorg depth",
+			retain:  5,
+			cur:     pruneHeights{proofs: 900, undo: 600},
+			tip:     1000,
+			want:    pruneHeights{proofs: 995, undo: 712},
+			changed: true,
+		},
+		{
+			name:    "retain past reorg depth",
+			retain:  500,
+			cur:     pruneHeights{proofs: 1400, undo: 1400},
+			tip:     2000,
+			want:    pruneHeights{proofs: 1500, undo: 1500},
+			changed: true,
+		},
+		{
+			name:    "aligned undo",
+			retain:  5,
+			tip:     1000,
+			align:   aligned.alignUndoPrune,
+			want:    pruneHeights{proofs: 995, undo: 699},
+			changed: true,
+		},
+		{
+			name:   "retention raised",
+			retain: 500,
+			cur:    pruneHeights{proofs: 995, undo: 712},
+			tip:    1001,
+			want:   pruneHeights{proofs: 995, undo: 712},
+		},
+	}
+
+	for _, test := range tests {
+		var p pruneState
+		p.setRetain(test.retain)
+		p.set(test.cur)
+
+		got, changed := p.next(test.tip, test.align)
+		if got != test.want || changed != test.changed {
+			t.Errorf("%s: got %+v (changed %v), want %+v (changed %v)",
+				test.name, got, changed, test.want, test.changed)
+		}
+	}
+}
+
+// TestRemovePruned ensures that the pruned heights are removed from the
+// servable ranges apart from the genesis block and the pinned heights.
+func TestRemovePruned(t *testing.T) {
+	servable := []HeightRange{{Start: 0, End: 20}}
+	pins := []ProofPin{{Height: 3}, {Height: 4}, {Height: 10}, {Height: 18}}
+
+	got := removePruned(servable, 15, pins)
+	want := []HeightRange{
+		{Start: 0, End: 0},
+		{Start: 3, End: 4},
+		{Start: 10, End: 10},
+		{Start: 16, End: 20},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	got = removePruned(servable, 0, pins)
+	if !reflect.DeepEqual(got, servable) {
+		t.Fatalf("got %v, want %v", got, servable)
+	}
+}
+
+// TestPruneProofs ensures that both utreexo proof indexes prune the proofs
+// older than the retention depth as blocks are connected, keep the pinned
+// heights and report the pruned heights apart from the missing ones.
+func TestPruneProofs(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestPruneProofs", 1)
+	defer tearDown()
+
+	var flatIdx *FlatUtreexoProofIndex
+	var idx *UtreexoProofIndex
+	for _, indexer := range indexes {
+		switch index := indexer.(type) {
+		case *FlatUtreexoProofIndex:
+			flatIdx = index
+		case *UtreexoProofIndex:
+			idx = index
+		}
+	}
+	flatIdx.SetRetainBlocks(5)
+	idx.SetRetainBlocks(5)
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	hashes := make(map[int32]*chainhash.Hash)
+	for i := 0; i < 20; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+		hashes[tip.Height()] = tip.Hash()
+
+		if tip.Height() == 3 {
+			err := flatIdx.PinHeights([]int32{3}, "audit")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, index := range []interface{ PrunedHeight() int32 }{flatIdx, idx} {
+		if got := index.PrunedHeight(); got != 15 {
+			t.Fatalf("expected the proofs to be pruned up to 15, got %d",
+				got)
+		}
+	}
+
+	for height := int32(1); height <= 20; height++ {
+		_, err := idx.FetchUtreexoProof(hashes[height])
+		if height <= 15 {
+			var pruneErr *ProofPrunedError
+			if !errors.As(err, &pruneErr) || pruneErr.Height != height ||
+				pruneErr.PrunedHeight != 15 {
+				t.Fatalf("height %d: expected a pruned error, got %v",
+					height, err)
+			}
+		} else if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+
+		_, err = flatIdx.FetchUtreexoProof(height, false)
+		switch {
+		case height == 3 || height > 15:
+			if err != nil {
+				t.Fatalf("height %d: %v", height, err)
+			}
+		case !errors.Is(err, ErrProofPruned):
+			t.Fatalf("height %d: expected a pruned error, got %v",
+				height, err)
+		}
+	}
+
+	// A block the index never had isn't reported as pruned.
+	_, err := idx.FetchUtreexoProof(&chainhash.Hash{0x01})
+	if err == nil || errors.Is(err, ErrProofPruned) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+
+	servable, err := flatIdx.ServableRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HeightRange{{0, 0}, {3, 3}, {16, 20}}
+	if !reflect.DeepEqual(servable, want) {
+		t.Fatalf("flat servable ranges: got %v, want %v", servable, want)
+	}
+
+	servable, err = idx.ServableRanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []HeightRange{{0, 0}, {16, 20}}
+	if !reflect.DeepEqual(servable, want) {
+		t.Fatalf("servable ranges: got %v, want %v", servable, want)
+	}
+
+	// The pruned heights are persisted so that they're known on restart.
+	pruned, err := readPrunedHeights(flatIdx.prunedPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != (pruneHeights{proofs: 15}) {
+		t.Fatalf("persisted pruned heights: got %+v", pruned)
+	}
+	idx.prune.set(pruneHeights{})
+	if err := idx.loadPruned(); err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.PrunedHeight(); got != 15 {
+		t.Fatalf("loaded pruned height: got %d, want 15", got)
+	}
+}
+
+// TestPruneProofsBefore ensures that the flat utreexo proof index prunes the
+// proofs before a height on request, refuses to prune the blocks within the
+// reorg depth, and keeps the undo blocks needed to disconnect them.
+func TestPruneProofsBefore(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestPruneProofsBefore", 1)
+	defer tearDown()
+
+	var idx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		if flatIdx, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			idx = flatIdx
+		}
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < pruneReorgDepth+10; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+	maxHeight := tip.Height() - pruneReorgDepth + 1
+
+	err := idx.PruneProofsBefore(maxHeight + 1)
+	var heightErr *PruneHeightError
+	if !errors.As(err, &heightErr) || heightErr.MaxHeight != maxHeight {
+		t.Fatalf("expected a prune height error, got %v", err)
+	}
+	if got := idx.PrunedHeight(); got != 0 {
+		t.Fatalf("pruned up to %d past the reorg-safe height", got)
+	}
+
+	if err := idx.PruneProofsBefore(maxHeight); err != nil {
+		t.Fatal(err)
+	}
+	if got := idx.PrunedHeight(); got != maxHeight-1 {
+		t.Fatalf("expected the proofs to be pruned up to %d, got %d",
+			maxHeight-1, got)
+	}
+	for _, height := range []int32{1, maxHeight - 1} {
+		_, err := idx.FetchUtreexoProof(height, false)
+		if !errors.Is(err, ErrProofPruned) {
+			t.Fatalf("height %d: expected a pruned error, got %v",
+				height, err)
+		}
+	}
+	for height := maxHeight; height <= tip.Height(); height++ {
+		if _, err := idx.FetchUtreexoProof(height, false); err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+		if _, err := idx.fetchUndoBlock(height); err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+	}
+
+	// Pruning before a lower height leaves the pruned heights as they are
+	// and the pruned heights are persisted for the restart.
+	if err := idx.PruneProofsBefore(5); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := readPrunedHeights(idx.prunedPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != idx.prune.heights() || pruned.proofs != maxHeight-1 {
+		t.Fatalf("persisted pruned heights: got %+v", pruned)
+	}
+}
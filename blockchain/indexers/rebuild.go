@@ -0,0 +1,998 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+var (
+	// indexRulesBucketName is the name of the db bucket used to house the
+	// version of each utreexo rule that each index was built under.
+	indexRulesBucketName = []byte("idxrules")
+)
+
+// Rule is a utreexo rule that the entries of some of the indexes depend on.
+type Rule uint8
+
+const (
+	// RuleLeafEligibility is the rule deciding which outputs are added
+	// to the accumulator as leaves.
+	RuleLeafEligibility Rule = iota
+
+	// RuleCanonicalOrdering is the rule deciding the order that the leaves
+	// and the targets of a block are in.
+	RuleCanonicalOrdering
+
+	// RuleLeafHasher is the rule deciding how the leaves are hashed.
+	RuleLeafHasher
+)
+
+// String returns the Rule in human-readable form.
+func (r Rule) String() string {
+	switch r {
+	case RuleLeafEligibility:
+		return "leaf eligibility"
+	case RuleCanonicalOrdering:
+		return "canonical ordering"
+	case RuleLeafHasher:
+		return "leaf hasher"
+	default:
+		return fmt.Sprintf("unknown rule %d", uint8(r))
+	}
+}
+
+// RuleChange is a new version of a utreexo rule.
+type RuleChange struct {
+	Rule    Rule
+	Version uint32
+}
+
+// String returns the RuleChange in human-readable form.
+func (c RuleChange) String() string {
+	return fmt.Sprintf("%v version %d", c.Rule, c.Version)
+}
+
+// Rebuilder provides a generic interface for an indexer whose entries depend on
+// the utreexo rules.  The index manager drops and creates the index again when
+// one of those rules changes.
+type Rebuilder interface {
+	// RebuildsOn returns whether the index has to be rebuilt when the rule
+	// changes.
+	RebuildsOn(change RuleChange) bool
+
+	// ResetIndex removes the state that the index keeps outside of its
+	// database bucket so that it starts over from an empty state.  It's
+	// invoked after the bucket was dropped and before the index is
+	// created again.
+	ResetIndex() error
+
+	// rebuildGate returns the gate that refuses the fetches of the index
+	// while it's being rebuilt.
+	rebuildGate() *rebuildGate
+}
+
+// RebuildingError is returned by the fetches of an index that's being rebuilt.
+// The index serves again once all the indexes of the rebuild reach the tip.
+type RebuildingError struct {
+	// Index is the name of the index.
+	Index string
+
+	// Change is the rule change that the index is rebuilt for.
+	Change RuleChange
+
+	// Height is the height that the rebuild scanned up to and
+	// TargetHeight is the tip of the chain.
+	Height       int32
+	TargetHeight int32
+}
+
+// Error returns the RebuildingError in human-readable form.
+func (e *RebuildingError) Error() string {
+	return fmt.Sprintf("%s is being rebuilt for %v (height %d of %d)",
+		e.Index, e.Change, e.Height, e.TargetHeight)
+}
+
+// RebuildPhase is how far the rebuild of an index got.
+type RebuildPhase uint8
+
+const (
+	// RebuildDropping is the phase of an index whose old entries are being
+	// dropped.
+	RebuildDropping RebuildPhase = iota
+
+	// RebuildScanning is the phase of an index that was created again and
+	// is being caught up by the shared chain scan.
+	RebuildScanning
+)
+
+// String returns the RebuildPhase in human-readable form.
+func (p RebuildPhase) String() string {
+	switch p {
+	case RebuildDropping:
+		return "dropping"
+	case RebuildScanning:
+		return "scanning"
+	default:
+		return fmt.Sprintf("unknown phase %d", uint8(p))
+	}
+}
+
+// IndexRebuildStatus is the status of an index that's being rebuilt.
+type IndexRebuildStatus struct {
+	Name   string
+	Phase  RebuildPhase
+	Height int32
+}
+
+// RebuildStats are the progress of a rebuild of the indexes.
+type RebuildStats struct {
+	// Change is the rule change that the indexes are rebuilt for.
+	Change RuleChange
+
+	// Height is the height that the shared scan got to and TargetHeight is
+	// the tip of the chain.
+	Height       int32
+	TargetHeight int32
+
+	// BlocksRead is the number of blocks that the shared scan read since
+	// it was started or resumed.
+	BlocksRead uint64
+
+	// Progress is the fraction of the blocks that were scanned.
+	Progress float64
+
+	// ETA is the estimated time left until the indexes reach the tip.
+	// It's 0 until the scan read a block.
+	ETA time.Duration
+
+	// Indexes are the status of each of the indexes that are rebuilt.
+	Indexes []IndexRebuildStatus
+}
+
+// rebuildGate refuses the fetches of an index while it's being rebuilt.
+type rebuildGate struct {
+	mtx     sync.RWMutex
+	rebuild *rebuild
+	name    string
+}
+
+// set makes the gate refuse the fetches until the given rebuild goes live.
+//
+// This function is safe for concurrent access.
+func (g *rebuildGate) set(r *rebuild, name string) {
+	g.mtx.Lock()
+	g.rebuild = r
+	g.name = name
+	g.mtx.Unlock()
+}
+
+// check returns a RebuildingError if the index is being rebuilt.
+//
+// This function is safe for concurrent access.
+func (g *rebuildGate) check() error {
+	g.mtx.RLock()
+	r, name := g.rebuild, g.name
+	g.mtx.RUnlock()
+
+	if r == nil || r.isLive() {
+		return nil
+	}
+
+	height, target := r.progress()
+	return &RebuildingError{
+		Index:        name,
+		Change:       r.change,
+		Height:       height,
+		TargetHeight: target,
+	}
+}
+
+// rebuild is a rebuild of the indexes that depend on a changed utreexo rule.
+type rebuild struct {
+	change  RuleChange
+	indexes []Indexer
+
+	// live is set once all the indexes reached the tip.  All of their
+	// gates check it so they start serving together.  It must only be
+	// used atomically.
+	live int32
+
+	mtx        sync.Mutex
+	phases     []RebuildPhase
+	heights    []int32
+	target     int32
+	blocksRead uint64
+	scanStart  time.Time
+	scanFrom   int32
+}
+
+// isLive returns whether the indexes of the rebuild serve again.
+func (r *rebuild) isLive() bool {
+	return atomic.LoadInt32(&r.live) == 1
+}
+
+// progress returns the height that the scan got to and the tip of the chain.
+//
+// This function is safe for concurrent access.
+func (r *rebuild) progress() (int32, int32) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.scanHeight(), r.target
+}
+
+// scanHeight returns the lowest height of the indexes.
+//
+// This function MUST be called with the rebuild mutex held.
+func (r *rebuild) scanHeight() int32 {
+	height := r.target
+	for _, h := range r.heights {
+		if h < height {
+			height = h
+		}
+	}
+
+	return height
+}
+
+// phaseOf returns the phase of the given index and whether it's rebuilt.
+//
+// This function is safe for concurrent access.
+func (r *rebuild) phaseOf(indexer Indexer) (RebuildPhase, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for i, idx := range r.indexes {
+		if idx == indexer {
+			return r.phases[i], true
+		}
+	}
+
+	return 0, false
+}
+
+// stats returns the progress of the rebuild.
+//
+// This function is safe for concurrent access.
+func (r *rebuild) stats() *RebuildStats {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	stats := &RebuildStats{
+		Change:       r.change,
+		Height:       r.scanHeight(),
+		TargetHeight: r.target,
+		BlocksRead:   r.blocksRead,
+	}
+	if r.target > 0 {
+		stats.Progress = float64(stats.Height+1) / float64(r.target+1)
+		if stats.Progress < 0 {
+			stats.Progress = 0
+		}
+	}
+	if r.blocksRead > 0 && stats.Height > r.scanFrom {
+		perBlock := time.Since(r.scanStart) /
+			time.Duration(stats.Height-r.scanFrom)
+		stats.ETA = perBlock * time.Duration(r.target-stats.Height)
+	}
+	for i, idx := range r.indexes {
+		stats.Indexes = append(stats.Indexes, IndexRebuildStatus{
+			Name:   idx.Name(),
+			Phase:  r.phases[i],
+			Height: r.heights[i],
+		})
+	}
+
+	return stats
+}
+
+// indexRebuildKey returns the key for an index which indicates it's being
+// rebuilt.
+func indexRebuildKey(idxKey []byte) []byte {
+	rebuildKey := make([]byte, len(idxKey)+1)
+	rebuildKey[0] = 'r'
+	copy(rebuildKey[1:], idxKey)
+	return rebuildKey
+}
+
+// -----------------------------------------------------------------------------
+// The rebuild marker of an index is kept in the index tips bucket under the
+// rebuild key of the index.
+//
+// The serialized format is:
+//
+//   <rule><version><phase>
+//
+//   Field           Type             Size
+//   rule            uint8            1 byte
+//   version         uint32           4 bytes
+//   phase           uint8            1 byte
+// -----------------------------------------------------------------------------
+
+// serializeRebuildMarker returns the rebuild marker of an index in the given
+// phase of the rebuild for the rule change.
+func serializeRebuildMarker(change RuleChange, phase RebuildPhase) []byte {
+	serialized := make([]byte, 6)
+	serialized[0] = byte(change.Rule)
+	byteOrder.PutUint32(serialized[1:5], change.Version)
+	serialized[5] = byte(phase)
+	return serialized
+}
+
+// deserializeRebuildMarker returns the rule change and the phase of a rebuild
+// marker.
+func deserializeRebuildMarker(serialized []byte) (RuleChange, RebuildPhase, error) {
+	if len(serialized) != 6 {
+		return RuleChange{}, 0, database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("unexpected rebuild marker "+
+				"length %d", len(serialized)),
+		}
+	}
+
+	change := RuleChange{
+		Rule:    Rule(serialized[0]),
+		Version: byteOrder.Uint32(serialized[1:5]),
+	}
+	return change, RebuildPhase(serialized[5]), nil
+}
+
+// indexRuleKey returns the key that the version of the rule that the index was
+// built under is kept at.
+func indexRuleKey(idxKey []byte, rule Rule) []byte {
+	ruleKey := make([]byte, len(idxKey)+1)
+	copy(ruleKey, idxKey)
+	ruleKey[len(idxKey)] = byte(rule)
+	return ruleKey
+}
+
+// RuleVersion returns the version of the rule that the index was built under.
+// It's 0 if the index was never rebuilt for the rule.
+func (m *Manager) RuleVersion(indexer Indexer, rule Rule) (uint32, error) {
+	var version uint32
+	err := m.db.View(func(dbTx database.Tx) error {
+		rulesBucket := dbTx.Metadata().Bucket(indexRulesBucketName)
+		if rulesBucket == nil {
+			return nil
+		}
+		serialized := rulesBucket.Get(indexRuleKey(indexer.Key(), rule))
+		if len(serialized) == 4 {
+			version = byteOrder.Uint32(serialized)
+		}
+		return nil
+	})
+
+	return version, err
+}
+
+// RebuildStats returns the progress of the rebuild of the indexes.  It's nil if
+// no rebuild is in progress.
+//
+// This function is safe for concurrent access.
+func (m *Manager) RebuildStats() *RebuildStats {
+	m.rebuildMtx.Lock()
+	r := m.rebuild
+	m.rebuildMtx.Unlock()
+
+	if r == nil {
+		return nil
+	}
+
+	return r.stats()
+}
+
+// activeRebuild returns the rebuild in progress.  It's nil if there's none.
+//
+// This function is safe for concurrent access.
+func (m *Manager) activeRebuild() *rebuild {
+	m.rebuildMtx.Lock()
+	defer m.rebuildMtx.Unlock()
+
+	return m.rebuild
+}
+
+// loadRebuild returns the rebuild that was left unfinished.  It's nil if there
+// was none.
+func (m *Manager) loadRebuild() (*rebuild, error) {
+	var r *rebuild
+	err := m.db.View(func(dbTx database.Tx) error {
+		indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+		if indexesBucket == nil {
+			return nil
+		}
+
+		for _, indexer := range m.enabledIndexes {
+			serialized := indexesBucket.Get(indexRebuildKey(indexer.Key()))
+			if serialized == nil {
+				continue
+			}
+			change, phase, err := deserializeRebuildMarker(serialized)
+			if err != nil {
+				return err
+			}
+			if _, ok := indexer.(Rebuilder); !ok {
+				return AssertError(fmt.Sprintf("%s is marked as "+
+					"being rebuilt but can't be rebuilt",
+					indexer.Name()))
+			}
+
+			if r == nil {
+				r = &rebuild{change: change}
+			}
+			if r.change != change {
+				return AssertError(fmt.Sprintf("%s is being "+
+					"rebuilt for %v while the other indexes "+
+					"are rebuilt for %v", indexer.Name(),
+					change, r.change))
+			}
+			r.indexes = append(r.indexes, indexer)
+			r.phases = append(r.phases, phase)
+			r.heights = append(r.heights, -1)
+		}
+
+		return nil
+	})
+
+	return r, err
+}
+
+// startRebuild makes the gates of the indexes of the rebuild refuse fetches and
+// sets it as the rebuild in progress.
+func (m *Manager) startRebuild(r *rebuild) {
+	for _, indexer := range r.indexes {
+		indexer.(Rebuilder).rebuildGate().set(r, indexer.Name())
+	}
+
+	m.rebuildMtx.Lock()
+	m.rebuild = r
+	m.rebuildMtx.Unlock()
+}
+
+// RebuildAll drops all the enabled indexes whose entries depend on the changed
+// rule and creates them again under the new rule version.  The indexes are
+// caught up together by a single scan of the chain that reads each block once
+// and connects it to all of them.  They refuse fetches with a RebuildingError
+// until they all reach the tip and then start serving together.
+//
+// An interrupted rebuild is resumed by calling RebuildAll with the same change
+// or by initializing the manager again.  An error is returned if another
+// change is still being rebuilt for.
+func (m *Manager) RebuildAll(ctx context.Context, change RuleChange) error {
+	if m.chain == nil {
+		return AssertError("RebuildAll called before the index manager " +
+			"was initialized")
+	}
+
+	if !atomic.CompareAndSwapInt32(&m.rebuildRunning, 0, 1) {
+		return fmt.Errorf("a rebuild of the indexes is already running")
+	}
+	defer atomic.StoreInt32(&m.rebuildRunning, 0)
+
+	r, err := m.loadRebuild()
+	if err != nil {
+		return err
+	}
+	if r != nil && r.change != change {
+		return fmt.Errorf("the indexes are still being rebuilt for %v",
+			r.change)
+	}
+
+	if r == nil {
+		r = &rebuild{change: change}
+		for _, indexer := range m.enabledIndexes {
+			rebuilder, ok := indexer.(Rebuilder)
+			if !ok || !rebuilder.RebuildsOn(change) {
+				continue
+			}
+			r.indexes = append(r.indexes, indexer)
+			r.phases = append(r.phases, RebuildDropping)
+			r.heights = append(r.heights, -1)
+		}
+		if len(r.indexes) == 0 {
+			log.Infof("No index depends on %v", change)
+			return nil
+		}
+
+		// Mark all of the indexes as being rebuilt in one
+		// transaction so that they're either all rebuilt or none of
+		// them are.
+		m.startRebuild(r)
+		err = m.db.Update(func(dbTx database.Tx) error {
+			indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+			marker := serializeRebuildMarker(change, RebuildDropping)
+			for _, indexer := range r.indexes {
+				err := indexesBucket.Put(
+					indexRebuildKey(indexer.Key()), marker)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Infof("Resuming the rebuild of the indexes for %v", change)
+		m.startRebuild(r)
+	}
+
+	interrupt := ctx.Done()
+	err = m.dropRebuilding(r, interrupt)
+	if err != nil {
+		return err
+	}
+	err = m.scanRebuilding(r, interrupt)
+	if err != nil {
+		return err
+	}
+
+	return m.finishRebuild(r, interrupt)
+}
+
+// dropRebuilding drops the indexes of the rebuild that weren't dropped yet and
+// creates them again.
+func (m *Manager) dropRebuilding(r *rebuild, interrupt <-chan struct{}) error {
+	for i, indexer := range r.indexes {
+		if phase, _ := r.phaseOf(indexer); phase != RebuildDropping {
+			continue
+		}
+
+		// The undo blocks that the flat utreexo proof index keeps for
+		// the utreexo proof index are only dropped along with it.
+		if _, ok := indexer.(*FlatUtreexoProofIndex); ok {
+			dbIdx, _ := m.utreexoProofIndexes()
+			if _, rebuilt := r.phaseOf(dbIdx); dbIdx == nil || !rebuilt {
+				err := m.db.View(checkSharedUndoDrop)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		log.Infof("Dropping %s to rebuild it for %v", indexer.Name(),
+			r.change)
+		err := dropIndex(m.db, indexer.Key(), indexer.Name(),
+			m.ioLimiter, interrupt)
+		if err != nil {
+			return err
+		}
+		err = indexer.(Rebuilder).ResetIndex()
+		if err != nil {
+			return err
+		}
+
+		err = m.db.Update(func(dbTx database.Tx) error {
+			err := indexer.Create(dbTx)
+			if err != nil {
+				return err
+			}
+			err = dbPutIndexerTip(dbTx, indexer.Key(), &chainhash.Hash{}, -1)
+			if err != nil {
+				return err
+			}
+			err = m.recordSharedUndo(dbTx)
+			if err != nil {
+				return err
+			}
+
+			indexesBucket := dbTx.Metadata().Bucket(indexTipsBucketName)
+			return indexesBucket.Put(indexRebuildKey(indexer.Key()),
+				serializeRebuildMarker(r.change, RebuildScanning))
+		})
+		if err != nil {
+			return err
+		}
+
+		r.mtx.Lock()
+		r.phases[i] = RebuildScanning
+		r.heights[i] = -1
+		r.mtx.Unlock()
+	}
+
+	return nil
+}
+
+// rebuildTips returns the tips of the indexes of the rebuild.
+func (m *Manager) rebuildTips(r *rebuild) ([]chainhash.Hash, []int32, error) {
+	hashes := make([]chainhash.Hash, len(r.indexes))
+	heights := make([]int32, len(r.indexes))
+	err := m.db.View(func(dbTx database.Tx) error {
+		for i, indexer := range r.indexes {
+			hash, height, err := dbFetchIndexerTip(dbTx, indexer.Key())
+			if err != nil {
+				return err
+			}
+			hashes[i], heights[i] = *hash, height
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.mtx.Lock()
+	copy(r.heights, heights)
+	r.target = m.chain.BestSnapshot().Height
+	r.mtx.Unlock()
+
+	return hashes, heights, nil
+}
+
+// scanRebuilding catches the indexes of the rebuild up to the tip of the chain.
+// Each block is read once and connected to all of the indexes that it extends.
+// Blocks that are connected to the chain in the meantime are connected to the
+// indexes that reached the tip by ConnectBlock.
+func (m *Manager) scanRebuilding(r *rebuild, interrupt <-chan struct{}) error {
+	blockByHeight := m.blockByHeight
+	if blockByHeight == nil {
+		blockByHeight = m.chain.BlockByHeight
+	}
+
+	needsInputs := false
+	for _, indexer := range r.indexes {
+		needsInputs = needsInputs || indexNeedsInputs(indexer)
+	}
+
+	_, heights, err := m.rebuildTips(r)
+	if err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	if r.scanStart.IsZero() {
+		r.scanStart = time.Now()
+		r.scanFrom = r.scanHeight()
+	}
+	r.mtx.Unlock()
+
+	progressLogger := newBlockProgressLogger("Rebuilt", log)
+	for {
+		if interruptRequested(interrupt) {
+			return errInterruptRequested
+		}
+
+		lowest := heights[0]
+		for _, height := range heights[1:] {
+			if height < lowest {
+				lowest = height
+			}
+		}
+		if lowest >= m.chain.BestSnapshot().Height {
+			return nil
+		}
+
+		block, err := blockByHeight(lowest + 1)
+		if err != nil {
+			return err
+		}
+		r.mtx.Lock()
+		r.blocksRead++
+		r.mtx.Unlock()
+
+		err = m.ioLimiter.Wait(1, uint64(block.MsgBlock().SerializeSize()),
+			interrupt)
+		if err != nil {
+			return err
+		}
+
+		var spentTxos []blockchain.SpentTxOut
+		if needsInputs {
+			spentTxos, err = m.chain.FetchSpendJournal(block)
+			if err != nil {
+				return err
+			}
+		}
+		n, err := m.blockNotification(block, spentTxos, true)
+		if err != nil {
+			return err
+		}
+
+		// The block is connected to all of the indexes in one
+		// transaction so that they stay at the same height.  An index
+		// that the block doesn't extend any more because of a reorg
+		// is left for the next block that's read.
+		prevHash := &block.MsgBlock().Header.PrevBlock
+		err = m.db.Update(func(dbTx database.Tx) error {
+			for _, indexer := range r.indexes {
+				tipHash, _, err := dbFetchIndexerTip(dbTx, indexer.Key())
+				if err != nil {
+					return err
+				}
+				if !tipHash.IsEqual(prevHash) {
+					continue
+				}
+
+				err = dbIndexConnectBlock(dbTx, indexer, n)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		progressLogger.LogBlockHeight(block)
+
+		_, heights, err = m.rebuildTips(r)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// finishRebuild makes the indexes of the rebuild serve again once they're all
+// at the tip of the chain.  The rebuild markers are removed and the new rule
+// version is recorded in one transaction with checking the tips so that no
+// block is connected to the chain in between.
+func (m *Manager) finishRebuild(r *rebuild, interrupt <-chan struct{}) error {
+	for {
+		if interruptRequested(interrupt) {
+			return errInterruptRequested
+		}
+
+		var atTip bool
+		err := m.db.Update(func(dbTx database.Tx) error {
+			best := m.chain.BestSnapshot()
+			for _, indexer := range r.indexes {
+				tipHash, _, err := dbFetchIndexerTip(dbTx, indexer.Key())
+				if err != nil {
+					return err
+				}
+				if !tipHash.IsEqual(&best.Hash) {
+					return nil
+				}
+			}
+			atTip = true
+
+			meta := dbTx.Metadata()
+			rulesBucket, err := meta.CreateBucketIfNotExists(
+				indexRulesBucketName)
+			if err != nil {
+				return err
+			}
+			indexesBucket := meta.Bucket(indexTipsBucketName)
+			var version [4]byte
+			byteOrder.PutUint32(version[:], r.change.Version)
+			for _, indexer := range r.indexes {
+				err := rulesBucket.Put(indexRuleKey(indexer.Key(),
+					r.change.Rule), version[:])
+				if err != nil {
+					return err
+				}
+				err = indexesBucket.Delete(indexRebuildKey(indexer.Key()))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if atTip {
+			break
+		}
+
+		// A block was connected to the chain while the tips were
+		// checked.  Catch up with it.
+		err = m.scanRebuilding(r, interrupt)
+		if err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Flip all of the indexes live together.
+	atomic.StoreInt32(&r.live, 1)
+	m.rebuildMtx.Lock()
+	m.rebuild = nil
+	m.rebuildMtx.Unlock()
+
+	log.Infof("Rebuilt %d indexes for %v", len(r.indexes), r.change)
+	return nil
+}
+
+// connectRebuilding returns whether ConnectBlock must connect the block to the
+// given index.  The indexes that are being dropped are skipped and so are the
+// ones that the scan hasn't caught up to the block yet.
+func (m *Manager) connectRebuilding(dbTx database.Tx, indexer Indexer,
+	block *btcutil.Block) (bool, error) {
+
+	r := m.activeRebuild()
+	if r == nil {
+		return true, nil
+	}
+	phase, ok := r.phaseOf(indexer)
+	if !ok {
+		return true, nil
+	}
+	if phase == RebuildDropping {
+		return false, nil
+	}
+
+	tipHash, _, err := dbFetchIndexerTip(dbTx, indexer.Key())
+	if err != nil {
+		return false, err
+	}
+
+	return tipHash.IsEqual(&block.MsgBlock().Header.PrevBlock), nil
+}
+
+// disconnectRebuilding returns whether DisconnectBlock must disconnect the
+// block from the given index.  The indexes that are being dropped are skipped
+// and so are the ones that the scan hasn't caught up to the block yet.
+func (m *Manager) disconnectRebuilding(dbTx database.Tx, indexer Indexer,
+	block *btcutil.Block) (bool, error) {
+
+	r := m.activeRebuild()
+	if r == nil {
+		return true, nil
+	}
+	phase, ok := r.phaseOf(indexer)
+	if !ok {
+		return true, nil
+	}
+	if phase == RebuildDropping {
+		return false, nil
+	}
+
+	tipHash, _, err := dbFetchIndexerTip(dbTx, indexer.Key())
+	if err != nil {
+		return false, err
+	}
+
+	return tipHash.IsEqual(block.Hash()), nil
+}
+
+// resetUtreexoState returns an empty utreexo state in place of the given one.
+// The saved state is deleted.
+func resetUtreexoState(uState *UtreexoState) (*UtreexoState, error) {
+	err := deleteUtreexoState(utreexoBasePath(uState.config))
+	if err != nil {
+		return nil, err
+	}
+
+	return InitUtreexoState(uState.config)
+}
+
+// RebuildsOn returns true as every utreexo rule changes the proofs.
+//
+// This is part of the Rebuilder interface.
+func (idx *FlatUtreexoProofIndex) RebuildsOn(change RuleChange) bool {
+	return true
+}
+
+// ResetIndex empties the flat files and the utreexo state of the index.
+//
+// This is part of the Rebuilder interface.
+func (idx *FlatUtreexoProofIndex) ResetIndex() error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	for _, ff := range []*FlatFileState{&idx.proofState, &idx.undoState,
+		&idx.rememberIdxState, &idx.proofStatsState} {
+
+		err := ff.truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := idx.coinAge.truncate(0)
+	if err != nil {
+		return err
+	}
+	err = idx.proofCost.truncate(0)
+	if err != nil {
+		return err
+	}
+	err = idx.lowerUntaggedUndoTip(0)
+	if err != nil {
+		return err
+	}
+	idx.lastUndoHeight = -1
+	idx.lastUndoBytes = nil
+	idx.pStats = proofStats{}
+
+	// The proofs of every block are stored again as they're reconnected.
+	err = writePrunedHeights(idx.prunedPath(), pruneHeights{})
+	if err != nil {
+		return err
+	}
+	idx.prune.set(pruneHeights{})
+
+	idx.utreexoState, err = resetUtreexoState(idx.utreexoState)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&idx.durableHeight, idx.proofState.BestHeight())
+
+	return nil
+}
+
+// rebuildGate returns the gate that refuses the fetches of the index while it's
+// being rebuilt.
+//
+// This is part of the Rebuilder interface.
+func (idx *FlatUtreexoProofIndex) rebuildGate() *rebuildGate {
+	return &idx.gate
+}
+
+// RebuildsOn returns true as every utreexo rule changes the proofs.
+//
+// This is part of the Rebuilder interface.
+func (idx *UtreexoProofIndex) RebuildsOn(change RuleChange) bool {
+	return true
+}
+
+// ResetIndex empties the utreexo state of the index.
+//
+// This is part of the Rebuilder interface.
+func (idx *UtreexoProofIndex) ResetIndex() error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	uState, err := resetUtreexoState(idx.utreexoState)
+	if err != nil {
+		return err
+	}
+	idx.utreexoState = uState
+
+	// The proofs of every block are stored again as they're reconnected.
+	idx.prune.set(pruneHeights{})
+	idx.proofCache.clear()
+
+	return nil
+}
+
+// rebuildGate returns the gate that refuses the fetches of the index while it's
+// being rebuilt.
+//
+// This is part of the Rebuilder interface.
+func (idx *UtreexoProofIndex) rebuildGate() *rebuildGate {
+	return &idx.gate
+}
+
+// RebuildsOn returns whether the change is to the leaf eligibility as that
+// decides which spent outputs get a time to live.
+//
+// This is part of the Rebuilder interface.
+func (idx *TTLIndex) RebuildsOn(change RuleChange) bool {
+	return change.Rule == RuleLeafEligibility
+}
+
+// ResetIndex does nothing as the index keeps everything in its bucket.
+//
+// This is part of the Rebuilder interface.
+func (idx *TTLIndex) ResetIndex() error {
+	return nil
+}
+
+// rebuildGate returns the gate that refuses the fetches of the index while it's
+// being rebuilt.
+//
+// This is part of the Rebuilder interface.
+func (idx *TTLIndex) rebuildGate() *rebuildGate {
+	return &idx.gate
+}
+
+// Rebuilding returns a RebuildingError while the index is being rebuilt.  The
+// time to live values returned by GetTTL in the meantime are incomplete.
+//
+// This function is safe for concurrent access.
+func (idx *TTLIndex) Rebuilding() error {
+	return idx.gate.check()
+}
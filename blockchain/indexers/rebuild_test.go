@@ -0,0 +1,304 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// fakeRebuilder is a Rebuilder that keeps the hash of every block it's
+// connected to in its bucket.  It's rebuilt when rule changes.
+type fakeRebuilder struct {
+	key    []byte
+	rule   Rule
+	resets int
+	gate   rebuildGate
+}
+
+func (idx *fakeRebuilder) Key() []byte  { return idx.key }
+func (idx *fakeRebuilder) Name() string { return string(idx.key) + " index" }
+func (idx *fakeRebuilder) Init() error  { return nil }
+
+func (idx *fakeRebuilder) Create(dbTx database.Tx) error {
+	_, err := dbTx.Metadata().CreateBucket(idx.key)
+	return err
+}
+
+func (idx *fakeRebuilder) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	block := n.Block
+	var height [4]byte
+	byteOrder.PutUint32(height[:], uint32(block.Height()))
+	return dbTx.Metadata().Bucket(idx.key).Put(height[:], block.Hash()[:])
+}
+
+func (idx *fakeRebuilder) DisconnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	block := n.Block
+	var height [4]byte
+	byteOrder.PutUint32(height[:], uint32(block.Height()))
+	return dbTx.Metadata().Bucket(idx.key).Delete(height[:])
+}
+
+func (idx *fakeRebuilder) RebuildsOn(change RuleChange) bool {
+	return change.Rule == idx.rule
+}
+
+func (idx *fakeRebuilder) ResetIndex() error {
+	idx.resets++
+	return nil
+}
+
+func (idx *fakeRebuilder) rebuildGate() *rebuildGate {
+	return &idx.gate
+}
+
+// entries returns the number of blocks in the bucket of the index whose hash
+// is the one of the block at that height of the main chain.
+func (idx *fakeRebuilder) entries(db database.DB, chain *blockchain.BlockChain) (int, error) {
+	var entries int
+	err := db.View(func(dbTx database.Tx) error {
+		return dbTx.Metadata().Bucket(idx.key).ForEach(func(k, v []byte) error {
+			hash, err := chain.BlockHashByHeight(int32(byteOrder.Uint32(k)))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(hash[:], v) {
+				return errors.New("entry of a block off the main chain")
+			}
+			entries++
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+func TestRebuildMarkerSerialize(t *testing.T) {
+	change := RuleChange{Rule: RuleLeafHasher, Version: 0x01020304}
+	serialized := serializeRebuildMarker(change, RebuildScanning)
+
+	gotChange, gotPhase, err := deserializeRebuildMarker(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotChange != change || gotPhase != RebuildScanning {
+		t.Fatalf("expected %v %v, got %v %v", change, RebuildScanning,
+			gotChange, gotPhase)
+	}
+
+	_, _, err = deserializeRebuildMarker(serialized[:5])
+	if dbErr, ok := err.(database.Error); !ok ||
+		dbErr.ErrorCode != database.ErrCorruption {
+
+		t.Fatalf("expected a corruption error, got %v", err)
+	}
+}
+
+func TestRebuildAll(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestRebuildAll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	// The ttl index and the first two fake indexes depend on the leaf
+	// eligibility while the last one doesn't.
+	ttlIdx := NewTTLIndex(db, &params)
+	first := &fakeRebuilder{key: []byte("first"), rule: RuleLeafEligibility}
+	second := &fakeRebuilder{key: []byte("second"), rule: RuleLeafEligibility}
+	other := &fakeRebuilder{key: []byte("other"), rule: RuleLeafHasher}
+	rebuilt := []Rebuilder{ttlIdx, first, second}
+
+	m := NewManager(db, []Indexer{ttlIdx, first, second, other})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numBlocks = 10
+	var spends []*blockchain.SpendableOut
+	block := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < numBlocks; b++ {
+		block, spends = blockchain.AddBlock(chain, block, spends)
+	}
+
+	// gatesClosed returns an error unless all of the rebuilt indexes
+	// refuse fetches.
+	gatesClosed := func() error {
+		for _, idx := range rebuilt {
+			var rErr *RebuildingError
+			if !errors.As(idx.rebuildGate().check(), &rErr) {
+				return errors.New("expected the gate to be closed")
+			}
+		}
+		return nil
+	}
+
+	// Interrupt the rebuild half way through the scan.
+	const interruptHeight = 5
+	change := RuleChange{Rule: RuleLeafEligibility, Version: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	var fetches int
+	var gateErr error
+	m.blockByHeight = func(height int32) (*btcutil.Block, error) {
+		fetches++
+		if err := gatesClosed(); err != nil && gateErr == nil {
+			gateErr = err
+		}
+		if height == interruptHeight {
+			cancel()
+		}
+		return chain.BlockByHeight(height)
+	}
+	err = m.RebuildAll(ctx, change)
+	if err != errInterruptRequested {
+		t.Fatalf("expected the rebuild to be interrupted, got %v", err)
+	}
+	if gateErr != nil {
+		t.Fatal(gateErr)
+	}
+	if fetches != interruptHeight+1 {
+		t.Fatalf("expected %d fetches, got %d", interruptHeight+1, fetches)
+	}
+
+	// The rebuild stays marked and the indexes keep refusing fetches.
+	if err := gatesClosed(); err != nil {
+		t.Fatal(err)
+	}
+	if other.gate.check() != nil {
+		t.Fatal("expected the unaffected index to serve")
+	}
+	stats := m.RebuildStats()
+	if stats == nil || stats.Height != interruptHeight ||
+		stats.TargetHeight != numBlocks || len(stats.Indexes) != 3 {
+
+		t.Fatalf("unexpected rebuild stats %+v", stats)
+	}
+	r, err := m.loadRebuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.change != change || len(r.indexes) != 3 {
+		t.Fatalf("expected the rebuild of 3 indexes to be marked, got %+v", r)
+	}
+	for _, phase := range r.phases {
+		if phase != RebuildScanning {
+			t.Fatalf("expected the indexes to be scanning, got %v", phase)
+		}
+	}
+
+	// Another change can't be rebuilt for until the rebuild finishes.
+	err = m.RebuildAll(context.Background(),
+		RuleChange{Rule: RuleLeafHasher, Version: 1})
+	if err == nil {
+		t.Fatal("expected another change to be refused")
+	}
+
+	// Blocks connected in the meantime are left for the scan.
+	const extraBlocks = 2
+	for b := 0; b < extraBlocks; b++ {
+		block, spends = blockchain.AddBlock(chain, block, spends)
+	}
+	bestHeight := chain.BestSnapshot().Height
+
+	// Resuming reads every other block once and flips all of the indexes
+	// live together.
+	m.blockByHeight = func(height int32) (*btcutil.Block, error) {
+		fetches++
+		if err := gatesClosed(); err != nil && gateErr == nil {
+			gateErr = err
+		}
+		return chain.BlockByHeight(height)
+	}
+	err = m.RebuildAll(context.Background(), change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gateErr != nil {
+		t.Fatal(gateErr)
+	}
+	if fetches != int(bestHeight)+1 {
+		t.Fatalf("expected %d fetches, got %d", bestHeight+1, fetches)
+	}
+	for _, idx := range rebuilt {
+		if err := idx.rebuildGate().check(); err != nil {
+			t.Fatalf("expected the gate to be open, got %v", err)
+		}
+	}
+	if m.RebuildStats() != nil {
+		t.Fatal("expected no rebuild in progress")
+	}
+	if first.resets != 1 || second.resets != 1 || other.resets != 0 {
+		t.Fatalf("unexpected resets %d %d %d", first.resets,
+			second.resets, other.resets)
+	}
+
+	for _, idx := range []Indexer{ttlIdx, first, second, other} {
+		var height int32
+		err := db.View(func(dbTx database.Tx) error {
+			_, height, err = dbFetchIndexerTip(dbTx, idx.Key())
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != bestHeight {
+			t.Fatalf("expected %s at height %d, got %d", idx.Name(),
+				bestHeight, height)
+		}
+
+		want := change.Version
+		if idx == other {
+			want = 0
+		}
+		version, err := m.RuleVersion(idx, change.Rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != want {
+			t.Fatalf("expected %s at rule version %d, got %d",
+				idx.Name(), want, version)
+		}
+	}
+	for _, idx := range []*fakeRebuilder{first, second, other} {
+		entries, err := idx.entries(db, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries != int(bestHeight)+1 {
+			t.Fatalf("expected %d entries in %s, got %d",
+				bestHeight+1, idx.Name(), entries)
+		}
+	}
+}
@@ -0,0 +1,902 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// DefaultRecoverySampleInterval is the default of how often in blocks
+	// the proofs of a rebuilt index are verified against the accumulator
+	// roots.
+	DefaultRecoverySampleInterval = 10
+
+	// defaultRecoveryBatch is how many blocks are rebuilt in a single
+	// database transaction.
+	defaultRecoveryBatch = 2000
+)
+
+// RecoveryMode is what the index manager does on start up when one of the
+// utreexo proof indexes is empty while the other one covers the chain.
+type RecoveryMode uint8
+
+const (
+	// RecoveryPrompt logs that the empty index is able to be rebuilt from
+	// the other one and catches it up by connecting every block to it.
+	RecoveryPrompt RecoveryMode = iota
+
+	// RecoveryAuto rebuilds the empty index from the entries and the
+	// utreexo state of the other one.
+	RecoveryAuto
+
+	// RecoveryOff catches the empty index up by connecting every block to
+	// it without saying anything.
+	RecoveryOff
+)
+
+// String returns the RecoveryMode in human-readable form.
+func (mode RecoveryMode) String() string {
+	switch mode {
+	case RecoveryPrompt:
+		return "prompt"
+	case RecoveryAuto:
+		return "auto"
+	case RecoveryOff:
+		return "off"
+	default:
+		return fmt.Sprintf("unknown recovery mode %d", uint8(mode))
+	}
+}
+
+// ParseRecoveryMode returns the recovery mode with the given name.  An empty
+// name is RecoveryPrompt.
+func ParseRecoveryMode(s string) (RecoveryMode, error) {
+	switch s {
+	case "", "prompt":
+		return RecoveryPrompt, nil
+	case "auto":
+		return RecoveryAuto, nil
+	case "off":
+		return RecoveryOff, nil
+	}
+
+	return 0, fmt.Errorf("invalid recovery mode %q: expected auto, "+
+		"prompt, or off", s)
+}
+
+// IndexRecoveryStats are the progress of rebuilding a utreexo proof index from
+// the entries of the other one on start up.
+type IndexRecoveryStats struct {
+	// Source is the name of the index that the entries are taken from.
+	Source string
+
+	// Height is the height up to which the entries were rebuilt and
+	// TipHeight is the height of the tip of the source.
+	Height    int32
+	TipHeight int32
+
+	// SampleInterval is how often in blocks the rebuilt proofs within the
+	// last VerifyDepth blocks are verified against the accumulator roots
+	// and Verified is how many were.  Every rebuilt entry is checked
+	// against its block regardless.
+	SampleInterval int32
+	VerifyDepth    int32
+	Verified       int32
+
+	// Done is whether the index was rebuilt and Elapsed is how long it
+	// took so far.
+	Done    bool
+	Elapsed time.Duration
+}
+
+// recoveryProgress keeps the progress of rebuilding an index from the other
+// one.
+type recoveryProgress struct {
+	mtx   sync.Mutex
+	start time.Time
+	stats *IndexRecoveryStats
+}
+
+// begin starts keeping the progress of rebuilding the index.
+func (p *recoveryProgress) begin(stats IndexRecoveryStats) {
+	p.mtx.Lock()
+	p.start = time.Now()
+	p.stats = &stats
+	p.mtx.Unlock()
+}
+
+// update calls fn with the stats to change them.
+func (p *recoveryProgress) update(fn func(stats *IndexRecoveryStats)) {
+	p.mtx.Lock()
+	fn(p.stats)
+	p.stats.Elapsed = time.Since(p.start)
+	p.mtx.Unlock()
+}
+
+// snapshot returns a copy of the stats.  It's nil if the index wasn't rebuilt
+// from the other one.
+//
+// This function is safe for concurrent access.
+func (p *recoveryProgress) snapshot() *IndexRecoveryStats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.stats == nil {
+		return nil
+	}
+	stats := *p.stats
+	return &stats
+}
+
+// recoverable is a utreexo proof index that's able to be rebuilt from the
+// entries and the utreexo state of another one.
+type recoverable interface {
+	proofStore
+	Rebuilder
+
+	// isLost returns whether the entries of the index are missing even
+	// though its tip is at the given height.
+	isLost(tip int32) bool
+
+	// accumulatorState returns the utreexo state of the index and the
+	// mutex that protects it.
+	accumulatorState() (*UtreexoState, *sync.RWMutex)
+
+	// storeRecovered stores the serialized proof and the undo block taken
+	// from the other index for the block.
+	storeRecovered(dbTx database.Tx, id *BlockID, ud *wire.UData,
+		proof []byte, undoBlock *accumulator.UndoBlock) error
+
+	// syncRecovered writes out everything that was rebuilt up to the given
+	// height so that the rebuild can be resumed from there.
+	syncRecovered(height int32) error
+
+	// resumeRecovery deletes what was rebuilt past the given height so
+	// that the rebuild can be resumed from there.
+	resumeRecovery(height int32) error
+
+	// finishRecovery makes the forest the utreexo state of the index and
+	// writes out everything that was rebuilt.
+	finishRecovery(forest *accumulator.Forest, tip int32) error
+
+	// recoveryProgress returns where the progress of rebuilding the
+	// index is kept.
+	recoveryProgress() *recoveryProgress
+}
+
+// Ensure the utreexo proof indexes implement the recoverable interface.
+var _ recoverable = (*FlatUtreexoProofIndex)(nil)
+var _ recoverable = (*UtreexoProofIndex)(nil)
+
+// isLost returns whether the flat files of the index are empty even though
+// its tip is past the genesis block, as when they were deleted while the
+// database was kept.
+//
+// This is part of the recoverable interface.
+func (idx *FlatUtreexoProofIndex) isLost(tip int32) bool {
+	return tip > 0 && idx.proofState.BestHeight() <= 0 &&
+		idx.undoState.BestHeight() <= 0
+}
+
+// isLost returns whether the utreexo state of the index is empty even though
+// its tip is past the genesis block, as when it was deleted while the database
+// was kept.
+//
+// This is part of the recoverable interface.
+func (idx *UtreexoProofIndex) isLost(tip int32) bool {
+	if tip <= 0 {
+		return false
+	}
+
+	idx.mtx.RLock()
+	numLeaves, err := idx.utreexoState.NumLeaves()
+	idx.mtx.RUnlock()
+
+	return err != nil || numLeaves == 0
+}
+
+// accumulatorState returns the utreexo state of the index and the mutex that
+// protects it.
+//
+// This is part of the recoverable interface.
+func (idx *FlatUtreexoProofIndex) accumulatorState() (*UtreexoState, *sync.RWMutex) {
+	return idx.utreexoState, idx.mtx
+}
+
+// accumulatorState returns the utreexo state of the index and the mutex that
+// protects it.
+//
+// This is part of the recoverable interface.
+func (idx *UtreexoProofIndex) accumulatorState() (*UtreexoState, *sync.RWMutex) {
+	return idx.utreexoState, idx.mtx
+}
+
+// storeRecovered stores the proof and the undo block for the block in the flat
+// files the same as connecting the block would.
+//
+// This is part of the recoverable interface.
+func (idx *FlatUtreexoProofIndex) storeRecovered(dbTx database.Tx, id *BlockID,
+	ud *wire.UData, proof []byte, undoBlock *accumulator.UndoBlock) error {
+
+	idx.pStats.UpdateTotalDelCount(uint64(len(ud.LeafDatas)))
+	idx.pStats.UpdateUDStats(false, ud)
+
+	err := idx.storeUndoBlock(id.Height, *undoBlock)
+	if err != nil {
+		return err
+	}
+
+	return idx.proofState.StoreData(id.Height, proof)
+}
+
+// storeRecovered stores the proof and the undo block for the block in the
+// database the same as connecting the block would.
+//
+// This is part of the recoverable interface.
+func (idx *UtreexoProofIndex) storeRecovered(dbTx database.Tx, id *BlockID,
+	ud *wire.UData, proof []byte, undoBlock *accumulator.UndoBlock) error {
+
+	proofBucket := dbTx.Metadata().Bucket(utreexoParentBucketKey).Bucket(utreexoProofIndexKey)
+	err := proofBucket.Put(id.Hash[:], proof)
+	if err != nil {
+		return err
+	}
+
+	return idx.storeUndoEntry(dbTx, &id.Hash, undoBlock)
+}
+
+// syncRecovered writes the proof statistics as of the given height and syncs
+// the flat files to disk.
+//
+// This is part of the recoverable interface.
+func (idx *FlatUtreexoProofIndex) syncRecovered(height int32) error {
+	idx.pStats.BlockHeight = uint64(height)
+	err := idx.pStats.WritePStats(&idx.proofStatsState)
+	if err != nil {
+		return err
+	}
+	for _, cf := range idx.classedFlatFiles() {
+		err := cf.ff.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncRecovered does nothing as the entries are stored in the database
+// transaction of their batch.
+//
+// This is part of the recoverable interface.
+func (idx *UtreexoProofIndex) syncRecovered(height int32) error {
+	return nil
+}
+
+// resumeRecovery truncates the flat files to the given height as the entries
+// past it may have been written before the rebuild was interrupted.
+//
+// This is part of the recoverable interface.
+func (idx *FlatUtreexoProofIndex) resumeRecovery(height int32) error {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	return idx.truncateFlatFiles(height)
+}
+
+// resumeRecovery does nothing as the entries past the given height are only
+// ever stored again with the same contents.
+//
+// This is part of the recoverable interface.
+func (idx *UtreexoProofIndex) resumeRecovery(height int32) error {
+	return nil
+}
+
+// finishRecovery makes the forest the utreexo state of the index and syncs the
+// flat files and the utreexo state to disk.
+//
+// This is part of the recoverable interface.
+func (idx *FlatUtreexoProofIndex) finishRecovery(forest *accumulator.Forest,
+	tip int32) error {
+
+	idx.mtx.Lock()
+	err := idx.utreexoState.setForest(forest,
+		utreexoBasePath(idx.utreexoState.config))
+	idx.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	idx.pStats.BlockHeight = uint64(tip)
+	err = idx.pStats.WritePStats(&idx.proofStatsState)
+	if err != nil {
+		return err
+	}
+	for _, cf := range idx.classedFlatFiles() {
+		err := cf.ff.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	return idx.FlushUtreexoState()
+}
+
+// finishRecovery makes the forest the utreexo state of the index and flushes it
+// to disk.
+//
+// This is part of the recoverable interface.
+func (idx *UtreexoProofIndex) finishRecovery(forest *accumulator.Forest,
+	tip int32) error {
+
+	idx.mtx.Lock()
+	err := idx.utreexoState.setForest(forest,
+		utreexoBasePath(idx.utreexoState.config))
+	idx.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return idx.FlushUtreexoState()
+}
+
+// recoveryProgress returns where the progress of rebuilding the index is kept.
+//
+// This is part of the recoverable interface.
+func (idx *FlatUtreexoProofIndex) recoveryProgress() *recoveryProgress {
+	return &idx.recovery
+}
+
+// recoveryProgress returns where the progress of rebuilding the index is kept.
+//
+// This is part of the recoverable interface.
+func (idx *UtreexoProofIndex) recoveryProgress() *recoveryProgress {
+	return &idx.recovery
+}
+
+// SetIndexRecovery sets what's done on start up when one of the utreexo proof
+// indexes is empty while the other one covers the chain, and how often in
+// blocks the proofs of a rebuilt index are verified against the accumulator
+// roots.  A sample interval of 0 is DefaultRecoverySampleInterval.  It must be
+// called before the manager is initialized.
+func (m *Manager) SetIndexRecovery(mode RecoveryMode, sampleInterval int32) {
+	if sampleInterval <= 0 {
+		sampleInterval = DefaultRecoverySampleInterval
+	}
+	m.recoveryMode = mode
+	m.recoverySample = sampleInterval
+}
+
+// indexRecovery is an empty utreexo proof index that's able to be rebuilt from
+// the other one.
+type indexRecovery struct {
+	dest   recoverable
+	source recoverable
+
+	// migration is the direction that the index is migrated in when it
+	// was asked for rather than being rebuilt because it's empty.  The
+	// height that it got up to is then recorded after every batch and
+	// resume is the height that an interrupted migration is resumed from.
+	migration MigrationDirection
+	resume    int32
+}
+
+// startOverLostIndexes sets the tips of the utreexo proof indexes whose entries
+// are missing back to before the genesis block so that they're caught up again.
+// The returned recovery is the index that's empty while the other one isn't.
+// It's nil if there's none.
+func (m *Manager) startOverLostIndexes() (*indexRecovery, error) {
+	dbIdx, flatIdx := m.utreexoProofIndexes()
+
+	if dbIdx == nil || flatIdx == nil {
+		return nil, nil
+	}
+
+	var empty, full []recoverable
+	for _, idx := range []recoverable{dbIdx, flatIdx} {
+		var tip int32
+		err := m.db.View(func(dbTx database.Tx) error {
+			var err error
+			_, tip, err = dbFetchIndexerTip(dbTx, idx.Key())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if idx.isLost(tip) {
+			log.Warnf("The %s is missing its entries for its tip at "+
+				"height %d.  Starting it over", idx.Name(), tip)
+			err := m.db.Update(func(dbTx database.Tx) error {
+				return dbPutIndexerTip(dbTx, idx.Key(),
+					&chainhash.Hash{}, -1)
+			})
+			if err != nil {
+				return nil, err
+			}
+			tip = -1
+		}
+
+		if tip <= 0 {
+			empty = append(empty, idx)
+		} else {
+			full = append(full, idx)
+		}
+	}
+	if len(empty) != 1 || len(full) != 1 {
+		return nil, nil
+	}
+
+	return &indexRecovery{dest: empty[0], source: full[0]}, nil
+}
+
+// recoveryBlocker returns why the empty index can't be rebuilt from the other
+// one.  It's nil if it can.
+func (m *Manager) recoveryBlocker(r *indexRecovery) error {
+	if m.activeRebuild() != nil {
+		return errors.New("the indexes are being rebuilt for a " +
+			"utreexo rule change")
+	}
+
+	dbIdx, flatIdx := m.utreexoProofIndexes()
+	if flatIdx.proofGenInterVal != 1 {
+		return fmt.Errorf("the %s generates its proofs every %d "+
+			"blocks", flatIdx.Name(), flatIdx.proofGenInterVal)
+	}
+	if r.dest == recoverable(flatIdx) && dbIdx.SharedUndo() {
+		return ErrSharedUndoStoreMissing
+	}
+
+	for _, idx := range []recoverable{r.dest, r.source} {
+		uState, _ := idx.accumulatorState()
+		if uState.config.Type != RamForest {
+			return fmt.Errorf("the utreexo state of the %s isn't "+
+				"kept in memory", idx.Name())
+		}
+	}
+
+	// The entries of the source are only of use if they were made under
+	// the same rules.
+	for _, rule := range []Rule{RuleLeafEligibility,
+		RuleCanonicalOrdering, RuleLeafHasher} {
+
+		destVersion, err := m.RuleVersion(r.dest, rule)
+		if err != nil {
+			return err
+		}
+		sourceVersion, err := m.RuleVersion(r.source, rule)
+		if err != nil {
+			return err
+		}
+		if destVersion != sourceVersion {
+			return fmt.Errorf("the %s was built under %v version "+
+				"%d and the %s under version %d", r.source.Name(),
+				rule, sourceVersion, r.dest.Name(), destVersion)
+		}
+	}
+
+	return nil
+}
+
+// maybeRecover rebuilds the empty index from the other one when the recovery
+// mode allows it.  The index is left empty to be caught up by connecting every
+// block to it if it can't be rebuilt.
+func (m *Manager) maybeRecover(r *indexRecovery, interrupt <-chan struct{}) error {
+	if r == nil || m.recoveryMode == RecoveryOff {
+		return nil
+	}
+
+	var sourceTip int32
+	err := m.db.View(func(dbTx database.Tx) error {
+		var err error
+		_, sourceTip, err = dbFetchIndexerTip(dbTx, r.source.Key())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sourceTip <= 0 {
+		return nil
+	}
+
+	if err := m.recoveryBlocker(r); err != nil {
+		log.Infof("The %s is empty but can't be rebuilt from the %s "+
+			"at height %d: %v", r.dest.Name(), r.source.Name(),
+			sourceTip, err)
+		return nil
+	}
+
+	if m.recoveryMode == RecoveryPrompt {
+		log.Infof("The %s is empty while the %s covers the chain up to "+
+			"height %d.  Enable the automatic recovery of the utreexo "+
+			"proof indexes to rebuild it from the %s instead of "+
+			"connecting every block to it", r.dest.Name(),
+			r.source.Name(), sourceTip, r.source.Name())
+		return nil
+	}
+
+	err = m.recoverIndex(r, sourceTip, interrupt)
+	if err == nil || errors.Is(err, errInterruptRequested) {
+		return err
+	}
+
+	// Whatever was rebuilt is thrown away so that the index is caught up
+	// from an empty state.
+	log.Warnf("Unable to rebuild the %s from the %s: %v.  Connecting "+
+		"every block to it instead", r.dest.Name(), r.source.Name(), err)
+	return r.dest.ResetIndex()
+}
+
+// recoverIndex rebuilds the empty index from the entries and the utreexo state
+// of the other one up to its tip.  Every entry is checked against the block of
+// the main chain that it's for and the proofs of every sample interval blocks
+// within the last maxSnapshotDepth blocks are verified against the accumulator
+// roots before them.  The tip of the index is only set once everything was
+// rebuilt.
+func (m *Manager) recoverIndex(r *indexRecovery, tip int32,
+	interrupt <-chan struct{}) error {
+
+	dest, source := r.dest, r.source
+	verifyDepth := int32(maxSnapshotDepth)
+	if verifyDepth > tip {
+		verifyDepth = tip
+	}
+	progress := dest.recoveryProgress()
+	progress.begin(IndexRecoveryStats{
+		Source:         source.Name(),
+		Height:         r.resume,
+		TipHeight:      tip,
+		SampleInterval: m.recoverySample,
+		VerifyDepth:    verifyDepth,
+	})
+	log.Infof("Rebuilding the %s from the %s up to height %d.  The "+
+		"proofs of every %d blocks within the last %d are verified "+
+		"against the accumulator roots", dest.Name(), source.Name(),
+		tip, m.recoverySample, verifyDepth)
+
+	// Start from empty entries and state in case a previous attempt was
+	// interrupted.  A migration was already started over or is resumed.
+	if r.migration == MigrateNone {
+		err := dest.ResetIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, flatIdx := m.utreexoProofIndexes()
+	schedule := flatIdx.chainParams.LeafCommitments
+	progressLogger := newBlockProgressLogger("Recovered", log)
+	for start := r.resume + 1; start <= tip; start += m.recoveryBatch {
+		end := start + m.recoveryBatch - 1
+		if end > tip {
+			end = tip
+		}
+
+		// The entries are fetched from the source before the database
+		// transaction that stores them as the source reads them in
+		// transactions of its own.
+		entries := make([]*recoveredEntry, 0, end-start+1)
+		for height := start; height <= end; height++ {
+			block, err := m.chain.BlockByHeight(height)
+			if err != nil {
+				return err
+			}
+			entry, err := m.fetchRecovered(r.source, block, schedule)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			progressLogger.LogBlockHeight(block)
+		}
+		err := m.db.Update(func(dbTx database.Tx) error {
+			for _, entry := range entries {
+				err := storeRecoveredEntry(dbTx, r, entry)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if r.migration != MigrateNone {
+			err := m.recordMigration(r, &entries[len(entries)-1].id)
+			if err != nil {
+				return err
+			}
+		}
+		progress.update(func(stats *IndexRecoveryStats) {
+			stats.Height = end
+		})
+
+		if interruptRequested(interrupt) {
+			return errInterruptRequested
+		}
+	}
+
+	// Copy the utreexo state and verify the sampled proofs with another
+	// copy of it that's rolled back with the rebuilt undo blocks.
+	forest, err := copyUtreexoState(source, dest)
+	if err != nil {
+		return err
+	}
+	uState, _ := dest.accumulatorState()
+	scratch, err := restoreUtreexoState(uState.config,
+		utreexoBasePath(uState.config))
+	if err != nil {
+		return err
+	}
+	err = m.verifyRecovered(dest, scratch, tip, verifyDepth, schedule,
+		progress)
+	if err != nil {
+		return err
+	}
+
+	err = dest.finishRecovery(forest, tip)
+	if err != nil {
+		return err
+	}
+	tipHash, err := m.chain.BlockHashByHeight(tip)
+	if err != nil {
+		return err
+	}
+	err = m.db.Update(func(dbTx database.Tx) error {
+		if r.migration != MigrateNone {
+			err := dbDeleteMigration(dbTx)
+			if err != nil {
+				return err
+			}
+		}
+		return dbPutIndexerTip(dbTx, dest.Key(), tipHash, tip)
+	})
+	if err != nil {
+		return err
+	}
+
+	progress.update(func(stats *IndexRecoveryStats) {
+		stats.Done = true
+	})
+	stats := progress.snapshot()
+	log.Infof("Rebuilt the %s from the %s up to height %d in %v with %d "+
+		"proofs verified against the accumulator roots", dest.Name(),
+		source.Name(), tip, stats.Elapsed.Round(time.Millisecond),
+		stats.Verified)
+
+	return nil
+}
+
+// recoveredEntry is what the source keeps for a block that's stored in the
+// index that's rebuilt from it.
+type recoveredEntry struct {
+	id        BlockID
+	ud        *wire.UData
+	proof     []byte
+	undoBlock *accumulator.UndoBlock
+}
+
+// fetchRecovered returns the proof and the undo block that the source keeps for
+// the block after checking them against the block.
+func (m *Manager) fetchRecovered(source recoverable, block *btcutil.Block,
+	schedule wire.LeafCommitmentSchedule) (*recoveredEntry, error) {
+
+	entry := &recoveredEntry{
+		id: BlockID{Height: block.Height(), Hash: *block.Hash()},
+	}
+	ud, err := source.fetchProof(&entry.id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the proof for block %v "+
+			"at height %d: %v", entry.id.Hash, entry.id.Height, err)
+	}
+	entry.undoBlock, err = source.fetchUndo(&entry.id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the undo block for "+
+			"block %v at height %d: %v", entry.id.Hash,
+			entry.id.Height, err)
+	}
+
+	// The proofs are stored with the same serialization by both indexes.
+	// It's made before the check below fills in the leaf datas.
+	var buf bytes.Buffer
+	err = ud.SerializeCompact(&buf, udataSerializeBool)
+	if err != nil {
+		return nil, err
+	}
+	entry.proof = buf.Bytes()
+	entry.ud = ud
+
+	err = checkRecoveredEntry(block, ud, entry.undoBlock,
+		m.chain.BlockHashByHeight, schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// storeRecoveredEntry stores the entry in the index that's rebuilt along with
+// the leaf eligibility summary that the source keeps for the block.
+func storeRecoveredEntry(dbTx database.Tx, r *indexRecovery,
+	entry *recoveredEntry) error {
+
+	err := r.dest.storeRecovered(dbTx, &entry.id, entry.ud, entry.proof,
+		entry.undoBlock)
+	if err != nil {
+		return err
+	}
+
+	eligibility, err := dbFetchLeafEligibility(dbTx, r.source.Key(),
+		&entry.id.Hash)
+	if err != nil || eligibility == nil {
+		return err
+	}
+	return dbPutLeafEligibility(dbTx, r.dest.Key(), &entry.id.Hash,
+		eligibility)
+}
+
+// checkRecoveredEntry returns an error if the proof and the undo block aren't
+// the ones of the block.  The leaf datas of the proof must be for the inputs of
+// the block and the undo block must add its outputs and delete the proven
+// leaves.
+func checkRecoveredEntry(block *btcutil.Block, ud *wire.UData,
+	undoBlock *accumulator.UndoBlock,
+	hashByHeight func(int32) (*chainhash.Hash, error),
+	schedule wire.LeafCommitmentSchedule) error {
+
+	_, err := blockchain.ReconstructUData(ud, block, hashByHeight, schedule,
+		nil)
+	if err != nil {
+		return err
+	}
+
+	undo, err := NewUndoBlock(undoBlock)
+	if err != nil {
+		return err
+	}
+	_, _, _, outskip := blockchain.DedupeBlock(block)
+	adds := -len(outskip)
+	for _, tx := range block.Transactions() {
+		for _, txOut := range tx.MsgTx().TxOut {
+			if !blockchain.IsUnspendable(txOut) {
+				adds++
+			}
+		}
+	}
+	if int(undo.NumAdds) != adds {
+		return fmt.Errorf("the undo block for block %v at height %d "+
+			"adds %d leaves but the block adds %d", block.Hash(),
+			block.Height(), undo.NumAdds, adds)
+	}
+
+	// The undo block has the deleted positions in order.
+	targets := make([]uint64, len(ud.AccProof.Targets))
+	copy(targets, ud.AccProof.Targets)
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	var confirmed int
+	for _, ld := range ud.LeafDatas {
+		if !ld.IsUnconfirmed() {
+			confirmed++
+		}
+	}
+	// A forest of a single leaf proves it without any targets.
+	if (len(targets) != confirmed && len(targets) != 0) ||
+		len(targets) != len(undo.Positions) {
+
+		return fmt.Errorf("the proof for block %v at height %d proves "+
+			"%d targets for %d confirmed leaf datas and %d "+
+			"deletions", block.Hash(), block.Height(), len(targets),
+			confirmed, len(undo.Positions))
+	}
+	for i, target := range targets {
+		if undo.Positions[i] != target {
+			return fmt.Errorf("the proof for block %v at height %d "+
+				"doesn't prove the leaves that its undo block "+
+				"deletes", block.Hash(), block.Height())
+		}
+	}
+
+	return nil
+}
+
+// verifyRecovered rolls the scratch forest back from the tip over the given
+// number of blocks with the rebuilt undo blocks and verifies the rebuilt proof
+// of every sample interval blocks against the roots before its block.
+func (m *Manager) verifyRecovered(dest recoverable, scratch *accumulator.Forest,
+	tip, depth int32, schedule wire.LeafCommitmentSchedule,
+	progress *recoveryProgress) error {
+
+	for height := tip; height > tip-depth; height-- {
+		block, err := m.chain.BlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		id := &BlockID{Height: height, Hash: *block.Hash()}
+		undoBlock, err := dest.fetchUndo(id)
+		if err != nil {
+			return err
+		}
+		err = scratch.Undo(*undoBlock)
+		if err != nil {
+			return fmt.Errorf("unable to undo block %v at height %d: "+
+				"%v", id.Hash, height, err)
+		}
+		if (tip-height)%m.recoverySample != 0 {
+			continue
+		}
+
+		ud, err := dest.fetchProof(id)
+		if err != nil {
+			return err
+		}
+		delHashes, err := blockchain.ReconstructUData(ud, block,
+			m.chain.BlockHashByHeight, schedule, nil)
+		if err != nil {
+			return err
+		}
+		err = scratch.VerifyBatchProof(delHashes, ud.AccProof)
+		if err != nil {
+			return fmt.Errorf("the proof for block %v at height %d "+
+				"doesn't verify: %v", id.Hash, height, err)
+		}
+		progress.update(func(stats *IndexRecoveryStats) {
+			stats.Verified++
+		})
+	}
+
+	return nil
+}
+
+// copyUtreexoState writes the utreexo state of the source to where the utreexo
+// state of the destination is saved and returns it restored from there.
+func copyUtreexoState(source, dest recoverable) (*accumulator.Forest, error) {
+	sourceState, sourceMtx := source.accumulatorState()
+	destState, _ := dest.accumulatorState()
+
+	basePath := utreexoBasePath(destState.config)
+	err := os.MkdirAll(basePath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	forestFile, err := os.OpenFile(filepath.Join(basePath,
+		defaultUtreexoFileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer forestFile.Close()
+	miscFile, err := os.OpenFile(filepath.Join(basePath,
+		defaultUtreexoMiscFileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer miscFile.Close()
+
+	sourceMtx.RLock()
+	err = sourceState.state.WriteForestToDisk(forestFile, true, false)
+	if err == nil {
+		err = sourceState.state.WriteMiscData(miscFile)
+	}
+	sourceMtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return restoreUtreexoState(destState.config, basePath)
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+)
+
+// restartIndexes returns new instances of the utreexo proof indexes on the same
+// database and data directory as the given ones, initialized by a new manager
+// with the given recovery mode.
+func restartIndexes(t *testing.T, chain *blockchain.BlockChain, dbPath string,
+	indexes []Indexer, params *chaincfg.Params, mode RecoveryMode) (
+	*UtreexoProofIndex, *FlatUtreexoProofIndex) {
+
+	db := indexes[0].(*UtreexoProofIndex).db
+	proofGenInterval := int32(1)
+	flatIdx, err := NewFlatUtreexoProofIndex(dbPath, params,
+		&proofGenInterval, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbIdx, err := NewUtreexoProofIndex(db, dbPath, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager(db, []Indexer{dbIdx, flatIdx})
+	m.SetIndexRecovery(mode, 1)
+	err = m.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dbIdx, flatIdx
+}
+
+// TestIndexRecovery ensures that a utreexo proof index that lost its entries is
+// rebuilt from the other one without connecting any block to it and that the
+// rebuilt index has the same entries as the other one.
+func TestIndexRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		mode RecoveryMode
+
+		// dropDb is whether the utreexo proof index is dropped rather
+		// than the flat files of the flat one deleted.
+		dropDb bool
+	}{
+		{
+			name: "flat files deleted",
+			mode: RecoveryAuto,
+		},
+		{
+			name:   "database index dropped",
+			mode:   RecoveryAuto,
+			dropDb: true,
+		},
+		{
+			name: "flat files deleted with the prompt",
+			mode: RecoveryPrompt,
+		},
+		{
+			name:   "database index dropped with recovery off",
+			mode:   RecoveryOff,
+			dropDb: true,
+		},
+	}
+
+	defer os.RemoveAll(testDbRoot)
+	for _, test := range tests {
+		testName := "TestIndexRecovery" + test.name
+		chain, indexes, params, tearDown := indexersTestChain(testName, 1)
+
+		tip, spendables := blockchain.AddBlock(chain,
+			btcutil.NewBlock(params.GenesisBlock), nil)
+		for i := 0; i < 20; i++ {
+			tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+		}
+
+		// The utreexo states are flushed as they are on shutdown.
+		dbIdx := indexes[0].(*UtreexoProofIndex)
+		flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+		if err := dbIdx.FlushUtreexoState(); err != nil {
+			t.Fatal(err)
+		}
+		if err := flatIdx.FlushUtreexoState(); err != nil {
+			t.Fatal(err)
+		}
+
+		dbPath := filepath.Join(testDbRoot, testName)
+		var err error
+		if test.dropDb {
+			err = DropUtreexoProofIndex(dbIdx.db, dbPath, nil)
+		} else {
+			err = deleteFlatIndexFiles(dbPath)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		dbIdx, flatIdx = restartIndexes(t, chain, dbPath, indexes, params,
+			test.mode)
+
+		var dest, source Indexer = flatIdx, dbIdx
+		destStats := flatIdx.Stats()
+		if test.dropDb {
+			dest, source = dbIdx, flatIdx
+			destStats = dbIdx.Stats()
+		}
+
+		// Only the automatic recovery rebuilds the index without
+		// connecting the blocks to it.
+		if test.mode != RecoveryAuto {
+			if destStats.Recovery != nil ||
+				destStats.Total.Blocks != uint64(tip.Height()) {
+
+				t.Fatalf("%s: connected %d blocks with recovery %+v",
+					test.name, destStats.Total.Blocks,
+					destStats.Recovery)
+			}
+		} else {
+			recovery := destStats.Recovery
+			if destStats.Total.Blocks != 0 {
+				t.Fatalf("%s: connected %d blocks to the %s",
+					test.name, destStats.Total.Blocks, dest.Name())
+			}
+			if recovery == nil || !recovery.Done ||
+				recovery.Source != source.Name() ||
+				recovery.Height != tip.Height() ||
+				recovery.Verified != tip.Height() {
+
+				t.Fatalf("%s: got recovery %+v", test.name, recovery)
+			}
+		}
+
+		err = compareUtreexoIdx(1, tip.Height()+1, chain,
+			[]Indexer{dbIdx, flatIdx})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		tearDown()
+	}
+}
+
+// deleteFlatIndexFiles deletes the flat files and the utreexo state of the flat
+// utreexo proof index in the data directory.
+func deleteFlatIndexFiles(dataDir string) error {
+	paths, err := filepath.Glob(filepath.Join(dataDir, "*_"+flatFileNameSuffix))
+	if err != nil {
+		return err
+	}
+	paths = append(paths, utreexoBasePath(&UtreexoConfig{
+		DataDir: dataDir,
+		Name:    flatUtreexoProofIndexType,
+	}))
+	for _, path := range paths {
+		err := os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,776 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// replicationConnect marks a replication record of a connected block.
+	replicationConnect = 1
+
+	// replicationDisconnect marks a replication record of a disconnected
+	// block.
+	replicationDisconnect = 2
+
+	// replicationEventBuffer is how many events a replication stream may
+	// fall behind by before it's dropped.
+	replicationEventBuffer = 100
+)
+
+var (
+	// ErrReplicationLagged is returned by StreamReplication when the
+	// stream fell too far behind the blocks being committed.  The standby
+	// should start a new stream from its tip.
+	ErrReplicationLagged = errors.New("replication stream fell behind the " +
+		"committed blocks")
+)
+
+// -----------------------------------------------------------------------------
+// A replication stream is a sequence of replication records.  A record is:
+//
+//   Field         Type             Size
+//   type          uint8            1
+//   height        uint32           4
+//
+// followed for a connected block by:
+//
+//   block         wire.MsgBlock    variable
+//   proof         []byte           varint + variable
+//   undo          []byte           varint + variable
+//   roots count   varint           variable
+//   roots         []chainhash      32 * roots count
+//
+// or for a disconnected block by:
+//
+//   prev hash     chainhash        32
+//
+// The proof is the utreexo proof as it's stored by the flat utreexo proof
+// index and the undo is the undo block tagged with its accumulator
+// serialization version.  The roots are the accumulator roots after the block
+// was connected and are only sent for blocks that were streamed as they were
+// committed.
+// -----------------------------------------------------------------------------
+
+// ReplicationRecord is a block that was connected to or disconnected from the
+// flat utreexo proof index of the primary.
+type ReplicationRecord struct {
+	// Disconnect is whether the block was disconnected.
+	Disconnect bool
+
+	// Height is the height of the block.
+	Height int32
+
+	// Block is the connected block.  It's nil for disconnected blocks.
+	Block *wire.MsgBlock
+
+	// Proof is the stored utreexo proof of the connected block.
+	Proof []byte
+
+	// Undo is the tagged undo block of the connected block.
+	Undo []byte
+
+	// Roots are the accumulator roots after the block was connected.
+	// They're empty if they weren't known when the record was made.
+	Roots []AccHash
+
+	// PrevHash is the hash of the block before the disconnected block.
+	PrevHash chainhash.Hash
+}
+
+// Serialize writes the replication record to w.
+func (rec *ReplicationRecord) Serialize(w io.Writer) error {
+	var header [5]byte
+	header[0] = replicationConnect
+	if rec.Disconnect {
+		header[0] = replicationDisconnect
+	}
+	binary.LittleEndian.PutUint32(header[1:], uint32(rec.Height))
+	_, err := w.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	if rec.Disconnect {
+		_, err = w.Write(rec.PrevHash[:])
+		return err
+	}
+
+	err = rec.Block.Serialize(w)
+	if err != nil {
+		return err
+	}
+	err = wire.WriteVarBytes(w, 0, rec.Proof)
+	if err != nil {
+		return err
+	}
+	err = wire.WriteVarBytes(w, 0, rec.Undo)
+	if err != nil {
+		return err
+	}
+	err = wire.WriteVarInt(w, 0, uint64(len(rec.Roots)))
+	if err != nil {
+		return err
+	}
+	for i := range rec.Roots {
+		_, err = w.Write(rec.Roots[i][:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Deserialize reads a replication record from r.  io.EOF is returned if r
+// ends before the record starts.
+func (rec *ReplicationRecord) Deserialize(r io.Reader) error {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:1])
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r, header[1:])
+	if err != nil {
+		return err
+	}
+	*rec = ReplicationRecord{
+		Height: int32(binary.LittleEndian.Uint32(header[1:])),
+	}
+
+	switch header[0] {
+	case replicationDisconnect:
+		rec.Disconnect = true
+		_, err = io.ReadFull(r, rec.PrevHash[:])
+		return err
+
+	case replicationConnect:
+
+	default:
+		return errDeserialize(fmt.Sprintf("unknown replication record "+
+			"type %d", header[0]))
+	}
+
+	rec.Block = new(wire.MsgBlock)
+	err = rec.Block.Deserialize(r)
+	if err != nil {
+		return err
+	}
+	rec.Proof, err = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload,
+		"replication proof")
+	if err != nil {
+		return err
+	}
+	rec.Undo, err = wire.ReadVarBytes(r, 0, wire.MaxMessagePayload,
+		"replication undo")
+	if err != nil {
+		return err
+	}
+	count, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	if count > wire.MaxMessagePayload/chainhash.HashSize {
+		return errDeserialize(fmt.Sprintf("%d replication roots is "+
+			"too many", count))
+	}
+	rec.Roots = make([]AccHash, count)
+	for i := range rec.Roots {
+		_, err = io.ReadFull(r, rec.Roots[i][:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replicationEvent is a block that was connected to or disconnected from the
+// index.
+type replicationEvent struct {
+	disconnect bool
+	block      *btcutil.Block
+	roots      []accumulator.Hash
+}
+
+// replicationHub hands out the blocks committed to the index to the
+// replication streams.
+type replicationHub struct {
+	mtx  sync.Mutex
+	subs map[chan replicationEvent]struct{}
+}
+
+// subscribe returns a channel that the committed blocks are sent to.  The
+// channel is closed if it falls too far behind.
+func (h *replicationHub) subscribe() chan replicationEvent {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.subs == nil {
+		h.subs = make(map[chan replicationEvent]struct{})
+	}
+	ch := make(chan replicationEvent, replicationEventBuffer)
+	h.subs[ch] = struct{}{}
+
+	return ch
+}
+
+// unsubscribe stops sending the committed blocks to the channel.
+func (h *replicationHub) unsubscribe(ch chan replicationEvent) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// active returns whether there are any replication streams.
+func (h *replicationHub) active() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return len(h.subs) > 0
+}
+
+// publish sends the event to every replication stream without blocking.
+// Streams that are too far behind to take it are dropped.
+func (h *replicationHub) publish(ev replicationEvent) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishReplication hands the block that was just connected or disconnected
+// to the replication streams.
+//
+// This function MUST be called with the snapshotMtx held.
+func (idx *FlatUtreexoProofIndex) publishReplication(block *btcutil.Block,
+	disconnect bool) {
+
+	if !idx.replication.active() {
+		return
+	}
+
+	ev := replicationEvent{disconnect: disconnect, block: block}
+	if !disconnect {
+		idx.mtx.RLock()
+		ev.roots = idx.utreexoState.state.GetRoots()
+		idx.mtx.RUnlock()
+	}
+	idx.replication.publish(ev)
+}
+
+// replicationRecord returns the replication record of the block that's
+// committed to the index at the given height.  The block is fetched from the
+// chain if it's not given.
+func (idx *FlatUtreexoProofIndex) replicationRecord(height int32,
+	block *btcutil.Block, roots []accumulator.Hash) (*ReplicationRecord, error) {
+
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	tip := idx.proofState.BestHeight()
+	if height <= 0 || height > tip {
+		return nil, fmt.Errorf("height %d is not committed to the index "+
+			"at tip height %d", height, tip)
+	}
+
+	if block == nil {
+		var err error
+		block, err = idx.chain.BlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+	}
+	proof, err := idx.proofState.FetchData(height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Undo blocks stored by an older accumulator serialization version
+	// are sent re-encoded.
+	undoBlock, err := idx.fetchUndoBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	undo, err := serializeUndoBlock(undoBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReplicationRecord{
+		Height: height,
+		Block:  block.MsgBlock(),
+		Proof:  proof,
+		Undo:   undo,
+		Roots:  NewAccHashes(roots),
+	}, nil
+}
+
+// StreamReplication writes the replication records of the blocks committed to
+// the index from the given height up to the tip to w.  The records of the
+// blocks that are connected and disconnected afterwards are written as they're
+// committed until quit is closed or writing to w fails.
+//
+// ErrReplicationLagged is returned if w can't keep up with the committed
+// blocks.  Replication is only supported when proofs are generated for every
+// block.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) StreamReplication(w io.Writer, from int32,
+	quit <-chan struct{}) error {
+
+	if idx.proofGenInterVal != 1 {
+		return fmt.Errorf("replication needs proofs for every block but "+
+			"they're generated every %d blocks", idx.proofGenInterVal)
+	}
+	if from <= 0 {
+		from = 1
+	}
+
+	// Subscribe before catching up so that no block committed in between
+	// is missed.  The ones that were already caught up on are skipped.
+	events := idx.replication.subscribe()
+	defer idx.replication.unsubscribe(events)
+
+	sent := from - 1
+	catchUp := func() error {
+		for sent < idx.proofState.BestHeight() {
+			rec, err := idx.replicationRecord(sent+1, nil, nil)
+			if err != nil {
+				return err
+			}
+			err = rec.Serialize(w)
+			if err != nil {
+				return err
+			}
+			sent++
+		}
+
+		return nil
+	}
+	err := catchUp()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-quit:
+			return nil
+
+		case ev, ok := <-events:
+			if !ok {
+				return ErrReplicationLagged
+			}
+
+			height := ev.block.Height()
+			switch {
+			case ev.disconnect && height == sent:
+				rec := &ReplicationRecord{
+					Disconnect: true,
+					Height:     height,
+					PrevHash:   ev.block.MsgBlock().Header.PrevBlock,
+				}
+				err = rec.Serialize(w)
+				sent--
+
+			// The standby never got the disconnected block.
+			case ev.disconnect && height > sent:
+
+			case ev.disconnect:
+				err = fmt.Errorf("block %d was disconnected after "+
+					"block %d was streamed", height, sent)
+
+			// Already streamed while catching up.
+			case height <= sent:
+
+			case height == sent+1:
+				var rec *ReplicationRecord
+				rec, err = idx.replicationRecord(height, ev.block,
+					ev.roots)
+				if err == nil {
+					err = rec.Serialize(w)
+					sent++
+				}
+
+			default:
+				err = catchUp()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ReplicationApplier applies the replication records streamed from the flat
+// utreexo proof index of a primary to the flat utreexo proof index of a
+// standby.  Every connected block is checked to modify the accumulator of the
+// standby into the same undo block and roots as the one of the primary.
+//
+// The applier stays one block behind the stream so that a block isn't applied
+// until the primary has moved past it.  Promote applies the block that's held
+// back.
+type ReplicationApplier struct {
+	idx *FlatUtreexoProofIndex
+
+	// db is the database that the index tip of the standby is written to
+	// so that the index manager is able to pick up from it.  It's nil if
+	// the tip isn't written.
+	db database.DB
+
+	// tip is the height of the last block applied to the index.
+	tip int32
+
+	// pending is the record that's held back.
+	pending *ReplicationRecord
+
+	// prevHashes are the hashes of the blocks before the applied blocks
+	// keyed by the height of the applied block.  They're the index tips
+	// to go back to when the applied blocks are disconnected.
+	prevHashes map[int32]chainhash.Hash
+
+	// connect and disconnect apply a record to the index.  They're only
+	// replaced by tests.
+	connect    func(rec *ReplicationRecord) error
+	disconnect func(rec *ReplicationRecord) error
+}
+
+// NewReplicationApplier returns a new applier of replication records to the
+// given flat utreexo proof index of a standby.  The index must not be
+// maintained by an index manager while records are applied to it.  If a
+// database is given, the index tip is written to it with every applied record.
+func NewReplicationApplier(idx *FlatUtreexoProofIndex, db database.DB) (
+	*ReplicationApplier, error) {
+
+	if idx.proofGenInterVal != 1 {
+		return nil, fmt.Errorf("replication needs proofs for every block "+
+			"but they're generated every %d blocks", idx.proofGenInterVal)
+	}
+
+	a := &ReplicationApplier{
+		idx:        idx,
+		db:         db,
+		tip:        idx.proofState.BestHeight(),
+		prevHashes: make(map[int32]chainhash.Hash),
+	}
+	a.connect = a.applyConnect
+	a.disconnect = a.applyDisconnect
+
+	return a, nil
+}
+
+// Height returns the height of the last block applied to the index.  A new
+// stream should be started from the height after it.
+func (a *ReplicationApplier) Height() int32 {
+	return a.tip
+}
+
+// Apply applies the replication record.  A connected block is held back until
+// the next record arrives.
+func (a *ReplicationApplier) Apply(rec *ReplicationRecord) error {
+	tip := a.tip
+	if a.pending != nil {
+		tip = a.pending.Height
+	}
+
+	if rec.Disconnect {
+		if rec.Height != tip {
+			return fmt.Errorf("replication record disconnects block "+
+				"%d but the tip is at %d", rec.Height, tip)
+		}
+		if a.pending != nil {
+			a.pending = nil
+			return nil
+		}
+
+		err := a.disconnect(rec)
+		if err != nil {
+			return err
+		}
+		a.tip--
+
+		return nil
+	}
+
+	if rec.Height != tip+1 {
+		return fmt.Errorf("replication record connects block %d but "+
+			"the tip is at %d", rec.Height, tip)
+	}
+	if a.pending != nil {
+		err := a.connect(a.pending)
+		if err != nil {
+			return err
+		}
+		a.tip++
+	}
+	a.pending = rec
+
+	return nil
+}
+
+// Run applies the replication records read from r until it ends.
+func (a *ReplicationApplier) Run(r io.Reader) error {
+	for {
+		rec := new(ReplicationRecord)
+		err := rec.Deserialize(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = a.Apply(rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Promote applies the record that's held back and flushes the utreexo state so
+// that the index of the standby is ready to serve once the primary is gone.
+func (a *ReplicationApplier) Promote() error {
+	if a.pending != nil {
+		err := a.connect(a.pending)
+		if err != nil {
+			return err
+		}
+		a.tip++
+		a.pending = nil
+	}
+
+	return a.idx.FlushUtreexoState()
+}
+
+// putTip writes the index tip of the standby.
+func (a *ReplicationApplier) putTip(hash *chainhash.Hash, height int32) error {
+	if a.db == nil {
+		return nil
+	}
+
+	return a.db.Update(func(dbTx database.Tx) error {
+		indexesBucket, err := dbTx.Metadata().CreateBucketIfNotExists(
+			indexTipsBucketName)
+		if err != nil {
+			return err
+		}
+
+		// Create the index the same as the index manager would so that
+		// it's resumed from the tip instead of being created again.
+		idxKey := a.idx.Key()
+		if indexesBucket.Get(idxKey) == nil {
+			err = a.idx.Create(dbTx)
+			if err != nil {
+				return err
+			}
+		}
+
+		return dbPutIndexerTip(dbTx, idxKey, hash, height)
+	})
+}
+
+// applyConnect connects the block of the record to the index of the standby.
+func (a *ReplicationApplier) applyConnect(rec *ReplicationRecord) error {
+	idx := a.idx
+
+	ud := new(wire.UData)
+	err := ud.DeserializeCompact(bytes.NewReader(rec.Proof), udataSerializeBool, 0)
+	if err != nil {
+		return err
+	}
+	primaryUndo, err := untagAccPayload("undo block", rec.Undo)
+	if err != nil {
+		return err
+	}
+
+	block := btcutil.NewBlock(rec.Block)
+	block.SetHeight(rec.Height)
+
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	err = idx.connectShipped(block, ud, rec.Proof,
+		func(undoBlock *accumulator.UndoBlock) error {
+			return checkReplicatedState(idx, rec, undoBlock, primaryUndo)
+		})
+	if err != nil {
+		return err
+	}
+
+	a.prevHashes[rec.Height] = rec.Block.Header.PrevBlock
+	delete(a.prevHashes, rec.Height-maxSnapshotDepth)
+
+	return a.putTip(block.Hash(), rec.Height)
+}
+
+// connectShipped connects the block to the index with the proof that another
+// node made for it instead of generating one.  check is called with the undo
+// block that connecting the block made before anything is stored, and the
+// block is rolled back if it returns an error.
+//
+// This function MUST be called with the snapshotMtx held.
+func (idx *FlatUtreexoProofIndex) connectShipped(block *btcutil.Block,
+	ud *wire.UData, proof []byte,
+	check func(undoBlock *accumulator.UndoBlock) error) error {
+
+	height := block.Height()
+	_, outCount, _, outskip := blockchain.DedupeBlock(block)
+	adds := blockchain.BlockToAddLeaves(block, outskip, nil, outCount,
+		idx.chainParams.LeafCommitments, idx.leafHasher)
+
+	// Remove any entries left behind by a previous attempt to connect this
+	// block.
+	err := idx.truncateFlatFiles(height - 1)
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.RLock()
+	err = idx.collisions.check(height, adds,
+		blockchain.BlockToAddOutPoints(block, outskip), ud.LeafDatas,
+		ud.StxoHashes(idx.chainParams.LeafCommitments),
+		idx.utreexoState.state)
+	idx.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return commitBlock(&blockCommit{
+		modifyState: func() (*accumulator.UndoBlock, error) {
+			idx.mtx.Lock()
+			defer idx.mtx.Unlock()
+			return idx.leafLimit.modify(idx.utreexoState, adds,
+				ud.AccProof.Targets)
+		},
+		storeEntries: func(undoBlock *accumulator.UndoBlock) error {
+			err := check(undoBlock)
+			if err != nil {
+				return err
+			}
+
+			err = idx.storeUndoBlock(height, *undoBlock)
+			if err != nil {
+				return err
+			}
+			return idx.proofState.StoreData(height, proof)
+		},
+		sync: func() error {
+			return idx.syncFlatFiles(height)
+		},
+		rollback: func(undoBlock *accumulator.UndoBlock) error {
+			idx.mtx.Lock()
+			err := idx.utreexoState.undo(*undoBlock)
+			idx.mtx.Unlock()
+			if err != nil {
+				return err
+			}
+
+			return idx.truncateFlatFiles(height - 1)
+		},
+	})
+}
+
+// checkReplicatedState returns an error if connecting the block of the record
+// modified the accumulator of the standby differently than the one of the
+// primary.
+func checkReplicatedState(idx *FlatUtreexoProofIndex, rec *ReplicationRecord,
+	undoBlock *accumulator.UndoBlock, primaryUndo []byte) error {
+
+	same, err := sameUndoBlock(undoBlock, primaryUndo)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("the undo block for height %d differs from "+
+			"the one of the primary", rec.Height)
+	}
+
+	if len(rec.Roots) == 0 {
+		return nil
+	}
+	idx.mtx.RLock()
+	roots := idx.utreexoState.state.GetRoots()
+	idx.mtx.RUnlock()
+	if len(roots) != len(rec.Roots) {
+		return fmt.Errorf("the roots after height %d differ from the "+
+			"ones of the primary", rec.Height)
+	}
+	for i := range roots {
+		if AccHash(roots[i]) != rec.Roots[i] {
+			return fmt.Errorf("the roots after height %d differ "+
+				"from the ones of the primary", rec.Height)
+		}
+	}
+
+	return nil
+}
+
+// sameUndoBlock returns whether the undo block serializes to the given bytes.
+func sameUndoBlock(undoBlock *accumulator.UndoBlock, serialized []byte) (bool, error) {
+	var buf bytes.Buffer
+	err := undoBlock.Serialize(&buf)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(buf.Bytes(), serialized), nil
+}
+
+// applyDisconnect disconnects the last applied block from the index of the
+// standby.
+func (a *ReplicationApplier) applyDisconnect(rec *ReplicationRecord) error {
+	idx := a.idx
+
+	idx.snapshotMtx.Lock()
+	defer idx.snapshotMtx.Unlock()
+
+	undoBlock, err := idx.fetchUndoBlock(rec.Height)
+	if err != nil {
+		return err
+	}
+	idx.mtx.Lock()
+	err = idx.utreexoState.undo(*undoBlock)
+	idx.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	err = idx.truncateFlatFiles(rec.Height - 1)
+	if err != nil {
+		return err
+	}
+
+	prevHash, ok := a.prevHashes[rec.Height]
+	if !ok {
+		prevHash = rec.PrevHash
+	}
+	delete(a.prevHashes, rec.Height)
+
+	return a.putTip(&prevHash, rec.Height-1)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestReplicationRecordSerialize ensures that replication records are read back
+// from a stream the same as they were written.
+func TestReplicationRecordSerialize(t *testing.T) {
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		[]byte{0x01, 0x02}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(5000, []byte{0x51}))
+	msgBlock := wire.NewMsgBlock(&wire.BlockHeader{PrevBlock: chainhash.Hash{7}})
+	msgBlock.AddTransaction(coinbase)
+
+	records := []*ReplicationRecord{
+		{
+			Height: 5,
+			Block:  msgBlock,
+			Proof:  []byte{1, 2, 3},
+			Undo:   []byte{accSerializationVersion, 4},
+			Roots:  []AccHash{{1}, {2}},
+		},
+		{
+			Height: 6,
+			Block:  msgBlock,
+			Proof:  []byte{},
+			Undo:   []byte{accSerializationVersion},
+			Roots:  []AccHash{},
+		},
+		{
+			Disconnect: true,
+			Height:     6,
+			PrevHash:   chainhash.Hash{9},
+		},
+	}
+
+	var buf bytes.Buffer
+	for _, rec := range records {
+		err := rec.Serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, want := range records {
+		got := new(ReplicationRecord)
+		err := got.Deserialize(&buf)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if (got.Block == nil) != (want.Block == nil) ||
+			(got.Block != nil && got.Block.BlockHash() != want.Block.BlockHash()) {
+
+			t.Fatalf("record %d: expected block %v, got %v", i,
+				want.Block, got.Block)
+		}
+		got.Block = want.Block
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("record %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+	err := new(ReplicationRecord).Deserialize(&buf)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF at the end of the stream, got %v", err)
+	}
+
+	// Unknown record types are rejected.
+	err = new(ReplicationRecord).Deserialize(bytes.NewReader([]byte{9, 0, 0, 0, 0}))
+	if err == nil {
+		t.Fatal("expected an error for an unknown record type")
+	}
+}
+
+// TestReplicationApplierBuffering ensures that the applier stays one block
+// behind the stream and that disconnects drop the held back block before the
+// applied ones are undone.
+func TestReplicationApplierBuffering(t *testing.T) {
+	var applied []int32
+	a := &ReplicationApplier{prevHashes: make(map[int32]chainhash.Hash)}
+	a.connect = func(rec *ReplicationRecord) error {
+		applied = append(applied, rec.Height)
+		return nil
+	}
+	a.disconnect = func(rec *ReplicationRecord) error {
+		if applied[len(applied)-1] != rec.Height {
+			t.Fatalf("disconnected %d but the tip is at %d", rec.Height,
+				applied[len(applied)-1])
+		}
+		applied = applied[:len(applied)-1]
+		return nil
+	}
+	connect := func(height int32) *ReplicationRecord {
+		return &ReplicationRecord{Height: height}
+	}
+	disconnect := func(height int32) *ReplicationRecord {
+		return &ReplicationRecord{Disconnect: true, Height: height}
+	}
+
+	steps := []struct {
+		rec     *ReplicationRecord
+		applied []int32
+		pending int32
+		invalid bool
+	}{
+		{rec: connect(2), invalid: true},
+		{rec: connect(1), pending: 1},
+		{rec: connect(2), applied: []int32{1}, pending: 2},
+		{rec: connect(3), applied: []int32{1, 2}, pending: 3},
+		{rec: connect(5), applied: []int32{1, 2}, pending: 3, invalid: true},
+		{rec: disconnect(2), applied: []int32{1, 2}, pending: 3, invalid: true},
+		{rec: disconnect(3), applied: []int32{1, 2}},
+		{rec: connect(3), applied: []int32{1, 2}, pending: 3},
+		{rec: connect(4), applied: []int32{1, 2, 3}, pending: 4},
+		{rec: disconnect(4), applied: []int32{1, 2, 3}},
+		{rec: disconnect(3), applied: []int32{1, 2}},
+		{rec: disconnect(2), applied: []int32{1}},
+		{rec: connect(2), applied: []int32{1}, pending: 2},
+	}
+	for i, step := range steps {
+		err := a.Apply(step.rec)
+		if (err != nil) != step.invalid {
+			t.Fatalf("step %d: unexpected error %v", i, err)
+		}
+		if !reflect.DeepEqual(applied, step.applied) {
+			t.Fatalf("step %d: expected applied %v, got %v", i,
+				step.applied, applied)
+		}
+		var pending int32
+		if a.pending != nil {
+			pending = a.pending.Height
+		}
+		if pending != step.pending {
+			t.Fatalf("step %d: expected pending %d, got %d", i,
+				step.pending, pending)
+		}
+	}
+}
+
+// TestReplicationHub ensures that streams that fall too far behind are dropped
+// instead of blocking the committed blocks.
+func TestReplicationHub(t *testing.T) {
+	var hub replicationHub
+	if hub.active() {
+		t.Fatal("expected no streams")
+	}
+
+	slow := hub.subscribe()
+	fast := hub.subscribe()
+	block := btcutil.NewBlock(wire.NewMsgBlock(&wire.BlockHeader{}))
+	for i := 0; i < replicationEventBuffer+1; i++ {
+		hub.publish(replicationEvent{block: block})
+		<-fast
+	}
+
+	for i := 0; i < replicationEventBuffer; i++ {
+		<-slow
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("expected the lagging stream to be closed")
+	}
+	if !hub.active() {
+		t.Fatal("expected the stream that kept up to stay subscribed")
+	}
+
+	hub.unsubscribe(fast)
+	hub.unsubscribe(slow)
+	if hub.active() {
+		t.Fatal("expected no streams")
+	}
+}
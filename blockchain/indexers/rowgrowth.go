@@ -0,0 +1,484 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"math/bits"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+const (
+	// defaultRowGrowthLookahead is the default number of blocks before
+	// the forest is expected to gain a row that the storage of the row
+	// starts being preallocated over.
+	defaultRowGrowthLookahead = 144
+
+	// maxRowGrowthChunk is the most bytes of the storage of the next row
+	// that are preallocated while connecting a single block.
+	maxRowGrowthChunk = 64 * 1024 * 1024
+
+	// maxRowBoundaries is the number of the latest blocks that added a
+	// row to the forest that the row growth stats keep.
+	maxRowBoundaries = 16
+
+	// forestNodeSize is the size of a node of the forest in its storage.
+	forestNodeSize = 32
+
+	// rowGrowthDeltaWeight is the weight that the number of leaves a
+	// block adds is given in the moving average that the blocks left
+	// until the next row are estimated with.
+	rowGrowthDeltaWeight = 0.1
+)
+
+// IndexEventType is the kind of an IndexEvent.
+type IndexEventType uint8
+
+const (
+	// IndexEventRowAdded is the event of the forest of an index gaining
+	// a row.
+	IndexEventRowAdded IndexEventType = iota
+)
+
+// String returns the IndexEventType in human-readable form.
+func (t IndexEventType) String() string {
+	switch t {
+	case IndexEventRowAdded:
+		return "row added"
+	}
+
+	return fmt.Sprintf("unknown index event (%d)", uint8(t))
+}
+
+// IndexEvent is something that happened to an index while it connected a
+// block.
+type IndexEvent struct {
+	// Type is the kind of the event.
+	Type IndexEventType
+
+	// Index is the name of the index.
+	Index string
+
+	// Height is the height of the block that was connected.
+	Height int32
+
+	// Rows and NumLeaves are of the forest once the block was connected.
+	Rows      uint8
+	NumLeaves uint64
+
+	// ConnectTime is how long connecting the block took.
+	ConnectTime time.Duration
+}
+
+// RowBoundary is a block that added a row to the forest.
+type RowBoundary struct {
+	// Height is the height of the block and Rows are the rows that the
+	// forest has since.
+	Height int32
+	Rows   uint8
+
+	// ConnectTime is how long connecting the block took.
+	ConnectTime time.Duration
+
+	// Preallocated are the bytes of the storage of the row that were
+	// preallocated over the blocks before.
+	Preallocated int64
+}
+
+// RowGrowthStats are how close the forest of an index is to gaining a row and
+// how long the blocks that added the latest rows took to connect.
+type RowGrowthStats struct {
+	// Rows and NumLeaves are of the forest.
+	Rows      uint8
+	NumLeaves uint64
+
+	// LeavesToNextRow is the number of leaves that can be added before
+	// the forest gains a row.
+	LeavesToNextRow uint64
+
+	// BlocksToNextRow is the estimated number of blocks until the forest
+	// gains a row.  It's -1 if the forest isn't growing.
+	BlocksToNextRow int64
+
+	// Preallocated are the bytes of the storage of the next row that
+	// were preallocated so far.  Only forests kept in a file have their
+	// storage preallocated.
+	Preallocated int64
+
+	// AvgConnectTime is the moving average of how long connecting the
+	// blocks that didn't add a row took.
+	AvgConnectTime time.Duration
+
+	// Boundaries are the latest blocks that added a row, oldest first.
+	Boundaries []RowBoundary
+}
+
+// forestStorageSize returns the number of nodes that the storage of the forest
+// has room for.  The forest only exposes it through its printed stats, so 0 is
+// returned if it can't be parsed out of them.
+func forestStorageSize(forest *accumulator.Forest) uint64 {
+	var numLeaves, hashesEver, posMap, size uint64
+	_, err := fmt.Sscanf(forest.Stats(),
+		"numleaves: %d hashesever: %d posmap: %d forest: %d",
+		&numLeaves, &hashesEver, &posMap, &size)
+	if err != nil {
+		return 0
+	}
+
+	return size
+}
+
+// forestSizeMultiple returns the number of nodes that the storage of the forest
+// type has room for per node of the forest.  The disk forest keeps its file
+// twice as large as it needs to.
+func forestSizeMultiple(forestType ForestType) uint64 {
+	if forestType == DiskForest {
+		return 2
+	}
+
+	return 1
+}
+
+// forestRows returns the number of rows of a forest of the given type whose
+// storage has room for the given number of nodes.  A forest of n rows has
+// 2^(n+1) - 1 nodes.
+func forestRows(forestType ForestType, size uint64) uint8 {
+	nodes := size / forestSizeMultiple(forestType)
+	if nodes < 1 {
+		return 0
+	}
+
+	return uint8(bits.Len64(nodes+1) - 2)
+}
+
+// rowStorageSize returns the bytes of the storage of a forest of the given type
+// and number of rows.
+func rowStorageSize(forestType ForestType, rows uint8) int64 {
+	nodes := uint64(2)<<rows - 1
+	return int64(nodes * forestSizeMultiple(forestType) * forestNodeSize)
+}
+
+// rowGrowth anticipates the forest of an index gaining a row.  Gaining a row
+// resizes the storage of the forest at once, so the storage that the next row
+// needs is preallocated over the blocks before it's expected to be gained.
+type rowGrowth struct {
+	index      string
+	forestType ForestType
+
+	// path is the file that the forest is kept in.  It's empty for the
+	// forest types whose storage can't be preallocated.
+	path string
+
+	mtx       sync.Mutex
+	lookahead int32
+	handler   func(*IndexEvent)
+
+	rows      uint8
+	numLeaves uint64
+	avgDelta  float64
+	avgTime   time.Duration
+
+	// preallocated are the bytes preallocated for the forest to gain a
+	// row once it has preallocRows rows.  unsupported is whether the
+	// platform can't preallocate files.
+	preallocated int64
+	preallocRows uint8
+	unsupported  bool
+
+	boundaries []RowBoundary
+}
+
+// newRowGrowth returns the rowGrowth of the given utreexo state of the index
+// with the given name.
+func newRowGrowth(index string, uState *UtreexoState) *rowGrowth {
+	g := &rowGrowth{
+		index:      index,
+		forestType: uState.config.Type,
+		lookahead:  defaultRowGrowthLookahead,
+	}
+	switch g.forestType {
+	case DiskForest, CacheForest:
+		g.path = filepath.Join(utreexoBasePath(uState.config),
+			defaultUtreexoFileName)
+	}
+	// The number of leaves is always known right after the utreexo state
+	// is loaded.
+	g.numLeaves, _ = uState.NumLeaves()
+	g.rows = forestRows(g.forestType, forestStorageSize(uState.state))
+
+	return g
+}
+
+// setLookahead sets the number of blocks before the forest is expected to gain
+// a row that its storage starts being preallocated over.  0 turns the
+// preallocation off.
+//
+// This function is safe for concurrent access.
+func (g *rowGrowth) setLookahead(blocks int32) {
+	g.mtx.Lock()
+	g.lookahead = blocks
+	g.mtx.Unlock()
+}
+
+// setHandler sets the function that the events are handed to.
+//
+// This function is safe for concurrent access.
+func (g *rowGrowth) setHandler(handler func(*IndexEvent)) {
+	g.mtx.Lock()
+	g.handler = handler
+	g.mtx.Unlock()
+}
+
+// blocksToNextRow returns the estimated number of blocks until the forest
+// gains a row.  It's -1 if the forest isn't growing.
+//
+// This function MUST be called with the mtx held.
+func (g *rowGrowth) blocksToNextRow() int64 {
+	if g.avgDelta <= 0 {
+		return -1
+	}
+	left := float64(leavesToNextRow(g.rows, g.numLeaves)) / g.avgDelta
+	return int64(left)
+}
+
+// leavesToNextRow returns the number of leaves that can be added to a forest of
+// the given rows and number of leaves before it gains a row.
+func leavesToNextRow(rows uint8, numLeaves uint64) uint64 {
+	capacity := uint64(1) << rows
+	if numLeaves >= capacity {
+		return 0
+	}
+	return capacity - numLeaves
+}
+
+// anticipate preallocates the next chunk of the storage that the forest needs
+// once it gains a row if the row is expected to be gained within the
+// lookahead.  The chunk is what's left to preallocate spread over the blocks
+// left, so that the block that adds the row has nothing left to allocate.
+// The preallocation is only an optimization so it's given up on after the
+// first error.
+//
+// This function is safe for concurrent access.
+func (g *rowGrowth) anticipate() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if g.path == "" || g.unsupported || g.lookahead <= 0 {
+		return
+	}
+	blocksLeft := g.blocksToNextRow()
+	if blocksLeft < 0 || blocksLeft > int64(g.lookahead) {
+		return
+	}
+
+	// Start over if the forest gained the row the preallocation was for.
+	if g.preallocRows != g.rows {
+		g.preallocRows = g.rows
+		g.preallocated = 0
+	}
+	current := rowStorageSize(g.forestType, g.rows)
+	target := rowStorageSize(g.forestType, g.rows+1)
+	remaining := target - current - g.preallocated
+	if remaining <= 0 {
+		return
+	}
+
+	chunk := remaining / (blocksLeft + 1)
+	if chunk < forestNodeSize {
+		chunk = remaining
+	}
+	if chunk > maxRowGrowthChunk {
+		chunk = maxRowGrowthChunk
+	}
+
+	supported, err := preallocateFile(g.path, current+g.preallocated, chunk)
+	if err != nil {
+		log.Warnf("Unable to preallocate the forest of the %s: %v",
+			g.index, err)
+	}
+	if err != nil || !supported {
+		g.unsupported = true
+		return
+	}
+	g.preallocated += chunk
+}
+
+// connected records the forest of the index once the block at the given height
+// was connected to it in the given time, and hands the event of gaining a row
+// to the handler if the block added one.  The handler is called with no locks
+// held.
+//
+// This function is safe for concurrent access.
+func (g *rowGrowth) connected(height int32, numLeaves, size uint64,
+	connectTime time.Duration) {
+
+	g.mtx.Lock()
+
+	rows := forestRows(g.forestType, size)
+	delta := float64(numLeaves) - float64(g.numLeaves)
+	g.avgDelta += rowGrowthDeltaWeight * (delta - g.avgDelta)
+	g.numLeaves = numLeaves
+
+	// The forest never loses a row, so fewer rows means that the utreexo
+	// state was reset.
+	if rows <= g.rows {
+		if rows < g.rows {
+			g.preallocated = 0
+			g.avgDelta = 0
+		}
+		g.rows = rows
+		if g.avgTime == 0 {
+			g.avgTime = connectTime
+		} else {
+			g.avgTime += (connectTime - g.avgTime) / 8
+		}
+		g.mtx.Unlock()
+		return
+	}
+
+	var preallocated int64
+	if g.preallocRows == g.rows {
+		preallocated = g.preallocated
+	}
+	g.rows = rows
+	g.preallocated = 0
+	g.preallocRows = rows
+	if len(g.boundaries) == maxRowBoundaries {
+		g.boundaries = g.boundaries[1:]
+	}
+	g.boundaries = append(g.boundaries, RowBoundary{
+		Height:       height,
+		Rows:         rows,
+		ConnectTime:  connectTime,
+		Preallocated: preallocated,
+	})
+	handler := g.handler
+	g.mtx.Unlock()
+
+	log.Debugf("The forest of the %s gained row %d at height %d with %d "+
+		"leaves in %v", g.index, rows, height, numLeaves, connectTime)
+
+	if handler != nil {
+		handler(&IndexEvent{
+			Type:        IndexEventRowAdded,
+			Index:       g.index,
+			Height:      height,
+			Rows:        rows,
+			NumLeaves:   numLeaves,
+			ConnectTime: connectTime,
+		})
+	}
+}
+
+// disconnected records the number of leaves of the forest of the utreexo state
+// once a block was disconnected from it.
+//
+// This function MUST be called with the lock of the utreexo state held for
+// reads.
+func (g *rowGrowth) disconnected(uState *UtreexoState) {
+	numLeaves, err := uState.NumLeaves()
+	if err != nil {
+		return
+	}
+
+	g.mtx.Lock()
+	g.numLeaves = numLeaves
+	g.mtx.Unlock()
+}
+
+// stats returns the row growth stats.
+//
+// This function is safe for concurrent access.
+func (g *rowGrowth) stats() RowGrowthStats {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	stats := RowGrowthStats{
+		Rows:            g.rows,
+		NumLeaves:       g.numLeaves,
+		LeavesToNextRow: leavesToNextRow(g.rows, g.numLeaves),
+		BlocksToNextRow: g.blocksToNextRow(),
+		AvgConnectTime:  g.avgTime,
+		Boundaries:      make([]RowBoundary, len(g.boundaries)),
+	}
+	if g.preallocRows == g.rows {
+		stats.Preallocated = g.preallocated
+	}
+	copy(stats.Boundaries, g.boundaries)
+
+	return stats
+}
+
+// recordConnected hands the forest of the utreexo state to the rowGrowth once
+// the block at the given height was connected to it.
+//
+// This function MUST be called with the lock of the utreexo state held for
+// reads.
+func (g *rowGrowth) recordConnected(height int32, uState *UtreexoState,
+	start time.Time) {
+
+	numLeaves, err := uState.NumLeaves()
+	if err != nil {
+		return
+	}
+	g.connected(height, numLeaves, forestStorageSize(uState.state),
+		time.Since(start))
+}
+
+// SetRowGrowthLookahead sets the number of blocks before the forest is expected
+// to gain a row that the storage of the row starts being preallocated over.  0
+// turns the preallocation off.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) SetRowGrowthLookahead(blocks int32) {
+	idx.rowGrowth.setLookahead(blocks)
+}
+
+// SetIndexEventHandler sets the function that the events of the index are
+// handed to.  It's called while a block is connected with the chain lock held
+// so it must not call into the chain.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) SetIndexEventHandler(handler func(*IndexEvent)) {
+	idx.rowGrowth.setHandler(handler)
+}
+
+// RowGrowthStats returns how close the forest of the index is to gaining a row
+// and how long the blocks that added the latest rows took to connect.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) RowGrowthStats() RowGrowthStats {
+	return idx.rowGrowth.stats()
+}
+
+// SetRowGrowthLookahead sets the number of blocks before the forest is expected
+// to gain a row that the storage of the row starts being preallocated over.  0
+// turns the preallocation off.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) SetRowGrowthLookahead(blocks int32) {
+	idx.rowGrowth.setLookahead(blocks)
+}
+
+// SetIndexEventHandler sets the function that the events of the index are
+// handed to.  It's called while a block is connected with the chain lock held
+// so it must not call into the chain.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) SetIndexEventHandler(handler func(*IndexEvent)) {
+	idx.rowGrowth.setHandler(handler)
+}
+
+// RowGrowthStats returns how close the forest of the index is to gaining a row
+// and how long the blocks that added the latest rows took to connect.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) RowGrowthStats() RowGrowthStats {
+	return idx.rowGrowth.stats()
+}
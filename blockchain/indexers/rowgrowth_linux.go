@@ -0,0 +1,36 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is the fallocate mode that allocates the range without
+// changing the size of the file.
+const fallocKeepSize = 0x1
+
+// preallocateFile allocates the given range of the file at the given path
+// without changing its size, so that the range costs nothing to allocate once
+// the file grows into it.  It returns false if the filesystem can't
+// preallocate.
+func preallocateFile(path string, offset, length int64) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	err = syscall.Fallocate(int(f.Fd()), fallocKeepSize, offset, length)
+	switch err {
+	case nil:
+		return true, nil
+	case syscall.EOPNOTSUPP, syscall.ENOSYS:
+		return false, nil
+	}
+
+	return false, err
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package indexers
+
+// preallocateFile allocates the given range of the file at the given path
+// without changing its size.  Files can only be preallocated on Linux so it
+// always returns false.
+func preallocateFile(path string, offset, length int64) (bool, error) {
+	return false, nil
+}
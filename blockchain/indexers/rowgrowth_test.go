@@ -0,0 +1,334 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// TestForestRows ensures that the rows of a forest are told from the size of
+// its storage for every forest type.
+func TestForestRows(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(243))
+	for _, forestType := range []ForestType{RamForest, DiskForest, CacheForest} {
+		uState, err := InitUtreexoState(&UtreexoConfig{
+			DataDir: dir,
+			Name:    fmt.Sprintf("rows%d", forestType),
+			Type:    forestType,
+			Params:  &chaincfg.RegressionNetParams,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var numLeaves uint64
+		for _, adds := range []int{1, 1, 3, 10, 50, 200} {
+			_, err := uState.modify(randLeaves(rng, adds), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			numLeaves += uint64(adds)
+
+			gotLeaves, err := uState.NumLeaves()
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := forestStorageSize(uState.state)
+			if gotLeaves != numLeaves {
+				t.Fatalf("%d: got %d leaves, want %d", forestType,
+					gotLeaves, numLeaves)
+			}
+			wantRows := uint8(0)
+			for uint64(1)<<wantRows < numLeaves {
+				wantRows++
+			}
+			if rows := forestRows(forestType, size); rows != wantRows {
+				t.Fatalf("%d: got %d rows for %d leaves, want %d",
+					forestType, rows, numLeaves, wantRows)
+			}
+			if int64(size*forestNodeSize) !=
+				rowStorageSize(forestType, wantRows) {
+
+				t.Fatalf("%d: storage of %d nodes for %d rows",
+					forestType, size, wantRows)
+			}
+		}
+	}
+}
+
+// randLeaves returns the given number of leaves with random hashes.
+func randLeaves(rng *rand.Rand, n int) []accumulator.Leaf {
+	leaves := make([]accumulator.Leaf, n)
+	for i := range leaves {
+		rng.Read(leaves[i].Hash[:])
+	}
+	return leaves
+}
+
+// rowGrowthTestChain returns a chain with a utreexo proof index whose forest is
+// of the given type and whose row growth is anticipated over the given number
+// of blocks, along with the events that the index emits.
+func rowGrowthTestChain(t *testing.T, name string, forestType ForestType,
+	lookahead int32) (*blockchain.BlockChain, *UtreexoProofIndex,
+	func() []IndexEvent) {
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	db, dbPath, err := createDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	})
+
+	idx, err := NewUtreexoProofIndex(db, dbPath, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uState, err := InitUtreexoState(&UtreexoConfig{
+		DataDir: dbPath,
+		Name:    "rowgrowth",
+		Type:    forestType,
+		Params:  &params,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.utreexoState = uState
+	idx.rowGrowth = newRowGrowth(idx.Name(), uState)
+	idx.leafLimit = newLeafLimit(idx.Name(), uState)
+	idx.SetRowGrowthLookahead(lookahead)
+
+	var mtx sync.Mutex
+	var events []IndexEvent
+	idx.SetIndexEventHandler(func(event *IndexEvent) {
+		mtx.Lock()
+		events = append(events, *event)
+		mtx.Unlock()
+	})
+
+	indexManager := NewManager(db, []Indexer{idx})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     indexManager,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = indexManager.Init(chain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chain, idx, func() []IndexEvent {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]IndexEvent(nil), events...)
+	}
+}
+
+// TestRowGrowthChain ensures that anticipating the rows of the forest doesn't
+// change the accumulator of any forest type, that every row that's gained is
+// reported, and that the storage of the forests kept in a file is
+// preallocated before the row is gained.
+func TestRowGrowthChain(t *testing.T) {
+	t.Parallel()
+
+	type testChain struct {
+		name       string
+		forestType ForestType
+		lookahead  int32
+
+		chain  *blockchain.BlockChain
+		idx    *UtreexoProofIndex
+		events func() []IndexEvent
+	}
+	chains := []*testChain{
+		{name: "ram", forestType: RamForest},
+		{name: "ram preallocating", forestType: RamForest,
+			lookahead: defaultRowGrowthLookahead},
+		{name: "disk", forestType: DiskForest},
+		{name: "disk preallocating", forestType: DiskForest,
+			lookahead: defaultRowGrowthLookahead},
+	}
+	for i, c := range chains {
+		c.chain, c.idx, c.events = rowGrowthTestChain(t,
+			fmt.Sprintf("TestRowGrowthChain-%d", i), c.forestType,
+			c.lookahead)
+	}
+
+	// The blocks are generated on the first chain and processed by the
+	// others.  Every block spends an output into 20 so the forest grows
+	// by 20 leaves a block and gains a row every few blocks.
+	base := chains[0]
+	tip, spendables := blockchain.AddBlock(base.chain,
+		btcutil.NewBlock(chaincfg.RegressionNetParams.GenesisBlock), nil)
+	blocks := []*btcutil.Block{tip}
+	for i := 0; i < 40; i++ {
+		block, outs, err := blockchain.GenerateBlockFromSpec(base.chain,
+			tip, spendables, blockchain.BlockSpec{
+				NumTxs:       1,
+				InputsPerTx:  1,
+				OutputsPerTx: 20,
+			}, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = base.chain.ProcessBlock(block, blockchain.BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tip, spendables = block, outs
+		blocks = append(blocks, block)
+	}
+
+	for _, c := range chains[1:] {
+		for _, block := range blocks {
+			_, _, err := c.chain.ProcessBlock(block, blockchain.BFNone)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+	}
+
+	want := base.idx.utreexoState.state.GetRoots()
+	wantLeaves, _ := base.idx.utreexoState.NumLeaves()
+	wantEvents := base.events()
+	if len(wantEvents) < 2 {
+		t.Fatalf("only %d rows were gained", len(wantEvents))
+	}
+	for _, c := range chains {
+		got := c.idx.utreexoState.state.GetRoots()
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: roots %v, want %v", c.name, got, want)
+		}
+
+		events := c.events()
+		if len(events) != len(wantEvents) {
+			t.Fatalf("%s: got %d events, want %d", c.name,
+				len(events), len(wantEvents))
+		}
+		for j, event := range events {
+			if event.Type != IndexEventRowAdded ||
+				event.Height != wantEvents[j].Height ||
+				event.Rows != wantEvents[j].Rows ||
+				event.NumLeaves != wantEvents[j].NumLeaves {
+
+				t.Fatalf("%s: event %d is %+v, want %+v", c.name,
+					j, event, wantEvents[j])
+			}
+			if j > 0 && event.Rows != events[j-1].Rows+1 {
+				t.Fatalf("%s: event %d is for row %d after row %d",
+					c.name, j, event.Rows, events[j-1].Rows)
+			}
+		}
+
+		stats := c.idx.RowGrowthStats()
+		if len(stats.Boundaries) != len(events) {
+			t.Fatalf("%s: %d boundaries recorded for %d events",
+				c.name, len(stats.Boundaries), len(events))
+		}
+		for j, boundary := range stats.Boundaries {
+			if boundary.Height != events[j].Height ||
+				boundary.ConnectTime <= 0 {
+
+				t.Fatalf("%s: boundary %d is %+v", c.name, j,
+					boundary)
+			}
+		}
+		if stats.Rows != events[len(events)-1].Rows ||
+			stats.NumLeaves != wantLeaves {
+
+			t.Fatalf("%s: stats %+v", c.name, stats)
+		}
+
+		// Only the forest kept in a file has its storage preallocated
+		// and only where the platform is able to.
+		var preallocated int64
+		for _, boundary := range stats.Boundaries {
+			preallocated += boundary.Preallocated
+		}
+		canPreallocate := c.forestType == DiskForest && c.lookahead > 0 &&
+			runtime.GOOS == "linux" && !c.idx.rowGrowth.unsupported
+		if canPreallocate != (preallocated > 0) {
+			t.Fatalf("%s: preallocated %d bytes", c.name, preallocated)
+		}
+	}
+}
+
+// BenchmarkRowBoundary benchmarks connecting the leaves that make a forest kept
+// in a file gain a row, with and without having preallocated the storage of
+// the row over the blocks before.
+func BenchmarkRowBoundary(b *testing.B) {
+	const rows = 14
+
+	for _, preallocate := range []bool{false, true} {
+		name := "baseline"
+		if preallocate {
+			name = "preallocated"
+		}
+		b.Run(name, func(b *testing.B) {
+			rng := rand.New(rand.NewSource(243))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				uState, err := InitUtreexoState(&UtreexoConfig{
+					DataDir: b.TempDir(),
+					Name:    "bench",
+					Type:    DiskForest,
+					Params:  &chaincfg.RegressionNetParams,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = uState.modify(
+					randLeaves(rng, 1<<rows), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				// Preallocate the whole row at once as the
+				// blocks before the boundary would have.
+				if preallocate {
+					g := newRowGrowth("bench", uState)
+					current := rowStorageSize(DiskForest, rows)
+					_, err := preallocateFile(g.path, current,
+						rowStorageSize(DiskForest, rows+1)-current)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				adds := randLeaves(rng, 1)
+				b.StartTimer()
+
+				_, err = uState.modify(adds, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,632 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// defaultSelfTestBlocks is the default number of blocks that the
+	// self-test generates before the reorg.
+	defaultSelfTestBlocks = 36
+
+	// defaultSelfTestReorgDepth is the default number of blocks that the
+	// self-test reorgs out.
+	defaultSelfTestReorgDepth = 3
+
+	// selfTestForkSeedOffset is added to the seeds of the blocks of the
+	// fork so that they differ from the blocks they replace.
+	selfTestForkSeedOffset = 1 << 32
+)
+
+// SelfTestSpecs are the shapes of the blocks that the self-test generates in
+// turn.  They're picked so that the blocks fan out to outputs of every script
+// type, spend outputs created in the same block, have leaves that only differ
+// by their output index, and consolidate many outputs.  Segwit never activates
+// on the throwaway chain, so the P2WSH outputs are spent without a witness and
+// their leaves carry the whole script.
+//
+// They're only ever read so that self-tests run concurrently, or alongside the
+// indexes of other networks, never see each other's blocks.
+var SelfTestSpecs = []blockchain.BlockSpec{
+	{},
+	{
+		NumTxs:       1,
+		InputsPerTx:  1,
+		OutputsPerTx: 40,
+		ScriptTypes: []blockchain.ScriptType{blockchain.ScriptOpTrue,
+			blockchain.ScriptP2SHOpTrue, blockchain.ScriptP2WSHOpTrue},
+	},
+	{
+		NumTxs:       5,
+		InputsPerTx:  2,
+		OutputsPerTx: 2,
+		ScriptTypes: []blockchain.ScriptType{blockchain.ScriptOpTrue,
+			blockchain.ScriptP2SHOpTrue, blockchain.ScriptP2WSHOpTrue},
+	},
+	{
+		NumTxs:         10,
+		InputsPerTx:    1,
+		SpendSameBlock: true,
+	},
+	{
+		NumTxs:      4,
+		InputsPerTx: 3,
+		ScriptTypes: []blockchain.ScriptType{blockchain.ScriptOpTrue,
+			blockchain.ScriptP2WSHOpTrue},
+		OversizedScripts:     2,
+		DuplicateLeafPattern: true,
+	},
+	{
+		NumTxs:      1,
+		InputsPerTx: 8,
+	},
+}
+
+// SelfTestStage is a stage of the self-test.
+type SelfTestStage uint8
+
+const (
+	// SelfTestSetup creates the throwaway chain and the proof indexes.
+	SelfTestSetup SelfTestStage = iota
+
+	// SelfTestGenerate generates the blocks and connects them to the
+	// chain and the proof indexes.
+	SelfTestGenerate
+
+	// SelfTestReorg reorgs out the last blocks.
+	SelfTestReorg
+
+	// SelfTestCompare checks that both proof indexes stored the same
+	// proofs and undo blocks and that the undo blocks invert the blocks.
+	SelfTestCompare
+
+	// SelfTestVerify verifies the proof of every block against the
+	// accumulator of the block before it.
+	SelfTestVerify
+
+	// SelfTestCSNSync syncs a compact state node from the proofs.
+	SelfTestCSNSync
+
+	// numSelfTestStages is the number of stages of the self-test.
+	numSelfTestStages
+)
+
+// String returns the SelfTestStage in human-readable form.
+func (s SelfTestStage) String() string {
+	switch s {
+	case SelfTestSetup:
+		return "setup"
+	case SelfTestGenerate:
+		return "generate"
+	case SelfTestReorg:
+		return "reorg"
+	case SelfTestCompare:
+		return "compare"
+	case SelfTestVerify:
+		return "verify"
+	case SelfTestCSNSync:
+		return "csnsync"
+	default:
+		return fmt.Sprintf("unknown SelfTestStage (%d)", uint8(s))
+	}
+}
+
+// SelfTestConfig configures a run of the self-test.
+type SelfTestConfig struct {
+	// Seed is the seed that the blocks are generated with.  The current
+	// time is used if it's 0.
+	Seed int64
+
+	// NumBlocks is the number of blocks generated before the reorg and
+	// ReorgDepth is the number of them that are reorged out.  The
+	// defaults are used if they're 0.
+	NumBlocks  int32
+	ReorgDepth int32
+
+	// TempDir is the directory that the throwaway data directory is
+	// created in.  The default directory for temporary files is used if
+	// it's empty.
+	TempDir string
+
+	// proofFailpoint is called with every utreexo proof that the
+	// self-test verifies before it's verified.  It's only set by the
+	// tests to corrupt a proof.
+	proofFailpoint func(height int32, ud *wire.UData)
+}
+
+// SelfTestStageResult is the outcome of a stage of the self-test.
+type SelfTestStageResult struct {
+	Stage    SelfTestStage
+	Duration time.Duration
+	Err      error
+}
+
+// SelfTestFailure describes where the self-test failed so that it can be
+// reproduced.
+type SelfTestFailure struct {
+	// Stage is the stage that failed.
+	Stage SelfTestStage
+
+	// Height is the height of the block that the stage failed at and Spec
+	// and Seed are what the block was generated with.  Spec is nil if the
+	// stage didn't fail at a block.
+	Height int32
+	Spec   *blockchain.BlockSpec
+	Seed   int64
+
+	// Err is why the stage failed.
+	Err error
+}
+
+// Error returns the failure as a human-readable string.
+func (f *SelfTestFailure) Error() string {
+	if f.Spec == nil {
+		return fmt.Sprintf("self-test failed at the %v stage: %v",
+			f.Stage, f.Err)
+	}
+
+	return fmt.Sprintf("self-test failed at the %v stage at height %d "+
+		"(spec %+v, seed %d): %v", f.Stage, f.Height, *f.Spec, f.Seed,
+		f.Err)
+}
+
+// Unwrap returns why the stage failed.
+func (f *SelfTestFailure) Unwrap() error {
+	return f.Err
+}
+
+// SelfTestResult is the outcome of a run of the self-test.
+type SelfTestResult struct {
+	// Seed is the seed that the blocks were generated with.
+	Seed int64
+
+	// Stages are the stages that were run in order.  The last one is the
+	// one that failed if the self-test failed.
+	Stages []SelfTestStageResult
+
+	// Failure is where the self-test failed.  It's nil if it passed.
+	Failure *SelfTestFailure
+}
+
+// Passed returns whether every stage of the self-test passed.
+func (r *SelfTestResult) Passed() bool {
+	return r.Failure == nil && len(r.Stages) == int(numSelfTestStages)
+}
+
+// String returns a report of the self-test with the timing of every stage.
+func (r *SelfTestResult) String() string {
+	var b strings.Builder
+	verdict := "passed"
+	if !r.Passed() {
+		verdict = "FAILED"
+	}
+	fmt.Fprintf(&b, "utreexo self-test %s (seed %d)", verdict, r.Seed)
+	for _, stage := range r.Stages {
+		status := "ok"
+		if stage.Err != nil {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "\n  %-8v %-4s %v", stage.Stage, status,
+			stage.Duration.Round(time.Millisecond))
+	}
+	if r.Failure != nil {
+		fmt.Fprintf(&b, "\n  %v", r.Failure)
+	}
+
+	return b.String()
+}
+
+// selfTestBlock is what a block of the main chain was generated with.
+type selfTestBlock struct {
+	spec blockchain.BlockSpec
+	seed int64
+}
+
+// selfTest is a run of the self-test.
+type selfTest struct {
+	cfg       SelfTestConfig
+	interrupt <-chan struct{}
+	params    chaincfg.Params
+	dir       string
+
+	db      database.DB
+	chain   *blockchain.BlockChain
+	manager *Manager
+	flat    *FlatUtreexoProofIndex
+	indexes []Indexer
+
+	// tip is the tip of the main chain and spendables are the outputs
+	// that may be spent by the next block.  blocks and outs are what
+	// every block of the main chain was generated with and the outputs
+	// that were spendable after it.
+	tip        *btcutil.Block
+	spendables []*blockchain.SpendableOut
+	blocks     map[int32]selfTestBlock
+	outs       map[int32][]*blockchain.SpendableOut
+}
+
+// RunSelfTest exercises the whole bridge pipeline on a throwaway regtest chain.
+// The blocks are generated in the shapes of SelfTestSpecs and connected to both
+// proof indexes, the last ones are reorged out, and then the indexes are
+// compared, every proof is verified, and a compact state node is synced from
+// the proofs.  The data is kept in a temporary directory that's removed once
+// the self-test is done so nothing of the node is touched.
+//
+// The self-test stops at the first stage that fails and is cancelled when the
+// interrupt channel is closed.
+func RunSelfTest(cfg *SelfTestConfig, interrupt <-chan struct{}) *SelfTestResult {
+	t := &selfTest{
+		cfg:       *cfg,
+		interrupt: interrupt,
+		params:    chaincfg.RegressionNetParams,
+		blocks:    make(map[int32]selfTestBlock),
+		outs:      make(map[int32][]*blockchain.SpendableOut),
+	}
+	t.params.CoinbaseMaturity = 1
+	if t.cfg.Seed == 0 {
+		t.cfg.Seed = time.Now().UnixNano()
+	}
+	if t.cfg.NumBlocks == 0 {
+		t.cfg.NumBlocks = defaultSelfTestBlocks
+	}
+	if t.cfg.ReorgDepth == 0 {
+		t.cfg.ReorgDepth = defaultSelfTestReorgDepth
+	}
+	defer t.tearDown()
+
+	result := &SelfTestResult{Seed: t.cfg.Seed}
+	stages := []func() *SelfTestFailure{
+		SelfTestSetup:    t.setup,
+		SelfTestGenerate: t.generate,
+		SelfTestReorg:    t.reorg,
+		SelfTestCompare:  t.compare,
+		SelfTestVerify:   t.verify,
+		SelfTestCSNSync:  t.csnSync,
+	}
+	for stage, run := range stages {
+		start := time.Now()
+		failure := run()
+		if failure == nil && interruptRequested(interrupt) {
+			failure = &SelfTestFailure{Err: errInterruptRequested}
+		}
+
+		stageResult := SelfTestStageResult{
+			Stage:    SelfTestStage(stage),
+			Duration: time.Since(start),
+		}
+		if failure != nil {
+			failure.Stage = SelfTestStage(stage)
+			stageResult.Err = failure.Err
+			result.Failure = failure
+		}
+		result.Stages = append(result.Stages, stageResult)
+		if failure != nil {
+			break
+		}
+	}
+
+	return result
+}
+
+// atBlock returns a failure at the block of the main chain at the given height.
+func (t *selfTest) atBlock(height int32, err error) *SelfTestFailure {
+	failure := &SelfTestFailure{Height: height, Err: err}
+	if block, ok := t.blocks[height]; ok {
+		failure.Spec = &block.spec
+		failure.Seed = block.seed
+	}
+
+	return failure
+}
+
+// setup creates the throwaway chain and both proof indexes.
+func (t *selfTest) setup() *SelfTestFailure {
+	dir, err := os.MkdirTemp(t.cfg.TempDir, "utreexod-selftest-")
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+	t.dir = dir
+
+	t.db, err = database.Create("ffldb", filepath.Join(dir, "blocks"),
+		t.params.Net)
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+
+	interval := int32(1)
+	t.flat, err = NewFlatUtreexoProofIndex(dir, &t.params, &interval, 0, false)
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+	utreexoProofIndex, err := NewUtreexoProofIndex(t.db, dir, &t.params)
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+	t.flat.SetUndoAssertions(true)
+	utreexoProofIndex.SetUndoAssertions(true)
+	t.indexes = []Indexer{utreexoProofIndex, t.flat}
+
+	t.manager = NewManager(t.db, t.indexes)
+	t.chain, err = blockchain.New(&blockchain.Config{
+		DB:               t.db,
+		ChainParams:      &t.params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     t.manager,
+	})
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+	err = t.manager.Init(t.chain, t.interrupt)
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+
+	t.tip = btcutil.NewBlock(t.params.GenesisBlock)
+	t.outs[0] = nil
+
+	return nil
+}
+
+// connect generates a block of the given spec on top of the given parent and
+// processes it.  It returns the block, the outputs that are spendable after it,
+// and whether it's on the main chain.
+func (t *selfTest) connect(parent *btcutil.Block,
+	spendables []*blockchain.SpendableOut, spec blockchain.BlockSpec,
+	seed int64) (*btcutil.Block, []*blockchain.SpendableOut, bool, error) {
+
+	block, outs, err := blockchain.GenerateBlockFromSpec(t.chain, parent,
+		spendables, spec, seed)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	isMainChain, _, err := t.chain.ProcessBlock(block, blockchain.BFNone)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return block, outs, isMainChain, nil
+}
+
+// generate generates the blocks of the main chain.
+func (t *selfTest) generate() *SelfTestFailure {
+	for i := int32(0); i < t.cfg.NumBlocks; i++ {
+		if interruptRequested(t.interrupt) {
+			return &SelfTestFailure{Err: errInterruptRequested}
+		}
+
+		height := t.tip.Height() + 1
+		spec := SelfTestSpecs[int(i)%len(SelfTestSpecs)]
+		seed := t.cfg.Seed + int64(height)
+		t.blocks[height] = selfTestBlock{spec: spec, seed: seed}
+
+		block, outs, isMainChain, err := t.connect(t.tip, t.spendables,
+			spec, seed)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		if !isMainChain {
+			return t.atBlock(height, fmt.Errorf("block %v didn't "+
+				"extend the main chain", block.Hash()))
+		}
+		t.tip, t.spendables = block, outs
+		t.outs[height] = outs
+	}
+
+	return nil
+}
+
+// reorg reorgs out the last blocks with a longer fork that spends the outputs
+// differently.
+func (t *selfTest) reorg() *SelfTestFailure {
+	forkHeight := t.tip.Height() - t.cfg.ReorgDepth
+	if forkHeight < 0 {
+		return &SelfTestFailure{Err: fmt.Errorf("can't reorg %d blocks "+
+			"of a chain of %d", t.cfg.ReorgDepth, t.tip.Height())}
+	}
+	parent, err := t.chain.BlockByHeight(forkHeight)
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+	spendables := t.outs[forkHeight]
+
+	for i := int32(0); i <= t.cfg.ReorgDepth; i++ {
+		if interruptRequested(t.interrupt) {
+			return &SelfTestFailure{Err: errInterruptRequested}
+		}
+
+		height := parent.Height() + 1
+		spec := SelfTestSpecs[int(height)%len(SelfTestSpecs)]
+		seed := t.cfg.Seed + selfTestForkSeedOffset + int64(height)
+		t.blocks[height] = selfTestBlock{spec: spec, seed: seed}
+
+		block, outs, _, err := t.connect(parent, spendables, spec, seed)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		parent, spendables = block, outs
+		t.outs[height] = outs
+	}
+
+	best := t.chain.BestSnapshot()
+	if best.Hash != *parent.Hash() {
+		return &SelfTestFailure{Err: fmt.Errorf("expected the fork tip "+
+			"%v at height %d to be the best block, got %v at "+
+			"height %d", parent.Hash(), parent.Height(), best.Hash,
+			best.Height)}
+	}
+	t.tip, t.spendables = parent, spendables
+
+	return nil
+}
+
+// compare checks that both proof indexes stored the same proof and undo block
+// for every block and that the undo blocks invert the blocks.
+func (t *selfTest) compare() *SelfTestFailure {
+	tip := t.tip.Height()
+	for height := int32(1); height <= tip; height++ {
+		if interruptRequested(t.interrupt) {
+			return &SelfTestFailure{Err: errInterruptRequested}
+		}
+
+		hash, err := t.chain.BlockHashByHeight(height)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		result, err := t.manager.CompareIndexesAt(&BlockID{
+			Height: height,
+			Hash:   *hash,
+		})
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		if !result.Agree() {
+			return t.atBlock(height, fmt.Errorf("%v", result.String()))
+		}
+	}
+
+	for height := int32(1); height <= tip; height++ {
+		err := t.flat.VerifyUndoInverts(height)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+	}
+
+	return nil
+}
+
+// verify verifies the proof of every block against the accumulator of the
+// block before it.  The leaves that are proven are the ones of the outputs
+// that the block spends according to the chain rather than the ones in the
+// proof.
+func (t *selfTest) verify() *SelfTestFailure {
+	schedule := t.params.LeafCommitments
+	for height := int32(1); height <= t.tip.Height(); height++ {
+		if interruptRequested(t.interrupt) {
+			return &SelfTestFailure{Err: errInterruptRequested}
+		}
+
+		block, err := t.chain.BlockByHeight(height)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		ud, err := t.flat.FetchUtreexoProof(height, false)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		if t.cfg.proofFailpoint != nil {
+			t.cfg.proofFailpoint(height, ud)
+		}
+
+		stxos, err := t.chain.FetchSpendJournal(block)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		_, _, inskip, _ := blockchain.DedupeBlock(block)
+		dels, _, err := blockchain.BlockToDelLeaves(stxos, t.chain, block,
+			inskip, -1)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		delHashes := make([]accumulator.Hash, 0, len(dels))
+		for _, del := range dels {
+			if del.IsUnconfirmed() {
+				continue
+			}
+			delHashes = append(delHashes, del.ScheduledLeafHash(schedule))
+		}
+
+		err = t.flat.withSnapshotState(height-1, func() error {
+			return t.flat.utreexoState.state.VerifyBatchProof(
+				delHashes, ud.AccProof)
+		})
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+	}
+
+	return nil
+}
+
+// csnSync syncs a compact state node from the proofs of every block and checks
+// that it ends up at the same tip.
+func (t *selfTest) csnSync() *SelfTestFailure {
+	db, err := database.Create("ffldb", filepath.Join(t.dir, "csn"),
+		t.params.Net)
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+	defer db.Close()
+
+	csn, err := blockchain.New(&blockchain.Config{
+		DB:          db,
+		ChainParams: &t.params,
+		TimeSource:  blockchain.NewMedianTime(),
+		SigCache:    txscript.NewSigCache(1000),
+		UtreexoView: blockchain.NewUtreexoViewpoint(0),
+	})
+	if err != nil {
+		return &SelfTestFailure{Err: err}
+	}
+
+	for height := int32(1); height <= t.tip.Height(); height++ {
+		if interruptRequested(t.interrupt) {
+			return &SelfTestFailure{Err: errInterruptRequested}
+		}
+
+		block, err := t.chain.BlockByHeight(height)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		ud, err := t.flat.FetchUtreexoProof(height, false)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+		block.MsgBlock().UData = ud
+
+		_, _, err = csn.ProcessBlock(block, blockchain.BFNone)
+		if err != nil {
+			return t.atBlock(height, err)
+		}
+	}
+
+	if best := csn.BestSnapshot(); best.Hash != *t.tip.Hash() {
+		return &SelfTestFailure{Err: fmt.Errorf("expected the compact "+
+			"state node to be at %v, got %v at height %d",
+			t.tip.Hash(), best.Hash, best.Height)}
+	}
+
+	return nil
+}
+
+// tearDown closes the throwaway chain and removes its data.
+func (t *selfTest) tearDown() {
+	if t.db != nil {
+		t.db.Close()
+	}
+	if t.dir == "" {
+		return
+	}
+	err := os.RemoveAll(t.dir)
+	if err != nil {
+		log.Warnf("Unable to remove the self-test data in %s: %v",
+			t.dir, err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestRunSelfTest ensures that the self-test passes every stage and leaves
+// nothing behind.
+func TestRunSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	result := RunSelfTest(&SelfTestConfig{
+		Seed:      1,
+		NumBlocks: 12,
+		TempDir:   dir,
+	}, nil)
+	if !result.Passed() {
+		t.Fatalf("expected the self-test to pass:\n%v", result)
+	}
+	for i, stage := range result.Stages {
+		if stage.Stage != SelfTestStage(i) {
+			t.Fatalf("expected stage %v, got %v", SelfTestStage(i),
+				stage.Stage)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the self-test data to be removed, got %d "+
+			"entries", len(entries))
+	}
+}
+
+// TestSelfTestCorruptProof ensures that a corrupted proof fails the verify
+// stage at the height of its block along with what the block was generated
+// with.
+func TestSelfTestCorruptProof(t *testing.T) {
+	corrupted := int32(-1)
+	result := RunSelfTest(&SelfTestConfig{
+		Seed:      2,
+		NumBlocks: 12,
+		TempDir:   t.TempDir(),
+		proofFailpoint: func(height int32, ud *wire.UData) {
+			if corrupted != -1 || len(ud.AccProof.Targets) == 0 {
+				return
+			}
+			corrupted = height
+			ud.AccProof.Targets[0]++
+		},
+	}, nil)
+	if result.Passed() || result.Failure == nil {
+		t.Fatal("expected the self-test to fail")
+	}
+	failure := result.Failure
+	if failure.Stage != SelfTestVerify || failure.Height != corrupted {
+		t.Fatalf("expected a failure at the verify stage at height %d, "+
+			"got %v", corrupted, failure)
+	}
+	spec := SelfTestSpecs[int(corrupted-1)%len(SelfTestSpecs)]
+	if failure.Spec == nil || !reflect.DeepEqual(*failure.Spec, spec) ||
+		failure.Seed != 2+int64(corrupted) {
+
+		t.Fatalf("unexpected spec or seed in %v", failure)
+	}
+	if last := result.Stages[len(result.Stages)-1]; last.Stage != SelfTestVerify {
+		t.Fatalf("expected the self-test to stop at the verify stage, "+
+			"got %v", last.Stage)
+	}
+}
+
+// TestSelfTestInterrupt ensures that the self-test stops when it's interrupted.
+func TestSelfTestInterrupt(t *testing.T) {
+	interrupt := make(chan struct{})
+	close(interrupt)
+
+	result := RunSelfTest(&SelfTestConfig{TempDir: t.TempDir()}, interrupt)
+	if result.Failure == nil || result.Failure.Err != errInterruptRequested {
+		t.Fatalf("expected the self-test to be interrupted, got %v", result)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+)
+
+// ServingLagRecord is the timing of a block from being connected to the main
+// chain to its utreexo proof being served.  The times that weren't reached yet
+// are zero.
+type ServingLagRecord struct {
+	// Height and Hash are the block.
+	Height int32
+	Hash   chainhash.Hash
+
+	// Connected is when the chain handed the block to the index manager.
+	Connected time.Time
+
+	// Generated is when every index was done connecting the block, which
+	// is when its utreexo proof was generated.
+	Generated time.Time
+
+	// Durable is when everything the indexes keep for the block was
+	// persisted.  The indexes that don't report a durable height are taken
+	// to be durable once they connected the block.
+	Durable time.Time
+
+	// FirstServed is when the proof of the block was first served to a
+	// peer or an RPC client.
+	FirstServed time.Time
+}
+
+// lag returns the duration from the start time to the end time and whether the
+// end time was reached.
+func lag(start, end time.Time) (time.Duration, bool) {
+	if end.IsZero() {
+		return 0, false
+	}
+
+	return end.Sub(start), true
+}
+
+// LagSummary summarizes the lags of one stage over the recorded blocks.
+type LagSummary struct {
+	// Count is the number of recorded blocks that reached the stage.
+	Count int
+
+	// P50, P90, and P99 are the percentiles of the lags and Max is the
+	// longest lag.
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// summarizeLags returns the summary of the passed in lags.  The lags are sorted
+// in place.
+func summarizeLags(lags []time.Duration) LagSummary {
+	if len(lags) == 0 {
+		return LagSummary{}
+	}
+
+	sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+	percentile := func(p int) time.Duration {
+		return lags[(len(lags)-1)*p/100]
+	}
+
+	return LagSummary{
+		Count: len(lags),
+		P50:   percentile(50),
+		P90:   percentile(90),
+		P99:   percentile(99),
+		Max:   lags[len(lags)-1],
+	}
+}
+
+// ServingLagStats are the lags of the recorded blocks measured from when they
+// were connected.
+type ServingLagStats struct {
+	// Blocks is the number of recorded blocks.
+	Blocks int
+
+	// Generation is the lag until the proofs were generated.
+	Generation LagSummary
+
+	// Durability is the lag until the proofs were persisted.
+	Durability LagSummary
+
+	// FirstServe is the lag until the proofs were first served.
+	FirstServe LagSummary
+}
+
+// servingLagExport is a record as it's appended to the export file.  The lags
+// of the stages that weren't reached are -1.
+type servingLagExport struct {
+	Height        int32  `json:"height"`
+	Hash          string `json:"hash"`
+	Connected     int64  `json:"connected"`
+	GenerationLag int64  `json:"generationlag"`
+	DurabilityLag int64  `json:"durabilitylag"`
+	FirstServeLag int64  `json:"firstservelag"`
+}
+
+// ServingLag records when the proofs of the last connected blocks became
+// fetchable to quantify the lag of serving them.  A nil ServingLag records
+// nothing.
+type ServingLag struct {
+	// mtx protects all the fields below.
+	mtx sync.Mutex
+
+	// max is the number of blocks the records are kept for.
+	max int
+
+	// records are the records of the last connected blocks in the order
+	// they were connected and byHash are the same records by block hash.
+	records []*ServingLagRecord
+	byHash  map[chainhash.Hash]*ServingLagRecord
+
+	// export is the file the records are appended to once they're dropped
+	// from memory.  It's nil if the records aren't exported.
+	export *os.File
+
+	// now returns the current time.  It's only replaced by tests.
+	now func() time.Time
+}
+
+// NewServingLag returns a ServingLag that keeps the records of the last
+// maxBlocks connected blocks.  If exportPath isn't empty, the records are
+// appended to that file as lines of JSON once they're dropped from memory.
+func NewServingLag(maxBlocks int, exportPath string) (*ServingLag, error) {
+	s := &ServingLag{
+		max:    maxBlocks,
+		byHash: make(map[chainhash.Hash]*ServingLagRecord),
+		now:    time.Now,
+	}
+	if exportPath != "" {
+		f, err := os.OpenFile(exportPath,
+			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		s.export = f
+	}
+
+	return s, nil
+}
+
+// connected starts the record of the block at the given height.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) connected(height int32, hash *chainhash.Hash) {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Start over if connecting the block is retried.
+	if _, ok := s.byHash[*hash]; ok {
+		s.remove(hash)
+	}
+
+	rec := &ServingLagRecord{
+		Height:    height,
+		Hash:      *hash,
+		Connected: s.now(),
+	}
+	s.records = append(s.records, rec)
+	s.byHash[*hash] = rec
+
+	for len(s.records) > s.max {
+		s.exportRecord(s.records[0])
+		delete(s.byHash, s.records[0].Hash)
+		s.records[0] = nil
+		s.records = s.records[1:]
+	}
+}
+
+// generated records that the indexes are done connecting the block.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) generated(hash *chainhash.Hash) {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if rec, ok := s.byHash[*hash]; ok && rec.Generated.IsZero() {
+		rec.Generated = s.now()
+	}
+}
+
+// durable records that everything the indexes keep for the blocks up to and
+// including the given height was persisted.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) durable(height int32) {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	for _, rec := range s.records {
+		if rec.Height <= height && !rec.Generated.IsZero() &&
+			rec.Durable.IsZero() {
+
+			rec.Durable = now
+		}
+	}
+}
+
+// disconnected drops the record of a block that was disconnected.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) disconnected(hash *chainhash.Hash) {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.byHash[*hash]; ok {
+		s.remove(hash)
+	}
+}
+
+// remove drops the record of the block.
+//
+// This function MUST be called with the mtx held.
+func (s *ServingLag) remove(hash *chainhash.Hash) {
+	delete(s.byHash, *hash)
+	for i, rec := range s.records {
+		if rec.Hash == *hash {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+			break
+		}
+	}
+}
+
+// Served records that the proof of the block was served.  Only the first time
+// is kept.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) Served(hash *chainhash.Hash) {
+	if s == nil {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if rec, ok := s.byHash[*hash]; ok && rec.FirstServed.IsZero() {
+		rec.FirstServed = s.now()
+	}
+}
+
+// Records returns copies of the records of the last connected blocks in the
+// order they were connected.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) Records() []ServingLagRecord {
+	if s == nil {
+		return nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	records := make([]ServingLagRecord, len(s.records))
+	for i, rec := range s.records {
+		records[i] = *rec
+	}
+
+	return records
+}
+
+// Stats returns the summaries of the lags of the recorded blocks.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) Stats() ServingLagStats {
+	if s == nil {
+		return ServingLagStats{}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var generation, durability, firstServe []time.Duration
+	for _, rec := range s.records {
+		if d, ok := lag(rec.Connected, rec.Generated); ok {
+			generation = append(generation, d)
+		}
+		if d, ok := lag(rec.Connected, rec.Durable); ok {
+			durability = append(durability, d)
+		}
+		if d, ok := lag(rec.Connected, rec.FirstServed); ok {
+			firstServe = append(firstServe, d)
+		}
+	}
+
+	return ServingLagStats{
+		Blocks:     len(s.records),
+		Generation: summarizeLags(generation),
+		Durability: summarizeLags(durability),
+		FirstServe: summarizeLags(firstServe),
+	}
+}
+
+// Close appends the records still in memory to the export file and closes it.
+//
+// This function is safe for concurrent access.
+func (s *ServingLag) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.export == nil {
+		return nil
+	}
+	for _, rec := range s.records {
+		s.exportRecord(rec)
+	}
+	err := s.export.Close()
+	s.export = nil
+
+	return err
+}
+
+// exportRecord appends the record to the export file if there is one.
+//
+// This function MUST be called with the mtx held.
+func (s *ServingLag) exportRecord(rec *ServingLagRecord) {
+	if s.export == nil {
+		return
+	}
+
+	lagNanos := func(end time.Time) int64 {
+		d, ok := lag(rec.Connected, end)
+		if !ok {
+			return -1
+		}
+		return int64(d)
+	}
+	line, err := json.Marshal(&servingLagExport{
+		Height:        rec.Height,
+		Hash:          rec.Hash.String(),
+		Connected:     rec.Connected.UnixNano(),
+		GenerationLag: lagNanos(rec.Generated),
+		DurabilityLag: lagNanos(rec.Durable),
+		FirstServeLag: lagNanos(rec.FirstServed),
+	})
+	if err == nil {
+		_, err = s.export.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Warnf("Unable to export the serving lag of block %v: %v",
+			rec.Hash, err)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// delayIndexer is a fakeRebuilder that calls delay every time it connects a
+// block to simulate slow proof generation.
+type delayIndexer struct {
+	fakeRebuilder
+	delay func(height int32)
+}
+
+func (idx *delayIndexer) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	idx.delay(n.Height)
+	return idx.fakeRebuilder.ConnectBlock(dbTx, n)
+}
+
+func TestServingLagExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servinglag.json")
+	s, err := NewServingLag(2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	// Connect three blocks a second apart with each taking a second to
+	// generate and only the first being served.
+	for height := int32(1); height <= 3; height++ {
+		hash := &chainhash.Hash{byte(height)}
+		s.connected(height, hash)
+		now = now.Add(time.Second)
+		s.generated(hash)
+		if height == 1 {
+			s.durable(1)
+			now = now.Add(time.Second)
+			s.Served(hash)
+		}
+	}
+
+	// The first block is dropped from memory once the third is connected
+	// and the third is dropped when it's disconnected.
+	s.disconnected(&chainhash.Hash{3})
+	records := s.Records()
+	if len(records) != 1 || records[0].Height != 2 {
+		t.Fatalf("expected only the record of block 2, got %+v", records)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var exported []servingLagExport
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec servingLagExport
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		exported = append(exported, rec)
+	}
+
+	want := []servingLagExport{
+		{
+			Height:        1,
+			Hash:          chainhash.Hash{1}.String(),
+			Connected:     time.Unix(1700000000, 0).UnixNano(),
+			GenerationLag: int64(time.Second),
+			DurabilityLag: int64(time.Second),
+			FirstServeLag: int64(2 * time.Second),
+		},
+		{
+			Height:        2,
+			Hash:          chainhash.Hash{2}.String(),
+			Connected:     time.Unix(1700000002, 0).UnixNano(),
+			GenerationLag: int64(time.Second),
+			DurabilityLag: -1,
+			FirstServeLag: -1,
+		},
+	}
+	if len(exported) != len(want) {
+		t.Fatalf("expected %d exported records, got %+v", len(want),
+			exported)
+	}
+	for i := range want {
+		if exported[i] != want[i] {
+			t.Fatalf("record %d: expected %+v, got %+v", i, want[i],
+				exported[i])
+		}
+	}
+}
+
+// TestManagerServingLag ensures that the lags that the index manager records
+// for the connected blocks are the delays injected at each stage.
+func TestManagerServingLag(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestManagerServingLag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	// Generating the proof of each block takes as many seconds as its
+	// height and the proofs aren't durable until the indexes are flushed.
+	now := time.Unix(1700000000, 0)
+	generating := &delayIndexer{
+		fakeRebuilder: fakeRebuilder{key: []byte("delay")},
+		delay: func(height int32) {
+			now = now.Add(time.Duration(height) * time.Second)
+		},
+	}
+	aligner := &fakeAligner{durable: -1}
+
+	servingLag, err := NewServingLag(10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servingLag.now = func() time.Time { return now }
+
+	m := NewManager(db, []Indexer{generating, aligner})
+	m.SetServingLag(servingLag)
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Init(chain, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const numBlocks = 3
+	var spends []*blockchain.SpendableOut
+	block := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < numBlocks; b++ {
+		block, spends = blockchain.AddBlock(chain, block, spends)
+	}
+
+	// Make the blocks durable ten seconds after the last one was connected
+	// and serve the first two five seconds after that.
+	now = now.Add(10 * time.Second)
+	aligner.durable = numBlocks
+	if err := m.FlushIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	durableAt := now
+	now = now.Add(5 * time.Second)
+	records := servingLag.Records()
+	if len(records) != numBlocks {
+		t.Fatalf("expected %d records, got %d", numBlocks, len(records))
+	}
+	for _, rec := range records[:2] {
+		servingLag.Served(&rec.Hash)
+	}
+	servedAt := now
+
+	records = servingLag.Records()
+	for i, rec := range records {
+		height := int32(i + 1)
+		hash, err := chain.BlockHashByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Height != height || rec.Hash != *hash {
+			t.Fatalf("record %d is for block %v at height %d", i,
+				rec.Hash, rec.Height)
+		}
+		if got := rec.Generated.Sub(rec.Connected); got !=
+			time.Duration(height)*time.Second {
+
+			t.Fatalf("block %d: expected a generation lag of %ds, "+
+				"got %v", height, height, got)
+		}
+		if !rec.Durable.Equal(durableAt) {
+			t.Fatalf("block %d: expected to be durable at %v, got %v",
+				height, durableAt, rec.Durable)
+		}
+		served := height <= 2
+		if served != rec.FirstServed.Equal(servedAt) {
+			t.Fatalf("block %d: unexpected first serve time %v",
+				height, rec.FirstServed)
+		}
+	}
+
+	// The blocks were connected at 0s, 1s, and 3s, generated at 1s, 3s,
+	// and 6s, durable at 16s, and the first two were served at 21s.
+	stats := m.ServingLagStats()
+	want := ServingLagStats{
+		Blocks: numBlocks,
+		Generation: LagSummary{Count: 3, P50: 2 * time.Second,
+			P90: 2 * time.Second, P99: 2 * time.Second,
+			Max: 3 * time.Second},
+		Durability: LagSummary{Count: 3, P50: 15 * time.Second,
+			P90: 15 * time.Second, P99: 15 * time.Second,
+			Max: 16 * time.Second},
+		FirstServe: LagSummary{Count: 2, P50: 20 * time.Second,
+			P90: 20 * time.Second, P99: 20 * time.Second,
+			Max: 21 * time.Second},
+	}
+	if stats != want {
+		t.Fatalf("expected stats %+v, got %+v", want, stats)
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// defaultShadowSampleInterval is how many blocks apart the blocks that
+	// a shadow index is compared against its primary at are by default.
+	defaultShadowSampleInterval = 16
+
+	// shadowRoleSize is the size of a recorded promotion without the name
+	// of the promoted index.  It's the height, the promotion time, and
+	// whether the old primary was detached.
+	shadowRoleSize = 4 + 8 + 1
+)
+
+// shadowRolesBucketName is the name of the bucket in the metadata that keeps
+// the last promotion of every pair of indexes that were run as a shadow and
+// its primary.
+var shadowRolesBucketName = []byte("idxshadowroles")
+
+// ErrShadowDiverged is the error that's wrapped when a shadow index that
+// diverged from its primary is asked to be promoted without forcing it.
+var ErrShadowDiverged = errors.New("shadow index diverged from its primary")
+
+// ShadowDivergedError is returned when a shadow index that stored something
+// else than its primary for any of the compared blocks is asked to be promoted.
+type ShadowDivergedError struct {
+	// Shadow and Primary are the names of the indexes.
+	Shadow  string
+	Primary string
+
+	// Divergences is the number of compared blocks they differ on.
+	Divergences uint64
+}
+
+// Error returns the error as a human-readable string.
+func (e *ShadowDivergedError) Error() string {
+	return fmt.Sprintf("%v: the %s differs from the %s on %d of the "+
+		"compared blocks. It can only be promoted when forced",
+		ErrShadowDiverged, e.Shadow, e.Primary, e.Divergences)
+}
+
+// Is returns true for ErrShadowDiverged.
+func (e *ShadowDivergedError) Is(target error) bool {
+	return target == ErrShadowDiverged
+}
+
+// shadowIndexer is an index that may be run as the shadow of another one.
+type shadowIndexer interface {
+	proofStore
+
+	// setShadow sets whether the index is run as a shadow.
+	setShadow(shadow bool)
+}
+
+// Ensure the utreexo proof indexes implement the shadowIndexer interface.
+var _ shadowIndexer = (*FlatUtreexoProofIndex)(nil)
+var _ shadowIndexer = (*UtreexoProofIndex)(nil)
+
+// ShadowStats are how a shadow index compared against its primary.
+type ShadowStats struct {
+	// Shadow and Primary are the names of the indexes.
+	Shadow  string
+	Primary string
+
+	// SampleInterval is how many blocks apart the compared blocks are.
+	SampleInterval int32
+
+	// Compared is the number of blocks that were compared and Divergences
+	// how many of them the indexes differ on.
+	Compared    uint64
+	Divergences uint64
+
+	// FetchErrors is the number of blocks that couldn't be compared as
+	// either of the indexes failed to fetch them.
+	FetchErrors uint64
+
+	// LastDivergence is the last comparison that the indexes differed on.
+	// It's nil if they never did.
+	LastDivergence *ComparisonResult
+}
+
+// shadowExperiment is an index that's run as the shadow of a primary index.
+// The shadow is connected to every block like the primary and the blocks are
+// compared between them once both connected them.
+//
+// The fields are protected by the experiment mutex of the manager.
+type shadowExperiment struct {
+	shadow  shadowIndexer
+	primary shadowIndexer
+
+	// pending is the block to compare once the database transaction that
+	// connected it was committed.  It's nil if there's none.
+	pending *BlockID
+
+	stats ShadowStats
+
+	// corrupt is called with the proof that the shadow stored for the
+	// compared block before it's compared.  It's only ever set by tests
+	// to make the shadow diverge.
+	corrupt func(id *BlockID, ud *wire.UData)
+}
+
+// RegisterShadow runs the shadow index as the shadow of the primary index.  The
+// shadow is connected to the blocks like any other enabled index but what it
+// stores is never to be served.  Every sampleInterval blocks, the proof and the
+// undo block that it stored are compared against the ones of the primary.  The
+// default interval is used if it's zero.
+//
+// Both indexes must be enabled in the manager.  If the shadow was promoted the
+// last time they were run together, it's run as the primary instead.
+func (m *Manager) RegisterShadow(shadow, primary Indexer,
+	sampleInterval int32) error {
+
+	if sampleInterval < 0 {
+		return fmt.Errorf("negative shadow sample interval %d",
+			sampleInterval)
+	}
+	if sampleInterval == 0 {
+		sampleInterval = defaultShadowSampleInterval
+	}
+
+	var shadowIdx, primaryIdx shadowIndexer
+	for _, indexer := range m.enabledIndexes {
+		idx, ok := indexer.(shadowIndexer)
+		switch {
+		case indexer == shadow && ok:
+			shadowIdx = idx
+		case indexer == primary && ok:
+			primaryIdx = idx
+		}
+	}
+	if shadowIdx == nil || primaryIdx == nil || shadowIdx == primaryIdx {
+		return fmt.Errorf("the shadow and the primary must be two " +
+			"different enabled utreexo proof indexes")
+	}
+
+	m.experimentMtx.Lock()
+	defer m.experimentMtx.Unlock()
+
+	for _, exp := range m.shadows {
+		for _, idx := range []shadowIndexer{exp.shadow, exp.primary} {
+			if idx == shadowIdx || idx == primaryIdx {
+				return fmt.Errorf("the %s is already run in a "+
+					"shadow experiment", idx.Name())
+			}
+		}
+	}
+
+	// Keep the roles of the last promotion of the pair.
+	var promoted string
+	err := m.db.View(func(dbTx database.Tx) error {
+		var err error
+		promoted, _, err = dbFetchShadowRole(dbTx, shadowIdx.Name(),
+			primaryIdx.Name())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if promoted == shadowIdx.Name() {
+		log.Infof("Running the %s as the primary of the %s as it was "+
+			"promoted", shadowIdx.Name(), primaryIdx.Name())
+		shadowIdx, primaryIdx = primaryIdx, shadowIdx
+	}
+
+	shadowIdx.setShadow(true)
+	primaryIdx.setShadow(false)
+	m.shadows = append(m.shadows, &shadowExperiment{
+		shadow:  shadowIdx,
+		primary: primaryIdx,
+		stats: ShadowStats{
+			Shadow:         shadowIdx.Name(),
+			Primary:        primaryIdx.Name(),
+			SampleInterval: sampleInterval,
+		},
+	})
+
+	return nil
+}
+
+// IsShadow returns whether the index with the given name is run as a shadow or
+// was detached when its shadow was promoted.  What such an index stores must
+// never be served.
+//
+// This function is safe for concurrent access.
+func (m *Manager) IsShadow(name string) bool {
+	m.experimentMtx.Lock()
+	defer m.experimentMtx.Unlock()
+
+	for _, exp := range m.shadows {
+		if exp.shadow.Name() == name {
+			return true
+		}
+	}
+	for indexer := range m.detached {
+		if indexer.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ShadowStats returns how every shadow index compared against its primary.
+//
+// This function is safe for concurrent access.
+func (m *Manager) ShadowStats() []ShadowStats {
+	m.experimentMtx.Lock()
+	defer m.experimentMtx.Unlock()
+
+	stats := make([]ShadowStats, 0, len(m.shadows))
+	for _, exp := range m.shadows {
+		stats = append(stats, exp.stats)
+	}
+
+	return stats
+}
+
+// PromoteShadow makes the shadow index with the given name the primary and the
+// primary its shadow.  If detach is set, the old primary is no longer connected
+// to the blocks at all and may be dropped.  A ShadowDivergedError is returned
+// if the shadow diverged from its primary unless force is set.
+//
+// The roles are swapped between two blocks and the promotion is recorded in
+// the database so that the indexes keep their roles when they're registered
+// again.  The comparison counts start over.
+//
+// This function is safe for concurrent access.
+func (m *Manager) PromoteShadow(name string, force, detach bool) error {
+	m.experimentMtx.Lock()
+	defer m.experimentMtx.Unlock()
+
+	var exp *shadowExperiment
+	for _, e := range m.shadows {
+		if e.shadow.Name() == name {
+			exp = e
+		}
+	}
+	if exp == nil {
+		return fmt.Errorf("no shadow index named %q is registered",
+			name)
+	}
+	if exp.stats.Divergences > 0 && !force {
+		return &ShadowDivergedError{
+			Shadow:      exp.stats.Shadow,
+			Primary:     exp.stats.Primary,
+			Divergences: exp.stats.Divergences,
+		}
+	}
+
+	var height int32
+	if m.chain != nil {
+		height = m.chain.BestSnapshot().Height
+	}
+	err := m.db.Update(func(dbTx database.Tx) error {
+		return dbPutShadowRole(dbTx, exp.shadow.Name(),
+			exp.primary.Name(), height, time.Now(), detach)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Promoted the %s over the %s at height %d (forced: %v, "+
+		"detached: %v)", exp.shadow.Name(), exp.primary.Name(), height,
+		force, detach)
+
+	exp.shadow, exp.primary = exp.primary, exp.shadow
+	exp.shadow.setShadow(true)
+	exp.primary.setShadow(false)
+	exp.pending = nil
+	exp.stats = ShadowStats{
+		Shadow:         exp.shadow.Name(),
+		Primary:        exp.primary.Name(),
+		SampleInterval: exp.stats.SampleInterval,
+	}
+	if detach {
+		if m.detached == nil {
+			m.detached = make(map[Indexer]struct{})
+		}
+		m.detached[exp.shadow] = struct{}{}
+
+		// The detached index is no longer compared.
+		for i, e := range m.shadows {
+			if e == exp {
+				m.shadows = append(m.shadows[:i], m.shadows[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// isDetached returns whether the index was detached when its shadow was
+// promoted.
+//
+// This function MUST be called with the experiment mutex held.
+func (m *Manager) isDetached(indexer Indexer) bool {
+	_, ok := m.detached[indexer]
+	return ok
+}
+
+// shadowConnected compares the blocks that are pending in the shadow
+// experiments now that the database transaction that connected them was
+// committed and makes the connected block pending at the sample interval.
+//
+// This function MUST be called with the experiment mutex held.
+func (m *Manager) shadowConnected(id *BlockID) {
+	for _, exp := range m.shadows {
+		if exp.pending != nil {
+			m.compareShadow(exp, exp.pending)
+			exp.pending = nil
+		}
+		if id.Height%exp.stats.SampleInterval == 0 {
+			pending := *id
+			exp.pending = &pending
+		}
+	}
+}
+
+// shadowDisconnected drops the disconnected block from the pending blocks of
+// the shadow experiments.
+//
+// This function MUST be called with the experiment mutex held.
+func (m *Manager) shadowDisconnected(id *BlockID) {
+	for _, exp := range m.shadows {
+		if exp.pending != nil && exp.pending.Hash == id.Hash {
+			exp.pending = nil
+		}
+	}
+}
+
+// compareShadow compares what the shadow of the experiment stored for the
+// block against what its primary stored.  The shadow is compared against the
+// primary as the primary is what's served.
+//
+// This function MUST be called with the experiment mutex held.
+func (m *Manager) compareShadow(exp *shadowExperiment, id *BlockID) {
+	if m.isDegraded(exp.shadow) || m.isDegraded(exp.primary) {
+		return
+	}
+
+	result, err := compareProofStores(id, []proofStore{exp.primary,
+		exp.shadow}, exp.corrupt)
+	if err != nil {
+		exp.stats.FetchErrors++
+		log.Debugf("Unable to compare the %s against the %s: %v",
+			exp.shadow.Name(), exp.primary.Name(), err)
+		return
+	}
+
+	exp.stats.Compared++
+	if !result.Agree() {
+		exp.stats.Divergences++
+		exp.stats.LastDivergence = &result
+		log.Warnf("Shadow index diverged: %v", result.String())
+	}
+}
+
+// shadowRoleKey returns the key of the recorded promotion of the pair of
+// indexes with the given names.  The key is the same whichever was promoted.
+func shadowRoleKey(a, b string) []byte {
+	if a > b {
+		a, b = b, a
+	}
+
+	key := make([]byte, 0, len(a)+1+len(b))
+	key = append(key, a...)
+	key = append(key, 0)
+	return append(key, b...)
+}
+
+// dbPutShadowRole records that the index named promoted was promoted over the
+// one named demoted at the given height and time.
+func dbPutShadowRole(dbTx database.Tx, promoted, demoted string,
+	height int32, now time.Time, detached bool) error {
+
+	bucket, err := dbTx.Metadata().CreateBucketIfNotExists(
+		shadowRolesBucketName)
+	if err != nil {
+		return err
+	}
+
+	value := make([]byte, shadowRoleSize, shadowRoleSize+len(promoted))
+	binary.BigEndian.PutUint32(value, uint32(height))
+	binary.BigEndian.PutUint64(value[4:], uint64(now.Unix()))
+	if detached {
+		value[12] = 1
+	}
+	value = append(value, promoted...)
+
+	return bucket.Put(shadowRoleKey(promoted, demoted), value)
+}
+
+// dbFetchShadowRole returns the name of the index of the pair that was last
+// promoted and the height it was promoted at.  The name is empty if neither
+// was ever promoted.
+func dbFetchShadowRole(dbTx database.Tx, a, b string) (string, int32, error) {
+	bucket := dbTx.Metadata().Bucket(shadowRolesBucketName)
+	if bucket == nil {
+		return "", 0, nil
+	}
+	value := bucket.Get(shadowRoleKey(a, b))
+	if value == nil {
+		return "", 0, nil
+	}
+	if len(value) < shadowRoleSize {
+		return "", 0, database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("corrupt shadow promotion of "+
+				"%s and %s. Expected at least %d bytes but got "+
+				"%d", a, b, shadowRoleSize, len(value)),
+		}
+	}
+
+	promoted := value[shadowRoleSize:]
+	if !bytes.Equal(promoted, []byte(a)) && !bytes.Equal(promoted, []byte(b)) {
+		return "", 0, database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("corrupt shadow promotion of "+
+				"%s and %s. The promoted index is %q", a, b,
+				promoted),
+		}
+	}
+
+	return string(promoted), int32(binary.BigEndian.Uint32(value)), nil
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// shadowTestChain creates a chain with both utreexo proof indexes and returns
+// them apart.
+func shadowTestChain(t *testing.T, testName string) (*blockchain.BlockChain,
+	*Manager, *UtreexoProofIndex, *FlatUtreexoProofIndex, func()) {
+
+	chain, indexes, m, _, tearDown, err := faultyTestChain(testName)
+	if err != nil {
+		tearDown()
+		t.Fatal(err)
+	}
+
+	var dbIdx *UtreexoProofIndex
+	var flatIdx *FlatUtreexoProofIndex
+	for _, indexer := range indexes {
+		switch idx := indexer.(type) {
+		case *UtreexoProofIndex:
+			dbIdx = idx
+		case *FlatUtreexoProofIndex:
+			flatIdx = idx
+		}
+	}
+
+	return chain, m, dbIdx, flatIdx, tearDown
+}
+
+// TestShadowPromotion ensures that a shadow index that stores the same as its
+// primary never diverges through reorgs and is cleanly promoted, and that the
+// promotion is kept when the indexes are registered again.
+func TestShadowPromotion(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, m, dbIdx, flatIdx, tearDown := shadowTestChain(t,
+		"TestShadowPromotion")
+	defer tearDown()
+
+	err := m.RegisterShadow(flatIdx, dbIdx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterShadow(dbIdx, flatIdx, 1); err == nil {
+		t.Fatal("expected an error registering an index twice")
+	}
+
+	// Connect the blocks and reorg to a longer chain.
+	genesis := btcutil.NewBlock(chaincfg.RegressionNetParams.GenesisBlock)
+	b1, spends := blockchain.AddBlock(chain, genesis, nil)
+	addLockOrderBlocks(chain, b1, spends, 6)
+	tip := addLockOrderBlocks(chain, b1, spends, 9)
+
+	stats := m.ShadowStats()
+	if len(stats) != 1 || stats[0].Shadow != flatIdx.Name() ||
+		stats[0].Primary != dbIdx.Name() || stats[0].Compared == 0 ||
+		stats[0].Divergences != 0 || stats[0].FetchErrors != 0 {
+
+		t.Fatalf("unexpected shadow stats %+v", stats)
+	}
+	if !flatIdx.Stats().Shadow || dbIdx.Stats().Shadow ||
+		!m.IsShadow(flatIdx.Name()) || m.IsShadow(dbIdx.Name()) {
+
+		t.Fatalf("the flat index isn't the only shadow")
+	}
+
+	err = m.PromoteShadow(flatIdx.Name(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = m.ShadowStats()
+	if len(stats) != 1 || stats[0].Shadow != dbIdx.Name() ||
+		stats[0].Primary != flatIdx.Name() || stats[0].Compared != 0 {
+
+		t.Fatalf("unexpected shadow stats after the promotion %+v", stats)
+	}
+	if flatIdx.Stats().Shadow || !dbIdx.Stats().Shadow {
+		t.Fatalf("the roles weren't swapped")
+	}
+
+	// The promotion is recorded at the tip it was done at.
+	err = m.db.View(func(dbTx database.Tx) error {
+		promoted, height, err := dbFetchShadowRole(dbTx,
+			dbIdx.Name(), flatIdx.Name())
+		if err != nil {
+			return err
+		}
+		if promoted != flatIdx.Name() || height != tip.Height() {
+			t.Fatalf("recorded promotion of the %s at height %d, "+
+				"want the %s at height %d", promoted, height,
+				flatIdx.Name(), tip.Height())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The demoted index keeps being connected and compared.
+	for i := 0; i < 3; i++ {
+		tip, _ = blockchain.AddBlock(chain, tip, nil)
+	}
+	stats = m.ShadowStats()
+	if stats[0].Compared == 0 || stats[0].Divergences != 0 {
+		t.Fatalf("unexpected shadow stats %+v", stats)
+	}
+	err = testUtreexoProof(tip, chain, []Indexer{dbIdx, flatIdx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registering the pair again keeps the promoted one as the primary.
+	m2 := NewManager(m.db, []Indexer{dbIdx, flatIdx})
+	err = m2.RegisterShadow(flatIdx, dbIdx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = m2.ShadowStats()
+	if stats[0].Shadow != dbIdx.Name() || stats[0].Primary != flatIdx.Name() ||
+		stats[0].SampleInterval != defaultShadowSampleInterval {
+
+		t.Fatalf("unexpected shadow stats after registering again %+v",
+			stats)
+	}
+}
+
+// TestShadowDivergence ensures that a shadow index that stores something else
+// than its primary is caught and can only be promoted when forced, and that
+// the detached primary is no longer connected.
+func TestShadowDivergence(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, m, dbIdx, flatIdx, tearDown := shadowTestChain(t,
+		"TestShadowDivergence")
+	defer tearDown()
+
+	err := m.RegisterShadow(flatIdx, dbIdx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the shadow store a different proof for one of the blocks.
+	const buggyHeight = 3
+	m.shadows[0].corrupt = func(id *BlockID, ud *wire.UData) {
+		if id.Height == buggyHeight {
+			ud.AccProof.Targets = append(ud.AccProof.Targets, 1<<40)
+		}
+	}
+
+	tip := btcutil.NewBlock(chaincfg.RegressionNetParams.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 6; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	stats := m.ShadowStats()
+	if stats[0].Divergences != 1 || stats[0].LastDivergence == nil ||
+		stats[0].LastDivergence.Block.Height != buggyHeight {
+
+		t.Fatalf("unexpected shadow stats %+v", stats)
+	}
+
+	err = m.PromoteShadow(flatIdx.Name(), false, false)
+	if !errors.Is(err, ErrShadowDiverged) {
+		t.Fatalf("expected a diverged shadow error, got %v", err)
+	}
+	if !m.IsShadow(flatIdx.Name()) {
+		t.Fatalf("the diverged shadow was promoted")
+	}
+
+	// Forcing the promotion detaches the old primary.
+	err = m.PromoteShadow(flatIdx.Name(), true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ShadowStats()) != 0 || !m.IsShadow(dbIdx.Name()) ||
+		m.IsShadow(flatIdx.Name()) {
+
+		t.Fatalf("the old primary wasn't detached")
+	}
+
+	detachedTip := tip
+	for i := 0; i < 2; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+	err = m.db.View(func(dbTx database.Tx) error {
+		dbTipHash, _, err := dbFetchIndexerTip(dbTx, dbIdx.Key())
+		if err != nil {
+			return err
+		}
+		if !dbTipHash.IsEqual(detachedTip.Hash()) {
+			t.Fatalf("detached index moved to %v from %v",
+				dbTipHash, detachedTip.Hash())
+		}
+
+		flatTipHash, _, err := dbFetchIndexerTip(dbTx, flatIdx.Key())
+		if err != nil {
+			return err
+		}
+		if !flatTipHash.IsEqual(tip.Hash()) {
+			t.Fatalf("promoted index is at %v, want %v",
+				flatTipHash, tip.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
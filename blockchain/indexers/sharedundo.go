@@ -0,0 +1,480 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+const (
+	// undoMarkerTag is the first byte of the undo entries of the utreexo
+	// proof index that only mark that the undo block is kept in the shared
+	// undo store.  It's never an accumulator serialization version.
+	undoMarkerTag = 0xff
+
+	// undoMarkerSize is the size of an undo marker.  It's the tag followed
+	// by the checksum of the serialized undo block.
+	undoMarkerSize = 1 + chainhash.HashSize
+
+	// sharedUndoMigrateBatch is how many undo blocks of the utreexo proof
+	// index are replaced by markers in a single database transaction.
+	sharedUndoMigrateBatch = 2000
+)
+
+var (
+	// sharedUndoKey is the key in the buckets of both utreexo proof
+	// indexes that's set while the utreexo proof index keeps its undo
+	// blocks in the flat utreexo proof index.  It keeps the name of the
+	// other index.
+	sharedUndoKey = []byte("sharedundo")
+
+	// sharedUndoMigrateKey is the key in the utreexoParentBucketKey bucket
+	// that keeps the height up to which the undo blocks of the utreexo
+	// proof index were replaced by markers.  It's only there while the
+	// migration to the shared undo store isn't done.
+	sharedUndoMigrateKey = []byte("sharedundomigrate")
+)
+
+// ErrSharedUndoStoreMissing is the error that's returned when the utreexo proof
+// index keeps its undo blocks in the flat utreexo proof index but the flat one
+// isn't enabled or is being dropped.
+var ErrSharedUndoStoreMissing = errors.New("the undo blocks of the utreexo " +
+	"proof index are kept by the flat utreexo proof index")
+
+// undoMarker returns the undo entry that the utreexo proof index stores for an
+// undo block that's kept in the shared undo store.  It has the checksum of the
+// undo block so that an undo block that was since replaced in the shared undo
+// store is never used in its place.
+func undoMarker(undoBlock *accumulator.UndoBlock) ([]byte, error) {
+	undoBytes, err := serializeUndoBlock(undoBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := make([]byte, 0, undoMarkerSize)
+	marker = append(marker, undoMarkerTag)
+	return append(marker, chainhash.HashB(undoBytes)...), nil
+}
+
+// isUndoMarker returns whether the undo entry of the utreexo proof index only
+// marks that the undo block is kept in the shared undo store.
+func isUndoMarker(entry []byte) bool {
+	return len(entry) == undoMarkerSize && entry[0] == undoMarkerTag
+}
+
+// setSharedUndo makes the index keep the undo blocks of the blocks it connects
+// from now on in the given flat utreexo proof index.
+func (idx *UtreexoProofIndex) setSharedUndo(flat *FlatUtreexoProofIndex) {
+	idx.sharedUndo = flat
+}
+
+// SharedUndo returns whether the index keeps its undo blocks in the flat
+// utreexo proof index.
+func (idx *UtreexoProofIndex) SharedUndo() bool {
+	return idx.sharedUndo != nil
+}
+
+// storeUndoEntry stores the undo block of the block with the given hash.  Only
+// a marker is stored when the undo blocks are kept in the shared undo store as
+// the flat utreexo proof index stores the same undo block.
+func (idx *UtreexoProofIndex) storeUndoEntry(dbTx database.Tx, hash *chainhash.Hash,
+	undoBlock *accumulator.UndoBlock) error {
+
+	if idx.sharedUndo == nil {
+		return dbStoreUndoBlock(dbTx, hash, undoBlock)
+	}
+
+	marker, err := undoMarker(undoBlock)
+	if err != nil {
+		return err
+	}
+	undoBlockBucket := dbTx.Metadata().Bucket(utreexoParentBucketKey).Bucket(utreexoUndoKey)
+	return undoBlockBucket.Put(hash[:], marker)
+}
+
+// undoBlockFromEntry returns the undo block of the block from the undo entry
+// that was stored for it.  The undo blocks that were only marked are fetched
+// from the shared undo store and checked against their marker.
+func (idx *UtreexoProofIndex) undoBlockFromEntry(id *BlockID, entry []byte) (
+	*accumulator.UndoBlock, error) {
+
+	if entry == nil {
+		return nil, fmt.Errorf("no undo block stored for block %v at "+
+			"height %d", id.Hash, id.Height)
+	}
+	if !isUndoMarker(entry) {
+		payload, err := untagAccPayload("undo block", entry)
+		if err != nil {
+			return nil, err
+		}
+		return deserializeUndoBlock(payload)
+	}
+
+	if idx.sharedUndo == nil {
+		return nil, fmt.Errorf("%w: unable to fetch the undo block for "+
+			"block %v at height %d", ErrSharedUndoStoreMissing,
+			id.Hash, id.Height)
+	}
+	undoBlock, err := idx.sharedUndo.fetchUndoBlock(id.Height)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch the undo block for block "+
+			"%v at height %d from the %s: %w", id.Hash, id.Height,
+			idx.sharedUndo.Name(), err)
+	}
+	marker, err := undoMarker(undoBlock)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(marker, entry) {
+		return nil, database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("the undo block at height %d "+
+				"in the %s isn't the one of block %v",
+				id.Height, idx.sharedUndo.Name(), id.Hash),
+		}
+	}
+
+	return undoBlock, nil
+}
+
+// SetSharedUndo sets whether the utreexo proof index keeps its undo blocks in
+// the flat utreexo proof index instead of a copy of its own when both are
+// enabled.  The undo blocks it already stored are migrated when the manager is
+// initialized.  Once migrated, the undo blocks stay shared.  It must be called
+// before the manager is initialized.
+func (m *Manager) SetSharedUndo(shared bool) {
+	m.sharedUndo = shared
+}
+
+// utreexoProofIndexes returns the enabled utreexo proof indexes.  Either is nil
+// when it isn't enabled.
+func (m *Manager) utreexoProofIndexes() (*UtreexoProofIndex, *FlatUtreexoProofIndex) {
+	var dbIdx *UtreexoProofIndex
+	var flatIdx *FlatUtreexoProofIndex
+	for _, indexer := range m.enabledIndexes {
+		switch idxType := indexer.(type) {
+		case *UtreexoProofIndex:
+			dbIdx = idxType
+		case *FlatUtreexoProofIndex:
+			flatIdx = idxType
+		}
+	}
+
+	return dbIdx, flatIdx
+}
+
+// loadSharedUndo makes the utreexo proof index keep its undo blocks in the flat
+// one when that's recorded in its bucket.  ErrSharedUndoStoreMissing is
+// returned when the flat utreexo proof index isn't enabled along with it.
+func (m *Manager) loadSharedUndo(dbTx database.Tx) error {
+	meta := dbTx.Metadata()
+	dbBucket := meta.Bucket(utreexoParentBucketKey)
+	flatBucket := meta.Bucket(flatUtreexoBucketKey)
+	shared := dbBucket != nil && dbBucket.Get(sharedUndoKey) != nil
+
+	// The flat utreexo proof index only keeps the undo blocks of the other
+	// one for as long as it wasn't dropped.
+	if dbBucket == nil && flatBucket != nil && flatBucket.Get(sharedUndoKey) != nil {
+		err := flatBucket.Delete(sharedUndoKey)
+		if err != nil {
+			return err
+		}
+	}
+	if !shared {
+		return nil
+	}
+
+	dbIdx, flatIdx := m.utreexoProofIndexes()
+	switch {
+	case dbIdx == nil:
+		// A reorg while the utreexo proof index is disabled replaces
+		// the undo blocks it would need to be rolled back.  That's
+		// caught by their markers when it's enabled again.
+		if flatIdx != nil {
+			log.Infof("The %s keeps the undo blocks of the disabled %s",
+				flatIdx.Name(), utreexoProofIndexName)
+		}
+		return nil
+
+	case flatIdx == nil:
+		return fmt.Errorf("%w: enable the flat utreexo proof index or "+
+			"drop the utreexo proof index", ErrSharedUndoStoreMissing)
+	}
+
+	if !m.sharedUndo {
+		log.Infof("The %s keeps its undo blocks in the %s as they "+
+			"were already migrated", dbIdx.Name(), flatIdx.Name())
+	}
+	dbIdx.setSharedUndo(flatIdx)
+
+	return nil
+}
+
+// recordSharedUndo records in the buckets of both utreexo proof indexes that
+// the undo blocks of the utreexo proof index are kept in the flat one.  It does
+// nothing when they aren't shared.
+func (m *Manager) recordSharedUndo(dbTx database.Tx) error {
+	dbIdx, flatIdx := m.utreexoProofIndexes()
+	if dbIdx == nil || dbIdx.sharedUndo == nil {
+		return nil
+	}
+
+	meta := dbTx.Metadata()
+	if bucket := meta.Bucket(dbIdx.Key()); bucket != nil {
+		err := bucket.Put(sharedUndoKey, []byte(flatIdx.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	if bucket := meta.Bucket(flatIdx.Key()); bucket != nil {
+		err := bucket.Put(sharedUndoKey, []byte(dbIdx.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// undoSharersFirst returns the indexes in the given order except that the
+// utreexo proof index is moved right before the flat one when it keeps its undo
+// blocks in it.  The utreexo proof index has to disconnect a block before the
+// flat one removes the undo block for it.
+func undoSharersFirst(indexes []Indexer) []Indexer {
+	dbPos, flatPos := -1, -1
+	for i, indexer := range indexes {
+		switch idxType := indexer.(type) {
+		case *UtreexoProofIndex:
+			if idxType.sharedUndo != nil {
+				dbPos = i
+			}
+		case *FlatUtreexoProofIndex:
+			flatPos = i
+		}
+	}
+	if dbPos == -1 || flatPos == -1 || dbPos < flatPos {
+		return indexes
+	}
+
+	ordered := make([]Indexer, 0, len(indexes))
+	for i, indexer := range indexes {
+		switch i {
+		case dbPos:
+			continue
+		case flatPos:
+			ordered = append(ordered, indexes[dbPos])
+		}
+		ordered = append(ordered, indexer)
+	}
+
+	return ordered
+}
+
+// SharedUndoMigration is the outcome of migrating the undo blocks of the utreexo
+// proof index to the shared undo store.
+type SharedUndoMigration struct {
+	// Blocks is the number of undo blocks that were replaced by markers.
+	Blocks int
+
+	// BytesFreed is the number of bytes of the undo blocks that were
+	// replaced less the bytes of their markers.
+	BytesFreed int64
+}
+
+// maybeMigrateSharedUndo migrates the undo blocks of the utreexo proof index to
+// the shared undo store when it's asked for and resumes an interrupted
+// migration.
+func (m *Manager) maybeMigrateSharedUndo(interrupt <-chan struct{}) error {
+	dbIdx, flatIdx := m.utreexoProofIndexes()
+	if dbIdx == nil || flatIdx == nil {
+		return nil
+	}
+
+	var migrating bool
+	err := m.db.View(func(dbTx database.Tx) error {
+		bucket := dbTx.Metadata().Bucket(dbIdx.Key())
+		migrating = bucket.Get(sharedUndoMigrateKey) != nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !migrating && (dbIdx.sharedUndo != nil || !m.sharedUndo) {
+		return nil
+	}
+
+	_, err = m.migrateSharedUndo(dbIdx, flatIdx, interrupt)
+	return err
+}
+
+// migrateSharedUndo replaces the undo blocks that the utreexo proof index
+// stored by markers for the copies that the flat utreexo proof index keeps.
+// Every undo block is checked to agree with the copy before it's replaced.  The
+// shared undo store is recorded in the buckets of both indexes before anything
+// is replaced so that an interrupted migration is resumed on the next start.
+//
+// Both indexes must be caught up to the same tip of the main chain.
+func (m *Manager) migrateSharedUndo(dbIdx *UtreexoProofIndex,
+	flatIdx *FlatUtreexoProofIndex, interrupt <-chan struct{}) (
+	*SharedUndoMigration, error) {
+
+	var start, end int32
+	err := m.db.Update(func(dbTx database.Tx) error {
+		dbHash, dbHeight, err := dbFetchIndexerTip(dbTx, dbIdx.Key())
+		if err != nil {
+			return err
+		}
+		flatHash, flatHeight, err := dbFetchIndexerTip(dbTx, flatIdx.Key())
+		if err != nil {
+			return err
+		}
+		if dbHeight != flatHeight || !dbHash.IsEqual(flatHash) {
+			return fmt.Errorf("unable to share the undo blocks of the "+
+				"%s with the %s as their tips %v (height %d) and "+
+				"%v (height %d) differ", dbIdx.Name(),
+				flatIdx.Name(), dbHash, dbHeight, flatHash,
+				flatHeight)
+		}
+		end = dbHeight
+
+		start = 1
+		bucket := dbTx.Metadata().Bucket(dbIdx.Key())
+		if done := bucket.Get(sharedUndoMigrateKey); len(done) == 4 {
+			start = int32(byteOrder.Uint32(done)) + 1
+		} else {
+			err = bucket.Put(sharedUndoMigrateKey, serializeMigrateHeight(0))
+			if err != nil {
+				return err
+			}
+		}
+
+		dbIdx.setSharedUndo(flatIdx)
+		return m.recordSharedUndo(dbTx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Migrating the undo blocks of the %s from height %d to %d "+
+		"to the %s", dbIdx.Name(), start, end, flatIdx.Name())
+
+	migration := new(SharedUndoMigration)
+	for height := start; height <= end; height += sharedUndoMigrateBatch {
+		if interruptRequested(interrupt) {
+			return migration, errInterruptRequested
+		}
+
+		batchEnd := height + sharedUndoMigrateBatch - 1
+		if batchEnd > end {
+			batchEnd = end
+		}
+		err := m.shareUndoBlocks(dbIdx, height, batchEnd, migration)
+		if err != nil {
+			return migration, err
+		}
+	}
+
+	err = m.db.Update(func(dbTx database.Tx) error {
+		bucket := dbTx.Metadata().Bucket(dbIdx.Key())
+		return bucket.Delete(sharedUndoMigrateKey)
+	})
+	if err != nil {
+		return migration, err
+	}
+
+	log.Infof("Migrated %d undo blocks of the %s to the %s, freeing %d "+
+		"bytes", migration.Blocks, dbIdx.Name(), flatIdx.Name(),
+		migration.BytesFreed)
+
+	return migration, nil
+}
+
+// shareUndoBlocks replaces the undo blocks that the utreexo proof index stored
+// for the blocks from start to end, inclusive, by markers once they're checked
+// to agree with the copies in the shared undo store.
+func (m *Manager) shareUndoBlocks(dbIdx *UtreexoProofIndex, start, end int32,
+	migration *SharedUndoMigration) error {
+
+	ids := make([]BlockID, 0, end-start+1)
+	for height := start; height <= end; height++ {
+		hash, err := m.chain.BlockHashByHeight(height)
+		if err != nil {
+			return err
+		}
+		id := BlockID{Height: height, Hash: *hash}
+
+		result, err := m.CompareIndexesAt(&id)
+		if err != nil {
+			return err
+		}
+		if len(result.UndoDiffs) != 0 {
+			return fmt.Errorf("unable to share the undo blocks: %v",
+				result)
+		}
+		ids = append(ids, id)
+	}
+
+	return m.db.Update(func(dbTx database.Tx) error {
+		var blocks int
+		var freed int64
+		for i := range ids {
+			entry, err := dbFetchUndoBlockEntry(dbTx, &ids[i].Hash)
+			if err != nil {
+				return err
+			}
+			if isUndoMarker(entry) {
+				continue
+			}
+
+			undoBlock, err := dbIdx.undoBlockFromEntry(&ids[i], entry)
+			if err != nil {
+				return err
+			}
+			err = dbIdx.storeUndoEntry(dbTx, &ids[i].Hash, undoBlock)
+			if err != nil {
+				return err
+			}
+			blocks++
+			freed += int64(len(entry) - undoMarkerSize)
+		}
+
+		bucket := dbTx.Metadata().Bucket(dbIdx.Key())
+		err := bucket.Put(sharedUndoMigrateKey, serializeMigrateHeight(end))
+		if err != nil {
+			return err
+		}
+
+		migration.Blocks += blocks
+		migration.BytesFreed += freed
+		return nil
+	})
+}
+
+// serializeMigrateHeight returns the height up to which the undo blocks were
+// migrated as it's kept under sharedUndoMigrateKey.
+func serializeMigrateHeight(height int32) []byte {
+	var buf [4]byte
+	byteOrder.PutUint32(buf[:], uint32(height))
+	return buf[:]
+}
+
+// checkSharedUndoDrop returns ErrSharedUndoStoreMissing when the flat utreexo
+// proof index is about to be dropped while the utreexo proof index keeps its
+// undo blocks in it.
+func checkSharedUndoDrop(dbTx database.Tx) error {
+	bucket := dbTx.Metadata().Bucket(utreexoParentBucketKey)
+	if bucket == nil || bucket.Get(sharedUndoKey) == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: drop the utreexo proof index before the flat "+
+		"one", ErrSharedUndoStoreMissing)
+}
@@ -0,0 +1,348 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/database"
+)
+
+// undoBucketSize returns the bytes of the undo entries that the utreexo proof
+// index stored and how many of them are markers.
+func undoBucketSize(t *testing.T, idx *UtreexoProofIndex) (int64, int) {
+	var size int64
+	var markers int
+	err := idx.db.View(func(dbTx database.Tx) error {
+		bucket := dbTx.Metadata().Bucket(utreexoParentBucketKey).
+			Bucket(utreexoUndoKey)
+		return bucket.ForEach(func(k, v []byte) error {
+			size += int64(len(v))
+			if isUndoMarker(v) {
+				markers++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return size, markers
+}
+
+// TestSharedUndo ensures that the undo blocks of the utreexo proof index are
+// migrated to the flat one and that reorgs and starting a single index work
+// against the shared undo store.
+func TestSharedUndo(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestSharedUndo", 1)
+	defer tearDown()
+	dbIdx := indexes[0].(*UtreexoProofIndex)
+	flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+
+	// Connect blocks while both indexes keep their own undo blocks.
+	const numBlocks = 20
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	b1, spends1 := blockchain.AddBlock(chain, tip, nil)
+	nextBlock, nextSpends := b1, spends1
+	for i := 1; i < numBlocks; i++ {
+		nextBlock, nextSpends = blockchain.AddBlock(chain, nextBlock,
+			nextSpends)
+	}
+
+	before, markers := undoBucketSize(t, dbIdx)
+	if markers != 0 {
+		t.Fatalf("expected no markers before the migration, got %d",
+			markers)
+	}
+
+	m := NewManager(dbIdx.db, indexes)
+	m.chain = chain
+	migration, err := m.migrateSharedUndo(dbIdx, flatIdx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, markers := undoBucketSize(t, dbIdx)
+	if migration.Blocks != numBlocks || markers != numBlocks {
+		t.Fatalf("expected %d undo blocks to be migrated, got %d with "+
+			"%d markers", numBlocks, migration.Blocks, markers)
+	}
+	if after >= before || before-after != migration.BytesFreed {
+		t.Fatalf("expected the undo entries to shrink by %d bytes, went "+
+			"from %d to %d", migration.BytesFreed, before, after)
+	}
+	if !dbIdx.SharedUndo() {
+		t.Fatal("expected the undo blocks to be shared")
+	}
+
+	// The shared undo store is recorded for both indexes.
+	err = dbIdx.db.View(func(dbTx database.Tx) error {
+		meta := dbTx.Metadata()
+		dbBucket := meta.Bucket(dbIdx.Key())
+		if string(dbBucket.Get(sharedUndoKey)) != flatIdx.Name() ||
+			dbBucket.Get(sharedUndoMigrateKey) != nil {
+
+			t.Fatal("unexpected shared undo store recorded for the " +
+				"utreexo proof index")
+		}
+		flatBucket := meta.Bucket(flatIdx.Key())
+		if string(flatBucket.Get(sharedUndoKey)) != dbIdx.Name() {
+			t.Fatal("unexpected shared undo store recorded for the " +
+				"flat utreexo proof index")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compareUtreexoIdx(1, numBlocks, chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reorg all but the first block out with a longer chain.  The utreexo
+	// proof index fetches the undo blocks from the flat one to disconnect
+	// them and only stores markers for the new blocks.
+	altBlock, altSpends := b1, spends1
+	for i := 1; i < numBlocks+5; i++ {
+		altBlock, altSpends = blockchain.AddBlock(chain, altBlock,
+			altSpends)
+	}
+	if chain.BestSnapshot().Hash != *altBlock.Hash() {
+		t.Fatal("expected the chain to reorg to the longer chain")
+	}
+	if err := testUtreexoProof(altBlock, chain, indexes); err != nil {
+		t.Fatal(err)
+	}
+	err = compareUtreexoIdx(1, numBlocks+5, chain, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, markers := undoBucketSize(t, dbIdx); markers != numBlocks+5 {
+		t.Fatalf("expected %d markers after the reorg, got %d",
+			numBlocks+5, markers)
+	}
+
+	// Migrating again doesn't find anything left to migrate.
+	migration, err = m.migrateSharedUndo(dbIdx, flatIdx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(migration, &SharedUndoMigration{}) {
+		t.Fatalf("expected nothing to migrate, got %+v", migration)
+	}
+
+	// Starting the utreexo proof index alone doesn't find its undo blocks,
+	// while starting the flat one alone does.  The flat one may not be
+	// dropped on its own.
+	loadSharedUndo := func(indexes ...Indexer) error {
+		dbIdx.setSharedUndo(nil)
+		return dbIdx.db.Update(NewManager(dbIdx.db, indexes).loadSharedUndo)
+	}
+	err = loadSharedUndo(dbIdx)
+	if !errors.Is(err, ErrSharedUndoStoreMissing) {
+		t.Fatalf("expected ErrSharedUndoStoreMissing, got %v", err)
+	}
+	if err := loadSharedUndo(flatIdx); err != nil {
+		t.Fatal(err)
+	}
+	err = DropFlatUtreexoProofIndex(dbIdx.db, testDbRoot, nil)
+	if !errors.Is(err, ErrSharedUndoStoreMissing) {
+		t.Fatalf("expected ErrSharedUndoStoreMissing, got %v", err)
+	}
+
+	// Starting both again keeps the undo blocks shared and the blocks are
+	// disconnected through the shared undo store.
+	if err := loadSharedUndo(dbIdx, flatIdx); err != nil {
+		t.Fatal(err)
+	}
+	if !dbIdx.SharedUndo() {
+		t.Fatal("expected the undo blocks to be shared after a restart")
+	}
+	if err := compareUtreexoIdx(1, numBlocks+5, chain, indexes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLoadSharedUndo ensures that the shared undo store that's recorded for
+// the utreexo proof indexes is set up for the enabled ones.
+func TestLoadSharedUndo(t *testing.T) {
+	db, dbPath, err := createDB("TestLoadSharedUndo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+	defer db.Close()
+
+	// record creates the buckets of the utreexo proof indexes and records
+	// the shared undo store in the ones that are given.
+	record := func(dbShared, flatShared bool, withDB bool) {
+		err := db.Update(func(dbTx database.Tx) error {
+			meta := dbTx.Metadata()
+			for _, key := range [][]byte{utreexoParentBucketKey,
+				flatUtreexoBucketKey} {
+
+				if meta.Bucket(key) != nil {
+					if err := meta.DeleteBucket(key); err != nil {
+						return err
+					}
+				}
+			}
+
+			flatBucket, err := meta.CreateBucket(flatUtreexoBucketKey)
+			if err != nil {
+				return err
+			}
+			if flatShared {
+				err := flatBucket.Put(sharedUndoKey,
+					[]byte(utreexoProofIndexName))
+				if err != nil {
+					return err
+				}
+			}
+			if !withDB {
+				return nil
+			}
+
+			dbBucket, err := meta.CreateBucket(utreexoParentBucketKey)
+			if err != nil {
+				return err
+			}
+			if dbShared {
+				return dbBucket.Put(sharedUndoKey,
+					[]byte(flatUtreexoProofIndexName))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dbIdx := &UtreexoProofIndex{}
+	flatIdx := &FlatUtreexoProofIndex{}
+	tests := []struct {
+		name       string
+		dbShared   bool
+		flatShared bool
+		withDB     bool
+		indexes    []Indexer
+		wantShared bool
+		wantErr    error
+		wantFlat   bool
+	}{
+		{
+			name:     "not shared",
+			withDB:   true,
+			indexes:  []Indexer{dbIdx, flatIdx},
+			wantFlat: false,
+		},
+		{
+			name:       "shared",
+			dbShared:   true,
+			flatShared: true,
+			withDB:     true,
+			indexes:    []Indexer{dbIdx, flatIdx},
+			wantShared: true,
+			wantFlat:   true,
+		},
+		{
+			name:       "utreexo proof index alone",
+			dbShared:   true,
+			flatShared: true,
+			withDB:     true,
+			indexes:    []Indexer{dbIdx},
+			wantErr:    ErrSharedUndoStoreMissing,
+			wantFlat:   true,
+		},
+		{
+			name:       "flat utreexo proof index alone",
+			dbShared:   true,
+			flatShared: true,
+			withDB:     true,
+			indexes:    []Indexer{flatIdx},
+			wantFlat:   true,
+		},
+		{
+			name:       "utreexo proof index dropped",
+			flatShared: true,
+			indexes:    []Indexer{flatIdx},
+			wantFlat:   false,
+		},
+	}
+	for _, test := range tests {
+		record(test.dbShared, test.flatShared, test.withDB)
+		dbIdx.setSharedUndo(nil)
+
+		m := NewManager(db, test.indexes)
+		err := db.Update(m.loadSharedUndo)
+		if !errors.Is(err, test.wantErr) {
+			t.Fatalf("%s: expected error %v, got %v", test.name,
+				test.wantErr, err)
+		}
+		if dbIdx.SharedUndo() != test.wantShared {
+			t.Fatalf("%s: expected shared %v, got %v", test.name,
+				test.wantShared, dbIdx.SharedUndo())
+		}
+
+		var flatShared bool
+		err = db.View(func(dbTx database.Tx) error {
+			bucket := dbTx.Metadata().Bucket(flatUtreexoBucketKey)
+			flatShared = bucket.Get(sharedUndoKey) != nil
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flatShared != test.wantFlat {
+			t.Fatalf("%s: expected the flat utreexo proof index to "+
+				"record the shared undo store %v, got %v",
+				test.name, test.wantFlat, flatShared)
+		}
+
+		err = db.View(checkSharedUndoDrop)
+		if test.dbShared != errors.Is(err, ErrSharedUndoStoreMissing) {
+			t.Fatalf("%s: unexpected drop check %v", test.name, err)
+		}
+	}
+}
+
+// TestUndoSharersFirst ensures that the utreexo proof index is ordered before
+// the flat one that keeps its undo blocks.
+func TestUndoSharersFirst(t *testing.T) {
+	other := &fakeIndexer{}
+	flatIdx := &FlatUtreexoProofIndex{}
+	dbIdx := &UtreexoProofIndex{}
+
+	// Nothing's reordered while the undo blocks aren't shared.
+	indexes := []Indexer{other, flatIdx, dbIdx}
+	if got := undoSharersFirst(indexes); !reflect.DeepEqual(got, indexes) {
+		t.Fatalf("unexpected order %v", got)
+	}
+
+	dbIdx.setSharedUndo(flatIdx)
+	got := undoSharersFirst(indexes)
+	want := []Indexer{other, dbIdx, flatIdx}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if !reflect.DeepEqual(indexes, []Indexer{other, flatIdx, dbIdx}) {
+		t.Fatal("the given indexes were reordered")
+	}
+
+	// Already in order.
+	indexes = []Indexer{dbIdx, other, flatIdx}
+	if got := undoSharersFirst(indexes); !reflect.DeepEqual(got, indexes) {
+		t.Fatalf("unexpected order %v", got)
+	}
+}
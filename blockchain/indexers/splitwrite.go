@@ -0,0 +1,276 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// DefaultSplitWriteThreshold is the estimated size in bytes of the
+	// writes of a block to all the indexes above which the secondary
+	// indexes are written in their own database transactions after the
+	// one of the block.
+	DefaultSplitWriteThreshold = 16 * 1024 * 1024
+
+	// cfItemSize is about how many bytes an item of a basic committed
+	// filter takes.  The items are golomb-coded with a false positive rate
+	// of 1/784931, which takes a little over 20 bits per item.
+	cfItemSize = 3
+
+	// undoLeafSize is how many bytes an undo block takes for every leaf
+	// that the block deletes, which is its position and its hash.
+	undoLeafSize = 8 + chainhash.HashSize
+)
+
+// writeEstimator is an index that estimates how many bytes it writes to the
+// database transaction of a block when the block is connected to it.  The
+// indexes that don't implement it are only counted for their tip.
+type writeEstimator interface {
+	estimateWrites(n *BlockNotification) uint64
+}
+
+// followUp is the connect of a block to a secondary index that was deferred to
+// its own database transaction after the one of the block.
+type followUp struct {
+	indexer Indexer
+	n       *BlockNotification
+}
+
+// isSecondary returns whether the index only keeps data that the chain doesn't
+// depend on, like the transaction and address mappings and the filters.  The
+// utreexo proof indexes are what the utreexo nodes are served from, so they
+// are always written along with the block.
+func isSecondary(indexer Indexer) bool {
+	_, ok := indexer.(proofStore)
+	return !ok
+}
+
+// estimateWrites returns the estimated size in bytes of the writes of the block
+// to all the indexes that it's connected to, their tips included.
+//
+// The caller must hold experimentMtx.
+func (m *Manager) estimateWrites(n *BlockNotification) uint64 {
+	var total uint64
+	for _, index := range m.enabledIndexes {
+		if m.isDetached(index) || m.isDegraded(index) {
+			continue
+		}
+
+		total += uint64(len(index.Key())) + chainhash.HashSize + 4
+		if e, ok := index.(writeEstimator); ok {
+			total += e.estimateWrites(n)
+		}
+	}
+
+	return total
+}
+
+// splitWrites returns whether the secondary indexes are to be written in their
+// own database transactions after the one of the block.
+//
+// The caller must hold experimentMtx.
+func (m *Manager) splitWrites(n *BlockNotification) bool {
+	if m.splitWriteThreshold == 0 {
+		return false
+	}
+
+	estimate := m.estimateWrites(n)
+	if estimate <= m.splitWriteThreshold {
+		return false
+	}
+
+	log.Debugf("Splitting the index writes of block %s (height %d): "+
+		"estimated %d bytes, threshold %d", n.Block.Hash(), n.Height,
+		estimate, m.splitWriteThreshold)
+	m.splitBlocks++
+
+	return true
+}
+
+// completeFollowUp connects the block of the follow-up to its index in the
+// passed database transaction.  An index that's unable to write for good is
+// degraded instead of failing the transaction.
+func (m *Manager) completeFollowUp(dbTx database.Tx, f followUp) error {
+	if m.skipDegraded(f.indexer, true) {
+		return nil
+	}
+
+	err := m.connectIndex(dbTx, f.indexer, f.n)
+	if isPersistentWriteErr(err) {
+		m.degrade(f.indexer, f.n.Height-1, err)
+		return nil
+	}
+
+	return err
+}
+
+// completeFollowUps connects the follow-ups that are still pending in the passed
+// database transaction.  They're only left pending if writing them after the
+// block they were deferred from failed.
+//
+// The caller must hold experimentMtx.
+func (m *Manager) completeFollowUps(dbTx database.Tx) error {
+	for len(m.followUps) > 0 {
+		err := m.completeFollowUp(dbTx, m.followUps[0])
+		if err != nil {
+			return err
+		}
+		m.followUps = m.followUps[1:]
+	}
+	m.followUps = nil
+
+	return nil
+}
+
+// discardFollowUps drops the pending follow-ups of the block with the given
+// hash and returns the indexes that they were for.  The block is disconnected
+// before they were written, so the indexes never had it connected.
+//
+// The caller must hold experimentMtx.
+func (m *Manager) discardFollowUps(hash *chainhash.Hash) map[Indexer]struct{} {
+	var discarded map[Indexer]struct{}
+	kept := m.followUps[:0]
+	for _, f := range m.followUps {
+		if !f.n.Block.Hash().IsEqual(hash) {
+			kept = append(kept, f)
+			continue
+		}
+		if discarded == nil {
+			discarded = make(map[Indexer]struct{})
+		}
+		discarded[f.indexer] = struct{}{}
+	}
+	m.followUps = kept
+
+	return discarded
+}
+
+// WriteFollowUps connects the block that was last connected to the secondary
+// indexes that were deferred from its database transaction, each in its own
+// transaction.  The tip of each of them is written along with its entries so
+// that an index that a crash left out is simply behind and is caught up on the
+// next start.  The follow-ups that fail are left pending and are written along
+// with the next block instead.
+//
+// This is part of the blockchain.IndexFollowUpWriter interface.
+func (m *Manager) WriteFollowUps() error {
+	m.experimentMtx.Lock()
+	defer m.experimentMtx.Unlock()
+
+	for len(m.followUps) > 0 {
+		err := m.db.Update(func(dbTx database.Tx) error {
+			return m.completeFollowUp(dbTx, m.followUps[0])
+		})
+		if err != nil {
+			return err
+		}
+		m.followUps = m.followUps[1:]
+	}
+	m.followUps = nil
+
+	return nil
+}
+
+// SetSplitWriteThreshold sets the estimated size in bytes of the writes of a
+// block to all the indexes above which the secondary indexes are written in
+// their own database transactions after the one of the block.  0 means they're
+// always written along with the block.
+func (m *Manager) SetSplitWriteThreshold(threshold uint64) {
+	m.splitWriteThreshold = threshold
+}
+
+// inputCount returns the number of inputs of the transactions of the block that
+// aren't coinbases.
+func inputCount(n *BlockNotification) int {
+	var count int
+	for _, tx := range n.Block.Transactions()[1:] {
+		count += len(tx.MsgTx().TxIn)
+	}
+
+	return count
+}
+
+// outputCount returns the number of outputs of the transactions of the block.
+func outputCount(n *BlockNotification) int {
+	var count int
+	for _, tx := range n.Block.Transactions() {
+		count += len(tx.MsgTx().TxOut)
+	}
+
+	return count
+}
+
+// estimateWrites returns the size of the hash-to-location mapping of every
+// transaction of the block and of the block ID mappings of the block.
+func (idx *TxIndex) estimateWrites(n *BlockNotification) uint64 {
+	txs := uint64(len(n.Block.Transactions()))
+	return txs*(chainhash.HashSize+txEntrySize) + 2*(chainhash.HashSize+4)
+}
+
+// estimateWrites returns the size of the address mappings of the block.  Every
+// input and output is counted as involving an address of its own.
+func (idx *AddrIndex) estimateWrites(n *BlockNotification) uint64 {
+	entries := uint64(inputCount(n) + outputCount(n))
+	return entries * (levelKeySize + txEntrySize)
+}
+
+// estimateWrites returns the size of the filter of the block along with its
+// header and hash.
+func (idx *CfIndex) estimateWrites(n *BlockNotification) uint64 {
+	items := uint64(inputCount(n) + outputCount(n))
+	return items*cfItemSize + 5*chainhash.HashSize
+}
+
+// estimateWrites returns the size of the time to live and the spend height of
+// every input of the block along with the spend heights of its outputs and
+// where the outputs of its transactions are.  The spend heights of the blocks
+// that the inputs spend from are written whole, but only the spend height that
+// changed is counted.
+func (idx *TTLIndex) estimateWrites(n *BlockNotification) uint64 {
+	const entrySize = chainhash.HashSize + wire.MaxVarIntPayload + 4 + 4
+	const txPosSize = chainhash.HashSize + 8
+	txs := uint64(len(n.Block.Transactions()))
+	return uint64(inputCount(n))*entrySize + uint64(outputCount(n))*4 +
+		txs*txPosSize
+}
+
+// estimateWrites returns the upper bound of the size of the proof and the undo
+// block of the block along with its leaf eligibility.
+func (idx *UtreexoProofIndex) estimateWrites(n *BlockNotification) uint64 {
+	if n.Height == 0 {
+		return 0
+	}
+
+	_, _, inskip, _ := blockchain.DedupeBlock(n.Block)
+	count, leafDataSize := blockchain.DelLeavesSize(n.SpentTxOuts, inskip, -1)
+
+	// The estimate is an upper bound, so the most rows a forest can have
+	// are assumed if its number of leaves is unknown.
+	idx.mtx.RLock()
+	_, rows, err := idx.utreexoState.stats()
+	idx.mtx.RUnlock()
+	if err != nil {
+		rows = 63
+	}
+
+	proof := proofSize(uint64(leafDataSize), count, rows)
+	undo := 4 + uint64(count)*undoLeafSize
+	return 3*chainhash.HashSize + proof + undo + leafEligibilitySize
+}
+
+// estimateWrites returns the size of the leaf eligibility of the block.  The
+// proofs and the undo blocks are written to the flat files instead of the
+// database, but the index is still counted to keep the estimate honest.
+func (idx *FlatUtreexoProofIndex) estimateWrites(n *BlockNotification) uint64 {
+	if n.Height == 0 {
+		return 0
+	}
+
+	return chainhash.HashSize + leafEligibilitySize
+}
@@ -0,0 +1,348 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// maxBlockCommitTime is the longest that processing a block near the weight
+// limit with all of the indexes enabled may take.  It's generous so that slow
+// machines don't fail the test, but it catches the commits that balloon.
+const maxBlockCommitTime = time.Minute
+
+// unwrittenFollowUps is an index manager whose follow-ups are never written
+// after the blocks are committed, as if the node crashed in between.
+type unwrittenFollowUps struct {
+	blockchain.IndexManager
+}
+
+// secondaryTestIndexes returns all of the optional indexes besides the utreexo
+// proof indexes.
+func secondaryTestIndexes(db database.DB, params *chaincfg.Params) []Indexer {
+	return []Indexer{
+		NewTxIndex(db),
+		NewAddrIndex(db, params),
+		NewCfIndex(db, params),
+		NewTTLIndex(db, params),
+	}
+}
+
+// splitWriteTestChain returns a chain that's connected to the indexes through a
+// manager that splits the writes of the blocks above the given threshold.  The
+// follow-ups are left unwritten if crash is set.
+func splitWriteTestChain(db database.DB, params *chaincfg.Params,
+	indexes []Indexer, threshold uint64, crash bool) (
+	*blockchain.BlockChain, *Manager, error) {
+
+	m := NewManager(db, indexes)
+	m.SetSplitWriteThreshold(threshold)
+
+	var indexManager blockchain.IndexManager = m
+	if crash {
+		indexManager = unwrittenFollowUps{m}
+	}
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     indexManager,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = m.Init(chain, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return chain, m, nil
+}
+
+// checkIndexTips returns an error unless the tips of the indexes are at the
+// given heights.
+func checkIndexTips(db database.DB, indexes []Indexer, heights []int32) error {
+	return db.View(func(dbTx database.Tx) error {
+		for i, indexer := range indexes {
+			_, height, err := dbFetchIndexerTip(dbTx, indexer.Key())
+			if err != nil {
+				return err
+			}
+			if height != heights[i] {
+				return fmt.Errorf("expected the tip of the %s at "+
+					"height %d, got %d", indexer.Name(),
+					heights[i], height)
+			}
+		}
+		return nil
+	})
+}
+
+// repeatHeight returns the height repeated for each of the indexes.
+func repeatHeight(height int32, indexes []Indexer) []int32 {
+	heights := make([]int32, len(indexes))
+	for i := range heights {
+		heights[i] = height
+	}
+	return heights
+}
+
+// checkSecondaryEntries returns an error unless the secondary indexes have the
+// entries of the block.
+func checkSecondaryEntries(indexes []Indexer, block *btcutil.Block) error {
+	for _, indexer := range indexes {
+		switch idx := indexer.(type) {
+		case *TxIndex:
+			for _, tx := range block.Transactions() {
+				region, err := idx.TxBlockRegion(tx.Hash())
+				if err != nil {
+					return err
+				}
+				if region == nil {
+					return fmt.Errorf("tx %s of block %s isn't "+
+						"indexed", tx.Hash(), block.Hash())
+				}
+			}
+
+		case *CfIndex:
+			filter, err := idx.FilterByBlockHash(block.Hash(),
+				wire.GCSFilterRegular)
+			if err != nil {
+				return err
+			}
+			if filter == nil {
+				return fmt.Errorf("block %s has no filter",
+					block.Hash())
+			}
+
+		case *TTLIndex:
+			txIn := block.Transactions()[1].MsgTx().TxIn[0]
+			if idx.GetTTL(&txIn.PreviousOutPoint) == nil {
+				return fmt.Errorf("the spend of %v in block %s has "+
+					"no ttl", txIn.PreviousOutPoint, block.Hash())
+			}
+		}
+	}
+
+	return nil
+}
+
+// TestSplitWriteMaxBlock ensures that a block near the weight limit that spends
+// an output with each of its transactions is committed to all of the indexes
+// within the latency bound once its writes are split.
+func TestSplitWriteMaxBlock(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestSplitWriteMaxBlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	_, indexes, err := initIndexes(1, dbPath, &db, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes = append(indexes, secondaryTestIndexes(db, &params)...)
+
+	// The small blocks stay under the threshold while the large one goes
+	// way over it.
+	chain, m, err := splitWriteTestChain(db, &params, indexes, 1024*1024,
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tip, spendables := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+
+	// Create the outputs that the transactions of the large block spend.
+	// They're fanned out over a few transactions since the time it takes
+	// to generate a transaction grows with the square of its outputs.
+	const fanOutTxs, fanOutSize = 20, 1000
+	fanOuts := []blockchain.BlockSpec{
+		fanOut(fanOutTxs),
+		{NumTxs: fanOutTxs, InputsPerTx: 1, OutputsPerTx: fanOutSize},
+	}
+	for i, spec := range fanOuts {
+		block, outs, err := blockchain.GenerateBlockFromSpec(chain, tip,
+			spendables, spec, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = chain.ProcessBlock(block, blockchain.BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tip, spendables = block, outs
+	}
+
+	// Measure how much weight a transaction of the block takes to fill the
+	// block up to close to the limit with them.
+	spec := blockchain.BlockSpec{NumTxs: 100, InputsPerTx: 1}
+	trial, _, err := blockchain.GenerateBlockFromSpec(chain, tip, spendables,
+		spec, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txWeight := blockchain.GetTransactionWeight(trial.Transactions()[1])
+	spec.NumTxs = int((blockchain.MaxBlockWeight*95/100 -
+		blockchain.GetBlockWeight(trial)) / txWeight)
+	if spec.NumTxs > len(spendables) {
+		t.Fatalf("the %d outputs that were fanned out can't fill %d "+
+			"transactions", len(spendables), spec.NumTxs)
+	}
+
+	block, _, err := blockchain.GenerateBlockFromSpec(chain, tip, spendables,
+		spec, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weight := blockchain.GetBlockWeight(block)
+	if weight < blockchain.MaxBlockWeight*9/10 ||
+		weight > blockchain.MaxBlockWeight {
+
+		t.Fatalf("expected a block near the weight limit, got weight %d",
+			weight)
+	}
+
+	start := time.Now()
+	_, _, err = chain.ProcessBlock(block, blockchain.BFNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > maxBlockCommitTime {
+		t.Fatalf("committing the block took %v, more than %v", elapsed,
+			maxBlockCommitTime)
+	}
+
+	if m.splitBlocks != 1 {
+		t.Fatalf("expected only the large block to be split, got %d "+
+			"split blocks", m.splitBlocks)
+	}
+	if len(m.followUps) != 0 {
+		t.Fatalf("expected the follow-ups to be written, got %d pending",
+			len(m.followUps))
+	}
+	err = checkIndexTips(db, indexes, repeatHeight(block.Height(), indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkSecondaryEntries(indexes, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSplitWriteCrashRecovery ensures that the secondary indexes that a crash
+// left behind the block after it was committed are caught up on the next start
+// and that their follow-ups are discarded if the block is disconnected before
+// they're written.
+func TestSplitWriteCrashRecovery(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	db, dbPath, err := createDB("TestSplitWriteCrashRecovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	// Every block is split and none of the follow-ups are written after
+	// it, so each of them is only written along with the next block.
+	indexes := secondaryTestIndexes(db, &params)
+	chain, m, err := splitWriteTestChain(db, &params, indexes, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < 5; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+	if len(m.followUps) != len(indexes) {
+		t.Fatalf("expected %d pending follow-ups, got %d", len(indexes),
+			len(m.followUps))
+	}
+	err = checkIndexTips(db, indexes, repeatHeight(tip.Height()-1, indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash between the transaction of the block and its follow-ups.  The
+	// chain state is flushed since it's only the indexes under test.
+	err = chain.FlushCachedState(blockchain.FlushRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = database.Open(testDbType, dbPath, blockDataNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The indexes are caught up to the block on the next start.
+	indexes = secondaryTestIndexes(db, &params)
+	chain, m, err = splitWriteTestChain(db, &params, indexes, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkIndexTips(db, indexes, repeatHeight(tip.Height(), indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkSecondaryEntries(indexes, tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Disconnecting a block before its follow-ups are written discards
+	// them instead of disconnecting it from the indexes that never had it.
+	tip, _ = blockchain.AddBlock(chain, tip, spends)
+	stxos, err := chain.FetchSpendJournal(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(dbTx database.Tx) error {
+		return m.DisconnectBlock(dbTx, tip, stxos)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.followUps) != 0 {
+		t.Fatalf("expected the follow-ups to be discarded, got %d "+
+			"pending", len(m.followUps))
+	}
+	err = checkIndexTips(db, indexes, repeatHeight(tip.Height()-1, indexes))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"sync"
+)
+
+const (
+	// DefaultSyncProgressInterval is how often in blocks the progress of
+	// catching up an index is reported by default.
+	DefaultSyncProgressInterval = 1000
+)
+
+// SyncProgressFunc is called with the name of an index, the height that it was
+// caught up to and the height of the tip that it's being caught up to.  It's
+// called from the goroutine that catches the index up, which waits for it to
+// return.  The indexes are caught up at the same time so it may be called
+// concurrently for different indexes.
+type SyncProgressFunc func(indexName string, height, tip int32)
+
+// IndexSyncHeight is how far an index was caught up.
+type IndexSyncHeight struct {
+	// Name is the name of the index.
+	Name string
+
+	// Height is the height that the index was caught up to and Tip is the
+	// height of the tip that it's being caught up to.
+	Height int32
+	Tip    int32
+}
+
+// syncProgress keeps track of how far the indexes were caught up while the
+// manager catches them up to the chain tip.
+type syncProgress struct {
+	interval int32
+	report   SyncProgressFunc
+
+	// heights are the heights that the indexes were caught up to in the
+	// order of the enabled indexes.  They're nil unless the indexes are
+	// being caught up.  They're protected by mtx so that they can be read
+	// while the indexes are caught up.
+	mtx     sync.Mutex
+	names   []string
+	heights []int32
+	tip     int32
+}
+
+// start records that the indexes are being caught up from the given heights to
+// the tip.
+//
+// This function is safe for concurrent access.
+func (p *syncProgress) start(indexes []Indexer, heights []int32, tip int32) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.names = make([]string, len(indexes))
+	for i, indexer := range indexes {
+		p.names[i] = indexer.Name()
+	}
+	p.heights = make([]int32, len(heights))
+	copy(p.heights, heights)
+	p.tip = tip
+}
+
+// caughtUp records that the index at the given position of the enabled indexes
+// was caught up to the given height and reports it every interval blocks and
+// once it's at the tip.
+//
+// This function is safe for concurrent access.
+func (p *syncProgress) caughtUp(i int, height int32) {
+	p.mtx.Lock()
+	p.heights[i] = height
+	name, tip := p.names[i], p.tip
+	p.mtx.Unlock()
+
+	if p.report == nil {
+		return
+	}
+	if (p.interval > 0 && height > 0 && height%p.interval == 0) ||
+		height == tip {
+
+		p.report(name, height, tip)
+	}
+}
+
+// finish records that the indexes are done being caught up.
+//
+// This function is safe for concurrent access.
+func (p *syncProgress) finish() {
+	p.mtx.Lock()
+	p.names = nil
+	p.heights = nil
+	p.mtx.Unlock()
+}
+
+// syncHeights returns how far each of the indexes was caught up.  It's nil
+// unless the indexes are being caught up.
+//
+// This function is safe for concurrent access.
+func (p *syncProgress) syncHeights() []IndexSyncHeight {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.heights == nil {
+		return nil
+	}
+	heights := make([]IndexSyncHeight, len(p.heights))
+	for i, height := range p.heights {
+		heights[i] = IndexSyncHeight{
+			Name:   p.names[i],
+			Height: height,
+			Tip:    p.tip,
+		}
+	}
+
+	return heights
+}
+
+// SetSyncProgress sets the function that the progress of catching up the
+// indexes is reported to every interval blocks of each index and once the
+// index is at the tip.  It must be set before the manager is initialized.
+func (m *Manager) SetSyncProgress(interval int32, report SyncProgressFunc) {
+	m.syncProgress.interval = interval
+	m.syncProgress.report = report
+}
+
+// SyncHeights returns how far each of the enabled indexes was caught up while
+// the manager catches them up to the chain tip.  It's nil once they're caught
+// up.  It only waits for the catch up to record the block it connected last.
+//
+// This function is safe for concurrent access.
+func (m *Manager) SyncHeights() []IndexSyncHeight {
+	return m.syncProgress.syncHeights()
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/database"
+)
+
+// TestSyncProgress ensures that catching up an index reports its progress
+// every interval blocks and at the tip, and that how far it was caught up can
+// be read while it's caught up.
+func TestSyncProgress(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestSyncProgress", 1)
+	defer tearDown()
+
+	var db database.DB
+	for _, indexer := range indexes {
+		if idx, ok := indexer.(*UtreexoProofIndex); ok {
+			db = idx.db
+		}
+	}
+
+	const numBlocks = 100
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for i := 0; i < numBlocks; i++ {
+		tip, spends = blockchain.AddBlock(chain, tip, spends)
+	}
+
+	// Catch a new transaction index up from genesis while the heights are
+	// read from another goroutine as well.
+	txIndex := NewTxIndex(db)
+	m := NewManager(db, []Indexer{txIndex})
+
+	type progress struct {
+		name        string
+		height, tip int32
+	}
+	var reported []progress
+	var heightsErr string
+	m.SetSyncProgress(10, func(indexName string, height, tip int32) {
+		reported = append(reported, progress{indexName, height, tip})
+
+		heights := m.SyncHeights()
+		want := []IndexSyncHeight{{txIndex.Name(), height, tip}}
+		if heightsErr == "" && !reflect.DeepEqual(heights, want) {
+			heightsErr = fmt.Sprintf("expected sync heights %v, "+
+				"got %v", want, heights)
+		}
+	})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// The new index is at height -1 until it's
+			// caught up to the genesis block.
+			for _, h := range m.SyncHeights() {
+				if h.Height < -1 || h.Height > h.Tip {
+					t.Errorf("got sync height %d of %d",
+						h.Height, h.Tip)
+				}
+			}
+		}
+	}()
+
+	err := m.Init(chain, nil)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heightsErr != "" {
+		t.Fatal(heightsErr)
+	}
+
+	var want []progress
+	for height := int32(10); height <= numBlocks; height += 10 {
+		want = append(want, progress{txIndex.Name(), height, numBlocks})
+	}
+	if !reflect.DeepEqual(reported, want) {
+		t.Fatalf("expected progress %v, got %v", want, reported)
+	}
+
+	// Nothing is reported once the index is caught up.
+	if heights := m.SyncHeights(); heights != nil {
+		t.Fatalf("expected no sync heights once caught up, got %v",
+			heights)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSyncShedRetryAfter is the default duration that the callers
+	// of shed requests are told to retry after.
+	defaultSyncShedRetryAfter = time.Minute
+
+	// defaultSyncShedPollInterval is the default duration between two
+	// checks of whether the node is still syncing by paused background
+	// work.
+	defaultSyncShedPollInterval = time.Second * 10
+)
+
+// SyncingError is returned for the historical utreexo requests that are shed
+// while the node is in its initial block download.
+type SyncingError struct {
+	// Request is the name of the shed request.
+	Request string
+
+	// Height is the height of the chain tip and TargetHeight is the
+	// height that the node is syncing to.
+	Height       int32
+	TargetHeight int32
+
+	// RetryAfter is how long the caller should wait before retrying.
+	RetryAfter time.Duration
+}
+
+// Error returns the SyncingError in human-readable form.
+func (e *SyncingError) Error() string {
+	return fmt.Sprintf("%s is unavailable while the node is syncing "+
+		"(height %d of %d), retry after %v", e.Request, e.Height,
+		e.TargetHeight, e.RetryAfter)
+}
+
+// SyncShedderConfig is the configuration of a SyncShedder.
+type SyncShedderConfig struct {
+	// SyncLag returns the height of the chain tip and the height that the
+	// node is syncing to.
+	SyncLag func() (height, target int32)
+
+	// MaxLag is the number of blocks that the chain tip may be behind the
+	// target before the node is considered to be syncing.
+	MaxLag int32
+
+	// Disabled turns the shedding off so that every request is served
+	// and background work is never paused.
+	Disabled bool
+
+	// RetryAfter is how long the callers of shed requests are told to
+	// wait before retrying.
+	RetryAfter time.Duration
+
+	// PollInterval is how often paused background work checks whether the
+	// node is still syncing.
+	PollInterval time.Duration
+}
+
+// SyncShedStats are the load shed by a SyncShedder.
+type SyncShedStats struct {
+	// Syncing is whether the node is currently syncing.  Height and
+	// TargetHeight are the heights it was last checked at.
+	Syncing      bool
+	Height       int32
+	TargetHeight int32
+
+	// Shed is the number of shed requests by request name.
+	Shed map[string]uint64
+
+	// Pauses is the number of times that each background component was
+	// paused.
+	Pauses map[string]uint64
+}
+
+// SyncShedder sheds the load of the expensive historical utreexo requests and
+// pauses background utreexo work while the node is in its initial block
+// download so that they don't compete with the sync.  A nil SyncShedder never
+// sheds anything.
+type SyncShedder struct {
+	cfg SyncShedderConfig
+
+	mtx    sync.Mutex
+	shed   map[string]uint64
+	pauses map[string]uint64
+}
+
+// NewSyncShedder returns a SyncShedder for the given configuration.
+func NewSyncShedder(cfg *SyncShedderConfig) *SyncShedder {
+	s := &SyncShedder{
+		cfg:    *cfg,
+		shed:   make(map[string]uint64),
+		pauses: make(map[string]uint64),
+	}
+	if s.cfg.RetryAfter <= 0 {
+		s.cfg.RetryAfter = defaultSyncShedRetryAfter
+	}
+	if s.cfg.PollInterval <= 0 {
+		s.cfg.PollInterval = defaultSyncShedPollInterval
+	}
+
+	return s
+}
+
+// Syncing returns the height of the chain tip, the height that the node is
+// syncing to, and whether the tip is far enough behind for load to be shed.
+//
+// This function is safe for concurrent access.
+func (s *SyncShedder) Syncing() (int32, int32, bool) {
+	if s == nil || s.cfg.Disabled || s.cfg.SyncLag == nil {
+		return 0, 0, false
+	}
+
+	height, target := s.cfg.SyncLag()
+	return height, target, target-height > s.cfg.MaxLag
+}
+
+// Shed returns a SyncingError if the given historical request has to be shed
+// because the node is syncing.  Requests that aren't historical, such as the
+// ones for the tip, must not be passed in.
+//
+// This function is safe for concurrent access.
+func (s *SyncShedder) Shed(request string) error {
+	height, target, syncing := s.Syncing()
+	if !syncing {
+		return nil
+	}
+
+	s.mtx.Lock()
+	s.shed[request]++
+	s.mtx.Unlock()
+
+	return &SyncingError{
+		Request:      request,
+		Height:       height,
+		TargetHeight: target,
+		RetryAfter:   s.cfg.RetryAfter,
+	}
+}
+
+// WaitSynced blocks the given background component for as long as the node is
+// syncing.  It returns false if the quit channel was closed in the meantime.
+//
+// This function is safe for concurrent access.
+func (s *SyncShedder) WaitSynced(component string, quit <-chan struct{}) bool {
+	_, _, syncing := s.Syncing()
+	if !syncing {
+		return true
+	}
+
+	s.mtx.Lock()
+	s.pauses[component]++
+	s.mtx.Unlock()
+	log.Debugf("Pausing the %s while the node is syncing", component)
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	for syncing {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return false
+		}
+		_, _, syncing = s.Syncing()
+	}
+	log.Debugf("Resuming the %s", component)
+
+	return true
+}
+
+// Stats returns the load shed so far.
+//
+// This function is safe for concurrent access.
+func (s *SyncShedder) Stats() SyncShedStats {
+	var stats SyncShedStats
+	stats.Height, stats.TargetHeight, stats.Syncing = s.Syncing()
+	stats.Shed = make(map[string]uint64)
+	stats.Pauses = make(map[string]uint64)
+	if s == nil {
+		return stats
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for request, count := range s.shed {
+		stats.Shed[request] = count
+	}
+	for component, count := range s.pauses {
+		stats.Pauses[component] = count
+	}
+
+	return stats
+}
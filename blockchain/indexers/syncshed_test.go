@@ -0,0 +1,165 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// testSyncLag is a sync lag hook whose target can be moved to simulate the
+// initial block download.
+type testSyncLag struct {
+	height int32
+	target int32
+}
+
+func (l *testSyncLag) syncLag() (int32, int32) {
+	return l.height, atomic.LoadInt32(&l.target)
+}
+
+func (l *testSyncLag) setTarget(target int32) {
+	atomic.StoreInt32(&l.target, target)
+}
+
+func TestSyncShedder(t *testing.T) {
+	lag := &testSyncLag{height: 100, target: 105}
+	s := NewSyncShedder(&SyncShedderConfig{
+		SyncLag:    lag.syncLag,
+		MaxLag:     10,
+		RetryAfter: time.Second,
+	})
+
+	// Requests are served while the chain is within the maximum lag.
+	if err := s.Shed("verifyutreexoproofs"); err != nil {
+		t.Fatalf("expected the request to be served, got %v", err)
+	}
+
+	// They're shed once it falls further behind.
+	lag.setTarget(1000)
+	for i := 0; i < 2; i++ {
+		err := s.Shed("verifyutreexoproofs")
+		var syncErr *SyncingError
+		if !errors.As(err, &syncErr) {
+			t.Fatalf("expected a SyncingError, got %v", err)
+		}
+		want := SyncingError{
+			Request:      "verifyutreexoproofs",
+			Height:       100,
+			TargetHeight: 1000,
+			RetryAfter:   time.Second,
+		}
+		if *syncErr != want {
+			t.Fatalf("expected %+v, got %+v", want, *syncErr)
+		}
+	}
+	if err := s.Shed("getutreexoproofs"); err == nil {
+		t.Fatal("expected the request to be shed")
+	}
+
+	stats := s.Stats()
+	if !stats.Syncing || stats.Height != 100 || stats.TargetHeight != 1000 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.Shed["verifyutreexoproofs"] != 2 || stats.Shed["getutreexoproofs"] != 1 {
+		t.Fatalf("unexpected shed counts %v", stats.Shed)
+	}
+
+	// Service resumes once the chain caught up.
+	lag.setTarget(100)
+	if err := s.Shed("verifyutreexoproofs"); err != nil {
+		t.Fatalf("expected the request to be served, got %v", err)
+	}
+
+	// Nothing is shed if the shedding is disabled or there's no shedder.
+	lag.setTarget(1000)
+	disabled := NewSyncShedder(&SyncShedderConfig{
+		SyncLag:  lag.syncLag,
+		MaxLag:   10,
+		Disabled: true,
+	})
+	if err := disabled.Shed("verifyutreexoproofs"); err != nil {
+		t.Fatalf("expected the request to be served, got %v", err)
+	}
+	var none *SyncShedder
+	if err := none.Shed("verifyutreexoproofs"); err != nil {
+		t.Fatalf("expected the request to be served, got %v", err)
+	}
+	if !none.WaitSynced("test", nil) {
+		t.Fatal("expected no wait without a shedder")
+	}
+}
+
+// TestSyncShedderPausesWatchdog ensures that the proof watchdog doesn't request
+// any proofs while the node is syncing and resumes once it caught up.
+func TestSyncShedderPausesWatchdog(t *testing.T) {
+	t.Parallel()
+
+	lag := &testSyncLag{height: 10, target: 1000}
+	s := NewSyncShedder(&SyncShedderConfig{
+		SyncLag:      lag.syncLag,
+		MaxLag:       10,
+		PollInterval: time.Millisecond,
+	})
+
+	var fetches int32
+	source := &testProofSource{
+		name: "source",
+		fetch: func(height int32) (*chainhash.Hash, *wire.UData, error) {
+			atomic.AddInt32(&fetches, 1)
+			return testUData(height)
+		},
+	}
+	w, err := NewProofWatchdog(&ProofWatchdogConfig{
+		Sources:     []RemoteProofSource{source},
+		FetchLocal:  compactTestUData,
+		MinInterval: time.Millisecond,
+		Shedder:     s,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	defer w.Stop()
+
+	const numBlocks = 3
+	for h := int32(1); h <= numBlocks; h++ {
+		w.BlockConnected(h)
+	}
+
+	// Wait for the watchdog to be paused and make sure it stays paused.
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Stats().Pauses["proof watchdog"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the watchdog to pause")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&fetches); n != 0 {
+		t.Fatalf("expected no proofs to be fetched while syncing, got %d", n)
+	}
+
+	// The queued blocks are audited once the node caught up.
+	lag.setTarget(10)
+	for {
+		stats := w.Stats()[0]
+		if stats.Agreements == numBlocks {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out with stats %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if pauses := s.Stats().Pauses["proof watchdog"]; pauses != 1 {
+		t.Fatalf("expected the watchdog to be paused once, got %d", pauses)
+	}
+}
@@ -1,9 +1,13 @@
 package indexers
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/utreexo/utreexod/blockchain"
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
 	"github.com/utreexo/utreexod/database"
 	"github.com/utreexo/utreexod/wire"
 )
@@ -16,12 +20,25 @@ const (
 var (
 	// ttlIndexKey is the name of the
 	ttlIndexKey = []byte("ttlindexkey")
+
+	// ttlHeightBucketName is the name of the bucket in the ttl index
+	// bucket that keeps the spend heights of the outputs created by every
+	// block by the height of the block.
+	ttlHeightBucketName = []byte("ttlheights")
+
+	// ttlTxPosBucketName is the name of the bucket in the ttl index bucket
+	// that keeps where the outputs of every transaction are in the block
+	// that created them.
+	ttlTxPosBucketName = []byte("ttltxpositions")
 )
 
 // TTLIndex implements a time to live index for all the STXOs.
 type TTLIndex struct {
 	db          database.DB
 	chainParams *chaincfg.Params
+
+	// gate refuses the fetches while the index is being rebuilt.
+	gate rebuildGate
 }
 
 // Ensure the TTLIndex type implements the Indexer interface.
@@ -30,6 +47,9 @@ var _ Indexer = (*TTLIndex)(nil)
 // Ensure the TTLIndex type implements the NeedsInputser interface.
 var _ NeedsInputser = (*TTLIndex)(nil)
 
+// Ensure the TTLIndex type implements the Rebuilder interface.
+var _ Rebuilder = (*TTLIndex)(nil)
+
 // NeedsInputs signals that the index requires the referenced inputs in order
 // to properly create the index.
 //
@@ -38,10 +58,22 @@ func (idx *TTLIndex) NeedsInputs() bool {
 	return true
 }
 
-// Init initializes the time to live index. This is part of the Indexer
-// interface.
+// Init initializes the time to live index.  An index that was created before
+// the spend heights were kept by the height of the block has to be dropped and
+// created again as they can't be filled in for the blocks it already has.
+//
+// This is part of the Indexer interface.
 func (idx *TTLIndex) Init() error {
-	return nil // Nothing to do.
+	return idx.db.View(func(dbTx database.Tx) error {
+		ttlIdxBucket := dbTx.Metadata().Bucket(ttlIndexKey)
+		if ttlIdxBucket.Bucket(ttlHeightBucketName) != nil {
+			return nil
+		}
+
+		return fmt.Errorf("the %s doesn't keep the spend heights by "+
+			"block height.  Drop it with --dropttlindex and "+
+			"enable it again to create it over", ttlIndexName)
+	})
 }
 
 // Name returns the human-readable name of the index.
@@ -59,34 +91,52 @@ func (idx *TTLIndex) Key() []byte {
 
 // Create is invoked when the indexer manager determines the index needs
 // to be created for the first time.  It creates the bucket for the ttl
-// index.
+// index along with the buckets it keeps the spend heights by block height in.
 //
 // This is part of the Indexer interface.
 func (idx *TTLIndex) Create(dbTx database.Tx) error {
-	_, err := dbTx.Metadata().CreateBucket(ttlIndexKey)
+	ttlIdxBucket, err := dbTx.Metadata().CreateBucket(ttlIndexKey)
+	if err != nil {
+		return err
+	}
+	_, err = ttlIdxBucket.CreateBucket(ttlHeightBucketName)
+	if err != nil {
+		return err
+	}
+	_, err = ttlIdxBucket.CreateBucket(ttlTxPosBucketName)
 	return err
 }
 
 // ConnectBlock is invoked by the index manager when a new block has been
 // connected to the main chain.  This indexer stores ttl value for every
-// stxo in the block.
+// stxo in the block and the spend height of every output that the block
+// spends.
 //
 // This is part of the Indexer interface.
-func (idx *TTLIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
+func (idx *TTLIndex) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	ttlIdxBucket := dbTx.Metadata().Bucket(ttlIndexKey)
-	return storeTTLEntries(ttlIdxBucket, block, stxos)
+	err := storeTTLEntries(ttlIdxBucket, n.Block, n.SpentTxOuts)
+	if err != nil {
+		return err
+	}
+
+	return connectSpendHeights(ttlIdxBucket, n.Block)
 }
 
 // DisconnectBlock is invoked by the index manager when a new block has been
 // disconnected to the main chain.  This indexer removes the ttl value for
-// every stxo in the block.
+// every stxo in the block and resets the spend height of every output that
+// the block spent.
 //
 // This is part of the Indexer interface.
-func (idx *TTLIndex) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
+func (idx *TTLIndex) DisconnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	ttlIdxBucket := dbTx.Metadata().Bucket(ttlIndexKey)
-	return removeTTLEntries(ttlIdxBucket, block)
+	err := removeTTLEntries(ttlIdxBucket, n.Block)
+	if err != nil {
+		return err
+	}
+
+	return disconnectSpendHeights(ttlIdxBucket, n.Block)
 }
 
 // GetTTL returns a pointer to the ttl value of a transaction outpout.
@@ -103,6 +153,39 @@ func (idx *TTLIndex) GetTTL(op *wire.OutPoint) *int32 {
 	return ttl
 }
 
+// FetchTTLs returns the heights that the outputs created by the main chain
+// block at the given height are spent at in the order that the block creates
+// them in.  The spend height is 0 for the outputs that aren't spent yet.
+//
+// This function is safe for concurrent access.
+func (idx *TTLIndex) FetchTTLs(height int32) ([]int32, error) {
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+
+	var spendHeights []int32
+	err := idx.db.View(func(dbTx database.Tx) error {
+		bucket := dbTx.Metadata().Bucket(ttlIndexKey).
+			Bucket(ttlHeightBucketName)
+		serialized := bucket.Get(spendHeightsKey(height))
+		if serialized == nil {
+			return fmt.Errorf("no spend heights for the block at "+
+				"height %d", height)
+		}
+
+		spendHeights = make([]int32, len(serialized)/4)
+		for i := range spendHeights {
+			spendHeights[i] = int32(byteOrder.Uint32(serialized[i*4:]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return spendHeights, nil
+}
+
 // -----------------------------------------------------------------------------
 // Each TTL entry is stored on disk with a <key><value> of:
 //
@@ -198,6 +281,212 @@ func removeTTLEntries(bucket internalBucket, blk *btcutil.Block) error {
 	return nil
 }
 
+// -----------------------------------------------------------------------------
+// The spend heights of the outputs created by a block are kept in the ttl
+// heights bucket with a <key><value> of:
+//
+// <block height><spend heights>
+//
+// Field          Type      Size
+// block height   uint32    4 (big-endian)
+// spend heights  []int32   4 per output
+//
+// There's a spend height for every output of every transaction of the block in
+// the order that the block creates them in.  It's 0 while the output isn't
+// spent.
+//
+// Where the outputs of a transaction are in the block that created it is kept
+// in the ttl tx positions bucket with a <key><value> of:
+//
+// <txid><block height><output position>
+//
+// Field            Type      Size
+// txid             [32]byte  32
+// block height     uint32    4
+// output position  uint32    4
+//
+// The output position is the position of the first output of the transaction
+// among the outputs of the block.
+// -----------------------------------------------------------------------------
+
+// ttlTxPos is where the outputs of a transaction are in the block that created
+// it.
+type ttlTxPos struct {
+	height int32
+	first  uint32
+}
+
+// spendHeightsKey returns the key of the spend heights of the block at the
+// given height.  The height is big-endian so that the keys are in the order of
+// the heights.
+func spendHeightsKey(height int32) []byte {
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], uint32(height))
+	return key[:]
+}
+
+// spendHeightsTracker keeps the spend heights of the blocks that the spends of
+// a block change until they're all written out.
+type spendHeightsTracker struct {
+	heights   database.Bucket
+	positions database.Bucket
+
+	// blockTxs are the positions of the transactions of the block whose
+	// spends are tracked as they're not stored while it's connected and
+	// blockOutputs is how many outputs it creates.
+	blockTxs     map[chainhash.Hash]ttlTxPos
+	blockOutputs uint32
+
+	// changed are the spend heights that were changed by the height of
+	// the block that created the outputs.
+	changed map[int32][]byte
+}
+
+// newSpendHeightsTracker returns a tracker of the spends of the block.
+func newSpendHeightsTracker(ttlIdxBucket database.Bucket,
+	blk *btcutil.Block) *spendHeightsTracker {
+
+	t := &spendHeightsTracker{
+		heights:   ttlIdxBucket.Bucket(ttlHeightBucketName),
+		positions: ttlIdxBucket.Bucket(ttlTxPosBucketName),
+		blockTxs:  make(map[chainhash.Hash]ttlTxPos),
+		changed:   make(map[int32][]byte),
+	}
+
+	for _, tx := range blk.Transactions() {
+		t.blockTxs[*tx.Hash()] = ttlTxPos{
+			height: blk.Height(),
+			first:  t.blockOutputs,
+		}
+		t.blockOutputs += uint32(len(tx.MsgTx().TxOut))
+	}
+
+	return t
+}
+
+// setSpendHeight sets the spend height of the given output.
+func (t *spendHeightsTracker) setSpendHeight(op *wire.OutPoint,
+	spendHeight int32) error {
+
+	pos, ok := t.blockTxs[op.Hash]
+	if !ok {
+		serialized := t.positions.Get(op.Hash[:])
+		if len(serialized) != 8 {
+			return database.Error{
+				ErrorCode: database.ErrCorruption,
+				Description: fmt.Sprintf("no output position for "+
+					"transaction %v in the %s", op.Hash,
+					ttlIndexName),
+			}
+		}
+		pos.height = int32(byteOrder.Uint32(serialized[0:4]))
+		pos.first = byteOrder.Uint32(serialized[4:8])
+	}
+
+	spendHeights, ok := t.changed[pos.height]
+	if !ok {
+		// The values returned by the database can't be modified so
+		// they're copied.
+		serialized := t.heights.Get(spendHeightsKey(pos.height))
+		spendHeights = make([]byte, len(serialized))
+		copy(spendHeights, serialized)
+		t.changed[pos.height] = spendHeights
+	}
+
+	offset := int(pos.first+op.Index) * 4
+	if offset+4 > len(spendHeights) {
+		return database.Error{
+			ErrorCode: database.ErrCorruption,
+			Description: fmt.Sprintf("no spend height for output "+
+				"%v created at height %d in the %s", op,
+				pos.height, ttlIndexName),
+		}
+	}
+	byteOrder.PutUint32(spendHeights[offset:], uint32(spendHeight))
+
+	return nil
+}
+
+// setBlockSpendHeights sets the spend height of every output that the block
+// spends.
+func (t *spendHeightsTracker) setBlockSpendHeights(blk *btcutil.Block,
+	spendHeight int32) error {
+
+	for _, tx := range blk.Transactions()[1:] {
+		for _, txIn := range tx.MsgTx().TxIn {
+			err := t.setSpendHeight(&txIn.PreviousOutPoint,
+				spendHeight)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// write writes out the spend heights that were changed.
+func (t *spendHeightsTracker) write() error {
+	for height, spendHeights := range t.changed {
+		err := t.heights.Put(spendHeightsKey(height), spendHeights)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// connectSpendHeights stores where the outputs of the block are along with
+// their spend heights, and sets the spend height of every output that the block
+// spends to the height of the block.
+func connectSpendHeights(ttlIdxBucket database.Bucket, blk *btcutil.Block) error {
+	t := newSpendHeightsTracker(ttlIdxBucket, blk)
+	for txid, pos := range t.blockTxs {
+		var serialized [8]byte
+		byteOrder.PutUint32(serialized[0:4], uint32(pos.height))
+		byteOrder.PutUint32(serialized[4:8], pos.first)
+		err := t.positions.Put(txid[:], serialized[:])
+		if err != nil {
+			return err
+		}
+	}
+	t.changed[blk.Height()] = make([]byte, t.blockOutputs*4)
+
+	err := t.setBlockSpendHeights(blk, blk.Height())
+	if err != nil {
+		return err
+	}
+
+	return t.write()
+}
+
+// disconnectSpendHeights resets the spend height of every output that the block
+// spends and removes where the outputs of the block are along with their spend
+// heights.
+func disconnectSpendHeights(ttlIdxBucket database.Bucket, blk *btcutil.Block) error {
+	t := newSpendHeightsTracker(ttlIdxBucket, blk)
+	err := t.setBlockSpendHeights(blk, 0)
+	if err != nil {
+		return err
+	}
+
+	// The outputs created by the block go away along with it.
+	delete(t.changed, blk.Height())
+	err = t.write()
+	if err != nil {
+		return err
+	}
+	for txid := range t.blockTxs {
+		err := t.positions.Delete(txid[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.heights.Delete(spendHeightsKey(blk.Height()))
+}
+
 // dbFetchTTLEntry returns a pointer to the ttl value of a transaction output.
 // Returns nil for UTXOs.
 func dbFetchTTLEntry(dbTx database.Tx, op *wire.OutPoint) *int32 {
@@ -230,5 +519,5 @@ func NewTTLIndex(db database.DB, chainParams *chaincfg.Params) *TTLIndex {
 // DropTTLIndex drops the address index from the provided database if it
 // exists.
 func DropTTLIndex(db database.DB, interrupt <-chan struct{}) error {
-	return dropIndex(db, ttlIndexKey, ttlIndexName, interrupt)
+	return dropIndex(db, ttlIndexKey, ttlIndexName, nil, interrupt)
 }
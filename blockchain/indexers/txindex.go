@@ -8,7 +8,6 @@ import (
 	"errors"
 	"fmt"
 
-	"github.com/utreexo/utreexod/blockchain"
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
 	"github.com/utreexo/utreexod/database"
@@ -388,19 +387,17 @@ func (idx *TxIndex) Create(dbTx database.Tx) error {
 // for every transaction in the passed block.
 //
 // This is part of the Indexer interface.
-func (idx *TxIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
-
+func (idx *TxIndex) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	// Increment the internal block ID to use for the block being connected
 	// and add all of the transactions in the block to the index.
 	newBlockID := idx.curBlockID + 1
-	if err := dbAddTxIndexEntries(dbTx, block, newBlockID); err != nil {
+	if err := dbAddTxIndexEntries(dbTx, n.Block, newBlockID); err != nil {
 		return err
 	}
 
 	// Add the new block ID index entry for the block being connected and
 	// update the current internal block ID accordingly.
-	err := dbPutBlockIDIndexEntry(dbTx, block.Hash(), newBlockID)
+	err := dbPutBlockIDIndexEntry(dbTx, n.Block.Hash(), newBlockID)
 	if err != nil {
 		return err
 	}
@@ -413,17 +410,15 @@ func (idx *TxIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
 // hash-to-transaction mapping for every transaction in the block.
 //
 // This is part of the Indexer interface.
-func (idx *TxIndex) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
-
+func (idx *TxIndex) DisconnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	// Remove all of the transactions in the block from the index.
-	if err := dbRemoveTxIndexEntries(dbTx, block); err != nil {
+	if err := dbRemoveTxIndexEntries(dbTx, n.Block); err != nil {
 		return err
 	}
 
 	// Remove the block ID index entry for the block being disconnected and
 	// decrement the current internal block ID to account for it.
-	if err := dbRemoveBlockIDIndexEntry(dbTx, block.Hash()); err != nil {
+	if err := dbRemoveBlockIDIndexEntry(dbTx, n.Block.Hash()); err != nil {
 		return err
 	}
 	idx.curBlockID--
@@ -474,10 +469,10 @@ func dropBlockIDIndex(db database.DB) error {
 // exists.  Since the address index relies on it, the address index will also be
 // dropped when it exists.
 func DropTxIndex(db database.DB, interrupt <-chan struct{}) error {
-	err := dropIndex(db, addrIndexKey, addrIndexName, interrupt)
+	err := dropIndex(db, addrIndexKey, addrIndexName, nil, interrupt)
 	if err != nil {
 		return err
 	}
 
-	return dropIndex(db, txIndexKey, txIndexName, interrupt)
+	return dropIndex(db, txIndexKey, txIndexName, nil, interrupt)
 }
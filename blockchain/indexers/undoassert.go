@@ -0,0 +1,339 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// undoAssertDepth is how many blocks below the tip the fingerprints are kept
+// for.  Disconnecting blocks that were connected further back isn't checked.
+const undoAssertDepth = 1000
+
+// stateFingerprint is a compact fingerprint of the utreexo state of an index and
+// of the state kept along with it.  It's cheap enough to take for every block.
+type stateFingerprint struct {
+	// height is the height of the block the fingerprint was taken for.
+	height int32
+
+	// numLeaves, numRoots, and rootsHash are the accumulator.
+	numLeaves uint64
+	numRoots  int
+	rootsHash chainhash.Hash
+
+	// flatHeights are the tips of the flat files of the index by name.
+	// It's nil for indexes without flat files.
+	flatHeights map[string]int32
+}
+
+// diff returns every difference between the fingerprint taken before a block
+// was connected and the one taken after it was disconnected, one per line.
+func (fp *stateFingerprint) diff(after *stateFingerprint) []string {
+	var diff []string
+	if fp.numLeaves != after.numLeaves {
+		diff = append(diff, fmt.Sprintf("num leaves: connected at %d, "+
+			"disconnected to %d", fp.numLeaves, after.numLeaves))
+	}
+	if fp.numRoots != after.numRoots || fp.rootsHash != after.rootsHash {
+		diff = append(diff, fmt.Sprintf("roots: connected at %d roots "+
+			"hashing to %v, disconnected to %d roots hashing to %v",
+			fp.numRoots, fp.rootsHash, after.numRoots, after.rootsHash))
+	}
+	for name, height := range fp.flatHeights {
+		if after.flatHeights[name] != height {
+			diff = append(diff, fmt.Sprintf("%s flat file tip: "+
+				"connected at %d, disconnected to %d", name,
+				height, after.flatHeights[name]))
+		}
+	}
+
+	return diff
+}
+
+// fingerprintState returns the fingerprint of the given utreexo state for the
+// block at the given height.
+//
+// This function MUST be called with the lock of the utreexo state held for
+// reads.
+func fingerprintState(uState *UtreexoState, height int32) (*stateFingerprint, error) {
+	numLeaves, err := uState.NumLeaves()
+	if err != nil {
+		return nil, err
+	}
+	roots := uState.state.GetRoots()
+
+	rootBytes := make([]byte, 0, len(roots)*chainhash.HashSize)
+	for _, root := range roots {
+		rootBytes = append(rootBytes, root[:]...)
+	}
+
+	return &stateFingerprint{
+		height:    height,
+		numLeaves: numLeaves,
+		numRoots:  len(roots),
+		rootsHash: chainhash.HashH(rootBytes),
+	}, nil
+}
+
+// describeBlock returns what the block consists of in the terms that the edge
+// cases of connecting it to the accumulator are told apart by.
+func describeBlock(block *btcutil.Block) string {
+	var inputs, outputs, unspendable int
+	for _, tx := range block.Transactions() {
+		if !blockchain.IsCoinBase(tx) {
+			inputs += len(tx.MsgTx().TxIn)
+		}
+		outputs += len(tx.MsgTx().TxOut)
+		for _, txOut := range tx.MsgTx().TxOut {
+			if blockchain.IsUnspendable(txOut) {
+				unspendable++
+			}
+		}
+	}
+	_, _, inskip, _ := blockchain.DedupeBlock(block)
+
+	return fmt.Sprintf("block %v at height %d: %d transactions, %d "+
+		"inputs of which %d spend outputs of the same block, %d outputs "+
+		"of which %d are unspendable", block.Hash(), block.Height(),
+		len(block.Transactions()), inputs, len(inskip), outputs,
+		unspendable)
+}
+
+// undoAssertions checks that disconnecting a block from an index brings its
+// state back to exactly what it was before the block was connected.  A nil
+// undoAssertions checks nothing.
+type undoAssertions struct {
+	name string
+
+	mtx          sync.Mutex
+	fingerprints map[chainhash.Hash]*stateFingerprint
+}
+
+// newUndoAssertions returns undoAssertions for the index with the given name.
+func newUndoAssertions(name string) *undoAssertions {
+	return &undoAssertions{
+		name:         name,
+		fingerprints: make(map[chainhash.Hash]*stateFingerprint),
+	}
+}
+
+// record keeps the fingerprint taken right before the block was connected.
+//
+// This function is safe for concurrent access.
+func (a *undoAssertions) record(block *btcutil.Block, fp *stateFingerprint) {
+	if a == nil {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.fingerprints[*block.Hash()] = fp
+
+	// Forget the blocks too deep to be disconnected every so often.
+	if block.Height()%undoAssertDepth == 0 {
+		for hash, fp := range a.fingerprints {
+			if fp.height <= block.Height()-undoAssertDepth {
+				delete(a.fingerprints, hash)
+			}
+		}
+	}
+}
+
+// check returns an AssertError describing the differences and the block if the
+// fingerprint taken right after the block was disconnected isn't the same as
+// the one recorded before it was connected.
+//
+// This function is safe for concurrent access.
+func (a *undoAssertions) check(block *btcutil.Block, after *stateFingerprint) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mtx.Lock()
+	before, ok := a.fingerprints[*block.Hash()]
+	delete(a.fingerprints, *block.Hash())
+	a.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+
+	diff := before.diff(after)
+	if len(diff) == 0 {
+		return nil
+	}
+
+	return AssertError(fmt.Sprintf("disconnecting %s from the %s didn't "+
+		"undo connecting it:\n  %s", describeBlock(block), a.name,
+		strings.Join(diff, "\n  ")))
+}
+
+// checkLeafDatas returns an AssertError describing the differences and the
+// block if the leaf datas of the outputs that disconnecting the block restored
+// to the accumulator aren't byte-for-byte the ones in the proof that was stored
+// for the block.  The restored leaf datas are made again from the spend journal
+// of the chain and are matched to the stored ones strictly by the outpoints
+// they're for.  missing are the restored leaf datas whose leaves aren't in the
+// accumulator after the block was disconnected.
+func (a *undoAssertions) checkLeafDatas(block *btcutil.Block, stored *wire.UData,
+	restored []wire.LeafData, missing []wire.OutPoint) error {
+
+	if a == nil {
+		return nil
+	}
+
+	// The compact leaf datas that are stored don't keep their outpoints,
+	// so they're told apart by the outpoints that the block spends in the
+	// same order.
+	outPoints := blockchain.BlockToDelOPs(block)
+	storedByOutPoint := make(map[wire.OutPoint]*wire.LeafData, len(outPoints))
+	var diff []string
+	if len(outPoints) != len(stored.LeafDatas) {
+		diff = append(diff, fmt.Sprintf("the stored proof has %d leaf "+
+			"datas for %d spent outpoints", len(stored.LeafDatas),
+			len(outPoints)))
+	} else {
+		for i := range outPoints {
+			storedByOutPoint[outPoints[i]] = &stored.LeafDatas[i]
+		}
+	}
+
+	for i := range restored {
+		ld := &restored[i]
+		storedLd, ok := storedByOutPoint[ld.OutPoint]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("%v: restored but not "+
+				"in the stored proof", ld.OutPoint))
+			continue
+		}
+		delete(storedByOutPoint, ld.OutPoint)
+
+		var want, got bytes.Buffer
+		err := storedLd.SerializeCompact(&want, udataSerializeBool)
+		if err != nil {
+			return err
+		}
+		err = ld.SerializeCompact(&got, udataSerializeBool)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(want.Bytes(), got.Bytes()) {
+			diff = append(diff, fmt.Sprintf("%v: stored leaf data "+
+				"%x, restored %x", ld.OutPoint, want.Bytes(),
+				got.Bytes()))
+		}
+	}
+	for op := range storedByOutPoint {
+		diff = append(diff, fmt.Sprintf("%v: in the stored proof but "+
+			"not restored", op))
+	}
+	for _, op := range missing {
+		diff = append(diff, fmt.Sprintf("%v: restored but its leaf "+
+			"isn't in the accumulator", op))
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+
+	// The differences of the outpoints left in the map are in a random
+	// order.
+	sort.Strings(diff)
+
+	return AssertError(fmt.Sprintf("disconnecting %s from the %s didn't "+
+		"restore the leaf datas it spent:\n  %s", describeBlock(block),
+		a.name, strings.Join(diff, "\n  ")))
+}
+
+// SetUndoAssertions sets whether disconnecting every block is checked to bring
+// the utreexo state and the flat files of the index back to exactly what they
+// were before the block was connected.  A block that fails the check fails to
+// be disconnected with an AssertError.  It's meant for debugging and tests.
+func (idx *FlatUtreexoProofIndex) SetUndoAssertions(enabled bool) {
+	idx.undoAssert = nil
+	if enabled {
+		idx.undoAssert = newUndoAssertions(idx.Name())
+	}
+}
+
+// fingerprint returns the fingerprint of the state of the index for the block
+// at the given height.
+//
+// This function MUST be called with the snapshotMtx held.
+func (idx *FlatUtreexoProofIndex) fingerprint(height int32) (*stateFingerprint, error) {
+	idx.mtx.RLock()
+	fp, err := fingerprintState(idx.utreexoState, height)
+	idx.mtx.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	fp.flatHeights = map[string]int32{
+		"proof":        idx.proofState.BestHeight(),
+		"undo":         idx.undoState.BestHeight(),
+		"remember idx": idx.rememberIdxState.BestHeight(),
+	}
+
+	return fp, nil
+}
+
+// SetUndoAssertions sets whether disconnecting every block is checked to bring
+// the utreexo state of the index back to exactly what it was before the block
+// was connected and to restore byte-for-byte the leaf datas in the proof stored
+// for the block.  A block that fails the check fails to be disconnected with an
+// AssertError.  It's meant for debugging and tests.
+func (idx *UtreexoProofIndex) SetUndoAssertions(enabled bool) {
+	idx.undoAssert = nil
+	if enabled {
+		idx.undoAssert = newUndoAssertions(idx.Name())
+	}
+}
+
+// fingerprint returns the fingerprint of the state of the index for the block
+// at the given height.
+func (idx *UtreexoProofIndex) fingerprint(height int32) (*stateFingerprint, error) {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	return fingerprintState(idx.utreexoState, height)
+}
+
+// assertLeafDatas checks the leaf datas that disconnecting the block of the
+// notification restored against the proof that was stored for the block, which
+// is nil if there's none to check against.  It's called right after the block
+// was disconnected from the utreexo state of the index.
+func (idx *UtreexoProofIndex) assertLeafDatas(n *BlockNotification,
+	stored *wire.UData) error {
+
+	if idx.undoAssert == nil || stored == nil || n.SpentBlockHashes == nil {
+		return nil
+	}
+
+	leaves, err := n.utreexoLeaves(idx.chainParams.LeafCommitments,
+		idx.leafHasher)
+	if err != nil {
+		return err
+	}
+
+	var missing []wire.OutPoint
+	idx.mtx.RLock()
+	for i, hash := range leaves.delHashes {
+		if !idx.utreexoState.state.FindLeaf(hash) {
+			missing = append(missing, leaves.dels[i].OutPoint)
+		}
+	}
+	idx.mtx.RUnlock()
+
+	return idx.undoAssert.checkLeafDatas(n.Block, stored, leaves.dels,
+		missing)
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+func TestUndoAssertions(t *testing.T) {
+	block := btcutil.NewBlock(chaincfg.RegressionNetParams.GenesisBlock)
+	block.SetHeight(5)
+	before := &stateFingerprint{
+		height:      5,
+		numLeaves:   10,
+		numRoots:    2,
+		rootsHash:   chainhash.Hash{1},
+		flatHeights: map[string]int32{"proof": 4, "undo": 4},
+	}
+
+	// Nothing is checked if the assertions are disabled or the block was
+	// connected before they were enabled.
+	var disabled *undoAssertions
+	disabled.record(block, before)
+	if err := disabled.check(block, &stateFingerprint{}); err != nil {
+		t.Fatal(err)
+	}
+	a := newUndoAssertions("test index")
+	if err := a.check(block, &stateFingerprint{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Undoing the block exactly passes.
+	a.record(block, before)
+	same := *before
+	if err := a.check(block, &same); err != nil {
+		t.Fatal(err)
+	}
+
+	// Anything left behind is reported along with the block.
+	a.record(block, before)
+	after := &stateFingerprint{
+		height:      5,
+		numLeaves:   11,
+		numRoots:    2,
+		rootsHash:   chainhash.Hash{1},
+		flatHeights: map[string]int32{"proof": 5, "undo": 4},
+	}
+	err := a.check(block, after)
+	if _, ok := err.(AssertError); !ok {
+		t.Fatalf("expected an AssertError, got %v", err)
+	}
+	for _, want := range []string{"num leaves: connected at 10, " +
+		"disconnected to 11", "proof flat file tip: connected at 4, " +
+		"disconnected to 5", "height 5: 1 transactions"} {
+
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in %q", want, err.Error())
+		}
+	}
+	if strings.Contains(err.Error(), "undo flat file") {
+		t.Fatalf("unexpected undo flat file difference in %q", err.Error())
+	}
+
+	// The fingerprints of blocks too deep to be disconnected are dropped.
+	a.record(block, before)
+	tip := btcutil.NewBlock(chaincfg.MainNetParams.GenesisBlock)
+	tip.SetHeight(undoAssertDepth * 2)
+	a.record(tip, &stateFingerprint{height: undoAssertDepth * 2})
+	if len(a.fingerprints) != 1 {
+		t.Fatalf("expected 1 fingerprint, got %d", len(a.fingerprints))
+	}
+}
+
+// TestChainSplitUndoAssertions splits the chain off at random heights with
+// longer side chains of random blocks so that both indexes reorg across proof
+// generation intervals with the undo assertions enabled.
+func TestChainSplitUndoAssertions(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	source := rand.NewSource(time.Now().UnixNano())
+	rand := rand.New(source)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestChainSplitUndoAssertions", defaultProofGenInterval)
+	defer tearDown()
+
+	// addBlock adds an empty block or one that spends the given outputs.
+	// Empty blocks on the same parent are identical so the first block
+	// after a fork must always spend.
+	addBlock := func(prev *btcutil.Block, spends []*blockchain.SpendableOut,
+		mayBeEmpty bool) (*btcutil.Block, []*blockchain.SpendableOut) {
+
+		if mayBeEmpty && rand.Intn(4) == 0 {
+			block, _ := blockchain.AddBlock(chain, prev, nil)
+			return block, spends
+		}
+		return blockchain.AddBlock(chain, prev, spends)
+	}
+
+	blocks := []*btcutil.Block{btcutil.NewBlock(params.GenesisBlock)}
+	spends := [][]*blockchain.SpendableOut{nil}
+	for i := 0; i < defaultProofGenInterval*3; i++ {
+		block, outs := addBlock(blocks[i], spends[i], i > 0)
+		blocks = append(blocks, block)
+		spends = append(spends, outs)
+	}
+
+	for split := 0; split < 5; split++ {
+		fork := 1 + rand.Intn(len(blocks)-1)
+		sideLen := len(blocks) - fork + rand.Intn(defaultProofGenInterval)
+
+		prev, prevSpends := blocks[fork], spends[fork]
+		blocks, spends = blocks[:fork+1], spends[:fork+1]
+		for i := 0; i < sideLen; i++ {
+			prev, prevSpends = addBlock(prev, prevSpends, i > 0)
+			blocks = append(blocks, prev)
+			spends = append(spends, prevSpends)
+		}
+
+		best := chain.BestSnapshot()
+		if best.Hash != *prev.Hash() {
+			t.Fatalf("split %d from height %d: expected the side chain "+
+				"tip %v to be the best block, got %v. Rand source %v",
+				split, fork, prev.Hash(), best.Hash, source)
+		}
+
+		// The flat index only keeps multi-block proofs at this
+		// interval so only the undo blocks are compared.
+		m := NewManager(nil, indexes)
+		for height := int32(1); height <= best.Height; height++ {
+			hash, err := chain.BlockHashByHeight(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			undos, err := m.FetchUndoAllIndexes(
+				&BlockID{Height: height, Hash: *hash})
+			if err != nil {
+				t.Fatalf("split %d from height %d: %v. Rand "+
+					"source %v", split, fork, err, source)
+			}
+			var first *accumulator.UndoBlock
+			for name, undo := range undos {
+				if first == nil {
+					first = undo
+					continue
+				}
+				if !reflect.DeepEqual(first, undo) {
+					t.Fatalf("split %d from height %d: undo "+
+						"block of the %s differs at height "+
+						"%d. Rand source %v", split, fork,
+						name, height, source)
+				}
+			}
+		}
+	}
+}
+
+// TestUndoLeafDataAssertions ensures that the leaf datas restored by
+// disconnecting a block are matched to the stored ones by their outpoints and
+// compared byte-for-byte.
+func TestUndoLeafDataAssertions(t *testing.T) {
+	spent := wire.OutPoint{Hash: chainhash.Hash{1}, Index: 2}
+	coinbase := chaincfg.RegressionNetParams.GenesisBlock.Transactions[0]
+	spendTx := wire.NewMsgTx(1)
+	spendTx.AddTxIn(wire.NewTxIn(&spent, nil, nil))
+	spendTx.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_TRUE}))
+	block := btcutil.NewBlock(&wire.MsgBlock{
+		Transactions: []*wire.MsgTx{coinbase, spendTx},
+	})
+	block.SetHeight(5)
+
+	leafData := wire.LeafData{
+		OutPoint: spent,
+		Amount:   2000,
+		PkScript: []byte{txscript.OP_TRUE},
+		Height:   3,
+	}
+	stored := &wire.UData{LeafDatas: []wire.LeafData{leafData}}
+
+	// Nothing is checked if the assertions are disabled.
+	var disabled *undoAssertions
+	err := disabled.checkLeafDatas(block, stored, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored leaf datas don't keep the outpoints but the restored
+	// ones still match them.
+	a := newUndoAssertions("test index")
+	storedCompact := *stored
+	storedCompact.LeafDatas = []wire.LeafData{leafData}
+	storedCompact.LeafDatas[0].OutPoint = wire.OutPoint{}
+	err = a.checkLeafDatas(block, &storedCompact, []wire.LeafData{leafData}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A leaf data for another outpoint that pays to the same script
+	// doesn't stand in for the spent one.
+	sameScript := leafData
+	sameScript.OutPoint = wire.OutPoint{Hash: chainhash.Hash{3}, Index: 2}
+	otherAmount := leafData
+	otherAmount.Amount++
+	tests := []struct {
+		name     string
+		restored []wire.LeafData
+		missing  []wire.OutPoint
+		want     []string
+	}{
+		{
+			name:     "same script at another outpoint",
+			restored: []wire.LeafData{sameScript},
+			want: []string{
+				sameScript.OutPoint.String() + ": restored but " +
+					"not in the stored proof",
+				spent.String() + ": in the stored proof but not " +
+					"restored",
+			},
+		},
+		{
+			name:     "different amount",
+			restored: []wire.LeafData{otherAmount},
+			want:     []string{spent.String() + ": stored leaf data"},
+		},
+		{
+			name:     "leaf not in the accumulator",
+			restored: []wire.LeafData{leafData},
+			missing:  []wire.OutPoint{spent},
+			want: []string{spent.String() + ": restored but its " +
+				"leaf isn't in the accumulator"},
+		},
+	}
+	for _, test := range tests {
+		err := a.checkLeafDatas(block, stored, test.restored, test.missing)
+		if _, ok := err.(AssertError); !ok {
+			t.Fatalf("%s: expected an AssertError, got %v", test.name,
+				err)
+		}
+		for _, want := range append(test.want, "height 5: 2 transactions") {
+			if !strings.Contains(err.Error(), want) {
+				t.Fatalf("%s: expected %q in %q", test.name, want,
+					err.Error())
+			}
+		}
+	}
+}
+
+// TestReorgSharedScriptUndoAssertions reorgs between two chains whose blocks
+// pay to and spend outputs of the same script at different outpoints with the
+// undo assertions enabled.  Every disconnected block must restore the leaf
+// datas of the outpoints that it spent and the proofs of the blocks of the
+// chain that's reorged to must be for their own outpoints.
+func TestReorgSharedScriptUndoAssertions(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestReorgSharedScriptUndoAssertions", defaultProofGenInterval)
+	defer tearDown()
+
+	var spends []*blockchain.SpendableOut
+	fork := btcutil.NewBlock(params.GenesisBlock)
+	for i := 0; i < 5; i++ {
+		fork, spends = blockchain.AddBlock(chain, fork, spends)
+	}
+
+	// addBlocks adds count blocks on top of prev that all pay to the same
+	// script and spend the outputs of the block before them.  The seed
+	// makes the transactions, and so the outpoints, differ from the ones
+	// of the other branch.
+	spec := blockchain.BlockSpec{
+		NumTxs:       2,
+		InputsPerTx:  1,
+		OutputsPerTx: 2,
+		ScriptTypes:  []blockchain.ScriptType{blockchain.ScriptP2SHOpTrue},
+	}
+	addBlocks := func(prev *btcutil.Block, prevSpends []*blockchain.SpendableOut,
+		seed int64, count int) ([]*btcutil.Block, []*blockchain.SpendableOut) {
+
+		blocks := make([]*btcutil.Block, 0, count)
+		for i := 0; i < count; i++ {
+			block, outs, err := blockchain.GenerateBlockFromSpec(chain,
+				prev, prevSpends, spec, seed+int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = chain.ProcessBlock(block, blockchain.BFNone)
+			if err != nil {
+				t.Fatalf("seed %d: %v", seed+int64(i), err)
+			}
+			blocks = append(blocks, block)
+			prev, prevSpends = block, outs
+		}
+
+		return blocks, prevSpends
+	}
+
+	// checkBranch checks that the tip is the last block of the branch and
+	// that the proofs of the blocks of the branch are for the outpoints
+	// that they spend with the amounts and heights that they were created
+	// with.
+	checkBranch := func(name string, blocks []*btcutil.Block) {
+		tip := blocks[len(blocks)-1]
+		if best := chain.BestSnapshot(); best.Hash != *tip.Hash() {
+			t.Fatalf("%s: expected the tip to be %v, got %v", name,
+				tip.Hash(), best.Hash)
+		}
+
+		created := make(map[wire.OutPoint]wire.LeafData)
+		for _, block := range append([]*btcutil.Block{fork}, blocks...) {
+			for _, tx := range block.Transactions() {
+				for i, txOut := range tx.MsgTx().TxOut {
+					op := wire.OutPoint{Hash: *tx.Hash(),
+						Index: uint32(i)}
+					created[op] = wire.LeafData{
+						Amount: txOut.Value,
+						Height: block.Height(),
+					}
+				}
+			}
+		}
+
+		for _, block := range blocks[1:] {
+			ud, err := indexes[0].(*UtreexoProofIndex).FetchUtreexoProof(
+				block.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			outPoints := blockchain.BlockToDelOPs(block)
+			if len(ud.LeafDatas) != len(outPoints) {
+				t.Fatalf("%s: expected %d leaf datas for block "+
+					"%v, got %d", name, len(outPoints),
+					block.Hash(), len(ud.LeafDatas))
+			}
+			for i, op := range outPoints {
+				want, ok := created[op]
+				got := ud.LeafDatas[i]
+				if !ok || got.Amount != want.Amount ||
+					got.Height != want.Height {
+
+					t.Fatalf("%s: block %v has the leaf data "+
+						"%s for %v", name, block.Hash(),
+						got.ToString(), op)
+				}
+			}
+		}
+	}
+
+	// The second branch is longer so the chain reorgs to it, and then
+	// back to the first one once that's longer.
+	first, firstSpends := addBlocks(fork, spends, 1, 3)
+	checkBranch("first branch", first)
+	second, _ := addBlocks(fork, spends, 100, 4)
+	checkBranch("second branch", second)
+	more, _ := addBlocks(first[len(first)-1], firstSpends, 4, 2)
+	checkBranch("first branch again", append(first, more...))
+}
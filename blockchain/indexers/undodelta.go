@@ -0,0 +1,297 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// flatUtreexoUndoDeltaName is the name given to the delta-encoded undo
+	// data of the flat utreexo proof index.  It's kept apart from the undo
+	// data that's stored whole so that an index is never read with the
+	// wrong encoding.
+	flatUtreexoUndoDeltaName = "undodelta"
+
+	// undoRecordFull marks a delta-encoded undo record that holds the
+	// whole serialized undo block.
+	undoRecordFull = 0
+
+	// undoRecordDelta marks a delta-encoded undo record that holds the
+	// serialized undo block as a delta against the undo block of the
+	// previous height.
+	undoRecordDelta = 1
+)
+
+// -----------------------------------------------------------------------------
+// When the undo blocks are delta-encoded, every undo block is stored as a
+// record that starts with its type.  A full record is followed by the
+// serialized undo block.  A delta record is followed by the serialized undo
+// block xored with the serialized undo block of the previous height, where the
+// previous one is padded with zeros when it's shorter:
+//
+//   <length><zero run><literal length><literal>...
+//
+//   Field            Type      Size
+//   length           uvarint   variable
+//   zero run         uvarint   variable
+//   literal length   uvarint   variable
+//   literal          []byte    literal length
+//
+// Consecutive undo blocks have similar heights and positions so most of the
+// xored bytes end up being zeros.  A full record is stored at every snapshot
+// interval so that fetching an undo block never applies more deltas than the
+// interval.
+// -----------------------------------------------------------------------------
+
+// minUndoZeroRun is the minimum number of zeros that end a literal in a delta.
+// Shorter runs of zeros are cheaper to keep in the literal.
+const minUndoZeroRun = 3
+
+// encodeUndoDelta returns the delta that turns prev into cur.
+func encodeUndoDelta(prev, cur []byte) []byte {
+	xored := make([]byte, len(cur))
+	for i := range cur {
+		xored[i] = cur[i]
+		if i < len(prev) {
+			xored[i] ^= prev[i]
+		}
+	}
+
+	var scratch [binary.MaxVarintLen64]byte
+	delta := make([]byte, 0, len(cur)/4+binary.MaxVarintLen64)
+	putUvarint := func(v int) {
+		n := binary.PutUvarint(scratch[:], uint64(v))
+		delta = append(delta, scratch[:n]...)
+	}
+
+	putUvarint(len(xored))
+	for i := 0; i < len(xored); {
+		zeros := 0
+		for i+zeros < len(xored) && xored[i+zeros] == 0 {
+			zeros++
+		}
+		i += zeros
+
+		// The literal goes on until a run of zeros that's long enough
+		// to be worth ending it for.
+		end := i
+		for end < len(xored) {
+			run := 0
+			for end+run < len(xored) && xored[end+run] == 0 {
+				run++
+			}
+			if run >= minUndoZeroRun || end+run == len(xored) {
+				break
+			}
+			end += run + 1
+		}
+
+		putUvarint(zeros)
+		putUvarint(end - i)
+		delta = append(delta, xored[i:end]...)
+		i = end
+	}
+
+	return delta
+}
+
+// decodeUndoDelta returns the serialized undo block that the delta turns prev
+// into.
+func decodeUndoDelta(prev, delta []byte) ([]byte, error) {
+	readUvarint := func() (int, error) {
+		v, n := binary.Uvarint(delta)
+		if n <= 0 || v > math.MaxInt32 {
+			return 0, errDeserialize("malformed undo block delta")
+		}
+		delta = delta[n:]
+		return int(v), nil
+	}
+
+	length, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	cur := make([]byte, length)
+	for i := 0; i < length; {
+		zeros, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		literal, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if i+zeros+literal > length || literal > len(delta) {
+			return nil, errDeserialize("undo block delta is out of " +
+				"bounds")
+		}
+
+		i += zeros
+		copy(cur[i:], delta[:literal])
+		delta = delta[literal:]
+		i += literal
+	}
+	if len(delta) != 0 {
+		return nil, errDeserialize(fmt.Sprintf("%d unexpected trailing "+
+			"bytes in undo block delta", len(delta)))
+	}
+
+	for i := range cur {
+		if i < len(prev) {
+			cur[i] ^= prev[i]
+		}
+	}
+
+	return cur, nil
+}
+
+// undoEncodingName returns the name of the flat file that the undo blocks are
+// stored in for the given snapshot interval.  A snapshot interval of 0 means
+// that the undo blocks are stored whole.
+func undoEncodingName(snapshotInterval int32) string {
+	if snapshotInterval > 0 {
+		return flatUtreexoUndoDeltaName
+	}
+
+	return flatUtreexoUndoName
+}
+
+// checkUndoEncoding returns an error if the undo blocks of the index in the
+// data directory were stored with the other encoding than the one for the
+// given snapshot interval.
+func checkUndoEncoding(dataDir string, snapshotInterval int32) error {
+	other := flatUtreexoUndoDeltaName
+	if snapshotInterval > 0 {
+		other = flatUtreexoUndoName
+	}
+
+	// The offset file always holds the offset of the genesis block so
+	// anything more than that means some undo blocks are stored.
+	path := flatFilePath(dataDir, other)
+	fi, err := os.Stat(filepath.Join(path, offsetFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	version, err := readFlatFileVersion(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() <= offsetsSize(version) {
+		return nil
+	}
+
+	return fmt.Errorf("the undo blocks of the flat utreexo proof index "+
+		"are stored in %q and can't be read with an undo snapshot "+
+		"interval of %d.  The index must be dropped to change between "+
+		"storing the undo blocks whole and delta-encoded", other,
+		snapshotInterval)
+}
+
+// storeUndoBytes stores the serialized undo block for the given height.  When
+// the undo blocks are delta-encoded, it's stored as a delta against the undo
+// block of the previous height unless the height is at a snapshot interval.
+func (idx *FlatUtreexoProofIndex) storeUndoBytes(height int32, undoBytes []byte) error {
+	if idx.undoSnapshotInterval <= 0 {
+		return idx.undoState.StoreData(height, undoBytes)
+	}
+
+	var record []byte
+	if height == 1 || height%idx.undoSnapshotInterval == 0 {
+		record = append([]byte{undoRecordFull}, undoBytes...)
+	} else {
+		prev := idx.lastUndoBytes
+		if idx.lastUndoHeight != height-1 {
+			var err error
+			prev, err = idx.fetchUndoBytes(height - 1)
+			if err != nil {
+				return err
+			}
+		}
+
+		delta := encodeUndoDelta(prev, undoBytes)
+		record = append([]byte{undoRecordDelta}, delta...)
+	}
+
+	err := idx.undoState.StoreData(height, record)
+	if err != nil {
+		return err
+	}
+
+	idx.lastUndoHeight = height
+	idx.lastUndoBytes = undoBytes
+	return nil
+}
+
+// fetchUndoBytes returns the serialized undo block for the given height.  When
+// the undo blocks are delta-encoded, it's rebuilt by applying the deltas from
+// the nearest full undo block at or below the height.
+func (idx *FlatUtreexoProofIndex) fetchUndoBytes(height int32) ([]byte, error) {
+	if idx.undoSnapshotInterval <= 0 {
+		return idx.undoState.FetchData(height)
+	}
+
+	// Walk back to the nearest full record.  The walk is bounded by the
+	// first height since a full record is always stored for it.
+	var deltas [][]byte
+	var undoBytes []byte
+	for h := height; ; h-- {
+		if h <= 0 {
+			return nil, fmt.Errorf("no full undo block at or below "+
+				"height %d", height)
+		}
+
+		record, err := idx.undoState.FetchData(h)
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 {
+			return nil, errDeserialize(fmt.Sprintf("empty undo "+
+				"record at height %d", h))
+		}
+
+		if record[0] == undoRecordFull {
+			undoBytes = record[1:]
+			break
+		}
+		if record[0] != undoRecordDelta {
+			return nil, errDeserialize(fmt.Sprintf("unknown undo "+
+				"record type %d at height %d", record[0], h))
+		}
+		deltas = append(deltas, record[1:])
+	}
+
+	for i := len(deltas) - 1; i >= 0; i-- {
+		var err error
+		undoBytes, err = decodeUndoDelta(undoBytes, deltas[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return undoBytes, nil
+}
+
+// removeUndoBlock removes the undo block for the given height, which must be
+// the latest one stored.
+func (idx *FlatUtreexoProofIndex) removeUndoBlock(height int32) error {
+	idx.lastUndoHeight = -1
+	idx.lastUndoBytes = nil
+
+	err := idx.undoState.DisconnectBlock(height)
+	if err != nil {
+		return err
+	}
+
+	return idx.lowerUntaggedUndoTip(height - 1)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// fakeUndoBytes returns bytes laid out like a serialized undo block with
+// positions near each other for the given height.
+func fakeUndoBytes(rnd *rand.Rand, height int32) []byte {
+	count := 5 + rnd.Intn(10)
+
+	buf := make([]byte, 8, 8+count*40)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(height))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(count))
+	pos := uint64(height) * 1000
+	for i := 0; i < count; i++ {
+		pos += uint64(rnd.Intn(50))
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], pos)
+		buf = append(buf, b[:]...)
+	}
+	for i := 0; i < count; i++ {
+		var hash [32]byte
+		rnd.Read(hash[:])
+		buf = append(buf, hash[:]...)
+	}
+
+	return buf
+}
+
+func TestUndoDeltaRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		name string
+		prev []byte
+		cur  []byte
+	}{
+		{"empty", nil, nil},
+		{"no prev", nil, []byte{1, 2, 3}},
+		{"same", []byte{1, 2, 3}, []byte{1, 2, 3}},
+		{"shorter", []byte{1, 2, 3, 4, 5}, []byte{1, 9}},
+		{"longer", []byte{1}, []byte{1, 0, 0, 0, 0, 7, 0, 8}},
+		{"undo blocks", fakeUndoBytes(rnd, 9), fakeUndoBytes(rnd, 10)},
+	}
+	for _, test := range tests {
+		delta := encodeUndoDelta(test.prev, test.cur)
+		got, err := decodeUndoDelta(test.prev, delta)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(got, test.cur) {
+			t.Fatalf("%s: expected %x, got %x", test.name, test.cur, got)
+		}
+	}
+
+	// Malformed deltas are rejected.
+	malformed := [][]byte{
+		{},
+		{5},
+		{5, 0, 6, 1, 2, 3, 4, 5, 6},
+		{1, 0, 1, 1, 9},
+	}
+	for _, delta := range malformed {
+		_, err := decodeUndoDelta(nil, delta)
+		if !isDeserializeErr(err) {
+			t.Fatalf("expected a deserialize error for %x, got %v",
+				delta, err)
+		}
+	}
+}
+
+// TestUndoDeltaReorg ensures that the delta-encoded undo blocks are fetched
+// back the same after a reorg that crosses a snapshot boundary.
+func TestUndoDeltaReorg(t *testing.T) {
+	dataDir := t.TempDir()
+	undoState, err := loadFlatFileState(dataDir, flatUtreexoUndoDeltaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := &FlatUtreexoProofIndex{
+		undoState:            *undoState,
+		undoSnapshotInterval: 10,
+		lastUndoHeight:       -1,
+	}
+
+	rnd := rand.New(rand.NewSource(2))
+	stored := make(map[int32][]byte)
+	var rawSize, recordSize int
+	store := func(start, end int32) {
+		for height := start; height <= end; height++ {
+			undoBytes := fakeUndoBytes(rnd, height)
+			err := idx.storeUndoBytes(height, undoBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored[height] = undoBytes
+
+			record, err := idx.undoState.FetchData(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rawSize += len(undoBytes)
+			recordSize += len(record)
+		}
+	}
+	check := func(tip int32) {
+		for height := int32(1); height <= tip; height++ {
+			got, err := idx.fetchUndoBytes(height)
+			if err != nil {
+				t.Fatalf("height %d: %v", height, err)
+			}
+			if !bytes.Equal(got, stored[height]) {
+				t.Fatalf("height %d: expected %x, got %x", height,
+					stored[height], got)
+			}
+
+			record, err := idx.undoState.FetchData(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			full := height == 1 || height%10 == 0
+			if full != (record[0] == undoRecordFull) {
+				t.Fatalf("height %d: unexpected record type %d",
+					height, record[0])
+			}
+		}
+	}
+
+	store(1, 25)
+	check(25)
+	if recordSize >= rawSize {
+		t.Fatalf("expected the delta-encoded undo blocks to be smaller, "+
+			"got %d bytes for %d raw bytes", recordSize, rawSize)
+	}
+
+	// Reorg back to height 7 which removes the snapshots at 10 and 20.
+	for height := int32(25); height > 7; height-- {
+		err := idx.removeUndoBlock(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(7)
+
+	store(8, 30)
+	check(30)
+
+	// Reopening the undo state with the undo blocks stored whole fails.
+	err = checkUndoEncoding(dataDir, 0)
+	if err == nil {
+		t.Fatal("expected an error for the wrong undo encoding")
+	}
+	err = checkUndoEncoding(dataDir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// VerifyUndoInverts verifies that the stored undo block for the block at the
+// given height correctly inverts connecting the block to the accumulator.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) VerifyUndoInverts(height int32) error {
+	return idx.VerifyUndoInvertsRange(height, height)
+}
+
+// VerifyUndoInvertsRange verifies that the stored undo blocks for all the
+// blocks from start to end, inclusive, correctly invert connecting the blocks
+// to the accumulator.  The utreexo state is rolled back to the block before
+// start and each block is connected, checked against its stored undo block,
+// undone, and then connected again.
+//
+// The stored undo blocks are only compared against the undo blocks generated
+// while connecting the blocks.  The generated undo blocks are the ones used to
+// undo the blocks so that a corrupted undo block will never corrupt the utreexo
+// state.
+//
+// An error is returned for the first block that fails verification.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) VerifyUndoInvertsRange(start, end int32) error {
+	if start <= 0 || start > end {
+		return fmt.Errorf("invalid range of %d to %d. Start must be "+
+			"above 0 and not above the end", start, end)
+	}
+
+	return idx.withSnapshotState(start-1, func() error {
+		// withSnapshotState makes sure that start is at most the tip but
+		// end may still be beyond it.
+		tip := idx.undoState.currentHeight
+		if end > tip {
+			return fmt.Errorf("end height %d is above the tip "+
+				"height of %d", end, tip)
+		}
+
+		// Keep the generated undo blocks so that the state can be
+		// brought back to the block before start on failure.
+		undoBlocks := make([]*accumulator.UndoBlock, 0, end-start+1)
+		for height := start; height <= end; height++ {
+			undoBlock, err := idx.verifyUndoInverts(height)
+			if err != nil {
+				for i := len(undoBlocks) - 1; i >= 0; i-- {
+					undoErr := idx.utreexoState.undo(*undoBlocks[i])
+					if undoErr != nil {
+						panic(fmt.Sprintf("failed to undo verified "+
+							"block %d: %v. The utreexo state is "+
+							"corrupted", start+int32(i), undoErr))
+					}
+				}
+				return err
+			}
+			undoBlocks = append(undoBlocks, undoBlock)
+		}
+
+		// withSnapshotState expects the state to be at the block
+		// before start once we return.
+		for i := len(undoBlocks) - 1; i >= 0; i-- {
+			err := idx.utreexoState.undo(*undoBlocks[i])
+			if err != nil {
+				panic(fmt.Sprintf("failed to undo verified block %d: "+
+					"%v. The utreexo state is corrupted",
+					start+int32(i), err))
+			}
+		}
+
+		return nil
+	})
+}
+
+// verifyUndoInverts verifies the stored undo block for the block at the given
+// height.  The utreexo state must be at the block right before the given
+// height.  On success, the block is connected to the utreexo state and the
+// generated undo block for it is returned.  On failure, the utreexo state is
+// left at the block right before the given height.
+//
+// This function MUST be called with the snapshotMtx and the mtx held.
+func (idx *FlatUtreexoProofIndex) verifyUndoInverts(height int32) (
+	*accumulator.UndoBlock, error) {
+
+	fetched, err := fetchNotifications(idx.chain, height, height+1)
+	if err != nil {
+		return nil, err
+	}
+	n := fetched[0]
+
+	storedUndo, err := idx.fetchUndoBlock(height)
+	if err != nil {
+		return nil, err
+	}
+
+	prevRoots := idx.utreexoState.state.GetRoots()
+
+	undoBlock, err := idx.attachBlockWithUndo(n)
+	if err != nil {
+		return nil, err
+	}
+	roots := idx.utreexoState.state.GetRoots()
+
+	// Undoing the block must bring the roots back exactly to what they
+	// were before the block was connected.
+	err = idx.utreexoState.undo(*undoBlock)
+	if err != nil {
+		panic(fmt.Sprintf("failed to undo block %d: %v. The utreexo "+
+			"state is corrupted", height, err))
+	}
+	if !reflect.DeepEqual(idx.utreexoState.state.GetRoots(), prevRoots) {
+		panic(fmt.Sprintf("undo of block %d did not return the roots "+
+			"to the state before the block was connected. The "+
+			"utreexo state is corrupted", height))
+	}
+
+	if !reflect.DeepEqual(storedUndo, undoBlock) {
+		return nil, fmt.Errorf("stored undo block for height %d "+
+			"does not invert the block", height)
+	}
+
+	// Move the state back to the given height.
+	undoBlock, err = idx.attachBlockWithUndo(n)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(idx.utreexoState.state.GetRoots(), roots) {
+		panic(fmt.Sprintf("re-connecting block %d resulted in different "+
+			"roots. The utreexo state is corrupted", height))
+	}
+
+	return undoBlock, nil
+}
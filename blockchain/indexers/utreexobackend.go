@@ -5,8 +5,14 @@
 package indexers
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/util"
@@ -40,7 +46,7 @@ type UtreexoConfig struct {
 	Name string
 
 	// Type specifies what type of UtreexoBackEnd should be created.
-	Type accumulator.ForestType
+	Type ForestType
 
 	// Params are the Bitcoin network parameters. This is used to separately store
 	// different accumulators.
@@ -52,6 +58,142 @@ type UtreexoConfig struct {
 type UtreexoState struct {
 	config *UtreexoConfig
 	state  *accumulator.Forest
+
+	// numLeaves is the number of leaves in the forest.  The forest doesn't
+	// expose it so it's read from the saved state and kept up to date as
+	// the forest is modified.  leavesKnown is unset once a modification
+	// fails partway through and leaves it unknown.
+	numLeaves   uint64
+	leavesKnown bool
+}
+
+// NumLeaves returns the number of leaves in the accumulator.  An error is
+// returned if it's unknown because a modification of the accumulator failed.
+//
+// The caller must hold the lock of the utreexo state for reads.
+func (us *UtreexoState) NumLeaves() (uint64, error) {
+	if !us.leavesKnown {
+		return 0, fmt.Errorf("the number of leaves in the utreexo state "+
+			"of the %s is unknown", us.config.Name)
+	}
+
+	return us.numLeaves, nil
+}
+
+// stats returns the number of leaves in the accumulator and the number of rows
+// that the biggest tree they fit in has.
+//
+// The caller must hold the lock of the utreexo state for reads.
+func (us *UtreexoState) stats() (uint64, uint8, error) {
+	numLeaves, err := us.NumLeaves()
+	if err != nil || numLeaves == 0 {
+		return 0, 0, err
+	}
+
+	return numLeaves, uint8(bits.Len64(numLeaves - 1)), nil
+}
+
+// modify adds and deletes the leaves from the accumulator and keeps track of
+// its number of leaves.
+//
+// The caller must hold the lock of the utreexo state for writes.
+func (us *UtreexoState) modify(adds []accumulator.Leaf, dels []uint64) (
+	*accumulator.UndoBlock, error) {
+
+	undoBlock, err := us.state.Modify(adds, dels)
+	if err != nil {
+		us.leavesKnown = false
+		return nil, err
+	}
+	us.numLeaves = us.numLeaves + uint64(len(adds)) - uint64(len(dels))
+
+	return undoBlock, nil
+}
+
+// undo reverts the modification of the accumulator that returned the undo
+// block and keeps track of its number of leaves.
+//
+// The caller must hold the lock of the utreexo state for writes.
+func (us *UtreexoState) undo(undoBlock accumulator.UndoBlock) error {
+	numAdds, numDels, err := undoBlockCounts(&undoBlock)
+	if err != nil {
+		return err
+	}
+	err = us.state.Undo(undoBlock)
+	if err != nil {
+		us.leavesKnown = false
+		return err
+	}
+	us.numLeaves = us.numLeaves - numAdds + numDels
+
+	return nil
+}
+
+// setForest makes the forest that was restored from the saved state at the
+// given path the accumulator.
+//
+// The caller must hold the lock of the utreexo state for writes.
+func (us *UtreexoState) setForest(forest *accumulator.Forest, basePath string) error {
+	numLeaves, err := readForestNumLeaves(basePath)
+	if err != nil {
+		return err
+	}
+	us.state = forest
+	us.numLeaves = numLeaves
+	us.leavesKnown = true
+
+	return nil
+}
+
+// undoBlockCounts returns the number of leaves that the modification that
+// returned the undo block added and deleted.  The undo block only exposes them
+// through its serialization, which starts with the number of adds followed by
+// the deleted positions and then the deleted hashes.
+func undoBlockCounts(undoBlock *accumulator.UndoBlock) (uint64, uint64, error) {
+	var buf bytes.Buffer
+	err := undoBlock.Serialize(&buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	r := bytes.NewReader(buf.Bytes())
+
+	var numAdds uint32
+	var numPositions, numHashes uint64
+	err = binary.Read(r, binary.BigEndian, &numAdds)
+	if err == nil {
+		err = binary.Read(r, binary.BigEndian, &numPositions)
+	}
+	if err == nil {
+		_, err = r.Seek(int64(numPositions)*8, io.SeekCurrent)
+	}
+	if err == nil {
+		err = binary.Read(r, binary.BigEndian, &numHashes)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to read the undo block: %v", err)
+	}
+
+	return uint64(numAdds), numHashes, nil
+}
+
+// readForestNumLeaves returns the number of leaves of the utreexo state saved
+// at the given path, which leads its misc forest data.
+func readForestNumLeaves(basePath string) (uint64, error) {
+	miscFile, err := os.Open(filepath.Join(basePath,
+		defaultUtreexoMiscFileName))
+	if err != nil {
+		return 0, err
+	}
+	defer miscFile.Close()
+
+	var numLeaves uint64
+	err = binary.Read(miscFile, binary.BigEndian, &numLeaves)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read the number of leaves of "+
+			"the utreexo state at %s: %v", basePath, err)
+	}
+
+	return numLeaves, nil
 }
 
 // utreexoBasePath returns the base path of where the utreexo state should be
@@ -67,20 +209,38 @@ func InitUtreexoState(cfg *UtreexoConfig) (*UtreexoState, error) {
 	log.Infof("Initializing Utreexo state from '%s'", basePath)
 
 	var forest *accumulator.Forest
+	var numLeaves uint64
 	var err error
 	if checkUtreexoExists(cfg, basePath) {
+		err = checkForestAccVersion(basePath)
+		if err != nil {
+			return nil, err
+		}
 		forest, err = restoreUtreexoState(cfg, basePath)
 		if err != nil {
 			return nil, err
 		}
+		numLeaves, err = readForestNumLeaves(basePath)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		forest, err = createUtreexoState(cfg, basePath)
 		if err != nil {
 			return nil, err
 		}
+		err = writeForestAccVersion(basePath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	uState := &UtreexoState{cfg, forest}
+	uState := &UtreexoState{
+		config:      cfg,
+		state:       forest,
+		numLeaves:   numLeaves,
+		leavesKnown: true,
+	}
 
 	log.Info("Utreexo state loaded")
 
@@ -104,7 +264,7 @@ func deleteUtreexoState(path string) error {
 func checkUtreexoExists(cfg *UtreexoConfig, basePath string) bool {
 	var path string
 	switch cfg.Type {
-	case accumulator.CowForest:
+	case CowForest:
 		cowPath := filepath.Join(basePath, defaultUtreexoCowDirName)
 		path = filepath.Join(cowPath, defaultUtreexoCowFileName)
 	default:
@@ -148,10 +308,28 @@ func (idx *UtreexoProofIndex) FlushUtreexoState() error {
 
 // FlushUtreexoState saves the utreexo state to disk.
 func (idx *FlatUtreexoProofIndex) FlushUtreexoState() error {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	// The flat files that are synced relaxed are synced first so that the
+	// proofs of the blocks that the flushed state includes are never lost.
+	err := idx.syncRelaxedFlatFiles()
+	if err != nil {
+		return err
+	}
+
 	basePath := utreexoBasePath(idx.utreexoState.config)
 	if _, err := os.Stat(basePath); err != nil {
 		os.MkdirAll(basePath, os.ModePerm)
 	}
+
+	// The height of the state is unknown while it's written so that a
+	// crash in the middle isn't mistaken for the state of either height.
+	err = writeForestHeight(basePath, -1)
+	if err != nil {
+		return err
+	}
+
 	forestFilePath := filepath.Join(basePath, defaultUtreexoFileName)
 	forestFile, err := os.OpenFile(forestFilePath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
@@ -174,6 +352,13 @@ func (idx *FlatUtreexoProofIndex) FlushUtreexoState() error {
 		return err
 	}
 
+	height := idx.proofState.BestHeight()
+	err = writeForestHeight(basePath, height)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&idx.durableHeight, height)
 	return nil
 }
 
@@ -185,7 +370,7 @@ func restoreUtreexoState(cfg *UtreexoConfig, basePath string) (
 	var forest *accumulator.Forest
 
 	switch cfg.Type {
-	case accumulator.CowForest:
+	case CowForest:
 		cowPath := filepath.Join(basePath, defaultUtreexoCowDirName)
 		miscForestFilePath := filepath.Join(basePath, defaultUtreexoMiscFileName)
 
@@ -207,9 +392,9 @@ func restoreUtreexoState(cfg *UtreexoConfig, basePath string) (
 			cache bool
 		)
 		switch cfg.Type {
-		case accumulator.RamForest:
+		case RamForest:
 			inRam = true
-		case accumulator.CacheForest:
+		case CacheForest:
 			cache = true
 		}
 
@@ -244,12 +429,16 @@ func createUtreexoState(cfg *UtreexoConfig, basePath string) (
 
 	var forest *accumulator.Forest
 	switch cfg.Type {
-	case accumulator.RamForest:
-		forest = accumulator.NewForest(cfg.Type, nil, "", 0)
-	case accumulator.CowForest:
+	case RamForest:
+		forest = accumulator.NewForest(cfg.Type.accumulatorForestType(), nil, "", 0)
+	case CowForest:
 		// Default to 1000MB of cache for now.
-		forest = accumulator.NewForest(cfg.Type, nil, basePath, 1000)
+		forest = accumulator.NewForest(cfg.Type.accumulatorForestType(), nil, basePath, 1000)
 	default:
+		err := os.MkdirAll(basePath, 0700)
+		if err != nil {
+			return nil, err
+		}
 		forestFileName := filepath.Join(basePath, defaultUtreexoFileName)
 
 		// Where the forestfile exists
@@ -260,7 +449,7 @@ func createUtreexoState(cfg *UtreexoConfig, basePath string) (
 		}
 
 		// Restores all the forest data
-		forest = accumulator.NewForest(cfg.Type, forestFile, "", 0)
+		forest = accumulator.NewForest(cfg.Type.accumulatorForestType(), forestFile, "", 0)
 	}
 
 	return forest, nil
@@ -0,0 +1,106 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/utreexo/utreexod/chaincfg"
+)
+
+// TestUtreexoStateNumLeaves ensures that the utreexo state keeps track of its
+// number of leaves as it's modified and undone, that it reads it back from the
+// saved state, and that it's reported as unknown once a modification fails.
+func TestUtreexoStateNumLeaves(t *testing.T) {
+	cfg := &UtreexoConfig{
+		DataDir: t.TempDir(),
+		Name:    "numleaves",
+		Type:    RamForest,
+		Params:  &chaincfg.RegressionNetParams,
+	}
+	uState, err := InitUtreexoState(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkLeaves := func(want uint64) {
+		t.Helper()
+		numLeaves, err := uState.NumLeaves()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numLeaves != want {
+			t.Fatalf("got %d leaves, want %d", numLeaves, want)
+		}
+	}
+	checkLeaves(0)
+
+	rng := rand.New(rand.NewSource(201))
+	_, err = uState.modify(randLeaves(rng, 20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLeaves(20)
+	undoBlock, err := uState.modify(randLeaves(rng, 5), []uint64{1, 4, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLeaves(22)
+	err = uState.undo(*undoBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLeaves(20)
+
+	// Save the state the way the indexes flush it and load it back.
+	basePath := utreexoBasePath(cfg)
+	forestFile, err := os.OpenFile(filepath.Join(basePath,
+		defaultUtreexoFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forestFile.Close()
+	err = uState.state.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile, err := os.OpenFile(filepath.Join(basePath,
+		defaultUtreexoMiscFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer miscFile.Close()
+	err = uState.state.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uState, err = InitUtreexoState(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLeaves(20)
+
+	// Deleting more leaves than there are fails and leaves the number of
+	// leaves unknown.
+	dels := make([]uint64, 21)
+	for i := range dels {
+		dels[i] = uint64(i)
+	}
+	_, err = uState.modify(nil, dels)
+	if err == nil {
+		t.Fatal("expected deleting more leaves than there are to fail")
+	}
+	_, err = uState.NumLeaves()
+	if err == nil {
+		t.Fatal("expected the number of leaves to be unknown")
+	}
+	_, _, err = uState.stats()
+	if err == nil {
+		t.Fatal("expected the stats to be unknown")
+	}
+}
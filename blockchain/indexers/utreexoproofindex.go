@@ -6,12 +6,13 @@ package indexers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/utreexo/utreexod/blockchain"
-	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
 	"github.com/utreexo/utreexod/database"
@@ -37,21 +38,60 @@ var (
 	// utreexoUndoKey is the name of the utreexo undo data.  It is included
 	// in the utreexoParentBucketKey and contains the utreexo undo data.
 	utreexoUndoKey = []byte("utreexoundokey")
+
+	// ErrProofNotFound is the error that's wrapped when the utreexo proof
+	// of a block isn't in the index.
+	ErrProofNotFound = errors.New("utreexo proof not found")
 )
 
+// ProofNotFoundError identifies the block whose utreexo proof wasn't found in
+// the index.
+type ProofNotFoundError struct {
+	// Index is the name of the index that was asked.
+	Index string
+
+	// Hash is the hash of the block whose proof wasn't found.
+	Hash chainhash.Hash
+}
+
+// Error returns the error as a human-readable string.
+func (e *ProofNotFoundError) Error() string {
+	return fmt.Sprintf("%v: %s doesn't have the proof for block %v",
+		ErrProofNotFound, e.Index, e.Hash)
+}
+
+// Is returns true for ErrProofNotFound so that callers may check for a missing
+// proof regardless of the block.
+func (e *ProofNotFoundError) Is(target error) bool {
+	return target == ErrProofNotFound
+}
+
 // Ensure the UtreexoProofIndex type implements the Indexer interface.
 var _ Indexer = (*UtreexoProofIndex)(nil)
 
 // Ensure the UtreexoProofIndex type implements the NeedsInputser interface.
 var _ NeedsInputser = (*UtreexoProofIndex)(nil)
 
+// Ensure the UtreexoProofIndex type implements the Rebuilder interface.
+var _ Rebuilder = (*UtreexoProofIndex)(nil)
+
+// Ensure the UtreexoProofIndex type implements the RangeServer interface.
+var _ RangeServer = (*UtreexoProofIndex)(nil)
+
+// Ensure the UtreexoProofIndex type implements the retryingIndexer interface.
+var _ retryingIndexer = (*UtreexoProofIndex)(nil)
+
 // UtreexoProofIndex implements a utreexo accumulator proof index for all the blocks.
 type UtreexoProofIndex struct {
 	db          database.DB
 	chainParams *chaincfg.Params
 
+	// leafHasher hashes the leaves of the blocks.  It's the hasher of the
+	// chain once the chain is set.
+	leafHasher *wire.LeafHasher
+
 	// The blockchain instance the index corresponds to.
-	chain *blockchain.BlockChain
+	chain indexChain
 
 	// mtx protects concurrent access to utreexoView.
 	mtx *sync.RWMutex
@@ -59,6 +99,57 @@ type UtreexoProofIndex struct {
 	// utreexoState represents the Bitcoin UTXO set as a utreexo accumulator.
 	// It keeps all the elements of the forest in order to generate proofs.
 	utreexoState *UtreexoState
+
+	// proofGenBudget caps the memory used by in-flight proof generation.
+	// It's nil if there's no cap.
+	proofGenBudget *ProofGenBudget
+
+	// leases are the leases of the cursors of the clients of the index.
+	leases *LeaseManager
+
+	// writeStats are the bytes put into the database to connect blocks.
+	writeStats writeStats
+
+	// recovery is the progress of rebuilding the index from the flat
+	// utreexo proof index.
+	recovery recoveryProgress
+
+	// gate refuses the fetches while the index is being rebuilt.
+	gate rebuildGate
+
+	// undoAssert checks that disconnecting blocks undoes connecting them.
+	// It's nil unless the assertions are enabled.
+	undoAssert *undoAssertions
+
+	// fsync is the fsync policy of the index and recordedFsync is the
+	// policy that the index was last run with.
+	fsync         FsyncPolicy
+	recordedFsync string
+
+	// collisions checks the added leaves for leaf hash collisions.
+	collisions leafCollisionChecker
+
+	// sharedUndo is the flat utreexo proof index that keeps the undo
+	// blocks of the index.  It's nil if the index keeps its own.
+	sharedUndo *FlatUtreexoProofIndex
+
+	// rowGrowth anticipates the forest gaining a row.
+	rowGrowth *rowGrowth
+
+	// leafLimit keeps the forest within the leaves that the platform can
+	// address.
+	leafLimit *leafLimit
+
+	// prune is how long the proofs are retained for and how far the index
+	// was pruned.
+	prune pruneState
+
+	// proofCache keeps the recently fetched proofs in memory.
+	proofCache *proofCache
+
+	// restoreErr is set if the accumulator couldn't be caught back up to
+	// the tip after it was rolled back.  It's protected by mtx.
+	restoreErr error
 }
 
 // NeedsInputs signals that the index requires the referenced inputs in order
@@ -72,7 +163,25 @@ func (idx *UtreexoProofIndex) NeedsInputs() bool {
 // Init initializes the utreexo proof index. This is part of the Indexer
 // interface.
 func (idx *UtreexoProofIndex) Init() error {
-	return nil // nothing to do
+	// Tag the undo blocks stored by an older accumulator serialization
+	// version.
+	err := idx.db.Update(migrateDBUndoAccVersion)
+	if err != nil {
+		return err
+	}
+
+	err = idx.loadPruned()
+	if err != nil {
+		return err
+	}
+
+	idx.mtx.RLock()
+	numLeaves, err := idx.utreexoState.NumLeaves()
+	idx.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	return idx.leafLimit.checkStart(numLeaves)
 }
 
 // Name returns the human-readable name of the index.
@@ -109,17 +218,17 @@ func (idx *UtreexoProofIndex) Create(dbTx database.Tx) error {
 		return err
 	}
 
-	return nil
+	return utreexoParentBucket.Put(utreexoAccVersionKey,
+		[]byte{accSerializationVersion})
 }
 
 // ConnectBlock is invoked by the index manager when a new block has been
 // connected to the main chain.
 //
 // This is part of the Indexer interface.
-func (idx *UtreexoProofIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
-
+func (idx *UtreexoProofIndex) ConnectBlock(dbTx database.Tx, n *BlockNotification) error {
 	// Don't include genesis blocks.
+	block := n.Block
 	if block.Height() == 0 {
 		log.Tracef("UtreexoProofIndex.ConnectBlock: Asked to connect genesis"+
 			" block (height %d) Ignoring request and skipping block",
@@ -127,67 +236,199 @@ func (idx *UtreexoProofIndex) ConnectBlock(dbTx database.Tx, block *btcutil.Bloc
 		return nil
 	}
 
-	_, outCount, inskip, outskip := blockchain.DedupeBlock(block)
-	dels, _, err := blockchain.BlockToDelLeaves(stxos, idx.chain, block, inskip, -1)
+	if err := idx.checkRestored(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	eligibility, err := checkLeafEligibility(dbTx, idx.Key(), idx.Name(),
+		block)
 	if err != nil {
 		return err
 	}
 
-	adds := blockchain.BlockToAddLeaves(block, outskip, nil, outCount)
+	if idx.undoAssert != nil {
+		fp, err := idx.fingerprint(block.Height())
+		if err != nil {
+			return err
+		}
+		idx.undoAssert.record(block, fp)
+	}
+
+	leaves, err := n.utreexoLeaves(idx.chainParams.LeafCommitments,
+		idx.leafHasher)
+	if err != nil {
+		return err
+	}
+	adds := leaves.adds
 
 	idx.mtx.RLock()
-	ud, err := wire.GenerateUData(dels, idx.utreexoState.state)
+	ud, err := wire.GenerateUDataFromHashes(leaves.dels, leaves.delHashes,
+		idx.utreexoState.state)
 	idx.mtx.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	err = dbStoreUtreexoProof(dbTx, block.Hash(), ud)
+	// Make sure that none of the added leaves share their leaf hash with
+	// another leaf before they're added.
+	idx.mtx.RLock()
+	err = idx.collisions.check(block.Height(), adds, leaves.addOutPoints,
+		leaves.dels, leaves.delHashes, idx.utreexoState.state)
+	idx.mtx.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	idx.mtx.Lock()
-	undoBlock, err := idx.utreexoState.state.Modify(adds, ud.AccProof.Targets)
-	idx.mtx.Unlock()
+	// Prune the blocks that the block buries past the retention depth in
+	// the same database transaction.
+	err = idx.pruneBlocks(dbTx, n)
 	if err != nil {
 		return err
 	}
 
-	// UndoBlocks needed during reorgs.
-	err = dbStoreUndoBlock(dbTx, block.Hash(), undoBlock)
+	idx.rowGrowth.anticipate()
+
+	var counts WriteStats
+	countedTx := &countingTx{Tx: dbTx, counts: &counts}
+	err = commitBlock(&blockCommit{
+		modifyState: func() (*accumulator.UndoBlock, error) {
+			idx.mtx.Lock()
+			defer idx.mtx.Unlock()
+			return idx.leafLimit.modify(idx.utreexoState, adds,
+				ud.AccProof.Targets)
+		},
+		storeProof: func() error {
+			return dbStoreUtreexoProof(countedTx, block.Hash(), ud)
+		},
+		storeEntries: func(undoBlock *accumulator.UndoBlock) error {
+			// UndoBlocks needed during reorgs.
+			err := idx.storeUndoEntry(countedTx, block.Hash(), undoBlock)
+			if err != nil {
+				return err
+			}
+
+			// The roots are kept so that they're fetched for the
+			// block without rolling the accumulator back.
+			idx.mtx.RLock()
+			roots := idx.utreexoState.state.GetRoots()
+			numLeaves, err := idx.utreexoState.NumLeaves()
+			idx.mtx.RUnlock()
+			if err != nil {
+				return err
+			}
+			err = dbPutBlockRoots(countedTx, block.Hash(), numLeaves, roots)
+			if err != nil {
+				return err
+			}
+
+			return dbPutLeafEligibility(dbTx, idx.Key(),
+				block.Hash(), eligibility)
+		},
+		// The entries are written in the same database transaction as
+		// the index tip so only the accumulator state needs to be
+		// rolled back.
+		rollback: func(undoBlock *accumulator.UndoBlock) error {
+			if undoBlock == nil {
+				return nil
+			}
+
+			idx.mtx.Lock()
+			defer idx.mtx.Unlock()
+			return idx.utreexoState.undo(*undoBlock)
+		},
+	})
 	if err != nil {
 		return err
 	}
+	idx.writeStats.record(block.Height(), counts)
+
+	idx.mtx.RLock()
+	idx.rowGrowth.recordConnected(block.Height(), idx.utreexoState, start)
+	idx.mtx.RUnlock()
 
 	return nil
 }
 
+// recordDbRetries records that connecting a block was attempted again the given
+// number of times after transient database errors.
+//
+// This is part of the retryingIndexer interface.
+func (idx *UtreexoProofIndex) recordDbRetries(retries int, connected bool) {
+	idx.writeStats.recordDbRetries(retries, connected)
+}
+
+// setShadow sets whether the index is run as the shadow of another index.
+//
+// This is part of the shadowIndexer interface.
+func (idx *UtreexoProofIndex) setShadow(shadow bool) {
+	idx.writeStats.setShadow(shadow)
+}
+
+// Stats returns the bytes put into the database to connect blocks since the
+// index was started.  The counts are approximate as the database's own writes
+// aren't visible to the index.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) Stats() IndexWriteStats {
+	stats := idx.writeStats.snapshot()
+	stats.Network = idx.chainParams.Name
+	stats.Approximate = true
+	stats.FsyncPolicy = idx.fsync.String()
+	stats.RecordedFsyncPolicy = idx.recordedFsync
+	stats.LeafHashing = idx.leafHasher.Stats()
+	stats.Recovery = idx.recovery.snapshot()
+	stats.MaxLeaves, stats.LeafHeadroom = idx.leafHeadroom()
+	stats.ProofCache = idx.proofCache.stats()
+	return stats
+}
+
 // DisconnectBlock is invoked by the index manager when a new block has been
 // disconnected to the main chain.
 //
 // This is part of the Indexer interface.
-func (idx *UtreexoProofIndex) DisconnectBlock(dbTx database.Tx, block *btcutil.Block,
-	stxos []blockchain.SpentTxOut) error {
+func (idx *UtreexoProofIndex) DisconnectBlock(dbTx database.Tx, n *BlockNotification) error {
+	if err := idx.checkRestored(); err != nil {
+		return err
+	}
 
+	block := n.Block
+	err := idx.prune.checkUndo(idx.Name(), block.Height(), nil)
+	if err != nil {
+		return err
+	}
 	undoBlockBytes, err := dbFetchUndoBlockEntry(dbTx, block.Hash())
 	if err != nil {
 		return err
 	}
 
-	r := bytes.NewReader(undoBlockBytes)
-	undoBlock := new(accumulator.UndoBlock)
-	err = undoBlock.Deserialize(r)
+	// The undo block is fetched from the shared undo store when only its
+	// marker was stored.
+	id := &BlockID{Height: block.Height(), Hash: *block.Hash()}
+	undoBlock, err := idx.undoBlockFromEntry(id, undoBlockBytes)
 	if err != nil {
 		return err
 	}
 
+	// The leaf datas that the block restores are checked against its
+	// proof as it's stored, not as it may be cached, before it's deleted.
+	var storedProof *wire.UData
+	if idx.undoAssert != nil {
+		storedProof, err = dbFetchStoredProof(dbTx, block.Hash())
+		if err != nil {
+			return err
+		}
+	}
+
 	idx.mtx.Lock()
-	err = idx.utreexoState.state.Undo(*undoBlock)
+	err = idx.utreexoState.undo(*undoBlock)
 	idx.mtx.Unlock()
 	if err != nil {
 		return err
 	}
+	idx.mtx.RLock()
+	idx.rowGrowth.disconnected(idx.utreexoState)
+	idx.mtx.RUnlock()
 
 	err = dbDeleteUndoBlockEntry(dbTx, block.Hash())
 	if err != nil {
@@ -198,43 +439,432 @@ func (idx *UtreexoProofIndex) DisconnectBlock(dbTx database.Tx, block *btcutil.B
 	if err != nil {
 		return err
 	}
+	idx.proofCache.remove(block.Hash())
+
+	err = dbDeleteBlockRoots(dbTx, block.Hash())
+	if err != nil {
+		return err
+	}
+
+	err = dbDeleteLeafEligibility(dbTx, idx.Key(), block.Hash())
+	if err != nil {
+		return err
+	}
+
+	if idx.undoAssert != nil {
+		fp, err := idx.fingerprint(block.Height())
+		if err != nil {
+			return err
+		}
+		err = idx.undoAssert.check(block, fp)
+		if err != nil {
+			return err
+		}
+		err = idx.assertLeafDatas(n, storedProof)
+		if err != nil {
+			return err
+		}
+	}
+	idx.leases.invalidateFrom(block.Height())
 
 	return nil
 }
 
 // FetchUtreexoProof returns the Utreexo proof data for the given block hash.
+// The proof data for the genesis block is always empty as it doesn't modify the
+// accumulator.  A ProofPrunedError is returned if the proof was pruned and a
+// ProofNotFoundError if the block was never indexed.  A RebuildingError is
+// returned while the index is being rebuilt.
+//
+// The recently fetched proofs are served from the proof cache of the index
+// without reading them from the database.
+//
+// This function is safe for concurrent access.
 func (idx *UtreexoProofIndex) FetchUtreexoProof(hash *chainhash.Hash) (*wire.UData, error) {
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+
+	if hash.IsEqual(idx.chainParams.GenesisHash) {
+		return blockchain.GenesisUData(), nil
+	}
+
+	proofBytes, generation, ok := idx.proofCache.get(hash)
+	if ok && !idx.servesCachedProof(hash) {
+		// The proof is read again from the database below, which
+		// returns the error for it.
+		idx.proofCache.stale(hash)
+		ok = false
+	}
+	if ok {
+		ud := new(wire.UData)
+		err := ud.DeserializeCompact(bytes.NewReader(proofBytes),
+			udataSerializeBool, 0)
+		if err != nil {
+			return nil, err
+		}
+		return ud, nil
+	}
+
+	ud, proofBytes, err := idx.fetchStoredProof(hash)
+	if err != nil {
+		return nil, err
+	}
+	idx.proofCache.add(hash, proofBytes, generation)
+
+	return ud, nil
+}
+
+// fetchStoredProof returns the proof of the block with the given hash as it's
+// stored in the database, deserialized and in its compact serialization.
+func (idx *UtreexoProofIndex) fetchStoredProof(hash *chainhash.Hash) (
+	*wire.UData, []byte, error) {
+
 	ud := new(wire.UData)
+	var proofBytes []byte
 	err := idx.db.View(func(dbTx database.Tx) error {
-		proofBytes, err := dbFetchUtreexoProofEntry(dbTx, hash)
+		entry, err := dbFetchUtreexoProofEntry(dbTx, hash)
 		if err != nil {
 			return err
 		}
+		if entry == nil {
+			return idx.missingProofError(hash)
+		}
+
+		// The bytes are only valid during the transaction.
+		proofBytes = copyBytes(entry)
 		r := bytes.NewReader(proofBytes)
 
-		err = ud.DeserializeCompact(r, udataSerializeBool, 0)
+		return ud.DeserializeCompact(r, udataSerializeBool, 0)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ud, proofBytes, nil
+}
+
+// servesCachedProof returns whether the cached proof of the block with the given
+// hash may be served.  A proof that was read from the database right before its
+// block was disconnected or it was pruned may have been cached after the
+// deletion, so it's only served while its block is in the main chain and its
+// proof is retained.
+func (idx *UtreexoProofIndex) servesCachedProof(hash *chainhash.Hash) bool {
+	if idx.chain == nil {
+		return true
+	}
+	if !idx.chain.MainChainHasBlock(hash) {
+		return false
+	}
+	height, err := idx.chain.BlockHeightByHash(hash)
+	if err != nil {
+		return false
+	}
+
+	return idx.prune.checkProof(idx.Name(), height, nil) == nil
+}
+
+// dbFetchStoredProof returns the proof stored for the block with the given hash
+// or nil if there's none, like when it was pruned.
+func dbFetchStoredProof(dbTx database.Tx, hash *chainhash.Hash) (*wire.UData, error) {
+	entry, err := dbFetchUtreexoProofEntry(dbTx, hash)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	ud := new(wire.UData)
+	err = ud.DeserializeCompact(bytes.NewReader(entry), udataSerializeBool, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return ud, nil
+}
+
+// FetchUtreexoProofs returns the Utreexo proof data for each of the given block
+// hashes, in the same order.  They're all fetched in a single database
+// transaction.  A ProofNotFoundError, or a ProofPrunedError if it was pruned,
+// identifying the first block whose proof isn't in the index is returned if any
+// of them is missing.  A RebuildingError
+// is returned while the index is being rebuilt.
+func (idx *UtreexoProofIndex) FetchUtreexoProofs(hashes []*chainhash.Hash) (
+	[]*wire.UData, error) {
+
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+
+	uds := make([]*wire.UData, 0, len(hashes))
+	err := idx.db.View(func(dbTx database.Tx) error {
+		for _, hash := range hashes {
+			if hash.IsEqual(idx.chainParams.GenesisHash) {
+				uds = append(uds, blockchain.GenesisUData())
+				continue
+			}
+
+			proofBytes, err := dbFetchUtreexoProofEntry(dbTx, hash)
+			if err != nil {
+				return err
+			}
+			if proofBytes == nil {
+				return idx.missingProofError(hash)
+			}
+
+			ud := new(wire.UData)
+			err = ud.DeserializeCompact(bytes.NewReader(proofBytes),
+				udataSerializeBool, 0)
+			if err != nil {
+				return err
+			}
+			uds = append(uds, ud)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return uds, nil
+}
+
+// rootsRollback is what's needed to take a block out of the accumulator and to
+// put it back in.
+type rootsRollback struct {
+	undoBlock *accumulator.UndoBlock
+	adds      []accumulator.Leaf
+	targets   []uint64
+}
+
+// FetchUtreexoRoots returns the roots of the accumulator and the number of
+// leaves in it right after the block with the given hash was connected.  They're
+// read from the roots that were stored when the block was connected.  The
+// blocks connected before the roots were stored fall back to rolling the
+// accumulator back with withStateAt, so for them the block may be at most
+// maxSnapshotDepth blocks behind the tip.  A ProofNotFoundError is returned if
+// the block isn't in the index and a RebuildingError is returned while the
+// index is being rebuilt.
+//
+// The fallback fetches the blocks after the given one from the chain so it must
+// not be called while the chain notifies the index.
+func (idx *UtreexoProofIndex) FetchUtreexoRoots(hash *chainhash.Hash) (
+	[]*chainhash.Hash, int64, error) {
+
+	if err := idx.gate.check(); err != nil {
+		return nil, 0, err
+	}
+
+	if hash.IsEqual(idx.chainParams.GenesisHash) {
+		return []*chainhash.Hash{}, 0, nil
+	}
+	if idx.chain != nil && !idx.chain.MainChainHasBlock(hash) {
+		return nil, 0, &ProofNotFoundError{Index: idx.Name(), Hash: *hash}
+	}
+
+	var roots []*chainhash.Hash
+	var numLeaves uint64
+	err := idx.db.View(func(dbTx database.Tx) error {
+		var err error
+		numLeaves, roots, err = dbFetchBlockRoots(dbTx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if roots != nil {
+		return roots, int64(numLeaves), nil
+	}
+
+	var accRoots []accumulator.Hash
+	err = idx.withStateAt(hash, func() error {
+		var err error
+		accRoots = idx.utreexoState.state.GetRoots()
+		numLeaves, err = idx.utreexoState.NumLeaves()
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	roots = make([]*chainhash.Hash, 0, len(accRoots))
+	for _, root := range accRoots {
+		h := chainhash.Hash(root)
+		roots = append(roots, &h)
+	}
+
+	return roots, int64(numLeaves), nil
+}
+
+// withStateAt rolls the accumulator back to right after the main chain block
+// with the given hash was connected, calls fn, and then catches the accumulator
+// back up to the tip.  The block may be at most maxSnapshotDepth blocks behind
+// the tip.  A ProofNotFoundError is returned if the block isn't in the index.
+// If the accumulator can't be caught back up, the error is returned and kept
+// so that the index refuses to change the accumulator from then on.
+//
+// The blocks after the given one are fetched from the chain so it must not be
+// called while the chain notifies the index.
+func (idx *UtreexoProofIndex) withStateAt(hash *chainhash.Hash, fn func() error) error {
+	if idx.chain == nil {
+		return fmt.Errorf("the chain of the index isn't set")
+	}
+	notFound := &ProofNotFoundError{Index: idx.Name(), Hash: *hash}
+	if !idx.chain.MainChainHasBlock(hash) {
+		return notFound
+	}
+	height, err := idx.chain.BlockHeightByHash(hash)
+	if err != nil {
+		return notFound
+	}
+
+	var tip int32
+	var tipHash *chainhash.Hash
+	err = idx.db.View(func(dbTx database.Tx) error {
+		var err error
+		tipHash, tip, err = dbFetchIndexerTip(dbTx, idx.Key())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if height > tip {
+		return notFound
+	}
+	if tip-height > maxSnapshotDepth {
+		return fmt.Errorf("block %v at height %d is more than %d "+
+			"blocks behind the tip", hash, height, maxSnapshotDepth)
+	}
+
+	// Gather the blocks after the given one before the accumulator is
+	// locked as the chain is only called into without holding the lock.
+	rollbacks := make([]rootsRollback, 0, tip-height)
+	for h := height + 1; h <= tip; h++ {
+		block, err := idx.chain.BlockByHeight(h)
+		if err != nil {
+			return err
+		}
+		ud, err := idx.FetchUtreexoProof(block.Hash())
+		if err != nil {
+			return err
+		}
+		undoBlock, err := idx.fetchUndo(&BlockID{Height: h, Hash: *block.Hash()})
 		if err != nil {
 			return err
 		}
 
+		_, outCount, _, outskip := blockchain.DedupeBlock(block)
+		rollbacks = append(rollbacks, rootsRollback{
+			undoBlock: undoBlock,
+			adds: blockchain.BlockToAddLeaves(block, outskip, nil,
+				outCount, idx.chainParams.LeafCommitments,
+				idx.leafHasher),
+			targets: ud.AccProof.Targets,
+		})
+	}
+
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+
+	// Make sure that the tip didn't move while the blocks were gathered.
+	err = idx.db.View(func(dbTx database.Tx) error {
+		curHash, curTip, err := dbFetchIndexerTip(dbTx, idx.Key())
+		if err != nil {
+			return err
+		}
+		if curTip != tip || !curHash.IsEqual(tipHash) {
+			return fmt.Errorf("the tip of the %s moved from %v at "+
+				"height %d to %v at height %d", idx.Name(),
+				tipHash, tip, curHash, curTip)
+		}
+
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if idx.restoreErr != nil {
+		return idx.restoreErr
+	}
+
+	// redo puts the blocks from the given one onward back in the
+	// accumulator.  The accumulator is left behind the tip if they can't
+	// be, so the index refuses to connect and disconnect blocks and to
+	// roll back again from then on.
+	redo := func(from int, prevErr error) error {
+		for _, r := range rollbacks[from:] {
+			_, err := idx.utreexoState.modify(r.adds, r.targets)
+			if err != nil {
+				idx.restoreErr = fmt.Errorf("cannot restore the "+
+					"utreexo state of the %s at height %d.  "+
+					"This is likely because of disk "+
+					"corruption and the index must be "+
+					"rebuilt.  Undo err: %v, redo err: %v",
+					idx.Name(), tip, prevErr, err)
+				log.Error(idx.restoreErr)
+				return idx.restoreErr
+			}
+		}
 
-	return ud, err
+		return nil
+	}
+
+	for i := len(rollbacks) - 1; i >= 0; i-- {
+		err := idx.utreexoState.undo(*rollbacks[i].undoBlock)
+		if err != nil {
+			if redoErr := redo(i+1, err); redoErr != nil {
+				return redoErr
+			}
+			return err
+		}
+	}
+
+	fnErr := fn()
+
+	if err := redo(0, nil); err != nil {
+		return err
+	}
+
+	return fnErr
+}
+
+// checkRestored returns the error that left the accumulator behind the tip
+// after it was rolled back by withStateAt.  It's nil unless that happened.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) checkRestored() error {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	return idx.restoreErr
+}
+
+// tipHeight returns the height of the latest block connected to the index.
+func (idx *UtreexoProofIndex) tipHeight() (int32, error) {
+	var tip int32
+	err := idx.db.View(func(dbTx database.Tx) error {
+		var err error
+		_, tip, err = dbFetchIndexerTip(dbTx, idx.Key())
+		return err
+	})
+
+	return tip, err
 }
 
 // GenerateUData generates utreexo data for the dels passed in.  Height passed in
 // should either be of block height of where the deletions are happening or just
 // the lastest block height for mempool tx proof generation.
+//
+// If a proof generation budget is set, the request is rejected with
+// ErrProofGenBudgetExceeded when the budget doesn't have room for it.
 func (idx *UtreexoProofIndex) GenerateUData(dels []wire.LeafData) (*wire.UData, error) {
-	idx.mtx.RLock()
-	ud, err := wire.GenerateUData(dels, idx.utreexoState.state)
-	idx.mtx.RUnlock()
-	if err != nil {
-		return nil, err
-	}
+	return generateBudgetedUData(idx.proofGenBudget, idx.mtx, idx.utreexoState, dels)
+}
 
-	return ud, nil
+// SetProofGenBudget sets the memory budget that proof generation requests
+// made through GenerateUData must be admitted into.
+func (idx *UtreexoProofIndex) SetProofGenBudget(budget *ProofGenBudget) {
+	idx.proofGenBudget = budget
 }
 
 // ProveUtxos returns an accumulator proof of the outpoints passed in with
@@ -248,6 +878,48 @@ func (idx *UtreexoProofIndex) GenerateUData(dels []wire.LeafData) (*wire.UData,
 func (idx *UtreexoProofIndex) ProveUtxos(utxos []*blockchain.UtxoEntry,
 	outpoints *[]wire.OutPoint) (*blockchain.ChainTipProof, error) {
 
+	hashes, err := idx.utxosToLeafHashes(utxos, outpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	// Admit the request into the proof generation budget.
+	release, err := acquireProveBudget(idx.proofGenBudget, idx.mtx,
+		idx.utreexoState, len(hashes))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Get a read lock for the index.  This will prevent connectBlock from updating
+	// the height and the utreexo state.
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+
+	// Prove the commited hashes.
+	accProof, err := idx.utreexoState.state.ProveBatch(hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Grab the height and the blockhash the proof was generated at.
+	snapshot := idx.chain.BestSnapshot()
+	provedAtHash := snapshot.Hash
+
+	proof := &blockchain.ChainTipProof{
+		ProvedAtHash: &provedAtHash,
+		AccProof:     &accProof,
+		HashesProven: hashes,
+	}
+
+	return proof, nil
+}
+
+// utxosToLeafHashes returns the hashes committed in the accumulator for the
+// passed in utxos and their outpoints.
+func (idx *UtreexoProofIndex) utxosToLeafHashes(utxos []*blockchain.UtxoEntry,
+	outpoints *[]wire.OutPoint) ([]accumulator.Hash, error) {
+
 	// We'll turn the entries and outpoints into leaves that go in
 	// the accumulator.
 	leaves := make([]wire.LeafData, 0, len(utxos))
@@ -283,43 +955,33 @@ func (idx *UtreexoProofIndex) ProveUtxos(utxos []*blockchain.UtxoEntry,
 	// commited in the accumulator.
 	hashes := make([]accumulator.Hash, 0, len(leaves))
 	for _, leaf := range leaves {
-		hashes = append(hashes, leaf.LeafHash())
+		hashes = append(hashes, leaf.ScheduledLeafHash(idx.chainParams.LeafCommitments))
 	}
 
-	// Get a read lock for the index.  This will prevent connectBlock from updating
-	// the height and the utreexo state.
-	idx.mtx.RLock()
-	defer idx.mtx.RUnlock()
-
-	// Prove the commited hashes.
-	accProof, err := idx.utreexoState.state.ProveBatch(hashes)
-	if err != nil {
-		return nil, err
-	}
-
-	// Grab the height and the blockhash the proof was generated at.
-	snapshot := idx.chain.BestSnapshot()
-	provedAtHash := snapshot.Hash
-
-	proof := &blockchain.ChainTipProof{
-		ProvedAtHash: &provedAtHash,
-		AccProof:     &accProof,
-		HashesProven: hashes,
-	}
+	return hashes, nil
+}
 
-	return proof, nil
+// VerifyBatchProof verifies the given accumulator proof.  Returns an error if
+// the verification failed.
+func (idx *UtreexoProofIndex) VerifyBatchProof(toProve []AccHash,
+	proof *BatchProof) error {
+	return idx.utreexoState.state.VerifyBatchProof(
+		AccumulatorHashes(toProve), *proof.AccumulatorBatchProof())
 }
 
 // VerifyAccProof verifies the given accumulator proof.  Returns an error if the
 // verification failed.
+//
+// Deprecated: Use VerifyBatchProof instead.
 func (idx *UtreexoProofIndex) VerifyAccProof(toProve []accumulator.Hash,
 	proof *accumulator.BatchProof) error {
-	return idx.utreexoState.state.VerifyBatchProof(toProve, *proof)
+	return idx.VerifyBatchProof(NewAccHashes(toProve), NewBatchProof(proof))
 }
 
 // SetChain sets the given chain as the chain to be used for blockhash fetching.
 func (idx *UtreexoProofIndex) SetChain(chain *blockchain.BlockChain) {
 	idx.chain = chain
+	idx.leafHasher = chain.LeafHasher()
 }
 
 // NewUtreexoProofIndex returns a new instance of an indexer that is used to create a
@@ -331,20 +993,28 @@ func NewUtreexoProofIndex(db database.DB, dataDir string, chainParams *chaincfg.
 	idx := &UtreexoProofIndex{
 		db:          db,
 		chainParams: chainParams,
+		leafHasher:  blockchain.NewLeafHasher(chainParams),
 		mtx:         new(sync.RWMutex),
+		leases:      NewLeaseManager(),
+		collisions: leafCollisionChecker{
+			sampleRate: defaultLeafCollisionSampleRate,
+		},
+		proofCache: newProofCache(DefaultProofCacheSize),
 	}
 
 	uState, err := InitUtreexoState(&UtreexoConfig{
 		DataDir: dataDir,
 		Name:    db.Type(),
 		// Default to ram for now.
-		Type:   accumulator.RamForest,
+		Type:   RamForest,
 		Params: chainParams,
 	})
 	if err != nil {
 		return nil, err
 	}
 	idx.utreexoState = uState
+	idx.rowGrowth = newRowGrowth(idx.Name(), uState)
+	idx.leafLimit = newLeafLimit(idx.Name(), uState)
 
 	return idx, nil
 }
@@ -352,7 +1022,7 @@ func NewUtreexoProofIndex(db database.DB, dataDir string, chainParams *chaincfg.
 // DropUtreexoProofIndex drops the address index from the provided database if it
 // exists.
 func DropUtreexoProofIndex(db database.DB, dataDir string, interrupt <-chan struct{}) error {
-	err := dropIndex(db, utreexoParentBucketKey, utreexoProofIndexName, interrupt)
+	err := dropIndex(db, utreexoParentBucketKey, utreexoProofIndexName, nil, interrupt)
 	if err != nil {
 		return err
 	}
@@ -390,16 +1060,16 @@ func dbDeleteUtreexoProofEntry(dbTx database.Tx, hash *chainhash.Hash) error {
 	return idx.Delete(hash[:])
 }
 
-// Stores the undo block for forest in the database.
+// Stores the undo block for forest in the database.  It's tagged with the
+// accumulator serialization version.
 func dbStoreUndoBlock(dbTx database.Tx, hash *chainhash.Hash, undoBlock *accumulator.UndoBlock) error {
-	var buf bytes.Buffer
-	err := undoBlock.Serialize(&buf)
+	undoBytes, err := serializeUndoBlock(undoBlock)
 	if err != nil {
 		return err
 	}
 
 	undoBlockBucket := dbTx.Metadata().Bucket(utreexoParentBucketKey).Bucket(utreexoUndoKey)
-	return undoBlockBucket.Put(hash[:], buf.Bytes())
+	return undoBlockBucket.Put(hash[:], undoBytes)
 }
 
 // Fetches the undo block for forest in the database.
@@ -378,10 +378,14 @@ func (ps *proofStats) WritePStats(pStatFF *FlatFileState) error {
 		return err
 	}
 
+	pStatFF.mtx.Lock()
+	defer pStatFF.mtx.Unlock()
+
 	_, err = pStatFF.dataFile.WriteAt(w.Bytes(), 0)
 	if err != nil {
 		return err
 	}
+	pStatFF.writes.writtenBytes += uint64(w.Len())
 
 	return nil
 }
@@ -22,7 +22,8 @@ func TestProofStatSerialize(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ff := FlatFileState{dataFile: f}
+	ff := NewFlatFileState()
+	ff.dataFile = f
 
 	// Get random seed.
 	time := time.Now().UnixNano()
@@ -36,13 +37,13 @@ func TestProofStatSerialize(t *testing.T) {
 
 	pStats := proofStatsVal.Interface().(proofStats)
 
-	err = pStats.WritePStats(&ff)
+	err = pStats.WritePStats(ff)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	newPStats := proofStats{}
-	err = newPStats.InitPStats(&ff)
+	err = newPStats.InitPStats(ff)
 	if err != nil {
 		t.Fatal(err)
 	}
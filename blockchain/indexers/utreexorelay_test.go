@@ -0,0 +1,445 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// relayTestChain returns a verifying relay chain on the given database.
+func relayTestChain(db database.DB, params *chaincfg.Params) (*blockchain.BlockChain, error) {
+	return blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		UtreexoRelay:     true,
+	})
+}
+
+// checkRelayRoots returns an error unless the accumulator of the verifying relay
+// is the same as the one of the utreexo node.
+func checkRelayRoots(relay, csn *blockchain.BlockChain) error {
+	relayView := relay.GetUtreexoRelayView()
+	csnView := csn.GetUtreexoView()
+	if relayView.NumLeaves() != csnView.NumLeaves() ||
+		!reflect.DeepEqual(relayView.GetRoots(), csnView.GetRoots()) {
+
+		return fmt.Errorf("the verifying relay has %d leaves with the "+
+			"roots %v but the utreexo node has %d leaves with the "+
+			"roots %v", relayView.NumLeaves(), relayView.GetRoots(),
+			csnView.NumLeaves(), csnView.GetRoots())
+	}
+
+	return nil
+}
+
+// checkRelayIndexRoots returns an error unless the accumulator of the verifying
+// relay is the same as the one of the utreexo proof index.
+func checkRelayIndexRoots(relay *blockchain.BlockChain, idx *UtreexoProofIndex) error {
+	relayRoots := relay.GetUtreexoRelayView().GetRoots()
+	idxRoots := make([]*chainhash.Hash, 0, len(relayRoots))
+	for _, root := range idx.utreexoState.state.GetRoots() {
+		h := chainhash.Hash(root)
+		idxRoots = append(idxRoots, &h)
+	}
+	if !reflect.DeepEqual(relayRoots, idxRoots) {
+		return fmt.Errorf("the verifying relay has the roots %v but the "+
+			"utreexo proof index has the roots %v", relayRoots, idxRoots)
+	}
+
+	return nil
+}
+
+// relayTestBlock processes the block at the given height of the source chain
+// on the verifying relay along with its proof from the flat utreexo proof
+// index.
+func relayTestBlock(relay, source *blockchain.BlockChain,
+	flatIdx *FlatUtreexoProofIndex, height int32) error {
+
+	block, err := source.BlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	ud, err := flatIdx.FetchUtreexoProof(height, false)
+	if err != nil {
+		return err
+	}
+	_, _, err = relay.ProcessBlockWithUData(block, ud, blockchain.BFNone)
+	return err
+}
+
+// TestUtreexoRelay ensures that a verifying relay keeps the same accumulator as
+// a utreexo node, that it refuses blocks without their utreexo data and utreexo
+// data that doesn't prove the outputs a block spends, and that it loads its
+// accumulator back when the chain is loaded again.
+func TestUtreexoRelay(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	source, indexes, params, tearDown := indexersTestChain("TestUtreexoRelay", 1)
+	defer tearDown()
+	flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+
+	csn, _, csnTearDown, err := csnTestChain("TestUtreexoRelay-CsnChain")
+	defer csnTearDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relayDB, relayPath, err := createDB("TestUtreexoRelay-RelayChain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		relayDB.Close()
+		os.RemoveAll(relayPath)
+	}()
+	relay, err := relayTestChain(relayDB, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the chain with blocks that spend outputs created both before
+	// them and within them.
+	const numBlocks = 40
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for height := int32(1); height <= numBlocks; height++ {
+		if height%5 != 0 || len(spends) < 4 {
+			tip, spends = blockchain.AddBlock(source, tip, spends)
+			continue
+		}
+
+		spec := blockchain.BlockSpec{
+			NumTxs:         2,
+			InputsPerTx:    2,
+			OutputsPerTx:   2,
+			SpendSameBlock: true,
+		}
+		block, created, err := blockchain.GenerateBlockFromSpec(source, tip,
+			spends, spec, int64(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = source.ProcessBlock(block, blockchain.BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tip, spends = block, created
+	}
+
+	tampered := false
+	for height := int32(1); height <= numBlocks; height++ {
+		block, err := source.BlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ud, err := flatIdx.FetchUtreexoProof(height, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = csn.ProcessBlockWithUData(block, ud, blockchain.BFNone)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+
+		// Legacy peers send the blocks without utreexo data, which the
+		// pruned accumulator can't be updated without.
+		if height%2 == 1 {
+			_, _, err = relay.ProcessBlock(block, blockchain.BFNone)
+			var ruleErr blockchain.RuleError
+			if !errors.As(err, &ruleErr) ||
+				ruleErr.ErrorCode != blockchain.ErrUDataMissing {
+
+				t.Fatalf("height %d: got error %v for the block "+
+					"without utreexo data, want %v", height, err,
+					blockchain.ErrUDataMissing)
+			}
+			if best := relay.BestSnapshot(); best.Height != height-1 {
+				t.Fatalf("height %d: expected the relay to stay at "+
+					"height %d, got %d", height, height-1,
+					best.Height)
+			}
+		}
+
+		// The first proof of a spent leaf is tampered with once.  A
+		// leaf marked as a witness script whose input has no witness to
+		// rebuild it from is refused as well, attached to the block the
+		// way a peer sends it.
+		if !tampered && len(ud.AccProof.Proof) > 0 {
+			tampered = true
+
+			bad, err := flatIdx.FetchUtreexoProof(height, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bad.AccProof.Proof[0][0] ^= 0xff
+			_, _, err = relay.ProcessBlockWithUData(block, bad,
+				blockchain.BFNone)
+			if err == nil {
+				t.Fatalf("height %d: expected the tampered proof to "+
+					"be refused", height)
+			}
+
+			malformed, err := flatIdx.FetchUtreexoProof(height, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			malformed.LeafDatas[0].ReconstructablePkType =
+				wire.WitnessV0ScriptHashTy
+			malformed.LeafDatas[0].PkScript = nil
+			msgBlock := *block.MsgBlock()
+			msgBlock.UData = malformed
+			_, _, err = relay.ProcessBlock(btcutil.NewBlock(&msgBlock),
+				blockchain.BFNone)
+			var ruleErr blockchain.RuleError
+			if !errors.As(err, &ruleErr) ||
+				ruleErr.ErrorCode != blockchain.ErrUDataInvalid {
+
+				t.Fatalf("height %d: got error %v for the malformed "+
+					"leaf, want %v", height, err,
+					blockchain.ErrUDataInvalid)
+			}
+			if best := relay.BestSnapshot(); best.Height != height-1 {
+				t.Fatalf("height %d: expected the relay to stay at "+
+					"height %d, got %d", height, height-1,
+					best.Height)
+			}
+		}
+
+		err = relayTestBlock(relay, source, flatIdx, height)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+		err = checkRelayRoots(relay, csn)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+	}
+	if !tampered {
+		t.Fatal("no block with a proof to tamper with")
+	}
+
+	// The accumulator is stored with every block so it's loaded back
+	// when the chain is loaded again.
+	err = relay.FlushCachedState(blockchain.FlushRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := relayTestChain(relayDB, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkRelayRoots(reloaded, csn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUtreexoRelayReorg ensures that a verifying relay checks the utreexo data
+// of the blocks of a side chain against the accumulator they build on and that
+// it ends up with the same accumulator as a utreexo proof index when it
+// reorganizes to the side chain.
+func TestUtreexoRelayReorg(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	source, indexes, params, tearDown := indexersTestChain(
+		"TestUtreexoRelayReorg", 1)
+	defer tearDown()
+	idx := indexes[0].(*UtreexoProofIndex)
+	flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+
+	relayDB, relayPath, err := createDB("TestUtreexoRelayReorg-RelayChain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		relayDB.Close()
+		os.RemoveAll(relayPath)
+	}()
+	relay, err := relayTestChain(relayDB, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the main chain and relay all of it.
+	const forkHeight = 15
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends, forkSpends []*blockchain.SpendableOut
+	var forkBlock *btcutil.Block
+	for height := int32(1); height <= 20; height++ {
+		tip, spends = blockchain.AddBlock(source, tip, spends)
+		if height == forkHeight {
+			forkBlock, forkSpends = tip, spends
+		}
+
+		err = relayTestBlock(relay, source, flatIdx, height)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+		err = checkRelayIndexRoots(relay, idx)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+	}
+
+	// Reorganize the source chain to a longer chain from the fork height
+	// that spends the same outputs as the blocks it replaces.
+	tip, spends = forkBlock, forkSpends
+	for height := int32(forkHeight + 1); height <= 22; height++ {
+		tip, spends = blockchain.AddBlock(source, tip, spends)
+	}
+	if best := source.BestSnapshot(); best.Height != 22 {
+		t.Fatalf("expected the source chain to reorg to height 22, "+
+			"got %d", best.Height)
+	}
+
+	// The blocks of the new chain are side chain blocks on the relay until
+	// it has more work, so their utreexo data is checked against the
+	// accumulator after the fork point rather than the main chain's.
+	sideBlock, err := source.BlockByHeight(forkHeight + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := flatIdx.FetchUtreexoProof(forkHeight+1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad.AccProof.Proof) == 0 {
+		t.Fatal("no proof to tamper with in the side chain")
+	}
+	bad.AccProof.Proof[0][0] ^= 0xff
+	_, _, err = relay.ProcessBlockWithUData(sideBlock, bad, blockchain.BFNone)
+	var ruleErr blockchain.RuleError
+	if !errors.As(err, &ruleErr) ||
+		ruleErr.ErrorCode != blockchain.ErrUDataInvalid {
+
+		t.Fatalf("got error %v for the tampered side chain proof, "+
+			"want %v", err, blockchain.ErrUDataInvalid)
+	}
+	for height := int32(forkHeight + 1); height <= 22; height++ {
+		err = relayTestBlock(relay, source, flatIdx, height)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+	}
+	if best := relay.BestSnapshot(); best.Hash != *tip.Hash() {
+		t.Fatalf("expected the relay to reorg to block %v, got %v",
+			tip.Hash(), best.Hash)
+	}
+	err = checkRelayIndexRoots(relay, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The accumulator at the new tip is loaded back as is.
+	err = relay.FlushCachedState(blockchain.FlushRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := relayTestChain(relayDB, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkRelayIndexRoots(reloaded, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUtreexoRelayBuild ensures that a chain that was synced without being a
+// verifying relay builds the accumulator from its blocks and spend journal when
+// it's loaded as one and relays the blocks after it.
+func TestUtreexoRelayBuild(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	source, indexes, params, tearDown := indexersTestChain(
+		"TestUtreexoRelayBuild", 1)
+	defer tearDown()
+	idx := indexes[0].(*UtreexoProofIndex)
+	flatIdx := indexes[1].(*FlatUtreexoProofIndex)
+
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for height := int32(1); height <= 25; height++ {
+		tip, spends = blockchain.AddBlock(source, tip, spends)
+	}
+
+	db, dbPath, err := createDB("TestUtreexoRelayBuild-Chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.Close()
+		os.RemoveAll(dbPath)
+	}()
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := int32(1); height <= 20; height++ {
+		block, err := source.BlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = chain.ProcessBlock(block, blockchain.BFNone)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+	}
+	err = chain.FlushCachedState(blockchain.FlushRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay, err := relayTestChain(db, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	best := relay.BestSnapshot()
+	root, _, err := idx.FetchUtreexoRoots(&best.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayRoots := relay.GetUtreexoRelayView().GetRoots()
+	if !reflect.DeepEqual(relayRoots, root) {
+		t.Fatalf("the verifying relay has the roots %v at height 20 "+
+			"but the utreexo proof index has %v", relayRoots, root)
+	}
+
+	for height := int32(21); height <= 25; height++ {
+		err = relayTestBlock(relay, source, flatIdx, height)
+		if err != nil {
+			t.Fatalf("height %d: %v", height, err)
+		}
+	}
+	err = checkRelayIndexRoots(relay, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// UtxoNotInAccumulatorError is returned when the inclusion proof of an
+// outpoint is asked for at a block that its leaf isn't in the accumulator at.
+type UtxoNotInAccumulatorError struct {
+	// OutPoint is the outpoint that the proof was asked for.
+	OutPoint wire.OutPoint
+
+	// Height is the height of the block that the proof was asked for at.
+	Height int32
+
+	// Reason is why the leaf isn't in the accumulator.
+	Reason NonInclusionReason
+
+	// SpendHeight and SpendBlockHash are the block that spent the
+	// outpoint.  They're only set for NonInclusionSpent.
+	SpendHeight    int32
+	SpendBlockHash chainhash.Hash
+}
+
+// Error returns the error as a human-readable string.
+func (e *UtxoNotInAccumulatorError) Error() string {
+	if e.Reason == NonInclusionSpent {
+		return fmt.Sprintf("outpoint %v was already spent by block %v "+
+			"at height %d, at or before height %d", e.OutPoint,
+			e.SpendBlockHash, e.SpendHeight, e.Height)
+	}
+
+	return fmt.Sprintf("outpoint %v wasn't created by any block up to "+
+		"height %d", e.OutPoint, e.Height)
+}
+
+// utxoLeafAt returns the leaf of the given outpoint as it's in the accumulator
+// right after the main chain block at the given height was connected.  A
+// UtxoNotInAccumulatorError is returned if it isn't in the accumulator then.
+//
+// Finding the leaf of an outpoint that's no longer in the utxo set scans the
+// inputs of the blocks down from the chain tip so it's meant for occasional
+// requests.
+func utxoLeafAt(chain indexChain, op wire.OutPoint, height int32) (
+	*wire.LeafData, error) {
+
+	notCreated := &UtxoNotInAccumulatorError{
+		OutPoint: op,
+		Height:   height,
+		Reason:   NonInclusionNotCreated,
+	}
+
+	// An unspent outpoint is in the accumulator from the block that
+	// created it on.
+	entry, err := chain.FetchUtxoEntry(op)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && !entry.IsSpent() {
+		if entry.BlockHeight() > height {
+			return nil, notCreated
+		}
+		blockHash, err := chain.BlockHashByHeight(entry.BlockHeight())
+		if err != nil {
+			return nil, err
+		}
+
+		return &wire.LeafData{
+			BlockHash:  *blockHash,
+			OutPoint:   op,
+			Amount:     entry.Amount(),
+			PkScript:   entry.PkScript(),
+			Height:     entry.BlockHeight(),
+			IsCoinBase: entry.IsCoinBase(),
+		}, nil
+	}
+
+	// The leaf of a spent outpoint is the one that the block that spent it
+	// removed from the accumulator.
+	spendBlock, _, err := findSpendingBlock(chain, op,
+		chain.BestSnapshot().Height)
+	if err != nil {
+		return nil, err
+	}
+	if spendBlock == nil {
+		return nil, notCreated
+	}
+	if spendBlock.Height() <= height {
+		return nil, &UtxoNotInAccumulatorError{
+			OutPoint:       op,
+			Height:         height,
+			Reason:         NonInclusionSpent,
+			SpendHeight:    spendBlock.Height(),
+			SpendBlockHash: *spendBlock.Hash(),
+		}
+	}
+
+	stxos, err := chain.FetchSpendJournalUnsafe(spendBlock)
+	if err != nil {
+		return nil, err
+	}
+	_, _, inskip, _ := blockchain.DedupeBlock(spendBlock)
+	dels, _, err := blockchain.BlockToDelLeaves(stxos, chain, spendBlock,
+		inskip, -1)
+	if err != nil {
+		return nil, err
+	}
+	for i := range dels {
+		if dels[i].OutPoint != op {
+			continue
+		}
+		if dels[i].Height > height {
+			return nil, notCreated
+		}
+		return &dels[i], nil
+	}
+
+	// The outpoint never had a leaf if it was spent in the block that
+	// created it, which is after the height.
+	return nil, notCreated
+}
+
+// utxoProof returns the utreexo data that proves the given leaf in the
+// accumulator of the given utreexo state.
+func utxoProof(uState *UtreexoState, leaf *wire.LeafData,
+	schedule wire.LeafCommitmentSchedule) (*wire.UData, error) {
+
+	leafHash := leaf.ScheduledLeafHash(schedule)
+	accProof, err := uState.state.ProveBatch([]accumulator.Hash{leafHash})
+	if err != nil {
+		return nil, err
+	}
+
+	return &wire.UData{
+		AccProof:  accProof,
+		LeafDatas: []wire.LeafData{*leaf},
+	}, nil
+}
+
+// ProveUtxoAt returns the utreexo data that proves that the leaf of the given
+// outpoint is in the accumulator right after the main chain block with the
+// given hash was connected.  The block may be at most maxSnapshotDepth blocks
+// behind the tip.  A UtxoNotInAccumulatorError is returned if the leaf isn't in
+// the accumulator then, a ProofNotFoundError if the block isn't in the index,
+// and a RebuildingError while the index is being rebuilt.
+//
+// This function is safe for concurrent access.
+func (idx *UtreexoProofIndex) ProveUtxoAt(op wire.OutPoint,
+	hash *chainhash.Hash) (*wire.UData, error) {
+
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	if idx.chain == nil {
+		return nil, fmt.Errorf("the chain of the index isn't set")
+	}
+	if !idx.chain.MainChainHasBlock(hash) {
+		return nil, &ProofNotFoundError{Index: idx.Name(), Hash: *hash}
+	}
+	height, err := idx.chain.BlockHeightByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := utxoLeafAt(idx.chain, op, height)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := acquireProveBudget(idx.proofGenBudget, idx.mtx,
+		idx.utreexoState, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var ud *wire.UData
+	err = idx.withStateAt(hash, func() error {
+		var err error
+		ud, err = utxoProof(idx.utreexoState, leaf,
+			idx.chainParams.LeafCommitments)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ud, nil
+}
+
+// ProveUtxoAt returns the utreexo data that proves that the leaf of the given
+// outpoint is in the accumulator right after the main chain block with the
+// given hash was connected.  The block may be at most maxSnapshotDepth blocks
+// behind the tip.  A UtxoNotInAccumulatorError is returned if the leaf isn't in
+// the accumulator then, a ProofNotFoundError if the block isn't in the index,
+// and a RebuildingError while the index is being rebuilt.
+//
+// This function is safe for concurrent access.
+func (idx *FlatUtreexoProofIndex) ProveUtxoAt(op wire.OutPoint,
+	hash *chainhash.Hash) (*wire.UData, error) {
+
+	if err := idx.gate.check(); err != nil {
+		return nil, err
+	}
+	if idx.chain == nil {
+		return nil, fmt.Errorf("the chain of the index isn't set")
+	}
+	if !idx.chain.MainChainHasBlock(hash) {
+		return nil, &ProofNotFoundError{Index: idx.Name(), Hash: *hash}
+	}
+	height, err := idx.chain.BlockHeightByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := utxoLeafAt(idx.chain, op, height)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := acquireProveBudget(idx.proofGenBudget, idx.mtx,
+		idx.utreexoState, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var ud *wire.UData
+	err = idx.withSnapshotState(height, func() error {
+		var err error
+		ud, err = utxoProof(idx.utreexoState, leaf,
+			idx.chainParams.LeafCommitments)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ud, nil
+}
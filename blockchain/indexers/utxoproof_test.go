@@ -0,0 +1,218 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestProveUtxoAt ensures that both utreexo proof indexes prove the leaf of an
+// outpoint at a past block with the same proof that verifies against the
+// accumulator at that block, and that they tell why an outpoint that isn't in
+// that accumulator can't be proven.
+func TestProveUtxoAt(t *testing.T) {
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestProveUtxoAt", 1)
+	defer tearDown()
+
+	// Every block spends the outputs of the one before it.
+	blocks := make([]*btcutil.Block, 0, 13)
+	tip, spendables := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	blocks = append(blocks, nil, tip)
+	for i := 0; i < 11; i++ {
+		tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+		blocks = append(blocks, tip)
+	}
+	coinbase := func(height int32) wire.OutPoint {
+		return wire.OutPoint{
+			Hash:  *blocks[height].Transactions()[0].Hash(),
+			Index: 0,
+		}
+	}
+
+	// prove returns the proof of the outpoint at the block at the given
+	// height from the index and checks it against the accumulator then.
+	prove := func(indexer Indexer, op wire.OutPoint, height int32) (
+		*wire.UData, error) {
+
+		hash := blocks[height].Hash()
+		var ud *wire.UData
+		var err error
+		switch idx := indexer.(type) {
+		case *UtreexoProofIndex:
+			ud, err = idx.ProveUtxoAt(op, hash)
+			if err == nil {
+				err = idx.withStateAt(hash, func() error {
+					return verifyUtxoProof(idx.utreexoState, ud,
+						params.LeafCommitments)
+				})
+			}
+		case *FlatUtreexoProofIndex:
+			ud, err = idx.ProveUtxoAt(op, hash)
+			if err == nil {
+				err = idx.withSnapshotState(height, func() error {
+					return verifyUtxoProof(idx.utreexoState, ud,
+						params.LeafCommitments)
+				})
+			}
+		}
+
+		return ud, err
+	}
+
+	tests := []struct {
+		name   string
+		op     wire.OutPoint
+		height int32
+
+		// provable is whether the outpoint is in the accumulator at
+		// the block.  reason is why it isn't otherwise.
+		provable bool
+		reason   NonInclusionReason
+
+		// spendHeight is the height of the block that spent the
+		// outpoint.  Only checked for NonInclusionSpent.
+		spendHeight int32
+	}{
+		{
+			name:     "spent in the next block",
+			op:       coinbase(8),
+			height:   8,
+			provable: true,
+		},
+		{
+			name: "output of a spending tx",
+			op: wire.OutPoint{
+				Hash:  *blocks[4].Transactions()[1].Hash(),
+				Index: 0,
+			},
+			height:   4,
+			provable: true,
+		},
+		{
+			name:     "unspent at the tip",
+			op:       coinbase(12),
+			height:   12,
+			provable: true,
+		},
+		{
+			name:        "already spent",
+			op:          coinbase(5),
+			height:      8,
+			reason:      NonInclusionSpent,
+			spendHeight: 6,
+		},
+		{
+			name:        "spent by the block",
+			op:          coinbase(7),
+			height:      8,
+			reason:      NonInclusionSpent,
+			spendHeight: 8,
+		},
+		{
+			name:   "spent after being created later",
+			op:     coinbase(10),
+			height: 8,
+			reason: NonInclusionNotCreated,
+		},
+		{
+			name:   "unspent and created later",
+			op:     coinbase(12),
+			height: 8,
+			reason: NonInclusionNotCreated,
+		},
+		{
+			name:   "never created",
+			op:     wire.OutPoint{Hash: chainhash.Hash{0x01}},
+			height: 8,
+			reason: NonInclusionNotCreated,
+		},
+	}
+
+	for _, test := range tests {
+		var proofs []*wire.UData
+		for _, indexer := range indexes {
+			ud, err := prove(indexer, test.op, test.height)
+			if test.provable {
+				if err != nil {
+					t.Fatalf("%s: %s: %v", test.name,
+						indexer.Name(), err)
+				}
+				if ud.LeafDatas[0].OutPoint != test.op {
+					t.Fatalf("%s: %s: proved outpoint %v, "+
+						"want %v", test.name, indexer.Name(),
+						ud.LeafDatas[0].OutPoint, test.op)
+				}
+				proofs = append(proofs, ud)
+				continue
+			}
+
+			var notInAcc *UtxoNotInAccumulatorError
+			if !errors.As(err, &notInAcc) {
+				t.Fatalf("%s: %s: got error %v, want a "+
+					"UtxoNotInAccumulatorError", test.name,
+					indexer.Name(), err)
+			}
+			if notInAcc.Reason != test.reason {
+				t.Fatalf("%s: %s: got reason %v, want %v",
+					test.name, indexer.Name(), notInAcc.Reason,
+					test.reason)
+			}
+			if test.reason != NonInclusionSpent {
+				continue
+			}
+			if notInAcc.SpendHeight != test.spendHeight ||
+				notInAcc.SpendBlockHash != *blocks[test.spendHeight].Hash() {
+
+				t.Fatalf("%s: %s: got spent at height %d (%v), "+
+					"want %d", test.name, indexer.Name(),
+					notInAcc.SpendHeight, notInAcc.SpendBlockHash,
+					test.spendHeight)
+			}
+		}
+		if len(proofs) == 2 && !reflect.DeepEqual(proofs[0], proofs[1]) {
+			t.Fatalf("%s: the proofs of the indexes differ", test.name)
+		}
+	}
+
+	// A block that isn't in the main chain has no proof.
+	for _, indexer := range indexes {
+		var err error
+		switch idx := indexer.(type) {
+		case *UtreexoProofIndex:
+			_, err = idx.ProveUtxoAt(coinbase(8), &chainhash.Hash{0x01})
+		case *FlatUtreexoProofIndex:
+			_, err = idx.ProveUtxoAt(coinbase(8), &chainhash.Hash{0x01})
+		}
+		if !errors.Is(err, ErrProofNotFound) {
+			t.Fatalf("%s: got error %v, want %v", indexer.Name(), err,
+				ErrProofNotFound)
+		}
+	}
+}
+
+// verifyUtxoProof verifies the proof of the utreexo data against the accumulator
+// of the given utreexo state.
+func verifyUtxoProof(uState *UtreexoState, ud *wire.UData,
+	schedule wire.LeafCommitmentSchedule) error {
+
+	hashes := make([]accumulator.Hash, 0, len(ud.LeafDatas))
+	for i := range ud.LeafDatas {
+		hashes = append(hashes, ud.LeafDatas[i].ScheduledLeafHash(schedule))
+	}
+
+	return uState.state.VerifyBatchProof(hashes, ud.AccProof)
+}
@@ -0,0 +1,727 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// proofWatchdogVersion is the version of the saved proof watchdog
+	// statistics.
+	proofWatchdogVersion = 1
+
+	// proofWatchdogQueueSize is how many connected blocks a remote source
+	// may fall behind by before the blocks are skipped for it.
+	proofWatchdogQueueSize = 100
+
+	// defaultWatchdogMinInterval is the default minimum duration between
+	// two requests to a remote source.
+	defaultWatchdogMinInterval = time.Second
+
+	// defaultWatchdogMaxBackoff is the default longest duration that a
+	// remote source that fails to serve proofs is backed off for.
+	defaultWatchdogMaxBackoff = time.Minute * 10
+)
+
+// RemoteProofSource is a bridge whose served utreexo proofs are audited by a
+// ProofWatchdog.
+type RemoteProofSource interface {
+	// Name returns what the source is told apart by in the statistics
+	// and the alerts.
+	Name() string
+
+	// FetchUtreexoProof returns the hash of the block at the given height
+	// of the source's main chain and its utreexo proof as served by the
+	// source.
+	FetchUtreexoProof(height int32) (*chainhash.Hash, *wire.UData, error)
+}
+
+// ProofDivergence is a utreexo proof served by a remote source that differs
+// from the one generated by the local index for the same block.
+type ProofDivergence struct {
+	// Source is the name of the remote source.
+	Source string
+
+	// Height and Hash are the block the proofs are for.
+	Height int32
+	Hash   chainhash.Hash
+
+	// Diff describes every difference between the local and the remote
+	// proof, one per line.
+	Diff []string
+}
+
+// ProofSourceStats are what a ProofWatchdog recorded for a remote source.
+type ProofSourceStats struct {
+	// Name is the name of the remote source.
+	Name string
+
+	// Agreements is the number of remote proofs that were the same as the
+	// local ones.
+	Agreements uint64
+
+	// Divergences is the number of remote proofs that differed from the
+	// local ones.
+	Divergences uint64
+
+	// Failures is the number of requests that the remote source failed to
+	// serve.
+	Failures uint64
+
+	// Skipped is the number of blocks that weren't compared because the
+	// source fell behind, the local proof couldn't be fetched, or the
+	// source had another block at the height.
+	Skipped uint64
+
+	// Available is whether the last request to the source was served.
+	Available bool
+
+	// LastDivergence is the last divergence found.  It's nil if none were
+	// found.
+	LastDivergence *ProofDivergence
+}
+
+// ProofWatchdogConfig is the configuration of a ProofWatchdog.
+type ProofWatchdogConfig struct {
+	// Sources are the remote sources to audit.
+	Sources []RemoteProofSource
+
+	// FetchLocal returns the hash of the block at the given height of the
+	// main chain and its utreexo proof generated by the local index.
+	FetchLocal func(height int32) (*chainhash.Hash, *wire.UData, error)
+
+	// FetchBlock returns the block at the given height of the main chain.
+	// Its inputs decide which scripts of the proofs are reconstructable.
+	// It may be nil, and then a script is taken to be reconstructable
+	// whenever its type is.
+	FetchBlock func(height int32) (*btcutil.Block, error)
+
+	// BestHeight returns the height of the local index tip.  The random
+	// historical heights are picked below it.
+	BestHeight func() int32
+
+	// StatsPath is the file the statistics are saved to.  They're not
+	// saved if it's empty.
+	StatsPath string
+
+	// MinInterval is the minimum duration between two requests to a
+	// remote source.
+	MinInterval time.Duration
+
+	// MaxBackoff is the longest duration that a remote source that fails
+	// to serve proofs is backed off for.
+	MaxBackoff time.Duration
+
+	// HistoricalInterval is how often a random historical height is
+	// audited.  No historical heights are audited if it's 0.
+	HistoricalInterval time.Duration
+
+	// OnDivergence is called with every divergence found.  It's the hook
+	// for alerting the operator and may be nil.
+	OnDivergence func(*ProofDivergence)
+
+	// Shedder pauses the auditing while the node is syncing.  It may be
+	// nil.
+	Shedder *SyncShedder
+}
+
+// watchedSource is a remote source audited by a ProofWatchdog.
+type watchedSource struct {
+	source RemoteProofSource
+
+	// queue is the heights of the connected blocks that are yet to be
+	// audited.
+	queue chan int32
+
+	// stats are protected by the mutex of the ProofWatchdog.
+	stats ProofSourceStats
+
+	// backoff is how long to wait before the next request after a failed
+	// one.  It's only used by the handler of the source.
+	backoff time.Duration
+}
+
+// ProofWatchdog continuously audits the utreexo proofs served by other bridges
+// against the ones generated by the local index.  The proofs of every connected
+// block and of random historical blocks are fetched from each remote source,
+// canonicalized, and compared.
+type ProofWatchdog struct {
+	cfg     ProofWatchdogConfig
+	sources []*watchedSource
+
+	// mtx protects the statistics of the sources and rand.
+	mtx  sync.Mutex
+	rand *rand.Rand
+
+	// saveMtx serializes saving the statistics.
+	saveMtx sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewProofWatchdog returns a ProofWatchdog for the given configuration with the
+// statistics saved at the StatsPath loaded.
+func NewProofWatchdog(cfg *ProofWatchdogConfig) (*ProofWatchdog, error) {
+	w := &ProofWatchdog{
+		cfg:  *cfg,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		quit: make(chan struct{}),
+	}
+	if w.cfg.MinInterval <= 0 {
+		w.cfg.MinInterval = defaultWatchdogMinInterval
+	}
+	if w.cfg.MaxBackoff < w.cfg.MinInterval {
+		w.cfg.MaxBackoff = defaultWatchdogMaxBackoff
+	}
+
+	names := make(map[string]struct{}, len(cfg.Sources))
+	for _, source := range cfg.Sources {
+		name := source.Name()
+		if _, exists := names[name]; exists {
+			return nil, fmt.Errorf("duplicate proof source %s", name)
+		}
+		names[name] = struct{}{}
+
+		w.sources = append(w.sources, &watchedSource{
+			source: source,
+			queue:  make(chan int32, proofWatchdogQueueSize),
+			stats:  ProofSourceStats{Name: name},
+		})
+	}
+
+	err := w.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Start starts auditing the remote sources.
+func (w *ProofWatchdog) Start() {
+	for _, ws := range w.sources {
+		w.wg.Add(1)
+		go w.sourceHandler(ws)
+	}
+}
+
+// Stop stops auditing the remote sources and saves the statistics.
+func (w *ProofWatchdog) Stop() error {
+	close(w.quit)
+	w.wg.Wait()
+
+	return w.save()
+}
+
+// BlockConnected queues the block at the given height to be audited.  The block
+// is skipped for the sources that fell too far behind.
+//
+// This function is safe for concurrent access.
+func (w *ProofWatchdog) BlockConnected(height int32) {
+	for _, ws := range w.sources {
+		select {
+		case ws.queue <- height:
+		default:
+			w.mtx.Lock()
+			ws.stats.Skipped++
+			w.mtx.Unlock()
+		}
+	}
+}
+
+// Stats returns what was recorded for each of the remote sources.
+//
+// This function is safe for concurrent access.
+func (w *ProofWatchdog) Stats() []ProofSourceStats {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	stats := make([]ProofSourceStats, 0, len(w.sources))
+	for _, ws := range w.sources {
+		stats = append(stats, ws.stats)
+	}
+
+	return stats
+}
+
+// sourceHandler audits the queued and the random historical heights against
+// the given source.  Requests are at least MinInterval apart and a source that
+// fails to serve a proof is retried with an exponential backoff.
+//
+// This function MUST be run as a goroutine.
+func (w *ProofWatchdog) sourceHandler(ws *watchedSource) {
+	defer w.wg.Done()
+
+	var historical <-chan time.Time
+	if w.cfg.HistoricalInterval > 0 {
+		ticker := time.NewTicker(w.cfg.HistoricalInterval)
+		defer ticker.Stop()
+		historical = ticker.C
+	}
+
+	var lastRequest time.Time
+	for {
+		var height int32
+		select {
+		case height = <-ws.queue:
+		case <-historical:
+			height = w.randomHeight()
+			if height <= 0 {
+				continue
+			}
+		case <-w.quit:
+			return
+		}
+
+		// Leave the local and the remote proof index alone while the
+		// node is syncing.
+		if !w.cfg.Shedder.WaitSynced("proof watchdog", w.quit) {
+			return
+		}
+
+		for {
+			wait := w.cfg.MinInterval - time.Since(lastRequest)
+			if ws.backoff > wait {
+				wait = ws.backoff
+			}
+			if !w.sleep(wait) {
+				return
+			}
+
+			lastRequest = time.Now()
+			err := w.check(ws, height)
+			if err == nil {
+				ws.backoff = 0
+				break
+			}
+
+			ws.backoff = nextWatchdogBackoff(ws.backoff,
+				w.cfg.MinInterval, w.cfg.MaxBackoff)
+			log.Debugf("Proof source %s failed to serve the proof "+
+				"for height %d, retrying in %v: %v",
+				ws.source.Name(), height, ws.backoff, err)
+		}
+
+		err := w.save()
+		if err != nil {
+			log.Warnf("Unable to save the proof watchdog "+
+				"statistics: %v", err)
+		}
+	}
+}
+
+// sleep waits for the given duration.  It returns false if the ProofWatchdog
+// was stopped in the meantime.
+func (w *ProofWatchdog) sleep(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-w.quit:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-w.quit:
+		return false
+	}
+}
+
+// nextWatchdogBackoff returns the backoff that follows the given one after
+// another failed request.  It doubles from min up to max.
+func nextWatchdogBackoff(backoff, min, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < min {
+		backoff = min
+	}
+	if backoff > max {
+		backoff = max
+	}
+
+	return backoff
+}
+
+// randomHeight returns a random height of a block that the local index has a
+// proof for.  It returns 0 if there are none.
+//
+// This function is safe for concurrent access.
+func (w *ProofWatchdog) randomHeight() int32 {
+	best := w.cfg.BestHeight()
+	if best <= 0 {
+		return 0
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return 1 + w.rand.Int31n(best)
+}
+
+// check compares the proof served by the source for the block at the given
+// height with the local one and records the outcome.  An error is only
+// returned if the source failed to serve the proof.
+//
+// This function is safe for concurrent access.
+func (w *ProofWatchdog) check(ws *watchedSource, height int32) error {
+	name := ws.source.Name()
+	remoteHash, remoteUD, err := ws.source.FetchUtreexoProof(height)
+	if err != nil {
+		w.mtx.Lock()
+		ws.stats.Failures++
+		ws.stats.Available = false
+		w.mtx.Unlock()
+		return err
+	}
+
+	localHash, localUD, err := w.cfg.FetchLocal(height)
+	if err != nil || *localHash != *remoteHash {
+		if err != nil {
+			log.Debugf("Unable to fetch the local proof for height "+
+				"%d to compare with %s: %v", height, name, err)
+		} else {
+			log.Debugf("Proof source %s has block %v at height %d "+
+				"instead of %v", name, remoteHash, height, localHash)
+		}
+
+		w.mtx.Lock()
+		ws.stats.Skipped++
+		ws.stats.Available = true
+		w.mtx.Unlock()
+		return nil
+	}
+
+	var txIns []*wire.TxIn
+	if w.cfg.FetchBlock != nil {
+		block, err := w.cfg.FetchBlock(height)
+		if err != nil || !block.Hash().IsEqual(localHash) {
+			log.Debugf("Unable to fetch block %v at height %d to "+
+				"compare the proof of %s", localHash, height, name)
+
+			w.mtx.Lock()
+			ws.stats.Skipped++
+			ws.stats.Available = true
+			w.mtx.Unlock()
+			return nil
+		}
+		txIns = blockchain.BlockToDelTxIns(block)
+	}
+	local := canonicalUData(localUD, txIns)
+	remote := canonicalUData(remoteUD, txIns)
+	if local.Equal(remote) {
+		w.mtx.Lock()
+		ws.stats.Agreements++
+		ws.stats.Available = true
+		w.mtx.Unlock()
+		return nil
+	}
+
+	divergence := &ProofDivergence{
+		Source: name,
+		Height: height,
+		Hash:   *localHash,
+		Diff:   diffUData(local, remote),
+	}
+	w.mtx.Lock()
+	ws.stats.Divergences++
+	ws.stats.Available = true
+	ws.stats.LastDivergence = divergence
+	w.mtx.Unlock()
+
+	log.Warnf("Proof source %s served a proof for block %v (height %d) "+
+		"that differs from the local one: %v", name, localHash, height,
+		divergence.Diff)
+	if w.cfg.OnDivergence != nil {
+		w.cfg.OnDivergence(divergence)
+	}
+
+	return nil
+}
+
+// canonicalUData returns a copy of the utreexo data in the form it's stored in
+// by the indexes so that the same proof compares equal whichever serialization
+// it was served in.  The block hashes and the outpoints of the leaf datas are
+// left out as they're not stored and are given by the block's inputs.  The
+// scripts that are reconstructable from the inputs are left out too.
+//
+// txIns are the inputs of the block that spend the leaf datas, in their order.
+// They're ignored if there isn't one for every leaf data, and then a script is
+// taken to be reconstructable whenever its type is.
+func canonicalUData(ud *wire.UData, txIns []*wire.TxIn) *wire.UData {
+	if len(txIns) != len(ud.LeafDatas) {
+		txIns = nil
+	}
+
+	canonical := &wire.UData{
+		AccProof: accumulator.BatchProof{
+			Targets: append([]uint64(nil), ud.AccProof.Targets...),
+			Proof:   append([]accumulator.Hash(nil), ud.AccProof.Proof...),
+		},
+		LeafDatas:   make([]wire.LeafData, len(ud.LeafDatas)),
+		RememberIdx: append([]uint32(nil), ud.RememberIdx...),
+	}
+
+	for i, ld := range ud.LeafDatas {
+		ld.BlockHash = chainhash.Hash{}
+		ld.OutPoint = wire.OutPoint{}
+
+		var txIn *wire.TxIn
+		if txIns != nil {
+			txIn = txIns[i]
+		}
+		ld.ReconstructablePkType = canonicalPkType(&ld, txIn)
+		if ld.ReconstructablePkType != wire.OtherTy {
+			ld.PkScript = nil
+		} else {
+			ld.PkScript = append([]byte(nil), ld.PkScript...)
+		}
+
+		canonical.LeafDatas[i] = ld
+	}
+
+	return canonical
+}
+
+// canonicalPkType returns the type that the indexes store the script of the
+// leaf data as.  A script that's included is stored whole unless the input that
+// spends it reconstructs it exactly.  If the input is nil, a script that's
+// included is taken to be reconstructable whenever its type is.
+func canonicalPkType(ld *wire.LeafData, txIn *wire.TxIn) wire.PkType {
+	switch {
+	case len(ld.PkScript) == 0:
+		return ld.ReconstructablePkType
+	case txIn != nil:
+		return blockchain.ReconstructablePkTypeForInput(ld.PkScript, txIn)
+	case ld.ReconstructablePkType == wire.OtherTy:
+		return blockchain.ReconstructablePkType(ld.PkScript)
+	default:
+		return ld.ReconstructablePkType
+	}
+}
+
+// diffUData returns every difference between the local and the remote utreexo
+// data, one per line.
+func diffUData(local, remote *wire.UData) []string {
+	return diffUDataNamed(local, remote, "local", "remote")
+}
+
+// diffUDataNamed returns every difference between the utreexo data a and b,
+// one per line, with the values of each labeled by the given names.
+func diffUDataNamed(a, b *wire.UData, aName, bName string) []string {
+	var diff []string
+	addf := func(format string, args ...interface{}) {
+		diff = append(diff, fmt.Sprintf(format, args...))
+	}
+
+	if len(a.AccProof.Targets) != len(b.AccProof.Targets) {
+		addf("targets: %s %v, %s %v", aName, a.AccProof.Targets,
+			bName, b.AccProof.Targets)
+	} else {
+		for i := range a.AccProof.Targets {
+			l, r := a.AccProof.Targets[i], b.AccProof.Targets[i]
+			if l != r {
+				addf("target %d: %s %d, %s %d", i, aName, l,
+					bName, r)
+			}
+		}
+	}
+
+	if len(a.AccProof.Proof) != len(b.AccProof.Proof) {
+		addf("proof hashes: %s %d, %s %d", aName,
+			len(a.AccProof.Proof), bName, len(b.AccProof.Proof))
+	} else {
+		for i := range a.AccProof.Proof {
+			l, r := a.AccProof.Proof[i], b.AccProof.Proof[i]
+			if l != r {
+				addf("proof hash %d: %s %x, %s %x", i, aName, l,
+					bName, r)
+			}
+		}
+	}
+
+	if len(a.LeafDatas) != len(b.LeafDatas) {
+		addf("leaf datas: %s %d, %s %d", aName, len(a.LeafDatas),
+			bName, len(b.LeafDatas))
+	} else {
+		for i := range a.LeafDatas {
+			l, r := &a.LeafDatas[i], &b.LeafDatas[i]
+			if !l.Equal(r) {
+				addf("leaf data %d: %s {%s}, %s {%s}", i,
+					aName, leafDataSummary(l), bName,
+					leafDataSummary(r))
+			}
+		}
+	}
+
+	if len(a.RememberIdx) != len(b.RememberIdx) {
+		addf("remember indexes: %s %v, %s %v", aName, a.RememberIdx,
+			bName, b.RememberIdx)
+	} else {
+		for i := range a.RememberIdx {
+			l, r := a.RememberIdx[i], b.RememberIdx[i]
+			if l != r {
+				addf("remember index %d: %s %d, %s %d", i,
+					aName, l, bName, r)
+			}
+		}
+	}
+
+	return diff
+}
+
+// leafDataSummary returns the fields of a canonical leaf data in human-readable
+// form.
+func leafDataSummary(ld *wire.LeafData) string {
+	return fmt.Sprintf("height %d, coinbase %v, amount %d, type %v, "+
+		"script %x", ld.Height, ld.IsCoinBase, ld.Amount,
+		ld.ReconstructablePkType, ld.PkScript)
+}
+
+// serializedProofDivergence is a ProofDivergence as it's saved to disk.
+type serializedProofDivergence struct {
+	Height int32    `json:"height"`
+	Hash   string   `json:"hash"`
+	Diff   []string `json:"diff"`
+}
+
+// serializedProofSourceStats are the statistics of a remote source as they're
+// saved to disk.
+type serializedProofSourceStats struct {
+	Name           string                     `json:"name"`
+	Agreements     uint64                     `json:"agreements"`
+	Divergences    uint64                     `json:"divergences"`
+	Failures       uint64                     `json:"failures"`
+	Skipped        uint64                     `json:"skipped"`
+	LastDivergence *serializedProofDivergence `json:"lastdivergence,omitempty"`
+}
+
+// serializedProofWatchdog are the statistics of a ProofWatchdog as they're
+// saved to disk.
+type serializedProofWatchdog struct {
+	Version int                          `json:"version"`
+	Sources []serializedProofSourceStats `json:"sources"`
+}
+
+// save writes the statistics to the StatsPath.  They're written to a temporary
+// file first so that a crash doesn't leave a partial file behind.
+//
+// This function is safe for concurrent access.
+func (w *ProofWatchdog) save() error {
+	if w.cfg.StatsPath == "" {
+		return nil
+	}
+
+	w.saveMtx.Lock()
+	defer w.saveMtx.Unlock()
+
+	ss := serializedProofWatchdog{Version: proofWatchdogVersion}
+	for _, stats := range w.Stats() {
+		s := serializedProofSourceStats{
+			Name:        stats.Name,
+			Agreements:  stats.Agreements,
+			Divergences: stats.Divergences,
+			Failures:    stats.Failures,
+			Skipped:     stats.Skipped,
+		}
+		if d := stats.LastDivergence; d != nil {
+			s.LastDivergence = &serializedProofDivergence{
+				Height: d.Height,
+				Hash:   d.Hash.String(),
+				Diff:   d.Diff,
+			}
+		}
+		ss.Sources = append(ss.Sources, s)
+	}
+
+	buf, err := json.Marshal(&ss)
+	if err != nil {
+		return err
+	}
+	tmpPath := w.cfg.StatsPath + ".tmp"
+	err = os.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, w.cfg.StatsPath)
+}
+
+// load reads the statistics back from the StatsPath.  Nothing is loaded if they
+// were never saved.  The statistics of sources that are no longer configured
+// are dropped.
+func (w *ProofWatchdog) load() error {
+	if w.cfg.StatsPath == "" {
+		return nil
+	}
+
+	buf, err := os.ReadFile(w.cfg.StatsPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var ss serializedProofWatchdog
+	err = json.Unmarshal(buf, &ss)
+	if err != nil {
+		return err
+	}
+	if ss.Version != proofWatchdogVersion {
+		return fmt.Errorf("unknown proof watchdog statistics version %d",
+			ss.Version)
+	}
+
+	saved := make(map[string]*serializedProofSourceStats, len(ss.Sources))
+	for i := range ss.Sources {
+		saved[ss.Sources[i].Name] = &ss.Sources[i]
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for _, ws := range w.sources {
+		s, ok := saved[ws.stats.Name]
+		if !ok {
+			continue
+		}
+		ws.stats.Agreements = s.Agreements
+		ws.stats.Divergences = s.Divergences
+		ws.stats.Failures = s.Failures
+		ws.stats.Skipped = s.Skipped
+		if d := s.LastDivergence; d != nil {
+			hash, err := chainhash.NewHashFromStr(d.Hash)
+			if err != nil {
+				return err
+			}
+			ws.stats.LastDivergence = &ProofDivergence{
+				Source: ws.stats.Name,
+				Height: d.Height,
+				Hash:   *hash,
+				Diff:   d.Diff,
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,386 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// testProofSource is a RemoteProofSource that serves the proofs of fetch.  It
+// fails to serve the first failures requests and the proofs of the heights in
+// corrupt are served with their first target changed.
+type testProofSource struct {
+	name  string
+	fetch func(int32) (*chainhash.Hash, *wire.UData, error)
+
+	mtx      sync.Mutex
+	failures int
+	corrupt  map[int32]bool
+}
+
+func (s *testProofSource) Name() string {
+	return s.name
+}
+
+func (s *testProofSource) FetchUtreexoProof(height int32) (
+	*chainhash.Hash, *wire.UData, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return nil, nil, errors.New("unavailable")
+	}
+
+	hash, ud, err := s.fetch(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.corrupt[height] {
+		ud = canonicalUData(ud, nil)
+		ud.AccProof.Targets[0]++
+	}
+
+	return hash, ud, nil
+}
+
+// testP2PKHScript is a pay-to-pubkey-hash script and is reconstructable.
+var testP2PKHScript = []byte{
+	0x76, 0xa9, 0x14, 0x7a, 0xc5, 0xcf, 0xe7, 0x78, 0xbc, 0x4e, 0x65,
+	0xd8, 0xfa, 0x86, 0xf8, 0x0c, 0xae, 0xb4, 0x7b, 0x1f, 0x63, 0x03,
+	0xa9, 0x88, 0xac,
+}
+
+// testUData returns made up utreexo data for the given height.  The leaf data
+// is given in the form it's served in with the full serialization.
+func testUData(height int32) (*chainhash.Hash, *wire.UData, error) {
+	hash := chainhash.Hash{byte(height)}
+	ud := &wire.UData{
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{uint64(height), uint64(height) + 3},
+			Proof:   []accumulator.Hash{{byte(height)}, {2}},
+		},
+		LeafDatas: []wire.LeafData{{
+			BlockHash: chainhash.Hash{9},
+			OutPoint:  wire.OutPoint{Hash: hash, Index: 1},
+			Amount:    int64(height) * 1000,
+			PkScript:  testP2PKHScript,
+			Height:    height - 1,
+		}},
+		RememberIdx: []uint32{0},
+	}
+
+	return &hash, ud, nil
+}
+
+// compactTestUData returns the utreexo data of testUData in the form it's
+// stored in by the indexes.
+func compactTestUData(height int32) (*chainhash.Hash, *wire.UData, error) {
+	hash, ud, err := testUData(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	ld := &ud.LeafDatas[0]
+	ld.BlockHash = chainhash.Hash{}
+	ld.OutPoint = wire.OutPoint{}
+	ld.ReconstructablePkType = wire.PubKeyHashTy
+	ld.PkScript = nil
+
+	return hash, ud, nil
+}
+
+func TestNextWatchdogBackoff(t *testing.T) {
+	min, max := time.Second, 10*time.Second
+	tests := []struct {
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{0, min},
+		{min, 2 * min},
+		{4 * min, 8 * min},
+		{8 * min, max},
+		{max, max},
+	}
+
+	for _, test := range tests {
+		got := nextWatchdogBackoff(test.backoff, min, max)
+		if got != test.want {
+			t.Fatalf("backoff %v: expected %v, got %v", test.backoff,
+				test.want, got)
+		}
+	}
+}
+
+func TestProofWatchdog(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "proofwatchdog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const numBlocks = 10
+	const corruptHeight = 7
+	honest := &testProofSource{name: "honest", fetch: testUData, failures: 2}
+	corrupt := &testProofSource{
+		name:    "corrupt",
+		fetch:   testUData,
+		corrupt: map[int32]bool{corruptHeight: true},
+	}
+
+	divergences := make(chan *ProofDivergence, numBlocks)
+	cfg := ProofWatchdogConfig{
+		Sources:     []RemoteProofSource{honest, corrupt},
+		FetchLocal:  compactTestUData,
+		BestHeight:  func() int32 { return numBlocks },
+		StatsPath:   filepath.Join(dir, "proofwatchdog.json"),
+		MinInterval: time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+		OnDivergence: func(d *ProofDivergence) {
+			divergences <- d
+		},
+	}
+	w, err := NewProofWatchdog(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Start()
+	for h := int32(1); h <= numBlocks; h++ {
+		w.BlockConnected(h)
+	}
+
+	// Wait for every block to be compared against both sources.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		done := true
+		for _, stats := range w.Stats() {
+			if stats.Agreements+stats.Divergences < numBlocks {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out with stats %+v", w.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	err = w.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the corrupted height of the corrupt source is reported.
+	close(divergences)
+	var reported []*ProofDivergence
+	for d := range divergences {
+		reported = append(reported, d)
+	}
+	if len(reported) != 1 {
+		t.Fatalf("expected 1 divergence, got %d", len(reported))
+	}
+	d := reported[0]
+	if d.Source != corrupt.name || d.Height != corruptHeight {
+		t.Fatalf("expected a divergence of %s at height %d, got %s at "+
+			"height %d", corrupt.name, corruptHeight, d.Source, d.Height)
+	}
+	wantDiff := fmt.Sprintf("target 0: local %d, remote %d", corruptHeight,
+		corruptHeight+1)
+	if len(d.Diff) != 1 || d.Diff[0] != wantDiff {
+		t.Fatalf("expected diff %q, got %q", wantDiff, d.Diff)
+	}
+
+	want := []ProofSourceStats{
+		{
+			Name:       honest.name,
+			Agreements: numBlocks,
+			Failures:   2,
+			Available:  true,
+		},
+		{
+			Name:           corrupt.name,
+			Agreements:     numBlocks - 1,
+			Divergences:    1,
+			Available:      true,
+			LastDivergence: d,
+		},
+	}
+	for i, stats := range w.Stats() {
+		if fmt.Sprint(stats) != fmt.Sprint(want[i]) {
+			t.Fatalf("expected stats %+v, got %+v", want[i], stats)
+		}
+	}
+
+	// The stats are loaded back apart from the availability, which is
+	// only known once the sources are requested again.
+	reloaded, err := NewProofWatchdog(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, stats := range reloaded.Stats() {
+		want[i].Available = false
+		if want[i].LastDivergence != nil {
+			if fmt.Sprint(*stats.LastDivergence) !=
+				fmt.Sprint(*want[i].LastDivergence) {
+
+				t.Fatalf("expected last divergence %+v, got %+v",
+					*want[i].LastDivergence, *stats.LastDivergence)
+			}
+			stats.LastDivergence = want[i].LastDivergence
+		}
+		if fmt.Sprint(stats) != fmt.Sprint(want[i]) {
+			t.Fatalf("expected reloaded stats %+v, got %+v", want[i], stats)
+		}
+	}
+}
+
+func TestProofWatchdogCheck(t *testing.T) {
+	t.Parallel()
+
+	source := &testProofSource{name: "source", fetch: testUData}
+	w, err := NewProofWatchdog(&ProofWatchdogConfig{
+		Sources:    []RemoteProofSource{source},
+		FetchLocal: compactTestUData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := w.sources[0]
+
+	// A source that fails to serve the proof is marked unavailable.
+	source.failures = 1
+	err = w.check(ws, 1)
+	if err == nil {
+		t.Fatal("expected the failed request to be returned")
+	}
+	if ws.stats.Failures != 1 || ws.stats.Available {
+		t.Fatalf("unexpected stats %+v", ws.stats)
+	}
+
+	// A source with another block at the height is skipped.
+	source.fetch = func(height int32) (*chainhash.Hash, *wire.UData, error) {
+		_, ud, err := testUData(height)
+		return &chainhash.Hash{0xff}, ud, err
+	}
+	err = w.check(ws, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.stats.Skipped != 1 || !ws.stats.Available {
+		t.Fatalf("unexpected stats %+v", ws.stats)
+	}
+
+	// Leaf datas that differ are reported field by field.
+	source.fetch = func(height int32) (*chainhash.Hash, *wire.UData, error) {
+		hash, ud, err := testUData(height)
+		ud.LeafDatas[0].Amount++
+		return hash, ud, err
+	}
+	err = w.check(ws, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.stats.Divergences != 1 || len(ws.stats.LastDivergence.Diff) != 1 {
+		t.Fatalf("unexpected stats %+v", ws.stats)
+	}
+
+	// Sources can't share a name.
+	_, err = NewProofWatchdog(&ProofWatchdogConfig{
+		Sources:    []RemoteProofSource{source, source},
+		FetchLocal: compactTestUData,
+	})
+	if err == nil {
+		t.Fatal("expected duplicate sources to be refused")
+	}
+}
+
+// TestProofWatchdogBridges audits a second bridge that serves the proofs of
+// the same chain from its own index, with the proof of one block corrupted.
+func TestProofWatchdogBridges(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain(
+		"TestProofWatchdogBridges", 1)
+	defer tearDown()
+
+	const numBlocks = 10
+	const corruptHeight = 5
+	var spends []*blockchain.SpendableOut
+	block := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < numBlocks; b++ {
+		block, spends = blockchain.AddBlock(chain, block, spends)
+	}
+
+	var flatIdx *FlatUtreexoProofIndex
+	var dbIdx *UtreexoProofIndex
+	for _, indexer := range indexes {
+		switch idx := indexer.(type) {
+		case *FlatUtreexoProofIndex:
+			flatIdx = idx
+		case *UtreexoProofIndex:
+			dbIdx = idx
+		}
+	}
+
+	fetchLocal := func(height int32) (*chainhash.Hash, *wire.UData, error) {
+		hash, err := chain.BlockHashByHeight(height)
+		if err != nil {
+			return nil, nil, err
+		}
+		ud, err := flatIdx.FetchUtreexoProof(height, false)
+		return hash, ud, err
+	}
+	remote := &testProofSource{
+		name: "bridge",
+		fetch: func(height int32) (*chainhash.Hash, *wire.UData, error) {
+			hash, err := chain.BlockHashByHeight(height)
+			if err != nil {
+				return nil, nil, err
+			}
+			ud, err := dbIdx.FetchUtreexoProof(hash)
+			return hash, ud, err
+		},
+		corrupt: map[int32]bool{corruptHeight: true},
+	}
+
+	w, err := NewProofWatchdog(&ProofWatchdogConfig{
+		Sources:    []RemoteProofSource{remote},
+		FetchLocal: fetchLocal,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := w.sources[0]
+	for h := int32(1); h <= numBlocks; h++ {
+		err := w.check(ws, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ws.stats.Agreements != numBlocks-1 || ws.stats.Divergences != 1 {
+		t.Fatalf("unexpected stats %+v", ws.stats)
+	}
+	if ws.stats.LastDivergence.Height != corruptHeight {
+		t.Fatalf("expected the divergence at height %d, got %d",
+			corruptHeight, ws.stats.LastDivergence.Height)
+	}
+}
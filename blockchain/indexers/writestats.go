@@ -0,0 +1,233 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"sync"
+
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// WriteStats are the bytes that a utreexo proof index wrote to storage to keep
+// the proofs and the undo blocks of the blocks it connected.
+type WriteStats struct {
+	// Blocks is the number of connected blocks the stats are for.
+	Blocks uint64
+
+	// LogicalBytes is the size of the serialized proofs and undo blocks.
+	LogicalBytes uint64
+
+	// WrittenBytes is the number of bytes written to storage to keep the
+	// proofs and the undo blocks, including what the index writes along
+	// with them such as offsets, headers, keys, and proof statistics.
+	WrittenBytes uint64
+
+	// Syncs is the number of times a file was synced to disk.
+	Syncs uint64
+}
+
+// Amplification returns the bytes written to storage per byte of proof and
+// undo data.  It's 0 if no proof or undo data was written.
+func (s WriteStats) Amplification() float64 {
+	if s.LogicalBytes == 0 {
+		return 0
+	}
+
+	return float64(s.WrittenBytes) / float64(s.LogicalBytes)
+}
+
+// add adds the stats of other to the WriteStats.
+func (s *WriteStats) add(other WriteStats) {
+	s.Blocks += other.Blocks
+	s.LogicalBytes += other.LogicalBytes
+	s.WrittenBytes += other.WrittenBytes
+	s.Syncs += other.Syncs
+}
+
+// IndexWriteStats are the write stats of a utreexo proof index since it was
+// started.
+type IndexWriteStats struct {
+	// Network is the name of the network of the index so that the stats
+	// of indexes of different networks run in one process are told apart.
+	Network string
+
+	// Shadow is whether the index is run as the shadow of another index.
+	// What a shadow index stores is only compared and never served.
+	Shadow bool
+
+	// Approximate is whether WrittenBytes is an estimate.  The flat files
+	// are written directly and are counted exactly.  The database only
+	// exposes the keys and the values that are put into it, so its
+	// journaling and compaction aren't counted.
+	Approximate bool
+
+	// LastHeight is the height of the last connected block.
+	LastHeight int32
+
+	// LastBlock are the write stats of the last connected block.
+	LastBlock WriteStats
+
+	// Total are the write stats of all the blocks connected since the
+	// index was started.
+	Total WriteStats
+
+	// FsyncPolicy is the fsync policy that the index is run with and
+	// RecordedFsyncPolicy is the one that was recorded for it when it was
+	// started.  The latter is empty if none was recorded.
+	FsyncPolicy         string
+	RecordedFsyncPolicy string
+
+	// Reads are the counts of the reads from the flat files that didn't
+	// return everything right away.  It's nil for the database index.
+	Reads *FlatReadStats
+
+	// DbRetries are the counts of the blocks that were connected again
+	// after a transient database error.  The flat index is never
+	// connected again as it writes to its flat files outside of the
+	// database transaction, so they're always zero for it.
+	DbRetries DbRetryStats
+
+	// LeafHashing are the counts of the leaves hashed on and off the
+	// template fast path.  The leaf hasher is shared by every index in the
+	// process so they're the same for all of them.
+	LeafHashing wire.LeafHasherStats
+
+	// Recovery is the progress of rebuilding the index from the entries
+	// of the other utreexo proof index on start up.  It's nil unless the
+	// index was rebuilt that way.
+	Recovery *IndexRecoveryStats
+
+	// MaxLeaves is the most leaves that the forest of the index can hold
+	// before the offsets into its storage overflow the ints of the
+	// platform, and LeafHeadroom is how many more leaves it can take.
+	MaxLeaves    uint64
+	LeafHeadroom uint64
+
+	// ProofCache are the counts of the fetches served from the proof cache
+	// of the index.  It's nil for the flat index.
+	ProofCache *ProofCacheStats
+}
+
+// writeStats keeps the write stats of a utreexo proof index.
+type writeStats struct {
+	mtx   sync.Mutex
+	stats IndexWriteStats
+}
+
+// record records the writes done to connect the block at the given height.
+//
+// This function is safe for concurrent access.
+func (w *writeStats) record(height int32, block WriteStats) {
+	block.Blocks = 1
+
+	w.mtx.Lock()
+	w.stats.LastHeight = height
+	w.stats.LastBlock = block
+	w.stats.Total.add(block)
+	w.mtx.Unlock()
+}
+
+// setShadow sets whether the index is run as a shadow.
+//
+// This function is safe for concurrent access.
+func (w *writeStats) setShadow(shadow bool) {
+	w.mtx.Lock()
+	w.stats.Shadow = shadow
+	w.mtx.Unlock()
+}
+
+// recordDbRetries records that connecting a block was attempted again the given
+// number of times after transient database errors.
+//
+// This function is safe for concurrent access.
+func (w *writeStats) recordDbRetries(retries int, connected bool) {
+	w.mtx.Lock()
+	w.stats.DbRetries.Retries += uint64(retries)
+	if connected {
+		w.stats.DbRetries.Recovered++
+	} else {
+		w.stats.DbRetries.Exhausted++
+	}
+	w.mtx.Unlock()
+}
+
+// snapshot returns the current write stats.
+//
+// This function is safe for concurrent access.
+func (w *writeStats) snapshot() IndexWriteStats {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.stats
+}
+
+// flatWriteStats returns the writes done to connect a block to the flat
+// utreexo proof index given the writes done to its flat files before and after.
+// stored are the writes to the proof and the undo flat files and all are the
+// writes to every flat file of the index.
+func flatWriteStats(storedBefore, allBefore, storedAfter,
+	allAfter flatFileWrites) WriteStats {
+
+	return WriteStats{
+		LogicalBytes: storedAfter.dataBytes - storedBefore.dataBytes,
+		WrittenBytes: allAfter.writtenBytes - allBefore.writtenBytes,
+		Syncs:        allAfter.syncs - allBefore.syncs,
+	}
+}
+
+// countingTx is a database transaction that counts the keys and the values
+// that are put into the buckets of its metadata.
+type countingTx struct {
+	database.Tx
+	counts *WriteStats
+}
+
+// Metadata returns the top-most bucket for all metadata storage with the puts
+// into it and its nested buckets counted.
+//
+// This is part of the database.Tx interface.
+func (tx *countingTx) Metadata() database.Bucket {
+	return &countingBucket{dbBucket: tx.Tx.Metadata(), counts: tx.counts}
+}
+
+// dbBucket lets countingBucket embed database.Bucket while overriding its
+// Bucket method.
+type dbBucket = database.Bucket
+
+// countingBucket is a database bucket that counts the keys and the values put
+// into it and its nested buckets.  The values are counted as the logical bytes
+// and the keys and the values as the written bytes.
+type countingBucket struct {
+	dbBucket
+	counts *WriteStats
+}
+
+// Bucket returns the nested bucket with the given key with the puts into it
+// counted.  nil is returned if the bucket doesn't exist.
+//
+// This is part of the database.Bucket interface.
+func (b *countingBucket) Bucket(key []byte) database.Bucket {
+	bucket := b.dbBucket.Bucket(key)
+	if bucket == nil {
+		return nil
+	}
+
+	return &countingBucket{dbBucket: bucket, counts: b.counts}
+}
+
+// Put saves the key/value pair to the bucket and counts their bytes.
+//
+// This is part of the database.Bucket interface.
+func (b *countingBucket) Put(key, value []byte) error {
+	err := b.dbBucket.Put(key, value)
+	if err != nil {
+		return err
+	}
+
+	b.counts.LogicalBytes += uint64(len(value))
+	b.counts.WrittenBytes += uint64(len(key) + len(value))
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package indexers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/database"
+)
+
+func TestWriteStatsAmplification(t *testing.T) {
+	tests := []struct {
+		stats WriteStats
+		want  float64
+	}{
+		{WriteStats{}, 0},
+		{WriteStats{WrittenBytes: 16}, 0},
+		{WriteStats{LogicalBytes: 100, WrittenBytes: 150}, 1.5},
+		{WriteStats{LogicalBytes: 200, WrittenBytes: 100}, 0.5},
+	}
+
+	for _, test := range tests {
+		got := test.stats.Amplification()
+		if got != test.want {
+			t.Fatalf("%+v: expected %v, got %v", test.stats, test.want, got)
+		}
+	}
+}
+
+func TestIndexWriteStats(t *testing.T) {
+	// Always remove the root on return.
+	defer os.RemoveAll(testDbRoot)
+
+	chain, indexes, params, tearDown := indexersTestChain("TestIndexWriteStats", 1)
+	defer tearDown()
+
+	const numBlocks = 10
+	var spends []*blockchain.SpendableOut
+	block := btcutil.NewBlock(params.GenesisBlock)
+	for b := 0; b < numBlocks; b++ {
+		block, spends = blockchain.AddBlock(chain, block, spends)
+	}
+
+	for _, indexer := range indexes {
+		switch idx := indexer.(type) {
+		case *FlatUtreexoProofIndex:
+			// The logical bytes are exactly the proofs and the undo
+			// blocks that were stored and every flat file entry
+			// adds 16 bytes of offset, magic, and size.  No remember
+			// indexes are stored with a proof interval of 1 and the
+			// proof stats are rewritten in place for every block.
+			var want WriteStats
+			for h := int32(1); h <= numBlocks; h++ {
+				for _, ff := range []*FlatFileState{&idx.proofState,
+					&idx.undoState} {
+
+					data, err := ff.FetchData(h)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want.LogicalBytes += uint64(len(data))
+					want.WrittenBytes += uint64(len(data)) + 8 +
+						flatOffsetRecordSize
+				}
+				want.WrittenBytes += uint64(proofStatsSize)
+			}
+
+			stats := idx.Stats()
+			if stats.Approximate {
+				t.Fatal("expected the flat index stats to be exact")
+			}
+			if stats.LastHeight != numBlocks {
+				t.Fatalf("expected last height %d, got %d",
+					numBlocks, stats.LastHeight)
+			}
+			if stats.Total.Blocks != numBlocks {
+				t.Fatalf("expected %d blocks, got %d", numBlocks,
+					stats.Total.Blocks)
+			}
+			if stats.Total.LogicalBytes != want.LogicalBytes ||
+				stats.Total.WrittenBytes != want.WrittenBytes {
+
+				t.Fatalf("expected %d logical and %d written bytes, "+
+					"got %d and %d", want.LogicalBytes,
+					want.WrittenBytes, stats.Total.LogicalBytes,
+					stats.Total.WrittenBytes)
+			}
+
+			// All four flat files are synced for every block.
+			if stats.Total.Syncs != numBlocks*8 {
+				t.Fatalf("expected %d syncs, got %d", numBlocks*8,
+					stats.Total.Syncs)
+			}
+			if stats.Total.Amplification() != float64(want.WrittenBytes)/
+				float64(want.LogicalBytes) {
+
+				t.Fatalf("unexpected amplification %v",
+					stats.Total.Amplification())
+			}
+
+		case *UtreexoProofIndex:
+			// The values put are the proofs and the undo blocks and
+			// they're keyed by the block hash.
+			var want WriteStats
+			err := idx.db.View(func(dbTx database.Tx) error {
+				for h := int32(1); h <= numBlocks; h++ {
+					block, err := chain.BlockByHeight(h)
+					if err != nil {
+						return err
+					}
+					proof, err := dbFetchUtreexoProofEntry(dbTx, block.Hash())
+					if err != nil {
+						return err
+					}
+					undo, err := dbFetchUndoBlockEntry(dbTx, block.Hash())
+					if err != nil {
+						return err
+					}
+					size := uint64(len(proof) + len(undo))
+					want.LogicalBytes += size
+					want.WrittenBytes += size + 2*uint64(len(block.Hash()))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats := idx.Stats()
+			if !stats.Approximate {
+				t.Fatal("expected the database index stats to be " +
+					"approximate")
+			}
+			if stats.Total.Blocks != numBlocks ||
+				stats.Total.LogicalBytes != want.LogicalBytes ||
+				stats.Total.WrittenBytes != want.WrittenBytes {
+
+				t.Fatalf("expected %d blocks, %d logical, and %d "+
+					"written bytes, got %+v", numBlocks,
+					want.LogicalBytes, want.WrittenBytes, stats.Total)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/txscript"
+)
+
+// LeafEligibilityVersion is the version of the rule deciding which outputs
+// become leaves of the utreexo accumulator.  Any change to which outputs are
+// eligible must bump it since accumulators built under different versions
+// aren't compatible.
+const LeafEligibilityVersion uint32 = 1
+
+// LeafEligibility is the decision of whether an output becomes a leaf of the
+// utreexo accumulator, along with why it doesn't if it doesn't.
+//
+// The decision is made by matching the public key script against fixed
+// patterns only.  It must never depend on executing any part of the script or
+// on the script verification flags since a node that skips the script checks
+// of old blocks, like one synced from a checkpoint, would then disagree with a
+// fully verifying node about the leaves and build an incompatible
+// accumulator.  An output that's unspendable only once part of its script is
+// executed, like one with an OP_RETURN buried in a branch, is a leaf.
+type LeafEligibility uint8
+
+const (
+	// LeafEligible is an output that becomes a leaf.
+	LeafEligible LeafEligibility = iota
+
+	// LeafNullData is an output whose public key script starts with
+	// OP_RETURN.
+	LeafNullData
+
+	// LeafOversized is an output whose public key script is over the
+	// maximum script size.
+	LeafOversized
+)
+
+// String returns the LeafEligibility in human-readable form.
+func (e LeafEligibility) String() string {
+	switch e {
+	case LeafEligible:
+		return "eligible"
+	case LeafNullData:
+		return "null data"
+	case LeafOversized:
+		return "oversized"
+	}
+
+	return fmt.Sprintf("unknown leaf eligibility (%d)", uint8(e))
+}
+
+// ExecutionDependent returns whether the decision depended on anything other
+// than the static patterns of the public key script.  None of the decisions of
+// the current version do.  Any other decision breaks the invariant that nodes
+// that skip script checks and nodes that don't agree on the leaves.
+func (e LeafEligibility) ExecutionDependent() bool {
+	switch e {
+	case LeafEligible, LeafNullData, LeafOversized:
+		return false
+	}
+
+	return true
+}
+
+// CheckLeafEligibility returns whether an output with the public key script
+// becomes a leaf of the utreexo accumulator.  An empty script is eligible and
+// so is one that doesn't parse, as parsing it doesn't decide anything here.
+func CheckLeafEligibility(pkScript []byte) LeafEligibility {
+	switch {
+	case len(pkScript) > txscript.MaxScriptSize:
+		return LeafOversized
+	case len(pkScript) > 0 && pkScript[0] == txscript.OP_RETURN:
+		return LeafNullData
+	default:
+		return LeafEligible
+	}
+}
+
+// BlockEligibility summarizes the leaf eligibility decisions made for the
+// outputs of a block.
+type BlockEligibility struct {
+	// Version is the leaf eligibility version the decisions were made
+	// under.
+	Version uint32
+
+	// Ineligible is the number of outputs that didn't become leaves.
+	Ineligible uint32
+
+	// ExecutionDependent is the number of decisions that depended on
+	// more than the static patterns of the public key scripts.  It's
+	// always 0 unless the invariant is broken.
+	ExecutionDependent uint32
+}
+
+// BlockLeafEligibility returns the summary of the leaf eligibility decisions
+// made for the outputs of the block.
+func BlockLeafEligibility(block *btcutil.Block) BlockEligibility {
+	summary := BlockEligibility{Version: LeafEligibilityVersion}
+	for _, tx := range block.Transactions() {
+		for _, txOut := range tx.MsgTx().TxOut {
+			eligibility := CheckLeafEligibility(txOut.PkScript)
+			if eligibility != LeafEligible {
+				summary.Ineligible++
+			}
+			if eligibility.ExecutionDependent() {
+				summary.ExecutionDependent++
+			}
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestCheckLeafEligibility ensures that leaf eligibility is decided by the
+// static patterns of the public key scripts alone so that outputs that are
+// unspendable only once their scripts are executed still become leaves.
+func TestCheckLeafEligibility(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		pkScript []byte
+		want     LeafEligibility
+	}{
+		{
+			name: "empty",
+			want: LeafEligible,
+		},
+		{
+			name:     "op true",
+			pkScript: []byte{txscript.OP_TRUE},
+			want:     LeafEligible,
+		},
+		{
+			name:     "bare op return",
+			pkScript: []byte{txscript.OP_RETURN},
+			want:     LeafNullData,
+		},
+		{
+			name: "op return with data",
+			pkScript: []byte{txscript.OP_RETURN, txscript.OP_DATA_2,
+				0xbe, 0xef},
+			want: LeafNullData,
+		},
+		{
+			name: "op return in a taken branch",
+			pkScript: []byte{txscript.OP_TRUE, txscript.OP_IF,
+				txscript.OP_RETURN, txscript.OP_ENDIF},
+			want: LeafEligible,
+		},
+		{
+			name: "op return in a skipped branch",
+			pkScript: []byte{txscript.OP_FALSE, txscript.OP_IF,
+				txscript.OP_RETURN, txscript.OP_ENDIF, txscript.OP_TRUE},
+			want: LeafEligible,
+		},
+		{
+			name:     "op return pushed as data",
+			pkScript: []byte{txscript.OP_DATA_1, txscript.OP_RETURN},
+			want:     LeafEligible,
+		},
+		{
+			name:     "unparseable",
+			pkScript: []byte{txscript.OP_PUSHDATA1},
+			want:     LeafEligible,
+		},
+		{
+			name:     "max size",
+			pkScript: bytes.Repeat([]byte{txscript.OP_TRUE}, txscript.MaxScriptSize),
+			want:     LeafEligible,
+		},
+		{
+			name:     "oversized",
+			pkScript: bytes.Repeat([]byte{txscript.OP_TRUE}, txscript.MaxScriptSize+1),
+			want:     LeafOversized,
+		},
+	}
+
+	for _, test := range tests {
+		got := CheckLeafEligibility(test.pkScript)
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		if got.ExecutionDependent() {
+			t.Errorf("%s: %v is execution dependent", test.name, got)
+		}
+		unspendable := IsUnspendable(wire.NewTxOut(0, test.pkScript))
+		if unspendable != (test.want != LeafEligible) {
+			t.Errorf("%s: IsUnspendable returned %v for %v",
+				test.name, unspendable, test.want)
+		}
+	}
+
+	// Decisions the rule doesn't know of are treated as execution
+	// dependent.
+	if !LeafEligibility(255).ExecutionDependent() {
+		t.Errorf("unknown leaf eligibility isn't execution dependent")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
 	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/wire"
 )
 
 // BehaviorFlags is a bitmask defining tweaks to the normal behavior when
@@ -29,6 +30,13 @@ const (
 	// not be performed.
 	BFNoPoWCheck
 
+	// BFCheckUDataCommitment may be set to indicate that the leaves of the
+	// utreexo data attached to the block must be checked against the
+	// inputs of the transactions the block's merkle root commits to.  This
+	// catches a bridge that supplies a valid accumulator proof for leaves
+	// of a different block.
+	BFCheckUDataCommitment
+
 	// BFNone is a convenience value to specifically indicate no flags.
 	BFNone BehaviorFlags = 0
 )
@@ -76,16 +84,19 @@ func (b *BlockChain) blockExists(hash *chainhash.Hash) (bool, error) {
 // It repeats the process for the newly accepted blocks (to detect further
 // orphans which may no longer be orphans) until there are no more.
 //
-// The flags do not modify the behavior of this function directly, however they
-// are needed to pass along to maybeAcceptBlock.
+// Each orphan is accepted with the flags it was processed with when it was
+// added to the orphan pool.  An orphan that fails to be accepted is dropped
+// and the other orphans are still processed.  The first of the failures is
+// returned once all of them are.
 //
 // This function MUST be called with the chain state lock held (for writes).
-func (b *BlockChain) processOrphans(hash *chainhash.Hash, flags BehaviorFlags) error {
+func (b *BlockChain) processOrphans(hash *chainhash.Hash) error {
 	// Start with processing at least the passed hash.  Leave a little room
 	// for additional orphan blocks that need to be processed without
 	// needing to grow the array in the common case.
 	processHashes := make([]*chainhash.Hash, 0, 10)
 	processHashes = append(processHashes, hash)
+	var firstErr error
 	for len(processHashes) > 0 {
 		// Pop the first hash to process from the slice.
 		processHash := processHashes[0]
@@ -114,10 +125,14 @@ func (b *BlockChain) processOrphans(hash *chainhash.Hash, flags BehaviorFlags) e
 			b.removeOrphanBlock(orphan)
 			i--
 
-			// Potentially accept the block into the block chain.
-			_, err := b.maybeAcceptBlock(orphan.block, flags)
+			err := b.acceptOrphan(orphan, processHash)
 			if err != nil {
-				return err
+				log.Debugf("Rejected orphan block %v: %v",
+					orphanHash, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
 			}
 
 			// Add this block to the list of blocks to process so
@@ -126,7 +141,27 @@ func (b *BlockChain) processOrphans(hash *chainhash.Hash, flags BehaviorFlags) e
 			processHashes = append(processHashes, orphanHash)
 		}
 	}
-	return nil
+	return firstErr
+}
+
+// acceptOrphan potentially accepts the orphan, whose parent has the given hash,
+// into the block chain with the flags it was processed with.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) acceptOrphan(orphan *orphanBlock, prevHash *chainhash.Hash) error {
+	// Make sure that the leaves of the utreexo data of the orphan are the
+	// ones it spends if requested.  They couldn't be checked without its
+	// parent.
+	if orphan.flags&BFCheckUDataCommitment == BFCheckUDataCommitment {
+		prevNode := b.index.LookupNode(prevHash)
+		err := checkUDataCommitment(orphan.block, prevNode, b.index)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := b.maybeAcceptBlock(orphan.block, orphan.flags)
+	return err
 }
 
 // ProcessBlock is the main workhorse for handling insertion of new blocks into
@@ -143,6 +178,45 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, flags BehaviorFlags) (bo
 	b.chainLock.Lock()
 	defer b.chainLock.Unlock()
 
+	return b.processBlock(block, flags)
+}
+
+// ProcessBlockWithUData is ProcessBlock for a block whose utreexo data is
+// supplied separately from the block, like when the block and its proof are
+// fetched from different sources.  The passed in block isn't modified, the
+// utreexo data is attached to a copy of it instead, so the block may be shared
+// with other goroutines.
+//
+// The leaves of the utreexo data are always checked against the outpoints the
+// block spends, as with BFCheckUDataCommitment, before the accumulator is
+// touched.  The leaves of an orphan block are checked once its parent is
+// accepted.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) ProcessBlockWithUData(block *btcutil.Block, ud *wire.UData,
+	flags BehaviorFlags) (bool, bool, error) {
+
+	if ud == nil {
+		str := fmt.Sprintf("no utreexo data was supplied for block %v",
+			block.Hash())
+		return false, false, ruleError(ErrUDataCommitmentMismatch, str)
+	}
+
+	msgBlock := *block.MsgBlock()
+	msgBlock.UData = ud
+	udBlock := btcutil.NewBlock(&msgBlock)
+	udBlock.SetHeight(block.Height())
+
+	b.chainLock.Lock()
+	defer b.chainLock.Unlock()
+
+	return b.processBlock(udBlock, flags|BFCheckUDataCommitment)
+}
+
+// processBlock is the body of ProcessBlock.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) processBlock(block *btcutil.Block, flags BehaviorFlags) (bool, bool, error) {
 	fastAdd := flags&BFFastAdd == BFFastAdd
 
 	blockHash := block.Hash()
@@ -218,11 +292,21 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, flags BehaviorFlags) (bo
 	}
 	if !prevHashExists {
 		log.Infof("Adding orphan block %v with parent %v", blockHash, prevHash)
-		b.addOrphanBlock(block)
+		b.addOrphanBlock(block, flags)
 
 		return false, true, nil
 	}
 
+	// Make sure that the leaves of the utreexo data are the ones the block
+	// spends if requested.
+	if flags&BFCheckUDataCommitment == BFCheckUDataCommitment {
+		prevNode := b.index.LookupNode(prevHash)
+		err = checkUDataCommitment(block, prevNode, b.index)
+		if err != nil {
+			return false, false, err
+		}
+	}
+
 	// The block has passed all context independent checks and appears sane
 	// enough to potentially accept it into the block chain.
 	isMainChain, err := b.maybeAcceptBlock(block, flags)
@@ -233,7 +317,7 @@ func (b *BlockChain) ProcessBlock(block *btcutil.Block, flags BehaviorFlags) (bo
 	// Accept any orphan blocks that depend on this block (they are
 	// no longer orphans) and repeat for those accepted blocks until
 	// there are no more.
-	err = b.processOrphans(blockHash, flags)
+	err = b.processOrphans(blockHash)
 	if err != nil {
 		return false, false, err
 	}
@@ -0,0 +1,255 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+)
+
+// relayHashByHeight returns a function that looks up the hashes of the
+// ancestors of the given block node by their height.  The main chain is used
+// up to the point the node forks off of it so that only the blocks of a side
+// chain are walked to.
+func (b *BlockChain) relayHashByHeight(node *blockNode) func(int32) (*chainhash.Hash, error) {
+	fork := b.bestChain.FindFork(node)
+	return func(height int32) (*chainhash.Hash, error) {
+		var ancestor *blockNode
+		if fork != nil && height <= fork.height {
+			ancestor = b.bestChain.NodeByHeight(height)
+		} else {
+			ancestor = node.Ancestor(height)
+		}
+		if ancestor == nil {
+			return nil, fmt.Errorf("block %v has no ancestor at "+
+				"height %d", node.hash, height)
+		}
+		return &ancestor.hash, nil
+	}
+}
+
+// fetchRelayView returns the accumulator of the verifying relay after the block
+// with the given hash, as it was stored when the block was accepted.  It's
+// only made of the roots.
+func (b *BlockChain) fetchRelayView(hash *chainhash.Hash) (*UtreexoViewpoint, error) {
+	var view *UtreexoViewpoint
+	err := b.db.View(func(dbTx database.Tx) error {
+		var err error
+		view, err = dbFetchUtreexoView(dbTx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if view == nil {
+		return nil, fmt.Errorf("no utreexo accumulator of the verifying "+
+			"relay is stored for block %v", hash)
+	}
+
+	return view, nil
+}
+
+// acceptRelayUData checks the utreexo data attached to a block against the
+// accumulator of the verifying relay after the block's parent, which needn't be
+// on the main chain, and returns the accumulator after the block.  It's checked
+// before the block is stored so that a block that's refused for its utreexo data
+// can still be accepted with valid utreexo data from another peer.
+//
+// The accumulator after every accepted block is stored so that it's only
+// looked up when the block is connected or disconnected, including during a
+// reorg, rather than rebuilt.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) acceptRelayUData(block *btcutil.Block, prevNode *blockNode) (
+	*UtreexoViewpoint, error) {
+
+	ud := block.MsgBlock().UData
+	if ud == nil {
+		str := fmt.Sprintf("block %v came without the utreexo data that "+
+			"the verifying relay needs to update its accumulator",
+			block.Hash())
+		return nil, ruleError(ErrUDataMissing, str)
+	}
+
+	view, err := b.fetchRelayView(&prevNode.hash)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := b.chainParams.LeafCommitments
+	delHashes, err := ReconstructUData(ud, block, b.relayHashByHeight(prevNode),
+		schedule, b.leafHasher)
+	if err != nil {
+		str := fmt.Sprintf("the utreexo data of block %v is malformed: %v",
+			block.Hash(), err)
+		return nil, ruleError(ErrUDataInvalid, str)
+	}
+
+	err = view.IngestProof(false, delHashes, &ud.AccProof)
+	if err != nil {
+		str := fmt.Sprintf("the utreexo proof of block %v doesn't "+
+			"verify: %v", block.Hash(), err)
+		return nil, ruleError(ErrUDataInvalid, str)
+	}
+
+	_, outCount, _, outskip := DedupeBlock(block)
+	adds := BlockToAddLeaves(block, outskip, nil, outCount, schedule,
+		b.leafHasher)
+	err = view.Modify(ud, adds)
+	if err != nil {
+		str := fmt.Sprintf("the utreexo proof of block %v doesn't "+
+			"delete its leaves: %v", block.Hash(), err)
+		return nil, ruleError(ErrUDataInvalid, str)
+	}
+
+	return view, nil
+}
+
+// loadRelayView loads the accumulator of the verifying relay at the end of the
+// main chain.  It's built from the blocks and the spend journal the first time
+// the chain is loaded as a verifying relay.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) loadRelayView() error {
+	tip := b.bestChain.Tip()
+	var view *UtreexoViewpoint
+	err := b.db.Update(func(dbTx database.Tx) error {
+		_, err := dbTx.Metadata().CreateBucketIfNotExists(
+			utreexoStateBucketName)
+		if err != nil {
+			return err
+		}
+
+		view, err = dbFetchUtreexoView(dbTx, &tip.hash)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if view == nil {
+		return b.buildRelayView()
+	}
+
+	b.relayView = view
+	return nil
+}
+
+// buildRelayView builds the accumulator of the verifying relay from the blocks
+// of the main chain and the outputs they spent, storing it after every block.
+// The pruned accumulator can't delete the leaves spent by a block without the
+// proof of the block, so it's built with a full one that remembers every leaf
+// and finds their positions the same way the utreexo proof indexes do for the
+// proofs.  Only the roots are kept afterwards.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) buildRelayView() error {
+	tip := b.bestChain.Tip()
+	log.Infof("Building the utreexo accumulator of the verifying relay "+
+		"up to height %d", tip.height)
+
+	pollard := accumulator.NewFullPollard()
+	view := &UtreexoViewpoint{
+		proofInterval: 1,
+		accumulator:   &pollard,
+	}
+	err := b.db.Update(func(dbTx database.Tx) error {
+		return dbPutUtreexoView(dbTx, view, &b.bestChain.Genesis().hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	schedule := b.chainParams.LeafCommitments
+	for height := int32(1); height <= tip.height; height++ {
+		node := b.bestChain.NodeByHeight(height)
+
+		var block *btcutil.Block
+		var stxos []SpentTxOut
+		err := b.db.View(func(dbTx database.Tx) error {
+			var err error
+			block, err = dbFetchBlockByNode(dbTx, node)
+			if err != nil {
+				return err
+			}
+			stxos, err = dbFetchSpendJournalEntry(dbTx, block)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		_, outCount, inskip, outskip := DedupeBlock(block)
+		delLeaves, _, err := BlockToDelLeaves(stxos, b, block, inskip, -1)
+		if err != nil {
+			return err
+		}
+		delHashes := make([]accumulator.Hash, len(delLeaves))
+		for i := range delLeaves {
+			delHashes[i] = b.leafHasher.ScheduledLeafHash(&delLeaves[i],
+				schedule)
+		}
+
+		// ProveBatch doesn't delete anything from an accumulator of
+		// less than two leaves, the same as the proofs of the utreexo
+		// proof indexes.
+		proof, err := pollard.ProveBatch(delHashes)
+		if err != nil {
+			return fmt.Errorf("unable to build the utreexo accumulator "+
+				"of the verifying relay at height %d: %v", height, err)
+		}
+		adds := BlockToAddLeaves(block, outskip, nil, outCount, schedule,
+			b.leafHasher)
+		for i := range adds {
+			adds[i].Remember = true
+		}
+		err = pollard.Modify(adds, proof.Targets)
+		if err != nil {
+			return fmt.Errorf("unable to build the utreexo accumulator "+
+				"of the verifying relay at height %d: %v", height, err)
+		}
+
+		err = b.db.Update(func(dbTx database.Tx) error {
+			return dbPutUtreexoView(dbTx, view, &node.hash)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	relayView, err := b.fetchRelayView(&tip.hash)
+	if err != nil {
+		return err
+	}
+	b.relayView = relayView
+
+	return nil
+}
+
+// NeedsUData returns whether the blocks must come with their utreexo data to be
+// accepted, which is the case for a utreexo node and a verifying relay.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) NeedsUData() bool {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	return b.utreexoView != nil || b.relayView != nil
+}
+
+// GetUtreexoRelayView returns the utreexo viewpoint of the verifying relay at
+// the end of the main chain or nil if the chain isn't a verifying relay.  It's
+// only made of the roots of the accumulator.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) GetUtreexoRelayView() *UtreexoViewpoint {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	return b.relayView
+}
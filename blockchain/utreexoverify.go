@@ -0,0 +1,197 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// treeProof is the part of an accumulator proof that proves the leaves in one
+// of the trees of the accumulator.
+type treeProof struct {
+	delHashes []accumulator.Hash
+	proof     accumulator.BatchProof
+}
+
+// forestRows returns the number of rows of the forest of an accumulator with
+// the given number of leaves.  It matches the rows the accumulator library
+// lays out the positions of its nodes with.
+func forestRows(numLeaves uint64) uint8 {
+	if numLeaves <= 1 {
+		return 0
+	}
+	return uint8(bits.Len64(numLeaves - 1))
+}
+
+// leafTree returns the index of the tree that the leaf at the given position is
+// in.  The trees are ordered from the biggest to the smallest, the same as the
+// roots of the accumulator.
+func leafTree(pos, numLeaves uint64) int {
+	var tree int
+	var start uint64
+	for row := 63; row >= 0; row-- {
+		size := uint64(1) << uint(row)
+		if numLeaves&size == 0 {
+			continue
+		}
+		if pos < start+size {
+			break
+		}
+		start += size
+		tree++
+	}
+
+	return tree
+}
+
+// splitProof splits the accumulator proof of the given leaves into the proofs
+// of the leaves in each tree of the accumulator.  Since the trees don't share
+// any nodes, the proof of a tree holds exactly the hashes of the proof that are
+// in that tree, and the proofs of all the trees verify if and only if the whole
+// proof does.
+//
+// False is returned if the proof can't be split, like when it doesn't have
+// a hash for each of its positions or it proves the same leaf twice.  The
+// proof is then left to be verified all at once, which refuses it the same way
+// it would be refused otherwise.
+func splitProof(delHashes []accumulator.Hash, accProof *accumulator.BatchProof,
+	numLeaves uint64) ([]treeProof, bool) {
+
+	if len(accProof.Targets) != len(delHashes) {
+		return nil, false
+	}
+
+	// The proof positions are laid out in the order of the targets.
+	order := make([]int, len(accProof.Targets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return accProof.Targets[order[i]] < accProof.Targets[order[j]]
+	})
+	targets := make([]uint64, len(order))
+	hashes := make([]accumulator.Hash, len(order))
+	for i, idx := range order {
+		targets[i] = accProof.Targets[idx]
+		hashes[i] = delHashes[idx]
+		if targets[i] >= numLeaves || (i > 0 && targets[i] == targets[i-1]) {
+			return nil, false
+		}
+	}
+
+	rows := forestRows(numLeaves)
+	var positions []uint64
+	accumulator.ProofPositions(targets, numLeaves, rows, &positions)
+	if len(positions) != len(accProof.Proof) {
+		return nil, false
+	}
+	proofHashes := make(map[uint64]accumulator.Hash, len(positions))
+	for i, pos := range positions {
+		proofHashes[pos] = accProof.Proof[i]
+	}
+
+	var trees []treeProof
+	var proofCount int
+	for start := 0; start < len(targets); {
+		tree := leafTree(targets[start], numLeaves)
+		end := start + 1
+		for end < len(targets) && leafTree(targets[end], numLeaves) == tree {
+			end++
+		}
+
+		var treePositions []uint64
+		accumulator.ProofPositions(targets[start:end], numLeaves, rows,
+			&treePositions)
+		treeHashes := make([]accumulator.Hash, len(treePositions))
+		for i, pos := range treePositions {
+			hash, ok := proofHashes[pos]
+			if !ok {
+				return nil, false
+			}
+			treeHashes[i] = hash
+		}
+		proofCount += len(treeHashes)
+
+		trees = append(trees, treeProof{
+			delHashes: hashes[start:end],
+			proof: accumulator.BatchProof{
+				Targets: targets[start:end],
+				Proof:   treeHashes,
+			},
+		})
+		start = end
+	}
+	if proofCount != len(accProof.Proof) {
+		return nil, false
+	}
+
+	return trees, true
+}
+
+// runTreeProofs calls f on every tree proof with the given number of
+// goroutines and returns the first error by the order of the trees.
+func runTreeProofs(workers int, trees []treeProof, f func(*treeProof) error) error {
+	if workers > len(trees) {
+		workers = len(trees)
+	}
+
+	next := make(chan int, len(trees))
+	for i := range trees {
+		next <- i
+	}
+	close(next)
+
+	errs := make([]error, len(trees))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range next {
+				errs[idx] = f(&trees[idx])
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ingestProofParallel verifies and ingests the accumulator proof of the given
+// leaves split by the trees of the accumulator, with the trees spread over the
+// proof workers of the viewpoint.  Each tree is verified only once, by its own
+// ingest.  A proof that doesn't verify leaves the roots of the accumulator as
+// they were, though the trees that did verify keep the nodes of their proofs
+// cached.  Those are the same nodes that the valid proof of the leaves caches.
+// The accumulator ends up the same as when a valid proof is ingested all at
+// once.
+//
+// This function is NOT safe for concurrent access.
+func (uview *UtreexoViewpoint) ingestProofParallel(rememberAll bool,
+	delHashes []accumulator.Hash, accProof *accumulator.BatchProof) error {
+
+	trees, ok := splitProof(delHashes, accProof, uview.accumulator.NumLeaves())
+	if !ok || len(trees) < 2 {
+		return uview.accumulator.IngestBatchProof(delHashes, *accProof,
+			rememberAll)
+	}
+
+	// The trees only read and write the nodes of their own tree in the
+	// accumulator, so they can be ingested at the same time.
+	return runTreeProofs(uview.proofWorkers, trees, func(tp *treeProof) error {
+		return uview.accumulator.IngestBatchProof(tp.delHashes, tp.proof,
+			rememberAll)
+	})
+}
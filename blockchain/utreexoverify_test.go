@@ -0,0 +1,217 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+)
+
+// verifyTestLeaves returns count leaves with hashes that no other call with a
+// different start makes.
+func verifyTestLeaves(start, count int) []accumulator.Leaf {
+	leaves := make([]accumulator.Leaf, count)
+	for i := range leaves {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], uint64(start+i))
+		leaves[i] = accumulator.Leaf{Hash: sha256.Sum256(buf[:])}
+	}
+
+	return leaves
+}
+
+// TestProofWorkers ensures that a viewpoint that verifies the accumulator
+// proofs with several workers accepts and refuses the same proofs as one that
+// verifies them all at once and that their roots stay the same.
+func TestProofWorkers(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// The full pollard remembers every leaf to make the proofs with.
+	full := accumulator.NewFullPollard()
+	serial := NewUtreexoViewpoint(0)
+	parallel := NewUtreexoViewpoint(4)
+
+	var live []accumulator.Hash
+	var next int
+	modify := func(adds []accumulator.Leaf, dels []uint64) {
+		t.Helper()
+
+		remembered := make([]accumulator.Leaf, len(adds))
+		for i := range adds {
+			remembered[i] = adds[i]
+			remembered[i].Remember = true
+		}
+		err := full.Modify(remembered, dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, uview := range []*UtreexoViewpoint{serial, parallel} {
+			err = uview.accumulator.Modify(adds, dels)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, add := range adds {
+			live = append(live, add.Hash)
+		}
+		next += len(adds)
+	}
+	modify(verifyTestLeaves(next, 1000), nil)
+
+	// ingest ingests the proof into both viewpoints and checks that they
+	// agree.  The trees of a proof that doesn't verify may leave the nodes
+	// of their own proofs cached in the parallel viewpoint, so only the
+	// roots are compared then.
+	ingest := func(dels []accumulator.Hash, proof accumulator.BatchProof) error {
+		t.Helper()
+
+		serialErr := serial.IngestProof(false, dels, &proof)
+		parallelErr := parallel.IngestProof(false, dels, &proof)
+		if (serialErr == nil) != (parallelErr == nil) {
+			t.Fatalf("the serial ingest returned %v but the parallel "+
+				"one returned %v", serialErr, parallelErr)
+		}
+		if !reflect.DeepEqual(serial.accumulator.GetRoots(),
+			parallel.accumulator.GetRoots()) {
+
+			t.Fatal("the roots of the viewpoints differ")
+		}
+		if serialErr == nil &&
+			serial.PrintRemembers() != parallel.PrintRemembers() {
+
+			t.Fatalf("the accumulators differ after the ingest:\n%s\n%s",
+				serial.PrintRemembers(), parallel.PrintRemembers())
+		}
+
+		return serialErr
+	}
+
+	var split int
+	for round := 0; round < 20; round++ {
+		// Spend some leaves spread over every tree.
+		rng.Shuffle(len(live), func(i, j int) {
+			live[i], live[j] = live[j], live[i]
+		})
+		count := 1 + rng.Intn(40)
+		dels := append([]accumulator.Hash(nil), live[:count]...)
+		proof, err := full.ProveBatch(dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees, ok := splitProof(dels, &proof, full.NumLeaves())
+		if !ok {
+			t.Fatalf("round %d: the proof couldn't be split", round)
+		}
+		if len(trees) > 1 {
+			split++
+		}
+
+		// Tamper with a copy of the proof in a few ways.  Neither
+		// viewpoint may accept it or change its roots.
+		if len(proof.Proof) > 0 {
+			bad := proof
+			bad.Proof = append([]accumulator.Hash(nil), proof.Proof...)
+			bad.Proof[rng.Intn(len(bad.Proof))][0] ^= 0xff
+			if ingest(dels, bad) == nil {
+				t.Fatalf("round %d: a tampered proof hash was "+
+					"accepted", round)
+			}
+
+			bad.Proof = proof.Proof[1:]
+			if ingest(dels, bad) == nil {
+				t.Fatalf("round %d: a short proof was accepted",
+					round)
+			}
+		}
+		badDels := append([]accumulator.Hash(nil), dels...)
+		badDels[rng.Intn(len(badDels))][31] ^= 0xff
+		if ingest(badDels, proof) == nil {
+			t.Fatalf("round %d: a proof of the wrong leaves was "+
+				"accepted", round)
+		}
+
+		// The targets are copied since deleting them sorts them.
+		targets := append([]uint64(nil), proof.Targets...)
+		err = ingest(dels, proof)
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+
+		live = live[count:]
+		modify(verifyTestLeaves(next, rng.Intn(60)), targets)
+	}
+	if split == 0 {
+		t.Fatal("no proof was verified in parallel")
+	}
+}
+
+// TestIngestBlockProof ensures that the proof of a block that was ingested when
+// the block was accepted isn't verified again when the block is connected, and
+// that the proof of any other block is.
+func TestIngestBlockProof(t *testing.T) {
+	full := accumulator.NewFullPollard()
+	uview := NewUtreexoViewpoint(0)
+	leaves := verifyTestLeaves(0, 16)
+	remembered := make([]accumulator.Leaf, len(leaves))
+	for i := range leaves {
+		remembered[i] = leaves[i]
+		remembered[i].Remember = true
+	}
+	err := full.Modify(remembered, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uview.accumulator.Modify(leaves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dels := []accumulator.Hash{leaves[3].Hash}
+	proof, err := full.ProveBatch(dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := proof
+	bad.Proof = append([]accumulator.Hash(nil), proof.Proof...)
+	bad.Proof[0][0] ^= 0xff
+
+	accepted := chainhash.Hash{1}
+	other := chainhash.Hash{2}
+	err = uview.IngestProof(false, dels, &proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uview.ingested = accepted
+
+	// The proof that's handed over when the block is connected isn't
+	// verified, so not even a bad one is refused.
+	err = uview.ingestBlockProof(&accepted, dels, &bad)
+	if err != nil {
+		t.Fatalf("the ingested proof was verified again: %v", err)
+	}
+
+	// The block is only skipped once.
+	err = uview.ingestBlockProof(&accepted, dels, &bad)
+	if err == nil {
+		t.Fatal("a bad proof was accepted the second time")
+	}
+
+	// The proof of another block is verified.
+	uview.ingested = accepted
+	err = uview.ingestBlockProof(&other, dels, &bad)
+	if err == nil {
+		t.Fatal("a bad proof of another block was accepted")
+	}
+	err = uview.ingestBlockProof(&accepted, dels, &bad)
+	if err == nil {
+		t.Fatal("a bad proof was accepted after another block")
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
 	"github.com/utreexo/utreexod/txscript"
 	"github.com/utreexo/utreexod/wire"
@@ -22,17 +23,25 @@ import (
 // UtreexoViewpoint is the compact state of the chainstate using the utreexo accumulator
 type UtreexoViewpoint struct {
 	proofInterval int32
+	proofWorkers  int
 	accumulator   *accumulator.Pollard
+
+	// ingested is the block whose proof was ingested when the block was
+	// accepted, ahead of its connection.
+	ingested chainhash.Hash
 }
 
 // ProcessUData checks that the accumulator proof and the utxo data included in the UData
-// passes consensus and then it updates the underlying accumulator.
+// passes consensus and then it updates the underlying accumulator.  The leaves are
+// hashed by the given hasher with the schemes of the given leaf commitment schedule.
 func (uview *UtreexoViewpoint) ProcessUData(block *btcutil.Block,
-	bestChain *chainView, ud *wire.UData) error {
+	bestChain *chainView, ud *wire.UData, schedule wire.LeafCommitmentSchedule,
+	hasher *wire.LeafHasher) error {
 
 	// Extracts the block into additions and deletions that will be processed.
 	// Adds correspond to newly created UTXOs and dels correspond to STXOs.
-	adds, dels, err := ExtractAccumulatorAddDels(block, bestChain, ud.RememberIdx)
+	adds, dels, err := ExtractAccumulatorAddDels(block, bestChain, ud.RememberIdx,
+		schedule, hasher)
 	if err != nil {
 		return err
 	}
@@ -41,7 +50,7 @@ func (uview *UtreexoViewpoint) ProcessUData(block *btcutil.Block,
 	// the accumulator before we can update it.  For proof intervals of more than 1,
 	// the ingest will happen before ProcessUData is called.
 	if uview.proofInterval == 1 {
-		err = uview.IngestProof(false, dels, &ud.AccProof)
+		err = uview.ingestBlockProof(block.Hash(), dels, &ud.AccProof)
 		if err != nil {
 			return err
 		}
@@ -56,10 +65,63 @@ func (uview *UtreexoViewpoint) ProcessUData(block *btcutil.Block,
 	return nil
 }
 
+// ingestUtreexoViewUData verifies the utreexo proof of a block that extends the
+// utreexo viewpoint by ingesting it, which leaves the roots of the accumulator
+// as they were.  The block doesn't ingest the proof again when it's connected.
+// The leaf datas are filled in on a copy of the utreexo data so that the block
+// keeps it as it was sent.
+//
+// This function MUST be called with the chain state lock held (for writes).
+func (b *BlockChain) ingestUtreexoViewUData(block *btcutil.Block) error {
+	ud := *block.MsgBlock().UData
+	ud.LeafDatas = append([]wire.LeafData(nil), ud.LeafDatas...)
+	delHashes, err := ReconstructUData(&ud, block,
+		b.relayHashByHeight(b.bestChain.Tip()), b.chainParams.LeafCommitments,
+		b.leafHasher)
+	if err != nil {
+		str := fmt.Sprintf("the utreexo data of block %v is malformed: %v",
+			block.Hash(), err)
+		return ruleError(ErrUDataInvalid, str)
+	}
+
+	err = b.utreexoView.IngestProof(false, delHashes, &ud.AccProof)
+	if err != nil {
+		str := fmt.Sprintf("the utreexo proof of block %v doesn't "+
+			"verify: %v", block.Hash(), err)
+		return ruleError(ErrUDataInvalid, str)
+	}
+	b.utreexoView.ingested = *block.Hash()
+
+	return nil
+}
+
+// ingestBlockProof readys the accumulator for the deletions of the block with
+// the given hash by ingesting its proof, unless the proof was already ingested
+// when the block was accepted.  Either way, the proof is only verified once.
+//
+// This function is NOT safe for concurrent access.
+func (uview *UtreexoViewpoint) ingestBlockProof(hash *chainhash.Hash,
+	delHashes []accumulator.Hash, accProof *accumulator.BatchProof) error {
+
+	ingested := uview.ingested == *hash
+	uview.ingested = chainhash.Hash{}
+	if ingested {
+		return nil
+	}
+
+	return uview.IngestProof(false, delHashes, accProof)
+}
+
 // IngestProof first checks that the utreexo proofs are valid. If it is valid,
 // it readys the utreexo accumulator for additions/deletions by ingesting the proof.
+// With more than one proof worker, the proof is split by the trees of the
+// accumulator and the trees are verified and ingested in parallel.
 func (uview *UtreexoViewpoint) IngestProof(rememberAll bool, delHashes []accumulator.Hash,
 	accProof *accumulator.BatchProof) error {
+
+	if uview.proofWorkers > 1 {
+		return uview.ingestProofParallel(rememberAll, delHashes, accProof)
+	}
 	return uview.accumulator.IngestBatchProof(delHashes, *accProof, rememberAll)
 }
 
@@ -107,6 +169,34 @@ func BlockToDelOPs(
 	return delOPs
 }
 
+// BlockToDelTxIns returns the inputs of the block that spend the leaves that
+// are deleted from the accumulator, in the order of their leaf datas.
+func BlockToDelTxIns(blk *btcutil.Block) []*wire.TxIn {
+	inCount, _, inskip, _ := DedupeBlock(blk)
+	txIns := make([]*wire.TxIn, 0, inCount-len(inskip))
+
+	var blockInIdx uint32
+	for idx, tx := range blk.Transactions() {
+		if idx == 0 {
+			// coinbase can have many inputs
+			blockInIdx += uint32(len(tx.MsgTx().TxIn))
+			continue
+		}
+
+		for _, txIn := range tx.MsgTx().TxIn {
+			if len(inskip) > 0 && inskip[0] == blockInIdx {
+				inskip = inskip[1:]
+				blockInIdx++
+				continue
+			}
+
+			txIns = append(txIns, txIn)
+			blockInIdx++
+		}
+	}
+	return txIns
+}
+
 // DedupeBlock takes a bitcoin block, and returns two int slices: the indexes of
 // inputs, and idexes of outputs which can be removed.  These are indexes
 // within the block as a whole, even the coinbase tx.
@@ -156,8 +246,10 @@ func DedupeBlock(blk *btcutil.Block) (inCount, outCount int, inskip []uint32, ou
 }
 
 // ExtractAccumulatorAddDels extracts the additions and the deletions that will be
-// used to modify the utreexo accumulator.
-func ExtractAccumulatorAddDels(block *btcutil.Block, bestChain *chainView, remembers []uint32) (
+// used to modify the utreexo accumulator.  The leaves are hashed by the given hasher
+// with the schemes of the given leaf commitment schedule.
+func ExtractAccumulatorAddDels(block *btcutil.Block, bestChain *chainView, remembers []uint32,
+	schedule wire.LeafCommitmentSchedule, hasher *wire.LeafHasher) (
 	[]accumulator.Leaf, []accumulator.Hash, error) {
 
 	// Check that UData field isn't nil before doing anything else.
@@ -174,7 +266,8 @@ func ExtractAccumulatorAddDels(block *btcutil.Block, bestChain *chainView, remem
 
 	// Make the now verified utxos into 32 byte leaves ready to be added into the
 	// utreexo accumulator.
-	leaves := BlockToAddLeaves(block, outskip, remembers, outCount)
+	leaves := BlockToAddLeaves(block, outskip, remembers, outCount, schedule,
+		hasher)
 
 	// Make slice of hashes from the LeafDatas. These are the hash commitments
 	// to be proven.
@@ -184,7 +277,8 @@ func ExtractAccumulatorAddDels(block *btcutil.Block, bestChain *chainView, remem
 	var delHashes []accumulator.Hash
 	if len(ud.LeafDatas) > 0 {
 		var err error
-		delHashes, err = reconstructUData(ud, block, bestChain, inskip)
+		delHashes, err = reconstructUData(ud, block, bestChain, inskip,
+			schedule, hasher)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -229,17 +323,156 @@ func ProofSanity(ud *wire.UData, outPoints []wire.OutPoint) error {
 	return nil
 }
 
+// checkUDataCommitment checks that the leaves of the utreexo data attached to
+// the block are the ones spent by its transactions.  The transactions are tied
+// to the header by the merkle root check in checkBlockSanity, so a valid
+// accumulator proof for the leaves of a different block is rejected here
+// instead of having its outpoints overwritten by reconstructUData.
+//
+// A leaf that commits to a known block at its height which isn't an ancestor
+// of the block, such as one that was reorged out, is rejected with
+// ErrUDataStaleCommitment so that it can be told apart from invalid utreexo
+// data.
+//
+// Compact leaf datas don't carry the outpoint or the block hash and are only
+// checked for their height.  Blocks without utreexo data are not checked.
+func checkUDataCommitment(block *btcutil.Block, prevNode *blockNode,
+	index *blockIndex) error {
+
+	ud := block.MsgBlock().UData
+	if ud == nil {
+		return nil
+	}
+
+	outPoints := BlockToDelOPs(block)
+	if len(outPoints) != len(ud.LeafDatas) {
+		str := fmt.Sprintf("block %v spends %d outpoints but its "+
+			"utreexo data has %d leaves", block.Hash(), len(outPoints),
+			len(ud.LeafDatas))
+		return ruleError(ErrUDataCommitmentMismatch, str)
+	}
+
+	var emptyOutPoint wire.OutPoint
+	var emptyHash chainhash.Hash
+	for i := range ud.LeafDatas {
+		ld := &ud.LeafDatas[i]
+
+		if ld.OutPoint != emptyOutPoint && ld.OutPoint != outPoints[i] {
+			str := fmt.Sprintf("leaf %d of the utreexo data of block "+
+				"%v is for outpoint %v but the block spends %v", i,
+				block.Hash(), ld.OutPoint, outPoints[i])
+			return ruleError(ErrUDataCommitmentMismatch, str)
+		}
+
+		// The leaf must have been created in a block before this
+		// one.  Outputs created in this block are never leaves.
+		if ld.Height < 0 || prevNode == nil || ld.Height > prevNode.height {
+			str := fmt.Sprintf("leaf %d of the utreexo data of block "+
+				"%v has height %d which isn't before the block", i,
+				block.Hash(), ld.Height)
+			return ruleError(ErrUDataCommitmentMismatch, str)
+		}
+		if ld.BlockHash != emptyHash &&
+			ld.BlockHash != prevNode.Ancestor(ld.Height).hash {
+
+			str := fmt.Sprintf("leaf %d of the utreexo data of block "+
+				"%v claims block %v at height %d which isn't an "+
+				"ancestor of the block", i, block.Hash(),
+				ld.BlockHash, ld.Height)
+			node := index.LookupNode(&ld.BlockHash)
+			if node != nil && node.height == ld.Height {
+				return ruleError(ErrUDataStaleCommitment, str)
+			}
+			return ruleError(ErrUDataCommitmentMismatch, str)
+		}
+	}
+
+	return nil
+}
+
+// NewLeafHasher returns a hasher for the utreexo leaves of the network with the
+// given parameters.  It only keeps the hash states after the tagged prefixes of
+// the transactions if the leaf commitment schedule of the network has
+// LeafCommitmentTaggedV1 as the states don't help any other scheme.
+func NewLeafHasher(params *chaincfg.Params) *wire.LeafHasher {
+	for _, upgrade := range params.LeafCommitments {
+		if upgrade.Scheme == wire.LeafCommitmentTaggedV1 {
+			return wire.NewLeafHasher(wire.DefaultLeafMidstates)
+		}
+	}
+
+	return wire.NewLeafHasher(0)
+}
+
+// LeafHasher returns the hasher that the leaves of the created and the spent
+// outputs of the blocks are hashed with.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) LeafHasher() *wire.LeafHasher {
+	return b.leafHasher
+}
+
 // reconstructUData adds in missing information to the passed in compact UData and
 // makes it full. The hashes returned are the hashes of the individual leaf data
 // that were commited into the accumulator.
 //
 // This function is safe for concurrent access.
 func reconstructUData(ud *wire.UData, block *btcutil.Block, chainView *chainView,
-	inskip []uint32) ([]accumulator.Hash, error) {
+	inskip []uint32, schedule wire.LeafCommitmentSchedule,
+	hasher *wire.LeafHasher) ([]accumulator.Hash, error) {
 	if chainView == nil {
 		return nil, fmt.Errorf("Passed in chainView is nil. Cannot make compact udata to full")
 	}
 
+	hashByHeight := func(height int32) (*chainhash.Hash, error) {
+		blockNode := chainView.NodeByHeight(height)
+		if blockNode == nil {
+			return nil, fmt.Errorf("Couldn't find blockNode for height %d",
+				height)
+		}
+		return &blockNode.hash, nil
+	}
+
+	return reconstructLeafDatas(ud, block, hashByHeight, inskip, schedule,
+		hasher)
+}
+
+// ReconstructUData adds in the block hashes, the outpoints, and the
+// reconstructable scripts that are left out of the leaf datas of the passed in
+// compact UData for the given block.  The block hashes are looked up by the
+// heights of the leaf datas with the given function.  The hashes returned are
+// the hashes of the individual leaf datas with the schemes of the given leaf
+// commitment schedule, hashed by the given hasher if it isn't nil.
+//
+// Unlike the UData of a connected block, the passed in UData may come from
+// anywhere so an error is returned rather than a panic if it doesn't have a
+// leaf data for every input of the block that needs to be proven.
+func ReconstructUData(ud *wire.UData, block *btcutil.Block,
+	hashByHeight func(int32) (*chainhash.Hash, error),
+	schedule wire.LeafCommitmentSchedule,
+	hasher *wire.LeafHasher) ([]accumulator.Hash, error) {
+
+	inCount, _, inskip, _ := DedupeBlock(block)
+	toProve := inCount - len(inskip) - len(block.Transactions()[0].MsgTx().TxIn)
+	if len(ud.LeafDatas) != toProve {
+		return nil, fmt.Errorf("%d leaf datas for the %d inputs of block %v "+
+			"that need to be proven", len(ud.LeafDatas), toProve,
+			block.Hash())
+	}
+
+	return reconstructLeafDatas(ud, block, hashByHeight, inskip, schedule,
+		hasher)
+}
+
+// reconstructLeafDatas adds in missing information to the leaf datas of the
+// passed in compact UData with the block hashes looked up by height with the
+// given function.  The hashes returned are the hashes of the individual leaf
+// data that were commited into the accumulator.
+func reconstructLeafDatas(ud *wire.UData, block *btcutil.Block,
+	hashByHeight func(int32) (*chainhash.Hash, error), inskip []uint32,
+	schedule wire.LeafCommitmentSchedule,
+	hasher *wire.LeafHasher) ([]accumulator.Hash, error) {
+
 	// blockInIdx is used to get the indexes of the skips.  ldIdx is used
 	// as a separate idx for the LeafDatas.  We need both of them because
 	// LeafDatas have already been deduped while the transactions are not.
@@ -262,12 +495,11 @@ func reconstructUData(ud *wire.UData, block *btcutil.Block, chainView *chainView
 			ld := &ud.LeafDatas[ldIdx]
 
 			// Get BlockHash.
-			blockNode := chainView.NodeByHeight(ld.Height)
-			if blockNode == nil {
-				return nil, fmt.Errorf("Couldn't find blockNode for height %d",
-					ld.Height)
+			blockHash, err := hashByHeight(ld.Height)
+			if err != nil {
+				return nil, err
 			}
-			ld.BlockHash = blockNode.hash
+			ld.BlockHash = *blockHash
 
 			// Get OutPoint.
 			op := wire.OutPoint{
@@ -279,19 +511,11 @@ func reconstructUData(ud *wire.UData, block *btcutil.Block, chainView *chainView
 			if ld.ReconstructablePkType != wire.OtherTy &&
 				ld.PkScript == nil {
 
-				var class txscript.ScriptClass
-
-				switch ld.ReconstructablePkType {
-				case wire.PubKeyHashTy:
-					class = txscript.PubKeyHashTy
-				case wire.ScriptHashTy:
-					class = txscript.ScriptHashTy
-				case wire.WitnessV0PubKeyHashTy:
-					class = txscript.WitnessV0PubKeyHashTy
-				case wire.WitnessV0ScriptHashTy:
-					class = txscript.WitnessV0ScriptHashTy
+				class := pkTypeClass(ld.ReconstructablePkType)
+				err := checkReconstructInput(txIn, class)
+				if err != nil {
+					return nil, err
 				}
-
 				scriptToUse, err := txscript.ReconstructScript(
 					txIn.SignatureScript, txIn.Witness, class)
 				if err != nil {
@@ -301,7 +525,7 @@ func reconstructUData(ud *wire.UData, block *btcutil.Block, chainView *chainView
 				ld.PkScript = scriptToUse
 			}
 
-			delHashes = append(delHashes, ld.LeafHash())
+			delHashes = append(delHashes, hasher.ScheduledLeafHash(ld, schedule))
 
 			blockInIdx++
 			ldIdx++
@@ -311,17 +535,39 @@ func reconstructUData(ud *wire.UData, block *btcutil.Block, chainView *chainView
 	return delHashes, nil
 }
 
-// IsUnspendable determines whether a tx is spendable or not.
-// returns true if spendable, false if unspendable.
-func IsUnspendable(o *wire.TxOut) bool {
-	switch {
-	case len(o.PkScript) > 10000: //len 0 is OK, spendable
-		return true
-	case len(o.PkScript) > 0 && o.PkScript[0] == 0x6a: // OP_RETURN is 0x6a
-		return true
+// checkReconstructInput returns an error if the input doesn't have the data
+// that the script of the given class is reconstructed from.  The leaf datas may
+// come from a peer or an RPC so a reconstructable type that doesn't match the
+// spending input mustn't be trusted.
+func checkReconstructInput(txIn *wire.TxIn, class txscript.ScriptClass) error {
+	switch class {
+	case txscript.PubKeyHashTy, txscript.ScriptHashTy:
+		if len(txIn.SignatureScript) == 0 {
+			return fmt.Errorf("can't reconstruct the %v script of %v "+
+				"from an empty signature script", class,
+				txIn.PreviousOutPoint)
+		}
+	case txscript.WitnessV0PubKeyHashTy, txscript.WitnessV0ScriptHashTy:
+		if len(txIn.Witness) == 0 ||
+			len(txIn.Witness[len(txIn.Witness)-1]) == 0 {
+
+			return fmt.Errorf("can't reconstruct the %v script of %v "+
+				"from an empty witness", class,
+				txIn.PreviousOutPoint)
+		}
 	default:
-		return false
+		return fmt.Errorf("can't reconstruct the script of %v with "+
+			"class %v", txIn.PreviousOutPoint, class)
 	}
+
+	return nil
+}
+
+// IsUnspendable returns whether the output doesn't become a leaf of the
+// utreexo accumulator.  It's decided by CheckLeafEligibility so it only looks
+// at the static patterns of the public key script.
+func IsUnspendable(o *wire.TxOut) bool {
+	return CheckLeafEligibility(o.PkScript) != LeafEligible
 }
 
 // BlockToAdds turns the newly created utxos in a block into leaves that will
@@ -331,8 +577,12 @@ func IsUnspendable(o *wire.TxOut) bool {
 // included in the slice. For example, if [0, 3, 11] is given as the skiplist,
 // then utxos that appear in the 0th, 3rd, and 11th in the block will
 // be skipped over.
+//
+// The leaves are hashed by the given hasher, if it isn't nil, with the scheme that
+// the leaf commitment schedule has for the height of the block.
 func BlockToAddLeaves(block *btcutil.Block, skiplist []uint32, remembers []uint32,
-	outCount int) []accumulator.Leaf {
+	outCount int, schedule wire.LeafCommitmentSchedule,
+	hasher *wire.LeafHasher) []accumulator.Leaf {
 
 	// Sort first as the below loop expects the remembers to be in order.
 	sortUint32s(remembers)
@@ -379,7 +629,7 @@ func BlockToAddLeaves(block *btcutil.Block, skiplist []uint32, remembers []uint3
 			}
 
 			uleaf := accumulator.Leaf{
-				Hash:     leaf.LeafHash(),
+				Hash:     hasher.ScheduledLeafHash(&leaf, schedule),
 				Remember: remember,
 			}
 
@@ -391,6 +641,38 @@ func BlockToAddLeaves(block *btcutil.Block, skiplist []uint32, remembers []uint3
 	return leaves
 }
 
+// BlockToAddOutPoints returns the outpoints of the newly created utxos in a
+// block in the same order as the leaves returned by BlockToAddLeaves for the
+// same skiplist.
+func BlockToAddOutPoints(block *btcutil.Block, skiplist []uint32) []wire.OutPoint {
+	var outPoints []wire.OutPoint
+
+	var txonum uint32
+	for _, tx := range block.Transactions() {
+		for outIdx, txOut := range tx.MsgTx().TxOut {
+			// Skip all the OP_RETURNs and the txos on the skip
+			// list just like BlockToAddLeaves does.
+			if IsUnspendable(txOut) {
+				txonum++
+				continue
+			}
+			if len(skiplist) > 0 && skiplist[0] == txonum {
+				skiplist = skiplist[1:]
+				txonum++
+				continue
+			}
+
+			outPoints = append(outPoints, wire.OutPoint{
+				Hash:  *tx.Hash(),
+				Index: uint32(outIdx),
+			})
+			txonum++
+		}
+	}
+
+	return outPoints
+}
+
 // ExcludedUtxo is the utxo that was excluded because it was spent and created
 // within a given block interval.  It includes the creation height and the outpoint
 // of the utxo.
@@ -402,8 +684,105 @@ type ExcludedUtxo struct {
 	Outpoint wire.OutPoint
 }
 
+// ReconstructablePkType returns the type that the pkScript is serialized as in
+// the compact leaf data serialization when the spending input reconstructs it.
+// Scripts that can't be reconstructed are returned as OtherTy and are
+// serialized whole.  ReconstructablePkTypeForInput checks the spending input as
+// well.
+func ReconstructablePkType(pkScript []byte) wire.PkType {
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.PubKeyHashTy:
+		return wire.PubKeyHashTy
+	case txscript.WitnessV0PubKeyHashTy:
+		return wire.WitnessV0PubKeyHashTy
+	case txscript.ScriptHashTy:
+		return wire.ScriptHashTy
+	case txscript.WitnessV0ScriptHashTy:
+		return wire.WitnessV0ScriptHashTy
+	default:
+		return wire.OtherTy
+	}
+}
+
+// ReconstructablePkTypeForInput returns the type that the pkScript spent by the
+// given input is serialized as in the compact leaf data serialization.  It's the
+// type from ReconstructablePkType only if the script is reconstructed exactly
+// from the input.  Otherwise it's OtherTy and the script is serialized whole, as
+// for a P2WSH output spent without a witness before segwit is active.
+func ReconstructablePkTypeForInput(pkScript []byte, txIn *wire.TxIn) wire.PkType {
+	ty := ReconstructablePkType(pkScript)
+	if ty == wire.OtherTy {
+		return ty
+	}
+
+	class := pkTypeClass(ty)
+	if checkReconstructInput(txIn, class) != nil {
+		return wire.OtherTy
+	}
+	script, err := txscript.ReconstructScript(txIn.SignatureScript,
+		txIn.Witness, class)
+	if err != nil || !bytes.Equal(script, pkScript) {
+		return wire.OtherTy
+	}
+
+	return ty
+}
+
+// pkTypeClass returns the script class of the reconstructable type.
+func pkTypeClass(ty wire.PkType) txscript.ScriptClass {
+	switch ty {
+	case wire.PubKeyHashTy:
+		return txscript.PubKeyHashTy
+	case wire.ScriptHashTy:
+		return txscript.ScriptHashTy
+	case wire.WitnessV0PubKeyHashTy:
+		return txscript.WitnessV0PubKeyHashTy
+	case wire.WitnessV0ScriptHashTy:
+		return txscript.WitnessV0ScriptHashTy
+	default:
+		return txscript.NonStandardTy
+	}
+}
+
+// BlockHashLookup looks up the hashes of the blocks of the main chain by their
+// height.  It's implemented by BlockChain.
+type BlockHashLookup interface {
+	BlockHashByHeight(blockHeight int32) (*chainhash.Hash, error)
+}
+
+// DelLeavesSize returns the number of leaves that BlockToDelLeaves turns the
+// stxos into with the given inskip and excludeAfter, and the sum of their
+// serialized sizes.  It's computed from the count and the pkScript lengths of
+// the stxos alone so that the leaves and their proofs can be sized exactly
+// before they're made.  The size of the spending transactions has no bearing
+// on either since witnesses never make it into the leaves.
+func DelLeavesSize(stxos []SpentTxOut, inskip []uint32, excludeAfter int32) (int, int) {
+	var count, size int
+	for i := range stxos {
+		// The stxos start from the input after the one of the
+		// coinbase, the same as in BlockToDelLeaves.
+		blockInIdx := uint32(i) + 1
+		for len(inskip) > 0 && inskip[0] < blockInIdx {
+			inskip = inskip[1:]
+		}
+		if len(inskip) > 0 && inskip[0] == blockInIdx {
+			continue
+		}
+		if excludeAfter >= 0 && stxos[i].Height >= excludeAfter {
+			continue
+		}
+
+		leaf := wire.LeafData{PkScript: stxos[i].PkScript}
+		count++
+		size += leaf.SerializeSize()
+	}
+
+	return count, size
+}
+
 // BlockToDelLeaves takes a non-utreexo block and stxos and turns the block into
-// leaves that are to be deleted.
+// leaves that are to be deleted.  The hashes of the blocks that created the
+// spent outputs are looked up with the given chain.
 //
 // inskip and excludeAfter are optional arguments. inskip will skip indexes of the
 // txIns that match with the ones included in the slice. For example, if [0, 3, 11]
@@ -416,13 +795,19 @@ type ExcludedUtxo struct {
 //
 // NOTE To opt out of the optional arguments inskip and excludeAfter, just pass nil
 // for inskip and -1 for excludeAfter.
-func BlockToDelLeaves(stxos []SpentTxOut, chain *BlockChain, block *btcutil.Block,
+func BlockToDelLeaves(stxos []SpentTxOut, chain BlockHashLookup, block *btcutil.Block,
 	inskip []uint32, excludeAfter int32) (delLeaves []wire.LeafData, excluded []ExcludedUtxo, err error) {
 
 	if chain == nil {
 		return nil, nil, fmt.Errorf("Passed in chain is nil. Cannot make delLeaves")
 	}
 
+	// Size the leaves exactly from the stxos so that they're never grown
+	// while they're appended to.
+	if count, _ := DelLeavesSize(stxos, inskip, excludeAfter); count > 0 {
+		delLeaves = make([]wire.LeafData, 0, count)
+	}
+
 	var blockInIdx uint32
 	for idx, tx := range block.Transactions() {
 		if idx == 0 {
@@ -463,27 +848,11 @@ func BlockToDelLeaves(stxos []SpentTxOut, chain *BlockChain, block *btcutil.Bloc
 					stxo.Height)
 			}
 
-			var pkType wire.PkType
-
-			scriptType := txscript.GetScriptClass(stxo.PkScript)
-			switch scriptType {
-			case txscript.PubKeyHashTy:
-				pkType = wire.PubKeyHashTy
-			case txscript.WitnessV0PubKeyHashTy:
-				pkType = wire.WitnessV0PubKeyHashTy
-			case txscript.ScriptHashTy:
-				pkType = wire.ScriptHashTy
-			case txscript.WitnessV0ScriptHashTy:
-				pkType = wire.WitnessV0ScriptHashTy
-			default:
-				pkType = wire.OtherTy
-			}
-
 			var leaf = wire.LeafData{
 				BlockHash:             *blockHash,
 				OutPoint:              op,
 				Amount:                stxo.Amount,
-				ReconstructablePkType: pkType,
+				ReconstructablePkType: ReconstructablePkTypeForInput(stxo.PkScript, txIn),
 				PkScript:              stxo.PkScript,
 				Height:                stxo.Height,
 				IsCoinBase:            stxo.IsCoinBase,
@@ -557,29 +926,13 @@ func TxToDelLeaves(tx *btcutil.Tx, chain *BlockChain) ([]wire.LeafData, error) {
 			return nil, err
 		}
 
-		var pkType wire.PkType
-
-		scriptType := txscript.GetScriptClass(entry.PkScript())
-		switch scriptType {
-		case txscript.PubKeyHashTy:
-			pkType = wire.PubKeyHashTy
-		case txscript.WitnessV0PubKeyHashTy:
-			pkType = wire.WitnessV0PubKeyHashTy
-		case txscript.ScriptHashTy:
-			pkType = wire.ScriptHashTy
-		case txscript.WitnessV0ScriptHashTy:
-			pkType = wire.WitnessV0ScriptHashTy
-		default:
-			pkType = wire.OtherTy
-		}
-
 		leaf := wire.LeafData{
 			BlockHash:             *blockHash,
 			OutPoint:              txIn.PreviousOutPoint,
 			Amount:                entry.Amount(),
 			Height:                entry.BlockHeight(),
 			IsCoinBase:            entry.IsCoinBase(),
-			ReconstructablePkType: pkType,
+			ReconstructablePkType: ReconstructablePkTypeForInput(entry.PkScript(), txIn),
 		}
 		// Copy the key over so it doesn't get dropped while
 		// we're still using it.
@@ -703,11 +1056,29 @@ func (uview *UtreexoViewpoint) PruneAll() {
 	uview.accumulator.PruneAll()
 }
 
-// NewUtreexoViewpoint returns an empty UtreexoViewpoint
-func NewUtreexoViewpoint() *UtreexoViewpoint {
+// GenesisUData returns the utreexo data for the genesis block.
+//
+// The genesis block never modifies the accumulator on any network since its
+// coinbase is not spendable by consensus rules and is never added to the utxo
+// set.  The utreexo data for it is therefore always empty.
+func GenesisUData() *wire.UData {
+	return &wire.UData{}
+}
+
+// NewUtreexoViewpoint returns an empty UtreexoViewpoint.  Since the genesis block
+// doesn't modify the accumulator, the returned viewpoint is both the state
+// before and after the genesis block.
+//
+// proofWorkers is the number of goroutines that the accumulator proof of a block
+// is verified with.  The proof is split by the trees of the accumulator, which
+// are checked independently of each other.  0 or 1 verifies the whole proof at
+// once on the calling goroutine.  Either way, the same proofs are accepted and
+// the accumulator ends up the same.
+func NewUtreexoViewpoint(proofWorkers int) *UtreexoViewpoint {
 	return &UtreexoViewpoint{
 		// Use 1 as a default value.
 		proofInterval: 1,
+		proofWorkers:  proofWorkers,
 		accumulator:   new(accumulator.Pollard),
 	}
 }
@@ -717,6 +1088,44 @@ func (b *BlockChain) GetUtreexoView() *UtreexoViewpoint {
 	return b.utreexoView
 }
 
+// UtreexoViewState is the accumulator of the utreexo viewpoint at a block.
+type UtreexoViewState struct {
+	// Hash and Height are of the block that the accumulator is at.
+	Hash   chainhash.Hash
+	Height int32
+
+	// NumLeaves is the number of leaves in the accumulator and NumHashes
+	// is the number of hashes of its trees that the viewpoint keeps.
+	NumLeaves uint64
+	NumHashes uint64
+
+	// Roots are the roots of the accumulator.
+	Roots []*chainhash.Hash
+}
+
+// UtreexoViewTip returns the accumulator of the utreexo viewpoint at the block
+// that it's at.  ok is false if the node doesn't depend on the utreexo
+// viewpoint.
+//
+// This function is safe for concurrent access.
+func (b *BlockChain) UtreexoViewTip() (state *UtreexoViewState, ok bool) {
+	b.chainLock.RLock()
+	defer b.chainLock.RUnlock()
+
+	if b.utreexoView == nil {
+		return nil, false
+	}
+
+	tip := b.bestChain.Tip()
+	return &UtreexoViewState{
+		Hash:      tip.hash,
+		Height:    tip.height,
+		NumLeaves: b.utreexoView.NumLeaves(),
+		NumHashes: b.utreexoView.NumHashes(),
+		Roots:     b.utreexoView.GetRoots(),
+	}, true
+}
+
 // PrintRemembers prints all the nodes and their remember status.  Useful for debugging.
 func (uview *UtreexoViewpoint) PrintRemembers() string {
 	str, _ := uview.accumulator.PrintRemembers()
@@ -728,6 +1137,14 @@ func (uview *UtreexoViewpoint) NumLeaves() uint64 {
 	return uview.accumulator.NumLeaves()
 }
 
+// NumHashes returns the number of hashes of the trees of the accumulator that
+// are kept, including the roots.  Only the parts of the trees that are needed
+// to prove the remembered leaves are kept, so it's usually far below the number
+// of hashes of the whole trees.
+func (uview *UtreexoViewpoint) NumHashes() uint64 {
+	return uint64(uview.accumulator.GetTotalCount())
+}
+
 // IsUtreexoViewActive returns true if the node depends on the utreexoView
 // instead of a full UTXO set.  Returns false if it's not.
 func (b *BlockChain) IsUtreexoViewActive() bool {
@@ -803,19 +1220,11 @@ func (b *BlockChain) VerifyUData(ud *wire.UData, txIns []*wire.TxIn) error {
 			if ld.ReconstructablePkType != wire.OtherTy &&
 				ld.PkScript == nil {
 
-				var class txscript.ScriptClass
-
-				switch ld.ReconstructablePkType {
-				case wire.PubKeyHashTy:
-					class = txscript.PubKeyHashTy
-				case wire.ScriptHashTy:
-					class = txscript.ScriptHashTy
-				case wire.WitnessV0PubKeyHashTy:
-					class = txscript.WitnessV0PubKeyHashTy
-				case wire.WitnessV0ScriptHashTy:
-					class = txscript.WitnessV0ScriptHashTy
+				class := pkTypeClass(ld.ReconstructablePkType)
+				err := checkReconstructInput(txIn, class)
+				if err != nil {
+					return err
 				}
-
 				scriptToUse, err := txscript.ReconstructScript(
 					txIn.SignatureScript, txIn.Witness, class)
 				if err != nil {
@@ -825,7 +1234,8 @@ func (b *BlockChain) VerifyUData(ud *wire.UData, txIns []*wire.TxIn) error {
 				ld.PkScript = scriptToUse
 			}
 
-			delHashes = append(delHashes, ld.LeafHash())
+			delHashes = append(delHashes, b.leafHasher.ScheduledLeafHash(ld,
+				b.chainParams.LeafCommitments))
 		}
 	}
 
@@ -5,10 +5,15 @@
 package blockchain
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 
 	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
 )
 
 func TestChainTipProofSerialize(t *testing.T) {
@@ -87,3 +92,776 @@ func TestChainTipProofSerialize(t *testing.T) {
 
 	}
 }
+
+// TestGenesisUtreexoState ensures that the genesis block doesn't modify the
+// accumulator on any of the networks.
+func TestGenesisUtreexoState(t *testing.T) {
+	nets := []*chaincfg.Params{
+		&chaincfg.MainNetParams,
+		&chaincfg.TestNet3Params,
+		&chaincfg.RegressionNetParams,
+		&chaincfg.SimNetParams,
+		&chaincfg.SigNetParams,
+	}
+	for _, params := range nets {
+		chain, teardown, err := chainSetup("genesisutreexostate", params)
+		if err != nil {
+			t.Fatalf("%s: %v", params.Name, err)
+		}
+
+		hash, err := chain.BlockHashByHeight(0)
+		if err != nil {
+			teardown()
+			t.Fatalf("%s: %v", params.Name, err)
+		}
+		if !hash.IsEqual(params.GenesisHash) {
+			teardown()
+			t.Fatalf("%s: expected the genesis hash %v at height 0, "+
+				"got %v", params.Name, params.GenesisHash, hash)
+		}
+
+		// The genesis coinbase is unspendable by consensus rules so
+		// none of its outputs are in the utxo set.
+		coinbase := params.GenesisBlock.Transactions[0]
+		for i := range coinbase.TxOut {
+			op := wire.OutPoint{Hash: coinbase.TxHash(), Index: uint32(i)}
+			entry, err := chain.FetchUtxoEntry(op)
+			if err != nil {
+				teardown()
+				t.Fatalf("%s: %v", params.Name, err)
+			}
+			if entry != nil {
+				teardown()
+				t.Fatalf("%s: genesis coinbase output %v is in the "+
+					"utxo set", params.Name, op)
+			}
+		}
+		teardown()
+
+		// Nothing is added or proven for the genesis block.
+		ud := GenesisUData()
+		if len(ud.LeafDatas) != 0 || len(ud.AccProof.Targets) != 0 ||
+			len(ud.RememberIdx) != 0 {
+
+			t.Fatalf("%s: expected empty genesis utreexo data, got %v",
+				params.Name, ud)
+		}
+		if roots := NewUtreexoViewpoint(0).GetRoots(); len(roots) != 0 {
+			t.Fatalf("%s: expected no roots after the genesis block, "+
+				"got %d", params.Name, len(roots))
+		}
+	}
+}
+
+// coinbaseLeaf returns the leaf of the spendable output of the coinbase of the
+// block.
+func coinbaseLeaf(block *btcutil.Block, spendable *SpendableOut) wire.LeafData {
+	coinbase := block.MsgBlock().Transactions[0]
+	return wire.LeafData{
+		BlockHash:  *block.Hash(),
+		OutPoint:   spendable.PrevOut,
+		Height:     block.Height(),
+		IsCoinBase: true,
+		Amount:     int64(spendable.Amount),
+		PkScript:   coinbase.TxOut[spendable.PrevOut.Index].PkScript,
+	}
+}
+
+// TestCheckUDataCommitment ensures that blocks with the utreexo data of a
+// different block attached are rejected when the commitment check is on.
+func TestCheckUDataCommitment(t *testing.T) {
+	chain, params, tearDown := utxoCacheTestChain("TestCheckUDataCommitment")
+	defer tearDown()
+
+	genesis := btcutil.NewBlock(params.GenesisBlock)
+	b1, spendables1 := AddBlock(chain, genesis, nil)
+	b2, spendables2 := AddBlock(chain, b1, nil)
+
+	// Two competing blocks on b2 that each spend the coinbase of a
+	// different block.
+	spec := BlockSpec{NumTxs: 1, InputsPerTx: 1}
+	blockA, _, err := GenerateBlockFromSpec(chain, b2, spendables1, spec, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockB, _, err := GenerateBlockFromSpec(chain, b2, spendables2, spec, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafA := coinbaseLeaf(b1, spendables1[0])
+	leafB := coinbaseLeaf(b2, spendables2[0])
+	wrongBlock := leafB
+	wrongBlock.BlockHash = *b1.Hash()
+	tooHigh := leafB
+	tooHigh.Height = b2.Height() + 1
+
+	tests := []struct {
+		name   string
+		leaves []wire.LeafData
+	}{
+		{"leaves of a different block", []wire.LeafData{leafA}},
+		{"block hash of a different block", []wire.LeafData{wrongBlock}},
+		{"created after the parent", []wire.LeafData{tooHigh}},
+		{"missing leaves", nil},
+		{"extra leaves", []wire.LeafData{leafB, leafA}},
+	}
+	for _, test := range tests {
+		blockB.MsgBlock().UData = &wire.UData{LeafDatas: test.leaves}
+		_, _, err := chain.ProcessBlock(blockB, BFCheckUDataCommitment)
+		rerr, ok := err.(RuleError)
+		if !ok || rerr.ErrorCode != ErrUDataCommitmentMismatch {
+			t.Fatalf("%s: expected ErrUDataCommitmentMismatch, got %v",
+				test.name, err)
+		}
+	}
+
+	// The block is accepted with its own leaves.
+	blockB.MsgBlock().UData = &wire.UData{LeafDatas: []wire.LeafData{leafB}}
+	_, _, err = chain.ProcessBlock(blockB, BFCheckUDataCommitment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The check is off without the flag.
+	blockA.MsgBlock().UData = &wire.UData{LeafDatas: []wire.LeafData{leafB}}
+	_, _, err = chain.ProcessBlock(blockA, BFNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStaleUDataCommitment ensures that leaves committing to a block that was
+// reorged out of the main chain are rejected as stale rather than invalid.
+func TestStaleUDataCommitment(t *testing.T) {
+	chain, params, tearDown := utxoCacheTestChain("TestStaleUDataCommitment")
+	defer tearDown()
+
+	// Reorg from b2a to the longer chain of b2b and b3b.  b2b spends the
+	// coinbase of b1 so that it differs from b2a.
+	genesis := btcutil.NewBlock(params.GenesisBlock)
+	b1, spendables1 := AddBlock(chain, genesis, nil)
+	b2a, _ := AddBlock(chain, b1, nil)
+	b2b, spendables2b := AddBlock(chain, b1, spendables1)
+	b3b, _ := AddBlock(chain, b2b, nil)
+	if best := chain.BestSnapshot(); best.Hash != *b3b.Hash() {
+		t.Fatalf("expected the chain to reorg to %v, got %v", b3b.Hash(),
+			best.Hash)
+	}
+
+	spec := BlockSpec{NumTxs: 1, InputsPerTx: 1}
+	block, _, err := GenerateBlockFromSpec(chain, b3b, spendables2b[:1], spec, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spendable := spendables2b[0]
+	coinbase := b2b.MsgBlock().Transactions[0]
+	leaf := wire.LeafData{
+		BlockHash:  *b2b.Hash(),
+		OutPoint:   spendable.PrevOut,
+		Height:     b2b.Height(),
+		IsCoinBase: true,
+		Amount:     int64(spendable.Amount),
+		PkScript:   coinbase.TxOut[spendable.PrevOut.Index].PkScript,
+	}
+	stale := leaf
+	stale.BlockHash = *b2a.Hash()
+	unknown := leaf
+	unknown.BlockHash = chainhash.Hash{0x01}
+
+	tests := []struct {
+		name string
+		leaf wire.LeafData
+		want ErrorCode
+	}{
+		{"reorged out block", stale, ErrUDataStaleCommitment},
+		{"unknown block", unknown, ErrUDataCommitmentMismatch},
+	}
+	for _, test := range tests {
+		block.MsgBlock().UData = &wire.UData{
+			LeafDatas: []wire.LeafData{test.leaf},
+		}
+		_, _, err := chain.ProcessBlock(block, BFCheckUDataCommitment)
+		rerr, ok := err.(RuleError)
+		if !ok || rerr.ErrorCode != test.want {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.want,
+				err)
+		}
+	}
+
+	// The block is accepted with the leaf of the main chain.
+	block.MsgBlock().UData = &wire.UData{LeafDatas: []wire.LeafData{leaf}}
+	_, _, err = chain.ProcessBlock(block, BFCheckUDataCommitment)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestProcessBlockWithUData ensures that utreexo data supplied separately from
+// a block is checked against the block before the block is accepted and that
+// the passed in block is left as it was.
+func TestProcessBlockWithUData(t *testing.T) {
+	chain, params, tearDown := utxoCacheTestChain("TestProcessBlockWithUData")
+	defer tearDown()
+
+	genesis := btcutil.NewBlock(params.GenesisBlock)
+	b1, spendables1 := AddBlock(chain, genesis, nil)
+	b2, spendables2 := AddBlock(chain, b1, nil)
+
+	spec := BlockSpec{NumTxs: 1, InputsPerTx: 1}
+	block, _, err := GenerateBlockFromSpec(chain, b2, spendables2, spec, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The leaves are checked even without BFCheckUDataCommitment.
+	tests := []struct {
+		name string
+		ud   *wire.UData
+	}{
+		{"no utreexo data", nil},
+		{"leaves of a different block", &wire.UData{
+			LeafDatas: []wire.LeafData{coinbaseLeaf(b1, spendables1[0])},
+		}},
+		{"missing leaves", &wire.UData{}},
+	}
+	for _, test := range tests {
+		_, _, err := chain.ProcessBlockWithUData(block, test.ud, BFNone)
+		rerr, ok := err.(RuleError)
+		if !ok || rerr.ErrorCode != ErrUDataCommitmentMismatch {
+			t.Fatalf("%s: expected ErrUDataCommitmentMismatch, got %v",
+				test.name, err)
+		}
+	}
+	if best := chain.BestSnapshot(); best.Hash != *b2.Hash() {
+		t.Fatalf("expected the tip to remain %v, got %v", b2.Hash(),
+			best.Hash)
+	}
+
+	// The block is accepted with its own leaves without them being
+	// attached to it.
+	ud := &wire.UData{LeafDatas: []wire.LeafData{coinbaseLeaf(b2, spendables2[0])}}
+	isMainChain, isOrphan, err := chain.ProcessBlockWithUData(block, ud, BFNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isMainChain || isOrphan {
+		t.Fatalf("expected the block to extend the main chain, got main "+
+			"chain %v and orphan %v", isMainChain, isOrphan)
+	}
+	if block.MsgBlock().UData != nil {
+		t.Fatal("expected the passed in block to be left without utreexo " +
+			"data")
+	}
+}
+
+// TestProcessOrphansWithUData ensures that the utreexo data of orphans that were
+// supplied separately is checked once their parent is accepted, even if the
+// parent is processed without BFCheckUDataCommitment, and that an orphan that
+// fails the check doesn't keep its sibling from being accepted.
+func TestProcessOrphansWithUData(t *testing.T) {
+	// The blocks are generated on another chain so that the parent of the
+	// orphans is known when they're generated.  It's torn down before the
+	// chain under test is set up as the tear down removes all the test
+	// databases.
+	gen, params, genTearDown := utxoCacheTestChain(
+		"TestProcessOrphansWithUDataGen")
+
+	genesis := btcutil.NewBlock(params.GenesisBlock)
+	b1, _ := AddBlock(gen, genesis, nil)
+	b2, spendables2 := AddBlock(gen, b1, nil)
+	spec := BlockSpec{NumTxs: 1, InputsPerTx: 1}
+	parent, parentOuts, err := GenerateBlockFromSpec(gen, b2,
+		spendables2[:1], spec, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = gen.ProcessBlock(parent, BFNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, _, err := GenerateBlockFromSpec(gen, parent, parentOuts[:1], spec, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siblingSpec := BlockSpec{NumTxs: 1, InputsPerTx: 1, OutputsPerTx: 2}
+	good, _, err := GenerateBlockFromSpec(gen, parent, parentOuts[:1],
+		siblingSpec, 2)
+	genTearDown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, _, tearDown := utxoCacheTestChain("TestProcessOrphansWithUData")
+	defer tearDown()
+
+	for _, block := range []*btcutil.Block{b1, b2} {
+		_, _, err := chain.ProcessBlock(block, BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The orphan with the leaves of another block is added first so that
+	// it's processed before its sibling.
+	orphans := []struct {
+		block *btcutil.Block
+		ud    *wire.UData
+	}{
+		{bad, &wire.UData{
+			LeafDatas: []wire.LeafData{coinbaseLeaf(b2, spendables2[0])},
+		}},
+		{good, &wire.UData{
+			LeafDatas: []wire.LeafData{coinbaseLeaf(parent, parentOuts[0])},
+		}},
+	}
+	for _, orphan := range orphans {
+		_, isOrphan, err := chain.ProcessBlockWithUData(orphan.block,
+			orphan.ud, BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isOrphan {
+			t.Fatalf("expected block %v to be an orphan",
+				orphan.block.Hash())
+		}
+	}
+
+	// The parent is accepted without BFCheckUDataCommitment.  The failure
+	// of the orphan is returned after the other orphan is processed.
+	_, _, err = chain.ProcessBlock(parent, BFNone)
+	rerr, ok := err.(RuleError)
+	if !ok || rerr.ErrorCode != ErrUDataCommitmentMismatch {
+		t.Fatalf("expected ErrUDataCommitmentMismatch, got %v", err)
+	}
+	if !chain.index.HaveBlock(parent.Hash()) {
+		t.Fatalf("expected the parent to be accepted")
+	}
+	if chain.index.HaveBlock(bad.Hash()) {
+		t.Fatalf("expected the orphan with the leaves of another block " +
+			"to be rejected")
+	}
+	if !chain.index.HaveBlock(good.Hash()) {
+		t.Fatalf("expected the orphan with its own leaves to be accepted")
+	}
+	if chain.IsKnownOrphan(bad.Hash()) || chain.IsKnownOrphan(good.Hash()) {
+		t.Fatalf("expected the orphans to be out of the orphan pool")
+	}
+}
+
+// TestLeafHasherCorpus ensures that the leaf hashes of the created and the
+// spent outputs of the blocks of the test data are bit-identical to the ones of
+// hashing the whole serialized leaf data under every scheme.
+func TestLeafHasherCorpus(t *testing.T) {
+	// The files don't have the heights of the blocks.
+	var blocks []*btcutil.Block
+	for file, height := range map[string]int32{
+		"blk_0_to_4.dat.bz2": 0,
+		"277647.dat.bz2":     277647,
+	} {
+		loaded, err := loadBlocks(file)
+		if err != nil {
+			t.Fatalf("error loading file %s: %v", file, err)
+		}
+		for i, block := range loaded {
+			block.SetHeight(height + int32(i))
+		}
+		blocks = append(blocks, loaded...)
+	}
+	view, err := loadUtxoView("277647.utxostore.bz2")
+	if err != nil {
+		t.Fatalf("error loading utxo view: %v", err)
+	}
+
+	schedules := []wire.LeafCommitmentSchedule{
+		nil,
+		{{Height: 0, Scheme: wire.LeafCommitmentTaggedV1}},
+	}
+	for _, schedule := range schedules {
+		hasher := wire.NewLeafHasher(wire.DefaultLeafMidstates)
+		for _, block := range blocks {
+			outCount := 0
+			for _, tx := range block.Transactions() {
+				outCount += len(tx.MsgTx().TxOut)
+			}
+			leaves := BlockToAddLeaves(block, nil, nil, outCount, schedule,
+				hasher)
+			unkept := BlockToAddLeaves(block, nil, nil, outCount,
+				schedule, nil)
+
+			// The leaves are in the order of the spendable outputs.
+			i := 0
+			for coinbase, tx := range block.Transactions() {
+				for outIdx, txOut := range tx.MsgTx().TxOut {
+					if IsUnspendable(txOut) {
+						continue
+					}
+					ld := wire.LeafData{
+						BlockHash: *block.Hash(),
+						OutPoint: wire.OutPoint{
+							Hash:  *tx.Hash(),
+							Index: uint32(outIdx),
+						},
+						Amount:     txOut.Value,
+						PkScript:   txOut.PkScript,
+						Height:     block.Height(),
+						IsCoinBase: coinbase == 0,
+					}
+					want := ld.ScheduledLeafHash(schedule)
+					if accumulator.Hash(want) != leaves[i].Hash {
+						t.Fatalf("block %v: leaf hash of %s is %x, "+
+							"want %x", block.Hash(), ld.ToString(),
+							leaves[i].Hash, want)
+					}
+					if unkept[i].Hash != leaves[i].Hash {
+						t.Fatalf("block %v: leaf hash of %s is %x "+
+							"without a hasher, want %x",
+							block.Hash(), ld.ToString(),
+							unkept[i].Hash, want)
+					}
+					i++
+				}
+			}
+		}
+
+		// The spent outputs of the block at 277647.  The utxo view doesn't
+		// have the hashes of the blocks they were created in so the hash
+		// of the transaction stands in for it.
+		var spender *btcutil.Block
+		for _, block := range blocks {
+			if block.Height() == 277647 {
+				spender = block
+			}
+		}
+		for _, tx := range spender.Transactions()[1:] {
+			for _, txIn := range tx.MsgTx().TxIn {
+				entry := view.LookupEntry(txIn.PreviousOutPoint)
+				if entry == nil {
+					t.Fatalf("no utxo for %v", txIn.PreviousOutPoint)
+				}
+				ld := wire.LeafData{
+					BlockHash:  txIn.PreviousOutPoint.Hash,
+					OutPoint:   txIn.PreviousOutPoint,
+					Amount:     entry.Amount(),
+					PkScript:   entry.PkScript(),
+					Height:     entry.BlockHeight(),
+					IsCoinBase: entry.IsCoinBase(),
+				}
+				want := ld.ScheduledLeafHash(schedule)
+				got := hasher.ScheduledLeafHash(&ld, schedule)
+				if got != want {
+					t.Fatalf("leaf hash of %s is %x, want %x",
+						ld.ToString(), got, want)
+				}
+				var unkept *wire.LeafHasher
+				got = unkept.ScheduledLeafHash(&ld, schedule)
+				if got != want {
+					t.Fatalf("leaf hash of %s is %x without a "+
+						"hasher, want %x", ld.ToString(), got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestNewLeafHasher ensures that the hasher of the leaves of a network only
+// keeps hash states if the network schedules LeafCommitmentTaggedV1.
+func TestNewLeafHasher(t *testing.T) {
+	tagged := chaincfg.RegressionNetParams
+	tagged.LeafCommitments = wire.LeafCommitmentSchedule{
+		{Height: 100, Scheme: wire.LeafCommitmentTaggedV1},
+	}
+	tests := []struct {
+		params       *chaincfg.Params
+		maxMidstates int
+	}{
+		{&chaincfg.MainNetParams, 0},
+		{&chaincfg.RegressionNetParams, 0},
+		{&tagged, wire.DefaultLeafMidstates},
+	}
+	for _, test := range tests {
+		hasher := NewLeafHasher(test.params)
+		stats := hasher.Stats()
+		if stats.MaxMidstates != test.maxMidstates {
+			t.Fatalf("%s: keeps %d midstates, want %d",
+				test.params.Name, stats.MaxMidstates,
+				test.maxMidstates)
+		}
+	}
+}
+
+// fixedHashLookup is a BlockHashLookup that returns the same hash for every
+// height without allocating.
+type fixedHashLookup struct {
+	hash chainhash.Hash
+}
+
+// BlockHashByHeight returns the hash of the lookup.
+func (l *fixedHashLookup) BlockHashByHeight(int32) (*chainhash.Hash, error) {
+	return &l.hash, nil
+}
+
+// TestDelLeavesSize ensures that the leaves of witness-heavy taproot blocks and
+// legacy multisig-heavy blocks are sized exactly from their stxos, so that
+// making them allocates nothing but the leaves regardless of how large the
+// spending transactions are.
+func TestDelLeavesSize(t *testing.T) {
+	chain, params, tearDown := utxoCacheTestChain("TestDelLeavesSize")
+	defer tearDown()
+
+	tip, spendables := AddBlock(chain, btcutil.NewBlock(params.GenesisBlock), nil)
+
+	// process generates the block of the spec on the tip from the given
+	// spendable outputs, connects it, and returns its stxos and the
+	// outputs it creates.
+	process := func(spendables []*SpendableOut, spec BlockSpec,
+		seed int64) (*btcutil.Block, []SpentTxOut, []*SpendableOut) {
+
+		t.Helper()
+
+		block, outs, err := GenerateBlockFromSpec(chain, tip, spendables,
+			spec, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = chain.ProcessBlock(block, BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tip = block
+
+		stxos, err := chain.FetchSpendJournal(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return block, stxos, outs
+	}
+
+	// Taproot isn't active on the test chain so the witnesses that the
+	// spends would have past its activation are added after the block is
+	// connected, with an annex and a large script path spend each.
+	const annexTag = 0x50
+	addAnnexes := func(block *btcutil.Block) {
+		for _, tx := range block.MsgBlock().Transactions[1:] {
+			for _, txIn := range tx.TxIn {
+				txIn.Witness = wire.TxWitness{
+					bytes.Repeat([]byte{0x51}, 10000),
+					append([]byte{0xc0}, make([]byte, 32)...),
+					append([]byte{annexTag}, make([]byte, 1000)...),
+				}
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		fanOut  ScriptType
+		spec    BlockSpec
+		witness bool
+	}{
+		{
+			name:   "witness-heavy taproot",
+			fanOut: ScriptP2TROpTrue,
+			spec: BlockSpec{
+				NumTxs:      10,
+				InputsPerTx: 10,
+				ScriptTypes: []ScriptType{ScriptP2TROpTrue},
+			},
+			witness: true,
+		},
+		{
+			name:   "legacy multisig-heavy",
+			fanOut: ScriptBareMultisig,
+			spec: BlockSpec{
+				NumTxs:         10,
+				InputsPerTx:    10,
+				SpendSameBlock: true,
+				ScriptTypes:    []ScriptType{ScriptBareMultisig},
+			},
+		},
+	}
+	lookup := new(fixedHashLookup)
+	for i, test := range tests {
+		// Spend only the outputs of the script type under test.  The
+		// first output is the coinbase of the fan out.
+		_, _, outs := process(spendables[:1], BlockSpec{
+			NumTxs:       1,
+			InputsPerTx:  1,
+			OutputsPerTx: 100,
+			ScriptTypes:  []ScriptType{test.fanOut},
+		}, int64(i*2))
+		block, stxos, _ := process(outs[1:], test.spec, int64(i*2+1))
+		spendables = append([]*SpendableOut{outs[0]}, spendables[1:]...)
+		if test.witness {
+			addAnnexes(block)
+		}
+		_, _, inskip, _ := DedupeBlock(block)
+
+		count, size := DelLeavesSize(stxos, inskip, -1)
+		dels, _, err := BlockToDelLeaves(stxos, lookup, block, inskip, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wantSize int
+		for j := range dels {
+			wantSize += dels[j].SerializeSize()
+		}
+		if count != len(dels) || size != wantSize {
+			t.Fatalf("%s: expected %d leaves of %d bytes, got %d of %d",
+				test.name, len(dels), wantSize, count, size)
+		}
+		if cap(dels) != len(dels) {
+			t.Fatalf("%s: expected the leaves to be sized exactly, "+
+				"got a capacity of %d for %d", test.name, cap(dels),
+				len(dels))
+		}
+
+		allocs := testing.AllocsPerRun(10, func() {
+			BlockToDelLeaves(stxos, lookup, block, inskip, -1)
+		})
+		if allocs != 1 {
+			t.Fatalf("%s: expected a single allocation, got %v",
+				test.name, allocs)
+		}
+
+		// Leaving out the leaves created after the block before leaves
+		// nothing.
+		count, size = DelLeavesSize(stxos, inskip, block.Height()-1)
+		if count != 0 || size != 0 {
+			t.Fatalf("%s: expected no leaves, got %d of %d bytes",
+				test.name, count, size)
+		}
+	}
+}
+
+// TestReconstructUDataEmptyInput ensures that a leaf data with a reconstructable
+// type whose spending input has nothing to reconstruct the script from is
+// rejected with an error rather than a panic.
+func TestReconstructUDataEmptyInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		pkType wire.PkType
+		txIn   wire.TxIn
+	}{
+		{
+			name:   "p2wsh with an empty witness",
+			pkType: wire.WitnessV0ScriptHashTy,
+		},
+		{
+			name:   "p2wpkh with an empty witness item",
+			pkType: wire.WitnessV0PubKeyHashTy,
+			txIn:   wire.TxIn{Witness: wire.TxWitness{{}}},
+		},
+		{
+			name:   "p2sh with an empty signature script",
+			pkType: wire.ScriptHashTy,
+			txIn:   wire.TxIn{Witness: wire.TxWitness{{0x51}}},
+		},
+		{
+			name:   "unknown type",
+			pkType: wire.PkType(0xff),
+			txIn:   wire.TxIn{SignatureScript: []byte{0x01, 0x51}},
+		},
+	}
+
+	hashByHeight := func(int32) (*chainhash.Hash, error) {
+		return &chainhash.Hash{0x01}, nil
+	}
+	for _, test := range tests {
+		coinbase := wire.NewMsgTx(1)
+		coinbase.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		})
+		coinbase.AddTxOut(&wire.TxOut{Value: 1, PkScript: []byte{0x51}})
+		tx := wire.NewMsgTx(1)
+		txIn := test.txIn
+		txIn.PreviousOutPoint = wire.OutPoint{Hash: chainhash.Hash{0x02}}
+		tx.AddTxIn(&txIn)
+		tx.AddTxOut(&wire.TxOut{Value: 1, PkScript: []byte{0x51}})
+		block := btcutil.NewBlock(&wire.MsgBlock{
+			Transactions: []*wire.MsgTx{coinbase, tx},
+		})
+
+		ud := &wire.UData{LeafDatas: []wire.LeafData{{
+			Height:                1,
+			Amount:                1,
+			ReconstructablePkType: test.pkType,
+		}}}
+		_, err := ReconstructUData(ud, block, hashByHeight,
+			chaincfg.RegressionNetParams.LeafCommitments, nil)
+		if err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+	}
+}
+
+// TestReconstructablePkTypeForInput ensures that a script is only sent as a
+// reconstructable type when the input spending it reconstructs it exactly.
+func TestReconstructablePkTypeForInput(t *testing.T) {
+	p2sh, err := ScriptP2SHOpTrue.pkScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2shSigScript, _, err := ScriptP2SHOpTrue.spendScripts(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2wsh, err := ScriptP2WSHOpTrue.pkScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, p2wshWitness, err := ScriptP2WSHOpTrue.spendScripts(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		pkScript []byte
+		txIn     wire.TxIn
+		want     wire.PkType
+	}{
+		{
+			name:     "p2sh",
+			pkScript: p2sh,
+			txIn:     wire.TxIn{SignatureScript: p2shSigScript},
+			want:     wire.ScriptHashTy,
+		},
+		{
+			name:     "p2sh with an empty signature script",
+			pkScript: p2sh,
+			want:     wire.OtherTy,
+		},
+		{
+			name:     "p2wsh",
+			pkScript: p2wsh,
+			txIn:     wire.TxIn{Witness: p2wshWitness},
+			want:     wire.WitnessV0ScriptHashTy,
+		},
+		{
+			name:     "p2wsh spent without a witness",
+			pkScript: p2wsh,
+			want:     wire.OtherTy,
+		},
+		{
+			name:     "p2wsh spent with the witness of another script",
+			pkScript: p2wsh,
+			txIn:     wire.TxIn{Witness: wire.TxWitness{{0x52}}},
+			want:     wire.OtherTy,
+		},
+		{
+			name:     "op_true",
+			pkScript: opTrueScript,
+			want:     wire.OtherTy,
+		},
+	}
+
+	for _, test := range tests {
+		txIn := test.txIn
+		got := ReconstructablePkTypeForInput(test.pkScript, &txIn)
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
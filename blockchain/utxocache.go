@@ -57,6 +57,10 @@ const (
 	pubKeyHashLen = 25
 )
 
+// MaxFlushAlignDelay is the maximum number of blocks that a periodic flush of
+// the utxo cache is postponed for to align it with the indexes.
+const MaxFlushAlignDelay = 100
+
 // txoFlags is a bitmask defining additional information and state for a
 // transaction output in a utxo view.
 type txoFlags uint8
@@ -719,22 +723,25 @@ func (s *utxoCache) Flush(mode FlushMode, bestState *BestState) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	var threshold uint64
-	switch mode {
-	case FlushRequired:
-		threshold = 0
+	if s.totalMemoryUsage() > s.flushThreshold(mode) {
+		return s.flush(bestState)
+	}
+	return nil
+}
 
+// flushThreshold returns the memory usage above which the cache is flushed for
+// the given flush mode.
+func (s *utxoCache) flushThreshold(mode FlushMode) uint64 {
+	switch mode {
 	case FlushIfNeeded:
-		threshold = s.maxTotalMemoryUsage
+		return s.maxTotalMemoryUsage
 
 	case FlushPeriodic:
-		threshold = (utxoFlushPeriodicThreshold * s.maxTotalMemoryUsage) / 100
-	}
+		return (utxoFlushPeriodicThreshold * s.maxTotalMemoryUsage) / 100
 
-	if s.totalMemoryUsage() > threshold {
-		return s.flush(bestState)
+	default:
+		return 0
 	}
-	return nil
 }
 
 // rollBackBlock rolls back the effects of the block when the state was left in
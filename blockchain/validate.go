@@ -11,6 +11,7 @@ import (
 	"math/big"
 	"time"
 
+	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
@@ -1037,12 +1038,36 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block, vi
 	//
 	// If utreexo accumulators are enabled, then check that the accumulator
 	// proof is ok.  Then convert the msgBlock.UData into UtxoViewpoint.
+	// The accumulator is only updated once every check has passed so that
+	// a rejected block leaves its roots as they were.
+	var utreexoAdds []accumulator.Leaf
 	if b.utreexoView != nil {
-		err := b.utreexoView.ProcessUData(block, b.bestChain, block.MsgBlock().UData)
+		ud := block.MsgBlock().UData
+		var utreexoDels []accumulator.Hash
+		var err error
+		utreexoAdds, utreexoDels, err = ExtractAccumulatorAddDels(block,
+			b.bestChain, ud.RememberIdx, b.chainParams.LeafCommitments,
+			b.leafHasher)
 		if err != nil {
 			return err
 		}
 
+		// For proof intervals of more than 1, the proof was already
+		// ingested before the block got here.  The same goes for the
+		// proof of a block that extended the utreexo viewpoint when
+		// it was accepted, which isn't ingested again.  The proof is
+		// checked ahead of the rest of the block since the leaf datas
+		// that the rest is checked against can't be trusted otherwise.
+		if b.utreexoView.proofInterval == 1 {
+			err = b.utreexoView.ingestBlockProof(block.Hash(),
+				utreexoDels, &ud.AccProof)
+			if err != nil {
+				str := fmt.Sprintf("the utreexo proof of block %v "+
+					"doesn't verify: %v", block.Hash(), err)
+				return ruleError(ErrUDataInvalid, str)
+			}
+		}
+
 		err = view.BlockToUtxoView(block)
 		if err != nil {
 			return err
@@ -1244,6 +1269,15 @@ func (b *BlockChain) checkConnectBlock(node *blockNode, block *btcutil.Block, vi
 		}
 	}
 
+	// Now that every other check of the block has passed, update the
+	// accumulator.
+	if b.utreexoView != nil {
+		err := b.utreexoView.Modify(block.MsgBlock().UData, utreexoAdds)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -48,6 +48,22 @@ func NewAddNodeCmd(addr string, subCmd AddNodeSubCmd) *AddNodeCmd {
 	}
 }
 
+// CompareProofCmd defines the compareproof JSON-RPC command.  The block is
+// given by either its height or its hash.
+type CompareProofCmd struct {
+	Block string
+	Proof string
+}
+
+// NewCompareProofCmd returns a new instance which can be used to issue a
+// compareproof JSON-RPC command.
+func NewCompareProofCmd(block, proof string) *CompareProofCmd {
+	return &CompareProofCmd{
+		Block: block,
+		Proof: proof,
+	}
+}
+
 // TransactionInput represents the inputs to a transaction.  Specifically a
 // transaction hash and output number pair.
 type TransactionInput struct {
@@ -122,6 +138,21 @@ func NewDeriveAddressesCmd(descriptor string, descriptorRange *DescriptorRange)
 	}
 }
 
+// EstimateProofSizeCmd defines the estimateproofsize JSON-RPC command.
+type EstimateProofSizeCmd struct {
+	Txids []string
+	Vouts []uint32
+}
+
+// NewEstimateProofSizeCmd returns a new instance which can be used to issue an
+// estimateproofsize JSON-RPC command.
+func NewEstimateProofSizeCmd(txids []string, vouts []uint32) *EstimateProofSizeCmd {
+	return &EstimateProofSizeCmd{
+		Txids: txids,
+		Vouts: vouts,
+	}
+}
+
 // ChangeType defines the different output types to use for the change address
 // of a transaction built by the node.
 type ChangeType string
@@ -352,6 +383,11 @@ type TemplateRequest struct {
 	Data   string `json:"data,omitempty"`
 	WorkID string `json:"workid,omitempty"`
 
+	// Optional utreexo preview of a block proposal.  UtreexoDeadline is the
+	// number of milliseconds the preview may take and the preview is only
+	// done when it's set.
+	UtreexoDeadline int64 `json:"utreexodeadline,omitempty"`
+
 	// list of supported softfork deployments, by name
 	// Ref: https://en.bitcoin.it/wiki/BIP_0009#getblocktemplate_changes.
 	Rules []string `json:"rules,omitempty"`
@@ -527,6 +563,15 @@ func NewGetHashesPerSecCmd() *GetHashesPerSecCmd {
 	return &GetHashesPerSecCmd{}
 }
 
+// GetIndexInfoCmd defines the getindexinfo JSON-RPC command.
+type GetIndexInfoCmd struct{}
+
+// NewGetIndexInfoCmd returns a new instance which can be used to issue a
+// getindexinfo JSON-RPC command.
+func NewGetIndexInfoCmd() *GetIndexInfoCmd {
+	return &GetIndexInfoCmd{}
+}
+
 // GetInfoCmd defines the getinfo JSON-RPC command.
 type GetInfoCmd struct{}
 
@@ -739,6 +784,156 @@ func NewGetTxOutSetInfoCmd() *GetTxOutSetInfoCmd {
 	return &GetTxOutSetInfoCmd{}
 }
 
+// GetProofServingStatsCmd defines the getproofservingstats JSON-RPC command.
+type GetProofServingStatsCmd struct {
+	TargetPercent *float64 `jsonrpcdefault:"99"`
+	Windows       *[]int64
+}
+
+// NewGetProofServingStatsCmd returns a new instance which can be used to issue
+// a getproofservingstats JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewGetProofServingStatsCmd(targetPercent *float64, windows *[]int64) *GetProofServingStatsCmd {
+	return &GetProofServingStatsCmd{
+		TargetPercent: targetPercent,
+		Windows:       windows,
+	}
+}
+
+// GetProofSourceScoresCmd defines the getproofsourcescores JSON-RPC command.
+type GetProofSourceScoresCmd struct{}
+
+// NewGetProofSourceScoresCmd returns a new instance which can be used to issue
+// a getproofsourcescores JSON-RPC command.
+func NewGetProofSourceScoresCmd() *GetProofSourceScoresCmd {
+	return &GetProofSourceScoresCmd{}
+}
+
+// GetProofWatchdogStatsCmd defines the getproofwatchdogstats JSON-RPC command.
+type GetProofWatchdogStatsCmd struct{}
+
+// NewGetProofWatchdogStatsCmd returns a new instance which can be used to issue
+// a getproofwatchdogstats JSON-RPC command.
+func NewGetProofWatchdogStatsCmd() *GetProofWatchdogStatsCmd {
+	return &GetProofWatchdogStatsCmd{}
+}
+
+// GetUtreexoCapabilitiesCmd defines the getutreexocapabilities JSON-RPC
+// command.
+type GetUtreexoCapabilitiesCmd struct{}
+
+// NewGetUtreexoCapabilitiesCmd returns a new instance which can be used to
+// issue a getutreexocapabilities JSON-RPC command.
+func NewGetUtreexoCapabilitiesCmd() *GetUtreexoCapabilitiesCmd {
+	return &GetUtreexoCapabilitiesCmd{}
+}
+
+// GetUtreexoCoinAgeStatsCmd defines the getutreexocoinagestats JSON-RPC
+// command.
+type GetUtreexoCoinAgeStatsCmd struct {
+	StartHeight int32
+	EndHeight   int32
+	Verbose     *bool `jsonrpcdefault:"false"`
+}
+
+// NewGetUtreexoCoinAgeStatsCmd returns a new instance which can be used to
+// issue a getutreexocoinagestats JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewGetUtreexoCoinAgeStatsCmd(startHeight, endHeight int32,
+	verbose *bool) *GetUtreexoCoinAgeStatsCmd {
+
+	return &GetUtreexoCoinAgeStatsCmd{
+		StartHeight: startHeight,
+		EndHeight:   endHeight,
+		Verbose:     verbose,
+	}
+}
+
+// GetUtreexoProofCostCmd defines the getutreexoproofcost JSON-RPC command.
+type GetUtreexoProofCostCmd struct {
+	StartHeight int32
+	EndHeight   int32
+	CSV         *bool `jsonrpcdefault:"false"`
+}
+
+// NewGetUtreexoProofCostCmd returns a new instance which can be used to issue
+// a getutreexoproofcost JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewGetUtreexoProofCostCmd(startHeight, endHeight int32,
+	csv *bool) *GetUtreexoProofCostCmd {
+
+	return &GetUtreexoProofCostCmd{
+		StartHeight: startHeight,
+		EndHeight:   endHeight,
+		CSV:         csv,
+	}
+}
+
+// GetUtreexoStateCmd defines the getutreexostate JSON-RPC command.
+type GetUtreexoStateCmd struct{}
+
+// NewGetUtreexoStateCmd returns a new instance which can be used to issue a
+// getutreexostate JSON-RPC command.
+func NewGetUtreexoStateCmd() *GetUtreexoStateCmd {
+	return &GetUtreexoStateCmd{}
+}
+
+// GetUtreexoProofCmd defines the getutreexoproof JSON-RPC command.
+type GetUtreexoProofCmd struct {
+	Txid      string
+	Vout      uint32
+	BlockHash string
+	Verbose   *bool `jsonrpcdefault:"false"`
+}
+
+// NewGetUtreexoProofCmd returns a new instance which can be used to issue a
+// getutreexoproof JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewGetUtreexoProofCmd(txHash string, vout uint32, blockHash string,
+	verbose *bool) *GetUtreexoProofCmd {
+
+	return &GetUtreexoProofCmd{
+		Txid:      txHash,
+		Vout:      vout,
+		BlockHash: blockHash,
+		Verbose:   verbose,
+	}
+}
+
+// GetUtreexoProofsCmd defines the getutreexoproofs JSON-RPC command.
+type GetUtreexoProofsCmd struct {
+	StartHeight int32
+	Count       *int32 `jsonrpcdefault:"100"`
+	Cursor      *string
+	Verbose     *bool `jsonrpcdefault:"false"`
+	Receipt     *bool `jsonrpcdefault:"false"`
+}
+
+// NewGetUtreexoProofsCmd returns a new instance which can be used to issue a
+// getutreexoproofs JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewGetUtreexoProofsCmd(startHeight int32, count *int32, cursor *string,
+	verbose, receipt *bool) *GetUtreexoProofsCmd {
+
+	return &GetUtreexoProofsCmd{
+		StartHeight: startHeight,
+		Count:       count,
+		Cursor:      cursor,
+		Verbose:     verbose,
+		Receipt:     receipt,
+	}
+}
+
 // GetWorkCmd defines the getwork JSON-RPC command.
 type GetWorkCmd struct {
 	Data *string
@@ -784,6 +979,15 @@ func NewInvalidateBlockCmd(blockHash string) *InvalidateBlockCmd {
 	}
 }
 
+// ListUtreexoPinsCmd defines the listutreexopins JSON-RPC command.
+type ListUtreexoPinsCmd struct{}
+
+// NewListUtreexoPinsCmd returns a new instance which can be used to issue a
+// listutreexopins JSON-RPC command.
+func NewListUtreexoPinsCmd() *ListUtreexoPinsCmd {
+	return &ListUtreexoPinsCmd{}
+}
+
 // PingCmd defines the ping JSON-RPC command.
 type PingCmd struct{}
 
@@ -793,6 +997,24 @@ func NewPingCmd() *PingCmd {
 	return &PingCmd{}
 }
 
+// PinUtreexoProofCmd defines the pinutreexoproof JSON-RPC command.
+type PinUtreexoProofCmd struct {
+	Heights []int32
+	Label   *string `jsonrpcdefault:"\"\""`
+}
+
+// NewPinUtreexoProofCmd returns a new instance which can be used to issue a
+// pinutreexoproof JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewPinUtreexoProofCmd(heights []int32, label *string) *PinUtreexoProofCmd {
+	return &PinUtreexoProofCmd{
+		Heights: heights,
+		Label:   label,
+	}
+}
+
 // PreciousBlockCmd defines the preciousblock JSON-RPC command.
 type PreciousBlockCmd struct {
 	BlockHash string
@@ -1018,6 +1240,19 @@ func NewSubmitBlockCmd(hexBlock string, options *SubmitBlockOptions) *SubmitBloc
 	}
 }
 
+// UnpinUtreexoProofCmd defines the unpinutreexoproof JSON-RPC command.
+type UnpinUtreexoProofCmd struct {
+	Heights []int32
+}
+
+// NewUnpinUtreexoProofCmd returns a new instance which can be used to issue an
+// unpinutreexoproof JSON-RPC command.
+func NewUnpinUtreexoProofCmd(heights []int32) *UnpinUtreexoProofCmd {
+	return &UnpinUtreexoProofCmd{
+		Heights: heights,
+	}
+}
+
 // UptimeCmd defines the uptime JSON-RPC command.
 type UptimeCmd struct{}
 
@@ -1087,6 +1322,89 @@ func NewVerifyTxOutProofCmd(proof string) *VerifyTxOutProofCmd {
 	}
 }
 
+// VerifyUndoBlocksCmd defines the verifyundoblocks JSON-RPC command.
+type VerifyUndoBlocksCmd struct {
+	StartHeight int32
+	EndHeight   *int32
+}
+
+// NewVerifyUndoBlocksCmd returns a new instance which can be used to issue a
+// verifyundoblocks JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewVerifyUndoBlocksCmd(startHeight int32, endHeight *int32) *VerifyUndoBlocksCmd {
+	return &VerifyUndoBlocksCmd{
+		StartHeight: startHeight,
+		EndHeight:   endHeight,
+	}
+}
+
+// VerifyProofReceiptCmd defines the verifyproofreceipt JSON-RPC command.
+type VerifyProofReceiptCmd struct {
+	RequestID string
+	BlockHash string
+	UDataHash string
+	Timestamp int64
+	Signature string
+}
+
+// NewVerifyProofReceiptCmd returns a new instance which can be used to issue a
+// verifyproofreceipt JSON-RPC command.
+func NewVerifyProofReceiptCmd(requestID, blockHash, udataHash string,
+	timestamp int64, signature string) *VerifyProofReceiptCmd {
+
+	return &VerifyProofReceiptCmd{
+		RequestID: requestID,
+		BlockHash: blockHash,
+		UDataHash: udataHash,
+		Timestamp: timestamp,
+		Signature: signature,
+	}
+}
+
+// VerifyUtreexoIndexesCmd defines the verifyutreexoindexes JSON-RPC command.
+type VerifyUtreexoIndexesCmd struct {
+	StartHeight int32
+	EndHeight   *int32
+}
+
+// NewVerifyUtreexoIndexesCmd returns a new instance which can be used to issue
+// a verifyutreexoindexes JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewVerifyUtreexoIndexesCmd(startHeight int32,
+	endHeight *int32) *VerifyUtreexoIndexesCmd {
+
+	return &VerifyUtreexoIndexesCmd{
+		StartHeight: startHeight,
+		EndHeight:   endHeight,
+	}
+}
+
+// VerifyUtreexoProofsCmd defines the verifyutreexoproofs JSON-RPC command.
+type VerifyUtreexoProofsCmd struct {
+	StartHeight int32
+	EndHeight   *int32
+	Repair      *bool `jsonrpcdefault:"false"`
+}
+
+// NewVerifyUtreexoProofsCmd returns a new instance which can be used to issue
+// a verifyutreexoproofs JSON-RPC command.
+//
+// The parameters which are pointers indicate they are optional.  Passing nil
+// for optional parameters will use the default value.
+func NewVerifyUtreexoProofsCmd(startHeight int32, endHeight *int32,
+	repair *bool) *VerifyUtreexoProofsCmd {
+
+	return &VerifyUtreexoProofsCmd{
+		StartHeight: startHeight,
+		EndHeight:   endHeight,
+		Repair:      repair,
+	}
+}
+
 // VerifyUtxoChainTipInclusionProofCmd defines the verifyutxochaintipinclusionproof JSON-RPC
 // command.
 type VerifyUtxoChainTipInclusionProofCmd struct {
@@ -1098,10 +1416,12 @@ func init() {
 	flags := UsageFlag(0)
 
 	MustRegisterCmd("addnode", (*AddNodeCmd)(nil), flags)
+	MustRegisterCmd("compareproof", (*CompareProofCmd)(nil), flags)
 	MustRegisterCmd("createrawtransaction", (*CreateRawTransactionCmd)(nil), flags)
 	MustRegisterCmd("decoderawtransaction", (*DecodeRawTransactionCmd)(nil), flags)
 	MustRegisterCmd("decodescript", (*DecodeScriptCmd)(nil), flags)
 	MustRegisterCmd("deriveaddresses", (*DeriveAddressesCmd)(nil), flags)
+	MustRegisterCmd("estimateproofsize", (*EstimateProofSizeCmd)(nil), flags)
 	MustRegisterCmd("fundrawtransaction", (*FundRawTransactionCmd)(nil), flags)
 	MustRegisterCmd("getaddednodeinfo", (*GetAddedNodeInfoCmd)(nil), flags)
 	MustRegisterCmd("getbestblockhash", (*GetBestBlockHashCmd)(nil), flags)
@@ -1122,6 +1442,7 @@ func init() {
 	MustRegisterCmd("getdifficulty", (*GetDifficultyCmd)(nil), flags)
 	MustRegisterCmd("getgenerate", (*GetGenerateCmd)(nil), flags)
 	MustRegisterCmd("gethashespersec", (*GetHashesPerSecCmd)(nil), flags)
+	MustRegisterCmd("getindexinfo", (*GetIndexInfoCmd)(nil), flags)
 	MustRegisterCmd("getinfo", (*GetInfoCmd)(nil), flags)
 	MustRegisterCmd("getmempoolentry", (*GetMempoolEntryCmd)(nil), flags)
 	MustRegisterCmd("getmempoolinfo", (*GetMempoolInfoCmd)(nil), flags)
@@ -1132,16 +1453,27 @@ func init() {
 	MustRegisterCmd("getnetworkhashps", (*GetNetworkHashPSCmd)(nil), flags)
 	MustRegisterCmd("getnodeaddresses", (*GetNodeAddressesCmd)(nil), flags)
 	MustRegisterCmd("getpeerinfo", (*GetPeerInfoCmd)(nil), flags)
+	MustRegisterCmd("getproofservingstats", (*GetProofServingStatsCmd)(nil), flags)
+	MustRegisterCmd("getproofsourcescores", (*GetProofSourceScoresCmd)(nil), flags)
+	MustRegisterCmd("getproofwatchdogstats", (*GetProofWatchdogStatsCmd)(nil), flags)
 	MustRegisterCmd("getrawmempool", (*GetRawMempoolCmd)(nil), flags)
 	MustRegisterCmd("getrawtransaction", (*GetRawTransactionCmd)(nil), flags)
 	MustRegisterCmd("getttl", (*GetTTLCmd)(nil), flags)
 	MustRegisterCmd("gettxout", (*GetTxOutCmd)(nil), flags)
 	MustRegisterCmd("gettxoutproof", (*GetTxOutProofCmd)(nil), flags)
 	MustRegisterCmd("gettxoutsetinfo", (*GetTxOutSetInfoCmd)(nil), flags)
+	MustRegisterCmd("getutreexocapabilities", (*GetUtreexoCapabilitiesCmd)(nil), flags)
+	MustRegisterCmd("getutreexocoinagestats", (*GetUtreexoCoinAgeStatsCmd)(nil), flags)
+	MustRegisterCmd("getutreexoproofcost", (*GetUtreexoProofCostCmd)(nil), flags)
+	MustRegisterCmd("getutreexoproof", (*GetUtreexoProofCmd)(nil), flags)
+	MustRegisterCmd("getutreexoproofs", (*GetUtreexoProofsCmd)(nil), flags)
+	MustRegisterCmd("getutreexostate", (*GetUtreexoStateCmd)(nil), flags)
 	MustRegisterCmd("getwork", (*GetWorkCmd)(nil), flags)
 	MustRegisterCmd("help", (*HelpCmd)(nil), flags)
 	MustRegisterCmd("invalidateblock", (*InvalidateBlockCmd)(nil), flags)
+	MustRegisterCmd("listutreexopins", (*ListUtreexoPinsCmd)(nil), flags)
 	MustRegisterCmd("ping", (*PingCmd)(nil), flags)
+	MustRegisterCmd("pinutreexoproof", (*PinUtreexoProofCmd)(nil), flags)
 	MustRegisterCmd("preciousblock", (*PreciousBlockCmd)(nil), flags)
 	MustRegisterCmd("proveutxochaintipinclusion", (*ProveUtxoChainTipInclusionCmd)(nil), flags)
 	MustRegisterCmd("reconsiderblock", (*ReconsiderBlockCmd)(nil), flags)
@@ -1151,10 +1483,15 @@ func init() {
 	MustRegisterCmd("signmessagewithprivkey", (*SignMessageWithPrivKeyCmd)(nil), flags)
 	MustRegisterCmd("stop", (*StopCmd)(nil), flags)
 	MustRegisterCmd("submitblock", (*SubmitBlockCmd)(nil), flags)
+	MustRegisterCmd("unpinutreexoproof", (*UnpinUtreexoProofCmd)(nil), flags)
 	MustRegisterCmd("uptime", (*UptimeCmd)(nil), flags)
 	MustRegisterCmd("validateaddress", (*ValidateAddressCmd)(nil), flags)
 	MustRegisterCmd("verifychain", (*VerifyChainCmd)(nil), flags)
 	MustRegisterCmd("verifymessage", (*VerifyMessageCmd)(nil), flags)
+	MustRegisterCmd("verifyproofreceipt", (*VerifyProofReceiptCmd)(nil), flags)
 	MustRegisterCmd("verifytxoutproof", (*VerifyTxOutProofCmd)(nil), flags)
+	MustRegisterCmd("verifyundoblocks", (*VerifyUndoBlocksCmd)(nil), flags)
+	MustRegisterCmd("verifyutreexoindexes", (*VerifyUtreexoIndexesCmd)(nil), flags)
+	MustRegisterCmd("verifyutreexoproofs", (*VerifyUtreexoProofsCmd)(nil), flags)
 	MustRegisterCmd("verifyutxochaintipinclusionproof", (*VerifyUtxoChainTipInclusionProofCmd)(nil), flags)
 }
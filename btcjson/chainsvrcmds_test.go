@@ -42,6 +42,34 @@ func TestChainSvrCmds(t *testing.T) {
 			marshalled:   `{"jsonrpc":"1.0","method":"addnode","params":["127.0.0.1","remove"],"id":1}`,
 			unmarshalled: &btcjson.AddNodeCmd{Addr: "127.0.0.1", SubCmd: btcjson.ANRemove},
 		},
+		{
+			name: "compareproof height",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("compareproof", "123", "00")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewCompareProofCmd("123", "00")
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"compareproof","params":["123","00"],"id":1}`,
+			unmarshalled: &btcjson.CompareProofCmd{
+				Block: "123",
+				Proof: "00",
+			},
+		},
+		{
+			name: "compareproof hash",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("compareproof", "deadbeef", "00")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewCompareProofCmd("deadbeef", "00")
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"compareproof","params":["deadbeef","00"],"id":1}`,
+			unmarshalled: &btcjson.CompareProofCmd{
+				Block: "deadbeef",
+				Proof: "00",
+			},
+		},
 		{
 			name: "createrawtransaction",
 			newCmd: func() (interface{}, error) {
@@ -96,6 +124,20 @@ func TestChainSvrCmds(t *testing.T) {
 				LockTime: btcjson.Int64(12312333333),
 			},
 		},
+		{
+			name: "estimateproofsize",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("estimateproofsize", `["012345","6789"]`, "[0,1]")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewEstimateProofSizeCmd([]string{"012345", "6789"}, []uint32{0, 1})
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"estimateproofsize","params":[["012345","6789"],[0,1]],"id":1}`,
+			unmarshalled: &btcjson.EstimateProofSizeCmd{
+				Txids: []string{"012345", "6789"},
+				Vouts: []uint32{0, 1},
+			},
+		},
 		{
 			name: "fundrawtransaction - empty opts",
 			newCmd: func() (i interface{}, e error) {
@@ -563,6 +605,28 @@ func TestChainSvrCmds(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "getblocktemplate optional - proposal request with utreexo deadline",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getblocktemplate", `{"mode":"proposal","data":"00","utreexodeadline":250}`)
+			},
+			staticCmd: func() interface{} {
+				template := btcjson.TemplateRequest{
+					Mode:            "proposal",
+					Data:            "00",
+					UtreexoDeadline: 250,
+				}
+				return btcjson.NewGetBlockTemplateCmd(&template)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getblocktemplate","params":[{"mode":"proposal","data":"00","utreexodeadline":250}],"id":1}`,
+			unmarshalled: &btcjson.GetBlockTemplateCmd{
+				Request: &btcjson.TemplateRequest{
+					Mode:            "proposal",
+					Data:            "00",
+					UtreexoDeadline: 250,
+				},
+			},
+		},
 		{
 			name: "getcfilter",
 			newCmd: func() (interface{}, error) {
@@ -688,6 +752,17 @@ func TestChainSvrCmds(t *testing.T) {
 			marshalled:   `{"jsonrpc":"1.0","method":"gethashespersec","params":[],"id":1}`,
 			unmarshalled: &btcjson.GetHashesPerSecCmd{},
 		},
+		{
+			name: "getindexinfo",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getindexinfo")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetIndexInfoCmd()
+			},
+			marshalled:   `{"jsonrpc":"1.0","method":"getindexinfo","params":[],"id":1}`,
+			unmarshalled: &btcjson.GetIndexInfoCmd{},
+		},
 		{
 			name: "getinfo",
 			newCmd: func() (interface{}, error) {
@@ -835,6 +910,56 @@ func TestChainSvrCmds(t *testing.T) {
 			marshalled:   `{"jsonrpc":"1.0","method":"getpeerinfo","params":[],"id":1}`,
 			unmarshalled: &btcjson.GetPeerInfoCmd{},
 		},
+		{
+			name: "getproofservingstats",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getproofservingstats")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetProofServingStatsCmd(nil, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getproofservingstats","params":[],"id":1}`,
+			unmarshalled: &btcjson.GetProofServingStatsCmd{
+				TargetPercent: btcjson.Float64(99),
+			},
+		},
+		{
+			name: "getproofservingstats optional",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getproofservingstats", 90.5, []int64{3600, 86400})
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetProofServingStatsCmd(btcjson.Float64(90.5),
+					&[]int64{3600, 86400})
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getproofservingstats","params":[90.5,[3600,86400]],"id":1}`,
+			unmarshalled: &btcjson.GetProofServingStatsCmd{
+				TargetPercent: btcjson.Float64(90.5),
+				Windows:       &[]int64{3600, 86400},
+			},
+		},
+		{
+			name: "getproofsourcescores",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getproofsourcescores")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetProofSourceScoresCmd()
+			},
+			marshalled:   `{"jsonrpc":"1.0","method":"getproofsourcescores","params":[],"id":1}`,
+			unmarshalled: &btcjson.GetProofSourceScoresCmd{},
+		},
+		{
+			name: "getproofwatchdogstats",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getproofwatchdogstats")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetProofWatchdogStatsCmd()
+			},
+			marshalled:   `{"jsonrpc":"1.0","method":"getproofwatchdogstats","params":[],"id":1}`,
+			unmarshalled: &btcjson.GetProofWatchdogStatsCmd{},
+		},
 		{
 			name: "getrawmempool",
 			newCmd: func() (interface{}, error) {
@@ -960,6 +1085,187 @@ func TestChainSvrCmds(t *testing.T) {
 			marshalled:   `{"jsonrpc":"1.0","method":"gettxoutsetinfo","params":[],"id":1}`,
 			unmarshalled: &btcjson.GetTxOutSetInfoCmd{},
 		},
+		{
+			name: "getutreexocapabilities",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexocapabilities")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoCapabilitiesCmd()
+			},
+			marshalled:   `{"jsonrpc":"1.0","method":"getutreexocapabilities","params":[],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoCapabilitiesCmd{},
+		},
+		{
+			name: "getutreexocoinagestats",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexocoinagestats", 10, 20)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoCoinAgeStatsCmd(10, 20, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexocoinagestats","params":[10,20],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoCoinAgeStatsCmd{
+				StartHeight: 10,
+				EndHeight:   20,
+				Verbose:     btcjson.Bool(false),
+			},
+		},
+		{
+			name: "getutreexocoinagestats verbose",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexocoinagestats", 10, 20, true)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoCoinAgeStatsCmd(10, 20, btcjson.Bool(true))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexocoinagestats","params":[10,20,true],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoCoinAgeStatsCmd{
+				StartHeight: 10,
+				EndHeight:   20,
+				Verbose:     btcjson.Bool(true),
+			},
+		},
+		{
+			name: "getutreexoproofcost",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproofcost", 10, 20)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofCostCmd(10, 20, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproofcost","params":[10,20],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofCostCmd{
+				StartHeight: 10,
+				EndHeight:   20,
+				CSV:         btcjson.Bool(false),
+			},
+		},
+		{
+			name: "getutreexoproofcost csv",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproofcost", 10, 20, true)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofCostCmd(10, 20, btcjson.Bool(true))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproofcost","params":[10,20,true],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofCostCmd{
+				StartHeight: 10,
+				EndHeight:   20,
+				CSV:         btcjson.Bool(true),
+			},
+		},
+		{
+			name: "getutreexoproof",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproof", "123", 1, "456")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofCmd("123", 1, "456", nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproof","params":["123",1,"456"],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofCmd{
+				Txid:      "123",
+				Vout:      1,
+				BlockHash: "456",
+				Verbose:   btcjson.Bool(false),
+			},
+		},
+		{
+			name: "getutreexoproof verbose",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproof", "123", 1, "456", true)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofCmd("123", 1, "456", btcjson.Bool(true))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproof","params":["123",1,"456",true],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofCmd{
+				Txid:      "123",
+				Vout:      1,
+				BlockHash: "456",
+				Verbose:   btcjson.Bool(true),
+			},
+		},
+		{
+			name: "getutreexoproofs",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproofs", 1)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofsCmd(1, nil, nil, nil, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproofs","params":[1],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofsCmd{
+				StartHeight: 1,
+				Count:       btcjson.Int32(100),
+				Verbose:     btcjson.Bool(false),
+				Receipt:     btcjson.Bool(false),
+			},
+		},
+		{
+			name: "getutreexoproofs cursor",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproofs", 0, 10, "0102")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofsCmd(0, btcjson.Int32(10), btcjson.String("0102"), nil, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproofs","params":[0,10,"0102"],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofsCmd{
+				StartHeight: 0,
+				Count:       btcjson.Int32(10),
+				Cursor:      btcjson.String("0102"),
+				Verbose:     btcjson.Bool(false),
+				Receipt:     btcjson.Bool(false),
+			},
+		},
+		{
+			name: "getutreexoproofs verbose",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproofs", 0, 10, "0102", true)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofsCmd(0, btcjson.Int32(10), btcjson.String("0102"), btcjson.Bool(true), nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproofs","params":[0,10,"0102",true],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofsCmd{
+				StartHeight: 0,
+				Count:       btcjson.Int32(10),
+				Cursor:      btcjson.String("0102"),
+				Verbose:     btcjson.Bool(true),
+				Receipt:     btcjson.Bool(false),
+			},
+		},
+		{
+			name: "getutreexoproofs receipt",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexoproofs", 0, 10, "0102", false, true)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoProofsCmd(0, btcjson.Int32(10), btcjson.String("0102"), btcjson.Bool(false), btcjson.Bool(true))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"getutreexoproofs","params":[0,10,"0102",false,true],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoProofsCmd{
+				StartHeight: 0,
+				Count:       btcjson.Int32(10),
+				Cursor:      btcjson.String("0102"),
+				Verbose:     btcjson.Bool(false),
+				Receipt:     btcjson.Bool(true),
+			},
+		},
+		{
+			name: "getutreexostate",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("getutreexostate")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewGetUtreexoStateCmd()
+			},
+			marshalled:   `{"jsonrpc":"1.0","method":"getutreexostate","params":[],"id":1}`,
+			unmarshalled: &btcjson.GetUtreexoStateCmd{},
+		},
 		{
 			name: "getwork",
 			newCmd: func() (interface{}, error) {
@@ -1025,6 +1331,17 @@ func TestChainSvrCmds(t *testing.T) {
 				BlockHash: "123",
 			},
 		},
+		{
+			name: "listutreexopins",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("listutreexopins")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewListUtreexoPinsCmd()
+			},
+			marshalled:   `{"jsonrpc":"1.0","method":"listutreexopins","params":[],"id":1}`,
+			unmarshalled: &btcjson.ListUtreexoPinsCmd{},
+		},
 		{
 			name: "ping",
 			newCmd: func() (interface{}, error) {
@@ -1036,6 +1353,35 @@ func TestChainSvrCmds(t *testing.T) {
 			marshalled:   `{"jsonrpc":"1.0","method":"ping","params":[],"id":1}`,
 			unmarshalled: &btcjson.PingCmd{},
 		},
+		{
+			name: "pinutreexoproof",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("pinutreexoproof", []int32{10, 20}, "audit")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewPinUtreexoProofCmd([]int32{10, 20},
+					btcjson.String("audit"))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"pinutreexoproof","params":[[10,20],"audit"],"id":1}`,
+			unmarshalled: &btcjson.PinUtreexoProofCmd{
+				Heights: []int32{10, 20},
+				Label:   btcjson.String("audit"),
+			},
+		},
+		{
+			name: "pinutreexoproof optional",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("pinutreexoproof", []int32{10})
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewPinUtreexoProofCmd([]int32{10}, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"pinutreexoproof","params":[[10]],"id":1}`,
+			unmarshalled: &btcjson.PinUtreexoProofCmd{
+				Heights: []int32{10},
+				Label:   btcjson.String(""),
+			},
+		},
 		{
 			name: "preciousblock",
 			newCmd: func() (interface{}, error) {
@@ -1385,6 +1731,19 @@ func TestChainSvrCmds(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "unpinutreexoproof",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("unpinutreexoproof", []int32{10, 20})
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewUnpinUtreexoProofCmd([]int32{10, 20})
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"unpinutreexoproof","params":[[10,20]],"id":1}`,
+			unmarshalled: &btcjson.UnpinUtreexoProofCmd{
+				Heights: []int32{10, 20},
+			},
+		},
 		{
 			name: "uptime",
 			newCmd: func() (interface{}, error) {
@@ -1466,6 +1825,107 @@ func TestChainSvrCmds(t *testing.T) {
 				Message:   "test",
 			},
 		},
+		{
+			name: "verifyproofreceipt",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("verifyproofreceipt", "01", "02", "03", 1600000000, "04")
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewVerifyProofReceiptCmd("01", "02", "03", 1600000000, "04")
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"verifyproofreceipt","params":["01","02","03",1600000000,"04"],"id":1}`,
+			unmarshalled: &btcjson.VerifyProofReceiptCmd{
+				RequestID: "01",
+				BlockHash: "02",
+				UDataHash: "03",
+				Timestamp: 1600000000,
+				Signature: "04",
+			},
+		},
+		{
+			name: "verifyundoblocks",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("verifyundoblocks", 10, 20)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewVerifyUndoBlocksCmd(10, btcjson.Int32(20))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"verifyundoblocks","params":[10,20],"id":1}`,
+			unmarshalled: &btcjson.VerifyUndoBlocksCmd{
+				StartHeight: 10,
+				EndHeight:   btcjson.Int32(20),
+			},
+		},
+		{
+			name: "verifyundoblocks optional",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("verifyundoblocks", 10)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewVerifyUndoBlocksCmd(10, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"verifyundoblocks","params":[10],"id":1}`,
+			unmarshalled: &btcjson.VerifyUndoBlocksCmd{
+				StartHeight: 10,
+			},
+		},
+		{
+			name: "verifyutreexoindexes",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("verifyutreexoindexes", 10, 20)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewVerifyUtreexoIndexesCmd(10, btcjson.Int32(20))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"verifyutreexoindexes","params":[10,20],"id":1}`,
+			unmarshalled: &btcjson.VerifyUtreexoIndexesCmd{
+				StartHeight: 10,
+				EndHeight:   btcjson.Int32(20),
+			},
+		},
+		{
+			name: "verifyutreexoindexes optional",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("verifyutreexoindexes", 10)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewVerifyUtreexoIndexesCmd(10, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"verifyutreexoindexes","params":[10],"id":1}`,
+			unmarshalled: &btcjson.VerifyUtreexoIndexesCmd{
+				StartHeight: 10,
+			},
+		},
+		{
+			name: "verifyutreexoproofs",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("verifyutreexoproofs", 10, 20, true)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewVerifyUtreexoProofsCmd(10, btcjson.Int32(20),
+					btcjson.Bool(true))
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"verifyutreexoproofs","params":[10,20,true],"id":1}`,
+			unmarshalled: &btcjson.VerifyUtreexoProofsCmd{
+				StartHeight: 10,
+				EndHeight:   btcjson.Int32(20),
+				Repair:      btcjson.Bool(true),
+			},
+		},
+		{
+			name: "verifyutreexoproofs optional",
+			newCmd: func() (interface{}, error) {
+				return btcjson.NewCmd("verifyutreexoproofs", 10)
+			},
+			staticCmd: func() interface{} {
+				return btcjson.NewVerifyUtreexoProofsCmd(10, nil, nil)
+			},
+			marshalled: `{"jsonrpc":"1.0","method":"verifyutreexoproofs","params":[10],"id":1}`,
+			unmarshalled: &btcjson.VerifyUtreexoProofsCmd{
+				StartHeight: 10,
+				Repair:      btcjson.Bool(false),
+			},
+		},
 		{
 			name: "verifytxoutproof",
 			newCmd: func() (interface{}, error) {
@@ -229,6 +229,46 @@ type GetBlockChainInfoResult struct {
 	SizeOnDisk           int64   `json:"size_on_disk,omitempty"`
 	*SoftForks
 	*UnifiedSoftForks
+
+	// Utreexo is only set on bridges and on utreexo nodes.
+	Utreexo *UtreexoChainInfoResult `json:"utreexo,omitempty"`
+}
+
+// UtreexoChainInfoVersion is the version of the layout of the utreexo section
+// of the getblockchaininfo command.  It's bumped whenever a field of the
+// section is renamed, removed, or changes its meaning.  Fields are only added
+// without bumping it.
+const UtreexoChainInfoVersion = 1
+
+// UtreexoChainInfoResult models the utreexo section of the data returned from
+// the getblockchaininfo command and the data returned from the getutreexostate
+// command.  Every field is always present.
+type UtreexoChainInfoResult struct {
+	Version   int32                     `json:"version"`
+	Mode      string                    `json:"mode"`
+	Height    int32                     `json:"height"`
+	NumLeaves uint64                    `json:"numleaves"`
+	Roots     []string                  `json:"roots"`
+	Indexes   []UtreexoIndexStateResult `json:"indexes"`
+	Servable  []HeightRangeResult       `json:"servable"`
+	Degraded  bool                      `json:"degraded"`
+	NumRoots  int                       `json:"numroots"`
+	NumHashes uint64                    `json:"numhashes"`
+}
+
+// UtreexoIndexStateResult models the state of a utreexo proof index in the
+// utreexo section of the getblockchaininfo command.
+type UtreexoIndexStateResult struct {
+	Name          string              `json:"name"`
+	Height        int32               `json:"height"`
+	NumLeaves     uint64              `json:"numleaves"`
+	Roots         []string            `json:"roots"`
+	Degraded      bool                `json:"degraded"`
+	DurableHeight int32               `json:"durableheight"`
+	Cause         string              `json:"cause"`
+	Servable      []HeightRangeResult `json:"servable"`
+	NumRoots      int                 `json:"numroots"`
+	NumHashes     uint64              `json:"numhashes"`
 }
 
 // GetBlockFilterResult models the data returned from the getblockfilter
@@ -298,6 +338,20 @@ type GetBlockTemplateResult struct {
 	RejectReasion string   `json:"reject-reason,omitempty"`
 }
 
+// UtreexoPreviewResult models the utreexo preview of a block proposal.
+type UtreexoPreviewResult struct {
+	Complete bool     `json:"complete"`
+	Checks   []string `json:"checks"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// GetBlockTemplateProposalResult models the data returned from the
+// getblocktemplate command for a block proposal with a utreexo deadline.
+type GetBlockTemplateProposalResult struct {
+	RejectReason string                `json:"reject-reason,omitempty"`
+	Utreexo      *UtreexoPreviewResult `json:"utreexo,omitempty"`
+}
+
 // GetMempoolEntryResult models the data returned from the getmempoolentry's
 // fee field
 
@@ -859,14 +913,491 @@ type DumpWalletResult struct {
 	Filename string `json:"filename"`
 }
 
+// ProofServingWindowResult models the utreexo proofs of a height band that were
+// served over a window of time returned by the getproofservingstats command.
+type ProofServingWindowResult struct {
+	Window      int64  `json:"window"`
+	Requests    uint64 `json:"requests"`
+	Bytes       uint64 `json:"bytes"`
+	UniquePeers int    `json:"uniquepeers"`
+}
+
+// ProofServingBandResult models the utreexo proofs served for a height band
+// returned by the getproofservingstats command.
+type ProofServingBandResult struct {
+	StartHeight     int32                      `json:"startheight"`
+	EndHeight       int32                      `json:"endheight"`
+	DecayedRequests float64                    `json:"decayedrequests"`
+	Windows         []ProofServingWindowResult `json:"windows"`
+}
+
+// IndexWriteStatsResult models the bytes an index wrote to storage for the
+// blocks it connected.
+type IndexWriteStatsResult struct {
+	Blocks        uint64  `json:"blocks"`
+	LogicalBytes  uint64  `json:"logicalbytes"`
+	WrittenBytes  uint64  `json:"writtenbytes"`
+	Syncs         uint64  `json:"syncs"`
+	Amplification float64 `json:"amplification"`
+}
+
+// IndexInfoResult models the write stats of an index returned by the
+// getindexinfo command.
+type IndexInfoResult struct {
+	Name                string                 `json:"name"`
+	Shadow              bool                   `json:"shadow,omitempty"`
+	Approximate         bool                   `json:"approximate"`
+	LastHeight          int32                  `json:"lastheight"`
+	LastBlock           IndexWriteStatsResult  `json:"lastblock"`
+	Total               IndexWriteStatsResult  `json:"total"`
+	Servable            []HeightRangeResult    `json:"servable"`
+	FsyncPolicy         string                 `json:"fsyncpolicy"`
+	RecordedFsyncPolicy string                 `json:"recordedfsyncpolicy,omitempty"`
+	Reads               *IndexReadStatsResult  `json:"reads,omitempty"`
+	DBRetries           *IndexDBRetryResult    `json:"dbretries,omitempty"`
+	RowGrowth           IndexRowGrowthResult   `json:"rowgrowth"`
+	LeafHashing         IndexLeafHashResult    `json:"leafhashing"`
+	MaxLeaves           uint64                 `json:"maxleaves"`
+	LeafHeadroom        uint64                 `json:"leafheadroom"`
+	ProofCache          *IndexProofCacheResult `json:"proofcache,omitempty"`
+}
+
+// IndexProofCacheResult models the fetches of the utreexo proofs that were
+// served from the proof cache of an index.
+type IndexProofCacheResult struct {
+	Size      uint64  `json:"size"`
+	MaxSize   uint64  `json:"maxsize"`
+	Entries   int     `json:"entries"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	HitRate   float64 `json:"hitrate"`
+	Evictions uint64  `json:"evictions"`
+}
+
+// IndexLeafHashResult models the counts of the leaves hashed on and off the
+// template fast path.
+type IndexLeafHashResult struct {
+	Templates       map[string]uint64 `json:"templates"`
+	Fallbacks       uint64            `json:"fallbacks"`
+	HitRate         float64           `json:"hitrate"`
+	Midstates       int               `json:"midstates"`
+	MaxMidstates    int               `json:"maxmidstates"`
+	MidstateHitRate float64           `json:"midstatehitrate"`
+}
+
+// IndexRowGrowthResult models how close the forest of an index is to gaining a
+// row and how long the blocks that added the latest rows took to connect.  The
+// times are in seconds.
+type IndexRowGrowthResult struct {
+	Rows            uint8                    `json:"rows"`
+	NumLeaves       uint64                   `json:"numleaves"`
+	LeavesToNextRow uint64                   `json:"leavestonextrow"`
+	BlocksToNextRow int64                    `json:"blockstonextrow"`
+	Preallocated    int64                    `json:"preallocated"`
+	AvgConnectTime  float64                  `json:"avgconnecttime"`
+	Boundaries      []IndexRowBoundaryResult `json:"boundaries"`
+}
+
+// IndexRowBoundaryResult models a block that added a row to the forest of an
+// index.  The connect time is in seconds.
+type IndexRowBoundaryResult struct {
+	Height       int32   `json:"height"`
+	Rows         uint8   `json:"rows"`
+	ConnectTime  float64 `json:"connecttime"`
+	Preallocated int64   `json:"preallocated"`
+}
+
+// IndexReadStatsResult models the reads from the flat files of an index that
+// didn't return everything right away.
+type IndexReadStatsResult struct {
+	ShortReads      uint64 `json:"shortreads"`
+	TransientErrors uint64 `json:"transienterrors"`
+	Retries         uint64 `json:"retries"`
+	Failed          uint64 `json:"failed"`
+}
+
+// IndexDBRetryResult models the blocks that were connected to an index again
+// after a transient database error.
+type IndexDBRetryResult struct {
+	Retries   uint64 `json:"retries"`
+	Recovered uint64 `json:"recovered"`
+	Exhausted uint64 `json:"exhausted"`
+}
+
+// HeightRangeResult models an inclusive range of block heights that an index
+// serves the utreexo proofs for.
+type HeightRangeResult struct {
+	Start int32 `json:"start"`
+	End   int32 `json:"end"`
+}
+
+// IndexWriteComparisonResult models the comparison of the write amplification
+// of the utreexo proof indexes when both of them are running.
+type IndexWriteComparisonResult struct {
+	FlatAmplification float64 `json:"flatamplification"`
+	DBAmplification   float64 `json:"dbamplification"`
+	DBToFlatRatio     float64 `json:"dbtoflatratio"`
+}
+
+// LagSummaryResult models the summary of the lags of a stage of serving the
+// utreexo proofs returned by the getindexinfo command.  The lags are in
+// seconds.
+type LagSummaryResult struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// IndexSyncResult models how far an index was caught up to the chain tip while
+// the indexes are caught up on start up returned by the getindexinfo command.
+type IndexSyncResult struct {
+	Name     string  `json:"name"`
+	Height   int32   `json:"height"`
+	Tip      int32   `json:"tip"`
+	Progress float64 `json:"progress"`
+}
+
+// ServingLagResult models the lags of serving the utreexo proofs of the
+// recently connected blocks returned by the getindexinfo command.
+type ServingLagResult struct {
+	Blocks     int              `json:"blocks"`
+	Generation LagSummaryResult `json:"generation"`
+	Durability LagSummaryResult `json:"durability"`
+	FirstServe LagSummaryResult `json:"firstserve"`
+}
+
+// UDataMemSubsystemResult models the memory of the utreexo data held by a
+// subsystem returned by the getindexinfo command.
+type UDataMemSubsystemResult struct {
+	Name         string `json:"name"`
+	Class        string `json:"class"`
+	Quota        uint64 `json:"quota"`
+	Floor        uint64 `json:"floor"`
+	Used         uint64 `json:"used"`
+	Peak         uint64 `json:"peak"`
+	Evictions    uint64 `json:"evictions"`
+	EvictedBytes uint64 `json:"evictedbytes"`
+	Rejected     uint64 `json:"rejected"`
+}
+
+// UDataMemAdjustmentResult models a shrink or a restore of the subsystems
+// holding utreexo data under memory pressure returned by the getindexinfo
+// command.
+type UDataMemAdjustmentResult struct {
+	Time     int64   `json:"time"`
+	Pressure float64 `json:"pressure"`
+	Shrink   bool    `json:"shrink"`
+	Freed    uint64  `json:"freed"`
+	Limit    uint64  `json:"limit"`
+}
+
+// UDataMemPressureResult models the state of the memory pressure responder
+// returned by the getindexinfo command.
+type UDataMemPressureResult struct {
+	Source       string                     `json:"source"`
+	Pressure     float64                    `json:"pressure"`
+	Samples      uint64                     `json:"samples"`
+	SampleErrors uint64                     `json:"sampleerrors"`
+	Shrunk       bool                       `json:"shrunk"`
+	Limit        uint64                     `json:"limit"`
+	Shrinks      uint64                     `json:"shrinks"`
+	Restores     uint64                     `json:"restores"`
+	History      []UDataMemAdjustmentResult `json:"history"`
+}
+
+// UDataMemResult models the memory of the utreexo data held by all the
+// subsystems together returned by the getindexinfo command.
+type UDataMemResult struct {
+	Cap        uint64                    `json:"cap"`
+	Used       uint64                    `json:"used"`
+	Peak       uint64                    `json:"peak"`
+	Subsystems []UDataMemSubsystemResult `json:"subsystems"`
+	Pressure   *UDataMemPressureResult   `json:"pressure,omitempty"`
+}
+
+// GetIndexInfoResult models the data from the getindexinfo command.
+type GetIndexInfoResult struct {
+	Indexes    []IndexInfoResult           `json:"indexes"`
+	Comparison *IndexWriteComparisonResult `json:"comparison,omitempty"`
+	ServingLag *ServingLagResult           `json:"servinglag,omitempty"`
+	UDataMem   *UDataMemResult             `json:"udatamem,omitempty"`
+	Sync       []IndexSyncResult           `json:"sync,omitempty"`
+}
+
+// GetProofServingStatsResult models the data from the getproofservingstats
+// command.
+type GetProofServingStatsResult struct {
+	BandWidth            int32                    `json:"bandwidth"`
+	HalfLife             int64                    `json:"halflife"`
+	TargetPercent        float64                  `json:"targetpercent"`
+	SuggestedPruneHeight int32                    `json:"suggestedpruneheight"`
+	Bands                []ProofServingBandResult `json:"bands"`
+}
+
+// ProofSourceScoreResult models how reliable the utreexo proofs delivered by a
+// source have been returned by the getproofsourcescores command.
+type ProofSourceScoreResult struct {
+	Source     string  `json:"source"`
+	Score      float64 `json:"score"`
+	SampleRate float64 `json:"samplerate"`
+	Staged     uint64  `json:"staged"`
+	Sampled    uint64  `json:"sampled"`
+	Failures   uint64  `json:"failures"`
+	Banned     bool    `json:"banned"`
+}
+
+// GetProofSourceScoresResult models the data from the getproofsourcescores
+// command.
+type GetProofSourceScoresResult struct {
+	Sources []ProofSourceScoreResult `json:"sources"`
+}
+
+// UtreexoPinResult models a pinned height returned by the listutreexopins
+// command.
+type UtreexoPinResult struct {
+	Height int32  `json:"height"`
+	Label  string `json:"label"`
+	Time   int64  `json:"time"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// ListUtreexoPinsResult models the data from the listutreexopins command.
+type ListUtreexoPinsResult struct {
+	Pins        []UtreexoPinResult `json:"pins"`
+	PinnedBytes uint64             `json:"pinnedbytes"`
+}
+
+// ProofDivergenceResult models a utreexo proof served by an audited bridge
+// that differs from the local one returned by the getproofwatchdogstats
+// command.
+type ProofDivergenceResult struct {
+	Height int32    `json:"height"`
+	Hash   string   `json:"hash"`
+	Diff   []string `json:"diff"`
+}
+
+// ProofWatchdogSourceResult models what was recorded for an audited bridge
+// returned by the getproofwatchdogstats command.
+type ProofWatchdogSourceResult struct {
+	Name           string                 `json:"name"`
+	Agreements     uint64                 `json:"agreements"`
+	Divergences    uint64                 `json:"divergences"`
+	Failures       uint64                 `json:"failures"`
+	Skipped        uint64                 `json:"skipped"`
+	Available      bool                   `json:"available"`
+	LastDivergence *ProofDivergenceResult `json:"lastdivergence,omitempty"`
+}
+
+// GetProofWatchdogStatsResult models the data from the getproofwatchdogstats
+// command.
+type GetProofWatchdogStatsResult struct {
+	Sources []ProofWatchdogSourceResult `json:"sources"`
+}
+
+// GetUtreexoCapabilitiesResult models the data from the getutreexocapabilities
+// command.
+type GetUtreexoCapabilitiesResult struct {
+	LowHeight          int32    `json:"lowheight"`
+	HighHeight         int32    `json:"highheight"`
+	Formats            []string `json:"formats"`
+	MultiBlockInterval int32    `json:"multiblockinterval,omitempty"`
+	OnDemand           bool     `json:"ondemand"`
+	MaxResponseSize    uint64   `json:"maxresponsesize"`
+	HashFunction       string   `json:"hashfunction"`
+}
+
+// UtreexoCoinAgeBlockResult models the coin age statistics of a block returned
+// by the getutreexocoinagestats command.
+type UtreexoCoinAgeBlockResult struct {
+	Height             int32   `json:"height"`
+	Inputs             uint64  `json:"inputs"`
+	Value              float64 `json:"value"`
+	CoinbaseInputs     uint64  `json:"coinbaseinputs"`
+	CoinbaseValue      float64 `json:"coinbasevalue"`
+	SatBlocksDestroyed uint64  `json:"satblocksdestroyed"`
+	CoinDaysDestroyed  float64 `json:"coindaysdestroyed"`
+}
+
+// GetUtreexoCoinAgeStatsResult models the data from the getutreexocoinagestats
+// command.  The statistics are aggregated over the range of blocks and the
+// statistics of every block are only included when verbose.
+type GetUtreexoCoinAgeStatsResult struct {
+	StartHeight         int32                       `json:"startheight"`
+	EndHeight           int32                       `json:"endheight"`
+	Inputs              uint64                      `json:"inputs"`
+	Value               float64                     `json:"value"`
+	CoinbaseInputs      uint64                      `json:"coinbaseinputs"`
+	CoinbaseValue       float64                     `json:"coinbasevalue"`
+	CoinBlocksDestroyed float64                     `json:"coinblocksdestroyed"`
+	CoinDaysDestroyed   float64                     `json:"coindaysdestroyed"`
+	Blocks              []UtreexoCoinAgeBlockResult `json:"blocks,omitempty"`
+}
+
+// UtreexoProofCostResult models the proof cost attributed to the spent outputs
+// of a script type returned by the getutreexoproofcost command.
+type UtreexoProofCostResult struct {
+	ScriptType     string  `json:"scripttype"`
+	Spends         uint64  `json:"spends"`
+	ProofHashes    float64 `json:"proofhashes"`
+	AvgProofHashes float64 `json:"avgproofhashes"`
+	LeafDataBytes  uint64  `json:"leafdatabytes"`
+	AvgAge         float64 `json:"avgage"`
+}
+
+// GetUtreexoProofCostResult models the data from the getutreexoproofcost
+// command.  CSV is only set when it's asked for.
+type GetUtreexoProofCostResult struct {
+	StartHeight int32                    `json:"startheight"`
+	EndHeight   int32                    `json:"endheight"`
+	ScriptTypes []UtreexoProofCostResult `json:"scripttypes"`
+	CSV         string                   `json:"csv,omitempty"`
+}
+
+// GetUtreexoProofVerboseResult models the data from the getutreexoproof
+// command when the verbose flag is set.
+type GetUtreexoProofVerboseResult struct {
+	BlockHash string     `json:"blockhash"`
+	Height    int32      `json:"height"`
+	Hex       string     `json:"hex"`
+	UData     *UDataJSON `json:"udata"`
+}
+
+// UtreexoProofResult models the utreexo proof of a block returned by the
+// getutreexoproofs command.  UData is only set when verbose is requested and
+// Receipt is only set when a receipt is requested.
+type UtreexoProofResult struct {
+	Height  int32               `json:"height"`
+	Hash    string              `json:"hash"`
+	Hex     string              `json:"hex"`
+	UData   *UDataJSON          `json:"udata,omitempty"`
+	Receipt *ProofReceiptResult `json:"receipt,omitempty"`
+}
+
+// ProofReceiptResult models the receipt of serving the utreexo proof of a block
+// returned by the getutreexoproofs command.  The signature is over the request
+// id, the block hash, the hash of the serialized proof, and the timestamp.
+type ProofReceiptResult struct {
+	RequestID string `json:"requestid"`
+	BlockHash string `json:"blockhash"`
+	UDataHash string `json:"udatahash"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+	PubKey    string `json:"pubkey"`
+}
+
+// VerifyProofReceiptResult models the data from the verifyproofreceipt
+// command.
+type VerifyProofReceiptResult struct {
+	Status         string `json:"status"`
+	ValidSignature bool   `json:"validsignature"`
+	Recorded       bool   `json:"recorded"`
+	PubKey         string `json:"pubkey"`
+}
+
+// CompareProofResult models the data from the compareproof command.  Only one
+// of redundant, differences, and error is set depending on the verdict.
+type CompareProofResult struct {
+	Height      int32    `json:"height"`
+	Hash        string   `json:"hash"`
+	Verdict     string   `json:"verdict"`
+	Redundant   []string `json:"redundant,omitempty"`
+	Differences []string `json:"differences,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// GetUtreexoProofsResult models the data from the getutreexoproofs command.
+// The cursor may be passed back in to resume the scan after the last returned
+// proof.
+type GetUtreexoProofsResult struct {
+	Proofs []UtreexoProofResult `json:"proofs"`
+	Cursor string               `json:"cursor"`
+}
+
+// NonCanonicalUtreexoProofResult models a stored utreexo proof that doesn't
+// serialize back into the same bytes returned by the verifyutreexoproofs
+// command.
+type NonCanonicalUtreexoProofResult struct {
+	Height         int32  `json:"height"`
+	Error          string `json:"error"`
+	QuarantinePath string `json:"quarantinepath,omitempty"`
+}
+
+// VerifyUtreexoIndexesResult models the data from the verifyutreexoindexes
+// command.  The height, the hash and the differences are of the first block
+// that the indexes stored differently.
+type VerifyUtreexoIndexesResult struct {
+	Agree       bool     `json:"agree"`
+	Height      int32    `json:"height,omitempty"`
+	Hash        string   `json:"hash,omitempty"`
+	Differences []string `json:"differences,omitempty"`
+}
+
+// VerifyUtreexoProofsResult models the data from the verifyutreexoproofs
+// command.
+type VerifyUtreexoProofsResult struct {
+	NonCanonical []NonCanonicalUtreexoProofResult `json:"noncanonical"`
+	Repaired     bool                             `json:"repaired"`
+}
+
+// EstimateProofSizeResult models the data from the estimateproofsize command.
+// The proof hashes, bytes and hash operations are of the chain-tip inclusion
+// proof of the outpoints whose leaves exist.
+type EstimateProofSizeResult struct {
+	NumLeaves   uint64                    `json:"numleaves"`
+	ProofHashes int                       `json:"proofhashes"`
+	Bytes       int                       `json:"bytes"`
+	HashOps     int64                     `json:"hashops"`
+	Outpoints   []ProofSizeOutpointResult `json:"outpoints"`
+}
+
+// ProofSizeOutpointResult models what a single outpoint given to the
+// estimateproofsize command adds to the proof of the outpoints before it.
+type ProofSizeOutpointResult struct {
+	Index           int    `json:"index"`
+	Exists          bool   `json:"exists"`
+	Reason          string `json:"reason,omitempty"`
+	Position        uint64 `json:"position"`
+	Depth           uint8  `json:"depth"`
+	MarginalHashes  int    `json:"marginalhashes"`
+	MarginalBytes   int    `json:"marginalbytes"`
+	MarginalHashOps int64  `json:"marginalhashops"`
+}
+
 // ProveUtxoChainTipInclusionVerboseResult models the data from the
 // proveutxochaintipinclusion command when the verbose flag is set.  When the
 // verbose flag is not set, just the hex-encoded string of the entire proof
 // is returned.
 type ProveUtxoChainTipInclusionVerboseResult struct {
-	ProvedAtHash string   `json:"provedathash"`
-	ProofHashes  []string `json:"proofhashes"`
-	ProofTargets []uint64 `json:"prooftargets"`
-	HashesProven []string `json:"hashesproven"`
-	Hex          string   `json:"hex"`
+	ProvedAtHash string                 `json:"provedathash"`
+	ProofHashes  []string               `json:"proofhashes"`
+	ProofTargets []uint64               `json:"prooftargets"`
+	HashesProven []string               `json:"hashesproven"`
+	Hex          string                 `json:"hex"`
+	Inputs       []UtxoProofInputResult `json:"inputs"`
+}
+
+// These are the reasons a utxo given to the proveutxochaintipinclusion command
+// wasn't proven.
+const (
+	// UtxoProofSpent is the reason for a utxo that was created but has
+	// since been spent.
+	UtxoProofSpent = "spent"
+
+	// UtxoProofUnknown is the reason for a utxo that isn't known to have
+	// ever been created.
+	UtxoProofUnknown = "unknown"
+
+	// UtxoProofPruned is the reason for a utxo that's unspent but whose
+	// leaf isn't held by the utreexo accumulator anymore.
+	UtxoProofPruned = "pruned"
+)
+
+// UtxoProofInputResult models whether a single utxo given to the
+// proveutxochaintipinclusion command was proven.
+type UtxoProofInputResult struct {
+	Index  int    `json:"index"`
+	Proven bool   `json:"proven"`
+	Reason string `json:"reason,omitempty"`
 }
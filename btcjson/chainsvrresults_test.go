@@ -72,6 +72,21 @@ func TestChainSvrCustomResults(t *testing.T) {
 			},
 			expected: `{"txid":"123","vout":1,"scriptSig":{"asm":"0","hex":"00"},"prevOut":{"addresses":["addr1"],"value":0},"sequence":4294967295}`,
 		},
+		{
+			name: "proveutxochaintipinclusion with an unproven utxo",
+			result: &btcjson.ProveUtxoChainTipInclusionVerboseResult{
+				ProvedAtHash: "00",
+				ProofHashes:  []string{},
+				ProofTargets: []uint64{3},
+				HashesProven: []string{"01"},
+				Hex:          "02",
+				Inputs: []btcjson.UtxoProofInputResult{
+					{Index: 0, Proven: true},
+					{Index: 1, Reason: btcjson.UtxoProofSpent},
+				},
+			},
+			expected: `{"provedathash":"00","proofhashes":[],"prooftargets":[3],"hashesproven":["01"],"hex":"02","inputs":[{"index":0,"proven":true},{"index":1,"proven":false,"reason":"spent"}]}`,
+		},
 	}
 
 	t.Logf("Running %d tests", len(tests))
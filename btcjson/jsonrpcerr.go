@@ -184,3 +184,22 @@ const (
 	ErrRPCNoWallet      RPCErrorCode = -1
 	ErrRPCUnimplemented RPCErrorCode = -1
 )
+
+// Errors of the state that a client pinned, like a utreexo proof session or
+// the cursor of a range scan, that ended before the client was done with it.
+// Each one tells the client how to resume.
+const (
+	// ErrRPCLeaseExpired indicates that the state went unused for too long.
+	// It may be recreated right away from the height in the message.
+	ErrRPCLeaseExpired RPCErrorCode = -40
+
+	// ErrRPCLeaseShed indicates that the state was dropped to free memory.
+	// The client should back off before recreating it from the height in
+	// the message.
+	ErrRPCLeaseShed RPCErrorCode = -41
+
+	// ErrRPCLeaseReorged indicates that a reorg or an index repair made the
+	// state invalid.  It has to be recreated from the height in the
+	// message.
+	ErrRPCLeaseReorged RPCErrorCode = -42
+)
@@ -0,0 +1,304 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcjson
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// UDataJSON is the canonical JSON representation of the utreexo data of a block
+// or a transaction.  The field names are stable and every field is always
+// present so that tooling may rely on them.  It holds everything wire.UData
+// does so converting between them is lossless.
+type UDataJSON struct {
+	// Targets are the positions of the proven leaves in the accumulator.
+	Targets []uint64 `json:"targets"`
+
+	// ProofHashes are the hashes of the accumulator proof as hex strings
+	// in the byte order that hashes are displayed in.
+	ProofHashes []string `json:"proofhashes"`
+
+	// LeafDatas are the spent outputs that the proof is for.
+	LeafDatas []LeafDataJSON `json:"leafdatas"`
+
+	// RememberIdx are the indexes of the created outputs to remember.
+	RememberIdx []uint32 `json:"rememberidx"`
+}
+
+// LeafDataJSON is the canonical JSON representation of a spent output that's
+// proven by the utreexo data.
+type LeafDataJSON struct {
+	// BlockHash is the hash of the block that created the output.
+	BlockHash string `json:"blockhash"`
+
+	// Txid and Vout are the outpoint of the output.
+	Txid string `json:"txid"`
+	Vout uint32 `json:"vout"`
+
+	// Height is the height of the block that created the output.  It's -1
+	// for an output created by an unconfirmed transaction.
+	Height int32 `json:"height"`
+
+	// IsCoinBase is whether the output was created by a coinbase.
+	IsCoinBase bool `json:"iscoinbase"`
+
+	// Amount is the value of the output in satoshis.
+	Amount int64 `json:"amount"`
+
+	// PkType is the type of the pkscript that may be reconstructed from
+	// the spending input when the pkscript itself is left out.
+	PkType string `json:"pktype"`
+
+	// ScriptType is the class of the pkscript as decoded by txscript and
+	// PkScript is the pkscript as a hex string.
+	ScriptType string `json:"scripttype"`
+	PkScript   string `json:"pkscript"`
+}
+
+// pkTypes are the reconstructable pkscript types by their name.
+var pkTypes = map[string]wire.PkType{
+	wire.OtherTy.String():               wire.OtherTy,
+	wire.PubKeyHashTy.String():          wire.PubKeyHashTy,
+	wire.WitnessV0PubKeyHashTy.String(): wire.WitnessV0PubKeyHashTy,
+	wire.ScriptHashTy.String():          wire.ScriptHashTy,
+	wire.WitnessV0ScriptHashTy.String(): wire.WitnessV0ScriptHashTy,
+}
+
+// NewUDataJSON returns the canonical JSON representation of the utreexo data.
+func NewUDataJSON(ud *wire.UData) *UDataJSON {
+	u := &UDataJSON{
+		Targets:     make([]uint64, len(ud.AccProof.Targets)),
+		ProofHashes: make([]string, 0, len(ud.AccProof.Proof)),
+		LeafDatas:   make([]LeafDataJSON, 0, len(ud.LeafDatas)),
+		RememberIdx: make([]uint32, len(ud.RememberIdx)),
+	}
+	copy(u.Targets, ud.AccProof.Targets)
+	for _, hash := range ud.AccProof.Proof {
+		u.ProofHashes = append(u.ProofHashes, chainhash.Hash(hash).String())
+	}
+	for i := range ud.LeafDatas {
+		ld := &ud.LeafDatas[i]
+		u.LeafDatas = append(u.LeafDatas, LeafDataJSON{
+			BlockHash:  ld.BlockHash.String(),
+			Txid:       ld.OutPoint.Hash.String(),
+			Vout:       ld.OutPoint.Index,
+			Height:     ld.Height,
+			IsCoinBase: ld.IsCoinBase,
+			Amount:     ld.Amount,
+			PkType:     ld.ReconstructablePkType.String(),
+			ScriptType: txscript.GetScriptClass(ld.PkScript).String(),
+			PkScript:   hex.EncodeToString(ld.PkScript),
+		})
+	}
+	copy(u.RememberIdx, ud.RememberIdx)
+
+	return u
+}
+
+// decodeJSONHash decodes a hash displayed as a hex string.  Unlike
+// chainhash.NewHashFromStr, only strings of exactly the size of a hash are
+// accepted.
+func decodeJSONHash(field, str string) (chainhash.Hash, error) {
+	var hash chainhash.Hash
+	if len(str) != chainhash.MaxHashStringSize {
+		return hash, fmt.Errorf("%s %q is not a hash of %d hex "+
+			"characters", field, str, chainhash.MaxHashStringSize)
+	}
+	err := chainhash.Decode(&hash, str)
+	if err != nil {
+		return hash, fmt.Errorf("%s %q: %v", field, str, err)
+	}
+
+	return hash, nil
+}
+
+// UData returns the utreexo data of the JSON representation.  An error is
+// returned for any value that's out of range or that doesn't agree with the
+// other values.
+func (u *UDataJSON) UData() (*wire.UData, error) {
+	ud := &wire.UData{
+		AccProof: accumulator.BatchProof{
+			Targets: make([]uint64, len(u.Targets)),
+			Proof:   make([]accumulator.Hash, 0, len(u.ProofHashes)),
+		},
+		LeafDatas:   make([]wire.LeafData, 0, len(u.LeafDatas)),
+		RememberIdx: make([]uint32, len(u.RememberIdx)),
+	}
+	copy(ud.AccProof.Targets, u.Targets)
+	for i, str := range u.ProofHashes {
+		hash, err := decodeJSONHash(fmt.Sprintf("proofhashes[%d]", i), str)
+		if err != nil {
+			return nil, err
+		}
+		ud.AccProof.Proof = append(ud.AccProof.Proof, accumulator.Hash(hash))
+	}
+	for i := range u.LeafDatas {
+		ld, err := u.LeafDatas[i].leafData(i)
+		if err != nil {
+			return nil, err
+		}
+		ud.LeafDatas = append(ud.LeafDatas, *ld)
+	}
+	copy(ud.RememberIdx, u.RememberIdx)
+
+	return ud, nil
+}
+
+// leafData returns the leaf data of the JSON representation at the given index
+// of the leaf datas.
+func (l *LeafDataJSON) leafData(i int) (*wire.LeafData, error) {
+	field := func(name string) string {
+		return fmt.Sprintf("leafdatas[%d].%s", i, name)
+	}
+
+	blockHash, err := decodeJSONHash(field("blockhash"), l.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	txid, err := decodeJSONHash(field("txid"), l.Txid)
+	if err != nil {
+		return nil, err
+	}
+	if l.Height < -1 {
+		return nil, fmt.Errorf("%s %d is below -1", field("height"),
+			l.Height)
+	}
+	if l.Amount < 0 || l.Amount > btcutil.MaxSatoshi {
+		return nil, fmt.Errorf("%s %d is not between 0 and %d",
+			field("amount"), l.Amount, int64(btcutil.MaxSatoshi))
+	}
+	pkType, ok := pkTypes[l.PkType]
+	if !ok {
+		return nil, fmt.Errorf("%s %q is not a known type",
+			field("pktype"), l.PkType)
+	}
+	pkScript, err := hex.DecodeString(l.PkScript)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", field("pkscript"), err)
+	}
+	if len(pkScript) > wire.MaxScriptSize {
+		return nil, fmt.Errorf("%s of %d bytes is longer than the "+
+			"maximum of %d", field("pkscript"), len(pkScript),
+			wire.MaxScriptSize)
+	}
+	class := txscript.GetScriptClass(pkScript).String()
+	if l.ScriptType != class {
+		return nil, fmt.Errorf("%s %q doesn't match the %q pkscript",
+			field("scripttype"), l.ScriptType, class)
+	}
+
+	// Keep a nil pkscript nil so that the round trip is exact.
+	if len(pkScript) == 0 {
+		pkScript = nil
+	}
+
+	return &wire.LeafData{
+		BlockHash: blockHash,
+		OutPoint: wire.OutPoint{
+			Hash:  txid,
+			Index: l.Vout,
+		},
+		Height:                l.Height,
+		IsCoinBase:            l.IsCoinBase,
+		Amount:                l.Amount,
+		ReconstructablePkType: pkType,
+		PkScript:              pkScript,
+	}, nil
+}
+
+// DecodeUDataJSON strictly decodes the canonical JSON representation of utreexo
+// data.  Unknown fields, missing fields, trailing data, and out of range values
+// are all rejected so that tooling that produces the JSON catches its own bugs.
+func DecodeUDataJSON(data []byte) (*wire.UData, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var raw struct {
+		Targets     *[]uint64          `json:"targets"`
+		ProofHashes *[]string          `json:"proofhashes"`
+		LeafDatas   *[]json.RawMessage `json:"leafdatas"`
+		RememberIdx *[]uint32          `json:"rememberidx"`
+	}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the utreexo data")
+	}
+	if raw.Targets == nil || raw.ProofHashes == nil ||
+		raw.LeafDatas == nil || raw.RememberIdx == nil {
+
+		return nil, fmt.Errorf("utreexo data must have all of the " +
+			"targets, proofhashes, leafdatas, and rememberidx fields")
+	}
+
+	u := UDataJSON{
+		Targets:     *raw.Targets,
+		ProofHashes: *raw.ProofHashes,
+		LeafDatas:   make([]LeafDataJSON, len(*raw.LeafDatas)),
+		RememberIdx: *raw.RememberIdx,
+	}
+	for i, rawLeaf := range *raw.LeafDatas {
+		leaf, err := decodeLeafDataJSON(rawLeaf)
+		if err != nil {
+			return nil, fmt.Errorf("leafdatas[%d]: %v", i, err)
+		}
+		u.LeafDatas[i] = *leaf
+	}
+
+	return u.UData()
+}
+
+// decodeLeafDataJSON strictly decodes the canonical JSON representation of a
+// leaf data.
+func decodeLeafDataJSON(data []byte) (*LeafDataJSON, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var raw struct {
+		BlockHash  *string `json:"blockhash"`
+		Txid       *string `json:"txid"`
+		Vout       *uint32 `json:"vout"`
+		Height     *int32  `json:"height"`
+		IsCoinBase *bool   `json:"iscoinbase"`
+		Amount     *int64  `json:"amount"`
+		PkType     *string `json:"pktype"`
+		ScriptType *string `json:"scripttype"`
+		PkScript   *string `json:"pkscript"`
+	}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	if raw.BlockHash == nil || raw.Txid == nil || raw.Vout == nil ||
+		raw.Height == nil || raw.IsCoinBase == nil || raw.Amount == nil ||
+		raw.PkType == nil || raw.ScriptType == nil || raw.PkScript == nil {
+
+		return nil, fmt.Errorf("leaf data must have all of the " +
+			"blockhash, txid, vout, height, iscoinbase, amount, " +
+			"pktype, scripttype, and pkscript fields")
+	}
+
+	return &LeafDataJSON{
+		BlockHash:  *raw.BlockHash,
+		Txid:       *raw.Txid,
+		Vout:       *raw.Vout,
+		Height:     *raw.Height,
+		IsCoinBase: *raw.IsCoinBase,
+		Amount:     *raw.Amount,
+		PkType:     *raw.PkType,
+		ScriptType: *raw.ScriptType,
+		PkScript:   *raw.PkScript,
+	}, nil
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package btcjson_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/btcjson"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// udataFixtureHash returns a hash from the hex string that it's displayed as.
+func udataFixtureHash(t *testing.T, str string) chainhash.Hash {
+	hash, err := chainhash.NewHashFromStr(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *hash
+}
+
+// udataFixture returns the utreexo data that the golden JSON fixture is of.
+func udataFixture(t *testing.T) *wire.UData {
+	p2pkh := []byte{0x76, 0xa9, 0x14, 0x0c, 0x1b, 0x83, 0xd0, 0x1d,
+		0x0f, 0xfb, 0x2b, 0xcc, 0xae, 0x60, 0x69, 0x63, 0x37, 0x6c,
+		0xca, 0x38, 0x63, 0xa7, 0xce, 0x88, 0xac}
+	p2wpkh := []byte{0x00, 0x14, 0x1d, 0x0f, 0x17, 0x2a, 0x0e, 0xcb,
+		0x48, 0xae, 0xe1, 0xbe, 0x1f, 0x26, 0x87, 0xd2, 0x96, 0x3a,
+		0xe3, 0x3f, 0x71, 0xa1}
+
+	return &wire.UData{
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{4, 17},
+			Proof: []accumulator.Hash{
+				accumulator.Hash(udataFixtureHash(t, "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")),
+				accumulator.Hash(udataFixtureHash(t, "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098")),
+			},
+		},
+		LeafDatas: []wire.LeafData{
+			{
+				BlockHash: udataFixtureHash(t, "000000006a625f06636b8bb6ac7b960a8d03705d1ace08b1a19da3fdcc99ddbd"),
+				OutPoint: wire.OutPoint{
+					Hash:  udataFixtureHash(t, "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098"),
+					Index: 0,
+				},
+				Height:     1,
+				IsCoinBase: true,
+				Amount:     5000000000,
+				PkScript:   p2pkh,
+			},
+			{
+				BlockHash: udataFixtureHash(t, "0000000082b5015589a3fdf2d4baff403e6f0be035a5d9742c1cae6295464449"),
+				OutPoint: wire.OutPoint{
+					Hash:  udataFixtureHash(t, "9b0fc92260312ce44e74ef369f5c66bbb85848f2eddd5a7a1cde251e54ccfdd5"),
+					Index: 1,
+				},
+				Height:                3,
+				Amount:                0,
+				ReconstructablePkType: wire.WitnessV0PubKeyHashTy,
+				PkScript:              p2wpkh,
+			},
+			{
+				BlockHash: udataFixtureHash(t, "0000000000000000000000000000000000000000000000000000000000000000"),
+				OutPoint: wire.OutPoint{
+					Hash:  udataFixtureHash(t, "999e1c837c76a1b7fbb7e57baf87b309960f5ffefbf2a9b95dd890602272f644"),
+					Index: 2,
+				},
+				Height:                -1,
+				Amount:                1234,
+				ReconstructablePkType: wire.PubKeyHashTy,
+			},
+		},
+		RememberIdx: []uint32{0, 3},
+	}
+}
+
+// randUData returns random utreexo data with up to the given number of leaves.
+func randUData(rng *rand.Rand, maxLeaves int) *wire.UData {
+	randHash := func() (hash chainhash.Hash) {
+		rng.Read(hash[:])
+		return hash
+	}
+
+	ud := &wire.UData{}
+	numLeaves := rng.Intn(maxLeaves + 1)
+	for i := 0; i < numLeaves; i++ {
+		ud.AccProof.Targets = append(ud.AccProof.Targets, rng.Uint64())
+
+		ld := wire.LeafData{
+			BlockHash: randHash(),
+			OutPoint: wire.OutPoint{
+				Hash:  randHash(),
+				Index: rng.Uint32(),
+			},
+			Height:                rng.Int31n(1_000_000) - 1,
+			IsCoinBase:            rng.Intn(2) == 0,
+			Amount:                rng.Int63n(btcutil.MaxSatoshi + 1),
+			ReconstructablePkType: wire.PkType(rng.Intn(5)),
+		}
+		if scriptLen := rng.Intn(100); scriptLen > 0 {
+			ld.PkScript = make([]byte, scriptLen)
+			rng.Read(ld.PkScript)
+		}
+		ud.LeafDatas = append(ud.LeafDatas, ld)
+	}
+	for i := rng.Intn(2 * maxLeaves); i > 0; i-- {
+		ud.AccProof.Proof = append(ud.AccProof.Proof,
+			accumulator.Hash(randHash()))
+	}
+	for i := rng.Intn(maxLeaves + 1); i > 0; i-- {
+		ud.RememberIdx = append(ud.RememberIdx, rng.Uint32())
+	}
+
+	return ud
+}
+
+// TestUDataJSONRoundTrip ensures that utreexo data converted to its JSON
+// representation, marshalled, and strictly decoded back is equal to what it
+// was.
+func TestUDataJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	maxScript := make([]byte, wire.MaxScriptSize)
+	for i := range maxScript {
+		maxScript[i] = 0x51
+	}
+
+	tests := []struct {
+		name string
+		ud   *wire.UData
+	}{
+		{
+			name: "empty",
+			ud:   &wire.UData{},
+		},
+		{
+			name: "fixture",
+			ud:   udataFixture(t),
+		},
+		{
+			name: "max size script and max amount",
+			ud: &wire.UData{
+				AccProof: accumulator.BatchProof{
+					Targets: []uint64{^uint64(0)},
+				},
+				LeafDatas: []wire.LeafData{{
+					Height:   1<<31 - 1,
+					Amount:   btcutil.MaxSatoshi,
+					PkScript: maxScript,
+				}},
+			},
+		},
+		{
+			name: "zero amount outputs",
+			ud: &wire.UData{
+				AccProof: accumulator.BatchProof{
+					Targets: []uint64{0, 1},
+				},
+				LeafDatas: []wire.LeafData{
+					{Amount: 0, PkScript: []byte{0x6a}},
+					{Amount: 0, Height: -1},
+				},
+			},
+		},
+	}
+
+	// Random utreexo data makes up the rest of the corpus.
+	rng := rand.New(rand.NewSource(240))
+	for i := 0; i < 50; i++ {
+		tests = append(tests, struct {
+			name string
+			ud   *wire.UData
+		}{name: "random", ud: randUData(rng, 8)})
+	}
+
+	for i, test := range tests {
+		marshalled, err := json.Marshal(btcjson.NewUDataJSON(test.ud))
+		if err != nil {
+			t.Fatalf("test #%d (%s): unexpected marshal error: %v",
+				i, test.name, err)
+		}
+		ud, err := btcjson.DecodeUDataJSON(marshalled)
+		if err != nil {
+			t.Fatalf("test #%d (%s): unexpected decode error: %v\n%s",
+				i, test.name, err, marshalled)
+		}
+		if !ud.Equal(test.ud) {
+			t.Fatalf("test #%d (%s): round trip mismatch\ngot: %+v\n"+
+				"want: %+v", i, test.name, ud, test.ud)
+		}
+
+		// The JSON layout of wire.UData shares the field names, so
+		// it decodes the canonical representation too.
+		var wireUD wire.UData
+		err = json.Unmarshal(marshalled, &wireUD)
+		if err != nil {
+			t.Fatalf("test #%d (%s): unexpected wire decode error: %v",
+				i, test.name, err)
+		}
+		if !wireUD.Equal(test.ud) {
+			t.Fatalf("test #%d (%s): wire decode mismatch", i, test.name)
+		}
+	}
+}
+
+// TestUDataJSONGolden ensures the JSON representation of the utreexo data
+// keeps its field names and formatting by comparing it against a fixture.
+func TestUDataJSONGolden(t *testing.T) {
+	t.Parallel()
+
+	got, err := json.MarshalIndent(btcjson.NewUDataJSON(udataFixture(t)),
+		"", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "udata.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.TrimSpace(want)) {
+		t.Fatalf("JSON mismatch with the fixture\ngot:\n%s\nwant:\n%s",
+			got, want)
+	}
+
+	// The fixture decodes back to the utreexo data it's of.
+	ud, err := btcjson.DecodeUDataJSON(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ud.Equal(udataFixture(t)) {
+		t.Fatalf("fixture decoded to %+v", ud)
+	}
+}
+
+// TestDecodeUDataJSONErrors ensures the strict decoder rejects malformed and
+// out of range JSON.
+func TestDecodeUDataJSONErrors(t *testing.T) {
+	t.Parallel()
+
+	const hash = "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098"
+	leaf := func(replace ...string) string {
+		fields := map[string]string{
+			"blockhash":  `"` + hash + `"`,
+			"txid":       `"` + hash + `"`,
+			"vout":       "0",
+			"height":     "1",
+			"iscoinbase": "false",
+			"amount":     "1000",
+			"pktype":     `"other"`,
+			"scripttype": `"nulldata"`,
+			"pkscript":   `"6a"`,
+		}
+		for i := 0; i < len(replace); i += 2 {
+			if replace[i+1] == "" {
+				delete(fields, replace[i])
+				continue
+			}
+			fields[replace[i]] = replace[i+1]
+		}
+		parts := make([]string, 0, len(fields))
+		for name, value := range fields {
+			parts = append(parts, `"`+name+`":`+value)
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	}
+	udata := func(leaves string) string {
+		return `{"targets":[1],"proofhashes":[],"leafdatas":[` + leaves +
+			`],"rememberidx":[]}`
+	}
+
+	// Ensure the well-formed JSON that the failing ones are derived from
+	// decodes.
+	if _, err := btcjson.DecodeUDataJSON([]byte(udata(leaf()))); err != nil {
+		t.Fatalf("unexpected error decoding valid JSON: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"unknown field", `{"targets":[],"proofhashes":[],"leafdatas":[],"rememberidx":[],"extra":1}`},
+		{"missing field", `{"targets":[],"proofhashes":[],"leafdatas":[]}`},
+		{"null field", `{"targets":null,"proofhashes":[],"leafdatas":[],"rememberidx":[]}`},
+		{"trailing data", udata(leaf()) + `{}`},
+		{"negative target", `{"targets":[-1],"proofhashes":[],"leafdatas":[],"rememberidx":[]}`},
+		{"short proof hash", `{"targets":[],"proofhashes":["00"],"leafdatas":[],"rememberidx":[]}`},
+		{"non-hex proof hash", `{"targets":[],"proofhashes":["` + strings.Repeat("z", 64) + `"],"leafdatas":[],"rememberidx":[]}`},
+		{"unknown leaf field", udata(leaf("extra", "1"))},
+		{"missing leaf field", udata(leaf("amount", ""))},
+		{"short block hash", udata(leaf("blockhash", `"00"`))},
+		{"long txid", udata(leaf("txid", `"`+hash+`00"`))},
+		{"vout out of range", udata(leaf("vout", "4294967296"))},
+		{"height below -1", udata(leaf("height", "-2"))},
+		{"negative amount", udata(leaf("amount", "-1"))},
+		{"amount above max", udata(leaf("amount", "2100000000000001"))},
+		{"fractional amount", udata(leaf("amount", "0.5"))},
+		{"unknown pktype", udata(leaf("pktype", `"p2tr"`))},
+		{"mismatched scripttype", udata(leaf("scripttype", `"pubkeyhash"`))},
+		{"non-hex pkscript", udata(leaf("pkscript", `"6"`))},
+		{"pkscript too long", udata(leaf("scripttype", `"nonstandard"`,
+			"pkscript", `"`+strings.Repeat("51", wire.MaxScriptSize+1)+`"`))},
+	}
+
+	for i, test := range tests {
+		_, err := btcjson.DecodeUDataJSON([]byte(test.json))
+		if err == nil {
+			t.Errorf("test #%d (%s): expected an error", i, test.name)
+		}
+	}
+}
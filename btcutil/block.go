@@ -39,6 +39,26 @@ type Block struct {
 	blockHeight              int32           // Height in the main block chain
 	transactions             []*Tx           // Transactions
 	txnsGenerated            bool            // ALL wrapped transactions generated
+	udataSummary             *UDataSummary   // Summary of the released utreexo data
+}
+
+// UDataSummary describes the utreexo data that a block carried after the
+// utreexo data itself was released.
+type UDataSummary struct {
+	// LeafCount is the number of leaf datas, one for every input that
+	// spends an output created before the block.
+	LeafCount int
+
+	// TargetCount is the number of accumulator positions that were
+	// proven.
+	TargetCount int
+
+	// ProofHashes is the number of hashes in the accumulator proof.
+	ProofHashes int
+
+	// SerializeSize is the compact serialized size of the utreexo data in
+	// bytes.
+	SerializeSize int
 }
 
 // MsgBlock returns the underlying wire.MsgBlock for the Block.
@@ -47,6 +67,36 @@ func (b *Block) MsgBlock() *wire.MsgBlock {
 	return b.msgBlock
 }
 
+// ReleaseUData drops the block's references to its utreexo data so that the
+// memory it takes can be reclaimed once the block has been verified.  The
+// cached serialized bytes are dropped as well since the ones the block was
+// received as may include the utreexo data.  The summary of the released
+// utreexo data is returned and kept by the block.  Nothing is released and nil
+// is returned if the block doesn't carry any utreexo data.
+func (b *Block) ReleaseUData() *UDataSummary {
+	ud := b.msgBlock.UData
+	if ud == nil {
+		return b.udataSummary
+	}
+
+	b.udataSummary = &UDataSummary{
+		LeafCount:     len(ud.LeafDatas),
+		TargetCount:   len(ud.AccProof.Targets),
+		ProofHashes:   len(ud.AccProof.Proof),
+		SerializeSize: ud.SerializeSizeCompact(false),
+	}
+	b.msgBlock.UData = nil
+	b.serializedBlock = nil
+
+	return b.udataSummary
+}
+
+// UDataSummary returns the summary of the utreexo data that the block carried
+// before it was released.  It's nil if the utreexo data wasn't released.
+func (b *Block) UDataSummary() *UDataSummary {
+	return b.udataSummary
+}
+
 // Bytes returns the serialized bytes for the Block.  This is equivalent to
 // calling Serialize on the underlying wire.MsgBlock, however it caches the
 // result so subsequent calls are more efficient.
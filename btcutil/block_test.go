@@ -8,10 +8,12 @@ import (
 	"bytes"
 	"io"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
 	"github.com/utreexo/utreexod/wire"
@@ -164,6 +166,114 @@ func TestBlock(t *testing.T) {
 	}
 }
 
+// syntheticUData returns utreexo data with the given number of leaf datas,
+// targets, and proof hashes.
+func syntheticUData(count int) *wire.UData {
+	ud := &wire.UData{
+		AccProof: accumulator.BatchProof{
+			Targets: make([]uint64, count),
+			Proof:   make([]accumulator.Hash, count),
+		},
+		LeafDatas: make([]wire.LeafData, count),
+	}
+	for i := range ud.LeafDatas {
+		ud.AccProof.Targets[i] = uint64(i)
+		ud.AccProof.Proof[i][0] = byte(i)
+		ud.LeafDatas[i] = wire.LeafData{
+			OutPoint: wire.OutPoint{Index: uint32(i)},
+			Amount:   int64(i),
+			PkScript: make([]byte, 25),
+		}
+	}
+
+	return ud
+}
+
+// TestBlockReleaseUData ensures that releasing the utreexo data of a block
+// leaves a summary of it behind and that the memory it took is reclaimed.
+func TestBlockReleaseUData(t *testing.T) {
+	// newBlock returns a block carrying large utreexo data along with the
+	// bytes it was received as.
+	newBlock := func() *btcutil.Block {
+		msgBlock := Block100000
+		msgBlock.UData = syntheticUData(500)
+		var buf bytes.Buffer
+		err := msgBlock.BtcEncode(&buf, wire.ProtocolVersion,
+			wire.WitnessEncoding|wire.UtreexoEncoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return btcutil.NewBlockFromBlockAndBytes(&msgBlock, buf.Bytes())
+	}
+
+	b := newBlock()
+	if b.UDataSummary() != nil {
+		t.Fatal("expected no summary before the utreexo data is released")
+	}
+	size := b.MsgBlock().UData.SerializeSizeCompact(false)
+	summary := b.ReleaseUData()
+	want := &btcutil.UDataSummary{
+		LeafCount:     500,
+		TargetCount:   500,
+		ProofHashes:   500,
+		SerializeSize: size,
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("expected summary %+v, got %+v", want, summary)
+	}
+	if b.MsgBlock().UData != nil {
+		t.Fatal("expected the utreexo data to be released")
+	}
+	if b.ReleaseUData() != summary || b.UDataSummary() != summary {
+		t.Fatal("expected the summary to be kept")
+	}
+
+	// The serialized bytes no longer include the utreexo data.
+	var buf bytes.Buffer
+	err := Block100000.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized, err := b.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serialized, buf.Bytes()) {
+		t.Fatal("expected the serialized block without the utreexo data")
+	}
+
+	// The live heap of blocks with released utreexo data stays near the
+	// one of the blocks without any.
+	heapAlloc := func() uint64 {
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+	baseline := heapAlloc()
+	blocks := make([]*btcutil.Block, 200)
+	for i := range blocks {
+		blocks[i] = newBlock()
+	}
+	withUData := heapAlloc()
+	for _, block := range blocks {
+		block.ReleaseUData()
+	}
+	released := heapAlloc()
+	runtime.KeepAlive(blocks)
+
+	if withUData <= baseline {
+		t.Fatalf("expected the utreexo data to take memory, got %d "+
+			"bytes before and %d after", baseline, withUData)
+	}
+	udataBytes := withUData - baseline
+	if released > baseline && released-baseline > udataBytes/10 {
+		t.Fatalf("expected the released utreexo data of %d bytes to be "+
+			"reclaimed, got %d bytes still live", udataBytes,
+			released-baseline)
+	}
+}
+
 // TestNewBlockFromBytes tests creation of a Block from serialized bytes.
 func TestNewBlockFromBytes(t *testing.T) {
 	// Serialize the test block.
@@ -229,6 +229,17 @@ type Params struct {
 	MinerConfirmationWindow       uint32
 	Deployments                   [DefinedDeployments]ConsensusDeployment
 
+	// SigNetChallenge is the challenge script that the blocks of a signet
+	// network are signed for.  It's nil for the networks that aren't
+	// signets.
+	SigNetChallenge []byte
+
+	// LeafCommitments are the heights that the schemes used to commit to
+	// the utreexo accumulator leaves activate at.  Every leaf is committed
+	// with the scheme for the height it's created at.  No upgrades means
+	// that every leaf is committed with wire.LeafCommitmentV0.
+	LeafCommitments wire.LeafCommitmentSchedule
+
 	// Mempool parameters
 	RelayNonStdTxs bool
 
@@ -657,6 +668,8 @@ func CustomSignetParams(challenge []byte, dnsSeeds []DNSSeed) Params {
 		// Checkpoints ordered from oldest to newest.
 		Checkpoints: nil,
 
+		SigNetChallenge: challenge,
+
 		// Consensus rule change deployments.
 		//
 		// The miner confirmation window is defined as:
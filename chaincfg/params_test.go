@@ -9,6 +9,8 @@ import (
 	"encoding/hex"
 	"math/big"
 	"testing"
+
+	"github.com/utreexo/utreexod/wire"
 )
 
 // TestInvalidHashStr ensures the newShaHashFromStr function panics when used to
@@ -104,6 +106,35 @@ func TestSigNetPowLimit(t *testing.T) {
 	}
 }
 
+// TestCustomSignetParams ensures that the network of a signet is derived from
+// its challenge and that the default signet is wire.SigNet.
+func TestCustomSignetParams(t *testing.T) {
+	if SigNetParams.Net != wire.SigNet {
+		t.Fatalf("default signet network is %v, want %v",
+			SigNetParams.Net, wire.SigNet)
+	}
+	if !bytes.Equal(SigNetParams.SigNetChallenge, DefaultSignetChallenge) {
+		t.Fatalf("default signet challenge is %x, want %x",
+			SigNetParams.SigNetChallenge, DefaultSignetChallenge)
+	}
+
+	// An OP_TRUE challenge.
+	challenge := []byte{0x51}
+	custom := CustomSignetParams(challenge, nil)
+	if custom.Net == SigNetParams.Net {
+		t.Fatalf("custom signet has the network of the default signet %v",
+			custom.Net)
+	}
+	if !bytes.Equal(custom.SigNetChallenge, challenge) {
+		t.Fatalf("custom signet challenge is %x, want %x",
+			custom.SigNetChallenge, challenge)
+	}
+	if MainNetParams.SigNetChallenge != nil {
+		t.Fatalf("mainnet has the signet challenge %x",
+			MainNetParams.SigNetChallenge)
+	}
+}
+
 // compactToBig is a copy of the blockchain.CompactToBig function. We copy it
 // here so we don't run into a circular dependency just because of a test.
 func compactToBig(compact uint32) *big.Int {
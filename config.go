@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
@@ -24,6 +25,7 @@ import (
 	"github.com/btcsuite/go-socks/socks"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/blockchain/indexers"
 	"github.com/utreexo/utreexod/btcutil"
 	"github.com/utreexo/utreexod/chaincfg"
 	"github.com/utreexo/utreexod/chaincfg/chainhash"
@@ -31,6 +33,7 @@ import (
 	"github.com/utreexo/utreexod/database"
 	_ "github.com/utreexo/utreexod/database/ffldb"
 	"github.com/utreexo/utreexod/mempool"
+	"github.com/utreexo/utreexod/netsync"
 	"github.com/utreexo/utreexod/peer"
 )
 
@@ -67,6 +70,11 @@ const (
 	defaultTxIndex               = false
 	defaultTTLIndex              = false
 	defaultAddrIndex             = false
+	defaultProofStatsBandWidth   = 10000
+	defaultProofStatsHalfLife    = time.Hour * 24 * 30
+	defaultProofStatsRetention   = time.Hour * 24 * 7
+	defaultProofWatchdogInterval = time.Minute * 10
+	defaultSyncShedLag           = 144
 )
 
 var (
@@ -106,6 +114,7 @@ type config struct {
 	SigCacheMaxSize     uint   `long:"sigcachemaxsize" description:"The maximum number of entries in the signature verification cache"`
 	UtxoCacheMaxSizeMiB uint   `long:"utxocachemaxsize" description:"The maximum size in MiB of the UTXO cache"`
 	Utreexo             bool   `long:"utreexo" description:"Use utreexo compact state during block validation"`
+	UtreexoRelay        bool   `long:"utreexorelay" description:"Verify the utreexo proofs of incoming blocks against a utreexo accumulator kept along with the UTXO set, without a utreexo proof index -- Only the roots of the accumulator are kept, so every block must come with its utreexo data"`
 	NoWinService        bool   `long:"nowinservice" description:"Do not start as a background service on Windows -- NOTE: This flag only works on the command line, not in the config file"`
 
 	// Profiling options.
@@ -198,6 +207,26 @@ type config struct {
 	TTLIndex                  bool `long:"ttlindex" description:"Maintain a full time to live index for all stxos available via the getttl RPC"`
 	UtreexoProofIndex         bool `long:"utreexoproofindex" description:"Maintain a utreexo proof for all blocks"`
 	FlatUtreexoProofIndex     bool `long:"flatutreexoproofindex" description:"Maintain a utreexo proof for all blocks in flat files"`
+	FlatUtreexoFlushInterval  uint `long:"flatutreexoflushinterval" description:"Flush the utreexo state of the flat utreexo proof index to disk every this many blocks. The periodic flushes of the UTXO cache are aligned with these flushes for up to 100 blocks. 0 means the state is only flushed on shutdown"`
+	FlatUtreexoUndoSnapshot   uint `long:"flatutreexoundosnapshot" description:"Delta-encode the undo blocks of the flat utreexo proof index against the previous block and store a full undo block every this many blocks. Changing it from or to 0 requires dropping the index. 0 means every undo block is stored whole"`
+	FlatUtreexoNoLeafTTL      bool `long:"flatutreexonoleafttl" description:"Build the flat utreexo proof index without the leaf time to live data that's only used for analytics, like the coin age statistics of getutreexocoinagestats. The proofs are served as usual. Only allowed with a proof interval of 1. Changing it requires dropping the index"`
+	FlatUtreexoAccMigrate     bool `long:"flatutreexoaccmigrate" description:"Re-encode all the undo blocks of the flat utreexo proof index that were stored by an older accumulator library on start up instead of every time they're read"`
+	FlatUtreexoVerify         bool `long:"flatutreexoverify" description:"Check every proof and undo block of the flat utreexo proof index against the checksum it was stored with on start up and refuse to start at the first corrupt one, telling the height that the index has to be reindexed from"`
+	UtreexoProofGenMaxMemMiB  uint `long:"utreexoproofgenmaxmem" description:"The maximum memory in MiB that in-flight utreexo proof generation and serving is allowed to use. 0 means no limit"`
+	UtreexoProofMaxCallKiB    uint `long:"utreexoproofmaxcall" description:"The maximum memory in KiB that a single utreexo proof request from an RPC call or for a mempool transaction is allowed to use. Only used with --utreexoproofgenmaxmem. 0 means no per-call limit"`
+	UDataMaxMemMiB            uint `long:"udatamaxmem" description:"The maximum memory in MiB that the utreexo data held by all subsystems together is allowed to use. Currently charged by the bulk utreexo proof generation requests of --utreexoproofgenmaxmem, the utreexo proof cache of --utreexoproofcache and the proof sessions and cursors held by clients. 0 means no limit"`
+	UDataMemPressureMiB       uint `long:"udatamempressure" description:"Shrink the subsystems holding utreexo data under --udatamaxmem while the system is under memory pressure and restore them once it clears. The pressure stall information of Linux is read where available. Elsewhere, the value is the memory in MiB of the process past which it's under pressure. 0 disables"`
+	UtreexoUndoAssert         bool `long:"utreexoundoassert" description:"Check that disconnecting every block from the utreexo proof indexes brings their state back to exactly what it was before the block was connected and stop on the first block that doesn't.  Meant for debugging"`
+	UtreexoSharedUndo         bool `long:"utreexosharedundo" description:"Keep the undo blocks of the utreexo proof index in the flat utreexo proof index instead of storing them twice when both are enabled. The undo blocks already stored are migrated on start up and stay shared afterwards"`
+	UtreexoRetainBlocks       uint `long:"utreexoretainblocks" description:"Prune the utreexo proofs and undo blocks of the utreexo proof indexes once their blocks are buried this many blocks deep. The undo blocks of the last 288 blocks are always kept to handle reorgs and the pinned heights of the flat utreexo proof index are never pruned. Proofs that were pruned can only be brought back by reindexing. 0 means nothing is pruned"`
+	UtreexoProofCacheKiB      uint `long:"utreexoproofcache" description:"The maximum memory in KiB of the recently fetched utreexo proofs that the utreexo proof index keeps to serve them again without reading them from the database. 0 disables the cache"`
+	UtreexoLeafLimitWarn      bool `long:"utreexoleaflimitwarn" description:"Only warn instead of refusing to start when the forest of a utreexo proof index holds all but an eighth of the most leaves that its storage can address with the ints of the platform. Meant for 32-bit platforms, where the limit is within reach"`
+	IndexMaintMaxKiBps        uint `long:"indexmaintmaxkibps" description:"The maximum disk I/O in KiB per second that background index maintenance such as catching up and dropping indexes is allowed to do. 0 means no limit"`
+	IndexMaintMaxOps          uint `long:"indexmaintmaxops" description:"The maximum disk I/O operations per second that background index maintenance such as catching up and dropping indexes is allowed to do. 0 means no limit"`
+	IndexSplitWriteKiB        uint `long:"indexsplitwrite" description:"Write the transaction, address, committed filter and time to live indexes of a block in their own database transactions after the one of the block once the estimated writes of the block to all the indexes exceed this many KiB. The utreexo proof indexes are always written along with the block. 0 means everything is always written along with the block"`
+	IndexCatchUpWorkers       uint `long:"indexcatchupworkers" description:"How many of the indexes are caught up to the chain tip at the same time on start up. The indexes that depend on one another, like the address index on the transaction index, are always caught up together"`
+	IndexCatchUpFetchers      uint `long:"indexcatchupfetchers" description:"How many blocks are loaded at the same time for each of the indexes that are caught up to the chain tip on start up. Only connecting the blocks to the indexes is done one block at a time. 0 loads every block right before it's connected"`
+	IndexCatchUpQueue         uint `long:"indexcatchupqueue" description:"How many blocks are loaded ahead of the one that's connected to each of the indexes that are caught up to the chain tip on start up. Raised to the number of fetchers if it's below it"`
 	NoCFilters                bool `long:"nocfilters" description:"Disable committed filtering (CF) support"`
 	NoPeerBloomFilters        bool `long:"nopeerbloomfilters" description:"Disable bloom filtering support"`
 	DropAddrIndex             bool `long:"dropaddrindex" description:"Deletes the address-based transaction index from the database on start up and then exits."`
@@ -205,16 +234,55 @@ type config struct {
 	DropTxIndex               bool `long:"droptxindex" description:"Deletes the hash-based transaction index from the database on start up and then exits."`
 	DropTTLIndex              bool `long:"dropttlindex" description:"Deletes the time to live index from the database on start up and then exits."`
 	DropUtreexoProofIndex     bool `long:"droputreexoproofindex" description:"Deletes the utreexo proof index from the database on start up and then exits."`
-	DropFlatUtreexoProofIndex bool `long:"dropflatutreexoproofindex" description:"Deletes the flat utreexo proof index from the database on start up and then exits."`
+	DropFlatUtreexoProofIndex bool `long:"dropflatutreexoproofindex" description:"Deletes the flat utreexo proof index from the database along with its flat files and utreexo state on start up and then exits. Fails after dropping it if some of its files were already missing."`
+	SelfTest                  bool `long:"selftest" description:"Runs a self-test of the utreexo bridge pipeline on a throwaway regtest chain on start up and then exits."`
+
+	// Utreexo proof index durability options.
+	UtreexoFsync string `long:"utreexofsync" description:"How the utreexo proof indexes sync what they write to disk: strict syncs everything as it's written, relaxed only syncs the proofs and the proof statistics every 144 blocks and before the utreexo state is flushed, or a comma-separated list of class=mode pairs for the proofs, proofstats, undo, and quarantine classes such as proofs=relaxed,undo=strict. Meant to be relaxed only on battery-backed or replicated storage"`
+
+	// Utreexo proof index recovery options.
+	UtreexoIndexRecovery  string `long:"utreexoindexrecovery" description:"What's done on start up when one of the utreexo proof indexes lost its entries while the other one covers the chain: auto rebuilds it from the entries and the utreexo state of the other one, prompt logs that it can be and catches it up by connecting every block to it, and off catches it up without saying anything. Only used when both --utreexoproofindex and --flatutreexoproofindex are enabled"`
+	UtreexoRecoverySample uint   `long:"utreexorecoverysample" description:"Verify the rebuilt utreexo proof of every this many blocks within the last 1000 against the accumulator roots when a utreexo proof index is rebuilt from the other one. 0 means every 10 blocks"`
+	UtreexoMigrate        string `long:"utreexomigrate" description:"Migrate one utreexo proof index to the other on start up by copying its entries and utreexo state rather than connecting every block to it: toflat migrates the utreexo proof index to the flat one and todb the flat one to the utreexo proof index. Whatever the destination had is thrown away. An interrupted migration is resumed on the next start up. Needs both --utreexoproofindex and --flatutreexoproofindex"`
+
+	// Utreexo proof serving statistics options.
+	ProofStatsBandWidth uint          `long:"proofstatsbandwidth" description:"The width in blocks of the height bands that the utreexo proofs served to peers are tallied in"`
+	ProofStatsHalfLife  time.Duration `long:"proofstatshalflife" description:"How long it takes for the tallied requests of a height band to count half as much.  Valid time units are {s, m, h}"`
+	ProofStatsRetention time.Duration `long:"proofstatsretention" description:"How long the requests, bytes, and peers of each height band are kept for to be reported over windows.  Valid time units are {s, m, h}.  Minimum 1 hour"`
+	ServingLagBlocks    uint          `long:"servinglagblocks" description:"Record when the utreexo proofs of the last this many connected blocks were generated, persisted, and first served to report the lags in getindexinfo. 0 means nothing is recorded"`
+	ServingLagExport    string        `long:"servinglagexport" description:"File that the recorded serving lags of the blocks are appended to as lines of JSON once they're dropped from memory. Only used with --servinglagblocks"`
+
+	// Utreexo proof receipt options.
+	ProofReceipts         bool          `long:"proofreceipts" description:"Sign receipts of the utreexo proofs served to the RPC clients that ask for them with the attestation key of the node and record the serves in an audit log to confirm presented receipts against"`
+	ProofReceiptRetention time.Duration `long:"proofreceiptretention" description:"How long the serves that receipts were signed for are kept in the audit log.  Valid time units are {s, m, h}.  0 keeps them for 90 days"`
+
+	// Utreexo proof watchdog options.
+	ProofWatchdog         []string      `long:"proofwatchdog" description:"Audit the utreexo proofs served over RPC by the bridge at user:password@host:port against the local index -- May be specified multiple times"`
+	ProofWatchdogCert     string        `long:"proofwatchdogcert" description:"File containing the certificate of the RPC servers of the audited bridges"`
+	ProofWatchdogNoTLS    bool          `long:"proofwatchdognotls" description:"Connect to the RPC servers of the audited bridges without TLS"`
+	ProofWatchdogInterval time.Duration `long:"proofwatchdoginterval" description:"How often the utreexo proof of a random historical block is audited.  Valid time units are {s, m, h}.  0 only audits new blocks"`
+
+	// Utreexo proof sampling options.
+	ProofSampleRate float64 `long:"proofsamplerate" description:"The fraction of the utreexo proofs sent with the blocks that are checked before the blocks are validated.  More are checked for sources that served invalid proofs.  Only used with --utreexo"`
+
+	// Utreexo proof verification options.
+	UtreexoProofWorkers uint `long:"utreexoproofworkers" description:"Verify the utreexo proof of a block with this many goroutines, each checking the leaves in different trees of the accumulator.  Only used with --utreexo.  0 or 1 verifies the whole proof on one goroutine"`
+
+	// Initial block download load shedding options.
+	NoSyncShedding bool `long:"nosyncshedding" description:"Serve the historical utreexo RPCs and keep the proof watchdog running during the initial block download at the cost of a slower sync"`
+	SyncShedLag    uint `long:"syncshedlag" description:"The number of blocks that the chain may be behind the peers before the historical utreexo RPCs are refused and the proof watchdog is paused"`
 
 	// Cooked options ready for use.
-	lookup         func(string) ([]net.IP, error)
-	oniondial      func(string, string, time.Duration) (net.Conn, error)
-	dial           func(string, string, time.Duration) (net.Conn, error)
-	addCheckpoints []chaincfg.Checkpoint
-	miningAddrs    []btcutil.Address
-	minRelayTxFee  btcutil.Amount
-	whitelists     []*net.IPNet
+	lookup          func(string) ([]net.IP, error)
+	oniondial       func(string, string, time.Duration) (net.Conn, error)
+	dial            func(string, string, time.Duration) (net.Conn, error)
+	addCheckpoints  []chaincfg.Checkpoint
+	utreexoFsync    indexers.FsyncPolicy
+	utreexoRecovery indexers.RecoveryMode
+	utreexoMigrate  indexers.MigrationDirection
+	miningAddrs     []btcutil.Address
+	minRelayTxFee   btcutil.Amount
+	whitelists      []*net.IPNet
 }
 
 // serviceOptions defines the configuration options for the daemon as a service on
@@ -476,6 +544,18 @@ func loadConfig() (*config, []string, error) {
 		TxIndex:              defaultTxIndex,
 		TTLIndex:             defaultTTLIndex,
 		AddrIndex:            defaultAddrIndex,
+		ProofStatsBandWidth:  defaultProofStatsBandWidth,
+		ProofStatsHalfLife:   defaultProofStatsHalfLife,
+		ProofStatsRetention:  defaultProofStatsRetention,
+
+		ProofWatchdogInterval: defaultProofWatchdogInterval,
+		ProofSampleRate:       netsync.DefaultProofSampleRate,
+		SyncShedLag:           defaultSyncShedLag,
+		IndexSplitWriteKiB:    indexers.DefaultSplitWriteThreshold / 1024,
+		UtreexoProofCacheKiB:  indexers.DefaultProofCacheSize / 1024,
+		IndexCatchUpWorkers:   indexers.DefaultCatchUpWorkers,
+		IndexCatchUpFetchers:  indexers.DefaultCatchUpFetchers,
+		IndexCatchUpQueue:     indexers.DefaultCatchUpQueueDepth,
 	}
 
 	// Service options which are only added on Windows.
@@ -725,6 +805,43 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	// Validate the utreexo proof retention option.
+	if cfg.UtreexoRetainBlocks > math.MaxInt32 {
+		str := "%s: The utreexoretainblocks option must be at most " +
+			"%d -- parsed [%d]"
+		err := fmt.Errorf(str, funcName, math.MaxInt32, cfg.UtreexoRetainBlocks)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
+	// Validate the utreexo proof serving statistics options.
+	if cfg.ProofStatsBandWidth == 0 || cfg.ProofStatsBandWidth > math.MaxInt32 {
+		str := "%s: The proofstatsbandwidth option must be between 1 " +
+			"and %d -- parsed [%d]"
+		err := fmt.Errorf(str, funcName, math.MaxInt32, cfg.ProofStatsBandWidth)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.ProofStatsHalfLife <= 0 {
+		str := "%s: The proofstatshalflife option must be positive " +
+			"-- parsed [%v]"
+		err := fmt.Errorf(str, funcName, cfg.ProofStatsHalfLife)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+	if cfg.ProofStatsRetention < proofStatsSlotDuration {
+		str := "%s: The proofstatsretention option may not be less " +
+			"than %v -- parsed [%v]"
+		err := fmt.Errorf(str, funcName, proofStatsSlotDuration,
+			cfg.ProofStatsRetention)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
 	// Validate any given whitelisted IP addresses and networks.
 	if len(cfg.Whitelists) > 0 {
 		var ip net.IP
@@ -1001,6 +1118,16 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	// Cross-check the utreexo options for settings that contradict each
+	// other or that have no effect.
+	utreexoWarnings, err := checkUtreexoOptions(&cfg)
+	if err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return nil, nil, err
+	}
+
 	// Check mining addresses are valid and saved parsed versions.
 	cfg.miningAddrs = make([]btcutil.Address, 0, len(cfg.MiningAddrs))
 	for _, strAddr := range cfg.MiningAddrs {
@@ -1219,10 +1346,199 @@ func loadConfig() (*config, []string, error) {
 	if configFileError != nil {
 		btcdLog.Warnf("%v", configFileError)
 	}
+	for _, warning := range utreexoWarnings {
+		btcdLog.Warnf("%s", warning)
+	}
 
 	return &cfg, remainingArgs, nil
 }
 
+// checkUtreexoOptions cross-checks the options of the utreexo proof indexes
+// for consistency.  An error naming the conflicting options is returned for
+// settings that contradict each other.  Warnings are returned for options that
+// have no effect with the other settings.
+func checkUtreexoOptions(cfg *config) ([]string, error) {
+	var warnings []string
+	proofIndex := cfg.UtreexoProofIndex || cfg.FlatUtreexoProofIndex
+
+	// A single call can't be allowed more memory than all of in-flight
+	// proof generation together.
+	if cfg.UtreexoProofGenMaxMemMiB > 0 &&
+		cfg.UtreexoProofMaxCallKiB > cfg.UtreexoProofGenMaxMemMiB*1024 {
+
+		return nil, fmt.Errorf("the --utreexoproofmaxcall option of %d "+
+			"KiB may not be larger than the --utreexoproofgenmaxmem "+
+			"option of %d MiB", cfg.UtreexoProofMaxCallKiB,
+			cfg.UtreexoProofGenMaxMemMiB)
+	}
+
+	// The periodic flushes of the UTXO cache are only postponed for so
+	// long to align them with the utreexo state flushes.
+	if cfg.FlatUtreexoFlushInterval > blockchain.MaxFlushAlignDelay {
+		warnings = append(warnings, fmt.Sprintf("The "+
+			"--flatutreexoflushinterval option of %d blocks is longer "+
+			"than the %d blocks that the UTXO cache flushes are "+
+			"postponed for to align them.  The UTXO cache will be "+
+			"flushed at heights that the utreexo state isn't "+
+			"durable at", cfg.FlatUtreexoFlushInterval,
+			blockchain.MaxFlushAlignDelay))
+	}
+
+	// A verifying relay keeps its own accumulator along with the UTXO set,
+	// which neither a utreexo node nor a utreexo proof index has use for.
+	if cfg.UtreexoRelay && cfg.Utreexo {
+		return nil, fmt.Errorf("the --utreexorelay and --utreexo options " +
+			"may not be activated at the same time")
+	}
+	if cfg.UtreexoRelay && proofIndex {
+		return nil, fmt.Errorf("the --utreexorelay option may not be " +
+			"activated along with --utreexoproofindex or " +
+			"--flatutreexoproofindex")
+	}
+
+	ignored := func(option, needs string) {
+		warnings = append(warnings, fmt.Sprintf("The --%s option is "+
+			"ignored without %s", option, needs))
+	}
+	if !cfg.FlatUtreexoProofIndex {
+		if cfg.FlatUtreexoFlushInterval > 0 {
+			ignored("flatutreexoflushinterval", "--flatutreexoproofindex")
+		}
+		if cfg.FlatUtreexoUndoSnapshot > 0 {
+			ignored("flatutreexoundosnapshot", "--flatutreexoproofindex")
+		}
+		if cfg.FlatUtreexoAccMigrate {
+			ignored("flatutreexoaccmigrate", "--flatutreexoproofindex")
+		}
+		if cfg.FlatUtreexoVerify {
+			ignored("flatutreexoverify", "--flatutreexoproofindex")
+		}
+		if cfg.FlatUtreexoNoLeafTTL {
+			ignored("flatutreexonoleafttl", "--flatutreexoproofindex")
+		}
+	}
+	const needsProofIndex = "--utreexoproofindex or --flatutreexoproofindex"
+	if !proofIndex && cfg.UtreexoProofGenMaxMemMiB > 0 {
+		ignored("utreexoproofgenmaxmem", needsProofIndex)
+	}
+	if !proofIndex && cfg.UtreexoUndoAssert {
+		ignored("utreexoundoassert", needsProofIndex)
+	}
+	if !proofIndex && cfg.UtreexoRetainBlocks > 0 {
+		ignored("utreexoretainblocks", needsProofIndex)
+	}
+	if !proofIndex && cfg.UtreexoLeafLimitWarn {
+		ignored("utreexoleaflimitwarn", needsProofIndex)
+	}
+	if !cfg.UtreexoProofIndex &&
+		cfg.UtreexoProofCacheKiB != indexers.DefaultProofCacheSize/1024 {
+
+		ignored("utreexoproofcache", "--utreexoproofindex")
+	}
+	if cfg.UtreexoSharedUndo && !(cfg.UtreexoProofIndex && cfg.FlatUtreexoProofIndex) {
+		ignored("utreexosharedundo", "both --utreexoproofindex and "+
+			"--flatutreexoproofindex")
+	}
+	if !proofIndex && cfg.ServingLagBlocks > 0 {
+		ignored("servinglagblocks", needsProofIndex)
+	}
+	if cfg.ServingLagExport != "" && (!proofIndex || cfg.ServingLagBlocks == 0) {
+		ignored("servinglagexport", "--servinglagblocks")
+	}
+	if !proofIndex && cfg.ProofReceipts {
+		ignored("proofreceipts", needsProofIndex)
+	}
+	if cfg.ProofReceiptRetention != 0 && (!proofIndex || !cfg.ProofReceipts) {
+		ignored("proofreceiptretention", "--proofreceipts")
+	}
+	if cfg.UtreexoProofMaxCallKiB > 0 && cfg.UtreexoProofGenMaxMemMiB == 0 {
+		ignored("utreexoproofmaxcall", "--utreexoproofgenmaxmem")
+	}
+	if cfg.UDataMaxMemMiB > 0 && (!proofIndex || cfg.UtreexoProofGenMaxMemMiB == 0) {
+		ignored("udatamaxmem", "--utreexoproofgenmaxmem")
+	}
+	if cfg.UDataMemPressureMiB > 0 && (!proofIndex ||
+		cfg.UtreexoProofGenMaxMemMiB == 0 || cfg.UDataMaxMemMiB == 0) {
+
+		ignored("udatamempressure", "--udatamaxmem")
+	}
+	if !proofIndex && (cfg.ProofStatsBandWidth != defaultProofStatsBandWidth ||
+		cfg.ProofStatsHalfLife != defaultProofStatsHalfLife ||
+		cfg.ProofStatsRetention != defaultProofStatsRetention) {
+
+		ignored("proofstats*", needsProofIndex)
+	}
+
+	// The policy is parsed here so that a typo stops the node before
+	// anything is written with the default one.
+	fsync, err := indexers.ParseFsyncPolicy(cfg.UtreexoFsync)
+	if err != nil {
+		return nil, fmt.Errorf("the --utreexofsync option: %v", err)
+	}
+	cfg.utreexoFsync = fsync
+	if !proofIndex && cfg.UtreexoFsync != "" {
+		ignored("utreexofsync", needsProofIndex)
+	}
+
+	recovery, err := indexers.ParseRecoveryMode(cfg.UtreexoIndexRecovery)
+	if err != nil {
+		return nil, fmt.Errorf("the --utreexoindexrecovery option: %v", err)
+	}
+	cfg.utreexoRecovery = recovery
+	bothIndexes := cfg.UtreexoProofIndex && cfg.FlatUtreexoProofIndex
+	if !bothIndexes && cfg.UtreexoIndexRecovery != "" {
+		ignored("utreexoindexrecovery", "both --utreexoproofindex and "+
+			"--flatutreexoproofindex")
+	}
+	if (!bothIndexes || recovery != indexers.RecoveryAuto) &&
+		cfg.UtreexoRecoverySample != 0 {
+
+		ignored("utreexorecoverysample", "--utreexoindexrecovery=auto")
+	}
+	migrate, err := indexers.ParseMigrationDirection(cfg.UtreexoMigrate)
+	if err != nil {
+		return nil, fmt.Errorf("the --utreexomigrate option: %v", err)
+	}
+	cfg.utreexoMigrate = migrate
+	if !bothIndexes && migrate != indexers.MigrateNone {
+		return nil, fmt.Errorf("the --utreexomigrate option needs both " +
+			"--utreexoproofindex and --flatutreexoproofindex")
+	}
+
+	if cfg.ProofSampleRate <= 0 || cfg.ProofSampleRate > 1 {
+		return nil, fmt.Errorf("the --proofsamplerate option must be "+
+			"more than 0 and at most 1 -- parsed [%v]", cfg.ProofSampleRate)
+	}
+	if !cfg.Utreexo && cfg.ProofSampleRate != netsync.DefaultProofSampleRate {
+		ignored("proofsamplerate", "--utreexo")
+	}
+	if cfg.UtreexoProofWorkers > math.MaxInt32 {
+		return nil, fmt.Errorf("the --utreexoproofworkers option may not "+
+			"be more than %d -- parsed [%d]", math.MaxInt32,
+			cfg.UtreexoProofWorkers)
+	}
+	if !cfg.Utreexo && cfg.UtreexoProofWorkers > 0 {
+		ignored("utreexoproofworkers", "--utreexo")
+	}
+
+	// The audited bridges are compared against the local proof index.
+	for _, source := range cfg.ProofWatchdog {
+		_, _, _, err := parseProofWatchdogSource(source)
+		if err != nil {
+			return nil, fmt.Errorf("the --proofwatchdog option: %v", err)
+		}
+	}
+	if cfg.ProofWatchdogInterval < 0 {
+		return nil, fmt.Errorf("the --proofwatchdoginterval option may "+
+			"not be negative -- parsed [%v]", cfg.ProofWatchdogInterval)
+	}
+	if !proofIndex && len(cfg.ProofWatchdog) > 0 {
+		ignored("proofwatchdog", needsProofIndex)
+	}
+
+	return warnings, nil
+}
+
 // createDefaultConfig copies the file sample-btcd.conf to the given destination path,
 // and populates it with some randomly generated RPC username and password.
 func createDefaultConfigFile(destinationPath string) error {
@@ -6,7 +6,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/utreexo/utreexod/blockchain/indexers"
+	"github.com/utreexo/utreexod/netsync"
 )
 
 var (
@@ -70,3 +74,198 @@ func TestCreateDefaultConfigFile(t *testing.T) {
 		t.Error("Could not find rpcpass in generated default config file.")
 	}
 }
+
+// TestCheckUtreexoOptions ensures that contradictory utreexo options are
+// rejected by naming them and that options without effect are warned about.
+func TestCheckUtreexoOptions(t *testing.T) {
+	newConfig := func() config {
+		return config{
+			ProofStatsBandWidth: defaultProofStatsBandWidth,
+			ProofStatsHalfLife:  defaultProofStatsHalfLife,
+			ProofStatsRetention: defaultProofStatsRetention,
+			ProofSampleRate:     netsync.DefaultProofSampleRate,
+
+			UtreexoProofCacheKiB: indexers.DefaultProofCacheSize / 1024,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(cfg *config)
+		err      []string
+		warnings []string
+	}{
+		{
+			name:   "defaults",
+			modify: func(cfg *config) {},
+		},
+		{
+			name: "consistent flat index",
+			modify: func(cfg *config) {
+				cfg.FlatUtreexoProofIndex = true
+				cfg.FlatUtreexoFlushInterval = 50
+				cfg.FlatUtreexoUndoSnapshot = 10
+				cfg.UtreexoProofGenMaxMemMiB = 1
+				cfg.UtreexoProofMaxCallKiB = 1024
+			},
+		},
+		{
+			name: "relay with a utreexo node",
+			modify: func(cfg *config) {
+				cfg.Utreexo = true
+				cfg.UtreexoRelay = true
+			},
+			err: []string{"--utreexorelay", "--utreexo "},
+		},
+		{
+			name: "relay with a proof index",
+			modify: func(cfg *config) {
+				cfg.FlatUtreexoProofIndex = true
+				cfg.UtreexoRelay = true
+			},
+			err: []string{"--utreexorelay", "--flatutreexoproofindex"},
+		},
+		{
+			name: "call larger than the budget",
+			modify: func(cfg *config) {
+				cfg.UtreexoProofIndex = true
+				cfg.UtreexoProofGenMaxMemMiB = 1
+				cfg.UtreexoProofMaxCallKiB = 1025
+			},
+			err: []string{"--utreexoproofmaxcall", "--utreexoproofgenmaxmem"},
+		},
+		{
+			name: "flush interval past the alignment",
+			modify: func(cfg *config) {
+				cfg.FlatUtreexoProofIndex = true
+				cfg.FlatUtreexoFlushInterval = 101
+			},
+			warnings: []string{"--flatutreexoflushinterval"},
+		},
+		{
+			name: "flat options without the flat index",
+			modify: func(cfg *config) {
+				cfg.UtreexoProofIndex = true
+				cfg.FlatUtreexoFlushInterval = 10
+				cfg.FlatUtreexoUndoSnapshot = 10
+				cfg.FlatUtreexoAccMigrate = true
+				cfg.FlatUtreexoVerify = true
+			},
+			warnings: []string{"--flatutreexoflushinterval",
+				"--flatutreexoundosnapshot", "--flatutreexoaccmigrate",
+				"--flatutreexoverify"},
+		},
+		{
+			name: "proof options without an index",
+			modify: func(cfg *config) {
+				cfg.UtreexoProofMaxCallKiB = 10
+				cfg.ProofStatsBandWidth = 100
+			},
+			warnings: []string{"--utreexoproofmaxcall", "--proofstats"},
+		},
+		{
+			name: "malformed proof watchdog source",
+			modify: func(cfg *config) {
+				cfg.FlatUtreexoProofIndex = true
+				cfg.ProofWatchdog = []string{"user:pass@127.0.0.1:8334",
+					"127.0.0.1:8334"}
+			},
+			err: []string{"--proofwatchdog"},
+		},
+		{
+			name: "proof watchdog without an index",
+			modify: func(cfg *config) {
+				cfg.ProofWatchdog = []string{"user:pass@127.0.0.1:8334"}
+			},
+			warnings: []string{"--proofwatchdog"},
+		},
+		{
+			name: "proof sample rate out of range",
+			modify: func(cfg *config) {
+				cfg.Utreexo = true
+				cfg.ProofSampleRate = 1.5
+			},
+			err: []string{"--proofsamplerate"},
+		},
+		{
+			name: "proof sample rate without the compact state",
+			modify: func(cfg *config) {
+				cfg.ProofSampleRate = 1
+			},
+			warnings: []string{"--proofsamplerate"},
+		},
+		{
+			name: "proof workers with the compact state",
+			modify: func(cfg *config) {
+				cfg.Utreexo = true
+				cfg.UtreexoProofWorkers = 4
+			},
+		},
+		{
+			name: "proof workers without the compact state",
+			modify: func(cfg *config) {
+				cfg.UtreexoProofWorkers = 4
+			},
+			warnings: []string{"--utreexoproofworkers"},
+		},
+		{
+			name: "proof cache without the database index",
+			modify: func(cfg *config) {
+				cfg.FlatUtreexoProofIndex = true
+				cfg.UtreexoProofCacheKiB = 0
+			},
+			warnings: []string{"--utreexoproofcache"},
+		},
+		{
+			name: "migration with both indexes",
+			modify: func(cfg *config) {
+				cfg.UtreexoProofIndex = true
+				cfg.FlatUtreexoProofIndex = true
+				cfg.UtreexoMigrate = "toflat"
+			},
+		},
+		{
+			name: "migration with a single index",
+			modify: func(cfg *config) {
+				cfg.UtreexoProofIndex = true
+				cfg.UtreexoMigrate = "toflat"
+			},
+			err: []string{"--utreexomigrate", "--flatutreexoproofindex"},
+		},
+		{
+			name: "unknown migration direction",
+			modify: func(cfg *config) {
+				cfg.UtreexoProofIndex = true
+				cfg.FlatUtreexoProofIndex = true
+				cfg.UtreexoMigrate = "sideways"
+			},
+			err: []string{"--utreexomigrate", "toflat or todb"},
+		},
+	}
+
+	for _, test := range tests {
+		cfg := newConfig()
+		test.modify(&cfg)
+
+		warnings, err := checkUtreexoOptions(&cfg)
+		if (err != nil) != (len(test.err) > 0) {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		for _, option := range test.err {
+			if !strings.Contains(err.Error(), option) {
+				t.Fatalf("%s: expected the error to name %s, got %v",
+					test.name, option, err)
+			}
+		}
+		if len(warnings) != len(test.warnings) {
+			t.Fatalf("%s: expected %d warnings, got %v", test.name,
+				len(test.warnings), warnings)
+		}
+		for i, option := range test.warnings {
+			if !strings.Contains(warnings[i], option) {
+				t.Fatalf("%s: expected warning %d to name %s, got %q",
+					test.name, i, option, warnings[i])
+			}
+		}
+	}
+}
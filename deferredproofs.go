@@ -0,0 +1,245 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// maxDeferredProofs is the most requests for the utreexo proofs of
+	// blocks that aren't connected yet that are kept at once.
+	maxDeferredProofs = 1000
+
+	// maxDeferredProofsPerPeer is the most requests for the utreexo proofs
+	// of blocks that aren't connected yet that are kept for a single peer.
+	maxDeferredProofsPerPeer = 8
+
+	// deferredProofExpiry is how long a request for the utreexo proof of a
+	// block that isn't connected yet is kept before the peer is told that
+	// the block wasn't found after all.
+	deferredProofExpiry = time.Minute
+
+	// deferredProofSweepInterval is how often the expired requests for the
+	// utreexo proofs of blocks that aren't connected yet are answered.
+	deferredProofSweepInterval = 10 * time.Second
+
+	// deferredProofMaxAge is how old the timestamp of a known header may be
+	// for its block to still be taken as a new tip that's about to be
+	// connected.
+	deferredProofMaxAge = 2 * time.Hour
+)
+
+// proofRequester is a peer that asked for the utreexo proof of a block.
+type proofRequester interface {
+	Connected() bool
+	ProtocolVersion() uint32
+	QueueMessage(msg wire.Message, doneChan chan<- struct{})
+}
+
+// deferredProof is a request for the utreexo proof of a block that wasn't
+// connected yet when the peer asked for it.
+type deferredProof struct {
+	requester proofRequester
+	iv        wire.InvVect
+	expires   time.Time
+}
+
+// deferredProofs keeps the requests of peers for the utreexo proofs of blocks
+// that are likely new tips that aren't connected yet, like when a peer heard
+// of a block before us.  Instead of notfound, which some peers take as missing
+// data, the peers are told that the proofs aren't ready yet and the blocks are
+// pushed to them along with their proofs once they're connected.  The requests
+// for the blocks that don't get connected in time are answered with notfound.
+//
+// Only peers that know the notready message get their requests deferred.  The
+// number of requests that are kept is bounded both in total and per peer.
+type deferredProofs struct {
+	// isPlausibleTip returns whether the block with the given hash isn't
+	// connected yet but is likely to be a new tip that's about to be.
+	isPlausibleTip func(hash *chainhash.Hash) bool
+
+	// push sends the block the inventory vector is for along with its
+	// utreexo proof to the peer.
+	push func(requester proofRequester, iv *wire.InvVect)
+
+	// now returns the current time.  It's replaced by the tests.
+	now func() time.Time
+
+	mtx      sync.Mutex
+	requests map[chainhash.Hash][]*deferredProof
+	perPeer  map[proofRequester]int
+	count    int
+}
+
+// newDeferredProofs returns an empty table of deferred utreexo proof requests.
+func newDeferredProofs(isPlausibleTip func(hash *chainhash.Hash) bool,
+	push func(requester proofRequester, iv *wire.InvVect)) *deferredProofs {
+
+	return &deferredProofs{
+		isPlausibleTip: isPlausibleTip,
+		push:           push,
+		now:            time.Now,
+		requests:       make(map[chainhash.Hash][]*deferredProof),
+		perPeer:        make(map[proofRequester]int),
+	}
+}
+
+// isUtreexoBlockInv returns whether the inventory vector asks for a block along
+// with its utreexo proof.
+func isUtreexoBlockInv(iv *wire.InvVect) bool {
+	return iv.Type == wire.InvTypeUtreexoBlock ||
+		iv.Type == wire.InvTypeWitnessUtreexoBlock
+}
+
+// Defer keeps the request of the peer for the block and its utreexo proof that
+// couldn't be served and returns whether it did.  The peer is then to be told
+// that the block isn't ready yet with a notready message rather than notfound.
+// The request isn't kept if the peer doesn't know the notready message, if the
+// block isn't likely a new tip, or if the table is full.
+//
+// This function is safe for concurrent access.
+func (d *deferredProofs) Defer(requester proofRequester, iv *wire.InvVect) bool {
+	if !isUtreexoBlockInv(iv) ||
+		requester.ProtocolVersion() < wire.NotReadyVersion ||
+		!d.isPlausibleTip(&iv.Hash) {
+
+		return false
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	expires := d.now().Add(deferredProofExpiry)
+
+	// A request that's asked again is only kept for longer.
+	for _, req := range d.requests[iv.Hash] {
+		if req.requester == requester && req.iv.Type == iv.Type {
+			req.expires = expires
+			return true
+		}
+	}
+
+	if d.count >= maxDeferredProofs ||
+		d.perPeer[requester] >= maxDeferredProofsPerPeer {
+
+		return false
+	}
+
+	d.requests[iv.Hash] = append(d.requests[iv.Hash], &deferredProof{
+		requester: requester,
+		iv:        *iv,
+		expires:   expires,
+	})
+	d.perPeer[requester]++
+	d.count++
+
+	return true
+}
+
+// remove takes the request out of the counts.
+//
+// This function MUST be called with the mutex held.
+func (d *deferredProofs) remove(req *deferredProof) {
+	d.count--
+	d.perPeer[req.requester]--
+	if d.perPeer[req.requester] <= 0 {
+		delete(d.perPeer, req.requester)
+	}
+}
+
+// BlockConnected pushes the block with the given hash and its utreexo proof to
+// the peers that asked for it before it was connected.
+//
+// This function is safe for concurrent access.
+func (d *deferredProofs) BlockConnected(hash *chainhash.Hash) {
+	d.mtx.Lock()
+	reqs := d.requests[*hash]
+	delete(d.requests, *hash)
+	for _, req := range reqs {
+		d.remove(req)
+	}
+	d.mtx.Unlock()
+
+	for _, req := range reqs {
+		if !req.requester.Connected() {
+			continue
+		}
+		d.push(req.requester, &req.iv)
+	}
+}
+
+// Expire answers the requests that were kept for longer than the expiry with
+// notfound since their blocks didn't get connected in time.
+//
+// This function is safe for concurrent access.
+func (d *deferredProofs) Expire() {
+	now := d.now()
+	notFound := make(map[proofRequester]*wire.MsgNotFound)
+
+	d.mtx.Lock()
+	for hash, reqs := range d.requests {
+		kept := reqs[:0]
+		for _, req := range reqs {
+			if now.Before(req.expires) {
+				kept = append(kept, req)
+				continue
+			}
+			d.remove(req)
+
+			msg, ok := notFound[req.requester]
+			if !ok {
+				msg = wire.NewMsgNotFound()
+				notFound[req.requester] = msg
+			}
+			iv := req.iv
+			msg.AddInvVect(&iv)
+		}
+		if len(kept) == 0 {
+			delete(d.requests, hash)
+			continue
+		}
+		d.requests[hash] = kept
+	}
+	d.mtx.Unlock()
+
+	for requester, msg := range notFound {
+		if !requester.Connected() {
+			continue
+		}
+		requester.QueueMessage(msg, nil)
+	}
+}
+
+// RemovePeer drops the requests of the peer.
+//
+// This function is safe for concurrent access.
+func (d *deferredProofs) RemovePeer(requester proofRequester) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.perPeer[requester] == 0 {
+		return
+	}
+	for hash, reqs := range d.requests {
+		kept := reqs[:0]
+		for _, req := range reqs {
+			if req.requester == requester {
+				d.remove(req)
+				continue
+			}
+			kept = append(kept, req)
+		}
+		if len(kept) == 0 {
+			delete(d.requests, hash)
+			continue
+		}
+		d.requests[hash] = kept
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/peer"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// deferTestConn is a net.Conn with TCP addresses so that the peers accept it.
+type deferTestConn struct {
+	net.Conn
+	laddr, raddr net.Addr
+}
+
+func (c *deferTestConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *deferTestConn) RemoteAddr() net.Addr { return c.raddr }
+
+// deferTestPeers connects a bridge that answers getdata with the deferred
+// proofs to a peer that records the responses on the returned channels.  The
+// peer asks with the given protocol version.
+func deferTestPeers(t *testing.T, d *deferredProofs, pver uint32) (*peer.Peer,
+	chan *wire.MsgNotReady, chan *wire.MsgBlock, chan *wire.MsgNotFound) {
+
+	t.Helper()
+
+	notReadyChan := make(chan *wire.MsgNotReady, 10)
+	blockChan := make(chan *wire.MsgBlock, 10)
+	notFoundChan := make(chan *wire.MsgNotFound, 10)
+	verack := make(chan struct{}, 2)
+
+	bridgeCfg := &peer.Config{
+		Listeners: peer.MessageListeners{
+			OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+				verack <- struct{}{}
+			},
+			OnGetData: func(p *peer.Peer, msg *wire.MsgGetData) {
+				notFound := wire.NewMsgNotFound()
+				notReady := wire.NewMsgNotReady()
+				for _, iv := range msg.InvList {
+					if d.Defer(p, iv) {
+						notReady.AddInvVect(iv)
+					} else {
+						notFound.AddInvVect(iv)
+					}
+				}
+				if len(notReady.InvList) != 0 {
+					p.QueueMessage(notReady, nil)
+				}
+				if len(notFound.InvList) != 0 {
+					p.QueueMessage(notFound, nil)
+				}
+			},
+		},
+		ChainParams:     &chaincfg.MainNetParams,
+		TrickleInterval: time.Second * 10,
+		AllowSelfConns:  true,
+	}
+	csnCfg := &peer.Config{
+		Listeners: peer.MessageListeners{
+			OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+				verack <- struct{}{}
+			},
+			OnNotReady: func(p *peer.Peer, msg *wire.MsgNotReady) {
+				notReadyChan <- msg
+			},
+			OnBlock: func(p *peer.Peer, msg *wire.MsgBlock, buf []byte) {
+				blockChan <- msg
+			},
+			OnNotFound: func(p *peer.Peer, msg *wire.MsgNotFound) {
+				notFoundChan <- msg
+			},
+		},
+		ProtocolVersion: pver,
+		ChainParams:     &chaincfg.MainNetParams,
+		TrickleInterval: time.Second * 10,
+		AllowSelfConns:  true,
+	}
+
+	bridgeAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8333}
+	csnAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8333}
+	inConn, outConn := net.Pipe()
+
+	bridge := peer.NewInboundPeer(bridgeCfg)
+	bridge.AssociateConnection(&deferTestConn{inConn, bridgeAddr, csnAddr})
+	csn, err := peer.NewOutboundPeer(csnCfg, bridgeAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	csn.AssociateConnection(&deferTestConn{outConn, csnAddr, bridgeAddr})
+	t.Cleanup(func() {
+		csn.Disconnect()
+		bridge.Disconnect()
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-verack:
+		case <-time.After(time.Second * 5):
+			t.Fatal("verack timeout")
+		}
+	}
+
+	return csn, notReadyChan, blockChan, notFoundChan
+}
+
+// deferTestClock is a clock that only moves when it's told to.
+type deferTestClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+func (c *deferTestClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *deferTestClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	c.now = c.now.Add(d)
+	c.mtx.Unlock()
+}
+
+// TestDeferredProofs ensures that a peer asking for the utreexo proof of a
+// block that isn't connected yet is told that it isn't ready, that the block is
+// pushed to it once it's connected, and that it's told that the block wasn't
+// found if it isn't connected in time.  A peer that doesn't know the notready
+// message is told that the block wasn't found right away.
+func TestDeferredProofs(t *testing.T) {
+	connected := wire.NewMsgBlock(&wire.BlockHeader{Nonce: 1})
+	expired := wire.NewMsgBlock(&wire.BlockHeader{Nonce: 2})
+	connectedHash := connected.BlockHash()
+	expiredHash := expired.BlockHash()
+
+	pushed := make(map[chainhash.Hash]*wire.MsgBlock)
+	pushed[connectedHash] = connected
+	d := newDeferredProofs(
+		func(hash *chainhash.Hash) bool { return true },
+		func(requester proofRequester, iv *wire.InvVect) {
+			requester.QueueMessage(pushed[iv.Hash], nil)
+		},
+	)
+	clock := &deferTestClock{now: time.Unix(1600000000, 0)}
+	d.now = clock.Now
+
+	csn, notReadyChan, blockChan, notFoundChan := deferTestPeers(t, d,
+		wire.NotReadyVersion)
+
+	getData := wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessUtreexoBlock,
+		&connectedHash))
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeUtreexoBlock,
+		&expiredHash))
+	csn.QueueMessage(getData, nil)
+
+	select {
+	case msg := <-notReadyChan:
+		if len(msg.InvList) != 2 {
+			t.Fatalf("got %d not ready blocks, want 2", len(msg.InvList))
+		}
+	case msg := <-notFoundChan:
+		t.Fatalf("got notfound for %d blocks, want notready",
+			len(msg.InvList))
+	case <-time.After(time.Second * 5):
+		t.Fatal("notready timeout")
+	}
+
+	// The connected block is pushed once it's connected.
+	d.BlockConnected(&connectedHash)
+	select {
+	case msg := <-blockChan:
+		if msg.BlockHash() != connectedHash {
+			t.Fatalf("got block %v, want %v", msg.BlockHash(),
+				connectedHash)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("block timeout")
+	}
+
+	// The other block isn't found once its request expires.
+	d.Expire()
+	clock.Advance(deferredProofExpiry)
+	d.Expire()
+	select {
+	case msg := <-notFoundChan:
+		if len(msg.InvList) != 1 || msg.InvList[0].Hash != expiredHash {
+			t.Fatalf("got notfound for %v, want %v", msg.InvList,
+				expiredHash)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("notfound timeout")
+	}
+	if d.count != 0 || len(d.requests) != 0 || len(d.perPeer) != 0 {
+		t.Fatalf("%d requests are still kept", d.count)
+	}
+
+	// A peer that doesn't know the notready message isn't sent it.
+	legacy, notReadyChan, _, notFoundChan := deferTestPeers(t, d,
+		wire.ProofRangesVersion)
+	getData = wire.NewMsgGetData()
+	getData.AddInvVect(wire.NewInvVect(wire.InvTypeUtreexoBlock,
+		&expiredHash))
+	legacy.QueueMessage(getData, nil)
+	select {
+	case <-notFoundChan:
+	case <-notReadyChan:
+		t.Fatal("a legacy peer was sent notready")
+	case <-time.After(time.Second * 5):
+		t.Fatal("notfound timeout")
+	}
+}
+
+// deferTestRequester is a proof requester that records the messages queued to
+// it.
+type deferTestRequester struct {
+	pver     uint32
+	messages []wire.Message
+}
+
+func (r *deferTestRequester) Connected() bool         { return true }
+func (r *deferTestRequester) ProtocolVersion() uint32 { return r.pver }
+func (r *deferTestRequester) QueueMessage(msg wire.Message, _ chan<- struct{}) {
+	r.messages = append(r.messages, msg)
+}
+
+// TestDeferredProofsBounds ensures that only the requests for the utreexo
+// proofs of plausible tips are kept and that the requests kept for a peer are
+// bounded and dropped once the peer is gone.
+func TestDeferredProofsBounds(t *testing.T) {
+	plausible := true
+	d := newDeferredProofs(
+		func(hash *chainhash.Hash) bool { return plausible },
+		func(requester proofRequester, iv *wire.InvVect) {},
+	)
+	r1 := &deferTestRequester{pver: wire.NotReadyVersion}
+	r2 := &deferTestRequester{pver: wire.NotReadyVersion}
+
+	hash := func(i int) *chainhash.Hash {
+		return &chainhash.Hash{byte(i), byte(i >> 8)}
+	}
+	iv := func(i int) *wire.InvVect {
+		return wire.NewInvVect(wire.InvTypeUtreexoBlock, hash(i))
+	}
+
+	if d.Defer(r1, wire.NewInvVect(wire.InvTypeBlock, hash(0))) {
+		t.Fatal("a request for a block without its proof was kept")
+	}
+	plausible = false
+	if d.Defer(r1, iv(0)) {
+		t.Fatal("a request for a block that isn't a plausible tip was " +
+			"kept")
+	}
+	plausible = true
+
+	for i := 0; i < maxDeferredProofsPerPeer; i++ {
+		if !d.Defer(r1, iv(i)) {
+			t.Fatalf("request %d wasn't kept", i)
+		}
+	}
+	if d.Defer(r1, iv(maxDeferredProofsPerPeer)) {
+		t.Fatal("a request over the bound of the peer was kept")
+	}
+
+	// A request that's asked again and the requests of other peers are
+	// still kept.
+	if !d.Defer(r1, iv(0)) {
+		t.Fatal("a request that was asked again wasn't kept")
+	}
+	if !d.Defer(r2, iv(0)) {
+		t.Fatal("the request of another peer wasn't kept")
+	}
+	if d.count != maxDeferredProofsPerPeer+1 {
+		t.Fatalf("got %d requests, want %d", d.count,
+			maxDeferredProofsPerPeer+1)
+	}
+
+	d.RemovePeer(r1)
+	if d.count != 1 || d.perPeer[r1] != 0 || len(d.requests) != 1 {
+		t.Fatalf("got %d requests after the peer was removed, want 1",
+			d.count)
+	}
+	d.BlockConnected(hash(0))
+	if d.count != 0 || len(d.requests) != 0 || len(d.perPeer) != 0 {
+		t.Fatalf("got %d requests after the block was connected, "+
+			"want 0", d.count)
+	}
+}
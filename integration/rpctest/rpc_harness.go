@@ -5,6 +5,8 @@
 package rpctest
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -130,8 +132,19 @@ func New(activeNet *chaincfg.Params, handlers *rpcclient.NotificationHandlers,
 	case wire.SimNet:
 		extraArgs = append(extraArgs, "--simnet")
 	default:
-		return nil, fmt.Errorf("rpctest.New must be called with one " +
-			"of the supported chain networks")
+		// Every signet has a network of its own so they're told
+		// apart by their challenge.
+		if activeNet.SigNetChallenge == nil {
+			return nil, fmt.Errorf("rpctest.New must be called with one " +
+				"of the supported chain networks")
+		}
+		extraArgs = append(extraArgs, "--signet")
+		if !bytes.Equal(activeNet.SigNetChallenge,
+			chaincfg.DefaultSignetChallenge) {
+
+			extraArgs = append(extraArgs, "--signetchallenge="+
+				hex.EncodeToString(activeNet.SigNetChallenge))
+		}
 	}
 
 	testDir, err := baseDir()
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/utreexo/utreexod/wire"
+)
+
+// leafMidstatesFileName is the name of the file in the data directory that the
+// hash states kept by the hasher of the utreexo leaves are saved to on shutdown.
+const leafMidstatesFileName = "leafmidstates.dat"
+
+// loadLeafMidstates restores the hash states of the given hasher of the utreexo
+// leaves that were saved to the file at the given path.  The hasher starts out
+// empty if there's no such file or it can't be loaded.
+func loadLeafMidstates(hasher *wire.LeafHasher, path string) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		srvrLog.Warnf("Unable to open the utreexo leaf hash midstates: %v",
+			err)
+		return
+	}
+	defer f.Close()
+
+	err = hasher.LoadMidstates(f)
+	if err != nil {
+		srvrLog.Warnf("Unable to load the utreexo leaf hash midstates: %v",
+			err)
+		return
+	}
+
+	srvrLog.Debugf("Loaded %d utreexo leaf hash midstates",
+		hasher.Stats().Midstates)
+}
+
+// saveLeafMidstates saves the hash states of the given hasher of the utreexo
+// leaves to the file at the given path.
+func saveLeafMidstates(hasher *wire.LeafHasher, path string) error {
+	var buf bytes.Buffer
+	err := hasher.SaveMidstates(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -38,4 +38,9 @@ type Config struct {
 	MaxPeers           int
 
 	FeeEstimator *mempool.FeeEstimator
+
+	// ProofSampler samples the utreexo proofs that come with the blocks
+	// and keeps the scores of the peers that sent them.  The sync peer is picked among the
+	// peers with the best scores.  It's nil if the sources aren't scored.
+	ProofSampler *ProofSampler
 }
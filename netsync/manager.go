@@ -6,6 +6,7 @@ package netsync
 
 import (
 	"container/list"
+	"errors"
 	"math/rand"
 	"net"
 	"sync"
@@ -47,6 +48,11 @@ const (
 	// stallSampleInterval the interval at which we will check to see if our
 	// sync has stalled.
 	stallSampleInterval = 30 * time.Second
+
+	// maxProofFailures is the number of times a peer may fail to deliver
+	// the utreexo proof for a requested block before we disconnect it and
+	// request the blocks from another peer.
+	maxProofFailures = 3
 )
 
 // zeroHash is the zero value hash (all zeros).  It is defined as a convenience.
@@ -86,6 +92,13 @@ type notFoundMsg struct {
 	peer     *peerpkg.Peer
 }
 
+// proofRangesMsg packages a bitcoin proofranges message and the peer it came
+// from together so the block handler has access to that information.
+type proofRangesMsg struct {
+	ranges *wire.MsgProofRanges
+	peer   *peerpkg.Peer
+}
+
 // donePeerMsg signifies a newly disconnected peer to the block handler.
 type donePeerMsg struct {
 	peer *peerpkg.Peer
@@ -105,6 +118,13 @@ type getSyncPeerMsg struct {
 	reply chan int32
 }
 
+// getEvictionStatsMsg is a message type to be sent across the message channel
+// for retrieving the counts of the block requests evicted after an invalid
+// block.
+type getEvictionStatsMsg struct {
+	reply chan EvictionStats
+}
+
 // processBlockResponse is a response sent to the reply channel of a
 // processBlockMsg.
 type processBlockResponse struct {
@@ -152,6 +172,54 @@ type peerSyncState struct {
 	requestQueue    []*wire.InvVect
 	requestedTxns   map[chainhash.Hash]struct{}
 	requestedBlocks map[chainhash.Hash]struct{}
+
+	// proofFailures is the number of requested blocks the peer sent us
+	// without the utreexo proof.
+	proofFailures int
+
+	// evictedBlocks are the blocks requested from the peer whose requests
+	// were cancelled since a block they build on failed validation.  They
+	// are dropped without being validated if the peer still sends them.
+	evictedBlocks map[chainhash.Hash]struct{}
+
+	// proofRanges are the heights that the peer serves the utreexo proofs
+	// for.  It's nil if the peer didn't say, in which case it's assumed
+	// to serve them all.
+	proofRanges *wire.MsgProofRanges
+}
+
+// servesProofs returns whether the peer serves the utreexo proof for the block
+// at the given height.
+func (state *peerSyncState) servesProofs(peer *peerpkg.Peer, height int32) bool {
+	if state.proofRanges == nil {
+		return true
+	}
+
+	return state.proofRanges.Serves(height, peer.LastBlock())
+}
+
+// addProofFailure records that the peer failed to deliver the utreexo proof
+// for a requested block.  It returns true if the peer has now failed too many
+// times and should be disconnected.
+func (state *peerSyncState) addProofFailure() bool {
+	state.proofFailures++
+	return state.proofFailures >= maxProofFailures
+}
+
+// EvictionStats are the counts of the block requests that were cancelled during
+// the headers-first sync because a block they build on failed validation.
+type EvictionStats struct {
+	// InvalidBlocks is the number of requested blocks that failed
+	// validation and had the requests for their descendants evicted.
+	InvalidBlocks uint64
+
+	// Evicted is the number of requests for descendant blocks that were
+	// cancelled.
+	Evicted uint64
+
+	// Discarded is the number of evicted blocks that were sent anyway and
+	// dropped without being validated.
+	Discarded uint64
 }
 
 // limitAdd is a helper function for maps that require a maximum limit by
@@ -204,8 +272,17 @@ type SyncManager struct {
 	startHeader      *list.Element
 	nextCheckpoint   *chaincfg.Checkpoint
 
+	// evictionStats are the counts of the block requests evicted after
+	// an invalid block.  It should only be accessed from the blockHandler
+	// thread.
+	evictionStats EvictionStats
+
 	// An optional fee estimator.
 	feeEstimator *mempool.FeeEstimator
+
+	// proofSampler samples the utreexo proofs that come with the blocks
+	// and scores the peers that sent them.  It's nil if the sources aren't scored.
+	proofSampler *ProofSampler
 }
 
 // resetHeaderState sets the headers-first mode state to values appropriate for
@@ -271,9 +348,9 @@ func (sm *SyncManager) startSync() {
 		return
 	}
 
-	// If the current node is dependent on the utreexoView, (aka a compact state node)
-	// then only connect to other utreexo nodes.
-	utreexoViewActive := sm.chain.IsUtreexoViewActive()
+	// If the current node needs the utreexo data of the blocks, (aka a compact
+	// state node or a verifying relay) then only connect to other utreexo nodes.
+	utreexoViewActive := sm.chain.NeedsUData()
 
 	best := sm.chain.BestSnapshot()
 	var higherPeers, equalPeers []*peerpkg.Peer
@@ -292,6 +369,14 @@ func (sm *SyncManager) startSync() {
 			continue
 		}
 
+		// A compact state node needs the proof of the next block so
+		// skip the peers that said they don't serve it.
+		if utreexoViewActive && !state.servesProofs(peer, best.Height+1) {
+			log.Debugf("peer %v doesn't serve the utreexo proof for "+
+				"height %d, skipping", peer, best.Height+1)
+			continue
+		}
+
 		// Remove sync candidate peers that are no longer candidates due
 		// to passing their latest known block.  NOTE: The < is
 		// intentional as opposed to <=.  While technically the peer
@@ -320,9 +405,13 @@ func (sm *SyncManager) startSync() {
 
 	// Pick randomly from the set of peers greater than our block height,
 	// falling back to a random peer of the same height if none are greater.
+	// Only the peers whose utreexo proofs have been the most reliable are
+	// picked from.
 	//
 	// TODO(conner): Use a better algorithm to ranking peers based on
 	// observed metrics and/or sync in parallel.
+	higherPeers = sm.reliableProofPeers(higherPeers)
+	equalPeers = sm.reliableProofPeers(equalPeers)
 	var bestPeer *peerpkg.Peer
 	switch {
 	case len(higherPeers) > 0:
@@ -389,6 +478,30 @@ func (sm *SyncManager) startSync() {
 	}
 }
 
+// reliableProofPeers returns the peers whose utreexo proofs have been the most
+// reliable out of the given ones.  The peers are scored by their address.  The
+// peers are returned as they are if the proof sources aren't scored.
+func (sm *SyncManager) reliableProofPeers(peers []*peerpkg.Peer) []*peerpkg.Peer {
+	if sm.proofSampler == nil || len(peers) == 0 {
+		return peers
+	}
+
+	addrs := make([]string, len(peers))
+	byAddr := make(map[string]*peerpkg.Peer, len(peers))
+	for i, peer := range peers {
+		addrs[i] = peer.Addr()
+		byAddr[addrs[i]] = peer
+	}
+
+	preferred := sm.proofSampler.PreferredSources(addrs)
+	reliable := make([]*peerpkg.Peer, 0, len(preferred))
+	for _, addr := range preferred {
+		reliable = append(reliable, byAddr[addr])
+	}
+
+	return reliable
+}
+
 // isSyncCandidate returns whether or not the peer is a candidate to consider
 // syncing from.
 func (sm *SyncManager) isSyncCandidate(peer *peerpkg.Peer) bool {
@@ -421,10 +534,10 @@ func (sm *SyncManager) isSyncCandidate(peer *peerpkg.Peer) bool {
 			return false
 		}
 
-		// If the node is dependent on the utreexoViewpoint (aka the node
-		// is a compact state node), then the peer must have utreexo services
-		// active.
-		utreexoViewActive := sm.chain.IsUtreexoViewActive()
+		// If the node needs the utreexo data of the blocks (aka the node
+		// is a compact state node or a verifying relay), then the peer must
+		// have utreexo services active.
+		utreexoViewActive := sm.chain.NeedsUData()
 		if utreexoViewActive && !peer.IsUtreexoEnabled() {
 			return false
 		}
@@ -537,6 +650,203 @@ func (sm *SyncManager) handleDonePeerMsg(peer *peerpkg.Peer) {
 	}
 }
 
+// handleProofFailure penalizes a peer that sent us a requested block without
+// the utreexo proof.  Once the peer has failed too many times, it's
+// disconnected and the blocks requested from it are cleared so that they'll be
+// requested from another peer.  Otherwise, the block is requested again from
+// the same peer.
+func (sm *SyncManager) handleProofFailure(peer *peerpkg.Peer,
+	state *peerSyncState, blockHash *chainhash.Hash) {
+
+	if state.addProofFailure() {
+		log.Warnf("Peer %s failed to deliver the utreexo proof for %d "+
+			"requested blocks -- disconnecting", peer,
+			state.proofFailures)
+		sm.dropProofPeer(peer, state)
+		return
+	}
+
+	log.Debugf("Got block %v without the utreexo proof from %s -- "+
+		"requesting it again", blockHash, peer)
+
+	limitAdd(sm.requestedBlocks, *blockHash, maxRequestedBlocks)
+	limitAdd(state.requestedBlocks, *blockHash, maxRequestedBlocks)
+
+	gdmsg := wire.NewMsgGetData()
+	iv := wire.NewInvVect(wire.InvTypeUtreexoBlock, blockHash)
+	if peer.IsWitnessEnabled() {
+		iv.Type = wire.InvTypeWitnessUtreexoBlock
+	}
+	gdmsg.AddInvVect(iv)
+	peer.QueueMessage(gdmsg, nil)
+}
+
+// dropProofPeer disconnects a peer that can't be relied on for the utreexo
+// proofs and clears the blocks requested from it so that they'll be requested
+// from another peer.
+func (sm *SyncManager) dropProofPeer(peer *peerpkg.Peer, state *peerSyncState) {
+	// The peer stays known until it's done disconnecting, so make sure it
+	// isn't picked as the sync peer again in the meantime.
+	state.syncCandidate = false
+	sm.clearRequestedState(state)
+	if peer == sm.syncPeer {
+		sm.updateSyncPeer(true)
+	} else {
+		peer.Disconnect()
+	}
+}
+
+// isProofError returns whether the error from processing a block is due to its
+// utreexo data rather than the block itself.  Utreexo data committing to a
+// block we've reorged out of the main chain was likely generated by a peer
+// that's yet to see the reorg.  Neither it nor utreexo data that doesn't
+// verify or doesn't have the leaves the block spends, as when a peer drops the
+// proof, says anything about the block.
+func isProofError(err error) bool {
+	ruleErr, ok := err.(blockchain.RuleError)
+	if !ok {
+		return false
+	}
+
+	switch ruleErr.ErrorCode {
+	case blockchain.ErrUDataStaleCommitment,
+		blockchain.ErrUDataCommitmentMismatch,
+		blockchain.ErrUDataInvalid,
+		blockchain.ErrUDataMissing:
+
+		return true
+	}
+
+	return false
+}
+
+// stageProof hands the utreexo proof of the block to the proof sampler before
+// the block is processed so that its source is scored by it.  Only the proofs
+// of the blocks that extend the utreexo viewpoint are staged.  The chain
+// verifies the proofs of those blocks against the accumulator before it stores
+// them, so the proofs are staged without the roots and a sampled proof only
+// gets the checks that don't need the accumulator.  That way no proof is
+// verified against the accumulator more than once.  The staged proof is
+// returned, or nil if the proof wasn't staged.  An error is returned if the
+// proof was sampled and failed its checks or if the peer's proofs are banned.
+func (sm *SyncManager) stageProof(peer *peerpkg.Peer,
+	block *btcutil.Block) (*StagedProof, error) {
+
+	if sm.proofSampler == nil {
+		return nil, nil
+	}
+	view, ok := sm.chain.UtreexoViewTip()
+	if !ok || block.MsgBlock().Header.PrevBlock != view.Hash {
+		return nil, nil
+	}
+
+	proof := &StagedProof{
+		Source:    peer.Addr(),
+		BlockHash: *block.Hash(),
+		Height:    view.Height + 1,
+		UData:     block.MsgBlock().UData,
+		NumLeaves: view.NumLeaves,
+	}
+	err := sm.proofSampler.Stage(proof)
+	if err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+// recordProof reports the outcome of processing a block to the proof sampler.
+// The staged proof of the block is verified in full by the chain.  A proof that's refused counts against the peer whether it was
+// staged or not, while the outcome is unknown for a block that's rejected for
+// something else.
+func (sm *SyncManager) recordProof(peer *peerpkg.Peer,
+	blockHash *chainhash.Hash, staged *StagedProof, err error) {
+
+	if sm.proofSampler == nil {
+		return
+	}
+	if staged != nil {
+		sm.proofSampler.Take(blockHash)
+	}
+
+	switch {
+	case isProofError(err):
+		if staged == nil {
+			staged = &StagedProof{
+				Source:    peer.Addr(),
+				BlockHash: *blockHash,
+			}
+		}
+		sm.proofSampler.RecordConnection(staged, false)
+
+	case err == nil && staged != nil:
+		sm.proofSampler.RecordConnection(staged, true)
+	}
+}
+
+// evictDescendants cancels the requests for the blocks of the header list that
+// build on the given block, which failed validation, and marks them to be
+// dropped if the peers they were requested from send them anyway.  It returns
+// the number of requests that were evicted.
+func (sm *SyncManager) evictDescendants(invalid *chainhash.Hash) int {
+	var evicted int
+	for e := sm.headerList.Front(); e != nil; e = e.Next() {
+		node := e.Value.(*headerNode)
+		if node.hash.IsEqual(invalid) {
+			continue
+		}
+		if _, exists := sm.requestedBlocks[*node.hash]; !exists {
+			continue
+		}
+
+		delete(sm.requestedBlocks, *node.hash)
+		for _, state := range sm.peerStates {
+			if _, exists := state.requestedBlocks[*node.hash]; !exists {
+				continue
+			}
+			delete(state.requestedBlocks, *node.hash)
+			if state.evictedBlocks == nil {
+				state.evictedBlocks = make(map[chainhash.Hash]struct{})
+			}
+			limitAdd(state.evictedBlocks, *node.hash,
+				maxRequestedBlocks)
+		}
+		evicted++
+	}
+
+	sm.evictionStats.InvalidBlocks++
+	sm.evictionStats.Evicted += uint64(evicted)
+	return evicted
+}
+
+// discardEvicted returns whether the block from the peer with the given sync
+// state had its request evicted and should be dropped.
+func (sm *SyncManager) discardEvicted(state *peerSyncState,
+	blockHash *chainhash.Hash) bool {
+
+	if _, exists := state.evictedBlocks[*blockHash]; !exists {
+		return false
+	}
+
+	delete(state.evictedBlocks, *blockHash)
+	sm.evictionStats.Discarded++
+	return true
+}
+
+// handleInvalidHeaderBlock evicts the requests for the blocks of the header list
+// that build on a block from the sync peer which failed validation during the
+// headers-first sync.  The sync peer is then replaced, which resets the header
+// state to the current best chain tip so that the blocks are requested again
+// from there.
+func (sm *SyncManager) handleInvalidHeaderBlock(blockHash *chainhash.Hash) {
+	evicted := sm.evictDescendants(blockHash)
+	log.Warnf("Block %v from sync peer %s failed validation -- evicted "+
+		"%d requested blocks that build on it", blockHash, sm.syncPeer,
+		evicted)
+
+	sm.updateSyncPeer(true)
+}
+
 // clearRequestedState wipes all expected transactions and blocks from the sync
 // manager's requested maps that were requested under a peer's sync state, This
 // allows them to be rerequested by a subsequent sync peer.
@@ -676,8 +986,16 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 		return
 	}
 
-	// If we didn't ask for this block then the peer is misbehaving.
+	// Drop the block without validating it if its request was evicted
+	// since a block it builds on failed validation.
 	blockHash := bmsg.block.Hash()
+	if sm.discardEvicted(state, blockHash) {
+		log.Debugf("Discarding block %v from %s that builds on an "+
+			"invalid block", blockHash, peer)
+		return
+	}
+
+	// If we didn't ask for this block then the peer is misbehaving.
 	if _, exists = state.requestedBlocks[*blockHash]; !exists {
 		// The regression test intentionally sends some blocks twice
 		// to test duplicate block insertion fails.  Don't disconnect
@@ -700,12 +1018,14 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 	// since it is needed to verify the next round of headers links
 	// properly.
 	isCheckpointBlock := false
+	onHeaderList := false
 	behaviorFlags := blockchain.BFNone
 	if sm.headersFirstMode {
 		firstNodeEl := sm.headerList.Front()
 		if firstNodeEl != nil {
 			firstNode := firstNodeEl.Value.(*headerNode)
 			if blockHash.IsEqual(firstNode.hash) {
+				onHeaderList = true
 				behaviorFlags |= blockchain.BFFastAdd
 				if firstNode.hash.IsEqual(sm.nextCheckpoint.Hash) {
 					isCheckpointBlock = true
@@ -722,10 +1042,51 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 	delete(state.requestedBlocks, *blockHash)
 	delete(sm.requestedBlocks, *blockHash)
 
+	// When the utreexo data is needed, the block is useless to us without
+	// the proof.  Penalize the peer and let the block be requested again.
+	if sm.chain.NeedsUData() && bmsg.block.MsgBlock().UData == nil {
+		sm.handleProofFailure(peer, state, blockHash)
+		return
+	}
+
+	// Make sure the leaves of the utreexo data are the ones spent by the
+	// block so that stale utreexo data can be told apart from invalid
+	// utreexo data.
+	if sm.chain.NeedsUData() {
+		behaviorFlags |= blockchain.BFCheckUDataCommitment
+	}
+
+	// Sample the utreexo proof before the block is processed so that a
+	// peer serving invalid proofs is caught without validating its blocks.
+	staged, err := sm.stageProof(peer, bmsg.block)
+	if errors.Is(err, ErrProofSourceBanned) {
+		log.Warnf("Got block %v from %s, whose utreexo proofs are "+
+			"banned -- disconnecting", blockHash, peer)
+		sm.dropProofPeer(peer, state)
+		return
+	}
+	if err != nil {
+		log.Debugf("Got block %v with an invalid utreexo proof from "+
+			"%s: %v", blockHash, peer, err)
+		sm.handleProofFailure(peer, state, blockHash)
+		return
+	}
+
 	// Process the block to include validation, best chain selection, orphan
 	// handling, etc.
 	_, isOrphan, err := sm.chain.ProcessBlock(bmsg.block, behaviorFlags)
+	sm.recordProof(peer, blockHash, staged, err)
 	if err != nil {
+		// Utreexo data that doesn't check out says nothing about the
+		// block itself, so treat it like a missing proof instead of
+		// rejecting the block.
+		if isProofError(err) {
+			log.Debugf("Got block %v with stale or invalid utreexo "+
+				"data from %s: %v", blockHash, peer, err)
+			sm.handleProofFailure(peer, state, blockHash)
+			return
+		}
+
 		// When the error is a rule error, it means the block was simply
 		// rejected as opposed to something actually going wrong, so log
 		// it as such.  Otherwise, something really did go wrong, so log
@@ -746,6 +1107,13 @@ func (sm *SyncManager) handleBlockMsg(bmsg *blockMsg) {
 		// send it.
 		code, reason := mempool.ErrToRejectErr(err)
 		peer.PushRejectMsg(wire.CmdBlock, code, reason, blockHash, false)
+
+		// Every block after an invalid one in the header list builds
+		// on it so the requests for them are useless.
+		_, isRuleErr := err.(blockchain.RuleError)
+		if isRuleErr && onHeaderList && peer == sm.syncPeer {
+			sm.handleInvalidHeaderBlock(blockHash)
+		}
 		return
 	}
 
@@ -916,6 +1284,7 @@ func (sm *SyncManager) fetchHeaderBlocks() {
 
 			sm.requestedBlocks[*node.hash] = struct{}{}
 			syncPeerState.requestedBlocks[*node.hash] = struct{}{}
+			delete(syncPeerState.evictedBlocks, *node.hash)
 
 			// If we're fetching from a witness enabled peer
 			// post-fork, then ensure that we receive all the
@@ -1096,6 +1465,32 @@ func (sm *SyncManager) handleNotFoundMsg(nfmsg *notFoundMsg) {
 	}
 }
 
+// handleProofRangesMsg handles proofranges messages from all peers.  A sync
+// peer that no longer serves the utreexo proof of the next block is replaced
+// when the node depends on the proofs.
+func (sm *SyncManager) handleProofRangesMsg(prmsg *proofRangesMsg) {
+	peer := prmsg.peer
+	state, exists := sm.peerStates[peer]
+	if !exists {
+		log.Warnf("Received proofranges message from unknown peer %s", peer)
+		return
+	}
+	state.proofRanges = prmsg.ranges
+
+	if peer != sm.syncPeer || !sm.chain.NeedsUData() {
+		return
+	}
+	next := sm.chain.BestSnapshot().Height + 1
+	if state.servesProofs(peer, next) {
+		return
+	}
+
+	log.Infof("Sync peer %v no longer serves the utreexo proof for "+
+		"height %d -- switching sync peers", peer, next)
+	sm.clearRequestedState(state)
+	sm.updateSyncPeer(false)
+}
+
 // haveInventory returns whether or not the inventory represented by the passed
 // inventory vector is known.  This includes checking all of the various places
 // inventory can be when it is in different states such as blocks that are part
@@ -1424,6 +1819,9 @@ out:
 			case *notFoundMsg:
 				sm.handleNotFoundMsg(msg)
 
+			case *proofRangesMsg:
+				sm.handleProofRangesMsg(msg)
+
 			case *donePeerMsg:
 				sm.handleDonePeerMsg(msg.peer)
 
@@ -1452,6 +1850,9 @@ out:
 			case isCurrentMsg:
 				msg.reply <- sm.current()
 
+			case getEvictionStatsMsg:
+				msg.reply <- sm.evictionStats
+
 			case pauseMsg:
 				// Wait until the sender unpauses the manager.
 				<-msg.unpause
@@ -1642,6 +2043,18 @@ func (sm *SyncManager) QueueNotFound(notFound *wire.MsgNotFound, peer *peerpkg.P
 	sm.msgChan <- &notFoundMsg{notFound: notFound, peer: peer}
 }
 
+// QueueProofRanges adds the passed proofranges message and peer to the block
+// handling queue.
+func (sm *SyncManager) QueueProofRanges(ranges *wire.MsgProofRanges, peer *peerpkg.Peer) {
+	// No channel handling here because peers do not need to block on
+	// proofranges messages.
+	if atomic.LoadInt32(&sm.shutdown) != 0 {
+		return
+	}
+
+	sm.msgChan <- &proofRangesMsg{ranges: ranges, peer: peer}
+}
+
 // DonePeer informs the blockmanager that a peer has disconnected.
 func (sm *SyncManager) DonePeer(peer *peerpkg.Peer) {
 	// Ignore if we are shutting down.
@@ -1686,6 +2099,15 @@ func (sm *SyncManager) SyncPeerID() int32 {
 	return <-reply
 }
 
+// EvictionStats returns the counts of the block requests that were cancelled
+// during the headers-first sync because a block they build on failed
+// validation.
+func (sm *SyncManager) EvictionStats() EvictionStats {
+	reply := make(chan EvictionStats)
+	sm.msgChan <- getEvictionStatsMsg{reply: reply}
+	return <-reply
+}
+
 // ProcessBlock makes use of ProcessBlock on an internal instance of a block
 // chain.
 func (sm *SyncManager) ProcessBlock(block *btcutil.Block, flags blockchain.BehaviorFlags) (bool, error) {
@@ -1730,6 +2152,7 @@ func New(config *Config) (*SyncManager, error) {
 		headerList:      list.New(),
 		quit:            make(chan struct{}),
 		feeEstimator:    config.FeeEstimator,
+		proofSampler:    config.ProofSampler,
 	}
 
 	best := sm.chain.BestSnapshot()
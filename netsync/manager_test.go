@@ -0,0 +1,153 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package netsync
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	peerpkg "github.com/utreexo/utreexod/peer"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestAddProofFailure ensures that a peer is only flagged for disconnection
+// once it has failed to deliver the utreexo proof maxProofFailures times.
+func TestAddProofFailure(t *testing.T) {
+	state := &peerSyncState{}
+	for i := 1; i < maxProofFailures; i++ {
+		if state.addProofFailure() {
+			t.Fatalf("peer flagged after %d failures, want %d",
+				i, maxProofFailures)
+		}
+	}
+
+	if !state.addProofFailure() {
+		t.Fatalf("peer not flagged after %d failures", maxProofFailures)
+	}
+}
+
+// TestEvictDescendants ensures that the requests for the blocks of the header
+// list that build on an invalid block are evicted and that the evicted blocks
+// are dropped if they're sent anyway.
+func TestEvictDescendants(t *testing.T) {
+	syncPeer, otherPeer := &peerpkg.Peer{}, &peerpkg.Peer{}
+	syncState := &peerSyncState{
+		requestedBlocks: make(map[chainhash.Hash]struct{}),
+	}
+	otherState := &peerSyncState{
+		requestedBlocks: make(map[chainhash.Hash]struct{}),
+	}
+	sm := &SyncManager{
+		requestedBlocks: make(map[chainhash.Hash]struct{}),
+		peerStates: map[*peerpkg.Peer]*peerSyncState{
+			syncPeer:  syncState,
+			otherPeer: otherState,
+		},
+		syncPeer:         syncPeer,
+		headersFirstMode: true,
+		headerList:       list.New(),
+	}
+
+	// The header list holds the blocks after the invalid one at height 2.
+	// The blocks at heights 3 to 5 were requested from the sync peer and
+	// the one at height 6 is already known.  The other peer was asked for
+	// a block off the header list.
+	hashes := make(map[int32]*chainhash.Hash)
+	for height := int32(3); height <= 6; height++ {
+		hash := &chainhash.Hash{byte(height)}
+		hashes[height] = hash
+		sm.headerList.PushBack(&headerNode{height: height, hash: hash})
+		if height < 6 {
+			sm.requestedBlocks[*hash] = struct{}{}
+			syncState.requestedBlocks[*hash] = struct{}{}
+		}
+	}
+	unrelated := chainhash.Hash{0xff}
+	sm.requestedBlocks[unrelated] = struct{}{}
+	otherState.requestedBlocks[unrelated] = struct{}{}
+
+	invalid := &chainhash.Hash{2}
+	if evicted := sm.evictDescendants(invalid); evicted != 3 {
+		t.Fatalf("expected 3 evicted requests, got %d", evicted)
+	}
+
+	if len(sm.requestedBlocks) != 1 || len(syncState.requestedBlocks) != 0 {
+		t.Fatalf("expected only the unrelated request to be left, got "+
+			"%v and %v", sm.requestedBlocks, syncState.requestedBlocks)
+	}
+	if _, ok := otherState.requestedBlocks[unrelated]; !ok {
+		t.Fatal("unrelated request of the other peer was evicted")
+	}
+	if len(syncState.evictedBlocks) != 3 || otherState.evictedBlocks != nil {
+		t.Fatalf("unexpected evicted blocks %v and %v",
+			syncState.evictedBlocks, otherState.evictedBlocks)
+	}
+
+	// An evicted block is dropped once when it's sent anyway.
+	if !sm.discardEvicted(syncState, hashes[4]) {
+		t.Fatal("expected the evicted block to be discarded")
+	}
+	if sm.discardEvicted(syncState, hashes[4]) {
+		t.Fatal("expected the block to be discarded only once")
+	}
+	if sm.discardEvicted(otherState, &unrelated) {
+		t.Fatal("expected the unrelated block not to be discarded")
+	}
+
+	want := EvictionStats{InvalidBlocks: 1, Evicted: 3, Discarded: 1}
+	if sm.evictionStats != want {
+		t.Fatalf("expected stats %+v, got %+v", want, sm.evictionStats)
+	}
+}
+
+// TestProofRangesMsg ensures that a compact state node only considers the peers
+// that serve the utreexo proof of the next block it needs and that the peers
+// that didn't say which heights they serve are assumed to serve them all.
+func TestProofRangesMsg(t *testing.T) {
+	pruned, sharded, quiet := &peerpkg.Peer{}, &peerpkg.Peer{}, &peerpkg.Peer{}
+	sm := &SyncManager{
+		peerStates: map[*peerpkg.Peer]*peerSyncState{
+			pruned:  {},
+			sharded: {},
+			quiet:   {},
+		},
+	}
+
+	// One peer pruned the proofs below height 50 and the other one is
+	// missing the ones from 20 to 29 after a shard outage.
+	sm.handleProofRangesMsg(&proofRangesMsg{
+		ranges: &wire.MsgProofRanges{
+			Ranges: []wire.ProofRange{{Start: 50, End: 100}},
+		},
+		peer: pruned,
+	})
+	sm.handleProofRangesMsg(&proofRangesMsg{
+		ranges: &wire.MsgProofRanges{
+			Ranges: []wire.ProofRange{{Start: 0, End: 19},
+				{Start: 30, End: 100}},
+		},
+		peer: sharded,
+	})
+
+	tests := []struct {
+		height int32
+		want   map[*peerpkg.Peer]bool
+	}{
+		{10, map[*peerpkg.Peer]bool{pruned: false, sharded: true, quiet: true}},
+		{25, map[*peerpkg.Peer]bool{pruned: false, sharded: false, quiet: true}},
+		{60, map[*peerpkg.Peer]bool{pruned: true, sharded: true, quiet: true}},
+		{101, map[*peerpkg.Peer]bool{pruned: false, sharded: false, quiet: true}},
+	}
+	for _, test := range tests {
+		for peer, want := range test.want {
+			got := sm.peerStates[peer].servesProofs(peer, test.height)
+			if got != want {
+				t.Errorf("height %d: peer %p serves %v, want %v",
+					test.height, peer, got, want)
+			}
+		}
+	}
+}
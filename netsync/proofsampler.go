@@ -0,0 +1,456 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package netsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// DefaultProofSampleRate is the default fraction of the staged utreexo
+	// proofs of a source without failures that are checked as soon as
+	// they're staged.
+	DefaultProofSampleRate = 0.1
+
+	// defaultProofBanScore is the default score below which a source is
+	// banned.
+	defaultProofBanScore = 0.3
+
+	// proofScoreDecay is how much the latest verification of a proof of a
+	// source weighs in its score.  A source that keeps failing drops below
+	// the default ban score after six failures in a row.
+	proofScoreDecay = 0.2
+)
+
+var (
+	// ErrProofSourceBanned is the error that's returned when a proof is
+	// staged from a source that was banned.
+	ErrProofSourceBanned = errors.New("utreexo proof source is banned")
+)
+
+// ProofSampleError describes a staged utreexo proof that failed its
+// verification.
+type ProofSampleError struct {
+	// Source is the source that delivered the proof.
+	Source string
+
+	// BlockHash and Height are of the block that the proof is for.
+	BlockHash chainhash.Hash
+	Height    int32
+
+	// Reason describes what's wrong with the proof.
+	Reason string
+}
+
+// Error returns the error as a human-readable string.
+func (e *ProofSampleError) Error() string {
+	return fmt.Sprintf("utreexo proof for block %v (height %d) from %s "+
+		"failed verification: %s", e.BlockHash, e.Height, e.Source,
+		e.Reason)
+}
+
+// StagedProof is a utreexo proof that's staged before its block is processed.
+type StagedProof struct {
+	// Source is the name of what delivered the proof.  Failures of the
+	// proof are attributed to it.
+	Source string
+
+	// BlockHash and Height are of the block that the proof is for.
+	BlockHash chainhash.Hash
+	Height    int32
+
+	// UData is the utreexo data of the block.  When there are roots, the
+	// leaf datas must be complete as the outpoints they're for aren't
+	// looked up in the block.
+	UData *wire.UData
+
+	// NumLeaves and Roots are of the accumulator before the block.  Only
+	// the checks that don't need the accumulator are done when Roots is
+	// nil.
+	NumLeaves uint64
+	Roots     []accumulator.Hash
+
+	// Verified is whether the proof was verified against the roots when
+	// it was staged.  A proof that wasn't must be verified in full when
+	// its block is connected.
+	Verified bool
+}
+
+// ProofSourceScore is how reliable the utreexo proofs delivered by a source
+// have been.
+type ProofSourceScore struct {
+	// Source is the name of the source.
+	Source string
+
+	// Score is between 0 and 1 and drops with every proof of the source
+	// that fails verification.  It's 1 for a source without failures.
+	Score float64
+
+	// SampleRate is the fraction of the proofs of the source that are
+	// checked when they're staged.  It goes up as the score goes down.
+	SampleRate float64
+
+	// Staged is the number of proofs the source delivered, Sampled is
+	// the number of them that were checked when they were staged, and
+	// Failures is the number that failed verification, either when they
+	// were staged or when their blocks were connected.
+	Staged   uint64
+	Sampled  uint64
+	Failures uint64
+
+	// Banned is whether the score dropped below the ban score.  The
+	// proofs of a banned source are refused.
+	Banned bool
+}
+
+// ProofSamplerConfig is the configuration of a ProofSampler.
+type ProofSamplerConfig struct {
+	// SampleRate is the fraction of the staged proofs of a source without
+	// failures that are checked when they're staged.
+	// DefaultProofSampleRate is used if it's 0.
+	SampleRate float64
+
+	// BanScore is the score below which a source is banned.  A default
+	// is used if it's 0.
+	BanScore float64
+
+	// LeafCommitments is the schedule of the schemes that the leaves are
+	// committed with on the network.
+	LeafCommitments wire.LeafCommitmentSchedule
+
+	// Seed seeds which proofs are sampled.  The current time is used if
+	// it's 0.
+	Seed int64
+}
+
+// ProofSampler stages the utreexo proofs that come with the blocks and checks
+// a sample of them right away so that a source serving invalid proofs is
+// caught before their blocks are validated.  Every failure
+// is attributed to the source that delivered the proof and lowers its score,
+// which raises the fraction of its proofs that are sampled, steers requests
+// away from it, and eventually bans it.
+type ProofSampler struct {
+	mtx sync.Mutex
+
+	sampleRate      float64
+	banScore        float64
+	leafCommitments wire.LeafCommitmentSchedule
+	rand            *rand.Rand
+
+	sources map[string]*ProofSourceScore
+	staged  map[chainhash.Hash]*StagedProof
+}
+
+// NewProofSampler returns a ProofSampler with the given configuration.
+func NewProofSampler(cfg *ProofSamplerConfig) *ProofSampler {
+	sampleRate := cfg.SampleRate
+	if sampleRate == 0 {
+		sampleRate = DefaultProofSampleRate
+	}
+	banScore := cfg.BanScore
+	if banScore == 0 {
+		banScore = defaultProofBanScore
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &ProofSampler{
+		sampleRate:      sampleRate,
+		banScore:        banScore,
+		leafCommitments: cfg.LeafCommitments,
+		rand:            rand.New(rand.NewSource(seed)),
+		sources:         make(map[string]*ProofSourceScore),
+		staged:          make(map[chainhash.Hash]*StagedProof),
+	}
+}
+
+// source returns the score of the named source, adding it if it's new.
+//
+// This function MUST be called with the lock held.
+func (s *ProofSampler) source(name string) *ProofSourceScore {
+	score, ok := s.sources[name]
+	if !ok {
+		score = &ProofSourceScore{
+			Source:     name,
+			Score:      1,
+			SampleRate: s.sampleRate,
+		}
+		s.sources[name] = score
+	}
+
+	return score
+}
+
+// record updates the score of the source with the outcome of verifying one of
+// its proofs.
+//
+// This function MUST be called with the lock held.
+func (s *ProofSampler) record(source *ProofSourceScore, valid bool) {
+	var outcome float64
+	if valid {
+		outcome = 1
+	} else {
+		source.Failures++
+	}
+	source.Score = source.Score*(1-proofScoreDecay) + outcome*proofScoreDecay
+	source.SampleRate = s.sampleRate + (1-s.sampleRate)*(1-source.Score)
+
+	if source.Banned || source.Score >= s.banScore {
+		return
+	}
+	source.Banned = true
+	log.Warnf("Banning utreexo proof source %s after %d of its proofs "+
+		"failed verification", source.Source, source.Failures)
+
+	// Nothing from the source is trusted anymore.
+	for hash, proof := range s.staged {
+		if proof.Source == source.Source && !proof.Verified {
+			delete(s.staged, hash)
+		}
+	}
+}
+
+// Stage verifies the proof if it's sampled and stages it until its block is
+// connected.  A proof that fails verification is returned as a
+// ProofSampleError and isn't staged.  A sampled proof without roots that
+// passes the checks that don't need them is only counted once it's verified
+// in full.  ErrProofSourceBanned is returned for the proofs of banned sources.
+//
+// This function is safe for concurrent access.
+func (s *ProofSampler) Stage(proof *StagedProof) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	source := s.source(proof.Source)
+	if source.Banned {
+		return fmt.Errorf("%w: %s", ErrProofSourceBanned, proof.Source)
+	}
+	source.Staged++
+
+	proof.Verified = false
+	if s.rand.Float64() < source.SampleRate {
+		source.Sampled++
+		err := verifyStagedProof(proof, s.leafCommitments)
+		if err != nil {
+			s.record(source, false)
+			return err
+		}
+		if proof.Roots != nil {
+			s.record(source, true)
+			proof.Verified = true
+		}
+	}
+
+	// Keep a verified proof over one that isn't.
+	if staged, ok := s.staged[proof.BlockHash]; ok && staged.Verified &&
+		!proof.Verified {
+
+		return nil
+	}
+	s.staged[proof.BlockHash] = proof
+
+	return nil
+}
+
+// Take returns the proof staged for the block and unstages it.  It returns nil
+// if no proof was staged for the block.  The proof must be verified in full
+// before the block is connected unless it's marked verified, and the outcome
+// reported with RecordConnection.
+//
+// This function is safe for concurrent access.
+func (s *ProofSampler) Take(hash *chainhash.Hash) *StagedProof {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	proof, ok := s.staged[*hash]
+	if !ok {
+		return nil
+	}
+	delete(s.staged, *hash)
+
+	return proof
+}
+
+// RecordConnection records whether the proof taken for a block passed the full
+// verification when the block was connected.  Proofs that were verified when
+// they were staged were already counted so they're skipped.
+//
+// This function is safe for concurrent access.
+func (s *ProofSampler) RecordConnection(proof *StagedProof, valid bool) {
+	if proof.Verified {
+		return
+	}
+
+	s.mtx.Lock()
+	s.record(s.source(proof.Source), valid)
+	s.mtx.Unlock()
+}
+
+// Banned returns whether the named source is banned.
+//
+// This function is safe for concurrent access.
+func (s *ProofSampler) Banned(source string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	score, ok := s.sources[source]
+	return ok && score.Banned
+}
+
+// PreferredSources returns the sources among the given ones that proofs should
+// be requested from, which are the ones with the best score that aren't
+// banned.  Sources without proofs yet have the best score.  They're returned in
+// the order they're given in.
+//
+// This function is safe for concurrent access.
+func (s *ProofSampler) PreferredSources(sources []string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var preferred []string
+	var best float64
+	for _, name := range sources {
+		score := 1.0
+		if source, ok := s.sources[name]; ok {
+			if source.Banned {
+				continue
+			}
+			score = source.Score
+		}
+
+		switch {
+		case len(preferred) == 0 || score > best:
+			preferred = append(preferred[:0], name)
+			best = score
+		case score == best:
+			preferred = append(preferred, name)
+		}
+	}
+
+	return preferred
+}
+
+// Scores returns the scores of every source that delivered a proof, sorted by
+// the name of the source.
+//
+// This function is safe for concurrent access.
+func (s *ProofSampler) Scores() []ProofSourceScore {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	scores := make([]ProofSourceScore, 0, len(s.sources))
+	for _, score := range s.sources {
+		scores = append(scores, *score)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].Source < scores[j].Source
+	})
+
+	return scores
+}
+
+// verifyStagedProof checks the proof as far as it can be before its block is
+// known.  The leaf datas and the targets are checked to be consistent, and the
+// proof is verified against the roots when there are roots.
+func verifyStagedProof(proof *StagedProof,
+	leafCommitments wire.LeafCommitmentSchedule) error {
+
+	fail := func(format string, args ...interface{}) error {
+		return &ProofSampleError{
+			Source:    proof.Source,
+			BlockHash: proof.BlockHash,
+			Height:    proof.Height,
+			Reason:    fmt.Sprintf(format, args...),
+		}
+	}
+
+	ud := proof.UData
+	if ud == nil {
+		return fail("no utreexo data")
+	}
+
+	// The proof is empty when the accumulator has at most one leaf, in
+	// which case there are no targets for the leaf datas.
+	targets := ud.AccProof.Targets
+	if len(targets) > 0 && len(targets) != len(ud.LeafDatas) {
+		return fail("%d targets for %d leaf datas", len(targets),
+			len(ud.LeafDatas))
+	}
+	seen := make(map[uint64]struct{}, len(targets))
+	for _, target := range targets {
+		if _, ok := seen[target]; ok {
+			return fail("duplicate target %d", target)
+		}
+		seen[target] = struct{}{}
+	}
+	for i := range ud.LeafDatas {
+		ld := &ud.LeafDatas[i]
+		if ld.IsUnconfirmed() || ld.Height < 0 || ld.Height >= proof.Height {
+			return fail("leaf data %d was created at height %d",
+				i, ld.Height)
+		}
+		if ld.Amount < 0 || ld.Amount > btcutil.MaxSatoshi {
+			return fail("leaf data %d has an amount of %d", i,
+				ld.Amount)
+		}
+	}
+
+	if proof.Roots == nil {
+		return nil
+	}
+	if len(proof.Roots) != bits.OnesCount64(proof.NumLeaves) {
+		return fail("%d roots for %d leaves", len(proof.Roots),
+			proof.NumLeaves)
+	}
+	if len(targets) == 0 {
+		if len(ud.LeafDatas) > 0 && proof.NumLeaves > 1 {
+			return fail("no targets for %d leaf datas",
+				len(ud.LeafDatas))
+		}
+		return nil
+	}
+	for _, target := range targets {
+		if target >= proof.NumLeaves {
+			return fail("target %d is past the %d leaves", target,
+				proof.NumLeaves)
+		}
+	}
+
+	// The pollard is made from just the roots, the same way it's stored.
+	var buf bytes.Buffer
+	var numLeaves [8]byte
+	binary.BigEndian.PutUint64(numLeaves[:], proof.NumLeaves)
+	buf.Write(numLeaves[:])
+	for _, root := range proof.Roots {
+		buf.Write(root[:])
+	}
+	var pollard accumulator.Pollard
+	err := pollard.Deserialize(buf.Bytes())
+	if err != nil {
+		return fail("unable to load the roots: %v", err)
+	}
+
+	err = pollard.VerifyBatchProof(ud.StxoHashes(leafCommitments), ud.AccProof)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,397 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package netsync
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// proofSamplerHeight is the height of the blocks that the test proofs are for.
+const proofSamplerHeight = 100
+
+// proofSamplerForest is an accumulator that the test proofs are made with.
+type proofSamplerForest struct {
+	forest    *accumulator.Forest
+	leafDatas []wire.LeafData
+}
+
+// newProofSamplerForest returns an accumulator with the given number of
+// leaves, each of them created below proofSamplerHeight.
+func newProofSamplerForest(t *testing.T, numLeaves int) *proofSamplerForest {
+	f := &proofSamplerForest{
+		forest:    accumulator.NewForest(accumulator.RamForest, nil, "", 0),
+		leafDatas: make([]wire.LeafData, numLeaves),
+	}
+
+	adds := make([]accumulator.Leaf, numLeaves)
+	for i := range f.leafDatas {
+		f.leafDatas[i] = wire.LeafData{
+			BlockHash: chainhash.Hash{byte(i), 1},
+			OutPoint: wire.OutPoint{
+				Hash:  chainhash.Hash{byte(i), 2},
+				Index: uint32(i),
+			},
+			Height:   int32(i%proofSamplerHeight) + 1,
+			Amount:   int64(i+1) * 1000,
+			PkScript: []byte{0x51},
+		}
+		adds[i] = accumulator.Leaf{Hash: f.leafDatas[i].LeafHash()}
+	}
+	_, err := f.forest.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+// proof returns the proof of the given leaves for the block, sent by the
+// source along with the roots of the accumulator.
+func (f *proofSamplerForest) proof(t *testing.T, source string,
+	hash chainhash.Hash, leaves ...int) *StagedProof {
+
+	leafDatas := make([]wire.LeafData, len(leaves))
+	hashes := make([]accumulator.Hash, len(leaves))
+	for i, leaf := range leaves {
+		leafDatas[i] = f.leafDatas[leaf]
+		hashes[i] = leafDatas[i].LeafHash()
+	}
+	bp, err := f.forest.ProveBatch(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &StagedProof{
+		Source:    source,
+		BlockHash: hash,
+		Height:    proofSamplerHeight,
+		UData: &wire.UData{
+			AccProof:  bp,
+			LeafDatas: leafDatas,
+		},
+		NumLeaves: uint64(len(f.leafDatas)),
+		Roots:     f.forest.GetRoots(),
+	}
+}
+
+// corruptProof changes a hash of the proof so that it no longer proves its
+// leaves.
+func corruptProof(proof *StagedProof) {
+	proof.UData.AccProof.Proof[0][0] ^= 0xff
+}
+
+// TestVerifyStagedProof ensures that the staged proofs are checked as far as
+// they can be before their blocks are known, both with and without the roots.
+func TestVerifyStagedProof(t *testing.T) {
+	f := newProofSamplerForest(t, 16)
+
+	tests := []struct {
+		name   string
+		modify func(proof *StagedProof)
+		valid  bool
+	}{
+		{
+			name:   "valid",
+			modify: func(proof *StagedProof) {},
+			valid:  true,
+		},
+		{
+			name: "valid without roots",
+			modify: func(proof *StagedProof) {
+				corruptProof(proof)
+				proof.Roots = nil
+			},
+			valid: true,
+		},
+		{
+			name:   "corrupt proof",
+			modify: corruptProof,
+		},
+		{
+			name: "leaf data that isn't the leaf",
+			modify: func(proof *StagedProof) {
+				proof.UData.LeafDatas[0].Amount++
+			},
+		},
+		{
+			name: "roots of another accumulator",
+			modify: func(proof *StagedProof) {
+				proof.Roots[0][0] ^= 0xff
+			},
+		},
+		{
+			name: "leaf created at the height of the block",
+			modify: func(proof *StagedProof) {
+				proof.Roots = nil
+				proof.UData.LeafDatas[0].Height = proofSamplerHeight
+			},
+		},
+		{
+			name: "negative amount",
+			modify: func(proof *StagedProof) {
+				proof.Roots = nil
+				proof.UData.LeafDatas[1].Amount = -1
+			},
+		},
+		{
+			name: "duplicate target",
+			modify: func(proof *StagedProof) {
+				proof.Roots = nil
+				targets := proof.UData.AccProof.Targets
+				targets[1] = targets[0]
+			},
+		},
+		{
+			name: "missing target",
+			modify: func(proof *StagedProof) {
+				proof.Roots = nil
+				targets := proof.UData.AccProof.Targets
+				proof.UData.AccProof.Targets = targets[:1]
+			},
+		},
+		{
+			name: "wrong number of roots",
+			modify: func(proof *StagedProof) {
+				proof.Roots = append(proof.Roots, proof.Roots[0])
+			},
+		},
+		{
+			name: "target past the leaves",
+			modify: func(proof *StagedProof) {
+				proof.UData.AccProof.Targets[1] = 16
+			},
+		},
+		{
+			name: "no utreexo data",
+			modify: func(proof *StagedProof) {
+				proof.Roots = nil
+				proof.UData = nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		proof := f.proof(t, "source", chainhash.Hash{1}, 3, 9)
+		test.modify(proof)
+
+		err := verifyStagedProof(proof, nil)
+		if test.valid {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+
+		var sampleErr *ProofSampleError
+		if !errors.As(err, &sampleErr) {
+			t.Fatalf("%s: expected a ProofSampleError, got %v",
+				test.name, err)
+		}
+		if sampleErr.Source != "source" ||
+			sampleErr.BlockHash != proof.BlockHash ||
+			sampleErr.Height != proofSamplerHeight {
+
+			t.Fatalf("%s: error not attributed to the proof: %v",
+				test.name, err)
+		}
+	}
+}
+
+// TestProofSamplerScores ensures that every corrupt proof of a source is caught
+// either when it's staged or when its block is connected, and that the source
+// is sampled more and avoided once it has served corrupt proofs.
+func TestProofSamplerScores(t *testing.T) {
+	f := newProofSamplerForest(t, 32)
+	sampler := NewProofSampler(&ProofSamplerConfig{Seed: 1})
+
+	// The bad source serves a corrupt proof for every third block.
+	var corrupt, rejected, caught int
+	for i := 0; i < 60; i++ {
+		for _, source := range []string{"good", "bad"} {
+			hash := chainhash.Hash{byte(i), source[0]}
+			proof := f.proof(t, source, hash, i%32, (i+7)%32)
+			isCorrupt := source == "bad" && i%3 == 2
+			if isCorrupt {
+				corrupt++
+				corruptProof(proof)
+			}
+
+			err := sampler.Stage(proof)
+			if err != nil {
+				var sampleErr *ProofSampleError
+				if !isCorrupt || !errors.As(err, &sampleErr) {
+					t.Fatalf("block %d from %s: unexpected "+
+						"error: %v", i, source, err)
+				}
+				rejected++
+				continue
+			}
+
+			// The full verification of the block catches what
+			// the sampling missed.
+			taken := sampler.Take(&hash)
+			if taken != proof {
+				t.Fatalf("block %d from %s: staged proof not "+
+					"taken", i, source)
+			}
+			if taken.Verified && isCorrupt {
+				t.Fatalf("block %d from %s: corrupt proof "+
+					"verified", i, source)
+			}
+			if !taken.Verified && isCorrupt {
+				caught++
+			}
+			sampler.RecordConnection(taken, !isCorrupt)
+		}
+	}
+	if rejected+caught != corrupt {
+		t.Fatalf("%d corrupt proofs rejected and %d caught at "+
+			"connection, want %d", rejected, caught, corrupt)
+	}
+	if rejected == 0 {
+		t.Fatalf("no corrupt proof was rejected when it was staged")
+	}
+
+	scores := sampler.Scores()
+	if len(scores) != 2 || scores[0].Source != "bad" ||
+		scores[1].Source != "good" {
+
+		t.Fatalf("unexpected scores %+v", scores)
+	}
+	bad, good := scores[0], scores[1]
+	if good.Score != 1 || good.Failures != 0 ||
+		good.SampleRate != DefaultProofSampleRate || good.Staged != 60 {
+
+		t.Fatalf("unexpected score of the good source %+v", good)
+	}
+	if bad.Failures != uint64(corrupt) || bad.Score >= 1 ||
+		bad.SampleRate <= good.SampleRate || bad.Banned {
+
+		t.Fatalf("unexpected score of the bad source %+v", bad)
+	}
+	if bad.Sampled <= good.Sampled {
+		t.Fatalf("bad source sampled %d times, good source %d times",
+			bad.Sampled, good.Sampled)
+	}
+
+	// Requests move away from the bad source but new sources are
+	// trusted as much as the good one.
+	preferred := sampler.PreferredSources([]string{"bad", "good", "new"})
+	if !reflect.DeepEqual(preferred, []string{"good", "new"}) {
+		t.Fatalf("unexpected preferred sources %v", preferred)
+	}
+	preferred = sampler.PreferredSources([]string{"bad"})
+	if !reflect.DeepEqual(preferred, []string{"bad"}) {
+		t.Fatalf("unexpected preferred sources %v", preferred)
+	}
+}
+
+// TestProofSamplerWithoutRoots ensures that a sampled proof that's staged
+// without the roots isn't taken as verified when it passes the checks that
+// don't need them, and that it's only counted once its block is connected.
+func TestProofSamplerWithoutRoots(t *testing.T) {
+	f := newProofSamplerForest(t, 8)
+	sampler := NewProofSampler(&ProofSamplerConfig{SampleRate: 1, Seed: 1})
+
+	score := func() ProofSourceScore {
+		t.Helper()
+
+		scores := sampler.Scores()
+		if len(scores) != 1 {
+			t.Fatalf("unexpected scores %+v", scores)
+		}
+		return scores[0]
+	}
+
+	// A corrupt proof passes the checks without the roots.  It's only
+	// counted against the source when its block is connected.
+	hash := chainhash.Hash{1}
+	proof := f.proof(t, "source", hash, 1, 2)
+	proof.Roots = nil
+	corruptProof(proof)
+	err := sampler.Stage(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Verified {
+		t.Fatal("a proof without roots was taken as verified")
+	}
+	if got := score(); got.Sampled != 1 || got.Score != 1 {
+		t.Fatalf("unexpected score before the connection %+v", got)
+	}
+	sampler.RecordConnection(sampler.Take(&hash), false)
+	if got := score(); got.Failures != 1 || got.Score >= 1 {
+		t.Fatalf("unexpected score after the connection %+v", got)
+	}
+
+	// A leaf data that can't be right is caught without the roots.
+	hash = chainhash.Hash{2}
+	proof = f.proof(t, "source", hash, 3)
+	proof.Roots = nil
+	proof.UData.LeafDatas[0].Height = proofSamplerHeight
+	err = sampler.Stage(proof)
+	var sampleErr *ProofSampleError
+	if !errors.As(err, &sampleErr) {
+		t.Fatalf("expected a sample error, got %v", err)
+	}
+	if got := score(); got.Failures != 2 {
+		t.Fatalf("unexpected score after the sample error %+v", got)
+	}
+}
+
+// TestProofSamplerBan ensures that a source that keeps serving corrupt proofs
+// is banned, its unverified proofs are dropped, and its proofs are refused.
+func TestProofSamplerBan(t *testing.T) {
+	f := newProofSamplerForest(t, 8)
+
+	// Sample nothing at first so that the first failures are only found
+	// when the blocks are connected.  The proofs are sampled more as the
+	// score drops.
+	sampler := NewProofSampler(&ProofSamplerConfig{
+		SampleRate: 1e-9,
+		Seed:       1,
+	})
+	pending := f.proof(t, "bad", chainhash.Hash{0xff}, 1, 2)
+	err := sampler.Stage(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; !sampler.Banned("bad"); i++ {
+		if i == 10 {
+			t.Fatalf("source not banned after %d failures", i)
+		}
+
+		hash := chainhash.Hash{byte(i)}
+		proof := f.proof(t, "bad", hash, 3, 4)
+		corruptProof(proof)
+		err := sampler.Stage(proof)
+		var sampleErr *ProofSampleError
+		switch {
+		case err == nil:
+			sampler.RecordConnection(sampler.Take(&hash), false)
+		case !errors.As(err, &sampleErr):
+			t.Fatalf("failure %d: unexpected error: %v", i, err)
+		}
+	}
+
+	if sampler.Take(&pending.BlockHash) != nil {
+		t.Fatalf("unverified proof of the banned source still staged")
+	}
+	err = sampler.Stage(f.proof(t, "bad", chainhash.Hash{0xfe}, 1, 2))
+	if !errors.Is(err, ErrProofSourceBanned) {
+		t.Fatalf("expected ErrProofSourceBanned, got %v", err)
+	}
+	preferred := sampler.PreferredSources([]string{"bad"})
+	if len(preferred) != 0 {
+		t.Fatalf("banned source preferred: %v", preferred)
+	}
+}
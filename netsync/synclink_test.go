@@ -0,0 +1,690 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package netsync
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	_ "github.com/utreexo/utreexod/database/ffldb"
+	"github.com/utreexo/utreexod/mempool"
+	peerpkg "github.com/utreexo/utreexod/peer"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+const (
+	// syncTestBlocks is the number of blocks of the source chain that the
+	// compact state node syncs in the loopback tests.
+	syncTestBlocks = 12
+
+	// syncTestHold is the height above which the bridges of the loopback
+	// tests hold the blocks back until they're released.
+	syncTestHold = 5
+
+	// syncTestTimeout is how long the loopback tests wait for the sync
+	// manager to get to a state.
+	syncTestTimeout = 10 * time.Second
+)
+
+// testNotifier is a PeerNotifier that does nothing.
+type testNotifier struct{}
+
+func (testNotifier) AnnounceNewTransactions([]*mempool.TxDesc)               {}
+func (testNotifier) UpdatePeerHeights(*chainhash.Hash, int32, *peerpkg.Peer) {}
+func (testNotifier) RelayInventory(*wire.InvVect, interface{})               {}
+func (testNotifier) TransactionConfirmed(*btcutil.Tx)                        {}
+
+// faultLink is the loopback connection between the sync manager and a bridge.
+// The faults are injected into it from the tests.
+type faultLink struct {
+	net.Conn
+
+	cutOnce sync.Once
+	dead    chan struct{}
+}
+
+// cut closes the link as if the bridge on the other end had died.
+func (l *faultLink) cut() {
+	l.cutOnce.Do(func() {
+		close(l.dead)
+		l.Conn.Close()
+	})
+}
+
+// testBridge serves the blocks of the source chain to the sync manager over a
+// loopback link along with their utreexo proofs, unless it's a legacy peer.
+type testBridge struct {
+	h      *syncHarness
+	link   *faultLink
+	local  *peerpkg.Peer
+	remote *peerpkg.Peer
+	ready  chan struct{}
+
+	// legacy is set for a peer without utreexo services.
+	legacy bool
+
+	// dropProof returns whether the proof of the block at the given height
+	// is dropped and the block is sent with empty utreexo data instead.
+	dropProof func(height int32) bool
+
+	// corruptProof returns whether the proof of the block at the given
+	// height is sent with the amount of its first leaf data changed.
+	corruptProof func(height int32) bool
+
+	// corruptLeaf changes the first leaf data of a corrupted proof.  Its
+	// amount is raised by one if it's nil.
+	corruptLeaf func(ld *wire.LeafData)
+
+	// The blocks above the hold height are held back until release is
+	// closed.  hold is 0 for a bridge that doesn't hold any.
+	hold    int32
+	release chan struct{}
+
+	mtx     sync.Mutex
+	served  map[int32]int
+	dropped map[int32]int
+}
+
+// servedCount returns the number of times the block at the given height was
+// served and the number of times its proof was dropped.
+func (b *testBridge) servedCount(height int32) (int, int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.served[height], b.dropped[height]
+}
+
+// totalServed returns the number of blocks the bridge served.
+func (b *testBridge) totalServed() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var total int
+	for _, n := range b.served {
+		total += n
+	}
+	return total
+}
+
+// onGetBlocks answers a getblocks message with the hashes of the source chain
+// after the locator.
+func (b *testBridge) onGetBlocks(p *peerpkg.Peer, msg *wire.MsgGetBlocks) {
+	hashes := b.h.source.LocateBlocks(msg.BlockLocatorHashes, &msg.HashStop,
+		wire.MaxBlocksPerMsg)
+	inv := wire.NewMsgInv()
+	for i := range hashes {
+		inv.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &hashes[i]))
+	}
+	if len(inv.InvList) > 0 {
+		p.QueueMessage(inv, nil)
+	}
+}
+
+// onGetData serves the requested blocks.
+func (b *testBridge) onGetData(p *peerpkg.Peer, msg *wire.MsgGetData) {
+	for _, iv := range msg.InvList {
+		block, err := b.h.source.BlockByHash(&iv.Hash)
+		if err != nil {
+			b.h.t.Errorf("bridge asked for unknown block %v", iv.Hash)
+			return
+		}
+		height := block.Height()
+
+		if b.hold > 0 && height > b.hold {
+			select {
+			case <-b.release:
+			case <-b.link.dead:
+				return
+			}
+		}
+
+		msgBlock := *block.MsgBlock()
+		encoding := wire.WitnessEncoding
+		dropped := false
+		if !b.legacy {
+			encoding |= wire.UtreexoEncoding
+			msgBlock.UData = b.h.proofs[height]
+			if b.dropProof != nil && b.dropProof(height) {
+				msgBlock.UData = &wire.UData{}
+				dropped = true
+			}
+			if b.corruptProof != nil && b.corruptProof(height) {
+				ud := *msgBlock.UData
+				ud.LeafDatas = append([]wire.LeafData(nil),
+					ud.LeafDatas...)
+				if b.corruptLeaf != nil {
+					b.corruptLeaf(&ud.LeafDatas[0])
+				} else {
+					ud.LeafDatas[0].Amount++
+				}
+				msgBlock.UData = &ud
+			}
+		}
+
+		b.mtx.Lock()
+		b.served[height]++
+		if dropped {
+			b.dropped[height]++
+		}
+		b.mtx.Unlock()
+
+		p.QueueMessageWithEncoding(&msgBlock, nil, encoding)
+	}
+}
+
+// syncHarness runs a sync manager for a compact state node that syncs the
+// blocks of a source chain from bridges connected to it over loopback links.
+type syncHarness struct {
+	t      *testing.T
+	params *chaincfg.Params
+	source *blockchain.BlockChain
+	proofs map[int32]*wire.UData
+	chain  *blockchain.BlockChain
+	sm     *SyncManager
+}
+
+// newSyncTestChain returns a chain on a new database in the test's temporary
+// directory.  It's a compact state node if a utreexo view is given.
+func newSyncTestChain(t *testing.T, name string, params *chaincfg.Params,
+	view *blockchain.UtreexoViewpoint) *blockchain.BlockChain {
+
+	db, err := database.Create("ffldb", filepath.Join(t.TempDir(), name),
+		params.Net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	config := &blockchain.Config{
+		DB:          db,
+		ChainParams: params,
+		TimeSource:  blockchain.NewMedianTime(),
+		SigCache:    txscript.NewSigCache(1000),
+		UtreexoView: view,
+	}
+	if view == nil {
+		config.UtxoCacheMaxSize = 10 * 1024 * 1024
+	}
+	chain, err := blockchain.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chain
+}
+
+// newSyncHarness builds the source chain with the utreexo proofs of its blocks
+// and starts the sync manager of a compact state node at the genesis block.
+// The proofs are sampled with the given proof sampler unless it's nil.
+func newSyncHarness(t *testing.T, sampler *ProofSampler) *syncHarness {
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	h := &syncHarness{
+		t:      t,
+		params: &params,
+		source: newSyncTestChain(t, "source", &params, nil),
+		proofs: make(map[int32]*wire.UData),
+		chain: newSyncTestChain(t, "csn", &params,
+			blockchain.NewUtreexoViewpoint(0)),
+	}
+
+	// The proofs are generated the same way the utreexo proof indexes
+	// generate them.
+	schedule := params.LeafCommitments
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	tip := btcutil.NewBlock(params.GenesisBlock)
+	var spends []*blockchain.SpendableOut
+	for height := int32(1); height <= syncTestBlocks; height++ {
+		tip, spends = blockchain.AddBlock(h.source, tip, spends)
+
+		stxos, err := h.source.FetchSpendJournal(tip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, outCount, inskip, outskip := blockchain.DedupeBlock(tip)
+		dels, _, err := blockchain.BlockToDelLeaves(stxos, h.source, tip,
+			inskip, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud, err := wire.GenerateUData(dels, forest, schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds := blockchain.BlockToAddLeaves(tip, outskip, nil, outCount,
+			schedule, nil)
+		_, err = forest.Modify(adds, ud.AccProof.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.proofs[height] = ud
+	}
+
+	sm, err := New(&Config{
+		PeerNotifier:       testNotifier{},
+		Chain:              h.chain,
+		TxMemPool:          mempool.New(&mempool.Config{}),
+		ChainParams:        &params,
+		DisableCheckpoints: true,
+		MaxPeers:           8,
+		ProofSampler:       sampler,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.sm = sm
+	sm.Start()
+	t.Cleanup(func() { sm.Stop() })
+
+	return h
+}
+
+// connect connects the bridge to the sync manager over a loopback link and
+// waits for the sync manager to know of it.
+func (h *syncHarness) connect(b *testBridge) {
+	b.h = h
+	b.ready = make(chan struct{})
+	b.served = make(map[int32]int)
+	b.dropped = make(map[int32]int)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			h.t.Error(err)
+		}
+		accepted <- conn
+	}()
+	remoteConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	localConn := <-accepted
+	if localConn == nil {
+		h.t.FailNow()
+	}
+	b.link = &faultLink{Conn: localConn, dead: make(chan struct{})}
+	h.t.Cleanup(b.link.cut)
+
+	b.local = peerpkg.NewInboundPeer(&peerpkg.Config{
+		ChainParams:    h.params,
+		Services:       wire.SFNodeNetwork | wire.SFNodeWitness,
+		AllowSelfConns: true,
+		Listeners: peerpkg.MessageListeners{
+			OnVerAck: func(p *peerpkg.Peer, msg *wire.MsgVerAck) {
+				h.sm.NewPeer(p)
+				close(b.ready)
+			},
+			OnBlock: func(p *peerpkg.Peer, msg *wire.MsgBlock, buf []byte) {
+				done := make(chan struct{})
+				h.sm.QueueBlock(btcutil.NewBlock(msg), p, done)
+				<-done
+			},
+			OnInv: func(p *peerpkg.Peer, msg *wire.MsgInv) {
+				h.sm.QueueInv(msg, p)
+			},
+			OnHeaders: func(p *peerpkg.Peer, msg *wire.MsgHeaders) {
+				h.sm.QueueHeaders(msg, p)
+			},
+			OnNotFound: func(p *peerpkg.Peer, msg *wire.MsgNotFound) {
+				h.sm.QueueNotFound(msg, p)
+			},
+		},
+	})
+	b.local.AssociateConnection(b.link)
+	go func() {
+		b.local.WaitForDisconnect()
+		b.link.cut()
+		h.sm.DonePeer(b.local)
+	}()
+
+	services := wire.SFNodeNetwork | wire.SFNodeWitness
+	if !b.legacy {
+		services |= wire.SFNodeUtreexo
+	}
+	b.remote, err = peerpkg.NewOutboundPeer(&peerpkg.Config{
+		NewestBlock: func() (*chainhash.Hash, int32, error) {
+			best := h.source.BestSnapshot()
+			return &best.Hash, best.Height, nil
+		},
+		ChainParams:    h.params,
+		Services:       services,
+		AllowSelfConns: true,
+		Listeners: peerpkg.MessageListeners{
+			OnGetBlocks: b.onGetBlocks,
+			OnGetData:   b.onGetData,
+		},
+	}, remoteConn.RemoteAddr().String())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	b.remote.AssociateConnection(remoteConn)
+
+	select {
+	case <-b.ready:
+	case <-time.After(syncTestTimeout):
+		h.t.Fatal("timed out waiting for the bridge to connect")
+	}
+
+	// The sync peer query is handled after the new peer.
+	h.sm.SyncPeerID()
+}
+
+// waitFor waits for the condition to hold.
+func (h *syncHarness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+
+	deadline := time.Now().Add(syncTestTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitHeight waits for the compact state node to get to the given height.
+func (h *syncHarness) waitHeight(height int32) {
+	h.t.Helper()
+
+	h.waitFor("the chain to sync", func() bool {
+		return h.chain.BestSnapshot().Height >= height
+	})
+	if best := h.chain.BestSnapshot(); best.Height != height {
+		h.t.Fatalf("synced to height %d, want %d", best.Height, height)
+	}
+}
+
+// waitSyncPeer waits for the bridge to become the sync peer, or for there to
+// be none if the bridge is nil.
+func (h *syncHarness) waitSyncPeer(b *testBridge) {
+	h.t.Helper()
+
+	var id int32
+	if b != nil {
+		id = b.local.ID()
+	}
+	h.waitFor("the sync peer to change", func() bool {
+		return h.sm.SyncPeerID() == id
+	})
+}
+
+// TestSyncPeerDiesWithOtherBridge ensures that the compact state node finishes
+// syncing from another bridge when the link to its sync peer dies partway
+// through.
+func TestSyncPeerDiesWithOtherBridge(t *testing.T) {
+	h := newSyncHarness(t, nil)
+
+	first := &testBridge{hold: syncTestHold, release: make(chan struct{})}
+	h.connect(first)
+	h.waitSyncPeer(first)
+	second := &testBridge{}
+	h.connect(second)
+
+	h.waitHeight(syncTestHold)
+	first.link.cut()
+
+	h.waitHeight(syncTestBlocks)
+	h.waitSyncPeer(second)
+	if served := first.totalServed(); served != syncTestHold {
+		t.Fatalf("the dead bridge served %d blocks, want %d", served,
+			syncTestHold)
+	}
+}
+
+// TestSyncPeerDiesWithoutOtherBridge ensures that the compact state node stops
+// syncing when the link to its sync peer dies and only a peer without utreexo
+// services is left, and that it resumes once another bridge connects.
+func TestSyncPeerDiesWithoutOtherBridge(t *testing.T) {
+	h := newSyncHarness(t, nil)
+
+	first := &testBridge{hold: syncTestHold, release: make(chan struct{})}
+	h.connect(first)
+	h.waitSyncPeer(first)
+	legacy := &testBridge{legacy: true}
+	h.connect(legacy)
+
+	h.waitHeight(syncTestHold)
+	first.link.cut()
+	h.waitSyncPeer(nil)
+
+	// The peer without utreexo services can't deliver the proofs so
+	// nothing's requested from it.
+	time.Sleep(100 * time.Millisecond)
+	if best := h.chain.BestSnapshot(); best.Height != syncTestHold {
+		t.Fatalf("synced to height %d without a bridge", best.Height)
+	}
+	if served := legacy.totalServed(); served != 0 {
+		t.Fatalf("%d blocks were requested from the peer without "+
+			"utreexo services", served)
+	}
+
+	second := &testBridge{}
+	h.connect(second)
+	h.waitHeight(syncTestBlocks)
+	h.waitSyncPeer(second)
+}
+
+// TestSyncPeerDropsProofs ensures that a sync peer that keeps sending a block
+// without its proof is asked for it again up to maxProofFailures times before
+// it's disconnected, and that the block is then synced from another bridge.
+func TestSyncPeerDropsProofs(t *testing.T) {
+	h := newSyncHarness(t, nil)
+
+	// The blocks after the first one spend the outputs of the ones before
+	// them, so a block without its proof is refused.
+	const dropHeight = syncTestHold + 2
+	first := &testBridge{
+		hold:    syncTestHold,
+		release: make(chan struct{}),
+		dropProof: func(height int32) bool {
+			return height == dropHeight
+		},
+	}
+	h.connect(first)
+	h.waitSyncPeer(first)
+	second := &testBridge{}
+	h.connect(second)
+
+	h.waitHeight(syncTestHold)
+	close(first.release)
+
+	h.waitHeight(syncTestBlocks)
+	h.waitSyncPeer(second)
+	h.waitFor("the bridge dropping the proofs to be disconnected",
+		func() bool { return !first.local.Connected() })
+
+	served, dropped := first.servedCount(dropHeight)
+	if served != maxProofFailures || dropped != maxProofFailures {
+		t.Fatalf("the block at height %d was served %d times without "+
+			"its proof %d times, want %d", dropHeight, served,
+			dropped, maxProofFailures)
+	}
+	if served, _ := second.servedCount(dropHeight); served != 1 {
+		t.Fatalf("the other bridge served the block at height %d %d "+
+			"times, want 1", dropHeight, served)
+	}
+}
+
+// TestSyncPeerCorruptsProofs ensures that the proofs that come with the blocks
+// are sampled and that a sync peer that keeps sending a corrupt proof is scored
+// down and disconnected whether its proofs are sampled or not.  The sampler
+// only checks what it can without the accumulator, so the corrupt proofs are
+// caught when the blocks are processed.  The block is then synced from another
+// bridge whose proofs are scored up.
+func TestSyncPeerCorruptsProofs(t *testing.T) {
+	const corruptHeight = syncTestHold + 1
+	tests := []struct {
+		name       string
+		sampleRate float64
+	}{
+		{name: "sampled", sampleRate: 1},
+		{name: "not sampled", sampleRate: 1e-9},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sampler := NewProofSampler(&ProofSamplerConfig{
+				SampleRate:      test.sampleRate,
+				LeafCommitments: chaincfg.RegressionNetParams.LeafCommitments,
+				Seed:            233,
+			})
+			h := newSyncHarness(t, sampler)
+
+			first := &testBridge{
+				hold:    syncTestHold,
+				release: make(chan struct{}),
+				corruptProof: func(height int32) bool {
+					return height == corruptHeight
+				},
+			}
+			h.connect(first)
+			h.waitSyncPeer(first)
+			second := &testBridge{}
+			h.connect(second)
+
+			h.waitHeight(syncTestHold)
+			close(first.release)
+
+			h.waitHeight(syncTestBlocks)
+			h.waitSyncPeer(second)
+			h.waitFor("the bridge corrupting the proofs to be "+
+				"disconnected",
+				func() bool { return !first.local.Connected() })
+
+			scores := make(map[string]ProofSourceScore)
+			for _, score := range sampler.Scores() {
+				scores[score.Source] = score
+			}
+			bad := scores[first.local.Addr()]
+			good := scores[second.local.Addr()]
+
+			// The proofs of the blocks up to the corrupt one were
+			// staged, including the corrupt one every time it was
+			// sent.  The blocks after it didn't extend the chain.
+			const staged = syncTestHold + maxProofFailures
+			if bad.Staged != staged {
+				t.Fatalf("%d proofs of the corrupting bridge "+
+					"were staged, want %d", bad.Staged, staged)
+			}
+			if bad.Failures != maxProofFailures {
+				t.Fatalf("got %d failures for the corrupting "+
+					"bridge, want %d", bad.Failures,
+					maxProofFailures)
+			}
+			if test.sampleRate == 1 && bad.Sampled != bad.Staged {
+				t.Fatalf("%d of the %d proofs were sampled",
+					bad.Sampled, bad.Staged)
+			}
+			if test.sampleRate < 1 && bad.Sampled >= bad.Failures {
+				t.Fatalf("%d of the %d failures were sampled",
+					bad.Sampled, bad.Failures)
+			}
+			if bad.Score >= 1 {
+				t.Fatalf("the corrupting bridge has a score of "+
+					"%v", bad.Score)
+			}
+
+			if good.Staged == 0 || good.Failures != 0 ||
+				good.Score != 1 {
+
+				t.Fatalf("unexpected score for the other "+
+					"bridge: %+v", good)
+			}
+			if served, _ := second.servedCount(corruptHeight); served != 1 {
+				t.Fatalf("the other bridge served the block at "+
+					"height %d %d times, want 1",
+					corruptHeight, served)
+			}
+		})
+	}
+}
+
+// TestSyncPeerCorruptsProofAndBlock ensures that a block whose utreexo proof
+// doesn't verify is refused for its proof even when the block also fails the
+// checks against the leaf datas of the proof, whether it's checked when it's
+// connected or when it's accepted.  The peer that sent it is asked for it
+// again until it's disconnected and the block is then synced from another
+// bridge.
+func TestSyncPeerCorruptsProofAndBlock(t *testing.T) {
+	const corruptHeight = syncTestHold + 1
+	h := newSyncHarness(t, nil)
+
+	// With no leaf data left to spend, the block spends more than its
+	// inputs.
+	zeroAmount := func(ld *wire.LeafData) { ld.Amount = 0 }
+
+	for height := int32(1); height < corruptHeight; height++ {
+		block, err := h.source.BlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = h.chain.ProcessBlockWithUData(block, h.proofs[height],
+			blockchain.BFNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	block, err := h.source.BlockByHeight(corruptHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ud := *h.proofs[corruptHeight]
+	ud.LeafDatas = append([]wire.LeafData(nil), ud.LeafDatas...)
+	zeroAmount(&ud.LeafDatas[0])
+	msgBlock := *block.MsgBlock()
+	msgBlock.UData = &ud
+	err = h.chain.CheckConnectBlockTemplate(btcutil.NewBlock(&msgBlock))
+	if !isProofError(err) {
+		t.Fatalf("expected the block to be refused for its proof, "+
+			"got %v", err)
+	}
+
+	first := &testBridge{
+		hold:    syncTestHold,
+		release: make(chan struct{}),
+		corruptProof: func(height int32) bool {
+			return height == corruptHeight
+		},
+		corruptLeaf: zeroAmount,
+	}
+	h.connect(first)
+	h.waitSyncPeer(first)
+	second := &testBridge{}
+	h.connect(second)
+	close(first.release)
+
+	h.waitHeight(syncTestBlocks)
+	h.waitSyncPeer(second)
+	h.waitFor("the bridge corrupting the proofs to be disconnected",
+		func() bool { return !first.local.Connected() })
+
+	if served, _ := first.servedCount(corruptHeight); served != maxProofFailures {
+		t.Fatalf("the block at height %d was served %d times by the "+
+			"corrupting bridge, want %d", corruptHeight, served,
+			maxProofFailures)
+	}
+	if served, _ := second.servedCount(corruptHeight); served != 1 {
+		t.Fatalf("the other bridge served the block at height %d %d "+
+			"times, want 1", corruptHeight, served)
+	}
+}
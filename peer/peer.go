@@ -29,7 +29,7 @@ import (
 
 const (
 	// MaxProtocolVersion is the max protocol version the peer supports.
-	MaxProtocolVersion = wire.FeeFilterVersion
+	MaxProtocolVersion = wire.NotReadyVersion
 
 	// DefaultTrickleInterval is the min time between attempts to send an
 	// inv message to a peer.
@@ -197,6 +197,18 @@ type MessageListeners struct {
 	// message.
 	OnSendHeaders func(p *Peer, msg *wire.MsgSendHeaders)
 
+	// OnUtreexoCaps is invoked when a peer receives a utreexocaps bitcoin
+	// message.
+	OnUtreexoCaps func(p *Peer, msg *wire.MsgUtreexoCaps)
+
+	// OnProofRanges is invoked when a peer receives a proofranges bitcoin
+	// message.
+	OnProofRanges func(p *Peer, msg *wire.MsgProofRanges)
+
+	// OnNotReady is invoked when a peer receives a notready bitcoin
+	// message.
+	OnNotReady func(p *Peer, msg *wire.MsgNotReady)
+
 	// OnRead is invoked when a peer receives a bitcoin message.  It
 	// consists of the number of bytes read, the message, and whether or not
 	// an error in the read occurred.  Typically, callers will opt to use
@@ -1171,11 +1183,13 @@ func (p *Peer) maybeAddDeadline(pendingResponses map[string]time.Time, msgCmd st
 		pendingResponses[wire.CmdInv] = deadline
 
 	case wire.CmdGetData:
-		// Expects a block, merkleblock, tx, or notfound message.
+		// Expects a block, merkleblock, tx, notfound, or notready
+		// message.
 		pendingResponses[wire.CmdBlock] = deadline
 		pendingResponses[wire.CmdMerkleBlock] = deadline
 		pendingResponses[wire.CmdTx] = deadline
 		pendingResponses[wire.CmdNotFound] = deadline
+		pendingResponses[wire.CmdNotReady] = deadline
 
 	case wire.CmdGetHeaders:
 		// Expects a headers message.  Use a longer deadline since it
@@ -1235,10 +1249,13 @@ out:
 				case wire.CmdTx:
 					fallthrough
 				case wire.CmdNotFound:
+					fallthrough
+				case wire.CmdNotReady:
 					delete(pendingResponses, wire.CmdBlock)
 					delete(pendingResponses, wire.CmdMerkleBlock)
 					delete(pendingResponses, wire.CmdTx)
 					delete(pendingResponses, wire.CmdNotFound)
+					delete(pendingResponses, wire.CmdNotReady)
 
 				default:
 					delete(pendingResponses, msgCmd)
@@ -1538,6 +1555,21 @@ out:
 				p.cfg.Listeners.OnSendHeaders(p, msg)
 			}
 
+		case *wire.MsgUtreexoCaps:
+			if p.cfg.Listeners.OnUtreexoCaps != nil {
+				p.cfg.Listeners.OnUtreexoCaps(p, msg)
+			}
+
+		case *wire.MsgProofRanges:
+			if p.cfg.Listeners.OnProofRanges != nil {
+				p.cfg.Listeners.OnProofRanges(p, msg)
+			}
+
+		case *wire.MsgNotReady:
+			if p.cfg.Listeners.OnNotReady != nil {
+				p.cfg.Listeners.OnNotReady(p, msg)
+			}
+
 		default:
 			log.Debugf("Received unhandled message of type %v "+
 				"from %v", rmsg.Command(), p)
@@ -0,0 +1,396 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// proofStatsFileName is the name of the file in the data directory
+	// that the utreexo proof serving statistics are saved to.
+	proofStatsFileName = "proofserving.json"
+
+	// proofStatsSlotDuration is how much time the requests of a height
+	// band are grouped by.  Windows are reported with this precision.
+	proofStatsSlotDuration = time.Hour
+
+	// proofStatsDumpInterval is how often the utreexo proof serving
+	// statistics are saved to disk.
+	proofStatsDumpInterval = 10 * time.Minute
+
+	// proofStatsMinScore is the decayed request count below which a height
+	// band without any requests left in its slots is forgotten.
+	proofStatsMinScore = 0.01
+
+	// proofStatsVersion is the version of the saved utreexo proof serving
+	// statistics.
+	proofStatsVersion = 1
+)
+
+// defaultProofStatsWindows are the windows that the utreexo proof serving
+// statistics are reported over when none are requested.
+var defaultProofStatsWindows = []time.Duration{
+	time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// proofServingSlot is the tally of the requests of a height band that were
+// served during a slot of time.
+type proofServingSlot struct {
+	start    time.Time
+	requests uint64
+	bytes    uint64
+	peers    map[string]struct{}
+}
+
+// proofServingBand is the tally of the requests for the utreexo proofs of a
+// height band.
+type proofServingBand struct {
+	// score is the request count as of scoreTime with every request
+	// decayed by its age.
+	score     float64
+	scoreTime time.Time
+
+	// slots are the slots that requests were served in, oldest first.
+	slots []*proofServingSlot
+}
+
+// proofServingWindow is the tally of the requests of a height band that were
+// served over a window of time.
+type proofServingWindow struct {
+	window      time.Duration
+	requests    uint64
+	bytes       uint64
+	uniquePeers int
+}
+
+// proofServingBandStats are the statistics of a height band.
+type proofServingBandStats struct {
+	startHeight     int32
+	endHeight       int32
+	decayedRequests float64
+	windows         []proofServingWindow
+}
+
+// proofServingStats tallies the utreexo proofs served to peers by the height
+// of their blocks so that operators can tell which ranges of blocks are still
+// requested before pruning them.  Requests are tallied in height bands of a
+// fixed width.  The request count of each band decays with a half life so that
+// ranges that were only popular long ago fade, and the requests, bytes, and
+// peers of the recent past are kept to be reported over windows.
+type proofServingStats struct {
+	mtx       sync.Mutex
+	path      string
+	bandWidth int32
+	halfLife  time.Duration
+	retention time.Duration
+	bands     map[int32]*proofServingBand
+
+	// now returns the current time.  It's only replaced by tests.
+	now func() time.Time
+}
+
+// newProofServingStats returns new utreexo proof serving statistics that are
+// saved to the given path.  Requests are tallied in height bands of the given
+// width, their count halves every halfLife, and they're kept for retention to
+// be reported over windows.
+func newProofServingStats(path string, bandWidth int32, halfLife,
+	retention time.Duration) *proofServingStats {
+
+	return &proofServingStats{
+		path:      path,
+		bandWidth: bandWidth,
+		halfLife:  halfLife,
+		retention: retention,
+		bands:     make(map[int32]*proofServingBand),
+		now:       time.Now,
+	}
+}
+
+// decay returns the score decayed from the time it was at to now.
+func (s *proofServingStats) decay(score float64, at, now time.Time) float64 {
+	age := now.Sub(at)
+	if age <= 0 {
+		return score
+	}
+
+	return score * math.Exp2(-float64(age)/float64(s.halfLife))
+}
+
+// expire drops the slots that are past the retention and the bands that were
+// forgotten.
+//
+// This function MUST be called with the mutex held.
+func (s *proofServingStats) expire(now time.Time) {
+	cutoff := now.Add(-s.retention)
+	for start, band := range s.bands {
+		i := 0
+		for i < len(band.slots) &&
+			!band.slots[i].start.Add(proofStatsSlotDuration).After(cutoff) {
+
+			i++
+		}
+		band.slots = band.slots[i:]
+
+		if len(band.slots) == 0 &&
+			s.decay(band.score, band.scoreTime, now) < proofStatsMinScore {
+
+			delete(s.bands, start)
+		}
+	}
+}
+
+// record tallies a utreexo proof of the given size for the block at the given
+// height that was served to the peer.
+//
+// This function is safe for concurrent access.
+func (s *proofServingStats) record(height int32, peer string, size uint64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	start := height - height%s.bandWidth
+	band, ok := s.bands[start]
+	if !ok {
+		band = &proofServingBand{scoreTime: now}
+		s.bands[start] = band
+	}
+	band.score = s.decay(band.score, band.scoreTime, now) + 1
+	band.scoreTime = now
+
+	slotStart := now.Truncate(proofStatsSlotDuration)
+	var slot *proofServingSlot
+	if n := len(band.slots); n > 0 && band.slots[n-1].start.Equal(slotStart) {
+		slot = band.slots[n-1]
+	} else {
+		slot = &proofServingSlot{
+			start: slotStart,
+			peers: make(map[string]struct{}),
+		}
+		band.slots = append(band.slots, slot)
+	}
+	slot.requests++
+	slot.bytes += size
+	slot.peers[peer] = struct{}{}
+}
+
+// stats returns the statistics of every height band that was requested,
+// ordered by height, with the requests reported over each of the windows.
+// Windows longer than the retention only report the requests that are kept.
+//
+// This function is safe for concurrent access.
+func (s *proofServingStats) stats(windows []time.Duration) []proofServingBandStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := s.now()
+	s.expire(now)
+
+	starts := make([]int32, 0, len(s.bands))
+	for start := range s.bands {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	stats := make([]proofServingBandStats, 0, len(starts))
+	for _, start := range starts {
+		band := s.bands[start]
+		bandStats := proofServingBandStats{
+			startHeight:     start,
+			endHeight:       start + s.bandWidth - 1,
+			decayedRequests: s.decay(band.score, band.scoreTime, now),
+			windows:         make([]proofServingWindow, 0, len(windows)),
+		}
+		for _, window := range windows {
+			w := proofServingWindow{window: window}
+			cutoff := now.Add(-window)
+			peers := make(map[string]struct{})
+			for _, slot := range band.slots {
+				if !slot.start.Add(proofStatsSlotDuration).After(cutoff) {
+					continue
+				}
+				w.requests += slot.requests
+				w.bytes += slot.bytes
+				for peer := range slot.peers {
+					peers[peer] = struct{}{}
+				}
+			}
+			w.uniquePeers = len(peers)
+			bandStats.windows = append(bandStats.windows, w)
+		}
+		stats = append(stats, bandStats)
+	}
+
+	return stats
+}
+
+// suggestPruneHeight returns the lowest height that has to be kept for the
+// given percentage of the decayed requests to still be servable.  The height is
+// the start of a height band.  It's 0 if nothing was requested.  The suggestion
+// is only advisory and nothing is pruned by it.
+//
+// This function is safe for concurrent access.
+func (s *proofServingStats) suggestPruneHeight(targetPercent float64) int32 {
+	stats := s.stats(nil)
+
+	var total float64
+	for i := range stats {
+		total += stats[i].decayedRequests
+	}
+	if total == 0 {
+		return 0
+	}
+
+	// Keep the bands from the highest one down until enough of the
+	// requests are covered.  The tolerance keeps a 100% target from
+	// missing the last band due to rounding.
+	need := total * targetPercent / 100
+	var covered float64
+	for i := len(stats) - 1; i >= 0; i-- {
+		covered += stats[i].decayedRequests
+		if covered >= need-total*1e-9 {
+			return stats[i].startHeight
+		}
+	}
+
+	return stats[0].startHeight
+}
+
+// serializedProofServingSlot is the saved form of a proofServingSlot.
+type serializedProofServingSlot struct {
+	Start    int64    `json:"start"`
+	Requests uint64   `json:"requests"`
+	Bytes    uint64   `json:"bytes"`
+	Peers    []string `json:"peers"`
+}
+
+// serializedProofServingBand is the saved form of a proofServingBand.
+type serializedProofServingBand struct {
+	Start     int32                        `json:"start"`
+	Score     float64                      `json:"score"`
+	ScoreTime int64                        `json:"scoretime"`
+	Slots     []serializedProofServingSlot `json:"slots"`
+}
+
+// serializedProofServingStats is the saved form of the proofServingStats.
+type serializedProofServingStats struct {
+	Version   int                          `json:"version"`
+	BandWidth int32                        `json:"bandwidth"`
+	Bands     []serializedProofServingBand `json:"bands"`
+}
+
+// save writes the utreexo proof serving statistics to disk.  They're written
+// to a temporary file first so that a crash doesn't leave a partial file
+// behind.
+//
+// This function is safe for concurrent access.
+func (s *proofServingStats) save() error {
+	s.mtx.Lock()
+	s.expire(s.now())
+	ss := serializedProofServingStats{
+		Version:   proofStatsVersion,
+		BandWidth: s.bandWidth,
+		Bands:     make([]serializedProofServingBand, 0, len(s.bands)),
+	}
+	for start, band := range s.bands {
+		sb := serializedProofServingBand{
+			Start:     start,
+			Score:     band.score,
+			ScoreTime: band.scoreTime.Unix(),
+			Slots:     make([]serializedProofServingSlot, 0, len(band.slots)),
+		}
+		for _, slot := range band.slots {
+			peers := make([]string, 0, len(slot.peers))
+			for peer := range slot.peers {
+				peers = append(peers, peer)
+			}
+			sort.Strings(peers)
+			sb.Slots = append(sb.Slots, serializedProofServingSlot{
+				Start:    slot.start.Unix(),
+				Requests: slot.requests,
+				Bytes:    slot.bytes,
+				Peers:    peers,
+			})
+		}
+		ss.Bands = append(ss.Bands, sb)
+	}
+	s.mtx.Unlock()
+
+	buf, err := json.Marshal(&ss)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	err = os.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+// load reads the utreexo proof serving statistics back from disk.  Nothing is
+// loaded if they were never saved.  An error is returned if they were tallied
+// with a different band width and they're discarded.
+//
+// This function is safe for concurrent access.
+func (s *proofServingStats) load() error {
+	buf, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var ss serializedProofServingStats
+	err = json.Unmarshal(buf, &ss)
+	if err != nil {
+		return err
+	}
+	if ss.Version != proofStatsVersion {
+		return fmt.Errorf("unknown version %d", ss.Version)
+	}
+	if ss.BandWidth != s.bandWidth {
+		return fmt.Errorf("discarding the statistics tallied with a band "+
+			"width of %d blocks", ss.BandWidth)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.bands = make(map[int32]*proofServingBand, len(ss.Bands))
+	for _, sb := range ss.Bands {
+		band := &proofServingBand{
+			score:     sb.Score,
+			scoreTime: time.Unix(sb.ScoreTime, 0),
+			slots:     make([]*proofServingSlot, 0, len(sb.Slots)),
+		}
+		for _, ssl := range sb.Slots {
+			slot := &proofServingSlot{
+				start:    time.Unix(ssl.Start, 0),
+				requests: ssl.Requests,
+				bytes:    ssl.Bytes,
+				peers:    make(map[string]struct{}, len(ssl.Peers)),
+			}
+			for _, peer := range ssl.Peers {
+				slot.peers[peer] = struct{}{}
+			}
+			band.slots = append(band.slots, slot)
+		}
+		s.bands[sb.Start] = band
+	}
+	s.expire(s.now())
+
+	return nil
+}
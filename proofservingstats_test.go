@@ -0,0 +1,201 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestProofServingStats replays a synthetic request pattern and ensures that
+// the requests are tallied by height band and reported over windows, and that
+// they survive a restart.
+func TestProofServingStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), proofStatsFileName)
+	now := time.Unix(1700000000, 0).Truncate(proofStatsSlotDuration)
+	stats := newProofServingStats(path, 1000, 24*time.Hour, 48*time.Hour)
+	stats.now = func() time.Time { return now }
+
+	// Over two days ago a single peer fetched old blocks, a day ago two
+	// peers fetched recent blocks, and just now a third peer did.
+	now = now.Add(-50 * time.Hour)
+	for height := int32(0); height < 1000; height += 100 {
+		stats.record(height, "peer1", 10)
+	}
+	now = now.Add(26 * time.Hour)
+	for height := int32(5000); height < 5010; height++ {
+		stats.record(height, "peer1", 20)
+		stats.record(height, "peer2", 20)
+	}
+	now = now.Add(24*time.Hour + 30*time.Minute)
+	stats.record(5999, "peer3", 30)
+	stats.record(6000, "peer3", 40)
+
+	windows := []time.Duration{time.Hour, 25 * time.Hour, 100 * time.Hour}
+	want := []proofServingBandStats{
+		{
+			startHeight: 5000,
+			endHeight:   5999,
+			windows: []proofServingWindow{
+				{window: time.Hour, requests: 1, bytes: 30, uniquePeers: 1},
+				{window: 25 * time.Hour, requests: 21, bytes: 430, uniquePeers: 3},
+				{window: 100 * time.Hour, requests: 21, bytes: 430, uniquePeers: 3},
+			},
+		},
+		{
+			startHeight: 6000,
+			endHeight:   6999,
+			windows: []proofServingWindow{
+				{window: time.Hour, requests: 1, bytes: 40, uniquePeers: 1},
+				{window: 25 * time.Hour, requests: 1, bytes: 40, uniquePeers: 1},
+				{window: 100 * time.Hour, requests: 1, bytes: 40, uniquePeers: 1},
+			},
+		},
+	}
+
+	// check makes sure that the bands are tallied as expected.  The slots
+	// of the oldest band are past the retention so it's only reported by
+	// its decayed requests.
+	check := func(stats *proofServingStats) {
+		t.Helper()
+
+		got := stats.stats(windows)
+		if len(got) != 3 || got[0].startHeight != 0 || got[0].endHeight != 999 {
+			t.Fatalf("expected 3 bands starting with 0-999, got %+v", got)
+		}
+		for _, w := range got[0].windows {
+			if w.requests != 0 {
+				t.Fatalf("expected the expired requests to be "+
+					"dropped, got %+v", w)
+			}
+		}
+		got = got[1:]
+		for i := range got {
+			got[i].decayedRequests = 0
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+	check(stats)
+
+	// The stats are the same after a restart.
+	err := stats.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newProofServingStats(path, 1000, 24*time.Hour, 48*time.Hour)
+	restarted.now = stats.now
+	err = restarted.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(restarted)
+
+	// Stats tallied with a different band width are discarded.
+	resized := newProofServingStats(path, 500, 24*time.Hour, 48*time.Hour)
+	err = resized.load()
+	if err == nil {
+		t.Fatal("expected an error for a different band width")
+	}
+	if len(resized.bands) != 0 {
+		t.Fatalf("expected no bands, got %d", len(resized.bands))
+	}
+}
+
+// TestProofServingStatsDecay ensures that the requests of a band count half as
+// much every half life and that bands are forgotten once they've faded.
+func TestProofServingStatsDecay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	halfLife := 10 * 24 * time.Hour
+	stats := newProofServingStats(filepath.Join(t.TempDir(), proofStatsFileName),
+		100, halfLife, time.Hour)
+	stats.now = func() time.Time { return now }
+
+	for i := 0; i < 8; i++ {
+		stats.record(50, "peer", 1)
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		score   float64
+	}{
+		{0, 8},
+		{halfLife, 4},
+		{3 * halfLife, 1},
+	}
+	start := now
+	for _, test := range tests {
+		now = start.Add(test.elapsed)
+		got := stats.stats(nil)
+		if len(got) != 1 {
+			t.Fatalf("after %v: expected 1 band, got %d", test.elapsed,
+				len(got))
+		}
+		if math.Abs(got[0].decayedRequests-test.score) > 1e-9 {
+			t.Fatalf("after %v: expected %v decayed requests, got %v",
+				test.elapsed, test.score, got[0].decayedRequests)
+		}
+	}
+
+	// A new request adds to what's left of the decayed requests.
+	stats.record(99, "peer", 1)
+	got := stats.stats(nil)
+	if math.Abs(got[0].decayedRequests-2) > 1e-9 {
+		t.Fatalf("expected 2 decayed requests, got %v",
+			got[0].decayedRequests)
+	}
+
+	// The band fades once its requests decayed away.
+	now = now.Add(10 * halfLife)
+	if got := stats.stats(nil); len(got) != 0 {
+		t.Fatalf("expected the band to be forgotten, got %+v", got)
+	}
+}
+
+// TestSuggestPruneHeight ensures that the suggested prune height keeps the
+// target percentage of the decayed requests servable.
+func TestSuggestPruneHeight(t *testing.T) {
+	stats := newProofServingStats(filepath.Join(t.TempDir(), proofStatsFileName),
+		100, time.Hour, time.Hour)
+	now := time.Unix(1700000000, 0)
+	stats.now = func() time.Time { return now }
+
+	if height := stats.suggestPruneHeight(99); height != 0 {
+		t.Fatalf("expected no suggestion without requests, got %d", height)
+	}
+
+	// Of the 100 requests, 50 are for the highest band, 30 for the one
+	// below it, 15 for the one below that, and 5 for the lowest one.
+	pattern := map[int32]int{0: 5, 100: 15, 200: 30, 300: 50}
+	for height, count := range pattern {
+		for i := 0; i < count; i++ {
+			stats.record(height+int32(i), "peer", 1)
+		}
+	}
+
+	tests := []struct {
+		target float64
+		height int32
+	}{
+		{target: 100, height: 0},
+		{target: 99, height: 0},
+		{target: 95, height: 100},
+		{target: 90, height: 100},
+		{target: 80, height: 200},
+		{target: 50, height: 300},
+		{target: 10, height: 300},
+	}
+	for _, test := range tests {
+		height := stats.suggestPruneHeight(test.target)
+		if height != test.height {
+			t.Fatalf("target %v%%: expected height %d, got %d",
+				test.target, test.height, height)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/blockchain/indexers"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/rpcclient"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// proofWatchdogFileName is the name of the file in the data directory that the
+// utreexo proof watchdog statistics are saved to.
+const proofWatchdogFileName = "proofwatchdog.json"
+
+// rpcProofSource is another bridge whose utreexo proofs are fetched over its
+// RPC server with the getutreexoproofs command.  It implements the
+// indexers.RemoteProofSource interface.
+type rpcProofSource struct {
+	host   string
+	client *rpcclient.Client
+}
+
+// parseProofWatchdogSource splits a --proofwatchdog option of the form
+// user:password@host:port into its parts.
+func parseProofWatchdogSource(source string) (user, pass, host string, err error) {
+	at := strings.LastIndex(source, "@")
+	if at < 0 {
+		return "", "", "", fmt.Errorf("proof watchdog source %q isn't "+
+			"of the form user:password@host:port", source)
+	}
+	credentials, host := source[:at], source[at+1:]
+
+	colon := strings.Index(credentials, ":")
+	if colon < 0 || host == "" {
+		return "", "", "", fmt.Errorf("proof watchdog source %q isn't "+
+			"of the form user:password@host:port", source)
+	}
+
+	return credentials[:colon], credentials[colon+1:], host, nil
+}
+
+// newRPCProofSource returns a source for the bridge given by a --proofwatchdog
+// option.  The certificates are used to verify its RPC server unless noTLS is
+// set.
+func newRPCProofSource(source string, certs []byte, noTLS bool) (*rpcProofSource, error) {
+	user, pass, host, err := parseProofWatchdogSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         host,
+		User:         user,
+		Pass:         pass,
+		HTTPPostMode: true,
+		DisableTLS:   noTLS,
+		Certificates: certs,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rpcProofSource{host: host, client: client}, nil
+}
+
+// Name returns the host of the bridge.
+//
+// This is part of the indexers.RemoteProofSource interface.
+func (s *rpcProofSource) Name() string {
+	return s.host
+}
+
+// FetchUtreexoProof returns the hash of the block at the given height of the
+// bridge's main chain and the utreexo proof it serves for it.
+//
+// This is part of the indexers.RemoteProofSource interface.
+func (s *rpcProofSource) FetchUtreexoProof(height int32) (
+	*chainhash.Hash, *wire.UData, error) {
+
+	count := int32(1)
+	res, err := s.client.GetUtreexoProofs(height, &count, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(res.Proofs) != 1 || res.Proofs[0].Height != height {
+		return nil, nil, fmt.Errorf("%s didn't serve the proof for "+
+			"height %d", s.host, height)
+	}
+	proof := res.Proofs[0]
+
+	hash, err := chainhash.NewHashFromStr(proof.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialized, err := hex.DecodeString(proof.Hex)
+	if err != nil {
+		return nil, nil, err
+	}
+	ud := new(wire.UData)
+	err = ud.Deserialize(bytes.NewReader(serialized))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hash, ud, nil
+}
+
+// Close shuts down the RPC client of the bridge.
+func (s *rpcProofSource) Close() {
+	s.client.Shutdown()
+}
+
+// newProofWatchdog returns a watchdog that audits the bridges given by the
+// --proofwatchdog options against the given utreexo proof index along with
+// their sources.  The flat index is used if both are given.  The auditing is
+// paused by the shedder while the node is syncing.
+func newProofWatchdog(chain *blockchain.BlockChain,
+	flatIdx *indexers.FlatUtreexoProofIndex, idx *indexers.UtreexoProofIndex,
+	shedder *indexers.SyncShedder) (
+	*indexers.ProofWatchdog, []*rpcProofSource, error) {
+
+	var certs []byte
+	if !cfg.ProofWatchdogNoTLS && cfg.ProofWatchdogCert != "" {
+		var err error
+		certs, err = os.ReadFile(cleanAndExpandPath(cfg.ProofWatchdogCert))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var sources []*rpcProofSource
+	closeSources := func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}
+	remotes := make([]indexers.RemoteProofSource, 0, len(cfg.ProofWatchdog))
+	for _, option := range cfg.ProofWatchdog {
+		source, err := newRPCProofSource(option, certs,
+			cfg.ProofWatchdogNoTLS)
+		if err != nil {
+			closeSources()
+			return nil, nil, err
+		}
+		sources = append(sources, source)
+		remotes = append(remotes, source)
+	}
+
+	fetchLocal := func(height int32) (*chainhash.Hash, *wire.UData, error) {
+		hash, err := chain.BlockHashByHeight(height)
+		if err != nil {
+			return nil, nil, err
+		}
+		var ud *wire.UData
+		if flatIdx != nil {
+			ud, err = flatIdx.FetchUtreexoProof(height, false)
+		} else {
+			ud, err = idx.FetchUtreexoProof(hash)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return hash, ud, nil
+	}
+
+	watchdog, err := indexers.NewProofWatchdog(&indexers.ProofWatchdogConfig{
+		Sources:    remotes,
+		FetchLocal: fetchLocal,
+		FetchBlock: chain.BlockByHeight,
+		BestHeight: func() int32 {
+			return chain.BestSnapshot().Height
+		},
+		StatsPath:          filepath.Join(cfg.DataDir, proofWatchdogFileName),
+		HistoricalInterval: cfg.ProofWatchdogInterval,
+		Shedder:            shedder,
+	})
+	if err != nil {
+		closeSources()
+		return nil, nil, err
+	}
+
+	return watchdog, sources, nil
+}
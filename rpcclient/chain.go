@@ -1382,3 +1382,47 @@ func (c *Client) GetDescriptorInfoAsync(descriptor string) FutureGetDescriptorIn
 func (c *Client) GetDescriptorInfo(descriptor string) (*btcjson.GetDescriptorInfoResult, error) {
 	return c.GetDescriptorInfoAsync(descriptor).Receive()
 }
+
+// FutureGetUtreexoProofsResult is a future promise to deliver the result of a
+// GetUtreexoProofsAsync RPC invocation (or an applicable error).
+type FutureGetUtreexoProofsResult chan *Response
+
+// Receive waits for the Response promised by the future and returns the
+// utreexo proofs and the cursor to resume the scan from.
+func (r FutureGetUtreexoProofsResult) Receive() (*btcjson.GetUtreexoProofsResult, error) {
+	res, err := ReceiveFuture(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var proofs btcjson.GetUtreexoProofsResult
+	err = json.Unmarshal(res, &proofs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proofs, nil
+}
+
+// GetUtreexoProofsAsync returns an instance of a type that can be used to get
+// the result of the RPC at some future time by invoking the Receive function on
+// the returned instance.
+//
+// See GetUtreexoProofs for the blocking version and more details.
+func (c *Client) GetUtreexoProofsAsync(startHeight int32, count *int32,
+	cursor *string) FutureGetUtreexoProofsResult {
+
+	cmd := btcjson.NewGetUtreexoProofsCmd(startHeight, count, cursor, nil, nil)
+	return c.SendCmd(cmd)
+}
+
+// GetUtreexoProofs returns up to count utreexo proofs of the main chain
+// starting at startHeight, or after the block the cursor points to if it's
+// not nil.
+//
+// See btcjson.GetUtreexoProofsResult for details about the result.
+func (c *Client) GetUtreexoProofs(startHeight int32, count *int32,
+	cursor *string) (*btcjson.GetUtreexoProofsResult, error) {
+
+	return c.GetUtreexoProofsAsync(startHeight, count, cursor).Receive()
+}
@@ -1447,6 +1447,8 @@ func New(config *ConnConfig, ntfnHandlers *NotificationHandlers) (*Client, error
 		client.chainParams = &chaincfg.RegressionNetParams
 	case chaincfg.SimNetParams.Name:
 		client.chainParams = &chaincfg.SimNetParams
+	case chaincfg.SigNetParams.Name:
+		client.chainParams = &chaincfg.SigNetParams
 	default:
 		return nil, fmt.Errorf("rpcclient.New: Unknown chain %s", config.Params)
 	}
@@ -10,6 +10,7 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -39,6 +40,7 @@ import (
 	"github.com/utreexo/utreexod/mempool"
 	"github.com/utreexo/utreexod/mining"
 	"github.com/utreexo/utreexod/mining/cpuminer"
+	"github.com/utreexo/utreexod/netsync"
 	"github.com/utreexo/utreexod/peer"
 	"github.com/utreexo/utreexod/txscript"
 	"github.com/utreexo/utreexod/wire"
@@ -75,6 +77,14 @@ const (
 
 	// maxProtocolVersion is the max protocol version the server supports.
 	maxProtocolVersion = 70002
+
+	// maxUtreexoProofsPerRequest is the maximum amount of utreexo proofs
+	// returned by a single getutreexoproofs request.
+	maxUtreexoProofsPerRequest = 1000
+
+	// maxProofEstimateOutpoints is the maximum amount of outpoints whose
+	// utreexo proof is estimated by a single estimateproofsize request.
+	maxProofEstimateOutpoints = 1000
 )
 
 var (
@@ -131,11 +141,13 @@ type commandHandler func(*rpcServer, interface{}, <-chan struct{}) (interface{},
 var rpcHandlers map[string]commandHandler
 var rpcHandlersBeforeInit = map[string]commandHandler{
 	"addnode":                          handleAddNode,
+	"compareproof":                     handleCompareProof,
 	"createrawtransaction":             handleCreateRawTransaction,
 	"debuglevel":                       handleDebugLevel,
 	"decoderawtransaction":             handleDecodeRawTransaction,
 	"decodescript":                     handleDecodeScript,
 	"estimatefee":                      handleEstimateFee,
+	"estimateproofsize":                handleEstimateProofSize,
 	"generate":                         handleGenerate,
 	"getaddednodeinfo":                 handleGetAddedNodeInfo,
 	"getbestblock":                     handleGetBestBlock,
@@ -154,6 +166,7 @@ var rpcHandlersBeforeInit = map[string]commandHandler{
 	"getgenerate":                      handleGetGenerate,
 	"gethashespersec":                  handleGetHashesPerSec,
 	"getheaders":                       handleGetHeaders,
+	"getindexinfo":                     handleGetIndexInfo,
 	"getinfo":                          handleGetInfo,
 	"getmempoolinfo":                   handleGetMempoolInfo,
 	"getmininginfo":                    handleGetMiningInfo,
@@ -162,13 +175,24 @@ var rpcHandlersBeforeInit = map[string]commandHandler{
 	"getnetworkhashps":                 handleGetNetworkHashPS,
 	"getnodeaddresses":                 handleGetNodeAddresses,
 	"getpeerinfo":                      handleGetPeerInfo,
+	"getproofservingstats":             handleGetProofServingStats,
+	"getproofsourcescores":             handleGetProofSourceScores,
+	"getproofwatchdogstats":            handleGetProofWatchdogStats,
 	"getrawmempool":                    handleGetRawMempool,
 	"getrawtransaction":                handleGetRawTransaction,
 	"getttl":                           handleGetTTL,
 	"gettxout":                         handleGetTxOut,
+	"getutreexocapabilities":           handleGetUtreexoCapabilities,
+	"getutreexocoinagestats":           handleGetUtreexoCoinAgeStats,
+	"getutreexoproofcost":              handleGetUtreexoProofCost,
+	"getutreexoproof":                  handleGetUtreexoProof,
+	"getutreexoproofs":                 handleGetUtreexoProofs,
+	"getutreexostate":                  handleGetUtreexoState,
 	"help":                             handleHelp,
+	"listutreexopins":                  handleListUtreexoPins,
 	"node":                             handleNode,
 	"ping":                             handlePing,
+	"pinutreexoproof":                  handlePinUtreexoProof,
 	"proveutxochaintipinclusion":       handleProveUtxoChainTipInclusion,
 	"searchrawtransactions":            handleSearchRawTransactions,
 	"sendrawtransaction":               handleSendRawTransaction,
@@ -176,10 +200,15 @@ var rpcHandlersBeforeInit = map[string]commandHandler{
 	"signmessagewithprivkey":           handleSignMessageWithPrivKey,
 	"stop":                             handleStop,
 	"submitblock":                      handleSubmitBlock,
+	"unpinutreexoproof":                handleUnpinUtreexoProof,
 	"uptime":                           handleUptime,
 	"validateaddress":                  handleValidateAddress,
 	"verifychain":                      handleVerifyChain,
 	"verifymessage":                    handleVerifyMessage,
+	"verifyproofreceipt":               handleVerifyProofReceipt,
+	"verifyundoblocks":                 handleVerifyUndoBlocks,
+	"verifyutreexoindexes":             handleVerifyUtreexoIndexes,
+	"verifyutreexoproofs":              handleVerifyUtreexoProofs,
 	"verifyutxochaintipinclusionproof": handleVerifyUtxoChainTipInclusionProof,
 	"version":                          handleVersion,
 }
@@ -264,6 +293,7 @@ var rpcLimited = map[string]struct{}{
 	"decoderawtransaction":       {},
 	"decodescript":               {},
 	"estimatefee":                {},
+	"estimateproofsize":          {},
 	"getbestblock":               {},
 	"getbestblockhash":           {},
 	"getblock":                   {},
@@ -275,6 +305,7 @@ var rpcLimited = map[string]struct{}{
 	"getcurrentnet":              {},
 	"getdifficulty":              {},
 	"getheaders":                 {},
+	"getindexinfo":               {},
 	"getinfo":                    {},
 	"getnettotals":               {},
 	"gettxtotals":                {},
@@ -282,6 +313,10 @@ var rpcLimited = map[string]struct{}{
 	"getrawmempool":              {},
 	"getrawtransaction":          {},
 	"gettxout":                   {},
+	"getutreexocapabilities":     {},
+	"getutreexoproof":            {},
+	"getutreexoproofs":           {},
+	"getutreexostate":            {},
 	"proveutxochaintipinclusion": {},
 	"searchrawtransactions":      {},
 	"sendrawtransaction":         {},
@@ -289,6 +324,7 @@ var rpcLimited = map[string]struct{}{
 	"uptime":                     {},
 	"validateaddress":            {},
 	"verifymessage":              {},
+	"verifyproofreceipt":         {},
 	"version":                    {},
 }
 
@@ -519,6 +555,113 @@ func messageToHex(msg wire.Message) (string, error) {
 	return hex.EncodeToString(buf.Bytes()), nil
 }
 
+// deserializeExternalUData deserializes a utreexo proof produced by another
+// implementation.  The leaf datas may be in the full or the compact form, so
+// whichever of them uses up exactly all of the bytes is used.
+func deserializeExternalUData(serialized []byte) (*wire.UData, error) {
+	ud := new(wire.UData)
+	r := bytes.NewReader(serialized)
+	err := ud.Deserialize(r)
+	if err == nil && r.Len() == 0 {
+		return ud, nil
+	}
+
+	ud = new(wire.UData)
+	r = bytes.NewReader(serialized)
+	compactErr := ud.DeserializeCompact(r, false, 0)
+	if compactErr == nil && r.Len() == 0 {
+		return ud, nil
+	}
+	if compactErr == nil {
+		compactErr = fmt.Errorf("%d trailing bytes", r.Len())
+	}
+
+	return nil, fmt.Errorf("not a utreexo proof in the full or the "+
+		"compact form: %v", compactErr)
+}
+
+// handleCompareProof implements the compareproof command.
+func handleCompareProof(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+
+	if err := s.shedHistorical("compareproof"); err != nil {
+		return nil, err
+	}
+
+	c := cmd.(*btcjson.CompareProofCmd)
+	// A block hash is always 64 hex characters so anything shorter that's
+	// a number is a height.
+	var height int32
+	parsed, err := strconv.ParseInt(c.Block, 10, 32)
+	if err == nil && len(c.Block) < chainhash.MaxHashStringSize {
+		height = int32(parsed)
+	} else {
+		hash, err := chainhash.NewHashFromStr(c.Block)
+		if err != nil {
+			return nil, rpcDecodeHexError(c.Block)
+		}
+		height, err = s.cfg.Chain.BlockHeightByHash(hash)
+		if err != nil {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCBlockNotFound,
+				Message: "Block not found in the main chain",
+			}
+		}
+	}
+	hash, err := s.cfg.Chain.BlockHashByHeight(height)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCOutOfRange,
+			Message: "Block number out of range",
+		}
+	}
+
+	serialized, err := hex.DecodeString(c.Proof)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.Proof)
+	}
+	result := &btcjson.CompareProofResult{
+		Height: height,
+		Hash:   hash.String(),
+	}
+
+	// A proof that can't be deserialized is as invalid as one that doesn't
+	// verify.
+	ud, err := deserializeExternalUData(serialized)
+	if err != nil {
+		result.Verdict = indexers.ProofInvalid.String()
+		result.Error = err.Error()
+		return result, nil
+	}
+
+	cmp, err := s.cfg.FlatUtreexoProofIndex.CompareProof(height, ud)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: err.Error(),
+		}
+	}
+	if cmp.Verdict == indexers.ProofDifferentTargets {
+		rpcsLog.Warnf("Submitted utreexo proof for block %v (height %d) "+
+			"verifies but proves other targets than the local one: %v",
+			hash, height, cmp.Diff)
+	}
+
+	result.Verdict = cmp.Verdict.String()
+	result.Redundant = cmp.Redundant
+	result.Differences = cmp.Diff
+	if cmp.Err != nil {
+		result.Error = cmp.Err.Error()
+	}
+
+	return result, nil
+}
+
 // handleCreateRawTransaction handles createrawtransaction commands.
 func handleCreateRawTransaction(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	c := cmd.(*btcjson.CreateRawTransactionCmd)
@@ -1303,9 +1446,132 @@ func handleGetBlockChainInfo(s *rpcServer, cmd interface{}, closeChan <-chan str
 		}
 	}
 
+	utreexoInfo, err := utreexoChainInfo(s)
+	if err != nil {
+		return nil, err
+	}
+	chainInfo.Utreexo = utreexoInfo
+
 	return chainInfo, nil
 }
 
+// hexRoots returns the hex-encoded accumulator roots.
+func hexRoots(roots []*chainhash.Hash) []string {
+	strs := make([]string, 0, len(roots))
+	for _, root := range roots {
+		strs = append(strs, root.String())
+	}
+	return strs
+}
+
+// heightRangeResults returns the height ranges in the form they're returned
+// from the rpc server.
+func heightRangeResults(ranges []indexers.HeightRange) []btcjson.HeightRangeResult {
+	results := make([]btcjson.HeightRangeResult, 0, len(ranges))
+	for _, r := range ranges {
+		results = append(results, btcjson.HeightRangeResult{
+			Start: r.Start,
+			End:   r.End,
+		})
+	}
+	return results
+}
+
+// bridgeUtreexoInfo returns the utreexo section of getblockchaininfo for a
+// bridge with the given accumulators and health of its utreexo proof indexes
+// and the heights that any of them serves the proofs for.  The accumulator of
+// the bridge is the one of the first index that isn't degraded, or of the first
+// index if they all are.
+func bridgeUtreexoInfo(tips []indexers.AccumulatorTip,
+	health []indexers.IndexHealth,
+	servable []indexers.HeightRange) *btcjson.UtreexoChainInfoResult {
+
+	healthByName := make(map[string]indexers.IndexHealth, len(health))
+	for _, h := range health {
+		healthByName[h.Name] = h
+	}
+
+	info := &btcjson.UtreexoChainInfoResult{
+		Version:  btcjson.UtreexoChainInfoVersion,
+		Mode:     "bridge",
+		Roots:    []string{},
+		Indexes:  make([]btcjson.UtreexoIndexStateResult, 0, len(tips)),
+		Servable: heightRangeResults(servable),
+	}
+	chosen := -1
+	for i, tip := range tips {
+		h := healthByName[tip.Name]
+		index := btcjson.UtreexoIndexStateResult{
+			Name:          tip.Name,
+			Height:        tip.Height,
+			NumLeaves:     tip.NumLeaves,
+			Roots:         hexRoots(tip.Roots),
+			Degraded:      h.Degraded,
+			DurableHeight: tip.Height,
+			Servable:      heightRangeResults(h.Servable),
+			NumRoots:      len(tip.Roots),
+			NumHashes:     tip.NumHashes,
+		}
+		if h.Degraded {
+			index.DurableHeight = h.DurableHeight
+			if h.Cause != nil {
+				index.Cause = h.Cause.Error()
+			}
+			info.Degraded = true
+		}
+		info.Indexes = append(info.Indexes, index)
+
+		if chosen == -1 || (!h.Degraded && info.Indexes[chosen].Degraded) {
+			chosen = i
+		}
+	}
+	if chosen != -1 {
+		info.Height = info.Indexes[chosen].Height
+		info.NumLeaves = info.Indexes[chosen].NumLeaves
+		info.Roots = info.Indexes[chosen].Roots
+		info.NumRoots = info.Indexes[chosen].NumRoots
+		info.NumHashes = info.Indexes[chosen].NumHashes
+	}
+
+	return info
+}
+
+// utreexoChainInfo returns the utreexo section of getblockchaininfo.  A bridge
+// reports the accumulators of its utreexo proof indexes and a utreexo node
+// reports its utreexo viewpoint.  It's nil if the node is neither.  Only the
+// counters and the roots that are kept up to date are read so that it takes
+// the same time however long the chain is.
+func utreexoChainInfo(s *rpcServer) (*btcjson.UtreexoChainInfoResult, error) {
+	if s.cfg.IndexManager != nil && (s.cfg.UtreexoProofIndex != nil ||
+		s.cfg.FlatUtreexoProofIndex != nil) {
+
+		tips, err := s.cfg.IndexManager.AccumulatorTips()
+		if err != nil {
+			context := "Failed to fetch the utreexo accumulators"
+			return nil, internalRPCError(err.Error(), context)
+		}
+
+		return bridgeUtreexoInfo(tips, s.cfg.IndexManager.Health(),
+			s.cfg.IndexManager.ServableRanges()), nil
+	}
+
+	view, ok := s.cfg.Chain.UtreexoViewTip()
+	if !ok {
+		return nil, nil
+	}
+	return &btcjson.UtreexoChainInfoResult{
+		Version:   btcjson.UtreexoChainInfoVersion,
+		Mode:      "csn",
+		Height:    view.Height,
+		NumLeaves: view.NumLeaves,
+		Roots:     hexRoots(view.Roots),
+		Indexes:   []btcjson.UtreexoIndexStateResult{},
+		Servable:  []btcjson.HeightRangeResult{},
+		NumRoots:  len(view.Roots),
+		NumHashes: view.NumHashes,
+	}, nil
+}
+
 // handleGetBlockCount implements the getblockcount command.
 func handleGetBlockCount(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	best := s.cfg.Chain.BestSnapshot()
@@ -2105,6 +2371,10 @@ func chainErrToGBTErrString(err error) string {
 //
 // See https://en.bitcoin.it/wiki/BIP_0023 for more details.
 func handleGetBlockTemplateProposal(s *rpcServer, request *btcjson.TemplateRequest) (interface{}, error) {
+	// The utreexo preview deadline starts from when the proposal arrived.
+	deadline := time.Now().Add(time.Duration(request.UtreexoDeadline) *
+		time.Millisecond)
+
 	hexData := request.Data
 	if hexData == "" {
 		return false, &btcjson.RPCError{
@@ -2136,6 +2406,31 @@ func handleGetBlockTemplateProposal(s *rpcServer, request *btcjson.TemplateReque
 	}
 	block := btcutil.NewBlock(&msgBlock)
 
+	reject, err := checkBlockTemplateProposal(s, block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the BIP0023 response unless the utreexo preview was asked for.
+	if request.UtreexoDeadline <= 0 {
+		if reject == "" {
+			return nil, nil
+		}
+		return reject, nil
+	}
+
+	result := &btcjson.GetBlockTemplateProposalResult{RejectReason: reject}
+	if reject == "" {
+		result.Utreexo = previewUtreexoProposal(s, block, deadline)
+	}
+
+	return result, nil
+}
+
+// checkBlockTemplateProposal checks that the proposed block connects to the
+// tip of the main chain.  The reason the block was rejected is returned or an
+// empty string if it was accepted.
+func checkBlockTemplateProposal(s *rpcServer, block *btcutil.Block) (string, error) {
 	// Ensure the block is building from the expected previous block.
 	expectedPrevHash := s.cfg.Chain.BestSnapshot().Hash
 	prevHash := &block.MsgBlock().Header.PrevBlock
@@ -2147,7 +2442,7 @@ func handleGetBlockTemplateProposal(s *rpcServer, request *btcjson.TemplateReque
 		if _, ok := err.(blockchain.RuleError); !ok {
 			errStr := fmt.Sprintf("Failed to process block proposal: %v", err)
 			rpcsLog.Error(errStr)
-			return nil, &btcjson.RPCError{
+			return "", &btcjson.RPCError{
 				Code:    btcjson.ErrRPCVerify,
 				Message: errStr,
 			}
@@ -2157,7 +2452,40 @@ func handleGetBlockTemplateProposal(s *rpcServer, request *btcjson.TemplateReque
 		return chainErrToGBTErrString(err), nil
 	}
 
-	return nil, nil
+	return "", nil
+}
+
+// previewUtreexoProposal previews the utreexo proof of the proposed block with
+// whichever utreexo proof index is enabled.  Nil is returned if neither is.
+func previewUtreexoProposal(s *rpcServer, block *btcutil.Block,
+	deadline time.Time) *btcjson.UtreexoPreviewResult {
+
+	var preview *indexers.ConnectPreview
+	var err error
+	switch {
+	case s.cfg.FlatUtreexoProofIndex != nil:
+		preview, err = s.cfg.FlatUtreexoProofIndex.PreviewConnect(block, deadline)
+	case s.cfg.UtreexoProofIndex != nil:
+		preview, err = s.cfg.UtreexoProofIndex.PreviewConnect(block, deadline)
+	default:
+		return nil
+	}
+	if err != nil {
+		return &btcjson.UtreexoPreviewResult{
+			Checks: []string{},
+			Error:  err.Error(),
+		}
+	}
+
+	result := &btcjson.UtreexoPreviewResult{
+		Complete: preview.Complete,
+		Checks:   preview.Checks,
+	}
+	if preview.Err != nil {
+		result.Error = preview.Err.Error()
+	}
+
+	return result
 }
 
 // handleGetBlockTemplate implements the getblocktemplate command.
@@ -2314,6 +2642,251 @@ func handleGetHeaders(s *rpcServer, cmd interface{}, closeChan <-chan struct{})
 	return hexBlockHeaders, nil
 }
 
+// indexWriteStatsResult returns the write stats of an index as the result of
+// the getindexinfo command.
+func indexWriteStatsResult(stats *indexers.WriteStats) btcjson.IndexWriteStatsResult {
+	return btcjson.IndexWriteStatsResult{
+		Blocks:        stats.Blocks,
+		LogicalBytes:  stats.LogicalBytes,
+		WrittenBytes:  stats.WrittenBytes,
+		Syncs:         stats.Syncs,
+		Amplification: stats.Amplification(),
+	}
+}
+
+// handleGetIndexInfo implements the getindexinfo command.
+func handleGetIndexInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.UtreexoProofIndex == nil && s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "A utreexo proof index must be enabled. " +
+				"(--utreexoproofindex) or (--flatutreexoproofindex).",
+		}
+	}
+
+	result := &btcjson.GetIndexInfoResult{}
+	addIndex := func(name string, stats *indexers.IndexWriteStats,
+		rowGrowth *indexers.RowGrowthStats, rs indexers.RangeServer) error {
+
+		ranges, err := rs.ServableRanges()
+		if err != nil {
+			context := "Failed to fetch the servable ranges"
+			return internalRPCError(err.Error(), context)
+		}
+		servable := heightRangeResults(ranges)
+
+		var reads *btcjson.IndexReadStatsResult
+		if stats.Reads != nil {
+			reads = &btcjson.IndexReadStatsResult{
+				ShortReads:      stats.Reads.ShortReads,
+				TransientErrors: stats.Reads.TransientErrors,
+				Retries:         stats.Reads.Retries,
+				Failed:          stats.Reads.Failed,
+			}
+		}
+
+		// Only the database index is connected again after a
+		// transient database error.
+		var dbRetries *btcjson.IndexDBRetryResult
+		if stats.Reads == nil {
+			dbRetries = &btcjson.IndexDBRetryResult{
+				Retries:   stats.DbRetries.Retries,
+				Recovered: stats.DbRetries.Recovered,
+				Exhausted: stats.DbRetries.Exhausted,
+			}
+		}
+
+		boundaries := make([]btcjson.IndexRowBoundaryResult, 0,
+			len(rowGrowth.Boundaries))
+		for _, b := range rowGrowth.Boundaries {
+			boundaries = append(boundaries, btcjson.IndexRowBoundaryResult{
+				Height:       b.Height,
+				Rows:         b.Rows,
+				ConnectTime:  b.ConnectTime.Seconds(),
+				Preallocated: b.Preallocated,
+			})
+		}
+
+		var proofCache *btcjson.IndexProofCacheResult
+		if stats.ProofCache != nil {
+			proofCache = &btcjson.IndexProofCacheResult{
+				Size:      stats.ProofCache.Size,
+				MaxSize:   stats.ProofCache.MaxSize,
+				Entries:   stats.ProofCache.Entries,
+				Hits:      stats.ProofCache.Hits,
+				Misses:    stats.ProofCache.Misses,
+				HitRate:   stats.ProofCache.HitRate(),
+				Evictions: stats.ProofCache.Evictions,
+			}
+		}
+
+		templates := make(map[string]uint64, len(stats.LeafHashing.Templates))
+		for _, t := range stats.LeafHashing.Templates {
+			templates[t.Template.String()] = t.Hits
+		}
+
+		result.Indexes = append(result.Indexes, btcjson.IndexInfoResult{
+			Name:                name,
+			Shadow:              stats.Shadow,
+			Approximate:         stats.Approximate,
+			LastHeight:          stats.LastHeight,
+			LastBlock:           indexWriteStatsResult(&stats.LastBlock),
+			Total:               indexWriteStatsResult(&stats.Total),
+			Servable:            servable,
+			FsyncPolicy:         stats.FsyncPolicy,
+			RecordedFsyncPolicy: stats.RecordedFsyncPolicy,
+			Reads:               reads,
+			DBRetries:           dbRetries,
+			RowGrowth: btcjson.IndexRowGrowthResult{
+				Rows:            rowGrowth.Rows,
+				NumLeaves:       rowGrowth.NumLeaves,
+				LeavesToNextRow: rowGrowth.LeavesToNextRow,
+				BlocksToNextRow: rowGrowth.BlocksToNextRow,
+				Preallocated:    rowGrowth.Preallocated,
+				AvgConnectTime:  rowGrowth.AvgConnectTime.Seconds(),
+				Boundaries:      boundaries,
+			},
+			LeafHashing: btcjson.IndexLeafHashResult{
+				Templates:       templates,
+				Fallbacks:       stats.LeafHashing.Fallbacks,
+				HitRate:         stats.LeafHashing.HitRate(),
+				Midstates:       stats.LeafHashing.Midstates,
+				MaxMidstates:    stats.LeafHashing.MaxMidstates,
+				MidstateHitRate: stats.LeafHashing.MidstateHitRate(),
+			},
+			MaxLeaves:    stats.MaxLeaves,
+			LeafHeadroom: stats.LeafHeadroom,
+			ProofCache:   proofCache,
+		})
+		return nil
+	}
+
+	var flatStats, dbStats indexers.IndexWriteStats
+	if s.cfg.FlatUtreexoProofIndex != nil {
+		flatStats = s.cfg.FlatUtreexoProofIndex.Stats()
+		rowGrowth := s.cfg.FlatUtreexoProofIndex.RowGrowthStats()
+		err := addIndex(s.cfg.FlatUtreexoProofIndex.Name(), &flatStats,
+			&rowGrowth, s.cfg.FlatUtreexoProofIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.cfg.UtreexoProofIndex != nil {
+		dbStats = s.cfg.UtreexoProofIndex.Stats()
+		rowGrowth := s.cfg.UtreexoProofIndex.RowGrowthStats()
+		err := addIndex(s.cfg.UtreexoProofIndex.Name(), &dbStats,
+			&rowGrowth, s.cfg.UtreexoProofIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Compare the indexes when both of them are running.
+	if s.cfg.FlatUtreexoProofIndex != nil && s.cfg.UtreexoProofIndex != nil {
+		comparison := &btcjson.IndexWriteComparisonResult{
+			FlatAmplification: flatStats.Total.Amplification(),
+			DBAmplification:   dbStats.Total.Amplification(),
+		}
+		if comparison.FlatAmplification > 0 {
+			comparison.DBToFlatRatio = comparison.DBAmplification /
+				comparison.FlatAmplification
+		}
+		result.Comparison = comparison
+	}
+
+	// Report the serving lags when they're recorded.
+	if s.cfg.ServingLag != nil {
+		stats := s.cfg.ServingLag.Stats()
+		result.ServingLag = &btcjson.ServingLagResult{
+			Blocks:     stats.Blocks,
+			Generation: lagSummaryResult(&stats.Generation),
+			Durability: lagSummaryResult(&stats.Durability),
+			FirstServe: lagSummaryResult(&stats.FirstServe),
+		}
+	}
+
+	// Report how far the indexes were caught up while they're caught up.
+	if s.cfg.IndexManager != nil {
+		for _, h := range s.cfg.IndexManager.SyncHeights() {
+			var progress float64
+			if h.Tip > 0 {
+				progress = float64(h.Height) / float64(h.Tip)
+			}
+			result.Sync = append(result.Sync, btcjson.IndexSyncResult{
+				Name:     h.Name,
+				Height:   h.Height,
+				Tip:      h.Tip,
+				Progress: progress,
+			})
+		}
+	}
+
+	// Report the memory of the utreexo data when it's capped.
+	if s.cfg.MemAccountant != nil {
+		stats := s.cfg.MemAccountant.Stats()
+		mem := &btcjson.UDataMemResult{
+			Cap:  stats.Cap,
+			Used: stats.Used,
+			Peak: stats.Peak,
+			Subsystems: make([]btcjson.UDataMemSubsystemResult, 0,
+				len(stats.Subsystems)),
+		}
+		for _, sub := range stats.Subsystems {
+			subResult := btcjson.UDataMemSubsystemResult{
+				Name:         sub.Name,
+				Class:        sub.Class.String(),
+				Quota:        sub.Quota,
+				Floor:        sub.Floor,
+				Used:         sub.Used,
+				Peak:         sub.Peak,
+				Evictions:    sub.Evictions,
+				EvictedBytes: sub.EvictedBytes,
+				Rejected:     sub.Rejected,
+			}
+			mem.Subsystems = append(mem.Subsystems, subResult)
+		}
+		if pressure := stats.Pressure; pressure.Source != "" {
+			mem.Pressure = &btcjson.UDataMemPressureResult{
+				Source:       pressure.Source,
+				Pressure:     pressure.Pressure,
+				Samples:      pressure.Samples,
+				SampleErrors: pressure.SampleErrors,
+				Shrunk:       pressure.Shrunk,
+				Limit:        pressure.Limit,
+				Shrinks:      pressure.Shrinks,
+				Restores:     pressure.Restores,
+				History: make([]btcjson.UDataMemAdjustmentResult, 0,
+					len(pressure.History)),
+			}
+			for _, adj := range pressure.History {
+				mem.Pressure.History = append(mem.Pressure.History,
+					btcjson.UDataMemAdjustmentResult{
+						Time:     adj.Time.Unix(),
+						Pressure: adj.Pressure,
+						Shrink:   adj.Shrink,
+						Freed:    adj.Freed,
+						Limit:    adj.Limit,
+					})
+			}
+		}
+		result.UDataMem = mem
+	}
+
+	return result, nil
+}
+
+// lagSummaryResult returns the summary of the lags of a stage of serving the
+// utreexo proofs as the result of the getindexinfo command.
+func lagSummaryResult(summary *indexers.LagSummary) btcjson.LagSummaryResult {
+	return btcjson.LagSummaryResult{
+		Count: summary.Count,
+		P50:   summary.P50.Seconds(),
+		P90:   summary.P90.Seconds(),
+		P99:   summary.P99.Seconds(),
+		Max:   summary.Max.Seconds(),
+	}
+}
+
 // handleGetInfo implements the getinfo command. We only return the fields
 // that are not related to wallet functionality.
 func handleGetInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
@@ -2579,6 +3152,139 @@ func handleGetPeerInfo(s *rpcServer, cmd interface{}, closeChan <-chan struct{})
 	return infos, nil
 }
 
+// handleGetProofServingStats implements the getproofservingstats command.
+func handleGetProofServingStats(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetProofServingStatsCmd)
+
+	stats := s.cfg.ProofServingStats
+	if stats == nil {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "A utreexo proof index must be enabled. " +
+				"(--utreexoproofindex) or (--flatutreexoproofindex).",
+		}
+	}
+
+	targetPercent := float64(99)
+	if c.TargetPercent != nil {
+		targetPercent = *c.TargetPercent
+	}
+	if targetPercent <= 0 || targetPercent > 100 {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCInvalidParameter,
+			Message: "Target percent must be above 0 and at most 100",
+		}
+	}
+
+	windows := defaultProofStatsWindows
+	if c.Windows != nil {
+		windows = make([]time.Duration, 0, len(*c.Windows))
+		for _, window := range *c.Windows {
+			if window <= 0 {
+				return nil, &btcjson.RPCError{
+					Code:    btcjson.ErrRPCInvalidParameter,
+					Message: "Windows must be positive",
+				}
+			}
+			windows = append(windows, time.Duration(window)*time.Second)
+		}
+	}
+
+	bands := stats.stats(windows)
+	result := &btcjson.GetProofServingStatsResult{
+		BandWidth:            stats.bandWidth,
+		HalfLife:             int64(stats.halfLife / time.Second),
+		TargetPercent:        targetPercent,
+		SuggestedPruneHeight: stats.suggestPruneHeight(targetPercent),
+		Bands:                make([]btcjson.ProofServingBandResult, 0, len(bands)),
+	}
+	for _, band := range bands {
+		bandResult := btcjson.ProofServingBandResult{
+			StartHeight:     band.startHeight,
+			EndHeight:       band.endHeight,
+			DecayedRequests: band.decayedRequests,
+			Windows:         make([]btcjson.ProofServingWindowResult, 0, len(band.windows)),
+		}
+		for _, w := range band.windows {
+			bandResult.Windows = append(bandResult.Windows,
+				btcjson.ProofServingWindowResult{
+					Window:      int64(w.window / time.Second),
+					Requests:    w.requests,
+					Bytes:       w.bytes,
+					UniquePeers: w.uniquePeers,
+				})
+		}
+		result.Bands = append(result.Bands, bandResult)
+	}
+
+	return result, nil
+}
+
+// handleGetProofSourceScores implements the getproofsourcescores command.
+func handleGetProofSourceScores(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.ProofSampler == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "The utreexo compact state must be enabled. (--utreexo)",
+		}
+	}
+
+	scores := s.cfg.ProofSampler.Scores()
+	result := &btcjson.GetProofSourceScoresResult{
+		Sources: make([]btcjson.ProofSourceScoreResult, 0, len(scores)),
+	}
+	for _, score := range scores {
+		result.Sources = append(result.Sources, btcjson.ProofSourceScoreResult{
+			Source:     score.Source,
+			Score:      score.Score,
+			SampleRate: score.SampleRate,
+			Staged:     score.Staged,
+			Sampled:    score.Sampled,
+			Failures:   score.Failures,
+			Banned:     score.Banned,
+		})
+	}
+
+	return result, nil
+}
+
+// handleGetProofWatchdogStats implements the getproofwatchdogstats command.
+func handleGetProofWatchdogStats(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.ProofWatchdog == nil {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "The utreexo proof watchdog must be enabled. " +
+				"(--proofwatchdog) with (--utreexoproofindex) or " +
+				"(--flatutreexoproofindex).",
+		}
+	}
+
+	stats := s.cfg.ProofWatchdog.Stats()
+	result := &btcjson.GetProofWatchdogStatsResult{
+		Sources: make([]btcjson.ProofWatchdogSourceResult, 0, len(stats)),
+	}
+	for _, source := range stats {
+		sourceResult := btcjson.ProofWatchdogSourceResult{
+			Name:        source.Name,
+			Agreements:  source.Agreements,
+			Divergences: source.Divergences,
+			Failures:    source.Failures,
+			Skipped:     source.Skipped,
+			Available:   source.Available,
+		}
+		if d := source.LastDivergence; d != nil {
+			sourceResult.LastDivergence = &btcjson.ProofDivergenceResult{
+				Height: d.Height,
+				Hash:   d.Hash.String(),
+				Diff:   d.Diff,
+			}
+		}
+		result.Sources = append(result.Sources, sourceResult)
+	}
+
+	return result, nil
+}
+
 // handleGetRawMempool implements the getrawmempool command.
 func handleGetRawMempool(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	c := cmd.(*btcjson.GetRawMempoolCmd)
@@ -2737,6 +3443,14 @@ func handleGetTTL(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (int
 		return nil, rpcDecodeHexError(c.Txid)
 	}
 
+	// The time to live values are incomplete while the index is rebuilt.
+	if err := ttlIndex.Rebuilding(); err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: err.Error(),
+		}
+	}
+
 	op := wire.NewOutPoint(txHash, c.Vout)
 	ttlRes := ttlIndex.GetTTL(op)
 
@@ -2859,27 +3573,506 @@ func handleGetTxOut(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (i
 	return txOutReply, nil
 }
 
-// handleHelp implements the help command.
-func handleHelp(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
-	c := cmd.(*btcjson.HelpCmd)
+// handleGetUtreexoCapabilities implements the getutreexocapabilities command.
+func handleGetUtreexoCapabilities(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	var caps *indexers.Capabilities
+	var err error
+	switch {
+	case s.cfg.FlatUtreexoProofIndex != nil:
+		caps, err = s.cfg.FlatUtreexoProofIndex.Capabilities()
+	case s.cfg.UtreexoProofIndex != nil:
+		caps, err = s.cfg.UtreexoProofIndex.Capabilities()
+	default:
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "A utreexo proof index must be enabled. " +
+				"(--utreexoproofindex) or (--flatutreexoproofindex).",
+		}
+	}
+	if err != nil {
+		return nil, internalRPCError(err.Error(), "Failed to fetch utreexo capabilities")
+	}
+
+	return &btcjson.GetUtreexoCapabilitiesResult{
+		LowHeight:          caps.LowHeight,
+		HighHeight:         caps.HighHeight,
+		Formats:            caps.Formats.Strings(),
+		MultiBlockInterval: caps.MultiBlockInterval,
+		OnDemand:           caps.OnDemand,
+		MaxResponseSize:    caps.MaxResponseSize,
+		HashFunction:       caps.HashFunction.String(),
+	}, nil
+}
 
-	// Provide a usage overview of all commands when no specific command
-	// was specified.
-	var command string
-	if c.Command != nil {
-		command = *c.Command
+// handleGetUtreexoState implements the getutreexostate command.
+func handleGetUtreexoState(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	info, err := utreexoChainInfo(s)
+	if err != nil {
+		return nil, err
 	}
-	if command == "" {
-		usage, err := s.helpCacher.rpcUsage(false)
-		if err != nil {
-			context := "Failed to generate RPC usage"
-			return nil, internalRPCError(err.Error(), context)
+	if info == nil {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "A utreexo proof index must be enabled " +
+				"(--utreexoproofindex) or (--flatutreexoproofindex), " +
+				"or the node must be a utreexo node.",
 		}
-		return usage, nil
 	}
 
-	// Check that the command asked for is supported and implemented.  Only
-	// search the main list of handlers since help should not be provided
+	return info, nil
+}
+
+// shedHistorical returns an error for the given historical utreexo RPC while
+// the node is in its initial block download so that it doesn't compete with
+// the sync.
+func (s *rpcServer) shedHistorical(method string) error {
+	err := s.cfg.SyncShedder.Shed(method)
+	if err == nil {
+		return nil
+	}
+
+	return &btcjson.RPCError{
+		Code:    btcjson.ErrRPCClientInInitialDownload,
+		Message: err.Error(),
+	}
+}
+
+// handleGetUtreexoCoinAgeStats implements the getutreexocoinagestats command.
+func handleGetUtreexoCoinAgeStats(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+	if s.cfg.FlatUtreexoProofIndex.LeafTTLDisabled() {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index is built without the leaf TTL data (--flatutreexonoleafttl)",
+		}
+	}
+	if err := s.shedHistorical("getutreexocoinagestats"); err != nil {
+		return nil, err
+	}
+
+	c := cmd.(*btcjson.GetUtreexoCoinAgeStatsCmd)
+	stats, err := s.cfg.FlatUtreexoProofIndex.FetchCoinAgeStats(
+		c.StartHeight, c.EndHeight)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCOutOfRange,
+			Message: err.Error(),
+		}
+	}
+
+	// The coin blocks destroyed are summed up as BTC since the
+	// satoshi-blocks of a long range may not fit in 64 bits.
+	blocksPerDay := float64(24*time.Hour) /
+		float64(s.cfg.ChainParams.TargetTimePerBlock)
+	result := &btcjson.GetUtreexoCoinAgeStatsResult{
+		StartHeight: c.StartHeight,
+		EndHeight:   c.EndHeight,
+	}
+	var value, coinbaseValue btcutil.Amount
+	for _, blockStats := range stats {
+		coinBlocks := float64(blockStats.SatBlocksDestroyed) / btcutil.SatoshiPerBitcoin
+		result.Inputs += blockStats.Inputs
+		result.CoinbaseInputs += blockStats.CoinbaseInputs
+		result.CoinBlocksDestroyed += coinBlocks
+		value += btcutil.Amount(blockStats.Value)
+		coinbaseValue += btcutil.Amount(blockStats.CoinbaseValue)
+
+		if c.Verbose != nil && *c.Verbose {
+			result.Blocks = append(result.Blocks, btcjson.UtreexoCoinAgeBlockResult{
+				Height:             blockStats.Height,
+				Inputs:             blockStats.Inputs,
+				Value:              btcutil.Amount(blockStats.Value).ToBTC(),
+				CoinbaseInputs:     blockStats.CoinbaseInputs,
+				CoinbaseValue:      btcutil.Amount(blockStats.CoinbaseValue).ToBTC(),
+				SatBlocksDestroyed: blockStats.SatBlocksDestroyed,
+				CoinDaysDestroyed:  coinBlocks / blocksPerDay,
+			})
+		}
+	}
+	result.Value = value.ToBTC()
+	result.CoinbaseValue = coinbaseValue.ToBTC()
+	result.CoinDaysDestroyed = result.CoinBlocksDestroyed / blocksPerDay
+
+	return result, nil
+}
+
+// handleGetUtreexoProofCost implements the getutreexoproofcost command.
+func handleGetUtreexoProofCost(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+	if err := s.shedHistorical("getutreexoproofcost"); err != nil {
+		return nil, err
+	}
+
+	c := cmd.(*btcjson.GetUtreexoProofCostCmd)
+	costs, err := s.cfg.FlatUtreexoProofIndex.FetchProofCostByScriptType(
+		c.StartHeight, c.EndHeight)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCOutOfRange,
+			Message: err.Error(),
+		}
+	}
+
+	result := &btcjson.GetUtreexoProofCostResult{
+		StartHeight: c.StartHeight,
+		EndHeight:   c.EndHeight,
+		ScriptTypes: make([]btcjson.UtreexoProofCostResult, 0, len(costs)),
+	}
+	for i := range costs {
+		result.ScriptTypes = append(result.ScriptTypes, btcjson.UtreexoProofCostResult{
+			ScriptType:     costs[i].Class.String(),
+			Spends:         costs[i].Spends,
+			ProofHashes:    costs[i].ProofHashes(),
+			AvgProofHashes: costs[i].AvgProofHashes(),
+			LeafDataBytes:  costs[i].LeafDataBytes,
+			AvgAge:         costs[i].AvgAge(),
+		})
+	}
+	if c.CSV != nil && *c.CSV {
+		result.CSV, err = proofCostCSV(result.ScriptTypes)
+		if err != nil {
+			return nil, internalRPCError(err.Error(), "Failed to write the proof costs as CSV")
+		}
+	}
+
+	return result, nil
+}
+
+// proofCostCSV returns the proof costs of the script types as CSV with a header
+// line of the JSON names of the fields.
+func proofCostCSV(costs []btcjson.UtreexoProofCostResult) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	err := w.Write([]string{"scripttype", "spends", "proofhashes",
+		"avgproofhashes", "leafdatabytes", "avgage"})
+	if err != nil {
+		return "", err
+	}
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	for _, c := range costs {
+		err := w.Write([]string{
+			c.ScriptType,
+			strconv.FormatUint(c.Spends, 10),
+			formatFloat(c.ProofHashes),
+			formatFloat(c.AvgProofHashes),
+			strconv.FormatUint(c.LeafDataBytes, 10),
+			formatFloat(c.AvgAge),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+
+	return buf.String(), w.Error()
+}
+
+// leaseRPCErrorCodes maps the reasons a lease ends for to their RPC error codes.
+var leaseRPCErrorCodes = map[indexers.LeaseReason]btcjson.RPCErrorCode{
+	indexers.LeaseExpired: btcjson.ErrRPCLeaseExpired,
+	indexers.LeaseShed:    btcjson.ErrRPCLeaseShed,
+	indexers.LeaseReorged: btcjson.ErrRPCLeaseReorged,
+}
+
+// leaseRPCError returns the RPC error for the state pinned by a client whose
+// lease ended.  The code tells the reason and the message the height to resume
+// from.
+func leaseRPCError(leaseErr *indexers.LeaseError) *btcjson.RPCError {
+	var message string
+	switch leaseErr.Reason {
+	case indexers.LeaseExpired:
+		message = "The %v expired. Recreate it from height %d"
+	case indexers.LeaseShed:
+		message = "The %v was dropped to free memory. Back off and " +
+			"recreate it from height %d"
+	default:
+		message = "The %v was invalidated by a reorg. Restart from " +
+			"height %d"
+	}
+
+	return &btcjson.RPCError{
+		Code:    leaseRPCErrorCodes[leaseErr.Reason],
+		Message: fmt.Sprintf(message, leaseErr.Kind, leaseErr.ResumeHeight),
+	}
+}
+
+// handleGetUtreexoProof implements the getutreexoproof command.
+func handleGetUtreexoProof(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetUtreexoProofCmd)
+
+	var proveUtxoAt func(wire.OutPoint, *chainhash.Hash) (*wire.UData, error)
+	switch {
+	case s.cfg.UtreexoProofIndex != nil:
+		proveUtxoAt = s.cfg.UtreexoProofIndex.ProveUtxoAt
+	case s.cfg.FlatUtreexoProofIndex != nil:
+		proveUtxoAt = s.cfg.FlatUtreexoProofIndex.ProveUtxoAt
+	default:
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "A utreexo proof index must be enabled. " +
+				"(--utreexoproofindex) or (--flatutreexoproofindex).",
+		}
+	}
+
+	txHash, err := chainhash.NewHashFromStr(c.Txid)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.Txid)
+	}
+	blockHash, err := chainhash.NewHashFromStr(c.BlockHash)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.BlockHash)
+	}
+	if !s.cfg.Chain.MainChainHasBlock(blockHash) {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCBlockNotFound,
+			Message: "Block not found in the main chain",
+		}
+	}
+	height, err := s.cfg.Chain.BlockHeightByHash(blockHash)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCBlockNotFound,
+			Message: "Block not found in the main chain",
+		}
+	}
+
+	// Proving at a block below the tip rolls the accumulator back to it.
+	if *blockHash != s.cfg.Chain.BestSnapshot().Hash {
+		if err := s.shedHistorical("getutreexoproof"); err != nil {
+			return nil, err
+		}
+	}
+
+	ud, err := proveUtxoAt(*wire.NewOutPoint(txHash, c.Vout), blockHash)
+	if err != nil {
+		var notInErr *indexers.UtxoNotInAccumulatorError
+		if errors.As(err, &notInErr) {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCNoTxInfo,
+				Message: notInErr.Error(),
+			}
+		}
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: err.Error(),
+		}
+	}
+
+	var buf bytes.Buffer
+	err = ud.Serialize(&buf)
+	if err != nil {
+		return nil, internalRPCError(err.Error(),
+			"Failed to serialize the utreexo proof")
+	}
+	udHex := hex.EncodeToString(buf.Bytes())
+	if c.Verbose == nil || !*c.Verbose {
+		return udHex, nil
+	}
+
+	return &btcjson.GetUtreexoProofVerboseResult{
+		BlockHash: blockHash.String(),
+		Height:    height,
+		Hex:       udHex,
+		UData:     btcjson.NewUDataJSON(ud),
+	}, nil
+}
+
+// handleGetUtreexoProofs implements the getutreexoproofs command.
+func handleGetUtreexoProofs(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.GetUtreexoProofsCmd)
+
+	// Only the proof of the tip is served while the node is syncing.
+	if c.Cursor != nil || c.StartHeight < s.cfg.Chain.BestSnapshot().Height {
+		if err := s.shedHistorical("getutreexoproofs"); err != nil {
+			return nil, err
+		}
+	}
+
+	count := int32(100)
+	if c.Count != nil {
+		count = *c.Count
+	}
+	if count <= 0 || count > maxUtreexoProofsPerRequest {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCInvalidParameter,
+			Message: fmt.Sprintf("Count must be between 1 and %d",
+				maxUtreexoProofsPerRequest),
+		}
+	}
+
+	var newCursor func(int32) (*indexers.Cursor, error)
+	var forEachProof func(*indexers.Cursor, int32,
+		func(int32, *chainhash.Hash, *wire.UData) error) (*indexers.Cursor, error)
+	switch {
+	case s.cfg.FlatUtreexoProofIndex != nil:
+		newCursor = s.cfg.FlatUtreexoProofIndex.NewCursor
+		forEachProof = s.cfg.FlatUtreexoProofIndex.ForEachProof
+	case s.cfg.UtreexoProofIndex != nil:
+		newCursor = s.cfg.UtreexoProofIndex.NewCursor
+		forEachProof = s.cfg.UtreexoProofIndex.ForEachProof
+	default:
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "A utreexo proof index must be enabled. " +
+				"(--utreexoproofindex) or (--flatutreexoproofindex).",
+		}
+	}
+
+	// Receipts are only signed when asked for so that bulk fetches don't
+	// pay for the signatures.
+	wantReceipt := c.Receipt != nil && *c.Receipt
+	var requestID indexers.ReceiptRequestID
+	if wantReceipt {
+		if s.cfg.ProofReceipts == nil {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCMisc,
+				Message: "Proof receipts must be enabled (--proofreceipts)",
+			}
+		}
+		var err error
+		requestID, err = indexers.NewReceiptRequestID()
+		if err != nil {
+			return nil, internalRPCError(err.Error(),
+				"Failed to create a receipt request id")
+		}
+	}
+
+	var cursor *indexers.Cursor
+	var err error
+	if c.Cursor != nil {
+		serialized, err := hex.DecodeString(*c.Cursor)
+		if err != nil {
+			return nil, rpcDecodeHexError(*c.Cursor)
+		}
+		cursor, err = indexers.DeserializeCursor(serialized)
+		if err != nil {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCInvalidParameter,
+				Message: "Invalid cursor: " + err.Error(),
+			}
+		}
+	} else {
+		cursor, err = newCursor(c.StartHeight)
+		if err != nil {
+			return nil, &btcjson.RPCError{
+				Code:    btcjson.ErrRPCOutOfRange,
+				Message: err.Error(),
+			}
+		}
+	}
+
+	proofs := make([]btcjson.UtreexoProofResult, 0, count)
+	var receipts []*indexers.ProofReceipt
+	cursor, err = forEachProof(cursor, count,
+		func(height int32, hash *chainhash.Hash, ud *wire.UData) error {
+			var buf bytes.Buffer
+			err := ud.Serialize(&buf)
+			if err != nil {
+				return err
+			}
+			proof := btcjson.UtreexoProofResult{
+				Height: height,
+				Hash:   hash.String(),
+				Hex:    hex.EncodeToString(buf.Bytes()),
+			}
+			if c.Verbose != nil && *c.Verbose {
+				proof.UData = btcjson.NewUDataJSON(ud)
+			}
+			if wantReceipt {
+				receipt, err := s.cfg.ProofReceipts.Sign(requestID,
+					hash, buf.Bytes(), time.Now())
+				if err != nil {
+					return err
+				}
+				receipts = append(receipts, receipt)
+				proof.Receipt = newProofReceiptResult(receipt,
+					s.cfg.ProofReceipts.PubKey())
+			}
+			proofs = append(proofs, proof)
+			s.cfg.ServingLag.Served(hash)
+			return nil
+		})
+	if err != nil {
+		var leaseErr *indexers.LeaseError
+		if errors.As(err, &leaseErr) {
+			return nil, leaseRPCError(leaseErr)
+		}
+		var invalidErr *indexers.CursorInvalidatedError
+		if errors.As(err, &invalidErr) {
+			return nil, &btcjson.RPCError{
+				Code: btcjson.ErrRPCLeaseReorged,
+				Message: fmt.Sprintf("Cursor invalidated by a reorg "+
+					"or an index repair. Restart from height %d",
+					invalidErr.RestartHeight),
+			}
+		}
+		return nil, internalRPCError(err.Error(), "Failed to fetch utreexo proofs")
+	}
+
+	// The receipts are only handed out once their serves are in the audit
+	// log so that every receipt can be confirmed later.
+	if len(receipts) > 0 {
+		err := s.cfg.ProofReceipts.Record(receipts)
+		if err != nil {
+			return nil, internalRPCError(err.Error(),
+				"Failed to record the proof receipts")
+		}
+	}
+
+	return &btcjson.GetUtreexoProofsResult{
+		Proofs: proofs,
+		Cursor: hex.EncodeToString(cursor.Serialize()),
+	}, nil
+}
+
+// newProofReceiptResult returns the receipt of serving a utreexo proof that's
+// signed by the given public key as a JSON-RPC result.
+func newProofReceiptResult(receipt *indexers.ProofReceipt,
+	pubKey *btcec.PublicKey) *btcjson.ProofReceiptResult {
+
+	return &btcjson.ProofReceiptResult{
+		RequestID: receipt.RequestID.String(),
+		BlockHash: receipt.BlockHash.String(),
+		UDataHash: receipt.UDataHash.String(),
+		Timestamp: receipt.Timestamp.Unix(),
+		Signature: hex.EncodeToString(receipt.Signature),
+		PubKey:    hex.EncodeToString(pubKey.SerializeCompressed()),
+	}
+}
+
+// handleHelp implements the help command.
+func handleHelp(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	c := cmd.(*btcjson.HelpCmd)
+
+	// Provide a usage overview of all commands when no specific command
+	// was specified.
+	var command string
+	if c.Command != nil {
+		command = *c.Command
+	}
+	if command == "" {
+		usage, err := s.helpCacher.rpcUsage(false)
+		if err != nil {
+			context := "Failed to generate RPC usage"
+			return nil, internalRPCError(err.Error(), context)
+		}
+		return usage, nil
+	}
+
+	// Check that the command asked for is supported and implemented.  Only
+	// search the main list of handlers since help should not be provided
 	// for commands that are unimplemented or related to wallet
 	// functionality.
 	if _, ok := rpcHandlers[command]; !ok {
@@ -2898,6 +4091,36 @@ func handleHelp(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (inter
 	return help, nil
 }
 
+// handleListUtreexoPins implements the listutreexopins command.
+func handleListUtreexoPins(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+
+	pins, err := s.cfg.FlatUtreexoProofIndex.ListPins()
+	if err != nil {
+		return nil, internalRPCError(err.Error(), "Failed to list the pins")
+	}
+
+	result := &btcjson.ListUtreexoPinsResult{
+		Pins: make([]btcjson.UtreexoPinResult, 0, len(pins)),
+	}
+	for _, pin := range pins {
+		result.Pins = append(result.Pins, btcjson.UtreexoPinResult{
+			Height: pin.Height,
+			Label:  pin.Label,
+			Time:   pin.Time.Unix(),
+			Bytes:  pin.Bytes,
+		})
+		result.PinnedBytes += pin.Bytes
+	}
+
+	return result, nil
+}
+
 // handlePing implements the ping command.
 func handlePing(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	// Ask server to ping \o_
@@ -2911,6 +4134,145 @@ func handlePing(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (inter
 	return nil, nil
 }
 
+// handlePinUtreexoProof implements the pinutreexoproof command.
+func handlePinUtreexoProof(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+
+	c := cmd.(*btcjson.PinUtreexoProofCmd)
+	var label string
+	if c.Label != nil {
+		label = *c.Label
+	}
+	err := s.cfg.FlatUtreexoProofIndex.PinHeights(c.Heights, label)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCInvalidParameter,
+			Message: err.Error(),
+		}
+	}
+
+	return nil, nil
+}
+
+// proofBudgetRPCError converts errors from the utreexo proof generation budget
+// into RPC errors that tell the caller how to retry the request.  numItems is
+// the amount of items that were requested to be proven.  Other errors are
+// returned as is.
+func proofBudgetRPCError(err error, numItems int) error {
+	switch e := err.(type) {
+	case *indexers.ProofSizeError:
+		// Hint at how many items would fit in a single call.
+		perItem := e.Size / uint64(numItems)
+		maxItems := uint64(1)
+		if perItem > 0 && e.MaxSize/perItem > 1 {
+			maxItems = e.MaxSize / perItem
+		}
+		return &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: fmt.Sprintf("%v. Request at most %d items per call",
+				e, maxItems),
+		}
+
+	case *indexers.ProofDeferredError:
+		return &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: e.Error(),
+		}
+	}
+
+	return err
+}
+
+// handleEstimateProofSize implements the estimateproofsize command.
+func handleEstimateProofSize(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	// Before doing anything, check that one of the indexes are active.
+	if s.cfg.UtreexoProofIndex == nil && s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "A utreexo proof index must be enabled. " +
+				"(--utreexoproofindex) or (--flatutreexoproofindex).",
+		}
+	}
+	c := cmd.(*btcjson.EstimateProofSizeCmd)
+
+	if len(c.Txids) != len(c.Vouts) {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: fmt.Sprintf("Must give same number of txids as vouts. "+
+				"Given %d txids but %d vouts", len(c.Txids), len(c.Vouts)),
+		}
+	}
+	if len(c.Txids) > maxProofEstimateOutpoints {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCInvalidParameter,
+			Message: fmt.Sprintf("Given %d outpoints but at most %d "+
+				"can be estimated at once", len(c.Txids),
+				maxProofEstimateOutpoints),
+		}
+	}
+
+	// Fetch the utxos of the outpoints.  The ones that aren't in the utxo
+	// set are reported instead of failing the estimate.
+	outpoints := make([]wire.OutPoint, len(c.Txids))
+	utxos := make([]*blockchain.UtxoEntry, len(c.Txids))
+	outpointResults := make([]btcjson.ProofSizeOutpointResult, len(c.Txids))
+	for i, txid := range c.Txids {
+		txHash, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return nil, rpcDecodeHexError(txid)
+		}
+		outpoints[i] = *wire.NewOutPoint(txHash, c.Vouts[i])
+		outpointResults[i].Index = i
+
+		utxo, err := s.cfg.Chain.FetchUtxoEntry(outpoints[i])
+		if err != nil || utxo == nil || utxo.IsSpent() {
+			outpointResults[i].Reason = utxoUnavailableReason(s, outpoints[i])
+			continue
+		}
+		utxos[i] = utxo
+	}
+
+	var est *indexers.ProofEstimate
+	var err error
+	if s.cfg.UtreexoProofIndex != nil {
+		est, err = s.cfg.UtreexoProofIndex.EstimateUtxoProof(utxos, outpoints)
+	} else {
+		est, err = s.cfg.FlatUtreexoProofIndex.EstimateUtxoProof(utxos, outpoints)
+	}
+	if err != nil {
+		return nil, internalRPCError(err.Error(),
+			"Failed to estimate the utreexo proof")
+	}
+
+	for i, leaf := range est.Leaves {
+		if !leaf.Exists {
+			if utxos[i] != nil {
+				outpointResults[i].Reason = btcjson.UtxoProofPruned
+			}
+			continue
+		}
+		outpointResults[i].Exists = true
+		outpointResults[i].Position = leaf.Position
+		outpointResults[i].Depth = leaf.Depth
+		outpointResults[i].MarginalHashes = leaf.MarginalHashes
+		outpointResults[i].MarginalBytes = leaf.MarginalBytes
+		outpointResults[i].MarginalHashOps = leaf.MarginalHashOps
+	}
+
+	return &btcjson.EstimateProofSizeResult{
+		NumLeaves:   est.NumLeaves,
+		ProofHashes: est.ProofHashes,
+		Bytes:       est.SerializedBytes,
+		HashOps:     est.HashOps,
+		Outpoints:   outpointResults,
+	}, nil
+}
+
 // handleProveUtxoChainTipInclusion implements the proveutxochaintipinclusion command.
 func handleProveUtxoChainTipInclusion(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (
 	interface{}, error) {
@@ -2945,54 +4307,51 @@ func handleProveUtxoChainTipInclusion(s *rpcServer, cmd interface{}, closeChan <
 		outpoints = append(outpoints, *op)
 	}
 
-	// Fetch the utxos that we'll need to prove the outpoints.
-	utxos := make([]*blockchain.UtxoEntry, 0, len(c.Txids))
-	for _, outpoint := range outpoints {
-		utxo, err := s.cfg.Chain.FetchUtxoEntry(outpoint)
-		if err != nil {
-			return nil, &btcjson.RPCError{
-				Code: btcjson.ErrRPCMisc,
-				Message: fmt.Sprintf("Requested UTXO with txid %s and vout %d "+
-					"does not exist in the UTXO set at chain tip height of %d",
-					outpoint.Hash.String(), outpoint.Index,
-					s.cfg.Chain.BestSnapshot().Height),
-			}
-		}
+	// Fetch the utxos that we'll need to prove the outpoints.  The ones that
+	// aren't in the utxo set are reported instead of being proven.
+	inputs := make([]btcjson.UtxoProofInputResult, len(outpoints))
+	utxos := make([]*blockchain.UtxoEntry, len(outpoints))
+	var provable []int
+	for i, outpoint := range outpoints {
+		inputs[i].Index = i
 
-		if utxo == nil || utxo.IsSpent() {
-			return nil, &btcjson.RPCError{
-				Code: btcjson.ErrRPCMisc,
-				Message: fmt.Sprintf("Requested UTXO with txid %s and vout %d "+
-					"does not exist in the UTXO set at chain tip height of %d",
-					outpoint.Hash.String(), outpoint.Index,
-					s.cfg.Chain.BestSnapshot().Height),
-			}
+		utxo, err := s.cfg.Chain.FetchUtxoEntry(outpoint)
+		if err != nil || utxo == nil || utxo.IsSpent() {
+			inputs[i].Reason = utxoUnavailableReason(s, outpoint)
+			continue
 		}
 
-		utxos = append(utxos, utxo)
+		utxos[i] = utxo
+		provable = append(provable, i)
 	}
 
-	// We already checked that at least one index is active.  Pick one and
-	// generate the inclusion proof.
-	var proof *blockchain.ChainTipProof
-	if s.cfg.UtreexoProofIndex != nil {
-		var err error
-		proof, err = s.cfg.UtreexoProofIndex.ProveUtxos(utxos, &outpoints)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		var err error
-		proof, err = s.cfg.FlatUtreexoProofIndex.ProveUtxos(utxos, &outpoints)
-		if err != nil {
-			return nil, err
-		}
+	proof, proven, err := proveUtxoIndexes(s, utxos, outpoints, provable)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range provable {
+		inputs[i].Reason = btcjson.UtxoProofPruned
+	}
+	for _, i := range proven {
+		inputs[i].Proven = true
+		inputs[i].Reason = ""
 	}
 
-	if *c.Verbosity == 0 {
+	allProven := len(proven) == len(outpoints)
+	if *c.Verbosity == 0 && allProven {
 		return proof.String(), nil
 	}
 
+	proveReply := &btcjson.ProveUtxoChainTipInclusionVerboseResult{
+		ProofHashes:  []string{},
+		ProofTargets: []uint64{},
+		HashesProven: []string{},
+		Inputs:       inputs,
+	}
+	if proof == nil {
+		return proveReply, nil
+	}
+
 	// Convert the hashes to string.
 	proofString := make([]string, 0, len(proof.AccProof.Proof))
 	for _, singleProof := range proof.AccProof.Proof {
@@ -3008,17 +4367,110 @@ func handleProveUtxoChainTipInclusion(s *rpcServer, cmd interface{}, closeChan <
 		hashesProvenString = append(hashesProvenString, chainHash.String())
 	}
 
-	proveReply := &btcjson.ProveUtxoChainTipInclusionVerboseResult{
-		ProvedAtHash: proof.ProvedAtHash.String(),
-		ProofHashes:  proofString,
-		ProofTargets: proof.AccProof.Targets,
-		HashesProven: hashesProvenString,
-		Hex:          proof.String(),
-	}
+	proveReply.ProvedAtHash = proof.ProvedAtHash.String()
+	proveReply.ProofHashes = proofString
+	proveReply.ProofTargets = proof.AccProof.Targets
+	proveReply.HashesProven = hashesProvenString
+	proveReply.Hex = proof.String()
 
 	return proveReply, nil
 }
 
+// proveUtxoIndexes proves the utxos at the given indexes with whichever utreexo
+// proof index is enabled.  When they can't be proven together, each one is
+// tried on its own and the proof only covers the ones that could be proven.
+// The indexes of the proven utxos are returned along with the proof, which is
+// nil if none of them were proven.
+func proveUtxoIndexes(s *rpcServer, utxos []*blockchain.UtxoEntry,
+	outpoints []wire.OutPoint, indexes []int) (*blockchain.ChainTipProof, []int, error) {
+
+	prove := func(indexes []int) (*blockchain.ChainTipProof, error) {
+		entries := make([]*blockchain.UtxoEntry, 0, len(indexes))
+		ops := make([]wire.OutPoint, 0, len(indexes))
+		for _, i := range indexes {
+			entries = append(entries, utxos[i])
+			ops = append(ops, outpoints[i])
+		}
+
+		// We already checked that at least one index is active.
+		if s.cfg.UtreexoProofIndex != nil {
+			return s.cfg.UtreexoProofIndex.ProveUtxos(entries, &ops)
+		}
+		return s.cfg.FlatUtreexoProofIndex.ProveUtxos(entries, &ops)
+	}
+
+	if len(indexes) == 0 {
+		return nil, nil, nil
+	}
+
+	proof, err := prove(indexes)
+	if err == nil {
+		return proof, indexes, nil
+	}
+	if errors.Is(err, indexers.ErrProofGenBudgetExceeded) {
+		return nil, nil, proofBudgetRPCError(err, len(indexes))
+	}
+
+	// Find out which ones can't be proven.
+	var proven []int
+	for _, i := range indexes {
+		_, err := prove([]int{i})
+		if errors.Is(err, indexers.ErrProofGenBudgetExceeded) {
+			return nil, nil, proofBudgetRPCError(err, 1)
+		}
+		if err != nil {
+			rpcsLog.Debugf("Couldn't prove utxo %v: %v", outpoints[i], err)
+			continue
+		}
+		proven = append(proven, i)
+	}
+	if len(proven) == 0 {
+		return nil, nil, nil
+	}
+
+	proof, err = prove(proven)
+	if err != nil {
+		if errors.Is(err, indexers.ErrProofGenBudgetExceeded) {
+			return nil, nil, proofBudgetRPCError(err, len(proven))
+		}
+		return nil, nil, internalRPCError(err.Error(),
+			"Failed to prove the utxos")
+	}
+
+	return proof, proven, nil
+}
+
+// utxoUnavailableReason returns why the outpoint isn't in the utxo set.  The
+// transaction index is needed to tell a spent utxo apart from one that was
+// never created so the reason is always unknown without it.
+func utxoUnavailableReason(s *rpcServer, outpoint wire.OutPoint) string {
+	if s.cfg.TxIndex == nil {
+		return btcjson.UtxoProofUnknown
+	}
+
+	blockRegion, err := s.cfg.TxIndex.TxBlockRegion(&outpoint.Hash)
+	if err != nil || blockRegion == nil {
+		return btcjson.UtxoProofUnknown
+	}
+
+	var txBytes []byte
+	err = s.cfg.DB.View(func(dbTx database.Tx) error {
+		var err error
+		txBytes, err = dbTx.FetchBlockRegion(blockRegion)
+		return err
+	})
+	if err != nil {
+		return btcjson.UtxoProofUnknown
+	}
+	var msgTx wire.MsgTx
+	err = msgTx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil || int(outpoint.Index) >= len(msgTx.TxOut) {
+		return btcjson.UtxoProofUnknown
+	}
+
+	return btcjson.UtxoProofSpent
+}
+
 // retrievedTx represents a transaction that was either loaded from the
 // transaction memory pool or from the database.  When a transaction is loaded
 // from the database, it is loaded with the raw serialized bytes while the
@@ -3730,6 +5182,24 @@ func handleSubmitBlock(s *rpcServer, cmd interface{}, closeChan <-chan struct{})
 	return nil, nil
 }
 
+// handleUnpinUtreexoProof implements the unpinutreexoproof command.
+func handleUnpinUtreexoProof(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+
+	c := cmd.(*btcjson.UnpinUtreexoProofCmd)
+	err := s.cfg.FlatUtreexoProofIndex.UnpinHeights(c.Heights)
+	if err != nil {
+		return nil, internalRPCError(err.Error(), "Failed to unpin the heights")
+	}
+
+	return nil, nil
+}
+
 // handleUptime implements the uptime command.
 func handleUptime(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	return time.Now().Unix() - s.cfg.StartupTime, nil
@@ -3834,6 +5304,58 @@ func handleVerifyChain(s *rpcServer, cmd interface{}, closeChan <-chan struct{})
 	return err == nil, nil
 }
 
+// handleVerifyProofReceipt implements the verifyproofreceipt command.
+func handleVerifyProofReceipt(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	if s.cfg.ProofReceipts == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Proof receipts must be enabled (--proofreceipts)",
+		}
+	}
+
+	c := cmd.(*btcjson.VerifyProofReceiptCmd)
+	requestID, err := indexers.ReceiptRequestIDFromStr(c.RequestID)
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCInvalidParameter,
+			Message: "Invalid request id: " + err.Error(),
+		}
+	}
+	blockHash, err := chainhash.NewHashFromStr(c.BlockHash)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.BlockHash)
+	}
+	udataHash, err := chainhash.NewHashFromStr(c.UDataHash)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.UDataHash)
+	}
+	signature, err := hex.DecodeString(c.Signature)
+	if err != nil {
+		return nil, rpcDecodeHexError(c.Signature)
+	}
+
+	status, err := s.cfg.ProofReceipts.Confirm(&indexers.ProofReceipt{
+		RequestID: requestID,
+		BlockHash: *blockHash,
+		UDataHash: *udataHash,
+		Timestamp: time.Unix(c.Timestamp, 0),
+		Signature: signature,
+	})
+	if err != nil {
+		return nil, internalRPCError(err.Error(),
+			"Failed to look up the proof receipt")
+	}
+
+	pubKey := s.cfg.ProofReceipts.PubKey()
+	return &btcjson.VerifyProofReceiptResult{
+		Status:         status.String(),
+		ValidSignature: status != indexers.ReceiptInvalidSignature,
+		Recorded: status == indexers.ReceiptConfirmed ||
+			status == indexers.ReceiptMismatch,
+		PubKey: hex.EncodeToString(pubKey.SerializeCompressed()),
+	}, nil
+}
+
 // handleVerifyMessage implements the verifymessage command.
 func handleVerifyMessage(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
 	c := cmd.(*btcjson.VerifyMessageCmd)
@@ -3912,6 +5434,133 @@ func handleVersion(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (in
 	return result, nil
 }
 
+// handleVerifyUndoBlocks implements the verifyundoblocks command.
+func handleVerifyUndoBlocks(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (
+	interface{}, error) {
+
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+
+	if err := s.shedHistorical("verifyundoblocks"); err != nil {
+		return nil, err
+	}
+
+	c := cmd.(*btcjson.VerifyUndoBlocksCmd)
+	endHeight := c.StartHeight
+	if c.EndHeight != nil {
+		endHeight = *c.EndHeight
+	}
+
+	err := s.cfg.FlatUtreexoProofIndex.VerifyUndoInvertsRange(c.StartHeight, endHeight)
+	if err != nil {
+		rpcsLog.Errorf("Undo block verification failed: %v", err)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// handleVerifyUtreexoIndexes implements the verifyutreexoindexes command.
+func handleVerifyUtreexoIndexes(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (
+	interface{}, error) {
+
+	if s.cfg.UtreexoProofIndex == nil || s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code: btcjson.ErrRPCMisc,
+			Message: "Both utreexo proof indexes must be enabled " +
+				"(--utreexoproofindex and --flatutreexoproofindex)",
+		}
+	}
+
+	if err := s.shedHistorical("verifyutreexoindexes"); err != nil {
+		return nil, err
+	}
+
+	c := cmd.(*btcjson.VerifyUtreexoIndexesCmd)
+	endHeight := s.cfg.Chain.BestSnapshot().Height
+	if c.EndHeight != nil {
+		endHeight = *c.EndHeight
+	}
+
+	err := indexers.VerifyUtreexoIndexes(s.cfg.Chain, s.cfg.UtreexoProofIndex,
+		s.cfg.FlatUtreexoProofIndex, c.StartHeight, endHeight)
+	var divergence *indexers.IndexDivergenceError
+	switch {
+	case err == nil:
+		return &btcjson.VerifyUtreexoIndexesResult{Agree: true}, nil
+
+	case !errors.As(err, &divergence):
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: err.Error(),
+		}
+	}
+
+	result := divergence.Result
+	return &btcjson.VerifyUtreexoIndexesResult{
+		Height:      result.Block.Height,
+		Hash:        result.Block.Hash.String(),
+		Differences: result.Differences(),
+	}, nil
+}
+
+// handleVerifyUtreexoProofs implements the verifyutreexoproofs command.
+func handleVerifyUtreexoProofs(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (
+	interface{}, error) {
+
+	if s.cfg.FlatUtreexoProofIndex == nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: "Flat utreexo proof index must be enabled (--flatutreexoproofindex)",
+		}
+	}
+
+	if err := s.shedHistorical("verifyutreexoproofs"); err != nil {
+		return nil, err
+	}
+
+	c := cmd.(*btcjson.VerifyUtreexoProofsCmd)
+	endHeight := c.StartHeight
+	if c.EndHeight != nil {
+		endHeight = *c.EndHeight
+	}
+
+	idx := s.cfg.FlatUtreexoProofIndex
+	var found []indexers.NonCanonicalProof
+	var err error
+	repair := c.Repair != nil && *c.Repair
+	if repair {
+		found, err = idx.RepairNonCanonicalProofs(c.StartHeight, endHeight)
+	} else {
+		found, err = idx.AuditCanonicalProofs(c.StartHeight, endHeight)
+	}
+	if err != nil {
+		return nil, &btcjson.RPCError{
+			Code:    btcjson.ErrRPCMisc,
+			Message: err.Error(),
+		}
+	}
+
+	result := &btcjson.VerifyUtreexoProofsResult{
+		NonCanonical: make([]btcjson.NonCanonicalUtreexoProofResult, 0, len(found)),
+		Repaired:     repair && len(found) > 0,
+	}
+	for _, proof := range found {
+		result.NonCanonical = append(result.NonCanonical,
+			btcjson.NonCanonicalUtreexoProofResult{
+				Height:         proof.Height,
+				Error:          proof.Err.Error(),
+				QuarantinePath: proof.QuarantinePath,
+			})
+	}
+
+	return result, nil
+}
+
 // handleVerifyUtxoChainTipInclusionProof implements the verifyutxochaintipinclusionproof command.
 func handleVerifyUtxoChainTipInclusionProof(s *rpcServer, cmd interface{}, closeChan <-chan struct{}) (
 	interface{}, error) {
@@ -3951,12 +5600,16 @@ func handleVerifyUtxoChainTipInclusionProof(s *rpcServer, cmd interface{}, close
 	// Any of these can verify the given proof.  We already checked that at least one is
 	// active so pick one and validate the proof.
 	if s.cfg.UtreexoProofIndex != nil {
-		err := s.cfg.UtreexoProofIndex.VerifyAccProof(proof.HashesProven, proof.AccProof)
+		err := s.cfg.UtreexoProofIndex.VerifyBatchProof(
+			indexers.NewAccHashes(proof.HashesProven),
+			indexers.NewBatchProof(proof.AccProof))
 		if err != nil {
 			return false, nil
 		}
 	} else if s.cfg.FlatUtreexoProofIndex != nil {
-		err := s.cfg.FlatUtreexoProofIndex.VerifyAccProof(proof.HashesProven, proof.AccProof)
+		err := s.cfg.FlatUtreexoProofIndex.VerifyBatchProof(
+			indexers.NewAccHashes(proof.HashesProven),
+			indexers.NewBatchProof(proof.AccProof))
 		if err != nil {
 			return false, nil
 		}
@@ -4821,6 +6474,40 @@ type rpcserverConfig struct {
 	UtreexoProofIndex     *indexers.UtreexoProofIndex
 	FlatUtreexoProofIndex *indexers.FlatUtreexoProofIndex
 
+	// ProofServingStats tallies the utreexo proofs served to peers.  It's
+	// nil if no utreexo proof index is enabled.
+	ProofServingStats *proofServingStats
+
+	// ProofWatchdog audits the utreexo proofs served by other bridges.
+	// It's nil if no bridges are audited.
+	ProofWatchdog *indexers.ProofWatchdog
+
+	// ProofSampler keeps the scores of the peers that send the utreexo
+	// proofs of the blocks.  It's nil unless the utreexo compact
+	// state is enabled.
+	ProofSampler *netsync.ProofSampler
+
+	// SyncShedder refuses the historical utreexo RPCs while the node is
+	// in its initial block download.
+	SyncShedder *indexers.SyncShedder
+
+	// ServingLag records when the utreexo proofs of the connected blocks
+	// became fetchable and were first served.  It's nil if they aren't
+	// recorded.
+	ServingLag *indexers.ServingLag
+
+	// IndexManager manages the optional indexes.  It's nil if none of them
+	// are enabled.
+	IndexManager *indexers.Manager
+
+	// ProofReceipts signs the receipts of the utreexo proofs served to the
+	// clients that ask for them.  It's nil if receipts aren't enabled.
+	ProofReceipts *indexers.ProofReceipts
+
+	// MemAccountant caps the memory of the utreexo data held by all the
+	// subsystems together.  It's nil if there's no cap.
+	MemAccountant *indexers.MemAccountant
+
 	// The fee estimator keeps track of how long transactions are left in
 	// the mempool before they are mined into blocks.
 	FeeEstimator *mempool.FeeEstimator
@@ -0,0 +1,620 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/utreexo/utreexod/blockchain"
+	"github.com/utreexo/utreexod/blockchain/indexers"
+	"github.com/utreexo/utreexod/btcjson"
+	"github.com/utreexo/utreexod/btcutil"
+	"github.com/utreexo/utreexod/chaincfg"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+	"github.com/utreexo/utreexod/database"
+	"github.com/utreexo/utreexod/txscript"
+	"github.com/utreexo/utreexod/wire"
+)
+
+// TestProofReceiptRPCs ensures that the receipts returned by getutreexoproofs
+// verify offline and are confirmed by verifyproofreceipt, and that tampered
+// receipts and receipts of serves that aren't in the audit log are denied.
+func TestProofReceiptRPCs(t *testing.T) {
+	// The loggers of the subsystems write to the log rotator, which isn't
+	// opened by the tests.
+	blockchain.DisableLog()
+	indexers.DisableLog()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	dir := t.TempDir()
+	db, err := database.Create("ffldb", filepath.Join(dir, "db"), params.Net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	idx, err := indexers.NewUtreexoProofIndex(db, dir, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexManager := indexers.NewManager(db, []indexers.Indexer{idx})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     indexManager,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := indexManager.Init(chain, nil); err != nil {
+		t.Fatal(err)
+	}
+	tip, _ := blockchain.AddBlock(chain, btcutil.NewBlock(params.GenesisBlock), nil)
+
+	s := &rpcServer{cfg: rpcserverConfig{
+		Chain:             chain,
+		ChainParams:       &params,
+		UtreexoProofIndex: idx,
+	}}
+	getProofs := btcjson.NewGetUtreexoProofsCmd(1, nil, nil, nil,
+		btcjson.Bool(true))
+
+	// Receipts can't be asked for unless they're enabled.
+	_, err = handleGetUtreexoProofs(s, getProofs, nil)
+	if err == nil {
+		t.Fatal("expected an error asking for receipts while disabled")
+	}
+
+	key, err := indexers.LoadAttestationKey(filepath.Join(dir,
+		attestationKeyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cfg.ProofReceipts = indexers.NewProofReceipts(db, key, 0)
+
+	res, err := handleGetUtreexoProofs(s, getProofs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofs := res.(*btcjson.GetUtreexoProofsResult).Proofs
+	if len(proofs) != 1 || proofs[0].Receipt == nil {
+		t.Fatalf("expected a proof with a receipt but got %+v", proofs)
+	}
+	receipt := proofs[0].Receipt
+	if receipt.BlockHash != tip.Hash().String() {
+		t.Fatalf("receipt for block %s, want %s", receipt.BlockHash,
+			tip.Hash())
+	}
+	serialized, err := hex.DecodeString(proofs[0].Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udataHash := indexers.ReceiptUDataHash(serialized)
+	if receipt.UDataHash != udataHash.String() {
+		t.Fatalf("receipt commits to proof %s, want %s",
+			receipt.UDataHash, udataHash)
+	}
+
+	// Without a receipt requested none is signed.
+	res, err = handleGetUtreexoProofs(s, btcjson.NewGetUtreexoProofsCmd(1,
+		nil, nil, nil, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.(*btcjson.GetUtreexoProofsResult).Proofs[0].Receipt != nil {
+		t.Fatal("a receipt was signed without being requested")
+	}
+
+	// The receipt verifies offline against the public key of the node.
+	signature, err := hex.DecodeString(receipt.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestID, err := indexers.ReceiptRequestIDFromStr(receipt.RequestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = indexers.VerifyReceipt(&indexers.ProofReceipt{
+		RequestID: requestID,
+		BlockHash: *tip.Hash(),
+		UDataHash: udataHash,
+		Timestamp: time.Unix(receipt.Timestamp, 0),
+		Signature: signature,
+	}, key.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A receipt that the node signed but never recorded isn't found.
+	unrecorded, err := s.cfg.ProofReceipts.Sign(requestID, tip.Hash(),
+		serialized, time.Unix(receipt.Timestamp, 0).Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cmd  *btcjson.VerifyProofReceiptCmd
+		want btcjson.VerifyProofReceiptResult
+	}{
+		{
+			name: "confirmed",
+			cmd: btcjson.NewVerifyProofReceiptCmd(receipt.RequestID,
+				receipt.BlockHash, receipt.UDataHash,
+				receipt.Timestamp, receipt.Signature),
+			want: btcjson.VerifyProofReceiptResult{
+				Status:         "confirmed",
+				ValidSignature: true,
+				Recorded:       true,
+			},
+		},
+		{
+			name: "tampered timestamp",
+			cmd: btcjson.NewVerifyProofReceiptCmd(receipt.RequestID,
+				receipt.BlockHash, receipt.UDataHash,
+				receipt.Timestamp+1, receipt.Signature),
+			want: btcjson.VerifyProofReceiptResult{
+				Status: "invalidsignature",
+			},
+		},
+		{
+			name: "not found",
+			cmd: btcjson.NewVerifyProofReceiptCmd(receipt.RequestID,
+				receipt.BlockHash, receipt.UDataHash,
+				unrecorded.Timestamp.Unix(),
+				hex.EncodeToString(unrecorded.Signature)),
+			want: btcjson.VerifyProofReceiptResult{
+				Status:         "notfound",
+				ValidSignature: true,
+			},
+		},
+	}
+	for _, test := range tests {
+		res, err := handleVerifyProofReceipt(s, test.cmd, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got := *res.(*btcjson.VerifyProofReceiptResult)
+		test.want.PubKey = receipt.PubKey
+		if got != test.want {
+			t.Fatalf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// testUtreexoChainInfo returns the utreexo section returned by
+// getblockchaininfo.
+func testUtreexoChainInfo(t *testing.T, s *rpcServer) *btcjson.UtreexoChainInfoResult {
+	t.Helper()
+
+	res, err := handleGetBlockChainInfo(s, &btcjson.GetBlockChainInfoCmd{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.(*btcjson.GetBlockChainInfoResult).Utreexo
+}
+
+// TestGetBlockChainInfoUtreexo ensures that getblockchaininfo summarizes the
+// utreexo accumulator and the utreexo proof indexes of a bridge and the utreexo
+// viewpoint of a utreexo node with every field of the layout present, that it
+// takes no longer on a longer chain, and that it's left out on a node that's
+// neither.
+func TestGetBlockChainInfoUtreexo(t *testing.T) {
+	blockchain.DisableLog()
+	indexers.DisableLog()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	dir := t.TempDir()
+	db, err := database.Create("ffldb", filepath.Join(dir, "db"), params.Net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dbIdx, err := indexers.NewUtreexoProofIndex(db, dir, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofGenInterval := int32(1)
+	flatIdx, err := indexers.NewFlatUtreexoProofIndex(dir, &params,
+		&proofGenInterval, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexManager := indexers.NewManager(db, []indexers.Indexer{dbIdx, flatIdx})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     indexManager,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := indexManager.Init(chain, nil); err != nil {
+		t.Fatal(err)
+	}
+	tip, spendables := blockchain.AddBlock(chain,
+		btcutil.NewBlock(params.GenesisBlock), nil)
+	for i := 0; i < 4; i++ {
+		tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+	}
+
+	// A node that's neither a bridge nor a utreexo node has no utreexo
+	// section.
+	s := &rpcServer{cfg: rpcserverConfig{
+		Chain:       chain,
+		ChainParams: &params,
+	}}
+	if info := testUtreexoChainInfo(t, s); info != nil {
+		t.Fatalf("got a utreexo section %+v without utreexo", info)
+	}
+	_, err = handleGetUtreexoState(s, &btcjson.GetUtreexoStateCmd{}, nil)
+	var rpcErr *btcjson.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != btcjson.ErrRPCMisc {
+		t.Fatalf("got error %v from getutreexostate without utreexo",
+			err)
+	}
+
+	s.cfg.UtreexoProofIndex = dbIdx
+	s.cfg.FlatUtreexoProofIndex = flatIdx
+	s.cfg.IndexManager = indexManager
+	info := testUtreexoChainInfo(t, s)
+	if info == nil || info.Version != btcjson.UtreexoChainInfoVersion ||
+		info.Mode != "bridge" || info.Height != 5 ||
+		info.NumLeaves == 0 || len(info.Roots) == 0 || info.Degraded {
+
+		t.Fatalf("unexpected utreexo section of a bridge %+v", info)
+	}
+
+	// The forest of a bridge keeps every hash of its trees: 2n-1 for each
+	// tree of n leaves.
+	if info.NumRoots != len(info.Roots) ||
+		info.NumHashes != 2*info.NumLeaves-uint64(info.NumRoots) {
+
+		t.Fatalf("got %d roots and %d hashes for %d leaves",
+			info.NumRoots, info.NumHashes, info.NumLeaves)
+	}
+	if len(info.Indexes) != 2 {
+		t.Fatalf("got %d indexes, want 2", len(info.Indexes))
+	}
+	for _, index := range info.Indexes {
+		if index.Height != 5 || index.DurableHeight != 5 ||
+			index.NumLeaves != info.NumLeaves ||
+			!reflect.DeepEqual(index.Roots, info.Roots) ||
+			index.NumRoots != info.NumRoots ||
+			index.NumHashes != info.NumHashes ||
+			index.Degraded || len(index.Servable) == 0 {
+
+			t.Fatalf("unexpected state of the %s %+v", index.Name,
+				index)
+		}
+	}
+	if len(info.Servable) != 1 || info.Servable[0].End != 5 {
+		t.Fatalf("got servable ranges %+v", info.Servable)
+	}
+
+	// Every field is present even when it's empty.
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"version":1`, `"mode":"bridge"`,
+		`"degraded":false`, `"cause":""`, `"durableheight":5`,
+		`"numroots":`, `"numhashes":`} {
+
+		if !strings.Contains(string(encoded), field) {
+			t.Fatalf("%s doesn't have %s", encoded, field)
+		}
+	}
+
+	// The summary reads no more on a longer chain.
+	bestOf := func() time.Duration {
+		best := time.Duration(math.MaxInt64)
+		for i := 0; i < 20; i++ {
+			start := time.Now()
+			testUtreexoChainInfo(t, s)
+			if took := time.Since(start); took < best {
+				best = took
+			}
+		}
+		return best
+	}
+	short := bestOf()
+	for i := 0; i < 195; i++ {
+		tip, spendables = blockchain.AddBlock(chain, tip, spendables)
+	}
+	long := bestOf()
+	if long > 5*short+time.Millisecond {
+		t.Fatalf("took %v at height %d and %v at height 5", long,
+			tip.Height(), short)
+	}
+	info = testUtreexoChainInfo(t, s)
+	if info.Height != tip.Height() || info.Servable[0].End != tip.Height() {
+		t.Fatalf("got height %d and servable ranges %+v at height %d",
+			info.Height, info.Servable, tip.Height())
+	}
+
+	// A utreexo node reports the same accumulator after syncing the chain
+	// with the proofs of the bridge.
+	csnDB, err := database.Create("ffldb", filepath.Join(dir, "csndb"),
+		params.Net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csnDB.Close()
+	csnChain, err := blockchain.New(&blockchain.Config{
+		DB:          csnDB,
+		ChainParams: &params,
+		TimeSource:  blockchain.NewMedianTime(),
+		SigCache:    txscript.NewSigCache(1000),
+		UtreexoView: blockchain.NewUtreexoViewpoint(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := int32(1); height <= tip.Height(); height++ {
+		block, err := chain.BlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proofs, err := indexManager.FetchProofAllIndexes(
+			&indexers.BlockID{Height: height, Hash: *block.Hash()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = csnChain.ProcessBlockWithUData(block,
+			proofs[dbIdx.Name()], blockchain.BFNone)
+		if err != nil {
+			t.Fatalf("block %d: %v", height, err)
+		}
+	}
+	csn := &rpcServer{cfg: rpcserverConfig{
+		Chain:       csnChain,
+		ChainParams: &params,
+	}}
+	csnInfo := testUtreexoChainInfo(t, csn)
+	if csnInfo == nil || csnInfo.Mode != "csn" ||
+		csnInfo.Height != info.Height ||
+		csnInfo.NumLeaves != info.NumLeaves ||
+		!reflect.DeepEqual(csnInfo.Roots, info.Roots) ||
+		csnInfo.Indexes == nil || csnInfo.Servable == nil {
+
+		t.Fatalf("got utreexo section %+v of a utreexo node, want the "+
+			"accumulator of the bridge %+v", csnInfo, info)
+	}
+
+	// The utreexo node keeps at most the hashes that the bridge keeps.
+	if csnInfo.NumRoots != info.NumRoots ||
+		csnInfo.NumHashes < uint64(csnInfo.NumRoots) ||
+		csnInfo.NumHashes > info.NumHashes {
+
+		t.Fatalf("got %d roots and %d hashes of a utreexo node, want "+
+			"%d roots and at most %d hashes", csnInfo.NumRoots,
+			csnInfo.NumHashes, info.NumRoots, info.NumHashes)
+	}
+
+	// getutreexostate returns the utreexo section of both.
+	for _, server := range []*rpcServer{s, csn} {
+		res, err := handleGetUtreexoState(server,
+			&btcjson.GetUtreexoStateCmd{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := testUtreexoChainInfo(t, server)
+		if !reflect.DeepEqual(res, want) {
+			t.Fatalf("got utreexo state %+v, want %+v", res, want)
+		}
+	}
+}
+
+// TestBridgeUtreexoInfoDegraded ensures that a degraded utreexo proof index is
+// reported along with the height that it still serves up to and that the
+// accumulator of the bridge is taken from an index that isn't degraded.
+func TestBridgeUtreexoInfoDegraded(t *testing.T) {
+	root := func(b byte) *chainhash.Hash { return &chainhash.Hash{b} }
+	tips := []indexers.AccumulatorTip{
+		{Name: "first", Height: 10, NumLeaves: 7, NumHashes: 11,
+			Roots: []*chainhash.Hash{root(1), root(2), root(3)}},
+		{Name: "second", Height: 12, NumLeaves: 8, NumHashes: 15,
+			Roots: []*chainhash.Hash{root(4)}},
+	}
+	health := []indexers.IndexHealth{
+		{
+			Name:          "first",
+			Degraded:      true,
+			Cause:         syscall.EROFS,
+			DurableHeight: 8,
+			Servable:      []indexers.HeightRange{{Start: 0, End: 8}},
+		},
+		{
+			Name:     "second",
+			Servable: []indexers.HeightRange{{Start: 0, End: 12}},
+		},
+	}
+
+	info := bridgeUtreexoInfo(tips, health,
+		[]indexers.HeightRange{{Start: 0, End: 12}})
+	if !info.Degraded || info.Height != 12 || info.NumLeaves != 8 ||
+		!reflect.DeepEqual(info.Roots, []string{root(4).String()}) ||
+		info.NumRoots != 1 || info.NumHashes != 15 {
+
+		t.Fatalf("unexpected utreexo section %+v", info)
+	}
+	first := info.Indexes[0]
+	if !first.Degraded || first.DurableHeight != 8 || first.Height != 10 ||
+		first.Cause != syscall.EROFS.Error() ||
+		!reflect.DeepEqual(first.Servable, []btcjson.HeightRangeResult{
+			{Start: 0, End: 8}}) {
+
+		t.Fatalf("unexpected state of the degraded index %+v", first)
+	}
+	if second := info.Indexes[1]; second.Degraded || second.Cause != "" ||
+		second.DurableHeight != 12 {
+
+		t.Fatalf("unexpected state of the healthy index %+v", second)
+	}
+
+	// The first index is taken once both of them are degraded.
+	health[1].Degraded = true
+	health[1].DurableHeight = 11
+	info = bridgeUtreexoInfo(tips, health, nil)
+	if info.Height != 10 || len(info.Roots) != 3 || info.NumRoots != 3 ||
+		info.NumHashes != 11 || info.Servable == nil {
+		t.Fatalf("unexpected utreexo section %+v", info)
+	}
+}
+
+// TestGetUtreexoProofRPC ensures that getutreexoproof returns the proof of a
+// single outpoint at a past block as hex or verbosely, and that an outpoint
+// that was already spent at the block is reported as such.
+func TestGetUtreexoProofRPC(t *testing.T) {
+	blockchain.DisableLog()
+	indexers.DisableLog()
+
+	params := chaincfg.RegressionNetParams
+	params.CoinbaseMaturity = 1
+
+	dir := t.TempDir()
+	db, err := database.Create("ffldb", filepath.Join(dir, "db"), params.Net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	idx, err := indexers.NewUtreexoProofIndex(db, dir, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexManager := indexers.NewManager(db, []indexers.Indexer{idx})
+	chain, err := blockchain.New(&blockchain.Config{
+		DB:               db,
+		ChainParams:      &params,
+		TimeSource:       blockchain.NewMedianTime(),
+		SigCache:         txscript.NewSigCache(1000),
+		UtxoCacheMaxSize: 10 * 1024 * 1024,
+		IndexManager:     indexManager,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := indexManager.Init(chain, nil); err != nil {
+		t.Fatal(err)
+	}
+	blocks := []*btcutil.Block{btcutil.NewBlock(params.GenesisBlock)}
+	var spendables []*blockchain.SpendableOut
+	for i := 0; i < 5; i++ {
+		var tip *btcutil.Block
+		tip, spendables = blockchain.AddBlock(chain, blocks[i], spendables)
+		blocks = append(blocks, tip)
+	}
+
+	s := &rpcServer{cfg: rpcserverConfig{
+		Chain:             chain,
+		ChainParams:       &params,
+		UtreexoProofIndex: idx,
+	}}
+	txid := blocks[3].Transactions()[0].Hash().String()
+	blockHash := blocks[3].Hash().String()
+
+	res, err := handleGetUtreexoProof(s, btcjson.NewGetUtreexoProofCmd(
+		txid, 0, blockHash, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udBytes, err := hex.DecodeString(res.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ud wire.UData
+	if err := ud.Deserialize(bytes.NewReader(udBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ud.LeafDatas) != 1 ||
+		ud.LeafDatas[0].OutPoint.Hash.String() != txid {
+
+		t.Fatalf("unexpected leaves %+v", ud.LeafDatas)
+	}
+
+	res, err = handleGetUtreexoProof(s, btcjson.NewGetUtreexoProofCmd(
+		txid, 0, blockHash, btcjson.Bool(true)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verbose := res.(*btcjson.GetUtreexoProofVerboseResult)
+	if verbose.BlockHash != blockHash || verbose.Height != 3 ||
+		verbose.Hex != hex.EncodeToString(udBytes) ||
+		len(verbose.UData.LeafDatas) != 1 ||
+		verbose.UData.LeafDatas[0].Txid != txid {
+
+		t.Fatalf("unexpected verbose result %+v", verbose)
+	}
+
+	// The coinbase of the second block was spent by the third one.
+	spentTxid := blocks[2].Transactions()[0].Hash().String()
+	_, err = handleGetUtreexoProof(s, btcjson.NewGetUtreexoProofCmd(
+		spentTxid, 0, blockHash, nil), nil)
+	rpcErr, ok := err.(*btcjson.RPCError)
+	if !ok || rpcErr.Code != btcjson.ErrRPCNoTxInfo ||
+		!strings.Contains(rpcErr.Message, "already spent") {
+
+		t.Fatalf("got error %v, want an already spent error", err)
+	}
+
+	_, err = handleGetUtreexoProof(s, btcjson.NewGetUtreexoProofCmd(
+		txid, 0, (&chainhash.Hash{0x01}).String(), nil), nil)
+	rpcErr, ok = err.(*btcjson.RPCError)
+	if !ok || rpcErr.Code != btcjson.ErrRPCBlockNotFound {
+		t.Fatalf("got error %v, want a block not found error", err)
+	}
+}
+
+// TestProofCostCSV ensures that the proof costs of the getutreexoproofcost
+// command are written as CSV with a header line in the order of the fields.
+func TestProofCostCSV(t *testing.T) {
+	got, err := proofCostCSV([]btcjson.UtreexoProofCostResult{
+		{
+			ScriptType:     "witness_v0_scripthash",
+			Spends:         3,
+			ProofHashes:    4.5,
+			AvgProofHashes: 1.5,
+			LeafDataBytes:  120,
+			AvgAge:         2,
+		},
+		{
+			ScriptType:    "multisig",
+			Spends:        1,
+			LeafDataBytes: 80,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "scripttype,spends,proofhashes,avgproofhashes,leafdatabytes,avgage\n" +
+		"witness_v0_scripthash,3,4.5,1.5,120,2\n" +
+		"multisig,1,0,0,80,0\n"
+	if got != want {
+		t.Fatalf("got CSV\n%s\nwant\n%s", got, want)
+	}
+}
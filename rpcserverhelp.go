@@ -44,6 +44,19 @@ var helpDescsEnUS = map[string]string{
 	"transactioninput-txid": "The hash of the input transaction",
 	"transactioninput-vout": "The specific output of the input transaction to redeem",
 
+	// CompareProofCmd help.
+	"compareproof--synopsis": "Verifies a utreexo proof produced by another implementation for a block against the roots before the block and compares it with the proof of the flat utreexo proof index once both are canonicalized.",
+	"compareproof-block":     "The height or the hash of the main chain block",
+	"compareproof-proof":     "The serialized utreexo proof as a hex string with its leaf datas in the full or the compact form",
+
+	// CompareProofResult help.
+	"compareproofresult-height":      "The height of the block",
+	"compareproofresult-hash":        "The hash of the block",
+	"compareproofresult-verdict":     "How the proof compares to the local one (identical, equivalent, differenttargets, or invalid)",
+	"compareproofresult-redundant":   "The parts of an equivalent proof that differ from the local one without changing what's proven",
+	"compareproofresult-differences": "The differences between the canonical forms of the local proof and a proof that verifies but proves other targets",
+	"compareproofresult-error":       "Why an invalid proof didn't verify",
+
 	// CreateRawTransactionCmd help.
 	"createrawtransaction--synopsis": "Returns a new transaction spending the provided inputs and sending to the provided addresses.\n" +
 		"The transaction inputs are not signed in the created transaction.\n" +
@@ -185,6 +198,31 @@ var helpDescsEnUS = map[string]string{
 	"getblockchaininforesult-initialblockdownload": "Estimate of whether this node is in Initial Block Download mode",
 	"getblockchaininforesult-softforks":            "The status of the super-majority soft-forks",
 	"getblockchaininforesult-unifiedsoftforks":     "The status of the super-majority soft-forks used by bitcoind on or after v0.19.0",
+	"getblockchaininforesult-utreexo":              "The state of the utreexo accumulator and of the utreexo proof indexes (only on bridges and utreexo nodes)",
+
+	// UtreexoChainInfoResult help.
+	"utreexochaininforesult-version":   "The version of the layout of this object.  It changes whenever a field is renamed, removed, or changes its meaning",
+	"utreexochaininforesult-mode":      "Whether the node is a bridge that serves the utreexo proofs from its indexes (bridge) or a utreexo node that keeps only the accumulator (csn)",
+	"utreexochaininforesult-height":    "The block height that the accumulator is at",
+	"utreexochaininforesult-numleaves": "The number of leaves that were ever added to the accumulator",
+	"utreexochaininforesult-roots":     "The hex-encoded roots of the accumulator",
+	"utreexochaininforesult-indexes":   "The state of each of the enabled utreexo proof indexes",
+	"utreexochaininforesult-servable":  "The ranges of block heights that the utreexo proofs are served for by any of the indexes",
+	"utreexochaininforesult-degraded":  "Whether any of the indexes was degraded to read-only after a write failure",
+	"utreexochaininforesult-numroots":  "The number of roots of the accumulator",
+	"utreexochaininforesult-numhashes": "The number of hashes of the trees of the accumulator that are kept, including the roots.  A bridge keeps the whole trees and a utreexo node only the parts that prove the leaves it remembers",
+
+	// UtreexoIndexStateResult help.
+	"utreexoindexstateresult-name":          "The name of the index",
+	"utreexoindexstateresult-height":        "The height of the tip of the index",
+	"utreexoindexstateresult-numleaves":     "The number of leaves that were ever added to the accumulator of the index",
+	"utreexoindexstateresult-roots":         "The hex-encoded roots of the accumulator of the index",
+	"utreexoindexstateresult-degraded":      "Whether the index was degraded to read-only after a write failure that won't go away without a restart",
+	"utreexoindexstateresult-durableheight": "The height that a degraded index still serves up to, or the height of its tip if it isn't degraded",
+	"utreexoindexstateresult-cause":         "The write failure that degraded the index.  It's empty if the index isn't degraded",
+	"utreexoindexstateresult-servable":      "The ranges of block heights that the index serves the utreexo proofs for",
+	"utreexoindexstateresult-numroots":      "The number of roots of the accumulator of the index",
+	"utreexoindexstateresult-numhashes":     "The number of hashes of the trees of the accumulator of the index, including the roots",
 
 	// SoftForkDescription help.
 	"softforkdescription-reject":  "The current activation status of the softfork",
@@ -288,16 +326,17 @@ var helpDescsEnUS = map[string]string{
 	"getblockheaderverboseresult-nextblockhash":     "The hash of the next block (only if there is one)",
 
 	// TemplateRequest help.
-	"templaterequest-mode":         "This is 'template', 'proposal', or omitted",
-	"templaterequest-capabilities": "List of capabilities",
-	"templaterequest-longpollid":   "The long poll ID of a job to monitor for expiration; required and valid only for long poll requests ",
-	"templaterequest-sigoplimit":   "Number of signature operations allowed in blocks (this parameter is ignored)",
-	"templaterequest-sizelimit":    "Number of bytes allowed in blocks (this parameter is ignored)",
-	"templaterequest-maxversion":   "Highest supported block version number (this parameter is ignored)",
-	"templaterequest-target":       "The desired target for the block template (this parameter is ignored)",
-	"templaterequest-data":         "Hex-encoded block data (only for mode=proposal)",
-	"templaterequest-workid":       "The server provided workid if provided in block template (not applicable)",
-	"templaterequest-rules":        "Specific block rules that are to be enforced e.g. '[\"segwit\"]",
+	"templaterequest-mode":            "This is 'template', 'proposal', or omitted",
+	"templaterequest-capabilities":    "List of capabilities",
+	"templaterequest-longpollid":      "The long poll ID of a job to monitor for expiration; required and valid only for long poll requests ",
+	"templaterequest-sigoplimit":      "Number of signature operations allowed in blocks (this parameter is ignored)",
+	"templaterequest-sizelimit":       "Number of bytes allowed in blocks (this parameter is ignored)",
+	"templaterequest-maxversion":      "Highest supported block version number (this parameter is ignored)",
+	"templaterequest-target":          "The desired target for the block template (this parameter is ignored)",
+	"templaterequest-data":            "Hex-encoded block data (only for mode=proposal)",
+	"templaterequest-workid":          "The server provided workid if provided in block template (not applicable)",
+	"templaterequest-rules":           "Specific block rules that are to be enforced e.g. '[\"segwit\"]",
+	"templaterequest-utreexodeadline": "Milliseconds the utreexo preview of the proposal may take (only for mode=proposal; no preview if omitted)",
 
 	// GetBlockTemplateResultTx help.
 	"getblocktemplateresulttx-data":    "Hex-encoded transaction data (byte-for-byte)",
@@ -345,8 +384,18 @@ var helpDescsEnUS = map[string]string{
 	"getblocktemplate--condition0": "mode=template",
 	"getblocktemplate--condition1": "mode=proposal, rejected",
 	"getblocktemplate--condition2": "mode=proposal, accepted",
+	"getblocktemplate--condition3": "mode=proposal, utreexodeadline set",
 	"getblocktemplate--result1":    "An error string which represents why the proposal was rejected or nothing if accepted",
 
+	// GetBlockTemplateProposalResult help.
+	"getblocktemplateproposalresult-reject-reason": "Reason the proposal was rejected (omitted if accepted)",
+	"getblocktemplateproposalresult-utreexo":       "Preview of the proposal's utreexo proof (omitted if rejected or no utreexo proof index is enabled)",
+
+	// UtreexoPreviewResult help.
+	"utreexopreviewresult-complete": "Whether every check was performed; false if a check failed or the deadline passed before the proof was constructed",
+	"utreexopreviewresult-checks":   "The checks that were performed, in order ('inputs', 'leaves', 'targets', 'proof')",
+	"utreexopreviewresult-error":    "Why the last check failed (omitted if every performed check passed)",
+
 	// GetCFilterCmd help.
 	"getcfilter--synopsis":  "Returns a block's committed filter given its hash.",
 	"getcfilter-filtertype": "The type of filter to return (0=regular)",
@@ -415,6 +464,153 @@ var helpDescsEnUS = map[string]string{
 	"getheaders-hashstop":      "Block hash to stop including block headers for; if not found, all headers to the latest known block are returned.",
 	"getheaders--result0":      "Serialized block headers of all located blocks, limited to some arbitrary maximum number of hashes (currently 2000, which matches the wire protocol headers message, but this is not guaranteed)",
 
+	// GetIndexInfoCmd help.
+	"getindexinfo--synopsis": "Returns the bytes the utreexo proof indexes wrote to storage per byte of proof and undo data.\n" +
+		"The flat index is counted exactly. The database index only counts the keys and the values it puts into the database so its counts are approximate.\n" +
+		"Requires a utreexo proof index (--utreexoproofindex or --flatutreexoproofindex).",
+
+	// GetIndexInfoResult help.
+	"getindexinforesult-indexes":    "The write stats of each running utreexo proof index",
+	"getindexinforesult-comparison": "The comparison of the write amplification of the indexes. Only present when both of them are running",
+	"getindexinforesult-servinglag": "The lags from connecting the recently connected blocks to their utreexo proofs being generated, persisted, and first served. Only present with --servinglagblocks",
+	"getindexinforesult-udatamem":   "The memory of the utreexo data held by all the subsystems together. Only present with --udatamaxmem",
+	"getindexinforesult-sync":       "How far each index was caught up to the chain tip. Only present while the indexes are being caught up",
+
+	// IndexSyncResult help.
+	"indexsyncresult-name":     "The name of the index",
+	"indexsyncresult-height":   "The height that the index was caught up to",
+	"indexsyncresult-tip":      "The height of the chain tip that the index is being caught up to",
+	"indexsyncresult-progress": "The fraction of the chain that the index was caught up to",
+
+	// UDataMemResult help.
+	"udatamemresult-cap":        "The maximum bytes of utreexo data that may be held in total",
+	"udatamemresult-used":       "The bytes of utreexo data currently held in total",
+	"udatamemresult-peak":       "The most bytes of utreexo data held at once",
+	"udatamemresult-subsystems": "The memory of each subsystem holding utreexo data",
+	"udatamemresult-pressure":   "The state of the responder that shrinks the subsystems under memory pressure. Only present with --udatamempressure",
+
+	// UDataMemPressureResult help.
+	"udatamempressureresult-source":       "Where the memory pressure is read from",
+	"udatamempressureresult-pressure":     "The last sampled memory pressure from 0 to 100",
+	"udatamempressureresult-samples":      "The number of times the memory pressure was sampled",
+	"udatamempressureresult-sampleerrors": "The number of samples that failed to be read",
+	"udatamempressureresult-shrunk":       "Whether the subsystems that can be evicted from are currently shrunk",
+	"udatamempressureresult-limit":        "The bytes the shrunk subsystems are held to in total, 0 when they're not shrunk",
+	"udatamempressureresult-shrinks":      "The number of times the subsystems were shrunk",
+	"udatamempressureresult-restores":     "The number of times the subsystems were restored a step",
+	"udatamempressureresult-history":      "The last adjustments of the subsystems, the oldest first",
+
+	// UDataMemAdjustmentResult help.
+	"udatamemadjustmentresult-time":     "The time of the adjustment in seconds since 1 Jan 1970 GMT",
+	"udatamemadjustmentresult-pressure": "The memory pressure sampled right before the adjustment",
+	"udatamemadjustmentresult-shrink":   "Whether the subsystems were shrunk or restored",
+	"udatamemadjustmentresult-freed":    "The bytes evicted by a shrink",
+	"udatamemadjustmentresult-limit":    "The bytes the shrunk subsystems are held to after the adjustment, 0 once fully restored",
+
+	// UDataMemSubsystemResult help.
+	"udatamemsubsystemresult-name":         "The name of the subsystem",
+	"udatamemsubsystemresult-class":        "The eviction class of the subsystem (cache, prefetch, staging, or pinned)",
+	"udatamemsubsystemresult-quota":        "The soft quota in bytes of the subsystem, 0 if it has none",
+	"udatamemsubsystemresult-floor":        "The bytes the subsystem is never shrunk below under memory pressure",
+	"udatamemsubsystemresult-used":         "The bytes the subsystem currently holds",
+	"udatamemsubsystemresult-peak":         "The most bytes the subsystem held at once",
+	"udatamemsubsystemresult-evictions":    "The number of times the subsystem was evicted from",
+	"udatamemsubsystemresult-evictedbytes": "The total bytes evicted from the subsystem",
+	"udatamemsubsystemresult-rejected":     "The number of reservations of the subsystem that were refused",
+
+	// ServingLagResult help.
+	"servinglagresult-blocks":     "The number of recently connected blocks that the lags are recorded for",
+	"servinglagresult-generation": "The lags until the proofs were generated",
+	"servinglagresult-durability": "The lags until the proofs were persisted",
+	"servinglagresult-firstserve": "The lags until the proofs were first served to a peer or an RPC client",
+
+	// LagSummaryResult help.
+	"lagsummaryresult-count": "The number of blocks that reached the stage",
+	"lagsummaryresult-p50":   "The median lag in seconds",
+	"lagsummaryresult-p90":   "The 90th percentile of the lags in seconds",
+	"lagsummaryresult-p99":   "The 99th percentile of the lags in seconds",
+	"lagsummaryresult-max":   "The longest lag in seconds",
+
+	// IndexInfoResult help.
+	"indexinforesult-name":                "The name of the index",
+	"indexinforesult-shadow":              "Whether the index is run as the shadow of another index and never served. Only present when it is",
+	"indexinforesult-approximate":         "Whether the written bytes are an estimate",
+	"indexinforesult-lastheight":          "The height of the last connected block",
+	"indexinforesult-lastblock":           "The write stats of the last connected block",
+	"indexinforesult-total":               "The write stats of all the blocks connected since the index was started",
+	"indexinforesult-servable":            "The ranges of block heights that the index serves the utreexo proofs for",
+	"indexinforesult-fsyncpolicy":         "The policy that the index syncs what it writes to disk with",
+	"indexinforesult-recordedfsyncpolicy": "The fsync policy that the index was last run with before it was started. Only present if one was recorded",
+	"indexinforesult-reads":               "The reads from the flat files that didn't return everything right away. Only present for the flat index",
+	"indexinforesult-dbretries":           "The blocks that were connected again after a transient database error. Only present for the database index",
+	"indexinforesult-rowgrowth":           "How close the forest of the index is to gaining a row and how long the blocks that added the latest rows took to connect",
+	"indexinforesult-leafhashing":         "The counts of the leaves hashed on and off the template fast path by every index in the process",
+	"indexinforesult-maxleaves":           "The most leaves that the forest of the index can hold before the offsets into its storage overflow the ints of the platform",
+	"indexinforesult-leafheadroom":        "How many more leaves the forest of the index can take",
+	"indexinforesult-proofcache":          "The fetches of the utreexo proofs that were served from memory. Only present for the database index",
+
+	// IndexProofCacheResult help.
+	"indexproofcacheresult-size":      "The size in bytes of the cached utreexo proofs",
+	"indexproofcacheresult-maxsize":   "The most bytes of utreexo proofs that are cached (--utreexoproofcache)",
+	"indexproofcacheresult-entries":   "The number of cached utreexo proofs",
+	"indexproofcacheresult-hits":      "The number of fetched utreexo proofs that were cached",
+	"indexproofcacheresult-misses":    "The number of fetched utreexo proofs that were read from the database",
+	"indexproofcacheresult-hitrate":   "The share of the fetched utreexo proofs that were cached",
+	"indexproofcacheresult-evictions": "The number of cached utreexo proofs that were evicted to make room for others",
+
+	// IndexLeafHashResult help.
+	"indexleafhashresult-templates":        "The number of leaves hashed on the fast path by template",
+	"indexleafhashresult-templates--key":   "template",
+	"indexleafhashresult-templates--value": "The number of leaves of the template",
+	"indexleafhashresult-templates--desc":  "The number of leaves hashed on the fast path by the template of their public key script",
+	"indexleafhashresult-fallbacks":        "The number of leaves that didn't match a template and were hashed by serializing the whole leaf data",
+	"indexleafhashresult-hitrate":          "The share of the hashed leaves that were hashed on the fast path",
+	"indexleafhashresult-midstates":        "The number of kept hash states after the tagged prefix of a transaction",
+	"indexleafhashresult-maxmidstates":     "The most hash states that are kept",
+	"indexleafhashresult-midstatehitrate":  "The share of the tagged leaves hashed on the fast path that reused a kept hash state",
+
+	// IndexRowGrowthResult help.
+	"indexrowgrowthresult-rows":            "The number of rows of the forest",
+	"indexrowgrowthresult-numleaves":       "The number of leaves in the forest",
+	"indexrowgrowthresult-leavestonextrow": "The number of leaves that can be added before the forest gains a row",
+	"indexrowgrowthresult-blockstonextrow": "The estimated number of blocks until the forest gains a row. -1 if the forest isn't growing",
+	"indexrowgrowthresult-preallocated":    "The bytes of the storage of the next row that were preallocated so far. Only forests kept in a file are preallocated",
+	"indexrowgrowthresult-avgconnecttime":  "The moving average of how long connecting the blocks that didn't add a row took in seconds",
+	"indexrowgrowthresult-boundaries":      "The latest blocks that added a row to the forest, oldest first",
+
+	// IndexRowBoundaryResult help.
+	"indexrowboundaryresult-height":       "The height of the block",
+	"indexrowboundaryresult-rows":         "The number of rows the forest has since the block",
+	"indexrowboundaryresult-connecttime":  "How long connecting the block took in seconds",
+	"indexrowboundaryresult-preallocated": "The bytes of the storage of the row that were preallocated over the blocks before",
+
+	// HeightRangeResult help.
+	"heightrangeresult-start": "The first block height of the range",
+	"heightrangeresult-end":   "The last block height of the range",
+
+	// IndexWriteStatsResult help.
+	"indexwritestatsresult-blocks":        "The number of connected blocks",
+	"indexwritestatsresult-logicalbytes":  "The size of the serialized proofs and undo blocks",
+	"indexwritestatsresult-writtenbytes":  "The bytes written to storage to keep the proofs and the undo blocks",
+	"indexwritestatsresult-syncs":         "The number of times a file was synced to disk",
+	"indexwritestatsresult-amplification": "The bytes written to storage per byte of proof and undo data",
+
+	// IndexReadStatsResult help.
+	"indexreadstatsresult-shortreads":      "The number of reads that returned fewer bytes than the offsets say are stored",
+	"indexreadstatsresult-transienterrors": "The number of reads that failed with an error that may go away on a retry",
+	"indexreadstatsresult-retries":         "The number of times a read was retried",
+	"indexreadstatsresult-failed":          "The number of reads that were still short after all the retries",
+
+	// IndexDBRetryResult help.
+	"indexdbretryresult-retries":   "The number of times connecting a block was attempted again",
+	"indexdbretryresult-recovered": "The number of blocks that were connected after being attempted again",
+	"indexdbretryresult-exhausted": "The number of blocks that still failed to connect after every attempt",
+
+	// IndexWriteComparisonResult help.
+	"indexwritecomparisonresult-flatamplification": "The total write amplification of the flat index",
+	"indexwritecomparisonresult-dbamplification":   "The approximate total write amplification of the database index",
+	"indexwritecomparisonresult-dbtoflatratio":     "The write amplification of the database index divided by the one of the flat index",
+
 	// GetInfoCmd help.
 	"getinfo--synopsis": "Returns a JSON object containing various state info.",
 
@@ -505,6 +701,69 @@ var helpDescsEnUS = map[string]string{
 	// GetPeerInfoCmd help.
 	"getpeerinfo--synopsis": "Returns data about each connected network peer as an array of json objects.",
 
+	// GetProofServingStatsCmd help.
+	"getproofservingstats--synopsis": "Returns how often the utreexo proofs of each height band of blocks were served to peers and suggests a prune height.\n" +
+		"The suggestion is only advisory and nothing is pruned by it.\n" +
+		"Requires a utreexo proof index (--utreexoproofindex or --flatutreexoproofindex).",
+	"getproofservingstats-targetpercent": "The percentage of the decayed requests that should still be servable at the suggested prune height",
+	"getproofservingstats-windows":       "The windows in seconds to report the requests over. Defaults to an hour, a day, and a week",
+
+	// GetProofServingStatsResult help.
+	"getproofservingstatsresult-bandwidth":            "The width in blocks of the height bands",
+	"getproofservingstatsresult-halflife":             "How long in seconds it takes for the requests of a band to count half as much",
+	"getproofservingstatsresult-targetpercent":        "The percentage of the decayed requests that are still servable at the suggested prune height",
+	"getproofservingstatsresult-suggestedpruneheight": "The lowest height to keep so that the target percentage of the decayed requests is still servable. 0 if nothing was requested",
+	"getproofservingstatsresult-bands":                "The height bands that utreexo proofs were served for, ordered by height",
+
+	// ProofServingBandResult help.
+	"proofservingbandresult-startheight":     "The height of the first block of the band",
+	"proofservingbandresult-endheight":       "The height of the last block of the band",
+	"proofservingbandresult-decayedrequests": "The requests for the band with each request counting less the older it is",
+	"proofservingbandresult-windows":         "The requests for the band over each of the windows",
+
+	// ProofServingWindowResult help.
+	"proofservingwindowresult-window":      "The window in seconds",
+	"proofservingwindowresult-requests":    "The requests served over the window",
+	"proofservingwindowresult-bytes":       "The bytes of utreexo proofs served over the window",
+	"proofservingwindowresult-uniquepeers": "The distinct peers that were served over the window",
+
+	// GetProofSourceScoresCmd help.
+	"getproofsourcescores--synopsis": "Returns how reliable the utreexo proofs of the blocks have been for each peer that sent them.\n" +
+		"Requires --utreexo.",
+
+	// GetProofSourceScoresResult help.
+	"getproofsourcescoresresult-sources": "The scores of the sources",
+
+	// ProofSourceScoreResult help.
+	"proofsourcescoreresult-source":     "The name of the source",
+	"proofsourcescoreresult-score":      "Between 0 and 1, dropping with every proof of the source that failed verification",
+	"proofsourcescoreresult-samplerate": "The fraction of the proofs of the source checked before their blocks are validated",
+	"proofsourcescoreresult-staged":     "The proofs the source delivered",
+	"proofsourcescoreresult-sampled":    "The proofs of the source checked as soon as they were fetched",
+	"proofsourcescoreresult-failures":   "The proofs of the source that failed verification",
+	"proofsourcescoreresult-banned":     "Whether the proofs of the source are refused",
+
+	// GetProofWatchdogStatsCmd help.
+	"getproofwatchdogstats--synopsis": "Returns how the utreexo proofs served by the audited bridges compared with the ones of the local index.\n" +
+		"Requires a utreexo proof index and at least one --proofwatchdog bridge.",
+
+	// GetProofWatchdogStatsResult help.
+	"getproofwatchdogstatsresult-sources": "What was recorded for each of the audited bridges",
+
+	// ProofWatchdogSourceResult help.
+	"proofwatchdogsourceresult-name":           "The host of the bridge",
+	"proofwatchdogsourceresult-agreements":     "The proofs that were the same as the local ones",
+	"proofwatchdogsourceresult-divergences":    "The proofs that differed from the local ones",
+	"proofwatchdogsourceresult-failures":       "The requests that the bridge failed to serve",
+	"proofwatchdogsourceresult-skipped":        "The blocks that weren't compared because the bridge fell behind or had another block at the height",
+	"proofwatchdogsourceresult-available":      "Whether the last request to the bridge was served",
+	"proofwatchdogsourceresult-lastdivergence": "The last proof that differed from the local one. Omitted if there were none",
+
+	// ProofDivergenceResult help.
+	"proofdivergenceresult-height": "The height of the block the proof is for",
+	"proofdivergenceresult-hash":   "The hash of the block the proof is for",
+	"proofdivergenceresult-diff":   "Every difference between the local and the served proof",
+
 	// GetRawMempoolVerboseResult help.
 	"getrawmempoolverboseresult-size":             "Transaction size in bytes",
 	"getrawmempoolverboseresult-fee":              "Transaction fee in bitcoins",
@@ -553,6 +812,138 @@ var helpDescsEnUS = map[string]string{
 	"gettxout-vout":           "The index of the output",
 	"gettxout-includemempool": "Include the mempool when true",
 
+	// GetUtreexoCapabilitiesCmd help.
+	"getutreexocapabilities--synopsis": "Returns the utreexo proofs that are served by this node.\n" +
+		"Requires a utreexo proof index (--utreexoproofindex or --flatutreexoproofindex).",
+
+	// GetUtreexoCapabilitiesResult help.
+	"getutreexocapabilitiesresult-lowheight":          "The height of the first block that utreexo proofs are served for",
+	"getutreexocapabilitiesresult-highheight":         "The height of the last block that utreexo proofs are served for",
+	"getutreexocapabilitiesresult-formats":            "The utreexo proof formats that are served (blockproof, multiblockproof)",
+	"getutreexocapabilitiesresult-multiblockinterval": "The block interval of the multi-block proofs. Omitted if multi-block proofs aren't served",
+	"getutreexocapabilitiesresult-ondemand":           "Whether proofs for arbitrary utxos are generated on demand",
+	"getutreexocapabilitiesresult-maxresponsesize":    "The maximum size in bytes of a single response",
+	"getutreexocapabilitiesresult-hashfunction":       "The hash function used by the utreexo accumulator",
+
+	// GetUtreexoCoinAgeStatsCmd help.
+	"getutreexocoinagestats--synopsis": "Returns the coin age statistics of the outputs spent by the blocks in the given range, computed from the stored utreexo proofs.\n" +
+		"Only the spent outputs that the proofs have leaf datas for are counted. The input of a coinbase transaction spends nothing and outputs created and spent in the same block are never in the proofs, so neither is counted.\n" +
+		"Requires the flat utreexo proof index (--flatutreexoproofindex).",
+	"getutreexocoinagestats-startheight": "The height of the first block of the range",
+	"getutreexocoinagestats-endheight":   "The height of the last block of the range",
+	"getutreexocoinagestats-verbose":     "Include the statistics of every block in the range",
+
+	// GetUtreexoCoinAgeStatsResult help.
+	"getutreexocoinagestatsresult-startheight":         "The height of the first block of the range",
+	"getutreexocoinagestatsresult-endheight":           "The height of the last block of the range",
+	"getutreexocoinagestatsresult-inputs":              "The number of outputs spent by the blocks",
+	"getutreexocoinagestatsresult-value":               "The value of the spent outputs in BTC",
+	"getutreexocoinagestatsresult-coinbaseinputs":      "The number of the spent outputs that were created by a coinbase transaction",
+	"getutreexocoinagestatsresult-coinbasevalue":       "The value of the spent coinbase outputs in BTC",
+	"getutreexocoinagestatsresult-coinblocksdestroyed": "The sum of the value in BTC of every spent output times the number of blocks since it was created",
+	"getutreexocoinagestatsresult-coindaysdestroyed":   "The coin blocks destroyed in BTC-days at the target block time of the network",
+	"getutreexocoinagestatsresult-blocks":              "The statistics of every block in the range. Only included when verbose",
+
+	// UtreexoCoinAgeBlockResult help.
+	"utreexocoinageblockresult-height":             "The height of the block",
+	"utreexocoinageblockresult-inputs":             "The number of outputs spent by the block",
+	"utreexocoinageblockresult-value":              "The value of the spent outputs in BTC",
+	"utreexocoinageblockresult-coinbaseinputs":     "The number of the spent outputs that were created by a coinbase transaction",
+	"utreexocoinageblockresult-coinbasevalue":      "The value of the spent coinbase outputs in BTC",
+	"utreexocoinageblockresult-satblocksdestroyed": "The sum of the value in satoshis of every spent output times the number of blocks since it was created",
+	"utreexocoinageblockresult-coindaysdestroyed":  "The coin blocks destroyed in BTC-days at the target block time of the network",
+
+	// GetUtreexoProofCostCmd help.
+	"getutreexoproofcost--synopsis": "Returns how much of the utreexo proofs of the blocks in the given range is attributed to the spent outputs of every script type, computed from the stored utreexo proofs.\n" +
+		"Every proof hash is split evenly between the spent outputs in the subtree that it's the sibling of.\n" +
+		"Requires the flat utreexo proof index (--flatutreexoproofindex) with a proof generation interval of 1.",
+	"getutreexoproofcost-startheight": "The height of the first block of the range",
+	"getutreexoproofcost-endheight":   "The height of the last block of the range",
+	"getutreexoproofcost-csv":         "Also return the proof costs as CSV",
+
+	// GetUtreexoProofCostResult help.
+	"getutreexoproofcostresult-startheight": "The height of the first block of the range",
+	"getutreexoproofcostresult-endheight":   "The height of the last block of the range",
+	"getutreexoproofcostresult-scripttypes": "The proof costs of every script type that the blocks spent outputs of",
+	"getutreexoproofcostresult-csv":         "The proof costs as CSV with a header line. Only included when asked for",
+
+	// UtreexoProofCostResult help.
+	"utreexoproofcostresult-scripttype":     "The script type of the spent outputs (e.g. 'witness_v0_scripthash')",
+	"utreexoproofcostresult-spends":         "The number of spent outputs of the script type",
+	"utreexoproofcostresult-proofhashes":    "The number of proof hashes attributed to the spent outputs",
+	"utreexoproofcostresult-avgproofhashes": "The average number of proof hashes attributed to a spent output",
+	"utreexoproofcostresult-leafdatabytes":  "The size in bytes of the compact leaf datas of the spent outputs",
+	"utreexoproofcostresult-avgage":         "The average number of blocks between a spent output being created and spent",
+
+	// GetUtreexoProofCmd help.
+	"getutreexoproof--synopsis": "Returns the utreexo proof that an output is in the accumulator right after the given block was connected.\n" +
+		"The block may be at most 1000 blocks behind the tip. Requires --utreexoproofindex or --flatutreexoproofindex.",
+	"getutreexoproof-txid":        "The hash of the transaction that created the output",
+	"getutreexoproof-vout":        "The index of the output in the transaction",
+	"getutreexoproof-blockhash":   "The hash of the main chain block to prove the output at",
+	"getutreexoproof-verbose":     "Also return the proof decoded as JSON",
+	"getutreexoproof--condition0": "verbose=false",
+	"getutreexoproof--condition1": "verbose=true",
+	"getutreexoproof--result0":    "The hex-encoded serialized utreexo data that proves the output",
+
+	// GetUtreexoProofVerboseResult help.
+	"getutreexoproofverboseresult-blockhash": "The hash of the block that the output is proven at",
+	"getutreexoproofverboseresult-height":    "The height of the block that the output is proven at",
+	"getutreexoproofverboseresult-hex":       "The hex-encoded serialized utreexo data that proves the output",
+	"getutreexoproofverboseresult-udata":     "The utreexo data that proves the output decoded as JSON",
+
+	// GetUtreexoProofsCmd help.
+	"getutreexoproofs--synopsis": "Returns the utreexo proofs of consecutive blocks starting at the given height or at the cursor.\n" +
+		"The returned cursor may be persisted and passed back in to resume the scan, including after a restart.\n" +
+		"A cursor that went unused for too long fails with code -40, one dropped to free memory with -41 and one invalidated by a reorg with -42. The message has the height to restart from.\n" +
+		"Requires a utreexo proof index (--utreexoproofindex or --flatutreexoproofindex).",
+	"getutreexoproofs-startheight": "The height of the first block to return the proof of. Ignored if a cursor is given",
+	"getutreexoproofs-count":       "The maximum amount of proofs to return",
+	"getutreexoproofs-cursor":      "The hex-encoded cursor returned by a previous call to resume from",
+	"getutreexoproofs-verbose":     "Also return the proofs decoded as JSON",
+	"getutreexoproofs-receipt":     "Also return a receipt of serving each proof signed by the attestation key of the node. Requires --proofreceipts",
+
+	// GetUtreexoProofsResult help.
+	"getutreexoproofsresult-proofs": "The utreexo proofs of the blocks",
+	"getutreexoproofsresult-cursor": "The hex-encoded cursor to resume from after the last returned proof",
+
+	// GetUtreexoStateCmd help.
+	"getutreexostate--synopsis": "Returns the number of leaves, the roots, and the size of the live utreexo accumulator.\n" +
+		"The result is the same as the utreexo section of getblockchaininfo.\n" +
+		"Requires a utreexo proof index (--utreexoproofindex or --flatutreexoproofindex) or a utreexo node.",
+
+	// UtreexoProofResult help.
+	"utreexoproofresult-height":  "The height of the block",
+	"utreexoproofresult-hash":    "The hash of the block",
+	"utreexoproofresult-hex":     "The hex-encoded utreexo proof of the block",
+	"utreexoproofresult-udata":   "The utreexo proof of the block decoded as JSON (only when verbose)",
+	"utreexoproofresult-receipt": "The signed receipt of serving the proof (only when a receipt is requested)",
+
+	// ProofReceiptResult help.
+	"proofreceiptresult-requestid": "The hex-encoded id of the request that the proof was served for, shared by every proof of the request",
+	"proofreceiptresult-blockhash": "The hash of the block",
+	"proofreceiptresult-udatahash": "The double SHA256 hash of the serialized utreexo proof of the block",
+	"proofreceiptresult-timestamp": "When the proof was served in seconds since 1 Jan 1970 GMT",
+	"proofreceiptresult-signature": "The hex-encoded compact signature of the request id, block hash, proof hash, and timestamp",
+	"proofreceiptresult-pubkey":    "The hex-encoded compressed public key of the attestation key that signed the receipt",
+
+	// UDataJSON help.
+	"udatajson-targets":     "The positions of the proven leaves in the accumulator",
+	"udatajson-proofhashes": "The hashes of the accumulator proof",
+	"udatajson-leafdatas":   "The spent outputs that the proof is for",
+	"udatajson-rememberidx": "The indexes of the created outputs to remember",
+
+	// LeafDataJSON help.
+	"leafdatajson-blockhash":  "The hash of the block that created the output",
+	"leafdatajson-txid":       "The hash of the transaction that created the output",
+	"leafdatajson-vout":       "The index of the output in the transaction",
+	"leafdatajson-height":     "The height of the block that created the output (-1 if unconfirmed)",
+	"leafdatajson-iscoinbase": "Whether the output was created by a coinbase",
+	"leafdatajson-amount":     "The value of the output in satoshis",
+	"leafdatajson-pktype":     "The type of the pkscript that may be reconstructed from the spending input (other, pubkeyhash, witness_v0_keyhash, scripthash, witness_v0_scripthash)",
+	"leafdatajson-scripttype": "The type of the pkscript as decoded (e.g. 'pubkeyhash')",
+	"leafdatajson-pkscript":   "The hex-encoded pkscript",
+
 	// HelpCmd help.
 	"help--synopsis":   "Returns a list of all commands or help for a specified command.",
 	"help-command":     "The command to retrieve help for",
@@ -561,15 +952,62 @@ var helpDescsEnUS = map[string]string{
 	"help--result0":    "List of commands",
 	"help--result1":    "Help for specified command",
 
+	// ListUtreexoPinsCmd help.
+	"listutreexopins--synopsis": "Returns the heights whose utreexo proofs, undo blocks, and roots are never pruned.\n" +
+		"Requires --flatutreexoproofindex.",
+
+	// ListUtreexoPinsResult help.
+	"listutreexopinsresult-pins":        "The pins by their height",
+	"listutreexopinsresult-pinnedbytes": "The bytes on disk taken up by the entries of all the pinned heights",
+
+	// UtreexoPinResult help.
+	"utreexopinresult-height": "The pinned height",
+	"utreexopinresult-label":  "The label given when the height was pinned",
+	"utreexopinresult-time":   "When the height was pinned in seconds since 1 Jan 1970 GMT",
+	"utreexopinresult-bytes":  "The bytes on disk taken up by the entries of the height",
+
 	// PingCmd help.
 	"ping--synopsis": "Queues a ping to be sent to each connected peer.\n" +
 		"Ping times are provided by getpeerinfo via the pingtime and pingwait fields.",
 
+	// PinUtreexoProofCmd help.
+	"pinutreexoproof--synopsis": "Pins the given heights so that their utreexo proofs, undo blocks, and roots are never pruned.\n" +
+		"Either all of the heights are pinned or none of them are. A height whose proof isn't held can only be pinned after it's fetched again or the index is reindexed from it.\n" +
+		"Requires --flatutreexoproofindex.",
+	"pinutreexoproof-heights": "The heights to pin",
+	"pinutreexoproof-label":   "What the heights are pinned for, such as the audit or the dispute they're evidence in",
+
+	// EstimateProofSizeCmd help.
+	"estimateproofsize--synopsis": "Estimates the size of the utreexo accumulator proof of the given UTXOs and what it costs to verify it without building the proof, so that the UTXOs to spend can be picked before the transaction is made.\n" +
+		"The estimate matches the proof that proveutxochaintipinclusion returns at the same chain tip. The positions of the UTXOs change with every block, so it doesn't hold past the next one",
+	"estimateproofsize-txids": "The hash of the transactions",
+	"estimateproofsize-vouts": "The index of the outputs of the txids given",
+
+	// EstimateProofSizeResult help.
+	"estimateproofsizeresult-numleaves":   "The number of leaves in the accumulator",
+	"estimateproofsizeresult-proofhashes": "The number of hashes in the proof of the UTXOs that exist, accounting for the branches they share",
+	"estimateproofsizeresult-bytes":       "The size of the serialized chain-tip inclusion proof of the UTXOs that exist",
+	"estimateproofsizeresult-hashops":     "The number of hashes computed to verify the proof",
+	"estimateproofsizeresult-outpoints":   "What each of the given UTXOs adds to the proof of the UTXOs before it, in the order they were given",
+
+	// ProofSizeOutpointResult help.
+	"proofsizeoutpointresult-index":           "The index of the UTXO in the given txids and vouts",
+	"proofsizeoutpointresult-exists":          "Whether the leaf of the UTXO is in the accumulator",
+	"proofsizeoutpointresult-reason":          "Why the leaf doesn't exist: 'spent', 'unknown' (never created or unknown without the transaction index), or 'pruned' (unspent but not held by the accumulator)",
+	"proofsizeoutpointresult-position":        "The position of the leaf in the accumulator",
+	"proofsizeoutpointresult-depth":           "The number of rows of the tree the leaf is in, which is the number of hashes that prove it on its own",
+	"proofsizeoutpointresult-marginalhashes":  "How many hashes the leaf adds to the proof. Negative if the leaf was itself one of the proof hashes of the UTXOs before it",
+	"proofsizeoutpointresult-marginalbytes":   "How many bytes the leaf adds to the serialized proof",
+	"proofsizeoutpointresult-marginalhashops": "How many hashes the leaf adds to verifying the proof",
+
 	// ProveUtxoChainTipInclusionCmd help.
-	"proveutxochaintipinclusion--synopsis": "Returns an utreexo accumulator proof for the chain tip inclusion of the given UTXOs",
-	"proveutxochaintipinclusion-txids":     "The hash of the transactions",
-	"proveutxochaintipinclusion-vouts":     "The index of the outputs of the txids given",
-	"proveutxochaintipinclusion-verbosity": "Returns a json of the utxochaintipinclusion proof",
+	"proveutxochaintipinclusion--synopsis":   "Returns an utreexo accumulator proof for the chain tip inclusion of the given UTXOs",
+	"proveutxochaintipinclusion-txids":       "The hash of the transactions",
+	"proveutxochaintipinclusion-vouts":       "The index of the outputs of the txids given",
+	"proveutxochaintipinclusion-verbosity":   "Returns a json of the utxochaintipinclusion proof",
+	"proveutxochaintipinclusion--condition0": "verbosity=0 and every UTXO was proven",
+	"proveutxochaintipinclusion--condition1": "verbosity=1 or not every UTXO was proven",
+	"proveutxochaintipinclusion--result0":    "The hex-encoded chain-tip inclusion proof",
 
 	// ProveUtxoChainTipInclusionVerboseResult help.
 	"proveutxochaintipinclusionverboseresult-provedathash": "The blockhash at which the proof was generated at. The proof will not verify if the blockhash is different",
@@ -580,6 +1018,13 @@ var helpDescsEnUS = map[string]string{
 	"proveutxochaintipinclusionverboseresult-hashesproven": "The hashes of the UTXOs that are committed in the accumulator.\n" +
 		"Note that these are not purely hashes of txid:vout. The preimage also include Amount, PkScript, and other parts of the UTXO",
 	"proveutxochaintipinclusionverboseresult-hex": "The raw hash of the entire chain-tip inclusion proof",
+	"proveutxochaintipinclusionverboseresult-inputs": "Whether each of the given UTXOs was proven, in the order they were given.\n" +
+		"The proof only covers the UTXOs that were proven",
+
+	// UtxoProofInputResult help.
+	"utxoproofinputresult-index":  "The index of the UTXO in the given txids and vouts",
+	"utxoproofinputresult-proven": "Whether the UTXO is covered by the proof",
+	"utxoproofinputresult-reason": "Why the UTXO wasn't proven: 'spent', 'unknown' (never created or unknown without the transaction index), or 'pruned' (unspent but not held by the accumulator)",
 
 	// SearchRawTransactionsCmd help.
 	"searchrawtransactions--synopsis": "Returns raw data for transactions involving the passed address.\n" +
@@ -660,6 +1105,56 @@ var helpDescsEnUS = map[string]string{
 	"verifymessage-message":   "The signed message",
 	"verifymessage--result0":  "Whether or not the signature verified",
 
+	// VerifyProofReceiptCmd help.
+	"verifyproofreceipt--synopsis": "Confirms or denies that a receipt returned by getutreexoproofs was signed by this node for a serve in its audit log.\n" +
+		"Requires --proofreceipts.",
+	"verifyproofreceipt-requestid": "The hex-encoded request id of the receipt",
+	"verifyproofreceipt-blockhash": "The block hash of the receipt",
+	"verifyproofreceipt-udatahash": "The proof hash of the receipt",
+	"verifyproofreceipt-timestamp": "The timestamp of the receipt",
+	"verifyproofreceipt-signature": "The hex-encoded signature of the receipt",
+
+	// VerifyProofReceiptResult help.
+	"verifyproofreceiptresult-status":         "Whether the receipt is confirmed, or the reason it isn't (invalidsignature, notfound, or mismatch)",
+	"verifyproofreceiptresult-validsignature": "Whether the receipt was signed by the attestation key of this node",
+	"verifyproofreceiptresult-recorded":       "Whether the serve of the receipt is in the audit log",
+	"verifyproofreceiptresult-pubkey":         "The hex-encoded compressed public key of the attestation key of this node",
+
+	// VerifyUndoBlocksCmd help.
+	"verifyundoblocks--synopsis": "Verifies that the stored utreexo undo blocks correctly invert connecting their blocks to the accumulator.\n" +
+		"Requires the flat utreexo proof index (--flatutreexoproofindex).",
+	"verifyundoblocks-startheight": "The height of the first block to verify",
+	"verifyundoblocks-endheight":   "The height of the last block to verify. Defaults to the start height",
+	"verifyundoblocks--result0":    "Whether or not all the undo blocks verified",
+
+	// VerifyUtreexoIndexesCmd help.
+	"verifyutreexoindexes--synopsis": "Compares the utreexo proofs and the undo blocks that the utreexo proof index and the flat utreexo proof index stored for a range of main chain blocks and reports the first block they stored differently.\n" +
+		"The blocks are compared one at a time so any range can be verified. Requires --utreexoproofindex and --flatutreexoproofindex.",
+	"verifyutreexoindexes-startheight": "The height of the first block to verify",
+	"verifyutreexoindexes-endheight":   "The height of the last block to verify. Defaults to the tip",
+
+	// VerifyUtreexoIndexesResult help.
+	"verifyutreexoindexesresult-agree":       "Whether the indexes stored the same utreexo proof and undo block for every block",
+	"verifyutreexoindexesresult-height":      "The height of the first block the indexes stored differently",
+	"verifyutreexoindexesresult-hash":        "The hash of the first block the indexes stored differently",
+	"verifyutreexoindexesresult-differences": "How the proof or the undo block of the block differs from the one of the utreexo proof index",
+
+	// VerifyUtreexoProofsCmd help.
+	"verifyutreexoproofs--synopsis": "Verifies that the stored utreexo proofs serialize back into the exact same bytes they're stored as.\n" +
+		"Non-canonical proofs are copied into the quarantine directory and regenerated when repairing. Requires the flat utreexo proof index (--flatutreexoproofindex).",
+	"verifyutreexoproofs-startheight": "The height of the first block to verify",
+	"verifyutreexoproofs-endheight":   "The height of the last block to verify. Defaults to the start height",
+	"verifyutreexoproofs-repair":      "Whether to quarantine and regenerate the non-canonical proofs",
+
+	// VerifyUtreexoProofsResult help.
+	"verifyutreexoproofsresult-noncanonical": "The stored utreexo proofs that aren't canonical",
+	"verifyutreexoproofsresult-repaired":     "Whether the non-canonical proofs were regenerated",
+
+	// NonCanonicalUtreexoProofResult help.
+	"noncanonicalutreexoproofresult-height":         "The height of the block",
+	"noncanonicalutreexoproofresult-error":          "Why the proof isn't canonical",
+	"noncanonicalutreexoproofresult-quarantinepath": "The file that the stored proof was copied to when repairing",
+
 	// VerifyUtxoChainTipInclusionProofCmd help.
 	"verifyutxochaintipinclusionproof--synopsis": "Verify the given utxochaintipinclusion proof",
 	"verifyutxochaintipinclusionproof-proof":     "The hex encoded string of the utxochaintipinclusion proof",
@@ -730,6 +1225,11 @@ var helpDescsEnUS = map[string]string{
 	"rescannedblock-hash":         "Hash of the matching block.",
 	"rescannedblock-transactions": "List of matching transactions, serialized and hex-encoded.",
 
+	// UnpinUtreexoProofCmd help.
+	"unpinutreexoproof--synopsis": "Unpins the given heights. Heights that aren't pinned are ignored.\n" +
+		"Requires --flatutreexoproofindex.",
+	"unpinutreexoproof-heights": "The heights to unpin",
+
 	// Uptime help.
 	"uptime--synopsis": "Returns the total uptime of the server.",
 	"uptime--result0":  "The number of seconds that the server has been running",
@@ -754,11 +1254,13 @@ var helpDescsEnUS = map[string]string{
 // pointer to the type (or nil to indicate no return value).
 var rpcResultTypes = map[string][]interface{}{
 	"addnode":                          nil,
+	"compareproof":                     {(*btcjson.CompareProofResult)(nil)},
 	"createrawtransaction":             {(*string)(nil)},
 	"debuglevel":                       {(*string)(nil), (*string)(nil)},
 	"decoderawtransaction":             {(*btcjson.TxRawDecodeResult)(nil)},
 	"decodescript":                     {(*btcjson.DecodeScriptResult)(nil)},
 	"estimatefee":                      {(*float64)(nil)},
+	"estimateproofsize":                {(*btcjson.EstimateProofSizeResult)(nil)},
 	"generate":                         {(*[]string)(nil)},
 	"getaddednodeinfo":                 {(*[]string)(nil), (*[]btcjson.GetAddedNodeInfoResult)(nil)},
 	"getbestblock":                     {(*btcjson.GetBestBlockResult)(nil)},
@@ -767,7 +1269,7 @@ var rpcResultTypes = map[string][]interface{}{
 	"getblockcount":                    {(*int64)(nil)},
 	"getblockhash":                     {(*string)(nil)},
 	"getblockheader":                   {(*string)(nil), (*btcjson.GetBlockHeaderVerboseResult)(nil)},
-	"getblocktemplate":                 {(*btcjson.GetBlockTemplateResult)(nil), (*string)(nil), nil},
+	"getblocktemplate":                 {(*btcjson.GetBlockTemplateResult)(nil), (*string)(nil), nil, (*btcjson.GetBlockTemplateProposalResult)(nil)},
 	"getblockchaininfo":                {(*btcjson.GetBlockChainInfoResult)(nil)},
 	"getcfilter":                       {(*string)(nil)},
 	"getcfilterheader":                 {(*string)(nil)},
@@ -777,6 +1279,7 @@ var rpcResultTypes = map[string][]interface{}{
 	"getgenerate":                      {(*bool)(nil)},
 	"gethashespersec":                  {(*float64)(nil)},
 	"getheaders":                       {(*[]string)(nil)},
+	"getindexinfo":                     {(*btcjson.GetIndexInfoResult)(nil)},
 	"getinfo":                          {(*btcjson.InfoChainResult)(nil)},
 	"getmempoolinfo":                   {(*btcjson.GetMempoolInfoResult)(nil)},
 	"getmininginfo":                    {(*btcjson.GetMiningInfoResult)(nil)},
@@ -785,24 +1288,40 @@ var rpcResultTypes = map[string][]interface{}{
 	"getnetworkhashps":                 {(*int64)(nil)},
 	"getnodeaddresses":                 {(*[]btcjson.GetNodeAddressesResult)(nil)},
 	"getpeerinfo":                      {(*[]btcjson.GetPeerInfoResult)(nil)},
+	"getproofservingstats":             {(*btcjson.GetProofServingStatsResult)(nil)},
+	"getproofsourcescores":             {(*btcjson.GetProofSourceScoresResult)(nil)},
+	"getproofwatchdogstats":            {(*btcjson.GetProofWatchdogStatsResult)(nil)},
 	"getrawmempool":                    {(*[]string)(nil), (*btcjson.GetRawMempoolVerboseResult)(nil)},
 	"getrawtransaction":                {(*string)(nil), (*btcjson.TxRawResult)(nil)},
 	"getttl":                           {(*btcjson.GetTTLResult)(nil)},
 	"gettxout":                         {(*btcjson.GetTxOutResult)(nil)},
+	"getutreexocapabilities":           {(*btcjson.GetUtreexoCapabilitiesResult)(nil)},
+	"getutreexocoinagestats":           {(*btcjson.GetUtreexoCoinAgeStatsResult)(nil)},
+	"getutreexoproofcost":              {(*btcjson.GetUtreexoProofCostResult)(nil)},
+	"getutreexoproof":                  {(*string)(nil), (*btcjson.GetUtreexoProofVerboseResult)(nil)},
+	"getutreexoproofs":                 {(*btcjson.GetUtreexoProofsResult)(nil)},
+	"getutreexostate":                  {(*btcjson.UtreexoChainInfoResult)(nil)},
 	"node":                             nil,
 	"help":                             {(*string)(nil), (*string)(nil)},
+	"listutreexopins":                  {(*btcjson.ListUtreexoPinsResult)(nil)},
 	"ping":                             nil,
-	"proveutxochaintipinclusion":       {(*btcjson.ProveUtxoChainTipInclusionVerboseResult)(nil)},
+	"pinutreexoproof":                  nil,
+	"proveutxochaintipinclusion":       {(*string)(nil), (*btcjson.ProveUtxoChainTipInclusionVerboseResult)(nil)},
 	"searchrawtransactions":            {(*string)(nil), (*[]btcjson.SearchRawTransactionsResult)(nil)},
 	"sendrawtransaction":               {(*string)(nil)},
 	"setgenerate":                      nil,
 	"signmessagewithprivkey":           {(*string)(nil)},
 	"stop":                             {(*string)(nil)},
 	"submitblock":                      {nil, (*string)(nil)},
+	"unpinutreexoproof":                nil,
 	"uptime":                           {(*int64)(nil)},
 	"validateaddress":                  {(*btcjson.ValidateAddressChainResult)(nil)},
 	"verifychain":                      {(*bool)(nil)},
 	"verifymessage":                    {(*bool)(nil)},
+	"verifyproofreceipt":               {(*btcjson.VerifyProofReceiptResult)(nil)},
+	"verifyundoblocks":                 {(*bool)(nil)},
+	"verifyutreexoindexes":             {(*btcjson.VerifyUtreexoIndexesResult)(nil)},
+	"verifyutreexoproofs":              {(*btcjson.VerifyUtreexoProofsResult)(nil)},
 	"verifyutxochaintipinclusionproof": {(*bool)(nil)},
 	"version":                          {(*map[string]btcjson.VersionResult)(nil)},
 
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
@@ -57,6 +58,10 @@ const (
 	// retries when connecting to persistent peers.  It is adjusted by the
 	// number of retries such that there is a retry backoff.
 	connectionRetryInterval = time.Second * 5
+
+	// attestationKeyFileName is the name of the file in the data directory
+	// that the attestation key of the node is kept in.
+	attestationKeyFileName = "attestation.key"
 )
 
 var (
@@ -253,6 +258,68 @@ type server struct {
 	utreexoProofIndex     *indexers.UtreexoProofIndex
 	flatUtreexoProofIndex *indexers.FlatUtreexoProofIndex
 
+	// proofGenBudget caps the memory used by in-flight utreexo proof
+	// generation and serving.  It's shared between the utreexo proof
+	// indexes, the RPC server, and the p2p serving paths.  It will be nil
+	// if there's no cap.
+	proofGenBudget *indexers.ProofGenBudget
+
+	// memAccountant caps the memory of the utreexo data held by all the
+	// subsystems together.  It will be nil if there's no cap.
+	memAccountant *indexers.MemAccountant
+
+	// memPressure shrinks the subsystems of memAccountant while the system
+	// is under memory pressure.  It will be nil if --udatamempressure
+	// isn't set.
+	memPressure *indexers.MemPressureResponder
+
+	// proofServingStats tallies the utreexo proofs served to peers by the
+	// height of their blocks.  It will be nil if no utreexo proof index is
+	// enabled.
+	proofServingStats *proofServingStats
+
+	// deferredProofs keeps the requests of peers for the utreexo proofs of
+	// blocks that aren't connected yet so that they're pushed once the
+	// blocks are.  It will be nil if no utreexo proof index is enabled.
+	deferredProofs *deferredProofs
+
+	// proofWatchdog audits the utreexo proofs served by the bridges in
+	// proofWatchdogSources against the ones of the local index.  It will
+	// be nil if no bridges are audited.
+	proofWatchdog        *indexers.ProofWatchdog
+	proofWatchdogSources []*rpcProofSource
+
+	// syncShedder refuses the historical utreexo RPCs and pauses the
+	// proof watchdog while the node is in its initial block download.
+	syncShedder *indexers.SyncShedder
+
+	// servingLag records when the utreexo proofs of the connected blocks
+	// became fetchable and were first served.  It will be nil if they
+	// aren't recorded.
+	servingLag *indexers.ServingLag
+
+	// leafHasher hashes the utreexo leaves of the chain and its indexes.
+	// leafMidstatesPath is the file that the hash states it keeps are
+	// saved to on shutdown.  It's empty if the node doesn't hash any
+	// utreexo leaves.
+	leafHasher        *wire.LeafHasher
+	leafMidstatesPath string
+
+	// indexManager manages the optional indexes.  It will be nil if none
+	// of them are enabled.
+	indexManager *indexers.Manager
+
+	// proofReceipts signs the receipts of the utreexo proofs served over
+	// RPC and keeps the audit log of their serves.  It will be nil if
+	// receipts aren't enabled.
+	proofReceipts *indexers.ProofReceipts
+
+	// proofSampler scores the peers that send the utreexo proofs of the
+	// blocks by sampling their proofs and by whether the chain verifies
+	// them.  It will be
+	// nil if the node doesn't keep the utreexo compact state.
+	proofSampler *netsync.ProofSampler
+
 	// The fee estimator keeps track of how long transactions are left in
 	// the mempool before they are mined into blocks.
 	feeEstimator *mempool.FeeEstimator
@@ -290,6 +357,8 @@ type serverPeer struct {
 	filter         *bloom.Filter
 	addressesMtx   sync.RWMutex
 	knownAddresses map[string]struct{}
+	utreexoCapsMtx sync.RWMutex
+	utreexoCaps    *wire.MsgUtreexoCaps
 	banScore       connmgr.DynamicBanScore
 	quit           chan struct{}
 	// The following chans are used to sync blockmanager and server.
@@ -355,6 +424,26 @@ func (sp *serverPeer) relayTxDisabled() bool {
 	return isDisabled
 }
 
+// setUtreexoCaps sets the utreexo proof serving capabilities the peer
+// advertised.
+// It is safe for concurrent access.
+func (sp *serverPeer) setUtreexoCaps(caps *wire.MsgUtreexoCaps) {
+	sp.utreexoCapsMtx.Lock()
+	sp.utreexoCaps = caps
+	sp.utreexoCapsMtx.Unlock()
+}
+
+// UtreexoCaps returns the utreexo proof serving capabilities the peer
+// advertised.  It returns nil if the peer hasn't sent any.
+// It is safe for concurrent access.
+func (sp *serverPeer) UtreexoCaps() *wire.MsgUtreexoCaps {
+	sp.utreexoCapsMtx.RLock()
+	caps := sp.utreexoCaps
+	sp.utreexoCapsMtx.RUnlock()
+
+	return caps
+}
+
 // pushAddrMsg sends an addr message to the connected peer using the provided
 // addresses.
 func (sp *serverPeer) pushAddrMsg(addresses []*wire.NetAddress) {
@@ -495,6 +584,54 @@ func (sp *serverPeer) OnVersion(_ *peer.Peer, msg *wire.MsgVersion) *wire.MsgRej
 // to kick start communication with them.
 func (sp *serverPeer) OnVerAck(_ *peer.Peer, _ *wire.MsgVerAck) {
 	sp.server.AddPeer(sp)
+
+	// Let the peer know what utreexo proofs we serve so that it's able to
+	// make its routing and format decisions up front.
+	if sp.ProtocolVersion() < wire.UtreexoCapsVersion {
+		return
+	}
+	caps := sp.server.utreexoCapabilities()
+	if caps == nil {
+		return
+	}
+	sp.QueueMessage(caps.MsgUtreexoCaps(), nil)
+
+	// Follow up with exactly which heights the proofs are served for so
+	// that the peer doesn't ask for the ones that aren't.
+	if sp.ProtocolVersion() < wire.ProofRangesVersion {
+		return
+	}
+	ranges := sp.server.proofRanges()
+	if ranges != nil {
+		sp.QueueMessage(ranges, nil)
+	}
+}
+
+// OnUtreexoCaps is invoked when a peer receives a utreexocaps bitcoin message.
+// It records the utreexo proofs that the peer serves.
+func (sp *serverPeer) OnUtreexoCaps(_ *peer.Peer, msg *wire.MsgUtreexoCaps) {
+	peerLog.Debugf("Peer %v serves utreexo proofs for heights %d-%d "+
+		"(formats %v)", sp, msg.LowHeight, msg.HighHeight, msg.Formats)
+	sp.setUtreexoCaps(msg)
+}
+
+// OnProofRanges is invoked when a peer receives a proofranges bitcoin message.
+// It hands the heights that the peer serves the utreexo proofs for to the sync
+// manager so that the peer isn't asked for the ones it doesn't serve.
+func (sp *serverPeer) OnProofRanges(_ *peer.Peer, msg *wire.MsgProofRanges) {
+	peerLog.Debugf("Peer %v serves utreexo proofs for %d height ranges "+
+		"(follows tip %v)", sp, len(msg.Ranges), msg.FollowsTip)
+	sp.server.syncManager.QueueProofRanges(msg, sp.Peer)
+}
+
+// OnNotReady is invoked when a peer receives a notready bitcoin message.  The
+// peer hasn't connected the blocks yet and pushes them once it has, or sends
+// notfound for them if it doesn't in time, so the blocks are left requested
+// from the peer and no ban score is added.
+func (sp *serverPeer) OnNotReady(_ *peer.Peer, msg *wire.MsgNotReady) {
+	peerLog.Debugf("Peer %v doesn't have the utreexo proofs of %d %s "+
+		"ready yet", sp, len(msg.InvList),
+		pickNoun(uint64(len(msg.InvList)), "block", "blocks"))
 }
 
 // OnMemPool is invoked when a peer receives a mempool bitcoin message.
@@ -648,6 +785,7 @@ func (sp *serverPeer) OnHeaders(_ *peer.Peer, msg *wire.MsgHeaders) {
 func (sp *serverPeer) OnGetData(_ *peer.Peer, msg *wire.MsgGetData) {
 	numAdded := 0
 	notFound := wire.NewMsgNotFound()
+	notReady := wire.NewMsgNotReady()
 
 	length := len(msg.InvList)
 	// A decaying ban score increase is applied to prevent exhausting resources
@@ -668,10 +806,16 @@ func (sp *serverPeer) OnGetData(_ *peer.Peer, msg *wire.MsgGetData) {
 	var waitChan chan struct{}
 	doneChan := make(chan struct{}, 1)
 
+	// Fetch the utreexo proofs of the blocks requested with them all at
+	// once rather than one block at a time.
+	proofs := sp.server.prefetchUtreexoProofs(msg.InvList)
+
 	for i, iv := range msg.InvList {
 		var c chan struct{}
 		// If this will be the last message we send.
-		if i == length-1 && len(notFound.InvList) == 0 {
+		if i == length-1 && len(notFound.InvList) == 0 &&
+			len(notReady.InvList) == 0 {
+
 			c = doneChan
 		} else if (i+1)%3 == 0 {
 			// Buffered so as to not make the send goroutine block.
@@ -688,13 +832,15 @@ func (sp *serverPeer) OnGetData(_ *peer.Peer, msg *wire.MsgGetData) {
 		case wire.InvTypeUtreexoTx:
 			err = sp.server.pushTxMsg(sp, &iv.Hash, c, waitChan, wire.UtreexoEncoding)
 		case wire.InvTypeWitnessBlock:
-			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.WitnessEncoding)
+			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.WitnessEncoding, nil)
 		case wire.InvTypeBlock:
-			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.BaseEncoding)
+			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.BaseEncoding, nil)
 		case wire.InvTypeUtreexoBlock:
-			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.UtreexoEncoding)
+			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.UtreexoEncoding,
+				proofs[iv.Hash])
 		case wire.InvTypeWitnessUtreexoBlock:
-			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.UtreexoEncoding|wire.WitnessEncoding)
+			err = sp.server.pushBlockMsg(sp, &iv.Hash, c, waitChan, wire.UtreexoEncoding|wire.WitnessEncoding,
+				proofs[iv.Hash])
 		case wire.InvTypeFilteredWitnessBlock:
 			err = sp.server.pushMerkleBlockMsg(sp, &iv.Hash, c, waitChan, wire.WitnessEncoding)
 		case wire.InvTypeFilteredBlock:
@@ -705,7 +851,15 @@ func (sp *serverPeer) OnGetData(_ *peer.Peer, msg *wire.MsgGetData) {
 			continue
 		}
 		if err != nil {
-			notFound.AddInvVect(iv)
+			// The proof of a block that's likely a new tip we
+			// haven't connected yet isn't missing, only not ready,
+			// so the block is pushed once it's connected.
+			deferred := sp.server.deferredProofs
+			if deferred != nil && deferred.Defer(sp, iv) {
+				notReady.AddInvVect(iv)
+			} else {
+				notFound.AddInvVect(iv)
+			}
 
 			// When there is a failure fetching the final entry
 			// and the done channel was sent in due to there
@@ -719,8 +873,14 @@ func (sp *serverPeer) OnGetData(_ *peer.Peer, msg *wire.MsgGetData) {
 		numAdded++
 		waitChan = c
 	}
-	if len(notFound.InvList) != 0 {
+	switch {
+	case len(notFound.InvList) != 0 && len(notReady.InvList) != 0:
+		sp.QueueMessage(notReady, nil)
 		sp.QueueMessage(notFound, doneChan)
+	case len(notFound.InvList) != 0:
+		sp.QueueMessage(notFound, doneChan)
+	case len(notReady.InvList) != 0:
+		sp.QueueMessage(notReady, doneChan)
 	}
 
 	// Wait for messages to be sent. We can send quite a lot of data at this
@@ -1554,10 +1714,101 @@ func (s *server) pushTxMsg(sp *serverPeer, hash *chainhash.Hash, doneChan chan<-
 	return nil
 }
 
+// relayProofLaneDepth is the amount of blocks from the tip for which the block
+// proofs are served through the relay lane of the proof generation budget.
+const relayProofLaneDepth = 2
+
+// proofLaneForHeight returns the proof generation budget lane that the proof
+// for the block at the given height should be served through.
+func proofLaneForHeight(height, bestHeight int32) indexers.ProofLane {
+	if bestHeight-height < relayProofLaneDepth {
+		return indexers.ProofLaneRelay
+	}
+
+	return indexers.ProofLaneBulk
+}
+
+// releaseProofOnDone returns a channel that releases size bytes admitted
+// through the given lane from the budget once it's signaled and then passes on
+// the signal to doneChan.
+func releaseProofOnDone(budget *indexers.ProofGenBudget, lane indexers.ProofLane,
+	size uint64, doneChan chan<- struct{}) chan<- struct{} {
+
+	releaseChan := make(chan struct{}, 1)
+	go func() {
+		<-releaseChan
+		budget.ReleaseLane(lane, size)
+		if doneChan != nil {
+			doneChan <- struct{}{}
+		}
+	}()
+
+	return releaseChan
+}
+
+// prefetchUtreexoProofs returns the utreexo data of the blocks in the inventory
+// that are requested with it, keyed by block hash.  The proofs are fetched in a
+// single database transaction from the utreexo proof index, or with a single
+// read of the flat files from the flat one if the blocks are contiguous.  nil
+// is returned when there aren't several blocks to fetch the proofs of or when
+// fetching them fails, in which case pushBlockMsg fetches and reports them
+// one block at a time.
+func (s *server) prefetchUtreexoProofs(invList []*wire.InvVect) map[chainhash.Hash]*wire.UData {
+	if s.utreexoProofIndex == nil && s.flatUtreexoProofIndex == nil {
+		return nil
+	}
+
+	var hashes []*chainhash.Hash
+	for _, iv := range invList {
+		if iv.Type == wire.InvTypeUtreexoBlock ||
+			iv.Type == wire.InvTypeWitnessUtreexoBlock {
+
+			hashes = append(hashes, &iv.Hash)
+		}
+	}
+	if len(hashes) < 2 {
+		return nil
+	}
+
+	var uds []*wire.UData
+	var err error
+	if s.utreexoProofIndex != nil {
+		uds, err = s.utreexoProofIndex.FetchUtreexoProofs(hashes)
+	} else {
+		var start int32
+		for i, hash := range hashes {
+			height, err := s.chain.BlockHeightByHash(hash)
+			if err != nil {
+				return nil
+			}
+			if i == 0 {
+				start = height
+			} else if height != start+int32(i) {
+				return nil
+			}
+		}
+		uds, err = s.flatUtreexoProofIndex.FetchUtreexoProofBatch(start,
+			start+int32(len(hashes)-1))
+	}
+	if err != nil {
+		peerLog.Debugf("Unable to prefetch utreexo data for %d blocks: %v",
+			len(hashes), err)
+		return nil
+	}
+
+	proofs := make(map[chainhash.Hash]*wire.UData, len(hashes))
+	for i, hash := range hashes {
+		proofs[*hash] = uds[i]
+	}
+
+	return proofs
+}
+
 // pushBlockMsg sends a block message for the provided block hash to the
-// connected peer.  An error is returned if the block hash is not known.
+// connected peer.  An error is returned if the block hash is not known.  The
+// utreexo data is fetched from the proof index unless it was prefetched.
 func (s *server) pushBlockMsg(sp *serverPeer, hash *chainhash.Hash, doneChan chan<- struct{},
-	waitChan <-chan struct{}, encoding wire.MessageEncoding) error {
+	waitChan <-chan struct{}, encoding wire.MessageEncoding, prefetched *wire.UData) error {
 
 	// Early check to see if Utreexo proof index is there if UtreexoEncoding is given.
 	doUtreexo := encoding&wire.UtreexoEncoding == wire.UtreexoEncoding
@@ -1603,42 +1854,60 @@ func (s *server) pushBlockMsg(sp *serverPeer, hash *chainhash.Hash, doneChan cha
 
 	// Fetch the Utreexo accumulator proof.
 	if doUtreexo {
-		var ud *wire.UData
+		height, err := s.chain.BlockHeightByHash(hash)
+		if err != nil {
+			chanLog.Debugf("Unable to fetch height for block hash %v: %v",
+				hash, err)
+
+			if doneChan != nil {
+				doneChan <- struct{}{}
+			}
+			return err
+		}
+
+		ud := prefetched
 
 		// We already checked that at least one is active.  Pick one and
 		// generate the UData.
-		if s.utreexoProofIndex != nil {
+		switch {
+		case ud != nil:
+		case s.utreexoProofIndex != nil:
 			ud, err = s.utreexoProofIndex.FetchUtreexoProof(hash)
-			if err != nil {
-				peerLog.Debugf("Unable to fetch requested utreexo data for block hash %v: %v",
-					hash, err)
+		default:
+			ud, err = s.flatUtreexoProofIndex.FetchUtreexoProof(height, false)
+		}
+		if err != nil {
+			peerLog.Debugf("Unable to fetch requested utreexo data for block hash %v: %v",
+				hash, err)
 
-				if doneChan != nil {
-					doneChan <- struct{}{}
-				}
-				return err
+			if doneChan != nil {
+				doneChan <- struct{}{}
 			}
-		} else {
-			height, err := s.chain.BlockHeightByHash(hash)
-			if err != nil {
-				chanLog.Debugf("Unable to fetch height for block hash %v: %v",
-					hash, err)
+			return err
+		}
+		s.servingLag.Served(hash)
 
-				if doneChan != nil {
-					doneChan <- struct{}{}
-				}
-				return err
-			}
-			ud, err = s.flatUtreexoProofIndex.FetchUtreexoProof(height, false)
+		// Account for the proof until the message is sent.
+		if s.proofGenBudget != nil {
+			size := uint64(ud.SerializeSizeCompact(false))
+			lane := proofLaneForHeight(height, s.chain.BestSnapshot().Height)
+			err = s.proofGenBudget.AcquireLane(lane, size)
 			if err != nil {
-				peerLog.Debugf("Unable to fetch requested utreexo data for block hash %v: %v",
-					hash, err)
+				peerLog.Debugf("Not serving utreexo data for block hash %v "+
+					"to %v: %v", hash, sp, err)
 
 				if doneChan != nil {
 					doneChan <- struct{}{}
 				}
 				return err
 			}
+			doneChan = releaseProofOnDone(s.proofGenBudget, lane, size,
+				doneChan)
+		}
+
+		if s.proofServingStats != nil {
+			s.proofServingStats.record(height, proofStatsPeerKey(sp),
+				uint64(ud.SerializeSizeCompact(false)))
 		}
 
 		msgBlock.UData = ud
@@ -2190,6 +2459,9 @@ func newPeerConfig(sp *serverPeer) *peer.Config {
 			OnGetCFHeaders: sp.OnGetCFHeaders,
 			OnGetCFCheckpt: sp.OnGetCFCheckpt,
 			OnFeeFilter:    sp.OnFeeFilter,
+			OnUtreexoCaps:  sp.OnUtreexoCaps,
+			OnProofRanges:  sp.OnProofRanges,
+			OnNotReady:     sp.OnNotReady,
 			OnFilterAdd:    sp.OnFilterAdd,
 			OnFilterClear:  sp.OnFilterClear,
 			OnFilterLoad:   sp.OnFilterLoad,
@@ -2266,6 +2538,10 @@ func (s *server) peerDoneHandler(sp *serverPeer) {
 	if sp.VerAckReceived() {
 		s.syncManager.DonePeer(sp.Peer)
 
+		if s.deferredProofs != nil {
+			s.deferredProofs.RemovePeer(sp)
+		}
+
 		// Evict any remaining orphans that were sent by the peer.
 		numEvicted := s.txMemPool.RemoveOrphansByTag(mempool.Tag(sp.ID()))
 		if numEvicted > 0 {
@@ -2358,19 +2634,23 @@ out:
 	s.syncManager.Stop()
 	s.addrManager.Stop()
 
-	// If utreexoProofIndex option is on, flush it after closing down syncManager.
-	if s.utreexoProofIndex != nil {
-		err := s.utreexoProofIndex.FlushUtreexoState()
+	// Flush the state of the indexes along with the cached chain state
+	// after closing down syncManager so that they're durable at the same
+	// height.
+	if s.indexManager != nil {
+		err := s.indexManager.ForceAlignedFlush()
 		if err != nil {
-			btcdLog.Errorf("Error while flushing utreexo state: %v", err)
+			btcdLog.Errorf("Error while flushing the index state: %v", err)
 		}
 	}
 
-	// If flatUtreexoProofIndex option is on, flush it after closing down syncManager.
-	if s.flatUtreexoProofIndex != nil {
-		err := s.flatUtreexoProofIndex.FlushUtreexoState()
+	// Save the hash states of the utreexo leaves now that no more leaves
+	// are hashed.
+	if s.leafMidstatesPath != "" {
+		err := saveLeafMidstates(s.leafHasher, s.leafMidstatesPath)
 		if err != nil {
-			btcdLog.Errorf("Error while flushing utreexo state: %v", err)
+			srvrLog.Warnf("Unable to save the utreexo leaf hash "+
+				"midstates: %v", err)
 		}
 	}
 
@@ -2478,6 +2758,51 @@ func (s *server) addAccBytesSent(bytesSent uint64) {
 	atomic.AddUint64(&s.txBytes.accBytesSent, bytesSent)
 }
 
+// utreexoCapabilities returns the utreexo proofs that the server is able to
+// serve.  It returns nil if the server doesn't have a utreexo proof index.
+func (s *server) utreexoCapabilities() *indexers.Capabilities {
+	var caps *indexers.Capabilities
+	var err error
+	switch {
+	case s.flatUtreexoProofIndex != nil:
+		caps, err = s.flatUtreexoProofIndex.Capabilities()
+	case s.utreexoProofIndex != nil:
+		caps, err = s.utreexoProofIndex.Capabilities()
+	default:
+		return nil
+	}
+	if err != nil {
+		srvrLog.Errorf("Unable to fetch the utreexo capabilities: %v", err)
+		return nil
+	}
+
+	return caps
+}
+
+// proofRanges returns the heights that the server serves the utreexo proofs for
+// as a proofranges message.  The ranges are those of the index that the proofs
+// are served from.
+func (s *server) proofRanges() *wire.MsgProofRanges {
+	var rs indexers.RangeServer
+	switch {
+	case s.utreexoProofIndex != nil:
+		rs = s.utreexoProofIndex
+	case s.flatUtreexoProofIndex != nil:
+		rs = s.flatUtreexoProofIndex
+	default:
+		return nil
+	}
+
+	ranges, err := rs.ServableRanges()
+	if err != nil {
+		srvrLog.Errorf("Unable to fetch the servable utreexo proof "+
+			"ranges: %v", err)
+		return nil
+	}
+
+	return indexers.MsgProofRanges(ranges, s.chain.BestSnapshot().Height)
+}
+
 // GetProofSizeforTx calculates the size of the raw proof that would needed for
 // proving the tx to an utreexo node.
 func (s *server) GetProofSizeforTx(msgTx *wire.MsgTx) (int, int, error) {
@@ -2631,6 +2956,183 @@ cleanup:
 	s.wg.Done()
 }
 
+// syncLag returns the height of the chain tip and the highest height announced
+// by the connected peers.  It's the tip twice if the chain is current.
+//
+// This function is safe for concurrent access.
+func (s *server) syncLag() (int32, int32) {
+	height := s.chain.BestSnapshot().Height
+	if s.chain.IsCurrent() {
+		return height, height
+	}
+
+	replyChan := make(chan []*serverPeer)
+	select {
+	case s.query <- getPeersMsg{reply: replyChan}:
+	case <-s.quit:
+		return height, height
+	}
+
+	target := height
+	for _, sp := range <-replyChan {
+		if lastBlock := sp.LastBlock(); lastBlock > target {
+			target = lastBlock
+		}
+	}
+
+	return height, target
+}
+
+// proofServingStatsHandler periodically saves the utreexo proof serving
+// statistics so that they survive restarts.  They're saved one last time on
+// shutdown.
+func (s *server) proofServingStatsHandler() {
+	ticker := time.NewTicker(proofStatsDumpInterval)
+	defer ticker.Stop()
+
+out:
+	for {
+		select {
+		case <-ticker.C:
+			err := s.proofServingStats.save()
+			if err != nil {
+				srvrLog.Warnf("Unable to save the utreexo proof "+
+					"serving statistics: %v", err)
+			}
+
+		case <-s.quit:
+			break out
+		}
+	}
+
+	err := s.proofServingStats.save()
+	if err != nil {
+		srvrLog.Warnf("Unable to save the utreexo proof serving "+
+			"statistics: %v", err)
+	}
+	s.wg.Done()
+}
+
+// memPressureHandler responds to the memory pressure of the system until the
+// server shuts down.
+func (s *server) memPressureHandler() {
+	s.memPressure.Start()
+	<-s.quit
+	s.memPressure.Stop()
+	s.wg.Done()
+}
+
+// proofWatchdogHandler audits the utreexo proofs of every connected block
+// against the bridges until the server shuts down.  The watchdog statistics
+// are saved on shutdown.
+func (s *server) proofWatchdogHandler() {
+	s.chain.Subscribe(func(notification *blockchain.Notification) {
+		if notification.Type != blockchain.NTBlockConnected {
+			return
+		}
+		block, ok := notification.Data.(*btcutil.Block)
+		if !ok {
+			return
+		}
+		s.proofWatchdog.BlockConnected(block.Height())
+	})
+	s.proofWatchdog.Start()
+
+	<-s.quit
+
+	err := s.proofWatchdog.Stop()
+	if err != nil {
+		srvrLog.Warnf("Unable to save the utreexo proof watchdog "+
+			"statistics: %v", err)
+	}
+	for _, source := range s.proofWatchdogSources {
+		source.Close()
+	}
+	s.wg.Done()
+}
+
+// isPlausibleTip returns whether the block with the given hash isn't in the
+// main chain but is likely to be a new tip that's about to be connected, like
+// when a peer with a clock ahead of ours heard of it first.  A block with a
+// known header is if its timestamp is recent, and one with an unknown header is
+// if we're caught up to the tip.
+func (s *server) isPlausibleTip(hash *chainhash.Hash) bool {
+	if s.chain.MainChainHasBlock(hash) {
+		return false
+	}
+	header, err := s.chain.HeaderByHash(hash)
+	if err != nil {
+		return s.syncManager.IsCurrent()
+	}
+	age := s.timeSource.AdjustedTime().Sub(header.Timestamp)
+
+	return age < deferredProofMaxAge
+}
+
+// pushDeferredProof pushes the block the inventory vector is for along with
+// its utreexo proof to the peer that asked for it before it was connected.
+func (s *server) pushDeferredProof(requester proofRequester, iv *wire.InvVect) {
+	sp, ok := requester.(*serverPeer)
+	if !ok {
+		return
+	}
+	encoding := wire.UtreexoEncoding
+	if iv.Type == wire.InvTypeWitnessUtreexoBlock {
+		encoding |= wire.WitnessEncoding
+	}
+	err := s.pushBlockMsg(sp, &iv.Hash, nil, nil, encoding, nil)
+	if err != nil {
+		peerLog.Debugf("Unable to push the deferred utreexo block %v "+
+			"to %v: %v", iv.Hash, sp, err)
+		notFound := wire.NewMsgNotFound()
+		notFound.AddInvVect(iv)
+		sp.QueueMessage(notFound, nil)
+	}
+}
+
+// deferredProofHandler pushes the blocks that peers asked for the utreexo
+// proofs of before they were connected once they are, and answers the requests
+// that expire with notfound, until the server shuts down.
+func (s *server) deferredProofHandler() {
+	s.chain.Subscribe(func(notification *blockchain.Notification) {
+		if notification.Type != blockchain.NTBlockConnected {
+			return
+		}
+		block, ok := notification.Data.(*btcutil.Block)
+		if !ok {
+			return
+		}
+
+		// The blocks are pushed without the chain lock held.
+		go s.deferredProofs.BlockConnected(block.Hash())
+	})
+
+	ticker := time.NewTicker(deferredProofSweepInterval)
+	defer ticker.Stop()
+out:
+	for {
+		select {
+		case <-ticker.C:
+			s.deferredProofs.Expire()
+		case <-s.quit:
+			break out
+		}
+	}
+	s.wg.Done()
+}
+
+// proofStatsPeerKey returns what the peer is told apart by in the utreexo proof
+// serving statistics.  The port is left out so that a peer that reconnects is
+// counted once.
+func proofStatsPeerKey(sp *serverPeer) string {
+	host, _, err := net.SplitHostPort(sp.Addr())
+	if err != nil {
+		return sp.Addr()
+	}
+
+	return host
+}
+
 // Start begins accepting connections from peers.
 func (s *server) Start() {
 	// Already started?
@@ -2653,6 +3155,26 @@ func (s *server) Start() {
 		go s.upnpUpdateThread()
 	}
 
+	if s.proofServingStats != nil {
+		s.wg.Add(1)
+		go s.proofServingStatsHandler()
+	}
+
+	if s.proofWatchdog != nil {
+		s.wg.Add(1)
+		go s.proofWatchdogHandler()
+	}
+
+	if s.deferredProofs != nil {
+		s.wg.Add(1)
+		go s.deferredProofHandler()
+	}
+
+	if s.memPressure != nil {
+		s.wg.Add(1)
+		go s.memPressureHandler()
+	}
+
 	if !cfg.DisableRPC {
 		s.wg.Add(1)
 
@@ -2688,6 +3210,12 @@ func (s *server) Stop() error {
 		s.rpcServer.Stop()
 	}
 
+	// Append the recorded serving lags to the export file.
+	if err := s.servingLag.Close(); err != nil {
+		srvrLog.Warnf("Unable to export the utreexo proof serving "+
+			"lags: %v", err)
+	}
+
 	// Save fee estimator state in the database.
 	s.db.Update(func(tx database.Tx) error {
 		metadata := tx.Metadata()
@@ -2893,6 +3421,17 @@ func setupRPCListeners() ([]net.Listener, error) {
 	return listeners, nil
 }
 
+// logIndexEvent logs the event of a utreexo proof index.
+func logIndexEvent(event *indexers.IndexEvent) {
+	switch event.Type {
+	case indexers.IndexEventRowAdded:
+		indxLog.Infof("The forest of the %s gained row %d at height %d "+
+			"with %d leaves. Connecting the block took %v",
+			event.Index, event.Rows, event.Height, event.NumLeaves,
+			event.ConnectTime)
+	}
+}
+
 // newServer returns a new btcd server configured to listen on addr for the
 // bitcoin network type specified by chainParams.  Use start to begin accepting
 // connections from peers.
@@ -3001,6 +3540,13 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		if err != nil {
 			return nil, err
 		}
+		s.utreexoProofIndex.SetUndoAssertions(cfg.UtreexoUndoAssert)
+		s.utreexoProofIndex.SetFsyncPolicy(cfg.utreexoFsync)
+		s.utreexoProofIndex.SetIndexEventHandler(logIndexEvent)
+		s.utreexoProofIndex.SetRetainBlocks(int32(cfg.UtreexoRetainBlocks))
+		s.utreexoProofIndex.SetLeafLimitWarnOnly(cfg.UtreexoLeafLimitWarn)
+		s.utreexoProofIndex.SetProofCacheSize(
+			uint64(cfg.UtreexoProofCacheKiB) * 1024)
 
 		indexes = append(indexes, s.utreexoProofIndex)
 	}
@@ -3013,17 +3559,58 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 
 		var err error
 		s.flatUtreexoProofIndex, err = indexers.NewFlatUtreexoProofIndex(
-			cfg.DataDir, chainParams, interval)
+			cfg.DataDir, chainParams, interval,
+			int32(cfg.FlatUtreexoUndoSnapshot), cfg.FlatUtreexoNoLeafTTL)
 		if err != nil {
 			return nil, err
 		}
+		s.flatUtreexoProofIndex.SetStateFlushInterval(
+			int32(cfg.FlatUtreexoFlushInterval))
+		s.flatUtreexoProofIndex.SetEagerAccMigration(cfg.FlatUtreexoAccMigrate)
+		s.flatUtreexoProofIndex.SetVerifyOnInit(cfg.FlatUtreexoVerify)
+		s.flatUtreexoProofIndex.SetUndoAssertions(cfg.UtreexoUndoAssert)
+		s.flatUtreexoProofIndex.SetFsyncPolicy(cfg.utreexoFsync)
+		s.flatUtreexoProofIndex.SetIndexEventHandler(logIndexEvent)
+		s.flatUtreexoProofIndex.SetRetainBlocks(int32(cfg.UtreexoRetainBlocks))
+		s.flatUtreexoProofIndex.SetLeafLimitWarnOnly(cfg.UtreexoLeafLimitWarn)
 		indexes = append(indexes, s.flatUtreexoProofIndex)
 	}
 
 	// Create an index manager if any of the optional indexes are enabled.
 	var indexManager blockchain.IndexManager
 	if len(indexes) > 0 {
-		indexManager = indexers.NewManager(db, indexes)
+		manager := indexers.NewManager(db, indexes)
+		manager.SetSharedUndo(cfg.UtreexoSharedUndo)
+		manager.SetIndexRecovery(cfg.utreexoRecovery,
+			int32(cfg.UtreexoRecoverySample))
+		manager.SetUtreexoMigration(cfg.utreexoMigrate)
+		manager.SetSplitWriteThreshold(uint64(cfg.IndexSplitWriteKiB) * 1024)
+		manager.SetCatchUpWorkers(int(cfg.IndexCatchUpWorkers))
+		manager.SetCatchUpPipeline(int(cfg.IndexCatchUpFetchers),
+			int(cfg.IndexCatchUpQueue))
+		if cfg.IndexMaintMaxKiBps != 0 || cfg.IndexMaintMaxOps != 0 {
+			manager.SetIOLimiter(indexers.NewIOLimiter(
+				uint64(cfg.IndexMaintMaxKiBps)*1024,
+				uint64(cfg.IndexMaintMaxOps)))
+		}
+		proofIndex := s.utreexoProofIndex != nil ||
+			s.flatUtreexoProofIndex != nil
+		if proofIndex && cfg.ServingLagBlocks > 0 {
+			var err error
+			s.servingLag, err = indexers.NewServingLag(
+				int(cfg.ServingLagBlocks), cfg.ServingLagExport)
+			if err != nil {
+				return nil, err
+			}
+			manager.SetServingLag(s.servingLag)
+		}
+		manager.SetSyncProgress(indexers.DefaultSyncProgressInterval,
+			func(indexName string, height, tip int32) {
+				indxLog.Infof("Caught up the %s to height %d of %d",
+					indexName, height, tip)
+			})
+		s.indexManager = manager
+		indexManager = manager
 	}
 
 	// Merge given checkpoints with the default ones unless they are disabled.
@@ -3032,11 +3619,20 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		checkpoints = mergeCheckpoints(s.chainParams.Checkpoints, cfg.addCheckpoints)
 	}
 
+	// Restore the hash states of the leaves of the transactions hashed
+	// last before the chain and the indexes start hashing leaves.
+	s.leafHasher = blockchain.NewLeafHasher(s.chainParams)
+	if cfg.Utreexo || cfg.UtreexoProofIndex || cfg.FlatUtreexoProofIndex {
+		s.leafMidstatesPath = filepath.Join(cfg.DataDir,
+			leafMidstatesFileName)
+		loadLeafMidstates(s.leafHasher, s.leafMidstatesPath)
+	}
+
 	// If Utreexo is enabled, make an empty UtreexoViewpoint to signal that utreexo
 	// accumulators are enabled.
 	var utreexo *blockchain.UtreexoViewpoint
 	if cfg.Utreexo {
-		utreexo = blockchain.NewUtreexoViewpoint()
+		utreexo = blockchain.NewUtreexoViewpoint(int(cfg.UtreexoProofWorkers))
 	}
 
 	// Create a new block chain instance with the appropriate configuration.
@@ -3052,6 +3648,8 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		HashCache:        s.hashCache,
 		UtxoCacheMaxSize: uint64(cfg.UtxoCacheMaxSizeMiB) * 1024 * 1024,
 		UtreexoView:      utreexo,
+		UtreexoRelay:     cfg.UtreexoRelay,
+		LeafHasher:       s.leafHasher,
 	})
 	if err != nil {
 		return nil, err
@@ -3064,6 +3662,105 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		s.flatUtreexoProofIndex.SetChain(s.chain)
 	}
 
+	// Cap the memory used by in-flight proof generation if requested.  The
+	// same budget is shared between the utreexo proof indexes and the p2p
+	// serving paths.
+	if cfg.UtreexoProofGenMaxMemMiB > 0 {
+		s.proofGenBudget = indexers.NewProofGenBudget(
+			uint64(cfg.UtreexoProofGenMaxMemMiB)*1024*1024, 0)
+		s.proofGenBudget.SetMaxCallBytes(
+			uint64(cfg.UtreexoProofMaxCallKiB) * 1024)
+		if s.utreexoProofIndex != nil {
+			s.utreexoProofIndex.SetProofGenBudget(s.proofGenBudget)
+		}
+		if s.flatUtreexoProofIndex != nil {
+			s.flatUtreexoProofIndex.SetProofGenBudget(s.proofGenBudget)
+		}
+
+		if cfg.UDataMaxMemMiB > 0 {
+			s.memAccountant = indexers.NewMemAccountant(
+				uint64(cfg.UDataMaxMemMiB) * 1024 * 1024)
+			s.proofGenBudget.SetMemAccountant(s.memAccountant)
+
+			// The sessions and cursors pinned by the clients are
+			// shed along with the caches.
+			if s.utreexoProofIndex != nil {
+				s.utreexoProofIndex.SetMemAccountant(s.memAccountant)
+				s.utreexoProofIndex.Leases().SetMemAccountant(
+					s.memAccountant, "utreexo proof index leases")
+			}
+			if s.flatUtreexoProofIndex != nil {
+				s.flatUtreexoProofIndex.Leases().SetMemAccountant(
+					s.memAccountant, "flat utreexo proof index leases")
+			}
+
+			if cfg.UDataMemPressureMiB > 0 {
+				source := indexers.NewMemPressureSource(
+					uint64(cfg.UDataMemPressureMiB) * 1024 * 1024)
+				s.memPressure = indexers.NewMemPressureResponder(
+					s.memAccountant, &indexers.MemPressureConfig{
+						Source: source,
+					})
+			}
+		}
+	}
+
+	// Tally the utreexo proofs served to peers so that operators can tell
+	// which ranges of blocks are still requested.
+	if s.utreexoProofIndex != nil || s.flatUtreexoProofIndex != nil {
+		s.proofServingStats = newProofServingStats(
+			filepath.Join(cfg.DataDir, proofStatsFileName),
+			int32(cfg.ProofStatsBandWidth), cfg.ProofStatsHalfLife,
+			cfg.ProofStatsRetention)
+		s.deferredProofs = newDeferredProofs(s.isPlausibleTip,
+			s.pushDeferredProof)
+		err := s.proofServingStats.load()
+		if err != nil {
+			srvrLog.Warnf("Unable to load the utreexo proof serving "+
+				"statistics: %v", err)
+		}
+
+		if cfg.ProofReceipts {
+			key, err := indexers.LoadAttestationKey(
+				filepath.Join(cfg.DataDir, attestationKeyFileName))
+			if err != nil {
+				return nil, err
+			}
+			s.proofReceipts = indexers.NewProofReceipts(db, key,
+				cfg.ProofReceiptRetention)
+		}
+	}
+
+	// Keep the expensive utreexo work from competing with the initial
+	// block download.
+	s.syncShedder = indexers.NewSyncShedder(&indexers.SyncShedderConfig{
+		SyncLag:  s.syncLag,
+		MaxLag:   int32(cfg.SyncShedLag),
+		Disabled: cfg.NoSyncShedding,
+	})
+
+	// Audit the utreexo proofs served by other bridges against the local
+	// index if requested.
+	if len(cfg.ProofWatchdog) > 0 &&
+		(s.utreexoProofIndex != nil || s.flatUtreexoProofIndex != nil) {
+
+		s.proofWatchdog, s.proofWatchdogSources, err = newProofWatchdog(
+			s.chain, s.flatUtreexoProofIndex, s.utreexoProofIndex,
+			s.syncShedder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Score the sources of the utreexo proofs if the node keeps the utreexo
+	// compact state.
+	if cfg.Utreexo {
+		s.proofSampler = netsync.NewProofSampler(&netsync.ProofSamplerConfig{
+			SampleRate:      cfg.ProofSampleRate,
+			LeafCommitments: s.chainParams.LeafCommitments,
+		})
+	}
+
 	// Search for a FeeEstimator state in the database. If none can be found
 	// or if it cannot be loaded, create a new one.
 	db.Update(func(tx database.Tx) error {
@@ -3131,6 +3828,7 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 		DisableCheckpoints: cfg.DisableCheckpoints,
 		MaxPeers:           cfg.MaxPeers,
 		FeeEstimator:       s.feeEstimator,
+		ProofSampler:       s.proofSampler,
 	})
 	if err != nil {
 		return nil, err
@@ -3275,6 +3973,14 @@ func newServer(listenAddrs, agentBlacklist, agentWhitelist []string,
 			TTLIndex:              s.ttlIndex,
 			UtreexoProofIndex:     s.utreexoProofIndex,
 			FlatUtreexoProofIndex: s.flatUtreexoProofIndex,
+			ProofServingStats:     s.proofServingStats,
+			ProofWatchdog:         s.proofWatchdog,
+			SyncShedder:           s.syncShedder,
+			ServingLag:            s.servingLag,
+			IndexManager:          s.indexManager,
+			ProofReceipts:         s.proofReceipts,
+			ProofSampler:          s.proofSampler,
+			MemAccountant:         s.memAccountant,
 			FeeEstimator:          s.feeEstimator,
 		})
 		if err != nil {
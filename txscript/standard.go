@@ -1094,7 +1094,7 @@ func ExtractAtomicSwapDataPushes(version uint16, pkScript []byte) (*AtomicSwapDa
 // ReconstructScript reconstructs the script from the witness for standard
 // transactions.  This function only works for p2pkh, p2wpkh, p2sh and p2wsh.
 // Only version 0 witness scripts are supported.  Returns nil for types that
-// are not supported
+// are not supported and an error if the witness of a witness script is empty.
 func ReconstructScript(sigScript []byte, witness wire.TxWitness, class ScriptClass) ([]byte, error) {
 	var script []byte
 	var err error
@@ -1131,6 +1131,10 @@ func ReconstructScript(sigScript []byte, witness wire.TxWitness, class ScriptCla
 			return nil, err
 		}
 	case WitnessV0PubKeyHashTy:
+		if len(witness) == 0 {
+			return nil, scriptError(ErrWitnessProgramEmpty,
+				"no witness to reconstruct the script from")
+		}
 		last := witness[len(witness)-1]
 		hash := hash160(last)
 
@@ -1139,6 +1143,10 @@ func ReconstructScript(sigScript []byte, witness wire.TxWitness, class ScriptCla
 			return nil, err
 		}
 	case WitnessV0ScriptHashTy:
+		if len(witness) == 0 {
+			return nil, scriptError(ErrWitnessProgramEmpty,
+				"no witness to reconstruct the script from")
+		}
 		last := witness[len(witness)-1]
 		hash := chainhash.HashB(last)
 
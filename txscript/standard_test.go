@@ -1382,3 +1382,19 @@ func TestReconstructScript(t *testing.T) {
 		}
 	}
 }
+
+// TestReconstructScriptEmptyWitness ensures that reconstructing a witness script
+// from an empty witness returns an error.
+func TestReconstructScriptEmptyWitness(t *testing.T) {
+	t.Parallel()
+
+	for _, class := range []ScriptClass{WitnessV0PubKeyHashTy,
+		WitnessV0ScriptHashTy} {
+
+		_, err := ReconstructScript(nil, nil, class)
+		if !IsErrorCode(err, ErrWitnessProgramEmpty) {
+			t.Errorf("%v: got error %v, want %v", class, err,
+				ErrWitnessProgramEmpty)
+		}
+	}
+}
@@ -122,6 +122,18 @@ func btcdMain(serverChan chan<- *server) error {
 		return nil
 	}
 
+	// Run the self-test and exit if requested.  It's run on a throwaway
+	// chain so nothing in the data directory is touched.
+	if cfg.SelfTest {
+		result := indexers.RunSelfTest(&indexers.SelfTestConfig{}, interrupt)
+		btcdLog.Infof("%v", result)
+		if result.Failure != nil {
+			return result.Failure
+		}
+
+		return nil
+	}
+
 	// Load the block database.
 	db, err := loadBlockDB()
 	if err != nil {
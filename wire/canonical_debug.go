@@ -0,0 +1,12 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+//go:build utreexodebug
+// +build utreexodebug
+
+package wire
+
+// assertCanonicalSerialization is whether the compact leaf data serialization
+// panics when what it writes doesn't deserialize back into the same bytes.
+const assertCanonicalSerialization = true
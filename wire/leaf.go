@@ -6,7 +6,6 @@ package wire
 
 import (
 	"bytes"
-	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -46,16 +45,11 @@ type LeafData struct {
 	PkScript              []byte
 }
 
-// LeafHash concats and hashes all the data in LeafData.
+// LeafHash concats and hashes all the data in LeafData.  It's the commitment
+// of the LeafCommitmentV0 scheme.  The leaves of networks with leaf commitment
+// upgrades must be hashed with ScheduledLeafHash instead.
 func (l *LeafData) LeafHash() [32]byte {
-	digest := sha512.New512_256()
-	l.Serialize(digest)
-
-	// TODO go 1.17 support slice to array conversion so we
-	// can avoid this extra copy.
-	hash := [32]byte{}
-	copy(hash[:], digest.Sum(nil))
-	return hash
+	return l.CommitmentHash(LeafCommitmentV0)
 }
 
 // ToString turns a LeafData into a string for logging.
@@ -71,6 +65,18 @@ func (l *LeafData) ToString() (s string) {
 	return
 }
 
+// Equal returns whether the two leaf datas hold the same data.  A nil and an
+// empty pkscript are equal.
+func (l *LeafData) Equal(other *LeafData) bool {
+	return l.BlockHash == other.BlockHash &&
+		l.OutPoint == other.OutPoint &&
+		l.Height == other.Height &&
+		l.IsCoinBase == other.IsCoinBase &&
+		l.Amount == other.Amount &&
+		l.ReconstructablePkType == other.ReconstructablePkType &&
+		bytes.Equal(l.PkScript, other.PkScript)
+}
+
 // IsUnconfirmed returns whether the leaf data in question corresponds to an
 // unconfirmed transaction.
 func (l *LeafData) IsUnconfirmed() bool {
@@ -320,6 +326,10 @@ func PkScriptSerializeCompact(w io.Writer, ty PkType, pkscript []byte) error {
 		_, err = w.Write([]byte{0x3})
 	case WitnessV0ScriptHashTy:
 		_, err = w.Write([]byte{0x4})
+	default:
+		// Writing nothing for an unknown type would leave behind bytes
+		// that deserialize into a different leaf data.
+		return fmt.Errorf("%d is not a valid type", byte(ty))
 	}
 
 	return err
@@ -329,7 +339,7 @@ func PkScriptSerializeCompact(w io.Writer, ty PkType, pkscript []byte) error {
 // reconstructable serialization format.
 func PkScriptDeserializeCompact(r io.Reader) (PkType, []byte, error) {
 	buf := make([]byte, 1)
-	_, err := r.Read(buf)
+	_, err := io.ReadFull(r, buf)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -379,7 +389,20 @@ func (l *LeafData) SerializeSizeCompact(isForTx bool) int {
 }
 
 // SerializeCompact encodes the LeafData to w using the compact leaf data serialization format.
+//
+// When built with the utreexodebug tag, it panics if the serialized leaf data
+// doesn't deserialize back into the exact same bytes.
 func (l *LeafData) SerializeCompact(w io.Writer, isForTx bool) error {
+	if assertCanonicalSerialization {
+		return l.serializeCompactAsserted(w, isForTx)
+	}
+
+	return l.serializeCompact(w, isForTx)
+}
+
+// serializeCompact encodes the LeafData to w using the compact leaf data
+// serialization format.
+func (l *LeafData) serializeCompact(w io.Writer, isForTx bool) error {
 	if isForTx {
 		// If the tx is unconfirmed, write the unconfirmed marker and
 		// return immediately.
@@ -443,6 +466,14 @@ func (l *LeafData) DeserializeCompact(r io.Reader, isForTx bool) error {
 			// Return immediately here if the tx is unconfirmed.
 			return nil
 		}
+
+		// Anything other than 0 would be serialized back as 0 so it's
+		// rejected to keep the serialization canonical.
+		if unconfirmed[0] != 0x0 {
+			return messageError("LeafData DeserializeCompact",
+				fmt.Sprintf("invalid unconfirmed marker %d",
+					unconfirmed[0]))
+		}
 	}
 
 	bs := newSerializer()
@@ -473,3 +473,47 @@ func TestLeafDataSerializeCompact(t *testing.T) {
 		}
 	}
 }
+
+// TestLeafDataCompactCanonical ensures that the compact leaf data serialization
+// rejects encodings that wouldn't serialize back into the same bytes.
+func TestLeafDataCompactCanonical(t *testing.T) {
+	ld := LeafData{
+		Amount:                1000,
+		ReconstructablePkType: OtherTy,
+		PkScript:              hexToBytes("6a0401020304"),
+		Height:                12,
+	}
+
+	var buf bytes.Buffer
+	err := ld.SerializeCompact(&buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := buf.Bytes()
+	if err := checkCompactCanonical(serialized, true); err != nil {
+		t.Fatalf("unexpected error for canonical leaf data: %v", err)
+	}
+
+	// Trailing bytes aren't part of the leaf data.
+	trailing := append(append([]byte(nil), serialized...), 0x00)
+	if err := checkCompactCanonical(trailing, true); err == nil {
+		t.Fatal("expected an error for trailing bytes")
+	}
+
+	// Only 0 and 1 are valid unconfirmed markers.
+	marker := append([]byte(nil), serialized...)
+	marker[0] = 0x02
+	var check LeafData
+	err = check.DeserializeCompact(bytes.NewReader(marker), true)
+	if err == nil {
+		t.Fatal("expected an error for an invalid unconfirmed marker")
+	}
+
+	// An unknown pkType must not be serialized as nothing.
+	ld.ReconstructablePkType = WitnessV0ScriptHashTy + 1
+	buf.Reset()
+	err = ld.SerializeCompact(&buf, false)
+	if err == nil {
+		t.Fatal("expected an error for an unknown pkType")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// checkCompactCanonical returns an error if the compact serialized leaf data
+// doesn't deserialize back into the exact same bytes.
+func checkCompactCanonical(serialized []byte, isForTx bool) error {
+	r := bytes.NewReader(serialized)
+
+	var ld LeafData
+	err := ld.DeserializeCompact(r, isForTx)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d trailing bytes", r.Len())
+	}
+
+	var buf bytes.Buffer
+	err = ld.serializeCompact(&buf, isForTx)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf.Bytes(), serialized) {
+		return fmt.Errorf("serialized as %x but reserialized as %x",
+			serialized, buf.Bytes())
+	}
+
+	return nil
+}
+
+// serializeCompactAsserted encodes the LeafData to w using the compact leaf
+// data serialization format and panics if the serialized bytes aren't
+// canonical.  Nothing is written to w in that case.
+func (l *LeafData) serializeCompactAsserted(w io.Writer, isForTx bool) error {
+	var buf bytes.Buffer
+	err := l.serializeCompact(&buf, isForTx)
+	if err != nil {
+		return err
+	}
+
+	err = checkCompactCanonical(buf.Bytes(), isForTx)
+	if err != nil {
+		panic(fmt.Sprintf("non-canonical compact serialization of leaf "+
+			"data %s: %v", l.ToString(), err))
+	}
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"crypto/sha512"
+	"fmt"
+)
+
+// LeafCommitment identifies how a utreexo accumulator leaf commits to its leaf
+// data.
+type LeafCommitment uint8
+
+const (
+	// LeafCommitmentV0 commits to the leaf data with the SHA-512/256 hash
+	// of its serialization.
+	LeafCommitmentV0 LeafCommitment = iota
+
+	// LeafCommitmentTaggedV1 commits to the leaf data with the SHA-512/256
+	// hash of its serialization prefixed twice with the SHA-512/256 hash
+	// of the leafCommitmentV1Tag.  The tag keeps the leaf hashes from ever
+	// colliding with the ones committed with another scheme.
+	LeafCommitmentTaggedV1
+)
+
+// leafCommitmentV1Tag is the tag of the LeafCommitmentTaggedV1 scheme.
+var leafCommitmentV1Tag = []byte("UtreexoV1")
+
+// String returns the LeafCommitment in human-readable form.
+func (c LeafCommitment) String() string {
+	switch c {
+	case LeafCommitmentV0:
+		return "v0"
+	case LeafCommitmentTaggedV1:
+		return "taggedv1"
+	default:
+		return fmt.Sprintf("unknown LeafCommitment (%d)", uint8(c))
+	}
+}
+
+// LeafCommitmentUpgrade is a leaf commitment scheme that's used for the leaves
+// created at and above its activation height.
+type LeafCommitmentUpgrade struct {
+	// Height is the activation height of the scheme.
+	Height int32
+
+	// Scheme is the leaf commitment scheme that activates.
+	Scheme LeafCommitment
+}
+
+// LeafCommitmentSchedule is the list of leaf commitment upgrades of a network
+// ordered by their activation heights.  The leaves created before the first
+// upgrade are committed with LeafCommitmentV0.
+//
+// A leaf is always committed with the scheme for the height it's created at,
+// even when it's spent after another scheme activates.  This keeps the leaf
+// hash of every leaf in the accumulator the same no matter which blocks are
+// connected or disconnected so reorgs across an activation height don't need
+// anything re-committed.
+type LeafCommitmentSchedule []LeafCommitmentUpgrade
+
+// SchemeAt returns the leaf commitment scheme for the leaves created at the
+// given height.
+func (s LeafCommitmentSchedule) SchemeAt(height int32) LeafCommitment {
+	scheme := LeafCommitmentV0
+	for _, upgrade := range s {
+		if height < upgrade.Height {
+			break
+		}
+		scheme = upgrade.Scheme
+	}
+
+	return scheme
+}
+
+// CommitmentHash returns the hash that commits to the leaf data with the given
+// scheme.
+func (l *LeafData) CommitmentHash(scheme LeafCommitment) [32]byte {
+	digest := sha512.New512_256()
+	switch scheme {
+	case LeafCommitmentV0:
+	case LeafCommitmentTaggedV1:
+		tag := sha512.Sum512_256(leafCommitmentV1Tag)
+		digest.Write(tag[:])
+		digest.Write(tag[:])
+	default:
+		// The schedules are part of the chain parameters so an unknown
+		// scheme is never hashed with.
+		panic(fmt.Sprintf("unknown leaf commitment scheme %d",
+			uint8(scheme)))
+	}
+	l.Serialize(digest)
+
+	hash := [32]byte{}
+	copy(hash[:], digest.Sum(nil))
+	return hash
+}
+
+// ScheduledLeafHash returns the hash that commits to the leaf data with the
+// scheme that the schedule has for the height the leaf was created at.
+func (l *LeafData) ScheduledLeafHash(schedule LeafCommitmentSchedule) [32]byte {
+	return l.CommitmentHash(schedule.SchemeAt(l.Height))
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestLeafCommitmentSchedule ensures that the leaves are committed with the
+// scheme for the height they're created at.
+func TestLeafCommitmentSchedule(t *testing.T) {
+	schedule := LeafCommitmentSchedule{
+		{Height: 100, Scheme: LeafCommitmentTaggedV1},
+		{Height: 200, Scheme: LeafCommitmentV0},
+	}
+
+	tests := []struct {
+		height int32
+		want   LeafCommitment
+	}{
+		{0, LeafCommitmentV0},
+		{99, LeafCommitmentV0},
+		{100, LeafCommitmentTaggedV1},
+		{199, LeafCommitmentTaggedV1},
+		{200, LeafCommitmentV0},
+	}
+	for _, test := range tests {
+		got := schedule.SchemeAt(test.height)
+		if got != test.want {
+			t.Errorf("SchemeAt(%d): got %v, want %v", test.height,
+				got, test.want)
+		}
+		if got := LeafCommitmentSchedule(nil).SchemeAt(test.height); got != LeafCommitmentV0 {
+			t.Errorf("SchemeAt(%d) with no upgrades: got %v",
+				test.height, got)
+		}
+	}
+
+	ld := LeafData{
+		BlockHash:  *newHashFromStr("000000000000000005ff0e2a31e6e2d5e6e3e7bb5b2d6a12a3e7b7c7a0e8e0f1"),
+		OutPoint:   OutPoint{Index: 1},
+		Amount:     5000,
+		PkScript:   hexToBytes("6a0401020304"),
+		Height:     150,
+		IsCoinBase: true,
+	}
+
+	v0 := ld.CommitmentHash(LeafCommitmentV0)
+	if v0 != ld.LeafHash() {
+		t.Fatalf("expected the v0 commitment to be the leaf hash")
+	}
+	tagged := ld.CommitmentHash(LeafCommitmentTaggedV1)
+	if tagged == v0 {
+		t.Fatalf("expected the tagged commitment to differ from v0")
+	}
+	if got := ld.ScheduledLeafHash(schedule); got != tagged {
+		t.Fatalf("expected the leaf created at height %d to be "+
+			"committed with the tagged scheme", ld.Height)
+	}
+
+	// Leaves created before the upgrade keep the v0 scheme.
+	ld.Height = 99
+	if got := ld.ScheduledLeafHash(schedule); got != ld.LeafHash() {
+		t.Fatalf("expected the leaf created at height %d to be "+
+			"committed with the v0 scheme", ld.Height)
+	}
+}
+
+// TestLeafHashUniqueness ensures that leaves that only differ in a single field
+// of their leaf data never share a leaf hash.  Adversarial near-identical
+// outputs of the same block with the same script and amount are only told apart
+// by their outpoints, so the outpoint must always be committed to.  A field
+// that's added to or removed from LeafData fails the test until it's decided
+// whether the leaf hash commits to it.
+func TestLeafHashUniqueness(t *testing.T) {
+	// The fields the leaf hash commits to along with a change to each.
+	mutations := map[string]func(ld *LeafData){
+		"BlockHash":  func(ld *LeafData) { ld.BlockHash[31] ^= 1 },
+		"OutPoint":   func(ld *LeafData) { ld.OutPoint.Index++ },
+		"Height":     func(ld *LeafData) { ld.Height++ },
+		"IsCoinBase": func(ld *LeafData) { ld.IsCoinBase = !ld.IsCoinBase },
+		"Amount":     func(ld *LeafData) { ld.Amount++ },
+		"PkScript":   func(ld *LeafData) { ld.PkScript = append(ld.PkScript, 0x51) },
+	}
+	// The fields that aren't committed to.  The pkscript type is derived
+	// from the pkscript.
+	uncommitted := []string{"ReconstructablePkType"}
+
+	var want, got []string
+	for name := range mutations {
+		want = append(want, name)
+	}
+	want = append(want, uncommitted...)
+	ldType := reflect.TypeOf(LeafData{})
+	for i := 0; i < ldType.NumField(); i++ {
+		got = append(got, ldType.Field(i).Name)
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("LeafData fields changed: got %v, want %v.  Decide "+
+			"whether the leaf hash commits to the new fields",
+			got, want)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	randLeaf := func() LeafData {
+		ld := LeafData{
+			Height:     rnd.Int31n(1 << 20),
+			IsCoinBase: rnd.Intn(2) == 0,
+			Amount:     rnd.Int63n(21e14),
+			PkScript:   make([]byte, 1+rnd.Intn(40)),
+		}
+		rnd.Read(ld.BlockHash[:])
+		rnd.Read(ld.OutPoint.Hash[:])
+		ld.OutPoint.Index = uint32(rnd.Intn(1000))
+		rnd.Read(ld.PkScript)
+		return ld
+	}
+
+	schemes := []LeafCommitment{LeafCommitmentV0, LeafCommitmentTaggedV1}
+	for i := 0; i < 100; i++ {
+		base := randLeaf()
+		for name, mutate := range mutations {
+			mutated := base
+			mutated.PkScript = append([]byte(nil), base.PkScript...)
+			mutate(&mutated)
+			for _, scheme := range schemes {
+				if base.CommitmentHash(scheme) == mutated.CommitmentHash(scheme) {
+					t.Fatalf("%v: changing the %s didn't change "+
+						"the leaf hash of %s", scheme, name,
+						base.ToString())
+				}
+			}
+		}
+	}
+
+	// The outputs of a transaction that are the same in everything but
+	// their index, and the same outputs of another transaction in the
+	// same block, never share a leaf hash under any scheme.
+	seen := make(map[[32]byte]string)
+	for i := 0; i < 10; i++ {
+		base := randLeaf()
+		for tx := 0; tx < 2; tx++ {
+			base.OutPoint.Hash[0] ^= byte(tx)
+			for vout := uint32(0); vout < 50; vout++ {
+				ld := base
+				ld.OutPoint.Index = vout
+				for _, scheme := range schemes {
+					hash := ld.CommitmentHash(scheme)
+					desc := scheme.String() + " " +
+						ld.OutPoint.String()
+					if other, ok := seen[hash]; ok {
+						t.Fatalf("%s shares its leaf hash "+
+							"with %s", desc, other)
+					}
+					seen[hash] = desc
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,550 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+)
+
+// LeafTemplate is a common public key script template that the leaf hashes of
+// are computed on a fast path by a LeafHasher.
+type LeafTemplate uint8
+
+const (
+	// LeafTemplateNone is a public key script that doesn't match any of
+	// the templates.  Its leaf hash is computed by serializing the whole
+	// leaf data.
+	LeafTemplateNone LeafTemplate = iota
+
+	// LeafTemplateP2PKH is OP_DUP OP_HASH160 <20 bytes> OP_EQUALVERIFY
+	// OP_CHECKSIG.
+	LeafTemplateP2PKH
+
+	// LeafTemplateP2SH is OP_HASH160 <20 bytes> OP_EQUAL.
+	LeafTemplateP2SH
+
+	// LeafTemplateP2WPKH is OP_0 <20 bytes>.
+	LeafTemplateP2WPKH
+
+	// LeafTemplateP2WSH is OP_0 <32 bytes>.
+	LeafTemplateP2WSH
+
+	// LeafTemplateP2TR is OP_1 <32 bytes>.
+	LeafTemplateP2TR
+
+	// LeafTemplateAnchor is the OP_1 <0x4e73> pay to anchor script of the
+	// dust outputs that are made to be spent by a child paying the fee.
+	LeafTemplateAnchor
+
+	// numLeafTemplates is the number of leaf templates including
+	// LeafTemplateNone.
+	numLeafTemplates
+)
+
+// leafTemplateStrings is a map of leaf templates back to their names for pretty
+// printing.
+var leafTemplateStrings = [numLeafTemplates]string{
+	LeafTemplateNone:   "none",
+	LeafTemplateP2PKH:  "p2pkh",
+	LeafTemplateP2SH:   "p2sh",
+	LeafTemplateP2WPKH: "p2wpkh",
+	LeafTemplateP2WSH:  "p2wsh",
+	LeafTemplateP2TR:   "p2tr",
+	LeafTemplateAnchor: "anchor",
+}
+
+// String returns the LeafTemplate in human-readable form.
+func (t LeafTemplate) String() string {
+	if t < numLeafTemplates {
+		return leafTemplateStrings[t]
+	}
+	return "unknown"
+}
+
+// LeafTemplateOf returns the template that the public key script matches.  Only
+// the opcodes are matched as the data the templates push is what differs from
+// one output to another.
+func LeafTemplateOf(pkScript []byte) LeafTemplate {
+	switch len(pkScript) {
+	case 25:
+		if pkScript[0] == 0x76 && pkScript[1] == 0xa9 &&
+			pkScript[2] == 0x14 && pkScript[23] == 0x88 &&
+			pkScript[24] == 0xac {
+
+			return LeafTemplateP2PKH
+		}
+	case 23:
+		if pkScript[0] == 0xa9 && pkScript[1] == 0x14 &&
+			pkScript[22] == 0x87 {
+
+			return LeafTemplateP2SH
+		}
+	case 22:
+		if pkScript[0] == 0x00 && pkScript[1] == 0x14 {
+			return LeafTemplateP2WPKH
+		}
+	case 34:
+		if pkScript[0] == 0x00 && pkScript[1] == 0x20 {
+			return LeafTemplateP2WSH
+		}
+		if pkScript[0] == 0x51 && pkScript[1] == 0x20 {
+			return LeafTemplateP2TR
+		}
+	case 4:
+		if pkScript[0] == 0x51 && pkScript[1] == 0x02 &&
+			pkScript[2] == 0x4e && pkScript[3] == 0x73 {
+
+			return LeafTemplateAnchor
+		}
+	}
+
+	return LeafTemplateNone
+}
+
+const (
+	// leafPrefixSize is the size of the part of the serialized leaf data
+	// that all the outputs of a transaction share.  It's the block hash and
+	// the hash of the outpoint.
+	leafPrefixSize = chainhash.HashSize * 2
+
+	// leafSuffixMaxSize is the size of the rest of the serialized leaf data
+	// of the largest template.  It's the outpoint index, the header code,
+	// the amount, the length of the public key script, and a script of 34
+	// bytes.
+	leafSuffixMaxSize = 4 + 4 + 8 + 1 + 34
+
+	// DefaultLeafMidstates is the default number of the hash states after
+	// the tagged prefix of a transaction that a LeafHasher keeps.
+	DefaultLeafMidstates = 1024
+
+	// leafMidstatesVersion is the version of the hash states serialized by
+	// SaveMidstates.
+	leafMidstatesVersion = 1
+
+	// maxLeafMidstateSize is the largest serialized hash state that's
+	// loaded.  The serialized SHA-512 states are a lot smaller.
+	maxLeafMidstateSize = 512
+
+	// leafMidstatesChecksumSize is the size of the checksum that the
+	// serialized hash states end with.
+	leafMidstatesChecksumSize = 4
+)
+
+// leafCommitmentV1TagHash is the hash of the tag of the LeafCommitmentTaggedV1
+// scheme that prefixes the tagged leaf hashes twice.
+var leafCommitmentV1TagHash = sha512.Sum512_256(leafCommitmentV1Tag)
+
+// leafScratch is a digest along with the buffers that hashing the suffix of a
+// tagged leaf uses.  They're reused so that hashing a leaf doesn't allocate.
+type leafScratch struct {
+	digest hash.Hash
+	buf    [leafSuffixMaxSize]byte
+	sum    [32]byte
+}
+
+// leafMidstateKey is the block hash and the transaction hash that a midstate is
+// of.
+type leafMidstateKey [leafPrefixSize]byte
+
+// LeafTemplateHits is the number of leaves of a template that were hashed.
+type LeafTemplateHits struct {
+	Template LeafTemplate
+	Hits     uint64
+}
+
+// LeafHasherStats are the counts of the leaves hashed by a LeafHasher.
+type LeafHasherStats struct {
+	// Templates are the leaves hashed on the fast path by their template.
+	Templates []LeafTemplateHits
+
+	// Fallbacks is the number of leaves that didn't match a template or
+	// were otherwise hashed by serializing the whole leaf data.
+	Fallbacks uint64
+
+	// MidstateHits and MidstateMisses are the number of tagged leaves
+	// hashed on the fast path that the hash state after their prefix was
+	// and wasn't kept for.
+	MidstateHits   uint64
+	MidstateMisses uint64
+
+	// Midstates is the number of hash states that are kept and
+	// MaxMidstates is the most that are.
+	Midstates    int
+	MaxMidstates int
+}
+
+// TemplateHits returns the number of leaves hashed on the fast path.
+func (s *LeafHasherStats) TemplateHits() uint64 {
+	var hits uint64
+	for _, t := range s.Templates {
+		hits += t.Hits
+	}
+	return hits
+}
+
+// HitRate returns the share of the hashed leaves that were hashed on the fast
+// path.
+func (s *LeafHasherStats) HitRate() float64 {
+	hits := s.TemplateHits()
+	if hits+s.Fallbacks == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+s.Fallbacks)
+}
+
+// MidstateHitRate returns the share of the tagged leaves hashed on the fast
+// path that reused the hash state of their prefix.
+func (s *LeafHasherStats) MidstateHitRate() float64 {
+	if s.MidstateHits+s.MidstateMisses == 0 {
+		return 0
+	}
+	return float64(s.MidstateHits) /
+		float64(s.MidstateHits+s.MidstateMisses)
+}
+
+// LeafHasher computes leaf hashes that are bit-identical to the ones of
+// CommitmentHash while skipping the serialization of the leaf data for the
+// public key scripts that match a template.
+//
+// The public key script is the last of the hashed fields so the leaves of a
+// template only share the length of what's hashed and not a prefix.  What the
+// outputs of a transaction do share is the block hash and the transaction hash,
+// along with the tag under LeafCommitmentTaggedV1.  Under LeafCommitmentTaggedV1
+// that prefix is exactly one SHA-512 block so the hash state after it is kept
+// and every output of the transaction after the first one only hashes its
+// suffix.  The suffix of every template fits into the one block that's left.
+//
+// The hash states only help LeafCommitmentTaggedV1, which none of the networks
+// schedule yet.  The LeafCommitmentV0 prefix is half a SHA-512 block so there's
+// no state after it to keep, and the leaves of a template are only spared the
+// serialization of the leaf data.
+//
+// A nil LeafHasher hashes the leaves the same way without keeping any hash
+// states or counts.
+type LeafHasher struct {
+	// The counts are accessed atomically and kept first so they're 64-bit
+	// aligned.
+	templateHits   [numLeafTemplates]uint64
+	midstateHits   uint64
+	midstateMisses uint64
+
+	maxMidstates int
+
+	scratches sync.Pool
+
+	mtx       sync.Mutex
+	midstates map[leafMidstateKey][]byte
+	order     []leafMidstateKey
+	next      int
+}
+
+// NewLeafHasher returns a LeafHasher that keeps the hash states after the
+// tagged prefix of up to the given number of transactions.  It keeps none if
+// the number isn't positive.
+func NewLeafHasher(maxMidstates int) *LeafHasher {
+	if maxMidstates < 0 {
+		maxMidstates = 0
+	}
+
+	return &LeafHasher{
+		maxMidstates: maxMidstates,
+		scratches: sync.Pool{
+			New: func() interface{} {
+				return &leafScratch{digest: sha512.New512_256()}
+			},
+		},
+		midstates: make(map[leafMidstateKey][]byte, maxMidstates),
+		order:     make([]leafMidstateKey, 0, maxMidstates),
+	}
+}
+
+// ScheduledLeafHash returns the hash that commits to the leaf data with the
+// scheme that the schedule has for the height the leaf was created at.
+//
+// This function is safe for concurrent access.
+func (h *LeafHasher) ScheduledLeafHash(l *LeafData,
+	schedule LeafCommitmentSchedule) [32]byte {
+
+	return h.CommitmentHash(l, schedule.SchemeAt(l.Height))
+}
+
+// CommitmentHash returns the hash that commits to the leaf data with the given
+// scheme.  It's always the same as the one returned by the CommitmentHash
+// method of the leaf data.
+//
+// This function is safe for concurrent access.
+func (h *LeafHasher) CommitmentHash(l *LeafData, scheme LeafCommitment) [32]byte {
+	// The leaf data that fails to serialize is hashed as whatever was
+	// serialized before the failure, so it's left to the full hashing.
+	template := LeafTemplateOf(l.PkScript)
+	if template == LeafTemplateNone || l.BlockHash == empty ||
+		scheme > LeafCommitmentTaggedV1 {
+
+		if h != nil {
+			atomic.AddUint64(&h.templateHits[LeafTemplateNone], 1)
+		}
+		return l.CommitmentHash(scheme)
+	}
+
+	if h != nil {
+		atomic.AddUint64(&h.templateHits[template], 1)
+	}
+
+	switch {
+	case scheme == LeafCommitmentV0:
+		return leafHashV0(l)
+
+	// The hash states after the tagged prefixes are kept by the hasher.
+	case h == nil:
+		return l.CommitmentHash(scheme)
+	}
+	return h.leafHashTaggedV1(l)
+}
+
+// leafHashV0 returns the LeafCommitmentV0 hash of the leaf data whose public key
+// script is of a template.
+func leafHashV0(l *LeafData) [32]byte {
+	var buf [leafPrefixSize + leafSuffixMaxSize]byte
+	copy(buf[:chainhash.HashSize], l.BlockHash[:])
+	copy(buf[chainhash.HashSize:leafPrefixSize], l.OutPoint.Hash[:])
+	n := leafPrefixSize + putLeafSuffix(buf[leafPrefixSize:], l)
+
+	return sha512.Sum512_256(buf[:n])
+}
+
+// leafHashTaggedV1 returns the LeafCommitmentTaggedV1 hash of the leaf data
+// whose public key script is of a template.
+func (h *LeafHasher) leafHashTaggedV1(l *LeafData) [32]byte {
+	var key leafMidstateKey
+	copy(key[:chainhash.HashSize], l.BlockHash[:])
+	copy(key[chainhash.HashSize:], l.OutPoint.Hash[:])
+
+	scratch := h.scratches.Get().(*leafScratch)
+	h.startTagged(scratch.digest, &key)
+	n := putLeafSuffix(scratch.buf[:], l)
+	scratch.digest.Write(scratch.buf[:n])
+	scratch.digest.Sum(scratch.sum[:0])
+	hash := scratch.sum
+	h.scratches.Put(scratch)
+
+	return hash
+}
+
+// putLeafSuffix puts the part of the serialized leaf data after the prefix into
+// the buffer and returns its size.  The public key script must be of a
+// template.
+func putLeafSuffix(buf []byte, l *LeafData) int {
+	binary.LittleEndian.PutUint32(buf[0:4], l.OutPoint.Index)
+	hcb := l.Height << 1
+	if l.IsCoinBase {
+		hcb |= 1
+	}
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(hcb))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(l.Amount))
+
+	// The scripts of the templates are short enough for their length to
+	// be a single byte varint.
+	buf[16] = byte(len(l.PkScript))
+	return 17 + copy(buf[17:], l.PkScript)
+}
+
+// startTagged sets the digest to the state after the tagged prefix with the
+// given block hash and transaction hash.  The state is kept so that the digests
+// of the other outputs of the transaction start from it.
+func (h *LeafHasher) startTagged(digest hash.Hash, key *leafMidstateKey) {
+	h.mtx.Lock()
+	state, ok := h.midstates[*key]
+	h.mtx.Unlock()
+	if ok {
+		err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		if err == nil {
+			atomic.AddUint64(&h.midstateHits, 1)
+			return
+		}
+	}
+	atomic.AddUint64(&h.midstateMisses, 1)
+
+	digest.Reset()
+	digest.Write(leafCommitmentV1TagHash[:])
+	digest.Write(leafCommitmentV1TagHash[:])
+	digest.Write(key[:])
+	state, err := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	// The oldest hash state is replaced once there are as many as are
+	// kept.
+	h.mtx.Lock()
+	if _, ok := h.midstates[*key]; !ok && h.maxMidstates > 0 {
+		if len(h.order) < h.maxMidstates {
+			h.order = append(h.order, *key)
+		} else {
+			delete(h.midstates, h.order[h.next])
+			h.order[h.next] = *key
+			h.next = (h.next + 1) % h.maxMidstates
+		}
+		h.midstates[*key] = state
+	}
+	h.mtx.Unlock()
+}
+
+// SaveMidstates writes the hash states after the tagged prefixes that are kept,
+// the oldest first, so that LoadMidstates can restore them once the process is
+// restarted.  The outputs of the transactions that were hashed last are the
+// ones most likely to be spent, and so hashed again, soon after.
+//
+// The states are serialized as a version byte and their count followed by the
+// block hash, the transaction hash, the size and the bytes of every state.  A
+// checksum of everything before it comes last.
+//
+// This function is safe for concurrent access.
+func (h *LeafHasher) SaveMidstates(w io.Writer) error {
+	h.mtx.Lock()
+	keys := make([]leafMidstateKey, 0, len(h.order))
+	keys = append(keys, h.order[h.next:]...)
+	keys = append(keys, h.order[:h.next]...)
+	states := make([][]byte, len(keys))
+	for i := range keys {
+		states[i] = h.midstates[keys[i]]
+	}
+	h.mtx.Unlock()
+
+	var buf bytes.Buffer
+	var scratch [4]byte
+	buf.WriteByte(leafMidstatesVersion)
+	binary.LittleEndian.PutUint32(scratch[:], uint32(len(keys)))
+	buf.Write(scratch[:])
+	for i := range keys {
+		buf.Write(keys[i][:])
+		binary.LittleEndian.PutUint16(scratch[:2], uint16(len(states[i])))
+		buf.Write(scratch[:2])
+		buf.Write(states[i])
+	}
+	checksum := chainhash.DoubleHashB(buf.Bytes())
+	buf.Write(checksum[:leafMidstatesChecksumSize])
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// LoadMidstates replaces the hash states that are kept with the ones written by
+// SaveMidstates.  Only the newest ones are kept if there are more than the
+// hasher keeps.  Nothing is replaced if the states are corrupt as a corrupt
+// state would make the leaf hashes differ from the ones of CommitmentHash.
+//
+// This function is safe for concurrent access.
+func (h *LeafHasher) LoadMidstates(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < 1+4+leafMidstatesChecksumSize {
+		return fmt.Errorf("leaf hash midstates of %d bytes are too "+
+			"short", len(data))
+	}
+	body := data[:len(data)-leafMidstatesChecksumSize]
+	checksum := chainhash.DoubleHashB(body)[:leafMidstatesChecksumSize]
+	if !bytes.Equal(checksum, data[len(body):]) {
+		return fmt.Errorf("leaf hash midstates checksum mismatch")
+	}
+	if body[0] != leafMidstatesVersion {
+		return fmt.Errorf("unsupported leaf hash midstates version %d",
+			body[0])
+	}
+
+	count := binary.LittleEndian.Uint32(body[1:5])
+	body = body[5:]
+	keys := make([]leafMidstateKey, 0, count)
+	states := make([][]byte, 0, count)
+	digest := sha512.New512_256()
+	for i := uint32(0); i < count; i++ {
+		if len(body) < leafPrefixSize+2 {
+			return fmt.Errorf("leaf hash midstate %d is truncated", i)
+		}
+		var key leafMidstateKey
+		copy(key[:], body[:leafPrefixSize])
+		size := int(binary.LittleEndian.Uint16(body[leafPrefixSize:]))
+		body = body[leafPrefixSize+2:]
+		if size > maxLeafMidstateSize || len(body) < size {
+			return fmt.Errorf("leaf hash midstate %d of %d bytes is "+
+				"invalid", i, size)
+		}
+		state := append([]byte(nil), body[:size]...)
+		body = body[size:]
+
+		err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		if err != nil {
+			return fmt.Errorf("leaf hash midstate %d is invalid: %v",
+				i, err)
+		}
+		keys = append(keys, key)
+		states = append(states, state)
+	}
+	if len(body) != 0 {
+		return fmt.Errorf("%d bytes after the leaf hash midstates",
+			len(body))
+	}
+
+	if len(keys) > h.maxMidstates {
+		keys = keys[len(keys)-h.maxMidstates:]
+		states = states[len(states)-h.maxMidstates:]
+	}
+
+	h.mtx.Lock()
+	h.midstates = make(map[leafMidstateKey][]byte, h.maxMidstates)
+	h.order = h.order[:0]
+	h.next = 0
+	for i, key := range keys {
+		if _, ok := h.midstates[key]; ok {
+			continue
+		}
+		h.order = append(h.order, key)
+		h.midstates[key] = states[i]
+	}
+	h.mtx.Unlock()
+
+	return nil
+}
+
+// Stats returns the counts of the leaves hashed so far.  They're all zero for a
+// nil LeafHasher.
+//
+// This function is safe for concurrent access.
+func (h *LeafHasher) Stats() LeafHasherStats {
+	if h == nil {
+		return LeafHasherStats{}
+	}
+
+	stats := LeafHasherStats{
+		Templates:      make([]LeafTemplateHits, 0, numLeafTemplates-1),
+		Fallbacks:      atomic.LoadUint64(&h.templateHits[LeafTemplateNone]),
+		MidstateHits:   atomic.LoadUint64(&h.midstateHits),
+		MidstateMisses: atomic.LoadUint64(&h.midstateMisses),
+		MaxMidstates:   h.maxMidstates,
+	}
+	for t := LeafTemplateNone + 1; t < numLeafTemplates; t++ {
+		stats.Templates = append(stats.Templates, LeafTemplateHits{
+			Template: t,
+			Hits:     atomic.LoadUint64(&h.templateHits[t]),
+		})
+	}
+
+	h.mtx.Lock()
+	stats.Midstates = len(h.midstates)
+	h.mtx.Unlock()
+
+	return stats
+}
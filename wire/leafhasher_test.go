@@ -0,0 +1,381 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// templateScript returns a random public key script of the given template.
+func templateScript(rnd *rand.Rand, template LeafTemplate) []byte {
+	var script []byte
+	switch template {
+	case LeafTemplateP2PKH:
+		script = make([]byte, 25)
+		rnd.Read(script)
+		script[0], script[1], script[2] = 0x76, 0xa9, 0x14
+		script[23], script[24] = 0x88, 0xac
+	case LeafTemplateP2SH:
+		script = make([]byte, 23)
+		rnd.Read(script)
+		script[0], script[1], script[22] = 0xa9, 0x14, 0x87
+	case LeafTemplateP2WPKH:
+		script = make([]byte, 22)
+		rnd.Read(script)
+		script[0], script[1] = 0x00, 0x14
+	case LeafTemplateP2WSH:
+		script = make([]byte, 34)
+		rnd.Read(script)
+		script[0], script[1] = 0x00, 0x20
+	case LeafTemplateP2TR:
+		script = make([]byte, 34)
+		rnd.Read(script)
+		script[0], script[1] = 0x51, 0x20
+	case LeafTemplateAnchor:
+		script = []byte{0x51, 0x02, 0x4e, 0x73}
+	}
+
+	return script
+}
+
+// fuzzScript returns a random public key script that's either of a template,
+// a template with one of its opcodes changed, or random bytes of a random
+// length.
+func fuzzScript(rnd *rand.Rand) []byte {
+	switch rnd.Intn(4) {
+	case 0:
+		template := LeafTemplate(1 + rnd.Intn(int(numLeafTemplates)-1))
+		return templateScript(rnd, template)
+
+	case 1:
+		// Only the opcodes of the templates are fixed so changing
+		// the first byte always makes the script miss the template.
+		template := LeafTemplate(1 + rnd.Intn(int(numLeafTemplates)-1))
+		script := templateScript(rnd, template)
+		script[0]++
+		return script
+
+	case 2:
+		// The sizes around the ones of the templates.
+		sizes := []int{0, 1, 3, 4, 5, 21, 22, 23, 24, 25, 26, 33, 34, 35}
+		script := make([]byte, sizes[rnd.Intn(len(sizes))])
+		rnd.Read(script)
+		return script
+
+	default:
+		script := make([]byte, rnd.Intn(300))
+		rnd.Read(script)
+		return script
+	}
+}
+
+// TestLeafTemplateOf ensures that the public key scripts are matched to their
+// templates.
+func TestLeafTemplateOf(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(245))
+	for template := LeafTemplate(1); template < numLeafTemplates; template++ {
+		script := templateScript(rnd, template)
+		if got := LeafTemplateOf(script); got != template {
+			t.Fatalf("%x: got template %v, want %v", script, got, template)
+		}
+
+		// Changing any of the opcodes makes the script not match.
+		for _, i := range []int{0, len(script) - 1} {
+			changed := append([]byte(nil), script...)
+			changed[i]++
+			if template != LeafTemplateP2PKH && template != LeafTemplateP2SH &&
+				template != LeafTemplateAnchor && i != 0 {
+
+				// The last byte of the others is data.
+				continue
+			}
+			if got := LeafTemplateOf(changed); got != LeafTemplateNone {
+				t.Fatalf("%x: got template %v, want none", changed, got)
+			}
+		}
+		if got := LeafTemplateOf(script[:len(script)-1]); got != LeafTemplateNone {
+			t.Fatalf("%x: got template %v for a truncated script",
+				script, got)
+		}
+	}
+}
+
+// TestLeafHasherCrossCheck ensures that the leaf hashes of a LeafHasher are
+// bit-identical to the ones of hashing the whole serialized leaf data for
+// randomly generated leaves and public key scripts under every scheme,
+// including when the hash states are evicted and when leaves are hashed
+// concurrently.
+func TestLeafHasherCrossCheck(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(245))
+	randLeaves := func(n int) []LeafData {
+		leaves := make([]LeafData, 0, n)
+		for len(leaves) < n {
+			// The outputs of a transaction share the block hash and
+			// the transaction hash.
+			var tx LeafData
+			rnd.Read(tx.BlockHash[:])
+			rnd.Read(tx.OutPoint.Hash[:])
+			for i := 0; i < 1+rnd.Intn(8) && len(leaves) < n; i++ {
+				ld := tx
+				ld.OutPoint.Index = rnd.Uint32()
+				ld.Height = rnd.Int31n(1 << 24)
+				ld.IsCoinBase = rnd.Intn(2) == 0
+				ld.Amount = rnd.Int63()
+				ld.PkScript = fuzzScript(rnd)
+
+				// The edge cases of the fields.
+				switch rnd.Intn(10) {
+				case 0:
+					ld.Height = -1
+				case 1:
+					ld.Height = math.MaxInt32
+				case 2:
+					ld.Amount = -ld.Amount
+				case 3:
+					ld.BlockHash = empty
+				case 4:
+					ld.PkScript = nil
+					ld.ReconstructablePkType = PkType(1 + rnd.Intn(4))
+				}
+				leaves = append(leaves, ld)
+			}
+		}
+
+		return leaves
+	}
+
+	schemes := []LeafCommitment{LeafCommitmentV0, LeafCommitmentTaggedV1}
+	for _, maxMidstates := range []int{0, 1, 3, DefaultLeafMidstates} {
+		h := NewLeafHasher(maxMidstates)
+		leaves := randLeaves(5000)
+
+		// Hash every leaf twice so that the second time the hash state
+		// of its prefix may be kept.
+		for pass := 0; pass < 2; pass++ {
+			for i := range leaves {
+				ld := &leaves[i]
+				for _, scheme := range schemes {
+					want := ld.CommitmentHash(scheme)
+					got := h.CommitmentHash(ld, scheme)
+					if got != want {
+						t.Fatalf("max %d midstates: %v hash of "+
+							"%s is %x, want %x", maxMidstates,
+							scheme, ld.ToString(), got, want)
+					}
+				}
+			}
+		}
+
+		stats := h.Stats()
+		if stats.Midstates > maxMidstates || stats.MaxMidstates != maxMidstates {
+			t.Fatalf("kept %d midstates of at most %d", stats.Midstates,
+				stats.MaxMidstates)
+		}
+		if stats.TemplateHits() == 0 || stats.Fallbacks == 0 ||
+			(maxMidstates > 0) != (stats.MidstateHits != 0) {
+
+			t.Fatalf("max %d midstates: stats %+v", maxMidstates, stats)
+		}
+		total := stats.TemplateHits() + stats.Fallbacks
+		if total != uint64(2*len(leaves)*len(schemes)) {
+			t.Fatalf("counted %d leaves, want %d", total,
+				2*len(leaves)*len(schemes))
+		}
+	}
+
+	// A nil hasher hashes the same without counting anything.
+	var unkept *LeafHasher
+	for _, ld := range randLeaves(1000) {
+		for _, scheme := range schemes {
+			want := ld.CommitmentHash(scheme)
+			got := unkept.CommitmentHash(&ld, scheme)
+			if got != want {
+				t.Fatalf("nil hasher: %v hash of %s is %x, want %x",
+					scheme, ld.ToString(), got, want)
+			}
+		}
+	}
+	if stats := unkept.Stats(); stats.TemplateHits() != 0 ||
+		stats.Fallbacks != 0 {
+
+		t.Fatalf("nil hasher: stats %+v", stats)
+	}
+
+	// Hash concurrently with a few hash states so they're evicted while
+	// they're used.
+	h := NewLeafHasher(4)
+	leaves := randLeaves(2000)
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(leaves); i += 2 {
+				ld := &leaves[i]
+				want := ld.CommitmentHash(LeafCommitmentTaggedV1)
+				got := h.CommitmentHash(ld, LeafCommitmentTaggedV1)
+				if got != want {
+					errs <- fmt.Errorf("hash of %s is %x, want %x",
+						ld.ToString(), got, want)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// TestLeafHasherMidstatesPersist ensures that the hash states saved by a
+// LeafHasher are restored by another one, newest first if it keeps fewer, that
+// the leaves hashed with them are bit-identical to the full hashing, and that
+// corrupt states aren't restored.
+func TestLeafHasherMidstatesPersist(t *testing.T) {
+	t.Parallel()
+
+	leaves := templateBlockLeaves()[:200]
+	saved := NewLeafHasher(8)
+	for i := range leaves {
+		saved.CommitmentHash(&leaves[i], LeafCommitmentTaggedV1)
+	}
+	var buf bytes.Buffer
+	if err := saved.SaveMidstates(&buf); err != nil {
+		t.Fatalf("unable to save the midstates: %v", err)
+	}
+	serialized := buf.Bytes()
+
+	// The hasher that keeps fewer hash states only restores the ones of
+	// the transactions hashed last.  The leaves have 20 outputs a
+	// transaction.
+	for _, maxMidstates := range []int{8, 4} {
+		h := NewLeafHasher(maxMidstates)
+		err := h.LoadMidstates(bytes.NewReader(serialized))
+		if err != nil {
+			t.Fatalf("unable to load the midstates: %v", err)
+		}
+		if got := h.Stats().Midstates; got != maxMidstates {
+			t.Fatalf("restored %d midstates, want %d", got,
+				maxMidstates)
+		}
+
+		restored := len(leaves) - maxMidstates*20
+		for i := len(leaves) - 1; i >= 0; i-- {
+			ld := &leaves[i]
+			want := ld.CommitmentHash(LeafCommitmentTaggedV1)
+			got := h.CommitmentHash(ld, LeafCommitmentTaggedV1)
+			if got != want {
+				t.Fatalf("hash of %s is %x, want %x",
+					ld.ToString(), got, want)
+			}
+			if i == restored {
+				stats := h.Stats()
+				if stats.MidstateMisses != 0 {
+					t.Fatalf("%d misses hashing the leaves "+
+						"of the restored midstates",
+						stats.MidstateMisses)
+				}
+			}
+		}
+	}
+
+	// A hasher keeps what it has if the states are corrupt.
+	h := NewLeafHasher(8)
+	h.CommitmentHash(&leaves[0], LeafCommitmentTaggedV1)
+	for _, corrupt := range [][]byte{
+		serialized[:len(serialized)-1],
+		append(append([]byte(nil), serialized[:10]...), serialized[11:]...),
+		func() []byte {
+			c := append([]byte(nil), serialized...)
+			c[100] ^= 0x01
+			return c
+		}(),
+		nil,
+	} {
+		err := h.LoadMidstates(bytes.NewReader(corrupt))
+		if err == nil {
+			t.Fatal("expected an error for corrupt midstates")
+		}
+		if got := h.Stats().Midstates; got != 1 {
+			t.Fatalf("kept %d midstates after failing to load, "+
+				"want 1", got)
+		}
+	}
+}
+
+// templateBlockLeaves returns the leaves of a synthetic block dominated by the
+// outputs of templates like the ones of an exchange sweeping its deposits.
+func templateBlockLeaves() []LeafData {
+	rnd := rand.New(rand.NewSource(245))
+	var blockHash [32]byte
+	rnd.Read(blockHash[:])
+
+	leaves := make([]LeafData, 0, 4000)
+	for len(leaves) < cap(leaves) {
+		var tx LeafData
+		tx.BlockHash = blockHash
+		rnd.Read(tx.OutPoint.Hash[:])
+		tx.Height = 800000
+		for i := 0; i < 20; i++ {
+			ld := tx
+			ld.OutPoint.Index = uint32(i)
+			ld.Amount = rnd.Int63n(1e8)
+			template := LeafTemplateP2WPKH
+			switch {
+			case i == 19:
+				// A few of the outputs don't match a template.
+				ld.PkScript = make([]byte, 71)
+				rnd.Read(ld.PkScript)
+			case i%4 == 1:
+				template = LeafTemplateP2TR
+				fallthrough
+			default:
+				ld.PkScript = templateScript(rnd, template)
+			}
+			leaves = append(leaves, ld)
+		}
+	}
+
+	return leaves
+}
+
+// BenchmarkLeafHash benchmarks hashing the leaves of a synthetic block dominated
+// by the outputs of templates by serializing the whole leaf data and with a
+// LeafHasher under every scheme.
+func BenchmarkLeafHash(b *testing.B) {
+	leaves := templateBlockLeaves()
+	schemes := []LeafCommitment{LeafCommitmentV0, LeafCommitmentTaggedV1}
+	for _, scheme := range schemes {
+		b.Run(fmt.Sprintf("%v/full", scheme), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for j := range leaves {
+					leaves[j].CommitmentHash(scheme)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%v/template", scheme), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				h := NewLeafHasher(DefaultLeafMidstates)
+				for j := range leaves {
+					h.CommitmentHash(&leaves[j], scheme)
+				}
+			}
+		})
+	}
+}
@@ -58,6 +58,9 @@ const (
 	CmdCFHeaders    = "cfheaders"
 	CmdCFCheckpt    = "cfcheckpt"
 	CmdSendAddrV2   = "sendaddrv2"
+	CmdUtreexoCaps  = "utreexocaps"
+	CmdProofRanges  = "proofranges"
+	CmdNotReady     = "notready"
 )
 
 // MessageEncoding represents the wire message encoding format to be used.
@@ -107,6 +110,15 @@ func makeEmptyMessage(command string) (Message, error) {
 	case CmdSendAddrV2:
 		msg = &MsgSendAddrV2{}
 
+	case CmdUtreexoCaps:
+		msg = &MsgUtreexoCaps{}
+
+	case CmdProofRanges:
+		msg = &MsgProofRanges{}
+
+	case CmdNotReady:
+		msg = &MsgNotReady{}
+
 	case CmdGetAddr:
 		msg = &MsgGetAddr{}
 
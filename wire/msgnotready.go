@@ -0,0 +1,125 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+)
+
+// MsgNotReady implements the Message interface and represents a bitcoin
+// notready message.  It's sent in response to a getdata message for the
+// utreexo proofs of blocks that the peer doesn't have yet but that are likely
+// new blocks it hasn't heard of or connected yet.  Unlike notfound, it tells
+// the requesting peer that the peer isn't missing any data and that the blocks
+// along with their proofs will be sent without being asked for again once
+// they're connected.  The blocks that never arrive are answered with notfound
+// later on.
+//
+// This message was not added until protocol versions starting with
+// NotReadyVersion.
+type MsgNotReady struct {
+	InvList []*InvVect
+}
+
+// AddInvVect adds an inventory vector to the message.
+func (msg *MsgNotReady) AddInvVect(iv *InvVect) error {
+	if len(msg.InvList)+1 > MaxInvPerMsg {
+		str := fmt.Sprintf("too many invvect in message [max %v]",
+			MaxInvPerMsg)
+		return messageError("MsgNotReady.AddInvVect", str)
+	}
+
+	msg.InvList = append(msg.InvList, iv)
+	return nil
+}
+
+// BtcDecode decodes r using the bitcoin protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgNotReady) BtcDecode(r io.Reader, pver uint32, enc MessageEncoding) error {
+	if pver < NotReadyVersion {
+		str := fmt.Sprintf("notready message invalid for protocol "+
+			"version %d", pver)
+		return messageError("MsgNotReady.BtcDecode", str)
+	}
+
+	count, err := ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+
+	// Limit to max inventory vectors per message.
+	if count > MaxInvPerMsg {
+		str := fmt.Sprintf("too many invvect in message [%v]", count)
+		return messageError("MsgNotReady.BtcDecode", str)
+	}
+
+	// Create a contiguous slice of inventory vectors to deserialize into in
+	// order to reduce the number of allocations.
+	invList := make([]InvVect, count)
+	msg.InvList = make([]*InvVect, 0, count)
+	for i := uint64(0); i < count; i++ {
+		iv := &invList[i]
+		err := readInvVect(r, pver, iv)
+		if err != nil {
+			return err
+		}
+		msg.AddInvVect(iv)
+	}
+
+	return nil
+}
+
+// BtcEncode encodes the receiver to w using the bitcoin protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgNotReady) BtcEncode(w io.Writer, pver uint32, enc MessageEncoding) error {
+	if pver < NotReadyVersion {
+		str := fmt.Sprintf("notready message invalid for protocol "+
+			"version %d", pver)
+		return messageError("MsgNotReady.BtcEncode", str)
+	}
+
+	// Limit to max inventory vectors per message.
+	count := len(msg.InvList)
+	if count > MaxInvPerMsg {
+		str := fmt.Sprintf("too many invvect in message [%v]", count)
+		return messageError("MsgNotReady.BtcEncode", str)
+	}
+
+	err := WriteVarInt(w, pver, uint64(count))
+	if err != nil {
+		return err
+	}
+
+	for _, iv := range msg.InvList {
+		err := writeInvVect(w, pver, iv)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgNotReady) Command() string {
+	return CmdNotReady
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgNotReady) MaxPayloadLength(pver uint32) uint32 {
+	// Num inventory vectors (varInt) + max allowed inventory vectors.
+	return MaxVarIntPayload + (MaxInvPerMsg * maxInvVectPayload)
+}
+
+// NewMsgNotReady returns a new bitcoin notready message that conforms to the
+// Message interface.  See MsgNotReady for details.
+func NewMsgNotReady() *MsgNotReady {
+	return &MsgNotReady{
+		InvList: make([]*InvVect, 0, defaultInvListAlloc),
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+)
+
+// TestNotReadyWire tests the MsgNotReady wire encode and decode.
+func TestNotReadyWire(t *testing.T) {
+	hash := chainhash.Hash{0x01}
+	msg := NewMsgNotReady()
+	msg.AddInvVect(NewInvVect(InvTypeWitnessUtreexoBlock, &hash))
+
+	encoded := []byte{
+		0x01,                   // Num inv vectors
+		0x02, 0x00, 0x00, 0x41, // Type
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Hash
+	}
+
+	if cmd := msg.Command(); cmd != "notready" {
+		t.Errorf("wrong command - got %v want notready", cmd)
+	}
+	wantPayload := uint32(1800009)
+	if maxPayload := msg.MaxPayloadLength(ProtocolVersion); maxPayload != wantPayload {
+		t.Errorf("wrong max payload length - got %v, want %v",
+			maxPayload, wantPayload)
+	}
+
+	var buf bytes.Buffer
+	err := msg.BtcEncode(&buf, ProtocolVersion, BaseEncoding)
+	if err != nil {
+		t.Fatalf("BtcEncode error %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), encoded) {
+		t.Fatalf("BtcEncode\n got: %s want: %s",
+			spew.Sdump(buf.Bytes()), spew.Sdump(encoded))
+	}
+
+	var readMsg MsgNotReady
+	err = readMsg.BtcDecode(bytes.NewReader(encoded), ProtocolVersion, BaseEncoding)
+	if err != nil {
+		t.Fatalf("BtcDecode error %v", err)
+	}
+	if !reflect.DeepEqual(readMsg.InvList, msg.InvList) {
+		t.Fatalf("BtcDecode\n got: %s want: %s", spew.Sdump(&readMsg),
+			spew.Sdump(msg))
+	}
+
+	// The message isn't valid before the version that added it.
+	pver := NotReadyVersion - 1
+	if err := msg.BtcEncode(&buf, pver, BaseEncoding); err == nil {
+		t.Errorf("expected an encode error for protocol version %d", pver)
+	}
+	err = readMsg.BtcDecode(bytes.NewReader(encoded), pver, BaseEncoding)
+	if err == nil {
+		t.Errorf("expected a decode error for protocol version %d", pver)
+	}
+
+	// Too many inventory vectors are refused both ways.
+	for i := 0; i < MaxInvPerMsg; i++ {
+		err = msg.AddInvVect(msg.InvList[0])
+	}
+	if err == nil {
+		t.Error("expected an error adding too many inventory vectors")
+	}
+	msg.InvList = make([]*InvVect, MaxInvPerMsg+1)
+	if err := msg.BtcEncode(&buf, ProtocolVersion, BaseEncoding); err == nil {
+		t.Error("expected an encode error for too many inventory vectors")
+	}
+	tooMany := []byte{0xfe, 0x51, 0xc3, 0x00, 0x00} // Num inv vectors of 50001
+	err = readMsg.BtcDecode(bytes.NewReader(tooMany), ProtocolVersion, BaseEncoding)
+	if err == nil {
+		t.Error("expected a decode error for too many inventory vectors")
+	}
+}
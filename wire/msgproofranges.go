@@ -0,0 +1,136 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+)
+
+// MaxProofRanges is the maximum number of height ranges that can be in a
+// single bitcoin proofranges message.
+const MaxProofRanges = 1000
+
+// ProofRange is an inclusive range of block heights.
+type ProofRange struct {
+	Start int32
+	End   int32
+}
+
+// MsgProofRanges implements the Message interface and represents a bitcoin
+// proofranges message.  It's sent by a peer that serves utreexo proofs after
+// the utreexocaps message to describe exactly which block heights it serves
+// the proofs for so that the receiving peer can avoid asking it for the ones
+// it can't serve.  It's sent again whenever the ranges change other than by
+// the tip moving.
+//
+// This message was not added until protocol versions starting with
+// ProofRangesVersion.
+type MsgProofRanges struct {
+	// Ranges are the ranges of block heights that the utreexo proofs are
+	// served for in ascending order.
+	Ranges []ProofRange
+
+	// FollowsTip is whether the last range grows along with the chain
+	// tip of the peer.
+	FollowsTip bool
+}
+
+// Serves returns whether the proofs for the block at the given height are
+// served.  The last range is taken to end at the given tip height if it
+// follows the tip.
+func (msg *MsgProofRanges) Serves(height, tip int32) bool {
+	for i, r := range msg.Ranges {
+		end := r.End
+		if msg.FollowsTip && i == len(msg.Ranges)-1 && tip > end {
+			end = tip
+		}
+		if height >= r.Start && height <= end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BtcDecode decodes r using the bitcoin protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgProofRanges) BtcDecode(r io.Reader, pver uint32, enc MessageEncoding) error {
+	if pver < ProofRangesVersion {
+		str := fmt.Sprintf("proofranges message invalid for protocol "+
+			"version %d", pver)
+		return messageError("MsgProofRanges.BtcDecode", str)
+	}
+
+	count, err := ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	if count > MaxProofRanges {
+		str := fmt.Sprintf("too many ranges for message "+
+			"[count %v, max %v]", count, MaxProofRanges)
+		return messageError("MsgProofRanges.BtcDecode", str)
+	}
+
+	msg.Ranges = make([]ProofRange, count)
+	for i := range msg.Ranges {
+		err := readElements(r, &msg.Ranges[i].Start, &msg.Ranges[i].End)
+		if err != nil {
+			return err
+		}
+	}
+
+	return readElement(r, &msg.FollowsTip)
+}
+
+// BtcEncode encodes the receiver to w using the bitcoin protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgProofRanges) BtcEncode(w io.Writer, pver uint32, enc MessageEncoding) error {
+	if pver < ProofRangesVersion {
+		str := fmt.Sprintf("proofranges message invalid for protocol "+
+			"version %d", pver)
+		return messageError("MsgProofRanges.BtcEncode", str)
+	}
+
+	count := len(msg.Ranges)
+	if count > MaxProofRanges {
+		str := fmt.Sprintf("too many ranges for message "+
+			"[count %v, max %v]", count, MaxProofRanges)
+		return messageError("MsgProofRanges.BtcEncode", str)
+	}
+
+	err := WriteVarInt(w, pver, uint64(count))
+	if err != nil {
+		return err
+	}
+	for _, r := range msg.Ranges {
+		err := writeElements(w, r.Start, r.End)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeElement(w, msg.FollowsTip)
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgProofRanges) Command() string {
+	return CmdProofRanges
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgProofRanges) MaxPayloadLength(pver uint32) uint32 {
+	// Num ranges (varInt) + max allowed ranges of 8 bytes each + follows
+	// tip 1 byte.
+	return MaxVarIntPayload + MaxProofRanges*8 + 1
+}
+
+// NewMsgProofRanges returns a new bitcoin proofranges message that conforms to
+// the Message interface.  See MsgProofRanges for details.
+func NewMsgProofRanges() *MsgProofRanges {
+	return &MsgProofRanges{}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+// TestProofRangesWire tests the MsgProofRanges wire encode and decode.
+func TestProofRangesWire(t *testing.T) {
+	msg := NewMsgProofRanges()
+	msg.Ranges = []ProofRange{{0, 0x10}, {0x20, 0x1234}}
+	msg.FollowsTip = true
+
+	encoded := []byte{
+		0x02,                   // Num ranges
+		0x00, 0x00, 0x00, 0x00, // Start
+		0x10, 0x00, 0x00, 0x00, // End
+		0x20, 0x00, 0x00, 0x00, // Start
+		0x34, 0x12, 0x00, 0x00, // End
+		0x01, // Follows tip
+	}
+
+	if cmd := msg.Command(); cmd != "proofranges" {
+		t.Errorf("wrong command - got %v want proofranges", cmd)
+	}
+	wantPayload := uint32(MaxVarIntPayload + MaxProofRanges*8 + 1)
+	if maxPayload := msg.MaxPayloadLength(ProtocolVersion); maxPayload != wantPayload {
+		t.Errorf("wrong max payload length - got %v, want %v",
+			maxPayload, wantPayload)
+	}
+
+	var buf bytes.Buffer
+	err := msg.BtcEncode(&buf, ProtocolVersion, BaseEncoding)
+	if err != nil {
+		t.Fatalf("BtcEncode error %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), encoded) {
+		t.Fatalf("BtcEncode\n got: %s want: %s",
+			spew.Sdump(buf.Bytes()), spew.Sdump(encoded))
+	}
+
+	var readMsg MsgProofRanges
+	err = readMsg.BtcDecode(bytes.NewReader(encoded), ProtocolVersion, BaseEncoding)
+	if err != nil {
+		t.Fatalf("BtcDecode error %v", err)
+	}
+	if !reflect.DeepEqual(&readMsg, msg) {
+		t.Fatalf("BtcDecode\n got: %s want: %s", spew.Sdump(&readMsg),
+			spew.Sdump(msg))
+	}
+
+	// The message isn't valid before the version that added it.
+	pver := ProofRangesVersion - 1
+	if err := msg.BtcEncode(&buf, pver, BaseEncoding); err == nil {
+		t.Errorf("expected an encode error for protocol version %d", pver)
+	}
+	err = readMsg.BtcDecode(bytes.NewReader(encoded), pver, BaseEncoding)
+	if err == nil {
+		t.Errorf("expected a decode error for protocol version %d", pver)
+	}
+
+	// Too many ranges are refused both ways.
+	msg.Ranges = make([]ProofRange, MaxProofRanges+1)
+	if err := msg.BtcEncode(&buf, ProtocolVersion, BaseEncoding); err == nil {
+		t.Error("expected an encode error for too many ranges")
+	}
+	tooMany := []byte{0xfd, 0xe9, 0x03} // Num ranges of 1001
+	err = readMsg.BtcDecode(bytes.NewReader(tooMany), ProtocolVersion, BaseEncoding)
+	if err == nil {
+		t.Error("expected a decode error for too many ranges")
+	}
+}
+
+// TestProofRangesServes ensures that only the heights within the ranges are
+// served and that the last range grows with the tip when it follows it.
+func TestProofRangesServes(t *testing.T) {
+	msg := &MsgProofRanges{Ranges: []ProofRange{{0, 10}, {20, 30}}}
+	tests := []struct {
+		height     int32
+		followsTip bool
+		want       bool
+	}{
+		{0, false, true},
+		{10, false, true},
+		{11, false, false},
+		{19, false, false},
+		{25, false, true},
+		{31, false, false},
+		{31, true, true},
+		{40, true, true},
+		{41, true, false},
+		{15, true, false},
+	}
+	for _, test := range tests {
+		msg.FollowsTip = test.followsTip
+		if got := msg.Serves(test.height, 40); got != test.want {
+			t.Errorf("Serves(%d) with follows tip %v: got %v, want %v",
+				test.height, test.followsTip, got, test.want)
+		}
+	}
+
+	// Nothing is served without any ranges.
+	empty := &MsgProofRanges{FollowsTip: true}
+	if empty.Serves(0, 40) {
+		t.Error("expected nothing to be served without any ranges")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// UtreexoProofFormat identifies the formats of utreexo proofs that a peer is
+// able to serve.
+type UtreexoProofFormat uint32
+
+const (
+	// UPFBlockProof is a flag used to indicate a peer serves the utreexo
+	// data for every block along with the accumulator proof.
+	UPFBlockProof UtreexoProofFormat = 1 << iota
+
+	// UPFMultiBlockProof is a flag used to indicate a peer serves a single
+	// accumulator proof for multiple blocks at every multi-block proof
+	// interval.  The utreexo data for each block is served without the
+	// accumulator proof.
+	UPFMultiBlockProof
+)
+
+// Map of utreexo proof formats back to their names for pretty printing.
+var upfStrings = map[UtreexoProofFormat]string{
+	UPFBlockProof:      "blockproof",
+	UPFMultiBlockProof: "multiblockproof",
+}
+
+// orderedUPFStrings is an ordered list of utreexo proof formats from lowest to
+// highest.
+var orderedUPFStrings = []UtreexoProofFormat{
+	UPFBlockProof,
+	UPFMultiBlockProof,
+}
+
+// Strings returns the names of the formats that are set.
+func (f UtreexoProofFormat) Strings() []string {
+	var names []string
+	for _, flag := range orderedUPFStrings {
+		if f&flag == flag {
+			names = append(names, upfStrings[flag])
+			f -= flag
+		}
+	}
+
+	// Add any remaining flags which aren't accounted for as hex.
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(f)))
+	}
+
+	return names
+}
+
+// String returns the UtreexoProofFormat in human-readable form.
+func (f UtreexoProofFormat) String() string {
+	names := f.Strings()
+	if len(names) == 0 {
+		return "0x0"
+	}
+
+	return strings.Join(names, "|")
+}
+
+// AccumulatorHash identifies the hash function used by the utreexo accumulator.
+type AccumulatorHash uint32
+
+const (
+	// AccHashSHA512_256 is the SHA-512/256 hash function.
+	AccHashSHA512_256 AccumulatorHash = iota
+)
+
+// String returns the AccumulatorHash in human-readable form.
+func (h AccumulatorHash) String() string {
+	switch h {
+	case AccHashSHA512_256:
+		return "sha512_256"
+	default:
+		return fmt.Sprintf("unknown AccumulatorHash (%d)", uint32(h))
+	}
+}
+
+// MsgUtreexoCaps implements the Message interface and represents a bitcoin
+// utreexocaps message.  It's sent by a peer that serves utreexo proofs right
+// after the version handshake to describe everything that it serves so that
+// the receiving peer can make its routing and format decisions up front.
+//
+// This message was not added until protocol versions starting with
+// UtreexoCapsVersion.
+type MsgUtreexoCaps struct {
+	// LowHeight and HighHeight are the range of block heights that the
+	// utreexo proofs are served for.
+	LowHeight  int32
+	HighHeight int32
+
+	// Formats are the utreexo proof formats that are served.
+	Formats UtreexoProofFormat
+
+	// MultiBlockInterval is the interval of the multi-block proofs.  It's
+	// 0 if multi-block proofs aren't served.
+	MultiBlockInterval int32
+
+	// OnDemand is whether proofs for arbitrary utxos are generated on
+	// demand.
+	OnDemand bool
+
+	// MaxResponseSize is the maximum size in bytes of a single response.
+	MaxResponseSize uint64
+
+	// HashFunction is the hash function used by the accumulator.
+	HashFunction AccumulatorHash
+}
+
+// BtcDecode decodes r using the bitcoin protocol encoding into the receiver.
+// This is part of the Message interface implementation.
+func (msg *MsgUtreexoCaps) BtcDecode(r io.Reader, pver uint32, enc MessageEncoding) error {
+	if pver < UtreexoCapsVersion {
+		str := fmt.Sprintf("utreexocaps message invalid for protocol "+
+			"version %d", pver)
+		return messageError("MsgUtreexoCaps.BtcDecode", str)
+	}
+
+	var formats, hashFunction uint32
+	err := readElements(r, &msg.LowHeight, &msg.HighHeight, &formats,
+		&msg.MultiBlockInterval, &msg.OnDemand, &msg.MaxResponseSize,
+		&hashFunction)
+	if err != nil {
+		return err
+	}
+	msg.Formats = UtreexoProofFormat(formats)
+	msg.HashFunction = AccumulatorHash(hashFunction)
+
+	return nil
+}
+
+// BtcEncode encodes the receiver to w using the bitcoin protocol encoding.
+// This is part of the Message interface implementation.
+func (msg *MsgUtreexoCaps) BtcEncode(w io.Writer, pver uint32, enc MessageEncoding) error {
+	if pver < UtreexoCapsVersion {
+		str := fmt.Sprintf("utreexocaps message invalid for protocol "+
+			"version %d", pver)
+		return messageError("MsgUtreexoCaps.BtcEncode", str)
+	}
+
+	return writeElements(w, msg.LowHeight, msg.HighHeight,
+		uint32(msg.Formats), msg.MultiBlockInterval, msg.OnDemand,
+		msg.MaxResponseSize, uint32(msg.HashFunction))
+}
+
+// Command returns the protocol command string for the message.  This is part
+// of the Message interface implementation.
+func (msg *MsgUtreexoCaps) Command() string {
+	return CmdUtreexoCaps
+}
+
+// MaxPayloadLength returns the maximum length the payload can be for the
+// receiver.  This is part of the Message interface implementation.
+func (msg *MsgUtreexoCaps) MaxPayloadLength(pver uint32) uint32 {
+	// Low height 4 bytes + high height 4 bytes + formats 4 bytes +
+	// multi-block interval 4 bytes + on demand 1 byte + max response size
+	// 8 bytes + hash function 4 bytes.
+	return 29
+}
+
+// NewMsgUtreexoCaps returns a new bitcoin utreexocaps message that conforms to
+// the Message interface.  See MsgUtreexoCaps for details.
+func NewMsgUtreexoCaps() *MsgUtreexoCaps {
+	return &MsgUtreexoCaps{}
+}
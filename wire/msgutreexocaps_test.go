@@ -0,0 +1,91 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+// TestUtreexoCapsWire tests the MsgUtreexoCaps wire encode and decode.
+func TestUtreexoCapsWire(t *testing.T) {
+	msg := NewMsgUtreexoCaps()
+	msg.LowHeight = 0
+	msg.HighHeight = 0x1234
+	msg.Formats = UPFBlockProof | UPFMultiBlockProof
+	msg.MultiBlockInterval = 10
+	msg.OnDemand = true
+	msg.MaxResponseSize = 0x100000
+	msg.HashFunction = AccHashSHA512_256
+
+	encoded := []byte{
+		0x00, 0x00, 0x00, 0x00, // Low height
+		0x34, 0x12, 0x00, 0x00, // High height
+		0x03, 0x00, 0x00, 0x00, // Formats
+		0x0a, 0x00, 0x00, 0x00, // Multi-block interval
+		0x01,                                           // On demand
+		0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, // Max response size
+		0x00, 0x00, 0x00, 0x00, // Hash function
+	}
+
+	if cmd := msg.Command(); cmd != "utreexocaps" {
+		t.Errorf("wrong command - got %v want utreexocaps", cmd)
+	}
+	if maxPayload := msg.MaxPayloadLength(ProtocolVersion); maxPayload != uint32(len(encoded)) {
+		t.Errorf("wrong max payload length - got %v, want %v",
+			maxPayload, len(encoded))
+	}
+
+	var buf bytes.Buffer
+	err := msg.BtcEncode(&buf, ProtocolVersion, BaseEncoding)
+	if err != nil {
+		t.Fatalf("BtcEncode error %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), encoded) {
+		t.Fatalf("BtcEncode\n got: %s want: %s",
+			spew.Sdump(buf.Bytes()), spew.Sdump(encoded))
+	}
+
+	var readMsg MsgUtreexoCaps
+	err = readMsg.BtcDecode(bytes.NewReader(encoded), ProtocolVersion, BaseEncoding)
+	if err != nil {
+		t.Fatalf("BtcDecode error %v", err)
+	}
+	if !reflect.DeepEqual(&readMsg, msg) {
+		t.Fatalf("BtcDecode\n got: %s want: %s", spew.Sdump(&readMsg),
+			spew.Sdump(msg))
+	}
+
+	// The message isn't valid before the version that added it.
+	pver := UtreexoCapsVersion - 1
+	if err := msg.BtcEncode(&buf, pver, BaseEncoding); err == nil {
+		t.Errorf("expected an encode error for protocol version %d", pver)
+	}
+	err = readMsg.BtcDecode(bytes.NewReader(encoded), pver, BaseEncoding)
+	if err == nil {
+		t.Errorf("expected a decode error for protocol version %d", pver)
+	}
+}
+
+func TestUtreexoProofFormatStringer(t *testing.T) {
+	tests := []struct {
+		in   UtreexoProofFormat
+		want string
+	}{
+		{0, "0x0"},
+		{UPFBlockProof, "blockproof"},
+		{UPFMultiBlockProof, "multiblockproof"},
+		{UPFBlockProof | UPFMultiBlockProof, "blockproof|multiblockproof"},
+		{UPFBlockProof | 0x80, "blockproof|0x80"},
+	}
+	for _, test := range tests {
+		if got := test.in.String(); got != test.want {
+			t.Errorf("String: got %s, want %s", got, test.want)
+		}
+	}
+}
@@ -14,10 +14,11 @@ import (
 const (
 	// ProtocolVersion is the latest protocol version this package supports.
 	//
-	// NOTE ProtocolVersion set at 170013 for the moment to mark that it
-	// supports utreexo proof attached blocks.  This is experimental and is
+	// NOTE ProtocolVersion set at 170016 for the moment to mark that it
+	// supports utreexo proof attached blocks and the utreexocaps,
+	// proofranges, and notready messages.  This is experimental and is
 	// subject to change in the future.
-	ProtocolVersion uint32 = 170013
+	ProtocolVersion uint32 = 170016
 
 	// MultipleAddressVersion is the protocol version which added multiple
 	// addresses per message (pver >= MultipleAddressVersion).
@@ -55,6 +56,18 @@ const (
 	// FeeFilterVersion is the protocol version which added a new
 	// feefilter message.
 	FeeFilterVersion uint32 = 70013
+
+	// UtreexoCapsVersion is the protocol version which added a new
+	// utreexocaps message.
+	UtreexoCapsVersion uint32 = 170014
+
+	// ProofRangesVersion is the protocol version which added a new
+	// proofranges message.
+	ProofRangesVersion uint32 = 170015
+
+	// NotReadyVersion is the protocol version which added a new notready
+	// message.
+	NotReadyVersion uint32 = 170016
 )
 
 // ServiceFlag identifies services supported by a bitcoin peer.
@@ -170,6 +183,10 @@ const (
 
 	// SimNet represents the simulation test network.
 	SimNet BitcoinNet = 0x12141c16
+
+	// SigNet represents the default signet test network.  Custom signets
+	// have a network of their own derived from their challenge.
+	SigNet BitcoinNet = 0x40cf030a
 )
 
 // bnStrings is a map of bitcoin networks back to their constant names for
@@ -179,6 +196,7 @@ var bnStrings = map[BitcoinNet]string{
 	TestNet:  "TestNet",
 	TestNet3: "TestNet3",
 	SimNet:   "SimNet",
+	SigNet:   "SigNet",
 }
 
 // String returns the BitcoinNet in human-readable form.
@@ -27,16 +27,52 @@ type UData struct {
 }
 
 // StxosHashes returns the hash of all stxos in this UData.  The hashes returned
-// here represent the hash commitments of the stxos.
-func (ud *UData) StxoHashes() []accumulator.Hash {
+// here represent the hash commitments of the stxos with the schemes of the
+// given schedule.
+func (ud *UData) StxoHashes(schedule LeafCommitmentSchedule) []accumulator.Hash {
 	leafHashes := make([]accumulator.Hash, len(ud.LeafDatas))
 	for i, stxo := range ud.LeafDatas {
-		leafHashes[i] = stxo.LeafHash()
+		leafHashes[i] = stxo.ScheduledLeafHash(schedule)
 	}
 
 	return leafHashes
 }
 
+// Equal returns whether the two utreexo datas hold the same accumulator proof,
+// leaf datas, and remember indexes.  Nil and empty slices are equal.
+func (ud *UData) Equal(other *UData) bool {
+	if len(ud.AccProof.Targets) != len(other.AccProof.Targets) ||
+		len(ud.AccProof.Proof) != len(other.AccProof.Proof) ||
+		len(ud.LeafDatas) != len(other.LeafDatas) ||
+		len(ud.RememberIdx) != len(other.RememberIdx) {
+
+		return false
+	}
+
+	for i := range ud.AccProof.Targets {
+		if ud.AccProof.Targets[i] != other.AccProof.Targets[i] {
+			return false
+		}
+	}
+	for i := range ud.AccProof.Proof {
+		if ud.AccProof.Proof[i] != other.AccProof.Proof[i] {
+			return false
+		}
+	}
+	for i := range ud.LeafDatas {
+		if !ud.LeafDatas[i].Equal(&other.LeafDatas[i]) {
+			return false
+		}
+	}
+	for i := range ud.RememberIdx {
+		if ud.RememberIdx[i] != other.RememberIdx[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 // SerializeUtxoDataSize returns the number of bytes it would take to serialize the
 // utxo data size.
 func (ud *UData) SerializeUtxoDataSize() int {
@@ -380,6 +416,78 @@ func (ud *UData) DeserializeCompactNoAccProof(r io.Reader) error {
 	return nil
 }
 
+// ForEachLeafDataCompact decodes the leaf datas of the compactly serialized
+// utreexo data of a block from r one at a time and calls fn with each of them.
+// The remember indexes and the accumulator proof are skipped over without being
+// kept so that the whole utreexo data is never held in memory.  noAccProof must
+// be true if the utreexo data was serialized without the accumulator proof.
+//
+// NOTE: the leaf data passed to fn is reused for the next leaf data so fn must
+// copy anything it keeps.  Decoding stops at the first error returned by fn.
+func ForEachLeafDataCompact(r io.Reader, noAccProof bool,
+	fn func(ld *LeafData) error) error {
+
+	if !noAccProof {
+		rememberCount, err := ReadVarInt(r, 0)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < rememberCount; i++ {
+			_, err := ReadVarInt(r, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	targetCount, err := ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < targetCount; i++ {
+		_, err := ReadVarInt(r, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !noAccProof {
+		proofCount, err := ReadVarInt(r, 0)
+		if err != nil {
+			return err
+		}
+		var hash [32]byte
+		for i := uint64(0); i < proofCount; i++ {
+			_, err := io.ReadFull(r, hash[:])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	udCount, err := ReadVarInt(r, 0)
+	if err != nil {
+		return err
+	}
+	var ld LeafData
+	for i := uint64(0); i < udCount; i++ {
+		ld = LeafData{}
+		err := ld.DeserializeCompact(r, false)
+		if err != nil {
+			str := fmt.Sprintf("targetCount:%d, LeafDatas[%d], err:%s\n",
+				targetCount, i, err.Error())
+			return messageError("Deserialize leaf datas", str)
+		}
+
+		err = fn(&ld)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // SerializeRemembersSize returns how many bytes it would take to serialize
 // all the remember indexes.
 func SerializeRemembersSize(remembers []uint32) int {
@@ -431,33 +539,47 @@ func DeserializeRemembers(r io.Reader) ([]uint32, error) {
 // GenerateUData creates a block proof, calling forest.ProveBatch with the leaf indexes
 // to get a batched inclusion proof from the accumulator. It then adds on the leaf data,
 // to create a block proof which both proves inclusion and gives all utxo data
-// needed for transaction verification.
-func GenerateUData(txIns []LeafData, forest *accumulator.Forest) (
-	*UData, error) {
-
-	ud := new(UData)
-	ud.LeafDatas = txIns
+// needed for transaction verification.  The leaves are hashed with the schemes
+// of the given leaf commitment schedule.
+func GenerateUData(txIns []LeafData, forest *accumulator.Forest,
+	schedule LeafCommitmentSchedule) (*UData, error) {
 
 	// make slice of hashes from leafdata
-	var unconfirmedCount int
-	delHashes := make([]accumulator.Hash, 0, len(ud.LeafDatas))
-	for _, ld := range ud.LeafDatas {
+	delHashes := make([]accumulator.Hash, 0, len(txIns))
+	for _, ld := range txIns {
 		if ld.IsUnconfirmed() {
-			unconfirmedCount++
 			continue
 		}
-		delHashes = append(delHashes, ld.LeafHash())
+		delHashes = append(delHashes, ld.ScheduledLeafHash(schedule))
 	}
 
+	return GenerateUDataFromHashes(txIns, delHashes, forest)
+}
+
+// GenerateUDataFromHashes is GenerateUData for leaf datas that were already
+// hashed.  delHashes are the leaf hashes of the confirmed leaf datas in the
+// order of the leaf datas.
+func GenerateUDataFromHashes(txIns []LeafData, delHashes []accumulator.Hash,
+	forest *accumulator.Forest) (*UData, error) {
+
+	ud := new(UData)
+	ud.LeafDatas = txIns
+
 	// Generate the utreexo accumulator proof for all the inputs.
 	var err error
 	ud.AccProof, err = forest.ProveBatch(delHashes)
 	if err != nil {
 		// Find out which exact one is causing the error.
+		confirmed := make([]LeafData, 0, len(delHashes))
+		for _, ld := range ud.LeafDatas {
+			if !ld.IsUnconfirmed() {
+				confirmed = append(confirmed, ld)
+			}
+		}
 		for i, delHash := range delHashes {
 			_, err = forest.ProveBatch([]accumulator.Hash{delHash})
 			if err != nil {
-				ld := ud.LeafDatas[i]
+				ld := confirmed[i]
 				return nil,
 					fmt.Errorf("LeafData hash %s couldn't be proven. "+
 						"BlockHash %s, Outpoint %s, height %v, "+
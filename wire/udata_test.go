@@ -243,7 +243,7 @@ func TestUDataSerializeSize(t *testing.T) {
 		forest.Modify(addHashes, nil)
 
 		// Generate Proof.
-		ud, err := GenerateUData(testData.leavesPerBlock, forest)
+		ud, err := GenerateUData(testData.leavesPerBlock, forest, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -393,7 +393,7 @@ func TestUDataSerialize(t *testing.T) {
 		forest.Modify(addHashes, nil)
 
 		// Generate Proof.
-		ud, err := GenerateUData(testData.leavesPerBlock, forest)
+		ud, err := GenerateUData(testData.leavesPerBlock, forest, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -465,7 +465,7 @@ func TestUDataSerializeCompact(t *testing.T) {
 		forest.Modify(addHashes, nil)
 
 		// Generate Proof.
-		ud, err := GenerateUData(testData.leavesPerBlock, forest)
+		ud, err := GenerateUData(testData.leavesPerBlock, forest, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -555,7 +555,7 @@ func TestSerializeNoAccProof(t *testing.T) {
 		forest.Modify(addHashes, nil)
 
 		// Generate Proof.
-		ud, err := GenerateUData(testData.leavesPerBlock, forest)
+		ud, err := GenerateUData(testData.leavesPerBlock, forest, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -604,6 +604,84 @@ func TestSerializeNoAccProof(t *testing.T) {
 	}
 }
 
+// TestForEachLeafDataCompact ensures that the leaf datas decoded one at a time
+// are the ones that the whole utreexo data is decoded with, both with and
+// without the accumulator proof.
+func TestForEachLeafDataCompact(t *testing.T) {
+	t.Parallel()
+
+	for _, testData := range getTestDatas() {
+		forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+		addHashes := make([]accumulator.Leaf, 0, len(testData.leavesPerBlock))
+		for i, ld := range testData.leavesPerBlock {
+			addHashes = append(addHashes, accumulator.Leaf{
+				Hash:     ld.LeafHash(),
+				Remember: i%2 == 0,
+			})
+		}
+		forest.Modify(addHashes, nil)
+		ud, err := GenerateUData(testData.leavesPerBlock, forest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, noAccProof := range []bool{false, true} {
+			var buf bytes.Buffer
+			want := new(UData)
+			if noAccProof {
+				err = ud.SerializeCompactNoAccProof(&buf)
+				if err == nil {
+					err = want.DeserializeCompactNoAccProof(
+						bytes.NewReader(buf.Bytes()))
+				}
+			} else {
+				err = ud.SerializeCompact(&buf, false)
+				if err == nil {
+					err = want.DeserializeCompact(
+						bytes.NewReader(buf.Bytes()), false, 0)
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []LeafData
+			r := bytes.NewReader(buf.Bytes())
+			err = ForEachLeafDataCompact(r, noAccProof, func(ld *LeafData) error {
+				got = append(got, *ld)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%s (no acc proof %v): %v", testData.name,
+					noAccProof, err)
+			}
+			if !reflect.DeepEqual(got, want.LeafDatas) {
+				t.Fatalf("%s (no acc proof %v): got leaf datas %v, "+
+					"want %v", testData.name, noAccProof, got,
+					want.LeafDatas)
+			}
+			if r.Len() != 0 {
+				t.Fatalf("%s (no acc proof %v): %d bytes left "+
+					"undecoded", testData.name, noAccProof, r.Len())
+			}
+
+			// Decoding stops at the first error of the callback.
+			calls := 0
+			errStop := fmt.Errorf("stop")
+			err = ForEachLeafDataCompact(bytes.NewReader(buf.Bytes()),
+				noAccProof, func(ld *LeafData) error {
+					calls++
+					return errStop
+				})
+			if len(want.LeafDatas) > 0 && (err != errStop || calls != 1) {
+				t.Fatalf("%s (no acc proof %v): expected decoding "+
+					"to stop, got %v after %d calls", testData.name,
+					noAccProof, err, calls)
+			}
+		}
+	}
+}
+
 func TestGenerateUData(t *testing.T) {
 	t.Parallel()
 
@@ -652,7 +730,7 @@ func TestGenerateUData(t *testing.T) {
 	delLeaves[0] = leafDatas[firstDelIdx]
 	delLeaves[1] = leafDatas[secondDelIdx]
 
-	ud, err := GenerateUData(delLeaves, forest)
+	ud, err := GenerateUData(delLeaves, forest, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -673,3 +751,51 @@ func TestGenerateUData(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUDataEqual(t *testing.T) {
+	t.Parallel()
+
+	newUData := func() *UData {
+		return &UData{
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{1, 5},
+				Proof:   []accumulator.Hash{{1}, {2}},
+			},
+			LeafDatas: append([]LeafData(nil),
+				mainNetBlock104773.leavesPerBlock...),
+			RememberIdx: []uint32{0},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(ud *UData)
+		equal  bool
+	}{
+		{"same", func(ud *UData) {}, true},
+		{"empty remembers", func(ud *UData) { ud.RememberIdx = nil }, false},
+		{"target", func(ud *UData) { ud.AccProof.Targets[1] = 6 }, false},
+		{"proof hash", func(ud *UData) { ud.AccProof.Proof[0][0] = 3 }, false},
+		{"missing leaf", func(ud *UData) { ud.LeafDatas = ud.LeafDatas[1:] }, false},
+		{"leaf amount", func(ud *UData) { ud.LeafDatas[0].Amount++ }, false},
+		{"leaf script", func(ud *UData) {
+			ud.LeafDatas[0].PkScript = append([]byte{0x51},
+				ud.LeafDatas[0].PkScript...)
+		}, false},
+	}
+
+	for _, test := range tests {
+		a, b := newUData(), newUData()
+		test.modify(b)
+		if a.Equal(b) != test.equal || b.Equal(a) != test.equal {
+			t.Errorf("%s: expected equal to be %v", test.name, test.equal)
+		}
+	}
+
+	// Nil and empty slices are equal.
+	a := &UData{RememberIdx: []uint32{}}
+	b := &UData{LeafDatas: []LeafData{}}
+	if !a.Equal(b) {
+		t.Error("expected nil and empty slices to be equal")
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/utreexo/utreexod/chaincfg/chainhash"
+)
+
+// -----------------------------------------------------------------------------
+// The JSON layout of UData is meant for debugging and for verifiers that aren't
+// written in Go.  The field names are stable and every field is always present.
+// It holds everything the UData does, so UData decoded from it serializes to
+// the exact same bytes as the UData it was encoded from.
+//
+// Hashes are hex strings in the byte order that hashes are displayed in, the
+// same as block hashes and txids.
+//
+// {
+//   "targets":     [<position of the leaf in the accumulator>, ...],
+//   "proofhashes": ["<hash of the accumulator proof>", ...],
+//   "leafdatas": [
+//     {
+//       "blockhash":  "<hash of the block that created the output>",
+//       "txid":       "<txid of the outpoint>",
+//       "vout":       <index of the outpoint>,
+//       "height":     <height of the block that created the output>,
+//       "iscoinbase": <whether the output was created by a coinbase>,
+//       "amount":     <value of the output in satoshis>,
+//       "pktype":     "<name of the reconstructable pkscript type>",
+//       "pkscript":   "<pkscript as hex>"
+//     }, ...
+//   ],
+//   "rememberidx": [<index of a created output to remember>, ...]
+// }
+//
+// PortableUData wraps the same layout with the height of the block the utreexo
+// data is for and the number of leaves in the accumulator it's proven against:
+//
+// {
+//   "height":    <height of the block>,
+//   "numleaves": <number of leaves in the accumulator before the block>,
+//   "udata":     {<utreexo data as above>}
+// }
+//
+// Fields that aren't part of the layout are ignored when decoding, so the
+// canonical JSON of btcjson, which adds the script type of each pkscript, may
+// be decoded as well.
+// -----------------------------------------------------------------------------
+
+// uDataJSON is the JSON layout of UData.
+type uDataJSON struct {
+	Targets     *[]uint64       `json:"targets"`
+	ProofHashes *[]string       `json:"proofhashes"`
+	LeafDatas   *[]leafDataJSON `json:"leafdatas"`
+	RememberIdx *[]uint32       `json:"rememberidx"`
+}
+
+// leafDataJSON is the JSON layout of a LeafData.
+type leafDataJSON struct {
+	BlockHash  *string `json:"blockhash"`
+	Txid       *string `json:"txid"`
+	Vout       *uint32 `json:"vout"`
+	Height     *int32  `json:"height"`
+	IsCoinBase *bool   `json:"iscoinbase"`
+	Amount     *int64  `json:"amount"`
+	PkType     *string `json:"pktype"`
+	PkScript   *string `json:"pkscript"`
+}
+
+// MarshalJSON encodes the UData into its JSON layout.
+//
+// This is part of the json.Marshaler interface implementation.
+func (ud *UData) MarshalJSON() ([]byte, error) {
+	targets := make([]uint64, len(ud.AccProof.Targets))
+	copy(targets, ud.AccProof.Targets)
+	proofHashes := make([]string, len(ud.AccProof.Proof))
+	for i, hash := range ud.AccProof.Proof {
+		proofHashes[i] = chainhash.Hash(hash).String()
+	}
+	leafDatas := make([]leafDataJSON, len(ud.LeafDatas))
+	for i := range ud.LeafDatas {
+		ld := &ud.LeafDatas[i]
+		blockHash := ld.BlockHash.String()
+		txid := ld.OutPoint.Hash.String()
+		pkType := ld.ReconstructablePkType.String()
+		pkScript := hex.EncodeToString(ld.PkScript)
+		leafDatas[i] = leafDataJSON{
+			BlockHash:  &blockHash,
+			Txid:       &txid,
+			Vout:       &ld.OutPoint.Index,
+			Height:     &ld.Height,
+			IsCoinBase: &ld.IsCoinBase,
+			Amount:     &ld.Amount,
+			PkType:     &pkType,
+			PkScript:   &pkScript,
+		}
+	}
+	rememberIdx := make([]uint32, len(ud.RememberIdx))
+	copy(rememberIdx, ud.RememberIdx)
+
+	return json.Marshal(uDataJSON{
+		Targets:     &targets,
+		ProofHashes: &proofHashes,
+		LeafDatas:   &leafDatas,
+		RememberIdx: &rememberIdx,
+	})
+}
+
+// decodeJSONHash decodes a hash displayed as a hex string of exactly the size of
+// a hash.
+func decodeJSONHash(field, str string) (chainhash.Hash, error) {
+	var hash chainhash.Hash
+	if len(str) != chainhash.MaxHashStringSize {
+		return hash, fmt.Errorf("%s %q is not a hash of %d hex "+
+			"characters", field, str, chainhash.MaxHashStringSize)
+	}
+	err := chainhash.Decode(&hash, str)
+	if err != nil {
+		return hash, fmt.Errorf("%s %q: %v", field, str, err)
+	}
+
+	return hash, nil
+}
+
+// pkTypeFromString returns the reconstructable pkscript type with the given
+// name.
+func pkTypeFromString(name string) (PkType, bool) {
+	for ty, tyName := range pkTypeToName {
+		if tyName == name {
+			return PkType(ty), true
+		}
+	}
+
+	return OtherTy, false
+}
+
+// UnmarshalJSON decodes the UData from its JSON layout.  An error is returned if
+// any of the fields of the layout is missing or if a value couldn't be
+// serialized.
+//
+// This is part of the json.Unmarshaler interface implementation.
+func (ud *UData) UnmarshalJSON(data []byte) error {
+	var raw uDataJSON
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	if raw.Targets == nil || raw.ProofHashes == nil ||
+		raw.LeafDatas == nil || raw.RememberIdx == nil {
+
+		return fmt.Errorf("utreexo data must have all of the " +
+			"targets, proofhashes, leafdatas, and rememberidx fields")
+	}
+
+	proof := make([]accumulator.Hash, len(*raw.ProofHashes))
+	for i, str := range *raw.ProofHashes {
+		hash, err := decodeJSONHash(fmt.Sprintf("proofhashes[%d]", i), str)
+		if err != nil {
+			return err
+		}
+		proof[i] = accumulator.Hash(hash)
+	}
+	leafDatas := make([]LeafData, len(*raw.LeafDatas))
+	for i := range *raw.LeafDatas {
+		err := (*raw.LeafDatas)[i].leafData(i, &leafDatas[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	ud.AccProof = accumulator.BatchProof{
+		Targets: *raw.Targets,
+		Proof:   proof,
+	}
+	ud.LeafDatas = leafDatas
+	ud.RememberIdx = *raw.RememberIdx
+
+	return nil
+}
+
+// leafData decodes the leaf data at the given index of the leaf datas into ld.
+func (l *leafDataJSON) leafData(i int, ld *LeafData) error {
+	field := func(name string) string {
+		return fmt.Sprintf("leafdatas[%d].%s", i, name)
+	}
+	if l.BlockHash == nil || l.Txid == nil || l.Vout == nil ||
+		l.Height == nil || l.IsCoinBase == nil || l.Amount == nil ||
+		l.PkType == nil || l.PkScript == nil {
+
+		return fmt.Errorf("leafdatas[%d] must have all of the "+
+			"blockhash, txid, vout, height, iscoinbase, amount, "+
+			"pktype, and pkscript fields", i)
+	}
+
+	blockHash, err := decodeJSONHash(field("blockhash"), *l.BlockHash)
+	if err != nil {
+		return err
+	}
+	txid, err := decodeJSONHash(field("txid"), *l.Txid)
+	if err != nil {
+		return err
+	}
+	pkType, ok := pkTypeFromString(*l.PkType)
+	if !ok {
+		return fmt.Errorf("%s %q is not a known type", field("pktype"),
+			*l.PkType)
+	}
+	pkScript, err := hex.DecodeString(*l.PkScript)
+	if err != nil {
+		return fmt.Errorf("%s: %v", field("pkscript"), err)
+	}
+	if len(pkScript) > MaxScriptSize {
+		return fmt.Errorf("%s of %d bytes is longer than the maximum "+
+			"of %d", field("pkscript"), len(pkScript), MaxScriptSize)
+	}
+
+	// Keep a nil pkscript nil so that the round trip is exact.
+	if len(pkScript) == 0 {
+		pkScript = nil
+	}
+
+	*ld = LeafData{
+		BlockHash: blockHash,
+		OutPoint: OutPoint{
+			Hash:  txid,
+			Index: *l.Vout,
+		},
+		Height:                *l.Height,
+		IsCoinBase:            *l.IsCoinBase,
+		Amount:                *l.Amount,
+		ReconstructablePkType: pkType,
+		PkScript:              pkScript,
+	}
+
+	return nil
+}
+
+// PortableUData is utreexo data along with the context needed to verify it
+// without a node: the height of the block it's for and the number of leaves in
+// the accumulator that its proof is made against, which is the accumulator
+// before the block.
+type PortableUData struct {
+	Height    int32
+	NumLeaves uint64
+	UData     *UData
+}
+
+// portableUDataJSON is the JSON layout of PortableUData.
+type portableUDataJSON struct {
+	Height    *int32  `json:"height"`
+	NumLeaves *uint64 `json:"numleaves"`
+	UData     *UData  `json:"udata"`
+}
+
+// MarshalJSON encodes the utreexo data and its context into their JSON layout.
+//
+// This is part of the json.Marshaler interface implementation.
+func (p *PortableUData) MarshalJSON() ([]byte, error) {
+	ud := p.UData
+	if ud == nil {
+		ud = &UData{}
+	}
+
+	return json.Marshal(portableUDataJSON{
+		Height:    &p.Height,
+		NumLeaves: &p.NumLeaves,
+		UData:     ud,
+	})
+}
+
+// UnmarshalJSON decodes the utreexo data and its context from their JSON
+// layout.
+//
+// This is part of the json.Unmarshaler interface implementation.
+func (p *PortableUData) UnmarshalJSON(data []byte) error {
+	var raw portableUDataJSON
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	if raw.Height == nil || raw.NumLeaves == nil || raw.UData == nil {
+		return fmt.Errorf("portable utreexo data must have all of the " +
+			"height, numleaves, and udata fields")
+	}
+
+	p.Height = *raw.Height
+	p.NumLeaves = *raw.NumLeaves
+	p.UData = raw.UData
+
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2022 The utreexo developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// TestUDataJSONLayout ensures that the JSON layout of UData is the documented
+// one.
+func TestUDataJSONLayout(t *testing.T) {
+	t.Parallel()
+
+	ud := &UData{
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{3},
+			Proof:   []accumulator.Hash{{0x01}},
+		},
+		LeafDatas: []LeafData{{
+			BlockHash:             *newHashFromStr("02"),
+			OutPoint:              OutPoint{Hash: *newHashFromStr("03"), Index: 1},
+			Height:                5,
+			IsCoinBase:            true,
+			Amount:                50,
+			ReconstructablePkType: PubKeyHashTy,
+			PkScript:              []byte{0x51},
+		}},
+		RememberIdx: []uint32{0},
+	}
+	want := `{"targets":[3],"proofhashes":["` + strings.Repeat("0", 62) +
+		`01"],"leafdatas":[{"blockhash":"` + strings.Repeat("0", 62) +
+		`02","txid":"` + strings.Repeat("0", 62) + `03","vout":1,` +
+		`"height":5,"iscoinbase":true,"amount":50,"pktype":"pubkeyhash",` +
+		`"pkscript":"51"}],"rememberidx":[0]}`
+
+	got, err := json.Marshal(ud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	// Empty utreexo data still has every field.
+	got, err = json.Marshal(&UData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"targets":[],"proofhashes":[],"leafdatas":[],"rememberidx":[]}`
+	if string(got) != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+// TestUDataJSONRoundTrip ensures that utreexo data decoded from its JSON layout
+// serializes to the same bytes as the utreexo data it was encoded from and
+// that the context of portable utreexo data is kept.
+func TestUDataJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, testData := range getTestDatas() {
+		forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+		adds := make([]accumulator.Leaf, 0, len(testData.leavesPerBlock))
+		for _, ld := range testData.leavesPerBlock {
+			adds = append(adds, accumulator.Leaf{Hash: ld.LeafHash()})
+		}
+		_, err := forest.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The leaves are copied since the other tests share them.
+		leaves := make([]LeafData, len(testData.leavesPerBlock))
+		copy(leaves, testData.leavesPerBlock)
+		leaves[0].ReconstructablePkType = PubKeyHashTy
+		ud, err := GenerateUData(leaves, forest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud.RememberIdx = testData.rememberIdx
+
+		var before bytes.Buffer
+		err = ud.Serialize(&before)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		portable := &PortableUData{
+			Height:    testData.height,
+			NumLeaves: uint64(len(adds)),
+			UData:     ud,
+		}
+		encoded, err := json.Marshal(portable)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded PortableUData
+		err = json.Unmarshal(encoded, &decoded)
+		if err != nil {
+			t.Fatalf("%s: %v", testData.name, err)
+		}
+		if decoded.Height != portable.Height ||
+			decoded.NumLeaves != portable.NumLeaves {
+
+			t.Fatalf("%s: got height %d and %d leaves, want %d and %d",
+				testData.name, decoded.Height, decoded.NumLeaves,
+				portable.Height, portable.NumLeaves)
+		}
+		if !decoded.UData.Equal(ud) {
+			t.Fatalf("%s: the decoded utreexo data differs",
+				testData.name)
+		}
+
+		var after bytes.Buffer
+		err = decoded.UData.Serialize(&after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before.Bytes(), after.Bytes()) {
+			t.Fatalf("%s: serialized to %x, want %x", testData.name,
+				after.Bytes(), before.Bytes())
+		}
+	}
+}
+
+// TestUDataJSONErrors ensures that JSON that doesn't hold valid utreexo data is
+// refused and that fields outside of the layout are ignored.
+func TestUDataJSONErrors(t *testing.T) {
+	t.Parallel()
+
+	hash := `"` + strings.Repeat("0", 63) + `1"`
+	leaf := func(pkType, pkScript string) string {
+		return `{"targets":[0],"proofhashes":[],"leafdatas":[{` +
+			`"blockhash":` + hash + `,"txid":` + hash + `,"vout":0,` +
+			`"height":1,"iscoinbase":false,"amount":1,` +
+			`"pktype":"` + pkType + `","pkscript":"` + pkScript + `"` +
+			`,"scripttype":"nonstandard"}],"rememberidx":[]}`
+	}
+
+	tests := []struct {
+		name string
+		json string
+		err  string
+	}{
+		{
+			name: "missing field",
+			json: `{"targets":[],"proofhashes":[],"leafdatas":[]}`,
+			err:  "must have all of the",
+		},
+		{
+			name: "short proof hash",
+			json: `{"targets":[],"proofhashes":["01"],"leafdatas":[],` +
+				`"rememberidx":[]}`,
+			err: "proofhashes[0]",
+		},
+		{
+			name: "missing leaf data field",
+			json: `{"targets":[],"proofhashes":[],"leafdatas":[{}],` +
+				`"rememberidx":[]}`,
+			err: "leafdatas[0] must have all of the",
+		},
+		{
+			name: "unknown pktype",
+			json: leaf("bare", "51"),
+			err:  "leafdatas[0].pktype",
+		},
+		{
+			name: "pkscript not hex",
+			json: leaf("other", "zz"),
+			err:  "leafdatas[0].pkscript",
+		},
+		{
+			name: "pkscript too long",
+			json: leaf("other", strings.Repeat("51", MaxScriptSize+1)),
+			err:  "longer than the maximum",
+		},
+		{
+			name: "valid with a script type",
+			json: leaf("other", "51"),
+		},
+	}
+
+	for _, test := range tests {
+		var ud UData
+		err := json.Unmarshal([]byte(test.json), &ud)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one with %q", test.name,
+				err, test.err)
+		}
+	}
+
+	var portable PortableUData
+	err := json.Unmarshal([]byte(`{"height":1,"numleaves":2}`), &portable)
+	if err == nil {
+		t.Fatal("expected portable utreexo data without udata to be " +
+			"refused")
+	}
+}